@@ -0,0 +1,136 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build amd64,!appengine
+
+package biosimd
+
+import (
+	"reflect"
+	"unsafe"
+
+	"golang.org/x/sys/cpu"
+)
+
+// These are the per-read transforms at the top of the pileup inner loop.
+// Reads are usually a few hundred bases long and CIGARs are usually a few
+// operations long, so the assembly only handles whole vectors, and the Go
+// wrappers finish the remainder.
+
+//go:noescape
+func cigarRefLenSSE41Asm(cigar unsafe.Pointer, nOp int) int
+
+//go:noescape
+func cigarRefLenAVX2Asm(cigar unsafe.Pointer, nOp int) int
+
+//go:noescape
+func maskLowQualSSE42Asm(seq8, qual unsafe.Pointer, nByte int, maxMaskedQual, maskCode byte) int
+
+//go:noescape
+func maskLowQualAVX2Asm(seq8, qual unsafe.Pointer, nByte int, maxMaskedQual, maskCode byte) int
+
+//go:noescape
+func countMismatchesSSE42Asm(seq8, ref unsafe.Pointer, nByte int, nCode byte) int
+
+//go:noescape
+func countMismatchesAVX2Asm(seq8, ref unsafe.Pointer, nByte int, nCode byte) int
+
+// useAVX2 is set when the 32-byte versions of the functions in this file can
+// be used.
+var useAVX2 = cpu.X86.HasAVX2
+
+// cigarConsumesRef is a bitset of the .bam CIGAR operation codes (M, D, N, =,
+// X) which consume the reference.
+const cigarConsumesRef = (1 << 0) | (1 << 2) | (1 << 3) | (1 << 7) | (1 << 8)
+
+// CigarRefLen returns the number of reference bases covered by cigar, where
+// each element is a .bam-format CIGAR operation (length << 4 | op code).  A
+// []sam.CigarOp can be passed by reinterpreting its backing array.
+func CigarRefLen(cigar []uint32) int {
+	nOp := len(cigar)
+	refLen := 0
+	nVecOp := 0
+	if useAVX2 && nOp >= 8 {
+		nVecOp = nOp &^ 7
+		cigarHeader := (*reflect.SliceHeader)(unsafe.Pointer(&cigar))
+		refLen = cigarRefLenAVX2Asm(unsafe.Pointer(cigarHeader.Data), nVecOp)
+	} else if nOp >= 4 {
+		nVecOp = nOp &^ 3
+		cigarHeader := (*reflect.SliceHeader)(unsafe.Pointer(&cigar))
+		refLen = cigarRefLenSSE41Asm(unsafe.Pointer(cigarHeader.Data), nVecOp)
+	}
+	for _, op := range cigar[nVecOp:] {
+		if (cigarConsumesRef>>(op&15))&1 != 0 {
+			refLen += int(op >> 4)
+		}
+	}
+	return refLen
+}
+
+// MaskLowQual sets seq8[pos] := maskCode for every position where qual[pos] <
+// minQual, and returns the number of positions changed that way (including
+// those which already had the value maskCode).  seq8 and qual are typically
+// the unpacked bases and the raw (not +33) qualities of a read, and maskCode
+// is 15 (.bam N).  It panics if len(seq8) != len(qual).
+func MaskLowQual(seq8, qual []byte, minQual, maskCode byte) int {
+	nByte := len(seq8)
+	if len(qual) != nByte {
+		panic("MaskLowQual() requires len(seq8) == len(qual).")
+	}
+	if minQual == 0 {
+		return 0
+	}
+	nMasked := 0
+	nVecByte := 0
+	if useAVX2 && nByte >= 32 {
+		nVecByte = nByte &^ 31
+		seq8Header := (*reflect.SliceHeader)(unsafe.Pointer(&seq8))
+		qualHeader := (*reflect.SliceHeader)(unsafe.Pointer(&qual))
+		nMasked = maskLowQualAVX2Asm(unsafe.Pointer(seq8Header.Data), unsafe.Pointer(qualHeader.Data), nVecByte, minQual-1, maskCode)
+	} else if nByte >= 16 {
+		nVecByte = nByte &^ 15
+		seq8Header := (*reflect.SliceHeader)(unsafe.Pointer(&seq8))
+		qualHeader := (*reflect.SliceHeader)(unsafe.Pointer(&qual))
+		nMasked = maskLowQualSSE42Asm(unsafe.Pointer(seq8Header.Data), unsafe.Pointer(qualHeader.Data), nVecByte, minQual-1, maskCode)
+	}
+	for pos := nVecByte; pos < nByte; pos++ {
+		if qual[pos] < minQual {
+			seq8[pos] = maskCode
+			nMasked++
+		}
+	}
+	return nMasked
+}
+
+// CountMismatches returns the number of positions where seq8[pos] !=
+// ref[pos], ignoring positions where either byte is nCode.  seq8 and ref must
+// use the same encoding, e.g. unpacked .bam codes with nCode 15, or
+// capitalized ASCII with nCode 'N'.  It panics if len(seq8) != len(ref).
+func CountMismatches(seq8, ref []byte, nCode byte) int {
+	nByte := len(seq8)
+	if len(ref) != nByte {
+		panic("CountMismatches() requires len(seq8) == len(ref).")
+	}
+	cnt := 0
+	nVecByte := 0
+	if useAVX2 && nByte >= 32 {
+		nVecByte = nByte &^ 31
+		seq8Header := (*reflect.SliceHeader)(unsafe.Pointer(&seq8))
+		refHeader := (*reflect.SliceHeader)(unsafe.Pointer(&ref))
+		cnt = countMismatchesAVX2Asm(unsafe.Pointer(seq8Header.Data), unsafe.Pointer(refHeader.Data), nVecByte, nCode)
+	} else if nByte >= 16 {
+		nVecByte = nByte &^ 15
+		seq8Header := (*reflect.SliceHeader)(unsafe.Pointer(&seq8))
+		refHeader := (*reflect.SliceHeader)(unsafe.Pointer(&ref))
+		cnt = countMismatchesSSE42Asm(unsafe.Pointer(seq8Header.Data), unsafe.Pointer(refHeader.Data), nVecByte, nCode)
+	}
+	for pos := nVecByte; pos < nByte; pos++ {
+		seqByte := seq8[pos]
+		refByte := ref[pos]
+		if seqByte != refByte && seqByte != nCode && refByte != nCode {
+			cnt++
+		}
+	}
+	return cnt
+}
@@ -0,0 +1,262 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build amd64,!appengine
+
+        // The 16-byte constants are repeated so that the AVX2 functions can
+        // load them into ymm registers.
+        DATA ·CigarOpMask<>+0x00(SB)/8, $0x0000000f0000000f
+        DATA ·CigarOpMask<>+0x08(SB)/8, $0x0000000f0000000f
+        DATA ·CigarOpMask<>+0x10(SB)/8, $0x0000000f0000000f
+        DATA ·CigarOpMask<>+0x18(SB)/8, $0x0000000f0000000f
+        GLOBL ·CigarOpMask<>(SB), 24, $32
+        DATA ·CigarLowByte<>+0x00(SB)/8, $0x000000ff000000ff
+        DATA ·CigarLowByte<>+0x08(SB)/8, $0x000000ff000000ff
+        DATA ·CigarLowByte<>+0x10(SB)/8, $0x000000ff000000ff
+        DATA ·CigarLowByte<>+0x18(SB)/8, $0x000000ff000000ff
+        GLOBL ·CigarLowByte<>(SB), 24, $32
+        // CigarRefTable[op] is 0xff iff op is one of M, D, N, =, X.
+        DATA ·CigarRefTable<>+0x00(SB)/8, $0xff000000ffff00ff
+        DATA ·CigarRefTable<>+0x08(SB)/8, $0x00000000000000ff
+        DATA ·CigarRefTable<>+0x10(SB)/8, $0xff000000ffff00ff
+        DATA ·CigarRefTable<>+0x18(SB)/8, $0x00000000000000ff
+        GLOBL ·CigarRefTable<>(SB), 24, $32
+
+TEXT ·cigarRefLenSSE41Asm(SB),4,$0-24
+        // Requires nOp to be a positive multiple of 4.
+        MOVQ    cigar+0(FP), SI
+        MOVQ    nOp+8(FP), R9
+
+        MOVOU   ·CigarOpMask<>(SB), X0
+        MOVOU   ·CigarRefTable<>(SB), X1
+        MOVOU   ·CigarLowByte<>(SB), X2
+        // X3 holds two 64-bit partial sums, since a single 32-bit lane can
+        // overflow on long CIGARs.
+        PXOR    X3, X3
+
+        // set DI to the end of cigar[].
+        LEAQ    (SI)(R9*4), DI
+
+cigarRefLenSSE41Loop:
+        MOVOU   (SI), X4
+        // Look up the op codes.  Only the low byte of each lane is
+        // meaningful after the lookup.
+        MOVO    X0, X5
+        PAND    X4, X5
+        MOVO    X1, X6
+        PSHUFB  X5, X6
+        PAND    X2, X6
+        // Extend the low byte to a full-lane mask.
+        PCMPEQL X2, X6
+        // Keep the lengths of the ops which consume the reference.
+        PSRLL   $4, X4
+        PAND    X6, X4
+        PMOVZXDQ        X4, X7
+        PADDQ   X7, X3
+        PSHUFD  $0xee, X4, X4
+        PMOVZXDQ        X4, X7
+        PADDQ   X7, X3
+
+        ADDQ    $16, SI
+        CMPQ    DI, SI
+        JG      cigarRefLenSSE41Loop
+
+        PSHUFD  $0xee, X3, X4
+        PADDQ   X4, X3
+        MOVQ    X3, AX
+        MOVQ    AX, ret+16(FP)
+        RET
+
+TEXT ·cigarRefLenAVX2Asm(SB),4,$0-24
+        // Requires nOp to be a positive multiple of 8.  Same algorithm as
+        // cigarRefLenSSE41Asm.
+        MOVQ    cigar+0(FP), SI
+        MOVQ    nOp+8(FP), R9
+
+        VMOVDQU ·CigarOpMask<>(SB), Y0
+        VMOVDQU ·CigarRefTable<>(SB), Y1
+        VMOVDQU ·CigarLowByte<>(SB), Y2
+        VPXOR   Y3, Y3, Y3
+
+        LEAQ    (SI)(R9*4), DI
+
+cigarRefLenAVX2Loop:
+        VMOVDQU (SI), Y4
+        VPAND   Y0, Y4, Y5
+        VPSHUFB Y5, Y1, Y6
+        VPAND   Y2, Y6, Y6
+        VPCMPEQD        Y2, Y6, Y6
+        VPSRLD  $4, Y4, Y4
+        VPAND   Y6, Y4, Y4
+        VPMOVZXDQ       X4, Y7
+        VPADDQ  Y7, Y3, Y3
+        VEXTRACTI128    $1, Y4, X4
+        VPMOVZXDQ       X4, Y7
+        VPADDQ  Y7, Y3, Y3
+
+        ADDQ    $32, SI
+        CMPQ    DI, SI
+        JG      cigarRefLenAVX2Loop
+
+        VEXTRACTI128    $1, Y3, X4
+        VPADDQ  X4, X3, X3
+        VPSHUFD $0xee, X3, X4
+        VPADDQ  X4, X3, X3
+        VMOVQ   X3, AX
+        VZEROUPPER
+        MOVQ    AX, ret+16(FP)
+        RET
+
+TEXT ·maskLowQualSSE42Asm(SB),4,$0-40
+        // Requires nByte to be a positive multiple of 16.
+        MOVQ    seq8+0(FP), SI
+        MOVQ    qual+8(FP), DI
+        MOVQ    nByte+16(FP), R9
+
+        // Broadcast maxMaskedQual to X0 and maskCode to X1.
+        PXOR    X7, X7
+        MOVBQZX maxMaskedQual+24(FP), AX
+        MOVQ    AX, X0
+        PSHUFB  X7, X0
+        MOVBQZX maskCode+25(FP), AX
+        MOVQ    AX, X1
+        PSHUFB  X7, X1
+        // R10 counts the masked positions.
+        XORQ    R10, R10
+
+        LEAQ    (SI)(R9*1), R8
+
+maskLowQualSSE42Loop:
+        MOVOU   (DI), X2
+        // X3 := (qual <= maxMaskedQual) ? 0xff : 0, via unsigned min.
+        MOVO    X2, X3
+        PMINUB  X0, X3
+        PCMPEQB X2, X3
+        MOVOU   (SI), X4
+        MOVO    X3, X5
+        PANDN   X4, X5
+        MOVO    X3, X6
+        PAND    X1, X6
+        POR     X6, X5
+        MOVOU   X5, (SI)
+        PMOVMSKB        X3, AX
+        POPCNTL AX, AX
+        ADDQ    AX, R10
+
+        ADDQ    $16, SI
+        ADDQ    $16, DI
+        CMPQ    R8, SI
+        JG      maskLowQualSSE42Loop
+
+        MOVQ    R10, ret+32(FP)
+        RET
+
+TEXT ·maskLowQualAVX2Asm(SB),4,$0-40
+        // Requires nByte to be a positive multiple of 32.
+        MOVQ    seq8+0(FP), SI
+        MOVQ    qual+8(FP), DI
+        MOVQ    nByte+16(FP), R9
+
+        MOVBQZX maxMaskedQual+24(FP), AX
+        MOVQ    AX, X0
+        VPBROADCASTB    X0, Y0
+        MOVBQZX maskCode+25(FP), AX
+        MOVQ    AX, X1
+        VPBROADCASTB    X1, Y1
+        XORQ    R10, R10
+
+        LEAQ    (SI)(R9*1), R8
+
+maskLowQualAVX2Loop:
+        VMOVDQU (DI), Y2
+        VPMINUB Y0, Y2, Y3
+        VPCMPEQB        Y2, Y3, Y3
+        VMOVDQU (SI), Y4
+        VPBLENDVB       Y3, Y1, Y4, Y5
+        VMOVDQU Y5, (SI)
+        VPMOVMSKB       Y3, AX
+        POPCNTL AX, AX
+        ADDQ    AX, R10
+
+        ADDQ    $32, SI
+        ADDQ    $32, DI
+        CMPQ    R8, SI
+        JG      maskLowQualAVX2Loop
+
+        VZEROUPPER
+        MOVQ    R10, ret+32(FP)
+        RET
+
+TEXT ·countMismatchesSSE42Asm(SB),4,$0-40
+        // Requires nByte to be a positive multiple of 16.
+        MOVQ    seq8+0(FP), SI
+        MOVQ    ref+8(FP), DI
+        MOVQ    nByte+16(FP), R9
+
+        // Broadcast nCode to X0.
+        PXOR    X7, X7
+        MOVBQZX nCode+24(FP), AX
+        MOVQ    AX, X0
+        PSHUFB  X7, X0
+        XORQ    R10, R10
+
+        LEAQ    (SI)(R9*1), R8
+
+countMismatchesSSE42Loop:
+        MOVOU   (SI), X1
+        MOVOU   (DI), X2
+        // X3 := positions which aren't counted: equal, or N on either side.
+        MOVO    X1, X3
+        PCMPEQB X2, X3
+        PCMPEQB X0, X1
+        PCMPEQB X0, X2
+        POR     X1, X3
+        POR     X2, X3
+        PMOVMSKB        X3, AX
+        XORL    $0xffff, AX
+        POPCNTL AX, AX
+        ADDQ    AX, R10
+
+        ADDQ    $16, SI
+        ADDQ    $16, DI
+        CMPQ    R8, SI
+        JG      countMismatchesSSE42Loop
+
+        MOVQ    R10, ret+32(FP)
+        RET
+
+TEXT ·countMismatchesAVX2Asm(SB),4,$0-40
+        // Requires nByte to be a positive multiple of 32.
+        MOVQ    seq8+0(FP), SI
+        MOVQ    ref+8(FP), DI
+        MOVQ    nByte+16(FP), R9
+
+        MOVBQZX nCode+24(FP), AX
+        MOVQ    AX, X0
+        VPBROADCASTB    X0, Y0
+        XORQ    R10, R10
+
+        LEAQ    (SI)(R9*1), R8
+
+countMismatchesAVX2Loop:
+        VMOVDQU (SI), Y1
+        VMOVDQU (DI), Y2
+        VPCMPEQB        Y1, Y2, Y3
+        VPCMPEQB        Y0, Y1, Y1
+        VPCMPEQB        Y0, Y2, Y2
+        VPOR    Y1, Y3, Y3
+        VPOR    Y2, Y3, Y3
+        VPMOVMSKB       Y3, AX
+        NOTL    AX
+        POPCNTL AX, AX
+        ADDQ    AX, R10
+
+        ADDQ    $32, SI
+        ADDQ    $32, DI
+        CMPQ    R8, SI
+        JG      countMismatchesAVX2Loop
+
+        VZEROUPPER
+        MOVQ    R10, ret+32(FP)
+        RET
@@ -0,0 +1,61 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !amd64 appengine
+
+package biosimd
+
+// cigarConsumesRef is a bitset of the .bam CIGAR operation codes (M, D, N, =,
+// X) which consume the reference.
+const cigarConsumesRef = (1 << 0) | (1 << 2) | (1 << 3) | (1 << 7) | (1 << 8)
+
+// CigarRefLen returns the number of reference bases covered by cigar, where
+// each element is a .bam-format CIGAR operation (length << 4 | op code).  A
+// []sam.CigarOp can be passed by reinterpreting its backing array.
+func CigarRefLen(cigar []uint32) int {
+	refLen := 0
+	for _, op := range cigar {
+		if (cigarConsumesRef>>(op&15))&1 != 0 {
+			refLen += int(op >> 4)
+		}
+	}
+	return refLen
+}
+
+// MaskLowQual sets seq8[pos] := maskCode for every position where qual[pos] <
+// minQual, and returns the number of positions changed that way (including
+// those which already had the value maskCode).  seq8 and qual are typically
+// the unpacked bases and the raw (not +33) qualities of a read, and maskCode
+// is 15 (.bam N).  It panics if len(seq8) != len(qual).
+func MaskLowQual(seq8, qual []byte, minQual, maskCode byte) int {
+	if len(qual) != len(seq8) {
+		panic("MaskLowQual() requires len(seq8) == len(qual).")
+	}
+	nMasked := 0
+	for pos, q := range qual {
+		if q < minQual {
+			seq8[pos] = maskCode
+			nMasked++
+		}
+	}
+	return nMasked
+}
+
+// CountMismatches returns the number of positions where seq8[pos] !=
+// ref[pos], ignoring positions where either byte is nCode.  seq8 and ref must
+// use the same encoding, e.g. unpacked .bam codes with nCode 15, or
+// capitalized ASCII with nCode 'N'.  It panics if len(seq8) != len(ref).
+func CountMismatches(seq8, ref []byte, nCode byte) int {
+	if len(ref) != len(seq8) {
+		panic("CountMismatches() requires len(seq8) == len(ref).")
+	}
+	cnt := 0
+	for pos, seqByte := range seq8 {
+		refByte := ref[pos]
+		if seqByte != refByte && seqByte != nCode && refByte != nCode {
+			cnt++
+		}
+	}
+	return cnt
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package biosimd_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/bio/biosimd"
+)
+
+// forEachVecWidth runs f once per vector width supported by the machine, so
+// that both the SSE and AVX2 kernels are compared against the slow versions.
+func forEachVecWidth(f func()) {
+	prev := biosimd.SetUseAVX2(false)
+	defer biosimd.SetUseAVX2(prev)
+	f()
+	if prev {
+		biosimd.SetUseAVX2(true)
+		f()
+	}
+}
+
+func cigarRefLenSlow(cigar []uint32) int {
+	refLen := 0
+	for _, op := range cigar {
+		switch op & 15 {
+		case 0, 2, 3, 7, 8: // M, D, N, =, X
+			refLen += int(op >> 4)
+		}
+	}
+	return refLen
+}
+
+func TestCigarRefLen(t *testing.T) {
+	forEachVecWidth(func() { testCigarRefLen(t) })
+}
+
+func testCigarRefLen(t *testing.T) {
+	maxSize := 300
+	nIter := 2000
+	cigar := make([]uint32, maxSize)
+	for iter := 0; iter < nIter; iter++ {
+		sliceStart := rand.Intn(maxSize)
+		sliceEnd := sliceStart + rand.Intn(maxSize+1-sliceStart)
+		cigarSlice := cigar[sliceStart:sliceEnd]
+		for ii := range cigarSlice {
+			// Mostly valid op codes, occasionally garbage, and lengths up to
+			// the full 28 bits so that the 32-bit lanes would overflow.
+			if rand.Intn(4) == 0 {
+				cigarSlice[ii] = rand.Uint32()
+			} else {
+				cigarSlice[ii] = uint32(rand.Intn(1<<28))<<4 | uint32(rand.Intn(9))
+			}
+		}
+		if biosimd.CigarRefLen(cigarSlice) != cigarRefLenSlow(cigarSlice) {
+			t.Fatal("Mismatched CigarRefLen result.")
+		}
+	}
+	// 10M2I5M3S
+	if biosimd.CigarRefLen([]uint32{10<<4 | 0, 2<<4 | 1, 5<<4 | 0, 3<<4 | 4}) != 15 {
+		t.Fatal("Wrong CigarRefLen result for 10M2I5M3S.")
+	}
+}
+
+func maskLowQualSlow(seq8, qual []byte, minQual, maskCode byte) int {
+	nMasked := 0
+	for pos, q := range qual {
+		if q < minQual {
+			seq8[pos] = maskCode
+			nMasked++
+		}
+	}
+	return nMasked
+}
+
+func TestMaskLowQual(t *testing.T) {
+	forEachVecWidth(func() { testMaskLowQual(t) })
+}
+
+func testMaskLowQual(t *testing.T) {
+	maxSize := 500
+	nIter := 2000
+	seqArr := make([]byte, maxSize)
+	qualArr := make([]byte, maxSize)
+	expectedArr := make([]byte, maxSize)
+	for iter := 0; iter < nIter; iter++ {
+		sliceStart := rand.Intn(maxSize)
+		sliceEnd := sliceStart + rand.Intn(maxSize+1-sliceStart)
+		seqSlice := seqArr[sliceStart:sliceEnd]
+		qualSlice := qualArr[sliceStart:sliceEnd]
+		for ii := range seqSlice {
+			seqSlice[ii] = byte(rand.Intn(16))
+			qualSlice[ii] = byte(rand.Intn(256))
+		}
+		expectedSlice := expectedArr[sliceStart:sliceEnd]
+		copy(expectedSlice, seqSlice)
+		minQual := byte(rand.Intn(256))
+		if rand.Intn(8) == 0 {
+			minQual = 0
+		}
+		nExpected := maskLowQualSlow(expectedSlice, qualSlice, minQual, 15)
+		if biosimd.MaskLowQual(seqSlice, qualSlice, minQual, 15) != nExpected {
+			t.Fatal("Mismatched MaskLowQual count.")
+		}
+		if !bytes.Equal(seqSlice, expectedSlice) {
+			t.Fatal("Mismatched MaskLowQual result.")
+		}
+	}
+}
+
+func countMismatchesSlow(seq8, ref []byte, nCode byte) int {
+	cnt := 0
+	for pos := range seq8 {
+		if seq8[pos] != ref[pos] && seq8[pos] != nCode && ref[pos] != nCode {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func TestCountMismatches(t *testing.T) {
+	forEachVecWidth(func() { testCountMismatches(t) })
+}
+
+func testCountMismatches(t *testing.T) {
+	maxSize := 500
+	nIter := 2000
+	seqArr := make([]byte, maxSize)
+	refArr := make([]byte, maxSize)
+	codes := []byte("ACGTN")
+	for iter := 0; iter < nIter; iter++ {
+		sliceStart := rand.Intn(maxSize)
+		sliceEnd := sliceStart + rand.Intn(maxSize+1-sliceStart)
+		seqSlice := seqArr[sliceStart:sliceEnd]
+		refSlice := refArr[sliceStart:sliceEnd]
+		for ii := range seqSlice {
+			refSlice[ii] = codes[rand.Intn(len(codes))]
+			// Mostly matches, as in real reads.
+			if rand.Intn(4) == 0 {
+				seqSlice[ii] = codes[rand.Intn(len(codes))]
+			} else {
+				seqSlice[ii] = refSlice[ii]
+			}
+		}
+		if biosimd.CountMismatches(seqSlice, refSlice, 'N') != countMismatchesSlow(seqSlice, refSlice, 'N') {
+			t.Fatal("Mismatched CountMismatches result.")
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build amd64,!appengine
+
+package biosimd
+
+import "golang.org/x/sys/cpu"
+
+// SetUseAVX2 enables or disables the AVX2 kernels, for testing the SSE ones
+// on AVX2 machines.  Enabling them has no effect on machines without AVX2.
+// It returns the previous setting.
+func SetUseAVX2(enable bool) bool {
+	prev := useAVX2
+	useAVX2 = enable && cpu.X86.HasAVX2
+	return prev
+}
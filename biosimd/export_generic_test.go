@@ -0,0 +1,12 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !amd64 appengine
+
+package biosimd
+
+// SetUseAVX2 does nothing on this platform; see export_amd64_test.go.
+func SetUseAVX2(enable bool) bool {
+	return false
+}
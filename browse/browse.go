@@ -0,0 +1,285 @@
+// Package browse computes render-ready genome browser data for a small
+// region of a BAM/PAM file: reference bases, per-position coverage with
+// allele counts, and reads packed into non-overlapping rows with their
+// mismatches and indels already resolved against the reference.
+//
+// The result is a plain struct with JSON tags, so a web viewer only has to
+// draw rectangles; it does not need to parse CIGARs or compare bases.
+package browse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+)
+
+// Opts controls View computation.
+type Opts struct {
+	// FlagExclude causes reads with any of these FLAG bits to be skipped.
+	FlagExclude sam.Flags
+	// MinMapQ causes reads with lower MAPQ to be skipped.
+	MinMapQ int
+	// MaxReadSpan bounds the reference span of a read.  Reads starting up to
+	// this many bases before the region are fetched so that reads overlapping
+	// the region start are not missed.
+	MaxReadSpan int
+	// MaxRows bounds the number of stacked read rows.  Reads that don't fit are
+	// still counted in Coverage, and in View.Hidden.  0 means unlimited.
+	MaxRows int
+	// RowGap is the minimum number of empty positions between two reads placed
+	// in the same row.
+	RowGap int
+	// MaxRegionLen bounds the region size, since the result is held in
+	// memory and sent to a browser.
+	MaxRegionLen int
+}
+
+// DefaultOpts is suitable for short-read data.
+var DefaultOpts = Opts{
+	FlagExclude:  sam.Unmapped | sam.Secondary | sam.QCFail | sam.Duplicate | sam.Supplementary,
+	MinMapQ:      0,
+	MaxReadSpan:  1000,
+	MaxRows:      200,
+	RowGap:       1,
+	MaxRegionLen: 100000,
+}
+
+// Coverage summarizes one reference position.  Bases are counted only from
+// aligned (M/=/X) CIGAR operations.
+type Coverage struct {
+	Depth int `json:"depth"`
+	A     int `json:"a"`
+	C     int `json:"c"`
+	G     int `json:"g"`
+	T     int `json:"t"`
+	N     int `json:"n"`
+	Del   int `json:"del"`
+}
+
+// Block is a 0-based half-open reference interval.
+type Block struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Mismatch is an aligned read base differing from the reference.
+type Mismatch struct {
+	Pos  int    `json:"pos"`
+	Base string `json:"base"`
+	Qual int    `json:"qual"`
+}
+
+// Insertion is inserted sequence placed between Pos-1 and Pos.
+type Insertion struct {
+	Pos int    `json:"pos"`
+	Seq string `json:"seq"`
+}
+
+// Read is a single alignment, in reference coordinates.
+type Read struct {
+	Name       string      `json:"name"`
+	Flags      int         `json:"flags"`
+	MapQ       int         `json:"mapq"`
+	Reverse    bool        `json:"reverse"`
+	Start      int         `json:"start"`
+	End        int         `json:"end"`
+	Blocks     []Block     `json:"blocks"`
+	Deletions  []Block     `json:"deletions,omitempty"`
+	Skips      []Block     `json:"skips,omitempty"`
+	Insertions []Insertion `json:"insertions,omitempty"`
+	Mismatches []Mismatch  `json:"mismatches,omitempty"`
+	// SoftClipStart and SoftClipEnd are the number of soft-clipped bases on
+	// each side, for viewers that draw clipping markers.
+	SoftClipStart int `json:"softClipStart,omitempty"`
+	SoftClipEnd   int `json:"softClipEnd,omitempty"`
+}
+
+// View is the render-ready data for a region.
+type View struct {
+	Chrom string `json:"chrom"`
+	// Start and End are the 0-based half-open region bounds.
+	Start    int        `json:"start"`
+	End      int        `json:"end"`
+	Ref      string     `json:"ref"`
+	Coverage []Coverage `json:"coverage"`
+	// Rows contains reads packed so that reads in a row don't overlap.  Reads
+	// within a row are sorted by start position.
+	Rows [][]Read `json:"rows"`
+	// Hidden is the number of reads that did not fit within Opts.MaxRows.
+	Hidden int `json:"hidden"`
+}
+
+// Compute builds the View for the given region.  The reference is looked up
+// by the region's contig name.
+func Compute(provider bamprovider.Provider, ref fasta.Fasta, region interval.Entry, opts Opts) (*View, error) {
+	start, end := int(region.Start0), int(region.End)
+	if end <= start {
+		return nil, fmt.Errorf("browse.Compute: empty region %s:%d-%d", region.RefName, start, end)
+	}
+	if refLen, err := ref.Len(region.RefName); err != nil {
+		return nil, err
+	} else if uint64(end) > refLen {
+		end = int(refLen)
+	}
+	if opts.MaxRegionLen > 0 && end-start > opts.MaxRegionLen {
+		return nil, fmt.Errorf("browse.Compute: region length %d exceeds limit %d", end-start, opts.MaxRegionLen)
+	}
+	refSeq, err := ref.Get(region.RefName, uint64(start), uint64(end))
+	if err != nil {
+		return nil, err
+	}
+	v := &View{
+		Chrom:    region.RefName,
+		Start:    start,
+		End:      end,
+		Ref:      refSeq,
+		Coverage: make([]Coverage, end-start),
+		Rows:     [][]Read{},
+	}
+	fetchStart := start - opts.MaxReadSpan
+	if fetchStart < 0 {
+		fetchStart = 0
+	}
+	iter := bamprovider.NewRefIterator(provider, region.RefName, fetchStart, end)
+	var reads []Read
+	for iter.Scan() {
+		rec := iter.Record()
+		if rec.Flags&opts.FlagExclude != 0 || int(rec.MapQ) < opts.MinMapQ || len(rec.Cigar) == 0 {
+			sam.PutInFreePool(rec)
+			continue
+		}
+		if r, ok := v.addRecord(rec); ok {
+			reads = append(reads, r)
+		}
+		sam.PutInFreePool(rec)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	v.layout(reads, opts)
+	return v, nil
+}
+
+// addRecord converts rec, updating coverage.  It returns false if rec does
+// not overlap the view.
+func (v *View) addRecord(rec *sam.Record) (Read, bool) {
+	r := Read{
+		Name:    rec.Name,
+		Flags:   int(rec.Flags),
+		MapQ:    int(rec.MapQ),
+		Reverse: rec.Flags&sam.Reverse != 0,
+		Start:   rec.Pos,
+		End:     rec.End(),
+	}
+	if r.End <= v.Start || r.Start >= v.End {
+		return r, false
+	}
+	seq := rec.Seq.Expand()
+	refPos, readPos := rec.Pos, 0
+	for i, co := range rec.Cigar {
+		n := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			r.Blocks = append(r.Blocks, Block{refPos, refPos + n})
+			for k := 0; k < n; k++ {
+				v.addBase(&r, refPos+k, seq[readPos+k], qualAt(rec.Qual, readPos+k))
+			}
+			refPos += n
+			readPos += n
+		case sam.CigarInsertion:
+			if refPos >= v.Start && refPos <= v.End {
+				r.Insertions = append(r.Insertions, Insertion{refPos, string(seq[readPos : readPos+n])})
+			}
+			readPos += n
+		case sam.CigarDeletion:
+			r.Deletions = append(r.Deletions, Block{refPos, refPos + n})
+			for k := refPos; k < refPos+n; k++ {
+				if k >= v.Start && k < v.End {
+					c := &v.Coverage[k-v.Start]
+					c.Depth++
+					c.Del++
+				}
+			}
+			refPos += n
+		case sam.CigarSkipped:
+			r.Skips = append(r.Skips, Block{refPos, refPos + n})
+			refPos += n
+		case sam.CigarSoftClipped:
+			if i == 0 || (i == 1 && rec.Cigar[0].Type() == sam.CigarHardClipped) {
+				r.SoftClipStart = n
+			} else {
+				r.SoftClipEnd = n
+			}
+			readPos += n
+		}
+	}
+	return r, true
+}
+
+func qualAt(qual []byte, i int) int {
+	if i < len(qual) && qual[i] != 0xff {
+		return int(qual[i])
+	}
+	return -1
+}
+
+func (v *View) addBase(r *Read, pos int, base byte, qual int) {
+	if pos < v.Start || pos >= v.End {
+		return
+	}
+	c := &v.Coverage[pos-v.Start]
+	c.Depth++
+	switch base {
+	case 'A':
+		c.A++
+	case 'C':
+		c.C++
+	case 'G':
+		c.G++
+	case 'T':
+		c.T++
+	default:
+		c.N++
+	}
+	if refBase := v.Ref[pos-v.Start] &^ 0x20; base != refBase && base != '=' {
+		r.Mismatches = append(r.Mismatches, Mismatch{pos, string(base), qual})
+	}
+}
+
+// layout packs reads into rows greedily in start order: each read goes into
+// the first row whose last read ends at least RowGap positions before it.
+func (v *View) layout(reads []Read, opts Opts) {
+	sort.SliceStable(reads, func(i, j int) bool { return reads[i].Start < reads[j].Start })
+	var rowEnds []int
+	for _, r := range reads {
+		placed := false
+		for i, e := range rowEnds {
+			if e+opts.RowGap <= r.Start {
+				v.Rows[i] = append(v.Rows[i], r)
+				rowEnds[i] = r.End
+				placed = true
+				break
+			}
+		}
+		if placed {
+			continue
+		}
+		if opts.MaxRows > 0 && len(rowEnds) >= opts.MaxRows {
+			v.Hidden++
+			continue
+		}
+		v.Rows = append(v.Rows, []Read{r})
+		rowEnds = append(rowEnds, r.End)
+	}
+}
+
+// WriteJSON writes the view as a single JSON object.
+func (v *View) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,98 @@
+package browse_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/browse"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func TestCompute(t *testing.T) {
+	//                 0123456789012345678901234567890123456789
+	const refSeq = "ACGTACGTACGTACGTACGTACGTACGTACGTACGTACGT"
+	fa, err := fasta.New(strings.NewReader(">chr1\n" + refSeq + "\n"))
+	assert.NoError(t, err)
+	ref, err := sam.NewReference("chr1", "", "", len(refSeq), nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	newRecord := func(name string, pos int, flags sam.Flags, cigar []sam.CigarOp, seq string) *sam.Record {
+		return &sam.Record{
+			Name:  name,
+			Ref:   ref,
+			Pos:   pos,
+			MapQ:  60,
+			Flags: flags,
+			Cigar: cigar,
+			Seq:   sam.NewSeq([]byte(seq)),
+			Qual:  bytes.Repeat([]byte{30}, len(seq)),
+		}
+	}
+	m := func(n int) sam.CigarOp { return sam.NewCigarOp(sam.CigarMatch, n) }
+	records := []*sam.Record{
+		// Ends before the region.
+		newRecord("r0", 0, 0, []sam.CigarOp{m(4)}, "ACGT"),
+		// Mismatch at 10 (A->T), overlapping the region start.
+		newRecord("r1", 6, 0, []sam.CigarOp{m(8)}, "GTACTTAC"),
+		// 2-base deletion at [14, 16), then a 1-base insertion before 18.
+		newRecord("r2", 10, sam.Reverse, []sam.CigarOp{
+			sam.NewCigarOp(sam.CigarSoftClipped, 2), m(4), sam.NewCigarOp(sam.CigarDeletion, 2),
+			m(2), sam.NewCigarOp(sam.CigarInsertion, 1), m(2)}, "NNGTACACGGT"),
+		// Duplicate; excluded by default.
+		newRecord("r3", 12, sam.Duplicate, []sam.CigarOp{m(4)}, "ACGT"),
+		// Fits in row 0 after r1.
+		newRecord("r4", 16, 0, []sam.CigarOp{m(4)}, "ACGT"),
+	}
+	provider := bamprovider.NewFakeProvider(header, records)
+	opts := browse.DefaultOpts
+	opts.MaxReadSpan = 20
+	v, err := browse.Compute(provider, fa, interval.Entry{RefName: "chr1", Start0: 8, End: 24}, opts)
+	assert.NoError(t, err)
+
+	expect.EQ(t, v.Ref, refSeq[8:24])
+	assert.EQ(t, len(v.Coverage), 16)
+	// Position 10: r1 has T, r2 has G (ref).
+	expect.EQ(t, v.Coverage[2], browse.Coverage{Depth: 2, G: 1, T: 1})
+	// Position 14: r2 deletion only.
+	expect.EQ(t, v.Coverage[6], browse.Coverage{Depth: 1, Del: 1})
+	// Position 17: r2 and r4.
+	expect.EQ(t, v.Coverage[9].Depth, 2)
+
+	assert.EQ(t, len(v.Rows), 2)
+	expect.EQ(t, len(v.Rows[0]), 2)
+	expect.EQ(t, v.Rows[0][0].Name, "r1")
+	expect.EQ(t, v.Rows[0][0].Mismatches, []browse.Mismatch{{Pos: 10, Base: "T", Qual: 30}})
+	expect.EQ(t, v.Rows[0][1].Name, "r4")
+	r2 := v.Rows[1][0]
+	expect.EQ(t, r2.Name, "r2")
+	expect.True(t, r2.Reverse)
+	expect.EQ(t, r2.Start, 10)
+	expect.EQ(t, r2.End, 20)
+	expect.EQ(t, r2.SoftClipStart, 2)
+	expect.EQ(t, r2.Blocks, []browse.Block{{10, 14}, {16, 18}, {18, 20}})
+	expect.EQ(t, r2.Deletions, []browse.Block{{14, 16}})
+	expect.EQ(t, r2.Insertions, []browse.Insertion{{Pos: 18, Seq: "G"}})
+	expect.EQ(t, len(r2.Mismatches), 0)
+	expect.EQ(t, v.Hidden, 0)
+
+	var buf bytes.Buffer
+	assert.NoError(t, v.WriteJSON(&buf))
+	var decoded browse.View
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	expect.EQ(t, decoded.Rows[1][0].Deletions, r2.Deletions)
+
+	opts.MaxRows = 1
+	v, err = browse.Compute(bamprovider.NewFakeProvider(header, records), fa, interval.Entry{RefName: "chr1", Start0: 8, End: 24}, opts)
+	assert.NoError(t, err)
+	expect.EQ(t, len(v.Rows), 1)
+	expect.EQ(t, v.Hidden, 1)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/grailbio/base/grail"
 	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/util/flaghelp"
 )
 
 var (
@@ -16,8 +17,15 @@ var (
 )
 
 func main() {
+	cmd := &flaghelp.Command{
+		Name:  "bio-bam-gindex",
+		Short: "Write a .gbai index for the BAM on stdin to stdout",
+		Flags: flag.CommandLine,
+	}
+	flaghelp.Register(cmd)
 	shutdown := grail.Init()
 	defer shutdown()
+	flaghelp.Handle(cmd)
 
 	r := io.Reader(os.Stdin)
 	w := io.Writer(os.Stdout)
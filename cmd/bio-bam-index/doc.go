@@ -0,0 +1,10 @@
+/*Command bio-bam-index reads a coordinate-sorted .bam file and writes its
+  .bai or .csi index, like "samtools index".  bio-bam-index expects the bam
+  file to arrive on stdin, and writes to stdout.  --csi selects the .csi
+  format, whose binning is set by --min-shift and --depth; .bai indexes are
+  limited to positions below 2^29.
+
+  Usage: cat foo.bam | bio-bam-index > foo.bam.bai
+         cat foo.bam | bio-bam-index --csi > foo.bam.csi
+*/
+package main
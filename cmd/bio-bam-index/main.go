@@ -0,0 +1,44 @@
+package main
+
+// See doc.go for documentation
+import (
+	"flag"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/grailbio/base/grail"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/util/flaghelp"
+)
+
+var (
+	csi      = flag.Bool("csi", false, "Write a .csi index instead of a .bai index")
+	minShift = flag.Int("min-shift", 14, "Log2 of the smallest bin size of a .csi index")
+	depth    = flag.Int("depth", 0, "Number of bin levels of a .csi index; 0 picks the smallest depth covering the longest reference")
+)
+
+func main() {
+	cmd := &flaghelp.Command{
+		Name:  "bio-bam-index",
+		Short: "Write a .bai or .csi index for the BAM on stdin to stdout",
+		Flags: flag.CommandLine,
+	}
+	flaghelp.Register(cmd)
+	shutdown := grail.Init()
+	defer shutdown()
+	flaghelp.Handle(cmd)
+
+	r := io.Reader(os.Stdin)
+	w := io.Writer(os.Stdout)
+
+	opts := bam.BuildIndexOpts{Parallelism: runtime.NumCPU()}
+	if *csi {
+		opts.Format = bam.IndexCSI
+		opts.MinShift = *minShift
+		opts.Depth = *depth
+	}
+	if err := bam.BuildIndex(r, w, opts); err != nil {
+		panic(err.Error())
+	}
+}
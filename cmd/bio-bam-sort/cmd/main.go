@@ -9,12 +9,14 @@ import (
 	"io"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/grailbio/base/file"
 	"github.com/grailbio/base/grail"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/cmd/bio-bam-sort/sorter"
+	"github.com/grailbio/bio/util/flaghelp"
 	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/sam"
 )
@@ -27,6 +29,10 @@ var (
 	parallelismFlag        = flag.Int("parallelism", 64, "Parallelism during PAM generation.")
 	recordsPerPAMShardFlag = flag.Int64("records-per-pam-shard", 128<<20,
 		"Approx. size of each PAM shard, in number of reads.")
+	checkNamesFlag = flag.Bool("check-name-collisions", false,
+		"With -bam or -pam, fail if the same read name (and R1/R2 flag) appears in more than one input sortshard.")
+	namePrefixesFlag = flag.String("name-prefixes", "",
+		"With -bam or -pam, comma-separated list of strings, one per input sortshard, prepended to the read names of the input.")
 )
 
 // recordReader is implemented by both biogo sam.Reader and biogo bam.Reader.
@@ -113,19 +119,35 @@ sorting and merging.
 
    The command reads a list of sortshard files and merges them into foo.pam.
    Existing contents of foo.pam, if any, are destroyed.
+
+When merging sortshards of different samples, -check-name-collisions detects
+reads with the same name in different inputs, which would otherwise be taken for
+mates or duplicates of each other, and -name-prefixes makes the names distinct.
 `)
 		flag.PrintDefaults()
 	}
+	cmd := &flaghelp.Command{
+		Name:     "bio-bam-sort",
+		Short:    "Sort BAM/SAM records into sortshards, and merge sortshards into BAM or PAM",
+		ArgsName: "input output.sortshard | input.sortshard...",
+		Flags:    flag.CommandLine,
+	}
+	flaghelp.Register(cmd)
 	shutdown := grail.Init()
 	defer shutdown()
+	flaghelp.Handle(cmd)
 
 	args := flag.Args()
+	mergeOpts := sorter.MergeOptions{CheckNameCollisions: *checkNamesFlag}
+	if *namePrefixesFlag != "" {
+		mergeOpts.NamePrefixes = strings.Split(*namePrefixesFlag, ",")
+	}
 	if *bamFlag != "" {
 		if len(args) < 1 {
 			flag.Usage()
 			os.Exit(1)
 		}
-		err := sorter.BAMFromSortShards(args, *bamFlag)
+		err := sorter.BAMFromSortShards(args, *bamFlag, mergeOpts)
 		if err != nil {
 			log.Panicf("merge %v to %v: %v", args, *bamFlag, err)
 		}
@@ -134,7 +156,7 @@ sorting and merging.
 			flag.Usage()
 			os.Exit(1)
 		}
-		err := sorter.PAMFromSortShards(args, *pamFlag, *recordsPerPAMShardFlag, *parallelismFlag)
+		err := sorter.PAMFromSortShards(args, *pamFlag, *recordsPerPAMShardFlag, *parallelismFlag, mergeOpts)
 		if err != nil {
 			log.Panicf("merge %v to %v: %v", args, *pamFlag, err)
 		}
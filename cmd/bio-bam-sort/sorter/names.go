@@ -0,0 +1,163 @@
+package sorter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// MergeOptions controls BAMFromSortShards and PAMFromSortShards.
+type MergeOptions struct {
+	// CheckNameCollisions causes the merge to fail if the same read appears in
+	// more than one input, e.g. because the inputs are from different samples
+	// that were sequenced on the same flowcell.  Such collisions silently
+	// corrupt mate pairing and duplicate marking downstream.
+	//
+	// A read is identified by its name and its Read1/Read2 flags, so the mates
+	// of a pair may be in different inputs, as happens when sortshards are
+	// produced from chunks of the same aligner output.  Secondary and
+	// supplementary records are ignored.  The check keeps an 8-byte hash of
+	// every primary record in memory, and reports the (very unlikely)
+	// collisions of the hashes of different reads as well.
+	CheckNameCollisions bool
+
+	// NamePrefixes, if non-nil, has one entry per input.  The names of the
+	// records of the i'th input are prefixed with NamePrefixes[i], e.g.
+	// "sample1:", so that reads from different inputs can't collide.  Mates
+	// must be in the same input, or have the same prefix.
+	NamePrefixes []string
+}
+
+// Offsets of the fields of a BAM record serialized by bam.Marshal, including
+// the 4-byte length prefix.
+const (
+	bamNameLenOffset = 12
+	bamFlagsOffset   = 18
+	bamNameOffset    = 36
+	// bamMaxNameLen is the longest read name; the length field is one byte,
+	// and counts the terminating NUL.
+	bamMaxNameLen = 254
+)
+
+// bamRecordName returns the name of the serialized record, without the NUL.
+func bamRecordName(body []byte) []byte {
+	n := int(body[bamNameLenOffset])
+	return body[bamNameOffset : bamNameOffset+n-1]
+}
+
+// bamRecordFlags returns the flags of the serialized record.
+func bamRecordFlags(body []byte) sam.Flags {
+	return sam.Flags(binary.LittleEndian.Uint16(body[bamFlagsOffset:]))
+}
+
+// prefixBAMRecordName returns a copy of the serialized record, with the name
+// prefixed by prefix.
+func prefixBAMRecordName(body []byte, prefix string) ([]byte, error) {
+	name := bamRecordName(body)
+	n := len(prefix) + len(name)
+	if n > bamMaxNameLen {
+		return nil, fmt.Errorf("read name %s%s is longer than %d bytes", prefix, name, bamMaxNameLen)
+	}
+	out := make([]byte, 0, len(body)+len(prefix))
+	out = append(out, body[:bamNameOffset]...)
+	out = append(out, prefix...)
+	out = append(out, body[bamNameOffset:]...)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)-4))
+	out[bamNameLenOffset] = byte(n + 1)
+	return out, nil
+}
+
+// nNameStripes is the number of independently locked parts of a nameChecker,
+// so that the parallel PAM shard generators rarely wait for each other.
+const nNameStripes = 64
+
+// nameChecker remembers which input each read came from.  Thread safe.
+type nameChecker struct {
+	stripes [nNameStripes]struct {
+		mu     sync.Mutex
+		inputs map[uint64]int // read hash -> input index
+	}
+}
+
+func newNameChecker() *nameChecker {
+	c := &nameChecker{}
+	for i := range c.stripes {
+		c.stripes[i].inputs = make(map[uint64]int)
+	}
+	return c
+}
+
+// add records that the read with the given name and flags is in input.  If the
+// read was already seen in another input, it returns the index of that input
+// and false.
+func (c *nameChecker) add(name []byte, flags sam.Flags, input int) (int, bool) {
+	if (flags & (sam.Secondary | sam.Supplementary)) != 0 {
+		return input, true
+	}
+	segment := byte((flags & (sam.Read1 | sam.Read2)) >> 6)
+	h := fnv.New64a()
+	h.Write(append(name[:len(name):len(name)], segment)) // nolint: errcheck
+	key := h.Sum64()
+	s := &c.stripes[key%nNameStripes]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.inputs[key]; ok {
+		return prev, prev == input
+	}
+	s.inputs[key] = input
+	return input, true
+}
+
+// mergeFilter applies MergeOptions to the records of the merged inputs.  Thread
+// safe.  A nil *mergeFilter leaves the records alone.
+type mergeFilter struct {
+	paths    []string
+	prefixes []string
+	names    *nameChecker // nil unless CheckNameCollisions
+}
+
+// newMergeFilter returns the mergeFilter of the inputs paths, or nil if optList
+// doesn't request any change.
+func newMergeFilter(paths []string, optList []MergeOptions) (*mergeFilter, error) {
+	opts := MergeOptions{}
+	if len(optList) > 0 {
+		if len(optList) > 1 {
+			return nil, fmt.Errorf("more than one MergeOptions specified: %v", optList)
+		}
+		opts = optList[0]
+	}
+	if opts.NamePrefixes != nil && len(opts.NamePrefixes) != len(paths) {
+		return nil, fmt.Errorf("%d name prefixes given for %d inputs", len(opts.NamePrefixes), len(paths))
+	}
+	if !opts.CheckNameCollisions && opts.NamePrefixes == nil {
+		return nil, nil
+	}
+	f := &mergeFilter{paths: paths, prefixes: opts.NamePrefixes}
+	if opts.CheckNameCollisions {
+		f.names = newNameChecker()
+	}
+	return f, nil
+}
+
+// apply returns the serialized record body of the given input, as it should be
+// written to the merged output.
+func (f *mergeFilter) apply(body []byte, input int) ([]byte, error) {
+	if f == nil {
+		return body, nil
+	}
+	if f.prefixes != nil && f.prefixes[input] != "" {
+		var err error
+		if body, err = prefixBAMRecordName(body, f.prefixes[input]); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.paths[input], err)
+		}
+	}
+	if f.names != nil {
+		if prev, ok := f.names.add(bamRecordName(body), bamRecordFlags(body), input); !ok {
+			return nil, fmt.Errorf("read name collision: %s is in both %s and %s", bamRecordName(body), f.paths[prev], f.paths[input])
+		}
+	}
+	return body, nil
+}
@@ -139,6 +139,7 @@ func generatePAMShard(readers []*sortShardReader,
 	path string,
 	header *sam.Header,
 	start, limit recCoord,
+	filter *mergeFilter,
 	pool *sortShardBlockPool,
 	errReporter *errors.Once) {
 	opts := pam.WriteOpts{
@@ -146,14 +147,19 @@ func generatePAMShard(readers []*sortShardReader,
 	}
 	vlog.VI(1).Infof("%v: Generating PAM shard %+v", path, opts)
 	pamWriter := pam.NewWriter(opts, header, path)
-	readCallback := func(key sortEntry) bool {
+	readCallback := func(key sortEntry, input int) bool {
 		if key.coord >= limit {
 			// The rest of the records are not needed.
 			return false
 		}
 		if key.coord >= start {
+			body, err := filter.apply(key.body, input)
+			if err != nil {
+				errReporter.Set(err)
+				return false
+			}
 			// The first 4 bytes of data is the length field. Remove it.
-			rec, err := grailbam.Unmarshal(key.body[4:], header)
+			rec, err := grailbam.Unmarshal(body[4:], header)
 			if err != nil {
 				errReporter.Set(err)
 				return false
@@ -175,11 +181,16 @@ type generatePAMShardRequest struct {
 }
 
 // PAMFromSortShards merges a set of sortshard files into a single PAM file.
-// recordsPerShard is the goal # of reads to store in each rowshard.
-func PAMFromSortShards(paths []string, pamPath string, recordsPerShard int64, parallelism int) error {
+// recordsPerShard is the goal # of reads to store in each rowshard.  At most one
+// MergeOptions may be given.
+func PAMFromSortShards(paths []string, pamPath string, recordsPerShard int64, parallelism int, optList ...MergeOptions) error {
 	if len(paths) == 0 {
 		return fmt.Errorf("no shards to merge")
 	}
+	filter, err := newMergeFilter(paths, optList)
+	if err != nil {
+		return err
+	}
 	vlog.VI(1).Infof("%v: Generate PAM, #recordspershard=%d", pamPath, recordsPerShard)
 	// Delete existing files to avoid mixing up files from multiple generations.
 	if err := pamutil.Remove(pamPath); err != nil {
@@ -221,7 +232,7 @@ func PAMFromSortShards(paths []string, pamPath string, recordsPerShard int64, pa
 					}
 					subReaders[i] = newSortShardReader(path, pool, &errReporter, opts)
 				}
-				generatePAMShard(subReaders, pamPath, mergedHeader, req.start, req.limit, pool, &errReporter)
+				generatePAMShard(subReaders, pamPath, mergedHeader, req.start, req.limit, filter, pool, &errReporter)
 				vlog.Infof("%s: finished generating PAM shard %+v", pamPath, req)
 			}
 		}()
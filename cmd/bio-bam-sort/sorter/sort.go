@@ -233,7 +233,7 @@ func (s *Sorter) mergeShards(paths []string, header *sam.Header, outPath string)
 	}
 	writer := newSortShardWriter(out.Writer(ctx), !s.options.NoCompressTmpFiles, true, header,
 		s.sortBlockPool, &s.err)
-	callback := func(key sortEntry) bool {
+	callback := func(key sortEntry, input int) bool {
 		writer.add(key)
 		return true
 	}
@@ -243,11 +243,12 @@ func (s *Sorter) mergeShards(paths []string, header *sam.Header, outPath string)
 }
 
 // Merge sortShards. headerCallback is called once for the merged sam.Header,
-// then readCallback is called sequentially for each record in sort order.  If
-// readCallback returns false, this function exits immediately.
+// then readCallback is called sequentially for each record in sort order, along
+// with the index of its shard in shards.  If readCallback returns false, this
+// function exits immediately.
 func internalMergeShards(
 	shards []*sortShardReader,
-	readCallback func(key sortEntry) bool,
+	readCallback func(key sortEntry, input int) bool,
 	pool *sortShardBlockPool,
 	errReporter *errors.Once) {
 	// Sort all the inputs using a binary tree. This should be faster than
@@ -291,7 +292,7 @@ func internalMergeShards(
 		})
 		// Read records from top, until it becomes larger than next.
 		for {
-			if !readCallback(top.reader.key()) {
+			if !readCallback(top.reader.key(), top.seq) {
 				done = true
 				break
 			}
@@ -457,10 +458,15 @@ func mergeHeader(shards []*sortShardReader) (*sam.Header, error) {
 }
 
 // BAMFromSortShards merges a set of sortshard files into a single BAM file.
-func BAMFromSortShards(paths []string, bamPath string) error {
+// At most one MergeOptions may be given.
+func BAMFromSortShards(paths []string, bamPath string, optList ...MergeOptions) error {
 	if len(paths) == 0 {
 		return fmt.Errorf("no shards to merge")
 	}
+	filter, err := newMergeFilter(paths, optList)
+	if err != nil {
+		return err
+	}
 	errReporter := errors.Once{}
 	pool := newSortShardBlockPool()
 	shardReaders := make([]*sortShardReader, len(paths))
@@ -500,8 +506,13 @@ func BAMFromSortShards(paths []string, bamPath string) error {
 	writeBytes(buf.Bytes())
 
 	// Write the BAM records.
-	readCallback := func(key sortEntry) bool {
-		writeBytes(key.body)
+	readCallback := func(key sortEntry, input int) bool {
+		body, err := filter.apply(key.body, input)
+		if err != nil {
+			errReporter.Set(err)
+			return false
+		}
+		writeBytes(body)
 		return true
 	}
 	internalMergeShards(shardReaders, readCallback, pool, &errReporter)
@@ -278,7 +278,7 @@ read11	12	*	0	0	10M	*	0	0	ACGTACGTAC	ABCDEFGHIJ	RG:Z:NA12879
 	require.NoError(t, err)
 	pamPath := filepath.Join(tempDir, "test.pam")
 	generatePAMShard([]*sortShardReader{shardReader},
-		pamPath, header, unmappedCoord, infinityCoord, pool, &errReporter)
+		pamPath, header, unmappedCoord, infinityCoord, nil, pool, &errReporter)
 	require.NoError(t, errReporter.Err())
 	_, recs := readRecords(t, pamPath)
 	log.Printf("Read recs: %v", recs)
@@ -360,6 +360,49 @@ read1	0	chr1	123	60	10M	=	456	20	AAAAAAAAAA	ABCDEFGHIJ	NM:i:1
 	assert.Equal(t, n, len(expected))
 }
 
+func TestMergeNameCollisions(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	// The mates of pair1 are in different shards, and pair2/1 is in both.
+	shard0 := fmt.Sprintf("%s/shard0", tempDir)
+	shard1 := fmt.Sprintf("%s/shard1", tempDir)
+	sortSAM(t, SortOptions{ShardIndex: 1}, shard0, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+pair1	99	chr1	100	60	10M	=	300	210	AAAAAAAAAA	ABCDEFGHIJ
+pair2	65	chr1	200	60	10M	=	400	210	AAAAAAAAAA	ABCDEFGHIJ
+`)
+	sortSAM(t, SortOptions{ShardIndex: 2}, shard1, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+pair1	147	chr1	300	60	10M	=	100	-210	AAAAAAAAAA	ABCDEFGHIJ
+pair2	65	chr1	250	60	10M	=	400	160	AAAAAAAAAA	ABCDEFGHIJ
+`)
+	shards := []string{shard0, shard1}
+
+	bamPath := filepath.Join(tempDir, "test.bam")
+	require.NoError(t, BAMFromSortShards(shards, bamPath))
+	err := BAMFromSortShards(shards, bamPath, MergeOptions{CheckNameCollisions: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pair2 is in both")
+	pamPath := filepath.Join(tempDir, "test.pam")
+	require.Error(t, PAMFromSortShards(shards, pamPath, 1, 2, MergeOptions{CheckNameCollisions: true}))
+
+	opts := MergeOptions{CheckNameCollisions: true, NamePrefixes: []string{"s0:", "s1:"}}
+	require.NoError(t, BAMFromSortShards(shards, bamPath, opts))
+	require.NoError(t, PAMFromSortShards(shards, pamPath, 1, 2, opts))
+	for _, path := range []string{bamPath, pamPath} {
+		_, recs := readRecords(t, path)
+		var names []string
+		for _, rec := range recs {
+			names = append(names, rec.Name)
+		}
+		assert.Equal(t, []string{"s0:pair1", "s0:pair2", "s1:pair2", "s1:pair1"}, names, path)
+	}
+
+	opts.NamePrefixes = []string{"s0:"}
+	require.Error(t, BAMFromSortShards(shards, bamPath, opts))
+}
+
 func runCmd(t *testing.T, sh *gosh.Shell, arg0 string, args ...string) {
 	cmd := sh.Cmd(arg0, args...)
 	cmd.Run()
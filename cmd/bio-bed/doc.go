@@ -0,0 +1,21 @@
+/*Command bio-bed performs set operations on BED files, so that target
+  manipulation doesn't require bedtools.  Each subcommand reads BED3 to BED12
+  files (optionally gzipped, in any order), treats each file as the set of
+  positions covered by its intervals, and writes the resulting set to stdout
+  as sorted, merged BED3 intervals:
+
+    union a.bed b.bed...          positions in any input
+    intersect a.bed b.bed...      positions in every input
+    subtract a.bed b.bed...       positions in a.bed but in none of the others
+    merge [-d N] a.bed...         the union, with gaps of at most N positions filled
+    complement -g genome a.bed... positions of the genome in no input
+
+  -g names a bedtools-style genome file, with a reference name and length on
+  each line.  With -g, the output follows the genome file's reference order
+  (and drops references which aren't in it); otherwise references are
+  written in lexicographic order.  -split uses the blocks of BED12 records
+  (e.g. exons) instead of their whole extent.
+
+  Usage: bio-bed intersect -g hg38.genome targets.bed exons.bed > out.bed
+*/
+package main
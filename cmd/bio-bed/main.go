@@ -0,0 +1,221 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+// See doc.go for documentation
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/grailbio/base/cmdutil"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/util/buildinfo"
+	"github.com/grailbio/bio/util/flaghelp"
+	"v.io/x/lib/cmdline"
+)
+
+// setOpOpts are the options shared by all subcommands.
+type setOpOpts struct {
+	genomePath string
+	split      bool
+	// distance is the -d flag of merge.
+	distance int
+}
+
+// loadBED returns the positions covered by the BED file at path.
+func loadBED(path string, split bool) (interval.BEDUnion, error) {
+	records, err := interval.ReadBEDFromPath(path)
+	if err != nil {
+		return interval.BEDUnion{}, err
+	}
+	var entries []interval.Entry
+	for i := range records {
+		if split {
+			entries = append(entries, records[i].Entries()...)
+		} else {
+			entries = append(entries, records[i].Entry)
+		}
+	}
+	interval.SortEntries(entries)
+	return interval.NewBEDUnionFromEntries(entries, interval.NewBEDOpts{})
+}
+
+// loadGenome reads the genome file at path.
+func loadGenome(path string) (genome []interval.Entry, err error) {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	if genome, err = interval.ReadGenome(in.Reader(ctx)); err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+// runSetOp applies the set operation op to the BED files at paths, and
+// writes the result to w.
+func runSetOp(w io.Writer, op string, paths []string, opts setOpOpts) error {
+	minPaths := 1
+	if (op == "intersect") || (op == "subtract") {
+		minPaths = 2
+	}
+	if len(paths) < minPaths {
+		return fmt.Errorf("%s takes at least %d BED paths, but got %v", op, minPaths, paths)
+	}
+	var genome []interval.Entry
+	if opts.genomePath != "" {
+		var err error
+		if genome, err = loadGenome(opts.genomePath); err != nil {
+			return err
+		}
+	} else if op == "complement" {
+		return fmt.Errorf("complement requires -g")
+	}
+	if opts.distance < 0 {
+		return fmt.Errorf("invalid -d %d", opts.distance)
+	}
+	result, err := loadBED(paths[0], opts.split)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths[1:] {
+		u, err := loadBED(path, opts.split)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "intersect":
+			result = interval.Intersection(&result, &u)
+		case "subtract":
+			result = interval.Subtract(&result, &u)
+		default:
+			result = interval.Union(&result, &u)
+		}
+	}
+	switch op {
+	case "merge":
+		result = result.Merge(interval.PosType(opts.distance))
+	case "complement":
+		result = interval.Complement(&result, genome)
+	}
+	var refNames []string
+	for _, entry := range genome {
+		refNames = append(refNames, entry.RefName)
+	}
+	entries := result.Entries(refNames)
+	records := make([]interval.BEDRecord, len(entries))
+	for i, entry := range entries {
+		records[i] = interval.BEDRecord{Entry: entry, NFields: 3}
+	}
+	return interval.WriteBED(w, records)
+}
+
+func newCmdSetOp(name, short, argsName string) *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:     name,
+		Short:    short,
+		ArgsName: argsName,
+	}
+	opts := setOpOpts{}
+	genomeHelp := "Genome file with a reference name and length on each line. If set, the output follows its reference order."
+	if name == "complement" {
+		genomeHelp = "Genome file with a reference name and length on each line. Required."
+	}
+	cmd.Flags.StringVar(&opts.genomePath, "g", "", genomeHelp)
+	cmd.Flags.BoolVar(&opts.split, "split", false, "Use the blocks of BED12 records instead of their whole extent")
+	if name == "merge" {
+		cmd.Flags.IntVar(&opts.distance, "d", 0, "Merge intervals separated by gaps of at most this many positions")
+	}
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		return runSetOp(env.Stdout, name, argv, opts)
+	})
+	return cmd
+}
+
+// helpCommand converts a cmdline command tree to the form used by flaghelp.
+func helpCommand(cmd *cmdline.Command) *flaghelp.Command {
+	c := &flaghelp.Command{
+		Name:     cmd.Name,
+		Short:    cmd.Short,
+		ArgsName: cmd.ArgsName,
+		Flags:    &cmd.Flags,
+	}
+	for _, child := range cmd.Children {
+		c.Children = append(c.Children, helpCommand(child))
+	}
+	return c
+}
+
+func newCmdCompletion(root *cmdline.Command) *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:     "completion",
+		Short:    "Print a shell completion script",
+		ArgsName: "bash|fish|zsh",
+	}
+	helpLong := cmd.Flags.Bool("help-long", false, "Instead of a completion script, print long-form help for all commands")
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if *helpLong {
+			return flaghelp.WriteHelp(env.Stdout, helpCommand(root))
+		}
+		if len(argv) != 1 {
+			return fmt.Errorf("completion takes a shell name, but got %v", argv)
+		}
+		return flaghelp.WriteCompletion(env.Stdout, argv[0], helpCommand(root))
+	})
+	return cmd
+}
+
+func newCmdVersion() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:  "version",
+		Short: "Print build information",
+	}
+	asJSON := cmd.Flags.Bool("json", false, "Print build information as a JSON object")
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 0 {
+			return fmt.Errorf("version takes no arguments, but got %v", argv)
+		}
+		info := buildinfo.Get()
+		if *asJSON {
+			_, err := fmt.Fprintf(env.Stdout, "%s\n", info.JSON())
+			return err
+		}
+		_, err := fmt.Fprintf(env.Stdout, "bio-bed %s\n", info)
+		return err
+	})
+	return cmd
+}
+
+func main() {
+	cmdline.HideGlobalFlagsExcept()
+	root := &cmdline.Command{
+		Name:     "bio-bed",
+		Short:    "Set operations on BED files",
+		LookPath: false,
+		Children: []*cmdline.Command{
+			newCmdSetOp("union", "Print the positions in any input", "a.bed b.bed..."),
+			newCmdSetOp("intersect", "Print the positions in every input", "a.bed b.bed..."),
+			newCmdSetOp("subtract", "Print the positions in the first input but in none of the others", "a.bed b.bed..."),
+			newCmdSetOp("merge", "Print the union of the inputs, with small gaps filled", "a.bed..."),
+			newCmdSetOp("complement", "Print the positions of the genome in no input", "a.bed..."),
+		},
+	}
+	root.Children = append(root.Children, newCmdVersion(), newCmdCompletion(root))
+	cmdline.Main(root)
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestRunSetOp(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	write := func(name, data string) string {
+		path := filepath.Join(tmpdir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+		return path
+	}
+	// a.bed is unsorted, and has a BED12 record with two blocks.
+	a := write("a.bed", "chr2\t50\t60\nchr1\t200\t300\tgene\t0\t+\t200\t300\t0\t2\t10,20,\t0,80,\nchr1\t0\t100\n")
+	b := write("b.bed", "chr1\t90\t210\nchr3\t10\t20\n")
+	genome := write("genome", "chr2\t500\nchr1\t1000\n")
+
+	for _, test := range []struct {
+		op    string
+		paths []string
+		opts  setOpOpts
+		want  string
+	}{
+		{"union", []string{a, b}, setOpOpts{}, "chr1\t0\t300\nchr2\t50\t60\nchr3\t10\t20\n"},
+		{"intersect", []string{a, b}, setOpOpts{}, "chr1\t90\t100\nchr1\t200\t210\n"},
+		{"intersect", []string{a, b}, setOpOpts{split: true}, "chr1\t90\t100\nchr1\t200\t210\n"},
+		{"subtract", []string{a, b}, setOpOpts{split: true}, "chr1\t0\t90\nchr1\t280\t300\nchr2\t50\t60\n"},
+		{"merge", []string{a}, setOpOpts{split: true, distance: 70}, "chr1\t0\t100\nchr1\t200\t300\nchr2\t50\t60\n"},
+		{"merge", []string{a, b}, setOpOpts{genomePath: genome}, "chr2\t50\t60\nchr1\t0\t300\n"},
+		{"complement", []string{a}, setOpOpts{genomePath: genome}, "chr2\t0\t50\nchr2\t60\t500\nchr1\t100\t200\nchr1\t300\t1000\n"},
+	} {
+		var out strings.Builder
+		assert.NoError(t, runSetOp(&out, test.op, test.paths, test.opts), test.op)
+		assert.EQ(t, out.String(), test.want, test.op)
+	}
+
+	var out strings.Builder
+	assert.HasSubstr(t, runSetOp(&out, "intersect", []string{a}, setOpOpts{}).Error(), "at least 2 BED paths")
+	assert.HasSubstr(t, runSetOp(&out, "complement", []string{a}, setOpOpts{}).Error(), "requires -g")
+}
@@ -0,0 +1,18 @@
+/*Command bio-coverage-heatmap renders a coarse coverage heatmap of a BAM or
+  PAM file from its index alone, without decoding any records, for instant QC
+  of whether the file looks like whole-genome sequencing, an exome, or a
+  small panel.
+
+  Each contig of at least -min-contig-len positions is split into -bin-size
+  bins, and the number of records in each bin is estimated from the .bai
+  chunk sizes (or PAM index blocks).  -png writes an image with one row per
+  contig and one column per bin, shaded on a log scale; -json writes the
+  estimates themselves.  A one-line summary with the guessed library type
+  (wgs, exome, panel, or empty) is printed to stdout.
+
+  .gbai indexes and CRAM files are not supported, since their indexes can't
+  estimate record counts.
+
+  Usage: bio-coverage-heatmap -png foo.png -json foo.json foo.bam
+*/
+package main
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+)
+
+// contigCoverage is the estimated number of records in each bin of a contig.
+type contigCoverage struct {
+	Name    string  `json:"name"`
+	Len     int     `json:"len"`
+	Records []int64 `json:"records"`
+}
+
+// heatmap is the JSON output of bio-coverage-heatmap.
+type heatmap struct {
+	Path    string `json:"path"`
+	BinSize int    `json:"bin_size"`
+	// Class is the guessed kind of library: "wgs", "exome", "panel", or
+	// "empty".  See classify.
+	Class string `json:"class"`
+	// Occupancy is the fraction of bins with any records, and TopShare1 and
+	// TopShare10 are the fractions of records in the top 1% and 10% of bins.
+	Occupancy  float64          `json:"occupancy"`
+	TopShare1  float64          `json:"top_share_1"`
+	TopShare10 float64          `json:"top_share_10"`
+	Contigs    []contigCoverage `json:"contigs"`
+}
+
+// classify guesses whether the coverage looks like whole-genome sequencing,
+// an exome, or a small panel.  WGS coverage is spread nearly evenly over
+// almost all bins; an exome touches most bins at coarse resolution, but with
+// a much more skewed distribution; a panel concentrates its records in a few
+// bins.  The thresholds are heuristics, so the statistics are reported too.
+func classify(contigs []contigCoverage) (class string, occupancy, topShare1, topShare10 float64) {
+	var counts []int64
+	var total int64
+	nonempty := 0
+	for _, c := range contigs {
+		for _, n := range c.Records {
+			counts = append(counts, n)
+			total += n
+			if n > 0 {
+				nonempty++
+			}
+		}
+	}
+	if total == 0 {
+		return "empty", 0, 0, 0
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] > counts[j] })
+	topShare := func(frac float64) float64 {
+		n := int(math.Ceil(frac * float64(len(counts))))
+		var sum int64
+		for _, c := range counts[:n] {
+			sum += c
+		}
+		return float64(sum) / float64(total)
+	}
+	occupancy = float64(nonempty) / float64(len(counts))
+	topShare1, topShare10 = topShare(0.01), topShare(0.1)
+	switch {
+	case (occupancy < 0.2) || (topShare1 > 0.5):
+		class = "panel"
+	case (occupancy < 0.8) || (topShare10 > 0.3):
+		class = "exome"
+	default:
+		class = "wgs"
+	}
+	return
+}
+
+var (
+	emptyColor   = color.RGBA{255, 255, 255, 255}
+	pastEndColor = color.RGBA{224, 224, 224, 255}
+	lowColor     = color.RGBA{255, 255, 178, 255}
+	highColor    = color.RGBA{189, 0, 38, 255}
+)
+
+// binColor maps a record count to a color, on a log scale from lowColor to
+// highColor, where maxRecords maps to highColor.
+func binColor(records, maxRecords int64) color.RGBA {
+	if records <= 0 {
+		return emptyColor
+	}
+	f := math.Log1p(float64(records)) / math.Log1p(float64(maxRecords))
+	mix := func(lo, hi uint8) uint8 {
+		return uint8(math.Round(float64(lo) + f*(float64(hi)-float64(lo))))
+	}
+	return color.RGBA{mix(lowColor.R, highColor.R), mix(lowColor.G, highColor.G), mix(lowColor.B, highColor.B), 255}
+}
+
+// renderPNG draws the heatmap with one rowHeight-pixel row per contig and
+// one pixel column per bin.  Positions past the end of a shorter contig are
+// gray.
+func renderPNG(w io.Writer, contigs []contigCoverage, rowHeight int) error {
+	width := 1
+	var maxRecords int64
+	for _, c := range contigs {
+		if len(c.Records) > width {
+			width = len(c.Records)
+		}
+		for _, n := range c.Records {
+			if n > maxRecords {
+				maxRecords = n
+			}
+		}
+	}
+	height := len(contigs) * rowHeight
+	if height == 0 {
+		height = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, c := range contigs {
+		for x := 0; x < width; x++ {
+			col := pastEndColor
+			if x < len(c.Records) {
+				col = binColor(c.Records[x], maxRecords)
+			}
+			for y := i * rowHeight; y < (i+1)*rowHeight; y++ {
+				img.SetRGBA(x, y, col)
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+)
+
+func uniform(n int, records int64) []int64 {
+	r := make([]int64, n)
+	for i := range r {
+		r[i] = records
+	}
+	return r
+}
+
+func TestClassify(t *testing.T) {
+	wgs := []contigCoverage{{Name: "chr1", Records: uniform(200, 1000)}}
+	class, occupancy, _, topShare10 := classify(wgs)
+	assert.EQ(t, class, "wgs")
+	assert.EQ(t, occupancy, 1.0)
+	assert.EQ(t, topShare10, 0.1)
+
+	exome := make([]int64, 200)
+	for i := range exome {
+		exome[i] = 10
+		if i%5 == 0 {
+			exome[i] = 500
+		}
+	}
+	class, _, _, _ = classify([]contigCoverage{{Name: "chr1", Records: exome}})
+	assert.EQ(t, class, "exome")
+
+	panel := make([]int64, 200)
+	panel[17] = 10000
+	panel[150] = 5000
+	class, _, topShare1, _ := classify([]contigCoverage{{Name: "chr1", Records: panel}})
+	assert.EQ(t, class, "panel")
+	assert.EQ(t, topShare1, 1.0)
+
+	class, _, _, _ = classify([]contigCoverage{{Name: "chr1", Records: make([]int64, 10)}})
+	assert.EQ(t, class, "empty")
+}
+
+func TestRenderPNG(t *testing.T) {
+	contigs := []contigCoverage{
+		{Name: "chr1", Records: []int64{0, 10, 100}},
+		{Name: "chr2", Records: []int64{1}},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, renderPNG(&buf, contigs, 4))
+	img, err := png.Decode(&buf)
+	assert.NoError(t, err)
+	assert.EQ(t, img.Bounds().Dx(), 3)
+	assert.EQ(t, img.Bounds().Dy(), 8)
+	r, g, b, _ := img.At(0, 0).RGBA()
+	assert.EQ(t, []uint32{r >> 8, g >> 8, b >> 8}, []uint32{255, 255, 255})
+	r, g, b, _ = img.At(2, 3).RGBA()
+	assert.EQ(t, []uint32{r >> 8, g >> 8, b >> 8}, []uint32{189, 0, 38})
+	r, g, b, _ = img.At(2, 4).RGBA()
+	assert.EQ(t, []uint32{r >> 8, g >> 8, b >> 8}, []uint32{224, 224, 224})
+}
@@ -0,0 +1,102 @@
+package main
+
+// See doc.go for documentation
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/grail"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/util/flaghelp"
+)
+
+var (
+	indexPath    = flag.String("index", "", "Input BAM index path. Defaults to bampath + .bai")
+	binSize      = flag.Int("bin-size", 1000000, "Number of reference positions per heatmap bin")
+	minContigLen = flag.Int("min-contig-len", 1000000, "Omit contigs shorter than this, e.g. decoys and alt contigs")
+	rowHeight    = flag.Int("row-height", 8, "Height in pixels of each contig's row in the -png output")
+	pngPath      = flag.String("png", "", "Output PNG path")
+	jsonPath     = flag.String("json", "", "Output JSON path")
+)
+
+func writeOutput(path string, write func(f file.File) error) (err error) {
+	ctx := vcontext.Background()
+	var f file.File
+	if f, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	return write(f)
+}
+
+func run(path string) (err error) {
+	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: *indexPath})
+	defer func() {
+		if e := provider.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	header, err := provider.GetHeader()
+	if err != nil {
+		return err
+	}
+	counts, err := bamprovider.IndexCoverage(provider, *binSize)
+	if err != nil {
+		return err
+	}
+	h := heatmap{Path: path, BinSize: *binSize}
+	for i, ref := range header.Refs() {
+		if ref.Len() < *minContigLen {
+			continue
+		}
+		h.Contigs = append(h.Contigs, contigCoverage{Name: ref.Name(), Len: ref.Len(), Records: counts[i]})
+	}
+	h.Class, h.Occupancy, h.TopShare1, h.TopShare10 = classify(h.Contigs)
+	if *pngPath != "" {
+		if err = writeOutput(*pngPath, func(f file.File) error {
+			return renderPNG(f.Writer(vcontext.Background()), h.Contigs, *rowHeight)
+		}); err != nil {
+			return err
+		}
+	}
+	if *jsonPath != "" {
+		if err = writeOutput(*jsonPath, func(f file.File) error {
+			return json.NewEncoder(f.Writer(vcontext.Background())).Encode(&h)
+		}); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s\t%s\toccupancy=%.3f\ttop_share_1=%.3f\ttop_share_10=%.3f\n", path, h.Class, h.Occupancy, h.TopShare1, h.TopShare10)
+	return nil
+}
+
+func main() {
+	cmd := &flaghelp.Command{
+		Name:     "bio-coverage-heatmap",
+		Short:    "Render a coarse per-contig coverage heatmap of a BAM or PAM from its index alone",
+		ArgsName: "bampath",
+		Flags:    flag.CommandLine,
+	}
+	flaghelp.Register(cmd)
+	shutdown := grail.Init()
+	defer shutdown()
+	flaghelp.Handle(cmd)
+
+	if flag.NArg() != 1 {
+		log.Fatalf("bio-coverage-heatmap: expected one input path, got %d", flag.NArg())
+	}
+	if *binSize <= 0 {
+		log.Fatalf("bio-coverage-heatmap: invalid -bin-size %d", *binSize)
+	}
+	if *rowHeight <= 0 {
+		log.Fatalf("bio-coverage-heatmap: invalid -row-height %d", *rowHeight)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -6,9 +6,14 @@ import (
 	"strings"
 
 	"github.com/grailbio/base/cmdutil"
+	"github.com/grailbio/base/vcontext"
+	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/encoding/converter"
 	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/util/buildinfo"
+	"github.com/grailbio/bio/util/flaghelp"
+	"github.com/grailbio/bio/util/progress"
 	"v.io/x/lib/cmdline"
 )
 
@@ -22,6 +27,10 @@ func newCmdView() *cmdline.Command {
 		bamIndex:   cmd.Flags.String("index", "", "Input BAM index filename. By default set to input bampath + .bai"),
 		headerOnly: cmd.Flags.Bool("header", false, "Print only the header in SAM format"),
 		withHeader: cmd.Flags.Bool("with-header", false, "Print header before body"),
+		subsetHeader: cmd.Flags.Bool("subset-header", false, `Restrict the header to the references covered by -regions, or to the
+references that have any reads if -regions is empty, and drop mate
+information that points to other references. Useful for producing small,
+self-contained slices.`),
 		regions: cmd.Flags.String("regions", "", `A comma-separated list of regions to show.
 Format of each region is either 'chr:begin-end' or 'chr0:pos0:seq0-chr1:pos1:seq1'.
 
@@ -35,6 +44,11 @@ when multiple reads are aligned at the same (chromosome, position).  For
 example, 'chr1:123:0-chr3:456:10'. An empty 'chr' part means unmapped reads,
 e.g., ':0:1000-:0:2000' will show 1000th to 2000th (0-based) unmapped reads.`),
 		filter: cmd.Flags.String("filter", "", filterHelp),
+		auditFlags: cmd.Flags.Bool("audit-flags", false, `Check each record's flags for inconsistencies with its other fields, such
+as a mapped mate without a position or a proper pair across references, and
+log the number of records with each kind of problem.`),
+		repairFlags: cmd.Flags.Bool("repair-flags", false, `Like -audit-flags, but also repair the flags of the output records.  Useful
+with -subset-header, which drops mate positions on other references.`),
 	}
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 1 {
@@ -64,7 +78,7 @@ func newCmdFlagstat() *cmdline.Command {
 func newCmdConvert() *cmdline.Command {
 	cmd := &cmdline.Command{
 		Name:     "convert",
-		Short:    "Convert between BAM and PAM",
+		Short:    "Convert between BAM and PAM, or from PAM to PAM",
 		ArgsName: "srcpath destpath",
 	}
 	baiFlag := cmd.Flags.String("index", "", "Input BAM index filename. By default, set to input bampath + .bai")
@@ -74,14 +88,43 @@ func newCmdConvert() *cmdline.Command {
 Output file format. Value is either \"bam\" or \"pam\".
 If empty, the format is guessed from the input file
 (if the input is bam, output is pam and vice versa).`)
+	flaghelp.SetValues(&cmd.Flags, "format", "bam", "pam")
 	transformersFlag := cmd.Flags.String("transformers", "", `Comma-separated list of transformers to apply during PAM generation.
 For example, "-transform=zstd 20".`)
-	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+	dropFieldsFlag := cmd.Flags.String("drop-fields", "", `Comma-separated list of fields to drop during conversion, e.g.,
+"qual,aux". For PAM output, the fields are omitted from the file. For BAM
+output, they are replaced with the SAM "unavailable" values ('*' for names,
+0xff for qualities, etc.). To slim down an existing PAM file, pass a PAM
+input and -format=pam. Field names: `+strings.Join(gbam.FieldNames, ",")+`.`)
+	progressFlag := cmd.Flags.String("progress", "", `Comma-separated list of the sinks of the conversion's progress events
+(per-shard and overall throughput, ETA, and memory high-water mark): "log",
+"json:<path>" (one JSON object per line), and "http:<addr>" (Prometheus
+metrics at http://<addr>/metrics and expvar at /debug/vars).`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) (err error) {
 		if len(argv) != 2 {
 			return fmt.Errorf("convert takes srcpath destpath, but found %v", argv)
 		}
 		srcPath := argv[0]
 		destPath := argv[1]
+		var dropFields []gbam.FieldType
+		if *dropFieldsFlag != "" {
+			for _, name := range strings.Split(*dropFieldsFlag, ",") {
+				f, err := gbam.ParseFieldType(name)
+				if err != nil {
+					return err
+				}
+				dropFields = append(dropFields, f)
+			}
+		}
+		sinks, sinkCloser, err := progress.NewSinks(vcontext.Background(), *progressFlag)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if e := sinkCloser.Close(); e != nil && err == nil {
+				err = e
+			}
+		}()
 		destFormat := bamprovider.Unknown
 		if *formatFlag != "" {
 			destFormat = bamprovider.ParseFileType(*formatFlag)
@@ -102,13 +145,14 @@ For example, "-transform=zstd 20".`)
 			if *transformersFlag != "" {
 				transformers = strings.Split(*transformersFlag, ",")
 			}
-			return converter.ConvertToPAM(pam.WriteOpts{
+			return converter.ConvertToPAMWithProgress(pam.WriteOpts{
 				MaxBufSize:   *bytesPerBlockFlag,
 				Transformers: transformers,
-			}, destPath, srcPath, *baiFlag, *bytesPerShardFlag)
+				DropFields:   dropFields,
+			}, destPath, srcPath, *baiFlag, *bytesPerShardFlag, sinks)
 		case bamprovider.BAM:
-			p := bamprovider.NewProvider(srcPath, bamprovider.ProviderOpts{Index: *baiFlag})
-			err := converter.ConvertToBAM(destPath, p)
+			p := bamprovider.NewProvider(srcPath, bamprovider.ProviderOpts{Index: *baiFlag, DropFields: dropFields})
+			err = converter.ConvertToBAMWithOpts(converter.BAMWriteOpts{DropFields: dropFields, Progress: sinks}, destPath, p)
 			if e := p.Close(); e != nil && err == nil {
 				err = e
 			}
@@ -148,20 +192,75 @@ The checksum is a JSON string describing the summary of various attributes of th
 	return cmd
 }
 
+// helpCommand converts a cmdline command tree to the form used by flaghelp.
+func helpCommand(cmd *cmdline.Command) *flaghelp.Command {
+	c := &flaghelp.Command{
+		Name:     cmd.Name,
+		Short:    cmd.Short,
+		ArgsName: cmd.ArgsName,
+		Flags:    &cmd.Flags,
+	}
+	for _, child := range cmd.Children {
+		c.Children = append(c.Children, helpCommand(child))
+	}
+	return c
+}
+
+func newCmdCompletion(root *cmdline.Command) *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:     "completion",
+		Short:    "Print a shell completion script",
+		ArgsName: "bash|fish|zsh",
+	}
+	helpLong := cmd.Flags.Bool("help-long", false, "Instead of a completion script, print long-form help for all commands, including valid flag values")
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if *helpLong {
+			return flaghelp.WriteHelp(env.Stdout, helpCommand(root))
+		}
+		if len(argv) != 1 {
+			return fmt.Errorf("completion takes a shell name, but got %v", argv)
+		}
+		return flaghelp.WriteCompletion(env.Stdout, argv[0], helpCommand(root))
+	})
+	return cmd
+}
+
+func newCmdVersion() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:  "version",
+		Short: "Print build information",
+	}
+	asJSON := cmd.Flags.Bool("json", false, "Print build information as a JSON object")
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 0 {
+			return fmt.Errorf("version takes no arguments, but got %v", argv)
+		}
+		info := buildinfo.Get()
+		if *asJSON {
+			_, err := fmt.Fprintf(env.Stdout, "%s\n", info.JSON())
+			return err
+		}
+		_, err := fmt.Fprintf(env.Stdout, "bio-pamtool %s\n", info)
+		return err
+	})
+	return cmd
+}
+
 // Run is the entrypoint for the bio-pamtool library.
 func Run() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 	cmdline.HideGlobalFlagsExcept()
-	cmdline.Main(
-		&cmdline.Command{
-			Name:     "bio-pamtool",
-			Short:    "Tools for working with PAM format files",
-			LookPath: false,
-			Children: []*cmdline.Command{
-				newCmdConvert(),
-				newCmdFlagstat(),
-				newCmdView(),
-				newCmdChecksum(),
-			},
-		})
+	root := &cmdline.Command{
+		Name:     "bio-pamtool",
+		Short:    "Tools for working with PAM format files",
+		LookPath: false,
+		Children: []*cmdline.Command{
+			newCmdConvert(),
+			newCmdFlagstat(),
+			newCmdView(),
+			newCmdChecksum(),
+		},
+	}
+	root.Children = append(root.Children, newCmdVersion(), newCmdCompletion(root))
+	cmdline.Main(root)
 }
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"log"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -84,8 +85,12 @@ func parseRegionsFlag(flag string) ([]viewRegion, error) {
 
 // Scan shards in parallel, and output records matching the filter in order.
 //
+// If subset is non-nil, records are remapped to subset.Header, and records on
+// the dropped references are skipped.  If auditor is non-nil, it is applied
+// to the records after remapping, which may leave their flags inconsistent.
+//
 // REQUIRES: ShardIdx field of shards[] must have values 0, 1, 2, ...
-func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam.Shard) error {
+func viewShards(provider bamprovider.Provider, filter *filterExpr, subset *gbam.HeaderSubset, auditor *gbam.FlagAuditor, shards []gbam.Shard) error {
 	// traverse.Each() would technically work, but its current implementation
 	// interacts poorly with the ordered output queue: the first reader goroutine
 	// must finish before any records produced by the second reader goroutine can
@@ -117,9 +122,17 @@ func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam
 				}
 				iter := provider.NewIterator(shard)
 				for iter.Scan() {
-					if filter == nil || evaluateFilterExpr(filter, iter.Record()) {
-						recCh <- iter.Record()
+					rec := iter.Record()
+					if filter != nil && !evaluateFilterExpr(filter, rec) {
+						continue
+					}
+					if subset != nil && !subset.RemapRecord(rec) {
+						continue
 					}
+					if auditor != nil {
+						auditor.Apply(rec)
+					}
+					recCh <- rec
 				}
 				e.Set(iter.Close())
 				close(recCh)
@@ -160,7 +173,7 @@ func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam
 	return e.Err()
 }
 
-func viewAll(provider bamprovider.Provider, filter *filterExpr) error {
+func viewAll(provider bamprovider.Provider, filter *filterExpr, subset *gbam.HeaderSubset, auditor *gbam.FlagAuditor) error {
 	shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
 		IncludeUnmapped:     true,
 		SplitUnmappedCoords: true,
@@ -169,10 +182,10 @@ func viewAll(provider bamprovider.Provider, filter *filterExpr) error {
 	if err != nil {
 		return err
 	}
-	return viewShards(provider, filter, shards)
+	return viewShards(provider, filter, subset, auditor, shards)
 }
 
-func viewSubregion(provider bamprovider.Provider, region viewRegion, filter *filterExpr) error {
+func viewSubregion(provider bamprovider.Provider, region viewRegion, filter *filterExpr, subset *gbam.HeaderSubset, auditor *gbam.FlagAuditor) error {
 	header, err := provider.GetHeader()
 	if err != nil {
 		return err
@@ -201,15 +214,56 @@ func viewSubregion(provider bamprovider.Provider, region viewRegion, filter *fil
 	if shard.EndRef, err = findRef(region.limitRefName); err != nil {
 		return err
 	}
-	return viewShards(provider, filter, []gbam.Shard{shard})
+	return viewShards(provider, filter, subset, auditor, []gbam.Shard{shard})
+}
+
+// subsetHeader restricts the header to the references that the output may
+// contain: those spanned by regions if any are given, or otherwise those that
+// the index reports as nonempty.
+func subsetHeader(provider bamprovider.Provider, regions []viewRegion) (*gbam.HeaderSubset, error) {
+	header, err := provider.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	keep := make([]bool, len(header.Refs()))
+	if len(regions) > 0 {
+		refID := func(name string) int {
+			if ref := bamprovider.RefByName(header, name); ref != nil {
+				return ref.ID()
+			}
+			return -1
+		}
+		for _, region := range regions {
+			start, limit := refID(region.startRefName), refID(region.limitRefName)
+			if limit < 0 {
+				// The region extends into the unmapped reads.
+				limit = len(keep) - 1
+			}
+			for id := start; id >= 0 && id <= limit; id++ {
+				keep[id] = true
+			}
+		}
+	} else {
+		for _, ref := range header.Refs() {
+			stats, err := bamprovider.QueryIndex(provider, gbam.Shard{StartRef: ref, EndRef: ref, End: ref.Len()})
+			if err != nil {
+				return nil, err
+			}
+			keep[ref.ID()] = stats.MayHaveRecords
+		}
+	}
+	return gbam.SubsetHeader(header, func(ref *sam.Reference) bool { return keep[ref.ID()] })
 }
 
 type viewFlags struct {
-	bamIndex   *string
-	withHeader *bool
-	headerOnly *bool
-	regions    *string
-	filter     *string
+	bamIndex     *string
+	withHeader   *bool
+	headerOnly   *bool
+	subsetHeader *bool
+	regions      *string
+	filter       *string
+	auditFlags   *bool
+	repairFlags  *bool
 }
 
 // TODO(saito) Currently this function only dumps the index info.  Add feature
@@ -232,11 +286,21 @@ func view(flags viewFlags, path string) error {
 		}
 	}
 	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: *flags.bamIndex})
+	var subset *gbam.HeaderSubset
+	if *flags.subsetHeader {
+		var err error
+		if subset, err = subsetHeader(provider, regions); err != nil {
+			return err
+		}
+	}
 	if *flags.headerOnly || *flags.withHeader {
 		header, err := provider.GetHeader()
 		if err != nil {
 			return err
 		}
+		if subset != nil {
+			header = subset.Header
+		}
 		h, err := header.MarshalText()
 		if err != nil {
 			return err
@@ -246,16 +310,23 @@ func view(flags viewFlags, path string) error {
 			return nil
 		}
 	}
+	var auditor *gbam.FlagAuditor
+	if *flags.auditFlags || *flags.repairFlags {
+		auditor = &gbam.FlagAuditor{Repair: *flags.repairFlags}
+	}
 	if len(regions) > 0 {
 		for _, region := range regions {
-			if err := viewSubregion(provider, region, filter); err != nil {
+			if err := viewSubregion(provider, region, filter, subset, auditor); err != nil {
 				return err
 			}
 		}
 	} else {
-		if err := viewAll(provider, filter); err != nil {
+		if err := viewAll(provider, filter, subset, auditor); err != nil {
 			return err
 		}
 	}
+	if auditor != nil {
+		log.Printf("view: flag audit: %v", auditor)
+	}
 	return nil
 }
@@ -29,4 +29,10 @@ func TestView(t *testing.T) {
 	expected2 := "read2	0	chr2	111	60	10M	=	222	20	ACGTACGTAC	ABCDEFGHIJ	RG:Z:NA12878\n"
 	assert.Equal(t, expected2, sh.Cmd(pamtoolPath, "view", "-filter", "rec_name==\"read2\"", bamPath).CombinedOutput())
 	assert.Equal(t, expected2, sh.Cmd(pamtoolPath, "view", "-filter", "rec_name==\"read2\"", pamPath).CombinedOutput())
+
+	for _, path := range []string{bamPath, pamPath} {
+		header := sh.Cmd(pamtoolPath, "view", "-header", "-subset-header", "-regions", "chr2:1-1000", path).CombinedOutput()
+		assert.Contains(t, header, "SN:chr2\t")
+		assert.NotContains(t, header, "SN:chr1\t")
+	}
 }
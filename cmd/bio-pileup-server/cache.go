@@ -0,0 +1,101 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// regionCache is an LRU cache of the responses to recent queries, keyed by
+// the normalized region and options of the query.  It is bounded by both the
+// number of responses and their total number of positions, since the memory
+// of a response is proportional to its number of positions.
+type regionCache struct {
+	capacity     int
+	maxPositions int
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	// positions is the total number of positions of the cached responses.
+	positions int
+	hits      int64
+	misses    int64
+}
+
+type cacheEntry struct {
+	key  string
+	resp *pileupResponse
+}
+
+// newRegionCache returns a cache of up to capacity responses, with up to
+// maxPositions positions in total.  Nothing is cached if either is 0.
+func newRegionCache(capacity, maxPositions int) *regionCache {
+	return &regionCache{
+		capacity:     capacity,
+		maxPositions: maxPositions,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached response for key, or nil.
+func (c *regionCache) get(key string) *pileupResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).resp
+}
+
+// put adds the response for key, evicting the least recently used ones until
+// it fits.  A response with more than maxPositions positions is not cached.
+func (c *regionCache) put(key string, resp *pileupResponse) {
+	n := len(resp.Positions)
+	if (c.capacity <= 0) || (n > c.maxPositions) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		// Another request for the same key finished first.
+		c.remove(elem)
+	}
+	for (c.lru.Len() >= c.capacity) || (c.positions+n > c.maxPositions) {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, resp: resp})
+	c.positions += n
+}
+
+// remove evicts elem.  The caller must hold c.mu.
+func (c *regionCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.positions -= len(e.resp.Positions)
+}
+
+// stats returns the numbers of cache hits and misses so far, and the number
+// of cached positions.
+func (c *regionCache) stats() (hits, misses int64, positions int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.positions
+}
@@ -0,0 +1,41 @@
+/*Command bio-pileup-server loads a BAM, PAM or CRAM and its reference, and
+  computes the pileups of requested regions on demand, for interactive
+  viewers which only need the few kilobases on screen.  The pileups are
+  computed by snp.StreamPileup, so the counts are those of the basestrand
+  formats of bio-pileup.  The responses of the -cache-regions most recently
+  requested regions are cached.
+
+  GET /pileup?region=<region> returns a JSON object with the normalized
+  region and one entry per covered position:
+
+    {"region": "chr1:1001-1010",
+     "positions": [{"chrom": "chr1", "pos": 1001, "depth": 31,
+                    "A": [15, 14], "C": [0, 1], "G": [0, 0], "T": [0, 0],
+                    "N": [0, 0], "ins": [0, 0], "del": [0, 0]}, ...]}
+
+  region has the format of bio-pileup -region, and may have at most
+  -max-region-len positions.  pos is 1-based, and the counts are [forward,
+  reverse] pairs.  The optional mapq, min-base-qual, flag-exclude and clip
+  parameters override the options of the same names for the request, and
+  cols=indels fills in the ins and del counts.  GET /stats returns the cache
+  hit and miss counts, and the number of cached positions.
+
+  The cache is also bounded by -cache-positions, the total number of
+  positions of the cached responses: the least recently used responses are
+  evicted until a new one fits, and a response with more positions than that
+  is not cached.  A cached position takes roughly 100 bytes, so the default
+  of 4000000 positions bounds the cache at about 400 MB.
+
+  The same queries are served over gRPC on -grpc-addr, by the GetPileup
+  method of the Pileup service in pileuppb/pileup.proto: its request has the
+  region and the options to override, and its response has the same
+  positions, with {fwd, rev} counts.  Invalid requests fail with
+  InvalidArgument.
+
+  Identical queries in flight at the same time, over either interface, are
+  computed once, and their requests share the response.  GET /stats also
+  returns the number of requests that shared another's query.
+
+  Usage: bio-pileup-server -addr localhost:8080 -grpc-addr localhost:8081 foo.bam ref.fa
+*/
+package main
@@ -0,0 +1,120 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+// See doc.go for documentation
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+
+	"github.com/grailbio/base/grail"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/cmd/bio-pileup-server/pileuppb"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/bio/pileup/snp"
+	"github.com/grailbio/bio/util/flaghelp"
+	"google.golang.org/grpc"
+)
+
+var (
+	addr           = flag.String("addr", "localhost:8080", "Address to serve HTTP on")
+	grpcAddr       = flag.String("grpc-addr", "localhost:8081", "Address to serve the gRPC API on, or empty to serve only HTTP")
+	indexPath      = flag.String("index", "", "Input BAM index path. Defaults to bampath + .bai")
+	cacheRegions   = flag.Int("cache-regions", 256, "Number of recently requested regions whose pileups are cached")
+	cachePositions = flag.Int("cache-positions", 4000000, "Maximum total number of positions of the cached pileups; each takes roughly 100 bytes")
+	maxRegionLen   = flag.Int("max-region-len", 1000000, "Maximum number of positions of a requested region")
+	mapq           = flag.Int("mapq", snp.DefaultOpts.Mapq, "Default minimum MAPQ of the counted reads")
+	minBaseQual    = flag.Int("min-base-qual", snp.DefaultOpts.MinBaseQual, "Default minimum base quality")
+	maxReadLen     = flag.Int("max-read-len", snp.DefaultOpts.MaxReadLen, "Maximum length of a read")
+	maxReadSpan    = flag.Int("max-read-span", snp.DefaultOpts.MaxReadSpan, "Maximum number of reference positions spanned by a read")
+)
+
+func run(xampath, fapath string) (err error) {
+	ctx := vcontext.Background()
+	provider := bamprovider.NewProvider(xampath, bamprovider.ProviderOpts{Index: *indexPath})
+	header, err := provider.GetHeader()
+	if e := provider.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	// The reference is loaded once, instead of by every query.
+	refSeqs, err := pileup.LoadReference(ctx, fapath, 250000000, header.Refs())
+	if err != nil {
+		return err
+	}
+	opts := snp.DefaultOpts
+	opts.BamIndexPath = *indexPath
+	opts.Mapq = *mapq
+	opts.MinBaseQual = *minBaseQual
+	opts.MaxReadLen = *maxReadLen
+	opts.MaxReadSpan = *maxReadSpan
+	// Rows must come back in position order.
+	opts.Parallelism = 1
+	s := &server{
+		refs:         header.Refs(),
+		baseOpts:     opts,
+		maxRegionLen: *maxRegionLen,
+		cache:        newRegionCache(*cacheRegions, *cachePositions),
+		pileup: func(ctx context.Context, opts *snp.Opts, emit func(*snp.Row) error) error {
+			return snp.StreamPileup(ctx, xampath, fapath, opts, refSeqs, emit)
+		},
+	}
+	errc := make(chan error, 2)
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			return err
+		}
+		gs := grpc.NewServer()
+		pileuppb.RegisterPileupServer(gs, s)
+		log.Printf("bio-pileup-server: serving %s over gRPC on %s", xampath, *grpcAddr)
+		go func() { errc <- gs.Serve(lis) }()
+	}
+	log.Printf("bio-pileup-server: serving %s over HTTP on %s", xampath, *addr)
+	go func() { errc <- http.ListenAndServe(*addr, s.handler()) }()
+	return <-errc
+}
+
+func main() {
+	cmd := &flaghelp.Command{
+		Name:     "bio-pileup-server",
+		Short:    "Serve the pileups of regions of a BAM, PAM or CRAM on demand over HTTP and gRPC",
+		ArgsName: "xampath fapath",
+		Flags:    flag.CommandLine,
+	}
+	flaghelp.Register(cmd)
+	shutdown := grail.Init()
+	defer shutdown()
+	flaghelp.Handle(cmd)
+
+	if flag.NArg() != 2 {
+		log.Fatalf("bio-pileup-server: expected xampath and fapath, got %d arguments", flag.NArg())
+	}
+	if *maxRegionLen <= 0 {
+		log.Fatalf("bio-pileup-server: invalid -max-region-len %d", *maxRegionLen)
+	}
+	if *cacheRegions < 0 {
+		log.Fatalf("bio-pileup-server: invalid -cache-regions %d", *cacheRegions)
+	}
+	if err := run(flag.Arg(0), flag.Arg(1)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pileuppb defines the gRPC API of bio-pileup-server.
+package pileuppb
+
+//go:generate protoc -I../../.. -I$GOPATH/src --gogo_out=plugins=grpc,paths=source_relative:../../.. ../../../cmd/bio-pileup-server/pileuppb/pileup.proto
@@ -0,0 +1,2020 @@
+// Code generated by protoc-gen-gogo. DO NOT EDIT.
+// source: cmd/bio-pileup-server/pileuppb/pileup.proto
+
+package pileuppb
+
+import (
+	context "context"
+	fmt "fmt"
+	_ "github.com/gogo/protobuf/gogoproto"
+	proto "github.com/gogo/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	io "io"
+	math "math"
+	math_bits "math/bits"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
+
+// PileupOptions override the server's options of the same names for one
+// query.  Unset fields keep the server's options; each optional field is in a
+// oneof of its own, so that an explicit 0 can be told from an unset field.
+type PileupOptions struct {
+	// Types that are valid to be assigned to MapqOpt:
+	//	*PileupOptions_Mapq
+	MapqOpt isPileupOptions_MapqOpt `protobuf_oneof:"mapq_opt"`
+	// Types that are valid to be assigned to MinBaseQualOpt:
+	//	*PileupOptions_MinBaseQual
+	MinBaseQualOpt isPileupOptions_MinBaseQualOpt `protobuf_oneof:"min_base_qual_opt"`
+	// Types that are valid to be assigned to FlagExcludeOpt:
+	//	*PileupOptions_FlagExclude
+	FlagExcludeOpt isPileupOptions_FlagExcludeOpt `protobuf_oneof:"flag_exclude_opt"`
+	// Types that are valid to be assigned to ClipOpt:
+	//	*PileupOptions_Clip
+	ClipOpt isPileupOptions_ClipOpt `protobuf_oneof:"clip_opt"`
+	// indels fills in the ins and del counts.
+	Indels bool `protobuf:"varint,5,opt,name=indels,proto3" json:"indels,omitempty"`
+}
+
+func (m *PileupOptions) Reset()         { *m = PileupOptions{} }
+func (m *PileupOptions) String() string { return proto.CompactTextString(m) }
+func (*PileupOptions) ProtoMessage()    {}
+func (*PileupOptions) Descriptor() ([]byte, []int) {
+	return fileDescriptor_acd87ffa9e6d7f0d, []int{0}
+}
+func (m *PileupOptions) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *PileupOptions) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_PileupOptions.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *PileupOptions) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PileupOptions.Merge(m, src)
+}
+func (m *PileupOptions) XXX_Size() int {
+	return m.Size()
+}
+func (m *PileupOptions) XXX_DiscardUnknown() {
+	xxx_messageInfo_PileupOptions.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PileupOptions proto.InternalMessageInfo
+
+type isPileupOptions_MapqOpt interface {
+	isPileupOptions_MapqOpt()
+	MarshalTo([]byte) (int, error)
+	Size() int
+}
+type isPileupOptions_MinBaseQualOpt interface {
+	isPileupOptions_MinBaseQualOpt()
+	MarshalTo([]byte) (int, error)
+	Size() int
+}
+type isPileupOptions_FlagExcludeOpt interface {
+	isPileupOptions_FlagExcludeOpt()
+	MarshalTo([]byte) (int, error)
+	Size() int
+}
+type isPileupOptions_ClipOpt interface {
+	isPileupOptions_ClipOpt()
+	MarshalTo([]byte) (int, error)
+	Size() int
+}
+
+type PileupOptions_Mapq struct {
+	Mapq int32 `protobuf:"varint,1,opt,name=mapq,proto3,oneof" json:"mapq,omitempty"`
+}
+type PileupOptions_MinBaseQual struct {
+	MinBaseQual int32 `protobuf:"varint,2,opt,name=min_base_qual,json=minBaseQual,proto3,oneof" json:"min_base_qual,omitempty"`
+}
+type PileupOptions_FlagExclude struct {
+	FlagExclude int32 `protobuf:"varint,3,opt,name=flag_exclude,json=flagExclude,proto3,oneof" json:"flag_exclude,omitempty"`
+}
+type PileupOptions_Clip struct {
+	Clip int32 `protobuf:"varint,4,opt,name=clip,proto3,oneof" json:"clip,omitempty"`
+}
+
+func (*PileupOptions_Mapq) isPileupOptions_MapqOpt()               {}
+func (*PileupOptions_MinBaseQual) isPileupOptions_MinBaseQualOpt() {}
+func (*PileupOptions_FlagExclude) isPileupOptions_FlagExcludeOpt() {}
+func (*PileupOptions_Clip) isPileupOptions_ClipOpt()               {}
+
+func (m *PileupOptions) GetMapqOpt() isPileupOptions_MapqOpt {
+	if m != nil {
+		return m.MapqOpt
+	}
+	return nil
+}
+func (m *PileupOptions) GetMinBaseQualOpt() isPileupOptions_MinBaseQualOpt {
+	if m != nil {
+		return m.MinBaseQualOpt
+	}
+	return nil
+}
+func (m *PileupOptions) GetFlagExcludeOpt() isPileupOptions_FlagExcludeOpt {
+	if m != nil {
+		return m.FlagExcludeOpt
+	}
+	return nil
+}
+func (m *PileupOptions) GetClipOpt() isPileupOptions_ClipOpt {
+	if m != nil {
+		return m.ClipOpt
+	}
+	return nil
+}
+
+func (m *PileupOptions) GetMapq() int32 {
+	if x, ok := m.GetMapqOpt().(*PileupOptions_Mapq); ok {
+		return x.Mapq
+	}
+	return 0
+}
+
+func (m *PileupOptions) GetMinBaseQual() int32 {
+	if x, ok := m.GetMinBaseQualOpt().(*PileupOptions_MinBaseQual); ok {
+		return x.MinBaseQual
+	}
+	return 0
+}
+
+func (m *PileupOptions) GetFlagExclude() int32 {
+	if x, ok := m.GetFlagExcludeOpt().(*PileupOptions_FlagExclude); ok {
+		return x.FlagExclude
+	}
+	return 0
+}
+
+func (m *PileupOptions) GetClip() int32 {
+	if x, ok := m.GetClipOpt().(*PileupOptions_Clip); ok {
+		return x.Clip
+	}
+	return 0
+}
+
+func (m *PileupOptions) GetIndels() bool {
+	if m != nil {
+		return m.Indels
+	}
+	return false
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*PileupOptions) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*PileupOptions_Mapq)(nil),
+		(*PileupOptions_MinBaseQual)(nil),
+		(*PileupOptions_FlagExclude)(nil),
+		(*PileupOptions_Clip)(nil),
+	}
+}
+
+type GetPileupRequest struct {
+	// region has the format of bio-pileup -region, e.g. "chr1:1001-2000".
+	Region  string         `protobuf:"bytes,1,opt,name=region,proto3" json:"region,omitempty"`
+	Options *PileupOptions `protobuf:"bytes,2,opt,name=options,proto3" json:"options,omitempty"`
+}
+
+func (m *GetPileupRequest) Reset()         { *m = GetPileupRequest{} }
+func (m *GetPileupRequest) String() string { return proto.CompactTextString(m) }
+func (*GetPileupRequest) ProtoMessage()    {}
+func (*GetPileupRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_acd87ffa9e6d7f0d, []int{1}
+}
+func (m *GetPileupRequest) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *GetPileupRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_GetPileupRequest.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *GetPileupRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetPileupRequest.Merge(m, src)
+}
+func (m *GetPileupRequest) XXX_Size() int {
+	return m.Size()
+}
+func (m *GetPileupRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetPileupRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetPileupRequest proto.InternalMessageInfo
+
+func (m *GetPileupRequest) GetRegion() string {
+	if m != nil {
+		return m.Region
+	}
+	return ""
+}
+
+func (m *GetPileupRequest) GetOptions() *PileupOptions {
+	if m != nil {
+		return m.Options
+	}
+	return nil
+}
+
+// StrandCounts are the counts of one pileup column on each strand.
+type StrandCounts struct {
+	Fwd uint32 `protobuf:"varint,1,opt,name=fwd,proto3" json:"fwd,omitempty"`
+	Rev uint32 `protobuf:"varint,2,opt,name=rev,proto3" json:"rev,omitempty"`
+}
+
+func (m *StrandCounts) Reset()         { *m = StrandCounts{} }
+func (m *StrandCounts) String() string { return proto.CompactTextString(m) }
+func (*StrandCounts) ProtoMessage()    {}
+func (*StrandCounts) Descriptor() ([]byte, []int) {
+	return fileDescriptor_acd87ffa9e6d7f0d, []int{2}
+}
+func (m *StrandCounts) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *StrandCounts) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_StrandCounts.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *StrandCounts) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StrandCounts.Merge(m, src)
+}
+func (m *StrandCounts) XXX_Size() int {
+	return m.Size()
+}
+func (m *StrandCounts) XXX_DiscardUnknown() {
+	xxx_messageInfo_StrandCounts.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StrandCounts proto.InternalMessageInfo
+
+func (m *StrandCounts) GetFwd() uint32 {
+	if m != nil {
+		return m.Fwd
+	}
+	return 0
+}
+
+func (m *StrandCounts) GetRev() uint32 {
+	if m != nil {
+		return m.Rev
+	}
+	return 0
+}
+
+// Position is the pileup of a single position; see snp.Row for the
+// definitions of the counts.
+type Position struct {
+	Chrom string `protobuf:"bytes,1,opt,name=chrom,proto3" json:"chrom,omitempty"`
+	// pos is 1-based.
+	Pos   int32        `protobuf:"varint,2,opt,name=pos,proto3" json:"pos,omitempty"`
+	Depth uint32       `protobuf:"varint,3,opt,name=depth,proto3" json:"depth,omitempty"`
+	A     StrandCounts `protobuf:"bytes,4,opt,name=a,proto3" json:"a"`
+	C     StrandCounts `protobuf:"bytes,5,opt,name=c,proto3" json:"c"`
+	G     StrandCounts `protobuf:"bytes,6,opt,name=g,proto3" json:"g"`
+	T     StrandCounts `protobuf:"bytes,7,opt,name=t,proto3" json:"t"`
+	N     StrandCounts `protobuf:"bytes,8,opt,name=n,proto3" json:"n"`
+	Ins   StrandCounts `protobuf:"bytes,9,opt,name=ins,proto3" json:"ins"`
+	Del   StrandCounts `protobuf:"bytes,10,opt,name=del,proto3" json:"del"`
+}
+
+func (m *Position) Reset()         { *m = Position{} }
+func (m *Position) String() string { return proto.CompactTextString(m) }
+func (*Position) ProtoMessage()    {}
+func (*Position) Descriptor() ([]byte, []int) {
+	return fileDescriptor_acd87ffa9e6d7f0d, []int{3}
+}
+func (m *Position) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Position) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Position.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Position) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Position.Merge(m, src)
+}
+func (m *Position) XXX_Size() int {
+	return m.Size()
+}
+func (m *Position) XXX_DiscardUnknown() {
+	xxx_messageInfo_Position.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Position proto.InternalMessageInfo
+
+func (m *Position) GetChrom() string {
+	if m != nil {
+		return m.Chrom
+	}
+	return ""
+}
+
+func (m *Position) GetPos() int32 {
+	if m != nil {
+		return m.Pos
+	}
+	return 0
+}
+
+func (m *Position) GetDepth() uint32 {
+	if m != nil {
+		return m.Depth
+	}
+	return 0
+}
+
+func (m *Position) GetA() StrandCounts {
+	if m != nil {
+		return m.A
+	}
+	return StrandCounts{}
+}
+
+func (m *Position) GetC() StrandCounts {
+	if m != nil {
+		return m.C
+	}
+	return StrandCounts{}
+}
+
+func (m *Position) GetG() StrandCounts {
+	if m != nil {
+		return m.G
+	}
+	return StrandCounts{}
+}
+
+func (m *Position) GetT() StrandCounts {
+	if m != nil {
+		return m.T
+	}
+	return StrandCounts{}
+}
+
+func (m *Position) GetN() StrandCounts {
+	if m != nil {
+		return m.N
+	}
+	return StrandCounts{}
+}
+
+func (m *Position) GetIns() StrandCounts {
+	if m != nil {
+		return m.Ins
+	}
+	return StrandCounts{}
+}
+
+func (m *Position) GetDel() StrandCounts {
+	if m != nil {
+		return m.Del
+	}
+	return StrandCounts{}
+}
+
+type GetPileupResponse struct {
+	// region is the queried region, in 1-based chrom:start-end form, clipped
+	// to the reference.
+	Region string `protobuf:"bytes,1,opt,name=region,proto3" json:"region,omitempty"`
+	// positions are the covered positions of the region, in order.
+	Positions []Position `protobuf:"bytes,2,rep,name=positions,proto3" json:"positions"`
+}
+
+func (m *GetPileupResponse) Reset()         { *m = GetPileupResponse{} }
+func (m *GetPileupResponse) String() string { return proto.CompactTextString(m) }
+func (*GetPileupResponse) ProtoMessage()    {}
+func (*GetPileupResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_acd87ffa9e6d7f0d, []int{4}
+}
+func (m *GetPileupResponse) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *GetPileupResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_GetPileupResponse.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *GetPileupResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetPileupResponse.Merge(m, src)
+}
+func (m *GetPileupResponse) XXX_Size() int {
+	return m.Size()
+}
+func (m *GetPileupResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetPileupResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetPileupResponse proto.InternalMessageInfo
+
+func (m *GetPileupResponse) GetRegion() string {
+	if m != nil {
+		return m.Region
+	}
+	return ""
+}
+
+func (m *GetPileupResponse) GetPositions() []Position {
+	if m != nil {
+		return m.Positions
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*PileupOptions)(nil), "grail.proto.bio.pileup.PileupOptions")
+	proto.RegisterType((*GetPileupRequest)(nil), "grail.proto.bio.pileup.GetPileupRequest")
+	proto.RegisterType((*StrandCounts)(nil), "grail.proto.bio.pileup.StrandCounts")
+	proto.RegisterType((*Position)(nil), "grail.proto.bio.pileup.Position")
+	proto.RegisterType((*GetPileupResponse)(nil), "grail.proto.bio.pileup.GetPileupResponse")
+}
+
+func init() {
+	proto.RegisterFile("cmd/bio-pileup-server/pileuppb/pileup.proto", fileDescriptor_acd87ffa9e6d7f0d)
+}
+
+var fileDescriptor_acd87ffa9e6d7f0d = []byte{
+	// 555 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x94, 0xcf, 0x6e, 0xd3, 0x4e,
+	0x10, 0xc7, 0xe3, 0xba, 0x49, 0x93, 0x49, 0x23, 0xa5, 0xfb, 0xab, 0x2a, 0xab, 0x07, 0xff, 0xa2,
+	0x50, 0xa4, 0x20, 0x14, 0x47, 0x0a, 0x12, 0xe2, 0x80, 0x84, 0x14, 0x40, 0x70, 0x23, 0x2c, 0x37,
+	0x2e, 0xc1, 0x7f, 0x36, 0xce, 0x82, 0xed, 0xdd, 0xd8, 0xeb, 0xc2, 0x63, 0xf0, 0x58, 0x3d, 0xf6,
+	0xc8, 0x09, 0x50, 0x22, 0xf1, 0x1c, 0x68, 0x76, 0x0d, 0xa4, 0x88, 0x20, 0x7c, 0x9b, 0xef, 0xec,
+	0x7c, 0x66, 0x66, 0xc7, 0xe3, 0x85, 0xbb, 0x61, 0x1a, 0x4d, 0x02, 0x2e, 0xc6, 0x92, 0x27, 0xac,
+	0x94, 0xe3, 0x82, 0xe5, 0x97, 0x2c, 0x9f, 0x18, 0x25, 0x83, 0xca, 0xf0, 0x64, 0x2e, 0x94, 0x20,
+	0x67, 0x71, 0xee, 0xf3, 0xc4, 0x08, 0x2f, 0xe0, 0xc2, 0x33, 0xa7, 0xe7, 0xe3, 0x98, 0xab, 0x55,
+	0x19, 0x78, 0xa1, 0x48, 0x27, 0xb1, 0x88, 0xc5, 0x44, 0x47, 0x04, 0xe5, 0x52, 0x2b, 0x2d, 0xb4,
+	0x65, 0xc8, 0xe1, 0x17, 0x0b, 0x7a, 0x73, 0x4d, 0xbe, 0x90, 0x8a, 0x8b, 0xac, 0x20, 0xa7, 0x70,
+	0x98, 0xfa, 0x72, 0xed, 0x58, 0x03, 0x6b, 0xd4, 0x7c, 0xde, 0xa0, 0x5a, 0x91, 0x0b, 0xe8, 0xa5,
+	0x3c, 0x5b, 0x04, 0x7e, 0xc1, 0x16, 0xeb, 0xd2, 0x4f, 0x9c, 0x03, 0x7d, 0x6c, 0xd1, 0x6e, 0xca,
+	0xb3, 0x99, 0x5f, 0xb0, 0x97, 0xa5, 0x9f, 0x90, 0x5b, 0x70, 0xbc, 0x4c, 0xfc, 0x78, 0xc1, 0x3e,
+	0x84, 0x49, 0x19, 0x31, 0xc7, 0xd6, 0x41, 0x07, 0xb4, 0x8b, 0xde, 0xa7, 0xc6, 0x89, 0x05, 0xc2,
+	0x84, 0x4b, 0xe7, 0x50, 0x1f, 0xda, 0x54, 0x2b, 0x72, 0x06, 0x2d, 0x9e, 0x45, 0x2c, 0x29, 0x9c,
+	0xe6, 0xc0, 0x1a, 0xb5, 0x69, 0xa5, 0x66, 0x00, 0x6d, 0x6c, 0x60, 0x21, 0xa4, 0x9a, 0xfd, 0x07,
+	0x27, 0x37, 0x9a, 0xd0, 0x4e, 0x02, 0xfd, 0xdd, 0x9a, 0xda, 0x07, 0xd0, 0xc6, 0xa4, 0x68, 0x0f,
+	0xdf, 0x41, 0xff, 0x19, 0x53, 0xe6, 0x8e, 0x94, 0xad, 0x4b, 0x56, 0x28, 0x2c, 0x96, 0xb3, 0x98,
+	0x8b, 0x4c, 0xdf, 0xb2, 0x43, 0x2b, 0x45, 0x1e, 0xc1, 0x91, 0x30, 0x63, 0xd0, 0xf7, 0xeb, 0x4e,
+	0x6f, 0x7b, 0x7f, 0x1e, 0xb3, 0x77, 0x63, 0x66, 0xf4, 0x07, 0x35, 0x9c, 0xc2, 0xf1, 0x2b, 0x95,
+	0xfb, 0x59, 0xf4, 0x58, 0x94, 0x99, 0x2a, 0x48, 0x1f, 0xec, 0xe5, 0xfb, 0x48, 0x57, 0xe9, 0x51,
+	0x34, 0xd1, 0x93, 0xb3, 0x4b, 0x9d, 0xbe, 0x47, 0xd1, 0x1c, 0x7e, 0xb3, 0xa1, 0x3d, 0x17, 0x05,
+	0xc7, 0x0c, 0xe4, 0x14, 0x9a, 0xe1, 0x2a, 0x17, 0x69, 0xd5, 0x98, 0x11, 0x08, 0x49, 0x61, 0x7a,
+	0x6a, 0x52, 0x34, 0x31, 0x2e, 0x62, 0x52, 0xad, 0xf4, 0x88, 0x7b, 0xd4, 0x08, 0xf2, 0x00, 0x2c,
+	0x5f, 0xcf, 0xb5, 0x3b, 0xbd, 0xd8, 0xd7, 0xf9, 0x6e, 0x7f, 0xb3, 0xc3, 0xab, 0xcf, 0xff, 0x37,
+	0xa8, 0xe5, 0x23, 0x19, 0x3a, 0xcd, 0xfa, 0x64, 0x88, 0x64, 0xec, 0xb4, 0xea, 0x93, 0x31, 0x92,
+	0xca, 0x39, 0xaa, 0x4f, 0x2a, 0x24, 0x33, 0xa7, 0x5d, 0x9f, 0xcc, 0xc8, 0x43, 0xb0, 0x79, 0x56,
+	0x38, 0x9d, 0xda, 0x2c, 0x62, 0x48, 0x47, 0x2c, 0x71, 0xa0, 0x3e, 0x1d, 0xb1, 0x64, 0xb8, 0x86,
+	0x93, 0x9d, 0x4d, 0x2c, 0xa4, 0xc8, 0x0a, 0xb6, 0x77, 0x15, 0x9f, 0x40, 0x47, 0x56, 0x4b, 0x81,
+	0x1f, 0xde, 0x1e, 0x75, 0xa7, 0x83, 0xbd, 0xcb, 0x58, 0x05, 0x56, 0xc5, 0x7e, 0x81, 0xd3, 0xb7,
+	0xd0, 0x32, 0xf5, 0xc8, 0x1b, 0xe8, 0xfc, 0x2c, 0x4e, 0x46, 0xfb, 0x32, 0xfd, 0xfe, 0xa7, 0x9c,
+	0xdf, 0xf9, 0x87, 0x48, 0x73, 0x93, 0xd9, 0xfc, 0x6a, 0xe3, 0x5a, 0xd7, 0x1b, 0xd7, 0xfa, 0xba,
+	0x71, 0xad, 0x8f, 0x5b, 0xb7, 0x71, 0xbd, 0x75, 0x1b, 0x9f, 0xb6, 0x6e, 0xe3, 0xf5, 0xfd, 0xdd,
+	0x37, 0x09, 0xd3, 0x05, 0x5c, 0xe0, 0x43, 0x37, 0xf9, 0xfb, 0x83, 0x17, 0xb4, 0x74, 0xd5, 0x7b,
+	0xdf, 0x07, 0x00, 0x6d, 0x8b, 0x4f, 0xe8, 0x19, 0x05, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// PileupClient is the client API for Pileup service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type PileupClient interface {
+	// GetPileup computes the pileup of a region, or returns a cached one.  It
+	// fails with InvalidArgument if the region or the options are invalid.
+	GetPileup(ctx context.Context, in *GetPileupRequest, opts ...grpc.CallOption) (*GetPileupResponse, error)
+}
+
+type pileupClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewPileupClient(cc *grpc.ClientConn) PileupClient {
+	return &pileupClient{cc}
+}
+
+func (c *pileupClient) GetPileup(ctx context.Context, in *GetPileupRequest, opts ...grpc.CallOption) (*GetPileupResponse, error) {
+	out := new(GetPileupResponse)
+	err := c.cc.Invoke(ctx, "/grail.proto.bio.pileup.Pileup/GetPileup", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PileupServer is the server API for Pileup service.
+type PileupServer interface {
+	// GetPileup computes the pileup of a region, or returns a cached one.  It
+	// fails with InvalidArgument if the region or the options are invalid.
+	GetPileup(context.Context, *GetPileupRequest) (*GetPileupResponse, error)
+}
+
+// UnimplementedPileupServer can be embedded to have forward compatible implementations.
+type UnimplementedPileupServer struct {
+}
+
+func (*UnimplementedPileupServer) GetPileup(ctx context.Context, req *GetPileupRequest) (*GetPileupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPileup not implemented")
+}
+
+func RegisterPileupServer(s *grpc.Server, srv PileupServer) {
+	s.RegisterService(&_Pileup_serviceDesc, srv)
+}
+
+func _Pileup_GetPileup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPileupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PileupServer).GetPileup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grail.proto.bio.pileup.Pileup/GetPileup",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PileupServer).GetPileup(ctx, req.(*GetPileupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Pileup_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "grail.proto.bio.pileup.Pileup",
+	HandlerType: (*PileupServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetPileup",
+			Handler:    _Pileup_GetPileup_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "cmd/bio-pileup-server/pileuppb/pileup.proto",
+}
+
+func (m *PileupOptions) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *PileupOptions) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *PileupOptions) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Indels {
+		i--
+		if m.Indels {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x28
+	}
+	if m.ClipOpt != nil {
+		{
+			size := m.ClipOpt.Size()
+			i -= size
+			if _, err := m.ClipOpt.MarshalTo(dAtA[i:]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if m.FlagExcludeOpt != nil {
+		{
+			size := m.FlagExcludeOpt.Size()
+			i -= size
+			if _, err := m.FlagExcludeOpt.MarshalTo(dAtA[i:]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if m.MinBaseQualOpt != nil {
+		{
+			size := m.MinBaseQualOpt.Size()
+			i -= size
+			if _, err := m.MinBaseQualOpt.MarshalTo(dAtA[i:]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if m.MapqOpt != nil {
+		{
+			size := m.MapqOpt.Size()
+			i -= size
+			if _, err := m.MapqOpt.MarshalTo(dAtA[i:]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *PileupOptions_Mapq) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *PileupOptions_Mapq) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	i = encodeVarintPileup(dAtA, i, uint64(m.Mapq))
+	i--
+	dAtA[i] = 0x8
+	return len(dAtA) - i, nil
+}
+func (m *PileupOptions_MinBaseQual) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *PileupOptions_MinBaseQual) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	i = encodeVarintPileup(dAtA, i, uint64(m.MinBaseQual))
+	i--
+	dAtA[i] = 0x10
+	return len(dAtA) - i, nil
+}
+func (m *PileupOptions_FlagExclude) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *PileupOptions_FlagExclude) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	i = encodeVarintPileup(dAtA, i, uint64(m.FlagExclude))
+	i--
+	dAtA[i] = 0x18
+	return len(dAtA) - i, nil
+}
+func (m *PileupOptions_Clip) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *PileupOptions_Clip) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	i = encodeVarintPileup(dAtA, i, uint64(m.Clip))
+	i--
+	dAtA[i] = 0x20
+	return len(dAtA) - i, nil
+}
+func (m *GetPileupRequest) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *GetPileupRequest) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *GetPileupRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Options != nil {
+		{
+			size, err := m.Options.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintPileup(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x12
+	}
+	if len(m.Region) > 0 {
+		i -= len(m.Region)
+		copy(dAtA[i:], m.Region)
+		i = encodeVarintPileup(dAtA, i, uint64(len(m.Region)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *StrandCounts) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *StrandCounts) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *StrandCounts) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Rev != 0 {
+		i = encodeVarintPileup(dAtA, i, uint64(m.Rev))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Fwd != 0 {
+		i = encodeVarintPileup(dAtA, i, uint64(m.Fwd))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *Position) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Position) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Position) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	{
+		size, err := m.Del.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintPileup(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x52
+	{
+		size, err := m.Ins.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintPileup(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x4a
+	{
+		size, err := m.N.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintPileup(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x42
+	{
+		size, err := m.T.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintPileup(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x3a
+	{
+		size, err := m.G.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintPileup(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x32
+	{
+		size, err := m.C.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintPileup(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x2a
+	{
+		size, err := m.A.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintPileup(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x22
+	if m.Depth != 0 {
+		i = encodeVarintPileup(dAtA, i, uint64(m.Depth))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Pos != 0 {
+		i = encodeVarintPileup(dAtA, i, uint64(m.Pos))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Chrom) > 0 {
+		i -= len(m.Chrom)
+		copy(dAtA[i:], m.Chrom)
+		i = encodeVarintPileup(dAtA, i, uint64(len(m.Chrom)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *GetPileupResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *GetPileupResponse) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *GetPileupResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Positions) > 0 {
+		for iNdEx := len(m.Positions) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Positions[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintPileup(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x12
+		}
+	}
+	if len(m.Region) > 0 {
+		i -= len(m.Region)
+		copy(dAtA[i:], m.Region)
+		i = encodeVarintPileup(dAtA, i, uint64(len(m.Region)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func encodeVarintPileup(dAtA []byte, offset int, v uint64) int {
+	offset -= sovPileup(v)
+	base := offset
+	for v >= 1<<7 {
+		dAtA[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	dAtA[offset] = uint8(v)
+	return base
+}
+func (m *PileupOptions) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.MapqOpt != nil {
+		n += m.MapqOpt.Size()
+	}
+	if m.MinBaseQualOpt != nil {
+		n += m.MinBaseQualOpt.Size()
+	}
+	if m.FlagExcludeOpt != nil {
+		n += m.FlagExcludeOpt.Size()
+	}
+	if m.ClipOpt != nil {
+		n += m.ClipOpt.Size()
+	}
+	if m.Indels {
+		n += 2
+	}
+	return n
+}
+
+func (m *PileupOptions_Mapq) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	n += 1 + sovPileup(uint64(m.Mapq))
+	return n
+}
+func (m *PileupOptions_MinBaseQual) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	n += 1 + sovPileup(uint64(m.MinBaseQual))
+	return n
+}
+func (m *PileupOptions_FlagExclude) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	n += 1 + sovPileup(uint64(m.FlagExclude))
+	return n
+}
+func (m *PileupOptions_Clip) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	n += 1 + sovPileup(uint64(m.Clip))
+	return n
+}
+func (m *GetPileupRequest) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Region)
+	if l > 0 {
+		n += 1 + l + sovPileup(uint64(l))
+	}
+	if m.Options != nil {
+		l = m.Options.Size()
+		n += 1 + l + sovPileup(uint64(l))
+	}
+	return n
+}
+
+func (m *StrandCounts) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Fwd != 0 {
+		n += 1 + sovPileup(uint64(m.Fwd))
+	}
+	if m.Rev != 0 {
+		n += 1 + sovPileup(uint64(m.Rev))
+	}
+	return n
+}
+
+func (m *Position) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Chrom)
+	if l > 0 {
+		n += 1 + l + sovPileup(uint64(l))
+	}
+	if m.Pos != 0 {
+		n += 1 + sovPileup(uint64(m.Pos))
+	}
+	if m.Depth != 0 {
+		n += 1 + sovPileup(uint64(m.Depth))
+	}
+	l = m.A.Size()
+	n += 1 + l + sovPileup(uint64(l))
+	l = m.C.Size()
+	n += 1 + l + sovPileup(uint64(l))
+	l = m.G.Size()
+	n += 1 + l + sovPileup(uint64(l))
+	l = m.T.Size()
+	n += 1 + l + sovPileup(uint64(l))
+	l = m.N.Size()
+	n += 1 + l + sovPileup(uint64(l))
+	l = m.Ins.Size()
+	n += 1 + l + sovPileup(uint64(l))
+	l = m.Del.Size()
+	n += 1 + l + sovPileup(uint64(l))
+	return n
+}
+
+func (m *GetPileupResponse) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Region)
+	if l > 0 {
+		n += 1 + l + sovPileup(uint64(l))
+	}
+	if len(m.Positions) > 0 {
+		for _, e := range m.Positions {
+			l = e.Size()
+			n += 1 + l + sovPileup(uint64(l))
+		}
+	}
+	return n
+}
+
+func sovPileup(x uint64) (n int) {
+	return (math_bits.Len64(x|1) + 6) / 7
+}
+func sozPileup(x uint64) (n int) {
+	return sovPileup(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+func (m *PileupOptions) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPileup
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: PileupOptions: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: PileupOptions: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Mapq", wireType)
+			}
+			var v int32
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.MapqOpt = &PileupOptions_Mapq{v}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinBaseQual", wireType)
+			}
+			var v int32
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.MinBaseQualOpt = &PileupOptions_MinBaseQual{v}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FlagExclude", wireType)
+			}
+			var v int32
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.FlagExcludeOpt = &PileupOptions_FlagExclude{v}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Clip", wireType)
+			}
+			var v int32
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ClipOpt = &PileupOptions_Clip{v}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Indels", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Indels = bool(v != 0)
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPileup(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *GetPileupRequest) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPileup
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: GetPileupRequest: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: GetPileupRequest: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Region", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Region = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Options", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Options == nil {
+				m.Options = &PileupOptions{}
+			}
+			if err := m.Options.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPileup(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *StrandCounts) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPileup
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: StrandCounts: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: StrandCounts: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Fwd", wireType)
+			}
+			m.Fwd = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Fwd |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Rev", wireType)
+			}
+			m.Rev = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Rev |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPileup(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Position) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPileup
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Position: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Position: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Chrom", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Chrom = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Pos", wireType)
+			}
+			m.Pos = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Pos |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Depth", wireType)
+			}
+			m.Depth = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Depth |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field A", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.A.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field C", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.C.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field G", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.G.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field T", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.T.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field N", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.N.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ins", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.Ins.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Del", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.Del.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPileup(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *GetPileupResponse) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPileup
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: GetPileupResponse: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: GetPileupResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Region", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Region = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Positions", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPileup
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Positions = append(m.Positions, Position{})
+			if err := m.Positions[len(m.Positions)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPileup(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthPileup
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func skipPileup(dAtA []byte) (n int, err error) {
+	l := len(dAtA)
+	iNdEx := 0
+	depth := 0
+	for iNdEx < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return 0, ErrIntOverflowPileup
+			}
+			if iNdEx >= l {
+				return 0, io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		wireType := int(wire & 0x7)
+		switch wireType {
+		case 0:
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return 0, ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return 0, io.ErrUnexpectedEOF
+				}
+				iNdEx++
+				if dAtA[iNdEx-1] < 0x80 {
+					break
+				}
+			}
+		case 1:
+			iNdEx += 8
+		case 2:
+			var length int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return 0, ErrIntOverflowPileup
+				}
+				if iNdEx >= l {
+					return 0, io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				length |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if length < 0 {
+				return 0, ErrInvalidLengthPileup
+			}
+			iNdEx += length
+		case 3:
+			depth++
+		case 4:
+			if depth == 0 {
+				return 0, ErrUnexpectedEndOfGroupPileup
+			}
+			depth--
+		case 5:
+			iNdEx += 4
+		default:
+			return 0, fmt.Errorf("proto: illegal wireType %d", wireType)
+		}
+		if iNdEx < 0 {
+			return 0, ErrInvalidLengthPileup
+		}
+		if depth == 0 {
+			return iNdEx, nil
+		}
+	}
+	return 0, io.ErrUnexpectedEOF
+}
+
+var (
+	ErrInvalidLengthPileup        = fmt.Errorf("proto: negative length found during unmarshaling")
+	ErrIntOverflowPileup          = fmt.Errorf("proto: integer overflow")
+	ErrUnexpectedEndOfGroupPileup = fmt.Errorf("proto: unexpected end of group")
+)
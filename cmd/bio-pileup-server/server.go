@@ -0,0 +1,308 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/cmd/bio-pileup-server/pileuppb"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/bio/pileup/snp"
+	"github.com/grailbio/hts/sam"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pileupFunc computes the pileup of the server's input with opts, passing
+// the rows to emit in position order; it is snp.StreamPileup, except in
+// tests.
+type pileupFunc func(ctx context.Context, opts *snp.Opts, emit func(*snp.Row) error) error
+
+// server serves the pileups of a single BAM/PAM/CRAM, over HTTP and gRPC.
+type server struct {
+	refs []*sam.Reference
+	// baseOpts are the options of every query, before the query parameters
+	// are applied.
+	baseOpts     snp.Opts
+	maxRegionLen int
+	cache        *regionCache
+	pileup       pileupFunc
+
+	// inflight dedupes identical concurrent queries, so that a burst of
+	// requests for a region that isn't cached yet, e.g. from several viewers
+	// of the same locus, computes its pileup once.  shared is the number of
+	// requests answered by another request's query.
+	inflight singleflight.Group
+	shared   int64
+}
+
+// pileupResponse is the JSON response of /pileup.
+type pileupResponse struct {
+	// Region is the queried region, in 1-based chrom:start-end form.
+	Region    string     `json:"region"`
+	Positions []position `json:"positions"`
+}
+
+// position is the pileup of a single position.  The counts are [forward,
+// reverse] pairs; see snp.Row for their definitions.
+type position struct {
+	Chrom string `json:"chrom"`
+	// Pos is 1-based.
+	Pos   int       `json:"pos"`
+	Depth uint32    `json:"depth"`
+	A     [2]uint32 `json:"A"`
+	C     [2]uint32 `json:"C"`
+	G     [2]uint32 `json:"G"`
+	T     [2]uint32 `json:"T"`
+	N     [2]uint32 `json:"N"`
+	// Ins and Del are only filled in with cols=indels.
+	Ins [2]uint32 `json:"ins"`
+	Del [2]uint32 `json:"del"`
+}
+
+// intParams are the integer query parameters of /pileup, and the
+// pileuppb.PileupOptions fields they set.
+var intParams = []struct {
+	name string
+	set  func(o *pileuppb.PileupOptions, v int32)
+}{
+	{"mapq", func(o *pileuppb.PileupOptions, v int32) { o.MapqOpt = &pileuppb.PileupOptions_Mapq{Mapq: v} }},
+	{"min-base-qual", func(o *pileuppb.PileupOptions, v int32) {
+		o.MinBaseQualOpt = &pileuppb.PileupOptions_MinBaseQual{MinBaseQual: v}
+	}},
+	{"flag-exclude", func(o *pileuppb.PileupOptions, v int32) {
+		o.FlagExcludeOpt = &pileuppb.PileupOptions_FlagExclude{FlagExclude: v}
+	}},
+	{"clip", func(o *pileuppb.PileupOptions, v int32) { o.ClipOpt = &pileuppb.PileupOptions_Clip{Clip: v} }},
+}
+
+// parseQuery converts the parameters of a /pileup query to the equivalent
+// GetPileup request.
+func parseQuery(params url.Values) (*pileuppb.GetPileupRequest, error) {
+	req := &pileuppb.GetPileupRequest{Region: params.Get("region"), Options: &pileuppb.PileupOptions{}}
+	for _, p := range intParams {
+		v := params.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s parameter %q", p.name, v)
+		}
+		p.set(req.Options, int32(n))
+	}
+	switch cols := params.Get("cols"); cols {
+	case "":
+	case "indels":
+		req.Options.Indels = true
+	default:
+		return nil, fmt.Errorf("invalid cols parameter %q (only indels is supported)", cols)
+	}
+	return req, nil
+}
+
+// parseRequest returns the options and normalized region of a GetPileup
+// request, and its cache key.
+func (s *server) parseRequest(req *pileuppb.GetPileupRequest) (opts snp.Opts, region string, key string, err error) {
+	opts = s.baseOpts
+	var entry interval.Entry
+	if entry, err = interval.ParseRegionString(req.Region); err != nil {
+		return
+	}
+	var ref *sam.Reference
+	for _, r := range s.refs {
+		if r.Name() == entry.RefName {
+			ref = r
+			break
+		}
+	}
+	if ref == nil {
+		err = fmt.Errorf("unknown reference %s", entry.RefName)
+		return
+	}
+	if entry.End > interval.PosType(ref.Len()) {
+		entry.End = interval.PosType(ref.Len())
+	}
+	if entry.Start0 >= entry.End {
+		err = fmt.Errorf("region %s is past the end of %s", req.Region, entry.RefName)
+		return
+	}
+	if n := int(entry.End - entry.Start0); n > s.maxRegionLen {
+		err = fmt.Errorf("region %s has %d positions, more than the limit of %d", req.Region, n, s.maxRegionLen)
+		return
+	}
+	region = fmt.Sprintf("%s:%d-%d", entry.RefName, entry.Start0+1, entry.End)
+	opts.Region = region
+	if o := req.Options; o != nil {
+		if o.MapqOpt != nil {
+			opts.Mapq = int(o.GetMapq())
+		}
+		if o.MinBaseQualOpt != nil {
+			opts.MinBaseQual = int(o.GetMinBaseQual())
+		}
+		if o.FlagExcludeOpt != nil {
+			opts.FlagExclude = int(o.GetFlagExclude())
+		}
+		if o.ClipOpt != nil {
+			opts.Clip = int(o.GetClip())
+		}
+		if o.Indels {
+			opts.Cols = "indels"
+		}
+	}
+	key = fmt.Sprintf("%s mapq=%d min-base-qual=%d flag-exclude=%d clip=%d cols=%s", region, opts.Mapq, opts.MinBaseQual, opts.FlagExclude, opts.Clip, opts.Cols)
+	return
+}
+
+// getPileup returns the response for region with opts, from the cache, from
+// an identical query in flight, or by computing it.  The query isn't bound to
+// ctx, since other requests may be waiting for it.
+func (s *server) getPileup(opts *snp.Opts, region, key string) (*pileupResponse, error) {
+	// ran is set if this request's own call ran the flight.
+	ran := false
+	v, err, shared := s.inflight.Do(key, func() (interface{}, error) {
+		ran = true
+		// The cache is checked in the flight, so that a request that just
+		// missed a finished flight finds its response in the cache.
+		if resp := s.cache.get(key); resp != nil {
+			return resp, nil
+		}
+		resp, err := s.query(context.Background(), opts, region)
+		if err != nil {
+			return nil, err
+		}
+		s.cache.put(key, resp)
+		return resp, nil
+	})
+	if shared && !ran {
+		atomic.AddInt64(&s.shared, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*pileupResponse), nil
+}
+
+// query computes the response for region with opts.
+func (s *server) query(ctx context.Context, opts *snp.Opts, region string) (*pileupResponse, error) {
+	resp := &pileupResponse{Region: region, Positions: []position{}}
+	err := s.pileup(ctx, opts, func(row *snp.Row) error {
+		counts := &row.Counts
+		resp.Positions = append(resp.Positions, position{
+			Chrom: row.RefName,
+			Pos:   int(row.Pos) + 1,
+			Depth: row.Depth,
+			A:     counts[pileup.BaseA],
+			C:     counts[pileup.BaseC],
+			G:     counts[pileup.BaseG],
+			T:     counts[pileup.BaseT],
+			N:     counts[pileup.BaseX],
+			Ins:   row.InsCounts,
+			Del:   row.DelCounts,
+		})
+		return nil
+	})
+	return resp, err
+}
+
+// handlePileup serves GET /pileup?region=<region>[&<param>=<value>...]; see
+// doc.go.
+func (s *server) handlePileup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, region, key, err := s.parseRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.getPileup(&opts, region, key)
+	if err != nil {
+		log.Error.Printf("bio-pileup-server: %s: %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error.Printf("bio-pileup-server: %s: writing response: %v", key, err)
+	}
+}
+
+// GetPileup implements pileuppb.PileupServer.
+func (s *server) GetPileup(ctx context.Context, req *pileuppb.GetPileupRequest) (*pileuppb.GetPileupResponse, error) {
+	opts, region, key, err := s.parseRequest(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp, err := s.getPileup(&opts, region, key)
+	if err != nil {
+		log.Error.Printf("bio-pileup-server: %s: %v", key, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	pb := &pileuppb.GetPileupResponse{Region: resp.Region, Positions: make([]pileuppb.Position, len(resp.Positions))}
+	strandCounts := func(c [2]uint32) pileuppb.StrandCounts {
+		return pileuppb.StrandCounts{Fwd: c[0], Rev: c[1]}
+	}
+	for i, p := range resp.Positions {
+		pb.Positions[i] = pileuppb.Position{
+			Chrom: p.Chrom,
+			Pos:   int32(p.Pos),
+			Depth: p.Depth,
+			A:     strandCounts(p.A),
+			C:     strandCounts(p.C),
+			G:     strandCounts(p.G),
+			T:     strandCounts(p.T),
+			N:     strandCounts(p.N),
+			Ins:   strandCounts(p.Ins),
+			Del:   strandCounts(p.Del),
+		}
+	}
+	return pb, nil
+}
+
+// handleStats serves GET /stats, the cache hit and miss counts, the number of
+// cached positions, and the number of requests that shared another's query.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	hits, misses, positions := s.cache.stats()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{
+		"cache_hits":      hits,
+		"cache_misses":    misses,
+		"cache_positions": int64(positions),
+		"shared_queries":  atomic.LoadInt64(&s.shared),
+	})
+}
+
+// handler returns the server's http.Handler.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pileup", s.handlePileup)
+	mux.HandleFunc("/stats", s.handleStats)
+	return mux
+}
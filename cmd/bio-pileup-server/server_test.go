@@ -0,0 +1,253 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/bio/cmd/bio-pileup-server/pileuppb"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/bio/pileup/snp"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegionCache(t *testing.T) {
+	c := newRegionCache(2, 100)
+	a, b, d := &pileupResponse{Region: "a"}, &pileupResponse{Region: "b"}, &pileupResponse{Region: "d"}
+	c.put("a", a)
+	c.put("b", b)
+	assert.True(t, c.get("a") == a)
+	// "b" is now the least recently used.
+	c.put("d", d)
+	assert.True(t, c.get("b") == nil)
+	assert.True(t, c.get("a") == a)
+	assert.True(t, c.get("d") == d)
+	hits, misses, _ := c.stats()
+	assert.EQ(t, hits, int64(3))
+	assert.EQ(t, misses, int64(1))
+
+	c = newRegionCache(0, 100)
+	c.put("a", a)
+	assert.True(t, c.get("a") == nil)
+
+	// The least recently used responses are evicted until a new one fits in
+	// the positions bound.
+	sized := func(n int) *pileupResponse {
+		return &pileupResponse{Positions: make([]position, n)}
+	}
+	c = newRegionCache(10, 100)
+	r40, r30, r50 := sized(40), sized(30), sized(50)
+	c.put("40", r40)
+	c.put("30", r30)
+	assert.True(t, c.get("40") == r40)
+	c.put("50", r50)
+	assert.True(t, c.get("30") == nil)
+	assert.True(t, c.get("40") == r40)
+	_, _, positions := c.stats()
+	assert.EQ(t, positions, 90)
+	c.put("60", sized(60))
+	assert.True(t, c.get("50") == nil)
+	assert.True(t, c.get("40") == r40)
+	_, _, positions = c.stats()
+	assert.EQ(t, positions, 100)
+	// Replacing a response updates the count.
+	c.put("60", sized(20))
+	_, _, positions = c.stats()
+	assert.EQ(t, positions, 60)
+	// A response larger than the bound isn't cached, and evicts nothing.
+	c.put("101", sized(101))
+	assert.True(t, c.get("101") == nil)
+	_, _, positions = c.stats()
+	assert.EQ(t, positions, 60)
+}
+
+// newTestServer returns a server of a 1000-base chr1, whose pileups have a
+// single row, at position 10.  The options of the queries are appended to
+// *queries.
+func newTestServer(t *testing.T, queries *[]snp.Opts) *server {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	return &server{
+		refs:         header.Refs(),
+		baseOpts:     snp.DefaultOpts,
+		maxRegionLen: 100,
+		cache:        newRegionCache(4, 1000),
+		pileup: func(ctx context.Context, opts *snp.Opts, emit func(*snp.Row) error) error {
+			*queries = append(*queries, *opts)
+			row := snp.Row{RefName: "chr1", Pos: 9, Depth: 3}
+			row.Counts[pileup.BaseG] = [2]uint32{2, 1}
+			row.InsCounts = [2]uint32{0, 1}
+			return emit(&row)
+		},
+	}
+}
+
+func TestServer(t *testing.T) {
+	var queries []snp.Opts
+	s := newTestServer(t, &queries)
+	h := s.handler()
+	get := func(url string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/pileup?region=chr1:10-20&mapq=20")
+	assert.EQ(t, code, http.StatusOK)
+	var resp pileupResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.EQ(t, resp, pileupResponse{
+		Region:    "chr1:10-20",
+		Positions: []position{{Chrom: "chr1", Pos: 10, Depth: 3, G: [2]uint32{2, 1}, Ins: [2]uint32{0, 1}}},
+	})
+	assert.EQ(t, len(queries), 1)
+	assert.EQ(t, queries[0].Region, "chr1:10-20")
+	assert.EQ(t, queries[0].Mapq, 20)
+
+	// The same query is served from the cache, but a different mapq isn't.
+	code, _ = get("/pileup?mapq=20&region=chr1:10-20")
+	assert.EQ(t, code, http.StatusOK)
+	assert.EQ(t, len(queries), 1)
+	code, _ = get("/pileup?region=chr1:10-20")
+	assert.EQ(t, code, http.StatusOK)
+	assert.EQ(t, len(queries), 2)
+	assert.EQ(t, queries[1].Mapq, snp.DefaultOpts.Mapq)
+
+	// The region is clipped to the reference.
+	code, body = get("/pileup?region=chr1:950-2000")
+	assert.EQ(t, code, http.StatusOK)
+	assert.HasSubstr(t, body, `"region":"chr1:950-1000"`)
+
+	for _, tc := range []struct {
+		url, err string
+	}{
+		{"/pileup", "empty region"},
+		{"/pileup?region=chr2:1-10", "unknown reference chr2"},
+		{"/pileup?region=chr1:1-101", "more than the limit of 100"},
+		{"/pileup?region=chr1", "more than the limit of 100"},
+		{"/pileup?region=chr1:1001-1010", "past the end of chr1"},
+		{"/pileup?region=chr1:1-10&mapq=x", "invalid mapq parameter"},
+		{"/pileup?region=chr1:1-10&cols=quals", "invalid cols parameter"},
+	} {
+		code, body = get(tc.url)
+		assert.EQ(t, code, http.StatusBadRequest, tc.url)
+		assert.HasSubstr(t, body, tc.err)
+	}
+}
+
+func TestGetPileup(t *testing.T) {
+	var queries []snp.Opts
+	s := newTestServer(t, &queries)
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	gs := grpc.NewServer()
+	pileuppb.RegisterPileupServer(gs, s)
+	go func() { _ = gs.Serve(lis) }()
+	defer gs.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, conn.Close()) }()
+	client := pileuppb.NewPileupClient(conn)
+	ctx := context.Background()
+
+	resp, err := client.GetPileup(ctx, &pileuppb.GetPileupRequest{
+		Region: "chr1:10-20",
+		Options: &pileuppb.PileupOptions{
+			MapqOpt: &pileuppb.PileupOptions_Mapq{Mapq: 0},
+			Indels:  true,
+		},
+	})
+	assert.NoError(t, err)
+	assert.EQ(t, *resp, pileuppb.GetPileupResponse{
+		Region: "chr1:10-20",
+		Positions: []pileuppb.Position{{
+			Chrom: "chr1", Pos: 10, Depth: 3,
+			G:   pileuppb.StrandCounts{Fwd: 2, Rev: 1},
+			Ins: pileuppb.StrandCounts{Rev: 1},
+		}},
+	})
+	assert.EQ(t, len(queries), 1)
+	// An explicit 0 overrides the default.
+	assert.EQ(t, queries[0].Mapq, 0)
+	assert.EQ(t, queries[0].MinBaseQual, snp.DefaultOpts.MinBaseQual)
+	assert.EQ(t, queries[0].Cols, "indels")
+
+	// The gRPC and HTTP interfaces share the cache.
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pileup?region=chr1:10-20&mapq=0&cols=indels", nil))
+	assert.EQ(t, w.Code, http.StatusOK)
+	assert.EQ(t, len(queries), 1)
+
+	_, err = client.GetPileup(ctx, &pileuppb.GetPileupRequest{Region: "chr2:1-10"})
+	assert.EQ(t, status.Code(err), codes.InvalidArgument)
+	assert.HasSubstr(t, err.Error(), "unknown reference chr2")
+}
+
+func TestSharedQueries(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries []snp.Opts
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	s := newTestServer(t, &queries)
+	emitRow := s.pileup
+	s.pileup = func(ctx context.Context, opts *snp.Opts, emit func(*snp.Row) error) error {
+		close(started)
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		return emitRow(ctx, opts, emit)
+	}
+	const n = 4
+	var (
+		wg    sync.WaitGroup
+		resps [n]*pileuppb.GetPileupResponse
+		errs  [n]error
+	)
+	get := func(i int) {
+		defer wg.Done()
+		resps[i], errs[i] = s.GetPileup(context.Background(), &pileuppb.GetPileupRequest{Region: "chr1:10-20"})
+	}
+	wg.Add(n)
+	go get(0)
+	<-started
+	// The other requests either wait for the first one's query, or, if they
+	// start after it finished, hit the cache: the pileup is computed once.
+	for i := 1; i < n; i++ {
+		go get(i)
+	}
+	close(release)
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		assert.NoError(t, errs[i])
+		assert.EQ(t, resps[i], resps[0])
+	}
+	assert.EQ(t, len(queries), 1)
+	hits, misses, _ := s.cache.stats()
+	assert.EQ(t, misses, int64(1))
+	assert.EQ(t, hits+s.shared, int64(n-1))
+}
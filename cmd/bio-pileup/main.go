@@ -15,7 +15,9 @@ package main
 
 /*
 bio-pileup is a variant calling tool which reports the number of reads in a
-BAM/PAM supporting each allele at each genomic position.
+BAM/PAM/CRAM supporting each allele at each genomic position.  CRAM input is
+decoded against fapath.  fapath may also be a .2bit file, or an indexed FASTA
+or .2bit file behind an http(s):// URL, which is read with range requests.
 */
 
 import (
@@ -28,16 +30,20 @@ import (
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/pileup/snp"
+	"github.com/grailbio/bio/util/flaghelp"
+	"github.com/grailbio/bio/util/progress"
 )
 
 var (
 	bedPath      = flag.String("bed", snp.DefaultOpts.BedPath, "Input BED path; this xor -region required")
 	region       = flag.String("region", snp.DefaultOpts.Region, "Restrict pileup computation to the specified region. Format as <contig ID>:<1-based first pos>-<last pos>, <contig ID>:<1-based pos>, or just <contig ID>; this xor -bed required")
-	bamIndexPath = flag.String("index", snp.DefaultOpts.BamIndexPath, "Input BAM index path. Defaults to bampath + .bai")
+	pad          = flag.Int("pad", snp.DefaultOpts.Pad, "Extend each -bed interval by this many positions on both sides")
+	bedOverrides = flag.Bool("bed-overrides", snp.DefaultOpts.BedOverrides, "Read per-interval thresholds from the -bed columns after the third: min_bq=<n>, min_mapq=<n> and max_depth=<n> tokens override -min-base-qual, -mapq and -max-depth within the interval (the shortest interval applies where they overlap)")
+	bamIndexPath = flag.String("index", snp.DefaultOpts.BamIndexPath, "Input BAM or CRAM index path. Defaults to bampath + .bai (.crai for CRAM)")
 	clip         = flag.Int("clip", snp.DefaultOpts.Clip, "Number of bases on end of each read to treat as minimum-quality")
-	cols         = flag.String("cols", snp.DefaultOpts.Cols, "Output TSV column sets. #CHROM/POS/REF(/ALT) are always present. Currently supported optional sets are 'dpref', 'dpalt', 'enddists', 'quals', 'fraglens', 'strands', 'highq', and 'lowq'; default is \"dpref,highq,lowq\"")
+	cols         = flag.String("cols", snp.DefaultOpts.Cols, "Output TSV column sets. #CHROM/POS/REF(/ALT) are always present. Currently supported optional sets are 'dpref', 'dpalt', 'enddists', 'quals', 'fraglens', 'strands', 'highq', 'lowq', 'indels', 'biasstats' (strand- and position-bias statistics per ALT allele), 'qualweights' (base-quality-weighted depths), 'sketch' (read count, and means and quartiles of the per-read features), 'extbases' (deleted-base, insertion-following and modified-base counts; basestrand-tsv only), and 'hapcounts' (depths split by HP/PS haplotype tag, for allele-specific expression); default is \"dpref,highq,lowq\"")
 	flagExclude  = flag.Int("flag-exclude", snp.DefaultOpts.FlagExclude, "Reads with a FLAG bit intersecting this value are skipped")
-	format       = flag.String("format", "tsv", "Output format; 'basestrand-rio', 'basestrand-tsv', 'basestrand-tsv-bgz', 'tsv', and 'tsv-bgz' supported")
+	format       = flag.String("format", "tsv", "Output format; 'basestrand-rio', 'basestrand-tsv', 'basestrand-tsv-bgz', 'basestrand-tsv-zst', 'tsv', 'tsv-bgz', 'tsv-zst', 'consensus-fastq', 'vcf', 'vcf-bgz', 'mpileup', 'mpileup-bgz', 'gvcf', 'gvcf-bgz', and 'parquet' supported.  gvcf output has diploid genotype likelihoods computed from the base qualities, and GQ-banded reference blocks (see -gq-bands); it requires -stitch=false.  The -zst formats use the seekable zstd format, which supports random access like bgzf")
 	mapq         = flag.Int("mapq", snp.DefaultOpts.Mapq, "Reads with MAPQ below this level are skipped")
 	maxReadLen   = flag.Int("max-read-len", snp.DefaultOpts.MaxReadLen, "Upper bound on individual read length")
 	maxReadSpan  = flag.Int("max-read-span", snp.DefaultOpts.MaxReadSpan, "Upper bound on size of reference-genome region a read maps to")
@@ -49,33 +55,132 @@ var (
 	removeSq     = flag.Bool("remove-sq", snp.DefaultOpts.RemoveSq, "Remove sequencing duplicates (no DL aux tag with value > 1)")
 	stitch       = flag.Bool("stitch", snp.DefaultOpts.Stitch, "Stitch read-pairs")
 	tempDir      = flag.String("temp-dir", snp.DefaultOpts.TempDir, "Directory to write temporary files to (default os.TempDir())")
+
+	skipDiskCheck = flag.Bool("skip-disk-check", snp.DefaultOpts.SkipDiskCheck, "Don't fail early when the estimated scratch/output size exceeds the free space on -temp-dir/-out")
+	shardRetries  = flag.Int("shard-retries", snp.DefaultOpts.ShardRetries, "Number of times to rerun a failed parallel job")
+	quarantine    = flag.Bool("quarantine", snp.DefaultOpts.Quarantine, "If a parallel job fails every retry, list its region in <out>.quarantine.tsv and complete the rest of the run instead of failing")
+	timeBudget    = flag.Duration("time-budget", snp.DefaultOpts.TimeBudget, "If positive, stop starting new shards after this much time, write the output of the completed shards, and list the unprocessed regions in <out>.unprocessed.bed (see <out>.partial.tsv)")
+	minAltFrac    = flag.Float64("min-alt-frac", snp.DefaultOpts.MinAltFrac, "Minimum fraction of high-quality bases supporting an allele for it to be reported as ALT in vcf output")
+	minDepth      = flag.Int("min-depth", snp.DefaultOpts.MinDepth, "Leave positions with a lower depth out of the output")
+	minAltCount   = flag.Int("min-alt-count", snp.DefaultOpts.MinAltCount, "Leave positions without a non-reference allele with at least this many high-quality bases out of the output")
+	positions     = flag.String("positions", snp.DefaultOpts.Positions, "BED file, or .vcf file, of the positions to keep in the output")
+
+	window      = flag.Int("window", snp.DefaultOpts.WindowSize, "If positive, write one line of summary statistics per window of this many positions instead of one line per position (tsv and basestrand-tsv formats only)")
+	windowStep  = flag.Int("window-step", snp.DefaultOpts.WindowStep, "Distance between the starts of consecutive windows (default -window, i.e. non-overlapping)")
+	windowStats = flag.String("window-stats", snp.DefaultOpts.WindowStats, "Comma-separated list of per-window statistics to report (default all)")
+
+	auditBoundaries = flag.Bool("audit-boundaries", snp.DefaultOpts.AuditBoundaries, "Debugging mode: recompute the positions near shard boundaries without sharding, write differences to <out>.boundary_audit.tsv, and fail if there are any")
+
+	unmappedReads     = flag.String("unmapped-reads", snp.DefaultOpts.UnmappedReads, "Policy for unmapped reads with a position: drop or error (default drop)")
+	mateUnmappedReads = flag.String("mate-unmapped-reads", snp.DefaultOpts.MateUnmappedReads, "Policy for reads whose mate is unmapped: keep, drop, or error (default keep)")
+	zeroMapqReads     = flag.String("zero-mapq-reads", snp.DefaultOpts.ZeroMapqReads, "Policy for MAPQ-0 reads: keep (still subject to -mapq), drop, or error (default keep)")
+
+	downsample         = flag.Float64("downsample", snp.DefaultOpts.DownsampleFrac, "If in (0, 1), keep only this fraction of fragments, sampled within fragment-length bins to preserve the fragment-length distribution")
+	downsampleBinWidth = flag.Int("downsample-bin-width", snp.DefaultOpts.DownsampleBinWidth, "Width of the -downsample fragment-length bins (default 10)")
+	endMotifWeights    = flag.String("end-motif-weights", snp.DefaultOpts.EndMotifWeights, "Path of a table of <4-mer>\t<weight> lines, with weights in [0, 1]; each fragment is kept with probability equal to the product of the weights of its reference end motifs, to correct end-motif biases (unlisted motifs get weight 1)")
+	readFilter         = flag.String("read-filter", snp.DefaultOpts.ReadFilter, "Boolean expression which each read must satisfy to be counted, e.g. 'qual>=20 && mapq>=30 && !dup && fraglen<600'; fields are mapq, qual (mean base quality), fraglen, len and span, flags are paired, proper, unmapped, mateunmapped, reverse, matereverse, read1, read2, secondary, qcfail, dup and supplementary")
+	dedup              = flag.String("dedup", snp.DefaultOpts.Dedup, "Detect duplicate fragments on the fly, by 5' positions and strands: 'collapse' keeps one fragment per duplicate set, 'downweight' keeps about 1 + ln(n) of a set of n (default none)")
+	dedupUMITag        = flag.String("dedup-umi-tag", snp.DefaultOpts.DedupUMITag, "Aux tag of the UMI (e.g. RX) to include in the -dedup grouping key")
+	umiConsensusTag    = flag.String("umi-consensus-tag", snp.DefaultOpts.UMIConsensusTag, "If set, aux tag of the UMI (e.g. RX or BX); the reads of each UMI family are collapsed into a consensus read before counting, and reads without the tag are dropped")
+	umiMinFamilySize   = flag.Int("umi-min-family-size", snp.DefaultOpts.UMIMinFamilySize, "Minimum number of reads of a -umi-consensus-tag family for its consensus to be counted (default 1)")
+
+	activeRegions       = flag.Bool("active-regions", snp.DefaultOpts.ActiveRegions, "Locally reassemble the regions where many reads disagree with the reference, and realign the reads spanning them to the assembled haplotypes before counting")
+	activeRegionMinFrac = flag.Float64("active-region-min-frac", snp.DefaultOpts.ActiveRegionMinFrac, "Minimum fraction of reads with a mismatch, indel or soft clip at an -active-regions position (default 0.1)")
+
+	maxDepth     = flag.Int("max-depth", snp.DefaultOpts.MaxDepth, "If positive, maximum number of reads covering a position; the reads starting at each position are reservoir-sampled to stay within it")
+	maxDepthMode = flag.String("max-depth-mode", snp.DefaultOpts.MaxDepthMode, "'position' samples the -max-depth reads independently, while 'fragment' gives both reads of a pair the same decision (default position)")
+	sketchDepth  = flag.Int("sketch-depth", snp.DefaultOpts.SketchDepth, "If positive, maximum number of reads per base and position whose per-read features are kept; beyond it, the features are reservoir-sampled, and the read count and feature means of the 'sketch' column set stay exact")
+	circularRefs = flag.String("circular", snp.DefaultOpts.Circular, "Comma-separated list of circular contigs (e.g. chrM); the bases of reads aligned past the end of one of them are counted from its position 0")
+	seed         = flag.Int64("seed", snp.DefaultOpts.Seed, "Seed of the random sampling of -max-depth, -sketch-depth, -downsample and -end-motif-weights; each shard draws from its own source derived from the seed, so the sampled reads don't depend on -parallelism")
+
+	shardCodec      = flag.String("shard-codec", snp.DefaultOpts.ShardCodec, "Compression codec for the intermediate per-shard files: zstd[:level], lz4, snappy, or none (default zstd:1)")
+	shardBlockItems = flag.Int("shard-block-items", snp.DefaultOpts.ShardBlockItems, "Maximum number of positions per compressed block of the intermediate per-shard files (default recordio's)")
+	memoryBudgetMiB = flag.Int("memory-budget-mib", snp.DefaultOpts.MemoryBudgetMiB, "If positive, bound the memory (in MiB) held by finished rows waiting for their -shard-block-items block, mostly per-read features at high depth: over it, the jobs write their pending rows early, and release the per-read buffers of the written positions")
+	shardSchedule   = flag.String("shard-schedule", snp.DefaultOpts.ShardSchedule, "How the genome is split between the parallel jobs: 'balanced' gives each job an equal part of the genome, while 'contig' moves the job boundaries to contig boundaries where possible, for reference and index locality, and 'targets' only covers the (padded) -bed intervals, skipping untargeted references entirely (default targets with -bed, balanced otherwise)")
+
+	shardPlan    = flag.String("shard-plan", snp.DefaultOpts.ShardPlan, "Path of a -shard-plan-out file from an earlier run on the same references; its shards are reused, and split between the jobs according to their recorded times")
+	shardPlanOut = flag.String("shard-plan-out", snp.DefaultOpts.ShardPlanOut, "Path to write the run's shards, with the time spent on each, as JSON (may be the same as -shard-plan)")
+
+	parquetRowGroupSize = flag.Int("parquet-row-group-size", snp.DefaultOpts.ParquetRowGroupSize, "Number of positions per row group of the parquet output format (default 1048576)")
+	outputIndex         = flag.String("output-index", snp.DefaultOpts.OutputIndex, "Index to write next to each output file of a -bgz format, for region queries with tabix: 'tbi' or 'csi' (needed for contigs over 512 Mbp)")
+
+	depthHistogram = flag.Bool("depth-histogram", snp.DefaultOpts.DepthHistogram, "Also write the depth histogram and cumulative coverage curve, overall and per BED interval, to <out>.depth_hist.tsv and <out>.depth_hist.json")
+	metrics        = flag.String("metrics", snp.DefaultOpts.Metrics, "QC report to write: 'json', 'tsv' or 'json,tsv', for <out>.metrics.json and/or <out>.metrics.tsv, with the coverage histogram, per-BED-interval depth percentiles, Q30 base fraction, strand balance and filtered-read counts")
+	haplotypeSites = flag.String("haplotype-sites", snp.DefaultOpts.HaplotypeSites, "Path of a BED file of short loci (2-8 bp, e.g. CpG sites); the haplotype of each read across each locus is counted, and written to <out>.haplotypes.tsv")
+
+	hetSites               = flag.String("het-sites", snp.DefaultOpts.HetSites, "Path of a BED file of the sample's heterozygous sites; the two reads of each overlapping pair are compared at these sites, and the concordance counts are written to <out>.mate_concordance.tsv.  Requires -stitch or -clip-overlap")
+	excludeDiscordantPairs = flag.Bool("exclude-discordant-pairs", snp.DefaultOpts.ExcludeDiscordantPairs, "Leave the overlapping pairs which disagree at any -het-sites site out of the pileup")
+
+	requireProperPair = flag.Bool("require-proper-pair", snp.DefaultOpts.RequireProperPair, "Only count reads with the proper-pair flag")
+	maxInsertSize     = flag.Int("max-insert-size", snp.DefaultOpts.MaxInsertSize, "If positive, don't count paired reads with |TLEN| above this, or with a mate on another reference")
+	clipOverlap       = flag.Bool("clip-overlap", snp.DefaultOpts.ClipOverlap, "Where the two reads of a pair overlap, only count the higher-quality base; incompatible with -stitch")
+
+	longRead          = flag.Bool("long-read", snp.DefaultOpts.LongRead, "Long-read (PacBio/ONT) mode: reads are unpaired and counted on the strand they are aligned to; incompatible with -stitch, -clip-overlap, -require-proper-pair and -max-insert-size.  -max-read-len and -max-read-span usually need to be raised")
+	minReadIdentity   = flag.Float64("min-read-identity", snp.DefaultOpts.MinReadIdentity, "With -long-read, minimum alignment identity (1 - NM / alignment columns) of a counted read")
+	homopolymerIndels = flag.Bool("homopolymer-indels", snp.DefaultOpts.HomopolymerIndels, "With -long-read, move each indel which lengthens or shortens a reference homopolymer to the position before it, so that they are counted as one allele")
+
+	baq         = flag.Bool("baq", snp.DefaultOpts.BAQ, "Cap the base qualities by their BAQ (base alignment quality), computed like samtools by realigning each read to the local reference, or taken from the read's BQ tag if it has one; reduces false SNVs around indels.  Incompatible with -long-read")
+	recomputeNM = flag.Bool("recompute-nm", snp.DefaultOpts.RecomputeNM, "Compute the read edit distances (the readfeats NM column, and the -long-read identity) from the alignment and the reference instead of the reads' NM tags, for aligners which omit them or use a different reference; requires -cols readfeats or -long-read")
+
+	annotate       = flag.String("annotate", snp.DefaultOpts.Annotate, "Gene annotation file to annotate the output with, as gtf=<path> or gff3=<path>; the names of the genes whose gene, exon and CDS features overlap each position are added as GENES/EXONS/CDS columns (tsv) or INFO fields (vcf)")
+	kmerUniqueness = flag.Int("kmer-uniqueness", snp.DefaultOpts.KmerUniqueness, "If positive, k-mer length (at most 32) of the REF_KMER_COPIES and ALT_KMER_HITS INFO fields of the vcf records with ALT alleles: how often the k-mers overlapping the position occur in the reference, and how many of them occur elsewhere in the reference with the ALT base, a sign of mismapped reads")
+	gqBands        = flag.String("gq-bands", snp.DefaultOpts.GQBands, "Increasing comma-separated list of the GQ values at which the reference-block bands of gvcf output start (default 10,20,30,40,50,60); adjacent positions whose GQs fall in the same band are merged into one block")
+	hotspots       = flag.String("hotspots", snp.DefaultOpts.Hotspots, "Hotspot list (tsv with CHROM, POS, REF, ALT and optional NAME columns, or .vcf) of single-base substitutions.  The hotspot positions replace bed= and region=, and <out>.hotspots.tsv reports the counts, allele fraction and status of every hotspot")
+	methylation    = flag.String("methylation", snp.DefaultOpts.Methylation, "Comma-separated list of the cytosine contexts (CG, CHG, CHH, or all) of a bisulfite/EM-seq methylation report: the converted (T) and unconverted (C) reads of each cytosine's strand are counted, and written to <out>.CX_report.txt (Bismark coverage2cytosine format) and <out>.methylation.bedGraph.  Reads with an undefined strand are left out of the pileup")
+	modBase        = flag.String("mod-base", snp.DefaultOpts.ModBase, "Comma-separated list of the base modifications (5mC, 5hmC and 6mA), each optionally followed by =<probability threshold> (default 0.66), whose calls in the reads' MM/ML tags are counted and written to <out>.<modification>.bed, in the bedMethyl format of modbam2bed")
+	somatic        = flag.Bool("somatic", snp.DefaultOpts.Somatic, "With two inputs, the tumor and the normal, append the ALT, TUMOR_AF, NORMAL_AF, TLOD, NLOD and STATUS somatic scoring columns to the multi-sample table")
+	columns        = flag.String("columns", snp.DefaultOpts.Columns, "Comma-separated list of the columns to write, in order, to the tsv, basestrand-tsv and parquet outputs, each optionally renamed as <column>=<new name> (e.g. CHROM=chrom,POS,DP=depth); defaults to all of the columns of -cols")
+
+	fragmentomicsWindow = flag.Int("fragmentomics-window", snp.DefaultOpts.FragmentomicsWindow, "If positive, also write cfDNA fragmentomics features (fragment size ratios, read end counts, and 4-mer end motifs) per window of this many positions to <out>.fragmentomics.parquet, and per-position read end counts to <out>.fragment_ends.parquet")
+	wpsWindow           = flag.Int("wps-window", snp.DefaultOpts.WPSWindow, "If positive, also write the windowed protection score of each position, computed from the 120-180bp fragments with a protection window of this many positions (120 is typical), to <out>.wps.bw; requires -fragmentomics-window")
+
+	resume = flag.Bool("resume", snp.DefaultOpts.Resume, "Checkpoint the main loop under -temp-dir, and if an identical earlier run was interrupted, only recompute its unfinished tasks")
+
+	maxReadMiBPerSec = flag.Float64("max-read-mib-per-sec", snp.DefaultOpts.MaxReadMiBPerSec, "If positive, limit the combined read bandwidth of the inputs to this many MiB/s, to leave room for the other users of shared storage (NFS, S3); the input throughput is logged with the progress every minute")
+	maxReadOpsPerSec = flag.Int("max-read-ops-per-sec", snp.DefaultOpts.MaxReadOpsPerSec, "If positive, limit the combined read operations per second of the inputs")
+
+	progressSinks = flag.String("progress", "", "Comma-separated list of the sinks of the main loop's progress events (per-shard and overall throughput, ETA, and memory high-water mark): 'log', 'json:<path>' (one JSON object per line), and 'http:<addr>' (Prometheus metrics at http://<addr>/metrics and expvar at /debug/vars)")
 )
 
 func bioPileupUsage() {
-	fmt.Printf("Usage: %s [OPTIONS] {b,p}ampath fapath\n", os.Args[0])
+	fmt.Printf("Usage: %s [OPTIONS] {b,p}ampath [{b,p}ampath...] fapath\n", os.Args[0])
+	fmt.Printf("With multiple {b,p}ampaths, a single basestrand-tsv table with per-sample columns is written to <out>.samples.tsv.\n")
 	fmt.Printf("Other options:\n")
 	flag.PrintDefaults()
 }
 
 func main() {
 	flag.Usage = bioPileupUsage
+	cmd := &flaghelp.Command{
+		Name:     "bio-pileup",
+		Short:    "Report per-position allele counts in a BAM/PAM/CRAM",
+		ArgsName: "{b,p}ampath [{b,p}ampath...] fapath",
+		Flags:    flag.CommandLine,
+	}
+	flaghelp.SetValues(flag.CommandLine, "format", snp.FormatNames()...)
+	flaghelp.SetListValues(flag.CommandLine, "cols", snp.ColNames()...)
+	flaghelp.SetListValues(flag.CommandLine, "window-stats", snp.WindowStatNames()...)
+	flaghelp.Register(cmd)
 	shutdown := grail.Init()
 	defer shutdown()
+	flaghelp.Handle(cmd)
 
 	allArgs := flag.Args()
 	nPositionalArgs := flag.NArg()
 	positionalArgs := allArgs[len(allArgs)-nPositionalArgs:]
-	if nPositionalArgs != 2 {
-		if nPositionalArgs < 2 {
-			log.Fatalf("Missing positional arguments ({b,p}ampath and fapath required); please check flag syntax: '%s'", strings.Join(positionalArgs, " "))
-		} else {
-			log.Fatalf("Too many positional arguments (only {b,p}ampath and fapath expected); please check flag syntax: '%s'", strings.Join(positionalArgs, " "))
-		}
+	if nPositionalArgs < 2 {
+		log.Fatalf("Missing positional arguments ({b,p}ampath and fapath required); please check flag syntax: '%s'", strings.Join(positionalArgs, " "))
 	}
 	ctx := vcontext.Background()
+	sinks, sinkCloser, err := progress.NewSinks(ctx, *progressSinks)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	opts := snp.Opts{
 		BedPath:      *bedPath,
 		Region:       *region,
+		Pad:          *pad,
+		BedOverrides: *bedOverrides,
 		BamIndexPath: *bamIndexPath,
 		Clip:         *clip,
 		Cols:         *cols,
@@ -90,8 +195,103 @@ func main() {
 		RemoveSq:     *removeSq,
 		Stitch:       *stitch,
 		TempDir:      *tempDir,
+
+		SkipDiskCheck: *skipDiskCheck,
+		ShardRetries:  *shardRetries,
+		Quarantine:    *quarantine,
+		TimeBudget:    *timeBudget,
+		MinAltFrac:    *minAltFrac,
+		MinDepth:      *minDepth,
+		MinAltCount:   *minAltCount,
+		Positions:     *positions,
+
+		WindowSize:  *window,
+		WindowStep:  *windowStep,
+		WindowStats: *windowStats,
+
+		AuditBoundaries: *auditBoundaries,
+
+		UnmappedReads:     *unmappedReads,
+		MateUnmappedReads: *mateUnmappedReads,
+		ZeroMapqReads:     *zeroMapqReads,
+
+		DownsampleFrac:     *downsample,
+		DownsampleBinWidth: *downsampleBinWidth,
+		EndMotifWeights:    *endMotifWeights,
+		ReadFilter:         *readFilter,
+		Dedup:              *dedup,
+		DedupUMITag:        *dedupUMITag,
+		UMIConsensusTag:    *umiConsensusTag,
+		UMIMinFamilySize:   *umiMinFamilySize,
+
+		ActiveRegions:       *activeRegions,
+		ActiveRegionMinFrac: *activeRegionMinFrac,
+
+		MaxDepth:     *maxDepth,
+		MaxDepthMode: *maxDepthMode,
+		SketchDepth:  *sketchDepth,
+		Circular:     *circularRefs,
+		Seed:         *seed,
+
+		ShardCodec:      *shardCodec,
+		ShardBlockItems: *shardBlockItems,
+		MemoryBudgetMiB: *memoryBudgetMiB,
+		ShardSchedule:   *shardSchedule,
+
+		ShardPlan:    *shardPlan,
+		ShardPlanOut: *shardPlanOut,
+
+		ParquetRowGroupSize: *parquetRowGroupSize,
+		OutputIndex:         *outputIndex,
+
+		DepthHistogram: *depthHistogram,
+		Metrics:        *metrics,
+		HaplotypeSites: *haplotypeSites,
+
+		HetSites:               *hetSites,
+		ExcludeDiscordantPairs: *excludeDiscordantPairs,
+
+		RequireProperPair: *requireProperPair,
+		MaxInsertSize:     *maxInsertSize,
+		ClipOverlap:       *clipOverlap,
+
+		LongRead:          *longRead,
+		MinReadIdentity:   *minReadIdentity,
+		HomopolymerIndels: *homopolymerIndels,
+
+		BAQ:         *baq,
+		RecomputeNM: *recomputeNM,
+
+		Annotate:       *annotate,
+		KmerUniqueness: *kmerUniqueness,
+		GQBands:        *gqBands,
+		Hotspots:       *hotspots,
+		Methylation:    *methylation,
+		ModBase:        *modBase,
+		Somatic:        *somatic,
+		Columns:        *columns,
+
+		FragmentomicsWindow: *fragmentomicsWindow,
+		WPSWindow:           *wpsWindow,
+
+		Resume: *resume,
+
+		MaxReadMiBPerSec: *maxReadMiBPerSec,
+		MaxReadOpsPerSec: *maxReadOpsPerSec,
+
+		Progress: sinks,
+	}
+	xampaths := positionalArgs[:nPositionalArgs-1]
+	fapath := positionalArgs[nPositionalArgs-1]
+	if len(xampaths) == 1 {
+		err = snp.Pileup(ctx, xampaths[0], fapath, *format, *outPrefix, &opts, nil)
+	} else {
+		err = snp.PileupSamples(ctx, xampaths, fapath, *format, *outPrefix, &opts, nil)
+	}
+	if e := sinkCloser.Close(); (e != nil) && (err == nil) {
+		err = e
 	}
-	if err := snp.Pileup(ctx, positionalArgs[0], positionalArgs[1], *format, *outPrefix, &opts, nil); err != nil {
+	if err != nil {
 		log.Panicf("%v", err)
 	}
 	log.Debug.Printf("exiting")
@@ -0,0 +1,124 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/util/buildinfo"
+	"github.com/grailbio/bio/util/flaghelp"
+	"v.io/x/lib/cmdline"
+)
+
+func newCmdPipeline() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:     "pipeline",
+		Short:    "Run trim, align, sort, dedup, pileup and call steps from one YAML config",
+		Long:     pipelineHelp,
+		ArgsName: "config.yaml",
+	}
+	dryRun := cmd.Flags.Bool("n", false, "Validate the config, and print the steps which would run, without running them")
+	cmd.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 1 {
+			return fmt.Errorf("pipeline takes one config path, but got %v", argv)
+		}
+		ctx := vcontext.Background()
+		stages, err := loadPipeline(ctx, argv[0])
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			for _, s := range stages {
+				if _, err := fmt.Fprintln(env.Stdout, s.name); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return runStages(ctx, stages)
+	})
+	return cmd
+}
+
+// helpCommand converts a cmdline command tree to the form used by flaghelp.
+func helpCommand(cmd *cmdline.Command) *flaghelp.Command {
+	c := &flaghelp.Command{
+		Name:     cmd.Name,
+		Short:    cmd.Short,
+		ArgsName: cmd.ArgsName,
+		Flags:    &cmd.Flags,
+	}
+	for _, child := range cmd.Children {
+		c.Children = append(c.Children, helpCommand(child))
+	}
+	return c
+}
+
+func newCmdCompletion(root *cmdline.Command) *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:     "completion",
+		Short:    "Print a shell completion script",
+		ArgsName: "bash|fish|zsh",
+	}
+	helpLong := cmd.Flags.Bool("help-long", false, "Instead of a completion script, print long-form help for all commands, including valid flag values")
+	cmd.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if *helpLong {
+			return flaghelp.WriteHelp(env.Stdout, helpCommand(root))
+		}
+		if len(argv) != 1 {
+			return fmt.Errorf("completion takes a shell name, but got %v", argv)
+		}
+		return flaghelp.WriteCompletion(env.Stdout, argv[0], helpCommand(root))
+	})
+	return cmd
+}
+
+func newCmdVersion() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:  "version",
+		Short: "Print build information",
+	}
+	asJSON := cmd.Flags.Bool("json", false, "Print build information as a JSON object")
+	cmd.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 0 {
+			return fmt.Errorf("version takes no arguments, but got %v", argv)
+		}
+		info := buildinfo.Get()
+		if *asJSON {
+			_, err := fmt.Fprintf(env.Stdout, "%s\n", info.JSON())
+			return err
+		}
+		_, err := fmt.Fprintf(env.Stdout, "bio %s\n", info)
+		return err
+	})
+	return cmd
+}
+
+// Run is the entrypoint for the bio command.
+func Run() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	cmdline.HideGlobalFlagsExcept()
+	root := &cmdline.Command{
+		Name:     "bio",
+		Short:    "Multi-step workflows over the bio-* tools",
+		LookPath: false,
+		Children: []*cmdline.Command{
+			newCmdPipeline(),
+		},
+	}
+	root.Children = append(root.Children, newCmdVersion(), newCmdCompletion(root))
+	cmdline.Main(root)
+}
@@ -0,0 +1,733 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bio/cmd/bio-bam-sort/sorter"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/fastq"
+	"github.com/grailbio/bio/encoding/fastq/trim"
+	"github.com/grailbio/bio/pileup/snp"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/klauspost/compress/gzip"
+	"gopkg.in/yaml.v2"
+)
+
+const pipelineHelp = `Pipeline runs a multi-step workflow, from FASTQ trimming to variant calls,
+from one YAML config, so that a small lab can process a sample with a single
+command.  The config lists the steps in order, e.g.
+
+  steps:
+  - step: trim
+    in: r1.fq.gz
+    in2: r2.fq.gz
+    out: trimmed1.fq.gz
+    out2: trimmed2.fq.gz
+    opts: {QualCutoff: 20, MinLength: 30}
+  - step: align
+    command: [bwa, mem, -t, "16", hg38.fa, "{in}", "{in2}"]
+  - step: sort
+    out: sorted.bam
+  - step: dedup
+    mode: collapse
+  - step: pileup
+    ref: hg38.fa
+    out: sample
+    opts: {BedPath: targets.bed}
+  - step: call
+    ref: hg38.fa
+    out: sample
+    format: gvcf
+  temp_dir: /scratch
+
+The steps are:
+
+  trim    Adapter and quality trimming (encoding/fastq/trim) of the FASTQ
+          "in", or of the pair "in" and "in2", to "out" (and "out2").  Files
+          ending in .gz are gzipped.  "opts" overrides fields of
+          trim.DefaultOpts.
+  align   Runs the aligner "command", whose standard output must be SAM.
+          "{in}" and "{in2}" in its arguments are replaced by the input
+          FASTQ paths, which default to the outputs of the previous trim
+          step.  Without "out", the next step must be a sort, which reads the
+          aligner's output as it is written; with "out" (.sam or .bam), the
+          alignments are written there.
+  sort    Coordinate sort of the alignments to "out", a BAM (with a .gbai
+          index) or PAM, as in bio-bam-sort.
+  dedup   Sets the Dedup option ("collapse" or "downweight") of the next
+          pileup or call step.  Duplicates are detected by the pileup as it
+          reads the sorted alignments, so dedup writes no file.
+  pileup  bio-pileup of the sorted alignments, with "ref", output prefix
+          "out", and "format" (tsv by default).  "opts" overrides fields of
+          snp.DefaultOpts; one of BedPath or Region is required.
+  call    A pileup with a vcf, vcf-bgz, gvcf or gvcf-bgz format (vcf by
+          default).
+
+A step's "in" defaults to the output of the last step which wrote one, if
+that output has the right kind; e.g. pileup and call after sort read the
+sorted file.  The keys of "opts" are the Go field names of the options
+struct.  The whole config is validated before the first step runs.  Paths
+are relative to the current directory.`
+
+// pipelineConfig is the YAML pipeline configuration.
+type pipelineConfig struct {
+	// Steps are run in order.
+	Steps []stepConfig `yaml:"steps"`
+	// TempDir is the directory of the sort step's scratch files; the default
+	// is os.TempDir().
+	TempDir string `yaml:"temp_dir"`
+}
+
+// stepConfig configures one step.  Which fields apply depends on Step; see
+// pipelineHelp.
+type stepConfig struct {
+	Step string `yaml:"step"`
+	// In is the input path, and In2 the R2 input of a paired trim or align
+	// step.  In defaults to the output of the previous step which produced a
+	// file.
+	In  string `yaml:"in"`
+	In2 string `yaml:"in2"`
+	// Out is the output path (the output prefix of pileup and call), and
+	// Out2 the R2 output of a paired trim step.
+	Out  string `yaml:"out"`
+	Out2 string `yaml:"out2"`
+	// Command is the aligner command line of align.
+	Command []string `yaml:"command"`
+	// Ref is the reference FASTA (or .2bit) of pileup and call.
+	Ref string `yaml:"ref"`
+	// Format is the output format of pileup and call.
+	Format string `yaml:"format"`
+	// Mode is the dedup mode, "collapse" (the default) or "downweight".
+	Mode string `yaml:"mode"`
+	// Opts are the trim.Opts of trim, or the snp.Opts of pileup and call,
+	// which override the package defaults.
+	Opts map[string]interface{} `yaml:"opts"`
+}
+
+// fileKind is the kind of data in a step's input or output.
+type fileKind int
+
+const (
+	kindNone fileKind = iota
+	kindFASTQ
+	kindAlignments
+	kindIndexedAlignments
+)
+
+// stage is a validated step (or, for an align step which streams to a sort,
+// two steps), ready to run.
+type stage struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// alignRecords reads the header and records of a SAM or BAM stream.
+type alignRecords interface {
+	Header() *sam.Header
+	Read() (*sam.Record, error)
+}
+
+// parsePipelineConfig reads a YAML pipeline configuration.  Unknown fields
+// are errors, so that typos don't silently fall back to defaults.
+func parsePipelineConfig(r io.Reader) (pipelineConfig, error) {
+	var c pipelineConfig
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return c, fmt.Errorf("parse pipeline config: %v", err)
+	}
+	if len(c.Steps) == 0 {
+		return c, fmt.Errorf("pipeline config has no steps")
+	}
+	return c, nil
+}
+
+// loadPipeline reads and validates the pipeline config at path.
+func loadPipeline(ctx context.Context, path string) (stages []stage, err error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	c, err := parsePipelineConfig(f.Reader(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return planPipeline(c)
+}
+
+// planPipeline validates the steps of c, fills in the default inputs, and
+// returns the stages to run.  Nothing is run (or read) until then, so that a
+// bad config fails before the first step's work is done.
+func planPipeline(c pipelineConfig) ([]stage, error) {
+	var (
+		stages []stage
+		// cur (and cur2, for FASTQ pairs) is the output of the last step
+		// which produced a file, and curIndex the index of a sorted BAM.
+		cur, cur2, curIndex string
+		curKind             fileKind
+		dedup               string // mode of a pending dedup step
+		// align is the command and name of an align step without "out",
+		// whose output the next step streams.
+		align     []string
+		alignName string
+	)
+	for i, s := range c.Steps {
+		s := s
+		name := fmt.Sprintf("step %d (%s)", i+1, s.Step)
+		if (align != nil) && ((s.Step != "sort") || (s.In != "")) {
+			return nil, fmt.Errorf("%s: align without \"out\" must be followed by a sort step which reads its output", alignName)
+		}
+		input := func(want fileKind, what string) (string, error) {
+			if s.In != "" {
+				return s.In, nil
+			}
+			if cur == "" {
+				return "", fmt.Errorf("%s: \"in\" is required", name)
+			}
+			if (curKind < want) || ((want == kindFASTQ) && (curKind != kindFASTQ)) {
+				return "", fmt.Errorf("%s: the previous output %s is not %s; set \"in\"", name, cur, what)
+			}
+			return cur, nil
+		}
+		switch s.Step {
+		case "trim":
+			in, err := input(kindFASTQ, "FASTQ")
+			if err != nil {
+				return nil, err
+			}
+			if (s.Out == "") || ((s.In2 == "") != (s.Out2 == "")) {
+				return nil, fmt.Errorf("%s: \"out\" is required, and \"out2\" is required iff \"in2\" is set", name)
+			}
+			opts := trim.DefaultOpts
+			if err := decodeOpts(s.Opts, &opts); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			if _, err := trim.New(opts); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			stages = append(stages, stage{name, func(ctx context.Context) error {
+				return runTrim(ctx, in, s.In2, s.Out, s.Out2, opts)
+			}})
+			cur, cur2, curKind = s.Out, s.Out2, kindFASTQ
+		case "align":
+			in, err := input(kindFASTQ, "FASTQ")
+			if err != nil {
+				return nil, err
+			}
+			in2 := s.In2
+			if (s.In == "") && (in2 == "") {
+				in2 = cur2
+			}
+			argv, err := alignCommand(s.Command, in, in2)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			if s.Out == "" {
+				align, alignName = argv, name
+				continue
+			}
+			if !strings.HasSuffix(s.Out, ".sam") && !strings.HasSuffix(s.Out, ".bam") {
+				return nil, fmt.Errorf("%s: \"out\" must end in .sam or .bam", name)
+			}
+			stages = append(stages, stage{name, func(ctx context.Context) error {
+				return runAlign(ctx, argv, s.Out)
+			}})
+			cur, cur2, curKind = s.Out, "", kindAlignments
+		case "sort":
+			if !strings.HasSuffix(s.Out, ".bam") && !strings.HasSuffix(s.Out, ".pam") {
+				return nil, fmt.Errorf("%s: \"out\" must end in .bam or .pam", name)
+			}
+			tempDir := c.TempDir
+			if align != nil {
+				// The sort reads the aligner's output as it's written, so the
+				// unsorted alignments are never stored.
+				argv := align
+				stages = append(stages, stage{alignName + " | " + name, func(ctx context.Context) error {
+					return runAlignSort(ctx, argv, s.Out, tempDir)
+				}})
+				align = nil
+			} else {
+				in, err := input(kindAlignments, "SAM or BAM")
+				if err != nil {
+					return nil, err
+				}
+				stages = append(stages, stage{name, func(ctx context.Context) error {
+					return runSort(ctx, in, s.Out, tempDir)
+				}})
+			}
+			cur, cur2, curKind, curIndex = s.Out, "", kindIndexedAlignments, ""
+			if strings.HasSuffix(s.Out, ".bam") {
+				curIndex = s.Out + ".gbai"
+			}
+		case "dedup":
+			mode := s.Mode
+			if mode == "" {
+				mode = "collapse"
+			}
+			if (mode != "collapse") && (mode != "downweight") {
+				return nil, fmt.Errorf("%s: invalid mode %q", name, s.Mode)
+			}
+			// Duplicates are detected by the pileup itself, so dedup only
+			// configures the pileup and call steps which follow it.
+			dedup = mode
+		case "pileup", "call":
+			in, err := input(kindIndexedAlignments, "a sorted, indexed BAM or PAM")
+			if err != nil {
+				return nil, err
+			}
+			format := s.Format
+			if format == "" {
+				format = "tsv"
+				if s.Step == "call" {
+					format = "vcf"
+				}
+			}
+			if (s.Step == "call") && !strings.HasPrefix(format, "vcf") && !strings.HasPrefix(format, "gvcf") {
+				return nil, fmt.Errorf("%s: format must be vcf, vcf-bgz, gvcf or gvcf-bgz", name)
+			}
+			if (s.Ref == "") || (s.Out == "") {
+				return nil, fmt.Errorf("%s: \"ref\" and \"out\" are required", name)
+			}
+			opts := snp.DefaultOpts
+			if err := decodeOpts(s.Opts, &opts); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			if (dedup != "") && (opts.Dedup == "") {
+				opts.Dedup = dedup
+			}
+			if (s.In == "") && (opts.BamIndexPath == "") {
+				opts.BamIndexPath = curIndex
+			}
+			stages = append(stages, stage{name, func(ctx context.Context) error {
+				return snp.Pileup(ctx, in, s.Ref, format, s.Out, &opts, nil)
+			}})
+			// The next step still reads the alignments.
+			if s.In != "" {
+				cur, cur2, curKind, curIndex = s.In, "", kindIndexedAlignments, ""
+			}
+			dedup = ""
+		default:
+			return nil, fmt.Errorf("%s: unknown step; the steps are trim, align, sort, dedup, pileup and call", name)
+		}
+	}
+	if align != nil {
+		return nil, fmt.Errorf("%s: align without \"out\" must be followed by a sort step which reads its output", alignName)
+	}
+	if dedup != "" {
+		return nil, fmt.Errorf("dedup must be followed by a pileup or call step")
+	}
+	return stages, nil
+}
+
+// alignCommand returns the aligner command line, with "{in}" and "{in2}" in
+// its arguments replaced by the paths of the R1 and R2 (if paired) inputs.
+func alignCommand(command []string, in, in2 string) ([]string, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("\"command\" is required")
+	}
+	var hasIn2 bool
+	argv := make([]string, len(command))
+	for i, arg := range command {
+		hasIn2 = hasIn2 || strings.Contains(arg, "{in2}")
+		arg = strings.Replace(arg, "{in2}", in2, -1)
+		argv[i] = strings.Replace(arg, "{in}", in, -1)
+	}
+	if hasIn2 != (in2 != "") {
+		return nil, fmt.Errorf("the command must contain \"{in2}\" iff the input is paired")
+	}
+	return argv, nil
+}
+
+// decodeOpts sets the fields of opts named by the keys of m, as if m were a
+// JSON object.
+func decodeOpts(m map[string]interface{}, opts interface{}) error {
+	if len(m) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(jsonValue(m))
+	if err != nil {
+		return fmt.Errorf("invalid opts: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(opts); err != nil {
+		return fmt.Errorf("invalid opts: %v", err)
+	}
+	return nil
+}
+
+// jsonValue converts the maps of a decoded YAML value, whose keys may be of
+// any type, to maps which encoding/json accepts.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = jsonValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, val := range v {
+			l[i] = jsonValue(val)
+		}
+		return l
+	}
+	return v
+}
+
+// runStages runs the stages in order, and stops at the first error.
+func runStages(ctx context.Context, stages []stage) error {
+	for _, s := range stages {
+		start := time.Now()
+		log.Printf("%s: start", s.name)
+		if err := s.run(ctx); err != nil {
+			return fmt.Errorf("%s: %v", s.name, err)
+		}
+		log.Printf("%s: done in %v", s.name, time.Since(start))
+	}
+	return nil
+}
+
+// createFASTQ creates the FASTQ file at path, gzipped if path ends in .gz,
+// and returns a writer and a function which closes it.
+func createFASTQ(ctx context.Context, path string) (*fastq.Writer, func() error, error) {
+	f, err := file.Create(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return fastq.NewWriter(f.Writer(ctx)), func() error { return f.Close(ctx) }, nil
+	}
+	gz := gzip.NewWriter(f.Writer(ctx))
+	return fastq.NewWriter(gz), func() error {
+		err := gz.Close()
+		if e := f.Close(ctx); err == nil {
+			err = e
+		}
+		return err
+	}, nil
+}
+
+// runTrim trims the reads of in (and, for pairs, in2), and writes the reads
+// which are long enough to out (and out2).  A pair is written only if both
+// reads are.
+func runTrim(ctx context.Context, in, in2, out, out2 string, opts trim.Opts) (err error) {
+	t, err := trim.New(opts)
+	if err != nil {
+		return err
+	}
+	w1, close1, err := createFASTQ(ctx, out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := close1(); err == nil {
+			err = e
+		}
+	}()
+	if in2 == "" {
+		err = trimSingle(ctx, in, w1, t)
+	} else {
+		err = trimPairs(ctx, in, in2, w1, out2, t)
+	}
+	if err == nil {
+		log.Printf("trim: %+v", t.Stats())
+	}
+	return err
+}
+
+// trimSingle trims the single-end reads of the FASTQ file at path, which is
+// gzipped if path ends in .gz.
+func trimSingle(ctx context.Context, path string, w *fastq.Writer, t *trim.Trimmer) (err error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	var in io.Reader = f.Reader(ctx)
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		defer gz.Close() // nolint: errcheck
+		in = gz
+	}
+	sc := fastq.NewScanner(in, fastq.All)
+	var r fastq.Read
+	for sc.Scan(&r) {
+		if !t.Trim(&r) {
+			continue
+		}
+		if err := w.Write(&r); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// trimPairs trims the pairs of the FASTQ files at path1 and path2, and
+// writes the R1 reads to w1, and the R2 reads to out2.
+func trimPairs(ctx context.Context, path1, path2 string, w1 *fastq.Writer, out2 string, t *trim.Trimmer) (err error) {
+	r, err := fastq.OpenPair(ctx, path1, path2, fastq.PairReaderOpts{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := r.Close(); err == nil {
+			err = e
+		}
+	}()
+	w2, close2, err := createFASTQ(ctx, out2)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := close2(); err == nil {
+			err = e
+		}
+	}()
+	var r1, r2 fastq.Read
+	for {
+		if err := r.ReadPair(&r1, &r2); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !t.TrimPair(&r1, &r2) {
+			continue
+		}
+		if err := w1.Write(&r1); err != nil {
+			return err
+		}
+		if err := w2.Write(&r2); err != nil {
+			return err
+		}
+	}
+}
+
+// startAligner starts the aligner command argv, and returns a reader of the
+// SAM it writes to its standard output, and a function which waits for the
+// command to exit.  Cancelling ctx kills the command, e.g. when the reader
+// of its output fails.
+func startAligner(ctx context.Context, argv []string) (*sam.Reader, func() error, error) {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("start %s: %v", argv[0], err)
+	}
+	wait := func() error {
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("%s: %v", argv[0], err)
+		}
+		return nil
+	}
+	r, err := sam.NewReader(bufio.NewReaderSize(stdout, 1<<20))
+	if err != nil {
+		if e := wait(); e != nil {
+			err = e
+		}
+		return nil, nil, fmt.Errorf("read the SAM output of %s: %v", argv[0], err)
+	}
+	return r, wait, nil
+}
+
+// runAlign runs the aligner command argv, and writes its alignments to out,
+// a SAM or BAM file.
+func runAlign(ctx context.Context, argv []string, out string) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r, wait, err := startAligner(ctx, argv)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+		if e := wait(); err == nil {
+			err = e
+		}
+	}()
+	f, err := file.Create(ctx, out)
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	var (
+		write func(*sam.Record) error
+		flush = func() error { return nil }
+	)
+	if strings.HasSuffix(out, ".bam") {
+		w, err := bam.NewWriter(f.Writer(ctx), r.Header(), runtime.NumCPU())
+		if err != nil {
+			return err
+		}
+		write, flush = w.Write, w.Close
+	} else {
+		w, err := sam.NewWriter(f.Writer(ctx), r.Header(), sam.FlagDecimal)
+		if err != nil {
+			return err
+		}
+		write = w.Write
+	}
+	for {
+		rec, err := r.Read()
+		if rec == nil {
+			if err != io.EOF {
+				return fmt.Errorf("%s: %v", argv[0], err)
+			}
+			break
+		}
+		if err := write(rec); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// runAlignSort runs the aligner command argv, and sorts its alignments to
+// out as they are read.
+func runAlignSort(ctx context.Context, argv []string, out, tempDir string) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r, wait, err := startAligner(ctx, argv)
+	if err != nil {
+		return err
+	}
+	err = sortRecords(ctx, r, argv[0], out, tempDir)
+	if err != nil {
+		cancel()
+	}
+	if e := wait(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// openAlignments opens the SAM or BAM file at path; SAM is recognized by the
+// .sam extension.
+func openAlignments(ctx context.Context, path string) (alignRecords, file.File, error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.HasSuffix(path, ".sam") {
+		r, err := sam.NewReader(f.Reader(ctx))
+		if err != nil {
+			f.Close(ctx) // nolint: errcheck
+			return nil, nil, err
+		}
+		return r, f, nil
+	}
+	r, err := bam.NewReader(f.Reader(ctx), runtime.NumCPU())
+	if err != nil {
+		f.Close(ctx) // nolint: errcheck
+		return nil, nil, err
+	}
+	return r, f, nil
+}
+
+// runSort sorts the records of the SAM or BAM at in to out.
+func runSort(ctx context.Context, in, out, tempDir string) (err error) {
+	r, f, err := openAlignments(ctx, in)
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	return sortRecords(ctx, r, in, out, tempDir)
+}
+
+// sortRecords sorts the records of r, which come from the named source, by
+// coordinate, and writes them to out, a BAM (with a .gbai index) or a PAM.
+func sortRecords(ctx context.Context, r alignRecords, source, out, tempDir string) error {
+	dir, err := ioutil.TempDir(tempDir, "bio-pipeline")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	shard := filepath.Join(dir, "sorted.sortshard")
+	s := sorter.NewSorter(shard, r.Header())
+	for {
+		rec, err := r.Read()
+		if rec == nil {
+			if err != io.EOF {
+				s.Close() // nolint: errcheck
+				return fmt.Errorf("%s: %v", source, err)
+			}
+			break
+		}
+		s.AddRecord(rec)
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if strings.HasSuffix(out, ".pam") {
+		return sorter.PAMFromSortShards([]string{shard}, out, 128<<20, runtime.NumCPU())
+	}
+	if err := sorter.BAMFromSortShards([]string{shard}, out); err != nil {
+		return err
+	}
+	return writeGIndex(ctx, out)
+}
+
+// writeGIndex writes the .gbai index of the BAM at path.
+func writeGIndex(ctx context.Context, path string) (err error) {
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	out, err := file.Create(ctx, path+".gbai")
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, out, &err)
+	return gbam.WriteGIndex(out.Writer(ctx), in.Reader(ctx), 64*1024, runtime.NumCPU())
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestPlanPipeline(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		// steps are the stage names, or errSubstr the expected error.
+		steps     []string
+		errSubstr string
+	}{
+		{
+			config: `
+steps:
+- {step: trim, in: a.fq, in2: a2.fq, out: b.fq, out2: b2.fq}
+- {step: align, command: [bwa, mem, ref.fa, "{in}", "{in2}"]}
+- {step: sort, out: a.bam}
+- {step: dedup, mode: downweight}
+- {step: pileup, ref: ref.fa, out: a, opts: {Region: chr1}}
+- {step: call, ref: ref.fa, out: a, format: gvcf}
+`,
+			steps: []string{"step 1 (trim)", "step 2 (align) | step 3 (sort)", "step 5 (pileup)", "step 6 (call)"},
+		},
+		{
+			config: `
+steps:
+- {step: align, in: a.fq, out: a.sam, command: [bwa, mem, ref.fa, "{in}"]}
+- {step: sort, out: a.pam}
+`,
+			steps: []string{"step 1 (align)", "step 2 (sort)"},
+		},
+		{
+			// The paired trim output needs {in2}.
+			config: `
+steps:
+- {step: trim, in: a.fq, in2: a2.fq, out: b.fq, out2: b2.fq}
+- {step: align, command: [bwa, mem, ref.fa, "{in}"]}
+`,
+			errSubstr: "step 2 (align): the command must contain \"{in2}\"",
+		},
+		{
+			config:    "steps:\n- {step: align, in: a.fq, command: [bwa, mem, ref.fa, \"{in}\"]}\n- {step: pileup, ref: ref.fa, out: a}\n",
+			errSubstr: "step 1 (align): align without \"out\" must be followed by a sort step",
+		},
+		{
+			config:    "steps:\n- {step: align, in: a.fq, command: [bwa, mem, ref.fa, \"{in}\"]}\n",
+			errSubstr: "step 1 (align): align without \"out\" must be followed by a sort step",
+		},
+		{
+			config:    "steps:\n- {step: align, in: a.fq}\n",
+			errSubstr: "\"command\" is required",
+		},
+		{
+			// sort can't read the trimmed FASTQ.
+			config:    "steps:\n- {step: trim, in: a.fq, out: b.fq}\n- {step: sort, out: b.bam}\n",
+			errSubstr: "the previous output b.fq is not SAM or BAM",
+		},
+		{
+			// align can't read the sorted alignments.
+			config:    "steps:\n- {step: sort, in: a.sam, out: a.bam}\n- {step: align, command: [bwa, \"{in}\"]}\n",
+			errSubstr: "the previous output a.bam is not FASTQ",
+		},
+		{
+			config:    "steps:\n- {step: trim, in: a.fq, in2: a2.fq, out: b.fq}\n",
+			errSubstr: "\"out2\" is required",
+		},
+		{
+			config:    "steps:\n- {step: trim, in: a.fq, out: b.fq, opts: {MinLen: 3}}\n",
+			errSubstr: "unknown field \"MinLen\"",
+		},
+		{
+			config:    "steps:\n- {step: pileup, ref: ref.fa, out: a}\n",
+			errSubstr: "\"in\" is required",
+		},
+		{
+			config:    "steps:\n- {step: call, in: a.bam, ref: ref.fa, out: a, format: tsv}\n",
+			errSubstr: "format must be vcf",
+		},
+		{
+			config:    "steps:\n- {step: sort, in: a.sam, out: a.bam}\n- {step: dedup}\n",
+			errSubstr: "dedup must be followed by a pileup or call step",
+		},
+		{
+			config:    "steps:\n- {step: markdup}\n",
+			errSubstr: "unknown step",
+		},
+		{
+			config:    "steps:\n- {stepp: sort}\n",
+			errSubstr: "field stepp not found",
+		},
+	} {
+		stages, err := func() ([]stage, error) {
+			c, err := parsePipelineConfig(strings.NewReader(test.config))
+			if err != nil {
+				return nil, err
+			}
+			return planPipeline(c)
+		}()
+		if test.errSubstr != "" {
+			assert.HasSubstr(t, err.Error(), test.errSubstr)
+			continue
+		}
+		assert.NoError(t, err)
+		var names []string
+		for _, s := range stages {
+			names = append(names, s.name)
+		}
+		assert.EQ(t, names, test.steps)
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := func(name string) string { return filepath.Join(tmpdir, name) }
+	write := func(name, data string) {
+		assert.NoError(t, ioutil.WriteFile(path(name), []byte(data), 0600))
+	}
+	// The 20-base insert of the first pair is shorter than the reads, which
+	// run into the TruSeq adapter.  The second pair is too short after
+	// quality trimming.
+	write("r1.fq", "@p1/1\nACGTTGCAAGGCTTACCGATAGATCGGAAGAGC\n+\nIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIII\n"+
+		"@p2/1\nACGTACGTAC\n+\nII########\n")
+	write("r2.fq", "@p1/2\nATCGGTAAGCCTTGCAACGTAGATCGGAAGAGC\n+\nIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIII\n"+
+		"@p2/2\nGTACGTACGT\n+\nIIIIIIIIII\n")
+	// The "aligner" prints canned, unsorted alignments, after checking that
+	// it was given the trimmed reads.
+	write("a.sam", "@HD\tVN:1.6\tSO:unsorted\n@SQ\tSN:chr1\tLN:100\n@SQ\tSN:chr2\tLN:100\n"+
+		"r1\t0\tchr2\t5\t60\t4M\t*\t0\t0\tACGT\tIIII\n"+
+		"r2\t0\tchr1\t50\t60\t4M\t*\t0\t0\tACGT\tIIII\n"+
+		"r3\t0\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tIIII\n")
+	write("align.sh", "test -s \"$1\" && test -s \"$2\" && cat "+path("a.sam")+"\n")
+	write("ref.fa", ">chr1\n"+strings.Repeat("ACGT", 25)+"\n>chr2\n"+strings.Repeat("ACGT", 25)+"\n")
+	config := `
+temp_dir: ` + tmpdir + `
+steps:
+- step: trim
+  in: ` + path("r1.fq") + `
+  in2: ` + path("r2.fq") + `
+  out: ` + path("t1.fq") + `
+  out2: ` + path("t2.fq.gz") + `
+  opts: {QualCutoff: 20, MinLength: 5}
+- step: align
+  command: [sh, ` + path("align.sh") + `, "{in}", "{in2}"]
+- step: sort
+  out: ` + path("a.bam") + `
+- step: dedup
+- step: pileup
+  ref: ` + path("ref.fa") + `
+  out: ` + path("a") + `
+  opts: {Region: "chr1:1-100", Parallelism: 1}
+`
+	c, err := parsePipelineConfig(strings.NewReader(config))
+	assert.NoError(t, err)
+	stages, err := planPipeline(c)
+	assert.NoError(t, err)
+	assert.NoError(t, runStages(context.Background(), stages))
+
+	data, err := ioutil.ReadFile(path("t1.fq"))
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), "@p1/1\nACGTTGCAAGGCTTACCGAT\n+\nIIIIIIIIIIIIIIIIIIII\n")
+	_, err = os.Stat(path("t2.fq.gz"))
+	assert.NoError(t, err)
+
+	f, err := os.Open(path("a.bam"))
+	assert.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+	r, err := bam.NewReader(f, 1)
+	assert.NoError(t, err)
+	var names []string
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, rec.Name)
+	}
+	assert.EQ(t, names, []string{"r3", "r2", "r1"})
+	_, err = os.Stat(path("a.bam.gbai"))
+	assert.NoError(t, err)
+	// The pileup read the sorted BAM through its .gbai index.
+	data, err = ioutil.ReadFile(path("a.ref.tsv"))
+	assert.NoError(t, err)
+	assert.HasSubstr(t, string(data), "chr1\t49\t")
+	// The sort step's scratch directory is gone.
+	matches, err := filepath.Glob(path("bio-pipeline*"))
+	assert.NoError(t, err)
+	assert.EQ(t, len(matches), 0)
+}
+
+func TestAlignFailure(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	// The aligner's output is not SAM, so the sort fails, and the aligner is
+	// killed rather than left blocked on its output.
+	c, err := parsePipelineConfig(strings.NewReader(`
+temp_dir: ` + tmpdir + `
+steps:
+- {step: align, in: a.fq, command: [sh, -c, "echo garbage; yes"]}
+- {step: sort, out: ` + filepath.Join(tmpdir, "a.bam") + `}
+`))
+	assert.NoError(t, err)
+	stages, err := planPipeline(c)
+	assert.NoError(t, err)
+	assert.NotNil(t, runStages(context.Background(), stages))
+}
@@ -0,0 +1,465 @@
+package bam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+
+	biobgzf "github.com/grailbio/bio/encoding/bgzf"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/sam"
+)
+
+// IndexFormat is the format of the index written by BuildIndex.
+type IndexFormat int
+
+const (
+	// IndexBAI is the .bai format.  It supports positions up to 2^29.
+	IndexBAI IndexFormat = iota
+	// IndexCSI is the .csi format, which supports longer references.
+	IndexCSI
+)
+
+const (
+	// baiMinShift and baiDepth are the fixed binning parameters of .bai
+	// indexes.
+	baiMinShift = 14
+	baiDepth    = 5
+	// minMarkerDist is the compressed size below which the chunks of a bin
+	// are merged into its parent bin, as in htslib.
+	minMarkerDist = 0x10000
+)
+
+// BuildIndexOpts configures BuildIndex.
+type BuildIndexOpts struct {
+	// Format is the index format.  The default is IndexBAI.
+	Format IndexFormat
+	// MinShift is the log2 of the size of the smallest bins of a CSI index.
+	// The default is 14, as in samtools.
+	MinShift int
+	// Depth is the number of levels of bins of a CSI index.  The default is
+	// the smallest depth whose bins cover the longest reference of the
+	// header, as in samtools.
+	Depth int
+	// Parallelism is the number of goroutines decompressing the input.  The
+	// default is runtime.NumCPU().
+	Parallelism int
+}
+
+// BuildIndex reads a coordinate-sorted .bam file from r, and writes its .bai
+// or .csi index to w, like "samtools index".  The input is streamed; the
+// decompression is parallelized, and only the index is held in memory.
+func BuildIndex(r io.Reader, w io.Writer, opts BuildIndexOpts) error {
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	bgzfReader, err := bgzf.NewReader(r, parallelism)
+	if err != nil {
+		return err
+	}
+	header, err := sam.NewHeader(nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := header.DecodeBinary(bgzfReader); err != nil {
+		return err
+	}
+	b, err := newIndexBuilder(header, opts)
+	if err != nil {
+		return err
+	}
+
+	sizeBuf := make([]byte, 4)
+	buf := make([]byte, maxRecordSize)
+	// The chunk of a record ends where the next one begins, so each record
+	// is added once the next one is read.
+	var (
+		pending      []byte
+		pendingBegin uint64
+	)
+	for {
+		_, err := io.ReadFull(bgzfReader, sizeBuf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		recordBegin := toVOffset(bgzfReader.LastChunk().Begin)
+		if pending != nil {
+			if err := b.add(pending, pendingBegin, recordBegin); err != nil {
+				return err
+			}
+		}
+		sz := int(binary.LittleEndian.Uint32(sizeBuf))
+		if sz > maxRecordSize {
+			return fmt.Errorf("bam record exceeds max: %d", sz)
+		} else if sz < 32 {
+			return fmt.Errorf("bam record too short: %d", sz)
+		}
+		if _, err = io.ReadFull(bgzfReader, buf[0:sz]); err == io.EOF {
+			return fmt.Errorf("could not read full bam record")
+		} else if err != nil {
+			return err
+		}
+		pending, pendingBegin = buf[0:sz], recordBegin
+	}
+	if pending != nil {
+		if err := b.add(pending, pendingBegin, toVOffset(bgzfReader.LastChunk().End)); err != nil {
+			return err
+		}
+	}
+	return b.write(w)
+}
+
+// indexChunk is the [begin, end) range of virtual offsets of a run of
+// records.
+type indexChunk struct {
+	begin, end uint64
+}
+
+// indexRef is the index of one reference under construction.
+type indexRef struct {
+	bins map[uint32][]indexChunk
+	// linear holds the virtual offset of the first record overlapping each
+	// 1<<minShift window, or 0 if none has been seen.
+	linear []uint64
+	// begin and end are the virtual offsets of the reference's records.
+	begin, end uint64
+	// nMapped and nUnmapped are the numbers of the reference's mapped and
+	// (placed but) unmapped records.
+	nMapped, nUnmapped uint64
+}
+
+// indexBuilder builds a .bai or .csi index, as htslib's hts_idx_push and
+// hts_idx_finish do.
+type indexBuilder struct {
+	csi             bool
+	minShift, depth int
+	refs            []indexRef
+	// lastRefID and lastPos are the reference and position of the last
+	// record added.  lastRefID is -1 after an unplaced record.
+	lastRefID, lastPos int
+	// nNoCoor is the number of unplaced records.
+	nNoCoor uint64
+}
+
+func newIndexBuilder(header *sam.Header, opts BuildIndexOpts) (*indexBuilder, error) {
+	b := &indexBuilder{
+		minShift: baiMinShift,
+		depth:    baiDepth,
+		refs:     make([]indexRef, len(header.Refs())),
+	}
+	switch opts.Format {
+	case IndexBAI:
+	case IndexCSI:
+		b.csi = true
+		if opts.MinShift > 0 {
+			b.minShift = opts.MinShift
+		}
+		if opts.Depth > 0 {
+			b.depth = opts.Depth
+		} else {
+			maxLen := int64(0)
+			for _, ref := range header.Refs() {
+				if int64(ref.Len()) > maxLen {
+					maxLen = int64(ref.Len())
+				}
+			}
+			maxLen += 256
+			b.depth = 0
+			for s := int64(1) << uint(b.minShift); maxLen > s; s <<= 3 {
+				b.depth++
+			}
+		}
+		if b.minShift+3*b.depth > 62 {
+			return nil, fmt.Errorf("BuildIndex: invalid CSI min shift %d and depth %d", b.minShift, b.depth)
+		}
+	default:
+		return nil, fmt.Errorf("BuildIndex: unknown index format %d", opts.Format)
+	}
+	for i := range b.refs {
+		b.refs[i].bins = map[uint32][]indexChunk{}
+	}
+	return b, nil
+}
+
+// reg2bin returns the smallest bin which contains [beg, end).
+func reg2bin(beg, end, minShift, depth int) uint32 {
+	end--
+	s := minShift
+	t := ((1 << uint(depth*3)) - 1) / 7
+	for l := depth; l > 0; l-- {
+		if beg>>uint(s) == end>>uint(s) {
+			return uint32(t + beg>>uint(s))
+		}
+		s += 3
+		t -= 1 << uint((l-1)*3)
+	}
+	return 0
+}
+
+// binFirst returns the first bin of level l.
+func binFirst(l int) uint32 {
+	return uint32(((1 << uint(3*l)) - 1) / 7)
+}
+
+// binLevel returns the level of bin.
+func binLevel(bin uint32) int {
+	l := 0
+	for binFirst(l+1) <= bin {
+		l++
+	}
+	return l
+}
+
+// binParent returns the parent of bin, which must not be 0.
+func binParent(bin uint32) uint32 {
+	return (bin - 1) >> 3
+}
+
+// binWindow returns the linear-index window of the first position of bin.
+func (b *indexBuilder) binWindow(bin uint32) int {
+	l := binLevel(bin)
+	return int(bin-binFirst(l)) << uint(3*(b.depth-l))
+}
+
+// nBins returns the number of regular bins; the next bin number is the
+// pseudo-bin of the reference metadata.
+func (b *indexBuilder) nBins() uint32 {
+	return binFirst(b.depth + 1)
+}
+
+// recordEnd returns the end of the reference span of the record in buf (a
+// BAM record without its size), as htslib's bam_endpos does: unmapped
+// records, and records without reference-consuming CIGAR operations, span one
+// position.
+func recordEnd(buf []byte, pos int) (int, error) {
+	flag := binary.LittleEndian.Uint16(buf[14:16])
+	nCigarOp := int(binary.LittleEndian.Uint16(buf[12:14]))
+	cigarStart := 32 + int(buf[8])
+	if cigarStart+4*nCigarOp > len(buf) {
+		return 0, fmt.Errorf("BuildIndex: truncated bam record")
+	}
+	refLen := 0
+	if (flag & uint16(sam.Unmapped)) == 0 {
+		for i := 0; i < nCigarOp; i++ {
+			op := binary.LittleEndian.Uint32(buf[cigarStart+4*i:])
+			switch sam.CigarOpType(op & 0xf) {
+			case sam.CigarMatch, sam.CigarDeletion, sam.CigarSkipped, sam.CigarEqual, sam.CigarMismatch:
+				refLen += int(op >> 4)
+			}
+		}
+	}
+	if refLen == 0 {
+		refLen = 1
+	}
+	return pos + refLen, nil
+}
+
+// add indexes the record in buf (a BAM record without its size), which
+// occupies the virtual offsets [begin, end) of the file.
+func (b *indexBuilder) add(buf []byte, begin, end uint64) error {
+	refID := int(int32(binary.LittleEndian.Uint32(buf[0:4])))
+	pos := int(int32(binary.LittleEndian.Uint32(buf[4:8])))
+	if refID < 0 {
+		b.lastRefID = -1
+		b.nNoCoor++
+		return nil
+	}
+	if refID >= len(b.refs) {
+		return fmt.Errorf("BuildIndex: invalid reference ID %d", refID)
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	if (b.lastRefID < 0 && b.nNoCoor > 0) || (refID < b.lastRefID) || ((refID == b.lastRefID) && (pos < b.lastPos)) {
+		return fmt.Errorf("BuildIndex: the input is not sorted by coordinate at reference %d, position %d", refID, pos)
+	}
+	b.lastRefID, b.lastPos = refID, pos
+	recEnd, err := recordEnd(buf, pos)
+	if err != nil {
+		return err
+	}
+	if maxPos := 1 << uint(b.minShift+3*b.depth); recEnd > maxPos {
+		if !b.csi {
+			return fmt.Errorf("BuildIndex: position %d of reference %d is beyond the .bai limit of %d; use a CSI index", recEnd, refID, maxPos)
+		}
+		return fmt.Errorf("BuildIndex: position %d of reference %d is beyond the CSI index limit of %d", recEnd, refID, maxPos)
+	}
+
+	ref := &b.refs[refID]
+	bin := reg2bin(pos, recEnd, b.minShift, b.depth)
+	chunks := ref.bins[bin]
+	if n := len(chunks); (n > 0) && (chunks[n-1].end == begin) {
+		chunks[n-1].end = end
+	} else {
+		ref.bins[bin] = append(chunks, indexChunk{begin, end})
+	}
+
+	lastWindow := (recEnd - 1) >> uint(b.minShift)
+	for len(ref.linear) <= lastWindow {
+		ref.linear = append(ref.linear, 0)
+	}
+	for w := pos >> uint(b.minShift); w <= lastWindow; w++ {
+		if ref.linear[w] == 0 {
+			ref.linear[w] = begin
+		}
+	}
+
+	if (ref.nMapped == 0) && (ref.nUnmapped == 0) {
+		ref.begin = begin
+	}
+	ref.end = end
+	if (binary.LittleEndian.Uint16(buf[14:16]) & uint16(sam.Unmapped)) == 0 {
+		ref.nMapped++
+	} else {
+		ref.nUnmapped++
+	}
+	return nil
+}
+
+// finish fills in the empty windows of the linear index of ref, and merges
+// its small bins into their parents, as htslib's update_loff and
+// compress_binning do.
+func (b *indexBuilder) finish(ref *indexRef) {
+	for w := range ref.linear {
+		if ref.linear[w] != 0 {
+			break
+		}
+		ref.linear[w] = ref.begin
+	}
+	for w := 1; w < len(ref.linear); w++ {
+		if ref.linear[w] == 0 {
+			ref.linear[w] = ref.linear[w-1]
+		}
+	}
+	sortChunks := func(chunks []indexChunk) {
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].begin < chunks[j].begin })
+	}
+	// Merge a bin into its parent if its chunks span less than minMarkerDist
+	// compressed bytes.
+	for l := b.depth; l > 0; l-- {
+		bins := make([]uint32, 0, len(ref.bins))
+		for bin := range ref.bins {
+			if (bin >= binFirst(l)) && (bin < binFirst(l+1)) {
+				bins = append(bins, bin)
+			}
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+		for _, bin := range bins {
+			chunks := ref.bins[bin]
+			if l < b.depth {
+				sortChunks(chunks)
+			}
+			if (chunks[len(chunks)-1].end>>16)-(chunks[0].begin>>16) >= minMarkerDist {
+				continue
+			}
+			parent := binParent(bin)
+			if _, ok := ref.bins[parent]; !ok {
+				continue
+			}
+			ref.bins[parent] = append(ref.bins[parent], chunks...)
+			delete(ref.bins, bin)
+		}
+	}
+	if chunks, ok := ref.bins[0]; ok {
+		sortChunks(chunks)
+	}
+	// Merge adjacent chunks which start in the same bgzf block.
+	for bin, chunks := range ref.bins {
+		m := 0
+		for _, c := range chunks[1:] {
+			if chunks[m].end>>16 >= c.begin>>16 {
+				if chunks[m].end < c.end {
+					chunks[m].end = c.end
+				}
+			} else {
+				m++
+				chunks[m] = c
+			}
+		}
+		ref.bins[bin] = chunks[:m+1]
+	}
+}
+
+// write writes the index to w: uncompressed for .bai, bgzf-compressed for
+// .csi.
+func (b *indexBuilder) write(w io.Writer) error {
+	var buf []byte
+	if b.csi {
+		buf = append(buf, "CSI\x01"...)
+		buf = appendUint32(buf, uint32(b.minShift))
+		buf = appendUint32(buf, uint32(b.depth))
+		buf = appendUint32(buf, 0) // l_aux
+	} else {
+		buf = append(buf, "BAI\x01"...)
+	}
+	buf = appendUint32(buf, uint32(len(b.refs)))
+	appendBin := func(bin uint32, loff uint64, chunks []indexChunk) {
+		buf = appendUint32(buf, bin)
+		if b.csi {
+			buf = appendUint64(buf, loff)
+		}
+		buf = appendUint32(buf, uint32(len(chunks)))
+		for _, c := range chunks {
+			buf = appendUint64(appendUint64(buf, c.begin), c.end)
+		}
+	}
+	for i := range b.refs {
+		ref := &b.refs[i]
+		if (ref.nMapped == 0) && (ref.nUnmapped == 0) {
+			buf = appendUint32(buf, 0) // n_bin
+			if !b.csi {
+				buf = appendUint32(buf, 0) // n_intv
+			}
+			continue
+		}
+		b.finish(ref)
+		bins := make([]uint32, 0, len(ref.bins))
+		for bin := range ref.bins {
+			bins = append(bins, bin)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+		buf = appendUint32(buf, uint32(len(bins)+1))
+		for _, bin := range bins {
+			// The loffset of a CSI bin is the lower bound of the offsets of
+			// the records overlapping its first window.
+			var loff uint64
+			if w := b.binWindow(bin); w < len(ref.linear) {
+				loff = ref.linear[w]
+			}
+			appendBin(bin, loff, ref.bins[bin])
+		}
+		appendBin(b.nBins()+1, 0, []indexChunk{{ref.begin, ref.end}, {ref.nMapped, ref.nUnmapped}})
+		if !b.csi {
+			buf = appendUint32(buf, uint32(len(ref.linear)))
+			for _, off := range ref.linear {
+				buf = appendUint64(buf, off)
+			}
+		}
+	}
+	buf = appendUint64(buf, b.nNoCoor)
+	if !b.csi {
+		_, err := w.Write(buf)
+		return err
+	}
+	bw, err := biobgzf.NewWriter(w, 6)
+	if err != nil {
+		return err
+	}
+	if _, err = bw.Write(buf); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+func appendUint32(b []byte, x uint32) []byte {
+	return append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(x)), uint32(x>>32))
+}
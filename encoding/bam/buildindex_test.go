@@ -0,0 +1,150 @@
+package bam
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	biogobam "github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/csi"
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildIndexTestBAM returns a sorted .bam file with 1000 mapped reads on each
+// of chr0 and chr2 (chr1 is empty), a placed unmapped read on chr0, and two
+// unplaced reads.
+func buildIndexTestBAM(t *testing.T, refLen int) ([]byte, []*sam.Reference) {
+	var refs []*sam.Reference
+	for i := 0; i < 3; i++ {
+		ref, err := sam.NewReference(fmt.Sprintf("chr%d", i), "", "", refLen, nil, nil)
+		require.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w, err := biogobam.NewWriter(&buf, header, 1)
+	require.NoError(t, err)
+	write := func(name string, ref *sam.Reference, pos int, flags sam.Flags, cigar sam.Cigar) {
+		r := &sam.Record{
+			Name:  name,
+			Ref:   ref,
+			Pos:   pos,
+			Flags: flags,
+			Cigar: cigar,
+			Seq:   sam.NewSeq([]byte("ACGTACGTAC")),
+			Qual:  make([]byte, 10),
+		}
+		require.NoError(t, w.Write(r))
+	}
+	for _, ref := range []*sam.Reference{refs[0], refs[2]} {
+		for i := 0; i < 1000; i++ {
+			pos := i * (refLen / 1000)
+			write(fmt.Sprintf("%s_%d", ref.Name(), i), ref, pos, 0, sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 10)})
+			if (ref == refs[0]) && (i == 500) {
+				write("unmapped", ref, pos, sam.Unmapped, nil)
+			}
+		}
+	}
+	write("unplaced0", nil, -1, sam.Unmapped, nil)
+	write("unplaced1", nil, -1, sam.Unmapped, nil)
+	require.NoError(t, w.Close())
+	return buf.Bytes(), refs
+}
+
+// readChunkNames returns the names of the records in chunks of the .bam file
+// data which overlap [beg, end) of ref.
+func readChunkNames(t *testing.T, data []byte, chunks []bgzf.Chunk, ref *sam.Reference, beg, end int) []string {
+	r, err := biogobam.NewReader(bytes.NewReader(data), 1)
+	require.NoError(t, err)
+	var names []string
+	for _, c := range chunks {
+		it, err := biogobam.NewIterator(r, []bgzf.Chunk{c})
+		require.NoError(t, err)
+		for it.Next() {
+			rec := it.Record()
+			// As in BuildIndex, a record without an alignment spans one
+			// position.
+			recEnd := rec.End()
+			if recEnd <= rec.Pos {
+				recEnd = rec.Pos + 1
+			}
+			if (rec.Ref == nil) || (rec.Ref.ID() != ref.ID()) || (rec.Pos >= end) || (recEnd <= beg) {
+				continue
+			}
+			names = append(names, rec.Name)
+		}
+		require.NoError(t, it.Close())
+	}
+	return names
+}
+
+func TestBuildIndexBAI(t *testing.T) {
+	data, refs := buildIndexTestBAM(t, 1000000)
+	var out bytes.Buffer
+	require.NoError(t, BuildIndex(bytes.NewReader(data), &out, BuildIndexOpts{Parallelism: 2}))
+
+	index, err := ReadIndex(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 3, len(index.Refs))
+	assert.Equal(t, uint64(1000), index.Refs[0].Meta.MappedCount)
+	assert.Equal(t, uint64(1), index.Refs[0].Meta.UnmappedCount)
+	assert.Equal(t, 0, len(index.Refs[1].Bins))
+	assert.Equal(t, uint64(1000), index.Refs[2].Meta.MappedCount)
+	require.NotNil(t, index.UnmappedCount)
+	assert.Equal(t, uint64(2), *index.UnmappedCount)
+	// The last read ends at 999010, in 16kbp window 60.
+	assert.Equal(t, 61, len(index.Refs[0].Intervals))
+
+	htsIndex, err := biogobam.ReadIndex(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	chunks, err := htsIndex.Chunks(refs[2], 500000, 502001)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chr2_500", "chr2_501", "chr2_502"}, readChunkNames(t, data, chunks, refs[2], 500000, 502001))
+	chunks, err = htsIndex.Chunks(refs[0], 500000, 500001)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chr0_500", "unmapped"}, readChunkNames(t, data, chunks, refs[0], 500000, 500001))
+}
+
+func TestBuildIndexCSI(t *testing.T) {
+	// The positions are beyond the range of a .bai index.
+	const refLen = 1 << 30
+	data, refs := buildIndexTestBAM(t, refLen)
+	var out bytes.Buffer
+	err := BuildIndex(bytes.NewReader(data), &out, BuildIndexOpts{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "use a CSI index")
+
+	out.Reset()
+	require.NoError(t, BuildIndex(bytes.NewReader(data), &out, BuildIndexOpts{Format: IndexCSI}))
+	r, err := bgzf.NewReader(&out, 1)
+	require.NoError(t, err)
+	index, err := csi.ReadFrom(r)
+	require.NoError(t, err)
+	beg, end := 900*(refLen/1000), 900*(refLen/1000)+1
+	chunks := index.Chunks(refs[0].ID(), beg, end)
+	assert.Equal(t, []string{"chr0_900"}, readChunkNames(t, data, chunks, refs[0], beg, end))
+	n, ok := index.Unmapped()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), n)
+}
+
+func TestBuildIndexUnsorted(t *testing.T) {
+	ref, err := sam.NewReference("chr0", "", "", 1000, nil, nil)
+	require.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w, err := biogobam.NewWriter(&buf, header, 1)
+	require.NoError(t, err)
+	for _, pos := range []int{10, 5} {
+		require.NoError(t, w.Write(&sam.Record{Name: "r", Ref: ref, Pos: pos, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 1)}, Seq: sam.NewSeq([]byte("A")), Qual: []byte{30}}))
+	}
+	require.NoError(t, w.Close())
+	err = BuildIndex(&buf, &bytes.Buffer{}, BuildIndexOpts{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not sorted by coordinate")
+}
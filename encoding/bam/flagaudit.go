@@ -0,0 +1,153 @@
+package bam
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// FlagProblem is a kind of inconsistency between a record's flags and its
+// other fields.  Such records are usually produced by tools which edit mate
+// information without updating the flags, e.g. when slicing a BAM by region;
+// they confuse code which relies on the flags to find mates, such as mate
+// overlap detection and duplicate marking.
+type FlagProblem int
+
+const (
+	// MateFlagsUnpaired is an unpaired read with flags which describe its
+	// mate (proper pair, mate unmapped, mate reverse, read 1 or 2).
+	MateFlagsUnpaired FlagProblem = iota
+	// MateMissingCoords is a paired read whose mate is flagged as mapped, but
+	// which has no mate position.
+	MateMissingCoords
+	// ProperPairUnmapped is a proper pair in which the read or its mate is
+	// unmapped.
+	ProperPairUnmapped
+	// ProperPairCrossRef is a proper pair whose mate is on another reference.
+	ProperPairCrossRef
+
+	// NumFlagProblems is the number of FlagProblem values.
+	NumFlagProblems
+)
+
+var flagProblemNames = [NumFlagProblems]string{
+	"mate_flags_unpaired",
+	"mate_missing_coords",
+	"proper_pair_unmapped",
+	"proper_pair_cross_ref",
+}
+
+// String returns the name of p, e.g. "mate_missing_coords".
+func (p FlagProblem) String() string {
+	if p >= 0 && p < NumFlagProblems {
+		return flagProblemNames[p]
+	}
+	return fmt.Sprintf("FlagProblem(%d)", int(p))
+}
+
+// FlagProblems is a set of FlagProblems.
+type FlagProblems uint32
+
+// Has returns true if p is in s.
+func (s FlagProblems) Has(p FlagProblem) bool {
+	return s&(1<<uint(p)) != 0
+}
+
+func (s *FlagProblems) add(p FlagProblem) {
+	*s |= 1 << uint(p)
+}
+
+const mateFlags = sam.ProperPair | sam.MateUnmapped | sam.MateReverse | sam.Read1 | sam.Read2
+
+// AuditFlags returns the problems of r's flags.  It only looks at r itself,
+// so it doesn't detect disagreements between mates.
+func AuditFlags(r *sam.Record) FlagProblems {
+	var s FlagProblems
+	if r.Flags&sam.Paired == 0 {
+		if r.Flags&mateFlags != 0 {
+			s.add(MateFlagsUnpaired)
+		}
+		return s
+	}
+	if (r.Flags&sam.MateUnmapped == 0) && ((r.MateRef == nil) || (r.MatePos < 0)) {
+		s.add(MateMissingCoords)
+	}
+	if r.Flags&sam.ProperPair != 0 {
+		if (r.Flags&(sam.Unmapped|sam.MateUnmapped) != 0) || s.Has(MateMissingCoords) {
+			s.add(ProperPairUnmapped)
+		} else if (r.Ref != nil) && (r.MateRef.ID() != r.Ref.ID()) {
+			s.add(ProperPairCrossRef)
+		}
+	}
+	return s
+}
+
+// RepairFlags fixes the problems found by AuditFlags, and returns them.
+// Mate flags of unpaired reads are cleared; a mate without a position is
+// flagged as unmapped, since it can't be located; and the proper pair flag
+// is cleared from pairs which can't be proper.
+func RepairFlags(r *sam.Record) FlagProblems {
+	s := AuditFlags(r)
+	if s.Has(MateFlagsUnpaired) {
+		r.Flags &^= mateFlags
+	}
+	if s.Has(MateMissingCoords) {
+		r.Flags |= sam.MateUnmapped
+		r.Flags &^= sam.MateReverse
+		r.TempLen = 0
+	}
+	if s.Has(ProperPairUnmapped) || s.Has(ProperPairCrossRef) {
+		r.Flags &^= sam.ProperPair
+	}
+	return s
+}
+
+// FlagAuditor applies AuditFlags, or RepairFlags if Repair is set, to a
+// stream of records, and counts the problems.  It may be used concurrently.
+type FlagAuditor struct {
+	Repair bool
+
+	records int64
+	counts  [NumFlagProblems]int64
+}
+
+// Apply audits, and optionally repairs, r.
+func (a *FlagAuditor) Apply(r *sam.Record) FlagProblems {
+	var s FlagProblems
+	if a.Repair {
+		s = RepairFlags(r)
+	} else {
+		s = AuditFlags(r)
+	}
+	atomic.AddInt64(&a.records, 1)
+	if s != 0 {
+		for p := FlagProblem(0); p < NumFlagProblems; p++ {
+			if s.Has(p) {
+				atomic.AddInt64(&a.counts[p], 1)
+			}
+		}
+	}
+	return s
+}
+
+// Count returns the number of records with problem p.
+func (a *FlagAuditor) Count(p FlagProblem) int64 {
+	return atomic.LoadInt64(&a.counts[p])
+}
+
+// String summarizes the counts, e.g. "1000 records; mate_missing_coords: 3".
+func (a *FlagAuditor) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d records", atomic.LoadInt64(&a.records))
+	for p := FlagProblem(0); p < NumFlagProblems; p++ {
+		if n := a.Count(p); n > 0 {
+			fmt.Fprintf(&b, "; %s: %d", p, n)
+		}
+	}
+	if a.Repair {
+		b.WriteString(" (repaired)")
+	}
+	return b.String()
+}
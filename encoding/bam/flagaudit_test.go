@@ -0,0 +1,71 @@
+package bam_test
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func TestAuditFlags(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	assert.NoError(t, err)
+
+	paired := sam.Paired | sam.ProperPair | sam.Read1
+	tests := []struct {
+		rec       sam.Record
+		problems  []bam.FlagProblem
+		wantFlags sam.Flags
+	}{
+		{
+			rec:       sam.Record{Ref: chr1, Pos: 10, Flags: paired, MateRef: chr1, MatePos: 100, TempLen: 100},
+			wantFlags: paired,
+		},
+		{
+			rec:       sam.Record{Ref: chr1, Pos: 10, Flags: sam.Read1 | sam.MateReverse, MateRef: nil, MatePos: -1},
+			problems:  []bam.FlagProblem{bam.MateFlagsUnpaired},
+			wantFlags: 0,
+		},
+		{
+			// The mate was on a reference dropped by HeaderSubset.RemapRecord.
+			rec:       sam.Record{Ref: chr1, Pos: 10, Flags: paired | sam.MateReverse, MateRef: nil, MatePos: -1},
+			problems:  []bam.FlagProblem{bam.MateMissingCoords, bam.ProperPairUnmapped},
+			wantFlags: sam.Paired | sam.Read1 | sam.MateUnmapped,
+		},
+		{
+			rec:       sam.Record{Ref: chr1, Pos: 10, Flags: paired | sam.MateUnmapped, MateRef: chr1, MatePos: 10},
+			problems:  []bam.FlagProblem{bam.ProperPairUnmapped},
+			wantFlags: sam.Paired | sam.Read1 | sam.MateUnmapped,
+		},
+		{
+			rec:       sam.Record{Ref: chr1, Pos: 10, Flags: paired, MateRef: chr2, MatePos: 100},
+			problems:  []bam.FlagProblem{bam.ProperPairCrossRef},
+			wantFlags: sam.Paired | sam.Read1,
+		},
+	}
+	auditor := bam.FlagAuditor{Repair: true}
+	for _, test := range tests {
+		rec := test.rec
+		s := bam.AuditFlags(&rec)
+		for p := bam.FlagProblem(0); p < bam.NumFlagProblems; p++ {
+			want := false
+			for _, q := range test.problems {
+				want = want || (p == q)
+			}
+			expect.EQ(t, s.Has(p), want, "rec %+v, problem %v", test.rec, p)
+		}
+		expect.EQ(t, rec.Flags, test.rec.Flags)
+		expect.EQ(t, auditor.Apply(&rec), s)
+		expect.EQ(t, rec.Flags, test.wantFlags)
+		// Repaired records have no problems left.
+		expect.EQ(t, bam.AuditFlags(&rec), bam.FlagProblems(0))
+	}
+	expect.EQ(t, auditor.Count(bam.ProperPairUnmapped), int64(2))
+	expect.EQ(t, auditor.String(), "5 records; mate_flags_unpaired: 1; mate_missing_coords: 1; proper_pair_unmapped: 2; proper_pair_cross_ref: 1 (repaired)")
+}
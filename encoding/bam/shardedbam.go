@@ -2,12 +2,15 @@ package bam
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"sync"
 
 	"github.com/grailbio/base/syncqueue"
 	"github.com/grailbio/bio/encoding/bgzf"
 	htsbam "github.com/grailbio/hts/bam"
+	htsbgzf "github.com/grailbio/hts/bgzf"
 	"github.com/grailbio/hts/sam"
 	"v.io/x/lib/vlog"
 )
@@ -57,6 +60,14 @@ import (
 //   if c1.CloseShard() != nil { panic }
 //
 //   if w.Close() != nil { panic }
+//
+// By default, each ShardedBAMCompressor compresses its blocks in the
+// goroutine that calls AddRecord and CloseShard.  With
+// ShardedBAMOpts.Parallelism, the blocks of all the compressors are
+// compressed by a pool of goroutines instead, so that even a single
+// producer keeps many cores busy.  With ShardedBAMOpts.Index, the
+// writer also builds the .bai index of the BAM as it writes the
+// shards.
 
 var (
 	// magicBlock is the Bgzf EOF terminator.  It belongs at the end
@@ -67,6 +78,66 @@ var (
 	}
 )
 
+// ShardedBAMOpts defines optional behavior of a ShardedBAMWriter.
+type ShardedBAMOpts struct {
+	// Parallelism, if positive, is the number of goroutines that compress
+	// the BGZF blocks of all the compressors.  AddRecord then only
+	// serializes the records.  If zero, each compressor compresses its own
+	// blocks.
+	Parallelism int
+
+	// Index, if non-nil, receives the .bai index of the BAM file when the
+	// writer is closed.  The index is built as the shards are written, so
+	// the records, taken in shard number order, must be sorted by
+	// coordinate.
+	Index io.Writer
+}
+
+// shardOffset is a position in the uncompressed data of a shard: the index of
+// a block of the shard, and an offset within the block.
+type shardOffset struct {
+	block, offset int
+}
+
+// indexEntry is what the .bai index needs to know about a record.
+type indexEntry struct {
+	ref          *sam.Reference
+	pos, end     int
+	flags        sam.Flags
+	begin, limit shardOffset
+}
+
+// bgzfBlock is a block of a shard.  data is the uncompressed payload until the
+// block is compressed, and the BGZF block afterwards.  done, if non-nil, is
+// closed once the block is compressed by the writer's pool.
+type bgzfBlock struct {
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+// blockCompressor compresses bgzfBlocks one at a time.  Thread compatible.
+type blockCompressor struct {
+	w   *bgzf.Writer
+	out bytes.Buffer
+}
+
+func newBlockCompressor(gzLevel int) (*blockCompressor, error) {
+	bc := &blockCompressor{}
+	var err error
+	bc.w, err = bgzf.NewWriter(&bc.out, gzLevel)
+	return bc, err
+}
+
+// compress replaces b.data with its compressed BGZF block, or sets b.err.
+func (bc *blockCompressor) compress(b *bgzfBlock) {
+	bc.out.Reset()
+	if _, b.err = bc.w.Write(b.data); b.err == nil {
+		b.err = bc.w.CloseWithoutTerminator()
+	}
+	b.data = append([]byte(nil), bc.out.Bytes()...)
+}
+
 // ShardedBAMCompressor contains the state of an in-progress
 // compressed shard.  A caller should create a ShardedBAMCompressor
 // using ShardedBAMWriter.GetCompressor().  The ShardedBAMCompressor
@@ -76,10 +147,11 @@ var (
 // ShardedBAMCompressor can exist at once, and they can all compress
 // records in parallel with each other.
 type ShardedBAMCompressor struct {
-	writer *ShardedBAMWriter
-	bgzf   *bgzf.Writer
-	output *shardedBAMBuffer
-	buf    bytes.Buffer
+	writer     *ShardedBAMWriter
+	compressor *blockCompressor // nil if the writer has a pool
+	output     *shardedBAMBuffer
+	block      bytes.Buffer // uncompressed data of the current block
+	buf        bytes.Buffer
 }
 
 // StartShard begins a new shard with the specified shard number.  If
@@ -96,10 +168,13 @@ func (c *ShardedBAMCompressor) StartShard(shardNum int) error {
 		// StartShard(-1).
 		shardNum: shardNum + 1,
 	}
-
-	var err error
-	c.bgzf, err = bgzf.NewWriter(&c.output.buf, c.writer.gzLevel)
-	return err
+	c.block.Reset()
+	if c.writer.pool == nil && c.compressor == nil {
+		var err error
+		c.compressor, err = newBlockCompressor(c.writer.gzLevel)
+		return err
+	}
+	return nil
 }
 
 // addHeader adds a sam header to the current shard.  This must be
@@ -107,16 +182,57 @@ func (c *ShardedBAMCompressor) StartShard(shardNum int) error {
 // be at the correct position in the bam file; NewShardedBAMWriter
 // takes care of that for users.
 func (c *ShardedBAMCompressor) addHeader(h *sam.Header) error {
-	return h.EncodeBinary(c.bgzf)
+	if err := h.EncodeBinary(&c.block); err != nil {
+		return err
+	}
+	return c.flush(false)
+}
+
+// offset returns the position of the next byte added to the shard.
+func (c *ShardedBAMCompressor) offset() shardOffset {
+	return shardOffset{block: len(c.output.blocks), offset: c.block.Len()}
+}
+
+// flush cuts the full blocks off c.block, or all the remaining data if
+// all, and compresses them or sends them to the writer's pool.
+func (c *ShardedBAMCompressor) flush(all bool) error {
+	for c.block.Len() >= bgzf.DefaultUncompressedBlockSize || (all && c.block.Len() > 0) {
+		b := &bgzfBlock{data: append([]byte(nil), c.block.Next(bgzf.DefaultUncompressedBlockSize)...)}
+		c.output.blocks = append(c.output.blocks, b)
+		if c.writer.pool != nil {
+			b.done = make(chan struct{})
+			c.writer.pool <- b
+			continue
+		}
+		c.compressor.compress(b)
+		if b.err != nil {
+			return b.err
+		}
+	}
+	return nil
 }
 
 // AddRecord adds a sam record to the current in-progress shard.
 func (c *ShardedBAMCompressor) AddRecord(r *sam.Record) error {
+	begin := c.offset()
 	if err := htsbam.Marshal(r, &c.buf); err != nil {
 		return err
 	}
-	_, err := c.buf.WriteTo(c.bgzf)
-	return err
+	c.buf.WriteTo(&c.block) // nolint: errcheck
+	if err := c.flush(false); err != nil {
+		return err
+	}
+	if c.writer.index != nil {
+		c.output.records = append(c.output.records, indexEntry{
+			ref:   r.Ref,
+			pos:   r.Pos,
+			end:   r.End(),
+			flags: r.Flags,
+			begin: begin,
+			limit: c.offset(),
+		})
+	}
+	return nil
 }
 
 // CloseShard finalizes the in-progress shard, and passes the
@@ -128,7 +244,7 @@ func (c *ShardedBAMCompressor) AddRecord(r *sam.Record) error {
 // the caller must be careful about how out of order it is when
 // calling CloseShard(), otherwise, calls to CloseShard() will block.
 func (c *ShardedBAMCompressor) CloseShard() error {
-	if err := c.bgzf.CloseWithoutTerminator(); err != nil {
+	if err := c.flush(true); err != nil {
 		return err
 	}
 	f := c.output
@@ -139,7 +255,8 @@ func (c *ShardedBAMCompressor) CloseShard() error {
 // ShardedBAMBuffer represents a shard of the final output bam file.
 // The shardNum should be numbered sequentially from 0 to N.
 type shardedBAMBuffer struct {
-	buf      bytes.Buffer
+	blocks   []*bgzfBlock
+	records  []indexEntry // only set if the writer builds an index
 	shardNum int
 }
 
@@ -151,16 +268,60 @@ type ShardedBAMWriter struct {
 	queue     *syncqueue.OrderedQueue
 	waitGroup sync.WaitGroup
 	err       error
+
+	// pool receives the blocks to compress, if opts.Parallelism > 0.
+	pool    chan *bgzfBlock
+	workers sync.WaitGroup
+
+	// The index being built, if opts.Index != nil; nRef is the number of
+	// references in the header, and offset is the file offset of the next
+	// block to write.
+	indexOut io.Writer
+	index    *htsbam.Index
+	nRef     int
+	offset   uint64
 }
 
 // NewShardedBAMWriter creates a new ShardedBAMWriter that writes the
-// output bam to w.
-func NewShardedBAMWriter(w io.Writer, gzLevel, queueSize int, header *sam.Header) (*ShardedBAMWriter, error) {
+// output bam to w.  At most one ShardedBAMOpts may be given.
+func NewShardedBAMWriter(w io.Writer, gzLevel, queueSize int, header *sam.Header, optList ...ShardedBAMOpts) (*ShardedBAMWriter, error) {
+	var opts ShardedBAMOpts
+	if len(optList) > 0 {
+		if len(optList) > 1 {
+			return nil, fmt.Errorf("NewShardedBAMWriter: more than one ShardedBAMOpts specified: %v", optList)
+		}
+		opts = optList[0]
+	}
 	bw := ShardedBAMWriter{
 		w:       w,
 		gzLevel: gzLevel,
 		queue:   syncqueue.NewOrderedQueue(queueSize),
 	}
+	if opts.Index != nil {
+		bw.indexOut = opts.Index
+		bw.index = &htsbam.Index{}
+		bw.nRef = len(header.Refs())
+	}
+	if opts.Parallelism > 0 {
+		compressors := make([]*blockCompressor, opts.Parallelism)
+		for i := range compressors {
+			var err error
+			if compressors[i], err = newBlockCompressor(gzLevel); err != nil {
+				return nil, err
+			}
+		}
+		bw.pool = make(chan *bgzfBlock, opts.Parallelism*2)
+		for _, bc := range compressors {
+			bw.workers.Add(1)
+			go func(bc *blockCompressor) {
+				defer bw.workers.Done()
+				for b := range bw.pool {
+					bc.compress(b)
+					close(b.done)
+				}
+			}(bc)
+		}
+	}
 
 	c := bw.GetCompressor()
 	if err := c.StartShard(-1); err != nil {
@@ -209,8 +370,7 @@ func (bw *ShardedBAMWriter) writeShards() {
 			break
 		}
 		shard := entry.(*shardedBAMBuffer)
-		_, err = shard.buf.WriteTo(bw.w)
-		if err != nil {
+		if err = bw.writeShard(shard); err != nil {
 			bw.err = err
 			bw.queue.Close(err) // nolint: errcheck
 			return
@@ -218,11 +378,92 @@ func (bw *ShardedBAMWriter) writeShards() {
 	}
 }
 
+// writeShard writes the blocks of shard, waiting for the pool to compress them
+// if needed, and adds its records to the index.
+func (bw *ShardedBAMWriter) writeShard(shard *shardedBAMBuffer) error {
+	// The file offsets of the blocks, and of the end of the shard.
+	var offsets []int64
+	if bw.index != nil {
+		offsets = make([]int64, len(shard.blocks)+1)
+	}
+	for i, b := range shard.blocks {
+		if b.done != nil {
+			<-b.done
+		}
+		if b.err != nil {
+			return b.err
+		}
+		if offsets != nil {
+			offsets[i] = int64(bw.offset)
+		}
+		n, err := bw.w.Write(b.data)
+		bw.offset += uint64(n)
+		if err != nil {
+			return err
+		}
+	}
+	if bw.index == nil {
+		return nil
+	}
+	offsets[len(shard.blocks)] = int64(bw.offset)
+	voffset := func(o shardOffset) htsbgzf.Offset {
+		return htsbgzf.Offset{File: offsets[o.block], Block: uint16(o.offset)}
+	}
+	// The index only needs the extent of the alignment, which a single
+	// cigar op reproduces.
+	var cigar [1]sam.CigarOp
+	rec := sam.Record{}
+	for _, e := range shard.records {
+		rec.Ref, rec.Pos, rec.Flags = e.ref, e.pos, e.flags
+		if e.end > e.pos {
+			cigar[0] = sam.NewCigarOp(sam.CigarMatch, e.end-e.pos)
+		} else {
+			cigar[0] = sam.NewCigarOp(sam.CigarInsertion, 1)
+		}
+		rec.Cigar = cigar[:]
+		if err := bw.index.Add(&rec, htsbgzf.Chunk{Begin: voffset(e.begin), End: voffset(e.limit)}); err != nil {
+			return fmt.Errorf("shard %d: %v", shard.shardNum-1, err)
+		}
+	}
+	return nil
+}
+
+// writeIndex writes the .bai index.  The index only has entries up to the last
+// reference with records, so the empty references at the end of the header
+// are added here.
+func (bw *ShardedBAMWriter) writeIndex() error {
+	var buf bytes.Buffer
+	if err := htsbam.WriteIndex(&buf, bw.index); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if missing := bw.nRef - int(binary.LittleEndian.Uint32(data[4:8])); missing > 0 {
+		binary.LittleEndian.PutUint32(data[4:8], uint32(bw.nRef))
+		// Keep the trailing count of unplaced reads at the end.
+		tail := 0
+		if _, ok := bw.index.Unmapped(); ok {
+			tail = 8
+		}
+		padded := make([]byte, 0, len(data)+8*missing)
+		padded = append(padded, data[:len(data)-tail]...)
+		// An empty reference has no bins and no intervals.
+		padded = append(padded, make([]byte, 8*missing)...)
+		data = append(padded, data[len(data)-tail:]...)
+	}
+	_, err := bw.indexOut.Write(data)
+	return err
+}
+
 // Close the bam file.  This should be called only after all shards
-// have been added with WriteShard.  Returns an error of failure.
+// have been added with WriteShard.  Returns an error of failure.  If
+// ShardedBAMOpts.Index was set, Close also writes the index.
 func (bw *ShardedBAMWriter) Close() error {
 	err := bw.queue.Close(nil)
 	bw.waitGroup.Wait()
+	if bw.pool != nil {
+		close(bw.pool)
+		bw.workers.Wait()
+	}
 	if bw.err != nil {
 		return bw.err
 	}
@@ -230,6 +471,11 @@ func (bw *ShardedBAMWriter) Close() error {
 		return err
 	}
 
-	_, err = bw.w.Write(magicBlock)
-	return err
+	if _, err = bw.w.Write(magicBlock); err != nil {
+		return err
+	}
+	if bw.index != nil {
+		return bw.writeIndex()
+	}
+	return nil
 }
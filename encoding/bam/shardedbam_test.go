@@ -35,9 +35,33 @@ func verifyBAM(t *testing.T, records []*sam.Record, bamBuffer *bytes.Buffer) {
 	}
 }
 
-func writeAndVerify(t *testing.T, header *sam.Header, records []*sam.Record, compressors, shards int, forward bool) {
+// verifyIndex checks that index finds the first record of every reference.
+func verifyIndex(t *testing.T, header *sam.Header, records []*sam.Record, bamData []byte, indexData []byte) {
+	index, err := bam.ReadIndex(bytes.NewReader(indexData))
+	assert.NoError(t, err)
+	assert.EQ(t, index.NumRefs(), len(header.Refs()))
+	reader, err := bam.NewReader(bytes.NewReader(bamData), 1)
+	assert.NoError(t, err)
+	var prev *sam.Reference
+	for _, r := range records {
+		if r.Ref == nil || r.Ref == prev {
+			continue
+		}
+		prev = r.Ref
+		chunks, err := index.Chunks(r.Ref, r.Pos, r.Pos+1)
+		assert.NoError(t, err)
+		iter, err := bam.NewIterator(reader, chunks)
+		assert.NoError(t, err)
+		assert.True(t, iter.Next(), "ref %s", r.Ref.Name())
+		expect.EQ(t, iter.Record().Name, r.Name)
+		expect.EQ(t, iter.Record().Pos, r.Pos)
+		assert.NoError(t, iter.Close())
+	}
+}
+
+func writeAndVerify(t *testing.T, header *sam.Header, records []*sam.Record, compressors, shards int, forward bool, optList ...gbam.ShardedBAMOpts) {
 	var bamBuffer bytes.Buffer
-	w, err := gbam.NewShardedBAMWriter(&bamBuffer, gzip.DefaultCompression, 10, header)
+	w, err := gbam.NewShardedBAMWriter(&bamBuffer, gzip.DefaultCompression, 10, header, optList...)
 	if err != nil {
 		t.Errorf("error creating ShardedBAMWriter: %v", err)
 	}
@@ -76,7 +100,13 @@ func writeAndVerify(t *testing.T, header *sam.Header, records []*sam.Record, com
 	}
 	err = w.Close()
 	expect.Nil(t, err)
+	bamData := append([]byte(nil), bamBuffer.Bytes()...)
 	verifyBAM(t, records, &bamBuffer)
+	for _, opts := range optList {
+		if opts.Index != nil {
+			verifyIndex(t, header, records, bamData, opts.Index.(*bytes.Buffer).Bytes())
+		}
+	}
 }
 
 func TestShardedBAMSmall(t *testing.T) {
@@ -111,6 +141,25 @@ func TestShardedBAMSmall(t *testing.T) {
 	}
 	writeAndVerify(t, header, records, 2, 3, true)
 	writeAndVerify(t, header, records, 2, 3, false)
+	writeAndVerify(t, header, records, 2, 3, false, gbam.ShardedBAMOpts{Parallelism: 3, Index: &bytes.Buffer{}})
+
+	// The index must have entries for the references without records.
+	chr3, err := sam.NewReference("chr3", "", "", 3000, nil, nil)
+	expect.Nil(t, err)
+	expect.Nil(t, header.AddReference(chr3))
+	writeAndVerify(t, header, records, 1, 2, true, gbam.ShardedBAMOpts{Index: &bytes.Buffer{}})
+
+	// Shards out of coordinate order can't be indexed.
+	var bamBuffer bytes.Buffer
+	w, err := gbam.NewShardedBAMWriter(&bamBuffer, gzip.DefaultCompression, 10, header, gbam.ShardedBAMOpts{Index: &bytes.Buffer{}})
+	assert.NoError(t, err)
+	c := w.GetCompressor()
+	for i, r := range []*sam.Record{records[6], records[0]} {
+		assert.NoError(t, c.StartShard(i))
+		assert.NoError(t, c.AddRecord(r))
+		assert.NoError(t, c.CloseShard())
+	}
+	assert.NotNil(t, w.Close())
 }
 
 func TestShardedBAMLarge(t *testing.T) {
@@ -131,4 +180,5 @@ func TestShardedBAMLarge(t *testing.T) {
 
 	writeAndVerify(t, reader.Header(), records, 3, 6, true)
 	writeAndVerify(t, reader.Header(), records, 3, 6, false)
+	writeAndVerify(t, reader.Header(), records, 1, 6, true, gbam.ShardedBAMOpts{Parallelism: 4, Index: &bytes.Buffer{}})
 }
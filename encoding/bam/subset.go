@@ -0,0 +1,110 @@
+package bam
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// HeaderSubset is a copy of a sam.Header restricted to some of its
+// references, along with the mapping from the original references to the
+// renumbered ones.  It is used to write small, self-consistent slices of a
+// BAM/PAM, e.g. a mini-BAM covering a few regions of chr7.
+type HeaderSubset struct {
+	// Header is the subsetted header.  Non-@SQ lines are copied from the
+	// original header verbatim.
+	Header *sam.Header
+	// refs[i] is the reference in Header for the original reference with ID
+	// i, or nil if that reference was dropped.
+	refs []*sam.Reference
+}
+
+// SubsetHeader creates a HeaderSubset with the references of h for which keep
+// returns true.  The kept references retain their original relative order,
+// and are renumbered from 0.
+func SubsetHeader(h *sam.Header, keep func(ref *sam.Reference) bool) (*HeaderSubset, error) {
+	kept := map[string]bool{}
+	for _, ref := range h.Refs() {
+		if keep(ref) {
+			kept[ref.Name()] = true
+		}
+	}
+	// Round-trip through the text form, so that every header line other than
+	// the dropped @SQ lines is carried over unchanged.
+	text, err := h.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(text, []byte{'\n'}) {
+		if bytes.HasPrefix(line, []byte("@SQ\t")) && !kept[sqName(line)] {
+			continue
+		}
+		buf.Write(line)
+	}
+	newHeader, err := sam.NewHeader(buf.Bytes(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("bam.SubsetHeader: %v", err)
+	}
+	s := &HeaderSubset{
+		Header: newHeader,
+		refs:   make([]*sam.Reference, len(h.Refs())),
+	}
+	newRefs := newHeader.Refs()
+	for _, ref := range h.Refs() {
+		if !kept[ref.Name()] {
+			continue
+		}
+		if len(newRefs) == 0 || newRefs[0].Name() != ref.Name() {
+			return nil, fmt.Errorf("bam.SubsetHeader: reference %s missing from subset header", ref.Name())
+		}
+		s.refs[ref.ID()] = newRefs[0]
+		newRefs = newRefs[1:]
+	}
+	return s, nil
+}
+
+// sqName returns the SN field of an @SQ header line.
+func sqName(line []byte) string {
+	for _, field := range bytes.Split(bytes.TrimRight(line, "\n"), []byte{'\t'}) {
+		if bytes.HasPrefix(field, []byte("SN:")) {
+			return string(field[3:])
+		}
+	}
+	return ""
+}
+
+// Ref returns the reference in s.Header that corresponds to ref of the
+// original header.  It returns nil if ref is nil or was dropped.
+func (s *HeaderSubset) Ref(ref *sam.Reference) *sam.Reference {
+	if id := ref.ID(); id >= 0 && id < len(s.refs) {
+		return s.refs[id]
+	}
+	return nil
+}
+
+// RemapRecord rewrites r.Ref and r.MateRef to point to s.Header.  It returns
+// false, and leaves r unchanged, if r is mapped to a dropped reference; such
+// records should not be written.  Unmapped records without a position are
+// always kept.
+//
+// If only the mate is on a dropped reference, the mate position is cleared
+// (RNEXT "*", PNEXT 0 and TLEN 0 in SAM terms), since it can't be expressed
+// in the subsetted header.
+func (s *HeaderSubset) RemapRecord(r *sam.Record) bool {
+	var ref *sam.Reference
+	if r.Ref != nil {
+		if ref = s.Ref(r.Ref); ref == nil {
+			return false
+		}
+	}
+	r.Ref = ref
+	if r.MateRef != nil {
+		if r.MateRef = s.Ref(r.MateRef); r.MateRef == nil {
+			r.MatePos = -1
+			r.TempLen = 0
+		}
+	}
+	return true
+}
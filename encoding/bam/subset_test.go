@@ -0,0 +1,66 @@
+package bam_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func TestSubsetHeader(t *testing.T) {
+	var refs []*sam.Reference
+	for i, name := range []string{"chr1", "chr2", "chr3", "chr4"} {
+		ref, err := sam.NewReference(name, "", "", 100+i, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	rg, err := sam.NewReadGroup("rg1", "", "", "", "", "", "", "", "", "", time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, header.AddReadGroup(rg))
+
+	s, err := bam.SubsetHeader(header, func(ref *sam.Reference) bool {
+		return ref.Name() == "chr2" || ref.Name() == "chr4"
+	})
+	assert.NoError(t, err)
+	newRefs := s.Header.Refs()
+	assert.EQ(t, len(newRefs), 2)
+	expect.EQ(t, newRefs[0].Name(), "chr2")
+	expect.EQ(t, newRefs[0].ID(), 0)
+	expect.EQ(t, newRefs[0].Len(), 101)
+	expect.EQ(t, newRefs[1].Name(), "chr4")
+	expect.EQ(t, newRefs[1].ID(), 1)
+	expect.EQ(t, len(s.Header.RGs()), 1)
+	expect.True(t, s.Ref(refs[0]) == nil)
+	expect.True(t, s.Ref(refs[3]) == newRefs[1])
+	expect.True(t, s.Ref(nil) == nil)
+
+	// Both ends kept.
+	r := &sam.Record{Ref: refs[1], Pos: 10, MateRef: refs[3], MatePos: 20, TempLen: 30}
+	expect.True(t, s.RemapRecord(r))
+	expect.True(t, r.Ref == newRefs[0])
+	expect.True(t, r.MateRef == newRefs[1])
+	expect.EQ(t, r.MatePos, 20)
+	expect.EQ(t, r.TempLen, 30)
+
+	// Mate on a dropped reference.
+	r = &sam.Record{Ref: refs[1], Pos: 10, MateRef: refs[2], MatePos: 20, TempLen: 30}
+	expect.True(t, s.RemapRecord(r))
+	expect.True(t, r.MateRef == nil)
+	expect.EQ(t, r.MatePos, -1)
+	expect.EQ(t, r.TempLen, 0)
+
+	// Read on a dropped reference.
+	r = &sam.Record{Ref: refs[0], Pos: 10}
+	expect.False(t, s.RemapRecord(r))
+	expect.True(t, r.Ref == refs[0])
+
+	// Unmapped.
+	r = &sam.Record{Pos: -1, MatePos: -1, Flags: sam.Unmapped}
+	expect.True(t, s.RemapRecord(r))
+	expect.True(t, r.Ref == nil)
+}
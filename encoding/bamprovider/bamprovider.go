@@ -11,8 +11,10 @@ import (
 	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/biopb"
 	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/util/iothrottle"
 	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/bgzf/cache"
 	"github.com/grailbio/hts/bgzf/index"
 	"github.com/grailbio/hts/sam"
 	"v.io/x/lib/vlog"
@@ -28,12 +30,23 @@ const (
 // BAMProvider implements Provider for BAM files.  Both BAM and the index
 // filenames are allowed to be S3 URLs, in which case the data will be read from
 // S3. Otherwise the data will be read from the local filesystem.
+//
+// The iterators of a BAMProvider share the index, which is read once, and
+// optionally a cache of decompressed blocks.  Closed iterators are reused by
+// later NewIterator calls.
 type BAMProvider struct {
 	// Path of the *.bam file. Must be nonempty.
 	Path string
 	// Index is the pathname of *.bam.bai file. If "", Path + ".bai"
 	Index string
-	err   errors.Once
+	// BlockCacheSize, if positive, is the number of decompressed BGZF blocks
+	// (up to 64KiB each) kept in an LRU cache shared by the iterators.  It
+	// helps when iterators read nearby or overlapping regions, e.g. padded
+	// shards.
+	BlockCacheSize int
+	// Throttle, if non-nil, limits the reads of the iterators.
+	Throttle *iothrottle.Throttle
+	err      errors.Once
 
 	mu        sync.Mutex
 	nActive   int
@@ -43,6 +56,9 @@ type BAMProvider struct {
 	bindex    *bam.Index
 	gindex    *gbam.GIndex
 
+	blockCacheOnce sync.Once
+	blockCache     bgzf.Cache
+
 	infoOnce sync.Once
 	header   *sam.Header
 	info     FileInfo
@@ -57,10 +73,11 @@ type bamIterator struct {
 	// Half-open coordinate range to read.
 	startAddr, limitAddr biopb.Coord
 
-	active bool
-	err    error
-	next   *sam.Record
-	done   bool
+	active  bool
+	err     error
+	next    *sam.Record
+	done    bool
+	tracker bookmarkTracker
 }
 
 func (b *BAMProvider) indexPath() string {
@@ -157,16 +174,32 @@ func (b *BAMProvider) initInfo() {
 
 // Close implements the Provider interface.
 func (b *BAMProvider) Close() error {
+	b.mu.Lock()
 	if b.nActive > 0 {
 		vlog.Panicf("%d iterators still active for %+v", b.nActive, b)
 	}
-	for _, iter := range b.freeIters {
+	freeIters := b.freeIters
+	b.freeIters = nil
+	b.mu.Unlock()
+	for _, iter := range freeIters {
 		iter.internalClose()
 	}
-	b.freeIters = nil
 	return b.err.Err()
 }
 
+// getBlockCache returns the block cache shared by the iterators, or nil if
+// BlockCacheSize is not positive.
+func (b *BAMProvider) getBlockCache() bgzf.Cache {
+	b.blockCacheOnce.Do(func() {
+		if b.BlockCacheSize > 0 {
+			// The LRU serializes its own Gets and Puts, so the iterators
+			// can share it.
+			b.blockCache = cache.NewLRU(b.BlockCacheSize)
+		}
+	})
+	return b.blockCache
+}
+
 func (b *BAMProvider) freeIterator(i *bamIterator) {
 	if !i.active {
 		vlog.Panic(i)
@@ -219,9 +252,12 @@ func (b *BAMProvider) allocateIterator() *bamIterator {
 	if iter.in, iter.err = file.Open(ctx, b.Path); iter.err != nil {
 		return &iter
 	}
-	if iter.reader, iter.err = bam.NewReader(iter.in.Reader(ctx), 1); iter.err != nil {
+	if iter.reader, iter.err = bam.NewReader(b.Throttle.Reader(iter.in.Reader(ctx)), 1); iter.err != nil {
 		return &iter
 	}
+	if c := b.getBlockCache(); c != nil {
+		iter.reader.SetCache(c)
+	}
 	iter.firstRecord = iter.reader.LastChunk().End
 	return &iter
 }
@@ -282,9 +318,25 @@ func (b *BAMProvider) NewIterator(shard gbam.Shard) Iterator {
 	return iter
 }
 
+// NewIteratorAt implements the Resumer interface.
+func (b *BAMProvider) NewIteratorAt(shard gbam.Shard, bm Bookmark) Iterator {
+	iter := b.allocateIterator()
+	if iter.err != nil {
+		return iter
+	}
+	iter.reset(shard.StartRef, shard.PaddedStart(), shard.EndRef, shard.PaddedEnd())
+	if iter.err != nil {
+		return iter
+	}
+	iter.tracker = resumeBookmarkTracker(bm)
+	iter.err = iter.reader.Seek(fromVOffset(bm.VOffset))
+	return iter
+}
+
 // Reset the iterator to read the range [<startRef,startPos>, <endRef, endPos>).
 func (i *bamIterator) reset(startRef *sam.Reference, startPos int, endRef *sam.Reference, endPos int) {
 	header := i.reader.Header()
+	i.tracker = newBookmarkTracker()
 	i.startAddr = biopb.Coord{int32(startRef.ID()), int32(startPos), 0}
 	i.limitAddr = biopb.Coord{int32(endRef.ID()), int32(endPos), 0}
 	if i.startAddr.GE(i.limitAddr) {
@@ -430,7 +482,12 @@ func (i *bamIterator) Scan() bool {
 		if recAddr.LT(i.startAddr) {
 			continue
 		}
-		return recAddr.LT(i.limitAddr)
+		if !recAddr.LT(i.limitAddr) {
+			return false
+		}
+		i.tracker.observe(i.next)
+		i.tracker.vOffset = toVOffset(i.reader.LastChunk().End)
+		return true
 	}
 }
 
@@ -438,6 +495,11 @@ func (i *bamIterator) Record() *sam.Record {
 	return i.next
 }
 
+// Bookmark implements the Bookmarker interface.
+func (i *bamIterator) Bookmark() Bookmark {
+	return i.tracker.bookmark()
+}
+
 func (i *bamIterator) internalClose() {
 	if i.reader != nil {
 		if err := i.reader.Close(); err != nil && i.err == nil {
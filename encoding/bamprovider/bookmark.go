@@ -0,0 +1,140 @@
+package bamprovider
+
+import (
+	"fmt"
+
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/sam"
+)
+
+// Bookmark is a saved iterator position.  It lets a consumer that crashed or
+// paused resume reading a shard just after the last record it processed,
+// instead of rereading the shard from its start.  Bookmarks are plain values,
+// so they can be checkpointed along with the consumer's own state.
+//
+// A Bookmark is only meaningful for the file and shard of the iterator that
+// produced it.
+type Bookmark struct {
+	// N is the number of records the iterator had returned.  The zero Bookmark
+	// is the start of the shard.
+	N int64
+	// Addr is the coordinate of the last record returned.  Its Seq field
+	// counts the earlier records in the shard at the same position, so Addr
+	// identifies the record exactly.
+	Addr biopb.Coord
+	// VOffset is the bgzf virtual offset of the record following Addr, for
+	// BAM iterators.  It is 0 otherwise.
+	VOffset uint64
+}
+
+// Bookmarker is implemented by Iterators that can report their position.  The
+// Iterators created by the Providers in this package all implement it.
+type Bookmarker interface {
+	// Bookmark returns the position just after the record returned by the
+	// last successful Scan.
+	Bookmark() Bookmark
+}
+
+// Resumer is implemented by Providers that can seek directly to a Bookmark's
+// VOffset.
+type Resumer interface {
+	// NewIteratorAt returns an iterator over the records of shard after the
+	// one bookmarked by b.
+	NewIteratorAt(shard gbam.Shard, b Bookmark) Iterator
+}
+
+// SaveBookmark returns the position of iter; see Bookmark.
+func SaveBookmark(iter Iterator) (Bookmark, error) {
+	if b, ok := iter.(Bookmarker); ok {
+		return b.Bookmark(), nil
+	}
+	return Bookmark{}, fmt.Errorf("SaveBookmark: %T does not support bookmarks", iter)
+}
+
+// ResumeIterator returns an iterator over the records of shard after the one
+// bookmarked by b, which must have been saved from an iterator over the same
+// shard of the same file.  BAM iterators seek straight to b.VOffset.  Other
+// iterators scan the shard from its start and discard the records up to b;
+// this avoids reprocessing them, but not rereading them.
+func ResumeIterator(p Provider, shard gbam.Shard, b Bookmark) Iterator {
+	if b.N == 0 {
+		return p.NewIterator(shard)
+	}
+	if r, ok := p.(Resumer); ok && b.VOffset != 0 {
+		return r.NewIteratorAt(shard, b)
+	}
+	return &resumedIterator{Iterator: p.NewIterator(shard), tracker: newBookmarkTracker(), b: b, skipping: true}
+}
+
+func toVOffset(off bgzf.Offset) uint64 {
+	return uint64(off.File)<<16 | uint64(off.Block)
+}
+
+func fromVOffset(v uint64) bgzf.Offset {
+	return bgzf.Offset{File: int64(v >> 16), Block: uint16(v)}
+}
+
+// bookmarkTracker follows the records returned by an iterator, for
+// Bookmarker implementations.
+type bookmarkTracker struct {
+	n       int64
+	gen     gbam.CoordGenerator
+	vOffset uint64
+}
+
+func newBookmarkTracker() bookmarkTracker {
+	return bookmarkTracker{gen: gbam.NewCoordGenerator()}
+}
+
+// resumeBookmarkTracker returns a tracker that continues from b.
+func resumeBookmarkTracker(b Bookmark) bookmarkTracker {
+	return bookmarkTracker{n: b.N, gen: gbam.CoordGenerator{LastRec: b.Addr}, vOffset: b.VOffset}
+}
+
+// observe records that r was returned.
+func (t *bookmarkTracker) observe(r *sam.Record) {
+	t.gen.GenerateFromRecord(r)
+	t.n++
+}
+
+func (t *bookmarkTracker) bookmark() Bookmark {
+	if t.n == 0 {
+		return Bookmark{}
+	}
+	return Bookmark{N: t.n, Addr: t.gen.LastRec, VOffset: t.vOffset}
+}
+
+// resumedIterator skips the records of an iterator up to and including the
+// bookmarked one.
+type resumedIterator struct {
+	Iterator
+	tracker  bookmarkTracker
+	b        Bookmark
+	skipping bool
+}
+
+// Scan implements the Iterator interface.
+func (i *resumedIterator) Scan() bool {
+	for i.Iterator.Scan() {
+		i.tracker.observe(i.Iterator.Record())
+		if !i.skipping {
+			return true
+		}
+		addr := i.tracker.gen.LastRec
+		if addr.LT(i.b.Addr) {
+			continue
+		}
+		i.skipping = false
+		if addr.GT(i.b.Addr) {
+			// The bookmarked record is gone, e.g. because the shard changed.
+			// Resume at the first record after its position.
+			return true
+		}
+	}
+	return false
+}
+
+// Bookmark implements the Bookmarker interface.
+func (i *resumedIterator) Bookmark() Bookmark { return i.tracker.bookmark() }
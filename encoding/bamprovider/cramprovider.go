@@ -0,0 +1,279 @@
+package bamprovider
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/cram"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/util/iothrottle"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// CRAMProvider implements Provider for CRAM files.  As with BAMProvider, the
+// paths may be S3 URLs.
+type CRAMProvider struct {
+	// Path of the *.cram file. Must be nonempty.
+	Path string
+	// Index is the pathname of the *.cram.crai file. If "", Path + ".crai"
+	Index string
+	// Reference is the pathname of the reference FASTA the file was compressed
+	// against.  If "", sequences are fetched by the MD5s in the header from
+	// cram.DefaultMD5URL.
+	Reference string
+	// Throttle, if non-nil, limits the reads of the iterators.
+	Throttle *iothrottle.Throttle
+	err      errors.Once
+
+	mu      sync.Mutex
+	nActive int
+
+	indexOnce sync.Once
+	index     *cram.Index
+
+	refOnce sync.Once
+	ref     cram.Reference
+
+	infoOnce sync.Once
+	header   *sam.Header
+	info     FileInfo
+}
+
+type cramIterator struct {
+	provider *CRAMProvider
+	in       file.File
+	reader   *cram.Reader
+	// Half-open coordinate range to read.
+	startAddr, limitAddr biopb.Coord
+
+	err     error
+	next    *sam.Record
+	tracker bookmarkTracker
+}
+
+func (c *CRAMProvider) indexPath() string {
+	if c.Index == "" {
+		return c.Path + ".crai"
+	}
+	return c.Index
+}
+
+// readIndex reads the *.crai file into c.index.
+func (c *CRAMProvider) readIndex() error {
+	c.indexOnce.Do(func() {
+		ctx := vcontext.Background()
+		in, err := file.Open(ctx, c.indexPath())
+		if err != nil {
+			c.err.Set(err)
+			return
+		}
+		if c.index, err = cram.ReadIndex(in.Reader(ctx)); err != nil {
+			c.err.Set(err)
+		}
+		c.err.Set(in.Close(ctx))
+	})
+	return c.err.Err()
+}
+
+// reference returns the source of reference bases, reading the FASTA on
+// first use.
+func (c *CRAMProvider) reference() (cram.Reference, error) {
+	c.refOnce.Do(func() {
+		if c.Reference == "" {
+			c.ref = &cram.MD5Reference{}
+			return
+		}
+		ctx := vcontext.Background()
+		in, err := file.Open(ctx, c.Reference)
+		if err != nil {
+			c.err.Set(err)
+			return
+		}
+		fa, err := fasta.New(in.Reader(ctx), fasta.OptClean)
+		if err != nil {
+			c.err.Set(err)
+		} else {
+			c.ref = cram.NewFASTAReference(fa)
+		}
+		c.err.Set(in.Close(ctx))
+	})
+	return c.ref, c.err.Err()
+}
+
+// FileInfo implements the Provider interface.
+func (c *CRAMProvider) FileInfo() (FileInfo, error) {
+	c.initInfo()
+	if err := c.err.Err(); err != nil {
+		return FileInfo{}, err
+	}
+	return c.info, nil
+}
+
+// GetHeader implements the Provider interface.
+func (c *CRAMProvider) GetHeader() (*sam.Header, error) {
+	c.initInfo()
+	if err := c.err.Err(); err != nil {
+		return nil, err
+	}
+	return c.header, nil
+}
+
+func (c *CRAMProvider) initInfo() {
+	c.infoOnce.Do(func() {
+		ctx := vcontext.Background()
+		in, err := file.Open(ctx, c.Path)
+		if err != nil {
+			c.err.Set(err)
+			return
+		}
+		defer func() { c.err.Set(in.Close(ctx)) }()
+		info, err := in.Stat(ctx)
+		if err != nil {
+			c.err.Set(err)
+			return
+		}
+		c.info = FileInfo{ModTime: info.ModTime(), Size: info.Size()}
+		reader, err := cram.NewReader(in.Reader(ctx), nil)
+		if err != nil {
+			c.err.Set(err)
+			return
+		}
+		c.header = reader.Header()
+	})
+}
+
+// Close implements the Provider interface.
+func (c *CRAMProvider) Close() error {
+	if c.nActive > 0 {
+		vlog.Panicf("%d iterators still active for %+v", c.nActive, c)
+	}
+	return c.err.Err()
+}
+
+// GenerateShards implements the Provider interface.  Only position-based
+// sharding is supported.
+func (c *CRAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	if opts.Strategy == ByteBased {
+		return nil, fmt.Errorf("GenerateShards: byte-based sharding is not supported for CRAM files")
+	}
+	if (opts.SplitMappedCoords || opts.SplitUnmappedCoords) && (opts.Padding != 0) {
+		return nil, fmt.Errorf("GenerateShards: nonzero Padding cannot be specified with Split*Coords")
+	}
+	header, err := c.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return gbam.GetPositionBasedShards(header, 100000, opts.Padding, opts.IncludeUnmapped)
+}
+
+// GetFileShards implements the Provider interface.
+func (c *CRAMProvider) GetFileShards() ([]gbam.Shard, error) {
+	header, err := c.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []gbam.Shard{gbam.UniversalShard(header)}, nil
+}
+
+// NewIterator implements the Provider interface.
+func (c *CRAMProvider) NewIterator(shard gbam.Shard) Iterator {
+	c.mu.Lock()
+	c.nActive++
+	c.mu.Unlock()
+	iter := &cramIterator{
+		provider:  c,
+		tracker:   newBookmarkTracker(),
+		startAddr: biopb.Coord{int32(shard.StartRef.ID()), int32(shard.PaddedStart()), 0},
+		limitAddr: biopb.Coord{int32(shard.EndRef.ID()), int32(shard.PaddedEnd()), 0},
+	}
+	if iter.startAddr.GE(iter.limitAddr) {
+		iter.err = fmt.Errorf("start coord (%v) not before limit coord (%v)", iter.startAddr, iter.limitAddr)
+		return iter
+	}
+	ref, err := c.reference()
+	if err == nil {
+		err = c.readIndex()
+	}
+	if err != nil {
+		iter.err = err
+		return iter
+	}
+	// Unmapped shards have StartRef == nil, whose ID is -1, as
+	// ContainerOffset expects.
+	off, ok := c.index.ContainerOffset(shard.StartRef.ID(), shard.PaddedStart())
+	if !ok {
+		iter.err = io.EOF
+		return iter
+	}
+	ctx := vcontext.Background()
+	if iter.in, iter.err = file.Open(ctx, c.Path); iter.err != nil {
+		return iter
+	}
+	if iter.reader, iter.err = cram.NewReader(c.Throttle.Reader(iter.in.Reader(ctx)), ref); iter.err != nil {
+		return iter
+	}
+	iter.err = iter.reader.Seek(off)
+	return iter
+}
+
+// Scan implements the Iterator interface.
+func (i *cramIterator) Scan() bool {
+	for i.err == nil {
+		i.next, i.err = i.reader.Read()
+		if i.err != nil {
+			return false
+		}
+		recAddr := gbam.CoordFromSAMRecord(i.next, 0)
+		if recAddr.LT(i.startAddr) {
+			sam.PutInFreePool(i.next)
+			continue
+		}
+		if recAddr.LT(i.limitAddr) {
+			i.tracker.observe(i.next)
+			return true
+		}
+		i.err = io.EOF
+	}
+	return false
+}
+
+// Record implements the Iterator interface.
+func (i *cramIterator) Record() *sam.Record {
+	return i.next
+}
+
+// Bookmark implements the Bookmarker interface.
+func (i *cramIterator) Bookmark() Bookmark {
+	return i.tracker.bookmark()
+}
+
+// Err implements the Iterator interface.
+func (i *cramIterator) Err() error {
+	if i.err == io.EOF {
+		return nil
+	}
+	return i.err
+}
+
+// Close implements the Iterator interface.
+func (i *cramIterator) Close() error {
+	if i.in != nil {
+		if err := i.in.Close(vcontext.Background()); err != nil && i.err == nil {
+			i.err = err
+		}
+		i.in = nil
+	}
+	err := i.Err()
+	i.provider.err.Set(err)
+	i.provider.mu.Lock()
+	i.provider.nActive--
+	i.provider.mu.Unlock()
+	return err
+}
@@ -20,6 +20,7 @@ type fakeIterator struct {
 
 	shardRange    biopb.CoordRange
 	addrGenerator gbam.CoordGenerator
+	tracker       bookmarkTracker
 }
 
 // NewFakeProvider creates a provider that returns "header" in response to a
@@ -99,7 +100,7 @@ func (b *fakeProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, er
 //
 // REQUIRES: shard must be the one created by GenerateShards.
 func (b *fakeProvider) NewIterator(shard gbam.Shard) Iterator {
-	return &fakeIterator{recs: b.recs, rec: nil,
+	return &fakeIterator{recs: b.recs, rec: nil, tracker: newBookmarkTracker(),
 		shardRange: biopb.CoordRange{
 			biopb.Coord{int32(shard.StartRef.ID()), int32(shard.PaddedStart()), int32(shard.StartSeq)},
 			biopb.Coord{int32(shard.EndRef.ID()), int32(shard.PaddedEnd()), int32(shard.EndSeq)},
@@ -125,11 +126,17 @@ func (i *fakeIterator) Scan() bool {
 		i.recs = i.recs[1:]
 		addr := i.addrGenerator.GenerateFromRecord(i.rec)
 		if i.shardRange.Contains(addr) {
+			i.tracker.observe(i.rec)
 			return true
 		}
 	}
 }
 
+// Bookmark implements the Bookmarker interface.
+func (i *fakeIterator) Bookmark() Bookmark {
+	return i.tracker.bookmark()
+}
+
 func (i *fakeIterator) Record() *sam.Record {
 	// Return a copy so that the code under test cannot alter the
 	// original test input data.
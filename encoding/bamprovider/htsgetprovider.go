@@ -0,0 +1,567 @@
+package bamprovider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/util/iothrottle"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+const (
+	// HTSGETScheme is the path prefix of reads served over https by an htsget
+	// server.
+	HTSGETScheme = "htsget://"
+	// HTSGETInsecureScheme is the path prefix of reads served over plain http,
+	// e.g. by a server on the local network.
+	HTSGETInsecureScheme = "htsget+http://"
+)
+
+// HTSGETProvider implements Provider for reads served by an htsget server
+// (https://samtools.github.io/hts-specs/htsget.html).  The path has the form
+//
+//	htsget://host/reads/<id>[?referenceName=<ref>[&start=<start>][&end=<end>]]
+//
+// and the tickets are requested from https://host/reads/<id> (or
+// http://host/reads/<id> for htsget+http:// paths).  referenceName, start and
+// end have the htsget meaning: start and end are zero-based and half-open.  If
+// referenceName is set, GenerateShards only produces shards in that region, and
+// every iterator is clipped to it.
+//
+// Each iterator requests the padded range of its shard from the server, and
+// streams the blocks listed by the ticket, without downloading the file.  Only
+// BAM tickets are supported.  The server has no index to offer, so
+// QueryIndex gives conservative answers, and FileInfo is zero.
+type HTSGETProvider struct {
+	// Path is the htsget:// or htsget+http:// URL of the reads.  Must be
+	// nonempty.
+	Path string
+	// Client issues the ticket and data requests.  If nil, http.DefaultClient.
+	// Set it to add authentication, e.g. with a custom Transport.
+	Client *http.Client
+	// Throttle, if non-nil, limits the reads of the iterators.
+	Throttle *iothrottle.Throttle
+	err      errors.Once
+
+	mu      sync.Mutex
+	nActive int
+
+	parseOnce sync.Once
+	ticketURL string
+	region    htsgetRegion
+
+	infoOnce sync.Once
+	header   *sam.Header
+}
+
+// htsgetRegion is the referenceName, start and end of an htsget request.
+// end < 0 means the end of the reference.  refName "*" requests the unplaced
+// unmapped reads.
+type htsgetRegion struct {
+	refName    string
+	start, end int
+}
+
+// htsgetTicket is the JSON response to an htsget reads request.
+type htsgetTicket struct {
+	HTSGet struct {
+		Format string `json:"format"`
+		URLs   []struct {
+			URL     string            `json:"url"`
+			Headers map[string]string `json:"headers"`
+			Class   string            `json:"class"`
+		} `json:"urls"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	} `json:"htsget"`
+}
+
+type htsgetIterator struct {
+	provider *HTSGETProvider
+	// Regions left to request, and the coordinate range of the current one.
+	regions              []htsgetRegion
+	startAddr, limitAddr biopb.Coord
+	stream               *htsgetStream
+	reader               *bam.Reader
+
+	err     error
+	next    *sam.Record
+	tracker bookmarkTracker
+}
+
+// IsHTSGETPath returns true if path names reads on an htsget server.
+func IsHTSGETPath(path string) bool {
+	return strings.HasPrefix(path, HTSGETScheme) || strings.HasPrefix(path, HTSGETInsecureScheme)
+}
+
+// parseHTSGETPath splits path into the URL of the ticket endpoint and the
+// region restriction it specifies.
+func parseHTSGETPath(path string) (ticketURL string, region htsgetRegion, err error) {
+	region.end = -1
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", region, fmt.Errorf("htsget: %s: %v", path, err)
+	}
+	switch u.Scheme {
+	case "htsget":
+		u.Scheme = "https"
+	case "htsget+http":
+		u.Scheme = "http"
+	default:
+		return "", region, fmt.Errorf("htsget: %s: not an htsget path", path)
+	}
+	for key, vals := range u.Query() {
+		val := vals[len(vals)-1]
+		switch key {
+		case "referenceName":
+			if val == "*" {
+				err = fmt.Errorf("referenceName=* is not supported")
+			}
+			region.refName = val
+		case "start":
+			region.start, err = strconv.Atoi(val)
+		case "end":
+			region.end, err = strconv.Atoi(val)
+		default:
+			err = fmt.Errorf("unsupported parameter %s", key)
+		}
+		if err != nil {
+			return "", region, fmt.Errorf("htsget: %s: %v", path, err)
+		}
+	}
+	if region.refName == "" && (region.start != 0 || region.end >= 0) {
+		return "", region, fmt.Errorf("htsget: %s: start and end require referenceName", path)
+	}
+	if region.start < 0 || (region.end >= 0 && region.end <= region.start) {
+		return "", region, fmt.Errorf("htsget: %s: invalid range [%d, %d)", path, region.start, region.end)
+	}
+	u.RawQuery = ""
+	return u.String(), region, nil
+}
+
+func (h *HTSGETProvider) parsePath() error {
+	h.parseOnce.Do(func() {
+		var err error
+		h.ticketURL, h.region, err = parseHTSGETPath(h.Path)
+		h.err.Set(err)
+	})
+	return h.err.Err()
+}
+
+func (h *HTSGETProvider) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+// get issues a GET request and returns the response body.  Any status other
+// than 200 and 206 is an error, whose message includes the body.
+func (h *HTSGETProvider) get(rawurl string, header map[string]string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("htsget: GET %s: %s: %s", rawurl, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp.Body, nil
+}
+
+// fetchTicket requests the ticket of the region, or of the header if
+// headerOnly.
+func (h *HTSGETProvider) fetchTicket(region htsgetRegion, headerOnly bool) (*htsgetTicket, error) {
+	q := url.Values{"format": {"BAM"}}
+	if headerOnly {
+		q.Set("class", "header")
+	} else if region.refName != "" {
+		q.Set("referenceName", region.refName)
+		if region.refName != "*" {
+			q.Set("start", strconv.Itoa(region.start))
+			if region.end >= 0 {
+				q.Set("end", strconv.Itoa(region.end))
+			}
+		}
+	}
+	body, err := h.get(h.ticketURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close() // nolint: errcheck
+	ticket := &htsgetTicket{}
+	if err := json.NewDecoder(body).Decode(ticket); err != nil {
+		return nil, fmt.Errorf("htsget: %s: bad ticket: %v", h.ticketURL, err)
+	}
+	if ticket.HTSGet.Error != "" {
+		return nil, fmt.Errorf("htsget: %s: %s: %s", h.ticketURL, ticket.HTSGet.Error, ticket.HTSGet.Message)
+	}
+	if f := ticket.HTSGet.Format; f != "" && f != "BAM" {
+		return nil, fmt.Errorf("htsget: %s: unsupported format %s", h.ticketURL, f)
+	}
+	return ticket, nil
+}
+
+// htsgetStream concatenates the blocks of a ticket.  The blocks are fetched one
+// at a time, as the reader reaches them.
+type htsgetStream struct {
+	provider *HTSGETProvider
+	ticket   *htsgetTicket
+	nextURL  int
+	cur      io.ReadCloser
+}
+
+// Read implements io.Reader.
+func (s *htsgetStream) Read(p []byte) (int, error) {
+	for {
+		if s.cur == nil {
+			urls := s.ticket.HTSGet.URLs
+			if s.nextURL >= len(urls) {
+				return 0, io.EOF
+			}
+			var err error
+			if s.cur, err = s.provider.openBlock(urls[s.nextURL].URL, urls[s.nextURL].Headers); err != nil {
+				return 0, err
+			}
+			s.nextURL++
+		}
+		n, err := s.cur.Read(p)
+		if err == io.EOF {
+			err = s.cur.Close()
+			s.cur = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close implements io.Closer.
+func (s *htsgetStream) Close() error {
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close()
+	s.cur = nil
+	return err
+}
+
+// openBlock opens one block of a ticket, which is either an http(s) URL or a
+// data: URI.
+func (h *HTSGETProvider) openBlock(rawurl string, header map[string]string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(rawurl, "data:") {
+		return h.get(rawurl, header)
+	}
+	comma := strings.IndexByte(rawurl, ',')
+	if comma < 0 {
+		return nil, fmt.Errorf("htsget: malformed data URI %.40s", rawurl)
+	}
+	var data []byte
+	var err error
+	if strings.HasSuffix(rawurl[:comma], ";base64") {
+		data, err = base64.StdEncoding.DecodeString(rawurl[comma+1:])
+	} else {
+		var s string
+		s, err = url.PathUnescape(rawurl[comma+1:])
+		data = []byte(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("htsget: malformed data URI %.40s: %v", rawurl, err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// FileInfo implements the Provider interface.  The modification time and size
+// of the reads are unknown, so the FileInfo is zero.
+func (h *HTSGETProvider) FileInfo() (FileInfo, error) {
+	h.initInfo()
+	return FileInfo{}, h.err.Err()
+}
+
+// GetHeader implements the Provider interface.
+func (h *HTSGETProvider) GetHeader() (*sam.Header, error) {
+	h.initInfo()
+	if err := h.err.Err(); err != nil {
+		return nil, err
+	}
+	return h.header, nil
+}
+
+func (h *HTSGETProvider) initInfo() {
+	h.infoOnce.Do(func() {
+		if h.parsePath() != nil {
+			return
+		}
+		ticket, err := h.fetchTicket(htsgetRegion{}, true)
+		if err != nil {
+			h.err.Set(err)
+			return
+		}
+		stream := &htsgetStream{provider: h, ticket: ticket}
+		defer func() { h.err.Set(stream.Close()) }()
+		reader, err := bam.NewReader(stream, 1)
+		if err != nil {
+			h.err.Set(err)
+			return
+		}
+		h.header = reader.Header()
+		h.err.Set(reader.Close())
+	})
+}
+
+// Close implements the Provider interface.
+func (h *HTSGETProvider) Close() error {
+	if h.nActive > 0 {
+		vlog.Panicf("%d iterators still active for %+v", h.nActive, h)
+	}
+	return h.err.Err()
+}
+
+// GenerateShards implements the Provider interface.  Only position-based
+// sharding is supported.  If the path has a referenceName, the shards only
+// cover the region of the path, and IncludeUnmapped is ignored.
+func (h *HTSGETProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	if opts.Strategy == ByteBased {
+		return nil, fmt.Errorf("GenerateShards: byte-based sharding is not supported for htsget")
+	}
+	if (opts.SplitMappedCoords || opts.SplitUnmappedCoords) && (opts.Padding != 0) {
+		return nil, fmt.Errorf("GenerateShards: nonzero Padding cannot be specified with Split*Coords")
+	}
+	header, err := h.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	if h.region.refName == "" {
+		return gbam.GetPositionBasedShards(header, 100000, opts.Padding, opts.IncludeUnmapped)
+	}
+	ref := RefByName(header, h.region.refName)
+	if ref == nil {
+		return nil, fmt.Errorf("GenerateShards: %s: reference %s not found", h.Path, h.region.refName)
+	}
+	all, err := gbam.GetPositionBasedShards(header, 100000, opts.Padding, false)
+	if err != nil {
+		return nil, err
+	}
+	end := ref.Len()
+	if h.region.end >= 0 && h.region.end < end {
+		end = h.region.end
+	}
+	var shards []gbam.Shard
+	for _, shard := range all {
+		if shard.StartRef != ref || shard.End <= h.region.start || shard.Start >= end {
+			continue
+		}
+		if shard.Start < h.region.start {
+			shard.Start = h.region.start
+		}
+		if shard.End > end {
+			shard.End = end
+		}
+		shard.ShardIdx = len(shards)
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// GetFileShards implements the Provider interface.
+func (h *HTSGETProvider) GetFileShards() ([]gbam.Shard, error) {
+	header, err := h.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []gbam.Shard{gbam.UniversalShard(header)}, nil
+}
+
+// shardRegions returns the htsget regions covering [start, limit), clipped to
+// the region of the path.
+func (h *HTSGETProvider) shardRegions(header *sam.Header, start, limit biopb.Coord) []htsgetRegion {
+	var regions []htsgetRegion
+	for _, ref := range header.Refs() {
+		id := int32(ref.ID())
+		if (h.region.refName != "" && ref.Name() != h.region.refName) ||
+			!start.LT(biopb.Coord{RefId: id, Pos: int32(ref.Len())}) ||
+			!(biopb.Coord{RefId: id, Pos: 0}).LT(limit) {
+			continue
+		}
+		r := htsgetRegion{refName: ref.Name(), start: 0, end: ref.Len()}
+		if start.RefId == id {
+			r.start = int(start.Pos)
+		}
+		if limit.RefId == id {
+			r.end = int(limit.Pos)
+		}
+		if h.region.start > r.start {
+			r.start = h.region.start
+		}
+		if h.region.end >= 0 && h.region.end < r.end {
+			r.end = h.region.end
+		}
+		if r.start < r.end {
+			regions = append(regions, r)
+		}
+	}
+	if h.region.refName == "" && (biopb.Coord{RefId: biopb.UnmappedRefID, Pos: 0}).LT(limit) {
+		regions = append(regions, htsgetRegion{refName: "*", end: -1})
+	}
+	return regions
+}
+
+// NewIterator implements the Provider interface.  It requests the padded range
+// of shard, one reference at a time.
+func (h *HTSGETProvider) NewIterator(shard gbam.Shard) Iterator {
+	h.mu.Lock()
+	h.nActive++
+	h.mu.Unlock()
+	iter := &htsgetIterator{
+		provider: h,
+		tracker:  newBookmarkTracker(),
+	}
+	header, err := h.GetHeader()
+	if err != nil {
+		iter.err = err
+		return iter
+	}
+	start := gbam.NewCoord(shard.StartRef, shard.PaddedStart(), 0)
+	limit := gbam.NewCoord(shard.EndRef, shard.PaddedEnd(), 0)
+	if start.GE(limit) {
+		iter.err = fmt.Errorf("start coord (%v) not before limit coord (%v)", start, limit)
+		return iter
+	}
+	iter.regions = h.shardRegions(header, start, limit)
+	return iter
+}
+
+// openRegion starts reading the next region of i.regions.
+func (i *htsgetIterator) openRegion() error {
+	r := i.regions[0]
+	i.regions = i.regions[1:]
+	if r.refName == "*" {
+		i.startAddr = biopb.Coord{RefId: biopb.UnmappedRefID, Pos: 0}
+		i.limitAddr = biopb.Coord{RefId: biopb.UnmappedRefID, Pos: 1}
+	} else {
+		ref := RefByName(i.provider.header, r.refName)
+		i.startAddr = gbam.NewCoord(ref, r.start, 0)
+		i.limitAddr = gbam.NewCoord(ref, r.end, 0)
+	}
+	ticket, err := i.provider.fetchTicket(r, false)
+	if err != nil {
+		return err
+	}
+	i.stream = &htsgetStream{provider: i.provider, ticket: ticket}
+	i.reader, err = bam.NewReader(i.provider.Throttle.Reader(i.stream), 1)
+	return err
+}
+
+// closeRegion releases the reader and the stream of the current region.
+func (i *htsgetIterator) closeRegion() error {
+	var err error
+	if i.reader != nil {
+		err = i.reader.Close()
+		i.reader = nil
+	}
+	if i.stream != nil {
+		if e := i.stream.Close(); e != nil && err == nil {
+			err = e
+		}
+		i.stream = nil
+	}
+	return err
+}
+
+// Scan implements the Iterator interface.
+func (i *htsgetIterator) Scan() bool {
+	for i.err == nil {
+		if i.reader == nil {
+			if len(i.regions) == 0 {
+				i.err = io.EOF
+				break
+			}
+			i.err = i.openRegion()
+			continue
+		}
+		i.next, i.err = i.reader.Read()
+		if i.err == io.EOF {
+			i.err = i.closeRegion()
+			continue
+		}
+		if i.err != nil {
+			break
+		}
+		// The records refer to the references of the stream's header; point
+		// them to the provider's instead, which the callers' shards use.
+		refs := i.provider.header.Refs()
+		if i.next.Ref != nil {
+			i.next.Ref = refs[i.next.Ref.ID()]
+		}
+		if i.next.MateRef != nil {
+			i.next.MateRef = refs[i.next.MateRef.ID()]
+		}
+		// htsget returns the reads overlapping the region, so skip the ones
+		// that start before it, and the remaining ones once past it.
+		recAddr := gbam.CoordFromSAMRecord(i.next, 0)
+		if recAddr.LT(i.startAddr) {
+			sam.PutInFreePool(i.next)
+			continue
+		}
+		if recAddr.LT(i.limitAddr) {
+			i.tracker.observe(i.next)
+			return true
+		}
+		sam.PutInFreePool(i.next)
+		i.err = i.closeRegion()
+	}
+	return false
+}
+
+// Record implements the Iterator interface.
+func (i *htsgetIterator) Record() *sam.Record {
+	return i.next
+}
+
+// Bookmark implements the Bookmarker interface.
+func (i *htsgetIterator) Bookmark() Bookmark {
+	return i.tracker.bookmark()
+}
+
+// Err implements the Iterator interface.
+func (i *htsgetIterator) Err() error {
+	if i.err == io.EOF {
+		return nil
+	}
+	return i.err
+}
+
+// Close implements the Iterator interface.
+func (i *htsgetIterator) Close() error {
+	if err := i.closeRegion(); err != nil && i.err == nil {
+		i.err = err
+	}
+	err := i.Err()
+	i.provider.err.Set(err)
+	i.provider.mu.Lock()
+	i.provider.nActive--
+	i.provider.mu.Unlock()
+	return err
+}
@@ -0,0 +1,205 @@
+package bamprovider_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+// htsgetTestRead is a read of the test BAM.  refIdx -1 is unmapped.
+type htsgetTestRead struct {
+	name   string
+	refIdx int
+	pos    int
+}
+
+var htsgetTestReads = []htsgetTestRead{
+	{"r0", 0, 10},
+	{"r1", 0, 99990},
+	{"r2", 0, 100050},
+	{"r3", 0, 150000},
+	{"r4", 0, 249000},
+	{"r5", 1, 5},
+	{"u0", -1, -1},
+}
+
+// newHTSGETTestBAM returns the contents of a BAM containing htsgetTestReads.
+func newHTSGETTestBAM(t *testing.T) []byte {
+	ref1, err := sam.NewReference("chr1", "", "", 250000, nil, nil)
+	assert.NoError(t, err)
+	ref2, err := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref1, ref2})
+	assert.NoError(t, err)
+	refs := header.Refs()
+
+	var buf bytes.Buffer
+	w, err := bam.NewWriter(&buf, header, 1)
+	assert.NoError(t, err)
+	for _, r := range htsgetTestReads {
+		var ref *sam.Reference
+		var cigar []sam.CigarOp
+		if r.refIdx >= 0 {
+			ref = refs[r.refIdx]
+			cigar = []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 50)}
+		}
+		rec, err := sam.NewRecord(r.name, ref, nil, r.pos, -1, 0, 60, cigar, []byte(strings.Repeat("A", 50)), nil, nil)
+		assert.NoError(t, err)
+		if ref == nil {
+			rec.Flags = sam.Unmapped
+		}
+		assert.NoError(t, w.Write(rec))
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// htsgetTestServer serves data as the reads "sample".  Like a server without
+// an index, it ignores the region of the requests and always returns the whole
+// file, in two blocks: a data: URI, and a URL which requires a header given by
+// the ticket.
+type htsgetTestServer struct {
+	*httptest.Server
+	data []byte
+
+	mu      sync.Mutex
+	queries []url.Values
+}
+
+func newHTSGETTestServer(t *testing.T, data []byte) *htsgetTestServer {
+	s := &htsgetTestServer{data: data}
+	const split = 100
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reads/sample", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.queries = append(s.queries, r.URL.Query())
+		s.mu.Unlock()
+		fmt.Fprintf(w, `{"htsget": {"format": "BAM", "urls": [{"url": "data:application/vnd.ga4gh.bam;base64,%s"}, {"url": "%s/data", "headers": {"Authorization": "Bearer xyz"}}]}}`,
+			base64.StdEncoding.EncodeToString(s.data[:split]), s.URL)
+	})
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xyz" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write(s.data[split:]) // nolint: errcheck
+	})
+	mux.HandleFunc("/reads/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint: errcheck
+			"htsget": map[string]string{"error": "NotFound", "message": "no such reads"},
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// takeQueries returns the queries of the ticket requests since the last call.
+func (s *htsgetTestServer) takeQueries() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queries
+	s.queries = nil
+	return q
+}
+
+func (s *htsgetTestServer) path(suffix string) string {
+	return bamprovider.HTSGETInsecureScheme + strings.TrimPrefix(s.URL, "http://") + suffix
+}
+
+func readHTSGET(t *testing.T, p bamprovider.Provider, opts bamprovider.GenerateShardsOpts) []string {
+	shards, err := p.GenerateShards(opts)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, shard := range shards {
+		iter := p.NewIterator(shard)
+		names = append(names, readIterator(iter)...)
+		assert.NoError(t, iter.Close())
+	}
+	assert.NoError(t, p.Close())
+	return names
+}
+
+func TestHTSGET(t *testing.T) {
+	s := newHTSGETTestServer(t, newHTSGETTestBAM(t))
+	defer s.Close()
+
+	p := bamprovider.NewProvider(s.path("/reads/sample"))
+	_, ok := p.(*bamprovider.HTSGETProvider)
+	assert.True(t, ok)
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+	assert.EQ(t, len(header.Refs()), 2)
+	assert.EQ(t, readHTSGET(t, p, bamprovider.GenerateShardsOpts{IncludeUnmapped: true}),
+		[]string{"r0", "r1", "r2", "r3", "r4", "r5", "u0"})
+	// One header request, then one per shard and reference.
+	queries := s.takeQueries()
+	assert.EQ(t, len(queries), 6)
+	assert.EQ(t, queries[0].Get("class"), "header")
+	assert.EQ(t, queries[1].Get("referenceName"), "chr1")
+	assert.EQ(t, queries[1].Get("start"), "0")
+	assert.EQ(t, queries[1].Get("end"), "100000")
+	assert.EQ(t, queries[5].Get("referenceName"), "*")
+
+	// Padded shards request the padded range.
+	p = bamprovider.NewProvider(s.path("/reads/sample"))
+	assert.EQ(t, readHTSGET(t, p, bamprovider.GenerateShardsOpts{Padding: 20}),
+		[]string{"r0", "r1", "r1", "r2", "r3", "r4", "r5"})
+	queries = s.takeQueries()
+	assert.EQ(t, queries[2].Get("start"), "99980")
+	assert.EQ(t, queries[2].Get("end"), "200020")
+}
+
+func TestHTSGETRegion(t *testing.T) {
+	s := newHTSGETTestServer(t, newHTSGETTestBAM(t))
+	defer s.Close()
+
+	p := bamprovider.NewProvider(s.path("/reads/sample?referenceName=chr1&start=100000&end=200000"))
+	assert.EQ(t, readHTSGET(t, p, bamprovider.GenerateShardsOpts{IncludeUnmapped: true, Padding: 100}),
+		[]string{"r2", "r3"})
+	for _, q := range s.takeQueries()[1:] {
+		assert.EQ(t, q.Get("referenceName"), "chr1")
+		assert.EQ(t, q.Get("start"), "100000")
+		assert.EQ(t, q.Get("end"), "200000")
+	}
+
+	p = bamprovider.NewProvider(s.path("/reads/sample?referenceName=chr2"))
+	iter := bamprovider.NewRefIterator(p, "chr1", 0, 1000)
+	assert.EQ(t, readIterator(iter), []string(nil))
+	assert.NoError(t, iter.Close())
+	iter = bamprovider.NewRefIterator(p, "chr2", 0, 1000)
+	assert.EQ(t, readIterator(iter), []string{"r5"})
+	assert.NoError(t, iter.Close())
+	assert.NoError(t, p.Close())
+}
+
+func TestHTSGETErrors(t *testing.T) {
+	s := newHTSGETTestServer(t, newHTSGETTestBAM(t))
+	defer s.Close()
+
+	_, err := bamprovider.NewProvider(s.path("/reads/missing")).GetHeader()
+	assert.HasSubstr(t, err.Error(), "NotFound")
+	for _, suffix := range []string{
+		"/reads/sample?start=10",
+		"/reads/sample?referenceName=chr1&start=10&end=5",
+		"/reads/sample?referenceName=*",
+		"/reads/sample?format=CRAM",
+	} {
+		_, err := bamprovider.NewProvider(s.path(suffix)).GetHeader()
+		assert.NotNil(t, err, suffix)
+	}
+	_, err = bamprovider.NewProvider(s.path("/reads/sample?referenceName=chr3")).GenerateShards(bamprovider.GenerateShardsOpts{})
+	assert.HasSubstr(t, err.Error(), "chr3")
+}
@@ -0,0 +1,53 @@
+package bamprovider
+
+import (
+	"fmt"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+)
+
+// IndexCoverage estimates the number of records in each binSize-base bin of
+// each reference of p, using only p's index (see QueryIndex).  The result is
+// indexed by reference ID and then by bin; the last bin of a reference may be
+// shorter than binSize.  It fails if the index can't estimate record counts,
+// e.g., for a .gbai index or CRAM input.
+//
+// The estimates are only as fine as the index: a .bai index resolves
+// positions to 16kbp windows, and its chunks may straddle bin boundaries, so
+// the counts are suitable for coarse QC rather than depth calculations.
+func IndexCoverage(p Provider, binSize int) ([][]int64, error) {
+	if binSize <= 0 {
+		return nil, fmt.Errorf("bamprovider.IndexCoverage: invalid bin size %d", binSize)
+	}
+	header, err := p.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	refs := header.Refs()
+	counts := make([][]int64, len(refs))
+	for i, ref := range refs {
+		nBin := (ref.Len() + binSize - 1) / binSize
+		counts[i] = make([]int64, nBin)
+		for bin := 0; bin < nBin; bin++ {
+			end := (bin + 1) * binSize
+			if end > ref.Len() {
+				end = ref.Len()
+			}
+			shard := gbam.Shard{
+				StartRef: ref,
+				Start:    bin * binSize,
+				EndRef:   ref,
+				End:      end,
+			}
+			stats, err := QueryIndex(p, shard)
+			if err != nil {
+				return nil, err
+			}
+			if stats.ApproxRecords < 0 {
+				return nil, fmt.Errorf("bamprovider.IndexCoverage: the index can't estimate record counts")
+			}
+			counts[i][bin] = stats.ApproxRecords
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,169 @@
+package bamprovider
+
+import (
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/bgzf/index"
+)
+
+// IndexStats is the answer to an index-only query about a shard.
+type IndexStats struct {
+	// MayHaveRecords is false only if the index proves that NewIterator(shard)
+	// would yield no records.  It may be true for shards that turn out to be
+	// empty, since indexes have limited resolution.
+	MayHaveRecords bool
+	// ApproxRecords is a coarse estimate of the number of records that
+	// NewIterator(shard) would yield, or -1 if the index can't provide one.  It
+	// is 0 whenever MayHaveRecords is false.
+	ApproxRecords int64
+}
+
+var unknownIndexStats = IndexStats{MayHaveRecords: true, ApproxRecords: -1}
+
+// IndexQuerier is implemented by Providers that can answer IndexStats queries
+// from index metadata alone, without decompressing any record data.
+type IndexQuerier interface {
+	// QueryIndex returns IndexStats for the padded range of the shard.
+	QueryIndex(shard gbam.Shard) (IndexStats, error)
+}
+
+// QueryIndex asks p whether any record may overlap shard, using only p's
+// index.  It is cheap enough to call for every shard before creating an
+// iterator, which lets callers skip empty shards of sparse (e.g. targeted)
+// data.  If p doesn't implement IndexQuerier, the result is conservative:
+// MayHaveRecords is true and ApproxRecords is -1.
+func QueryIndex(p Provider, shard gbam.Shard) (IndexStats, error) {
+	if q, ok := p.(IndexQuerier); ok {
+		return q.QueryIndex(shard)
+	}
+	return unknownIndexStats, nil
+}
+
+// QueryIndex implements IndexQuerier.  It uses the .bai bins covering the
+// shard: a shard with no overlapping chunks is empty, and the record count is
+// estimated from the per-reference mapped count, prorated by the compressed
+// size of the overlapping chunks.  Shards containing unmapped reads, and BAMs
+// with a .gbai index, always get conservative answers.
+func (b *BAMProvider) QueryIndex(shard gbam.Shard) (IndexStats, error) {
+	if err := b.readIndex(); err != nil {
+		return IndexStats{}, err
+	}
+	if b.bindex == nil || shard.StartRef == nil || shard.EndRef == nil {
+		return unknownIndexStats, nil
+	}
+	header, err := b.GetHeader()
+	if err != nil {
+		return IndexStats{}, err
+	}
+	refs := header.Refs()
+	var (
+		stats   IndexStats
+		unknown bool
+	)
+	for refID := shard.StartRef.ID(); refID <= shard.EndRef.ID(); refID++ {
+		ref := refs[refID]
+		beg, end := 0, ref.Len()
+		if refID == shard.StartRef.ID() {
+			beg = shard.PaddedStart()
+		}
+		if refID == shard.EndRef.ID() {
+			if end = shard.PaddedEnd(); end == 0 {
+				// The shard ends at the start of EndRef.
+				break
+			}
+		}
+		if beg >= end {
+			continue
+		}
+		chunks, err := b.bindex.Chunks(ref, beg, end)
+		if err == index.ErrInvalid || (err == nil && len(chunks) == 0) {
+			continue
+		}
+		if err != nil {
+			return IndexStats{}, err
+		}
+		stats.MayHaveRecords = true
+		refStats, ok := b.bindex.ReferenceStats(refID)
+		if !ok {
+			unknown = true
+			continue
+		}
+		refBytes := refStats.Chunk.End.File - refStats.Chunk.Begin.File
+		if refBytes <= 0 {
+			// All of the reference's records are in a single BGZF block.
+			stats.ApproxRecords += int64(refStats.Mapped)
+			continue
+		}
+		var bytes int64
+		for _, c := range chunks {
+			bytes += c.End.File - c.Begin.File
+		}
+		n := int64(float64(refStats.Mapped) * float64(bytes) / float64(refBytes))
+		if n > int64(refStats.Mapped) {
+			n = int64(refStats.Mapped)
+		}
+		if n == 0 {
+			// The chunks are within one block, so there is at least one record.
+			n = 1
+		}
+		stats.ApproxRecords += n
+	}
+	if unknown && stats.MayHaveRecords {
+		stats.ApproxRecords = -1
+	}
+	return stats, nil
+}
+
+// QueryIndex implements IndexQuerier.  It sums the record counts of the
+// coordinate-field blocks that intersect the shard, so the estimate can
+// exceed the true count by up to two blocks' worth of records per rowshard.
+// The block indexes are read on the first call and cached.
+func (p *PAMProvider) QueryIndex(shard gbam.Shard) (IndexStats, error) {
+	p.initInfo()
+	if err := p.err.Err(); err != nil {
+		return IndexStats{}, err
+	}
+	blocks, err := p.coordBlockIndexes()
+	if err != nil {
+		return IndexStats{}, err
+	}
+	var rng biopb.CoordRange
+	rng.Start = biopb.Coord{int32(shard.StartRef.ID()), int32(shard.PaddedStart()), int32(shard.StartSeq)}
+	rng.Limit = biopb.Coord{int32(shard.EndRef.ID()), int32(shard.PaddedEnd()), int32(shard.EndSeq)}
+	var stats IndexStats
+	for i, fi := range p.indexes {
+		if !fi.Range.Intersects(rng) {
+			continue
+		}
+		for _, block := range blocks[i] {
+			if pamutil.BlockIntersectsRange(block.StartAddr, block.EndAddr, rng) {
+				stats.MayHaveRecords = true
+				stats.ApproxRecords += int64(block.NumRecords)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// coordBlockIndexes returns the block index of the coord field of each file in
+// p.indexes.
+func (p *PAMProvider) coordBlockIndexes() ([][]biopb.PAMBlockIndexEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.coordBlocks != nil {
+		return p.coordBlocks, nil
+	}
+	ctx := vcontext.Background()
+	blocks := make([][]biopb.PAMBlockIndexEntry, len(p.indexes))
+	for i, fi := range p.indexes {
+		index, err := pamutil.ReadFieldIndex(ctx, p.Path, fi.Range, gbam.FieldCoord.String())
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = index.Blocks
+	}
+	p.coordBlocks = blocks
+	return blocks, nil
+}
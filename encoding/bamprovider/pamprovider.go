@@ -17,6 +17,10 @@ import (
 // PAMProvider reads PAM files.  The path can be S3 URLs, in which case the data
 // will be read from S3. Otherwise the data will be read from the local
 // filesystem.
+//
+// The iterators of a PAMProvider share a pam.IndexCache (Opts.IndexCache, or
+// one created by the provider), so the indexes of the file are read once per
+// provider rather than once per iterator.
 type PAMProvider struct {
 	// Path prefix. Must be nonempty.
 	Path string
@@ -24,16 +28,35 @@ type PAMProvider struct {
 	Opts pam.ReadOpts
 	err  errors.Once
 
-	mu      sync.Mutex
-	header  *sam.Header        // extracted from <dir>/<range>.index.
-	info    FileInfo           // extracted from <dir>/<range>.index.
-	indexes []pamutil.FileInfo // files found in the pam directory.
+	mu         sync.Mutex
+	indexCache *pam.IndexCache
+	header     *sam.Header        // extracted from <dir>/<range>.index.
+	info       FileInfo           // extracted from <dir>/<range>.index.
+	indexes    []pamutil.FileInfo // files found in the pam directory.
+
+	// coordBlocks[i] is the coord-field block index of indexes[i]; see
+	// QueryIndex.
+	coordBlocks [][]biopb.PAMBlockIndexEntry
 }
 
 // pamIterator implements the Iterator interface.
 type pamIterator struct {
 	provider *PAMProvider
 	reader   *pam.Reader
+	tracker  bookmarkTracker
+}
+
+// getIndexCache returns the pam.IndexCache shared by the iterators.
+//
+// REQUIRES: p.mu is locked.
+func (p *PAMProvider) getIndexCache() *pam.IndexCache {
+	if p.indexCache == nil {
+		p.indexCache = p.Opts.IndexCache
+		if p.indexCache == nil {
+			p.indexCache = pam.NewIndexCache()
+		}
+	}
+	return p.indexCache
 }
 
 func (p *PAMProvider) initInfo() {
@@ -44,8 +67,9 @@ func (p *PAMProvider) initInfo() {
 	}
 
 	ctx := vcontext.Background()
+	cache := p.getIndexCache()
 	if len(p.indexes) == 0 {
-		indexes, err := pamutil.ListIndexes(ctx, p.Path)
+		indexes, err := cache.ListIndexes(ctx, p.Path)
 		if err != nil {
 			p.err.Set(err)
 			return
@@ -69,13 +93,7 @@ func (p *PAMProvider) initInfo() {
 		return
 	}
 	p.info = FileInfo{ModTime: info.ModTime(), Size: info.Size()}
-	index, err := pamutil.ReadShardIndex(ctx, p.Path, p.indexes[0].Range)
-	if err != nil {
-		p.err.Set(err)
-		return
-	}
-	p.header, err = gbam.UnmarshalHeader(index.EncodedBamHeader)
-	if err != nil {
+	if _, p.header, err = cache.ShardIndex(ctx, p.Path, p.indexes[0].Range); err != nil {
 		p.err.Set(err)
 		return
 	}
@@ -174,16 +192,30 @@ func (p *PAMProvider) NewIterator(shard gbam.Shard) Iterator {
 	// specified.
 	opts.Range.Start = biopb.Coord{int32(shard.StartRef.ID()), int32(shard.PaddedStart()), int32(shard.StartSeq)}
 	opts.Range.Limit = biopb.Coord{int32(shard.EndRef.ID()), int32(shard.PaddedEnd()), int32(shard.EndSeq)}
+	p.mu.Lock()
+	opts.IndexCache = p.getIndexCache()
+	p.mu.Unlock()
 	return &pamIterator{
 		provider: p,
 		reader:   pam.NewReader(opts, p.Path),
+		tracker:  newBookmarkTracker(),
 	}
 }
 
-func (i *pamIterator) Scan() bool          { return i.reader.Scan() }
+func (i *pamIterator) Scan() bool {
+	if !i.reader.Scan() {
+		return false
+	}
+	i.tracker.observe(i.reader.Record())
+	return true
+}
+
 func (i *pamIterator) Record() *sam.Record { return i.reader.Record() }
 func (i *pamIterator) Err() error          { return i.reader.Err() }
 
+// Bookmark implements the Bookmarker interface.
+func (i *pamIterator) Bookmark() Bookmark { return i.tracker.bookmark() }
+
 func (i *pamIterator) Close() error {
 	err := i.reader.Close()
 	if err != nil {
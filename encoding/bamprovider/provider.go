@@ -8,6 +8,7 @@ import (
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/pam"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/bio/util/iothrottle"
 	"github.com/grailbio/hts/sam"
 	"v.io/x/lib/vlog"
 )
@@ -21,6 +22,20 @@ type ProviderOpts struct {
 	// DropFields causes the listed fields not to be filled in sam.Record. This
 	// option is recognized only by the PAM reader.
 	DropFields []gbam.FieldType
+
+	// Reference is the reference FASTA used to decode CRAM files. If
+	// Reference=="", sequences are fetched by MD5. Ignored for BAM and PAM.
+	Reference string
+
+	// BlockCacheSize is BAMProvider.BlockCacheSize. Ignored for PAM, CRAM and
+	// htsget.
+	BlockCacheSize int
+
+	// Throttle, if non-nil, limits the bandwidth and read operations of the
+	// provider's iterators, e.g. to share NFS or S3 bandwidth with
+	// interactive users.  It may be shared with other providers, to limit
+	// their combined reads.
+	Throttle *iothrottle.Throttle
 }
 
 // ShardingStrategy defines algorithms used by Provider.GenerateShards.
@@ -79,7 +94,14 @@ type GenerateShardsOpts struct {
 	MinBasesPerShard int
 }
 
-// Provider allows reading BAM or PAM file in parallel. Thread safe.
+// Provider allows reading BAM or PAM file in parallel.
+//
+// Thread safety: all the methods except Close may be called concurrently, and
+// a single Provider may serve any number of concurrent iterators, which share
+// the provider's index (and, for BAM, block) caches.  Open one Provider per
+// file and an Iterator per goroutine, rather than one Provider per goroutine.
+// An Iterator is thread compatible: it must be used by one goroutine at a
+// time.  Close must be called after all the iterators have been closed.
 type Provider interface {
 	// FileInfo returns metadata of the underlying file(s).
 	//
@@ -175,6 +197,10 @@ const (
 	BAM
 	// PAM file
 	PAM
+	// CRAM file
+	CRAM
+	// HTSGET is reads served by an htsget server; see HTSGETProvider.
+	HTSGET
 )
 
 // ParseFileType parses the file type string. "bam" returns bamprovider.BAM, for
@@ -185,6 +211,8 @@ func ParseFileType(name string) FileType {
 		return BAM
 	case "pam":
 		return PAM
+	case "cram":
+		return CRAM
 	default:
 		return Unknown
 	}
@@ -193,9 +221,15 @@ func ParseFileType(name string) FileType {
 // GuessFileType returns the file type from the pathname and/or
 // contents. Returns Unknown on error.
 func GuessFileType(path string) FileType {
+	if IsHTSGETPath(path) {
+		return HTSGET
+	}
 	if strings.HasSuffix(path, ".bam") {
 		return BAM
 	}
+	if strings.HasSuffix(path, ".cram") {
+		return CRAM
+	}
 	if strings.Contains(path, ".pam") {
 		return PAM
 	}
@@ -213,20 +247,34 @@ func mergeOpts(optList []ProviderOpts) ProviderOpts {
 		if o.Index != "" {
 			opts.Index = o.Index
 		}
+		if o.Reference != "" {
+			opts.Reference = o.Reference
+		}
+		if o.BlockCacheSize > 0 {
+			opts.BlockCacheSize = o.BlockCacheSize
+		}
+		if o.Throttle != nil {
+			opts.Throttle = o.Throttle
+		}
 		opts.DropFields = append(opts.DropFields, o.DropFields...)
 	}
 	return opts
 }
 
-// NewProvider creates a Provider object that can handle BAM or PAM file of
-// "path". The file type is autodetected from the path.
+// NewProvider creates a Provider object that can handle BAM, PAM or CRAM file
+// of "path", or the reads served by an htsget server if path starts with
+// htsget:// or htsget+http://. The file type is autodetected from the path.
 func NewProvider(path string, optList ...ProviderOpts) Provider {
 	opts := mergeOpts(optList)
 	switch GuessFileType(path) {
 	case BAM, Unknown:
-		return &BAMProvider{Path: path, Index: opts.Index}
+		return &BAMProvider{Path: path, Index: opts.Index, BlockCacheSize: opts.BlockCacheSize, Throttle: opts.Throttle}
 	case PAM:
-		return &PAMProvider{Path: path, Opts: pam.ReadOpts{DropFields: opts.DropFields}}
+		return &PAMProvider{Path: path, Opts: pam.ReadOpts{DropFields: opts.DropFields, Throttle: opts.Throttle}}
+	case CRAM:
+		return &CRAMProvider{Path: path, Index: opts.Index, Reference: opts.Reference, Throttle: opts.Throttle}
+	case HTSGET:
+		return &HTSGETProvider{Path: path, Throttle: opts.Throttle}
 	}
 	panic("shouldn't reach here")
 }
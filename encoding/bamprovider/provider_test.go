@@ -114,6 +114,52 @@ func TestError(t *testing.T) {
 	}
 }
 
+// TestConcurrentIterators reads every shard from many goroutines at once,
+// through a single provider.
+func TestConcurrentIterators(t *testing.T) {
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	pamPath := filepath.Join(tmpDir, "large.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", 1<<20))
+
+	for _, path := range []string{bamPath, pamPath} {
+		p := bamprovider.NewProvider(path, bamprovider.ProviderOpts{BlockCacheSize: 16})
+		shards, err := p.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true, NumShards: 8})
+		assert.NoError(t, err)
+		want := make([][]string, len(shards))
+		for i, shard := range shards {
+			iter := p.NewIterator(shard)
+			want[i] = readIterator(iter)
+			assert.NoError(t, iter.Close())
+		}
+
+		const nGoroutine = 8
+		got := make([][][]string, nGoroutine)
+		var wg sync.WaitGroup
+		for g := 0; g < nGoroutine; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				got[g] = make([][]string, len(shards))
+				for j := range shards {
+					// Start at different shards, so that the goroutines overlap in
+					// various ways.
+					i := (g + j) % len(shards)
+					iter := p.NewIterator(shards[i])
+					got[g][i] = readIterator(iter)
+					expect.NoError(t, iter.Close())
+				}
+			}(g)
+		}
+		wg.Wait()
+		for g := range got {
+			expect.EQ(t, got[g], want, "path %s, goroutine %d", path, g)
+		}
+		assert.NoError(t, p.Close())
+	}
+}
+
 func TestBAM(t *testing.T) {
 	assert.That(t, doRead(t, testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")),
 		h.ElementsAre("read1", "read2", "read3"))
@@ -133,6 +179,56 @@ func TestRefByName(t *testing.T) {
 	assert.NoError(t, p.Close())
 }
 
+// testBookmarks checks that resuming from a bookmark after each record of a
+// shard yields the rest of the shard.
+func testBookmarks(t *testing.T, path string, wantVOffset bool) {
+	p := bamprovider.NewProvider(path)
+	shards, err := p.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true})
+	assert.NoError(t, err)
+	for _, shard := range shards {
+		var (
+			names     []string
+			bookmarks []bamprovider.Bookmark
+		)
+		iter := p.NewIterator(shard)
+		for iter.Scan() {
+			names = append(names, iter.Record().Name)
+			b, err := bamprovider.SaveBookmark(iter)
+			assert.NoError(t, err)
+			assert.EQ(t, b.N, int64(len(names)))
+			assert.EQ(t, b.VOffset != 0, wantVOffset)
+			bookmarks = append(bookmarks, b)
+		}
+		assert.NoError(t, iter.Close())
+		for i, b := range bookmarks {
+			iter := bamprovider.ResumeIterator(p, shard, b)
+			assert.EQ(t, readIterator(iter), append([]string(nil), names[i+1:]...), "bookmark %d: %+v", i, b)
+			assert.NoError(t, iter.Close())
+			// Bookmarks of a resumed iterator continue the original sequence.
+			if i+1 < len(bookmarks) {
+				iter = bamprovider.ResumeIterator(p, shard, b)
+				assert.True(t, iter.Scan())
+				b2, err := bamprovider.SaveBookmark(iter)
+				assert.NoError(t, err)
+				assert.EQ(t, b2, bookmarks[i+1])
+				assert.NoError(t, iter.Close())
+			}
+		}
+	}
+	assert.NoError(t, p.Close())
+}
+
+func TestBookmarks(t *testing.T) {
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test-unmapped.bam")
+	testBookmarks(t, bamPath, true)
+
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	pamPath := filepath.Join(tmpDir, "test-unmapped.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", math.MaxInt64))
+	testBookmarks(t, pamPath, false)
+}
+
 func TestNewRefIterator(t *testing.T) {
 	p := bamprovider.NewProvider(testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam"))
 
@@ -431,3 +527,59 @@ func TestGIndex(t *testing.T) {
 		assert.EQ(t, expected[i], actual[i])
 	}
 }
+
+func testQueryIndex(t *testing.T, p bamprovider.Provider) {
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+	const shardLen = 1 << 20
+	var nEmpty, nRecords int
+	var approxRecords int64
+	for _, ref := range header.Refs() {
+		for start := 0; start < ref.Len(); start += shardLen {
+			shard := gbam.Shard{StartRef: ref, EndRef: ref, Start: start, End: start + shardLen}
+			if shard.End > ref.Len() {
+				shard.End = ref.Len()
+			}
+			stats, err := bamprovider.QueryIndex(p, shard)
+			assert.NoError(t, err)
+			iter := p.NewIterator(shard)
+			n := len(readIterator(iter))
+			assert.NoError(t, iter.Close())
+			if !stats.MayHaveRecords {
+				expect.EQ(t, n, 0, "shard %+v", shard)
+				expect.EQ(t, stats.ApproxRecords, int64(0))
+				nEmpty++
+				continue
+			}
+			expect.GT(t, stats.ApproxRecords, int64(0), "shard %+v", shard)
+			nRecords += n
+			approxRecords += stats.ApproxRecords
+		}
+	}
+	expect.GT(t, nEmpty, 0)
+	expect.GT(t, nRecords, 0)
+	// The estimates are coarse, but should be in the right ballpark.
+	expect.GT(t, approxRecords, int64(nRecords/2))
+	assert.NoError(t, p.Close())
+}
+
+func TestQueryIndex(t *testing.T) {
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	testQueryIndex(t, bamprovider.NewProvider(bamPath))
+
+	pamPath := filepath.Join(tmpDir, "test.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", math.MaxInt64))
+	testQueryIndex(t, bamprovider.NewProvider(pamPath))
+
+	// Providers without an index always get a conservative answer.
+	p := bamprovider.NewProvider(bamPath)
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+	assert.NoError(t, p.Close())
+	ref := header.Refs()[0]
+	stats, err := bamprovider.QueryIndex(bamprovider.NewFakeProvider(header, nil), gbam.Shard{StartRef: ref, EndRef: ref, End: 100})
+	assert.NoError(t, err)
+	expect.EQ(t, stats, bamprovider.IndexStats{MayHaveRecords: true, ApproxRecords: -1})
+}
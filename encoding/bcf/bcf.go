@@ -0,0 +1,279 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bcf reads and writes BCF2 (binary VCF) files, as described in
+// section 6 of https://samtools.github.io/hts-specs/VCFv4.3.pdf.
+//
+// Records are kept close to their binary form: contigs and FILTER, INFO, and
+// FORMAT keys are dictionary indexes (see Header), and INFO and FORMAT values
+// are typed Values.  Genotypes are not decoded; a GT value holds the BCF
+// encoding (allele+1)<<1 | phased.  Reads can be restricted to a region with
+// a .csi or .tbi index; see ReadIndex and Reader.Query.
+package bcf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/bgzf/index"
+)
+
+// magic starts a BCF 2.2 file.
+const magic = "BCF\x02\x02"
+
+// InfoField is an INFO key and its value.  Key is a string dictionary index.
+type InfoField struct {
+	Key   int
+	Value Value
+}
+
+// FormatField is a FORMAT key and its values, one per sample.  Key is a string
+// dictionary index.
+type FormatField struct {
+	Key    int
+	Values []Value
+}
+
+// Record is a BCF record.
+type Record struct {
+	// ContigID is the contig dictionary index of CHROM.
+	ContigID int
+	// Pos is the 0-based position.
+	Pos int
+	// RLen is the length of the reference region covered by the record.  The
+	// Writer uses len(Ref) if it is 0.
+	RLen int
+	// Qual is MissingFloat if QUAL is missing.
+	Qual float32
+	// ID is "" if the ID is missing.
+	ID  string
+	Ref string
+	Alt []string
+	// Filters are string dictionary indexes.  An empty list means that the
+	// filters weren't applied; PASS is index 0.
+	Filters []int
+	Info    []InfoField
+	Format  []FormatField
+}
+
+// End returns the 0-based exclusive end of the reference region covered by
+// the record.
+func (r *Record) End() int {
+	return r.Pos + r.RLen
+}
+
+// Reader reads BCF records.  It is not safe for concurrent use.
+type Reader struct {
+	bg     *bgzf.Reader
+	header *Header
+	buf    []byte
+}
+
+// NewReader reads the header of a BCF file.  parallelism is passed to the
+// bgzf reader.
+func NewReader(r io.Reader, parallelism int) (*Reader, error) {
+	bg, err := bgzf.NewReader(r, parallelism)
+	if err != nil {
+		return nil, fmt.Errorf("bcf.NewReader: %v", err)
+	}
+	var hdr [len(magic) + 4]byte
+	if _, err = io.ReadFull(bg, hdr[:]); err != nil {
+		return nil, fmt.Errorf("bcf.NewReader: reading magic: %v", err)
+	}
+	if string(hdr[:3]) != magic[:3] {
+		return nil, fmt.Errorf("bcf.NewReader: not a BCF file")
+	}
+	if hdr[3] != 2 {
+		return nil, fmt.Errorf("bcf.NewReader: unsupported BCF version %d.%d", hdr[3], hdr[4])
+	}
+	text := make([]byte, binary.LittleEndian.Uint32(hdr[len(magic):]))
+	if _, err = io.ReadFull(bg, text); err != nil {
+		return nil, fmt.Errorf("bcf.NewReader: reading header: %v", err)
+	}
+	rd := &Reader{bg: bg}
+	if rd.header, err = ParseHeader(string(text)); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// Header returns the file's header.
+func (r *Reader) Header() *Header { return r.header }
+
+// Read returns the next record, or io.EOF at the end of the file.
+func (r *Reader) Read() (*Record, error) {
+	return r.readRecord(r.bg)
+}
+
+// Close closes the reader.  It doesn't close the underlying io.Reader.
+func (r *Reader) Close() error {
+	return r.bg.Close()
+}
+
+// readRecord reads a record from src.
+func (r *Reader) readRecord(src io.Reader) (*Record, error) {
+	var lens [8]byte
+	if _, err := io.ReadFull(src, lens[:]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("bcf.Reader: reading record: %v", err)
+	}
+	lShared := int(binary.LittleEndian.Uint32(lens[:4]))
+	lIndiv := int(binary.LittleEndian.Uint32(lens[4:]))
+	if cap(r.buf) < lShared+lIndiv {
+		r.buf = make([]byte, lShared+lIndiv)
+	}
+	r.buf = r.buf[:lShared+lIndiv]
+	if _, err := io.ReadFull(src, r.buf); err != nil {
+		return nil, fmt.Errorf("bcf.Reader: reading record: %v", err)
+	}
+	if lShared < 24 {
+		return nil, fmt.Errorf("bcf.Reader: record too short")
+	}
+	d := decoder{b: r.buf[:lShared]}
+	rec := &Record{
+		ContigID: int(int32(d.uint32())),
+		Pos:      int(int32(d.uint32())),
+		RLen:     int(int32(d.uint32())),
+		Qual:     math.Float32frombits(d.uint32()),
+	}
+	nAlleleInfo := d.uint32()
+	nFmtSample := d.uint32()
+	nAllele, nInfo := int(nAlleleInfo>>16), int(nAlleleInfo&0xffff)
+	nFmt, nSample := int(nFmtSample>>24), int(nFmtSample&0xffffff)
+	if nFmt > 0 && nSample != len(r.header.Samples) {
+		return nil, fmt.Errorf("bcf.Reader: record has %d samples, header has %d", nSample, len(r.header.Samples))
+	}
+	rec.ID = d.value().Str
+	for i := 0; i < nAllele; i++ {
+		allele := d.value().Str
+		if i == 0 {
+			rec.Ref = allele
+		} else {
+			rec.Alt = append(rec.Alt, allele)
+		}
+	}
+	for _, f := range d.value().Ints {
+		rec.Filters = append(rec.Filters, int(f))
+	}
+	for i := 0; i < nInfo; i++ {
+		key := int(d.typedInt())
+		rec.Info = append(rec.Info, InfoField{Key: key, Value: d.value()})
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("bcf.Reader: %v", d.err)
+	}
+
+	d = decoder{b: r.buf[lShared:]}
+	for i := 0; i < nFmt; i++ {
+		f := FormatField{Key: int(d.typedInt())}
+		t, n := d.typeDesc()
+		f.Values = make([]Value, nSample)
+		for s := range f.Values {
+			f.Values[s] = d.values(t, n)
+		}
+		rec.Format = append(rec.Format, f)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("bcf.Reader: %v", d.err)
+	}
+	return rec, nil
+}
+
+// Iterator iterates over the records returned by Reader.Query.
+type Iterator struct {
+	r        *Reader
+	cr       *index.ChunkReader
+	contigID int
+	beg, end int
+	rec      *Record
+	err      error
+}
+
+// Query returns an iterator over the records that overlap [beg, end) (0-based)
+// on contig, using idx to find them.  The Reader's position is undefined once
+// Query has been called, so Read should not be used afterwards.
+func (r *Reader) Query(idx *Index, contig string, beg, end int) (*Iterator, error) {
+	contigID, ok := r.header.ContigID(contig)
+	if !ok {
+		return nil, fmt.Errorf("bcf.Reader.Query: unknown contig %s", contig)
+	}
+	refID := contigID
+	if idx.Names != nil {
+		// .tbi indexes have their own list of sequence names.
+		refID = -1
+		for i, name := range idx.Names {
+			if name == contig {
+				refID = i
+				break
+			}
+		}
+	}
+	it := &Iterator{r: r, contigID: contigID, beg: beg, end: end}
+	chunks := idx.Chunks(refID, beg, end)
+	if len(chunks) == 0 {
+		return it, nil
+	}
+	var err error
+	if it.cr, err = index.NewChunkReader(r.bg, chunks); err != nil {
+		return nil, fmt.Errorf("bcf.Reader.Query: %v", err)
+	}
+	return it, nil
+}
+
+// Next reads the next record.  It returns false at the end of the query or on
+// error.
+func (it *Iterator) Next() bool {
+	if it.cr == nil || it.err != nil {
+		return false
+	}
+	for {
+		rec, err := it.r.readRecord(it.cr)
+		if err != nil {
+			if err != io.EOF {
+				it.err = err
+			}
+			return false
+		}
+		if rec.ContigID != it.contigID || rec.Pos >= it.end {
+			// Records are sorted, so nothing later in the chunks can overlap.
+			if rec.ContigID > it.contigID || (rec.ContigID == it.contigID && rec.Pos >= it.end) {
+				return false
+			}
+			continue
+		}
+		if rec.End() > it.beg {
+			it.rec = rec
+			return true
+		}
+	}
+}
+
+// Record returns the record read by the last call to Next.
+func (it *Iterator) Record() *Record { return it.rec }
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error { return it.err }
+
+// Close releases the iterator's resources.
+func (it *Iterator) Close() error {
+	if it.cr == nil {
+		return nil
+	}
+	return it.cr.Close()
+}
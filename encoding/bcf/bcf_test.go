@@ -0,0 +1,264 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/grailbio/hts/bgzf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHeader = `##fileformat=VCFv4.3
+##FILTER=<ID=PASS,Description="All filters passed">
+##FILTER=<ID=q10,Description="Quality below 10">
+##contig=<ID=chr1,length=248956422>
+##contig=<ID=chr2,length=242193529>
+##INFO=<ID=DP,Number=1,Type=Integer,Description="Total depth">
+##INFO=<ID=AF,Number=A,Type=Float,Description="Allele frequency">
+##INFO=<ID=DB,Number=0,Type=Flag,Description="dbSNP membership, build 129">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+##FORMAT=<ID=AD,Number=R,Type=Integer,Description="Allelic depths">
+##FORMAT=<ID=DP,Number=1,Type=Integer,Description="Read depth">
+##FORMAT=<ID=FT,Number=1,Type=String,Description="Sample filter">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	tumor	normal
+`
+
+func TestHeader(t *testing.T) {
+	h, err := ParseHeader(testHeader)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tumor", "normal"}, h.Samples)
+	assert.Equal(t, []Contig{{"chr1", 248956422}, {"chr2", 242193529}}, h.Contigs)
+	assert.Equal(t, testHeader, h.Text())
+	// INFO and FORMAT DP share a string dictionary entry.
+	for i, id := range []string{"PASS", "q10", "DP", "AF", "DB", "GT", "AD", "FT"} {
+		idx, ok := h.StringID(id)
+		assert.True(t, ok)
+		assert.Equal(t, i, idx, id)
+		assert.Equal(t, id, h.StringAt(i))
+	}
+	def, ok := h.Info("DB")
+	assert.True(t, ok)
+	assert.Equal(t, FieldDef{ID: "DB", Number: "0", Type: "Flag", Description: "dbSNP membership, build 129"}, def)
+
+	// IDX fields override the default numbering.
+	h, err = ParseHeader("##INFO=<ID=DP,Number=1,Type=Integer,Description=\"x\",IDX=3>\n##contig=<ID=chrM,IDX=1>\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n")
+	require.NoError(t, err)
+	idx, _ := h.StringID("DP")
+	assert.Equal(t, 3, idx)
+	assert.Equal(t, "", h.StringAt(1))
+	idx, _ = h.ContigID("chrM")
+	assert.Equal(t, 1, idx)
+	assert.Nil(t, h.Samples)
+
+	_, err = ParseHeader("##INFO=<ID=DP,IDX=1>\n##INFO=<ID=AF,IDX=1>\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n")
+	assert.Error(t, err)
+	_, err = ParseHeader("##fileformat=VCFv4.3\n")
+	assert.Error(t, err)
+}
+
+func testRecords(t *testing.T, h *Header) []*Record {
+	id := func(s string) int {
+		idx, ok := h.StringID(s)
+		require.True(t, ok, s)
+		return idx
+	}
+	gt := func(a, b int32) Value { return Ints((a+1)<<1, (b+1)<<1|1) }
+	return []*Record{
+		{
+			ContigID: 0, Pos: 99, RLen: 1, Qual: 50, ID: "rs123", Ref: "A", Alt: []string{"G"},
+			Filters: []int{id("PASS")},
+			Info: []InfoField{
+				{id("DP"), Ints(120)},
+				{id("AF"), Floats(0.25)},
+				{id("DB"), Flag()},
+			},
+			Format: []FormatField{
+				{id("GT"), []Value{gt(0, 1), gt(0, 0)}},
+				{id("AD"), []Value{Ints(30, 10), Ints(80, 0)}},
+				{id("DP"), []Value{Ints(40), Ints(80)}},
+				{id("FT"), []Value{String("PASS"), String("q10;lowdp")}},
+			},
+		},
+		{
+			// Wide integers, missing values, and multiple alleles.
+			ContigID: 0, Pos: 1000, RLen: 3, Qual: MissingFloat, Ref: "ACG", Alt: []string{"A", "ACGT"},
+			Filters: []int{id("q10")},
+			Info: []InfoField{
+				{id("DP"), Ints(100000)},
+				{id("AF"), Floats(0.5, MissingFloat)},
+			},
+			Format: []FormatField{
+				{id("AD"), []Value{Ints(300, -5, MissingInt), Ints(1)}},
+			},
+		},
+		{
+			ContigID: 1, Pos: 5, RLen: 1, Qual: 3.5, Ref: "T", Alt: []string{"C"},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	h, err := ParseHeader(testHeader)
+	require.NoError(t, err)
+	recs := testRecords(t, h)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, h, 6)
+	require.NoError(t, err)
+	for _, rec := range recs {
+		require.NoError(t, w.Write(rec))
+	}
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), 1)
+	require.NoError(t, err)
+	assert.Equal(t, testHeader, r.Header().Text())
+	for i, want := range recs {
+		got, err := r.Read()
+		require.NoError(t, err)
+		if IsMissingFloat(want.Qual) {
+			assert.True(t, IsMissingFloat(got.Qual))
+			got.Qual, want.Qual = 0, 0
+		}
+		if i == 1 {
+			// The second sample's AD is padded with end-of-vector values,
+			// which are removed on read.  The missing AF value is a NaN.
+			assert.True(t, IsMissingFloat(got.Info[1].Value.Floats[1]))
+			got.Info[1].Value.Floats[1], want.Info[1].Value.Floats[1] = 0, 0
+		}
+		// Integer types are narrowed on write.
+		for j := range want.Info {
+			want.Info[j].Value.Type = got.Info[j].Value.Type
+		}
+		for j := range want.Format {
+			for k := range want.Format[j].Values {
+				want.Format[j].Values[k].Type = got.Format[j].Values[k].Type
+			}
+		}
+		assert.Equal(t, want, got, "record %d", i)
+	}
+	assert.Equal(t, TypeInt8, recs[0].Info[0].Value.Type)
+	assert.Equal(t, TypeInt32, recs[1].Info[0].Value.Type)
+	assert.Equal(t, TypeInt16, recs[1].Format[0].Values[0].Type)
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReg2Bins(t *testing.T) {
+	assert.Equal(t, []uint32{0, 1, 9, 73, 585, 4681}, reg2bins(0, 1, 14, 5))
+	assert.Equal(t, []uint32{0, 1, 9, 73, 585, 4681, 4682}, reg2bins(16383, 16385, 14, 5))
+	assert.Equal(t, uint32(37449), binLimit(5))
+}
+
+// appendCSI appends a .csi index with one bin per reference, which covers
+// the whole reference with a single chunk.
+func appendCSI(b []byte, chunks []bgzf.Chunk) []byte {
+	voff := func(o bgzf.Offset) []byte {
+		v := uint64(o.File)<<16 | uint64(o.Block)
+		return appendUint32(appendUint32(nil, uint32(v)), uint32(v>>32))
+	}
+	b = append(b, "CSI\x01"...)
+	b = appendUint32(b, 14)
+	b = appendUint32(b, 5)
+	b = appendUint32(b, 0)
+	b = appendUint32(b, uint32(len(chunks)))
+	for _, c := range chunks {
+		b = appendUint32(b, 1) // n_bin
+		b = appendUint32(b, 0) // bin
+		b = append(b, voff(c.Begin)...)
+		b = appendUint32(b, 1) // n_chunk
+		b = append(b, voff(c.Begin)...)
+		b = append(b, voff(c.End)...)
+	}
+	return b
+}
+
+func TestQuery(t *testing.T) {
+	h, err := ParseHeader(testHeader)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, h, 6)
+	require.NoError(t, err)
+	toOffset := func(v uint64) bgzf.Offset { return bgzf.Offset{File: int64(v >> 16), Block: uint16(v)} }
+	chunks := make([]bgzf.Chunk, 2)
+	for contigID := range chunks {
+		chunks[contigID].Begin = toOffset(w.VOffset())
+		for pos := 0; pos < 100; pos += 10 {
+			require.NoError(t, w.Write(&Record{ContigID: contigID, Pos: pos, Qual: MissingFloat, Ref: "AC", Alt: []string{"A"}}))
+		}
+		require.NoError(t, w.Flush())
+		chunks[contigID].End = toOffset(w.VOffset())
+	}
+	require.NoError(t, w.Close())
+
+	var ibuf bytes.Buffer
+	zw := gzip.NewWriter(&ibuf)
+	_, err = zw.Write(appendCSI(nil, chunks))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	idx, err := ReadIndex(&ibuf)
+	require.NoError(t, err)
+	assert.Equal(t, chunks[1:], idx.Chunks(1, 0, 10))
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), 1)
+	require.NoError(t, err)
+	// Records cover [pos, pos+2), so the one at 20 doesn't overlap [30, 51).
+	it, err := r.Query(idx, "chr2", 30, 51)
+	require.NoError(t, err)
+	var got []int
+	for it.Next() {
+		assert.Equal(t, 1, it.Record().ContigID)
+		got = append(got, it.Record().Pos)
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+	assert.Equal(t, []int{30, 40, 50}, got)
+
+	_, err = r.Query(idx, "chrX", 0, 10)
+	assert.Error(t, err)
+}
+
+func TestIndexBuilder(t *testing.T) {
+	conf := TabixConf{Format: TabixGeneric, ColSeq: 1, ColBeg: 2, Meta: '#'}
+	for _, b := range []*IndexBuilder{NewTabixIndexBuilder(conf), NewCSIIndexBuilder(conf, 14, 6)} {
+		// One record per 1000 positions, each in its own bgzf block.
+		off := func(i int) uint64 { return uint64(i) << 16 }
+		for i := 0; i < 100; i++ {
+			require.NoError(t, b.Add("chr1", i*1000, i*1000+1, off(i), off(i+1)))
+		}
+		require.NoError(t, b.Add("chr2", 5, 6, off(100), off(101)))
+		var buf bytes.Buffer
+		require.NoError(t, b.Write(&buf))
+
+		idx, err := ReadIndex(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"chr1", "chr2"}, idx.Names)
+		// [49152, 65536) is the fourth 16kbp window, whose records (50000 to
+		// 65000) are contiguous.
+		assert.Equal(t, []bgzf.Chunk{{Begin: bgzf.Offset{File: 50}, End: bgzf.Offset{File: 66}}}, idx.Chunks(0, 50000, 50001))
+		assert.Equal(t, []bgzf.Chunk{{Begin: bgzf.Offset{File: 100}, End: bgzf.Offset{File: 101}}}, idx.Chunks(1, 0, 10))
+	}
+
+	b := NewTabixIndexBuilder(conf)
+	require.NoError(t, b.Add("chr1", 10, 11, 0, 1))
+	assert.Error(t, b.Add("chr1", 5, 6, 1, 2))
+	require.NoError(t, b.Add("chr2", 10, 11, 2, 3))
+	assert.Error(t, b.Add("chr1", 20, 21, 3, 4))
+	assert.Error(t, b.Add("chr2", 1<<29, 1<<29+1, 4, 5))
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Contig is a ##contig header line.
+type Contig struct {
+	Name string
+	// Length is 0 if the header line has no length.
+	Length int
+}
+
+// FieldDef is a ##INFO or ##FORMAT header line.
+type FieldDef struct {
+	ID, Number, Type, Description string
+}
+
+// Header is a VCF header, along with the BCF dictionaries derived from it.
+// Records refer to FILTER, INFO, and FORMAT keys by their index in the
+// string dictionary, and to contigs by their index in the contig dictionary.
+type Header struct {
+	// Lines are the meta-information lines, without the leading "##".
+	Lines []string
+	// Samples are the sample names from the #CHROM line.
+	Samples []string
+	// Contigs is the contig dictionary; unused indexes have empty names.
+	Contigs []Contig
+
+	strs      []string
+	strIdx    map[string]int
+	contigIdx map[string]int
+	infos     map[string]FieldDef
+	formats   map[string]FieldDef
+}
+
+// ParseHeader parses a VCF header, i.e. the meta-information lines followed
+// by the #CHROM line, and builds the dictionaries.  Following the BCF2 spec,
+// PASS is always string 0, and the other FILTER, INFO, and FORMAT IDs are
+// numbered in order of first appearance, unless the header lines have IDX
+// fields.
+func ParseHeader(text string) (*Header, error) {
+	h := &Header{
+		strs:      []string{"PASS"},
+		strIdx:    map[string]int{"PASS": 0},
+		contigIdx: make(map[string]int),
+		infos:     make(map[string]FieldDef),
+		formats:   make(map[string]FieldDef),
+	}
+	text = strings.TrimRight(text, "\x00\n")
+	sawColumns := false
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case strings.HasPrefix(line, "##"):
+			if sawColumns {
+				return nil, fmt.Errorf("bcf.ParseHeader: meta-information line after #CHROM line")
+			}
+			line = line[2:]
+			h.Lines = append(h.Lines, line)
+			if err := h.addLine(line); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "#CHROM"):
+			cols := strings.Split(line, "\t")
+			if len(cols) < 8 {
+				return nil, fmt.Errorf("bcf.ParseHeader: #CHROM line has %d columns", len(cols))
+			}
+			if len(cols) > 9 {
+				h.Samples = cols[9:]
+			}
+			sawColumns = true
+		case line == "":
+		default:
+			return nil, fmt.Errorf("bcf.ParseHeader: unexpected line %q", line)
+		}
+	}
+	if !sawColumns {
+		return nil, fmt.Errorf("bcf.ParseHeader: missing #CHROM line")
+	}
+	return h, nil
+}
+
+// parseStructuredLine parses the fields of a header line value like
+// <ID=DP,Number=1,Type=Integer,Description="Total depth">.
+func parseStructuredLine(value string) (map[string]string, error) {
+	if !strings.HasPrefix(value, "<") || !strings.HasSuffix(value, ">") {
+		return nil, nil
+	}
+	fields := make(map[string]string)
+	s := value[1 : len(value)-1]
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("bcf.ParseHeader: malformed header line %q", value)
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, "\"") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("bcf.ParseHeader: unterminated string in header line %q", value)
+			}
+			val = b.String()
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val = s[:end]
+			s = s[end:]
+		}
+		fields[key] = val
+		s = strings.TrimPrefix(s, ",")
+	}
+	return fields, nil
+}
+
+// addLine adds the dictionary entries of a meta-information line.
+func (h *Header) addLine(line string) error {
+	eq := strings.IndexByte(line, '=')
+	if eq < 0 {
+		return nil
+	}
+	key := line[:eq]
+	if key != "contig" && key != "FILTER" && key != "INFO" && key != "FORMAT" {
+		return nil
+	}
+	fields, err := parseStructuredLine(line[eq+1:])
+	if err != nil {
+		return err
+	}
+	id, ok := fields["ID"]
+	if !ok {
+		return fmt.Errorf("bcf.ParseHeader: %s header line without ID", key)
+	}
+	idx := -1
+	if s, ok := fields["IDX"]; ok {
+		if idx, err = strconv.Atoi(s); err != nil || idx < 0 {
+			return fmt.Errorf("bcf.ParseHeader: invalid IDX in header line %q", line)
+		}
+	}
+	if key == "contig" {
+		length := 0
+		if s, ok := fields["length"]; ok {
+			if length, err = strconv.Atoi(s); err != nil {
+				return fmt.Errorf("bcf.ParseHeader: invalid length in header line %q", line)
+			}
+		}
+		if _, ok := h.contigIdx[id]; ok {
+			return fmt.Errorf("bcf.ParseHeader: duplicate contig %s", id)
+		}
+		if idx < 0 {
+			idx = len(h.Contigs)
+		}
+		for len(h.Contigs) <= idx {
+			h.Contigs = append(h.Contigs, Contig{})
+		}
+		if h.Contigs[idx].Name != "" {
+			return fmt.Errorf("bcf.ParseHeader: contigs %s and %s have the same IDX", h.Contigs[idx].Name, id)
+		}
+		h.Contigs[idx] = Contig{Name: id, Length: length}
+		h.contigIdx[id] = idx
+		return nil
+	}
+
+	switch key {
+	case "INFO":
+		h.infos[id] = FieldDef{ID: id, Number: fields["Number"], Type: fields["Type"], Description: fields["Description"]}
+	case "FORMAT":
+		h.formats[id] = FieldDef{ID: id, Number: fields["Number"], Type: fields["Type"], Description: fields["Description"]}
+	}
+	if cur, ok := h.strIdx[id]; ok {
+		// INFO and FORMAT fields with the same ID share a dictionary entry.
+		if idx >= 0 && idx != cur {
+			return fmt.Errorf("bcf.ParseHeader: %s has inconsistent IDX values", id)
+		}
+		return nil
+	}
+	if idx < 0 {
+		idx = len(h.strs)
+	}
+	for len(h.strs) <= idx {
+		h.strs = append(h.strs, "")
+	}
+	if h.strs[idx] != "" {
+		return fmt.Errorf("bcf.ParseHeader: %s and %s have the same IDX", h.strs[idx], id)
+	}
+	h.strs[idx] = id
+	h.strIdx[id] = idx
+	return nil
+}
+
+// Text returns the header in VCF text form.
+func (h *Header) Text() string {
+	var b strings.Builder
+	for _, line := range h.Lines {
+		b.WriteString("##")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	b.WriteString("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO")
+	if len(h.Samples) > 0 {
+		b.WriteString("\tFORMAT")
+		for _, s := range h.Samples {
+			b.WriteByte('\t')
+			b.WriteString(s)
+		}
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// StringID returns the string dictionary index of a FILTER, INFO, or FORMAT
+// ID.
+func (h *Header) StringID(id string) (int, bool) {
+	idx, ok := h.strIdx[id]
+	return idx, ok
+}
+
+// StringAt returns the FILTER, INFO, or FORMAT ID at index idx of the string
+// dictionary, or "" if there is none.
+func (h *Header) StringAt(idx int) string {
+	if idx < 0 || idx >= len(h.strs) {
+		return ""
+	}
+	return h.strs[idx]
+}
+
+// ContigID returns the contig dictionary index of a contig.
+func (h *Header) ContigID(name string) (int, bool) {
+	idx, ok := h.contigIdx[name]
+	return idx, ok
+}
+
+// Info returns the ##INFO line with the given ID.
+func (h *Header) Info(id string) (FieldDef, bool) {
+	def, ok := h.infos[id]
+	return def, ok
+}
+
+// Format returns the ##FORMAT line with the given ID.
+func (h *Header) Format(id string) (FieldDef, bool) {
+	def, ok := h.formats[id]
+	return def, ok
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcf
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/hts/bgzf"
+)
+
+// tbiMinShift and tbiDepth are the fixed binning parameters of .tbi indexes.
+const (
+	tbiMinShift = 14
+	tbiDepth    = 5
+)
+
+// indexRef is the index of one reference sequence.
+type indexRef struct {
+	bins map[uint32][]bgzf.Chunk
+	// loffsets are the per-bin minimum offsets of a .csi index.
+	loffsets map[uint32]bgzf.Offset
+	// linear is the linear index of a .tbi index.
+	linear []bgzf.Offset
+}
+
+// Index is a .csi or .tbi index.
+type Index struct {
+	// MinShift and Depth are the parameters of the binning scheme.
+	MinShift, Depth int
+	// Names are the sequence names of a .tbi index, which identifies
+	// sequences by their position in this list, or of a .csi index of a text
+	// file.  They are nil for a .csi index of a BCF file, which uses the
+	// contig dictionary indexes of the BCF header.
+	Names []string
+
+	refs []indexRef
+}
+
+// indexReader reads little-endian integers, remembering the first error.
+type indexReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *indexReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.LittleEndian, v)
+	}
+}
+
+func (r *indexReader) int32() int32 {
+	var v int32
+	r.read(&v)
+	return v
+}
+
+func (r *indexReader) uint32() uint32 {
+	var v uint32
+	r.read(&v)
+	return v
+}
+
+func (r *indexReader) offset() bgzf.Offset {
+	var v uint64
+	r.read(&v)
+	return bgzf.Offset{File: int64(v >> 16), Block: uint16(v)}
+}
+
+// count reads a non-negative int32 count.
+func (r *indexReader) count() int {
+	n := r.int32()
+	if n < 0 && r.err == nil {
+		r.err = fmt.Errorf("negative count %d", n)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// ReadIndex reads a (bgzf-compressed) .csi or .tbi index.
+func ReadIndex(r io.Reader) (*Index, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("bcf.ReadIndex: %v", err)
+	}
+	ir := &indexReader{r: bufio.NewReader(zr)}
+	var m [4]byte
+	ir.read(&m)
+	idx := &Index{}
+	csi := false
+	switch string(m[:]) {
+	case "CSI\x01":
+		csi = true
+		idx.MinShift = int(ir.int32())
+		idx.Depth = int(ir.int32())
+		aux := make([]byte, ir.count())
+		ir.read(aux)
+		// The aux data of a text file's index is its tabix configuration,
+		// including the sequence names (see TabixConf).
+		if len(aux) >= 28 {
+			if nameLen := int(binary.LittleEndian.Uint32(aux[24:28])); nameLen > 0 && 28+nameLen <= len(aux) {
+				idx.Names = strings.Split(strings.TrimRight(string(aux[28:28+nameLen]), "\x00"), "\x00")
+			}
+		}
+	case "TBI\x01":
+		idx.MinShift, idx.Depth = tbiMinShift, tbiDepth
+		nRef := ir.count()
+		// format, col_seq, col_beg, col_end, meta, skip
+		var conf [6]int32
+		ir.read(&conf)
+		names := make([]byte, ir.count())
+		ir.read(names)
+		if nRef > 0 {
+			idx.Names = strings.Split(strings.TrimRight(string(names), "\x00"), "\x00")
+		} else {
+			idx.Names = []string{}
+		}
+		if ir.err == nil && len(idx.Names) != nRef {
+			return nil, fmt.Errorf("bcf.ReadIndex: .tbi index has %d names for %d sequences", len(idx.Names), nRef)
+		}
+	default:
+		if ir.err != nil {
+			return nil, fmt.Errorf("bcf.ReadIndex: %v", ir.err)
+		}
+		return nil, fmt.Errorf("bcf.ReadIndex: not a .csi or .tbi index")
+	}
+	if csi {
+		idx.refs = make([]indexRef, ir.count())
+	} else {
+		idx.refs = make([]indexRef, len(idx.Names))
+	}
+	for i := range idx.refs {
+		ref := &idx.refs[i]
+		nBin := ir.count()
+		ref.bins = make(map[uint32][]bgzf.Chunk, nBin)
+		if csi {
+			ref.loffsets = make(map[uint32]bgzf.Offset, nBin)
+		}
+		for j := 0; j < nBin; j++ {
+			bin := ir.uint32()
+			if csi {
+				ref.loffsets[bin] = ir.offset()
+			}
+			chunks := make([]bgzf.Chunk, ir.count())
+			for k := range chunks {
+				chunks[k].Begin = ir.offset()
+				chunks[k].End = ir.offset()
+			}
+			ref.bins[bin] = chunks
+		}
+		if !csi {
+			ref.linear = make([]bgzf.Offset, ir.count())
+			for k := range ref.linear {
+				ref.linear[k] = ir.offset()
+			}
+		}
+		if ir.err != nil {
+			break
+		}
+	}
+	if ir.err != nil {
+		return nil, fmt.Errorf("bcf.ReadIndex: %v", ir.err)
+	}
+	return idx, nil
+}
+
+// binLimit returns the largest real bin number; larger bins hold metadata.
+func binLimit(depth int) uint32 {
+	return uint32(((1 << (3 * (depth + 1))) - 1) / 7)
+}
+
+// reg2bins returns the bins that may contain records overlapping [beg, end).
+func reg2bins(beg, end, minShift, depth int) []uint32 {
+	var bins []uint32
+	end--
+	s := minShift + depth*3
+	t := 0
+	for l := 0; l <= depth; l++ {
+		for b := t + (beg >> uint(s)); b <= t+(end>>uint(s)); b++ {
+			bins = append(bins, uint32(b))
+		}
+		s -= 3
+		t += 1 << uint(l*3)
+	}
+	return bins
+}
+
+func offsetLess(a, b bgzf.Offset) bool {
+	return a.File < b.File || (a.File == b.File && a.Block < b.Block)
+}
+
+// Chunks returns the sorted, merged chunks which may contain the records
+// overlapping [beg, end) on reference refID.
+func (idx *Index) Chunks(refID, beg, end int) []bgzf.Chunk {
+	if refID < 0 || refID >= len(idx.refs) || beg >= end {
+		return nil
+	}
+	if beg < 0 {
+		beg = 0
+	}
+	ref := &idx.refs[refID]
+
+	// Chunks ending before minOff can't contain overlapping records.
+	var minOff bgzf.Offset
+	if ref.linear != nil {
+		if i := beg >> tbiMinShift; i < len(ref.linear) {
+			minOff = ref.linear[i]
+		} else if len(ref.linear) > 0 {
+			minOff = ref.linear[len(ref.linear)-1]
+		}
+	} else {
+		// Use the loffset of the smallest bin containing beg.
+		firstLeaf := (1<<uint(3*idx.Depth) - 1) / 7
+		for bin := uint32(firstLeaf + (beg >> uint(idx.MinShift))); ; bin = (bin - 1) >> 3 {
+			if off, ok := ref.loffsets[bin]; ok {
+				minOff = off
+				break
+			}
+			if bin == 0 {
+				break
+			}
+		}
+	}
+
+	limit := binLimit(idx.Depth)
+	var chunks []bgzf.Chunk
+	for _, bin := range reg2bins(beg, end, idx.MinShift, idx.Depth) {
+		if bin > limit {
+			continue
+		}
+		for _, c := range ref.bins[bin] {
+			if offsetLess(minOff, c.End) {
+				chunks = append(chunks, c)
+			}
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return offsetLess(chunks[i].Begin, chunks[j].Begin)
+	})
+	merged := chunks[:0]
+	for _, c := range chunks {
+		if n := len(merged); n > 0 && !offsetLess(merged[n-1].End, c.Begin) {
+			if offsetLess(merged[n-1].End, c.End) {
+				merged[n-1].End = c.End
+			}
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return merged
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcf
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/grailbio/bio/encoding/bgzf"
+)
+
+// Tabix formats, for TabixConf.Format.
+const (
+	// TabixGeneric is a generic tab-separated file, with 1-based inclusive
+	// coordinates.
+	TabixGeneric = 0
+	// TabixVCF is a VCF file, whose records end at POS+len(REF).
+	TabixVCF = 2
+)
+
+// TabixConf is the column layout of a text file indexed with a .tbi index,
+// or with a .csi index whose aux data holds the layout, as htslib writes for
+// text files.
+type TabixConf struct {
+	Format int32
+	// ColSeq, ColBeg, and ColEnd are the 1-based columns of the sequence
+	// name and of the first and last positions.  ColEnd is 0 if lines have
+	// no end column.
+	ColSeq, ColBeg, ColEnd int32
+	// Meta is the first character of comment lines.
+	Meta byte
+	// Skip is the number of header lines at the start of the file.
+	Skip int32
+}
+
+type builderChunk struct {
+	begin, end uint64
+}
+
+// builderRef is the index of one sequence under construction.
+type builderRef struct {
+	bins map[uint32][]builderChunk
+	// linear holds the virtual offset of the first record overlapping each
+	// 1<<minShift window, or 0 if none has been seen.
+	linear []uint64
+}
+
+// IndexBuilder builds a .tbi or .csi index of a bgzf-compressed text file.
+// Records must be added in file order, sorted by position within each
+// sequence, and each sequence's records must be contiguous.
+type IndexBuilder struct {
+	// Conf is the file's column layout.  It may be modified until Write is
+	// called.
+	Conf TabixConf
+
+	csi             bool
+	minShift, depth int
+	names           []string
+	nameIDs         map[string]int
+	refs            []builderRef
+	lastBeg         int
+}
+
+// NewTabixIndexBuilder returns a builder of a .tbi index, which supports
+// positions up to 1<<29.
+func NewTabixIndexBuilder(conf TabixConf) *IndexBuilder {
+	return &IndexBuilder{Conf: conf, minShift: tbiMinShift, depth: tbiDepth, nameIDs: map[string]int{}}
+}
+
+// NewCSIIndexBuilder returns a builder of a .csi index with the given binning
+// parameters, which supports positions up to 1<<(minShift+3*depth).
+func NewCSIIndexBuilder(conf TabixConf, minShift, depth int) *IndexBuilder {
+	return &IndexBuilder{Conf: conf, csi: true, minShift: minShift, depth: depth, nameIDs: map[string]int{}}
+}
+
+// reg2bin returns the smallest bin which contains [beg, end).
+func reg2bin(beg, end, minShift, depth int) uint32 {
+	end--
+	s := minShift
+	t := ((1 << uint(depth*3)) - 1) / 7
+	for l := depth; l > 0; l-- {
+		if beg>>uint(s) == end>>uint(s) {
+			return uint32(t + beg>>uint(s))
+		}
+		s += 3
+		t -= 1 << uint((l-1)*3)
+	}
+	return 0
+}
+
+// binStart returns the first position covered by bin.
+func binStart(bin uint32, minShift, depth int) int {
+	t := 0
+	for l := 0; l <= depth; l++ {
+		n := 1 << uint(l*3)
+		if int(bin) < t+n {
+			return (int(bin) - t) << uint(minShift+3*(depth-l))
+		}
+		t += n
+	}
+	return 0
+}
+
+// Add indexes a record covering [beg, end) (0-based) on sequence name, which
+// occupies the virtual offsets [begin, end) of the file.
+func (b *IndexBuilder) Add(name string, beg, end int, beginOff, endOff uint64) error {
+	if end <= beg {
+		end = beg + 1
+	}
+	if maxPos := 1 << uint(b.minShift+3*b.depth); end > maxPos {
+		return fmt.Errorf("bcf.IndexBuilder: %s:%d is beyond the index limit of %d", name, end, maxPos)
+	}
+	id, ok := b.nameIDs[name]
+	switch {
+	case !ok:
+		id = len(b.names)
+		b.nameIDs[name] = id
+		b.names = append(b.names, name)
+		b.refs = append(b.refs, builderRef{bins: map[uint32][]builderChunk{}})
+	case id != len(b.names)-1:
+		return fmt.Errorf("bcf.IndexBuilder: records of %s are not contiguous", name)
+	case beg < b.lastBeg:
+		return fmt.Errorf("bcf.IndexBuilder: records of %s are not sorted at %d", name, beg)
+	}
+	b.lastBeg = beg
+	ref := &b.refs[id]
+
+	bin := reg2bin(beg, end, b.minShift, b.depth)
+	chunks := ref.bins[bin]
+	if n := len(chunks); (n > 0) && (chunks[n-1].end == beginOff) {
+		chunks[n-1].end = endOff
+	} else {
+		ref.bins[bin] = append(chunks, builderChunk{beginOff, endOff})
+	}
+
+	lastWindow := (end - 1) >> uint(b.minShift)
+	for len(ref.linear) <= lastWindow {
+		ref.linear = append(ref.linear, 0)
+	}
+	for w := beg >> uint(b.minShift); w <= lastWindow; w++ {
+		if ref.linear[w] == 0 {
+			ref.linear[w] = beginOff
+		}
+	}
+	return nil
+}
+
+// Write writes the bgzf-compressed index to w.
+func (b *IndexBuilder) Write(w io.Writer) error {
+	var names []byte
+	for _, name := range b.names {
+		names = append(append(names, name...), 0)
+	}
+	conf := func(buf []byte) []byte {
+		c := &b.Conf
+		for _, v := range []int32{c.Format, c.ColSeq, c.ColBeg, c.ColEnd, int32(c.Meta), c.Skip, int32(len(names))} {
+			buf = appendUint32(buf, uint32(v))
+		}
+		return append(buf, names...)
+	}
+	var buf []byte
+	if b.csi {
+		aux := conf(nil)
+		buf = append(buf, "CSI\x01"...)
+		buf = appendUint32(buf, uint32(b.minShift))
+		buf = appendUint32(buf, uint32(b.depth))
+		buf = appendUint32(buf, uint32(len(aux)))
+		buf = append(buf, aux...)
+	} else {
+		buf = append(buf, "TBI\x01"...)
+		buf = appendUint32(buf, uint32(len(b.names)))
+		buf = conf(buf)
+	}
+	if b.csi {
+		buf = appendUint32(buf, uint32(len(b.refs)))
+	}
+	for i := range b.refs {
+		ref := &b.refs[i]
+		// Fill in empty windows, so that each entry is a lower bound on the
+		// offsets of the records overlapping its window.
+		for w := 1; w < len(ref.linear); w++ {
+			if ref.linear[w] == 0 {
+				ref.linear[w] = ref.linear[w-1]
+			}
+		}
+		bins := make([]uint32, 0, len(ref.bins))
+		for bin := range ref.bins {
+			bins = append(bins, bin)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+		buf = appendUint32(buf, uint32(len(bins)))
+		for _, bin := range bins {
+			buf = appendUint32(buf, bin)
+			if b.csi {
+				// The bin's loffset is the lower bound for records overlapping
+				// its first window.
+				var loff uint64
+				if w := binStart(bin, b.minShift, b.depth) >> uint(b.minShift); w < len(ref.linear) {
+					loff = ref.linear[w]
+				}
+				buf = appendUint64(buf, loff)
+			}
+			chunks := ref.bins[bin]
+			buf = appendUint32(buf, uint32(len(chunks)))
+			for _, c := range chunks {
+				buf = appendUint64(appendUint64(buf, c.begin), c.end)
+			}
+		}
+		if !b.csi {
+			buf = appendUint32(buf, uint32(len(ref.linear)))
+			for _, off := range ref.linear {
+				buf = appendUint64(buf, off)
+			}
+		}
+	}
+	bw, err := bgzf.NewWriter(w, 6)
+	if err != nil {
+		return err
+	}
+	if _, err = bw.Write(buf); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(x)), uint32(x>>32))
+}
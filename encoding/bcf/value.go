@@ -0,0 +1,388 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// ValueType is the type of a typed BCF value.
+type ValueType uint8
+
+// The BCF2 atomic types.  A Value with TypeMissing has no data; it is used
+// for INFO flags.
+const (
+	TypeMissing ValueType = 0
+	TypeInt8    ValueType = 1
+	TypeInt16   ValueType = 2
+	TypeInt32   ValueType = 3
+	TypeFloat   ValueType = 5
+	TypeChar    ValueType = 7
+)
+
+// Integer sentinels.  Narrower integer types are widened to int32 when read,
+// with their sentinels mapped to these.
+const (
+	MissingInt     int32 = math.MinInt32
+	EndOfVectorInt int32 = math.MinInt32 + 1
+)
+
+const (
+	missingFloatBits     uint32 = 0x7F800001
+	endOfVectorFloatBits uint32 = 0x7F800002
+)
+
+// MissingFloat is the missing float value, e.g. for a missing QUAL.  It is a
+// NaN, so use IsMissingFloat to test for it.
+var MissingFloat = math.Float32frombits(missingFloatBits)
+
+// IsMissingFloat returns true iff f is MissingFloat.
+func IsMissingFloat(f float32) bool {
+	return math.Float32bits(f) == missingFloatBits
+}
+
+// Value is a typed INFO or FORMAT value.  Exactly one of Ints, Floats, and
+// Str is used, depending on Type.  End-of-vector padding is removed when a
+// Value is read, and added when it is written.
+type Value struct {
+	Type   ValueType
+	Ints   []int32
+	Floats []float32
+	Str    string
+}
+
+// Ints returns an integer Value.  The Writer picks the narrowest integer
+// type that can hold v.
+func Ints(v ...int32) Value { return Value{Type: TypeInt32, Ints: v} }
+
+// Floats returns a float Value.
+func Floats(v ...float32) Value { return Value{Type: TypeFloat, Floats: v} }
+
+// String returns a character Value.
+func String(s string) Value { return Value{Type: TypeChar, Str: s} }
+
+// Flag returns the Value of a present INFO flag.
+func Flag() Value { return Value{Type: TypeMissing} }
+
+func (v *Value) isInt() bool {
+	return v.Type == TypeInt8 || v.Type == TypeInt16 || v.Type == TypeInt32
+}
+
+// len returns the number of atomic values in v.
+func (v *Value) len() int {
+	switch {
+	case v.isInt():
+		return len(v.Ints)
+	case v.Type == TypeFloat:
+		return len(v.Floats)
+	case v.Type == TypeChar:
+		return len(v.Str)
+	}
+	return 0
+}
+
+// typeSize returns the size in bytes of an atomic value of type t.
+func typeSize(t ValueType) int {
+	switch t {
+	case TypeInt8, TypeChar:
+		return 1
+	case TypeInt16:
+		return 2
+	case TypeInt32, TypeFloat:
+		return 4
+	}
+	return 0
+}
+
+// intType returns the narrowest integer type that can hold v, not counting
+// the sentinels, which exist in all types.
+func intType(v []int32) ValueType {
+	t := TypeInt8
+	for _, x := range v {
+		if x == MissingInt || x == EndOfVectorInt {
+			continue
+		}
+		if x < -32760 || x > math.MaxInt16 {
+			return TypeInt32
+		}
+		if x < -120 || x > math.MaxInt8 {
+			t = TypeInt16
+		}
+	}
+	return t
+}
+
+// decoder reads typed values from the shared or individual part of a record.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+	d.b = nil
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n < 0 || n > len(d.b) {
+		d.fail("bcf: record truncated")
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// int reads an atomic value of integer type t.
+func (d *decoder) int(t ValueType) int32 {
+	b := d.bytes(typeSize(t))
+	if b == nil {
+		return 0
+	}
+	switch t {
+	case TypeInt8:
+		switch b[0] {
+		case 0x80:
+			return MissingInt
+		case 0x81:
+			return EndOfVectorInt
+		}
+		return int32(int8(b[0]))
+	case TypeInt16:
+		switch x := binary.LittleEndian.Uint16(b); x {
+		case 0x8000:
+			return MissingInt
+		case 0x8001:
+			return EndOfVectorInt
+		default:
+			return int32(int16(x))
+		}
+	}
+	return int32(binary.LittleEndian.Uint32(b))
+}
+
+// typeDesc reads a type descriptor.
+func (d *decoder) typeDesc() (ValueType, int) {
+	b := d.bytes(1)
+	if b == nil {
+		return TypeMissing, 0
+	}
+	t, n := ValueType(b[0]&0xf), int(b[0]>>4)
+	if n == 15 {
+		n = int(d.typedInt())
+	}
+	if typeSize(t) == 0 && t != TypeMissing {
+		d.fail("bcf: unknown value type %d", t)
+	}
+	return t, n
+}
+
+// typedInt reads a single typed integer, e.g. an INFO key.
+func (d *decoder) typedInt() int32 {
+	t, n := d.typeDesc()
+	if n != 1 || t == TypeFloat || t == TypeChar || t == TypeMissing {
+		d.fail("bcf: expected a typed integer")
+		return 0
+	}
+	return d.int(t)
+}
+
+// values reads n atomic values of type t, and removes end-of-vector padding.
+func (d *decoder) values(t ValueType, n int) Value {
+	v := Value{Type: t}
+	switch t {
+	case TypeInt8, TypeInt16, TypeInt32:
+		for i := 0; i < n; i++ {
+			if x := d.int(t); x != EndOfVectorInt {
+				v.Ints = append(v.Ints, x)
+			}
+		}
+	case TypeFloat:
+		for i := 0; i < n; i++ {
+			bits := d.uint32()
+			if bits != endOfVectorFloatBits {
+				v.Floats = append(v.Floats, math.Float32frombits(bits))
+			}
+		}
+	case TypeChar:
+		s := d.bytes(n)
+		for len(s) > 0 && s[len(s)-1] == 0 {
+			s = s[:len(s)-1]
+		}
+		v.Str = string(s)
+	}
+	return v
+}
+
+// value reads a typed value.
+func (d *decoder) value() Value {
+	t, n := d.typeDesc()
+	return d.values(t, n)
+}
+
+func appendUint32(b []byte, x uint32) []byte {
+	return append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+}
+
+// appendTypeDesc appends the type descriptor of n values of type t.
+func appendTypeDesc(b []byte, t ValueType, n int) []byte {
+	if n < 15 {
+		return append(b, byte(n<<4)|byte(t))
+	}
+	b = append(b, 15<<4|byte(t))
+	return appendTypedInt(b, int32(n))
+}
+
+// appendInt appends x as an atomic value of integer type t.
+func appendInt(b []byte, t ValueType, x int32) []byte {
+	switch t {
+	case TypeInt8:
+		switch x {
+		case MissingInt:
+			return append(b, 0x80)
+		case EndOfVectorInt:
+			return append(b, 0x81)
+		}
+		return append(b, byte(x))
+	case TypeInt16:
+		switch x {
+		case MissingInt:
+			x = 0x8000
+		case EndOfVectorInt:
+			x = 0x8001
+		}
+		return append(b, byte(x), byte(x>>8))
+	}
+	return appendUint32(b, uint32(x))
+}
+
+// appendTypedInt appends x as a single typed integer.
+func appendTypedInt(b []byte, x int32) []byte {
+	t := intType([]int32{x})
+	return appendInt(append(b, 1<<4|byte(t)), t, x)
+}
+
+// appendTypedString appends s as a typed character vector.
+func appendTypedString(b []byte, s string) []byte {
+	return append(appendTypeDesc(b, TypeChar, len(s)), s...)
+}
+
+// appendValue appends v as a typed value.
+func appendValue(b []byte, v *Value) ([]byte, error) {
+	switch {
+	case v.Type == TypeMissing:
+		return append(b, 0), nil
+	case v.isInt():
+		t := intType(v.Ints)
+		b = appendTypeDesc(b, t, len(v.Ints))
+		for _, x := range v.Ints {
+			b = appendInt(b, t, x)
+		}
+	case v.Type == TypeFloat:
+		b = appendTypeDesc(b, TypeFloat, len(v.Floats))
+		for _, f := range v.Floats {
+			b = appendUint32(b, math.Float32bits(f))
+		}
+	case v.Type == TypeChar:
+		b = appendTypedString(b, v.Str)
+	default:
+		return b, fmt.Errorf("bcf: unknown value type %d", v.Type)
+	}
+	return b, nil
+}
+
+// appendSampleValues appends the values of a FORMAT field, one per sample.
+// All values must have the same type; each is padded to the length of the
+// longest one.  Samples with no data are written as missing.
+func appendSampleValues(b []byte, values []Value) ([]byte, error) {
+	t := TypeMissing
+	n := 1
+	var ints []int32
+	for i := range values {
+		v := &values[i]
+		if v.Type == TypeMissing {
+			continue
+		}
+		vt := v.Type
+		if v.isInt() {
+			vt = TypeInt32
+			ints = append(ints, v.Ints...)
+		}
+		if t == TypeMissing {
+			t = vt
+		} else if t != vt {
+			return b, fmt.Errorf("bcf: FORMAT values of different types (%d and %d)", t, vt)
+		}
+		if l := v.len(); l > n {
+			n = l
+		}
+	}
+	switch t {
+	case TypeMissing:
+		// Write the field as missing integers.
+		t = TypeInt8
+	case TypeInt32:
+		t = intType(ints)
+	}
+	b = appendTypeDesc(b, t, n)
+	for i := range values {
+		v := &values[i]
+		l := v.len()
+		switch t {
+		case TypeInt8, TypeInt16, TypeInt32:
+			for j := 0; j < n; j++ {
+				x := EndOfVectorInt
+				if j < l {
+					x = v.Ints[j]
+				} else if j == 0 {
+					x = MissingInt
+				}
+				b = appendInt(b, t, x)
+			}
+		case TypeFloat:
+			for j := 0; j < n; j++ {
+				bits := endOfVectorFloatBits
+				if j < l {
+					bits = math.Float32bits(v.Floats[j])
+				} else if j == 0 {
+					bits = missingFloatBits
+				}
+				b = appendUint32(b, bits)
+			}
+		case TypeChar:
+			s := v.Str
+			if l == 0 {
+				s = "."
+			}
+			b = append(b, s...)
+			for j := len(s); j < n; j++ {
+				b = append(b, 0)
+			}
+		}
+	}
+	return b, nil
+}
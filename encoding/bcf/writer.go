@@ -0,0 +1,143 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcf
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/grailbio/bio/encoding/bgzf"
+)
+
+// Writer writes BCF records.  It is not safe for concurrent use.
+type Writer struct {
+	bg     *bgzf.Writer
+	header *Header
+	shared []byte
+	indiv  []byte
+}
+
+// NewWriter writes the magic and header to a new BCF file.  level is the
+// compression level.  The header is flushed to its own bgzf block, so that the
+// first record starts a new block.
+func NewWriter(w io.Writer, header *Header, level int) (*Writer, error) {
+	bg, err := bgzf.NewWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	text := header.Text() + "\x00"
+	b := appendUint32([]byte(magic), uint32(len(text)))
+	b = append(b, text...)
+	if _, err = bg.Write(b); err != nil {
+		return nil, err
+	}
+	if err = bg.CloseWithoutTerminator(); err != nil {
+		return nil, err
+	}
+	return &Writer{bg: bg, header: header}, nil
+}
+
+// Write writes a record.  rec's dictionary indexes must be valid for the
+// Writer's header, and each FORMAT field must have one value per sample.
+func (w *Writer) Write(rec *Record) error {
+	h := w.header
+	if rec.ContigID < 0 || rec.ContigID >= len(h.Contigs) || h.Contigs[rec.ContigID].Name == "" {
+		return fmt.Errorf("bcf.Writer: invalid contig ID %d", rec.ContigID)
+	}
+	if len(rec.Info) > math.MaxUint16 || len(rec.Format) > math.MaxUint8 || len(rec.Alt)+1 > math.MaxUint16 {
+		return fmt.Errorf("bcf.Writer: too many alleles, INFO, or FORMAT fields at %s:%d", h.Contigs[rec.ContigID].Name, rec.Pos+1)
+	}
+	rlen := rec.RLen
+	if rlen == 0 {
+		rlen = len(rec.Ref)
+	}
+	nSample := len(h.Samples)
+	if len(rec.Format) == 0 {
+		nSample = 0
+	}
+	b := w.shared[:0]
+	b = appendUint32(b, uint32(rec.ContigID))
+	b = appendUint32(b, uint32(rec.Pos))
+	b = appendUint32(b, uint32(rlen))
+	b = appendUint32(b, math.Float32bits(rec.Qual))
+	b = appendUint32(b, uint32(len(rec.Alt)+1)<<16|uint32(len(rec.Info)))
+	b = appendUint32(b, uint32(len(rec.Format))<<24|uint32(nSample))
+	b = appendTypedString(b, rec.ID)
+	b = appendTypedString(b, rec.Ref)
+	for _, alt := range rec.Alt {
+		b = appendTypedString(b, alt)
+	}
+	filters := make([]int32, len(rec.Filters))
+	for i, f := range rec.Filters {
+		filters[i] = int32(f)
+	}
+	var err error
+	if len(filters) == 0 {
+		b = append(b, 0)
+	} else if b, err = appendValue(b, &Value{Type: TypeInt32, Ints: filters}); err != nil {
+		return err
+	}
+	for i := range rec.Info {
+		f := &rec.Info[i]
+		b = appendTypedInt(b, int32(f.Key))
+		if b, err = appendValue(b, &f.Value); err != nil {
+			return err
+		}
+	}
+	w.shared = b
+
+	b = w.indiv[:0]
+	for i := range rec.Format {
+		f := &rec.Format[i]
+		if len(f.Values) != nSample {
+			return fmt.Errorf("bcf.Writer: FORMAT field %s has %d values, expected %d", h.StringAt(f.Key), len(f.Values), nSample)
+		}
+		b = appendTypedInt(b, int32(f.Key))
+		if b, err = appendSampleValues(b, f.Values); err != nil {
+			return err
+		}
+	}
+	w.indiv = b
+
+	var lens [8]byte
+	copy(lens[:4], appendUint32(nil, uint32(len(w.shared))))
+	copy(lens[4:], appendUint32(nil, uint32(len(w.indiv))))
+	if _, err = w.bg.Write(lens[:]); err != nil {
+		return err
+	}
+	if _, err = w.bg.Write(w.shared); err != nil {
+		return err
+	}
+	_, err = w.bg.Write(w.indiv)
+	return err
+}
+
+// VOffset returns the bgzf virtual offset of the next record, e.g. for
+// building an index.
+func (w *Writer) VOffset() uint64 {
+	return w.bg.VOffset()
+}
+
+// Flush ends the current bgzf block.
+func (w *Writer) Flush() error {
+	return w.bg.CloseWithoutTerminator()
+}
+
+// Close flushes the remaining records and writes the bgzf terminator.  It
+// doesn't close the underlying io.Writer.
+func (w *Writer) Close() error {
+	return w.bg.Close()
+}
@@ -0,0 +1,66 @@
+package bigwig_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/bigwig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	chroms := []bigwig.Chrom{{Name: "chr2", Len: 100000}, {Name: "chr1", Len: 5000}, {Name: "chrEmpty", Len: 10}}
+	for _, opts := range []bigwig.WriterOpts{{}, {ItemsPerSection: 2}} {
+		w, err := bigwig.NewWriter(chroms, opts)
+		require.NoError(t, err)
+		var want [2][]bigwig.Interval
+		// chr2: 700 alternating-value positions, then a run of equal values,
+		// which is merged into one interval.
+		for pos := 0; pos < 700; pos++ {
+			v := float32(pos%3) - 1.5
+			require.NoError(t, w.Add(0, pos, pos+1, v))
+			want[0] = append(want[0], bigwig.Interval{Start: pos, End: pos + 1, Value: v})
+		}
+		for pos := 1000; pos < 1100; pos++ {
+			require.NoError(t, w.Add(0, pos, pos+1, 7))
+		}
+		want[0] = append(want[0], bigwig.Interval{Start: 1000, End: 1100, Value: 7})
+		require.NoError(t, w.Add(1, 10, 4000, 0.25))
+		want[1] = append(want[1], bigwig.Interval{Start: 10, End: 4000, Value: 0.25})
+		var buf bytes.Buffer
+		require.NoError(t, w.Finish(&buf))
+
+		r, err := bigwig.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		assert.Equal(t, chroms, r.Chroms)
+		for i := range want {
+			got, err := r.Intervals(chroms[i].Name)
+			require.NoError(t, err)
+			assert.Equal(t, want[i], got)
+		}
+		got, err := r.Intervals("chrEmpty")
+		require.NoError(t, err)
+		assert.Empty(t, got)
+		_, err = r.Intervals("chrX")
+		assert.Error(t, err)
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	_, err := bigwig.NewWriter([]bigwig.Chrom{{Name: "chr1", Len: 10}, {Name: "chr1", Len: 10}}, bigwig.WriterOpts{})
+	assert.Error(t, err)
+	_, err = bigwig.NewWriter(nil, bigwig.WriterOpts{ItemsPerSection: 1 << 16})
+	assert.Error(t, err)
+
+	w, err := bigwig.NewWriter([]bigwig.Chrom{{Name: "chr1", Len: 10}}, bigwig.WriterOpts{})
+	require.NoError(t, err)
+	assert.Error(t, w.Add(0, 5, 11, 1))
+	require.NoError(t, w.Close())
+
+	w, err = bigwig.NewWriter([]bigwig.Chrom{{Name: "chr1", Len: 10}}, bigwig.WriterOpts{})
+	require.NoError(t, err)
+	require.NoError(t, w.Add(0, 5, 7, 1))
+	assert.Error(t, w.Add(0, 6, 8, 1))
+	require.NoError(t, w.Close())
+}
@@ -0,0 +1,226 @@
+package bigwig
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Reader reads the full-resolution data of a bigWig file.
+type Reader struct {
+	r io.ReaderAt
+	// Chroms are the file's chromosomes, indexed by chromosome ID.
+	Chroms []Chrom
+
+	chromIDs          map[string]uint32
+	indexOffset       int64
+	uncompressBufSize uint32
+}
+
+func readAt(r io.ReaderAt, n int, off int64) ([]byte, error) {
+	b := make([]byte, n)
+	if k, err := r.ReadAt(b, off); k < n {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewReader reads the header and chromosome list of the size-byte file r.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < headerSize {
+		return nil, fmt.Errorf("bigwig.NewReader: file too short")
+	}
+	hdr, err := readAt(r, headerSize, 0)
+	if err != nil {
+		return nil, fmt.Errorf("bigwig.NewReader: %v", err)
+	}
+	if binary.LittleEndian.Uint32(hdr) != bigWigMagic {
+		return nil, fmt.Errorf("bigwig.NewReader: not a bigWig file")
+	}
+	br := &Reader{
+		r:                 r,
+		chromIDs:          make(map[string]uint32),
+		indexOffset:       int64(binary.LittleEndian.Uint64(hdr[24:])),
+		uncompressBufSize: binary.LittleEndian.Uint32(hdr[52:]),
+	}
+	treeOffset := int64(binary.LittleEndian.Uint64(hdr[8:]))
+	bpt, err := readAt(r, bptHeaderSize, treeOffset)
+	if err != nil {
+		return nil, fmt.Errorf("bigwig.NewReader: %v", err)
+	}
+	if binary.LittleEndian.Uint32(bpt) != bptMagic {
+		return nil, fmt.Errorf("bigwig.NewReader: bad chromosome tree")
+	}
+	keySize := int(binary.LittleEndian.Uint32(bpt[8:]))
+	valSize := int(binary.LittleEndian.Uint32(bpt[12:]))
+	itemCount := binary.LittleEndian.Uint64(bpt[16:])
+	if valSize != 8 || itemCount > uint64(size) {
+		return nil, fmt.Errorf("bigwig.NewReader: bad chromosome tree")
+	}
+	br.Chroms = make([]Chrom, itemCount)
+	if err = br.readChromNode(treeOffset+bptHeaderSize, keySize, 0); err != nil {
+		return nil, fmt.Errorf("bigwig.NewReader: %v", err)
+	}
+	return br, nil
+}
+
+func (r *Reader) readChromNode(off int64, keySize, depth int) error {
+	if depth > 64 {
+		return fmt.Errorf("chromosome tree too deep")
+	}
+	nodeHdr, err := readAt(r.r, 4, off)
+	if err != nil {
+		return err
+	}
+	isLeaf := nodeHdr[0] != 0
+	count := int(binary.LittleEndian.Uint16(nodeHdr[2:]))
+	itemSize := keySize + 8
+	items, err := readAt(r.r, count*itemSize, off+4)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		item := items[i*itemSize:]
+		if !isLeaf {
+			if err := r.readChromNode(int64(binary.LittleEndian.Uint64(item[keySize:])), keySize, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		name := string(bytes.TrimRight(item[:keySize], "\x00"))
+		id := binary.LittleEndian.Uint32(item[keySize:])
+		if int(id) >= len(r.Chroms) {
+			return fmt.Errorf("chromosome %s has out-of-range ID %d", name, id)
+		}
+		r.Chroms[id] = Chrom{Name: name, Len: int(binary.LittleEndian.Uint32(item[keySize+4:]))}
+		r.chromIDs[name] = id
+	}
+	return nil
+}
+
+// Intervals returns the intervals of the given chromosome, in order.  It
+// returns nil if the file has no data for the chromosome.
+func (r *Reader) Intervals(chrom string) ([]Interval, error) {
+	id, ok := r.chromIDs[chrom]
+	if !ok {
+		return nil, fmt.Errorf("bigwig.Intervals: unknown chromosome %s", chrom)
+	}
+	cir, err := readAt(r.r, cirHeaderSize, r.indexOffset)
+	if err != nil {
+		return nil, fmt.Errorf("bigwig.Intervals: %v", err)
+	}
+	if binary.LittleEndian.Uint32(cir) != cirMagic {
+		return nil, fmt.Errorf("bigwig.Intervals: bad index")
+	}
+	var result []Interval
+	if err = r.readIndexNode(r.indexOffset+cirHeaderSize, id, 0, &result); err != nil {
+		return nil, fmt.Errorf("bigwig.Intervals: %v", err)
+	}
+	return result, nil
+}
+
+func (r *Reader) readIndexNode(off int64, id uint32, depth int, result *[]Interval) error {
+	if depth > 64 {
+		return fmt.Errorf("index too deep")
+	}
+	nodeHdr, err := readAt(r.r, 4, off)
+	if err != nil {
+		return err
+	}
+	isLeaf := nodeHdr[0] != 0
+	count := int(binary.LittleEndian.Uint16(nodeHdr[2:]))
+	itemSize := cirNonLeafItemSize
+	if isLeaf {
+		itemSize = cirLeafItemSize
+	}
+	items, err := readAt(r.r, count*itemSize, off+4)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		item := items[i*itemSize:]
+		startChrom := binary.LittleEndian.Uint32(item[0:])
+		endChrom := binary.LittleEndian.Uint32(item[8:])
+		if id < startChrom || id > endChrom {
+			continue
+		}
+		dataOffset := int64(binary.LittleEndian.Uint64(item[16:]))
+		if !isLeaf {
+			if err := r.readIndexNode(dataOffset, id, depth+1, result); err != nil {
+				return err
+			}
+			continue
+		}
+		size := binary.LittleEndian.Uint64(item[24:])
+		if size > math.MaxInt32 {
+			return fmt.Errorf("bad section size %d", size)
+		}
+		data, err := readAt(r.r, int(size), dataOffset)
+		if err != nil {
+			return err
+		}
+		if err := r.decodeSection(data, id, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reader) decodeSection(data []byte, id uint32, result *[]Interval) error {
+	if r.uncompressBufSize > 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+	if len(data) < sectionHeaderSize {
+		return fmt.Errorf("truncated section")
+	}
+	chromID := binary.LittleEndian.Uint32(data[0:])
+	start := int(binary.LittleEndian.Uint32(data[4:]))
+	step := int(binary.LittleEndian.Uint32(data[12:]))
+	span := int(binary.LittleEndian.Uint32(data[16:]))
+	typ := data[20]
+	count := int(binary.LittleEndian.Uint16(data[22:]))
+	if chromID != id {
+		return nil
+	}
+	items := data[sectionHeaderSize:]
+	itemSize := map[byte]int{sectionBedGraph: 12, sectionVarStep: 8, sectionFixedStep: 4}[typ]
+	if itemSize == 0 {
+		return fmt.Errorf("unknown section type %d", typ)
+	}
+	if len(items) < count*itemSize {
+		return fmt.Errorf("truncated section")
+	}
+	for i := 0; i < count; i++ {
+		item := items[i*itemSize:]
+		var iv Interval
+		switch typ {
+		case sectionBedGraph:
+			iv.Start = int(binary.LittleEndian.Uint32(item[0:]))
+			iv.End = int(binary.LittleEndian.Uint32(item[4:]))
+			iv.Value = math.Float32frombits(binary.LittleEndian.Uint32(item[8:]))
+		case sectionVarStep:
+			iv.Start = int(binary.LittleEndian.Uint32(item[0:]))
+			iv.End = iv.Start + span
+			iv.Value = math.Float32frombits(binary.LittleEndian.Uint32(item[4:]))
+		case sectionFixedStep:
+			iv.Start = start + i*step
+			iv.End = iv.Start + span
+			iv.Value = math.Float32frombits(binary.LittleEndian.Uint32(item[0:]))
+		}
+		*result = append(*result, iv)
+	}
+	return nil
+}
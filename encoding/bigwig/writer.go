@@ -0,0 +1,470 @@
+// Package bigwig writes and reads UCSC bigWig files, the indexed binary
+// format for dense genome-wide signal tracks (coverage, protection scores,
+// etc.) that genome browsers can load remotely.
+//
+// Writer stores the data as zlib-compressed bedGraph sections, merging
+// adjacent positions with equal values, and indexes them with an R-tree.  It
+// does not write zoom levels, so browsers compute whole-chromosome views from
+// the full-resolution data.  Reader reads files with or without zoom levels,
+// in any of the three section types, but only at full resolution.
+//
+// Example use:
+//
+//	w, err := bigwig.NewWriter([]bigwig.Chrom{{Name: "chr1", Len: 248956422}}, bigwig.WriterOpts{})
+//	err = w.Add(0, 10000, 10001, 2.5)
+//	err = w.Finish(out)
+//
+//	r, err := bigwig.NewReader(in, size)
+//	intervals, err := r.Intervals("chr1")
+//
+// The format is specified in Kent et al., "BigWig and BigBed: enabling
+// browsing of large distributed datasets", Bioinformatics 2010, and the UCSC
+// kent source (bbiFile.h, bwgInternal.h, cirTree.h, bPlusTree.h).
+package bigwig
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+)
+
+// Chrom describes a chromosome.
+type Chrom struct {
+	Name string
+	Len  int
+}
+
+// Interval is a value over the 0-based half-open range [Start, End) of a
+// chromosome.
+type Interval struct {
+	Start, End int
+	Value      float32
+}
+
+// DefaultItemsPerSection is the default number of intervals per compressed
+// section.
+const DefaultItemsPerSection = 1024
+
+// WriterOpts configures a Writer.
+type WriterOpts struct {
+	// ItemsPerSection is the maximum number of intervals per compressed
+	// section, at most 65535.  If 0, DefaultItemsPerSection is used.
+	ItemsPerSection int
+	// TempDir is the directory for the temporary file holding the sections
+	// until Finish.  If empty, os.TempDir() is used.
+	TempDir string
+}
+
+const (
+	bigWigMagic = 0x888FFC26
+	bptMagic    = 0x78CA8C91
+	cirMagic    = 0x2468ACE0
+
+	headerSize         = 64
+	totalSummarySize   = 40
+	bptHeaderSize      = 32
+	cirHeaderSize      = 48
+	sectionHeaderSize  = 24
+	bedGraphItemSize   = 12
+	cirLeafItemSize    = 32
+	cirNonLeafItemSize = 24
+	// cirBlockSize is the maximum number of children of an R-tree node.
+	cirBlockSize = 256
+
+	sectionBedGraph  = 1
+	sectionVarStep   = 2
+	sectionFixedStep = 3
+)
+
+// section is the R-tree leaf entry of a compressed section.
+type section struct {
+	chromID    uint32
+	start, end uint32
+	offset     int64 // relative to the start of the first section
+	size       int64
+}
+
+// Writer writes a bigWig file.  Intervals must be added in (chromosome,
+// start) order, and must not overlap.  The compressed sections are kept in a
+// temporary file, since the header must describe them; Finish writes the
+// file, and Close discards it.
+//
+// Writer is not thread-safe.
+type Writer struct {
+	chroms []Chrom
+	opts   WriterOpts
+	tmp    *os.File
+	tmpOff int64
+
+	sections []section
+	// items are the encoded intervals of the current section, whose chromosome
+	// is itemChrom.
+	items     []byte
+	nItems    int
+	itemChrom int
+	// pending is the last interval added, which may still be extended.
+	pending      Interval
+	pendingChrom int
+	hasPending   bool
+
+	maxUncompressed int
+	// Total summary.
+	basesCovered       int64
+	minVal, maxVal     float64
+	sumData, sumSquare float64
+
+	zbuf bytes.Buffer
+	err  error
+}
+
+// NewWriter creates a Writer for the given chromosomes; Add identifies a
+// chromosome by its index in chroms.
+func NewWriter(chroms []Chrom, opts WriterOpts) (*Writer, error) {
+	if opts.ItemsPerSection == 0 {
+		opts.ItemsPerSection = DefaultItemsPerSection
+	}
+	if opts.ItemsPerSection < 0 || opts.ItemsPerSection > math.MaxUint16 {
+		return nil, fmt.Errorf("bigwig.NewWriter: invalid ItemsPerSection %d", opts.ItemsPerSection)
+	}
+	seen := make(map[string]bool, len(chroms))
+	for _, c := range chroms {
+		if c.Name == "" || seen[c.Name] {
+			return nil, fmt.Errorf("bigwig.NewWriter: missing or duplicate chromosome name %q", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	tmp, err := ioutil.TempFile(opts.TempDir, "bigwig_*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		chroms:    chroms,
+		opts:      opts,
+		tmp:       tmp,
+		itemChrom: -1,
+		minVal:    math.Inf(1),
+		maxVal:    math.Inf(-1),
+	}, nil
+}
+
+// Add adds value over [start, end) of chromosome chromID.
+func (w *Writer) Add(chromID, start, end int, value float32) error {
+	if w.err != nil {
+		return w.err
+	}
+	if chromID < 0 || chromID >= len(w.chroms) || start < 0 || end <= start || end > w.chroms[chromID].Len {
+		w.err = fmt.Errorf("bigwig.Writer.Add: invalid interval %d:[%d, %d)", chromID, start, end)
+		return w.err
+	}
+	if w.hasPending {
+		if chromID < w.pendingChrom || (chromID == w.pendingChrom && start < w.pending.End) {
+			w.err = fmt.Errorf("bigwig.Writer.Add: interval %d:[%d, %d) is out of order", chromID, start, end)
+			return w.err
+		}
+		if chromID == w.pendingChrom && start == w.pending.End && value == w.pending.Value {
+			w.pending.End = end
+			return nil
+		}
+		w.addItem(w.pendingChrom, w.pending)
+	}
+	w.pending = Interval{Start: start, End: end, Value: value}
+	w.pendingChrom = chromID
+	w.hasPending = true
+	return w.err
+}
+
+func (w *Writer) addItem(chromID int, iv Interval) {
+	if chromID != w.itemChrom || w.nItems == w.opts.ItemsPerSection {
+		w.flushSection()
+		w.itemChrom = chromID
+	}
+	var b [bedGraphItemSize]byte
+	binary.LittleEndian.PutUint32(b[0:], uint32(iv.Start))
+	binary.LittleEndian.PutUint32(b[4:], uint32(iv.End))
+	binary.LittleEndian.PutUint32(b[8:], math.Float32bits(iv.Value))
+	w.items = append(w.items, b[:]...)
+	w.nItems++
+
+	n, v := float64(iv.End-iv.Start), float64(iv.Value)
+	w.basesCovered += int64(iv.End - iv.Start)
+	w.minVal = math.Min(w.minVal, v)
+	w.maxVal = math.Max(w.maxVal, v)
+	w.sumData += n * v
+	w.sumSquare += n * v * v
+}
+
+// flushSection compresses the current section to the temporary file.
+func (w *Writer) flushSection() {
+	if w.nItems == 0 || w.err != nil {
+		return
+	}
+	sec := section{
+		chromID: uint32(w.itemChrom),
+		start:   binary.LittleEndian.Uint32(w.items[0:]),
+		end:     binary.LittleEndian.Uint32(w.items[len(w.items)-bedGraphItemSize+4:]),
+		offset:  w.tmpOff,
+	}
+	var hdr [sectionHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], sec.chromID)
+	binary.LittleEndian.PutUint32(hdr[4:], sec.start)
+	binary.LittleEndian.PutUint32(hdr[8:], sec.end)
+	hdr[20] = sectionBedGraph
+	binary.LittleEndian.PutUint16(hdr[22:], uint16(w.nItems))
+	if n := sectionHeaderSize + len(w.items); n > w.maxUncompressed {
+		w.maxUncompressed = n
+	}
+
+	w.zbuf.Reset()
+	zw := zlib.NewWriter(&w.zbuf)
+	_, _ = zw.Write(hdr[:])
+	_, _ = zw.Write(w.items)
+	if w.err = zw.Close(); w.err != nil {
+		return
+	}
+	if _, w.err = w.tmp.Write(w.zbuf.Bytes()); w.err != nil {
+		return
+	}
+	sec.size = int64(w.zbuf.Len())
+	w.tmpOff += sec.size
+	w.sections = append(w.sections, sec)
+	w.items = w.items[:0]
+	w.nItems = 0
+}
+
+// put is a little-endian encoding helper.
+type put struct {
+	b    []byte
+	base int64 // file offset of b[0]
+}
+
+func (p *put) u8(v uint8)   { p.b = append(p.b, v) }
+func (p *put) u16(v uint16) { p.b = append(p.b, byte(v), byte(v>>8)) }
+func (p *put) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	p.b = append(p.b, b[:]...)
+}
+func (p *put) u64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	p.b = append(p.b, b[:]...)
+}
+func (p *put) f64(v float64) { p.u64(math.Float64bits(v)) }
+func (p *put) zeros(n int)   { p.b = append(p.b, make([]byte, n)...) }
+
+// appendChromTree appends the chromosome B+ tree, as a single leaf node.
+func (w *Writer) appendChromTree(p *put) {
+	keySize := 1
+	order := make([]int, len(w.chroms))
+	for i, c := range w.chroms {
+		order[i] = i
+		if len(c.Name) > keySize {
+			keySize = len(c.Name)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return w.chroms[order[i]].Name < w.chroms[order[j]].Name })
+	blockSize := len(w.chroms)
+	if blockSize == 0 {
+		blockSize = 1
+	}
+	p.u32(bptMagic)
+	p.u32(uint32(blockSize))
+	p.u32(uint32(keySize))
+	p.u32(8) // value size: chromID, chromSize
+	p.u64(uint64(len(w.chroms)))
+	p.u64(0)
+	p.u8(1) // isLeaf
+	p.u8(0)
+	p.u16(uint16(len(w.chroms)))
+	for _, i := range order {
+		c := w.chroms[i]
+		p.b = append(p.b, c.Name...)
+		p.zeros(keySize - len(c.Name))
+		p.u32(uint32(i))
+		p.u32(uint32(c.Len))
+	}
+}
+
+// appendIndex appends the R-tree index of the sections, whose absolute file
+// offsets are dataStart + section.offset.  Following the kent source, nodes
+// are written level by level from the root, and padded to cirBlockSize
+// items.
+func (w *Writer) appendIndex(p *put, dataStart, dataEnd int64) {
+	secs := w.sections
+	p.u32(cirMagic)
+	p.u32(cirBlockSize)
+	p.u64(uint64(len(secs)))
+	if len(secs) > 0 {
+		p.u32(secs[0].chromID)
+		p.u32(secs[0].start)
+		p.u32(secs[len(secs)-1].chromID)
+		p.u32(secs[len(secs)-1].end)
+	} else {
+		p.zeros(16)
+	}
+	p.u64(uint64(dataEnd))
+	p.u32(uint32(w.opts.ItemsPerSection))
+	p.u32(0)
+
+	// levels[i] is the number of nodes at height i, leaves being at height 0.
+	// Node j at height i covers sections [j*n, (j+1)*n), where
+	// n = cirBlockSize^(i+1).
+	levels := []int{(len(secs) + cirBlockSize - 1) / cirBlockSize}
+	if levels[0] == 0 {
+		levels[0] = 1
+	}
+	for levels[len(levels)-1] > 1 {
+		levels = append(levels, (levels[len(levels)-1]+cirBlockSize-1)/cirBlockSize)
+	}
+	leafNodeSize := int64(4 + cirBlockSize*cirLeafItemSize)
+	nonLeafNodeSize := int64(4 + cirBlockSize*cirNonLeafItemSize)
+	// levelOffset[i] is the file offset of the first node at height i.
+	levelOffset := make([]int64, len(levels))
+	off := int64(len(p.b)) + p.base
+	for i := len(levels) - 1; i >= 0; i-- {
+		levelOffset[i] = off
+		if i == 0 {
+			off += int64(levels[i]) * leafNodeSize
+		} else {
+			off += int64(levels[i]) * nonLeafNodeSize
+		}
+	}
+	// span is the number of sections covered by a child of the nodes at the
+	// current height.
+	span := 1
+	for i := 0; i < len(levels)-1; i++ {
+		span *= cirBlockSize
+	}
+	for i := len(levels) - 1; i >= 1; i-- {
+		childSpan := span
+		for j := 0; j < levels[i]; j++ {
+			nChild := 0
+			start := len(p.b)
+			p.zeros(4)
+			for c := j * cirBlockSize; c < (j+1)*cirBlockSize && c < levels[i-1]; c++ {
+				first := c * childSpan
+				last := (c+1)*childSpan - 1
+				if last >= len(secs) {
+					last = len(secs) - 1
+				}
+				p.u32(secs[first].chromID)
+				p.u32(secs[first].start)
+				p.u32(secs[last].chromID)
+				p.u32(secs[last].end)
+				childSize := nonLeafNodeSize
+				if i == 1 {
+					childSize = leafNodeSize
+				}
+				p.u64(uint64(levelOffset[i-1] + int64(c)*childSize))
+				nChild++
+			}
+			binary.LittleEndian.PutUint16(p.b[start+2:], uint16(nChild))
+			p.zeros((cirBlockSize - nChild) * cirNonLeafItemSize)
+		}
+		span /= cirBlockSize
+	}
+	for j := 0; j < levels[0]; j++ {
+		nItem := 0
+		start := len(p.b)
+		p.u8(1) // isLeaf
+		p.zeros(3)
+		for s := j * cirBlockSize; s < (j+1)*cirBlockSize && s < len(secs); s++ {
+			sec := secs[s]
+			p.u32(sec.chromID)
+			p.u32(sec.start)
+			p.u32(sec.chromID)
+			p.u32(sec.end)
+			p.u64(uint64(dataStart + sec.offset))
+			p.u64(uint64(sec.size))
+			nItem++
+		}
+		binary.LittleEndian.PutUint16(p.b[start+2:], uint16(nItem))
+		p.zeros((cirBlockSize - nItem) * cirLeafItemSize)
+	}
+}
+
+// Finish writes the bigWig file to out, and removes the temporary file.
+func (w *Writer) Finish(out io.Writer) (err error) {
+	defer func() {
+		if e := w.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if w.hasPending {
+		w.addItem(w.pendingChrom, w.pending)
+		w.hasPending = false
+	}
+	w.flushSection()
+	if w.err != nil {
+		return w.err
+	}
+
+	// Layout: header, total summary, chromosome tree, section count,
+	// sections, index, magic.
+	var tree put
+	w.appendChromTree(&tree)
+	treeOffset := int64(headerSize + totalSummarySize)
+	dataOffset := treeOffset + int64(len(tree.b))
+	sectionsStart := dataOffset + 8
+	indexOffset := sectionsStart + w.tmpOff
+
+	var p put
+	p.u32(bigWigMagic)
+	p.u16(4) // version
+	p.u16(0) // zoom levels
+	p.u64(uint64(treeOffset))
+	p.u64(uint64(dataOffset))
+	p.u64(uint64(indexOffset))
+	p.u16(0) // field count
+	p.u16(0) // defined field count
+	p.u64(0) // autoSql offset
+	p.u64(headerSize)
+	p.u32(uint32(w.maxUncompressed))
+	p.u64(0) // extension offset
+
+	p.u64(uint64(w.basesCovered))
+	if w.basesCovered == 0 {
+		w.minVal, w.maxVal = 0, 0
+	}
+	p.f64(w.minVal)
+	p.f64(w.maxVal)
+	p.f64(w.sumData)
+	p.f64(w.sumSquare)
+	p.b = append(p.b, tree.b...)
+	p.u64(uint64(len(w.sections)))
+	if _, err = out.Write(p.b); err != nil {
+		return err
+	}
+	if _, err = w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, w.tmp); err != nil {
+		return err
+	}
+
+	idx := put{base: indexOffset}
+	w.appendIndex(&idx, sectionsStart, indexOffset)
+	idx.u32(bigWigMagic)
+	_, err = out.Write(idx.b)
+	return err
+}
+
+// Close removes the temporary file.  It is safe to call Close after Finish.
+func (w *Writer) Close() error {
+	if w.tmp == nil {
+		return nil
+	}
+	name := w.tmp.Name()
+	err := w.tmp.Close()
+	w.tmp = nil
+	if e := os.Remove(name); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
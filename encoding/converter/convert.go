@@ -1,6 +1,6 @@
 package converter
 
-// Utility for converting BAM to PAM.
+// Utility for converting between BAM and PAM.
 
 import (
 	"fmt"
@@ -9,6 +9,7 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/file"
@@ -19,6 +20,7 @@ import (
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/encoding/pam"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/bio/util/progress"
 	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/bgzf"
 	"github.com/grailbio/hts/sam"
@@ -113,28 +115,15 @@ func generateShardBoundaries(bamPath, baiPath string, bytesPerShard int64) ([]ba
 	return bounds, nil
 }
 
-// convertShard converts range [startShard, limitShard) of the BAM file to
-// PAM. Returns the number of sam.Records converted.
-func convertShard(opts pam.WriteOpts, pamPath string, in bamprovider.Provider, startShard, limitShard bamShardBound) (int64, error) {
+// convertShard converts the records of the given shard to a PAM file shard
+// covering coordRange. Returns the number of sam.Records converted.
+func convertShard(opts pam.WriteOpts, pamPath string, in bamprovider.Provider, shard gbam.Shard, coordRange biopb.CoordRange) (int64, error) {
 	header, e := in.GetHeader()
 	if e != nil {
 		return 0, e
 	}
-
-	getRef := func(id int32) *sam.Reference {
-		if id == biopb.UnmappedRefID {
-			return nil
-		}
-		return header.Refs()[id]
-	}
-
-	iter := in.NewIterator(gbam.Shard{
-		StartRef: getRef(startShard.rec.RefId),
-		Start:    int(startShard.rec.Pos),
-		EndRef:   getRef(limitShard.rec.RefId),
-		End:      int(limitShard.rec.Pos),
-	})
-	opts.Range = biopb.CoordRange{Start: startShard.rec, Limit: limitShard.rec}
+	iter := in.NewIterator(shard)
+	opts.Range = coordRange
 	w := pam.NewWriter(opts, header, pamPath)
 	err := errors.Once{}
 	var nRecs int64
@@ -149,17 +138,28 @@ func convertShard(opts pam.WriteOpts, pamPath string, in bamprovider.Provider, s
 	}
 	err.Set(iter.Close())
 	err.Set(w.Close())
-	vlog.Infof("%v: Finished converting [%+v, %+v) with %d recs read: %v",
-		pamPath, startShard, limitShard, nRecs, err.Err())
+	vlog.Infof("%v: Finished converting %+v with %d recs read: %v",
+		pamPath, coordRange, nRecs, err.Err())
 	return nRecs, err.Err()
 }
 
-// ConvertToPAM copies BAM to PAM.
+// ConvertToPAM copies a BAM or PAM file to PAM. Fields listed in
+// opts.DropFields are left out of the output, so e.g. dropping "qual" and
+// "aux" creates a slim PAM file for coverage-only analyses.
 //
 // bytesPerShard is specified in term of the input BAM file. For example, if you
 // have a 100GB BAM file and set bytesPerShard to 20GB, this function will
-// create roughly five (=100/20) PAM shards.
+// create roughly five (=100/20) PAM shards. When the input is a PAM file, the
+// output has the same shards as the input, and bytesPerShard and baiPath are
+// ignored.
 func ConvertToPAM(opts pam.WriteOpts, pamPath, bamPath, baiPath string, bytesPerShard int64) error {
+	return ConvertToPAMWithProgress(opts, pamPath, bamPath, baiPath, bytesPerShard, nil)
+}
+
+// ConvertToPAMWithProgress is ConvertToPAM, reporting the progress to sinks:
+// one event per output shard, with the number of records converted (pipeline
+// "bam2pam", or "pam2pam" for a PAM input), and a final one.
+func ConvertToPAMWithProgress(opts pam.WriteOpts, pamPath, bamPath, baiPath string, bytesPerShard int64, sinks []progress.Sink) error {
 	if baiPath == "" {
 		baiPath = bamPath + ".bai"
 	}
@@ -169,16 +169,19 @@ func ConvertToPAM(opts pam.WriteOpts, pamPath, bamPath, baiPath string, bytesPer
 	if bytesPerShard <= 0 {
 		return fmt.Errorf("Negative bytesPerShard: %v", bytesPerShard)
 	}
-	shards, e := generateShardBoundaries(bamPath, baiPath, bytesPerShard)
-	if e != nil {
-		return e
-	}
 	if e := pamutil.ValidateCoordRange(&opts.Range); e != nil {
 		return e
 	}
 	if !opts.Range.EQ(gbam.UniversalRange) {
 		return fmt.Errorf("WriteOpts.Range to ConvertFromBAM must be a universal range, but found %+v", opts)
 	}
+	if bamprovider.GuessFileType(bamPath) == bamprovider.PAM {
+		return convertPAMToPAM(opts, pamPath, bamPath, sinks)
+	}
+	shards, e := generateShardBoundaries(bamPath, baiPath, bytesPerShard)
+	if e != nil {
+		return e
+	}
 	vlog.Infof("%v: Creating %d shards: %+v", pamPath, len(shards), shards)
 	// Delete existing files to avoid mixing up files from multiple generations.
 	if e := pamutil.Remove(pamPath); e != nil {
@@ -187,6 +190,17 @@ func ConvertToPAM(opts pam.WriteOpts, pamPath, bamPath, baiPath string, bytesPer
 
 	var totalRecs int64
 	bam := bamprovider.BAMProvider{Path: bamPath, Index: baiPath}
+	header, e := bam.GetHeader()
+	if e != nil {
+		return e
+	}
+	reporter := progress.Start("bam2pam", len(shards), time.Minute, sinks...)
+	getRef := func(id int32) *sam.Reference {
+		if id == biopb.UnmappedRefID {
+			return nil
+		}
+		return header.Refs()[id]
+	}
 	err := traverse.Each(len(shards), func(i int) error {
 		shard := shards[i]
 		nextShard := bamShardBound{
@@ -196,28 +210,148 @@ func ConvertToPAM(opts pam.WriteOpts, pamPath, bamPath, baiPath string, bytesPer
 		if i < len(shards)-1 {
 			nextShard = shards[i+1]
 		}
-		nRecs, err := convertShard(opts, pamPath, &bam, shard, nextShard)
+		coordRange := biopb.CoordRange{Start: shard.rec, Limit: nextShard.rec}
+		start := time.Now()
+		nRecs, err := convertShard(opts, pamPath, &bam, gbam.Shard{
+			StartRef: getRef(shard.rec.RefId),
+			Start:    int(shard.rec.Pos),
+			EndRef:   getRef(nextShard.rec.RefId),
+			End:      int(nextShard.rec.Pos),
+		}, coordRange)
 		atomic.AddInt64(&totalRecs, nRecs)
+		reporter.ShardDone(pamutil.CoordRangePathString(coordRange), nRecs, 0, time.Since(start))
+		reporter.TaskDone()
 		return err
 	})
 	if e := bam.Close(); e != nil && err == nil {
 		err = e
 	}
+	reporter.Stop(err)
 	vlog.Infof("%v: Finished converting, written %d records, error %v", pamPath, totalRecs, err)
 	return err
 }
 
+// convertPAMToPAM copies a PAM file shard by shard, e.g. to drop fields.  The
+// progress is reported to sinks.
+func convertPAMToPAM(opts pam.WriteOpts, pamPath, srcPath string, sinks []progress.Sink) error {
+	if pamPath == srcPath {
+		return fmt.Errorf("%v: cannot convert a PAM file to itself", pamPath)
+	}
+	// There is no need to read the fields that will be dropped.
+	src := &bamprovider.PAMProvider{Path: srcPath, Opts: pam.ReadOpts{DropFields: opts.DropFields}}
+	shards, e := src.GetFileShards()
+	if e != nil {
+		src.Close() // nolint: errcheck
+		return e
+	}
+	vlog.Infof("%v: Creating %d shards: %+v", pamPath, len(shards), shards)
+	if e := pamutil.Remove(pamPath); e != nil {
+		src.Close() // nolint: errcheck
+		return e
+	}
+	var totalRecs int64
+	reporter := progress.Start("pam2pam", len(shards), time.Minute, sinks...)
+	err := traverse.Each(len(shards), func(i int) error {
+		coordRange := gbam.ShardToCoordRange(shards[i])
+		start := time.Now()
+		nRecs, err := convertShard(opts, pamPath, src, shards[i], coordRange)
+		atomic.AddInt64(&totalRecs, nRecs)
+		reporter.ShardDone(pamutil.CoordRangePathString(coordRange), nRecs, 0, time.Since(start))
+		reporter.TaskDone()
+		return err
+	})
+	if e := src.Close(); e != nil && err == nil {
+		err = e
+	}
+	reporter.Stop(err)
+	vlog.Infof("%v: Finished converting, written %d records, error %v", pamPath, totalRecs, err)
+	return err
+}
+
+// BAMWriteOpts configures ConvertToBAMWithOpts.
+type BAMWriteOpts struct {
+	// DropFields lists the fields to clear in the output. BAM has no way to
+	// leave a field out, so they are replaced with the SAM "unavailable"
+	// values, e.g. '*' for the name and 0xff for qualities. FieldCoord,
+	// FieldFlags and FieldCigar cannot be dropped.
+	DropFields []gbam.FieldType
+	// Progress, if non-empty, receives progress events (pipeline "pam2bam"):
+	// one per batch of records converted, and a final one.
+	Progress []progress.Sink
+}
+
+// fieldMask[f] is true iff field f is dropped.
+type fieldMask [gbam.NumFields]bool
+
+func newBAMFieldMask(dropFields []gbam.FieldType) (mask fieldMask, err error) {
+	for _, f := range dropFields {
+		switch f {
+		case gbam.FieldCoord, gbam.FieldFlags, gbam.FieldCigar:
+			return mask, fmt.Errorf("field %v cannot be dropped from BAM output", f)
+		}
+		if int(f) >= gbam.NumFields {
+			return mask, fmt.Errorf("invalid field %v", f)
+		}
+		mask[f] = true
+	}
+	return mask, nil
+}
+
+// apply clears the dropped fields of r.
+func (mask *fieldMask) apply(r *sam.Record) {
+	if mask[gbam.FieldMapq] {
+		r.MapQ = 255
+	}
+	if mask[gbam.FieldMateRefID] {
+		r.MateRef = nil
+	}
+	if mask[gbam.FieldMatePos] {
+		r.MatePos = -1
+	}
+	if mask[gbam.FieldTempLen] {
+		r.TempLen = 0
+	}
+	if mask[gbam.FieldName] {
+		r.Name = "*"
+	}
+	if mask[gbam.FieldSeq] {
+		// BAM requires the qualities to be absent too.
+		r.Seq = sam.Seq{}
+		r.Qual = nil
+	} else if mask[gbam.FieldQual] {
+		if len(r.Qual) != r.Seq.Length {
+			r.Qual = make([]byte, r.Seq.Length)
+		}
+		for i := range r.Qual {
+			r.Qual[i] = 0xff
+		}
+	}
+	if mask[gbam.FieldAux] {
+		r.AuxFields = nil
+	}
+}
+
 type convertRequest struct {
 	shardIdx int
 	records  []*sam.Record
+	start    time.Time // when the first record of the batch was read
 }
 
 // ConvertToBAM copies "provider" to a BAM file. Existing contents of "bamPath",
 // if any, are destroyed.
 func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
+	return ConvertToBAMWithOpts(BAMWriteOpts{}, bamPath, provider)
+}
+
+// ConvertToBAMWithOpts is ConvertToBAM, with options.
+func ConvertToBAMWithOpts(opts BAMWriteOpts, bamPath string, provider bamprovider.Provider) error {
 	const recordsPerShard = 128 << 10
 	parallelism := runtime.NumCPU()
 
+	mask, e := newBAMFieldMask(opts.DropFields)
+	if e != nil {
+		return fmt.Errorf("%v: %v", bamPath, e)
+	}
 	ctx := vcontext.Background()
 	header, e := provider.GetHeader()
 	if e != nil {
@@ -235,6 +369,8 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 	wg := sync.WaitGroup{}
 	reqCh := make(chan convertRequest, parallelism)
 	var err errors.Once
+	// The number of batches isn't known in advance.
+	reporter := progress.Start("pam2bam", 0, time.Minute, opts.Progress...)
 	vlog.Infof("Creating %d threads", parallelism)
 	for wi := 0; wi < parallelism; wi++ {
 		wg.Add(1)
@@ -246,10 +382,12 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 					break
 				}
 				for _, r := range req.records {
+					mask.apply(r)
 					c.AddRecord(r)
 					sam.PutInFreePool(r)
 				}
 				err.Set(c.CloseShard())
+				reporter.ShardDone(fmt.Sprintf("batch %d", req.shardIdx), int64(len(req.records)), 0, time.Since(req.start))
 			}
 			wg.Done()
 		}()
@@ -259,6 +397,7 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 	req := convertRequest{
 		records:  make([]*sam.Record, 0, recordsPerShard),
 		shardIdx: 0,
+		start:    time.Now(),
 	}
 	for iter.Scan() {
 		req.records = append(req.records, iter.Record())
@@ -266,6 +405,7 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 			reqCh <- req
 			req.records = make([]*sam.Record, 0, recordsPerShard)
 			req.shardIdx++
+			req.start = time.Now()
 		}
 	}
 	if len(req.records) > 0 {
@@ -277,5 +417,6 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 	wg.Wait()
 	err.Set(w.Close())
 	err.Set(out.Close(ctx))
+	reporter.Stop(err.Err())
 	return err.Err()
 }
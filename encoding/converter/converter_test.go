@@ -45,6 +45,27 @@ func TestBAM(t *testing.T) {
 	verifyFiles(t, pamPath, bam2Path)
 }
 
+func TestPAMDropFields(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	pamPath := filepath.Join(tempDir, "test.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", math.MaxInt64))
+
+	dropFields := []gbam.FieldType{gbam.FieldQual, gbam.FieldAux}
+	slimPath := filepath.Join(tempDir, "slim.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{DropFields: dropFields}, slimPath, pamPath, "", math.MaxInt64))
+	verifyFiles(t, pamPath, slimPath, bamprovider.ProviderOpts{DropFields: dropFields})
+
+	assert.NotNil(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, pamPath, "", math.MaxInt64))
+	p := bamprovider.NewProvider(pamPath)
+	assert.NotNil(t, converter.ConvertToBAMWithOpts(
+		converter.BAMWriteOpts{DropFields: []gbam.FieldType{gbam.FieldCigar}},
+		filepath.Join(tempDir, "test.bam"), p))
+	assert.NoError(t, p.Close())
+}
+
 func hasSamtools(t *testing.T, sh *gosh.Shell) bool {
 	if _, err := lookpath.Look(sh.Vars, "samtools"); err != nil {
 		t.Skipf("samtools not found on the machine. Skipping the test")
@@ -64,12 +85,12 @@ func convertToBAM(t *testing.T, sh *gosh.Shell, srcPath, destPath string) {
 }
 
 // verifyFiles verifes that files path0 and path1 store the same records in the
-// same order.
-func verifyFiles(t *testing.T, path0, path1 string) {
-	p0 := bamprovider.NewProvider(path0)
+// same order. opts, if any, are used to open both files.
+func verifyFiles(t *testing.T, path0, path1 string, opts ...bamprovider.ProviderOpts) {
+	p0 := bamprovider.NewProvider(path0, opts...)
 	header0, err := p0.GetHeader()
 	assert.NoError(t, err)
-	p1 := bamprovider.NewProvider(path1)
+	p1 := bamprovider.NewProvider(path1, opts...)
 	header1, err := p0.GetHeader()
 	assert.NoError(t, err)
 
@@ -0,0 +1,120 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// Block compression methods.
+const (
+	methodRaw      = 0
+	methodGzip     = 1
+	methodBzip2    = 2
+	methodLZMA     = 3
+	methodRANS4x8  = 4
+	methodRANSNx16 = 5
+	methodArith    = 6
+	methodFQZComp  = 7
+	methodTok3     = 8
+)
+
+// Block content types.
+const (
+	contentFileHeader        = 0
+	contentCompressionHeader = 1
+	contentSliceHeader       = 2
+	contentExternal          = 4
+	contentCore              = 5
+)
+
+// block is a decompressed CRAM block.
+type block struct {
+	contentType byte
+	contentID   int32
+	data        []byte
+}
+
+// readBlock reads and decompresses the next block from r.  If hasCRC is set
+// (CRAM 3.x), the trailing CRC32 is verified.
+func readBlock(r *byteReader, hasCRC bool) (*block, error) {
+	start := r.off
+	method := r.byte()
+	b := &block{contentType: r.byte()}
+	b.contentID = r.itf8()
+	size := r.itf8()
+	rawSize := r.itf8()
+	comp := r.bytes(int(size))
+	if hasCRC {
+		end := r.off
+		if crc := r.uint32(); r.err == nil && crc != crc32.ChecksumIEEE(r.b[start:end]) {
+			return nil, fmt.Errorf("cram: block CRC mismatch")
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	var err error
+	if b.data, err = decompress(method, comp); err != nil {
+		return nil, err
+	}
+	if len(b.data) != int(rawSize) {
+		return nil, fmt.Errorf("cram: block decompressed to %d bytes, expected %d", len(b.data), rawSize)
+	}
+	return b, nil
+}
+
+func decompress(method byte, data []byte) ([]byte, error) {
+	switch method {
+	case methodRaw:
+		return data, nil
+	case methodGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(zr)
+	case methodBzip2:
+		return ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	case methodRANS4x8:
+		return ransDecode(data)
+	case methodLZMA:
+		return nil, fmt.Errorf("cram: lzma block compression is not supported")
+	case methodRANSNx16, methodArith, methodFQZComp, methodTok3:
+		return nil, fmt.Errorf("cram: CRAM 3.1 block compression method %d is not supported", method)
+	}
+	return nil, fmt.Errorf("cram: unknown block compression method %d", method)
+}
+
+// parseFileHeader extracts the SAM header text from a file header block.
+func parseFileHeader(b *block) ([]byte, error) {
+	if b.contentType != contentFileHeader {
+		return nil, fmt.Errorf("cram: expected file header block, found content type %d", b.contentType)
+	}
+	if len(b.data) < 4 {
+		return nil, errTruncated
+	}
+	n := binary.LittleEndian.Uint32(b.data)
+	if int64(n) > int64(len(b.data)-4) {
+		return nil, errTruncated
+	}
+	return b.data[4 : 4+n], nil
+}
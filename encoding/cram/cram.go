@@ -0,0 +1,261 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cram reads CRAM files (https://samtools.github.io/hts-specs/CRAMv3.pdf)
+// as sam.Records.
+//
+// Versions 2.1 and 3.0 are supported, along with 3.1 files that only use the
+// 3.0 block compression methods.  The lzma block compression method is not
+// supported, since it would need a non-standard dependency; files written by
+// samtools and htslib with default options don't use it.
+//
+// Records are reconstructed against a Reference, which can be backed by a
+// FASTA file (NewFASTAReference) or fetch sequences by MD5 from a reference
+// registry such as ENA's (MD5Reference).  Reads are returned in file order;
+// use ReadIndex and Reader.Seek to start reading at a genomic position.
+// NM and MD tags are not regenerated.
+package cram
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// eofStart is the alignment start of the EOF container.
+const eofStart = 4542278
+
+// containerHeader is the header of a container.
+type containerHeader struct {
+	length    int32
+	refID     int32
+	start     int32
+	span      int32
+	nRecords  int32
+	nBlocks   int32
+	landmarks []int32
+}
+
+// Reader reads sam.Records from a CRAM file.  It is not safe for concurrent
+// use.
+type Reader struct {
+	r      io.Reader
+	br     *bufio.Reader
+	ref    Reference
+	major  byte
+	header *sam.Header
+
+	// recs[next:] are the decoded records not yet returned by Read.
+	recs []*sam.Record
+	next int
+}
+
+// NewReader reads the file definition and SAM header of a CRAM file.  ref
+// supplies the reference bases; it may be nil if the file doesn't need them
+// (e.g. it only has unmapped reads or embedded references).
+func NewReader(r io.Reader, ref Reference) (*Reader, error) {
+	rd := &Reader{r: r, br: bufio.NewReader(r), ref: ref}
+	var def [26]byte
+	if _, err := io.ReadFull(rd.br, def[:]); err != nil {
+		return nil, fmt.Errorf("cram.NewReader: reading file definition: %v", err)
+	}
+	if string(def[:4]) != "CRAM" {
+		return nil, fmt.Errorf("cram.NewReader: not a CRAM file")
+	}
+	rd.major = def[4]
+	if rd.major != 2 && rd.major != 3 {
+		return nil, fmt.Errorf("cram.NewReader: unsupported CRAM version %d.%d", def[4], def[5])
+	}
+	_, data, err := rd.readContainer()
+	if err != nil {
+		return nil, fmt.Errorf("cram.NewReader: reading header container: %v", err)
+	}
+	b, err := readBlock(&byteReader{b: data}, rd.hasCRC())
+	if err != nil {
+		return nil, fmt.Errorf("cram.NewReader: %v", err)
+	}
+	text, err := parseFileHeader(b)
+	if err != nil {
+		return nil, fmt.Errorf("cram.NewReader: %v", err)
+	}
+	if rd.header, err = sam.NewHeader(text, nil); err != nil {
+		return nil, fmt.Errorf("cram.NewReader: parsing SAM header: %v", err)
+	}
+	return rd, nil
+}
+
+// Header returns the SAM header.
+func (r *Reader) Header() *sam.Header { return r.header }
+
+func (r *Reader) hasCRC() bool { return r.major >= 3 }
+
+// readContainer reads the next container's header and data.  It returns
+// io.EOF at the end of the file.
+func (r *Reader) readContainer() (*containerHeader, []byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r.br, lenBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTruncated
+		}
+		return nil, nil, err
+	}
+	var err error
+	itf8 := func() int32 {
+		if err != nil {
+			return 0
+		}
+		var v int32
+		v, err = readITF8(r.br)
+		return v
+	}
+	ltf8 := func() int64 {
+		if err != nil {
+			return 0
+		}
+		var v int64
+		v, err = readLTF8(r.br)
+		return v
+	}
+	h := &containerHeader{length: int32(binary.LittleEndian.Uint32(lenBuf[:]))}
+	h.refID = itf8()
+	h.start = itf8()
+	h.span = itf8()
+	h.nRecords = itf8()
+	ltf8() // record counter
+	ltf8() // bases
+	h.nBlocks = itf8()
+	nLandmarks := itf8()
+	for i := int32(0); i < nLandmarks && err == nil; i++ {
+		h.landmarks = append(h.landmarks, itf8())
+	}
+	if err == nil && r.hasCRC() {
+		_, err = io.ReadFull(r.br, lenBuf[:])
+	}
+	if err == nil && h.length < 0 {
+		err = fmt.Errorf("cram: negative container length %d", h.length)
+	}
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTruncated
+		}
+		return nil, nil, err
+	}
+	data := make([]byte, h.length)
+	if _, err := io.ReadFull(r.br, data); err != nil {
+		return nil, nil, errTruncated
+	}
+	return h, data, nil
+}
+
+// readRecords decodes the records of the next container that has any into
+// r.recs.
+func (r *Reader) readRecords() error {
+	for {
+		h, data, err := r.readContainer()
+		if err != nil {
+			return err
+		}
+		if h.nRecords == 0 {
+			if h.refID == refIDUnmapped && h.start == eofStart {
+				return io.EOF
+			}
+			continue
+		}
+		br := &byteReader{b: data}
+		b, err := readBlock(br, r.hasCRC())
+		if err != nil {
+			return err
+		}
+		ch, err := parseCompressionHeader(b)
+		if err != nil {
+			return err
+		}
+		r.recs, r.next = r.recs[:0], 0
+		for _, landmark := range h.landmarks {
+			if landmark < 0 || int(landmark) >= len(data) {
+				return fmt.Errorf("cram: slice offset %d out of range", landmark)
+			}
+			br.off = int(landmark)
+			recs, err := r.readSlice(br, ch)
+			if err != nil {
+				return err
+			}
+			r.recs = append(r.recs, recs...)
+		}
+		if len(r.recs) > 0 {
+			return nil
+		}
+	}
+}
+
+func (r *Reader) readSlice(br *byteReader, ch *compressionHeader) ([]*sam.Record, error) {
+	b, err := readBlock(br, r.hasCRC())
+	if err != nil {
+		return nil, err
+	}
+	sh, err := parseSliceHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	d := &sliceDecoder{ch: ch, sh: sh, header: r.header, ref: r.ref}
+	d.external = map[int32]*byteReader{}
+	for i := int32(0); i < sh.nBlocks; i++ {
+		if b, err = readBlock(br, r.hasCRC()); err != nil {
+			return nil, err
+		}
+		switch b.contentType {
+		case contentCore:
+			d.core = bitReader{b: b.data}
+		case contentExternal:
+			d.external[b.contentID] = &byteReader{b: b.data}
+		}
+	}
+	return d.decode()
+}
+
+// Read returns the next record, or io.EOF at the end of the file.  The caller
+// may return the record to the pool with sam.PutInFreePool.
+func (r *Reader) Read() (*sam.Record, error) {
+	for r.next >= len(r.recs) {
+		if err := r.readRecords(); err != nil {
+			return nil, err
+		}
+	}
+	rec := r.recs[r.next]
+	r.recs[r.next] = nil
+	r.next++
+	return rec, nil
+}
+
+// Seek positions the reader at the container that starts at file offset off,
+// usually IndexEntry.ContainerOffset.  The underlying reader must implement
+// io.Seeker.
+func (r *Reader) Seek(off int64) error {
+	s, ok := r.r.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("cram.Reader.Seek: underlying reader is not seekable")
+	}
+	for _, rec := range r.recs[r.next:] {
+		sam.PutInFreePool(rec)
+	}
+	r.recs, r.next = r.recs[:0], 0
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	r.br.Reset(r.r)
+	return nil
+}
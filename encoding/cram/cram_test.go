@@ -0,0 +1,537 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendITF8(b []byte, v int32) []byte {
+	u := uint32(v)
+	switch {
+	case u < 1<<7:
+		return append(b, byte(u))
+	case u < 1<<14:
+		return append(b, byte(u>>8)|0x80, byte(u))
+	case u < 1<<21:
+		return append(b, byte(u>>16)|0xc0, byte(u>>8), byte(u))
+	case u < 1<<28:
+		return append(b, byte(u>>24)|0xe0, byte(u>>16), byte(u>>8), byte(u))
+	}
+	return append(b, byte(u>>28)|0xf0, byte(u>>20), byte(u>>12), byte(u>>4), byte(u&0xf))
+}
+
+func appendLTF8(b []byte, v int64) []byte {
+	u := uint64(v)
+	n := 0 // number of extra bytes
+	for n < 8 && u >= 1<<uint(7*(n+1)) {
+		n++
+	}
+	if n == 8 {
+		b = append(b, 0xff)
+	} else {
+		b = append(b, byte(0xff<<uint(8-n))|byte(u>>uint(8*n)))
+	}
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(u>>uint(8*i)))
+	}
+	return b
+}
+
+func TestITF8(t *testing.T) {
+	for _, v := range []int32{0, 1, 127, 128, 16383, 16384, 1<<21 - 1, 1 << 21, 1<<28 - 1, 1 << 28, 1<<31 - 1, -1, -4542278} {
+		r := &byteReader{b: appendITF8(nil, v)}
+		assert.Equal(t, v, r.itf8(), "%d", v)
+		assert.NoError(t, r.err)
+		assert.Equal(t, len(r.b), r.off)
+	}
+	for _, v := range []int64{0, 127, 128, 1<<35 + 5, 1<<56 - 1, 1 << 56, 1<<63 - 1, -1} {
+		r := &byteReader{b: appendLTF8(nil, v)}
+		assert.Equal(t, v, r.ltf8(), "%d", v)
+		assert.NoError(t, r.err)
+		assert.Equal(t, len(r.b), r.off)
+	}
+	r := &byteReader{b: []byte{0xc0, 0x01}}
+	r.itf8()
+	assert.Equal(t, errTruncated, r.err)
+}
+
+// ransEncode0 is a straightforward order-0 rANS 4x8 encoder, for testing.
+func ransEncode0(in []byte) []byte {
+	var counts [256]int
+	for _, c := range in {
+		counts[c]++
+	}
+	// Normalize the frequencies to sum to ransTotFreq, keeping every present
+	// symbol nonzero.
+	var freqs [256]uint32
+	total, maxSym := uint32(0), 0
+	for c, n := range counts {
+		if n > 0 {
+			freqs[c] = uint32(n * (ransTotFreq - 256) / len(in))
+			if freqs[c] == 0 {
+				freqs[c] = 1
+			}
+			total += freqs[c]
+			if freqs[c] > freqs[maxSym] {
+				maxSym = c
+			}
+		}
+	}
+	freqs[maxSym] += ransTotFreq - total
+	var starts [256]uint32
+	for c, x := 0, uint32(0); c < 256; c++ {
+		starts[c] = x
+		x += freqs[c]
+	}
+
+	var table []byte
+	rle := 0
+	for c := 0; c < 256; c++ {
+		if freqs[c] == 0 {
+			continue
+		}
+		if rle > 0 {
+			rle--
+		} else {
+			table = append(table, byte(c))
+			if c > 0 && freqs[c-1] != 0 {
+				for rle = c + 1; rle < 256 && freqs[rle] != 0; rle++ {
+				}
+				rle -= c + 1
+				table = append(table, byte(rle))
+			}
+		}
+		if f := freqs[c]; f < 128 {
+			table = append(table, byte(f))
+		} else {
+			table = append(table, byte(128|f>>8), byte(f))
+		}
+	}
+	table = append(table, 0)
+
+	// Encode backwards; out is built in reverse.
+	var out []byte
+	var R [4]uint32
+	for i := range R {
+		R[i] = ransLowBound
+	}
+	put := func(j int, c byte) {
+		f := freqs[c]
+		xMax := ((ransLowBound >> ransTFShift) << 8) * f
+		for R[j] >= xMax {
+			out = append(out, byte(R[j]))
+			R[j] >>= 8
+		}
+		R[j] = (R[j]/f)<<ransTFShift + R[j]%f + starts[c]
+	}
+	n := len(in)
+	for j := n&3 - 1; j >= 0; j-- {
+		put(j, in[n&^3+j])
+	}
+	for i := n &^ 3; i > 0; i -= 4 {
+		for j := 3; j >= 0; j-- {
+			put(j, in[i-4+j])
+		}
+	}
+	for j := 3; j >= 0; j-- {
+		out = append(out, byte(R[j]>>24), byte(R[j]>>16), byte(R[j]>>8), byte(R[j]))
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	body := append(table, out...)
+	hdr := make([]byte, 9)
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(hdr[5:], uint32(len(in)))
+	return append(hdr, body...)
+}
+
+func TestRANS(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 100, 10001} {
+		in := make([]byte, n)
+		for i := range in {
+			// Consecutive symbols exercise the run-length coding of the
+			// frequency table.
+			in[i] = "ABCDABCAAAZ"[r.Intn(11)]
+		}
+		out, err := ransDecode(ransEncode0(in))
+		require.NoError(t, err, "n=%d", n)
+		assert.Equal(t, string(in), string(out), "n=%d", n)
+	}
+	_, err := ransDecode([]byte{0, 1, 0, 0, 0, 4, 0, 0})
+	assert.Error(t, err)
+}
+
+func TestCodecs(t *testing.T) {
+	s := &sliceData{}
+	// Canonical codes: 1 -> 0, 2 -> 10, 3 -> 11.
+	h, err := newHuffman([]int32{3, 1, 2}, []int32{2, 1, 2})
+	require.NoError(t, err)
+	s.core = bitReader{b: []byte{0x5c}} // 0 10 11 100
+	c := &codec{id: encHuffman, huff: h}
+	assert.Equal(t, []int32{1, 2, 3}, []int32{c.readInt(s), c.readInt(s), c.readInt(s)})
+
+	// Gamma: 1 = "1", 4 = "00100".
+	s.core = bitReader{b: []byte{0x90}}
+	c = &codec{id: encGamma, offset: 0}
+	assert.Equal(t, []int32{1, 4}, []int32{c.readInt(s), c.readInt(s)})
+
+	// Subexp with k=2: 3 = "0 11", 6 = "10 10" (one 1 bit, then 2 bits + 4).
+	s.core = bitReader{b: []byte{0x74}}
+	c = &codec{id: encSubexp, param: 2, offset: 0}
+	assert.Equal(t, []int32{3, 6}, []int32{c.readInt(s), c.readInt(s)})
+
+	s.core = bitReader{b: []byte{0xff}}
+	c = &codec{id: encBeta, param: 4, offset: 3}
+	assert.Equal(t, int32(12), c.readInt(s))
+	assert.NoError(t, s.err)
+	c.readInt(s)
+	c.readInt(s)
+	assert.Equal(t, errTruncated, s.err)
+}
+
+// testWriter builds a CRAM 3.0 file in memory.  Every data series is stored in
+// its own external block.
+type testWriter struct {
+	buf bytes.Buffer
+}
+
+func testBlock(method, contentType byte, contentID int32, data []byte) []byte {
+	comp := data
+	switch method {
+	case methodGzip:
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		zw.Write(data) // nolint: errcheck
+		zw.Close()     // nolint: errcheck
+		comp = zb.Bytes()
+	case methodRANS4x8:
+		comp = ransEncode0(data)
+	}
+	b := []byte{method, contentType}
+	b = appendITF8(b, contentID)
+	b = appendITF8(b, int32(len(comp)))
+	b = appendITF8(b, int32(len(data)))
+	b = append(b, comp...)
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(b))
+	return append(b, crc[:]...)
+}
+
+func (w *testWriter) container(refID, start, span, nRecords int32, landmarks []int32, nBlocks int32, data []byte) {
+	var h []byte
+	h = appendITF8(h, refID)
+	h = appendITF8(h, start)
+	h = appendITF8(h, span)
+	h = appendITF8(h, nRecords)
+	h = appendLTF8(h, 0)
+	h = appendLTF8(h, 0)
+	h = appendITF8(h, nBlocks)
+	h = appendITF8(h, int32(len(landmarks)))
+	for _, l := range landmarks {
+		h = appendITF8(h, l)
+	}
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(data)))
+	w.buf.Write(n[:])
+	w.buf.Write(h)
+	w.buf.Write([]byte{0, 0, 0, 0}) // CRC; not checked
+	w.buf.Write(data)
+}
+
+type testRef string
+
+func (r testRef) Get(ref *sam.Reference, start, end int) ([]byte, error) {
+	if end > len(r) {
+		end = len(r)
+	}
+	return []byte(r[start:end]), nil
+}
+
+const testRefSeq = "ACGTACGTACGTACGTACGT"
+
+// testCRAM returns a CRAM file with a paired read and an unmapped read.
+func testCRAM(t *testing.T) []byte {
+	w := &testWriter{}
+	w.buf.WriteString("CRAM\x03\x00")
+	w.buf.Write(make([]byte, 20))
+	text := "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:20\n@RG\tID:grp1\tSM:s\n"
+	hdr := make([]byte, 4, 4+len(text))
+	binary.LittleEndian.PutUint32(hdr, uint32(len(text)))
+	hdr = append(hdr, text...)
+	w.container(0, 0, 0, 0, nil, 1, testBlock(methodRaw, contentFileHeader, 0, hdr))
+
+	// Compression header.
+	var pm []byte
+	pm = appendITF8(pm, 5)
+	pm = append(pm, "RN\x01AP\x01RR\x01SM"...)
+	pm = append(pm, 0x1b, 0x1b, 0x1b, 0x1b, 0x1b) // code k -> k'th other base
+	td := []byte("\x00XSZ\x00")
+	pm = append(pm, "TD"...)
+	pm = appendITF8(pm, int32(len(td)))
+	pm = append(pm, td...)
+
+	contentID := func(ds int) int32 { return int32(ds + 1) }
+	var dsm []byte
+	nSeries := 0
+	for ds, name := range dataSeriesNames {
+		var params []byte
+		var id int32
+		switch ds {
+		case dsMQ:
+			id = encBeta
+			params = appendITF8(appendITF8(nil, 0), 8)
+		case dsRN, dsIN, dsSC, dsBB, dsQQ:
+			id = encByteArrayStop
+			params = appendITF8([]byte{0}, contentID(ds))
+		default:
+			id = encExternal
+			params = appendITF8(nil, contentID(ds))
+		}
+		dsm = append(dsm, name...)
+		dsm = appendITF8(dsm, id)
+		dsm = appendITF8(dsm, int32(len(params)))
+		dsm = append(dsm, params...)
+		nSeries++
+	}
+	dsm = append(appendITF8(nil, int32(nSeries)), dsm...)
+
+	var tm []byte
+	tm = appendITF8(tm, 1)
+	tm = appendITF8(tm, 'X'<<16|'S'<<8|'Z')
+	var lenParams, valParams []byte
+	lenParams = appendITF8(appendITF8(appendITF8(nil, encExternal), 1), 100)
+	valParams = appendITF8(appendITF8(appendITF8(nil, encExternal), 1), 101)
+	tm = appendITF8(tm, encByteArrayLen)
+	tm = appendITF8(tm, int32(len(lenParams)+len(valParams)))
+	tm = append(append(tm, lenParams...), valParams...)
+
+	var ch []byte
+	for _, m := range [][]byte{pm, dsm, tm} {
+		ch = appendITF8(ch, int32(len(m)))
+		ch = append(ch, m...)
+	}
+
+	// Records.
+	blocks := map[int32][]byte{}
+	putInt := func(ds int, v int32) { blocks[contentID(ds)] = appendITF8(blocks[contentID(ds)], v) }
+	putBytes := func(ds int, v string) { blocks[contentID(ds)] = append(blocks[contentID(ds)], v...) }
+	putArray := func(ds int, v string) { putBytes(ds, v+"\x00") }
+	var core []byte
+
+	// r0: 3M2D1M2I at 1-based position 2, with a substitution at read
+	// position 3 (ref T -> code 0 -> A).
+	putInt(dsBF, int32(sam.Paired|sam.Read1))
+	putInt(dsCF, cfQualArray|cfMateDownstream)
+	putInt(dsRL, 6)
+	putInt(dsAP, 1)
+	putInt(dsRG, -1)
+	putArray(dsRN, "r0")
+	putInt(dsNF, 0)
+	putInt(dsTL, 1)
+	blocks[100] = appendITF8(blocks[100], 3)
+	blocks[101] = append(blocks[101], "hi\x00"...)
+	putInt(dsFN, 3)
+	putBytes(dsFC, "X")
+	putInt(dsFP, 3)
+	putBytes(dsBS, "\x00")
+	putBytes(dsFC, "D")
+	putInt(dsFP, 1)
+	putInt(dsDL, 2)
+	putBytes(dsFC, "I")
+	putInt(dsFP, 1)
+	putArray(dsIN, "GG")
+	core = append(core, 60)
+	putBytes(dsQS, "\x1e\x1f\x20\x21\x22\x23")
+
+	// r1: 2S2M at 1-based position 10, reverse strand.
+	putInt(dsBF, int32(sam.Paired|sam.Read2|sam.Reverse))
+	putInt(dsCF, cfQualArray)
+	putInt(dsRL, 4)
+	putInt(dsAP, 8)
+	putInt(dsRG, -1)
+	putArray(dsRN, "r0")
+	putInt(dsTL, 0)
+	putInt(dsFN, 1)
+	putBytes(dsFC, "S")
+	putInt(dsFP, 1)
+	putArray(dsSC, "TT")
+	core = append(core, 50)
+	putBytes(dsQS, "\x14\x14\x14\x14")
+
+	// u1: unmapped, with an unmapped mate stored explicitly.
+	putInt(dsBF, int32(sam.Unmapped))
+	putInt(dsCF, cfQualArray|cfDetached)
+	putInt(dsRL, 3)
+	putInt(dsAP, 0)
+	putInt(dsRG, 0)
+	putArray(dsRN, "u1")
+	putInt(dsMF, mfMateUnmapped)
+	putInt(dsNS, -1)
+	putInt(dsNP, 0)
+	putInt(dsTS, 0)
+	putInt(dsTL, 0)
+	putBytes(dsBA, "NAC")
+	putBytes(dsQS, "\x02\x02\x02")
+
+	var ids []int32
+	for id := int32(0); id < 200; id++ {
+		if blocks[id] != nil {
+			ids = append(ids, id)
+		}
+	}
+	var sh []byte
+	sh = appendITF8(sh, 0)  // ref ID
+	sh = appendITF8(sh, 1)  // start
+	sh = appendITF8(sh, 11) // span
+	sh = appendITF8(sh, 3)  // records
+	sh = appendLTF8(sh, 0)
+	sh = appendITF8(sh, int32(len(ids)+1))
+	sh = appendITF8(sh, int32(len(ids)+1))
+	sh = appendITF8(sh, 0)
+	for _, id := range ids {
+		sh = appendITF8(sh, id)
+	}
+	sh = appendITF8(sh, -1) // no embedded reference
+	sh = append(sh, make([]byte, 16)...)
+	sh = appendITF8(sh, 0) // no tags
+
+	chBlock := testBlock(methodRaw, contentCompressionHeader, 0, ch)
+	data := append([]byte(nil), chBlock...)
+	data = append(data, testBlock(methodRaw, contentSliceHeader, 0, sh)...)
+	data = append(data, testBlock(methodGzip, contentCore, 0, core)...)
+	for _, id := range ids {
+		method := byte(methodRaw)
+		if id == contentID(dsRN) {
+			method = methodRANS4x8
+		}
+		data = append(data, testBlock(method, contentExternal, id, blocks[id])...)
+	}
+	w.container(0, 1, 11, 3, []int32{int32(len(chBlock))}, int32(len(ids)+3), data)
+
+	w.container(-1, eofStart, 0, 0, nil, 1, testBlock(methodRaw, contentCompressionHeader, 0, []byte{0, 0, 0}))
+	return w.buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	data := testCRAM(t)
+	r, err := NewReader(bytes.NewReader(data), testRef(testRefSeq))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(r.Header().Refs()))
+	chr1 := r.Header().Refs()[0]
+	assert.Equal(t, "chr1", chr1.Name())
+
+	var recs []*sam.Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		recs = append(recs, rec)
+	}
+	require.Equal(t, 3, len(recs))
+
+	r0, r1, u1 := recs[0], recs[1], recs[2]
+	assert.Equal(t, "r0", r0.Name)
+	assert.Equal(t, chr1, r0.Ref)
+	assert.Equal(t, 1, r0.Pos)
+	assert.Equal(t, "3M2D1M2I", r0.Cigar.String())
+	assert.Equal(t, "CGAGGG", string(r0.Seq.Expand()))
+	assert.Equal(t, []byte{30, 31, 32, 33, 34, 35}, r0.Qual)
+	assert.Equal(t, byte(60), r0.MapQ)
+	assert.Equal(t, sam.Paired|sam.Read1|sam.MateReverse, r0.Flags)
+	assert.Equal(t, chr1, r0.MateRef)
+	assert.Equal(t, 9, r0.MatePos)
+	assert.Equal(t, 10, r0.TempLen)
+	require.Equal(t, 1, len(r0.AuxFields))
+	assert.Equal(t, "XSZhi", string(r0.AuxFields[0]))
+
+	assert.Equal(t, "r0", r1.Name)
+	assert.Equal(t, 9, r1.Pos)
+	assert.Equal(t, "2S2M", r1.Cigar.String())
+	assert.Equal(t, "TTCG", string(r1.Seq.Expand()))
+	assert.Equal(t, byte(50), r1.MapQ)
+	assert.Equal(t, sam.Paired|sam.Read2|sam.Reverse, r1.Flags)
+	assert.Equal(t, 1, r1.MatePos)
+	assert.Equal(t, -10, r1.TempLen)
+
+	assert.Equal(t, "u1", u1.Name)
+	// Unmapped reads in a mapped slice are placed at their mate's position.
+	assert.Equal(t, chr1, u1.Ref)
+	assert.Equal(t, 9, u1.Pos)
+	assert.Equal(t, sam.Unmapped|sam.MateUnmapped, u1.Flags)
+	assert.Equal(t, "NAC", string(u1.Seq.Expand()))
+	assert.Equal(t, []byte{2, 2, 2}, u1.Qual)
+	assert.Equal(t, -1, u1.MatePos)
+	require.Equal(t, 1, len(u1.AuxFields))
+	assert.Equal(t, "RGZgrp1", string(u1.AuxFields[0]))
+
+	// Without a reference, mapped reads can't be decoded.
+	r, err = NewReader(bytes.NewReader(data), nil)
+	require.NoError(t, err)
+	_, err = r.Read()
+	assert.Error(t, err)
+
+	// Corrupting a block is detected by its CRC.
+	bad := append([]byte(nil), data...)
+	bad[len(bad)-40] ^= 1
+	r, err = NewReader(bytes.NewReader(bad), testRef(testRefSeq))
+	require.NoError(t, err)
+	_, err = r.Read()
+	assert.Error(t, err)
+}
+
+func TestIndex(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte("0\t1\t1000\t100\t50\t900\n0\t1001\t500\t1000\t50\t800\n1\t1\t300\t2000\t50\t700\n-1\t0\t0\t3000\t50\t600\n"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	idx, err := ReadIndex(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(idx.Entries))
+	assert.Equal(t, IndexEntry{RefID: 0, Start: 1001, Span: 500, ContainerOffset: 1000, SliceOffset: 50, SliceSize: 800}, idx.Entries[1])
+
+	for _, tt := range []struct {
+		refID, pos int
+		want       int64
+	}{
+		{0, 0, 100},
+		{0, 999, 100},
+		{0, 1000, 1000},
+		{0, 1500, 2000},
+		{1, 299, 2000},
+		{1, 300, 3000},
+		{5, 0, 3000},
+		{-1, 0, 3000},
+	} {
+		off, ok := idx.ContainerOffset(tt.refID, tt.pos)
+		assert.True(t, ok)
+		assert.Equal(t, tt.want, off, "%+v", tt)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Encoding (codec) IDs.
+const (
+	encNull          = 0
+	encExternal      = 1
+	encGolomb        = 2
+	encHuffman       = 3
+	encByteArrayLen  = 4
+	encByteArrayStop = 5
+	encBeta          = 6
+	encSubexp        = 7
+	encGolombRice    = 8
+	encGamma         = 9
+)
+
+// sliceData holds the blocks of a slice being decoded.  Errors are sticky.
+type sliceData struct {
+	core     bitReader
+	external map[int32]*byteReader
+	err      error
+}
+
+func (s *sliceData) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *sliceData) block(contentID int32) *byteReader {
+	if r := s.external[contentID]; r != nil {
+		return r
+	}
+	s.fail(fmt.Errorf("cram: missing external block %d", contentID))
+	return &byteReader{}
+}
+
+// bitReader reads bits, most significant first, from the core block.
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+}
+
+func (r *bitReader) bits(s *sliceData, n int) uint32 {
+	if r.pos+n > 8*len(r.b) {
+		s.fail(errTruncated)
+		return 0
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(r.b[r.pos>>3]>>(7-uint(r.pos&7))&1)
+		r.pos++
+	}
+	return v
+}
+
+// codec decodes one data series or tag.  Only the fields relevant to id are
+// set.
+type codec struct {
+	id int32
+	// EXTERNAL and BYTE_ARRAY_STOP.
+	contentID int32
+	// BYTE_ARRAY_STOP.
+	stop byte
+	// BETA, SUBEXP and GAMMA.
+	offset int32
+	// BETA: number of bits; SUBEXP: k.
+	param int32
+	// HUFFMAN.
+	huff *huffman
+	// BYTE_ARRAY_LEN.
+	lenCodec, valCodec *codec
+}
+
+// parseCodec parses an encoding ID and its parameters.
+func parseCodec(r *byteReader) (*codec, error) {
+	c := &codec{id: r.itf8()}
+	n := r.itf8()
+	p := &byteReader{b: r.bytes(int(n))}
+	if r.err != nil {
+		return nil, r.err
+	}
+	var err error
+	switch c.id {
+	case encNull:
+	case encExternal:
+		c.contentID = p.itf8()
+	case encHuffman:
+		c.huff, err = newHuffman(p.itf8Array(), p.itf8Array())
+	case encByteArrayLen:
+		if c.lenCodec, err = parseCodec(p); err == nil {
+			c.valCodec, err = parseCodec(p)
+		}
+	case encByteArrayStop:
+		c.stop = p.byte()
+		c.contentID = p.itf8()
+	case encBeta, encSubexp:
+		c.offset = p.itf8()
+		c.param = p.itf8()
+	case encGamma:
+		c.offset = p.itf8()
+	default:
+		return nil, fmt.Errorf("cram: unsupported encoding %d", c.id)
+	}
+	if err == nil {
+		err = p.err
+	}
+	return c, err
+}
+
+func (c *codec) readInt(s *sliceData) int32 {
+	switch c.id {
+	case encExternal:
+		b := s.block(c.contentID)
+		v := b.itf8()
+		if b.err != nil {
+			s.fail(b.err)
+		}
+		return v
+	case encHuffman:
+		return c.huff.decode(s)
+	case encBeta:
+		return int32(s.core.bits(s, int(c.param))) - c.offset
+	case encSubexp:
+		k := int(c.param)
+		i := 0
+		for s.err == nil && s.core.bits(s, 1) == 1 {
+			i++
+		}
+		if i == 0 {
+			return int32(s.core.bits(s, k)) - c.offset
+		}
+		b := i + k - 1
+		return int32(s.core.bits(s, b)+1<<uint(b)) - c.offset
+	case encGamma:
+		n := 0
+		for s.err == nil && s.core.bits(s, 1) == 0 {
+			n++
+		}
+		return int32(1<<uint(n)|s.core.bits(s, n)) - c.offset
+	}
+	s.fail(fmt.Errorf("cram: encoding %d cannot decode integers", c.id))
+	return 0
+}
+
+func (c *codec) readByte(s *sliceData) byte {
+	if c.id == encExternal {
+		b := s.block(c.contentID)
+		v := b.byte()
+		if b.err != nil {
+			s.fail(b.err)
+		}
+		return v
+	}
+	return byte(c.readInt(s))
+}
+
+// appendBytes appends n bytes decoded by c to dst.
+func (c *codec) appendBytes(s *sliceData, dst []byte, n int) []byte {
+	if c.id == encExternal {
+		b := s.block(c.contentID)
+		v := b.bytes(n)
+		if b.err != nil {
+			s.fail(b.err)
+		}
+		return append(dst, v...)
+	}
+	for i := 0; i < n && s.err == nil; i++ {
+		dst = append(dst, c.readByte(s))
+	}
+	return dst
+}
+
+// appendArray appends a byte array decoded by c to dst.
+func (c *codec) appendArray(s *sliceData, dst []byte) []byte {
+	switch c.id {
+	case encByteArrayLen:
+		n := c.lenCodec.readInt(s)
+		if n < 0 {
+			s.fail(fmt.Errorf("cram: negative array length %d", n))
+			return dst
+		}
+		return c.valCodec.appendBytes(s, dst, int(n))
+	case encByteArrayStop:
+		b := s.block(c.contentID)
+		for {
+			v, err := b.ReadByte()
+			if err != nil {
+				s.fail(errTruncated)
+				return dst
+			}
+			if v == c.stop {
+				return dst
+			}
+			dst = append(dst, v)
+		}
+	}
+	s.fail(fmt.Errorf("cram: encoding %d cannot decode byte arrays", c.id))
+	return dst
+}
+
+// huffman is a canonical Huffman code.
+type huffman struct {
+	// codes maps bitLength<<32|code to the symbol.
+	codes map[uint64]int32
+	// single is the symbol of a one-symbol alphabet, which takes no bits.
+	single *int32
+	maxLen int32
+}
+
+func newHuffman(symbols, lens []int32) (*huffman, error) {
+	if len(symbols) != len(lens) || len(symbols) == 0 {
+		return nil, fmt.Errorf("cram: invalid huffman parameters")
+	}
+	h := &huffman{codes: map[uint64]int32{}}
+	if len(symbols) == 1 {
+		h.single = &symbols[0]
+		return h, nil
+	}
+	order := make([]int, len(symbols))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if lens[a] != lens[b] {
+			return lens[a] < lens[b]
+		}
+		return symbols[a] < symbols[b]
+	})
+	var code uint64
+	prevLen := lens[order[0]]
+	for _, i := range order {
+		if lens[i] <= 0 || lens[i] > 31 {
+			return nil, fmt.Errorf("cram: invalid huffman code length %d", lens[i])
+		}
+		code <<= uint(lens[i] - prevLen)
+		prevLen = lens[i]
+		h.codes[uint64(lens[i])<<32|code] = symbols[i]
+		code++
+	}
+	h.maxLen = prevLen
+	return h, nil
+}
+
+func (h *huffman) decode(s *sliceData) int32 {
+	if h.single != nil {
+		return *h.single
+	}
+	var code uint64
+	for n := int32(1); n <= h.maxLen && s.err == nil; n++ {
+		code = code<<1 | uint64(s.core.bits(s, 1))
+		if sym, ok := h.codes[uint64(n)<<32|code]; ok {
+			return sym
+		}
+	}
+	s.fail(fmt.Errorf("cram: invalid huffman code"))
+	return 0
+}
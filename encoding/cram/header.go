@@ -0,0 +1,232 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Data series, in the order of dataSeriesNames.
+const (
+	dsBF = iota
+	dsCF
+	dsRI
+	dsRL
+	dsAP
+	dsRG
+	dsRN
+	dsMF
+	dsNS
+	dsNP
+	dsTS
+	dsNF
+	dsTL
+	dsFN
+	dsFC
+	dsFP
+	dsDL
+	dsBB
+	dsQQ
+	dsBS
+	dsIN
+	dsRS
+	dsPD
+	dsHC
+	dsSC
+	dsMQ
+	dsBA
+	dsQS
+	nDataSeries
+)
+
+var dataSeriesNames = [nDataSeries]string{
+	"BF", "CF", "RI", "RL", "AP", "RG", "RN", "MF", "NS", "NP", "TS", "NF", "TL", "FN",
+	"FC", "FP", "DL", "BB", "QQ", "BS", "IN", "RS", "PD", "HC", "SC", "MQ", "BA", "QS",
+}
+
+// compressionHeader is the per-container description of how records are
+// encoded.
+type compressionHeader struct {
+	// readNamesIncluded is the RN preservation flag.  If false, names are
+	// generated for reads whose mate is in the same slice.
+	readNamesIncluded bool
+	// apDelta is the AP preservation flag: alignment positions are stored as
+	// deltas from the previous record.
+	apDelta bool
+	// refRequired is the RR preservation flag.
+	refRequired bool
+	// subst[r][code] is the base substituted for reference base r (in
+	// baseIndex order) by a BS code.
+	subst [5][4]byte
+	// tagDict[i] is the list of tag IDs (as used by tags) of tag line i.
+	tagDict [][]int32
+	series  [nDataSeries]*codec
+	// tags maps a tag ID, name[0]<<16|name[1]<<8|type, to its codec.
+	tags map[int32]*codec
+}
+
+// baseIndex maps an upper-case base to its row in the substitution matrix.
+func baseIndex(b byte) int {
+	switch b {
+	case 'A':
+		return 0
+	case 'C':
+		return 1
+	case 'G':
+		return 2
+	case 'T':
+		return 3
+	}
+	return 4
+}
+
+func parseCompressionHeader(b *block) (*compressionHeader, error) {
+	if b.contentType != contentCompressionHeader {
+		return nil, fmt.Errorf("cram: expected compression header block, found content type %d", b.contentType)
+	}
+	h := &compressionHeader{
+		readNamesIncluded: true,
+		apDelta:           true,
+		refRequired:       true,
+		tags:              map[int32]*codec{},
+	}
+	r := &byteReader{b: b.data}
+
+	// Preservation map.
+	pm := &byteReader{b: r.bytes(int(r.itf8()))}
+	hasSM := false
+	for n := pm.itf8(); n > 0 && pm.err == nil; n-- {
+		key := string(pm.bytes(2))
+		switch key {
+		case "RN":
+			h.readNamesIncluded = pm.byte() != 0
+		case "AP":
+			h.apDelta = pm.byte() != 0
+		case "RR":
+			h.refRequired = pm.byte() != 0
+		case "SM":
+			sm := pm.bytes(5)
+			if sm == nil {
+				break
+			}
+			hasSM = true
+			const bases = "ACGTN"
+			for i := range sm {
+				alts := make([]byte, 0, 4)
+				for j := range bases {
+					if j != i {
+						alts = append(alts, bases[j])
+					}
+				}
+				for k, alt := range alts {
+					h.subst[i][sm[i]>>uint(6-2*k)&3] = alt
+				}
+			}
+		case "TD":
+			td := pm.bytes(int(pm.itf8()))
+			for _, line := range bytes.Split(bytes.TrimSuffix(td, []byte{0}), []byte{0}) {
+				if len(line)%3 != 0 {
+					return nil, fmt.Errorf("cram: corrupt tag dictionary")
+				}
+				ids := make([]int32, len(line)/3)
+				for i := range ids {
+					t := line[3*i:]
+					ids[i] = int32(t[0])<<16 | int32(t[1])<<8 | int32(t[2])
+				}
+				h.tagDict = append(h.tagDict, ids)
+			}
+		default:
+			return nil, fmt.Errorf("cram: unknown preservation map key %q", key)
+		}
+	}
+	if pm.err != nil {
+		return nil, pm.err
+	}
+	if !hasSM {
+		return nil, fmt.Errorf("cram: compression header lacks a substitution matrix")
+	}
+
+	// Data series encodings.  Unknown (e.g. obsolete) series are ignored.
+	ds := &byteReader{b: r.bytes(int(r.itf8()))}
+	for n := ds.itf8(); n > 0 && ds.err == nil; n-- {
+		key := string(ds.bytes(2))
+		c, err := parseCodec(ds)
+		if err != nil {
+			return nil, fmt.Errorf("cram: data series %s: %v", key, err)
+		}
+		for i, name := range dataSeriesNames {
+			if name == key {
+				h.series[i] = c
+			}
+		}
+	}
+	if ds.err != nil {
+		return nil, ds.err
+	}
+
+	// Tag encodings.
+	tm := &byteReader{b: r.bytes(int(r.itf8()))}
+	for n := tm.itf8(); n > 0 && tm.err == nil; n-- {
+		id := tm.itf8()
+		c, err := parseCodec(tm)
+		if err != nil {
+			return nil, fmt.Errorf("cram: tag %c%c%c: %v", byte(id>>16), byte(id>>8), byte(id), err)
+		}
+		h.tags[id] = c
+	}
+	if tm.err != nil {
+		return nil, tm.err
+	}
+	return h, r.err
+}
+
+// sliceHeader is the header of a slice.
+type sliceHeader struct {
+	// refID is -1 for unmapped slices and -2 for multi-reference slices.
+	refID int32
+	// start is the 1-based alignment start.
+	start, span   int32
+	nRecords      int32
+	recordCounter int64
+	nBlocks       int32
+	// embeddedRefID is the content ID of the block holding the reference
+	// bases covered by the slice, or -1.
+	embeddedRefID int32
+}
+
+const (
+	refIDUnmapped = -1
+	refIDMulti    = -2
+)
+
+func parseSliceHeader(b *block) (*sliceHeader, error) {
+	if b.contentType != contentSliceHeader {
+		return nil, fmt.Errorf("cram: expected slice header block, found content type %d", b.contentType)
+	}
+	r := &byteReader{b: b.data}
+	h := &sliceHeader{
+		refID:         r.itf8(),
+		start:         r.itf8(),
+		span:          r.itf8(),
+		nRecords:      r.itf8(),
+		recordCounter: r.ltf8(),
+		nBlocks:       r.itf8(),
+	}
+	r.itf8Array() // block content IDs
+	h.embeddedRefID = r.itf8()
+	// The reference MD5 and optional tags follow; they're not used.
+	return h, r.err
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IndexEntry is one line of a .crai index.  It describes a slice, or the part
+// of a multi-reference slice on one reference.
+type IndexEntry struct {
+	// RefID is -1 for unmapped reads.
+	RefID int
+	// Start is the 1-based alignment start, and Span the number of reference
+	// bases covered.
+	Start, Span int
+	// ContainerOffset is the file offset of the slice's container.
+	ContainerOffset int64
+	// SliceOffset is the offset of the slice within the container's data, and
+	// SliceSize its size.
+	SliceOffset, SliceSize int64
+}
+
+// Index is a .crai index.
+type Index struct {
+	// Entries are in file order.
+	Entries []IndexEntry
+}
+
+// ReadIndex reads a (gzip-compressed) .crai index.
+func ReadIndex(r io.Reader) (*Index, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cram.ReadIndex: %v", err)
+	}
+	idx := &Index{}
+	scanner := bufio.NewScanner(zr)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("cram.ReadIndex: line %d: expected 6 fields, found %d", line, len(fields))
+		}
+		var v [6]int64
+		for i, f := range fields {
+			if v[i], err = strconv.ParseInt(f, 10, 64); err != nil {
+				return nil, fmt.Errorf("cram.ReadIndex: line %d: %v", line, err)
+			}
+		}
+		idx.Entries = append(idx.Entries, IndexEntry{
+			RefID:           int(v[0]),
+			Start:           int(v[1]),
+			Span:            int(v[2]),
+			ContainerOffset: v[3],
+			SliceOffset:     v[4],
+			SliceSize:       v[5],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cram.ReadIndex: %v", err)
+	}
+	return idx, nil
+}
+
+// ContainerOffset returns the offset of the first container that may contain
+// a record at or after 0-based <refID, pos> in a coordinate-sorted file.  Pass
+// refID -1 to find the unmapped reads.  ok is false if there is no such
+// container.
+func (idx *Index) ContainerOffset(refID, pos int) (off int64, ok bool) {
+	for _, e := range idx.Entries {
+		if e.RefID == -1 ||
+			(refID != -1 && (e.RefID > refID || (e.RefID == refID && e.Start-1+e.Span > pos))) {
+			return e.ContainerOffset, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+var errTruncated = fmt.Errorf("cram: truncated data")
+
+// readITF8 reads a CRAM ITF8 integer: a big-endian value of up to 32 bits,
+// whose length (1 to 5 bytes) is given by the number of leading 1 bits in the
+// first byte.
+func readITF8(r io.ByteReader) (int32, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		nExtra int
+		v      uint32
+	)
+	switch {
+	case b0&0x80 == 0:
+		return int32(b0), nil
+	case b0&0x40 == 0:
+		nExtra, v = 1, uint32(b0&0x3f)
+	case b0&0x20 == 0:
+		nExtra, v = 2, uint32(b0&0x1f)
+	case b0&0x10 == 0:
+		nExtra, v = 3, uint32(b0&0x0f)
+	default:
+		nExtra, v = 4, uint32(b0&0x0f)
+	}
+	for i := 0; i < nExtra; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errTruncated
+		}
+		if i == 3 {
+			// The 5th byte only contributes its low 4 bits.
+			v = v<<4 | uint32(b&0x0f)
+		} else {
+			v = v<<8 | uint32(b)
+		}
+	}
+	return int32(v), nil
+}
+
+// readLTF8 reads a CRAM LTF8 integer, the 64-bit analog of ITF8, which takes
+// 1 to 9 bytes.
+func readLTF8(r io.ByteReader) (int64, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	nExtra := bits.LeadingZeros8(^b0)
+	v := uint64(b0) & (0xff >> uint(nExtra+1))
+	for i := 0; i < nExtra; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errTruncated
+		}
+		v = v<<8 | uint64(b)
+	}
+	return int64(v), nil
+}
+
+// byteReader reads CRAM primitives from an in-memory buffer.  Errors are
+// sticky: after a read runs off the end of the buffer, all reads return zero
+// values, and err is set.
+type byteReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+// ReadByte implements io.ByteReader.
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.off >= len(r.b) {
+		return 0, io.EOF
+	}
+	b := r.b[r.off]
+	r.off++
+	return b, nil
+}
+
+func (r *byteReader) fail(err error) {
+	if err == io.EOF {
+		err = errTruncated
+	}
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *byteReader) byte() byte {
+	b, err := r.ReadByte()
+	if err != nil {
+		r.fail(err)
+	}
+	return b
+}
+
+func (r *byteReader) itf8() int32 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := readITF8(r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *byteReader) ltf8() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := readLTF8(r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+// bytes returns the next n bytes.  The result aliases the buffer.
+func (r *byteReader) bytes(n int) []byte {
+	if n < 0 || r.off+n > len(r.b) {
+		r.fail(errTruncated)
+		r.off = len(r.b)
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *byteReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// itf8Array reads an ITF8 count followed by that many ITF8 values.
+func (r *byteReader) itf8Array() []int32 {
+	n := r.itf8()
+	if n < 0 || int(n) > len(r.b)-r.off {
+		r.fail(errTruncated)
+		return nil
+	}
+	a := make([]int32, n)
+	for i := range a {
+		a[i] = r.itf8()
+	}
+	return a
+}
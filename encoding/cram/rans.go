@@ -0,0 +1,223 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// This file implements the rANS 4x8 block decoder (block compression method
+// 4), as specified in the CRAM codecs document
+// (https://samtools.github.io/hts-specs/CRAMcodecs.pdf).
+
+const (
+	ransTFShift  = 12
+	ransTotFreq  = 1 << ransTFShift
+	ransMask     = ransTotFreq - 1
+	ransLowBound = 1 << 23
+)
+
+type ransSym struct {
+	start, freq uint32
+}
+
+// ransInput reads the body of a rANS block.  Errors are sticky.
+type ransInput struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *ransInput) next() byte {
+	if r.off >= len(r.b) {
+		if r.err == nil {
+			r.err = fmt.Errorf("cram: truncated rANS data")
+		}
+		return 0
+	}
+	b := r.b[r.off]
+	r.off++
+	return b
+}
+
+func (r *ransInput) peek() byte {
+	if r.off >= len(r.b) {
+		return 0
+	}
+	return r.b[r.off]
+}
+
+func (r *ransInput) uint32() uint32 {
+	var v uint32
+	for i := uint(0); i < 4; i++ {
+		v |= uint32(r.next()) << (8 * i)
+	}
+	return v
+}
+
+// renorm shifts input bytes into x until it is back in range.
+func (r *ransInput) renorm(x uint32) uint32 {
+	for x < ransLowBound && r.off < len(r.b) {
+		x = x<<8 | uint32(r.b[r.off])
+		r.off++
+	}
+	return x
+}
+
+// nextSym returns the symbol following sym in a run-length encoded symbol
+// list, in which a symbol directly following its predecessor is followed by
+// the number of further consecutive symbols present.  A zero return value
+// terminates the list.
+func (r *ransInput) nextSym(sym int, rle *int) int {
+	if *rle == 0 && sym+1 == int(r.peek()) {
+		sym = int(r.next())
+		*rle = int(r.next())
+		return sym
+	}
+	if *rle > 0 {
+		*rle--
+		return sym + 1
+	}
+	return int(r.next())
+}
+
+// readFreqs reads one frequency table, and fills in the reverse lookup table
+// from cumulative frequency to symbol.
+func (r *ransInput) readFreqs(syms *[256]ransSym, lookup *[ransTotFreq]byte) {
+	var x uint32
+	sym, rle := int(r.next()), 0
+	for r.err == nil {
+		f := uint32(r.next())
+		if f >= 128 {
+			f = (f&127)<<8 | uint32(r.next())
+		}
+		if x+f > ransTotFreq || sym > 255 {
+			r.err = fmt.Errorf("cram: corrupt rANS frequency table")
+			return
+		}
+		syms[sym] = ransSym{x, f}
+		for i := x; i < x+f; i++ {
+			lookup[i] = byte(sym)
+		}
+		x += f
+		if sym = r.nextSym(sym, &rle); sym == 0 {
+			break
+		}
+	}
+}
+
+// advance moves rANS state x past symbol s, which was decoded from the low
+// bits of x.
+func (s ransSym) advance(x uint32) uint32 {
+	return s.freq*(x>>ransTFShift) + x&ransMask - s.start
+}
+
+// ransDecode decompresses a rANS 4x8 block.
+func ransDecode(in []byte) ([]byte, error) {
+	if len(in) < 9 {
+		return nil, fmt.Errorf("cram: rANS block too short (%d bytes)", len(in))
+	}
+	order := in[0]
+	inSize := binary.LittleEndian.Uint32(in[1:])
+	outSize := int(binary.LittleEndian.Uint32(in[5:]))
+	if int64(inSize) != int64(len(in)-9) {
+		return nil, fmt.Errorf("cram: rANS block size %d, expected %d", len(in)-9, inSize)
+	}
+	r := &ransInput{b: in[9:]}
+	var out []byte
+	switch order {
+	case 0:
+		out = ransDecode0(r, outSize)
+	case 1:
+		out = ransDecode1(r, outSize)
+	default:
+		return nil, fmt.Errorf("cram: unsupported rANS order %d", order)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return out, nil
+}
+
+func ransDecode0(r *ransInput, outSize int) []byte {
+	var (
+		syms   [256]ransSym
+		lookup [ransTotFreq]byte
+		R      [4]uint32
+	)
+	r.readFreqs(&syms, &lookup)
+	for j := range R {
+		R[j] = r.uint32()
+	}
+	if r.err != nil {
+		return nil
+	}
+	out := make([]byte, outSize)
+	for i := 0; i < outSize; i += 4 {
+		for j := 0; j < 4 && i+j < outSize; j++ {
+			c := lookup[R[j]&ransMask]
+			out[i+j] = c
+			R[j] = r.renorm(syms[c].advance(R[j]))
+		}
+	}
+	return out
+}
+
+func ransDecode1(r *ransInput, outSize int) []byte {
+	syms := make([][256]ransSym, 256)
+	lookup := make([][ransTotFreq]byte, 256)
+	ctx, rle := int(r.next()), 0
+	for r.err == nil {
+		if ctx > 255 {
+			r.err = fmt.Errorf("cram: corrupt rANS order-1 frequency table")
+			return nil
+		}
+		r.readFreqs(&syms[ctx], &lookup[ctx])
+		if ctx = r.nextSym(ctx, &rle); ctx == 0 {
+			break
+		}
+	}
+	var R [4]uint32
+	for j := range R {
+		R[j] = r.uint32()
+	}
+	if r.err != nil {
+		return nil
+	}
+	// The output is split into four equal parts, each decoded by one state,
+	// with the last state also decoding the remainder.
+	out := make([]byte, outSize)
+	quarter := outSize / 4
+	var last [4]byte
+	for i := 0; i < quarter; i++ {
+		for j := 0; j < 4; j++ {
+			c := lookup[last[j]][R[j]&ransMask]
+			out[j*quarter+i] = c
+			R[j] = syms[last[j]][c].advance(R[j])
+			last[j] = c
+		}
+		for j := 0; j < 4; j++ {
+			R[j] = r.renorm(R[j])
+		}
+	}
+	for i := 4 * quarter; i < outSize; i++ {
+		c := lookup[last[3]][R[3]&ransMask]
+		out[i] = c
+		R[3] = r.renorm(syms[last[3]][c].advance(R[3]))
+		last[3] = c
+	}
+	return out
+}
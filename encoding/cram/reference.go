@@ -0,0 +1,152 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/hts/sam"
+)
+
+// Reference supplies the reference bases that CRAM records are compressed
+// against.  Implementations must be safe for concurrent use.
+type Reference interface {
+	// Get returns the bases of ref in the 0-based half-open range [start, end),
+	// truncated at the end of the sequence.  Case is ignored.
+	Get(ref *sam.Reference, start, end int) ([]byte, error)
+}
+
+type fastaReference struct {
+	fa fasta.Fasta
+}
+
+// NewFASTAReference returns a Reference that looks up sequences by name in fa.
+func NewFASTAReference(fa fasta.Fasta) Reference {
+	return &fastaReference{fa}
+}
+
+// Get implements Reference.
+func (r *fastaReference) Get(ref *sam.Reference, start, end int) ([]byte, error) {
+	n, err := r.fa.Len(ref.Name())
+	if err != nil {
+		return nil, err
+	}
+	if uint64(end) > n {
+		end = int(n)
+	}
+	if start >= end {
+		return nil, nil
+	}
+	s, err := r.fa.Get(ref.Name(), uint64(start), uint64(end))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// DefaultMD5URL is the ENA CRAM reference registry, which serves sequences
+// by the MD5 of their upper-case bases.
+const DefaultMD5URL = "https://www.ebi.ac.uk/ena/cram/md5/%s"
+
+// MD5Reference fetches sequences by the M5 tag of their @SQ header line, as
+// htslib does when no reference FASTA is given.  Fetched sequences are kept in
+// memory.
+type MD5Reference struct {
+	// URL is a format string with a single %s, which is replaced by the
+	// hex-encoded MD5.  If "", DefaultMD5URL is used.
+	URL string
+	// CacheDir, if nonempty, is a local directory in which fetched sequences
+	// are stored, one file per MD5, and looked up before fetching.
+	CacheDir string
+
+	mu   sync.Mutex
+	seqs map[string][]byte
+}
+
+// Get implements Reference.
+func (r *MD5Reference) Get(ref *sam.Reference, start, end int) ([]byte, error) {
+	sum := ref.MD5()
+	if sum == nil {
+		return nil, fmt.Errorf("cram: reference %s has no M5 tag; a reference FASTA is needed", ref.Name())
+	}
+	key := hex.EncodeToString(sum)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seq, ok := r.seqs[key]
+	if !ok {
+		var err error
+		if seq, err = r.fetch(key, sum); err != nil {
+			return nil, fmt.Errorf("cram: fetching reference %s: %v", ref.Name(), err)
+		}
+		if r.seqs == nil {
+			r.seqs = map[string][]byte{}
+		}
+		r.seqs[key] = seq
+	}
+	if end > len(seq) {
+		end = len(seq)
+	}
+	if start >= end {
+		return nil, nil
+	}
+	return seq[start:end], nil
+}
+
+func (r *MD5Reference) fetch(key string, sum []byte) ([]byte, error) {
+	cachePath := ""
+	if r.CacheDir != "" {
+		cachePath = filepath.Join(r.CacheDir, key)
+		if seq, err := ioutil.ReadFile(cachePath); err == nil {
+			return seq, nil
+		}
+	}
+	url := r.URL
+	if url == "" {
+		url = DefaultMD5URL
+	}
+	resp, err := http.Get(fmt.Sprintf(url, key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", fmt.Sprintf(url, key), resp.Status)
+	}
+	seq, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if got := md5.Sum(bytes.ToUpper(seq)); !bytes.Equal(got[:], sum) {
+		return nil, fmt.Errorf("MD5 mismatch: got %x, expected %s", got, key)
+	}
+	if cachePath != "" {
+		if err := os.MkdirAll(r.CacheDir, 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(cachePath, seq, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return seq, nil
+}
@@ -0,0 +1,426 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// Compression bit flags (the CF data series).
+const (
+	cfQualArray      = 0x1
+	cfDetached       = 0x2
+	cfMateDownstream = 0x4
+	cfUnknownBases   = 0x8
+)
+
+// Mate flags (the MF data series).
+const (
+	mfMateReverse  = 0x1
+	mfMateUnmapped = 0x2
+)
+
+// refWindow holds the reference bases used to decode a slice.
+type refWindow struct {
+	refID int
+	// start is the 0-based position of bases[0].
+	start int
+	bases []byte
+}
+
+// base returns the upper-case reference base at 0-based pos, or 'N' if pos is
+// outside the window.
+func (w *refWindow) base(pos int) byte {
+	i := pos - w.start
+	if i < 0 || i >= len(w.bases) {
+		return 'N'
+	}
+	b := w.bases[i]
+	if b >= 'a' && b <= 'z' {
+		b -= 'a' - 'A'
+	}
+	return b
+}
+
+// sliceDecoder decodes the records of one slice.
+type sliceDecoder struct {
+	sliceData
+	ch     *compressionHeader
+	sh     *sliceHeader
+	header *sam.Header
+	ref    Reference
+	win    refWindow
+	cigar  []sam.CigarOp
+}
+
+func (d *sliceDecoder) int(ds int) int32 {
+	if c := d.series(ds); c != nil {
+		return c.readInt(&d.sliceData)
+	}
+	return 0
+}
+
+func (d *sliceDecoder) byte(ds int) byte {
+	if c := d.series(ds); c != nil {
+		return c.readByte(&d.sliceData)
+	}
+	return 0
+}
+
+func (d *sliceDecoder) bytes(ds int, dst []byte, n int) []byte {
+	if c := d.series(ds); c != nil {
+		return c.appendBytes(&d.sliceData, dst, n)
+	}
+	return dst
+}
+
+func (d *sliceDecoder) array(ds int) []byte {
+	if c := d.series(ds); c != nil {
+		return c.appendArray(&d.sliceData, nil)
+	}
+	return nil
+}
+
+func (d *sliceDecoder) series(ds int) *codec {
+	c := d.ch.series[ds]
+	if c == nil {
+		d.fail(fmt.Errorf("cram: no encoding for data series %s", dataSeriesNames[ds]))
+	}
+	return c
+}
+
+// setRef makes d.win cover [start, end) of refID, if the compression header
+// says the reference is needed.
+func (d *sliceDecoder) setRef(refID, start, end int) {
+	if !d.ch.refRequired || refID < 0 || (d.win.bases != nil && d.win.refID == refID) {
+		return
+	}
+	refs := d.header.Refs()
+	if refID >= len(refs) {
+		d.fail(fmt.Errorf("cram: reference ID %d out of range", refID))
+		return
+	}
+	if d.ref == nil {
+		d.fail(fmt.Errorf("cram: a reference is needed to decode %s", refs[refID].Name()))
+		return
+	}
+	bases, err := d.ref.Get(refs[refID], start, end)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	d.win = refWindow{refID: refID, start: start, bases: bases}
+}
+
+func (d *sliceDecoder) addCigar(t sam.CigarOpType, n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(d.cigar) - 1; last >= 0 && d.cigar[last].Type() == t {
+		d.cigar[last] = sam.NewCigarOp(t, d.cigar[last].Len()+n)
+		return
+	}
+	d.cigar = append(d.cigar, sam.NewCigarOp(t, n))
+}
+
+// decode decodes all the records of the slice.
+func (d *sliceDecoder) decode() ([]*sam.Record, error) {
+	sh := d.sh
+	if sh.embeddedRefID >= 0 {
+		d.win = refWindow{refID: int(sh.refID), start: int(sh.start) - 1, bases: d.block(sh.embeddedRefID).b}
+	} else if sh.refID >= 0 {
+		d.setRef(int(sh.refID), int(sh.start)-1, int(sh.start)-1+int(sh.span))
+	}
+	refs := d.header.Refs()
+	rgs := d.header.RGs()
+	recs := make([]*sam.Record, 0, sh.nRecords)
+	// next[i] is the index of the next fragment of record i's template, or -1.
+	next := make([]int, sh.nRecords)
+	prevPos := sh.start
+	for i := 0; i < int(sh.nRecords) && d.err == nil; i++ {
+		next[i] = -1
+		rec := sam.GetFromFreePool()
+		rec.Name, rec.TempLen = "", 0
+		recs = append(recs, rec)
+		bf := d.int(dsBF)
+		cf := d.int(dsCF)
+		refID := sh.refID
+		if refID == refIDMulti {
+			refID = d.int(dsRI)
+		}
+		readLen := int(d.int(dsRL))
+		pos := d.int(dsAP)
+		if d.ch.apDelta {
+			pos += prevPos
+			prevPos = pos
+		}
+		rg := d.int(dsRG)
+		if d.ch.readNamesIncluded {
+			rec.Name = string(d.array(dsRN))
+		}
+		rec.MateRef, rec.MatePos = nil, -1
+		if cf&cfDetached != 0 {
+			mf := d.int(dsMF)
+			if mf&mfMateReverse != 0 {
+				bf |= int32(sam.MateReverse)
+			}
+			if mf&mfMateUnmapped != 0 {
+				bf |= int32(sam.MateUnmapped)
+			}
+			if !d.ch.readNamesIncluded {
+				rec.Name = string(d.array(dsRN))
+			}
+			if ns := d.int(dsNS); ns >= 0 && int(ns) < len(refs) {
+				rec.MateRef = refs[ns]
+			}
+			rec.MatePos = int(d.int(dsNP)) - 1
+			rec.TempLen = int(d.int(dsTS))
+		} else if cf&cfMateDownstream != 0 {
+			next[i] = i + int(d.int(dsNF)) + 1
+		}
+		if rec.Name == "" {
+			rec.Name = strconv.FormatInt(sh.recordCounter+int64(i)+1, 10)
+		}
+
+		rec.AuxFields = rec.AuxFields[:0]
+		if rg >= 0 && int(rg) < len(rgs) {
+			rec.AuxFields = append(rec.AuxFields, sam.Aux(append([]byte("RGZ"), rgs[rg].Name()...)))
+		}
+		if tl := d.int(dsTL); tl >= 0 && int(tl) < len(d.ch.tagDict) {
+			for _, id := range d.ch.tagDict[tl] {
+				c := d.ch.tags[id]
+				if c == nil {
+					d.fail(fmt.Errorf("cram: no encoding for tag %c%c%c", byte(id>>16), byte(id>>8), byte(id)))
+					break
+				}
+				aux := c.appendArray(&d.sliceData, []byte{byte(id >> 16), byte(id >> 8), byte(id)})
+				if t := byte(id); (t == 'Z' || t == 'H') && len(aux) > 3 && aux[len(aux)-1] == 0 {
+					aux = aux[:len(aux)-1]
+				}
+				rec.AuxFields = append(rec.AuxFields, sam.Aux(aux))
+			}
+		} else if d.err == nil {
+			d.fail(fmt.Errorf("cram: tag line %d out of range", tl))
+		}
+
+		rec.Flags = sam.Flags(bf)
+		if refID >= 0 && int(refID) < len(refs) {
+			rec.Ref = refs[refID]
+		} else {
+			rec.Ref = nil
+		}
+		rec.Pos = int(pos) - 1
+		rec.MapQ = 0
+		rec.Cigar = nil
+		var seq, qual []byte
+		if bf&int32(sam.Unmapped) == 0 {
+			if refID != sh.refID && refID >= 0 && int(refID) < len(refs) {
+				d.setRef(int(refID), 0, refs[refID].Len())
+			}
+			seq, qual = d.decodeFeatures(readLen, int(pos)-1)
+			rec.Cigar = append(sam.Cigar(nil), d.cigar...)
+			rec.MapQ = byte(d.int(dsMQ))
+		} else {
+			if cf&cfUnknownBases == 0 {
+				seq = d.bytes(dsBA, make([]byte, 0, readLen), readLen)
+			}
+			qual = make([]byte, readLen)
+			for j := range qual {
+				qual[j] = 0xff
+			}
+		}
+		if cf&cfQualArray != 0 {
+			qual = d.bytes(dsQS, qual[:0], readLen)
+		}
+		if cf&cfUnknownBases != 0 {
+			seq, qual = nil, nil
+		}
+		rec.Seq = sam.NewSeq(seq)
+		rec.Qual = qual
+	}
+	if d.err != nil {
+		for _, rec := range recs {
+			sam.PutInFreePool(rec)
+		}
+		return nil, d.err
+	}
+	if err := resolveMates(recs, next); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// decodeFeatures decodes the read features of a mapped read of length
+// readLen starting at 0-based refPos, and returns its bases and qualities.
+// d.cigar is set to its CIGAR.
+func (d *sliceDecoder) decodeFeatures(readLen, refPos int) (seq, qual []byte) {
+	seq = make([]byte, readLen)
+	qual = make([]byte, readLen)
+	for i := range qual {
+		qual[i] = 0xff
+	}
+	d.cigar = d.cigar[:0]
+	readPos := 0 // 0-based
+	// copyRef fills read positions up to (not including) end with reference
+	// bases.
+	copyRef := func(end int) {
+		if end > readLen {
+			end = readLen
+		}
+		n := 0
+		for ; readPos < end; readPos++ {
+			seq[readPos] = d.win.base(refPos)
+			refPos++
+			n++
+		}
+		d.addCigar(sam.CigarMatch, n)
+	}
+	// put copies bases to the read at readPos, returning false if they don't
+	// fit.
+	put := func(dst, bases []byte) bool {
+		if readPos+len(bases) > readLen {
+			d.fail(fmt.Errorf("cram: read feature extends past the end of a %d-base read", readLen))
+			return false
+		}
+		copy(dst[readPos:], bases)
+		return true
+	}
+	fpos := 0
+	for n := d.int(dsFN); n > 0 && d.err == nil; n-- {
+		code := d.byte(dsFC)
+		fpos += int(d.int(dsFP))
+		if fpos < 1 || fpos-1 < readPos || fpos > readLen+1 {
+			d.fail(fmt.Errorf("cram: read feature %c at invalid position %d", code, fpos))
+			break
+		}
+		copyRef(fpos - 1)
+		switch code {
+		case 'X':
+			bs := d.byte(dsBS)
+			if put(seq, []byte{d.ch.subst[baseIndex(d.win.base(refPos))][bs&3]}) {
+				readPos++
+				refPos++
+				d.addCigar(sam.CigarMatch, 1)
+			}
+		case 'B':
+			b := d.byte(dsBA)
+			q := d.byte(dsQS)
+			if put(seq, []byte{b}) && put(qual, []byte{q}) {
+				readPos++
+				refPos++
+				d.addCigar(sam.CigarMatch, 1)
+			}
+		case 'b':
+			bases := d.array(dsBB)
+			if put(seq, bases) {
+				readPos += len(bases)
+				refPos += len(bases)
+				d.addCigar(sam.CigarMatch, len(bases))
+			}
+		case 'q':
+			put(qual, d.array(dsQQ))
+		case 'Q':
+			put(qual, []byte{d.byte(dsQS)})
+		case 'I', 'i', 'S':
+			var bases []byte
+			if code == 'i' {
+				bases = []byte{d.byte(dsBA)}
+			} else if code == 'I' {
+				bases = d.array(dsIN)
+			} else {
+				bases = d.array(dsSC)
+			}
+			if put(seq, bases) {
+				readPos += len(bases)
+				t := sam.CigarInsertion
+				if code == 'S' {
+					t = sam.CigarSoftClipped
+				}
+				d.addCigar(t, len(bases))
+			}
+		case 'D':
+			n := int(d.int(dsDL))
+			refPos += n
+			d.addCigar(sam.CigarDeletion, n)
+		case 'N':
+			n := int(d.int(dsRS))
+			refPos += n
+			d.addCigar(sam.CigarSkipped, n)
+		case 'P':
+			d.addCigar(sam.CigarPadded, int(d.int(dsPD)))
+		case 'H':
+			d.addCigar(sam.CigarHardClipped, int(d.int(dsHC)))
+		default:
+			d.fail(fmt.Errorf("cram: unknown read feature code %q", code))
+		}
+	}
+	copyRef(readLen)
+	return seq, qual
+}
+
+// resolveMates fills in the mate fields of records whose mates are in the
+// same slice.  next[i] is the index of the next fragment of record i's
+// template, or -1.
+func resolveMates(recs []*sam.Record, next []int) error {
+	hasPrev := make([]bool, len(recs))
+	for i, j := range next {
+		if j < 0 {
+			continue
+		}
+		if j <= i || j >= len(recs) || hasPrev[j] {
+			return fmt.Errorf("cram: invalid next-fragment link from record %d to %d", i, j)
+		}
+		hasPrev[j] = true
+	}
+	var chain []int
+	for head := range recs {
+		if hasPrev[head] || next[head] < 0 {
+			continue
+		}
+		chain = chain[:0]
+		for i := head; i >= 0; i = next[i] {
+			chain = append(chain, i)
+		}
+		for k, i := range chain {
+			rec, mate := recs[i], recs[chain[(k+1)%len(chain)]]
+			rec.MateRef, rec.MatePos = mate.Ref, mate.Pos
+			rec.Flags &^= sam.MateReverse | sam.MateUnmapped
+			if mate.Flags&sam.Reverse != 0 {
+				rec.Flags |= sam.MateReverse
+			}
+			if mate.Flags&sam.Unmapped != 0 {
+				rec.Flags |= sam.MateUnmapped
+			}
+			rec.TempLen = 0
+			if rec.Flags&(sam.Unmapped|sam.MateUnmapped) == 0 && rec.Ref == mate.Ref {
+				start, end := rec.Pos, rec.End()
+				if mate.Pos < start {
+					start = mate.Pos
+				}
+				if e := mate.End(); e > end {
+					end = e
+				}
+				rec.TempLen = end - start
+				if rec.Pos > mate.Pos || (rec.Pos == mate.Pos && k > 0) {
+					rec.TempLen = -rec.TempLen
+				}
+			}
+		}
+	}
+	return nil
+}
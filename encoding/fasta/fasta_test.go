@@ -2,9 +2,12 @@ package fasta_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"reflect"
 	"sort"
@@ -14,6 +17,7 @@ import (
 	"github.com/grailbio/base/file"
 	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/hts/bgzf"
 	"github.com/grailbio/testutil/assert"
 )
 
@@ -325,3 +329,86 @@ func BenchmarkRead(b *testing.B) {
 		})
 	}
 }
+
+func TestWriter(t *testing.T) {
+	var out, fai bytes.Buffer
+	w, err := fasta.NewWriter(&out, fasta.WriterOpts{LineWidth: 4, Index: &fai})
+	assert.NoError(t, err)
+	assert.NoError(t, w.StartSeq("seq1"))
+	// Sequences may be written in pieces which don't match the lines.
+	_, err = w.Write([]byte("ACG"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("TACGTA"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.StartSeq("seq2"))
+	_, err = w.Write([]byte("AC"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.StartSeq("seq3"))
+	_, err = w.Write([]byte("ACGT"))
+	assert.NoError(t, err)
+	assert.NotNil(t, w.StartSeq("bad name"))
+	assert.NoError(t, w.Close())
+	assert.EQ(t, out.String(), ">seq1\nACGT\nACGT\nA\n>seq2\nAC\n>seq3\nACGT\n")
+
+	// The index matches samtools faidx, as implemented by GenerateIndex.
+	var generated bytes.Buffer
+	assert.NoError(t, fasta.GenerateIndex(&generated, bytes.NewReader(out.Bytes())))
+	assert.EQ(t, fai.String(), generated.String())
+
+	indexed, err := fasta.NewIndexed(bytes.NewReader(out.Bytes()), &fai)
+	assert.NoError(t, err)
+	seq, err := indexed.Get("seq1", 2, 9)
+	assert.NoError(t, err)
+	assert.EQ(t, seq, "GTACGTA")
+}
+
+func TestWriterBGZF(t *testing.T) {
+	var plain, out, fai, gzi bytes.Buffer
+	pw, err := fasta.NewWriter(&plain, fasta.WriterOpts{})
+	assert.NoError(t, err)
+	w, err := fasta.NewWriter(&out, fasta.WriterOpts{BGZF: true, Index: &fai, GZI: &gzi})
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(0))
+	for _, name := range []string{"chr1", "chr2"} {
+		assert.NoError(t, pw.StartSeq(name))
+		assert.NoError(t, w.StartSeq(name))
+		bases := make([]byte, 100000)
+		for i := range bases {
+			bases[i] = "ACGT"[r.Intn(4)]
+		}
+		_, err = pw.Write(bases)
+		assert.NoError(t, err)
+		_, err = w.Write(bases)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, pw.Close())
+	assert.NoError(t, w.Close())
+
+	// The uncompressed data and its index are the same as without bgzf.
+	zr, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), plain.String())
+	var generated bytes.Buffer
+	assert.NoError(t, fasta.GenerateIndex(&generated, &plain))
+	assert.EQ(t, fai.String(), generated.String())
+
+	// Each .gzi entry is the start of a block.
+	b := gzi.Bytes()
+	n := int(binary.LittleEndian.Uint64(b))
+	assert.EQ(t, len(b), 8+16*n)
+	assert.EQ(t, n, len(data)/0xff00)
+	br, err := bgzf.NewReader(bytes.NewReader(out.Bytes()), 1)
+	assert.NoError(t, err)
+	for i := 0; i < n; i++ {
+		compressed := binary.LittleEndian.Uint64(b[8+16*i:])
+		uncompressed := binary.LittleEndian.Uint64(b[16+16*i:])
+		assert.EQ(t, uncompressed, uint64((i+1)*0xff00))
+		assert.NoError(t, br.Seek(bgzf.Offset{File: int64(compressed)}))
+		got := make([]byte, 10)
+		_, err = io.ReadFull(br, got)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), string(data[uncompressed:uncompressed+10]))
+	}
+}
@@ -0,0 +1,468 @@
+package fasta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"unsafe"
+
+	"github.com/grailbio/base/traverse"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// MaxKmerLength is the largest KmerIndexOpts.K; k-mers are packed into
+// uint64s.
+const MaxKmerLength = 32
+
+// kmerIndexMagic starts a KmerIndex file, followed by kmerIndexByteOrderMark
+// in little-endian order.  The arrays of the file are read in place, so it
+// can only be opened on little-endian hosts.
+const (
+	kmerIndexMagic         = "BIOKMIX1"
+	kmerIndexByteOrderMark = uint64(0x0102030405060708)
+)
+
+// kmerBaseCode maps ASCII bases to their 2-bit codes, and everything else to
+// 4.
+var kmerBaseCode = func() (t [256]byte) {
+	for i := range t {
+		t[i] = 4
+	}
+	for i, c := range "ACGT" {
+		t[c] = byte(i)
+		t[c+'a'-'A'] = byte(i)
+	}
+	return
+}()
+
+// KmerIndexOpts configures NewKmerIndex.
+type KmerIndexOpts struct {
+	// K is the k-mer length, in 1..MaxKmerLength.
+	K int
+	// Canonical causes each k-mer to be indexed under the smaller of itself
+	// and its reverse complement, so that lookups find the occurrences on
+	// both strands.  Otherwise, only the forward strand is indexed.
+	Canonical bool
+	// MinimizerWindow, if greater than 1, causes only the minimizers to be
+	// indexed: the k-mer with the smallest hash among each MinimizerWindow
+	// consecutive k-mers.  This shrinks the index about MinimizerWindow/2
+	// times, and two sequences which share a stretch of at least
+	// MinimizerWindow+K-1 bases are still guaranteed to share a minimizer.
+	MinimizerWindow int
+	// Parallelism is the number of goroutines used to build the index.  0
+	// selects runtime.NumCPU().
+	Parallelism int
+}
+
+// Position is an occurrence of a k-mer.
+type Position struct {
+	// SeqIndex is the index of the sequence in KmerIndex.SeqNames(), and Pos
+	// is the 0-based position of the k-mer's first base in it.
+	SeqIndex int
+	Pos      int
+	// Reverse is true if the reverse complement of the looked-up k-mer is at
+	// Pos, i.e. the k-mer occurs on the reverse strand.  It is always false
+	// without KmerIndexOpts.Canonical.
+	Reverse bool
+}
+
+// KmerIndex maps the k-mers of a set of sequences to their positions.  It is
+// built by NewKmerIndex, and can be written with Write and memory-mapped with
+// OpenKmerIndex.  It is thread-safe.
+type KmerIndex struct {
+	opts     KmerIndexOpts
+	seqNames []string
+	// kmers are the distinct indexed k-mers in ascending order, and the
+	// positions of kmers[i] are positions[offsets[i]:offsets[i+1]], each
+	// packed as seqIndex<<32 | pos<<1 | reverse, in ascending order.
+	kmers     []uint64
+	offsets   []uint64
+	positions []uint64
+	// mapped is the memory-mapped file of an index opened by OpenKmerIndex.
+	mapped []byte
+}
+
+// kmerEntry is an indexed k-mer occurrence, during construction.
+type kmerEntry struct {
+	kmer, pos uint64
+}
+
+// kmerHash scrambles a k-mer for minimizer selection, so that the minimizers
+// aren't biased towards low-complexity sequence like poly-A.  It is the
+// splitmix64 finalizer.
+func kmerHash(kmer uint64) uint64 {
+	kmer ^= kmer >> 30
+	kmer *= 0xbf58476d1ce4e5b9
+	kmer ^= kmer >> 27
+	kmer *= 0x94d049bb133111eb
+	kmer ^= kmer >> 31
+	return kmer
+}
+
+// appendSeqKmers appends the indexed k-mers of seq, the sequence with index
+// seqIndex, to entries.  K-mers with a base other than A, C, G or T are
+// skipped.
+func appendSeqKmers(entries []kmerEntry, seq string, seqIndex int, opts *KmerIndexOpts) []kmerEntry {
+	k := opts.K
+	mask := ^uint64(0) >> uint(64-2*k)
+	revShift := uint(2 * (k - 1))
+	w := opts.MinimizerWindow
+	if w < 1 {
+		w = 1
+	}
+	// window holds the candidate minimizers of the current window, in
+	// position order with increasing hashes.
+	type candidate struct {
+		kmerEntry
+		hash uint64
+		i    int
+	}
+	var window []candidate
+	lastPos := -1
+	var fwd, rev uint64
+	nValid := 0
+	for i := 0; i < len(seq); i++ {
+		c := uint64(kmerBaseCode[seq[i]])
+		if c > 3 {
+			nValid = 0
+			window = window[:0]
+			continue
+		}
+		fwd = ((fwd << 2) | c) & mask
+		rev = (rev >> 2) | ((3 - c) << revShift)
+		if nValid++; nValid < k {
+			continue
+		}
+		start := i - k + 1
+		e := kmerEntry{kmer: fwd, pos: uint64(seqIndex)<<32 | uint64(start)<<1}
+		if opts.Canonical && (rev < fwd) {
+			e.kmer = rev
+			e.pos |= 1
+		}
+		if w == 1 {
+			entries = append(entries, e)
+			continue
+		}
+		h := kmerHash(e.kmer)
+		for (len(window) > 0) && (window[len(window)-1].hash > h) {
+			window = window[:len(window)-1]
+		}
+		window = append(window, candidate{e, h, start})
+		if window[0].i <= start-w {
+			window = window[1:]
+		}
+		// The window is complete once it has w valid k-mers.
+		if (nValid >= k+w-1) && (window[0].i != lastPos) {
+			entries = append(entries, window[0].kmerEntry)
+			lastPos = window[0].i
+		}
+	}
+	return entries
+}
+
+// NewKmerIndex indexes the k-mers of the sequences of fa.
+func NewKmerIndex(fa Fasta, opts KmerIndexOpts) (*KmerIndex, error) {
+	if (opts.K < 1) || (opts.K > MaxKmerLength) {
+		return nil, errors.Errorf("NewKmerIndex: invalid k-mer length %d", opts.K)
+	}
+	if opts.MinimizerWindow < 0 {
+		return nil, errors.Errorf("NewKmerIndex: invalid minimizer window %d", opts.MinimizerWindow)
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.NumCPU()
+	}
+	seqNames := fa.SeqNames()
+	if uint64(len(seqNames)) > 1<<32 {
+		return nil, errors.Errorf("NewKmerIndex: too many sequences (%d)", len(seqNames))
+	}
+	seqEntries := make([][]kmerEntry, len(seqNames))
+	err := traverse.Limit(opts.Parallelism).Each(len(seqNames), func(i int) error {
+		n, err := fa.Len(seqNames[i])
+		if (err != nil) || (n == 0) {
+			return err
+		}
+		if n >= 1<<31 {
+			return errors.Errorf("NewKmerIndex: sequence %s is too long (%d bases)", seqNames[i], n)
+		}
+		seq, err := fa.Get(seqNames[i], 0, n)
+		if err != nil {
+			return err
+		}
+		seqEntries[i] = appendSeqKmers(nil, seq, i, &opts)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries are sorted in buckets of the k-mers' top bits, which are
+	// already in order.
+	bucketBits := uint(2 * opts.K)
+	if bucketBits > 12 {
+		bucketBits = 12
+	}
+	bucketShift := uint(2*opts.K) - bucketBits
+	bucketStarts := make([]int, (1<<bucketBits)+1)
+	for _, entries := range seqEntries {
+		for _, e := range entries {
+			bucketStarts[(e.kmer>>bucketShift)+1]++
+		}
+	}
+	for b := 1; b < len(bucketStarts); b++ {
+		bucketStarts[b] += bucketStarts[b-1]
+	}
+	all := make([]kmerEntry, bucketStarts[len(bucketStarts)-1])
+	next := append([]int(nil), bucketStarts...)
+	for i, entries := range seqEntries {
+		for _, e := range entries {
+			b := e.kmer >> bucketShift
+			all[next[b]] = e
+			next[b]++
+		}
+		seqEntries[i] = nil
+	}
+	_ = traverse.Limit(opts.Parallelism).Each(len(bucketStarts)-1, func(b int) error {
+		bucket := all[bucketStarts[b]:bucketStarts[b+1]]
+		sort.Slice(bucket, func(i, j int) bool {
+			if bucket[i].kmer != bucket[j].kmer {
+				return bucket[i].kmer < bucket[j].kmer
+			}
+			return bucket[i].pos < bucket[j].pos
+		})
+		return nil
+	})
+
+	idx := &KmerIndex{
+		opts:      opts,
+		seqNames:  append([]string(nil), seqNames...),
+		positions: make([]uint64, len(all)),
+	}
+	for i, e := range all {
+		if (i == 0) || (e.kmer != all[i-1].kmer) {
+			idx.kmers = append(idx.kmers, e.kmer)
+			idx.offsets = append(idx.offsets, uint64(i))
+		}
+		idx.positions[i] = e.pos
+	}
+	idx.offsets = append(idx.offsets, uint64(len(all)))
+	return idx, nil
+}
+
+// K returns the k-mer length of the index.
+func (idx *KmerIndex) K() int { return idx.opts.K }
+
+// SeqNames returns the names of the indexed sequences, indexed by
+// Position.SeqIndex.
+func (idx *KmerIndex) SeqNames() []string { return idx.seqNames }
+
+// NumKmers returns the number of distinct indexed k-mers.
+func (idx *KmerIndex) NumKmers() int { return len(idx.kmers) }
+
+// Lookup returns the positions of kmer, which must have length K() (case is
+// ignored), in ascending order.  It returns nil if kmer doesn't occur, has
+// the wrong length or has a base other than A, C, G or T.  With
+// KmerIndexOpts.MinimizerWindow, only the positions where kmer is a
+// minimizer are returned.
+func (idx *KmerIndex) Lookup(kmer string) []Position {
+	if len(kmer) != idx.opts.K {
+		return nil
+	}
+	var fwd, rev uint64
+	for i := 0; i < len(kmer); i++ {
+		c := uint64(kmerBaseCode[kmer[i]])
+		if c > 3 {
+			return nil
+		}
+		fwd = (fwd << 2) | c
+		rev |= (3 - c) << uint(2*i)
+	}
+	reverse := false
+	if idx.opts.Canonical && (rev < fwd) {
+		fwd = rev
+		reverse = true
+	}
+	i := sort.Search(len(idx.kmers), func(i int) bool { return idx.kmers[i] >= fwd })
+	if (i == len(idx.kmers)) || (idx.kmers[i] != fwd) {
+		return nil
+	}
+	packed := idx.positions[idx.offsets[i]:idx.offsets[i+1]]
+	positions := make([]Position, len(packed))
+	for j, p := range packed {
+		positions[j] = Position{
+			SeqIndex: int(p >> 32),
+			Pos:      int((p & 0xffffffff) >> 1),
+			Reverse:  ((p & 1) != 0) != reverse,
+		}
+	}
+	return positions
+}
+
+// Write writes the index to w, in the format read by OpenKmerIndex.
+func (idx *KmerIndex) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	putUint32 := func(v uint32) {
+		buf = append(buf, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], v)
+	}
+	putUint64 := func(v uint64) {
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(buf[len(buf)-8:], v)
+	}
+	buf = append(buf, kmerIndexMagic...)
+	putUint64(kmerIndexByteOrderMark)
+	var flags uint32
+	if idx.opts.Canonical {
+		flags |= 1
+	}
+	putUint32(uint32(idx.opts.K))
+	putUint32(flags)
+	putUint32(uint32(idx.opts.MinimizerWindow))
+	putUint32(uint32(len(idx.seqNames)))
+	for _, name := range idx.seqNames {
+		putUint32(uint32(len(name)))
+		buf = append(buf, name...)
+	}
+	// The arrays are 8-byte aligned.
+	for len(buf)%8 != 0 {
+		buf = append(buf, 0)
+	}
+	putUint64(uint64(len(idx.kmers)))
+	putUint64(uint64(len(idx.positions)))
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	for _, a := range [][]uint64{idx.kmers, idx.offsets, idx.positions} {
+		for _, v := range a {
+			binary.LittleEndian.PutUint64(buf[:8], v)
+			if _, err := bw.Write(buf[:8]); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// uint64s returns data as a []uint64, without copying it.  len(data) must be
+// a multiple of 8, and data must be 8-byte aligned.
+func uint64s(data []byte) []uint64 {
+	if len(data) == 0 {
+		return nil
+	}
+	var s []uint64
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&s))
+	hdr.Data = uintptr(unsafe.Pointer(&data[0]))
+	hdr.Len = len(data) / 8
+	hdr.Cap = hdr.Len
+	return s
+}
+
+// parseKmerIndex returns the index written by KmerIndex.Write to data,
+// which must be 8-byte aligned.  The returned index refers to data.
+func parseKmerIndex(data []byte) (*KmerIndex, error) {
+	off := 0
+	need := func(n int) error {
+		if off+n > len(data) {
+			return errors.Errorf("OpenKmerIndex: truncated index")
+		}
+		return nil
+	}
+	getUint32 := func() uint32 {
+		v := binary.LittleEndian.Uint32(data[off:])
+		off += 4
+		return v
+	}
+	getUint64 := func() uint64 {
+		v := binary.LittleEndian.Uint64(data[off:])
+		off += 8
+		return v
+	}
+	if err := need(32); err != nil {
+		return nil, err
+	}
+	if string(data[:8]) != kmerIndexMagic {
+		return nil, errors.Errorf("OpenKmerIndex: not a k-mer index")
+	}
+	if uint64s(data[8:16])[0] != kmerIndexByteOrderMark {
+		return nil, errors.Errorf("OpenKmerIndex: k-mer indexes can only be opened on little-endian hosts")
+	}
+	off = 16
+	idx := &KmerIndex{mapped: data}
+	idx.opts.K = int(getUint32())
+	idx.opts.Canonical = getUint32()&1 != 0
+	idx.opts.MinimizerWindow = int(getUint32())
+	nSeq := int(getUint32())
+	if (idx.opts.K < 1) || (idx.opts.K > MaxKmerLength) {
+		return nil, errors.Errorf("OpenKmerIndex: invalid k-mer length %d", idx.opts.K)
+	}
+	for i := 0; i < nSeq; i++ {
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		n := int(getUint32())
+		if err := need(n); err != nil {
+			return nil, err
+		}
+		idx.seqNames = append(idx.seqNames, string(data[off:off+n]))
+		off += n
+	}
+	off = (off + 7) &^ 7
+	if err := need(16); err != nil {
+		return nil, err
+	}
+	nKmer := int(getUint64())
+	nPos := int(getUint64())
+	if err := need(8 * (2*nKmer + 1 + nPos)); err != nil {
+		return nil, err
+	}
+	arrays := uint64s(data[off : off+8*(2*nKmer+1+nPos)])
+	idx.kmers = arrays[:nKmer]
+	idx.offsets = arrays[nKmer : 2*nKmer+1]
+	idx.positions = arrays[2*nKmer+1:]
+	return idx, nil
+}
+
+// OpenKmerIndex memory-maps the index written by KmerIndex.Write to the local
+// file at path, so that it can be used without reading it first.  The index
+// must be closed with Close.
+func OpenKmerIndex(path string) (*KmerIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, errors.Errorf("OpenKmerIndex: %s is empty", path)
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrapf(err, "OpenKmerIndex: mmap %s", path)
+	}
+	idx, err := parseKmerIndex(data)
+	if err != nil {
+		_ = unix.Munmap(data)
+		return nil, errors.Wrap(err, path)
+	}
+	return idx, nil
+}
+
+// Close releases the memory map of an index opened by OpenKmerIndex.  It is
+// a no-op for an index built by NewKmerIndex.  The index can't be used
+// afterwards.
+func (idx *KmerIndex) Close() error {
+	if idx.mapped == nil {
+		return nil
+	}
+	err := unix.Munmap(idx.mapped)
+	idx.mapped, idx.kmers, idx.offsets, idx.positions = nil, nil, nil, nil
+	return err
+}
@@ -0,0 +1,129 @@
+package fasta_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/testutil/assert"
+)
+
+const kmerFastaData = `>s1
+ACGTTGCANACG
+>s2
+ttgca
+`
+
+func newKmerIndex(t *testing.T, data string, opts fasta.KmerIndexOpts) *fasta.KmerIndex {
+	fa, err := fasta.New(strings.NewReader(data))
+	assert.NoError(t, err)
+	idx, err := fasta.NewKmerIndex(fa, opts)
+	assert.NoError(t, err)
+	return idx
+}
+
+func TestKmerIndexLookup(t *testing.T) {
+	idx := newKmerIndex(t, kmerFastaData, fasta.KmerIndexOpts{K: 3})
+	assert.EQ(t, idx.SeqNames(), []string{"s1", "s2"})
+	assert.EQ(t, idx.K(), 3)
+	assert.EQ(t, idx.Lookup("ACG"), []fasta.Position{{0, 0, false}, {0, 9, false}})
+	assert.EQ(t, idx.Lookup("ttg"), []fasta.Position{{0, 3, false}, {1, 0, false}})
+	assert.True(t, idx.Lookup("CGT") != nil)
+	assert.True(t, idx.Lookup("AAA") == nil)
+	assert.True(t, idx.Lookup("CAN") == nil)
+	assert.True(t, idx.Lookup("AC") == nil)
+
+	idx = newKmerIndex(t, kmerFastaData, fasta.KmerIndexOpts{K: 3, Canonical: true})
+	assert.EQ(t, idx.Lookup("ACG"), []fasta.Position{{0, 0, false}, {0, 1, true}, {0, 9, false}})
+	assert.EQ(t, idx.Lookup("CGT"), []fasta.Position{{0, 0, true}, {0, 1, false}, {0, 9, true}})
+	assert.EQ(t, idx.Lookup("gca"), []fasta.Position{{0, 4, true}, {0, 5, false}, {1, 1, true}, {1, 2, false}})
+
+	fa, err := fasta.New(strings.NewReader(kmerFastaData))
+	assert.NoError(t, err)
+	for _, k := range []int{0, 33} {
+		_, err = fasta.NewKmerIndex(fa, fasta.KmerIndexOpts{K: k})
+		assert.HasSubstr(t, err.Error(), "invalid k-mer length")
+	}
+}
+
+func randomKmerFasta(r *rand.Rand, seqLens ...int) string {
+	var b strings.Builder
+	for i, n := range seqLens {
+		b.WriteString(">seq")
+		b.WriteByte(byte('0' + i))
+		b.WriteByte('\n')
+		for j := 0; j < n; j++ {
+			b.WriteByte("ACGT"[r.Intn(4)])
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func TestKmerIndexMinimizers(t *testing.T) {
+	const (
+		k = 11
+		w = 8
+		n = 5000
+	)
+	data := randomKmerFasta(rand.New(rand.NewSource(0)), n)
+	seq := strings.Split(data, "\n")[1]
+	full := newKmerIndex(t, data, fasta.KmerIndexOpts{K: k, Canonical: true})
+	idx := newKmerIndex(t, data, fasta.KmerIndexOpts{K: k, Canonical: true, MinimizerWindow: w, Parallelism: 2})
+	assert.True(t, idx.NumKmers() < full.NumKmers()/2)
+
+	indexed := make([]bool, n-k+1)
+	for i := range indexed {
+		for _, p := range idx.Lookup(seq[i : i+k]) {
+			assert.EQ(t, p.SeqIndex, 0)
+			indexed[p.Pos] = true
+		}
+	}
+	// Every window of w consecutive k-mers has an indexed minimizer.
+	for start := 0; start+w <= len(indexed); start++ {
+		found := false
+		for i := start; i < start+w; i++ {
+			found = found || indexed[i]
+		}
+		assert.True(t, found)
+	}
+}
+
+func TestKmerIndexWriteOpen(t *testing.T) {
+	const k = 7
+	data := randomKmerFasta(rand.New(rand.NewSource(1)), 3000, 1000)
+	idx := newKmerIndex(t, data, fasta.KmerIndexOpts{K: k, Canonical: true})
+
+	dir, err := ioutil.TempDir("", "kmerindex")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "index")
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.Write(f))
+	assert.NoError(t, f.Close())
+
+	mapped, err := fasta.OpenKmerIndex(path)
+	assert.NoError(t, err)
+	assert.EQ(t, mapped.K(), k)
+	assert.EQ(t, mapped.SeqNames(), []string{"seq0", "seq1"})
+	assert.EQ(t, mapped.NumKmers(), idx.NumKmers())
+	for _, seq := range strings.Split(data, "\n") {
+		if strings.HasPrefix(seq, ">") {
+			continue
+		}
+		for i := 0; i+k <= len(seq); i += 13 {
+			kmer := seq[i : i+k]
+			assert.EQ(t, mapped.Lookup(kmer), idx.Lookup(kmer), kmer)
+		}
+	}
+	assert.NoError(t, mapped.Close())
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("this is not an index, but it is long enough"), 0644))
+	_, err = fasta.OpenKmerIndex(path)
+	assert.HasSubstr(t, err.Error(), "not a k-mer index")
+}
@@ -0,0 +1,220 @@
+package fasta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/encoding/bgzf"
+)
+
+// DefaultLineWidth is the default number of bases per line of Writer.
+const DefaultLineWidth = 60
+
+// WriterOpts configures a Writer.
+type WriterOpts struct {
+	// LineWidth is the number of bases per line.  0 selects DefaultLineWidth.
+	LineWidth int
+	// BGZF causes the output to be bgzf-compressed, which samtools faidx can
+	// read with the .gzi index.
+	BGZF bool
+	// Index, if non-nil, receives the .fai index of the output when the
+	// Writer is closed.  As with samtools, the offsets are uncompressed
+	// offsets when BGZF is set.
+	Index io.Writer
+	// GZI, if non-nil, receives the .gzi index of the bgzf blocks of the
+	// output when the Writer is closed.  It requires BGZF.
+	GZI io.Writer
+}
+
+// gziEntry maps the start of a bgzf block to its uncompressed offset.
+type gziEntry struct {
+	compressed, uncompressed uint64
+}
+
+// Writer writes FASTA data, building its index as it goes.  Typical usage:
+//
+//   w, err := fasta.NewWriter(out, fasta.WriterOpts{Index: faiOut})
+//   w.StartSeq("chr1")
+//   w.Write(bases)
+//   ...
+//   err := w.Close()
+//
+// It is not safe for concurrent use.
+type Writer struct {
+	opts WriterOpts
+	raw  io.Writer
+	bw   *bgzf.Writer
+	// off is the number of (uncompressed) bytes written.
+	off     uint64
+	entries []indexEntry
+	gzi     []gziEntry
+	// col is the number of bases in the current line.
+	col     int
+	started bool
+	err     error
+}
+
+// NewWriter returns a Writer which writes to w.
+func NewWriter(w io.Writer, opts WriterOpts) (*Writer, error) {
+	if opts.LineWidth == 0 {
+		opts.LineWidth = DefaultLineWidth
+	}
+	if opts.LineWidth < 0 {
+		return nil, fmt.Errorf("fasta.NewWriter: invalid line width %d", opts.LineWidth)
+	}
+	if (opts.GZI != nil) && !opts.BGZF {
+		return nil, fmt.Errorf("fasta.NewWriter: a .gzi index requires bgzf compression")
+	}
+	fw := &Writer{opts: opts, raw: w}
+	if opts.BGZF {
+		var err error
+		if fw.bw, err = bgzf.NewWriter(w, 6); err != nil {
+			return nil, err
+		}
+	}
+	return fw, nil
+}
+
+// write writes b to the output.  With bgzf, each call to the bgzf writer
+// completes at most one block, so that the start of each block can be
+// recorded in the .gzi index; blocks are always full, except for the last.
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	if w.bw == nil {
+		_, w.err = w.raw.Write(b)
+		w.off += uint64(len(b))
+		return
+	}
+	for len(b) > 0 {
+		n := bgzf.DefaultUncompressedBlockSize - int(w.off%bgzf.DefaultUncompressedBlockSize)
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, w.err = w.bw.Write(b[:n]); w.err != nil {
+			return
+		}
+		b = b[n:]
+		w.off += uint64(n)
+		if w.off%bgzf.DefaultUncompressedBlockSize == 0 {
+			w.gzi = append(w.gzi, gziEntry{compressed: w.bw.VOffset() >> 16, uncompressed: w.off})
+		}
+	}
+}
+
+// endSeq ends the current sequence's last line, and fixes up its index
+// entry.
+func (w *Writer) endSeq() {
+	if !w.started {
+		return
+	}
+	if w.col > 0 {
+		w.write([]byte{'\n'})
+		w.col = 0
+	}
+	e := &w.entries[len(w.entries)-1]
+	switch {
+	case e.length == 0:
+		// As in GenerateIndex.
+		e.lineBase, e.lineWidth = 0, 0
+	case e.length < e.lineBase:
+		// A single short line, as samtools faidx describes it.
+		e.lineBase, e.lineWidth = e.length, e.length+1
+	}
+}
+
+// StartSeq ends the current sequence, if any, and starts a new one.  name
+// must not contain whitespace.
+func (w *Writer) StartSeq(name string) error {
+	if (name == "") || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("fasta.Writer: invalid sequence name %q", name)
+	}
+	w.endSeq()
+	w.write([]byte(">" + name + "\n"))
+	w.entries = append(w.entries, indexEntry{
+		name:      name,
+		offset:    w.off,
+		lineBase:  uint64(w.opts.LineWidth),
+		lineWidth: uint64(w.opts.LineWidth) + 1,
+	})
+	w.started = true
+	return w.err
+}
+
+// Write appends bases to the current sequence, wrapping lines at
+// WriterOpts.LineWidth.  It implements io.Writer.
+func (w *Writer) Write(bases []byte) (int, error) {
+	if !w.started {
+		return 0, fmt.Errorf("fasta.Writer: Write called before StartSeq")
+	}
+	n := len(bases)
+	for len(bases) > 0 && w.err == nil {
+		m := w.opts.LineWidth - w.col
+		if m > len(bases) {
+			m = len(bases)
+		}
+		w.write(bases[:m])
+		bases = bases[m:]
+		if w.col += m; w.col == w.opts.LineWidth {
+			w.write([]byte{'\n'})
+			w.col = 0
+		}
+	}
+	w.entries[len(w.entries)-1].length += uint64(n)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return n, nil
+}
+
+// Close ends the last sequence, finishes the bgzf stream, and writes the
+// indexes.  It doesn't close the underlying writers.
+func (w *Writer) Close() error {
+	w.endSeq()
+	w.started = false
+	if w.err != nil {
+		return w.err
+	}
+	if w.bw != nil {
+		if err := w.bw.Close(); err != nil {
+			return err
+		}
+	}
+	if w.opts.Index != nil {
+		tw := tsv.NewWriter(w.opts.Index)
+		for _, e := range w.entries {
+			tw.WriteString(e.name)
+			tw.WriteInt64(int64(e.length))
+			tw.WriteInt64(int64(e.offset))
+			tw.WriteInt64(int64(e.lineBase))
+			tw.WriteInt64(int64(e.lineWidth))
+			if err := tw.EndLine(); err != nil {
+				return err
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if w.opts.GZI != nil {
+		// The last block boundary is the end of the file, not a block.
+		gzi := w.gzi
+		if (len(gzi) > 0) && (gzi[len(gzi)-1].uncompressed == w.off) {
+			gzi = gzi[:len(gzi)-1]
+		}
+		b := make([]byte, 8*(1+2*len(gzi)))
+		binary.LittleEndian.PutUint64(b, uint64(len(gzi)))
+		for i, e := range gzi {
+			binary.LittleEndian.PutUint64(b[8+16*i:], e.compressed)
+			binary.LittleEndian.PutUint64(b[16+16*i:], e.uncompressed)
+		}
+		if _, err := w.opts.GZI.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package fastq
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/klauspost/compress/gzip"
+)
+
+// ErrNameMismatch is returned by PairReader when the names of the reads of
+// a pair differ.
+var ErrNameMismatch = errors.New("mismatched FASTQ read names")
+
+// readAheadChunkSize is the size of the chunks of decompressed data passed
+// from a decompression goroutine to the parser.
+const readAheadChunkSize = 1 << 20
+
+// PairReaderOpts configures a PairReader.
+type PairReaderOpts struct {
+	// Fields is the set of fields to fill in the reads.  0 selects All.  ID
+	// is always read, unless SkipNameCheck is set.
+	Fields Field
+	// Parallelism is the number of goroutines decompressing the blocks of
+	// each bgzf input.  0 selects runtime.NumCPU().
+	Parallelism int
+	// SkipNameCheck disables the check that the reads of each pair have the
+	// same name.
+	SkipNameCheck bool
+}
+
+// PairReader reads R1 and R2 FASTQ streams in lockstep, validating that they
+// have the same number of reads, and that the reads of each pair have the
+// same name.  Alternatively, it reads the pairs of a single interleaved
+// stream, where each R1 read is followed by its R2 read.  Each input may be
+// plain text, gzip, bgzf or bzip2; each is decompressed on its own
+// goroutines, in chunks, ahead of parsing, and the blocks of bgzf input are
+// decompressed in parallel.  It is not safe for concurrent use.
+type PairReader struct {
+	opts PairReaderOpts
+	// r1 and r2 are the same scanner for an interleaved stream.
+	r1, r2 *Scanner
+	// closers are closed by Close, in reverse order.
+	closers []func() error
+	nPair   int64
+	err     error
+}
+
+// NewPairReader creates a PairReader for the (possibly compressed) R1 and R2
+// streams.
+func NewPairReader(r1, r2 io.Reader, opts PairReaderOpts) (*PairReader, error) {
+	p := newPairReader(opts)
+	d1, err := p.decompress(r1)
+	if err != nil {
+		p.Close() // nolint: errcheck
+		return nil, err
+	}
+	d2, err := p.decompress(r2)
+	if err != nil {
+		p.Close() // nolint: errcheck
+		return nil, err
+	}
+	p.r1 = NewScanner(d1, p.opts.Fields)
+	p.r2 = NewScanner(d2, p.opts.Fields)
+	return p, nil
+}
+
+// NewInterleavedPairReader creates a PairReader for a (possibly compressed)
+// interleaved stream.  ReadPair returns ErrDiscordant if the stream has an
+// odd number of reads.
+func NewInterleavedPairReader(r io.Reader, opts PairReaderOpts) (*PairReader, error) {
+	p := newPairReader(opts)
+	d, err := p.decompress(r)
+	if err != nil {
+		p.Close() // nolint: errcheck
+		return nil, err
+	}
+	p.r1 = NewScanner(d, p.opts.Fields)
+	p.r2 = p.r1
+	return p, nil
+}
+
+func newPairReader(opts PairReaderOpts) *PairReader {
+	if opts.Fields == 0 {
+		opts.Fields = All
+	}
+	if !opts.SkipNameCheck {
+		opts.Fields |= ID
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.NumCPU()
+	}
+	return &PairReader{opts: opts}
+}
+
+// OpenPair opens the R1 and R2 FASTQ files at the given paths with a
+// PairReader.  Close closes the files.
+func OpenPair(ctx context.Context, r1Path, r2Path string, opts PairReaderOpts) (*PairReader, error) {
+	f1, err := file.Open(ctx, r1Path)
+	if err != nil {
+		return nil, err
+	}
+	f2, err := file.Open(ctx, r2Path)
+	if err != nil {
+		f1.Close(ctx) // nolint: errcheck
+		return nil, err
+	}
+	p, err := NewPairReader(f1.Reader(ctx), f2.Reader(ctx), opts)
+	if err != nil {
+		f1.Close(ctx) // nolint: errcheck
+		f2.Close(ctx) // nolint: errcheck
+		return nil, err
+	}
+	// The files must be closed after the readers which use them.
+	p.closers = append([]func() error{
+		func() error { return f1.Close(ctx) },
+		func() error { return f2.Close(ctx) },
+	}, p.closers...)
+	return p, nil
+}
+
+// OpenInterleaved opens the interleaved FASTQ file at the given path with a
+// PairReader.  Close closes the file.
+func OpenInterleaved(ctx context.Context, path string, opts PairReaderOpts) (*PairReader, error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewInterleavedPairReader(f.Reader(ctx), opts)
+	if err != nil {
+		f.Close(ctx) // nolint: errcheck
+		return nil, err
+	}
+	p.closers = append([]func() error{func() error { return f.Close(ctx) }}, p.closers...)
+	return p, nil
+}
+
+// decompress detects the compression of r from its magic bytes, and returns
+// a reader of its decompressed contents, which are read ahead on another
+// goroutine.
+func (p *PairReader) decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	magic, err := br.Peek(16)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var d io.Reader = br
+	switch {
+	case isBGZF(magic):
+		bg, err := bgzf.NewReader(br, p.opts.Parallelism)
+		if err != nil {
+			return nil, err
+		}
+		p.closers = append(p.closers, bg.Close)
+		d = bg
+	case (len(magic) >= 2) && (magic[0] == 0x1f) && (magic[1] == 0x8b):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		p.closers = append(p.closers, gz.Close)
+		d = gz
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		d = bzip2.NewReader(br)
+	}
+	ra := newReadAhead(d)
+	p.closers = append(p.closers, ra.close)
+	return ra, nil
+}
+
+// isBGZF returns true if magic starts with a gzip header with the bgzf
+// "BC" extra subfield.
+func isBGZF(magic []byte) bool {
+	return (len(magic) >= 14) && (magic[0] == 0x1f) && (magic[1] == 0x8b) &&
+		(magic[3]&4 != 0) && (magic[12] == 'B') && (magic[13] == 'C')
+}
+
+// pairName returns the name of a read from its ID line, without the leading
+// '@', the comment, or a trailing "/1" or "/2".
+func pairName(id string) string {
+	if i := strings.IndexAny(id, " \t"); i >= 0 {
+		id = id[:i]
+	}
+	if len(id) > 0 && id[0] == '@' {
+		id = id[1:]
+	}
+	if n := len(id); (n >= 2) && (id[n-2] == '/') && ((id[n-1] == '1') || (id[n-1] == '2')) {
+		id = id[:n-2]
+	}
+	return id
+}
+
+// ReadPair reads the next pair into r1 and r2.  It returns io.EOF after the
+// last pair, ErrDiscordant if one input ends before the other (or an
+// interleaved input ends after an R1 read), and
+// ErrNameMismatch, with the mismatched reads in r1 and r2, if the reads'
+// names differ.  Once ReadPair returns an error, it returns the same error
+// on every call.
+func (p *PairReader) ReadPair(r1, r2 *Read) error {
+	if p.err != nil {
+		return p.err
+	}
+	ok1 := p.r1.Scan(r1)
+	ok2 := p.r2.Scan(r2)
+	switch {
+	case !ok1 || !ok2:
+		if p.err = p.r1.Err(); p.err == nil {
+			if p.err = p.r2.Err(); p.err == nil {
+				p.err = io.EOF
+				if ok1 != ok2 {
+					p.err = ErrDiscordant
+				}
+			}
+		}
+	case !p.opts.SkipNameCheck && (pairName(r1.ID) != pairName(r2.ID)):
+		p.err = ErrNameMismatch
+	default:
+		p.nPair++
+	}
+	return p.err
+}
+
+// NumPairs returns the number of pairs read successfully.
+func (p *PairReader) NumPairs() int64 {
+	return p.nPair
+}
+
+// Close releases the reader's resources, and closes the files opened by
+// OpenPair.
+func (p *PairReader) Close() error {
+	var err error
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if e := p.closers[i](); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.closers = nil
+	return err
+}
+
+// readAhead reads from r on a separate goroutine, in chunks, so that
+// decompression overlaps with parsing.
+type readAhead struct {
+	ch   chan readAheadChunk
+	done chan struct{}
+	cur  []byte
+	err  error
+}
+
+type readAheadChunk struct {
+	data []byte
+	err  error
+}
+
+func newReadAhead(r io.Reader) *readAhead {
+	ra := &readAhead{ch: make(chan readAheadChunk, 4), done: make(chan struct{})}
+	go func() {
+		defer close(ra.ch)
+		for {
+			buf := make([]byte, readAheadChunkSize)
+			n, err := io.ReadFull(r, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			select {
+			case ra.ch <- readAheadChunk{buf[:n], err}:
+			case <-ra.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ra
+}
+
+// Read implements io.Reader.
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		if ra.err != nil {
+			return 0, ra.err
+		}
+		c, ok := <-ra.ch
+		if !ok {
+			ra.err = io.EOF
+			continue
+		}
+		ra.cur, ra.err = c.data, c.err
+	}
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+// close stops the read-ahead goroutine, and waits for it to exit, so that
+// the underlying reader can be closed.
+func (ra *readAhead) close() error {
+	close(ra.done)
+	for range ra.ch {
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package fastq_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/bgzf"
+	"github.com/grailbio/bio/encoding/fastq"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+// pairFASTQ returns the R1 and R2 FASTQ data of n pairs.  The read names
+// have "/1" and "/2" suffixes, and R2 also has comments.  rename, if
+// non-nil, changes the R2 name of some pairs.
+func pairFASTQ(n int, rename func(i int) string) (r1, r2 []byte) {
+	var b1, b2 bytes.Buffer
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("pair%d", i)
+		fmt.Fprintf(&b1, "@%s/1\nACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTAC\n+\nEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEE\n", name)
+		if rename != nil {
+			name = rename(i)
+		}
+		fmt.Fprintf(&b2, "@%s/2 2:N:0:ATCACG\nTTTTGGGGCCCCAAAATTTTGGGGCCCCAAAATTTTGGGGCCCCAAAATT\n+\nAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\n", name)
+	}
+	return b1.Bytes(), b2.Bytes()
+}
+
+func compressGzip(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func compressBGZF(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := bgzf.NewWriter(&buf, 6)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// readAllPairs reads pairs until an error, and returns the number of pairs
+// and the error.
+func readAllPairs(t *testing.T, p *fastq.PairReader) (int, error) {
+	var r1, r2 fastq.Read
+	n := 0
+	for {
+		if err := p.ReadPair(&r1, &r2); err != nil {
+			return n, err
+		}
+		expect.EQ(t, r1.ID, fmt.Sprintf("@pair%d/1", n))
+		expect.EQ(t, r2.Seq[:4], "TTTT")
+		n++
+	}
+}
+
+func TestPairReader(t *testing.T) {
+	// Enough data for several read-ahead chunks and bgzf blocks.
+	const nPair = 20000
+	r1, r2 := pairFASTQ(nPair, nil)
+	for _, test := range []struct {
+		name     string
+		compress func(t *testing.T, data []byte) []byte
+	}{
+		{"plain", func(t *testing.T, data []byte) []byte { return data }},
+		{"gzip", compressGzip},
+		{"bgzf", compressBGZF},
+	} {
+		p, err := fastq.NewPairReader(bytes.NewReader(test.compress(t, r1)), bytes.NewReader(test.compress(t, r2)), fastq.PairReaderOpts{Parallelism: 2})
+		assert.NoError(t, err)
+		n, err := readAllPairs(t, p)
+		expect.EQ(t, err, io.EOF, test.name)
+		expect.EQ(t, n, nPair, test.name)
+		expect.EQ(t, p.NumPairs(), int64(nPair), test.name)
+		assert.NoError(t, p.Close())
+	}
+}
+
+func TestPairReaderErrors(t *testing.T) {
+	r1, r2 := pairFASTQ(10, nil)
+	// R2 is missing its last read.
+	short := r2[:bytes.LastIndex(r2, []byte("@pair9"))]
+	p, err := fastq.NewPairReader(bytes.NewReader(r1), bytes.NewReader(short), fastq.PairReaderOpts{})
+	assert.NoError(t, err)
+	n, err := readAllPairs(t, p)
+	expect.EQ(t, err, fastq.ErrDiscordant)
+	expect.EQ(t, n, 9)
+	assert.NoError(t, p.Close())
+
+	rename := func(i int) string {
+		if i == 3 {
+			return "other"
+		}
+		return fmt.Sprintf("pair%d", i)
+	}
+	r1, r2 = pairFASTQ(10, rename)
+	p, err = fastq.NewPairReader(bytes.NewReader(r1), bytes.NewReader(r2), fastq.PairReaderOpts{})
+	assert.NoError(t, err)
+	n, err = readAllPairs(t, p)
+	expect.EQ(t, err, fastq.ErrNameMismatch)
+	expect.EQ(t, n, 3)
+	// The error is sticky.
+	var read1, read2 fastq.Read
+	expect.EQ(t, p.ReadPair(&read1, &read2), fastq.ErrNameMismatch)
+	assert.NoError(t, p.Close())
+
+	p, err = fastq.NewPairReader(bytes.NewReader(r1), bytes.NewReader(r2), fastq.PairReaderOpts{SkipNameCheck: true})
+	assert.NoError(t, err)
+	n, err = readAllPairs(t, p)
+	expect.EQ(t, err, io.EOF)
+	expect.EQ(t, n, 10)
+	assert.NoError(t, p.Close())
+}
+
+func TestOpenPair(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	r1, r2 := pairFASTQ(100, nil)
+	r1Path := filepath.Join(tmpdir, "r1.fastq.gz")
+	r2Path := filepath.Join(tmpdir, "r2.fastq.gz")
+	assert.NoError(t, ioutil.WriteFile(r1Path, compressGzip(t, r1), 0600))
+	assert.NoError(t, ioutil.WriteFile(r2Path, compressBGZF(t, r2), 0600))
+	p, err := fastq.OpenPair(context.Background(), r1Path, r2Path, fastq.PairReaderOpts{Fields: fastq.Seq})
+	assert.NoError(t, err)
+	n, err := readAllPairs(t, p)
+	expect.EQ(t, err, io.EOF)
+	expect.EQ(t, n, 100)
+	assert.NoError(t, p.Close())
+}
+
+// interleave returns the interleaved FASTQ data of R1 and R2 data.
+func interleave(r1, r2 []byte) []byte {
+	l1 := bytes.SplitAfter(r1, []byte("\n"))
+	l2 := bytes.SplitAfter(r2, []byte("\n"))
+	var buf bytes.Buffer
+	for i := 0; i+4 <= len(l1); i += 4 {
+		buf.Write(bytes.Join(l1[i:i+4], nil))
+		buf.Write(bytes.Join(l2[i:i+4], nil))
+	}
+	return buf.Bytes()
+}
+
+func TestInterleavedPairReader(t *testing.T) {
+	const nPair = 20000
+	data := interleave(pairFASTQ(nPair, nil))
+	for _, test := range []struct {
+		name     string
+		compress func(t *testing.T, data []byte) []byte
+	}{
+		{"plain", func(t *testing.T, data []byte) []byte { return data }},
+		{"gzip", compressGzip},
+		{"bgzf", compressBGZF},
+	} {
+		p, err := fastq.NewInterleavedPairReader(bytes.NewReader(test.compress(t, data)), fastq.PairReaderOpts{Parallelism: 2})
+		assert.NoError(t, err)
+		n, err := readAllPairs(t, p)
+		expect.EQ(t, err, io.EOF, test.name)
+		expect.EQ(t, n, nPair, test.name)
+		assert.NoError(t, p.Close())
+	}
+
+	// The last R2 read is missing.
+	short := data[:bytes.LastIndex(data, []byte("@pair9999/2"))]
+	p, err := fastq.NewInterleavedPairReader(bytes.NewReader(short), fastq.PairReaderOpts{})
+	assert.NoError(t, err)
+	n, err := readAllPairs(t, p)
+	expect.EQ(t, err, fastq.ErrDiscordant)
+	expect.EQ(t, n, 9999)
+	assert.NoError(t, p.Close())
+
+	// An R2 read is missing in the middle, so the pairs are misaligned.
+	mid := bytes.Index(data, []byte("@pair5/2"))
+	skipped := append(append([]byte(nil), data[:mid]...), data[bytes.Index(data, []byte("@pair6/1")):]...)
+	p, err = fastq.NewInterleavedPairReader(bytes.NewReader(skipped), fastq.PairReaderOpts{})
+	assert.NoError(t, err)
+	n, err = readAllPairs(t, p)
+	expect.EQ(t, err, fastq.ErrNameMismatch)
+	expect.EQ(t, n, 5)
+	assert.NoError(t, p.Close())
+}
+
+func TestOpenInterleaved(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(tmpdir, "interleaved.fastq.gz")
+	assert.NoError(t, ioutil.WriteFile(path, compressBGZF(t, interleave(pairFASTQ(100, nil))), 0600))
+	p, err := fastq.OpenInterleaved(context.Background(), path, fastq.PairReaderOpts{Fields: fastq.Seq})
+	assert.NoError(t, err)
+	n, err := readAllPairs(t, p)
+	expect.EQ(t, err, io.EOF)
+	expect.EQ(t, n, 100)
+	assert.NoError(t, p.Close())
+}
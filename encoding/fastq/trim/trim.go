@@ -0,0 +1,362 @@
+// Package trim implements adapter and quality trimming of FASTQ reads.
+//
+// Adapters are located by semi-global alignment against the 3' end of each
+// read, so that both complete adapter occurrences and adapter prefixes that
+// run off the end of the read are found.  For read pairs, adapter read-through
+// is also detected from the overlap between read 1 and the reverse complement
+// of read 2, which finds adapters even when their sequence is unknown.
+package trim
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/bio/encoding/fastq"
+)
+
+// Adapter is a sequence which may be ligated to the 3' end of reads.  'N'
+// matches any base.
+type Adapter struct {
+	Name string
+	Seq  string
+}
+
+var (
+	// TruSeqAdapter is the common prefix of the Illumina TruSeq read 1 and
+	// read 2 adapters.
+	TruSeqAdapter = Adapter{"truseq", "AGATCGGAAGAGC"}
+	// NexteraAdapter is the Illumina Nextera transposase adapter.
+	NexteraAdapter = Adapter{"nextera", "CTGTCTCTTATACACATCT"}
+	// SmallRNAAdapter is the Illumina small RNA 3' adapter.
+	SmallRNAAdapter = Adapter{"small-rna", "TGGAATTCTCGG"}
+)
+
+// Opts configures a Trimmer.
+type Opts struct {
+	// Adapters are searched for in each read; the match closest to the 5'
+	// end wins.
+	Adapters []Adapter
+	// MaxErrorRate is the maximum number of edits per aligned adapter base,
+	// and the maximum mismatch rate of a read-pair overlap.
+	MaxErrorRate float64
+	// MinAdapterOverlap is the minimum number of adapter bases that must
+	// align to the end of a read for it to be trimmed.
+	MinAdapterOverlap int
+	// QualCutoff, if positive, causes low-quality 3' ends to be trimmed with
+	// the BWA algorithm: the read is cut at the position which maximizes the
+	// sum of (QualCutoff - qual) over the removed bases.
+	QualCutoff int
+	// QualOffset is the ASCII offset of the quality scores.
+	QualOffset int
+	// MinLength is the minimum length of a read after trimming.  For pairs,
+	// both reads must be at least this long.
+	MinLength int
+	// MinPairOverlap is the minimum overlap between read 1 and the reverse
+	// complement of read 2 for the pair to be treated as reading through
+	// into the adapters.  Zero disables overlap-based trimming.
+	MinPairOverlap int
+}
+
+// DefaultOpts are the default trimming options.
+var DefaultOpts = Opts{
+	Adapters:          []Adapter{TruSeqAdapter},
+	MaxErrorRate:      0.1,
+	MinAdapterOverlap: 3,
+	QualOffset:        33,
+	MinPairOverlap:    10,
+}
+
+// Stats counts what a Trimmer has done.
+type Stats struct {
+	// Reads is the number of reads (not pairs) examined.
+	Reads int64
+	// AdapterTrimmed is the number of reads trimmed because of an adapter
+	// match.
+	AdapterTrimmed int64
+	// OverlapTrimmed is the number of reads trimmed because their pair
+	// overlapped past the end of the insert.
+	OverlapTrimmed int64
+	// QualTrimmed is the number of reads with low-quality 3' ends removed.
+	QualTrimmed int64
+	// TooShort is the number of reads rejected for being shorter than
+	// MinLength after trimming.  For pairs, both reads are counted.
+	TooShort int64
+	// BasesRemoved is the total number of trimmed bases.
+	BasesRemoved int64
+}
+
+// Trimmer trims reads.  It is not thread-safe; use one Trimmer per
+// goroutine, and add up their Stats.
+type Trimmer struct {
+	opts     Opts
+	adapters [][]byte
+	stats    Stats
+
+	seq1, seq2 []byte
+	cost       []int
+	start      []int
+}
+
+// New creates a Trimmer.
+func New(opts Opts) (*Trimmer, error) {
+	if (opts.MaxErrorRate < 0) || (opts.MaxErrorRate >= 1) {
+		return nil, fmt.Errorf("trim.New: invalid MaxErrorRate %v", opts.MaxErrorRate)
+	}
+	if opts.MinAdapterOverlap < 1 {
+		return nil, fmt.Errorf("trim.New: MinAdapterOverlap must be positive")
+	}
+	if (opts.QualCutoff < 0) || (opts.MinLength < 0) || (opts.MinPairOverlap < 0) {
+		return nil, fmt.Errorf("trim.New: QualCutoff, MinLength and MinPairOverlap must be nonnegative")
+	}
+	t := &Trimmer{opts: opts}
+	maxLen := 0
+	for _, a := range opts.Adapters {
+		if len(a.Seq) == 0 {
+			return nil, fmt.Errorf("trim.New: adapter %q is empty", a.Name)
+		}
+		seq := []byte(a.Seq)
+		biosimd.CleanASCIISeqInplace(seq)
+		t.adapters = append(t.adapters, seq)
+		if len(seq) > maxLen {
+			maxLen = len(seq)
+		}
+	}
+	t.cost = make([]int, maxLen+1)
+	t.start = make([]int, maxLen+1)
+	return t, nil
+}
+
+// Stats returns the counts accumulated so far.
+func (t *Trimmer) Stats() Stats {
+	return t.stats
+}
+
+// Trim trims a single-end read in place.  It returns false if the read is
+// shorter than MinLength afterward.
+func (t *Trimmer) Trim(r *fastq.Read) bool {
+	t.stats.Reads++
+	t.seq1 = normalize(t.seq1, r.Seq)
+	t.trimAdapters(r, t.seq1)
+	t.trimQual(r)
+	if len(r.Seq) < t.opts.MinLength {
+		t.stats.TooShort++
+		return false
+	}
+	return true
+}
+
+// TrimPair trims both reads of a pair in place.  If the pair overlaps
+// enough to show that the insert is shorter than the reads, both are cut to
+// the insert length; otherwise each read is searched for adapters
+// separately.  It returns false if either read is shorter than MinLength
+// afterward.
+func (t *Trimmer) TrimPair(r1, r2 *fastq.Read) bool {
+	t.stats.Reads += 2
+	t.seq1 = normalize(t.seq1, r1.Seq)
+	t.seq2 = normalize(t.seq2, r2.Seq)
+	if n := t.insertLen(); n >= 0 {
+		for _, r := range [2]*fastq.Read{r1, r2} {
+			if n < len(r.Seq) {
+				t.stats.OverlapTrimmed++
+				t.stats.BasesRemoved += int64(len(r.Seq) - n)
+				r.Trim(n)
+			}
+		}
+	} else {
+		// insertLen reverse-complemented t.seq2.
+		t.seq2 = normalize(t.seq2, r2.Seq)
+		t.trimAdapters(r1, t.seq1)
+		t.trimAdapters(r2, t.seq2)
+	}
+	t.trimQual(r1)
+	t.trimQual(r2)
+	if (len(r1.Seq) < t.opts.MinLength) || (len(r2.Seq) < t.opts.MinLength) {
+		t.stats.TooShort += 2
+		return false
+	}
+	return true
+}
+
+// normalize copies seq to buf, capitalizing it and replacing non-ACGT bases
+// with 'N'.
+func normalize(buf []byte, seq string) []byte {
+	buf = append(buf[:0], seq...)
+	biosimd.CleanASCIISeqInplace(buf)
+	return buf
+}
+
+func (t *Trimmer) trimAdapters(r *fastq.Read, seq []byte) {
+	best := len(seq)
+	for _, adapter := range t.adapters {
+		if pos := t.findAdapter(seq[:best], adapter); pos >= 0 {
+			best = pos
+		}
+	}
+	if best < len(seq) {
+		t.stats.AdapterTrimmed++
+		t.stats.BasesRemoved += int64(len(seq) - best)
+		r.Trim(best)
+	}
+}
+
+func (t *Trimmer) trimQual(r *fastq.Read) {
+	if t.opts.QualCutoff <= 0 {
+		return
+	}
+	if n := QualTrimLen(r.Qual, t.opts.QualCutoff, t.opts.QualOffset); n < len(r.Seq) {
+		t.stats.QualTrimmed++
+		t.stats.BasesRemoved += int64(len(r.Seq) - n)
+		r.Trim(n)
+	}
+}
+
+// insertLen returns the insert length of the pair in t.seq1 and t.seq2, if
+// they read through into the adapters, and -1 otherwise.  t.seq2 is
+// reverse-complemented.
+func (t *Trimmer) insertLen() int {
+	if t.opts.MinPairOverlap == 0 {
+		return -1
+	}
+	len1, len2 := len(t.seq1), len(t.seq2)
+	maxN := len1
+	if len2 < maxN {
+		maxN = len2
+	}
+	if maxN == len1 && maxN == len2 {
+		// An insert as long as both reads doesn't need trimming.
+		maxN--
+	}
+	biosimd.ReverseComp8InplaceNoValidate(t.seq2)
+	// If the insert is n bases long, read 1's first n bases are the reverse
+	// complement of read 2's first n bases.
+	bestN, bestRate := -1, t.opts.MaxErrorRate
+	for n := t.opts.MinPairOverlap; n <= maxN; n++ {
+		maxMismatch := int(t.opts.MaxErrorRate * float64(n))
+		if m := mismatches(t.seq1[:n], t.seq2[len2-n:], maxMismatch); m <= maxMismatch {
+			if rate := float64(m) / float64(n); rate <= bestRate {
+				bestN, bestRate = n, rate
+			}
+		}
+	}
+	return bestN
+}
+
+// mismatches returns the number of mismatching positions between a and b,
+// or some value greater than limit if there are more than limit.  'N' never
+// matches.
+func mismatches(a, b []byte, limit int) int {
+	if bytes.Equal(a, b) && (bytes.IndexByte(a, 'N') < 0) {
+		return 0
+	}
+	n := 0
+	for i := range a {
+		if (a[i] != b[i]) || (a[i] == 'N') {
+			n++
+			if n > limit {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// FindAdapter returns the position in seq of the leftmost semi-global
+// alignment of adapter, or -1 if there is none.  The alignment may either
+// contain the entire adapter, or run off the end of seq after at least
+// minOverlap adapter bases; in both cases, at most maxErrorRate edits per
+// aligned adapter base are allowed.  seq must be capitalized, with non-ACGT
+// bases replaced by 'N'; 'N' in adapter matches any base.
+func FindAdapter(seq, adapter []byte, maxErrorRate float64, minOverlap int) int {
+	t := Trimmer{
+		opts:  Opts{MaxErrorRate: maxErrorRate, MinAdapterOverlap: minOverlap},
+		cost:  make([]int, len(adapter)+1),
+		start: make([]int, len(adapter)+1),
+	}
+	return t.findAdapter(seq, adapter)
+}
+
+func (t *Trimmer) findAdapter(seq, adapter []byte) int {
+	// Exact matches of the whole adapter are common, and bytes.Index is far
+	// cheaper than the alignment.
+	exact := -1
+	if bytes.IndexByte(adapter, 'N') < 0 {
+		exact = bytes.Index(seq, adapter)
+	}
+
+	// cost[i] is the edit distance of the best alignment of adapter[:i]
+	// ending at the current position of seq, and start[i] is the position in
+	// seq where that alignment starts.  Leading seq bases are free, so
+	// cost[0] is always zero.
+	m := len(adapter)
+	cost, start := t.cost[:m+1], t.start[:m+1]
+	for i := range cost {
+		cost[i] = i
+		start[i] = 0
+	}
+	best, bestCost := -1, 0
+	consider := func(pos, c, nAligned int) {
+		if c > int(t.opts.MaxErrorRate*float64(nAligned)) {
+			return
+		}
+		if (best < 0) || (pos < best) || ((pos == best) && (c < bestCost)) {
+			best, bestCost = pos, c
+		}
+	}
+	for j := 1; j <= len(seq); j++ {
+		if (exact >= 0) && (j > exact+m) {
+			// Later alignments can't start before the exact match.
+			break
+		}
+		b := seq[j-1]
+		diag, diagStart := cost[0], start[0]
+		cost[0], start[0] = 0, j
+		for i := 1; i <= m; i++ {
+			c, s := diag, diagStart
+			if (adapter[i-1] != b) && (adapter[i-1] != 'N') {
+				c++
+			}
+			if cost[i-1]+1 < c {
+				// Adapter base missing from seq.
+				c, s = cost[i-1]+1, start[i-1]
+			}
+			if cost[i]+1 < c {
+				// Extra base in seq.
+				c, s = cost[i]+1, start[i]
+			}
+			diag, diagStart = cost[i], start[i]
+			cost[i], start[i] = c, s
+		}
+		consider(start[m], cost[m], m)
+	}
+	if exact >= 0 {
+		if (best < 0) || (best > exact) {
+			return exact
+		}
+		return best
+	}
+	// Partial adapters running off the end of seq.
+	for i := t.opts.MinAdapterOverlap; i < m; i++ {
+		consider(start[i], cost[i], i)
+	}
+	return best
+}
+
+// QualTrimLen returns the length that qual should be cut to, using the BWA
+// 3' quality trimming algorithm with the given cutoff.  qualOffset is the
+// ASCII offset of the quality scores (usually 33).
+func QualTrimLen(qual string, cutoff, qualOffset int) int {
+	n := len(qual)
+	sum, maxSum := 0, 0
+	for i := len(qual) - 1; i >= 0; i-- {
+		sum += cutoff - (int(qual[i]) - qualOffset)
+		if sum < 0 {
+			break
+		}
+		if sum > maxSum {
+			maxSum = sum
+			n = i
+		}
+	}
+	return n
+}
@@ -0,0 +1,105 @@
+package trim_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/fastq"
+	"github.com/grailbio/bio/encoding/fastq/trim"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+const truSeq = "AGATCGGAAGAGC"
+
+func TestFindAdapter(t *testing.T) {
+	tests := []struct {
+		seq        string
+		minOverlap int
+		want       int
+	}{
+		// Whole adapter.
+		{"ACGTACGTAC" + truSeq + "TTTT", 3, 10},
+		// One mismatch.
+		{"ACGTACGTAC" + "AGATCGCAAGAGC" + "TTTT", 3, 10},
+		// One deleted base.
+		{"ACGTACGTAC" + "AGATCGAAGAGC" + "TTTT", 3, 10},
+		// Two mismatches are too many for 13 bases.
+		{"ACGTACGTAC" + "AGTTCGCAAGAGC" + "TTTT", 3, -1},
+		// Adapter prefix at the end of the read.
+		{"ACGTACGTAC" + "AGATC", 3, 10},
+		{"ACGTACGTAC" + "AGATC", 6, -1},
+		{"ACGTACGTAC", 3, -1},
+	}
+	for _, test := range tests {
+		got := trim.FindAdapter([]byte(test.seq), []byte(truSeq), 0.1, test.minOverlap)
+		expect.EQ(t, got, test.want, "seq %s", test.seq)
+	}
+}
+
+func TestQualTrimLen(t *testing.T) {
+	// 'I' is quality 40 and '#' is quality 2.
+	expect.EQ(t, trim.QualTrimLen("IIIII###", 20, 33), 5)
+	// A base at the cutoff doesn't stop the trimming.
+	expect.EQ(t, trim.QualTrimLen("IIIII#5##", 20, 33), 5)
+	expect.EQ(t, trim.QualTrimLen("IIIII", 20, 33), 5)
+	expect.EQ(t, trim.QualTrimLen("###", 20, 33), 0)
+}
+
+func TestTrim(t *testing.T) {
+	opts := trim.DefaultOpts
+	opts.QualCutoff = 20
+	opts.MinLength = 5
+	tr, err := trim.New(opts)
+	assert.NoError(t, err)
+
+	r := fastq.Read{ID: "@r1", Seq: "acgtacgtac" + truSeq, Unk: "+", Qual: strings.Repeat("I", 23)}
+	expect.True(t, tr.Trim(&r))
+	expect.EQ(t, r.Seq, "acgtacgtac")
+	expect.EQ(t, r.Qual, strings.Repeat("I", 10))
+
+	r = fastq.Read{ID: "@r2", Seq: "ACGTACGTAC", Unk: "+", Qual: "III#######"}
+	expect.False(t, tr.Trim(&r))
+	expect.EQ(t, r.Seq, "ACG")
+
+	expect.EQ(t, tr.Stats(), trim.Stats{
+		Reads:          2,
+		AdapterTrimmed: 1,
+		QualTrimmed:    1,
+		TooShort:       1,
+		BasesRemoved:   20,
+	})
+
+	opts.MaxErrorRate = 1
+	_, err = trim.New(opts)
+	expect.NotNil(t, err)
+}
+
+func TestTrimPair(t *testing.T) {
+	const (
+		insert   = "GATTACACCGTAGGCTTAACGGATCCATGA"
+		insertRC = "TCATGGATCCGTTAAGCCTACGGTGTAATC"
+	)
+	// The adapters are unknown to the trimmer, so only the overlap can find
+	// them.
+	opts := trim.DefaultOpts
+	opts.Adapters = nil
+	tr, err := trim.New(opts)
+	assert.NoError(t, err)
+
+	r1 := fastq.Read{ID: "@p1", Seq: insert + "CTGTCTCTTA", Unk: "+", Qual: strings.Repeat("I", 40)}
+	r2 := fastq.Read{ID: "@p1", Seq: insertRC + "CTGTCTCTTA", Unk: "+", Qual: strings.Repeat("I", 40)}
+	expect.True(t, tr.TrimPair(&r1, &r2))
+	expect.EQ(t, r1.Seq, insert)
+	expect.EQ(t, r2.Seq, insertRC)
+	expect.EQ(t, len(r2.Qual), len(insert))
+
+	// A long insert is left alone.
+	r1 = fastq.Read{ID: "@p2", Seq: insert, Unk: "+", Qual: strings.Repeat("I", 30)}
+	r2 = fastq.Read{ID: "@p2", Seq: "CCCCCGGGGGAAAAATTTTTCCCCCGGGGG", Unk: "+", Qual: strings.Repeat("I", 30)}
+	expect.True(t, tr.TrimPair(&r1, &r2))
+	expect.EQ(t, r1.Seq, insert)
+	expect.EQ(t, len(r2.Seq), 30)
+
+	expect.EQ(t, tr.Stats().OverlapTrimmed, int64(2))
+}
@@ -0,0 +1,239 @@
+package gff
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/bio/interval"
+)
+
+// Feature is a named, stranded interval with 0-based half-open coordinates,
+// i.e. a BED6 line with an unused score.
+type Feature struct {
+	Chrom  string
+	Start0 int
+	End    int
+	Name   string
+	Strand byte
+}
+
+// FlattenOpts controls Flatten.
+type FlattenOpts struct {
+	// Type is the feature type to collect.  It defaults to "exon"; use "CDS"
+	// to produce coding targets.
+	Type string
+	// Padding is added to both sides of every feature before merging.  Starts
+	// are clamped at 0; ends are not clamped since contig lengths are unknown.
+	Padding int
+	// TranscriptTypes, if nonempty, restricts the output to features of
+	// transcripts with one of these biotypes (e.g. "protein_coding").
+	TranscriptTypes []string
+	// AcrossGenes causes overlapping intervals from different genes (and
+	// strands) to be merged as well, with their gene names joined by ','.  The
+	// result is then a plain target set suitable for interval.BEDUnion.
+	// Otherwise intervals are only merged within each gene.
+	AcrossGenes bool
+}
+
+// Flatten collapses the features of the selected type into a union of
+// intervals per gene (or across genes; see FlattenOpts.AcrossGenes).
+// Transcripts are thereby "flattened": every base covered by an exon of any
+// retained transcript is covered exactly once.  Features are named by gene
+// name, falling back to gene ID.
+//
+// The result is sorted by contig (in order of first appearance in records),
+// then by start and end.
+func Flatten(records []Record, opts FlattenOpts) []Feature {
+	typ := opts.Type
+	if typ == "" {
+		typ = "exon"
+	}
+	keepType := map[string]bool{}
+	for _, t := range opts.TranscriptTypes {
+		keepType[t] = true
+	}
+	chromOrder := map[string]int{}
+	var features []Feature
+	lineages := NewLineages()
+	for i := range records {
+		r := &records[i]
+		if _, ok := chromOrder[r.SeqID]; !ok {
+			chromOrder[r.SeqID] = len(chromOrder)
+		}
+		lin := lineages.Add(r)
+		if r.Type != typ {
+			continue
+		}
+		if len(keepType) != 0 && !keepType[lin.TranscriptType] {
+			continue
+		}
+		name := lin.GeneName
+		if name == "" {
+			name = lin.GeneID
+		}
+		start0 := r.Start - 1 - opts.Padding
+		if start0 < 0 {
+			start0 = 0
+		}
+		features = append(features, Feature{
+			Chrom:  r.SeqID,
+			Start0: start0,
+			End:    r.End + opts.Padding,
+			Name:   name,
+			Strand: r.Strand,
+		})
+	}
+	sort.SliceStable(features, func(i, j int) bool {
+		fi, fj := &features[i], &features[j]
+		if fi.Chrom != fj.Chrom {
+			return chromOrder[fi.Chrom] < chromOrder[fj.Chrom]
+		}
+		if !opts.AcrossGenes && fi.Name != fj.Name {
+			// Group by gene so that each gene's intervals are merged
+			// independently; the final sort below restores positional order.
+			return fi.Name < fj.Name
+		}
+		if fi.Start0 != fj.Start0 {
+			return fi.Start0 < fj.Start0
+		}
+		return fi.End < fj.End
+	})
+	var merged []Feature
+	for _, f := range features {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			sameGroup := last.Chrom == f.Chrom && (opts.AcrossGenes || last.Name == f.Name)
+			if sameGroup && f.Start0 <= last.End {
+				if f.End > last.End {
+					last.End = f.End
+				}
+				if opts.AcrossGenes {
+					if last.Strand != f.Strand {
+						last.Strand = '.'
+					}
+					if !containsName(last.Name, f.Name) {
+						last.Name += "," + f.Name
+					}
+				}
+				continue
+			}
+		}
+		merged = append(merged, f)
+	}
+	if !opts.AcrossGenes {
+		sort.SliceStable(merged, func(i, j int) bool {
+			mi, mj := &merged[i], &merged[j]
+			if mi.Chrom != mj.Chrom {
+				return chromOrder[mi.Chrom] < chromOrder[mj.Chrom]
+			}
+			if mi.Start0 != mj.Start0 {
+				return mi.Start0 < mj.Start0
+			}
+			return mi.End < mj.End
+		})
+	}
+	return merged
+}
+
+func containsName(names, name string) bool {
+	for _, n := range strings.Split(names, ",") {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Entries converts features to interval.Entry values, e.g. for
+// interval.NewBEDUnionFromEntries.  Contigs must be contiguous in features,
+// as Flatten guarantees.
+func Entries(features []Feature) []interval.Entry {
+	entries := make([]interval.Entry, len(features))
+	for i, f := range features {
+		entries[i] = interval.Entry{
+			RefName: f.Chrom,
+			Start0:  interval.PosType(f.Start0),
+			End:     interval.PosType(f.End),
+		}
+	}
+	return entries
+}
+
+// WriteBED writes features as BED6 with a zero score.
+func WriteBED(w io.Writer, features []Feature) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range features {
+		strand := f.Strand
+		if strand == 0 {
+			strand = '.'
+		}
+		name := f.Name
+		if name == "" {
+			name = "."
+		}
+		if _, err := fmt.Fprintf(bw, "%s\t%d\t%d\t%s\t0\t%c\n", f.Chrom, f.Start0, f.End, name, strand); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadBED reads BED3 through BED6 lines as features.  Extra columns are
+// ignored; "track" and "browser" lines and '#' comments are skipped.
+func ReadBED(r io.Reader) ([]Feature, error) {
+	var features []Feature
+	s := bufio.NewScanner(r)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := s.Text()
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		cols := strings.Split(line, "\t")
+		if len(cols) < 3 {
+			return nil, fmt.Errorf("gff.ReadBED: line %d has fewer than 3 columns", lineno)
+		}
+		f := Feature{Chrom: cols[0], Strand: '.'}
+		var err error
+		if f.Start0, err = strconv.Atoi(cols[1]); err != nil {
+			return nil, fmt.Errorf("gff.ReadBED: line %d: %v", lineno, err)
+		}
+		if f.End, err = strconv.Atoi(cols[2]); err != nil {
+			return nil, fmt.Errorf("gff.ReadBED: line %d: %v", lineno, err)
+		}
+		if len(cols) > 3 {
+			f.Name = cols[3]
+		}
+		if len(cols) > 5 && len(cols[5]) == 1 {
+			f.Strand = cols[5][0]
+		}
+		features = append(features, f)
+	}
+	return features, s.Err()
+}
+
+// Record converts a feature to an annotation record of the given source and
+// type.  The name, if any, becomes gene_id for GTF and ID/Name for GFF3.
+func (f Feature) Record(source, typ string, format Format) Record {
+	r := Record{
+		SeqID:  f.Chrom,
+		Source: source,
+		Type:   typ,
+		Start:  f.Start0 + 1,
+		End:    f.End,
+		Strand: f.Strand,
+	}
+	if f.Name != "" {
+		if format == GTF {
+			r.Attrs = []Attr{{"gene_id", f.Name}}
+		} else {
+			r.Attrs = []Attr{{"ID", f.Name}, {"Name", f.Name}}
+		}
+	}
+	return r
+}
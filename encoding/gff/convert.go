@@ -0,0 +1,153 @@
+package gff
+
+// Lineage describes the gene and transcript a feature belongs to.  Fields
+// are empty when unknown (e.g. TranscriptID for a gene record).
+type Lineage struct {
+	GeneID         string
+	GeneName       string
+	TranscriptID   string
+	TranscriptType string
+}
+
+// Lineages resolves the gene/transcript membership of records read in file
+// order.  GTF records carry gene_id/transcript_id directly; GFF3 records are
+// resolved by following Parent links to previously seen IDs, so parents must
+// precede their children (as the GFF3 spec recommends and all major
+// annotation providers do).
+//
+// The zero value is not usable; call NewLineages.
+type Lineages struct {
+	byID map[string]Lineage
+}
+
+// NewLineages returns an empty Lineages.
+func NewLineages() *Lineages {
+	return &Lineages{byID: map[string]Lineage{}}
+}
+
+// transcriptTypeKeys are the attribute names used for transcript biotype by
+// GENCODE, Ensembl and RefSeq respectively.
+var transcriptTypeKeys = []string{"transcript_type", "transcript_biotype", "biotype"}
+
+func transcriptType(r *Record) string {
+	for _, k := range transcriptTypeKeys {
+		if v := r.Attr(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Add resolves r's lineage and, if r has a GFF3 ID, remembers it for its
+// children.
+func (l *Lineages) Add(r *Record) Lineage {
+	if geneID := r.Attr("gene_id"); geneID != "" && r.Attr("Parent") == "" && r.Attr("ID") == "" {
+		// GTF.
+		lin := Lineage{
+			GeneID:       geneID,
+			GeneName:     r.Attr("gene_name"),
+			TranscriptID: r.Attr("transcript_id"),
+		}
+		if lin.TranscriptID != "" {
+			lin.TranscriptType = transcriptType(r)
+		}
+		return lin
+	}
+	var lin Lineage
+	id := r.Attr("ID")
+	parents := r.Parents()
+	if len(parents) == 0 {
+		// Top-level feature; treat it as a gene.  Ensembl GFF3 IDs look like
+		// "gene:ENSG...", and the bare ID is available as gene_id.
+		lin.GeneID = r.Attr("gene_id")
+		if lin.GeneID == "" {
+			lin.GeneID = id
+		}
+		if lin.GeneName = r.Attr("Name"); lin.GeneName == "" {
+			lin.GeneName = r.Attr("gene_name")
+		}
+	} else {
+		// Multiple parents (e.g. an exon shared between transcripts) are all in
+		// the same gene; the first one is used for transcript attribution.
+		parent := l.byID[parents[0]]
+		lin.GeneID = parent.GeneID
+		lin.GeneName = parent.GeneName
+		if parent.TranscriptID != "" {
+			lin.TranscriptID = parent.TranscriptID
+			lin.TranscriptType = parent.TranscriptType
+		} else {
+			lin.TranscriptID = r.Attr("transcript_id")
+			if lin.TranscriptID == "" {
+				lin.TranscriptID = id
+			}
+			lin.TranscriptType = transcriptType(r)
+		}
+	}
+	if id != "" {
+		l.byID[id] = lin
+	}
+	return lin
+}
+
+// Convert copies all records from s to w, rewriting the attributes that carry
+// the feature hierarchy so that the output is valid in w's format:
+//
+//   - GFF3 -> GTF: ID/Parent are replaced by leading gene_id/transcript_id
+//     attributes (and gene_name when known).
+//
+//   - GTF -> GFF3: gene records get ID=<gene_id>, transcript records get
+//     ID=<transcript_id>;Parent=<gene_id>, and all other records get
+//     Parent=<transcript_id>.  GTF files without gene/transcript lines produce
+//     GFF3 with dangling Parent references, which most tools tolerate.
+//
+// All other attributes are preserved in order.
+func Convert(s *Scanner, w *Writer) error {
+	lineages := NewLineages()
+	var rec Record
+	var attrs []Attr
+	for s.Scan(&rec) {
+		lin := lineages.Add(&rec)
+		attrs = attrs[:0]
+		if w.format == GTF {
+			if s.format != GTF {
+				attrs = append(attrs, Attr{"gene_id", lin.GeneID})
+				if lin.TranscriptID != "" {
+					attrs = append(attrs, Attr{"transcript_id", lin.TranscriptID})
+				}
+				if lin.GeneName != "" && rec.Attr("gene_name") == "" {
+					attrs = append(attrs, Attr{"gene_name", lin.GeneName})
+				}
+			}
+			for _, a := range rec.Attrs {
+				if a.Key == "ID" || a.Key == "Parent" {
+					continue
+				}
+				if s.format != GTF && (a.Key == "gene_id" || a.Key == "transcript_id") {
+					continue
+				}
+				attrs = append(attrs, a)
+			}
+		} else {
+			if s.format == GTF {
+				switch {
+				case lin.TranscriptID == "":
+					attrs = append(attrs, Attr{"ID", lin.GeneID})
+				case rec.Type == "transcript" || rec.Type == "mRNA":
+					attrs = append(attrs, Attr{"ID", lin.TranscriptID}, Attr{"Parent", lin.GeneID})
+				default:
+					attrs = append(attrs, Attr{"Parent", lin.TranscriptID})
+				}
+			}
+			attrs = append(attrs, rec.Attrs...)
+		}
+		out := rec
+		out.Attrs = attrs
+		if err := w.Write(&out); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
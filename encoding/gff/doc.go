@@ -0,0 +1,16 @@
+// Package gff provides code for working with GTF (GFF2.5) and GFF3 gene
+// annotation files, and for deriving BED intervals from them.
+//
+// The two formats share the same nine tab-separated columns
+//
+//	seqid source type start end score strand phase attributes
+//
+// and differ only in the attribute syntax: GTF uses `key "value";` pairs with
+// gene_id/transcript_id on every line, while GFF3 uses `key=value` pairs and
+// expresses the gene -> transcript -> exon hierarchy through ID/Parent.
+// Coordinates in both formats are 1-based and closed; they are converted to
+// 0-based half-open intervals when BED output is produced.
+//
+// See https://www.ensembl.org/info/website/upload/gff.html and
+// https://github.com/The-Sequence-Ontology/Specifications/blob/master/gff3.md.
+package gff
@@ -0,0 +1,357 @@
+package gff
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Format identifies the attribute dialect of an annotation file.
+type Format int
+
+const (
+	// GTF is GTF2.2/GENCODE-style GFF2.5: `key "value";` attributes.
+	GTF Format = iota
+	// GFF3 uses `key=value` attributes with ID/Parent links.
+	GFF3
+)
+
+// String implements fmt.Stringer.
+func (f Format) String() string {
+	switch f {
+	case GTF:
+		return "gtf"
+	case GFF3:
+		return "gff3"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// FormatFromPath guesses the format from a file name, ignoring any trailing
+// compression suffix.  ".gtf" maps to GTF; ".gff" and ".gff3" map to GFF3.
+func FormatFromPath(path string) (Format, error) {
+	base := filepath.Base(path)
+	for _, suffix := range []string{".gz", ".bgz", ".zst"} {
+		base = strings.TrimSuffix(base, suffix)
+	}
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".gtf":
+		return GTF, nil
+	case ".gff", ".gff3":
+		return GFF3, nil
+	}
+	return GTF, fmt.Errorf("gff.FormatFromPath: can't determine annotation format of %s", path)
+}
+
+// Attr is a single key/value attribute.  Values are stored unescaped; GFF3
+// multi-valued attributes (e.g. "Parent=a,b") are kept as a single
+// comma-separated string.
+type Attr struct {
+	Key, Value string
+}
+
+// Record is a single feature line.  Start and End are 1-based and closed, as
+// in the file.
+type Record struct {
+	SeqID  string
+	Source string
+	Type   string
+	Start  int
+	End    int
+	// Score and Phase are kept as strings since they are usually ".".
+	Score  string
+	Strand byte
+	Phase  string
+	// Attrs are kept in file order so that records round-trip.
+	Attrs []Attr
+}
+
+// Attr returns the value of the first attribute with the given key, or "" if
+// there is none.
+func (r *Record) Attr(key string) string {
+	for _, a := range r.Attrs {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// SetAttr replaces the value of the given attribute, appending it if it is
+// not already present.
+func (r *Record) SetAttr(key, value string) {
+	for i := range r.Attrs {
+		if r.Attrs[i].Key == key {
+			r.Attrs[i].Value = value
+			return
+		}
+	}
+	r.Attrs = append(r.Attrs, Attr{key, value})
+}
+
+// Parents returns the GFF3 Parent IDs of the record.
+func (r *Record) Parents() []string {
+	p := r.Attr("Parent")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, ",")
+}
+
+var (
+	// ErrInvalid is returned when a malformed feature line is encountered.
+	ErrInvalid = errors.New("invalid GFF/GTF line")
+)
+
+// Scanner reads feature records from a GTF or GFF3 stream.  Comment and
+// directive lines are skipped; a GFF3 "##FASTA" directive ends the stream.
+// Scanners are not threadsafe.
+type Scanner struct {
+	b      *bufio.Scanner
+	format Format
+	lineno int
+	err    error
+	fields [9][]byte
+}
+
+// NewScanner constructs a Scanner that parses the given format from r.
+func NewScanner(r io.Reader, format Format) *Scanner {
+	b := bufio.NewScanner(r)
+	// Some GENCODE/RefSeq attribute columns are long.
+	b.Buffer(make([]byte, 64<<10), 16<<20)
+	return &Scanner{b: b, format: format}
+}
+
+// Scan parses the next record into rec, reusing its Attrs slice.  It returns
+// false at the end of the stream or on error; Err distinguishes the two.
+func (s *Scanner) Scan(rec *Record) bool {
+	if s.err != nil {
+		return false
+	}
+	for s.b.Scan() {
+		s.lineno++
+		line := s.b.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			if bytes.HasPrefix(line, []byte("##FASTA")) {
+				s.err = io.EOF
+				return false
+			}
+			continue
+		}
+		if err := s.parse(line, rec); err != nil {
+			s.err = fmt.Errorf("gff.Scanner: line %d: %v", s.lineno, err)
+			return false
+		}
+		return true
+	}
+	if s.err = s.b.Err(); s.err == nil {
+		s.err = io.EOF
+	}
+	return false
+}
+
+// Err returns the first error encountered, or nil if the stream ended
+// cleanly.
+func (s *Scanner) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+func (s *Scanner) parse(line []byte, rec *Record) (err error) {
+	fields := s.fields[:]
+	n := 0
+	for n < 8 {
+		tab := bytes.IndexByte(line, '\t')
+		if tab < 0 {
+			break
+		}
+		fields[n] = line[:tab]
+		line = line[tab+1:]
+		n++
+	}
+	if n != 8 {
+		return ErrInvalid
+	}
+	fields[8] = bytes.TrimRight(line, "\r")
+	rec.SeqID = string(fields[0])
+	rec.Source = string(fields[1])
+	rec.Type = string(fields[2])
+	if rec.Start, err = strconv.Atoi(string(fields[3])); err != nil {
+		return err
+	}
+	if rec.End, err = strconv.Atoi(string(fields[4])); err != nil {
+		return err
+	}
+	if rec.Start < 1 || rec.End < rec.Start-1 {
+		return fmt.Errorf("invalid coordinates [%d, %d]", rec.Start, rec.End)
+	}
+	rec.Score = string(fields[5])
+	if len(fields[6]) != 1 {
+		return fmt.Errorf("invalid strand %q", fields[6])
+	}
+	rec.Strand = fields[6][0]
+	rec.Phase = string(fields[7])
+	rec.Attrs = rec.Attrs[:0]
+	if s.format == GTF {
+		return parseGTFAttrs(string(fields[8]), rec)
+	}
+	return parseGFF3Attrs(string(fields[8]), rec)
+}
+
+func parseGTFAttrs(s string, rec *Record) error {
+	for _, field := range strings.Split(s, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		sp := strings.IndexByte(field, ' ')
+		if sp < 0 {
+			return fmt.Errorf("malformed GTF attribute %q", field)
+		}
+		value := strings.TrimSpace(field[sp+1:])
+		value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+		rec.Attrs = append(rec.Attrs, Attr{field[:sp], value})
+	}
+	return nil
+}
+
+func parseGFF3Attrs(s string, rec *Record) error {
+	if s == "." {
+		return nil
+	}
+	for _, field := range strings.Split(s, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			return fmt.Errorf("malformed GFF3 attribute %q", field)
+		}
+		key, err := url.PathUnescape(field[:eq])
+		if err != nil {
+			return err
+		}
+		value, err := url.PathUnescape(field[eq+1:])
+		if err != nil {
+			return err
+		}
+		rec.Attrs = append(rec.Attrs, Attr{key, value})
+	}
+	return nil
+}
+
+// ReadAll reads all records from r.
+func ReadAll(r io.Reader, format Format) ([]Record, error) {
+	var records []Record
+	s := NewScanner(r, format)
+	for {
+		var rec Record
+		if !s.Scan(&rec) {
+			break
+		}
+		records = append(records, rec)
+	}
+	return records, s.Err()
+}
+
+// Writer writes feature records in GTF or GFF3 format.  It does not perform
+// any attribute translation; see Convert for that.
+type Writer struct {
+	w      *bufio.Writer
+	format Format
+	err    error
+}
+
+// NewWriter constructs a Writer for the given format.  For GFF3, the
+// "##gff-version 3" pragma is written immediately.
+func NewWriter(w io.Writer, format Format) *Writer {
+	gw := &Writer{w: bufio.NewWriter(w), format: format}
+	if format == GFF3 {
+		_, gw.err = gw.w.WriteString("##gff-version 3\n")
+	}
+	return gw
+}
+
+// gff3Escaper percent-encodes the characters that are reserved in GFF3
+// attribute values.
+var gff3Escaper = strings.NewReplacer("%", "%25", ";", "%3B", "=", "%3D", "&", "%26", "\t", "%09", "\n", "%0A", "\r", "%0D")
+
+// Write writes a single record.
+func (w *Writer) Write(r *Record) error {
+	if w.err != nil {
+		return w.err
+	}
+	b := w.w
+	b.WriteString(r.SeqID)
+	b.WriteByte('\t')
+	b.WriteString(orDot(r.Source))
+	b.WriteByte('\t')
+	b.WriteString(r.Type)
+	b.WriteByte('\t')
+	b.WriteString(strconv.Itoa(r.Start))
+	b.WriteByte('\t')
+	b.WriteString(strconv.Itoa(r.End))
+	b.WriteByte('\t')
+	b.WriteString(orDot(r.Score))
+	b.WriteByte('\t')
+	if r.Strand == 0 {
+		b.WriteByte('.')
+	} else {
+		b.WriteByte(r.Strand)
+	}
+	b.WriteByte('\t')
+	b.WriteString(orDot(r.Phase))
+	b.WriteByte('\t')
+	if len(r.Attrs) == 0 {
+		b.WriteByte('.')
+	}
+	for i, a := range r.Attrs {
+		if w.format == GTF {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(a.Key)
+			b.WriteString(` "`)
+			b.WriteString(a.Value)
+			b.WriteString(`";`)
+		} else {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(gff3Escaper.Replace(a.Key))
+			b.WriteByte('=')
+			// Commas separate multiple values, so they are left alone.
+			b.WriteString(gff3Escaper.Replace(a.Value))
+		}
+	}
+	_, w.err = b.WriteString("\n")
+	return w.err
+}
+
+// Flush flushes buffered output to the underlying writer.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.w.Flush()
+	return w.err
+}
+
+func orDot(s string) string {
+	if s == "" {
+		return "."
+	}
+	return s
+}
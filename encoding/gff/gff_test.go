@@ -0,0 +1,196 @@
+package gff_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/gff"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+const testGTF = `#!genome-build GRCh38
+chr1	HAVANA	gene	100	500	.	+	.	gene_id "G1"; gene_name "ONE";
+chr1	HAVANA	transcript	100	500	.	+	.	gene_id "G1"; transcript_id "T1"; gene_name "ONE"; transcript_type "protein_coding";
+chr1	HAVANA	exon	100	150	.	+	.	gene_id "G1"; transcript_id "T1"; gene_name "ONE"; transcript_type "protein_coding";
+chr1	HAVANA	exon	300	500	.	+	.	gene_id "G1"; transcript_id "T1"; gene_name "ONE"; transcript_type "protein_coding";
+chr1	HAVANA	CDS	120	150	.	+	0	gene_id "G1"; transcript_id "T1"; gene_name "ONE"; transcript_type "protein_coding";
+chr1	HAVANA	transcript	140	400	.	+	.	gene_id "G1"; transcript_id "T2"; gene_name "ONE"; transcript_type "retained_intron";
+chr1	HAVANA	exon	140	200	.	+	.	gene_id "G1"; transcript_id "T2"; gene_name "ONE"; transcript_type "retained_intron";
+chr1	HAVANA	exon	350	400	.	+	.	gene_id "G1"; transcript_id "T2"; gene_name "ONE"; transcript_type "retained_intron";
+chr1	HAVANA	gene	450	900	.	-	.	gene_id "G2"; gene_name "TWO";
+chr1	HAVANA	transcript	450	900	.	-	.	gene_id "G2"; transcript_id "T3"; gene_name "TWO"; transcript_type "protein_coding";
+chr1	HAVANA	exon	450	600	.	-	.	gene_id "G2"; transcript_id "T3"; gene_name "TWO"; transcript_type "protein_coding";
+chr1	HAVANA	CDS	480	600	.	-	0	gene_id "G2"; transcript_id "T3"; gene_name "TWO"; transcript_type "protein_coding";
+`
+
+func readGTF(t *testing.T) []gff.Record {
+	records, err := gff.ReadAll(strings.NewReader(testGTF), gff.GTF)
+	assert.NoError(t, err)
+	assert.EQ(t, len(records), 12)
+	return records
+}
+
+func TestScan(t *testing.T) {
+	records := readGTF(t)
+	r := records[4]
+	expect.EQ(t, r.SeqID, "chr1")
+	expect.EQ(t, r.Type, "CDS")
+	expect.EQ(t, r.Start, 120)
+	expect.EQ(t, r.End, 150)
+	expect.EQ(t, r.Strand, byte('+'))
+	expect.EQ(t, r.Phase, "0")
+	expect.EQ(t, r.Attr("transcript_id"), "T1")
+	expect.EQ(t, r.Attr("missing"), "")
+
+	gff3 := "##gff-version 3\nchr1\t.\tmRNA\t1\t10\t.\t+\t.\tID=tx%3B1;Parent=g1,g2\n##FASTA\n>chr1\nACGT\n"
+	records, err := gff.ReadAll(strings.NewReader(gff3), gff.GFF3)
+	assert.NoError(t, err)
+	assert.EQ(t, len(records), 1)
+	expect.EQ(t, records[0].Attr("ID"), "tx;1")
+	expect.EQ(t, records[0].Parents(), []string{"g1", "g2"})
+
+	_, err = gff.ReadAll(strings.NewReader("chr1\t.\texon\t1\n"), gff.GTF)
+	expect.HasSubstr(t, err.Error(), "line 1")
+}
+
+func TestFormatFromPath(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want gff.Format
+	}{
+		{"gencode.v32.annotation.gtf.gz", gff.GTF},
+		{"a/b/refseq.gff3", gff.GFF3},
+		{"x.GFF", gff.GFF3},
+	} {
+		got, err := gff.FormatFromPath(tt.path)
+		assert.NoError(t, err)
+		expect.EQ(t, got, tt.want, tt.path)
+	}
+	_, err := gff.FormatFromPath("x.bed")
+	expect.NotNil(t, err)
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	var gff3 bytes.Buffer
+	assert.NoError(t, gff.Convert(gff.NewScanner(strings.NewReader(testGTF), gff.GTF), gff.NewWriter(&gff3, gff.GFF3)))
+	lines := strings.Split(gff3.String(), "\n")
+	expect.EQ(t, lines[0], "##gff-version 3")
+	expect.EQ(t, lines[1], "chr1\tHAVANA\tgene\t100\t500\t.\t+\t.\tID=G1;gene_id=G1;gene_name=ONE")
+	expect.HasPrefix(t, lines[2], "chr1\tHAVANA\ttranscript\t100\t500\t.\t+\t.\tID=T1;Parent=G1;")
+	expect.HasPrefix(t, lines[3], "chr1\tHAVANA\texon\t100\t150\t.\t+\t.\tParent=T1;")
+
+	// Strip the GTF-specific attributes so that the hierarchy must be
+	// reconstructed from ID/Parent alone.
+	records, err := gff.ReadAll(&gff3, gff.GFF3)
+	assert.NoError(t, err)
+	var stripped bytes.Buffer
+	w := gff.NewWriter(&stripped, gff.GFF3)
+	for _, r := range records {
+		var attrs []gff.Attr
+		for _, a := range r.Attrs {
+			if a.Key != "gene_id" && a.Key != "transcript_id" {
+				attrs = append(attrs, a)
+			}
+		}
+		r.Attrs = attrs
+		assert.NoError(t, w.Write(&r))
+	}
+	assert.NoError(t, w.Flush())
+
+	var gtf bytes.Buffer
+	assert.NoError(t, gff.Convert(gff.NewScanner(&stripped, gff.GFF3), gff.NewWriter(&gtf, gff.GTF)))
+	back, err := gff.ReadAll(&gtf, gff.GTF)
+	assert.NoError(t, err)
+	orig := readGTF(t)
+	assert.EQ(t, len(back), len(orig))
+	for i := range orig {
+		expect.EQ(t, back[i].Start, orig[i].Start)
+		expect.EQ(t, back[i].Attr("gene_id"), orig[i].Attr("gene_id"))
+		expect.EQ(t, back[i].Attr("transcript_id"), orig[i].Attr("transcript_id"))
+		expect.EQ(t, back[i].Attr("gene_name"), orig[i].Attr("gene_name"))
+		expect.EQ(t, back[i].Attr("ID"), "")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	records := readGTF(t)
+	exons := gff.Flatten(records, gff.FlattenOpts{})
+	expect.EQ(t, exons, []gff.Feature{
+		{"chr1", 99, 200, "ONE", '+'},
+		{"chr1", 299, 500, "ONE", '+'},
+		{"chr1", 449, 600, "TWO", '-'},
+	})
+
+	coding := gff.Flatten(records, gff.FlattenOpts{TranscriptTypes: []string{"protein_coding"}})
+	expect.EQ(t, coding, []gff.Feature{
+		{"chr1", 99, 150, "ONE", '+'},
+		{"chr1", 299, 500, "ONE", '+'},
+		{"chr1", 449, 600, "TWO", '-'},
+	})
+
+	targets := gff.Flatten(records, gff.FlattenOpts{Type: "exon", Padding: 10, AcrossGenes: true})
+	expect.EQ(t, targets, []gff.Feature{
+		{"chr1", 89, 210, "ONE", '+'},
+		{"chr1", 289, 610, "ONE,TWO", '.'},
+	})
+
+	cds := gff.Flatten(records, gff.FlattenOpts{Type: "CDS", Padding: 200})
+	expect.EQ(t, cds, []gff.Feature{
+		{"chr1", 0, 350, "ONE", '+'},
+		{"chr1", 279, 800, "TWO", '-'},
+	})
+	entries := gff.Entries(cds)
+	expect.EQ(t, int(entries[1].Start0), 279)
+	expect.EQ(t, int(entries[1].End), 800)
+}
+
+func TestBED(t *testing.T) {
+	features := []gff.Feature{
+		{"chr1", 99, 200, "ONE", '+'},
+		{"chr2", 0, 10, "", 0},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, gff.WriteBED(&buf, features))
+	expect.EQ(t, buf.String(), "chr1\t99\t200\tONE\t0\t+\nchr2\t0\t10\t.\t0\t.\n")
+
+	got, err := gff.ReadBED(strings.NewReader("track name=x\nchr1\t99\t200\tONE\t0\t+\nchr2\t0\t10\n"))
+	assert.NoError(t, err)
+	expect.EQ(t, got, []gff.Feature{
+		{"chr1", 99, 200, "ONE", '+'},
+		{"chr2", 0, 10, "", '.'},
+	})
+
+	r := got[0].Record("bed", "exon", gff.GTF)
+	expect.EQ(t, r.Start, 100)
+	expect.EQ(t, r.End, 200)
+	expect.EQ(t, r.Attr("gene_id"), "ONE")
+}
+
+func TestIndex(t *testing.T) {
+	records := readGTF(t)
+	x := gff.NewIndex(records)
+	expect.EQ(t, x.Types(), []string{"CDS", "exon", "gene", "transcript"})
+	expect.EQ(t, x.Overlaps("gene", "chr1", 460, 461), []gff.Feature{
+		{"chr1", 99, 500, "ONE", '+'},
+		{"chr1", 449, 900, "TWO", '-'},
+	})
+	expect.EQ(t, x.Overlaps("exon", "chr1", 140, 141), []gff.Feature{
+		{"chr1", 99, 150, "ONE", '+'},
+		{"chr1", 139, 200, "ONE", '+'},
+	})
+	expect.EQ(t, len(x.Overlaps("exon", "chr1", 200, 299)), 0)
+	expect.EQ(t, len(x.Overlaps("exon", "chr2", 0, 1000)), 0)
+	expect.EQ(t, len(x.Overlaps("UTR", "chr1", 0, 1000)), 0)
+
+	cds := gff.NewIndex(records, "CDS")
+	expect.EQ(t, cds.Types(), []string{"CDS"})
+	dst := cds.AppendOverlaps(nil, "CDS", "chr1", 0, 1000)
+	dst = cds.AppendOverlaps(dst, "CDS", "chr1", 599, 600)
+	expect.EQ(t, dst, []gff.Feature{
+		{"chr1", 119, 150, "ONE", '+'},
+		{"chr1", 479, 600, "TWO", '-'},
+		{"chr1", 479, 600, "TWO", '-'},
+	})
+}
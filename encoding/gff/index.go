@@ -0,0 +1,151 @@
+package gff
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"sort"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/fileio"
+)
+
+// featureList holds the features of one type on one contig, sorted by start.
+// maxEnd[i] is the largest End among features[:i+1], so that an overlap query
+// can stop scanning left as soon as no earlier feature can reach the query.
+type featureList struct {
+	features []Feature
+	maxEnd   []int
+}
+
+// Index is an in-memory interval index of annotation features, keyed by
+// feature type (e.g. "gene", "exon", "CDS") and contig.  Features are named by
+// gene name, falling back to gene ID, as in Flatten, but they are not merged.
+//
+// An Index is immutable once built, and is safe for concurrent queries.
+type Index struct {
+	byType map[string]map[string]*featureList
+}
+
+// NewIndex indexes the records of the given feature types, or of all types if
+// none are given.  Records must be in file order, so that GFF3 parents can be
+// resolved; see Lineages.
+func NewIndex(records []Record, types ...string) *Index {
+	keepType := map[string]bool{}
+	for _, t := range types {
+		keepType[t] = true
+	}
+	x := &Index{byType: map[string]map[string]*featureList{}}
+	lineages := NewLineages()
+	for i := range records {
+		r := &records[i]
+		lin := lineages.Add(r)
+		if len(keepType) != 0 && !keepType[r.Type] {
+			continue
+		}
+		name := lin.GeneName
+		if name == "" {
+			name = lin.GeneID
+		}
+		chroms := x.byType[r.Type]
+		if chroms == nil {
+			chroms = map[string]*featureList{}
+			x.byType[r.Type] = chroms
+		}
+		l := chroms[r.SeqID]
+		if l == nil {
+			l = &featureList{}
+			chroms[r.SeqID] = l
+		}
+		l.features = append(l.features, Feature{
+			Chrom:  r.SeqID,
+			Start0: r.Start - 1,
+			End:    r.End,
+			Name:   name,
+			Strand: r.Strand,
+		})
+	}
+	for _, chroms := range x.byType {
+		for _, l := range chroms {
+			sort.SliceStable(l.features, func(i, j int) bool {
+				return l.features[i].Start0 < l.features[j].Start0
+			})
+			l.maxEnd = make([]int, len(l.features))
+			maxEnd := 0
+			for i, f := range l.features {
+				if f.End > maxEnd {
+					maxEnd = f.End
+				}
+				l.maxEnd[i] = maxEnd
+			}
+		}
+	}
+	return x
+}
+
+// ReadIndex reads all records from r and indexes those of the given types;
+// see NewIndex.
+func ReadIndex(r io.Reader, format Format, types ...string) (*Index, error) {
+	records, err := ReadAll(r, format)
+	if err != nil {
+		return nil, err
+	}
+	return NewIndex(records, types...), nil
+}
+
+// ReadIndexFromPath is a wrapper for ReadIndex that takes a path, which may be
+// gzipped, instead of an io.Reader.
+func ReadIndexFromPath(ctx context.Context, path string, format Format, types ...string) (x *Index, err error) {
+	var in file.File
+	if in, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	reader := io.Reader(in.Reader(ctx))
+	if fileio.DetermineType(path) == fileio.Gzip {
+		if reader, err = gzip.NewReader(reader); err != nil {
+			return
+		}
+	}
+	return ReadIndex(reader, format, types...)
+}
+
+// Types returns the indexed feature types, sorted.
+func (x *Index) Types() []string {
+	types := make([]string, 0, len(x.byType))
+	for t := range x.byType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// AppendOverlaps appends the features of type typ on chrom which overlap the
+// 0-based half-open interval [start0, end) to dst, in order of start, and
+// returns the extended slice.
+func (x *Index) AppendOverlaps(dst []Feature, typ, chrom string, start0, end int) []Feature {
+	l := x.byType[typ][chrom]
+	if l == nil {
+		return dst
+	}
+	// Features at or past end can't overlap.
+	hi := sort.Search(len(l.features), func(i int) bool {
+		return l.features[i].Start0 >= end
+	})
+	lo := hi
+	for lo > 0 && l.maxEnd[lo-1] > start0 {
+		lo--
+	}
+	for _, f := range l.features[lo:hi] {
+		if f.End > start0 {
+			dst = append(dst, f)
+		}
+	}
+	return dst
+}
+
+// Overlaps returns the features of type typ on chrom which overlap the
+// 0-based half-open interval [start0, end), in order of start.
+func (x *Index) Overlaps(typ, chrom string, start0, end int) []Feature {
+	return x.AppendOverlaps(nil, typ, chrom, start0, end)
+}
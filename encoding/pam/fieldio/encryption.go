@@ -0,0 +1,183 @@
+package fieldio
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/compress/zstd"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/recordio/recordiozstd"
+)
+
+// EncryptionKeyIDHeader is the recordio header of an encrypted field file.  Its
+// value is the ID of the key that encrypts the blocks.
+const EncryptionKeyIDHeader = "pam.encryption_key_id"
+
+// KeyProvider supplies the keys of encrypted field files.  It can be backed by
+// a KMS, a ticket service, or a local keyring.  Its methods must be thread
+// safe.
+type KeyProvider interface {
+	// Key returns the AES-128, AES-192 or AES-256 key named keyID.
+	Key(ctx context.Context, keyID string) ([]byte, error)
+}
+
+// Encryption configures the encryption of a field file.
+type Encryption struct {
+	// Keys supplies the key.
+	Keys KeyProvider
+	// KeyID is the ID of the key, passed to Keys.Key.  It is stored in the
+	// file, so that readers can fetch the same key.
+	KeyID string
+}
+
+// blockCipher compresses and encrypts, or decrypts and decompresses, the
+// blocks of an encrypted field file.  Each sealed block is a random nonce
+// followed by the AES-GCM encryption of the zstd-compressed block.  The
+// block is compressed here, instead of by a recordio transformer, since
+// ciphertext doesn't compress.  The index in the recordio trailer is not
+// encrypted, so that readers can shard the file without the key.
+//
+// The additional data of each block binds it to its place: the key ID, the
+// base name of the file (the shard range and the field name, e.g.
+// "0:0,1:100.qual"), and the sequence number of the block in the file.  A
+// block moved to another field, shard or position fails to decrypt.  The
+// directory isn't bound, so that a PAM file can be copied or renamed.
+//
+// The index is sealed too, so that blocks dropped from the end of the file,
+// along with their index entries, are detected: see sealIndex.
+type blockCipher struct {
+	aead      cipher.AEAD
+	keyID     string
+	name      string
+	zstdLevel int
+}
+
+func newBlockCipher(ctx context.Context, keys KeyProvider, keyID, path string, zstdLevel int) (*blockCipher, error) {
+	key, err := keys.Key(ctx, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("get key %q: %v", keyID, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", keyID, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &blockCipher{aead: aead, keyID: keyID, name: file.Base(path), zstdLevel: zstdLevel}, nil
+}
+
+// parseZstdLevel returns the compression level of transformers, which must be
+// a single zstd transformer, e.g. {"zstd"} or {"zstd 1"}.
+func parseZstdLevel(transformers []string) (int, error) {
+	if len(transformers) != 1 {
+		return 0, fmt.Errorf("encrypted fields require a single %s transformer, but found %v", recordiozstd.Name, transformers)
+	}
+	toks := strings.SplitN(transformers[0], " ", 2)
+	if toks[0] != recordiozstd.Name {
+		return 0, fmt.Errorf("encrypted fields require a %s transformer, but found %v", recordiozstd.Name, transformers)
+	}
+	if len(toks) == 1 {
+		return -1, nil
+	}
+	return strconv.Atoi(toks[1])
+}
+
+// additionalData returns the AES-GCM additional data of block seq: the
+// key ID, the file name and seq, each prefixed by its length.
+func (c *blockCipher) additionalData(seq int) []byte {
+	buf := make([]byte, 3*binary.MaxVarintLen64+len(c.keyID)+len(c.name))
+	n := binary.PutUvarint(buf, uint64(len(c.keyID)))
+	n += copy(buf[n:], c.keyID)
+	n += binary.PutUvarint(buf[n:], uint64(len(c.name)))
+	n += copy(buf[n:], c.name)
+	n += binary.PutUvarint(buf[n:], uint64(seq))
+	return buf[:n]
+}
+
+// indexSealField is the protobuf field number of the seal that sealIndex
+// appends to the index.  It isn't a field of biopb.PAMFieldIndex, so readers
+// that don't check the seal, e.g. the sharder, skip it.
+const indexSealField = 1000
+
+// indexSealHeader returns the protobuf key and length of the index seal.
+func (c *blockCipher) indexSealHeader() []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, indexSealField<<3|2) // wire type 2: bytes.
+	n += binary.PutUvarint(buf[n:], uint64(c.aead.NonceSize()+c.aead.Overhead()))
+	return buf[:n]
+}
+
+// indexAdditionalData returns the AES-GCM additional data of the seal of
+// index, the serialized index of a file of nBlock blocks: the additional data
+// of block nBlock, which no block has, followed by index.
+func (c *blockCipher) indexAdditionalData(index []byte, nBlock int) []byte {
+	return append(c.additionalData(nBlock), index...)
+}
+
+// sealIndex appends the seal of index, the serialized index of a file of
+// nBlock blocks, as field indexSealField.  The seal is a random nonce followed
+// by the AES-GCM tag of no plaintext, so the index stays readable without the
+// key.
+func (c *blockCipher) sealIndex(index []byte, nBlock int) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append(index, c.indexSealHeader()...), nonce...)
+	return c.aead.Seal(sealed, nonce, nil, c.indexAdditionalData(index, nBlock)), nil
+}
+
+// openIndex checks the seal of trailer, the output of sealIndex for a file of
+// nBlock blocks.
+func (c *blockCipher) openIndex(trailer []byte, nBlock int) error {
+	header := c.indexSealHeader()
+	sealSize := c.aead.NonceSize() + c.aead.Overhead()
+	n := len(trailer) - len(header) - sealSize
+	if (n < 0) || !bytes.Equal(trailer[n:n+len(header)], header) {
+		return fmt.Errorf("index of %s isn't sealed", c.name)
+	}
+	index, seal := trailer[:n], trailer[n+len(header):]
+	nonceSize := c.aead.NonceSize()
+	if _, err := c.aead.Open(nil, seal[:nonceSize], seal[nonceSize:], c.indexAdditionalData(index, nBlock)); err != nil {
+		return fmt.Errorf("decrypt index of %s with key %q: %v", c.name, c.keyID, err)
+	}
+	return nil
+}
+
+// seal compresses and encrypts plaintext, the seq'th block of the file.
+func (c *blockCipher) seal(plaintext []byte, seq int) ([]byte, error) {
+	compressed, err := zstd.CompressLevel(nil, plaintext, c.zstdLevel)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := c.aead.NonceSize()
+	sealed := make([]byte, nonceSize, nonceSize+len(compressed)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(sealed, sealed, compressed, c.additionalData(seq)), nil
+}
+
+// open reverses seal.
+func (c *blockCipher) open(sealed []byte, seq int) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("encrypted block too short: %d bytes", len(sealed))
+	}
+	compressed, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], c.additionalData(seq))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt block %d of %s with key %q: %v", seq, c.name, c.keyID, err)
+	}
+	return zstd.Decompress(nil, compressed)
+}
@@ -0,0 +1,79 @@
+package fieldio
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+type testKeys map[string][]byte
+
+func (k testKeys) Key(ctx context.Context, keyID string) ([]byte, error) {
+	return k[keyID], nil
+}
+
+func TestBlockCipherAdditionalData(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys{"k0": []byte("0123456789abcdef0123456789abcdef")}
+	newCipher := func(path string) *blockCipher {
+		c, err := newBlockCipher(ctx, keys, "k0", path, 1)
+		assert.NoError(t, err)
+		return c
+	}
+	qual := newCipher("/tmp/a/0:0,1:100.qual")
+	sealed, err := qual.seal([]byte("block 3"), 3)
+	assert.NoError(t, err)
+	plaintext, err := qual.open(sealed, 3)
+	assert.NoError(t, err)
+	expect.EQ(t, string(plaintext), "block 3")
+	// A copy of the PAM file in another directory is still readable.
+	plaintext, err = newCipher("s3://b/c/0:0,1:100.qual").open(sealed, 3)
+	assert.NoError(t, err)
+	expect.EQ(t, string(plaintext), "block 3")
+
+	// The block fails to decrypt at another position, in another field, or in
+	// another shard.
+	_, err = qual.open(sealed, 4)
+	expect.Regexp(t, err, "decrypt block 4 of 0:0,1:100.qual with key \"k0\"")
+	_, err = newCipher("/tmp/a/0:0,1:100.aux").open(sealed, 3)
+	expect.Regexp(t, err, "decrypt block 3 of 0:0,1:100.aux")
+	_, err = newCipher("/tmp/a/0:100,1:200.qual").open(sealed, 3)
+	expect.Regexp(t, err, "decrypt block 3 of 0:100,1:200.qual")
+}
+
+func TestBlockCipherIndexSeal(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys{"k0": []byte("0123456789abcdef0123456789abcdef")}
+	qual, err := newBlockCipher(ctx, keys, "k0", "/tmp/a/0:0,1:100.qual", 1)
+	assert.NoError(t, err)
+	newIndex := func(nBlock int) []byte {
+		index := biopb.PAMFieldIndex{Magic: FieldIndexMagic, Version: "v1"}
+		for i := 0; i < nBlock; i++ {
+			index.Blocks = append(index.Blocks, biopb.PAMBlockIndexEntry{FileOffset: uint64(i) * 100, NumRecords: 10})
+		}
+		data, err := index.Marshal()
+		assert.NoError(t, err)
+		return data
+	}
+	trailer, err := qual.sealIndex(newIndex(3), 3)
+	assert.NoError(t, err)
+	assert.NoError(t, qual.openIndex(trailer, 3))
+	// Readers that don't check the seal skip it.
+	var index biopb.PAMFieldIndex
+	assert.NoError(t, index.Unmarshal(trailer))
+	expect.EQ(t, len(index.Blocks), 3)
+
+	// Dropping the last block and its index entry is detected, whether the
+	// old seal is kept or the index is left unsealed.
+	seal := trailer[len(newIndex(3)):]
+	expect.Regexp(t, qual.openIndex(append(newIndex(2), seal...), 2), "decrypt index of 0:0,1:100.qual with key \"k0\"")
+	expect.Regexp(t, qual.openIndex(trailer, 2), "decrypt index of 0:0,1:100.qual")
+	expect.Regexp(t, qual.openIndex(newIndex(2), 2), "index of 0:0,1:100.qual isn't sealed")
+	// The seal is bound to the file, like the blocks.
+	aux, err := newBlockCipher(ctx, keys, "k0", "/tmp/a/0:0,1:100.aux", 1)
+	assert.NoError(t, err)
+	expect.Regexp(t, aux.openIndex(trailer, 3), "decrypt index of 0:0,1:100.aux")
+}
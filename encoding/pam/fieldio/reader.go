@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"unsafe"
 
 	"sync/atomic"
@@ -22,6 +23,7 @@ import (
 	"github.com/grailbio/bio/biopb"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/bio/util/iothrottle"
 	"github.com/grailbio/hts/sam"
 )
 
@@ -35,6 +37,11 @@ type Reader struct {
 	blocks []biopb.PAMBlockIndexEntry // Subset of index.Blocks that intersect requestedRange.
 	fb     fieldReadBuf               // Current buffer being parsed.
 	err    *errors.Once
+	// cipher, if non-nil, decrypts and uncompresses each block.  blockSeq is
+	// the sequence number of the block being read, which is part of its
+	// additional data.
+	cipher   *blockCipher
+	blockSeq int
 
 	coordField    bool                // True if the field is gbam.FieldCoord.
 	addrGenerator gbam.CoordGenerator // Computes biopb.Coord.Seq. Used only when coordField=true.
@@ -46,6 +53,16 @@ type Reader struct {
 // computes biopb.Coord.Seq values. If no file is found for this field, return
 // value is nil, nil.
 func NewReader(ctx context.Context, path, label string, coordField bool, fileOpts file.Opts, errp *errors.Once) (*Reader, error) {
+	return NewReaderWithIndex(ctx, path, label, coordField, nil, nil, nil, fileOpts, errp)
+}
+
+// NewReaderWithIndex is NewReader for a file whose index is already known,
+// e.g. from the Index of an earlier reader of the same file. If index is nil,
+// it is read from the file. The index is not modified, so it may be shared by
+// concurrent readers. If throttle is non-nil, it limits the reads of the file.
+// Keys supplies the key of an encrypted file; opening an encrypted file fails
+// if it is nil.
+func NewReaderWithIndex(ctx context.Context, path, label string, coordField bool, index *biopb.PAMFieldIndex, throttle *iothrottle.Throttle, keys KeyProvider, fileOpts file.Opts, errp *errors.Once) (*Reader, error) {
 	fr := &Reader{
 		coordField: coordField,
 		label:      label,
@@ -60,8 +77,27 @@ func NewReader(ctx context.Context, path, label string, coordField bool, fileOpt
 	}
 	fr.in = in
 	fr.rin = fr.in.Reader(ctx)
-	fr.rio = recordio.NewScanner(fr.rin, recordio.ScannerOpts{})
+	if throttle != nil {
+		fr.rin = throttle.Reader(fr.rin).(io.ReadSeeker)
+	}
+	fr.rio = recordio.NewScanner(fr.rin, recordio.ScannerOpts{Unmarshal: fr.unmarshalBlock})
 	fr.addrGenerator = gbam.NewCoordGenerator()
+	for _, kv := range fr.rio.Header() {
+		if kv.Key != EncryptionKeyIDHeader {
+			continue
+		}
+		keyID, _ := kv.Value.(string)
+		if keys == nil {
+			return fr, fmt.Errorf("fieldio open %s: the field is encrypted with key %q, but no key provider was given", path, keyID)
+		}
+		if fr.cipher, err = newBlockCipher(ctx, keys, keyID, path, 0); err != nil {
+			return fr, errors.E(err, fmt.Sprintf("fieldio open %s", path))
+		}
+	}
+	if index != nil {
+		fr.index = *index
+		return fr, nil
+	}
 	trailer := fr.rio.Trailer()
 	if len(trailer) == 0 {
 		return fr, errors.E(fr.rio.Err(), fmt.Sprintf("fieldio open %v: file does not contain an index", path))
@@ -69,9 +105,29 @@ func NewReader(ctx context.Context, path, label string, coordField bool, fileOpt
 	if err := fr.index.Unmarshal(trailer); err != nil {
 		return fr, errors.E(err, fmt.Sprintf("fieldio open %s: Failed to unmarshal field index for %s", path, label))
 	}
+	if fr.cipher != nil {
+		// Unmarshal skips the seal, and the seal covers the number of blocks.
+		if err := fr.cipher.openIndex(trailer, len(fr.index.Blocks)); err != nil {
+			return fr, errors.E(err, fmt.Sprintf("fieldio open %s", path))
+		}
+	}
 	return fr, nil
 }
 
+// unmarshalBlock decrypts an encrypted block.
+func (fr *Reader) unmarshalBlock(in []byte) (interface{}, error) {
+	if fr.cipher == nil {
+		return in, nil
+	}
+	return fr.cipher.open(in, fr.blockSeq)
+}
+
+// Index returns the contents of the field's index. The caller must not modify
+// it.
+func (fr *Reader) Index() *biopb.PAMFieldIndex {
+	return &fr.index
+}
+
 // For parsing values of one field in one recordio block.
 type fieldReadBuf struct {
 	header              biopb.PAMBlockHeader
@@ -264,6 +320,12 @@ func (fr *Reader) readNextBlock() bool {
 	addr := fr.blocks[0]
 	fr.blocks = fr.blocks[1:]
 
+	if fr.cipher != nil {
+		// The writer numbers the blocks in file order.
+		fr.blockSeq = sort.Search(len(fr.index.Blocks), func(i int) bool {
+			return fr.index.Blocks[i].FileOffset >= addr.FileOffset
+		})
+	}
 	// Read and uncompress the recordio block.
 	if err := fr.readBlock(int64(addr.FileOffset)); err != nil {
 		fr.err.Set(err)
@@ -593,7 +655,8 @@ func (fr *Reader) Seek(requestedRange biopb.CoordRange) (biopb.Coord, bool) {
 		return biopb.Coord{}, false
 	}
 	if !fr.readNextBlock() {
-		panic(fr)
+		// The error, e.g. a block which fails to decrypt, is in fr.err.
+		return biopb.Coord{}, false
 	}
 	return fr.fb.index.StartAddr, true
 }
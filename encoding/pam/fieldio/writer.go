@@ -32,6 +32,9 @@ type Writer struct {
 	wout  io.Writer       // out.Writer
 	rio   recordio.Writer // recordio wrapper for out.
 
+	// cipher, if non-nil, compresses and encrypts each block.
+	cipher *blockCipher
+
 	// Value to be assigned to the "seq" field of a new fieldWriteBuf.
 	nextBlockSeq int
 
@@ -301,6 +304,9 @@ func (fw *Writer) marshalBlock(scratch []byte, v interface{}) ([]byte, error) {
 	copy(serialized[len(bb):], tmpBuf1[:n])
 	copy(serialized[len(bb)+n:], defaultData)
 	copy(serialized[len(bb)+n+len(defaultData):], blobData)
+	if fw.cipher != nil {
+		return fw.cipher.seal(serialized, wb.seq)
+	}
 	return serialized, nil
 }
 
@@ -368,6 +374,11 @@ func (fw *Writer) Close() {
 		if err != nil {
 			panic(err)
 		}
+		if fw.cipher != nil {
+			if data, err = fw.cipher.sealIndex(data, len(index.Blocks)); err != nil {
+				fw.err.Set(err)
+			}
+		}
 		fw.rio.SetTrailer(data)
 		if err := fw.rio.Finish(); err != nil {
 			fw.err.Set(err)
@@ -379,8 +390,10 @@ func (fw *Writer) Close() {
 }
 
 // NewWriter creates a new field writer that writes to the given path. Label is
-// used for logging. Transformers is set as the recordio transformers.
-func NewWriter(path, label string, transformers []string, bufFreePool *WriteBufPool, opts file.Opts, errp *errors.Once) *Writer {
+// used for logging. Transformers is set as the recordio transformers. If enc is
+// non-nil, the blocks are encrypted with its key; transformers must then be a
+// single zstd transformer, which is applied before the encryption.
+func NewWriter(path, label string, transformers []string, enc *Encryption, bufFreePool *WriteBufPool, opts file.Opts, errp *errors.Once) *Writer {
 	mu := &sync.Mutex{}
 	fw := &Writer{
 		label:            label,
@@ -391,8 +404,19 @@ func NewWriter(path, label string, transformers []string, bufFreePool *WriteBufP
 		err:              errp,
 	}
 	fw.NewBuf()
-	// Create a recordio file
 	ctx := backgroundcontext.Get()
+	if enc != nil {
+		zstdLevel, err := parseZstdLevel(transformers)
+		if err == nil {
+			fw.cipher, err = newBlockCipher(ctx, enc.Keys, enc.KeyID, path, zstdLevel)
+		}
+		if err != nil {
+			fw.err.Set(errors.E(err, fmt.Sprintf("fieldio newwriter %s", path)))
+			return fw
+		}
+		transformers = nil
+	}
+	// Create a recordio file
 	out, err := file.Create(ctx, path, opts)
 	if err != nil {
 		fw.err.Set(errors.E(err, fmt.Sprintf("fieldio newwriter %s", path)))
@@ -407,6 +431,9 @@ func NewWriter(path, label string, transformers []string, bufFreePool *WriteBufP
 		MaxFlushParallelism: 2,
 	})
 	fw.rio.AddHeader(recordio.KeyTrailer, true)
+	if enc != nil {
+		fw.rio.AddHeader(EncryptionKeyIDHeader, enc.KeyID)
+	}
 	return fw
 }
 
@@ -0,0 +1,109 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/sam"
+)
+
+// IndexCache caches the indexes of PAM files: the list of shards of each
+// directory, the shard indexes (and the sam.Headers in them), and the field
+// indexes. Readers that share a cache through ReadOpts.IndexCache read and
+// parse each index only once, instead of once per reader.
+//
+// IndexCache is thread safe. Entries are never invalidated, so a cache must
+// not outlive the PAM files it was used for if they may be rewritten. Failed
+// reads are not cached.
+type IndexCache struct {
+	mu     sync.Mutex
+	lists  map[string][]pamutil.FileInfo
+	shards map[string]*cachedShardIndex
+	fields map[string]*biopb.PAMFieldIndex
+}
+
+type cachedShardIndex struct {
+	index  biopb.PAMShardIndex
+	header *sam.Header
+}
+
+// NewIndexCache creates an empty IndexCache.
+func NewIndexCache() *IndexCache {
+	return &IndexCache{
+		lists:  map[string][]pamutil.FileInfo{},
+		shards: map[string]*cachedShardIndex{},
+		fields: map[string]*biopb.PAMFieldIndex{},
+	}
+}
+
+// ListIndexes is pamutil.ListIndexes, cached. The caller must not modify the
+// result.
+func (c *IndexCache) ListIndexes(ctx context.Context, dir string) ([]pamutil.FileInfo, error) {
+	c.mu.Lock()
+	list, ok := c.lists[dir]
+	c.mu.Unlock()
+	if ok {
+		return list, nil
+	}
+	// Concurrent misses may read the same list; they get identical results.
+	list, err := pamutil.ListIndexes(ctx, dir)
+	if err != nil || len(list) == 0 {
+		return list, err
+	}
+	c.mu.Lock()
+	c.lists[dir] = list
+	c.mu.Unlock()
+	return list, nil
+}
+
+// ShardIndex is pamutil.ReadShardIndex, cached, plus the sam.Header decoded
+// from the index. The caller must not modify the results.
+func (c *IndexCache) ShardIndex(ctx context.Context, dir string, recRange biopb.CoordRange) (*biopb.PAMShardIndex, *sam.Header, error) {
+	path := pamutil.ShardIndexPath(dir, recRange)
+	c.mu.Lock()
+	e, ok := c.shards[path]
+	c.mu.Unlock()
+	if ok {
+		return &e.index, e.header, nil
+	}
+	index, err := pamutil.ReadShardIndex(ctx, dir, recRange)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := gbam.UnmarshalHeader(index.EncodedBamHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// If another reader got here first, use its entry, so that the readers of
+	// a shard share one header.
+	if e, ok = c.shards[path]; !ok {
+		e = &cachedShardIndex{index: index, header: header}
+		c.shards[path] = e
+	}
+	return &e.index, e.header, nil
+}
+
+// fieldIndex returns the cached index of the field file at path, or nil.
+func (c *IndexCache) fieldIndex(path string) *biopb.PAMFieldIndex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fields[path]
+}
+
+// addFieldIndex caches the index of the field file at path.
+func (c *IndexCache) addFieldIndex(path string, index *biopb.PAMFieldIndex) {
+	c.mu.Lock()
+	if _, ok := c.fields[path]; !ok {
+		c.fields[path] = index
+	}
+	c.mu.Unlock()
+}
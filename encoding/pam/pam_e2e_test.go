@@ -5,6 +5,7 @@
 package pam_test
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -235,6 +236,62 @@ func TestReadSubsetColumns(t *testing.T) {
 	assert.NoError(t, r.Close())
 }
 
+// testKeys is a fieldio.KeyProvider with fixed keys.
+type testKeys map[string][]byte
+
+func (k testKeys) Key(ctx context.Context, keyID string) ([]byte, error) {
+	key, ok := k[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no key %q", keyID)
+	}
+	return key, nil
+}
+
+func TestEncryptFields(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
+	pamPath := filepath.Join(tempDir, "test")
+	keys := testKeys{"k0": []byte("0123456789abcdef0123456789abcdef")}
+	generatePAM(t, pam.WriteOpts{
+		MaxBufSize:    150,
+		EncryptFields: []gbam.FieldType{gbam.FieldQual, gbam.FieldAux},
+		KeyProvider:   keys,
+		KeyID:         "k0",
+	}, pamPath, bamPath)
+	verifyPAM(t, pam.ReadOpts{KeyProvider: keys}, pamPath, bamPath)
+
+	// Without the key, the encrypted fields can only be dropped.
+	r := pam.NewReader(pam.ReadOpts{}, pamPath)
+	assert.False(t, r.Scan())
+	assert.Regexp(t, r.Close(), "encrypted with key \"k0\", but no key provider")
+	r = pam.NewReader(pam.ReadOpts{KeyProvider: testKeys{"k0": []byte("fedcba9876543210fedcba9876543210")}}, pamPath)
+	assert.False(t, r.Scan())
+	assert.Regexp(t, r.Close(), "decrypt index of .* with key \"k0\"")
+	r = pam.NewReader(pam.ReadOpts{DropFields: []gbam.FieldType{gbam.FieldQual, gbam.FieldAux}}, pamPath)
+	n := 0
+	for r.Scan() {
+		n++
+	}
+	assert.NoError(t, r.Close())
+	assert.True(t, n > 0)
+
+	// The blocks and the index are bound to their field: a qual file renamed
+	// to the aux file fails to open.
+	qualPaths, err := filepath.Glob(filepath.Join(pamPath, "*.qual"))
+	assert.NoError(t, err)
+	assert.EQ(t, len(qualPaths), 1)
+	auxPath := strings.TrimSuffix(qualPaths[0], ".qual") + ".aux"
+	assert.NoError(t, os.Rename(qualPaths[0], auxPath))
+	r = pam.NewReader(pam.ReadOpts{KeyProvider: keys, DropFields: []gbam.FieldType{gbam.FieldQual}}, pamPath)
+	assert.False(t, r.Scan())
+	assert.Regexp(t, r.Close(), "decrypt index of .*\\.aux with key \"k0\"")
+
+	rbam := mustOpenBAM(t, bamPath)
+	w := pam.NewWriter(pam.WriteOpts{EncryptFields: []gbam.FieldType{gbam.FieldCoord}, KeyProvider: keys, KeyID: "k0"}, rbam.Header(), filepath.Join(tempDir, "coord"))
+	assert.Regexp(t, w.Close(), "field coord cannot be encrypted")
+}
+
 func TestReadWriteUnmapped(t *testing.T) {
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer cleanup()
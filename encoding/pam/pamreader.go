@@ -19,6 +19,7 @@ import (
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/pam/fieldio"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/bio/util/iothrottle"
 	"github.com/grailbio/hts/sam"
 	"v.io/x/lib/vlog"
 )
@@ -41,6 +42,19 @@ type ReadOpts struct {
 	// reported as not found.  This flag is passed to file.Opts. See file.Opts for
 	// more details.
 	RetryWhenNotFound bool
+
+	// IndexCache, if non-nil, is used to read the indexes of the PAM file, so
+	// that concurrent or successive readers of the same file don't each read
+	// them again.
+	IndexCache *IndexCache
+
+	// Throttle, if non-nil, limits the reads of the field data files.
+	Throttle *iothrottle.Throttle
+
+	// KeyProvider supplies the keys of fields encrypted with
+	// WriteOpts.EncryptFields. Reading an encrypted field fails if it is nil;
+	// such fields can be skipped with DropFields.
+	KeyProvider fieldio.KeyProvider
 }
 
 // ShardReader is for reading one PAM rowshard. This class is generally hidden
@@ -329,16 +343,26 @@ func NewShardReader(
 		r.needField[f] = false
 	}
 	var err error
-	if r.index, err = pamutil.ReadShardIndex(vcontext.Background(), r.path, r.shardRange); err != nil {
-		vlog.Errorf("Failed to read shard index: %v", err)
-		r.err.Set(errors.E(err, fmt.Sprintf("newshardreader %s: read shard index", r.path)))
-		return r
-	}
+	if opts.IndexCache != nil {
+		var index *biopb.PAMShardIndex
+		if index, r.header, err = opts.IndexCache.ShardIndex(vcontext.Background(), r.path, r.shardRange); err != nil {
+			vlog.Errorf("Failed to read shard index: %v", err)
+			r.err.Set(errors.E(err, fmt.Sprintf("newshardreader %s: read shard index", r.path)))
+			return r
+		}
+		r.index = *index
+	} else {
+		if r.index, err = pamutil.ReadShardIndex(vcontext.Background(), r.path, r.shardRange); err != nil {
+			vlog.Errorf("Failed to read shard index: %v", err)
+			r.err.Set(errors.E(err, fmt.Sprintf("newshardreader %s: read shard index", r.path)))
+			return r
+		}
 
-	r.header, err = gbam.UnmarshalHeader(r.index.EncodedBamHeader)
-	if err != nil {
-		r.err.Set(errors.E(err, fmt.Sprintf("newshardeader %s: decode sam.Header in index", r.path)))
-		return r
+		r.header, err = gbam.UnmarshalHeader(r.index.EncodedBamHeader)
+		if err != nil {
+			r.err.Set(errors.E(err, fmt.Sprintf("newshardeader %s: decode sam.Header in index", r.path)))
+			return r
+		}
 	}
 	if !r.requestedRange.Intersects(r.shardRange) {
 		vlog.Panicf("%v: Range doesn't intersect", r.label)
@@ -353,7 +377,11 @@ func NewShardReader(
 				pamutil.CoordRangePathString(r.requestedRange),
 				gbam.FieldType(f))
 			fileOpts := file.Opts{RetryWhenNotFound: opts.RetryWhenNotFound}
-			r.fieldReaders[f], err = fieldio.NewReader(ctx, path, label, f == int(gbam.FieldCoord), fileOpts, errp)
+			var fieldIndex *biopb.PAMFieldIndex
+			if opts.IndexCache != nil {
+				fieldIndex = opts.IndexCache.fieldIndex(path)
+			}
+			r.fieldReaders[f], err = fieldio.NewReaderWithIndex(ctx, path, label, f == int(gbam.FieldCoord), fieldIndex, opts.Throttle, opts.KeyProvider, fileOpts, errp)
 			if err != nil {
 				r.err.Set(err)
 				return r
@@ -361,6 +389,11 @@ func NewShardReader(
 				r.err.Set(fmt.Errorf("missing file for %s: %s", label, path))
 				return r
 			}
+			if (opts.IndexCache != nil) && (fieldIndex == nil) {
+				// Copy the index, so that the cache doesn't pin the reader.
+				index := *r.fieldReaders[f].Index()
+				opts.IndexCache.addFieldIndex(path, &index)
+			}
 		}
 	}
 	r.seek(r.requestedRange)
@@ -409,7 +442,15 @@ func NewReader(opts ReadOpts, dir string) *Reader {
 	}
 	r.label = fmt.Sprintf("%s:u%s", file.Base(dir), pamutil.CoordRangePathString(r.opts.Range))
 	var err error
-	if r.indexFiles, err = pamutil.FindIndexFilesInRange(r.ctx, dir, r.opts.Range); err != nil {
+	if r.opts.IndexCache != nil {
+		var allFiles []pamutil.FileInfo
+		if allFiles, err = r.opts.IndexCache.ListIndexes(r.ctx, dir); err == nil {
+			r.indexFiles, err = pamutil.ChooseIndexFilesInRange(allFiles, r.opts.Range)
+		}
+	} else {
+		r.indexFiles, err = pamutil.FindIndexFilesInRange(r.ctx, dir, r.opts.Range)
+	}
+	if err != nil {
 		r.err.Set(err)
 		return r
 	}
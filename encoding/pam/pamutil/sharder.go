@@ -71,6 +71,12 @@ func readFieldIndex(ctx context.Context, dir string, recRange biopb.CoordRange,
 	return index, err
 }
 
+// ReadFieldIndex reads and validates the block index of the given field in
+// the rowshard "dir/recRange".
+func ReadFieldIndex(ctx context.Context, dir string, recRange biopb.CoordRange, field string) (biopb.PAMFieldIndex, error) {
+	return readFieldIndex(ctx, dir, recRange, field)
+}
+
 func readAndSubsetIndexes(ctx context.Context, files []FileInfo, recRange biopb.CoordRange, fields []string) ([]ShardIndex, error) {
 	// Extract a subset of "blocks" that intersect with
 	// requestedRange. shardLimit is the limit of the shard file.
@@ -39,6 +39,17 @@ type WriteOpts struct {
 	// DropFields causes the writer not to write the specified fields to file.
 	DropFields []gbam.FieldType
 
+	// EncryptFields causes the writer to encrypt the specified fields, e.g.
+	// FieldQual, or FieldAux when aux tags hold sample identifiers, with
+	// AES-GCM. The key is KeyProvider.Key(KeyID). The ID is stored in the field
+	// files, and readers decrypt them when ReadOpts.KeyProvider supplies the
+	// same key. The coord field cannot be encrypted, since readers need it to
+	// seek. Encrypted fields are always compressed with zstd, so Transformers
+	// must be a single zstd transformer.
+	EncryptFields []gbam.FieldType
+	KeyProvider   fieldio.KeyProvider
+	KeyID         string
+
 	// Transformers defines the recordio block transformers. It can be used to
 	// change the compression algorithm, for example. The value is passed to
 	// recordio.WriteOpts.Transformers. If empty, {"zstd"} is used.
@@ -90,6 +101,16 @@ func validateWriteOpts(o *WriteOpts) error {
 	if len(o.Transformers) == 0 {
 		o.Transformers = []string{"zstd"}
 	}
+	if len(o.EncryptFields) > 0 {
+		if o.KeyProvider == nil {
+			return fmt.Errorf("pam: EncryptFields %v requires a KeyProvider", o.EncryptFields)
+		}
+		for _, f := range o.EncryptFields {
+			if f == gbam.FieldCoord {
+				return fmt.Errorf("pam: field %v cannot be encrypted", f)
+			}
+		}
+	}
 	return pamutil.ValidateCoordRange(&o.Range)
 }
 
@@ -176,7 +197,9 @@ func (w *Writer) Close() error {
 		}
 		return nil
 	})
-	w.bufPool.Finish()
+	if w.bufPool != nil { // nil if the options are invalid.
+		w.bufPool.Finish()
+	}
 	if w.err.Err() != nil {
 		return w.err.Err()
 	}
@@ -201,6 +224,10 @@ func NewWriter(wo WriteOpts, samHeader *sam.Header, dir string) *Writer {
 	for _, f := range wo.DropFields {
 		dropField[f] = true
 	}
+	encryptField := [gbam.NumFields]bool{}
+	for _, f := range wo.EncryptFields {
+		encryptField[f] = true
+	}
 	nWrittenFields := 0
 	for _, f := range dropField {
 		if !f {
@@ -218,7 +245,11 @@ func NewWriter(wo WriteOpts, samHeader *sam.Header, dir string) *Writer {
 
 		path := pamutil.FieldDataPath(dir, w.opts.Range, gbam.FieldType(f).String())
 		label := fmt.Sprintf("%s:%s:%v", file.Base(dir), pamutil.CoordRangePathString(w.opts.Range), gbam.FieldType(f))
-		fw := fieldio.NewWriter(path, label, w.opts.Transformers, w.bufPool, file.Opts{IgnoreNoSuchUpload: wo.IgnoreNoSuchUpload}, &w.err)
+		var enc *fieldio.Encryption
+		if encryptField[f] {
+			enc = &fieldio.Encryption{Keys: w.opts.KeyProvider, KeyID: w.opts.KeyID}
+		}
+		fw := fieldio.NewWriter(path, label, w.opts.Transformers, enc, w.bufPool, file.Opts{IgnoreNoSuchUpload: wo.IgnoreNoSuchUpload}, &w.err)
 		w.fieldWriters[f] = fw
 	}
 	return w
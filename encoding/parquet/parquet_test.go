@@ -0,0 +1,105 @@
+package parquet_test
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/parquet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testColumns = []parquet.Column{
+	{Name: "chrom", Type: parquet.String},
+	{Name: "pos", Type: parquet.Int64},
+	{Name: "depth", Type: parquet.Int32},
+	{Name: "frac", Type: parquet.Double},
+	{Name: "qual", Type: parquet.Float},
+	{Name: "read_pos", Type: parquet.Int32, List: true},
+	{Name: "read_names", Type: parquet.String, List: true},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, opts := range []parquet.WriterOpts{
+		{},
+		{RowGroupSize: 7, Codec: parquet.Snappy, Metadata: map[string]string{"schema_version": "1", "tool": "test"}, CreatedBy: "bio-pileup"},
+	} {
+		const nRow = 100
+		var buf bytes.Buffer
+		w, err := parquet.NewWriter(&buf, testColumns, opts)
+		require.NoError(t, err)
+		var (
+			wantChrom     []string
+			wantPos       []int64
+			wantDepth     []int32
+			wantFrac      []float64
+			wantQual      []float32
+			wantReadPos   [][]int32
+			wantReadNames [][]string
+		)
+		for i := 0; i < nRow; i++ {
+			chrom := "chr" + strconv.Itoa(1+i/50)
+			w.String(0, chrom)
+			w.Int64(1, int64(i)*1000)
+			w.Int32(2, int32(i%13))
+			w.Double(3, float64(i)/3)
+			w.Float(4, float32(i)/7)
+			readPos := []int32{}
+			readNames := []string{}
+			for j := 0; j < i%4; j++ {
+				w.Int32(5, int32(i+j))
+				readPos = append(readPos, int32(i+j))
+			}
+			for j := 0; j < i%3; j++ {
+				name := "read" + strconv.Itoa(i*10+j)
+				w.String(6, name)
+				readNames = append(readNames, name)
+			}
+			require.NoError(t, w.EndRow())
+			wantChrom = append(wantChrom, chrom)
+			wantPos = append(wantPos, int64(i)*1000)
+			wantDepth = append(wantDepth, int32(i%13))
+			wantFrac = append(wantFrac, float64(i)/3)
+			wantQual = append(wantQual, float32(i)/7)
+			wantReadPos = append(wantReadPos, readPos)
+			wantReadNames = append(wantReadNames, readNames)
+		}
+		require.NoError(t, w.Close())
+
+		r, err := parquet.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		assert.Equal(t, testColumns, r.Columns)
+		assert.Equal(t, int64(nRow), r.NumRows)
+		assert.Equal(t, opts.Metadata, r.Metadata)
+		assert.Equal(t, opts.CreatedBy, r.CreatedBy)
+		for col, want := range []interface{}{wantChrom, wantPos, wantDepth, wantFrac, wantQual, wantReadPos, wantReadNames} {
+			got, err := r.ReadColumn(col)
+			require.NoError(t, err)
+			assert.Equal(t, want, got, testColumns[col].Name)
+		}
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := parquet.NewWriter(&buf, nil, parquet.WriterOpts{})
+	assert.Error(t, err)
+	_, err = parquet.NewWriter(&buf, []parquet.Column{{Name: "a"}, {Name: "a"}}, parquet.WriterOpts{})
+	assert.Error(t, err)
+
+	w, err := parquet.NewWriter(&buf, testColumns[:2], parquet.WriterOpts{})
+	require.NoError(t, err)
+	w.String(0, "chr1")
+	// Missing pos.
+	assert.Error(t, w.EndRow())
+
+	w, err = parquet.NewWriter(&buf, testColumns[:2], parquet.WriterOpts{})
+	require.NoError(t, err)
+	w.String(0, "chr1")
+	w.Int32(1, 5)
+	assert.Error(t, w.EndRow())
+
+	_, err = parquet.NewReader(bytes.NewReader([]byte("PAR1 not really")), 15)
+	assert.Error(t, err)
+}
@@ -0,0 +1,334 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/golang/snappy"
+)
+
+// Reader reads the files written by Writer, and other files with the same
+// restrictions: required primitive or three-level LIST columns, PLAIN-encoded
+// version-1 data pages, and uncompressed or snappy-compressed chunks.
+type Reader struct {
+	r io.ReaderAt
+	// Columns is the schema of the file.
+	Columns []Column
+	// NumRows is the number of rows in the file.
+	NumRows int64
+	// Metadata is the file's key-value metadata.
+	Metadata map[string]string
+	// CreatedBy identifies the application that wrote the file.
+	CreatedBy string
+
+	rowGroups []thriftStruct
+}
+
+var typeOfPhysical = map[int64]Type{1: Int32, 2: Int64, 4: Float, 5: Double, 6: String}
+
+// NewReader reads the footer of the size-byte file r.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < 2*int64(len(magic))+4 {
+		return nil, fmt.Errorf("parquet.NewReader: file too short")
+	}
+	var tail [8]byte
+	if _, err := r.ReadAt(tail[:], size-8); err != nil {
+		return nil, fmt.Errorf("parquet.NewReader: %v", err)
+	}
+	if string(tail[4:]) != magic {
+		return nil, fmt.Errorf("parquet.NewReader: not a parquet file")
+	}
+	metaLen := int64(binary.LittleEndian.Uint32(tail[:4]))
+	if metaLen > size-8-int64(len(magic)) {
+		return nil, fmt.Errorf("parquet.NewReader: bad footer length %d", metaLen)
+	}
+	buf := make([]byte, metaLen)
+	if _, err := r.ReadAt(buf, size-8-metaLen); err != nil {
+		return nil, fmt.Errorf("parquet.NewReader: %v", err)
+	}
+	t := thriftReader{buf: buf}
+	meta := t.readStruct()
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	pr := &Reader{r: r, NumRows: meta.int(3), CreatedBy: meta.str(6)}
+	schema := meta.list(2)
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("parquet.NewReader: empty schema")
+	}
+	for i := 1; i < len(schema); i++ {
+		elem, _ := schema[i].(thriftStruct)
+		col := Column{Name: elem.str(4)}
+		if elem.int(5) > 0 {
+			// A LIST group: <name> (LIST) { repeated group list { element } }.
+			if i+2 >= len(schema) || elem.int(6) != convertedList {
+				return nil, fmt.Errorf("parquet.NewReader: unsupported group column %s", col.Name)
+			}
+			col.List = true
+			i += 2
+			elem, _ = schema[i].(thriftStruct)
+		}
+		typ, ok := typeOfPhysical[elem.int(1)]
+		if !ok || elem.int(3) != repRequired {
+			return nil, fmt.Errorf("parquet.NewReader: unsupported column %s", col.Name)
+		}
+		col.Type = typ
+		pr.Columns = append(pr.Columns, col)
+	}
+	for _, kv := range meta.list(5) {
+		kv, _ := kv.(thriftStruct)
+		if pr.Metadata == nil {
+			pr.Metadata = map[string]string{}
+		}
+		pr.Metadata[kv.str(1)] = kv.str(2)
+	}
+	for _, rg := range meta.list(4) {
+		rg, _ := rg.(thriftStruct)
+		if len(rg.list(1)) != len(pr.Columns) {
+			return nil, fmt.Errorf("parquet.NewReader: row group has %d columns, expected %d", len(rg.list(1)), len(pr.Columns))
+		}
+		pr.rowGroups = append(pr.rowGroups, rg)
+	}
+	return pr, nil
+}
+
+// decodeLevels decodes n levels in the RLE/bit-packing hybrid encoding with
+// bit width 1, preceded by a 4-byte length.  It returns the levels and the
+// rest of b.
+func decodeLevels(b []byte, n int) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("parquet: truncated levels")
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	if size > len(b)-4 {
+		return nil, nil, fmt.Errorf("parquet: truncated levels")
+	}
+	enc, rest := b[4:4+size], b[4+size:]
+	levels := make([]byte, 0, n)
+	for len(levels) < n {
+		h, k := binary.Uvarint(enc)
+		if k <= 0 {
+			return nil, nil, fmt.Errorf("parquet: bad level run header")
+		}
+		enc = enc[k:]
+		if h&1 == 0 {
+			// RLE run.
+			if len(enc) < 1 {
+				return nil, nil, fmt.Errorf("parquet: truncated level run")
+			}
+			for i := uint64(0); i < h>>1 && len(levels) < n; i++ {
+				levels = append(levels, enc[0]&1)
+			}
+			enc = enc[1:]
+		} else {
+			// Bit-packed run of (h>>1)*8 values.
+			nByte := int(h >> 1)
+			if len(enc) < nByte {
+				return nil, nil, fmt.Errorf("parquet: truncated level run")
+			}
+			for i := 0; i < nByte*8 && len(levels) < n; i++ {
+				levels = append(levels, (enc[i/8]>>uint(i%8))&1)
+			}
+			enc = enc[nByte:]
+		}
+	}
+	return levels, rest, nil
+}
+
+// columnData accumulates the values of a column.
+type columnData struct {
+	typ     Type
+	int32s  []int32
+	int64s  []int64
+	floats  []float32
+	doubles []float64
+	strings []string
+	// lens are the list lengths, for list columns.
+	lens []int
+}
+
+func (d *columnData) decodeValues(b []byte, n int) error {
+	width := map[Type]int{Int32: 4, Int64: 8, Float: 4, Double: 8}[d.typ]
+	if d.typ != String && len(b) < n*width {
+		return fmt.Errorf("parquet: truncated page")
+	}
+	for i := 0; i < n; i++ {
+		switch d.typ {
+		case Int32:
+			d.int32s = append(d.int32s, int32(binary.LittleEndian.Uint32(b[4*i:])))
+		case Int64:
+			d.int64s = append(d.int64s, int64(binary.LittleEndian.Uint64(b[8*i:])))
+		case Float:
+			d.floats = append(d.floats, math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:])))
+		case Double:
+			d.doubles = append(d.doubles, math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:])))
+		case String:
+			if len(b) < 4 {
+				return fmt.Errorf("parquet: truncated page")
+			}
+			l := int(binary.LittleEndian.Uint32(b))
+			if l > len(b)-4 {
+				return fmt.Errorf("parquet: truncated page")
+			}
+			d.strings = append(d.strings, string(b[4:4+l]))
+			b = b[4+l:]
+		}
+	}
+	return nil
+}
+
+// readChunk appends the values of column chunk cc to d.
+func (r *Reader) readChunk(cc thriftStruct, col Column, codec Codec, d *columnData) error {
+	md := cc.strct(3)
+	off := md.int(9)
+	remaining := md.int(5)
+	end := off + md.int(7)
+	for remaining > 0 {
+		if off >= end {
+			return fmt.Errorf("parquet: column %s chunk is missing values", col.Name)
+		}
+		// Page headers are small; read a generous prefix and decode from it.
+		hdrBuf := make([]byte, 256)
+		if end-off < int64(len(hdrBuf)) {
+			hdrBuf = hdrBuf[:end-off]
+		}
+		if _, err := r.r.ReadAt(hdrBuf, off); err != nil && err != io.EOF {
+			return err
+		}
+		t := thriftReader{buf: hdrBuf}
+		hdr := t.readStruct()
+		if t.err != nil {
+			return t.err
+		}
+		if hdr.int(1) != pageTypeData {
+			return fmt.Errorf("parquet: column %s: unsupported page type %d", col.Name, hdr.int(1))
+		}
+		dph := hdr.strct(5)
+		if dph.int(2) != encodingPlain {
+			return fmt.Errorf("parquet: column %s: unsupported encoding %d", col.Name, dph.int(2))
+		}
+		if size := hdr.int(3); size < 0 || size > end-off-int64(t.off) {
+			return fmt.Errorf("parquet: column %s: bad page size %d", col.Name, size)
+		}
+		body := make([]byte, hdr.int(3))
+		if _, err := r.r.ReadAt(body, off+int64(t.off)); err != nil {
+			return err
+		}
+		off += int64(t.off) + int64(len(body))
+		if codec == Snappy {
+			var err error
+			if body, err = snappy.Decode(nil, body); err != nil {
+				return err
+			}
+		}
+		n := int(dph.int(1))
+		nValues := n
+		if col.List {
+			var rep, def []byte
+			var err error
+			if rep, body, err = decodeLevels(body, n); err != nil {
+				return err
+			}
+			if def, body, err = decodeLevels(body, n); err != nil {
+				return err
+			}
+			nValues = 0
+			for i := range rep {
+				if rep[i] == 0 {
+					d.lens = append(d.lens, 0)
+				}
+				if len(d.lens) == 0 {
+					return fmt.Errorf("parquet: column %s: bad repetition levels", col.Name)
+				}
+				if def[i] == 1 {
+					d.lens[len(d.lens)-1]++
+					nValues++
+				}
+			}
+		}
+		if err := d.decodeValues(body, nValues); err != nil {
+			return err
+		}
+		remaining -= int64(n)
+	}
+	return nil
+}
+
+// ReadColumn returns all values of column col.  The result is a []int32,
+// []int64, []float32, []float64, or []string for plain columns, and a slice
+// of those, with one element per row, for list columns.
+func (r *Reader) ReadColumn(col int) (interface{}, error) {
+	if col < 0 || col >= len(r.Columns) {
+		return nil, fmt.Errorf("parquet.ReadColumn: column %d out of range", col)
+	}
+	c := r.Columns[col]
+	d := columnData{typ: c.Type}
+	for _, rg := range r.rowGroups {
+		cc, _ := rg.list(1)[col].(thriftStruct)
+		codec := Codec(cc.strct(3).int(4))
+		if codec != Uncompressed && codec != Snappy {
+			return nil, fmt.Errorf("parquet.ReadColumn: column %s: unsupported codec %d", c.Name, codec)
+		}
+		if err := r.readChunk(cc, c, codec, &d); err != nil {
+			return nil, fmt.Errorf("parquet.ReadColumn: %v", err)
+		}
+	}
+	if !c.List {
+		switch c.Type {
+		case Int32:
+			return d.int32s, nil
+		case Int64:
+			return d.int64s, nil
+		case Float:
+			return d.floats, nil
+		case Double:
+			return d.doubles, nil
+		}
+		return d.strings, nil
+	}
+	var start int
+	split := func(i int) (int, int) {
+		s := start
+		start += d.lens[i]
+		return s, start
+	}
+	switch c.Type {
+	case Int32:
+		rows := make([][]int32, len(d.lens))
+		for i := range rows {
+			s, e := split(i)
+			rows[i] = d.int32s[s:e:e]
+		}
+		return rows, nil
+	case Int64:
+		rows := make([][]int64, len(d.lens))
+		for i := range rows {
+			s, e := split(i)
+			rows[i] = d.int64s[s:e:e]
+		}
+		return rows, nil
+	case Float:
+		rows := make([][]float32, len(d.lens))
+		for i := range rows {
+			s, e := split(i)
+			rows[i] = d.floats[s:e:e]
+		}
+		return rows, nil
+	case Double:
+		rows := make([][]float64, len(d.lens))
+		for i := range rows {
+			s, e := split(i)
+			rows[i] = d.doubles[s:e:e]
+		}
+		return rows, nil
+	}
+	rows := make([][]string, len(d.lens))
+	for i := range rows {
+		s, e := split(i)
+		rows[i] = d.strings[s:e:e]
+	}
+	return rows, nil
+}
@@ -0,0 +1,252 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Parquet metadata is serialized with the Thrift compact protocol.  This file
+// implements just enough of it to write and read the structures in
+// parquet.thrift, without generated code.
+
+// Thrift compact protocol type codes.
+const (
+	tBoolTrue  = 1
+	tBoolFalse = 2
+	tByte      = 3
+	tI16       = 4
+	tI32       = 5
+	tI64       = 6
+	tDouble    = 7
+	tBinary    = 8
+	tList      = 9
+	tSet       = 10
+	tMap       = 11
+	tStruct    = 12
+)
+
+// thriftWriter encodes Thrift compact protocol structs.
+type thriftWriter struct {
+	buf []byte
+	// lastID is the id of the last field written in each open struct.
+	lastID []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf = append(t.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+// beginStruct starts a struct, either at top level, as a list element, or
+// after a field header written by structField.
+func (t *thriftWriter) beginStruct() {
+	t.lastID = append(t.lastID, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf = append(t.buf, 0)
+	t.lastID = t.lastID[:len(t.lastID)-1]
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &t.lastID[len(t.lastID)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, tI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, tI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) stringField(id int16, s string) {
+	t.fieldHeader(id, tBinary)
+	t.stringValue(s)
+}
+
+func (t *thriftWriter) stringValue(s string) {
+	t.varint(uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// structField writes the header of a struct-valued field, and starts the
+// struct.
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, tStruct)
+	t.beginStruct()
+}
+
+// listField writes the header of a list-valued field with n elements of type
+// elemType.  The caller then writes the elements.
+func (t *thriftWriter) listField(id int16, elemType byte, n int) {
+	t.fieldHeader(id, tList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elemType)
+	} else {
+		t.buf = append(t.buf, 0xf0|elemType)
+		t.varint(uint64(n))
+	}
+}
+
+// thriftStruct is a decoded struct, keyed by field id.  Integers are decoded
+// as int64, binaries as []byte, lists as []interface{}, and structs as
+// thriftStruct.
+type thriftStruct map[int16]interface{}
+
+func (s thriftStruct) int(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftStruct) str(id int16) string {
+	v, _ := s[id].([]byte)
+	return string(v)
+}
+
+func (s thriftStruct) list(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+func (s thriftStruct) strct(id int16) thriftStruct {
+	v, _ := s[id].(thriftStruct)
+	return v
+}
+
+// thriftReader decodes Thrift compact protocol structs.
+type thriftReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (t *thriftReader) fail(format string, args ...interface{}) {
+	if t.err == nil {
+		t.err = fmt.Errorf("parquet: corrupt metadata: "+format, args...)
+	}
+}
+
+func (t *thriftReader) byte() byte {
+	if t.off >= len(t.buf) {
+		t.fail("truncated")
+		return 0
+	}
+	t.off++
+	return t.buf[t.off-1]
+}
+
+func (t *thriftReader) varint() uint64 {
+	if t.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(t.buf[t.off:])
+	if n <= 0 {
+		t.fail("bad varint")
+		return 0
+	}
+	t.off += n
+	return v
+}
+
+func (t *thriftReader) zigzag() int64 {
+	v := t.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (t *thriftReader) readStruct() thriftStruct {
+	s := thriftStruct{}
+	var last int16
+	for t.err == nil {
+		b := t.byte()
+		if b == 0 {
+			break
+		}
+		typ := b & 0x0f
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			id = int16(t.zigzag())
+		}
+		last = id
+		switch typ {
+		case tBoolTrue:
+			s[id] = true
+		case tBoolFalse:
+			s[id] = false
+		default:
+			s[id] = t.readValue(typ)
+		}
+	}
+	return s
+}
+
+func (t *thriftReader) readValue(typ byte) interface{} {
+	switch typ {
+	case tBoolTrue, tBoolFalse:
+		// Only reached for list elements, which are encoded as bytes.
+		return t.byte() == tBoolTrue
+	case tByte:
+		return int64(int8(t.byte()))
+	case tI16, tI32, tI64:
+		return t.zigzag()
+	case tDouble:
+		if t.off+8 > len(t.buf) {
+			t.fail("truncated")
+			return float64(0)
+		}
+		t.off += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(t.buf[t.off-8:]))
+	case tBinary:
+		n := t.varint()
+		if uint64(len(t.buf)-t.off) < n {
+			t.fail("truncated")
+			return []byte(nil)
+		}
+		t.off += int(n)
+		return t.buf[t.off-int(n) : t.off]
+	case tList, tSet:
+		h := t.byte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = t.varint()
+		}
+		if uint64(len(t.buf)-t.off) < n {
+			t.fail("bad list length %d", n)
+			return []interface{}(nil)
+		}
+		elems := make([]interface{}, 0, n)
+		for i := uint64(0); i < n && t.err == nil; i++ {
+			elems = append(elems, t.readValue(h&0x0f))
+		}
+		return elems
+	case tMap:
+		n := t.varint()
+		if n == 0 {
+			return nil
+		}
+		kv := t.byte()
+		for i := uint64(0); i < n && t.err == nil; i++ {
+			t.readValue(kv >> 4)
+			t.readValue(kv & 0x0f)
+		}
+		return nil
+	case tStruct:
+		return t.readStruct()
+	}
+	t.fail("unknown type %d", typ)
+	return nil
+}
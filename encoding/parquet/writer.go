@@ -0,0 +1,489 @@
+// Package parquet writes and reads Apache Parquet files with simple schemas:
+// each column is a required primitive value, or a required list of them.
+// This covers tabular genomics output (one row per position or window, with
+// optional per-read arrays) without pulling in a general-purpose Parquet
+// implementation.
+//
+// Values are PLAIN-encoded in one version-1 data page per column chunk,
+// optionally snappy-compressed.  No statistics or dictionaries are written.
+// Files written by Writer can be loaded by Spark, pandas/pyarrow, DuckDB,
+// etc.
+//
+// Example use:
+//
+//	w, err := parquet.NewWriter(out, []parquet.Column{
+//		{Name: "chrom", Type: parquet.String},
+//		{Name: "pos", Type: parquet.Int64},
+//	}, parquet.WriterOpts{Codec: parquet.Snappy})
+//	w.String(0, "chr1")
+//	w.Int64(1, 12345)
+//	err = w.EndRow()
+//	err = w.Close()
+//
+// The format is specified in https://github.com/apache/parquet-format.
+package parquet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/golang/snappy"
+)
+
+// Type is the type of the values of a column.
+type Type int
+
+const (
+	Int32 Type = iota
+	Int64
+	Float
+	Double
+	// String is a UTF-8 BYTE_ARRAY.
+	String
+)
+
+// physicalType maps a Type to the parquet.thrift Type enum.
+var physicalType = [...]int32{Int32: 1, Int64: 2, Float: 4, Double: 5, String: 6}
+
+func (t Type) String() string {
+	switch t {
+	case Int32:
+		return "int32"
+	case Int64:
+		return "int64"
+	case Float:
+		return "float"
+	case Double:
+		return "double"
+	case String:
+		return "string"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Column describes a column.
+type Column struct {
+	Name string
+	Type Type
+	// List is true if each row holds a (possibly empty) list of values,
+	// rather than a single value.  Such columns use the standard three-level
+	// LIST structure, <name>.list.element.
+	List bool
+}
+
+// Codec is a column chunk compression codec.
+type Codec int
+
+const (
+	Uncompressed Codec = 0
+	Snappy       Codec = 1
+)
+
+// DefaultRowGroupSize is the default number of rows per row group.
+const DefaultRowGroupSize = 1 << 20
+
+// WriterOpts configures a Writer.
+type WriterOpts struct {
+	// RowGroupSize is the number of rows per row group.  Larger row groups
+	// compress better and are read more efficiently, at the cost of writer
+	// memory.  If 0, DefaultRowGroupSize is used.
+	RowGroupSize int
+	Codec        Codec
+	// Metadata is stored in the file's key-value metadata.
+	Metadata map[string]string
+	// CreatedBy identifies the writing application.
+	CreatedBy string
+}
+
+// Parquet enum values used below.
+const (
+	repRequired = 0
+	repRepeated = 2
+
+	convertedUTF8 = 0
+	convertedList = 3
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	pageTypeData = 0
+)
+
+const magic = "PAR1"
+
+// columnBuffer holds the current row group of a column.
+type columnBuffer struct {
+	col    Column
+	values []byte // PLAIN-encoded
+	// nValues is the number of values in values.  nLevels is the number of
+	// level entries (list columns only), which is nValues plus the number of
+	// empty lists.
+	nValues, nLevels int
+	// defLevels and repLevels are the definition and repetition levels of a
+	// list column; each is 0 or 1.
+	defLevels, repLevels []byte
+	// rowValues is the number of values added in the current row.
+	rowValues int
+}
+
+type chunkMeta struct {
+	offset                         int64
+	nValues                        int64
+	uncompressedSize, compressSize int64
+}
+
+type rowGroupMeta struct {
+	chunks    []chunkMeta
+	nRows     int64
+	totalSize int64
+}
+
+// Writer writes a Parquet file.  Values are added column by column with the
+// typed methods (Int32, String, ...); each non-list column must get exactly
+// one value per row, and then EndRow must be called.  Close must be called
+// after the last row.
+//
+// Writer is not thread-safe.
+type Writer struct {
+	w         io.Writer
+	opts      WriterOpts
+	cols      []columnBuffer
+	off       int64
+	nRows     int // rows in the current row group
+	totalRows int64
+	rowGroups []rowGroupMeta
+	scratch   []byte
+	err       error
+}
+
+// NewWriter creates a Writer, and writes the file header to w.
+func NewWriter(w io.Writer, cols []Column, opts WriterOpts) (*Writer, error) {
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("parquet.NewWriter: no columns")
+	}
+	seen := make(map[string]bool, len(cols))
+	for _, c := range cols {
+		if c.Name == "" || seen[c.Name] {
+			return nil, fmt.Errorf("parquet.NewWriter: missing or duplicate column name %q", c.Name)
+		}
+		if c.Type < Int32 || c.Type > String {
+			return nil, fmt.Errorf("parquet.NewWriter: column %s has invalid type %v", c.Name, c.Type)
+		}
+		seen[c.Name] = true
+	}
+	if opts.Codec != Uncompressed && opts.Codec != Snappy {
+		return nil, fmt.Errorf("parquet.NewWriter: unsupported codec %d", opts.Codec)
+	}
+	if opts.RowGroupSize <= 0 {
+		opts.RowGroupSize = DefaultRowGroupSize
+	}
+	pw := &Writer{w: w, opts: opts, cols: make([]columnBuffer, len(cols))}
+	for i, c := range cols {
+		pw.cols[i].col = c
+	}
+	pw.write([]byte(magic))
+	return pw, pw.err
+}
+
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	var n int
+	n, w.err = w.w.Write(b)
+	w.off += int64(n)
+}
+
+// add starts a new value for column col, and returns its buffer.
+func (w *Writer) add(col int, typ Type) *columnBuffer {
+	c := &w.cols[col]
+	if c.col.Type != typ && w.err == nil {
+		w.err = fmt.Errorf("parquet.Writer: %v value added to %v column %s", typ, c.col.Type, c.col.Name)
+	}
+	if c.col.List {
+		rep := byte(1)
+		if c.rowValues == 0 {
+			rep = 0
+		}
+		c.defLevels = append(c.defLevels, 1)
+		c.repLevels = append(c.repLevels, rep)
+		c.nLevels++
+	}
+	c.nValues++
+	c.rowValues++
+	return c
+}
+
+// Int32 adds a value to an Int32 column.
+func (w *Writer) Int32(col int, v int32) {
+	c := w.add(col, Int32)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	c.values = append(c.values, b[:]...)
+}
+
+// Int64 adds a value to an Int64 column.
+func (w *Writer) Int64(col int, v int64) {
+	c := w.add(col, Int64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	c.values = append(c.values, b[:]...)
+}
+
+// Float adds a value to a Float column.
+func (w *Writer) Float(col int, v float32) {
+	c := w.add(col, Float)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], math.Float32bits(v))
+	c.values = append(c.values, b[:]...)
+}
+
+// Double adds a value to a Double column.
+func (w *Writer) Double(col int, v float64) {
+	c := w.add(col, Double)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	c.values = append(c.values, b[:]...)
+}
+
+// String adds a value to a String column.
+func (w *Writer) String(col int, v string) {
+	c := w.add(col, String)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(v)))
+	c.values = append(c.values, b[:]...)
+	c.values = append(c.values, v...)
+}
+
+// EndRow finishes the current row, and writes a row group if it's full.
+func (w *Writer) EndRow() error {
+	if w.err != nil {
+		return w.err
+	}
+	for i := range w.cols {
+		c := &w.cols[i]
+		if c.col.List {
+			if c.rowValues == 0 {
+				// Empty list.
+				c.defLevels = append(c.defLevels, 0)
+				c.repLevels = append(c.repLevels, 0)
+				c.nLevels++
+			}
+		} else if c.rowValues != 1 {
+			w.err = fmt.Errorf("parquet.Writer.EndRow: column %s has %d values, expected 1", c.col.Name, c.rowValues)
+			return w.err
+		}
+		c.rowValues = 0
+	}
+	w.nRows++
+	w.totalRows++
+	if w.nRows >= w.opts.RowGroupSize {
+		w.flushRowGroup()
+	}
+	return w.err
+}
+
+// appendLevels appends levels, each 0 or 1, in the RLE/bit-packing hybrid
+// encoding with bit width 1, preceded by the encoded length as a 4-byte
+// integer.  Only RLE runs are used.
+func appendLevels(b []byte, levels []byte) []byte {
+	lenOff := len(b)
+	b = append(b, 0, 0, 0, 0)
+	var tmp [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(j-i)<<1)]...)
+		b = append(b, levels[i])
+		i = j
+	}
+	binary.LittleEndian.PutUint32(b[lenOff:], uint32(len(b)-lenOff-4))
+	return b
+}
+
+func (w *Writer) flushRowGroup() {
+	if w.nRows == 0 || w.err != nil {
+		return
+	}
+	rg := rowGroupMeta{nRows: int64(w.nRows)}
+	for i := range w.cols {
+		c := &w.cols[i]
+		page := w.scratch[:0]
+		nLevels := c.nValues
+		if c.col.List {
+			page = appendLevels(page, c.repLevels)
+			page = appendLevels(page, c.defLevels)
+			nLevels = c.nLevels
+		}
+		page = append(page, c.values...)
+		w.scratch = page
+		body := page
+		if w.opts.Codec == Snappy {
+			body = snappy.Encode(nil, page)
+		}
+
+		var hdr thriftWriter
+		hdr.beginStruct()
+		hdr.i32Field(1, pageTypeData)
+		hdr.i32Field(2, int32(len(page)))
+		hdr.i32Field(3, int32(len(body)))
+		hdr.structField(5)
+		hdr.i32Field(1, int32(nLevels))
+		hdr.i32Field(2, encodingPlain)
+		hdr.i32Field(3, encodingRLE)
+		hdr.i32Field(4, encodingRLE)
+		hdr.endStruct()
+		hdr.endStruct()
+
+		chunk := chunkMeta{
+			offset:           w.off,
+			nValues:          int64(nLevels),
+			uncompressedSize: int64(len(hdr.buf) + len(page)),
+			compressSize:     int64(len(hdr.buf) + len(body)),
+		}
+		w.write(hdr.buf)
+		w.write(body)
+		rg.chunks = append(rg.chunks, chunk)
+		rg.totalSize += chunk.uncompressedSize
+
+		c.values = c.values[:0]
+		c.defLevels = c.defLevels[:0]
+		c.repLevels = c.repLevels[:0]
+		c.nValues, c.nLevels = 0, 0
+	}
+	w.rowGroups = append(w.rowGroups, rg)
+	w.nRows = 0
+}
+
+// path returns the schema path of the leaf column of c.
+func (c Column) path() []string {
+	if c.List {
+		return []string{c.Name, "list", "element"}
+	}
+	return []string{c.Name}
+}
+
+func (w *Writer) appendFileMetadata(t *thriftWriter) {
+	t.beginStruct()
+	t.i32Field(1, 1)
+
+	nSchema := 1
+	for _, c := range w.cols {
+		nSchema += len(c.col.path())
+	}
+	t.listField(2, tStruct, nSchema)
+	t.beginStruct()
+	t.stringField(4, "schema")
+	t.i32Field(5, int32(len(w.cols)))
+	t.endStruct()
+	for _, c := range w.cols {
+		leaf := func(name string) {
+			t.beginStruct()
+			t.i32Field(1, physicalType[c.col.Type])
+			t.i32Field(3, repRequired)
+			t.stringField(4, name)
+			if c.col.Type == String {
+				t.i32Field(6, convertedUTF8)
+			}
+			t.endStruct()
+		}
+		if !c.col.List {
+			leaf(c.col.Name)
+			continue
+		}
+		t.beginStruct()
+		t.i32Field(3, repRequired)
+		t.stringField(4, c.col.Name)
+		t.i32Field(5, 1)
+		t.i32Field(6, convertedList)
+		t.endStruct()
+		t.beginStruct()
+		t.i32Field(3, repRepeated)
+		t.stringField(4, "list")
+		t.i32Field(5, 1)
+		t.endStruct()
+		leaf("element")
+	}
+
+	t.i64Field(3, w.totalRows)
+	t.listField(4, tStruct, len(w.rowGroups))
+	for _, rg := range w.rowGroups {
+		t.beginStruct()
+		t.listField(1, tStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			col := w.cols[i].col
+			t.beginStruct()
+			t.i64Field(2, chunk.offset)
+			t.structField(3)
+			t.i32Field(1, physicalType[col.Type])
+			t.listField(2, tI32, 2)
+			t.zigzag(encodingPlain)
+			t.zigzag(encodingRLE)
+			path := col.path()
+			t.listField(3, tBinary, len(path))
+			for _, p := range path {
+				t.stringValue(p)
+			}
+			t.i32Field(4, int32(w.opts.Codec))
+			t.i64Field(5, chunk.nValues)
+			t.i64Field(6, chunk.uncompressedSize)
+			t.i64Field(7, chunk.compressSize)
+			t.i64Field(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64Field(2, rg.totalSize)
+		t.i64Field(3, rg.nRows)
+		t.endStruct()
+	}
+
+	if len(w.opts.Metadata) > 0 {
+		keys := make([]string, 0, len(w.opts.Metadata))
+		for k := range w.opts.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		t.listField(5, tStruct, len(keys))
+		for _, k := range keys {
+			t.beginStruct()
+			t.stringField(1, k)
+			t.stringField(2, w.opts.Metadata[k])
+			t.endStruct()
+		}
+	}
+	if w.opts.CreatedBy != "" {
+		t.stringField(6, w.opts.CreatedBy)
+	}
+	t.endStruct()
+}
+
+// Close writes the last row group and the file footer.  It does not close the
+// underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	for _, c := range w.cols {
+		if c.rowValues != 0 {
+			return fmt.Errorf("parquet.Writer.Close: unfinished row")
+		}
+	}
+	w.flushRowGroup()
+	var t thriftWriter
+	w.appendFileMetadata(&t)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(t.buf)))
+	w.write(t.buf)
+	w.write(b[:])
+	w.write([]byte(magic))
+	if w.err == nil {
+		w.err = fmt.Errorf("parquet.Writer: closed")
+		return nil
+	}
+	return w.err
+}
@@ -0,0 +1,343 @@
+// Package zstdseek implements the zstd seekable format, which is to zstd
+// what .bgzf is to gzip: the data is split into independently compressed
+// zstd frames, and a seek table listing the compressed and decompressed size
+// of each frame is appended as a skippable frame.  Any zstd decoder can read
+// the file sequentially, while Reader can decompress an arbitrary byte range
+// by decoding only the frames that overlap it.
+//
+// The format is specified in
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+// This implementation does not write per-frame checksums, and ignores them
+// when reading.
+//
+// Example use:
+//
+//	w, err := zstdseek.NewWriter(out, zstdseek.WriterOpts{})
+//	_, err = w.Write([]byte("chr1\t12345\t..."))
+//	err = w.Close()
+//
+//	r, err := zstdseek.NewReader(in, size)
+//	n, err := r.ReadAt(buf, off)
+package zstdseek
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// DefaultFrameSize is the default uncompressed size of each frame.  It
+	// trades compression ratio for the amount of data that must be decoded to
+	// serve a random read.
+	DefaultFrameSize = 1 << 20
+	// MaxFrameSize is the largest legal uncompressed frame size.
+	MaxFrameSize = 1<<32 - 1
+
+	skippableMagic    = 0x184D2A5E
+	seekableMagic     = 0x8F92EAB1
+	footerSize        = 9
+	checksumFlag      = 1 << 7
+	reservedFlagsMask = 0x7c
+)
+
+// WriterOpts configures a Writer.
+type WriterOpts struct {
+	// FrameSize is the uncompressed size of each frame, except possibly the
+	// last one.  If zero, DefaultFrameSize is used.
+	FrameSize int
+}
+
+type frameEntry struct {
+	compressedSize, decompressedSize uint32
+}
+
+// Writer compresses data in the seekable format.  Close must be called to
+// write the final frame and the seek table.
+type Writer struct {
+	w         io.Writer
+	enc       *zstd.Encoder
+	frameSize int
+	buf       []byte
+	out       []byte
+	entries   []frameEntry
+	err       error
+}
+
+// NewWriter creates a Writer that writes to w.
+func NewWriter(w io.Writer, opts WriterOpts) (*Writer, error) {
+	if opts.FrameSize == 0 {
+		opts.FrameSize = DefaultFrameSize
+	}
+	if opts.FrameSize < 0 || int64(opts.FrameSize) > MaxFrameSize {
+		return nil, fmt.Errorf("zstdseek.NewWriter: invalid frame size %d", opts.FrameSize)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:         w,
+		enc:       enc,
+		frameSize: opts.FrameSize,
+		buf:       make([]byte, 0, opts.FrameSize),
+	}, nil
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && w.err == nil {
+		m := w.frameSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(w.buf) == w.frameSize {
+			w.flushFrame()
+		}
+	}
+	return n, w.err
+}
+
+// Flush ends the current frame, if it's nonempty.  Flushing at record
+// boundaries (e.g. once per contig) makes it possible to start decoding a
+// record without looking at the previous frame.
+func (w *Writer) Flush() error {
+	if len(w.buf) > 0 {
+		w.flushFrame()
+	}
+	return w.err
+}
+
+func (w *Writer) flushFrame() {
+	if w.err != nil {
+		return
+	}
+	w.out = w.enc.EncodeAll(w.buf, w.out[:0])
+	if int64(len(w.out)) > MaxFrameSize {
+		w.err = fmt.Errorf("zstdseek.Writer: compressed frame size %d too large", len(w.out))
+		return
+	}
+	if _, w.err = w.w.Write(w.out); w.err != nil {
+		return
+	}
+	w.entries = append(w.entries, frameEntry{uint32(len(w.out)), uint32(len(w.buf))})
+	w.buf = w.buf[:0]
+}
+
+// Close flushes the last frame and writes the seek table.  It does not close
+// the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	tableSize := len(w.entries)*8 + footerSize
+	table := make([]byte, 8+tableSize)
+	binary.LittleEndian.PutUint32(table[0:], skippableMagic)
+	binary.LittleEndian.PutUint32(table[4:], uint32(tableSize))
+	off := 8
+	for _, e := range w.entries {
+		binary.LittleEndian.PutUint32(table[off:], e.compressedSize)
+		binary.LittleEndian.PutUint32(table[off+4:], e.decompressedSize)
+		off += 8
+	}
+	binary.LittleEndian.PutUint32(table[off:], uint32(len(w.entries)))
+	table[off+4] = 0 // descriptor: no checksums
+	binary.LittleEndian.PutUint32(table[off+5:], seekableMagic)
+	_, w.err = w.w.Write(table)
+	w.enc.Close()
+	return w.err
+}
+
+type frame struct {
+	compressedOff, decompressedOff   int64
+	compressedSize, decompressedSize int64
+}
+
+// Reader provides random access to a seekable zstd file.  It is safe for
+// concurrent use, although concurrent readers serialize on the decoder.
+type Reader struct {
+	r      io.ReaderAt
+	frames []frame
+	size   int64
+
+	mu        sync.Mutex
+	dec       *zstd.Decoder
+	compBuf   []byte
+	cacheIdx  int
+	cacheData []byte
+	pos       int64
+}
+
+// NewReader reads the seek table of the seekable zstd file r, which has the
+// given (compressed) size.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < 8+footerSize {
+		return nil, fmt.Errorf("zstdseek.NewReader: file too short (%d bytes)", size)
+	}
+	var footer [footerSize]byte
+	if _, err := r.ReadAt(footer[:], size-footerSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, fmt.Errorf("zstdseek.NewReader: seek table not found")
+	}
+	nFrames := int64(binary.LittleEndian.Uint32(footer[0:]))
+	desc := footer[4]
+	if desc&reservedFlagsMask != 0 {
+		return nil, fmt.Errorf("zstdseek.NewReader: reserved seek table descriptor bits set: %#x", desc)
+	}
+	entrySize := int64(8)
+	if desc&checksumFlag != 0 {
+		entrySize = 12
+	}
+	tableSize := nFrames*entrySize + footerSize
+	if 8+tableSize > size {
+		return nil, fmt.Errorf("zstdseek.NewReader: seek table with %d frames exceeds file size %d", nFrames, size)
+	}
+	table := make([]byte, 8+tableSize)
+	if _, err := r.ReadAt(table, size-int64(len(table))); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table[0:]) != skippableMagic || int64(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, fmt.Errorf("zstdseek.NewReader: corrupt seek table header")
+	}
+	rd := &Reader{
+		r:        r,
+		frames:   make([]frame, nFrames),
+		cacheIdx: -1,
+	}
+	var compOff int64
+	for i := range rd.frames {
+		e := table[8+int64(i)*entrySize:]
+		f := &rd.frames[i]
+		f.compressedOff = compOff
+		f.decompressedOff = rd.size
+		f.compressedSize = int64(binary.LittleEndian.Uint32(e[0:]))
+		f.decompressedSize = int64(binary.LittleEndian.Uint32(e[4:]))
+		compOff += f.compressedSize
+		rd.size += f.decompressedSize
+	}
+	if compOff != size-int64(len(table)) {
+		return nil, fmt.Errorf("zstdseek.NewReader: seek table covers %d bytes, but data is %d bytes", compOff, size-int64(len(table)))
+	}
+	var err error
+	if rd.dec, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// Size returns the decompressed size of the data.
+func (r *Reader) Size() int64 { return r.size }
+
+// NumFrames returns the number of frames.
+func (r *Reader) NumFrames() int { return len(r.frames) }
+
+// frameData returns the decompressed contents of the i'th frame.  The result
+// is valid until the next call.
+//
+// REQUIRES: r.mu is locked.
+func (r *Reader) frameData(i int) ([]byte, error) {
+	if i == r.cacheIdx {
+		return r.cacheData, nil
+	}
+	f := r.frames[i]
+	if int64(cap(r.compBuf)) < f.compressedSize {
+		r.compBuf = make([]byte, f.compressedSize)
+	}
+	r.compBuf = r.compBuf[:f.compressedSize]
+	if _, err := r.r.ReadAt(r.compBuf, f.compressedOff); err != nil {
+		return nil, err
+	}
+	data, err := r.dec.DecodeAll(r.compBuf, r.cacheData[:0])
+	if err != nil {
+		r.cacheIdx = -1
+		return nil, fmt.Errorf("zstdseek: frame %d: %v", i, err)
+	}
+	if int64(len(data)) != f.decompressedSize {
+		r.cacheIdx = -1
+		return nil, fmt.Errorf("zstdseek: frame %d: decompressed to %d bytes, expected %d", i, len(data), f.decompressedSize)
+	}
+	r.cacheIdx, r.cacheData = i, data
+	return data, nil
+}
+
+// ReadAt implements io.ReaderAt.  off is an offset in the decompressed data.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readAt(p, off)
+}
+
+func (r *Reader) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("zstdseek.Reader.ReadAt: negative offset %d", off)
+	}
+	// Find the frame containing off.
+	i := sort.Search(len(r.frames), func(i int) bool {
+		f := r.frames[i]
+		return f.decompressedOff+f.decompressedSize > off
+	})
+	n := 0
+	for n < len(p) && i < len(r.frames) {
+		data, err := r.frameData(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[off+int64(n)-r.frames[i].decompressedOff:])
+		i++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-r.pos {
+		p = p[:r.size-r.pos]
+	}
+	n, err := r.readAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker.  Offsets are in the decompressed data.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.pos, fmt.Errorf("zstdseek.Reader.Seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return r.pos, fmt.Errorf("zstdseek.Reader.Seek: negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close releases the decoder.  It does not close the underlying reader.
+func (r *Reader) Close() error {
+	r.dec.Close()
+	return nil
+}
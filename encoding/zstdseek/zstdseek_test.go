@@ -0,0 +1,121 @@
+package zstdseek_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/zstdseek"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testData(r *rand.Rand, n int) []byte {
+	// Compressible but not trivial.
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = "ACGT\t\n"[r.Intn(6)]
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, length := range []int{0, 1, 999, 1000, 1001, 25000} {
+		data := testData(r, length)
+		var buf bytes.Buffer
+		w, err := zstdseek.NewWriter(&buf, zstdseek.WriterOpts{FrameSize: 1000})
+		require.NoError(t, err)
+		// Write in uneven pieces to exercise frame splitting.
+		for p := data; len(p) > 0; {
+			n := 1 + r.Intn(1500)
+			if n > len(p) {
+				n = len(p)
+			}
+			_, err := w.Write(p[:n])
+			require.NoError(t, err)
+			p = p[n:]
+		}
+		require.NoError(t, w.Close())
+
+		// The output is a valid zstd stream.
+		dec, err := zstd.NewReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(dec)
+		require.NoError(t, err)
+		dec.Close()
+		assert.Equal(t, len(data), len(got))
+		assert.True(t, bytes.Equal(data, got))
+
+		rd, err := zstdseek.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		assert.Equal(t, int64(length), rd.Size())
+		assert.Equal(t, (length+999)/1000, rd.NumFrames())
+		got, err = ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got))
+
+		for i := 0; i < 50 && length > 0; i++ {
+			off := r.Intn(length)
+			p := make([]byte, r.Intn(2500))
+			n, err := rd.ReadAt(p, int64(off))
+			want := data[off:]
+			if len(want) > len(p) {
+				want = want[:len(p)]
+			} else if len(want) < len(p) {
+				assert.Equal(t, io.EOF, err)
+			}
+			assert.Equal(t, len(want), n)
+			assert.True(t, bytes.Equal(want, p[:n]), "off=%d len=%d", off, len(p))
+		}
+
+		if length > 0 {
+			off := int64(length / 2)
+			pos, err := rd.Seek(off, io.SeekStart)
+			require.NoError(t, err)
+			assert.Equal(t, off, pos)
+			got, err = ioutil.ReadAll(rd)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data[off:], got))
+		}
+		require.NoError(t, rd.Close())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := zstdseek.NewWriter(&buf, zstdseek.WriterOpts{})
+	require.NoError(t, err)
+	for _, s := range []string{"chr1\t1\n", "chr2\t1\n", "chr3\t1\n"} {
+		_, err := w.Write([]byte(s))
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+	}
+	require.NoError(t, w.Close())
+	rd, err := zstdseek.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, 3, rd.NumFrames())
+	p := make([]byte, 7)
+	_, err = rd.ReadAt(p, 7)
+	require.NoError(t, err)
+	assert.Equal(t, "chr2\t1\n", string(p))
+}
+
+func TestCorrupt(t *testing.T) {
+	_, err := zstdseek.NewReader(bytes.NewReader([]byte("not a zstd file at all")), 22)
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	w, err := zstdseek.NewWriter(&buf, zstdseek.WriterOpts{})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	// Truncating the data invalidates the seek table.
+	data := append([]byte(nil), buf.Bytes()[1:]...)
+	_, err = zstdseek.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,112 @@
+package cmd
+
+// This file reads the fusion candidate read pairs of an aligned BAM or PAM.
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/grailbio/base/log"
+	gunsafe "github.com/grailbio/base/unsafe"
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// maxSoftClip returns the length of the longest soft clip of rec.
+func maxSoftClip(rec *sam.Record) int {
+	n := 0
+	for _, op := range rec.Cigar {
+		if (op.Type() == sam.CigarSoftClipped) && (op.Len() > n) {
+			n = op.Len()
+		}
+	}
+	return n
+}
+
+// isFusionCandidatePair returns true if the pair may support a fusion: if a
+// read is unmapped, the reads are aligned to different references or not
+// as a proper pair, or a read has a soft clip of at least minClip bases.
+// Other pairs align contiguously to one locus, so they can't span a fusion
+// junction.
+func isFusionCandidatePair(r1, r2 *sam.Record, minClip int) bool {
+	for _, rec := range []*sam.Record{r1, r2} {
+		if rec.Flags&(sam.Unmapped|sam.MateUnmapped) != 0 {
+			return true
+		}
+		if rec.Flags&sam.ProperPair == 0 {
+			return true
+		}
+		if maxSoftClip(rec) >= minClip {
+			return true
+		}
+	}
+	return r1.Ref.ID() != r2.Ref.ID()
+}
+
+// readSeq returns the sequence of rec as sequenced, i.e. reverse-complemented
+// back if it is aligned to the reverse strand.
+func readSeq(rec *sam.Record) string {
+	seq := rec.Seq.Expand()
+	if rec.Flags&sam.Reverse != 0 {
+		biosimd.ReverseComp8Inplace(seq)
+	}
+	return gunsafe.BytesToString(seq)
+}
+
+// readBAM sends the fusion candidate pairs of provider, as selected by
+// isFusionCandidatePair, to reqCh.  The pairs are read in parallel, so they
+// are collected and sent in name order, to make the output deterministic.
+// Pairs with a missing mate are logged and skipped.
+func readBAM(reqCh chan req, fileseq uint, path string, provider bamprovider.Provider, minClip int) {
+	iters, err := bamprovider.NewPairIterators(provider, true)
+	if err != nil {
+		log.Panicf("%s: %v", path, err)
+	}
+	var (
+		mu    sync.Mutex
+		reqs  []req
+		nPair int
+		wg    sync.WaitGroup
+	)
+	for _, iter := range iters {
+		wg.Add(1)
+		go func(iter *bamprovider.PairIterator) {
+			defer wg.Done()
+			var (
+				local  []req
+				nLocal int
+			)
+			for iter.Scan() {
+				p := iter.Record()
+				if p.Err != nil {
+					if _, ok := p.Err.(bamprovider.MissingMateError); !ok {
+						log.Panicf("%s: %v", path, p.Err)
+					}
+					log.Error.Printf("%s: skipping reads: %v", path, p.Err)
+					continue
+				}
+				nLocal++
+				if isFusionCandidatePair(p.R1, p.R2, minClip) {
+					local = append(local, req{name: p.R1.Name, r1Seq: readSeq(p.R1), r2Seq: readSeq(p.R2)})
+				}
+				sam.PutInFreePool(p.R1)
+				sam.PutInFreePool(p.R2)
+			}
+			mu.Lock()
+			reqs = append(reqs, local...)
+			nPair += nLocal
+			mu.Unlock()
+		}(iter)
+	}
+	wg.Wait()
+	if err := bamprovider.FinishPairIterators(iters); err != nil {
+		log.Error.Printf("%s: skipping reads: %v", path, err)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].name < reqs[j].name })
+	for i := range reqs {
+		reqs[i].seq = newSeq(fileseq, uint(i+1))
+		reqCh <- reqs[i]
+	}
+	log.Printf("Processed %d readpairs in %s, of which %d are fusion candidates", nPair, path, len(reqs))
+}
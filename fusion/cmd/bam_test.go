@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func TestReadBAM(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	assert.NoError(t, err)
+	newRecord := func(name string, ref *sam.Reference, pos int, mateRef *sam.Reference, matePos int, cigar string, seq string, flags sam.Flags) *sam.Record {
+		co, err := sam.ParseCigar([]byte(cigar))
+		assert.NoError(t, err)
+		rec, err := sam.NewRecord(name, ref, mateRef, pos, matePos, 0, 60, co, []byte(seq), nil, nil)
+		assert.NoError(t, err)
+		rec.Flags = flags | sam.Paired
+		return rec
+	}
+	const (
+		proper1 = sam.Read1 | sam.ProperPair | sam.MateReverse
+		proper2 = sam.Read2 | sam.ProperPair | sam.Reverse
+	)
+	recs := []*sam.Record{
+		newRecord("concordant", chr1, 100, chr1, 300, "8M", "ACGTACGT", proper1),
+		newRecord("clipped", chr1, 200, chr1, 400, "3S5M", "TTTACGTA", proper1),
+		newRecord("concordant", chr1, 300, chr1, 100, "8M", "AAAACCCC", proper2),
+		newRecord("discordant", chr1, 350, chr2, 500, "8M", "CCCCGGGG", sam.Read2|sam.Reverse),
+		newRecord("clipped", chr1, 400, chr1, 200, "8M", "AAAACCCC", proper2),
+		newRecord("discordant", chr2, 500, chr1, 350, "8M", "GGGGCCCC", sam.Read1|sam.MateReverse),
+		newRecord("unmapped", nil, -1, nil, -1, "*", "ACACACAC", sam.Read1|sam.Unmapped|sam.MateUnmapped),
+		newRecord("unmapped", nil, -1, nil, -1, "*", "TGTGTGTG", sam.Read2|sam.Unmapped|sam.MateUnmapped),
+	}
+
+	expect.False(t, isFusionCandidatePair(recs[0], recs[2], 3))
+	expect.True(t, isFusionCandidatePair(recs[1], recs[4], 3))
+	expect.False(t, isFusionCandidatePair(recs[1], recs[4], 4))
+
+	reqCh := make(chan req, len(recs))
+	readBAM(reqCh, 2, "test.bam", bamprovider.NewFakeProvider(header, recs), 3)
+	close(reqCh)
+	var reqs []req
+	for r := range reqCh {
+		reqs = append(reqs, r)
+	}
+	// The reverse-strand reads are reverse-complemented back.
+	expect.EQ(t, reqs, []req{
+		{newSeq(2, 1), "clipped", "TTTACGTA", "GGGGTTTT"},
+		{newSeq(2, 2), "discordant", "GGGGCCCC", "CCCCGGGG"},
+		{newSeq(2, 3), "unmapped", "ACACACAC", "TGTGTGTG"},
+	})
+}
@@ -21,10 +21,9 @@ import (
 	"io"
 	"os"
 
-	"github.com/grailbio/base/file"
 	"github.com/grailbio/base/log"
-	"github.com/grailbio/bio/encoding/fasta"
 	"github.com/grailbio/bio/fusion/parsegencode"
+	"github.com/grailbio/bio/reference"
 )
 
 type gencodeFlags struct {
@@ -45,6 +44,9 @@ type gencodeFlags struct {
 // given inputs. gtfPath is gencode comprehenve antotation file (e.g.,
 // gencode.v26.annotation.gtf), and fastaPath is the reference genome (e.g.,
 // hg38.fa). gtfPath may be compressed, but fastaPath must be uncompressed.
+// fastaPath is opened with reference.Open, so it may also be a .2bit file or
+// a URL, and an indexed FASTA file is read on demand rather than loaded
+// whole.
 func GenerateTranscriptome(ctx context.Context, gtfPath, fastaPath string, flags gencodeFlags) {
 	if flags.exonPadding < 0 {
 		log.Fatal("Pad cannot be negative.")
@@ -92,19 +94,16 @@ func GenerateTranscriptome(ctx context.Context, gtfPath, fastaPath string, flags
 		flags.separateJns,
 		flags.retainedExonBases)
 
-	fastaIn, err := file.Open(ctx, fastaPath)
+	genome, err := reference.Open(ctx, fastaPath)
 	if err != nil {
 		log.Panic(err)
 	}
 	defer func() {
-		if err := fastaIn.Close(ctx); err != nil {
+		if err := genome.Close(); err != nil {
 			log.Panic(err)
 		}
 	}()
-	fasta, err := fasta.New(fastaIn.Reader(ctx))
-	if err != nil {
-		log.Panic(err)
-	}
+	fasta := reference.AsFasta(genome)
 	switch {
 	case flags.wholeGenes:
 		parsegencode.PrintWholeGenes(out, fasta, records, flags.codingOnly, flags.exonPadding)
@@ -16,15 +16,16 @@ import (
 	"sync"
 	"time"
 
-	"github.com/grailbio/base/compress"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/file"
 	"github.com/grailbio/base/grail"
 	"github.com/grailbio/base/log"
 	gunsafe "github.com/grailbio/base/unsafe"
 	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/encoding/fastq"
 	"github.com/grailbio/bio/fusion"
+	"github.com/grailbio/bio/util/flaghelp"
 )
 
 type memStats struct {
@@ -68,6 +69,7 @@ type fusionFlags struct {
 	transcriptPath     string
 	cosmicFusionPath   string
 	r1, r2             string
+	bam                string
 	fastaOutputPath    string
 	rioOutputPath      string
 	rioInputPath       string
@@ -188,35 +190,27 @@ func processRequests(reqCh chan req, resCh chan res, geneDB *fusion.GeneDB, opts
 	resCh <- res{seq: invalidSeq, stats: stats}
 }
 
+// readFASTQ reads the pairs of the R1 and R2 FASTQ files, or of the
+// interleaved FASTQ file r1Path if r2Path is empty, and sends them to reqCh.
+// The files may be plain text, gzip, bgzf or bzip2.
 func readFASTQ(ctx context.Context, reqCh chan req, fileseq uint, r1Path, r2Path string) {
 	var (
-		sc       *fastq.PairScanner
+		p        *fastq.PairReader
 		r1R, r2R fastq.Read
 		nRead    uint
+		err      error
 	)
-
-	openFASTQ := func(path string) (file.File, io.ReadCloser) {
-		in, err := file.Open(ctx, path)
-		if err != nil {
-			log.Panicf("open %v: %v", path, err)
-		}
-		gz, _ := compress.NewReader(in.Reader(ctx))
-		return in, gz
+	opts := fastq.PairReaderOpts{Fields: fastq.ID | fastq.Seq}
+	if r2Path == "" {
+		p, err = fastq.OpenInterleaved(ctx, r1Path, opts)
+	} else {
+		p, err = fastq.OpenPair(ctx, r1Path, r2Path, opts)
 	}
-	closeFASTQ := func(in file.File, r io.ReadCloser, path string) {
-		if err := r.Close(); err != nil {
-			log.Panicf("close gzip %s: %v", path, err)
-		}
-		if err := in.Close(ctx); err != nil {
-			log.Panicf("close %s: %v", path, err)
-		}
+	if err != nil {
+		log.Panicf("open %v: %v", r1Path, err)
 	}
-
-	in1, inr1 := openFASTQ(r1Path)
-	in2, inr2 := openFASTQ(r2Path)
-	sc = fastq.NewPairScanner(inr1, inr2, fastq.ID|fastq.Seq)
 	for {
-		if !sc.Scan(&r1R, &r2R) {
+		if err = p.ReadPair(&r1R, &r2R); err != nil {
 			break
 		}
 		nRead++
@@ -231,16 +225,17 @@ func readFASTQ(ctx context.Context, reqCh chan req, fileseq uint, r1Path, r2Path
 		reqCh <- req{newSeq(fileseq, nRead), id, r1R.Seq, r2R.Seq}
 	}
 	log.Printf("Processed %d reads in %s", nRead, r1Path)
-	if err := sc.Err(); err != nil {
-		log.Panicf("close pair: %v", err)
+	if err != io.EOF {
+		log.Panicf("read %s: %v (read %+v, %+v)", r1Path, err, r1R, r2R)
+	}
+	if err := p.Close(); err != nil {
+		log.Panicf("close %s: %v", r1Path, err)
 	}
-	closeFASTQ(in1, inr1, r1Path)
-	closeFASTQ(in2, inr2, r2Path)
 }
 
-func processFASTQ(ctx context.Context, fileseq uint,
-	r1Path, r2Path string,
-	geneDB *fusion.GeneDB, opts fusion.Opts) ([]res, fusion.Stats) {
+// processInput detects the fusions of the read pairs sent by readInput,
+// which must return after sending all of them.
+func processInput(readInput func(reqCh chan req), geneDB *fusion.GeneDB, opts fusion.Opts) ([]res, fusion.Stats) {
 	reqCh := make(chan req, 1024*64)
 	resCh := make(chan res, 1024)
 
@@ -271,7 +266,7 @@ func processFASTQ(ctx context.Context, fileseq uint,
 		wg2.Done()
 	}()
 
-	readFASTQ(ctx, reqCh, fileseq, r1Path, r2Path)
+	readInput(reqCh)
 	close(reqCh)
 	wg1.Wait()
 	close(resCh)
@@ -325,7 +320,7 @@ func readGeneList(ctx context.Context, geneDB *fusion.GeneDB, geneListInputPath
 
 func generateCandidates(
 	ctx context.Context,
-	r1Paths, r2Paths []string,
+	r1Paths, r2Paths, bamPaths []string,
 	geneListInputPath string,
 	geneListOutputPath string,
 	cosmicFusionPath string,
@@ -353,15 +348,32 @@ func generateCandidates(
 		allStats     fusion.Stats
 		wg           sync.WaitGroup
 	)
+	process := func(readInput func(reqCh chan req)) {
+		c, stats := processInput(readInput, geneDB, opts)
+		allResultsMu.Lock()
+		allResults = append(allResults, c...)
+		allStats = allStats.Merge(stats)
+		allResultsMu.Unlock()
+		wg.Done()
+	}
 	for i := range r1Paths {
 		wg.Add(1)
 		go func(i int) {
-			c, stats := processFASTQ(ctx, uint(i), r1Paths[i], r2Paths[i], geneDB, opts)
-			allResultsMu.Lock()
-			allResults = append(allResults, c...)
-			allStats = allStats.Merge(stats)
-			allResultsMu.Unlock()
-			wg.Done()
+			process(func(reqCh chan req) { readFASTQ(ctx, reqCh, uint(i), r1Paths[i], r2Paths[i]) })
+		}(i)
+	}
+	for i := range bamPaths {
+		wg.Add(1)
+		go func(i int) {
+			// The BAMs are numbered after the FASTQs, for newSeq.
+			fileseq := uint(len(r1Paths) + i)
+			process(func(reqCh chan req) {
+				provider := bamprovider.NewProvider(bamPaths[i])
+				readBAM(reqCh, fileseq, bamPaths[i], provider, opts.KmerLength)
+				if err := provider.Close(); err != nil {
+					log.Panicf("close %s: %v", bamPaths[i], err)
+				}
+			})
 		}(i)
 	}
 	wg.Wait()
@@ -428,12 +440,25 @@ func DetectFusion(ctx context.Context, flags fusionFlags, opts fusion.Opts) {
 	if flags.rioInputPath == "" {
 		// Generate candidates from scratch
 		opts.Denovo = (flags.cosmicFusionPath == "")
-		r1Paths := strings.Split(flags.r1, ",")
-		r2Paths := strings.Split(flags.r2, ",")
+		var r1Paths, r2Paths, bamPaths []string
+		if flags.r1 != "" {
+			r1Paths = strings.Split(flags.r1, ",")
+			// Without -r2, the -r1 files are interleaved.
+			r2Paths = make([]string, len(r1Paths))
+		}
+		if flags.r2 != "" {
+			r2Paths = strings.Split(flags.r2, ",")
+		}
 		if len(r1Paths) != len(r2Paths) {
 			log.Panicf("There must be the same # of R1 and R2 files: '%s' <-> '%s'", flags.r1, flags.r2)
 		}
-		geneDB, allCandidates = generateCandidates(ctx, r1Paths, r2Paths,
+		if flags.bam != "" {
+			bamPaths = strings.Split(flags.bam, ",")
+		}
+		if len(r1Paths) == 0 && len(bamPaths) == 0 {
+			log.Panicf("Either -r1 or -bam must be set")
+		}
+		geneDB, allCandidates = generateCandidates(ctx, r1Paths, r2Paths, bamPaths,
 			flags.geneListInputPath, flags.geneListOutputPath,
 			flags.cosmicFusionPath,
 			flags.transcriptPath, opts)
@@ -515,8 +540,12 @@ genes)`)
 	flag.StringVar(&fusionFlags.transcriptPath, "transcript", "", "File containing all transcripts")
 	flag.StringVar(&fusionFlags.cosmicFusionPath, "cosmic-fusion", "", `Fixed list of fusions to query within the input.
 If this flag is empty, all possible combinations of genes in the --transcript file will be examined as fusion candidates.`)
-	flag.StringVar(&fusionFlags.r1, "r1", "", "Comma-separated list of Gzipped FASTQ files containing R1 reads.")
-	flag.StringVar(&fusionFlags.r2, "r2", "", "Comma-separated list of Gzipped FASTQ files containing R2 reads.")
+	flag.StringVar(&fusionFlags.r1, "r1", "", `Comma-separated list of FASTQ files containing R1 reads, or interleaved R1 and R2 reads if --r2 is empty.
+The files may be plain text, gzip, bgzf or bzip2; the format is detected from their contents.`)
+	flag.StringVar(&fusionFlags.r2, "r2", "", "Comma-separated list of FASTQ files containing R2 reads.")
+	flag.StringVar(&fusionFlags.bam, "bam", "", `Comma-separated list of aligned BAM or PAM files, read in addition to the -r1 and -r2 FASTQs.
+Only the read pairs which may span a fusion junction are processed: those with an unmapped read, those which
+aren't aligned as a proper pair, and those with a soft clip of at least -k bases.`)
 	flag.StringVar(&fusionFlags.fastaOutputPath, "fasta-output", "./all-outputs.fa", "FASTA file to store all candidates.")
 	flag.StringVar(&fusionFlags.rioInputPath, "rio-input", "", "FASTA file that store all candidates. If this flag is nonempty, af4 will run only the 2nd filtering stage using the input. If this flag is empty (default) af4 will run the whole process from scratch.")
 	flag.StringVar(&fusionFlags.rioOutputPath, "rio-output", "", "Recordio checkpoint file to store all candidates. If empty, the file will not be created")
@@ -539,8 +568,15 @@ gene IDs to genes to maintain compatibility with old code`)
 	flag.IntVar(&opts.MinSpan, "min-span", fusion.DefaultOpts.MinSpan, "min base evidence for a gene in the fusion")
 	flag.IntVar(&opts.MaxHomology, "max-homology", fusion.DefaultOpts.MaxHomology, "max overlap allowed b/w genes in a fusion")
 
+	cmd := &flaghelp.Command{
+		Name:  "bio-fusion",
+		Short: "Detect gene fusions in RNA/DNA FASTQs",
+		Flags: flag.CommandLine,
+	}
+	flaghelp.Register(cmd)
 	cleanup := grail.Init()
 	defer cleanup()
+	flaghelp.Handle(cmd)
 	ctx := vcontext.Background()
 	var memStats memStats
 	go func() {
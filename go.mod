@@ -13,10 +13,14 @@ require (
 	github.com/grailbio/testutil v0.0.3
 	github.com/klauspost/compress v1.8.6
 	github.com/minio/highwayhash v0.0.0-20190112144901-fc990dfafa15
+	github.com/pierrec/lz4 v2.6.1+incompatible
 	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.4.0
 	github.com/yasushi-saito/zlibng v0.0.0-20190922135643-2a860060b80c
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	golang.org/x/sys v0.0.0-20191008105621-543471e840be
+	google.golang.org/grpc v1.24.0
+	gopkg.in/yaml.v2 v2.4.0
 	v.io/x/lib v0.1.4
 )
 
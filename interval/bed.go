@@ -0,0 +1,291 @@
+package interval
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/fileio"
+	"github.com/grailbio/base/vcontext"
+	"github.com/klauspost/compress/gzip"
+)
+
+// Block is an exon-like block of a BED12 record, with 0-based absolute
+// coordinates.
+type Block struct {
+	Start0 PosType
+	End    PosType
+}
+
+// BEDRecord is one line of a BED3 to BED12 file.  Unlike BEDUnion, it keeps
+// all the fields of the line.
+type BEDRecord struct {
+	Entry
+	// NFields is the number of fields of the line, 3 to 12.  The remaining
+	// fields have their zero values, except Strand, which is '.'.
+	NFields int
+	Name    string
+	Score   float64
+	// Strand is '+', '-' or '.'.
+	Strand byte
+	// ThickStart and ThickEnd are 0-based [start, end) coordinates.
+	ThickStart PosType
+	ThickEnd   PosType
+	ItemRGB    string
+	// Blocks are the blocks of a BED12 record, in increasing order.  The
+	// first starts at Start0 and the last ends at End.
+	Blocks []Block
+}
+
+// Entries returns the intervals covered by the record: its blocks, or the
+// whole record if it has none.
+func (r *BEDRecord) Entries() []Entry {
+	if len(r.Blocks) == 0 {
+		return []Entry{r.Entry}
+	}
+	entries := make([]Entry, len(r.Blocks))
+	for i, b := range r.Blocks {
+		entries[i] = Entry{RefName: r.RefName, Start0: b.Start0, End: b.End}
+	}
+	return entries
+}
+
+// isBEDHeaderLine returns true for the comment, "track" and "browser" lines
+// which may precede the records of a BED file.
+func isBEDHeaderLine(line string) bool {
+	if strings.HasPrefix(line, "#") {
+		return true
+	}
+	first := strings.Fields(line)[0]
+	return (first == "track") || (first == "browser")
+}
+
+// parseBEDPos parses a coordinate of a BED line.
+func parseBEDPos(s string) (PosType, error) {
+	v, err := strconv.ParseInt(s, 10, 32)
+	if (err != nil) || (v < 0) || (v >= PosTypeMax) {
+		return 0, fmt.Errorf("invalid coordinate %q", s)
+	}
+	return PosType(v), nil
+}
+
+// parseBEDList parses the comma-separated, optionally comma-terminated
+// blockSizes or blockStarts field of a BED12 line.
+func parseBEDList(s string, n int) ([]PosType, error) {
+	s = strings.TrimSuffix(s, ",")
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("%q has %d values, but blockCount is %d", s, len(parts), n)
+	}
+	vals := make([]PosType, n)
+	for i, part := range parts {
+		v, err := parseBEDPos(part)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// ParseBEDRecord parses a line of a BED3 to BED12 file.  Fields are separated
+// by tabs or spaces.
+func ParseBEDRecord(line string) (r BEDRecord, err error) {
+	fields := strings.Fields(line)
+	r.NFields = len(fields)
+	if (r.NFields < 3) || (r.NFields > 12) {
+		err = fmt.Errorf("interval.ParseBEDRecord: expected 3 to 12 fields, got %d", r.NFields)
+		return
+	}
+	r.RefName = fields[0]
+	if r.Start0, err = parseBEDPos(fields[1]); err != nil {
+		return
+	}
+	if r.End, err = parseBEDPos(fields[2]); err != nil {
+		return
+	}
+	if r.End < r.Start0 {
+		err = fmt.Errorf("interval.ParseBEDRecord: end %d is before start %d", r.End, r.Start0)
+		return
+	}
+	r.Strand = '.'
+	r.ThickStart, r.ThickEnd = r.Start0, r.End
+	if r.NFields > 3 {
+		r.Name = fields[3]
+	}
+	if (r.NFields > 4) && (fields[4] != ".") {
+		if r.Score, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			err = fmt.Errorf("interval.ParseBEDRecord: invalid score %q", fields[4])
+			return
+		}
+	}
+	if r.NFields > 5 {
+		if (fields[5] != "+") && (fields[5] != "-") && (fields[5] != ".") {
+			err = fmt.Errorf("interval.ParseBEDRecord: invalid strand %q", fields[5])
+			return
+		}
+		r.Strand = fields[5][0]
+	}
+	if r.NFields > 6 {
+		if r.ThickStart, err = parseBEDPos(fields[6]); err != nil {
+			return
+		}
+	}
+	if r.NFields > 7 {
+		if r.ThickEnd, err = parseBEDPos(fields[7]); err != nil {
+			return
+		}
+	}
+	if r.NFields > 8 {
+		r.ItemRGB = fields[8]
+	}
+	switch {
+	case r.NFields == 12:
+	case r.NFields > 9:
+		err = fmt.Errorf("interval.ParseBEDRecord: blockCount, blockSizes and blockStarts must all be present")
+		return
+	default:
+		return
+	}
+	nBlock, err := strconv.Atoi(fields[9])
+	if (err != nil) || (nBlock <= 0) {
+		err = fmt.Errorf("interval.ParseBEDRecord: invalid blockCount %q", fields[9])
+		return
+	}
+	sizes, err := parseBEDList(fields[10], nBlock)
+	if err != nil {
+		err = fmt.Errorf("interval.ParseBEDRecord: invalid blockSizes: %v", err)
+		return
+	}
+	starts, err := parseBEDList(fields[11], nBlock)
+	if err != nil {
+		err = fmt.Errorf("interval.ParseBEDRecord: invalid blockStarts: %v", err)
+		return
+	}
+	r.Blocks = make([]Block, nBlock)
+	prevEnd := r.Start0
+	for i := range r.Blocks {
+		b := Block{Start0: r.Start0 + starts[i], End: r.Start0 + starts[i] + sizes[i]}
+		if (b.Start0 < prevEnd) || ((i == 0) && (b.Start0 != r.Start0)) || (b.End > r.End) {
+			err = fmt.Errorf("interval.ParseBEDRecord: block %d [%d, %d) is out of order or outside of the record", i, b.Start0, b.End)
+			return
+		}
+		r.Blocks[i] = b
+		prevEnd = b.End
+	}
+	if prevEnd != r.End {
+		err = fmt.Errorf("interval.ParseBEDRecord: the last block ends at %d instead of the record end %d", prevEnd, r.End)
+	}
+	return
+}
+
+// ReadBED reads the records of a BED3 to BED12 file, in file order.  Comment,
+// "track" and "browser" lines, and empty lines, are skipped.  Unlike
+// NewBEDUnion, the records needn't be sorted.
+func ReadBED(reader io.Reader) ([]BEDRecord, error) {
+	var records []BEDRecord
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 16<<20)
+	lineIdx := 0
+	for scanner.Scan() {
+		lineIdx++
+		line := scanner.Text()
+		if (strings.TrimSpace(line) == "") || isBEDHeaderLine(line) {
+			continue
+		}
+		r, err := ParseBEDRecord(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineIdx, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// ReadBEDFromPath is a wrapper for ReadBED that takes a path instead of an
+// io.Reader.
+func ReadBEDFromPath(path string) (records []BEDRecord, err error) {
+	ctx := vcontext.Background()
+	var infile file.File
+	if infile, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, infile, &err)
+	reader := io.Reader(infile.Reader(ctx))
+	switch fileio.DetermineType(path) {
+	case fileio.Gzip:
+		if reader, err = gzip.NewReader(reader); err != nil {
+			return
+		}
+	}
+	if records, err = ReadBED(reader); err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+// WriteBED writes records to w, each with NFields fields.
+func WriteBED(w io.Writer, records []BEDRecord) error {
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	for i := range records {
+		r := &records[i]
+		buf = append(buf[:0], r.RefName...)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, int64(r.Start0), 10)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, int64(r.End), 10)
+		for field := 3; field < r.NFields && field < 12; field++ {
+			buf = append(buf, '\t')
+			switch field {
+			case 3:
+				buf = append(buf, r.Name...)
+			case 4:
+				buf = strconv.AppendFloat(buf, r.Score, 'g', -1, 64)
+			case 5:
+				buf = append(buf, r.Strand)
+			case 6:
+				buf = strconv.AppendInt(buf, int64(r.ThickStart), 10)
+			case 7:
+				buf = strconv.AppendInt(buf, int64(r.ThickEnd), 10)
+			case 8:
+				buf = append(buf, r.ItemRGB...)
+			case 9:
+				buf = strconv.AppendInt(buf, int64(len(r.Blocks)), 10)
+			case 10, 11:
+				for _, b := range r.Blocks {
+					if field == 10 {
+						buf = strconv.AppendInt(buf, int64(b.End-b.Start0), 10)
+					} else {
+						buf = strconv.AppendInt(buf, int64(b.Start0-r.Start0), 10)
+					}
+					buf = append(buf, ',')
+				}
+			}
+		}
+		buf = append(buf, '\n')
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// SortEntries sorts entries by reference name, then by position, as
+// required by NewBEDUnionFromEntries.
+func SortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if a.RefName != b.RefName {
+			return a.RefName < b.RefName
+		}
+		if a.Start0 != b.Start0 {
+			return a.Start0 < b.Start0
+		}
+		return a.End < b.End
+	})
+}
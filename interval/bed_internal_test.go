@@ -0,0 +1,93 @@
+package interval
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func TestParseBEDRecord(t *testing.T) {
+	r, err := ParseBEDRecord("chr1\t100\t200")
+	assert.NoError(t, err)
+	expect.EQ(t, r, BEDRecord{
+		Entry:      Entry{RefName: "chr1", Start0: 100, End: 200},
+		NFields:    3,
+		Strand:     '.',
+		ThickStart: 100,
+		ThickEnd:   200,
+	})
+	expect.EQ(t, r.Entries(), []Entry{{"chr1", 100, 200}})
+
+	r, err = ParseBEDRecord("chr2\t1000\t5000\tNM_1\t960\t-\t1200\t4900\t255,0,0\t3\t500,400,1000,\t0,1500,3000")
+	assert.NoError(t, err)
+	expect.EQ(t, r, BEDRecord{
+		Entry:      Entry{RefName: "chr2", Start0: 1000, End: 5000},
+		NFields:    12,
+		Name:       "NM_1",
+		Score:      960,
+		Strand:     '-',
+		ThickStart: 1200,
+		ThickEnd:   4900,
+		ItemRGB:    "255,0,0",
+		Blocks:     []Block{{1000, 1500}, {2500, 2900}, {4000, 5000}},
+	})
+	expect.EQ(t, r.Entries(), []Entry{{"chr2", 1000, 1500}, {"chr2", 2500, 2900}, {"chr2", 4000, 5000}})
+
+	r, err = ParseBEDRecord("chr1 10 20 a . +")
+	assert.NoError(t, err)
+	expect.EQ(t, r.NFields, 6)
+	expect.EQ(t, r.Score, 0.0)
+	expect.EQ(t, r.Strand, byte('+'))
+
+	for _, test := range []struct {
+		line, err string
+	}{
+		{"chr1\t100", "expected 3 to 12 fields"},
+		{"chr1\t-1\t100", "invalid coordinate"},
+		{"chr1\t200\t100", "end 100 is before start 200"},
+		{"chr1\t100\t200\tx\ty", "invalid score"},
+		{"chr1\t100\t200\tx\t0\t*", "invalid strand"},
+		{"chr1\t100\t200\tx\t0\t+\t100\t200\t0\t1", "must all be present"},
+		{"chr1\t100\t200\tx\t0\t+\t100\t200\t0\t2\t10,10\t0", "invalid blockStarts"},
+		{"chr1\t100\t200\tx\t0\t+\t100\t200\t0\t2\t10,10\t10,90", "out of order or outside"},
+		{"chr1\t100\t200\tx\t0\t+\t100\t200\t0\t2\t10,10\t0,80", "the last block ends at 190"},
+	} {
+		_, err = ParseBEDRecord(test.line)
+		assert.NotNil(t, err, test.line)
+		expect.HasSubstr(t, err.Error(), test.err, test.line)
+	}
+}
+
+func TestReadWriteBED(t *testing.T) {
+	const data = `# comment
+track name=foo
+chr2	1000	5000	NM_1	960	-	1200	4900	255,0,0	3	500,400,1000,	0,1500,3000,
+
+chr1	100	200
+chr1	50	60	x	0.5
+`
+	records, err := ReadBED(strings.NewReader(data))
+	assert.NoError(t, err)
+	expect.EQ(t, len(records), 3)
+	expect.EQ(t, records[1].Entry, Entry{"chr1", 100, 200})
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteBED(&buf, records))
+	expect.EQ(t, buf.String(), `chr2	1000	5000	NM_1	960	-	1200	4900	255,0,0	3	500,400,1000,	0,1500,3000,
+chr1	100	200
+chr1	50	60	x	0.5
+`)
+
+	_, err = ReadBED(strings.NewReader("chr1\t1\t2\nchr1\t2\n"))
+	expect.HasSubstr(t, err.Error(), "line 2: ")
+
+	var entries []Entry
+	for _, r := range records {
+		entries = append(entries, r.Entries()...)
+	}
+	SortEntries(entries)
+	expect.EQ(t, entries, []Entry{{"chr1", 50, 60}, {"chr1", 100, 200}, {"chr2", 1000, 1500}, {"chr2", 2500, 2900}, {"chr2", 4000, 5000}})
+}
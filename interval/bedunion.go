@@ -32,6 +32,11 @@ type NewBEDOpts struct {
 	// OneBasedInput interprets the BED interval boundaries as one-based [start,
 	// end] instead of the usual zero-based [start, end).
 	OneBasedInput bool
+	// Padding extends each nonempty interval by this many positions on both
+	// sides, before overlapping intervals are merged.  If SAMHeader is
+	// provided, the padded intervals are clipped to the reference lengths.
+	// It can't be combined with Invert.
+	Padding PosType
 }
 
 // intervalUnion is the internal representation of an interval-union on a
@@ -467,6 +472,9 @@ func scanBEDUnion(scanner *bufio.Scanner, opts NewBEDOpts) (bedUnion BEDUnion, e
 			return
 		}
 		end := PosType(parsedEnd)
+		if end != start {
+			start, end = padInterval(start, end, opts.Padding)
+		}
 		if prevRef != gunsafe.BytesToString(curRef) {
 			if prevRef != "" {
 				// Save last interval, add to map.
@@ -548,16 +556,56 @@ func NewBEDUnion(reader io.Reader, opts NewBEDOpts) (bedUnion BEDUnion, err erro
 	// Shouldn't matter for BED files, though.
 	scanner := bufio.NewScanner(reader)
 
+	if (opts.Padding != 0) && ((opts.Padding < 0) || opts.Invert) {
+		err = fmt.Errorf("interval.NewBEDUnion: invalid padding %d", opts.Padding)
+		return
+	}
 	if bedUnion, err = scanBEDUnion(scanner, opts); err != nil {
 		return
 	}
 
 	if opts.SAMHeader != nil {
+		if opts.Padding > 0 {
+			bedUnion.clipToRefLens(opts.SAMHeader)
+		}
 		bedUnion.nameToIDData(opts.SAMHeader, opts.Invert)
 	}
 	return
 }
 
+// padInterval extends the interval [start, end) by pad positions on both
+// sides, without going below 0 or reaching PosTypeMax.
+func padInterval(start, end, pad PosType) (PosType, PosType) {
+	if start -= pad; start < 0 {
+		start = 0
+	}
+	if end >= PosTypeMax-pad {
+		end = PosTypeMax - 1
+	} else {
+		end += pad
+	}
+	return start, end
+}
+
+// clipToRefLens removes the parts of the (non-inverted) intervals which are
+// past the end of their reference in header.
+func (u *BEDUnion) clipToRefLens(header *sam.Header) {
+	for _, ref := range header.Refs() {
+		refIntervals := u.nameMap[ref.Name()]
+		refLen := PosType(ref.Len())
+		n := len(refIntervals)
+		for (n > 0) && (refIntervals[n-2] >= refLen) {
+			n -= 2
+		}
+		if (n > 0) && (refIntervals[n-1] > refLen) {
+			refIntervals[n-1] = refLen
+		}
+		if refIntervals != nil {
+			u.nameMap[ref.Name()] = refIntervals[:n]
+		}
+	}
+}
+
 // NewBEDUnionFromPath is a wrapper for NewBEDUnion that takes a path instead
 // of an io.Reader.
 func NewBEDUnionFromPath(path string, opts NewBEDOpts) (bedUnion BEDUnion, err error) {
@@ -653,6 +701,10 @@ func ParseRegionString(region string) (result Entry, err error) {
 // NewBEDUnionFromEntries initializes a BEDUnion from a sorted []Entry.
 // This ignores opts.OneBasedInput, since start0 is defined to be zero-based.
 func NewBEDUnionFromEntries(entries []Entry, opts NewBEDOpts) (bedUnion BEDUnion, err error) {
+	if (opts.Padding != 0) && ((opts.Padding < 0) || opts.Invert) {
+		err = fmt.Errorf("interval.NewBEDUnionFromEntries: invalid padding %d", opts.Padding)
+		return
+	}
 	bedUnion = initBEDUnion()
 	prevRef := ""
 	var prevStart, prevEnd PosType
@@ -668,6 +720,9 @@ func NewBEDUnionFromEntries(entries []Entry, opts NewBEDOpts) (bedUnion BEDUnion
 			err = fmt.Errorf("interval.NewBEDUnionFromEntry: invalid coordinate pair [%d, %d)", entry.Start0, entry.End)
 			return
 		}
+		if entry.End != entry.Start0 {
+			entry.Start0, entry.End = padInterval(entry.Start0, entry.End, opts.Padding)
+		}
 		if prevRef != curRef {
 			if prevRef != "" {
 				// Save last interval, add to map.
@@ -729,6 +784,9 @@ func NewBEDUnionFromEntries(entries []Entry, opts NewBEDOpts) (bedUnion BEDUnion
 		bedUnion.nameMap[prevRef] = refIntervals
 	}
 	if opts.SAMHeader != nil {
+		if opts.Padding > 0 {
+			bedUnion.clipToRefLens(opts.SAMHeader)
+		}
 		bedUnion.nameToIDData(opts.SAMHeader, opts.Invert)
 	}
 	return
@@ -3,6 +3,7 @@ package interval
 import (
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/grailbio/hts/sam"
@@ -663,3 +664,33 @@ func TestRefNameSet(t *testing.T) {
 		expect.EQ(t, len(bedUnion.EndpointsByName("thisReferenceDoesntExist")), 0)
 	}
 }
+
+func TestPadding(t *testing.T) {
+	chr1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	chr2, _ := sam.NewReference("chr2", "", "", 300, nil, nil)
+	header, _ := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	opts := NewBEDOpts{SAMHeader: header, Padding: 50}
+	bed := "chr1\t20\t100\nchr1\t180\t200\nchr1\t500\t500\nchr1\t600\t700\nchr2\t200\t280\n"
+	bedUnion, err := NewBEDUnion(strings.NewReader(bed), opts)
+	assert.NoError(t, err)
+	// [20, 100) and [180, 200) merge after padding, [500, 500) stays empty,
+	// and chr2 is clipped to its length.
+	expect.EQ(t, bedUnion.EndpointsByName("chr1"), []PosType{0, 250, 550, 750})
+	expect.EQ(t, bedUnion.EndpointsByName("chr2"), []PosType{150, 300})
+	expect.False(t, bedUnion.ContainsByID(0, 520))
+	expect.True(t, bedUnion.ContainsByID(1, 299))
+
+	bedUnion, err = NewBEDUnionFromEntries([]Entry{
+		{RefName: "chr1", Start0: 20, End: 100},
+		{RefName: "chr1", Start0: 180, End: 200},
+		{RefName: "chr2", Start0: 200, End: 280},
+	}, opts)
+	assert.NoError(t, err)
+	expect.EQ(t, bedUnion.EndpointsByName("chr1"), []PosType{0, 250})
+	expect.EQ(t, bedUnion.EndpointsByName("chr2"), []PosType{150, 300})
+
+	_, err = NewBEDUnion(strings.NewReader(bed), NewBEDOpts{Padding: 50, Invert: true})
+	expect.NotNil(t, err)
+	_, err = NewBEDUnion(strings.NewReader(bed), NewBEDOpts{Padding: -1})
+	expect.NotNil(t, err)
+}
@@ -5,5 +5,8 @@
   the desired behavior.)
   It assumes every position fits in a PosType, which is currently defined as
   int32 since that's what BAM files are limited to.
+  BEDUnions can be combined with Union, Intersection, Subtract, Merge and
+  Complement.  When the other fields of a BED file (names, strands, BED12
+  blocks, etc.) are needed, ReadBED returns its lines as BEDRecords.
 */
 package interval
@@ -0,0 +1,167 @@
+package interval
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file implements set operations on BEDUnions.  The operands must not
+// have been loaded with NewBEDOpts.Invert.  The results support ID-based
+// lookup iff the first operand does, with the same reference IDs.
+
+// combineEndpoints returns the endpoints of the positions p for which
+// keep(p is in a, p is in b) is true, where a and b are interval-endpoint
+// slices.
+func combineEndpoints(a, b []PosType, keep func(inA, inB bool) bool) []PosType {
+	var result []PosType
+	i, j := 0, 0
+	in := false
+	for (i < len(a)) || (j < len(b)) {
+		var pos PosType
+		if (j == len(b)) || ((i < len(a)) && (a[i] <= b[j])) {
+			pos = a[i]
+		} else {
+			pos = b[j]
+		}
+		for (i < len(a)) && (a[i] == pos) {
+			i++
+		}
+		for (j < len(b)) && (b[j] == pos) {
+			j++
+		}
+		// [pos, next endpoint) is in a iff an odd number of a's endpoints are
+		// <= pos.
+		if now := keep(i&1 == 1, j&1 == 1); now != in {
+			result = append(result, pos)
+			in = now
+		}
+	}
+	return result
+}
+
+// newBEDUnionFromNameMap returns a BEDUnion with the given interval-unions,
+// and the reference IDs of like, if it has them.
+func newBEDUnionFromNameMap(nameMap map[string]intervalUnion, like *BEDUnion) BEDUnion {
+	bedUnion := initBEDUnion()
+	bedUnion.nameMap = nameMap
+	if like.idMap != nil {
+		bedUnion.RefNames = like.RefNames
+		bedUnion.idMap = make([]intervalUnion, len(like.RefNames))
+		for refID, refName := range like.RefNames {
+			bedUnion.idMap[refID] = nameMap[refName]
+		}
+	}
+	return bedUnion
+}
+
+// combine applies keep to the positions of a and b, on the references of a,
+// and also those of b if withB is set.
+func combine(a, b *BEDUnion, withB bool, keep func(inA, inB bool) bool) BEDUnion {
+	nameMap := make(map[string]intervalUnion)
+	for refName, aIntervals := range a.nameMap {
+		nameMap[refName] = combineEndpoints(aIntervals, b.nameMap[refName], keep)
+	}
+	if withB {
+		for refName, bIntervals := range b.nameMap {
+			if _, ok := a.nameMap[refName]; !ok {
+				nameMap[refName] = combineEndpoints(nil, bIntervals, keep)
+			}
+		}
+	}
+	return newBEDUnionFromNameMap(nameMap, a)
+}
+
+// Union returns the positions which are in a or b.
+func Union(a, b *BEDUnion) BEDUnion {
+	return combine(a, b, true, func(inA, inB bool) bool { return inA || inB })
+}
+
+// Intersection returns the positions which are in both a and b.
+func Intersection(a, b *BEDUnion) BEDUnion {
+	return combine(a, b, false, func(inA, inB bool) bool { return inA && inB })
+}
+
+// Subtract returns the positions which are in a, but not in b.
+func Subtract(a, b *BEDUnion) BEDUnion {
+	return combine(a, b, false, func(inA, inB bool) bool { return inA && !inB })
+}
+
+// Merge returns the BEDUnion with the gaps of at most distance positions
+// between its intervals filled in, like "bedtools merge -d".  (Touching
+// intervals are always merged.)
+func (u *BEDUnion) Merge(distance PosType) BEDUnion {
+	nameMap := make(map[string]intervalUnion)
+	for refName, refIntervals := range u.nameMap {
+		var merged intervalUnion
+		for i := 0; i < len(refIntervals); i += 2 {
+			if n := len(merged); (n > 0) && (refIntervals[i]-merged[n-1] <= distance) {
+				merged[n-1] = refIntervals[i+1]
+				continue
+			}
+			merged = append(merged, refIntervals[i], refIntervals[i+1])
+		}
+		nameMap[refName] = merged
+	}
+	return newBEDUnionFromNameMap(nameMap, u)
+}
+
+// Complement returns the positions of the genome which aren't in u.  Each
+// genome entry is usually a whole reference, e.g. from ReadGenome.  The
+// references of u which aren't in the genome are dropped.
+func Complement(u *BEDUnion, genome []Entry) BEDUnion {
+	nameMap := make(map[string]intervalUnion)
+	for _, entry := range genome {
+		nameMap[entry.RefName] = combineEndpoints([]PosType{entry.Start0, entry.End}, u.nameMap[entry.RefName],
+			func(inA, inB bool) bool { return inA && !inB })
+	}
+	return newBEDUnionFromNameMap(nameMap, u)
+}
+
+// Entries returns the intervals of the BEDUnion, on the given references in
+// the given order, or on all references in lexicographic order if refNames
+// is nil.
+func (u *BEDUnion) Entries(refNames []string) []Entry {
+	if refNames == nil {
+		for refName := range u.nameMap {
+			refNames = append(refNames, refName)
+		}
+		sort.Strings(refNames)
+	}
+	var entries []Entry
+	for _, refName := range refNames {
+		refIntervals := u.nameMap[refName]
+		for i := 0; i < len(refIntervals); i += 2 {
+			entries = append(entries, Entry{RefName: refName, Start0: refIntervals[i], End: refIntervals[i+1]})
+		}
+	}
+	return entries
+}
+
+// ReadGenome reads a bedtools-style genome file, with a reference name and
+// length on each line, and returns an Entry covering each reference, in file
+// order.  Lines starting with '#' are skipped.
+func ReadGenome(reader io.Reader) ([]Entry, error) {
+	var genome []Entry
+	scanner := bufio.NewScanner(reader)
+	lineIdx := 0
+	for scanner.Scan() {
+		lineIdx++
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) == 0) || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("interval.ReadGenome: line %d has fewer tokens than expected", lineIdx)
+		}
+		refLen, err := strconv.ParseInt(fields[1], 10, 32)
+		if (err != nil) || (refLen < 0) || (refLen >= PosTypeMax) {
+			return nil, fmt.Errorf("interval.ReadGenome: invalid length %q on line %d", fields[1], lineIdx)
+		}
+		genome = append(genome, Entry{RefName: fields[0], End: PosType(refLen)})
+	}
+	return genome, scanner.Err()
+}
@@ -0,0 +1,74 @@
+package interval
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func newTestBEDUnion(t *testing.T, entries []Entry, opts NewBEDOpts) BEDUnion {
+	u, err := NewBEDUnionFromEntries(entries, opts)
+	assert.NoError(t, err)
+	return u
+}
+
+func TestCombineEndpoints(t *testing.T) {
+	or := func(inA, inB bool) bool { return inA || inB }
+	and := func(inA, inB bool) bool { return inA && inB }
+	andNot := func(inA, inB bool) bool { return inA && !inB }
+	a := []PosType{0, 10, 20, 30}
+	b := []PosType{5, 20, 25, 40}
+	expect.EQ(t, combineEndpoints(a, b, or), []PosType{0, 40})
+	expect.EQ(t, combineEndpoints(a, b, and), []PosType{5, 10, 25, 30})
+	expect.EQ(t, combineEndpoints(a, b, andNot), []PosType{0, 5, 20, 25})
+	expect.EQ(t, combineEndpoints(b, a, andNot), []PosType{10, 20, 30, 40})
+	expect.EQ(t, combineEndpoints(a, nil, or), a)
+	expect.EQ(t, len(combineEndpoints(nil, b, and)), 0)
+}
+
+func TestSetOps(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 500, nil, nil)
+	assert.NoError(t, err)
+	chr3, err := sam.NewReference("chr3", "", "", 300, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2, chr3})
+	assert.NoError(t, err)
+	a := newTestBEDUnion(t, []Entry{{"chr1", 0, 100}, {"chr1", 200, 300}, {"chr2", 50, 60}}, NewBEDOpts{SAMHeader: header})
+	b := newTestBEDUnion(t, []Entry{{"chr1", 90, 210}, {"chr3", 10, 20}}, NewBEDOpts{})
+
+	u := Union(&a, &b)
+	expect.EQ(t, u.Entries(nil), []Entry{{"chr1", 0, 300}, {"chr2", 50, 60}, {"chr3", 10, 20}})
+	// The result supports ID-based lookup, like a.
+	expect.True(t, u.ContainsByID(2, 15))
+	expect.False(t, u.ContainsByID(2, 20))
+
+	u = Intersection(&a, &b)
+	expect.EQ(t, u.Entries(nil), []Entry{{"chr1", 90, 100}, {"chr1", 200, 210}})
+	expect.False(t, u.ContainsByID(1, 55))
+
+	u = Subtract(&a, &b)
+	expect.EQ(t, u.Entries(nil), []Entry{{"chr1", 0, 90}, {"chr1", 210, 300}, {"chr2", 50, 60}})
+
+	u = a.Merge(99)
+	expect.EQ(t, u.Entries(nil), []Entry{{"chr1", 0, 100}, {"chr1", 200, 300}, {"chr2", 50, 60}})
+	u = a.Merge(100)
+	expect.EQ(t, u.Entries(nil), []Entry{{"chr1", 0, 300}, {"chr2", 50, 60}})
+	expect.True(t, u.ContainsByID(0, 150))
+
+	genome, err := ReadGenome(strings.NewReader("# name\tlength\nchr2\t500\nchr1\t1000\n\nchr3\t300\n"))
+	assert.NoError(t, err)
+	expect.EQ(t, genome, []Entry{{"chr2", 0, 500}, {"chr1", 0, 1000}, {"chr3", 0, 300}})
+	u = Complement(&a, genome)
+	expect.EQ(t, u.Entries([]string{"chr2", "chr1", "chr3"}), []Entry{
+		{"chr2", 0, 50}, {"chr2", 60, 500},
+		{"chr1", 100, 200}, {"chr1", 300, 1000},
+		{"chr3", 0, 300}})
+
+	_, err = ReadGenome(strings.NewReader("chr1\tx\n"))
+	expect.HasSubstr(t, err.Error(), "invalid length")
+}
@@ -25,6 +25,7 @@ import (
 	gunsafe "github.com/grailbio/base/unsafe"
 	"github.com/grailbio/bio/biosimd"
 	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/reference"
 	"github.com/grailbio/hts/sam"
 	"github.com/klauspost/compress/gzip"
 )
@@ -56,6 +57,19 @@ const (
 	BaseT
 	// BaseX is a catch-all.
 	BaseX
+
+	// The remaining values are observation classes which are not bases of the
+	// read, and are only tracked when requested.
+
+	// BaseDel represents a reference position spanned by a deletion in the
+	// read (rendered as '*', as in samtools mpileup).
+	BaseDel
+	// BaseIns represents an aligned base which is followed by an insertion in
+	// the read.  It is counted in addition to the base itself.
+	BaseIns
+	// BaseMod represents a modified base.  It is counted in addition to the
+	// base itself.
+	BaseMod
 )
 
 const (
@@ -63,13 +77,18 @@ const (
 	NBase = 4
 	// NBaseEnum counts BaseX as well as the regular base types.
 	NBaseEnum = 5
+	// NBaseEnumExt also counts the BaseDel, BaseIns and BaseMod observation
+	// classes.
+	NBaseEnumExt = 8
 )
 
 // Seq8ToEnumTable is the .bam seq nibble -> A/C/G/T/X enum mapping.
 var Seq8ToEnumTable = [...]byte{BaseX, BaseA, BaseC, BaseX, BaseG, BaseX, BaseX, BaseX, BaseT, BaseX, BaseX, BaseX, BaseX, BaseX, BaseX, BaseX}
 
 // EnumToASCIITable is the A/C/G/T/X -> ASCII mapping, with X rendered as 'N'.
-var EnumToASCIITable = [...]byte{'A', 'C', 'G', 'T', 'N'}
+// The extended observation classes are rendered as '*' (BaseDel), '+'
+// (BaseIns) and 'm' (BaseMod).
+var EnumToASCIITable = [...]byte{'A', 'C', 'G', 'T', 'N', '*', '+', 'm'}
 
 // Seq8ToASCIITable is the .bam seq nibble -> ASCII mapping.
 var Seq8ToASCIITable = [...]byte{'=', 'A', 'C', 'M', 'G', 'R', 'S', 'V', 'T', 'W', 'Y', 'H', 'K', 'D', 'B', 'N'}
@@ -256,3 +275,59 @@ func LoadFa(ctx context.Context, fapath string, maxline int, headerRefs []*sam.R
 	}
 	return
 }
+
+// LoadReference is like LoadFa, but also accepts the other reference formats
+// supported by reference.Open: a .2bit file, or an indexed FASTA file behind an
+// http(s):// URL, which are read with random access instead of being streamed.
+func LoadReference(ctx context.Context, path string, maxline int, headerRefs []*sam.Reference) (refSeqs [][]byte, err error) {
+	if !strings.HasSuffix(path, ".2bit") && !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return LoadFa(ctx, path, maxline, headerRefs)
+	}
+	var g reference.Genome
+	if g, err = reference.Open(ctx, path); err != nil {
+		return
+	}
+	defer func() {
+		if e := g.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	return LoadGenome(g, headerRefs)
+}
+
+// genomeLoadChunk is the number of bases LoadGenome reads at a time.
+const genomeLoadChunk = 1 << 24
+
+// LoadGenome reads the sequences of headerRefs from g, in the seq8 encoding
+// of LoadFa.  As with LoadFa, the sequences of contigs missing from g are
+// nil.
+func LoadGenome(g reference.Genome, headerRefs []*sam.Reference) (refSeqs [][]byte, err error) {
+	genomeLens := make(map[string]int)
+	for _, c := range g.Contigs() {
+		genomeLens[c.Name] = c.Len
+	}
+	refSeqs = make([][]byte, len(headerRefs))
+	for i, ref := range headerRefs {
+		n, ok := genomeLens[ref.Name()]
+		if !ok {
+			continue
+		}
+		if n != ref.Len() {
+			return nil, fmt.Errorf("LoadGenome: inconsistent lengths for contig %s (%d in .bam header, %d in reference)", ref.Name(), ref.Len(), n)
+		}
+		refSeq := make([]byte, n)
+		for start := 0; start < n; start += genomeLoadChunk {
+			end := start + genomeLoadChunk
+			if end > n {
+				end = n
+			}
+			var seq []byte
+			if seq, err = g.GetSeq(ref.Name(), start, end); err != nil {
+				return nil, err
+			}
+			biosimd.ASCIIToSeq8(refSeq[start:end], seq)
+		}
+		refSeqs[i] = refSeq
+	}
+	return
+}
@@ -0,0 +1,866 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/grailbio/bio/biosimd"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// Active-region reassembly parameters.
+const (
+	// activeRegionMinEvents is the minimum number of mismatches, indels and
+	// soft clips at an active position.
+	activeRegionMinEvents = 2
+	// activeRegionMinClip is the minimum length of a soft clip for it to
+	// count as an event at the adjacent aligned position.
+	activeRegionMinClip = 5
+	// activeRegionPad is the number of reference positions added on each side
+	// of a run of active positions to form the region which is reassembled;
+	// runs separated by at most 2*activeRegionPad positions are merged.
+	activeRegionPad = 20
+	// activeRegionMaxLen is the maximum length of a run of active positions.
+	// Longer runs aren't reassembled.
+	activeRegionMaxLen = 300
+	// activeRegionMaxPaths is the maximum number of paths enumerated through
+	// the assembly graph of a region, and activeRegionMaxHaplotypes is the
+	// maximum number of them (besides the reference) which are kept.
+	activeRegionMaxPaths      = 128
+	activeRegionMaxHaplotypes = 8
+	// activeRegionMinKmerCount is the minimum number of reads supporting a
+	// non-reference edge of the assembly graph.
+	activeRegionMinKmerCount = 2
+	// activeRegionMinReads is the minimum number of reads spanning a region
+	// for it to be reassembled.
+	activeRegionMinReads = 2
+)
+
+// activeRegionKmerSizes are the k-mer sizes tried, in order, for the
+// assembly graph of a region; the first one for which the reference of the
+// region has no repeated k-mer is used.
+var activeRegionKmerSizes = []int{10, 15, 20, 25, 31}
+
+// Scores of the global haplotype-to-reference alignment.  A gap of length n
+// scores alignGapOpen + n*alignGapExtend.
+const (
+	alignMatch     = 1
+	alignMismatch  = -4
+	alignGapOpen   = -6
+	alignGapExtend = -1
+	alignNegInf    = math.MinInt32 / 2
+)
+
+// activeRegionOpts holds the parsed Opts.ActiveRegions and
+// Opts.ActiveRegionMinFrac arguments, and the run-wide region counts.
+type activeRegionOpts struct {
+	minFrac float64
+	stats   *activeRegionStats
+}
+
+// parseActiveRegionOpts returns nil if active-region reassembly is disabled.
+func parseActiveRegionOpts(enabled bool, minFrac float64) (*activeRegionOpts, error) {
+	if (minFrac < 0) || (minFrac > 1) {
+		return nil, fmt.Errorf("Pileup: invalid active-region-min-frac= argument %v", minFrac)
+	}
+	if !enabled {
+		if minFrac != 0 {
+			return nil, fmt.Errorf("Pileup: active-region-min-frac= requires active-regions=")
+		}
+		return nil, nil
+	}
+	if minFrac == 0 {
+		minFrac = 0.1
+	}
+	return &activeRegionOpts{
+		minFrac: minFrac,
+		stats:   &activeRegionStats{},
+	}, nil
+}
+
+// activeRegionStats counts the active regions of a run.  It is shared by all
+// jobs, hence the atomic updates.
+type activeRegionStats struct {
+	// regions is the number of active regions, and skipped is the number of
+	// them which weren't reassembled (too long, repetitive, N-containing, or
+	// covered by too few reads).
+	regions, skipped int64
+	// haplotypes is the number of non-reference haplotypes assembled.
+	haplotypes int64
+	// realigned is the number of reads whose alignment was changed.
+	realigned int64
+}
+
+func (s *activeRegionStats) String() string {
+	return fmt.Sprintf("%d active regions (%d skipped), %d non-reference haplotypes, %d reads realigned",
+		atomic.LoadInt64(&s.regions), atomic.LoadInt64(&s.skipped), atomic.LoadInt64(&s.haplotypes), atomic.LoadInt64(&s.realigned))
+}
+
+// activityCount is the number of reads covering a position (including with a
+// deletion), and the number of them with an event there: a high-quality
+// mismatch, a deletion, an insertion or a long soft clip following the
+// position, or a long soft clip preceding it.
+type activityCount struct {
+	depth, events int32
+}
+
+func (c activityCount) isActive(minFrac float64) bool {
+	return (c.events >= activeRegionMinEvents) && (float64(c.events) >= minFrac*float64(c.depth))
+}
+
+// activeRegion is a run of active positions [start, end).
+type activeRegion struct {
+	start, end int
+	open       bool
+	// tooLong is set when the run exceeds activeRegionMaxLen; such a region
+	// isn't reassembled, so it doesn't hold reads back.
+	tooLong bool
+}
+
+// activeRegionIterator wraps the iterator of a shard, and locally reassembles
+// the reads around its active regions, i.e. the places where many reads
+// disagree with the reference, before they are counted.
+//
+// The reads covering a region (padded by activeRegionPad on each side) are
+// assembled into a de Bruijn graph together with the reference, and the
+// best-supported paths through it become the candidate haplotypes, which are
+// aligned to the reference.  Each read that spans the whole region and
+// matches a haplotype base-for-base (up to mismatches) then gets the
+// haplotype's alignment within the region, so that e.g. the reads of an
+// indel near a repeat or a cluster of mismatches agree on one representation.
+// Other reads, and reads outside of regions, are returned unchanged.
+// Realignment never changes the alignment start of a read, so the reads stay
+// in coordinate order; MD and NM tags aren't updated.
+//
+// A position is settled once a read starting after it has been seen, so a
+// region is complete (and all the reads which can overlap it have been seen)
+// once the settled positions are 2*activeRegionPad past its last active
+// position.  Like umiConsensusIterator, regions are tracked per shard.
+type activeRegionIterator struct {
+	src         bamprovider.Iterator
+	opts        *activeRegionOpts
+	refSeqs     [][]byte
+	flagExclude int
+	mapq        int
+	maxReadSpan int
+	minBaseQual byte
+
+	// refID is the reference of the pending reads, and refSeq8 is its
+	// sequence, in seq8 encoding.
+	refID   int
+	refSeq8 []byte
+	// activity[i] is the activity at position activityStart+i.  The positions
+	// before activityStart are settled.
+	activity      []activityCount
+	activityStart int
+	cur           activeRegion
+	// pending are the reads which may still be realigned, in input order, and
+	// ready are the reads to return.
+	pending []*sam.Record
+	ready   []*sam.Record
+	seqBuf  []byte
+
+	done bool
+	rec  *sam.Record
+	err  error
+}
+
+// newActiveRegionIterator returns an iterator over the reads of src, locally
+// reassembled around active regions.  refSeqs are the reference sequences in
+// seq8 encoding.  Reads which match flagExclude, or have a MAPQ below mapq,
+// are neither used for nor affected by the reassembly.
+func newActiveRegionIterator(src bamprovider.Iterator, opts *activeRegionOpts, refSeqs [][]byte, flagExclude, mapq, maxReadSpan, minBaseQual int) *activeRegionIterator {
+	return &activeRegionIterator{
+		src:         src,
+		opts:        opts,
+		refSeqs:     refSeqs,
+		flagExclude: flagExclude,
+		mapq:        mapq,
+		maxReadSpan: maxReadSpan,
+		minBaseQual: byte(minBaseQual),
+		refID:       -1,
+	}
+}
+
+// usable returns true if r takes part in the reassembly.
+func (it *activeRegionIterator) usable(r *sam.Record) bool {
+	return (it.flagExclude&int(r.Flags) == 0) && (int(r.MapQ) >= it.mapq) && (len(r.Cigar) != 0) && (len(r.Qual) == r.Seq.Length)
+}
+
+// count returns the activity at pos, or nil if pos is settled or past the end
+// of the reference.
+func (it *activeRegionIterator) count(pos int) *activityCount {
+	if pos >= len(it.refSeq8) {
+		return nil
+	}
+	i := pos - it.activityStart
+	if i < 0 {
+		return nil
+	}
+	for len(it.activity) <= i {
+		it.activity = append(it.activity, activityCount{})
+	}
+	return &it.activity[i]
+}
+
+func (it *activeRegionIterator) addEvent(pos int) {
+	if c := it.count(pos); c != nil {
+		c.events++
+	}
+}
+
+// addActivity adds the coverage and events of r to it.activity.
+func (it *activeRegionIterator) addActivity(r *sam.Record) {
+	seq8 := it.unpack(r, it.seqBuf)
+	it.seqBuf = seq8
+	pos := r.Pos
+	posInRead := 0
+	for i, co := range r.Cigar {
+		n := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			for j := 0; j < n; j++ {
+				c := it.count(pos + j)
+				if c == nil {
+					break
+				}
+				c.depth++
+				refBase := it.refSeq8[pos+j]
+				base := seq8[posInRead+j]
+				if (base != refBase) && (base != 15) && (refBase != 15) && (r.Qual[posInRead+j] >= it.minBaseQual) {
+					c.events++
+				}
+			}
+			pos += n
+			posInRead += n
+		case sam.CigarInsertion:
+			if pos > r.Pos {
+				it.addEvent(pos - 1)
+			}
+			posInRead += n
+		case sam.CigarDeletion:
+			for j := 0; j < n; j++ {
+				if c := it.count(pos + j); c != nil {
+					c.depth++
+					c.events++
+				}
+			}
+			pos += n
+		case sam.CigarSkipped:
+			pos += n
+		case sam.CigarSoftClipped:
+			if n >= activeRegionMinClip {
+				if i == 0 {
+					it.addEvent(pos)
+				} else if pos > r.Pos {
+					it.addEvent(pos - 1)
+				}
+			}
+			posInRead += n
+		}
+	}
+}
+
+// unpack returns the seq8 form of r's sequence, reusing buf if possible.
+func (it *activeRegionIterator) unpack(r *sam.Record, buf []byte) []byte {
+	n := r.Seq.Length
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if n != 0 {
+		biosimd.UnpackSeq(buf, gbam.UnsafeDoubletsToBytes(r.Seq.Seq))
+	}
+	return buf
+}
+
+// settle marks the positions before end as settled, extending or closing the
+// current region accordingly.
+func (it *activeRegionIterator) settle(end int) {
+	n := end - it.activityStart
+	if n < 0 {
+		n = 0
+	} else if n > len(it.activity) {
+		n = len(it.activity)
+	}
+	for i := 0; i < n; i++ {
+		if !it.activity[i].isActive(it.opts.minFrac) {
+			continue
+		}
+		pos := it.activityStart + i
+		if it.cur.open && (pos <= it.cur.end+2*activeRegionPad) {
+			it.cur.end = pos + 1
+			if it.cur.end-it.cur.start > activeRegionMaxLen {
+				it.cur.tooLong = true
+			}
+			continue
+		}
+		if it.cur.open {
+			it.closeRegion()
+		}
+		it.cur = activeRegion{start: pos, end: pos + 1, open: true}
+	}
+	it.activity = it.activity[n:]
+	if end > it.activityStart {
+		it.activityStart = end
+	}
+	if it.cur.open && (it.cur.end+2*activeRegionPad < it.activityStart) {
+		it.closeRegion()
+	}
+}
+
+// closeRegion reassembles the current region.
+func (it *activeRegionIterator) closeRegion() {
+	it.cur.open = false
+	stats := it.opts.stats
+	atomic.AddInt64(&stats.regions, 1)
+	start := it.cur.start - activeRegionPad
+	if start < 0 {
+		start = 0
+	}
+	end := it.cur.end + activeRegionPad
+	if end > len(it.refSeq8) {
+		end = len(it.refSeq8)
+	}
+	if it.cur.tooLong || !it.reassemble(start, end) {
+		atomic.AddInt64(&stats.skipped, 1)
+	}
+}
+
+// release moves the pending reads which can't overlap an unfinished region
+// to it.ready.  If all is true, all pending reads are moved.
+func (it *activeRegionIterator) release(all bool) {
+	bound := it.activityStart - activeRegionPad
+	if it.cur.open && !it.cur.tooLong && (it.cur.start-activeRegionPad < bound) {
+		bound = it.cur.start - activeRegionPad
+	}
+	i := 0
+	for ; i < len(it.pending); i++ {
+		if !all && (it.pending[i].End() > bound) {
+			break
+		}
+	}
+	it.ready = append(it.ready, it.pending[:i]...)
+	n := copy(it.pending, it.pending[i:])
+	for j := n; j < len(it.pending); j++ {
+		it.pending[j] = nil
+	}
+	it.pending = it.pending[:n]
+}
+
+// flush finishes the current reference.
+func (it *activeRegionIterator) flush() {
+	if it.refID != -1 {
+		it.settle(it.activityStart + len(it.activity) + 2*activeRegionPad + 1)
+	}
+	it.release(true)
+	it.activity = it.activity[:0]
+	it.cur = activeRegion{}
+}
+
+func (it *activeRegionIterator) add(r *sam.Record) {
+	if r.Ref == nil {
+		it.flush()
+		it.refID = -1
+		it.ready = append(it.ready, r)
+		return
+	}
+	if refID := r.Ref.ID(); refID != it.refID {
+		it.flush()
+		it.refID = refID
+		it.refSeq8 = nil
+		if refID < len(it.refSeqs) {
+			it.refSeq8 = it.refSeqs[refID]
+		}
+		it.activityStart = r.Pos
+	}
+	if it.refSeq8 == nil {
+		it.ready = append(it.ready, r)
+		return
+	}
+	it.settle(r.Pos)
+	it.pending = append(it.pending, r)
+	if it.usable(r) {
+		it.addActivity(r)
+	}
+	it.release(false)
+}
+
+// Scan implements bamprovider.Iterator.
+func (it *activeRegionIterator) Scan() bool {
+	for {
+		if len(it.ready) > 0 {
+			it.rec = it.ready[0]
+			it.ready[0] = nil
+			it.ready = it.ready[1:]
+			return true
+		}
+		if it.done {
+			return false
+		}
+		if !it.src.Scan() {
+			it.done = true
+			it.err = it.src.Err()
+			it.flush()
+			continue
+		}
+		it.add(it.src.Record())
+	}
+}
+
+// Record implements bamprovider.Iterator.
+func (it *activeRegionIterator) Record() *sam.Record {
+	return it.rec
+}
+
+// Err implements bamprovider.Iterator.
+func (it *activeRegionIterator) Err() error {
+	return it.err
+}
+
+// Close implements bamprovider.Iterator.
+func (it *activeRegionIterator) Close() error {
+	for _, r := range it.pending {
+		sam.PutInFreePool(r)
+	}
+	for _, r := range it.ready {
+		sam.PutInFreePool(r)
+	}
+	it.pending, it.ready = nil, nil
+	return it.src.Close()
+}
+
+// regionRead is the part of a read which is aligned to an active region.
+type regionRead struct {
+	r *sam.Record
+	// seq and qual are the read's bases from the one aligned to the first
+	// position of the region to the one aligned to the last.
+	seq, qual []byte
+}
+
+// reassemble reassembles the region [start, end) of the current reference,
+// and realigns the pending reads which span it.  It returns false if the
+// region couldn't be reassembled.
+func (it *activeRegionIterator) reassemble(start, end int) bool {
+	ref := it.refSeq8[start:end]
+	for _, b := range ref {
+		if b == 15 {
+			return false
+		}
+	}
+	var reads []regionRead
+	for _, r := range it.pending {
+		if (r.Pos > start) || (r.End() < end) || !it.usable(r) {
+			continue
+		}
+		first, ok := readOffsetAt(r.Cigar, r.Pos, start)
+		if !ok {
+			continue
+		}
+		last, ok := readOffsetAt(r.Cigar, r.Pos, end-1)
+		if !ok {
+			continue
+		}
+		seq8 := it.unpack(r, nil)
+		reads = append(reads, regionRead{r: r, seq: seq8[first : last+1], qual: r.Qual[first : last+1]})
+	}
+	if len(reads) < activeRegionMinReads {
+		return false
+	}
+	k := 0
+	for _, size := range activeRegionKmerSizes {
+		if 2*size <= len(ref) && !hasRepeatedKmer(ref, size) {
+			k = size
+			break
+		}
+	}
+	if k == 0 {
+		return false
+	}
+	haps := assembleHaplotypes(ref, reads, k)
+	atomic.AddInt64(&it.opts.stats.haplotypes, int64(len(haps)))
+	if len(haps) == 0 {
+		// Nothing to realign the reads to.
+		return true
+	}
+	// The reference comes first, so that it wins ties.
+	haps = append([][]byte{ref}, haps...)
+	hapCigars := make([]sam.Cigar, len(haps))
+	for i, hap := range haps {
+		hapCigars[i] = alignGlobal(hap, ref)
+	}
+	for _, rr := range reads {
+		best, bestScore := -1, 0
+		for i, hap := range haps {
+			if len(hap) != len(rr.seq) {
+				continue
+			}
+			score := 0
+			for j, b := range rr.seq {
+				if (b != hap[j]) && (b != 15) {
+					score += int(rr.qual[j])
+				}
+			}
+			if (best < 0) || (score < bestScore) {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		cigar := spliceCigar(rr.r.Cigar, rr.r.Pos, start, end, hapCigars[best])
+		if cigar == nil || cigarsEqual(cigar, rr.r.Cigar) {
+			continue
+		}
+		if span, _ := cigar.Lengths(); span > it.maxReadSpan {
+			continue
+		}
+		rr.r.Cigar = cigar
+		atomic.AddInt64(&it.opts.stats.realigned, 1)
+	}
+	return true
+}
+
+// hasRepeatedKmer returns true if some k-mer occurs more than once in seq.
+func hasRepeatedKmer(seq []byte, k int) bool {
+	seen := make(map[string]struct{}, len(seq))
+	for i := 0; i+k <= len(seq); i++ {
+		kmer := string(seq[i : i+k])
+		if _, ok := seen[kmer]; ok {
+			return true
+		}
+		seen[kmer] = struct{}{}
+	}
+	return false
+}
+
+// assembleHaplotypes builds the de Bruijn graph of the k-mers of ref and the
+// reads, and returns the sequences (other than ref) of the best-supported
+// paths from the first k-mer of ref to its last one.  The first and last
+// k-mers of ref must be unique.
+func assembleHaplotypes(ref []byte, reads []regionRead, k int) [][]byte {
+	// An edge is a (k+1)-mer.
+	edges := make(map[string]int)
+	for _, rr := range reads {
+		for i := 0; i+k+1 <= len(rr.seq); i++ {
+			e := rr.seq[i : i+k+1]
+			if bytesContain(e, 15) {
+				continue
+			}
+			edges[string(e)]++
+		}
+	}
+	refEdges := make(map[string]bool, len(ref))
+	for i := 0; i+k+1 <= len(ref); i++ {
+		refEdges[string(ref[i:i+k+1])] = true
+	}
+	source := string(ref[:k])
+	sink := string(ref[len(ref)-k:])
+
+	type path struct {
+		seq     []byte
+		support int // the smallest read count of a non-reference edge
+	}
+	var paths []path
+	maxLen := 2 * len(ref)
+	onPath := make(map[string]bool)
+	seq := []byte(source)
+	var visit func(node string, support int)
+	visit = func(node string, support int) {
+		if len(paths) >= activeRegionMaxPaths {
+			return
+		}
+		if node == sink {
+			if support != math.MaxInt32 {
+				paths = append(paths, path{seq: append([]byte(nil), seq...), support: support})
+			}
+			return
+		}
+		if len(seq) >= maxLen {
+			return
+		}
+		type next struct {
+			base  byte
+			count int
+			ref   bool
+		}
+		var nexts []next
+		for _, b := range []byte{1, 2, 4, 8} {
+			e := node + string(b)
+			c, isRef := edges[e], refEdges[e]
+			if isRef || (c >= activeRegionMinKmerCount) {
+				nexts = append(nexts, next{base: b, count: c, ref: isRef})
+			}
+		}
+		sort.SliceStable(nexts, func(i, j int) bool { return nexts[i].count > nexts[j].count })
+		onPath[node] = true
+		for _, nx := range nexts {
+			child := node[1:] + string(nx.base)
+			if onPath[child] {
+				continue
+			}
+			s := support
+			if !nx.ref && (nx.count < s) {
+				s = nx.count
+			}
+			seq = append(seq, nx.base)
+			visit(child, s)
+			seq = seq[:len(seq)-1]
+		}
+		onPath[node] = false
+	}
+	// Paths with support MaxInt32 only use reference edges, i.e. they are the
+	// reference itself.
+	visit(source, math.MaxInt32)
+	sort.SliceStable(paths, func(i, j int) bool { return paths[i].support > paths[j].support })
+	if len(paths) > activeRegionMaxHaplotypes {
+		paths = paths[:activeRegionMaxHaplotypes]
+	}
+	haps := make([][]byte, len(paths))
+	for i, p := range paths {
+		haps[i] = p.seq
+	}
+	return haps
+}
+
+func bytesContain(s []byte, b byte) bool {
+	for _, c := range s {
+		if c == b {
+			return true
+		}
+	}
+	return false
+}
+
+// alignGlobal returns the CIGAR of the best global alignment of query to ref,
+// with affine gap scores (Gotoh's algorithm).  Aligned bases are reported as
+// sam.CigarMatch whether or not they are equal.
+func alignGlobal(query, ref []byte) sam.Cigar {
+	const (
+		stMatch = iota
+		stIns
+		stDel
+	)
+	n, m := len(query), len(ref)
+	w := m + 1
+	// mat, ins and del are the best scores of the alignments of query[:i] to
+	// ref[:j] ending with an aligned pair, an inserted query base, and a
+	// deleted ref base respectively.
+	mat := make([]int32, (n+1)*w)
+	ins := make([]int32, (n+1)*w)
+	del := make([]int32, (n+1)*w)
+	ins[0], del[0] = alignNegInf, alignNegInf
+	for i := 1; i <= n; i++ {
+		mat[i*w], del[i*w] = alignNegInf, alignNegInf
+		ins[i*w] = alignGapOpen + int32(i)*alignGapExtend
+	}
+	for j := 1; j <= m; j++ {
+		mat[j], ins[j] = alignNegInf, alignNegInf
+		del[j] = alignGapOpen + int32(j)*alignGapExtend
+	}
+	score := func(i, j int) int32 {
+		if query[i-1] == ref[j-1] {
+			return alignMatch
+		}
+		return alignMismatch
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			k := i*w + j
+			mat[k] = max32(mat[k-w-1], max32(ins[k-w-1], del[k-w-1])) + score(i, j)
+			ins[k] = max32(max32(mat[k-w], del[k-w])+alignGapOpen+alignGapExtend, ins[k-w]+alignGapExtend)
+			del[k] = max32(max32(mat[k-1], ins[k-1])+alignGapOpen+alignGapExtend, del[k-1]+alignGapExtend)
+		}
+	}
+	// bestState returns the state with the highest score at k, preferring
+	// aligned pairs.
+	bestState := func(k int) int {
+		switch {
+		case (mat[k] >= ins[k]) && (mat[k] >= del[k]):
+			return stMatch
+		case ins[k] >= del[k]:
+			return stIns
+		}
+		return stDel
+	}
+	var ops []sam.CigarOpType // in reverse order
+	i, j := n, m
+	state := bestState(n*w + m)
+	for (i > 0) || (j > 0) {
+		k := i*w + j
+		switch state {
+		case stMatch:
+			ops = append(ops, sam.CigarMatch)
+			i--
+			j--
+			if (i > 0) || (j > 0) {
+				state = bestState(i*w + j)
+			}
+		case stIns:
+			ops = append(ops, sam.CigarInsertion)
+			if ins[k-w]+alignGapExtend != ins[k] {
+				if mat[k-w] < del[k-w] {
+					state = stDel
+				} else {
+					state = stMatch
+				}
+			}
+			i--
+		case stDel:
+			ops = append(ops, sam.CigarDeletion)
+			if del[k-1]+alignGapExtend != del[k] {
+				if mat[k-1] < ins[k-1] {
+					state = stIns
+				} else {
+					state = stMatch
+				}
+			}
+			j--
+		}
+	}
+	var cigar sam.Cigar
+	for x := len(ops) - 1; x >= 0; {
+		y := x
+		for (y >= 0) && (ops[y] == ops[x]) {
+			y--
+		}
+		cigar = append(cigar, sam.NewCigarOp(ops[x], x-y))
+		x = y
+	}
+	return cigar
+}
+
+func max32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// readOffsetAt returns the offset in the read of the base aligned to
+// reference position refPos, given the read's CIGAR and alignment start pos.
+// It returns false if no base is aligned there.
+func readOffsetAt(cigar sam.Cigar, pos, refPos int) (int, bool) {
+	posInRead := 0
+	for _, co := range cigar {
+		n := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			if refPos < pos+n {
+				if refPos < pos {
+					return 0, false
+				}
+				return posInRead + refPos - pos, true
+			}
+			pos += n
+			posInRead += n
+		case sam.CigarInsertion, sam.CigarSoftClipped:
+			posInRead += n
+		case sam.CigarDeletion, sam.CigarSkipped:
+			if refPos < pos+n {
+				return 0, false
+			}
+			pos += n
+		}
+	}
+	return 0, false
+}
+
+// spliceCigar returns the CIGAR of a read with the given CIGAR and alignment
+// start pos, with its alignment to the reference positions [start, end)
+// replaced by mid.  The bases aligned to start and end-1 must be the first
+// and last bases of mid.  It returns nil if the result doesn't start its
+// alignment at pos.
+func spliceCigar(cigar sam.Cigar, pos, start, end int, mid sam.Cigar) sam.Cigar {
+	var out sam.Cigar
+	refPos := pos
+	for _, co := range cigar {
+		n := co.Len()
+		t := co.Type()
+		if isAlignedOp(t) && (refPos+n > start) {
+			if start > refPos {
+				out = append(out, sam.NewCigarOp(t, start-refPos))
+			}
+			break
+		}
+		out = append(out, co)
+		if t.Consumes().Reference != 0 {
+			refPos += n
+		}
+	}
+	out = append(out, mid...)
+	refPos = pos
+	for i, co := range cigar {
+		n := co.Len()
+		t := co.Type()
+		if isAlignedOp(t) && (refPos+n >= end) {
+			if rest := refPos + n - end; rest > 0 {
+				out = append(out, sam.NewCigarOp(t, rest))
+			}
+			out = append(out, cigar[i+1:]...)
+			break
+		}
+		if t.Consumes().Reference != 0 {
+			refPos += n
+		}
+	}
+	out = mergeCigarOps(out)
+	// The alignment must still start with an aligned base.
+	for _, co := range out {
+		switch co.Type() {
+		case sam.CigarSoftClipped, sam.CigarHardClipped:
+			continue
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			return out
+		}
+		return nil
+	}
+	return nil
+}
+
+func isAlignedOp(t sam.CigarOpType) bool {
+	return (t == sam.CigarMatch) || (t == sam.CigarEqual) || (t == sam.CigarMismatch)
+}
+
+// mergeCigarOps merges the adjacent operations of the same type in cigar, in
+// place.
+func mergeCigarOps(cigar sam.Cigar) sam.Cigar {
+	out := cigar[:0]
+	for _, co := range cigar {
+		if last := len(out) - 1; (last >= 0) && (out[last].Type() == co.Type()) {
+			out[last] = sam.NewCigarOp(co.Type(), out[last].Len()+co.Len())
+			continue
+		}
+		out = append(out, co)
+	}
+	return out
+}
+
+func cigarsEqual(a, b sam.Cigar) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
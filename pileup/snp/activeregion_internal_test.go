@@ -0,0 +1,137 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseActiveRegionOpts(t *testing.T) {
+	o, err := parseActiveRegionOpts(false, 0)
+	assert.NoError(t, err)
+	assert.True(t, o == nil)
+	o, err = parseActiveRegionOpts(true, 0)
+	assert.NoError(t, err)
+	assert.EQ(t, o.minFrac, 0.1)
+	_, err = parseActiveRegionOpts(false, 0.2)
+	assert.NotNil(t, err)
+	_, err = parseActiveRegionOpts(true, 1.5)
+	assert.NotNil(t, err)
+}
+
+func TestAlignGlobal(t *testing.T) {
+	seq8 := func(s string) []byte {
+		b := make([]byte, len(s))
+		biosimd.ASCIIToSeq8(b, []byte(s))
+		return b
+	}
+	for _, tt := range []struct {
+		query, ref string
+		want       string
+	}{
+		{"ACGTACGTAC", "ACGTACGTAC", "10M"},
+		{"ACGTGACGTAC", "ACGTACGTAC", "4M1I6M"},
+		{"ACGTGCATTGCA", "ACGTGCAGGTTGCA", "7M2D5M"},
+		{"ACGTACCTAC", "ACGTACGTAC", "10M"},
+	} {
+		assert.EQ(t, alignGlobal(seq8(tt.query), seq8(tt.ref)).String(), tt.want, tt)
+	}
+}
+
+func TestSpliceCigar(t *testing.T) {
+	cigar := sam.Cigar{
+		sam.NewCigarOp(sam.CigarSoftClipped, 5),
+		sam.NewCigarOp(sam.CigarMatch, 73),
+		sam.NewCigarOp(sam.CigarDeletion, 3),
+		sam.NewCigarOp(sam.CigarMatch, 47),
+	}
+	off, ok := readOffsetAt(cigar, 30, 80)
+	assert.True(t, ok)
+	assert.EQ(t, off, 55)
+	_, ok = readOffsetAt(cigar, 30, 104)
+	assert.False(t, ok)
+	off, ok = readOffsetAt(cigar, 30, 125)
+	assert.True(t, ok)
+	assert.EQ(t, off, 97)
+
+	mid := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 20), sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 23)}
+	assert.EQ(t, spliceCigar(cigar, 30, 80, 126, mid).String(), "5S70M3D50M")
+	// A replacement which would move the alignment start is rejected.
+	mid = sam.Cigar{sam.NewCigarOp(sam.CigarDeletion, 1), sam.NewCigarOp(sam.CigarMatch, 46)}
+	assert.True(t, spliceCigar(cigar, 30, 30, 76, mid) == nil)
+}
+
+func TestActiveRegionIterator(t *testing.T) {
+	const refLen = 300
+	rng := rand.New(rand.NewSource(1))
+	refASCII := make([]byte, refLen)
+	for i := range refASCII {
+		refASCII[i] = "ACGT"[rng.Intn(4)]
+	}
+	// Make the 3-base deletion at 100..102 unambiguous.
+	copy(refASCII[99:], "CACGTTG")
+	refSeq8 := make([]byte, refLen)
+	biosimd.ASCIIToSeq8(refSeq8, refASCII)
+	ref, err := sam.NewReference("chr1", "", "", refLen, nil, nil)
+	assert.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	hap := append(append([]byte(nil), refASCII[:100]...), refASCII[103:]...)
+	readSeq := hap[30:150]
+	qual := make([]byte, len(readSeq))
+	for i := range qual {
+		qual[i] = 30
+	}
+	newRead := func(name string, pos int, cigar sam.Cigar) *sam.Record {
+		return &sam.Record{Name: name, Ref: ref, Pos: pos, MapQ: 60, Cigar: cigar, Seq: sam.NewSeq(readSeq), Qual: qual}
+	}
+	good := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 70), sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 50)}
+	// The same read sequence, with the deletion misplaced by 3 positions at
+	// the cost of 2 mismatches.
+	shifted := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 73), sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 47)}
+	var recs []*sam.Record
+	for i := 0; i < 3; i++ {
+		recs = append(recs, newRead("good", 30, good), newRead("shifted", 30, shifted))
+	}
+	// A read far from the region, which is returned as is.
+	far := newRead("far", 170, sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 120)})
+	recs = append(recs, far)
+
+	opts, err := parseActiveRegionOpts(true, 0)
+	assert.NoError(t, err)
+	it := newActiveRegionIterator(&sliceIterator{recs: recs}, opts, [][]byte{refSeq8}, 0, 0, 511, 0)
+	var got []*sam.Record
+	for it.Scan() {
+		got = append(got, it.Record())
+	}
+	assert.NoError(t, it.Err())
+	assert.EQ(t, len(got), len(recs))
+	for i, r := range got {
+		assert.True(t, r == recs[i])
+		if r != far {
+			assert.EQ(t, r.Cigar.String(), "70M3D50M", r.Name)
+		}
+	}
+	assert.EQ(t, far.Cigar.String(), "120M")
+	assert.EQ(t, opts.stats.regions, int64(1))
+	assert.EQ(t, opts.stats.skipped, int64(0))
+	assert.EQ(t, opts.stats.haplotypes, int64(1))
+	assert.EQ(t, opts.stats.realigned, int64(3))
+}
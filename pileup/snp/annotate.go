@@ -0,0 +1,141 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/encoding/gff"
+)
+
+// annotationTypes are the feature types reported by Opts.Annotate, with the
+// names of their TSV columns and VCF INFO fields.
+var annotationTypes = [...]struct {
+	typ, col, info string
+}{
+	{"gene", "GENES", "GENE"},
+	{"exon", "EXONS", "EXON"},
+	{"CDS", "CDS", "CDS"},
+}
+
+// vcfAnnotationHeaderLines are added to vcfHeaderLines when Opts.Annotate is
+// set.
+const vcfAnnotationHeaderLines = `##INFO=<ID=GENE,Number=.,Type=String,Description="Genes overlapping the position">
+##INFO=<ID=EXON,Number=.,Type=String,Description="Genes with an exon overlapping the position">
+##INFO=<ID=CDS,Number=.,Type=String,Description="Genes with a CDS overlapping the position">
+`
+
+// annotator looks up the genes overlapping each output position.  It is not
+// thread safe.
+type annotator struct {
+	index *gff.Index
+	// names[i] is the comma-separated list of genes with a feature of type
+	// annotationTypes[i] at the last position passed to lookup, or empty.
+	names    [len(annotationTypes)][]byte
+	features []gff.Feature
+}
+
+// newAnnotator parses an Opts.Annotate argument, gtf=<path> or gff3=<path>,
+// and reads the annotation file.
+func newAnnotator(ctx context.Context, arg string) (*annotator, error) {
+	eq := strings.IndexByte(arg, '=')
+	if eq < 0 {
+		return nil, fmt.Errorf("expected gtf=<path> or gff3=<path>, got %q", arg)
+	}
+	var format gff.Format
+	switch arg[:eq] {
+	case "gtf":
+		format = gff.GTF
+	case "gff3":
+		format = gff.GFF3
+	default:
+		return nil, fmt.Errorf("unknown annotation format %q", arg[:eq])
+	}
+	types := make([]string, len(annotationTypes))
+	for i, t := range annotationTypes {
+		types[i] = t.typ
+	}
+	index, err := gff.ReadIndexFromPath(ctx, arg[eq+1:], format, types...)
+	if err != nil {
+		return nil, err
+	}
+	return &annotator{index: index}, nil
+}
+
+// lookup finds the genes overlapping the given 0-based position.
+func (a *annotator) lookup(refName string, pos PosType) {
+	for i, t := range annotationTypes {
+		a.features = a.index.AppendOverlaps(a.features[:0], t.typ, refName, int(pos), int(pos)+1)
+		names := a.names[i][:0]
+		for j, f := range a.features {
+			if containsFeatureName(a.features[:j], f.Name) {
+				continue
+			}
+			if len(names) != 0 {
+				names = append(names, ',')
+			}
+			names = append(names, f.Name...)
+		}
+		a.names[i] = names
+	}
+}
+
+// containsFeatureName returns whether one of features is named name.
+func containsFeatureName(features []gff.Feature, name string) bool {
+	for _, f := range features {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// annotationColumns returns the names of the annotation columns.
+func annotationColumns() []string {
+	cols := make([]string, len(annotationTypes))
+	for i, t := range annotationTypes {
+		cols[i] = t.col
+	}
+	return cols
+}
+
+// writeCols appends the annotation columns for the last position passed to
+// lookup, with '.' for no genes.
+func (a *annotator) writeCols(w *tsv.Writer) {
+	for _, names := range a.names {
+		if len(names) == 0 {
+			w.WriteByte('.')
+		} else {
+			w.WriteBytes(names)
+		}
+	}
+}
+
+// appendInfo appends the nonempty annotation INFO fields for the last position
+// passed to lookup, each preceded by ';'.
+func (a *annotator) appendInfo(buf []byte) []byte {
+	for i, names := range a.names {
+		if len(names) == 0 {
+			continue
+		}
+		buf = append(buf, ';')
+		buf = append(buf, annotationTypes[i].info...)
+		buf = append(buf, '=')
+		buf = append(buf, names...)
+	}
+	return buf
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+const testAnnotationGTF = `chr1	HAVANA	gene	100	500	.	+	.	gene_id "G1"; gene_name "ONE";
+chr1	HAVANA	transcript	100	500	.	+	.	gene_id "G1"; transcript_id "T1"; gene_name "ONE";
+chr1	HAVANA	exon	100	150	.	+	.	gene_id "G1"; transcript_id "T1"; gene_name "ONE";
+chr1	HAVANA	CDS	120	150	.	+	0	gene_id "G1"; transcript_id "T1"; gene_name "ONE";
+chr1	HAVANA	transcript	140	400	.	+	.	gene_id "G1"; transcript_id "T2"; gene_name "ONE";
+chr1	HAVANA	exon	140	200	.	+	.	gene_id "G1"; transcript_id "T2"; gene_name "ONE";
+chr1	HAVANA	gene	450	900	.	-	.	gene_id "G2";
+chr1	HAVANA	exon	450	600	.	-	.	gene_id "G2"; transcript_id "T3";
+`
+
+func TestAnnotator(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(tmpdir, "genes.gtf")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testAnnotationGTF), 0644))
+	ctx := vcontext.Background()
+
+	ann, err := newAnnotator(ctx, "gtf="+path)
+	assert.NoError(t, err)
+	for _, tt := range []struct {
+		refName string
+		pos     PosType
+		cols    string
+		info    string
+	}{
+		{"chr1", 98, ".\t.\t.\n", ""},
+		{"chr1", 144, "ONE\tONE\tONE\n", ";GENE=ONE;EXON=ONE;CDS=ONE"},
+		{"chr1", 160, "ONE\tONE\t.\n", ";GENE=ONE;EXON=ONE"},
+		{"chr1", 460, "ONE,G2\tG2\t.\n", ";GENE=ONE,G2;EXON=G2"},
+		{"chr2", 144, ".\t.\t.\n", ""},
+	} {
+		ann.lookup(tt.refName, tt.pos)
+		var buf bytes.Buffer
+		w := tsv.NewWriter(&buf)
+		ann.writeCols(w)
+		assert.NoError(t, w.EndLine())
+		assert.NoError(t, w.Flush())
+		assert.EQ(t, buf.String(), tt.cols, tt.pos)
+		assert.EQ(t, string(ann.appendInfo(nil)), tt.info, tt.pos)
+	}
+
+	for _, bad := range []string{path, "bed=" + path, "gtf=" + filepath.Join(tmpdir, "missing.gtf")} {
+		_, err = newAnnotator(ctx, bad)
+		assert.NotNil(t, err, bad)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// Boundary audit mode (Opts.AuditBoundaries) checks the part of the pileup
+// that is most likely to be wrong: the positions near the boundaries between
+// shards, where reads are seen by two shards and the results of two jobs are
+// concatenated.  For each boundary, the positions within opts.padding of it
+// are recomputed by a single job whose shard extends another opts.padding
+// past them on both sides, so that it has no boundary anywhere near the
+// audited positions.  The two results must match exactly.
+
+// shardBoundary is a position where one shard ends and the next one starts.
+type shardBoundary struct {
+	ref *sam.Reference
+	pos PosType
+}
+
+// shardBoundaries returns the boundaries between consecutive shards that
+// split a reference.
+func shardBoundaries(shards []gbam.Shard) []shardBoundary {
+	var boundaries []shardBoundary
+	for i := 1; i < len(shards); i++ {
+		prev, cur := &shards[i-1], &shards[i]
+		if prev.EndRef == nil || prev.EndRef != cur.StartRef || prev.End != cur.Start {
+			continue
+		}
+		if cur.Start == 0 || cur.Start >= cur.StartRef.Len() {
+			continue
+		}
+		boundaries = append(boundaries, shardBoundary{ref: cur.StartRef, pos: PosType(cur.Start)})
+	}
+	return boundaries
+}
+
+// auditKey identifies a position.
+type auditKey struct {
+	refID, pos uint32
+}
+
+// auditCollector is a recordio.Writer which keeps the pileupRows of a single
+// job in memory, as Rows.
+type auditCollector struct {
+	refs []*sam.Reference
+	rows map[auditKey]Row
+}
+
+func (c *auditCollector) Append(v interface{}) {
+	pr := v.(*pileupRow)
+	c.rows[auditKey{pr.refID, pr.pos}] = newRow(pr, c.refs)
+}
+
+func (c *auditCollector) AddHeader(key string, value interface{}) {}
+func (c *auditCollector) Flush()                                  {}
+func (c *auditCollector) Wait()                                   {}
+func (c *auditCollector) SetTrailer(trailer []byte)               {}
+func (c *auditCollector) Err() error                              { return nil }
+func (c *auditCollector) Finish() error                           { return nil }
+
+// auditDiscrepancy describes an audited position where the sharded and
+// unsharded results differ.  sharded or unsharded is nil if the position is
+// missing from that result.
+type auditDiscrepancy struct {
+	key                auditKey
+	boundary           PosType
+	status             string
+	sharded, unsharded *Row
+}
+
+// formatAuditRow formats the counts of row as
+// DEPTH;A+,A-,C+,C-,G+,G-,T+,T-,N+,N-;INS+,INS-;DEL+,DEL-, or "." if row is
+// nil.
+func formatAuditRow(row *Row) string {
+	if row == nil {
+		return "."
+	}
+	buf := strconv.AppendUint(make([]byte, 0, 64), uint64(row.Depth), 10)
+	sep := byte(';')
+	for b := 0; b < pileup.NBaseEnum; b++ {
+		for strand := 0; strand < 2; strand++ {
+			buf = append(buf, sep)
+			buf = strconv.AppendUint(buf, uint64(row.Counts[b][strand]), 10)
+			sep = ','
+		}
+	}
+	for _, counts := range [][2]uint32{row.InsCounts, row.DelCounts} {
+		buf = append(buf, ';')
+		buf = strconv.AppendUint(buf, uint64(counts[0]), 10)
+		buf = append(buf, ',')
+		buf = strconv.AppendUint(buf, uint64(counts[1]), 10)
+	}
+	return string(buf)
+}
+
+// sameAuditCounts returns true if a and b have the same counts, i.e. the
+// same formatAuditRow output.
+func sameAuditCounts(a, b *Row) bool {
+	return (a.Depth == b.Depth) && (a.Counts == b.Counts) && (a.InsCounts == b.InsCounts) && (a.DelCounts == b.DelCounts)
+}
+
+// auditShardBoundaries recomputes the positions near each shard boundary as
+// described above, compares them to the rows in tmpFiles, and writes the
+// discrepancies to <mainPath>.boundary_audit.tsv.  It returns the number of
+// discrepancies.
+func auditShardBoundaries(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.StrandType, tmpFiles []*os.File, mainPath string, nCirc PosType, qpt *qualPassTable) (nBad int, reportPath string, err error) {
+	header, _ := opts.provider.GetHeader()
+	refs := header.Refs()
+	boundaries := shardBoundaries(opts.shards)
+	margin := PosType(opts.padding)
+	if margin == 0 {
+		margin = 1
+	}
+	log.Printf("auditShardBoundaries: recomputing %d shard boundaries", len(boundaries))
+	// The recomputed positions aren't part of the run's output, so they're
+	// kept from the hooks.  They are collected in memory rather than written
+	// in blocks, so the memory budget doesn't apply either.
+	auditOpts := *opts
+	auditOpts.hooks = nil
+	auditOpts.memBudget = nil
+
+	// want contains the unsharded results for all audited positions, and
+	// boundaryOf maps each audited position to its boundary.
+	want := make(map[auditKey]Row)
+	boundaryOf := make(map[auditKey]PosType)
+	for _, b := range boundaries {
+		refLen := PosType(b.ref.Len())
+		shard := gbam.Shard{
+			StartRef: b.ref,
+			EndRef:   b.ref,
+			Start:    int(maxPosType(0, b.pos-2*margin)),
+			End:      int(minPosType(refLen, b.pos+2*margin)),
+			Padding:  opts.padding,
+			ShardIdx: -1, // not one of opts.shards, for opts.shardTimer
+		}
+		c := &auditCollector{refs: refs, rows: make(map[auditKey]Row)}
+		if err = pileupJob(&auditOpts, strandReq, []gbam.Shard{shard}, c, nCirc, qpt, nil, nil, nil, nil, nil, nil, nil); err != nil {
+			return
+		}
+		auditStart := maxPosType(0, b.pos-margin)
+		auditEnd := minPosType(refLen, b.pos+margin)
+		for pos := auditStart; pos < auditEnd; pos++ {
+			key := auditKey{uint32(b.ref.ID()), uint32(pos)}
+			boundaryOf[key] = b.pos
+			if row, ok := c.rows[key]; ok {
+				want[key] = row
+			}
+		}
+	}
+
+	var bad []auditDiscrepancy
+	seen := make(map[auditKey]bool)
+	for _, f := range tmpFiles {
+		if _, err = f.Seek(0, 0); err != nil {
+			return
+		}
+		scanner := newPileupRowScanner(f)
+		for scanner.Scan() {
+			pr := scanner.Get().(*pileupRow)
+			key := auditKey{pr.refID, pr.pos}
+			boundary, ok := boundaryOf[key]
+			if !ok {
+				continue
+			}
+			got := newRow(pr, refs)
+			d := auditDiscrepancy{key: key, boundary: boundary, sharded: &got}
+			if seen[key] {
+				d.status = "duplicate"
+				bad = append(bad, d)
+				continue
+			}
+			seen[key] = true
+			expected, ok := want[key]
+			if !ok {
+				d.status = "extra"
+				bad = append(bad, d)
+			} else if !sameAuditCounts(&got, &expected) {
+				d.status = "mismatch"
+				d.unsharded = &expected
+				bad = append(bad, d)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+	}
+	for key, expected := range want {
+		if !seen[key] {
+			expected := expected
+			bad = append(bad, auditDiscrepancy{key: key, boundary: boundaryOf[key], status: "missing", unsharded: &expected})
+		}
+	}
+	sort.Slice(bad, func(i, j int) bool {
+		if bad[i].key.refID != bad[j].key.refID {
+			return bad[i].key.refID < bad[j].key.refID
+		}
+		return bad[i].key.pos < bad[j].key.pos
+	})
+	reportPath = mainPath + ".boundary_audit.tsv"
+	err = writeAuditReport(ctx, reportPath, refs, bad)
+	log.Printf("auditShardBoundaries: %d positions audited, %d discrepancies", len(boundaryOf), len(bad))
+	return len(bad), reportPath, err
+}
+
+func writeAuditReport(ctx context.Context, path string, refs []*sam.Reference, bad []auditDiscrepancy) (err error) {
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#CHROM\tPOS\tBOUNDARY\tSTATUS\tSHARDED\tUNSHARDED")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	for _, d := range bad {
+		// Positions are 0-based, as in the basestrand formats.
+		w.WriteString(refs[d.key.refID].Name())
+		w.WriteUint32(d.key.pos)
+		w.WriteInt64(int64(d.boundary))
+		w.WriteString(d.status)
+		w.WriteString(formatAuditRow(d.sharded))
+		w.WriteString(formatAuditRow(d.unsharded))
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	return w.Flush()
+}
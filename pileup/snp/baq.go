@@ -0,0 +1,392 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math"
+
+	"github.com/grailbio/bio/biosimd"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// This file implements Opts.BAQ, a port of the BAQ computation of
+// samtools/htslib (sam_prob_realn() and probaln_glocal()): each read is
+// realigned to the reference around its alignment with a profile HMM, and
+// the quality of each aligned base is capped by the posterior probability
+// that it is aligned to the same reference position as in the CIGAR.  Bases
+// near an indel that the aligner missed (or placed differently) get a low
+// BAQ, so their mismatches don't look like SNVs.
+
+// HMM parameters of samtools for Illumina reads.
+const (
+	baqGapOpen   = 0.001
+	baqGapExtend = 0.1
+	// baqEI and baqEM are the emission probabilities of an inserted base, and
+	// of a specific mismatching base.
+	baqEI = 0.25
+	baqEM = 1.0 / 3
+)
+
+// baqQualOffset is the offset of the BQ tag values of samtools: BQ[i] is
+// qual[i] - BAQ[i] + baqQualOffset.
+const baqQualOffset = 64
+
+// bqTag holds the BAQ of a read computed earlier, e.g. by "samtools calmd
+// -r".
+var bqTag = sam.NewTag("BQ")
+
+// baqQualToProb[q] is the error probability of base quality q.
+var baqQualToProb [256]float64
+
+func init() {
+	for q := range baqQualToProb {
+		baqQualToProb[q] = math.Pow(10, -float64(q)/10)
+	}
+}
+
+// baqRealigner computes the BAQ of reads.  Its buffers are reused from read
+// to read, so each pileup job needs its own.
+type baqRealigner struct {
+	seq8, ref, query []byte
+	// f and b are the forward and backward matrices of the HMM, with one row
+	// of 3 * (2 * bandwidth + 1) + 6 values per query position, and s holds
+	// the scaling factors of the rows.
+	f, b, s []float64
+	// state and q are the maximum a posteriori state and its phred-scaled
+	// probability for each query base.  state is (reference position << 2)
+	// for a match and (reference position << 2 | 1) for an insertion.
+	state []int
+	q     []byte
+}
+
+// resizeFloats returns a zeroed slice of n float64s, reusing buf if possible.
+func resizeFloats(buf []float64, n int) []float64 {
+	if cap(buf) < n {
+		return make([]float64, n)
+	}
+	buf = buf[:n]
+	for i := range buf {
+		buf[i] = 0
+	}
+	return buf
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// apply caps the base qualities of r by their BAQ.  r.Qual is replaced
+// rather than modified, since it may be shared with the record's source.
+// If r has a BQ tag, its values are used instead of computing the BAQ
+// again.  Reads with a reference skip (N) operation are left unchanged, as
+// in samtools.
+func (br *baqRealigner) apply(r *sam.Record, refSeq8 []byte) {
+	if (len(r.Cigar) == 0) || (len(r.Qual) == 0) || (r.Qual[0] == 0xff) {
+		return
+	}
+	if aux := r.AuxFields.Get(bqTag); aux != nil {
+		if bq, ok := aux.Value().(string); ok && (len(bq) == len(r.Qual)) {
+			qual := make([]byte, len(r.Qual))
+			for i, q := range r.Qual {
+				if int(q)+baqQualOffset >= int(bq[i]) {
+					qual[i] = byte(int(q) + baqQualOffset - int(bq[i]))
+				}
+			}
+			r.Qual = qual
+			return
+		}
+	}
+	n := r.Seq.Length
+	if cap(br.seq8) < n {
+		br.seq8 = make([]byte, n)
+	}
+	br.seq8 = br.seq8[:n]
+	biosimd.UnpackSeq(br.seq8, gbam.UnsafeDoubletsToBytes(r.Seq.Seq))
+	if qual := br.realign(r.Cigar, r.Pos, br.seq8, r.Qual, refSeq8); qual != nil {
+		r.Qual = qual
+	}
+}
+
+// realign returns the base qualities of a read, capped by their BAQ, or nil
+// if they are unchanged.  pos is the 0-based position of the alignment, and
+// seq8 and refSeq8 are the read and reference sequences in seq8 encoding.
+func (br *baqRealigner) realign(cigar sam.Cigar, pos int, seq8, qual, refSeq8 []byte) []byte {
+	// Find the aligned parts of the read (y) and the reference (x).
+	x, y := pos, 0
+	xb, xe, yb, ye := -1, -1, -1, -1
+	for _, co := range cigar {
+		l := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			if yb < 0 {
+				yb = y
+			}
+			if xb < 0 {
+				xb = x
+			}
+			ye, xe = y+l, x+l
+			x += l
+			y += l
+		case sam.CigarSoftClipped, sam.CigarInsertion:
+			y += l
+		case sam.CigarDeletion:
+			x += l
+		case sam.CigarSkipped:
+			return nil
+		}
+	}
+	if xb < 0 {
+		return nil
+	}
+	// The band must be wide enough for the net length of the indels, and
+	// the reference window covers the read's clipped bases.
+	lSeq := len(qual)
+	bw := 7
+	if d := abs((xe - xb) - (ye - yb)); d > bw {
+		bw = d + 3
+	}
+	xb -= yb + bw/2
+	if xb < 0 {
+		xb = 0
+	}
+	xe += lSeq - ye + bw/2
+	if xe-xb-lSeq > bw {
+		xb += (xe - xb - lSeq - bw) / 2
+		xe -= (xe - xb - lSeq - bw) / 2
+	}
+	xe = min(xe, len(refSeq8))
+	if xe <= xb {
+		return nil
+	}
+	br.ref = br.ref[:0]
+	for _, b := range refSeq8[xb:xe] {
+		br.ref = append(br.ref, pileup.Seq8ToEnumTable[b])
+	}
+	br.query = br.query[:0]
+	for _, b := range seq8 {
+		br.query = append(br.query, pileup.Seq8ToEnumTable[b])
+	}
+	br.glocal(br.ref, br.query, qual, bw)
+
+	// A base keeps min(qual, BAQ) if it is aligned to the same position as
+	// in the CIGAR, and gets 0 otherwise; clipped and inserted bases are
+	// unchanged.
+	bq := append([]byte(nil), qual...)
+	x, y = pos, 0
+	for _, co := range cigar {
+		l := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			for i := y; i < y+l; i++ {
+				if (br.state[i]&3 != 0) || (br.state[i]>>2 != x-xb+(i-y)) {
+					bq[i] = 0
+				} else if br.q[i] < bq[i] {
+					bq[i] = br.q[i]
+				}
+			}
+			x += l
+			y += l
+		case sam.CigarSoftClipped, sam.CigarInsertion:
+			y += l
+		case sam.CigarDeletion:
+			x += l
+		}
+	}
+	return bq
+}
+
+// glocal computes br.state and br.q for the alignment of query to ref, both
+// in pileup.BaseA..BaseX encoding, with the given band width: query is
+// aligned from end to end, within ref.  This is probaln_glocal() of htslib,
+// with the same scaling of the forward and backward matrices.
+func (br *baqRealigner) glocal(ref, query, iqual []byte, bw int) {
+	lRef, lQuery := len(ref), len(query)
+	if lRef > lQuery {
+		bw = min(bw, lRef)
+	} else {
+		bw = min(bw, lQuery)
+	}
+	if d := abs(lRef - lQuery); bw < d {
+		bw = d
+	}
+	w := 3*(2*bw+1) + 6
+	br.f = resizeFloats(br.f, (lQuery+1)*w)
+	br.b = resizeFloats(br.b, (lQuery+1)*w)
+	br.s = resizeFloats(br.s, lQuery+2)
+	f, b, s := br.f, br.b, br.s
+	row := func(m []float64, i int) []float64 { return m[i*w : (i+1)*w] }
+	// setU returns the offset of reference position k (1-based) in row i.
+	setU := func(i, k int) int {
+		x := i - bw
+		if x < 0 {
+			x = 0
+		}
+		return (k - x + 1) * 3
+	}
+	// emit returns the emission probability of query base i at reference
+	// position k (both 1-based).
+	emit := func(k, i int) float64 {
+		r, q := ref[k-1], query[i-1]
+		switch {
+		case (r > pileup.BaseT) || (q > pileup.BaseT):
+			return 1
+		case r == q:
+			return 1 - baqQualToProb[iqual[i-1]]
+		}
+		return baqQualToProb[iqual[i-1]] * baqEM
+	}
+	band := func(i int) (beg, end int) {
+		beg, end = 1, lRef
+		if i-bw > beg {
+			beg = i - bw
+		}
+		if i+bw < end {
+			end = i + bw
+		}
+		return
+	}
+
+	sM := 1 / float64(2*lQuery+2)
+	sI := sM
+	d, e := baqGapOpen, baqGapExtend
+	m := [9]float64{
+		(1 - d - d) * (1 - sM), d * (1 - sM), d * (1 - sM),
+		(1 - e) * (1 - sI), e * (1 - sI), 0,
+		1 - e, 0, e,
+	}
+	bM := (1 - d) / float64(lRef)
+	bI := d / float64(lRef)
+
+	// Forward.
+	f[setU(0, 0)] = 1
+	s[0] = 1
+	{
+		fi := row(f, 1)
+		end := min(lRef, bw+1)
+		var sum float64
+		for k := 1; k <= end; k++ {
+			u := setU(1, k)
+			fi[u] = emit(k, 1) * bM
+			fi[u+1] = baqEI * bI
+			sum += fi[u] + fi[u+1]
+		}
+		s[1] = sum
+		for k := setU(1, 1); k <= setU(1, end)+2; k++ {
+			fi[k] /= sum
+		}
+	}
+	for i := 2; i <= lQuery; i++ {
+		fi, fi1 := row(f, i), row(f, i-1)
+		beg, end := band(i)
+		var sum float64
+		for k := beg; k <= end; k++ {
+			u, v11, v10, v01 := setU(i, k), setU(i-1, k-1), setU(i-1, k), setU(i, k-1)
+			fi[u] = emit(k, i) * (m[0]*fi1[v11] + m[3]*fi1[v11+1] + m[6]*fi1[v11+2])
+			fi[u+1] = baqEI * (m[1]*fi1[v10] + m[4]*fi1[v10+1])
+			fi[u+2] = m[2]*fi[v01] + m[8]*fi[v01+2]
+			sum += fi[u] + fi[u+1] + fi[u+2]
+		}
+		s[i] = sum
+		for k := setU(i, beg); k <= setU(i, end)+2; k++ {
+			fi[k] /= sum
+		}
+	}
+	{
+		fl := row(f, lQuery)
+		var sum float64
+		for k := 1; k <= lRef; k++ {
+			u := setU(lQuery, k)
+			if (u < 3) || (u >= w-3) {
+				continue
+			}
+			sum += fl[u]*sM + fl[u+1]*sI
+		}
+		s[lQuery+1] = sum
+	}
+
+	// Backward.
+	{
+		bl := row(b, lQuery)
+		for k := 1; k <= lRef; k++ {
+			u := setU(lQuery, k)
+			if (u < 3) || (u >= w-3) {
+				continue
+			}
+			bl[u] = sM / s[lQuery] / s[lQuery+1]
+			bl[u+1] = sI / s[lQuery] / s[lQuery+1]
+		}
+	}
+	for i := lQuery - 1; i >= 1; i-- {
+		bi, bi1 := row(b, i), row(b, i+1)
+		beg, end := band(i)
+		y := 0.0
+		if i > 1 {
+			y = 1
+		}
+		for k := end; k >= beg; k-- {
+			u, v11, v10, v01 := setU(i, k), setU(i+1, k+1), setU(i+1, k), setU(i, k+1)
+			var e float64
+			if k < lRef {
+				e = emit(k+1, i+1) * bi1[v11]
+			}
+			bi[u] = e*m[0] + baqEI*m[1]*bi1[v10+1] + m[2]*bi[v01+2]
+			bi[u+1] = e*m[3] + baqEI*m[4]*bi1[v10+1]
+			bi[u+2] = (e*m[6] + m[8]*bi[v01+2]) * y
+		}
+		for k := setU(i, beg); k <= setU(i, end)+2; k++ {
+			bi[k] /= s[i]
+		}
+	}
+
+	// Maximum a posteriori states.
+	if cap(br.state) < lQuery {
+		br.state = make([]int, lQuery)
+		br.q = make([]byte, lQuery)
+	}
+	br.state, br.q = br.state[:lQuery], br.q[:lQuery]
+	for i := 1; i <= lQuery; i++ {
+		fi, bi := row(f, i), row(b, i)
+		beg, end := band(i)
+		var sum, max float64
+		maxK := -1
+		for k := beg; k <= end; k++ {
+			u := setU(i, k)
+			if z := fi[u] * bi[u]; z > max {
+				max, maxK = z, (k-1)<<2
+			}
+			sum += fi[u] * bi[u]
+			if z := fi[u+1] * bi[u+1]; z > max {
+				max, maxK = z, (k-1)<<2|1
+			}
+			sum += fi[u+1] * bi[u+1]
+		}
+		br.state[i-1] = maxK
+		br.q[i-1] = 0
+		if sum == 0 {
+			continue
+		}
+		if p := 1 - max/sum; p <= 0 {
+			br.q[i-1] = 99
+		} else if q := int(-4.343*math.Log(p) + .499); q > 100 {
+			br.q[i-1] = 99
+		} else {
+			br.q[i-1] = byte(q)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+// baqTestRef has a T homopolymer at [33, 40).
+const baqTestRef = "GATCGGAAGAGCACACGTCTGAACTCCAGTCACTTTTTTTGCATGACGTAGCTAGCTGACCTGACTGATCGATCGATGCTAGCTAGCA"
+
+func baqTestSeq8(s string) []byte {
+	b := make([]byte, len(s))
+	biosimd.ASCIIToSeq8(b, []byte(s))
+	return b
+}
+
+func baqTestQual(n int, q byte) []byte {
+	qual := make([]byte, n)
+	for i := range qual {
+		qual[i] = q
+	}
+	return qual
+}
+
+func TestBAQRealign(t *testing.T) {
+	var br baqRealigner
+	refSeq8 := baqTestSeq8(baqTestRef)
+	m := func(n int) sam.CigarOp { return sam.NewCigarOp(sam.CigarMatch, n) }
+
+	// A read which matches the reference keeps its qualities, including its
+	// soft-clipped bases, at the ends of the reference too.
+	read := baqTestRef[10:50]
+	qual := baqTestQual(40, 30)
+	assert.EQ(t, br.realign(sam.Cigar{m(40)}, 10, baqTestSeq8(read), qual, refSeq8), qual)
+	assert.EQ(t, br.realign(sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 5), m(35)}, 15, baqTestSeq8(read), qual, refSeq8), qual)
+	n := len(baqTestRef)
+	assert.EQ(t, br.realign(sam.Cigar{m(20)}, 0, baqTestSeq8(baqTestRef[:20]), qual[:20], refSeq8), qual[:20])
+	assert.EQ(t, br.realign(sam.Cigar{m(20)}, n-20, baqTestSeq8(baqTestRef[n-20:]), qual[:20], refSeq8), qual[:20])
+
+	// The read has a T deleted from the homopolymer, but is aligned without
+	// the deletion: the bases after the homopolymer start are misaligned.
+	read = baqTestRef[10:33] + baqTestRef[34:51]
+	baq := br.realign(sam.Cigar{m(40)}, 10, baqTestSeq8(read), qual, refSeq8)
+	assert.EQ(t, baq[:23], qual[:23])
+	assert.EQ(t, baq[23:26], []byte{8, 5, 4})
+	assert.EQ(t, baq[26:], make([]byte, 14))
+	// With the deletion in the CIGAR, only the bases next to the
+	// homopolymer, where the deletion could also be placed, are uncertain.
+	baq = br.realign(sam.Cigar{m(23), sam.NewCigarOp(sam.CigarDeletion, 1), m(17)}, 10, baqTestSeq8(read), qual, refSeq8)
+	assert.EQ(t, baq[:23], qual[:23])
+	assert.EQ(t, baq[23:29], []byte{0, 0, 0, 4, 5, 8})
+	assert.EQ(t, baq[29:], qual[29:])
+
+	// Reads with a reference skip are left alone.
+	assert.True(t, br.realign(sam.Cigar{m(20), sam.NewCigarOp(sam.CigarSkipped, 5), m(20)}, 10, baqTestSeq8(read), qual, refSeq8) == nil)
+}
+
+func TestBAQApply(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", len(baqTestRef), nil, nil)
+	assert.NoError(t, err)
+	refSeq8 := baqTestSeq8(baqTestRef)
+	var br baqRealigner
+
+	read := baqTestRef[10:33] + baqTestRef[34:51]
+	qual := baqTestQual(40, 30)
+	r := &sam.Record{Name: "r", Ref: ref, Pos: 10, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 40)}, Seq: sam.NewSeq([]byte(read)), Qual: qual}
+	br.apply(r, refSeq8)
+	assert.EQ(t, r.Qual[22:27], []byte{30, 8, 5, 4, 0})
+	// The original qualities aren't modified.
+	assert.EQ(t, qual, baqTestQual(40, 30))
+
+	// A BQ tag is used instead of the realignment.
+	bq, err := sam.NewAux(bqTag, "@J~")
+	assert.NoError(t, err)
+	r = &sam.Record{Name: "r", Ref: ref, Pos: 10, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 3)}, Seq: sam.NewSeq([]byte("ACA")), Qual: []byte{30, 30, 30}, AuxFields: sam.AuxFields{bq}}
+	br.apply(r, refSeq8)
+	assert.EQ(t, r.Qual, []byte{30, 20, 0})
+}
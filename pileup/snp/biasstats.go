@@ -0,0 +1,181 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math"
+	"sort"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+)
+
+// biasStats are the strand- and position-bias statistics of an ALT allele,
+// computed from the per-read features of the REF- and ALT-supporting reads.
+// They follow the definitions of the GATK annotations of the same names.
+// Statistics which can't be computed (e.g. rank sums when there are no
+// REF-supporting reads) are NaN.
+type biasStats struct {
+	// fs is the Phred-scaled p-value of Fisher's exact test for association
+	// between allele and strand.  Reads with an unknown strand are ignored.
+	fs float64
+	// readPosRankSum is the z-score of the Mann-Whitney U test comparing the
+	// distances of the ALT and REF bases from the nearest read end; negative
+	// values mean that the ALT bases are closer to the ends.
+	readPosRankSum float64
+	// baseQRankSum is the z-score of the Mann-Whitney U test comparing the
+	// base qualities of the ALT and REF bases.
+	baseQRankSum float64
+}
+
+// biasStatsEmpty is written in place of the biasstats column set where the
+// statistics aren't defined (ALT=N and indel lines).
+var biasStatsEmpty = []byte(".\t.\t.\t")
+
+func computeBiasStats(ref, alt []perReadFeatures) biasStats {
+	var strandCounts [2][2]int
+	for i, features := range [2][]perReadFeatures{ref, alt} {
+		for _, f := range features {
+			switch pileup.StrandType(f.strand) {
+			case pileup.StrandFwd:
+				strandCounts[i][0]++
+			case pileup.StrandRev:
+				strandCounts[i][1]++
+			}
+		}
+	}
+	readPos := func(f perReadFeatures) int {
+		dist3p := int(f.fraglen) - 1 - int(f.dist5p)
+		if dist3p < int(f.dist5p) {
+			return dist3p
+		}
+		return int(f.dist5p)
+	}
+	qual := func(f perReadFeatures) int { return int(f.qual) }
+	return biasStats{
+		fs:             fisherStrandPhred(strandCounts),
+		readPosRankSum: rankSumZ(ref, alt, readPos),
+		baseQRankSum:   rankSumZ(ref, alt, qual),
+	}
+}
+
+func logChoose(n, k int) float64 {
+	a, _ := math.Lgamma(float64(n + 1))
+	b, _ := math.Lgamma(float64(k + 1))
+	c, _ := math.Lgamma(float64(n - k + 1))
+	return a - b - c
+}
+
+// fisherStrandPhred returns the Phred-scaled two-sided p-value of Fisher's
+// exact test on the 2x2 table counts[allele][strand].  The p-value is summed
+// in log space, so that high-depth tables don't underflow to FS=Inf.
+func fisherStrandPhred(counts [2][2]int) float64 {
+	row0 := counts[0][0] + counts[0][1]
+	col0 := counts[0][0] + counts[1][0]
+	n := row0 + counts[1][0] + counts[1][1]
+	if n == 0 {
+		return math.NaN()
+	}
+	logDenom := logChoose(n, col0)
+	logProb := func(a int) float64 {
+		return logChoose(row0, a) + logChoose(n-row0, col0-a) - logDenom
+	}
+	lo := col0 - (n - row0)
+	if lo < 0 {
+		lo = 0
+	}
+	hi := row0
+	if col0 < hi {
+		hi = col0
+	}
+	logObs := logProb(counts[0][0])
+	// Tables as extreme as the observed one are those at most as likely, up to
+	// rounding error.
+	const relTol = 1e-7
+	sum := 0.0
+	for a := lo; a <= hi; a++ {
+		if lp := logProb(a); lp <= logObs+relTol {
+			sum += math.Exp(lp - logObs)
+		}
+	}
+	logP := logObs + math.Log(sum)
+	if logP >= 0 {
+		// Avoid writing -0.000.
+		return 0
+	}
+	return -10 * logP / math.Ln10
+}
+
+// rankSumZ returns the z-score of the Mann-Whitney U test comparing
+// value(alt) against value(ref), using the normal approximation with a tie
+// correction.  It returns NaN if either group is empty.
+func rankSumZ(ref, alt []perReadFeatures, value func(perReadFeatures) int) float64 {
+	nRef, nAlt := len(ref), len(alt)
+	if (nRef == 0) || (nAlt == 0) {
+		return math.NaN()
+	}
+	type item struct {
+		v   int
+		alt bool
+	}
+	items := make([]item, 0, nRef+nAlt)
+	for _, f := range ref {
+		items = append(items, item{v: value(f)})
+	}
+	for _, f := range alt {
+		items = append(items, item{v: value(f), alt: true})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].v < items[j].v })
+
+	// altRankSum is the sum of the (1-based, tie-averaged) ranks of the ALT
+	// values, and tieSum is sum(t^3 - t) over the tie groups.
+	altRankSum, tieSum := 0.0, 0.0
+	for i := 0; i < len(items); {
+		j := i + 1
+		for (j < len(items)) && (items[j].v == items[i].v) {
+			j++
+		}
+		rank := float64(i+1+j) / 2
+		for _, it := range items[i:j] {
+			if it.alt {
+				altRankSum += rank
+			}
+		}
+		t := float64(j - i)
+		tieSum += t*t*t - t
+		i = j
+	}
+	n := float64(nRef + nAlt)
+	u := altRankSum - float64(nAlt)*float64(nAlt+1)/2
+	mu := float64(nRef) * float64(nAlt) / 2
+	variance := float64(nRef) * float64(nAlt) / 12 * ((n + 1) - tieSum/(n*(n-1)))
+	if variance <= 0 {
+		// All values are equal.
+		return 0
+	}
+	return (u - mu) / math.Sqrt(variance)
+}
+
+// writeBiasStatsCols writes the biasstats column set (FS, READ_POS_RANK_SUM,
+// and BASE_Q_RANK_SUM) for an ALT allele, with '.' for undefined statistics.
+func writeBiasStatsCols(w *tsv.Writer, ref, alt []perReadFeatures) {
+	s := computeBiasStats(ref, alt)
+	for _, v := range []float64{s.fs, s.readPosRankSum, s.baseQRankSum} {
+		if math.IsNaN(v) {
+			w.WriteByte('.')
+		} else {
+			w.WriteFloat64(v, 'f', 3)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math"
+	"testing"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestFisherStrandPhred(t *testing.T) {
+	for _, tt := range []struct {
+		counts [2][2]int
+		want   float64
+	}{
+		{[2][2]int{{5, 5}, {5, 5}}, 0},
+		{[2][2]int{{3, 1}, {1, 3}}, 3.136},
+		{[2][2]int{{10, 0}, {0, 10}}, 49.656},
+		{[2][2]int{{0, 10}, {10, 0}}, 49.656},
+	} {
+		got := fisherStrandPhred(tt.counts)
+		assert.True(t, math.Abs(got-tt.want) < 1e-3, "counts %v: got %v, want %v", tt.counts, got, tt.want)
+	}
+	// High-depth tables don't underflow.
+	got := fisherStrandPhred([2][2]int{{5000, 0}, {0, 5000}})
+	assert.True(t, !math.IsInf(got, 0) && (got > 1000), "got %v", got)
+	assert.True(t, math.IsNaN(fisherStrandPhred([2][2]int{})))
+}
+
+func TestComputeBiasStats(t *testing.T) {
+	fwd, rev := byte(pileup.StrandFwd), byte(pileup.StrandRev)
+	ref := []perReadFeatures{
+		{dist5p: 50, fraglen: 150, qual: 10, strand: fwd},
+		{dist5p: 60, fraglen: 150, qual: 20, strand: rev},
+	}
+	alt := []perReadFeatures{
+		{dist5p: 1, fraglen: 150, qual: 30, strand: fwd},
+		{dist5p: 147, fraglen: 150, qual: 40, strand: fwd},
+		{dist5p: 2, fraglen: 150, qual: 40, strand: byte(pileup.StrandNone)},
+	}
+	s := computeBiasStats(ref, alt)
+	// The strand table is {{1, 1}, {2, 0}}, with p = 1.
+	assert.True(t, math.Abs(s.fs) < 1e-9, "fs %v", s.fs)
+	// The ALT bases are all closer to a read end (distances 1, 2, and 2 vs. 50
+	// and 60), and all have higher quality (30, 40, and 40 vs. 10 and 20).
+	// With nRef=2 and nAlt=3, U is 0 and 6 respectively, vs. a mean of 3, and
+	// the tie-corrected variance is 2*3/12*(6-6/(5*4)) = 2.85.
+	assert.True(t, math.Abs(s.readPosRankSum+3/math.Sqrt(2.85)) < 1e-9, "readPosRankSum %v", s.readPosRankSum)
+	assert.True(t, math.Abs(s.baseQRankSum-3/math.Sqrt(2.85)) < 1e-9, "baseQRankSum %v", s.baseQRankSum)
+
+	s = computeBiasStats(nil, alt)
+	assert.True(t, math.IsNaN(s.readPosRankSum) && math.IsNaN(s.baseQRankSum))
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+)
+
+// cutoffWriter is a recordio.Writer which drops the rows at and after a
+// cutoff position, once one is set.  When a job runs out of time, the rows
+// past its last processed shard would otherwise be written with incomplete
+// (or zero) counts.
+type cutoffWriter struct {
+	recordio.Writer
+	cut   bool
+	refID uint32
+	pos   uint32
+}
+
+func (w *cutoffWriter) setCutoff(c biopb.Coord) {
+	w.cut = true
+	w.refID = uint32(c.RefId)
+	w.pos = uint32(c.Pos)
+}
+
+func (w *cutoffWriter) Append(v interface{}) {
+	if w.cut {
+		pr := v.(*pileupRow)
+		if (pr.refID > w.refID) || ((pr.refID == w.refID) && (pr.pos >= w.pos)) {
+			return
+		}
+	}
+	w.Writer.Append(v)
+}
+
+// unprocessedIntervals returns the parts of bedUnion covered by the given
+// shards, as per-reference sorted endpoint slices in the usual [start, end)
+// pair layout.
+func unprocessedIntervals(unprocessed [][]gbam.Shard, refs []*sam.Reference, bedUnion *interval.BEDUnion) [][]PosType {
+	result := make([][]PosType, len(refs))
+	add := func(refID int, start, end PosType) {
+		for _, p := range bedUnion.IntersectionByID(refID, start, end) {
+			n := len(result[refID])
+			// Merge abutting intervals, which are common since consecutive
+			// shards share a boundary.
+			if (n > 0) && (n%2 == 0) && (result[refID][n-1] == p) {
+				result[refID] = result[refID][:n-1]
+				continue
+			}
+			result[refID] = append(result[refID], p)
+		}
+	}
+	for _, shards := range unprocessed {
+		for _, shard := range shards {
+			cr := gbam.ShardToCoordRange(shard)
+			startID, limitID := int(cr.Start.RefId), int(cr.Limit.RefId)
+			limitPos := PosType(cr.Limit.Pos)
+			if limitID < 0 {
+				// Unmapped reads; their end is the end of the last reference.
+				limitID = len(refs) - 1
+				limitPos = PosType(refs[limitID].Len())
+			}
+			start := PosType(cr.Start.Pos)
+			for refID := startID; refID < limitID; refID++ {
+				add(refID, start, PosType(refs[refID].Len()))
+				start = 0
+			}
+			add(limitID, start, limitPos)
+		}
+	}
+	return result
+}
+
+// writePartialReport writes <mainPath>.partial.tsv, a manifest marking the
+// output as incomplete, and <mainPath>.unprocessed.bed, listing the regions
+// that were not processed before the time budget ran out.  The latter can be
+// passed as -bed to a follow-up run (with -pad=0, since any padding has
+// already been applied).  Nothing is written if no shard was left
+// unprocessed.
+func writePartialReport(ctx context.Context, mainPath string, opts *pileupSNPOpts, nShard int, unprocessed [][]gbam.Shard, refs []*sam.Reference) (err error) {
+	nUnprocessed := 0
+	for _, shards := range unprocessed {
+		nUnprocessed += len(shards)
+	}
+	if nUnprocessed == 0 {
+		return nil
+	}
+	bedPath := mainPath + ".unprocessed.bed"
+	intervals := unprocessedIntervals(unprocessed, refs, &opts.bedUnion)
+	var nPos int64
+	if err = func() (err error) {
+		var dst file.File
+		if dst, err = file.Create(ctx, bedPath); err != nil {
+			return
+		}
+		defer file.CloseAndReport(ctx, dst, &err)
+		w := tsv.NewWriter(dst.Writer(ctx))
+		for refID, endpoints := range intervals {
+			for i := 0; i < len(endpoints); i += 2 {
+				w.WriteString(refs[refID].Name())
+				w.WriteInt64(int64(endpoints[i]))
+				w.WriteInt64(int64(endpoints[i+1]))
+				if err = w.EndLine(); err != nil {
+					return
+				}
+				nPos += int64(endpoints[i+1] - endpoints[i])
+			}
+		}
+		return w.Flush()
+	}(); err != nil {
+		return
+	}
+
+	path := mainPath + ".partial.tsv"
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#KEY\tVALUE")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	for _, kv := range [][2]string{
+		{"status", "partial"},
+		{"time_budget", opts.timeBudget.String()},
+		{"shards_total", strconv.Itoa(nShard)},
+		{"shards_unprocessed", strconv.Itoa(nUnprocessed)},
+		{"positions_unprocessed", strconv.FormatInt(nPos, 10)},
+		{"unprocessed_bed", bedPath},
+	} {
+		w.WriteString(kv[0])
+		w.WriteString(kv[1])
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Error.Printf("pileupSNPMain: time budget of %v exhausted with %d of %d shard(s) unprocessed; output is partial, see %s", opts.timeBudget, nUnprocessed, nShard, path)
+	return
+}
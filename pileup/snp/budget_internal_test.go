@@ -0,0 +1,78 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestWritePartialReport(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := context.Background()
+
+	chr1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	chr2, _ := sam.NewReference("chr2", "", "", 500, nil, nil)
+	refs := []*sam.Reference{chr1, chr2}
+	samHeader, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	opts := pileupSNPOpts{timeBudget: time.Hour}
+	opts.bedUnion, err = interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 100, End: 700},
+		{RefName: "chr2", Start0: 0, End: 500},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+	shards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: 600},
+		{StartRef: chr1, EndRef: chr2, Start: 600, End: 100},
+		{StartRef: chr2, EndRef: nil, Start: 100, End: 0},
+	}
+
+	// The first job completed, and the second didn't get past its first
+	// shard.
+	unprocessed := [][]gbam.Shard{nil, shards[1:]}
+	assert.EQ(t, unprocessedIntervals(unprocessed, refs, &opts.bedUnion), [][]PosType{{600, 700}, {0, 500}})
+
+	mainPath := filepath.Join(tmpdir, "out")
+	assert.NoError(t, writePartialReport(ctx, mainPath, &opts, len(shards), unprocessed, refs))
+	bed, err := ioutil.ReadFile(mainPath + ".unprocessed.bed")
+	assert.NoError(t, err)
+	assert.EQ(t, string(bed), "chr1\t600\t700\nchr2\t0\t500\n")
+	manifest, err := ioutil.ReadFile(mainPath + ".partial.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(manifest), "#KEY\tVALUE\n"+
+		"status\tpartial\n"+
+		"time_budget\t1h0m0s\n"+
+		"shards_total\t3\n"+
+		"shards_unprocessed\t2\n"+
+		"positions_unprocessed\t600\n"+
+		"unprocessed_bed\t"+mainPath+".unprocessed.bed\n")
+
+	// Nothing is written for a complete run.
+	completePath := filepath.Join(tmpdir, "complete")
+	assert.NoError(t, writePartialReport(ctx, completePath, &opts, len(shards), [][]gbam.Shard{nil, nil}, refs))
+	_, err = os.Stat(completePath + ".partial.tsv")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,98 @@
+# Code generated by gen.go. DO NOT EDIT.
+"""In-process access to the bio-pileup engine, via libbiopileup.
+
+Example:
+    import biopileup
+    res = biopileup.pileup("my.bam", "ref.fa", "chr1:1000-2000", Mapq=20)
+    for row in res.rows:
+        print(res.ref_names[row["ref_id"]], row["pos"] + 1, row["counts"])
+
+Build libbiopileup.so with
+    go build -buildmode=c-shared -o libbiopileup.so ./pileup/snp/capi
+"""
+
+import collections
+import ctypes
+import json
+import os
+
+import numpy as np
+
+# ROW_DTYPE is the layout of bio_pileup_row (see row.h).
+ROW_DTYPE = np.dtype([
+    ("ref_id", "<i4"),  # reference ID, indexing the reference names
+    ("pos", "<u4"),  # 0-based position
+    ("depth", "<u4"),  # number of reads covering the position, including low-quality bases
+    ("counts", "<u4", (5, 2)),  # [base][strand] read counts, with bases A, C, G, T, N and strands +, -
+    ("ins_counts", "<u4", (2,)),  # per-strand insertion counts (with Cols including "indels")
+    ("del_counts", "<u4", (2,)),  # per-strand deletion counts (with Cols including "indels")
+])
+
+PileupResult = collections.namedtuple("PileupResult", ["ref_names", "rows"])
+
+_lib = None
+
+
+def _load():
+    global _lib
+    if _lib is None:
+        path = os.environ.get(
+            "BIOPILEUP_LIB",
+            os.path.join(os.path.dirname(os.path.abspath(__file__)), "libbiopileup.so"))
+        lib = ctypes.CDLL(path)
+        lib.bio_pileup_query.restype = ctypes.c_int
+        lib.bio_pileup_query.argtypes = [
+            ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p,
+            ctypes.POINTER(ctypes.c_void_p), ctypes.POINTER(ctypes.c_int64),
+            ctypes.POINTER(ctypes.c_void_p), ctypes.POINTER(ctypes.c_void_p),
+        ]
+        lib.bio_pileup_free.restype = None
+        lib.bio_pileup_free.argtypes = [ctypes.c_void_p]
+        _lib = lib
+    return _lib
+
+
+def _take_string(lib, p):
+    if not p:
+        return ""
+    try:
+        return ctypes.string_at(p).decode("utf-8")
+    finally:
+        lib.bio_pileup_free(p)
+
+
+def pileup(xampath, fapath, region=None, **opts):
+    """Computes the pileup of xampath over region.
+
+    Args:
+      xampath: BAM, PAM, or CRAM path.
+      fapath: reference FASTA path.
+      region: region in the format of bio-pileup -region; if None, opts must
+        set Region or BedPath.
+      **opts: overrides of the snp.Opts fields, e.g. Mapq=20, Cols="indels".
+
+    Returns:
+      A PileupResult, whose rows are a numpy array of ROW_DTYPE in position
+      order, and whose ref_names are indexed by the rows' ref_id.
+
+    Raises:
+      RuntimeError: the pileup failed.
+    """
+    lib = _load()
+    enc = lambda s: None if s is None else s.encode("utf-8")
+    rows = ctypes.c_void_p()
+    n_rows = ctypes.c_int64()
+    ref_names = ctypes.c_void_p()
+    err = ctypes.c_void_p()
+    status = lib.bio_pileup_query(
+        enc(xampath), enc(fapath), enc(region), enc(json.dumps(opts)) if opts else None,
+        ctypes.byref(rows), ctypes.byref(n_rows), ctypes.byref(ref_names), ctypes.byref(err))
+    if status != 0:
+        raise RuntimeError(_take_string(lib, err.value))
+    try:
+        buf = ctypes.string_at(rows.value, n_rows.value * ROW_DTYPE.itemsize) if n_rows.value else b""
+        arr = np.frombuffer(buf, dtype=ROW_DTYPE).copy()
+    finally:
+        if rows.value:
+            lib.bio_pileup_free(rows.value)
+    return PileupResult(_take_string(lib, ref_names.value).split("\n"), arr)
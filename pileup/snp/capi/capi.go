@@ -0,0 +1,143 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command capi builds libbiopileup, a C shared library exposing the
+// StreamPileup query API, so that Python-based code can compute pileups
+// in-process instead of running bio-pileup and parsing its TSV output.
+//
+// Build it with
+//
+//   go build -buildmode=c-shared -o libbiopileup.so ./pileup/snp/capi
+//
+// biopileup.py is a ctypes wrapper around the library; it looks for
+// libbiopileup.so next to itself, or at $BIOPILEUP_LIB.  row.h and
+// biopileup.py are generated by gen.go from a single description of the row
+// layout; run "go generate" after changing it.
+package main
+
+//go:generate go run gen.go
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include "row.h"
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/pileup/snp"
+)
+
+// query runs StreamPileup over region, and returns its rows in position
+// order along with the names of the references, indexed by ref ID (only the
+// names of the references which have rows are filled in).
+func query(xampath, fapath, region, optsJSON string) ([]C.bio_pileup_row, []string, error) {
+	opts := snp.DefaultOpts
+	if optsJSON != "" {
+		dec := json.NewDecoder(strings.NewReader(optsJSON))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&opts); err != nil {
+			return nil, nil, fmt.Errorf("bio_pileup_query: invalid options: %v", err)
+		}
+	}
+	// Rows must come back in position order, which StreamPileup only
+	// guarantees with a single job.
+	if opts.Parallelism > 1 {
+		return nil, nil, fmt.Errorf("bio_pileup_query: invalid options: Parallelism must be 1, since rows are returned in position order")
+	}
+	opts.Parallelism = 1
+	if region != "" {
+		opts.Region = region
+	}
+	var (
+		rows     []C.bio_pileup_row
+		refNames []string
+	)
+	err := snp.StreamPileup(vcontext.Background(), xampath, fapath, &opts, nil, func(row *snp.Row) error {
+		for len(refNames) <= row.RefID {
+			refNames = append(refNames, "")
+		}
+		refNames[row.RefID] = row.RefName
+		var r C.bio_pileup_row
+		r.ref_id = C.int32_t(row.RefID)
+		r.pos = C.uint32_t(row.Pos)
+		r.depth = C.uint32_t(row.Depth)
+		// Only A, C, G, T and N are exported; the extended observation classes
+		// of Row.Counts are not part of the C row.
+		for b := range r.counts {
+			for s := range r.counts[b] {
+				r.counts[b][s] = C.uint32_t(row.Counts[b][s])
+			}
+		}
+		for s := 0; s < 2; s++ {
+			r.ins_counts[s] = C.uint32_t(row.InsCounts[s])
+			r.del_counts[s] = C.uint32_t(row.DelCounts[s])
+		}
+		rows = append(rows, r)
+		return nil
+	})
+	return rows, refNames, err
+}
+
+// bio_pileup_query computes the pileup of the BAM, PAM, or CRAM at xampath
+// over region (in the format of bio-pileup -region, or NULL to use the
+// options' Region or BedPath).  opts_json, if not NULL, is a JSON object
+// overriding fields of snp.DefaultOpts, e.g. {"Mapq": 20, "Cols": "indels"};
+// Parallelism may only be 1.
+//
+// On success, it returns 0, and sets *rows to a malloc'd array of *n_rows
+// rows, and *ref_names to a malloc'd string of the reference names indexed by
+// bio_pileup_row.ref_id, separated by newlines.  On failure, it returns -1 and
+// sets *err to a malloc'd error message.  The caller must free the returned
+// buffers with bio_pileup_free.
+//
+//export bio_pileup_query
+func bio_pileup_query(xampath, fapath, region, opts_json *C.char, rows **C.bio_pileup_row, n_rows *C.int64_t, ref_names, err **C.char) C.int {
+	*rows, *n_rows, *ref_names, *err = nil, 0, nil, nil
+	goString := func(s *C.char) string {
+		if s == nil {
+			return ""
+		}
+		return C.GoString(s)
+	}
+	goRows, names, e := query(goString(xampath), goString(fapath), goString(region), goString(opts_json))
+	if e != nil {
+		*err = C.CString(e.Error())
+		return -1
+	}
+	if len(goRows) > 0 {
+		size := C.size_t(len(goRows)) * C.sizeof_bio_pileup_row
+		*rows = (*C.bio_pileup_row)(C.malloc(size))
+		C.memcpy(unsafe.Pointer(*rows), unsafe.Pointer(&goRows[0]), size)
+	}
+	*n_rows = C.int64_t(len(goRows))
+	*ref_names = C.CString(strings.Join(names, "\n"))
+	return 0
+}
+
+// bio_pileup_free frees a buffer returned by bio_pileup_query.
+//
+//export bio_pileup_free
+func bio_pileup_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+func main() {}
@@ -0,0 +1,150 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+// writeQueryInputs writes a two-contig reference, a BED covering both
+// contigs, and a BAM (with its .gbai) containing a read pair on each contig,
+// to dir.
+func writeQueryInputs(t *testing.T, dir string) (bampath, gbaipath, bedpath, fapath string) {
+	fapath = filepath.Join(dir, "ref.fa")
+	seq := strings.Repeat("ACGT", 50)
+	assert.NoError(t, ioutil.WriteFile(fapath, []byte(">chr1\n"+seq+"\n>chr2\n"+seq+"\n"), 0600))
+	bedpath = filepath.Join(dir, "all.bed")
+	assert.NoError(t, ioutil.WriteFile(bedpath, []byte(fmt.Sprintf("chr1\t0\t%d\nchr2\t0\t%d\n", len(seq), len(seq))), 0600))
+
+	ref1, err := sam.NewReference("chr1", "", "", len(seq), nil, nil)
+	assert.NoError(t, err)
+	ref2, err := sam.NewReference("chr2", "", "", len(seq), nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref1, ref2})
+	assert.NoError(t, err)
+	pair := func(ref *sam.Reference, pos int) []*sam.Record {
+		return []*sam.Record{
+			{
+				Name:    fmt.Sprintf("%s_%d", ref.Name(), pos),
+				Ref:     ref,
+				Pos:     pos,
+				MapQ:    60,
+				Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4)},
+				Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+				MateRef: ref,
+				MatePos: pos + 10,
+				Seq:     sam.NewSeq([]byte("ACGT")),
+				Qual:    []byte{40, 40, 40, 40},
+			},
+			{
+				Name:    fmt.Sprintf("%s_%d", ref.Name(), pos),
+				Ref:     ref,
+				Pos:     pos + 10,
+				MapQ:    60,
+				Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4)},
+				Flags:   sam.Paired | sam.ProperPair | sam.Reverse | sam.Read2,
+				MateRef: ref,
+				MatePos: pos,
+				Seq:     sam.NewSeq([]byte("GTAC")),
+				Qual:    []byte{40, 40, 40, 40},
+			},
+		}
+	}
+
+	bampath = filepath.Join(dir, "in.bam")
+	out, err := os.Create(bampath)
+	assert.NoError(t, err)
+	w, err := bam.NewWriter(out, header, 1)
+	assert.NoError(t, err)
+	for _, r := range append(pair(ref1, 20), pair(ref2, 100)...) {
+		assert.NoError(t, w.Write(r))
+	}
+	assert.NoError(t, w.Close())
+	assert.NoError(t, out.Close())
+
+	gbaipath = bampath + ".gbai"
+	in, err := os.Open(bampath)
+	assert.NoError(t, err)
+	gbai, err := os.Create(gbaipath)
+	assert.NoError(t, err)
+	assert.NoError(t, gbam.WriteGIndex(gbai, in, 1024, 1))
+	assert.NoError(t, gbai.Close())
+	assert.NoError(t, in.Close())
+	return
+}
+
+func TestQuery(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	bampath, gbaipath, bedpath, fapath := writeQueryInputs(t, tmpdir)
+	optsJSON := fmt.Sprintf(`{"BamIndexPath": %q, "BedPath": %q, "MinBaseQual": 30}`, gbaipath, bedpath)
+
+	rows, refNames, err := query(bampath, fapath, "", optsJSON)
+	assert.NoError(t, err)
+	assert.EQ(t, refNames, []string{"chr1", "chr2"})
+	// Every position of the BED has a row, and the rows come back in position
+	// order.
+	assert.EQ(t, len(rows), 400)
+	for i := 1; i < len(rows); i++ {
+		prev, cur := rows[i-1], rows[i]
+		assert.True(t, (prev.ref_id < cur.ref_id) || ((prev.ref_id == cur.ref_id) && (prev.pos < cur.pos)), i)
+	}
+	assert.EQ(t, int32(rows[200].ref_id), int32(1))
+	assert.EQ(t, uint32(rows[200].pos), uint32(0))
+	// The first base of the chr1 read 1 is an A on the + strand.
+	assert.EQ(t, uint32(rows[20].pos), uint32(20))
+	assert.EQ(t, uint32(rows[20].depth), uint32(1))
+	assert.EQ(t, uint32(rows[20].counts[0][0]), uint32(1))
+	assert.EQ(t, uint32(rows[19].depth), uint32(0))
+
+	// The region argument overrides the options' region.
+	rows, refNames, err = query(bampath, fapath, "chr2:1-200", fmt.Sprintf(`{"BamIndexPath": %q, "Region": "chr1"}`, gbaipath))
+	assert.NoError(t, err)
+	assert.EQ(t, len(rows), 200)
+	assert.EQ(t, refNames[rows[0].ref_id], "chr2")
+	assert.EQ(t, uint32(rows[100].counts[0][0]), uint32(1))
+
+	// Options are applied: no base passes this quality filter.
+	rows, _, err = query(bampath, fapath, "", fmt.Sprintf(`{"BamIndexPath": %q, "BedPath": %q, "MinBaseQual": 41}`, gbaipath, bedpath))
+	assert.NoError(t, err)
+	for _, r := range rows {
+		for b := range r.counts {
+			assert.EQ(t, uint32(r.counts[b][0]+r.counts[b][1]), uint32(0))
+		}
+	}
+
+	for _, bad := range []string{
+		`{"NoSuchOption": 1}`,
+		`{"Parallelism": 4}`,
+		`{"Mapq": 20`,
+	} {
+		_, _, err = query(bampath, fapath, "", bad)
+		assert.HasSubstr(t, err.Error(), "bio_pileup_query: invalid options", bad)
+	}
+	// A single job is accepted.
+	rows, _, err = query(bampath, fapath, "", fmt.Sprintf(`{"BamIndexPath": %q, "BedPath": %q, "Parallelism": 1}`, gbaipath, bedpath))
+	assert.NoError(t, err)
+	assert.EQ(t, len(rows), 400)
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build ignore
+
+// gen.go generates row.h and biopileup.py, which must agree on the layout of
+// bio_pileup_row.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// rowField is a bio_pileup_row field: a scalar, or an array with the given
+// dimensions.  All fields are 4 bytes wide, so the struct has no padding.
+type rowField struct {
+	name   string
+	signed bool
+	dims   []int
+	doc    string
+}
+
+var rowFields = []rowField{
+	{name: "ref_id", signed: true, doc: "reference ID, indexing the reference names"},
+	{name: "pos", doc: "0-based position"},
+	{name: "depth", doc: "number of reads covering the position, including low-quality bases"},
+	{name: "counts", dims: []int{5, 2}, doc: "[base][strand] read counts, with bases A, C, G, T, N and strands +, -"},
+	{name: "ins_counts", dims: []int{2}, doc: "per-strand insertion counts (with Cols including \"indels\")"},
+	{name: "del_counts", dims: []int{2}, doc: "per-strand deletion counts (with Cols including \"indels\")"},
+}
+
+const generatedComment = "Code generated by gen.go. DO NOT EDIT."
+
+func genHeader() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n\n", generatedComment)
+	b.WriteString("#ifndef BIO_PILEUP_ROW_H\n#define BIO_PILEUP_ROW_H\n\n#include <stdint.h>\n\n")
+	b.WriteString("// bio_pileup_row is the pileup of a single position.\ntypedef struct {\n")
+	for _, f := range rowFields {
+		typ := "uint32_t"
+		if f.signed {
+			typ = "int32_t"
+		}
+		var dims string
+		for _, d := range f.dims {
+			dims += fmt.Sprintf("[%d]", d)
+		}
+		fmt.Fprintf(&b, "  // %s\n  %s %s%s;\n", f.doc, typ, f.name, dims)
+	}
+	b.WriteString("} bio_pileup_row;\n\n#endif  // BIO_PILEUP_ROW_H\n")
+	return b.Bytes()
+}
+
+func genPython() []byte {
+	var dtype []string
+	for _, f := range rowFields {
+		typ := "<u4"
+		if f.signed {
+			typ = "<i4"
+		}
+		if len(f.dims) == 0 {
+			dtype = append(dtype, fmt.Sprintf("    (%q, %q),  # %s", f.name, typ, f.doc))
+			continue
+		}
+		var dims []string
+		for _, d := range f.dims {
+			dims = append(dims, fmt.Sprint(d))
+		}
+		shape := strings.Join(dims, ", ")
+		if len(dims) == 1 {
+			shape += ","
+		}
+		dtype = append(dtype, fmt.Sprintf("    (%q, %q, (%s)),  # %s", f.name, typ, shape, f.doc))
+	}
+	return []byte(fmt.Sprintf(pythonTemplate, generatedComment, strings.Join(dtype, "\n")))
+}
+
+const pythonTemplate = `# %s
+"""In-process access to the bio-pileup engine, via libbiopileup.
+
+Example:
+    import biopileup
+    res = biopileup.pileup("my.bam", "ref.fa", "chr1:1000-2000", Mapq=20)
+    for row in res.rows:
+        print(res.ref_names[row["ref_id"]], row["pos"] + 1, row["counts"])
+
+Build libbiopileup.so with
+    go build -buildmode=c-shared -o libbiopileup.so ./pileup/snp/capi
+"""
+
+import collections
+import ctypes
+import json
+import os
+
+import numpy as np
+
+# ROW_DTYPE is the layout of bio_pileup_row (see row.h).
+ROW_DTYPE = np.dtype([
+%s
+])
+
+PileupResult = collections.namedtuple("PileupResult", ["ref_names", "rows"])
+
+_lib = None
+
+
+def _load():
+    global _lib
+    if _lib is None:
+        path = os.environ.get(
+            "BIOPILEUP_LIB",
+            os.path.join(os.path.dirname(os.path.abspath(__file__)), "libbiopileup.so"))
+        lib = ctypes.CDLL(path)
+        lib.bio_pileup_query.restype = ctypes.c_int
+        lib.bio_pileup_query.argtypes = [
+            ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p,
+            ctypes.POINTER(ctypes.c_void_p), ctypes.POINTER(ctypes.c_int64),
+            ctypes.POINTER(ctypes.c_void_p), ctypes.POINTER(ctypes.c_void_p),
+        ]
+        lib.bio_pileup_free.restype = None
+        lib.bio_pileup_free.argtypes = [ctypes.c_void_p]
+        _lib = lib
+    return _lib
+
+
+def _take_string(lib, p):
+    if not p:
+        return ""
+    try:
+        return ctypes.string_at(p).decode("utf-8")
+    finally:
+        lib.bio_pileup_free(p)
+
+
+def pileup(xampath, fapath, region=None, **opts):
+    """Computes the pileup of xampath over region.
+
+    Args:
+      xampath: BAM, PAM, or CRAM path.
+      fapath: reference FASTA path.
+      region: region in the format of bio-pileup -region; if None, opts must
+        set Region or BedPath.
+      **opts: overrides of the snp.Opts fields, e.g. Mapq=20, Cols="indels".
+
+    Returns:
+      A PileupResult, whose rows are a numpy array of ROW_DTYPE in position
+      order, and whose ref_names are indexed by the rows' ref_id.
+
+    Raises:
+      RuntimeError: the pileup failed.
+    """
+    lib = _load()
+    enc = lambda s: None if s is None else s.encode("utf-8")
+    rows = ctypes.c_void_p()
+    n_rows = ctypes.c_int64()
+    ref_names = ctypes.c_void_p()
+    err = ctypes.c_void_p()
+    status = lib.bio_pileup_query(
+        enc(xampath), enc(fapath), enc(region), enc(json.dumps(opts)) if opts else None,
+        ctypes.byref(rows), ctypes.byref(n_rows), ctypes.byref(ref_names), ctypes.byref(err))
+    if status != 0:
+        raise RuntimeError(_take_string(lib, err.value))
+    try:
+        buf = ctypes.string_at(rows.value, n_rows.value * ROW_DTYPE.itemsize) if n_rows.value else b""
+        arr = np.frombuffer(buf, dtype=ROW_DTYPE).copy()
+    finally:
+        if rows.value:
+            lib.bio_pileup_free(rows.value)
+    return PileupResult(_take_string(lib, ref_names.value).split("\n"), arr)
+`
+
+func main() {
+	if err := ioutil.WriteFile("row.h", genHeader(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("biopileup.py", genPython(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
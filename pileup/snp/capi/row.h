@@ -0,0 +1,24 @@
+// Code generated by gen.go. DO NOT EDIT.
+
+#ifndef BIO_PILEUP_ROW_H
+#define BIO_PILEUP_ROW_H
+
+#include <stdint.h>
+
+// bio_pileup_row is the pileup of a single position.
+typedef struct {
+  // reference ID, indexing the reference names
+  int32_t ref_id;
+  // 0-based position
+  uint32_t pos;
+  // number of reads covering the position, including low-quality bases
+  uint32_t depth;
+  // [base][strand] read counts, with bases A, C, G, T, N and strands +, -
+  uint32_t counts[5][2];
+  // per-strand insertion counts (with Cols including "indels")
+  uint32_t ins_counts[2];
+  // per-strand deletion counts (with Cols including "indels")
+  uint32_t del_counts[2];
+} bio_pileup_row;
+
+#endif  // BIO_PILEUP_ROW_H
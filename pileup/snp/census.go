@@ -0,0 +1,354 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/hts/sam"
+)
+
+// readPolicy is what happens to the reads in a census bucket.
+type readPolicy int
+
+const (
+	// policyKeep treats the reads like any other read; in particular, they
+	// are still subject to -mapq and the other filters.
+	policyKeep readPolicy = iota
+	// policyDrop leaves the reads out of the pileup.
+	policyDrop
+	// policyError fails the run.
+	policyError
+)
+
+var readPolicyNameMap = map[string]readPolicy{
+	"keep":  policyKeep,
+	"drop":  policyDrop,
+	"error": policyError,
+}
+
+// Census buckets.  A read can be in both the mate-unmapped and zero-MAPQ
+// buckets; an unmapped read is only in the unmapped bucket.
+const (
+	censusUnmapped = iota
+	censusMateUnmapped
+	censusZeroMapq
+	nCensusBucket
+)
+
+var censusBucketNames = [nCensusBucket]string{"UNMAPPED", "MATE_UNMAPPED", "ZERO_MAPQ"}
+
+// parseReadPolicy parses a policy name.  "" selects def.
+func parseReadPolicy(s string, def readPolicy) (readPolicy, error) {
+	if s == "" {
+		return def, nil
+	}
+	p, ok := readPolicyNameMap[s]
+	if !ok {
+		return 0, fmt.Errorf("Pileup: unknown read policy %q (must be keep, drop, or error)", s)
+	}
+	return p, nil
+}
+
+// parseReadPolicies parses the UnmappedReads, MateUnmappedReads and
+// ZeroMapqReads arguments.
+func parseReadPolicies(rawOpts *Opts) (policies [nCensusBucket]readPolicy, err error) {
+	for bucket, p := range []struct {
+		value string
+		def   readPolicy
+	}{
+		censusUnmapped:     {rawOpts.UnmappedReads, policyDrop},
+		censusMateUnmapped: {rawOpts.MateUnmappedReads, policyKeep},
+		censusZeroMapq:     {rawOpts.ZeroMapqReads, policyKeep},
+	} {
+		if policies[bucket], err = parseReadPolicy(p.value, p.def); err != nil {
+			return
+		}
+	}
+	// The pileup only uses the aligned bases of a read, and the later
+	// empty-CIGAR and MAPQ filters would drop the unmapped reads anyway.
+	if policies[censusUnmapped] == policyKeep {
+		err = fmt.Errorf("Pileup: invalid unmapped-reads= argument: unmapped reads can't be kept (must be drop or error)")
+	}
+	return
+}
+
+// nLengthBin is the number of bins of the length histograms.  Bin 0 holds
+// zero lengths, and bin k > 0 holds lengths in [2^(k-1), 2^k); the last bin
+// also holds everything longer.
+const nLengthBin = 24
+
+// readLengthStats describes the aligned and soft-clip lengths of the mapped
+// reads of a reference.  The aligned length of a read is the number of its
+// bases in M, = and X CIGAR operations; its soft-clip length is the number in
+// S operations.
+type readLengthStats struct {
+	Reads        int64             `json:"reads"`
+	Clipped      int64             `json:"clipped"` // reads with any soft clip
+	AlignedBases int64             `json:"aligned_bases"`
+	ClippedBases int64             `json:"clipped_bases"`
+	Aligned      [nLengthBin]int64 `json:"aligned"`
+	SoftClip     [nLengthBin]int64 `json:"soft_clip"`
+}
+
+// lengthBin returns the histogram bin of length n.
+func lengthBin(n int) int {
+	if b := bits.Len(uint(n)); b < nLengthBin {
+		return b
+	}
+	return nLengthBin - 1
+}
+
+func (s *readLengthStats) add(r *sam.Record) {
+	var aligned, clipped int
+	for _, op := range r.Cigar {
+		switch op.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			aligned += op.Len()
+		case sam.CigarSoftClipped:
+			clipped += op.Len()
+		}
+	}
+	s.Reads++
+	if clipped > 0 {
+		s.Clipped++
+	}
+	s.AlignedBases += int64(aligned)
+	s.ClippedBases += int64(clipped)
+	s.Aligned[lengthBin(aligned)]++
+	s.SoftClip[lengthBin(clipped)]++
+}
+
+func (s *readLengthStats) merge(other *readLengthStats) {
+	s.Reads += other.Reads
+	s.Clipped += other.Clipped
+	s.AlignedBases += other.AlignedBases
+	s.ClippedBases += other.ClippedBases
+	for i := range s.Aligned {
+		s.Aligned[i] += other.Aligned[i]
+		s.SoftClip[i] += other.SoftClip[i]
+	}
+}
+
+// readCensus counts the reads in each census bucket, by reference, and
+// collects the length distributions of the mapped reads.
+type readCensus struct {
+	mu      sync.Mutex
+	counts  [][nCensusBucket]int64
+	lengths []readLengthStats
+}
+
+func newReadCensus(nRef int) *readCensus {
+	return &readCensus{
+		counts:  make([][nCensusBucket]int64, nRef),
+		lengths: make([]readLengthStats, nRef),
+	}
+}
+
+// merge adds the counts of other to c.  It may be called concurrently.
+func (c *readCensus) merge(other *readCensus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range other.counts {
+		for j, n := range other.counts[i] {
+			c.counts[i][j] += n
+		}
+	}
+	// other.lengths is empty for checkpoints written before the length
+	// distributions were added.
+	for i := range other.lengths {
+		c.lengths[i].merge(&other.lengths[i])
+	}
+}
+
+// applyReadPolicies counts r in census if it is in shardRange (so that reads
+// in the padding between shards are only counted once), and applies
+// policies.  It returns true if r should be dropped.  The lengths of mapped
+// reads are counted regardless of the policies.
+func applyReadPolicies(r *sam.Record, policies *[nCensusBucket]readPolicy, census *readCensus, shardRange *biopb.CoordRange) (drop bool, err error) {
+	var inBucket [nCensusBucket]bool
+	if r.Flags&sam.Unmapped != 0 {
+		inBucket[censusUnmapped] = true
+	} else {
+		inBucket[censusMateUnmapped] = (r.Flags&(sam.Paired|sam.MateUnmapped) == (sam.Paired | sam.MateUnmapped))
+		inBucket[censusZeroMapq] = (r.MapQ == 0)
+	}
+	counted := inShard(r, shardRange)
+	if counted && !inBucket[censusUnmapped] {
+		census.lengths[r.Ref.ID()].add(r)
+	}
+	for bucket, in := range inBucket {
+		if !in {
+			continue
+		}
+		if counted {
+			census.counts[r.Ref.ID()][bucket]++
+		}
+		switch policies[bucket] {
+		case policyDrop:
+			drop = true
+		case policyError:
+			return true, fmt.Errorf("pileupMutable.processShard: read %s at %s:%d is in the %s bucket, whose policy is error", r.Name, r.Ref.Name(), r.Pos, censusBucketNames[bucket])
+		}
+	}
+	return drop, nil
+}
+
+// writeReadCensus writes the census to <mainPath>.read_census.tsv, with one
+// line per reference with any counted reads.
+func writeReadCensus(ctx context.Context, mainPath string, census *readCensus, refs []*sam.Reference) (err error) {
+	path := mainPath + ".read_census.tsv"
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#CHROM")
+	for _, name := range censusBucketNames {
+		w.WriteString(name)
+	}
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	var totals [nCensusBucket]int64
+	for refID, counts := range census.counts {
+		if counts == ([nCensusBucket]int64{}) {
+			continue
+		}
+		w.WriteString(refs[refID].Name())
+		for bucket, n := range counts {
+			w.WriteInt64(n)
+			totals[bucket] += n
+		}
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("pileupSNPMain: read census: %d unmapped, %d mate-unmapped, %d zero-MAPQ; see %s", totals[censusUnmapped], totals[censusMateUnmapped], totals[censusZeroMapq], path)
+	return
+}
+
+const (
+	// minUnusualReads is the minimum number of mapped reads of a reference for
+	// its length distributions to be checked.
+	minUnusualReads = 1000
+	// A reference is unusual if its fraction of soft-clipped reads is more
+	// than unusualClipRatio times the overall fraction, and more than
+	// unusualClipMargin above it ...
+	unusualClipRatio  = 2
+	unusualClipMargin = 0.05
+	// ... or if its mean aligned length is less than unusualAlignedRatio times
+	// the overall mean.
+	unusualAlignedRatio = 0.5
+)
+
+// formatLengthHist formats h as comma-separated counts, without the trailing
+// zero bins.
+func formatLengthHist(h *[nLengthBin]int64) string {
+	n := len(h)
+	for n > 1 && h[n-1] == 0 {
+		n--
+	}
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatInt(h[i], 10))
+	}
+	return sb.String()
+}
+
+// writeReadLengths writes the length distributions of census to
+// <mainPath>.read_lengths.tsv, with one line per reference with any mapped
+// reads.  The UNUSUAL column is 1 for the references whose distributions
+// differ markedly from the overall ones (e.g. a viral integration target
+// where most reads are split), and 0 otherwise; those references are also
+// logged.  The *_HIST columns hold the comma-separated counts of the length
+// bins, where bin 0 holds zero lengths and bin k > 0 holds lengths in
+// [2^(k-1), 2^k).
+func writeReadLengths(ctx context.Context, mainPath string, census *readCensus, refs []*sam.Reference) (err error) {
+	path := mainPath + ".read_lengths.tsv"
+	var total readLengthStats
+	for refID := range census.lengths {
+		total.merge(&census.lengths[refID])
+	}
+	if total.Reads == 0 {
+		return
+	}
+	totalClipFrac := float64(total.Clipped) / float64(total.Reads)
+	totalMeanAligned := float64(total.AlignedBases) / float64(total.Reads)
+
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	for _, col := range []string{"#CHROM", "READS", "MEAN_ALIGNED_LEN", "MEAN_SOFT_CLIP_LEN", "SOFT_CLIPPED_FRAC", "UNUSUAL", "ALIGNED_LEN_HIST", "SOFT_CLIP_LEN_HIST"} {
+		w.WriteString(col)
+	}
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	var unusual []string
+	for refID := range census.lengths {
+		s := &census.lengths[refID]
+		if s.Reads == 0 {
+			continue
+		}
+		clipFrac := float64(s.Clipped) / float64(s.Reads)
+		meanAligned := float64(s.AlignedBases) / float64(s.Reads)
+		isUnusual := s.Reads >= minUnusualReads &&
+			((clipFrac > unusualClipRatio*totalClipFrac && clipFrac > totalClipFrac+unusualClipMargin) ||
+				meanAligned < unusualAlignedRatio*totalMeanAligned)
+		w.WriteString(refs[refID].Name())
+		w.WriteInt64(s.Reads)
+		w.WriteFloat64(meanAligned, 'f', 2)
+		w.WriteFloat64(float64(s.ClippedBases)/float64(s.Reads), 'f', 2)
+		w.WriteFloat64(clipFrac, 'f', 4)
+		if isUnusual {
+			w.WriteString("1")
+			unusual = append(unusual, refs[refID].Name())
+		} else {
+			w.WriteString("0")
+		}
+		w.WriteString(formatLengthHist(&s.Aligned))
+		w.WriteString(formatLengthHist(&s.SoftClip))
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("pileupSNPMain: read lengths: mean aligned length %.2f, soft-clipped fraction %.4f; see %s", totalMeanAligned, totalClipFrac, path)
+	if len(unusual) > 0 {
+		log.Printf("pileupSNPMain: read lengths: %d reference(s) with unusual aligned or soft-clip lengths: %s", len(unusual), strings.Join(unusual, ","))
+	}
+	return
+}
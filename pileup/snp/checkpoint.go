@@ -0,0 +1,228 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/grailbio/base/log"
+	gbam "github.com/grailbio/bio/encoding/bam"
+)
+
+// checkpointManifestName is the name of the manifest in a checkpoint
+// directory.  Its first line is the run fingerprint; each following line is
+// the JSON checkpointEntry of a completed task.
+const checkpointManifestName = "manifest.jsonl"
+
+// checkpointEntry records a completed main-loop task.
+type checkpointEntry struct {
+	Task    int                    `json:"task"`
+	Size    int64                  `json:"size"`
+	SHA256  string                 `json:"sha256"`
+	Census  [][nCensusBucket]int64 `json:"census"`
+	Lengths []readLengthStats      `json:"lengths,omitempty"`
+}
+
+// checkpoint keeps the intermediate per-task pileupRow files of a run
+// (Opts.Resume) in a directory named after the run's fingerprint, so that a
+// rerun with the same arguments can skip the tasks which already completed.
+type checkpoint struct {
+	dir string
+	// done holds the verified entries of the tasks completed by earlier runs.
+	done     map[int]checkpointEntry
+	mu       sync.Mutex
+	manifest *os.File
+}
+
+// runFingerprint identifies a run, for checkpoint.  It covers everything that
+// affects the contents of the intermediate files, apart from the strand and
+// the number of tasks: the inputs, the options, and the shards.
+func runFingerprint(xampaths []string, fapath string, rawOpts *Opts, shards []gbam.Shard) string {
+	h := sha256.New()
+	opts := *rawOpts
+	// The hooks and progress sinks don't affect the results, and their
+	// addresses vary, as do those of NewRandSource.
+	opts.Hooks = nil
+	opts.Progress = nil
+	opts.NewRandSource = nil
+	fmt.Fprintf(h, "%q %q %+v\n", xampaths, fapath, opts)
+	for _, path := range append(append([]string{}, xampaths...), fapath) {
+		// Detect inputs that were replaced between runs, where we can.
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(h, "%d %d\n", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	for _, shard := range shards {
+		fmt.Fprintf(h, "%v\n", gbam.ShardToCoordRange(shard))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// openCheckpoint opens (creating it if necessary) the checkpoint directory of
+// the run with the given fingerprint under tempDir, and verifies the tasks
+// completed by earlier runs.
+func openCheckpoint(tempDir, fingerprint string) (*checkpoint, error) {
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	c := &checkpoint{
+		dir:  filepath.Join(tempDir, "pileup_checkpoint_"+fingerprint),
+		done: make(map[int]checkpointEntry),
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	manifestPath := filepath.Join(c.dir, checkpointManifestName)
+	if f, err := os.Open(manifestPath); err == nil {
+		c.readManifest(f, fingerprint)
+		_ = f.Close()
+	}
+	// Rewrite the manifest, keeping only the verified entries.
+	tmpPath := manifestPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	c.manifest = f
+	if _, err = fmt.Fprintln(f, fingerprint); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	tasks := make([]int, 0, len(c.done))
+	for task := range c.done {
+		tasks = append(tasks, task)
+	}
+	sort.Ints(tasks)
+	for _, task := range tasks {
+		if err = c.appendEntry(c.done[task]); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	if err = os.Rename(tmpPath, manifestPath); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if len(c.done) > 0 {
+		log.Printf("pileupSNPMain: resuming from %s, with %d completed tasks", c.dir, len(c.done))
+	}
+	return c, nil
+}
+
+// readManifest reads the manifest of an earlier run, and saves the entries
+// whose files are intact in c.done.
+func (c *checkpoint) readManifest(r io.Reader, fingerprint string) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<26)
+	if !scanner.Scan() || scanner.Text() != fingerprint {
+		return
+	}
+	for scanner.Scan() {
+		var e checkpointEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The run was interrupted while writing this entry.
+			continue
+		}
+		size, sum, err := hashFile(c.taskPath(e.Task))
+		if err != nil || size != e.Size || sum != e.SHA256 {
+			log.Printf("pileupSNPMain: checkpoint of task %d is missing or corrupt, recomputing it", e.Task)
+			continue
+		}
+		c.done[e.Task] = e
+	}
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close() // nolint: errcheck
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *checkpoint) taskPath(task int) string {
+	return filepath.Join(c.dir, "task"+strconv.Itoa(task)+".rio")
+}
+
+// openTaskFile opens the intermediate file of a task.  If the task was
+// completed by an earlier run, it returns the existing file and the task's
+// entry; otherwise it returns an empty file.
+func (c *checkpoint) openTaskFile(task int) (*os.File, *checkpointEntry, error) {
+	if e, ok := c.done[task]; ok {
+		f, err := os.OpenFile(c.taskPath(task), os.O_RDWR, 0)
+		return f, &e, err
+	}
+	f, err := os.OpenFile(c.taskPath(task), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	return f, nil, err
+}
+
+func (c *checkpoint) appendEntry(e checkpointEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = c.manifest.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return c.manifest.Sync()
+}
+
+// record adds the completed task, whose intermediate file is f and whose read
+// census is census, to the manifest.  It may be called concurrently.
+func (c *checkpoint) record(task int, f *os.File, census *readCensus) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	size, sum, err := hashFile(f.Name())
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.appendEntry(checkpointEntry{Task: task, Size: size, SHA256: sum, Census: census.counts, Lengths: census.lengths})
+}
+
+// close closes the manifest, leaving the checkpoint for the next run.
+func (c *checkpoint) close() error {
+	if c.manifest == nil {
+		return nil
+	}
+	err := c.manifest.Close()
+	c.manifest = nil
+	return err
+}
+
+// remove deletes the checkpoint, after the run has succeeded.
+func (c *checkpoint) remove() error {
+	if err := c.close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(c.dir)
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	writeTask := func(c *checkpoint, task int, data string) {
+		f, e, err := c.openTaskFile(task)
+		assert.NoError(t, err)
+		assert.True(t, e == nil)
+		_, err = f.WriteString(data)
+		assert.NoError(t, err)
+		census := newReadCensus(1)
+		census.counts[0][0] = int64(task + 1)
+		assert.NoError(t, c.record(task, f, census))
+		assert.NoError(t, f.Close())
+	}
+
+	c, err := openCheckpoint(tmpdir, "fp1")
+	assert.NoError(t, err)
+	assert.EQ(t, len(c.done), 0)
+	writeTask(c, 0, "task0")
+	writeTask(c, 1, "task1")
+	// Task 2 is interrupted before it is recorded.
+	f, _, err := c.openTaskFile(2)
+	assert.NoError(t, err)
+	_, err = f.WriteString("partial")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, c.close())
+
+	// Corrupt task 1.
+	assert.NoError(t, ioutil.WriteFile(c.taskPath(1), []byte("task1!"), 0644))
+
+	c, err = openCheckpoint(tmpdir, "fp1")
+	assert.NoError(t, err)
+	assert.EQ(t, len(c.done), 1)
+	f, e, err := c.openTaskFile(0)
+	assert.NoError(t, err)
+	assert.True(t, e != nil)
+	assert.EQ(t, e.Census[0][0], int64(1))
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), "task0")
+	assert.NoError(t, f.Close())
+	writeTask(c, 1, "task1")
+	assert.NoError(t, c.close())
+
+	// The manifest was rewritten, so both tasks survive another restart.
+	c, err = openCheckpoint(tmpdir, "fp1")
+	assert.NoError(t, err)
+	assert.EQ(t, len(c.done), 2)
+	assert.NoError(t, c.remove())
+
+	// A different run doesn't see them.
+	c, err = openCheckpoint(tmpdir, "fp2")
+	assert.NoError(t, err)
+	assert.EQ(t, len(c.done), 0)
+	assert.NoError(t, c.remove())
+}
@@ -0,0 +1,335 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// parseCircularContigs parses Opts.Circular, a comma-separated list of contig
+// names.  It returns nil if the list is empty, and otherwise a slice indexed
+// by reference ID which is true for the circular contigs.
+func parseCircularContigs(spec string, refs []*sam.Reference) ([]bool, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	ids := make(map[string]int, len(refs))
+	for _, ref := range refs {
+		ids[ref.Name()] = ref.ID()
+	}
+	circular := make([]bool, len(refs))
+	for _, name := range strings.Split(spec, ",") {
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("Pileup: circular= contig %q is not in the BAM/PAM header", name)
+		}
+		circular[id] = true
+	}
+	return circular, nil
+}
+
+// appendCigarOp appends op to cigar, merging it into the last operation if
+// they have the same type.
+func appendCigarOp(cigar sam.Cigar, t sam.CigarOpType, n int) sam.Cigar {
+	if n == 0 {
+		return cigar
+	}
+	if last := len(cigar) - 1; (last >= 0) && (cigar[last].Type() == t) {
+		cigar[last] = sam.NewCigarOp(t, cigar[last].Len()+n)
+		return cigar
+	}
+	return append(cigar, sam.NewCigarOp(t, n))
+}
+
+// splitCigarAt splits the alignment cigar at refOff reference positions from
+// its start.  head is the part before the split, with the read bases after
+// it soft-clipped, and tail is the part after it, with the read bases before
+// it soft-clipped; tailPos is the offset of the first aligned base of tail
+// from the split.  Insertions and deletions adjacent to the split are
+// dropped (the inserted bases are soft-clipped).  tail is nil if no base is
+// aligned after the split.
+func splitCigarAt(cigar sam.Cigar, refOff int) (head, tail sam.Cigar, tailPos int) {
+	// Hard clips stay at their end of both parts.
+	var leadH, trailH sam.CigarOp
+	if (len(cigar) > 0) && (cigar[0].Type() == sam.CigarHardClipped) {
+		leadH, cigar = cigar[0], cigar[1:]
+	}
+	if (len(cigar) > 0) && (cigar[len(cigar)-1].Type() == sam.CigarHardClipped) {
+		trailH, cigar = cigar[len(cigar)-1], cigar[:len(cigar)-1]
+	}
+	if leadH != 0 {
+		head = append(head, leadH)
+	}
+	var headQuery, tailQuery int
+	var tailOps sam.Cigar
+	refPos := 0
+	for _, op := range cigar {
+		t, n := op.Type(), op.Len()
+		c := t.Consumes()
+		if (refPos < refOff) && (c.Reference > 0) {
+			m := n
+			if refPos+m > refOff {
+				m = refOff - refPos
+			}
+			head = appendCigarOp(head, t, m)
+			headQuery += m * c.Query
+			refPos += m
+			n -= m
+		} else if refPos < refOff {
+			head = appendCigarOp(head, t, n)
+			headQuery += n * c.Query
+			n = 0
+		}
+		if n > 0 {
+			tailOps = appendCigarOp(tailOps, t, n)
+			tailQuery += n * c.Query
+		}
+	}
+	// Drop the deletions at the end of head, and soft-clip its trailing
+	// insertions along with the bases of tail.
+	for len(head) > 0 {
+		last := head[len(head)-1]
+		if t := last.Type(); (t == sam.CigarDeletion) || (t == sam.CigarSkipped) {
+			head = head[:len(head)-1]
+		} else if t == sam.CigarInsertion {
+			head = head[:len(head)-1]
+			tailQuery += last.Len()
+		} else {
+			break
+		}
+	}
+	head = appendCigarOp(head, sam.CigarSoftClipped, tailQuery)
+	if trailH != 0 {
+		head = append(head, trailH)
+	}
+	// Likewise at the start of tail.
+	for len(tailOps) > 0 {
+		first := tailOps[0]
+		t := first.Type()
+		if (t == sam.CigarDeletion) || (t == sam.CigarSkipped) {
+			tailPos += first.Len()
+		} else if (t == sam.CigarInsertion) || (t == sam.CigarSoftClipped) {
+			headQuery += first.Len()
+		} else {
+			break
+		}
+		tailOps = tailOps[1:]
+	}
+	aligned := false
+	for _, op := range tailOps {
+		if c := op.Type().Consumes(); (c.Query > 0) && (c.Reference > 0) {
+			aligned = true
+			break
+		}
+	}
+	if !aligned {
+		return head, nil, 0
+	}
+	if leadH != 0 {
+		tail = append(tail, leadH)
+	}
+	tail = appendCigarOp(tail, sam.CigarSoftClipped, headQuery)
+	for _, op := range tailOps {
+		tail = appendCigarOp(tail, op.Type(), op.Len())
+	}
+	if trailH != 0 {
+		tail = append(tail, trailH)
+	}
+	return head, tail, tailPos
+}
+
+// circularIterator wraps the iterator of a shard, and implements Opts.Circular.
+// The reads which extend past the end of a circular contig are cut there, and
+// their bases past the end are returned as separate records (with the same
+// name, flags and mate information) aligned from position 0, by the shard
+// which covers position 0 of the contig.  That shard gets them by reading the
+// last maxReadSpan positions of the contig before its reads on the contig.
+//
+// Since the part past the origin is usually far from the mate, it isn't
+// stitched with it; apart from that, it is filtered and counted like any
+// other read.
+type circularIterator struct {
+	src         bamprovider.Iterator
+	provider    bamprovider.Provider
+	circular    []bool
+	maxReadSpan int
+
+	// wrapRefs are the IDs of the circular contigs whose position 0 is in the
+	// shard, in increasing order, and whose wrapped reads haven't been
+	// returned yet.
+	wrapRefs []int
+	// next is the record of src which comes after the ready ones, if
+	// peeked is set; it is nil at the end of src.
+	next   *sam.Record
+	peeked bool
+	ready  []*sam.Record
+
+	rec *sam.Record
+	err error
+}
+
+// newCircularIterator returns an iterator over the reads of shard, read from
+// src, with the wrapping of the contigs marked in circular.
+func newCircularIterator(src bamprovider.Iterator, provider bamprovider.Provider, shard *gbam.Shard, circular []bool, maxReadSpan int) *circularIterator {
+	it := &circularIterator{
+		src:         src,
+		provider:    provider,
+		circular:    circular,
+		maxReadSpan: maxReadSpan,
+	}
+	startID := shard.StartRef.ID()
+	endID := len(circular) - 1
+	if shard.EndRef != nil {
+		endID = shard.EndRef.ID()
+	}
+	for id := startID; id <= endID; id++ {
+		if !circular[id] || ((id == startID) && (shard.Start > 0)) || ((id == endID) && (shard.EndRef != nil) && (shard.End <= 0)) {
+			continue
+		}
+		it.wrapRefs = append(it.wrapRefs, id)
+	}
+	return it
+}
+
+// recordRefID returns the reference ID of r, with the unmapped reads at the
+// end of the BAM/PAM after all the others.
+func recordRefID(r *sam.Record) int {
+	if r.Ref == nil {
+		return math.MaxInt32
+	}
+	return r.Ref.ID()
+}
+
+// crossesEnd returns true if r is aligned past the end of a circular contig.
+func (it *circularIterator) crossesEnd(r *sam.Record) bool {
+	return (r.Ref != nil) && it.circular[r.Ref.ID()] && (r.Flags&sam.Unmapped == 0) && (len(r.Cigar) > 0) && (r.Pos < r.Ref.Len()) && (r.End() > r.Ref.Len())
+}
+
+// readWrapped returns the parts past the origin of the reads which cross the
+// end of the circular contig ref.
+func (it *circularIterator) readWrapped(ref *sam.Reference) ([]*sam.Record, error) {
+	refLen := ref.Len()
+	start := refLen - it.maxReadSpan
+	if start < 0 {
+		start = 0
+	}
+	tailIter := it.provider.NewIterator(gbam.Shard{StartRef: ref, EndRef: ref, Start: start, End: refLen})
+	var wrapped []*sam.Record
+	for tailIter.Scan() {
+		r := tailIter.Record()
+		if !it.crossesEnd(r) {
+			sam.PutInFreePool(r)
+			continue
+		}
+		// r isn't returned to the pool, since the new record shares its
+		// sequence and qualities.
+		_, tail, tailPos := splitCigarAt(r.Cigar, refLen-r.Pos)
+		if tail == nil {
+			continue
+		}
+		w := new(sam.Record)
+		*w = *r
+		w.Pos = tailPos
+		w.Cigar = tail
+		wrapped = append(wrapped, w)
+	}
+	err := tailIter.Close()
+	if err == nil {
+		err = tailIter.Err()
+	}
+	// The records start at the offsets of their first aligned bases, which
+	// are usually all 0.
+	sortRecordsByPos(wrapped)
+	return wrapped, err
+}
+
+// sortRecordsByPos sorts a short slice of records of the same reference by
+// position, keeping the order of the records with the same position.
+func sortRecordsByPos(recs []*sam.Record) {
+	for i := 1; i < len(recs); i++ {
+		for j := i; (j > 0) && (recs[j-1].Pos > recs[j].Pos); j-- {
+			recs[j-1], recs[j] = recs[j], recs[j-1]
+		}
+	}
+}
+
+func (it *circularIterator) Scan() bool {
+	for {
+		if len(it.ready) > 0 {
+			it.rec = it.ready[0]
+			it.ready[0] = nil
+			it.ready = it.ready[1:]
+			return true
+		}
+		if it.err != nil {
+			return false
+		}
+		if !it.peeked {
+			it.next = nil
+			if it.src.Scan() {
+				it.next = it.src.Record()
+			} else if it.err = it.src.Err(); it.err != nil {
+				return false
+			}
+			it.peeked = true
+		}
+		// The wrapped reads of a contig go before its own reads.
+		if (len(it.wrapRefs) > 0) && ((it.next == nil) || (recordRefID(it.next) >= it.wrapRefs[0])) {
+			header, err := it.provider.GetHeader()
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if it.ready, it.err = it.readWrapped(header.Refs()[it.wrapRefs[0]]); it.err != nil {
+				return false
+			}
+			it.wrapRefs = it.wrapRefs[1:]
+			continue
+		}
+		if it.next == nil {
+			return false
+		}
+		it.rec, it.peeked = it.next, false
+		if it.crossesEnd(it.rec) {
+			it.rec.Cigar, _, _ = splitCigarAt(it.rec.Cigar, it.rec.Ref.Len()-it.rec.Pos)
+		}
+		return true
+	}
+}
+
+func (it *circularIterator) Record() *sam.Record {
+	return it.rec
+}
+
+func (it *circularIterator) Err() error {
+	return it.err
+}
+
+func (it *circularIterator) Close() error {
+	for _, r := range it.ready {
+		sam.PutInFreePool(r)
+	}
+	it.ready = nil
+	if it.peeked && (it.next != nil) {
+		sam.PutInFreePool(it.next)
+	}
+	it.next = nil
+	return it.src.Close()
+}
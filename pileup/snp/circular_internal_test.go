@@ -0,0 +1,78 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestSplitCigarAt(t *testing.T) {
+	parse := func(s string) sam.Cigar {
+		if s == "" {
+			return nil
+		}
+		cigar, err := sam.ParseCigar([]byte(s))
+		assert.NoError(t, err)
+		return cigar
+	}
+	tests := []struct {
+		cigar   string
+		refOff  int
+		head    string
+		tail    string
+		tailPos int
+	}{
+		{"10M", 4, "4M6S", "4S6M", 0},
+		{"2S10M3S", 4, "2S4M9S", "6S6M3S", 0},
+		{"5H10M", 7, "5H7M3S", "5H7S3M", 0},
+		{"4M2I6M", 4, "4M8S", "6S6M", 0},
+		{"4M3D6M", 4, "4M6S", "4S6M", 3},
+		{"4M3D6M", 5, "4M6S", "4S6M", 2},
+		{"6M2D4M", 7, "6M4S", "6S4M", 1},
+		{"8M2S", 8, "8M2S", "", 0},
+		{"5M5D", 5, "5M", "", 0},
+	}
+	for _, test := range tests {
+		head, tail, tailPos := splitCigarAt(parse(test.cigar), test.refOff)
+		assert.EQ(t, head.String(), test.head, "cigar=%s refOff=%d", test.cigar, test.refOff)
+		if test.tail == "" {
+			assert.True(t, tail == nil, "cigar=%s refOff=%d", test.cigar, test.refOff)
+			continue
+		}
+		assert.EQ(t, tail.String(), test.tail, "cigar=%s refOff=%d", test.cigar, test.refOff)
+		assert.EQ(t, tailPos, test.tailPos, "cigar=%s refOff=%d", test.cigar, test.refOff)
+	}
+}
+
+func TestParseCircularContigs(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	chrM, err := sam.NewReference("chrM", "", "", 16569, nil, nil)
+	assert.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{chr1, chrM})
+	assert.NoError(t, err)
+	refs := []*sam.Reference{chr1, chrM}
+
+	circular, err := parseCircularContigs("", refs)
+	assert.NoError(t, err)
+	assert.True(t, circular == nil)
+	circular, err = parseCircularContigs("chrM", refs)
+	assert.NoError(t, err)
+	assert.EQ(t, circular, []bool{false, true})
+	_, err = parseCircularContigs("chrM,virus1", refs)
+	assert.HasSubstr(t, err.Error(), `circular= contig "virus1"`)
+}
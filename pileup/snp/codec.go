@@ -0,0 +1,207 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/base/recordio/recordiozstd"
+	"github.com/pierrec/lz4"
+)
+
+// Names of the recordio transformers registered by this package for the
+// intermediate pileupRow files.  recordio's transformer registry is global,
+// so the names are prefixed to stay clear of other packages' registrations.
+// recordio scanners look transformers up by the name stored in the file
+// header, so these names must not change.
+const (
+	snappyTransformerName = "grail-snp-snappy"
+	lz4TransformerName    = "grail-snp-lz4"
+)
+
+// shardCodec determines how the intermediate per-shard pileupRow files are
+// compressed and blocked.
+type shardCodec struct {
+	// transformers is the recordio transformer list; nil means no
+	// compression.
+	transformers []string
+	// maxItems is the maximum number of pileupRows per recordio block; 0
+	// selects the recordio default.
+	maxItems uint32
+}
+
+// defaultShardCodec is zstd level 1, which costs little CPU time and still
+// shrinks the intermediate files several-fold.
+var defaultShardCodec = shardCodec{transformers: []string{recordiozstd.Name + " 1"}}
+
+// parseShardCodec parses the Opts.ShardCodec and Opts.ShardBlockItems
+// arguments.
+func parseShardCodec(codec string, blockItems int) (shardCodec, error) {
+	if (blockItems < 0) || (blockItems > int(recordio.MaxPackedItems)) {
+		return shardCodec{}, fmt.Errorf("Pileup: invalid shard-block-items= argument %d (expected at most %d)", blockItems, recordio.MaxPackedItems)
+	}
+	c := shardCodec{maxItems: uint32(blockItems)}
+	fields := strings.Fields(codec)
+	if len(fields) == 0 {
+		c.transformers = defaultShardCodec.transformers
+		return c, nil
+	}
+	// Accept "zstd:3" as well as recordio's "zstd 3" syntax, since the latter
+	// is awkward on the command line.
+	if (len(fields) == 1) && strings.Contains(fields[0], ":") {
+		fields = strings.SplitN(fields[0], ":", 2)
+	}
+	switch fields[0] {
+	case "none":
+		if len(fields) == 1 {
+			return c, nil
+		}
+	case recordiozstd.Name:
+		if len(fields) == 1 {
+			c.transformers = defaultShardCodec.transformers
+			return c, nil
+		}
+		if len(fields) == 2 {
+			if level, err := strconv.Atoi(fields[1]); (err == nil) && (level >= 1) && (level <= 22) {
+				c.transformers = []string{recordiozstd.Name + " " + fields[1]}
+				return c, nil
+			}
+		}
+	case "snappy":
+		if len(fields) == 1 {
+			c.transformers = []string{snappyTransformerName}
+			return c, nil
+		}
+	case "lz4":
+		if len(fields) == 1 {
+			c.transformers = []string{lz4TransformerName}
+			return c, nil
+		}
+	}
+	return shardCodec{}, fmt.Errorf("Pileup: invalid shard-codec= argument %q (expected zstd[:level], lz4, snappy, or none)", codec)
+}
+
+// newPileupRowWriter returns a recordio.Writer for the intermediate
+// pileupRow file f.  The file's header describes the row schema; read it
+// with newPileupRowScanner.
+func newPileupRowWriter(f io.Writer, codec shardCodec) recordio.Writer {
+	w := recordio.NewWriter(f, recordio.WriterOpts{
+		Marshal:      marshalPileupRow,
+		Transformers: codec.transformers,
+		MaxItems:     codec.maxItems,
+	})
+	w.AddHeader(pileupRowSchemaHeader, pileupRowSchemaString)
+	return w
+}
+
+// concatTransformInput returns the concatenation of in.
+func concatTransformInput(in [][]byte) []byte {
+	if len(in) == 1 {
+		return in[0]
+	}
+	n := 0
+	for _, b := range in {
+		n += len(b)
+	}
+	buf := make([]byte, 0, n)
+	for _, b := range in {
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func snappyCompress(scratch []byte, in [][]byte) ([]byte, error) {
+	src := concatTransformInput(in)
+	return snappy.Encode(scratch[:cap(scratch)], src), nil
+}
+
+func snappyUncompress(scratch []byte, in [][]byte) ([]byte, error) {
+	src := concatTransformInput(in)
+	return snappy.Decode(scratch[:cap(scratch)], src)
+}
+
+// lz4 blocks don't record their uncompressed size, so lz4Compress prepends it
+// as a uvarint, followed by a byte which is 1 if the body is compressed and 0
+// if the data was incompressible and is stored as is.
+func lz4Compress(scratch []byte, in [][]byte) ([]byte, error) {
+	src := concatTransformInput(in)
+	bound := binary.MaxVarintLen64 + 1 + lz4.CompressBlockBound(len(src))
+	dst := scratch[:0]
+	if cap(dst) < bound {
+		dst = make([]byte, 0, bound)
+	}
+	hdrLen := binary.PutUvarint(dst[:binary.MaxVarintLen64], uint64(len(src)))
+	n, err := lz4.CompressBlock(src, dst[hdrLen+1:bound], nil)
+	if err != nil {
+		return nil, err
+	}
+	dst = dst[:hdrLen+1]
+	if (n == 0) || (n >= len(src)) {
+		dst[hdrLen] = 0
+		return append(dst, src...), nil
+	}
+	dst[hdrLen] = 1
+	return dst[:hdrLen+1+n], nil
+}
+
+// lz4MaxRatio bounds the compression ratio of an lz4 block.
+const lz4MaxRatio = 255
+
+func lz4Uncompress(scratch []byte, in [][]byte) ([]byte, error) {
+	src := concatTransformInput(in)
+	size, hdrLen := binary.Uvarint(src)
+	if (hdrLen <= 0) || (hdrLen >= len(src)) {
+		return nil, fmt.Errorf("lz4Uncompress: corrupt block header")
+	}
+	body := src[hdrLen+1:]
+	if src[hdrLen] == 0 {
+		if uint64(len(body)) != size {
+			return nil, fmt.Errorf("lz4Uncompress: stored block has length %d, expected %d", len(body), size)
+		}
+		return body, nil
+	}
+	// An lz4 sequence expands to at most 255 bytes per compressed byte, so a
+	// larger size can only come from a corrupt header; don't let it allocate.
+	if size > uint64(len(body))*lz4MaxRatio {
+		return nil, fmt.Errorf("lz4Uncompress: corrupt block header: length %d, compressed length %d", size, len(body))
+	}
+	dst := scratch[:0]
+	if uint64(cap(dst)) < size {
+		dst = make([]byte, size)
+	}
+	dst = dst[:size]
+	n, err := lz4.UncompressBlock(body, dst)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) != size {
+		return nil, fmt.Errorf("lz4Uncompress: block has length %d, expected %d", n, size)
+	}
+	return dst, nil
+}
+
+func registerShardTransformers() {
+	recordio.RegisterTransformer(snappyTransformerName,
+		func(string) (recordio.TransformFunc, error) { return snappyCompress, nil },
+		func(string) (recordio.TransformFunc, error) { return snappyUncompress, nil })
+	recordio.RegisterTransformer(lz4TransformerName,
+		func(string) (recordio.TransformFunc, error) { return lz4Compress, nil },
+		func(string) (recordio.TransformFunc, error) { return lz4Uncompress, nil })
+}
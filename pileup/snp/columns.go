@@ -0,0 +1,210 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// columnSelection is an entry of Opts.Columns: a column of the output, and
+// the name it's written under.
+type columnSelection struct {
+	name, alias string
+}
+
+// parseColumnSelections parses Opts.Columns, a comma-separated list of
+// <column>[=<new name>] entries.
+func parseColumnSelections(spec string) ([]columnSelection, error) {
+	var sels []columnSelection
+	aliases := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		sel := columnSelection{name: entry}
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			sel = columnSelection{name: entry[:i], alias: entry[i+1:]}
+			if sel.alias == "" {
+				return nil, fmt.Errorf("Pileup: empty new name for column %q in columns= argument", sel.name)
+			}
+		}
+		sel.name = strings.TrimPrefix(sel.name, "#")
+		if sel.name == "" {
+			return nil, fmt.Errorf("Pileup: empty column name in columns= argument %q", spec)
+		}
+		alias := sel.alias
+		if alias == "" {
+			alias = sel.name
+		}
+		if aliases[alias] {
+			return nil, fmt.Errorf("Pileup: duplicate column %q in columns= argument", alias)
+		}
+		aliases[alias] = true
+		sels = append(sels, sel)
+	}
+	return sels, nil
+}
+
+// outputColumns returns the column names of each file written by format, or
+// nil if the format doesn't support column selection.  It is the registry
+// used to validate Opts.Columns; the writers get their headers from the same
+// functions.
+func outputColumns(format outputFormat, colBitset int, annotate bool) [][]string {
+	switch format {
+	case formatTSV, formatTSVBgz, formatTSVZst:
+		return [][]string{tsvColumns(colBitset, false, annotate), tsvColumns(colBitset, true, annotate)}
+	case formatBasestrandTSV, formatBasestrandTSVBgz, formatBasestrandTSVZst:
+		return [][]string{basestrandTSVColumns(colBitset)}
+	case formatParquet:
+		var names []string
+		for _, c := range pileupParquetColumns(colBitset) {
+			names = append(names, c.Name)
+		}
+		return [][]string{names}
+	}
+	return nil
+}
+
+// columnProjection describes the columns of an output file after
+// Opts.Columns is applied.
+type columnProjection struct {
+	// src[i] is the index of the i'th output column in the full layout of the
+	// file, and names[i] is its name.
+	src   []int
+	names []string
+}
+
+// newColumnProjections returns the projections of the files with the given
+// full layouts.  Each selected column must be in at least one of the files;
+// the files without it omit it, so that e.g. ALT can be selected for the
+// tsv formats even though only the .alt.tsv file has it.  Columns keep their
+// names, including the '#' of #CHROM, unless they are renamed.
+func newColumnProjections(sels []columnSelection, files [][]string) ([]*columnProjection, error) {
+	projs := make([]*columnProjection, len(files))
+	for i := range projs {
+		projs[i] = &columnProjection{}
+	}
+	for _, sel := range sels {
+		found := false
+		for i, cols := range files {
+			for c, name := range cols {
+				if strings.TrimPrefix(name, "#") != sel.name {
+					continue
+				}
+				found = true
+				if sel.alias != "" {
+					name = sel.alias
+				}
+				projs[i].src = append(projs[i].src, c)
+				projs[i].names = append(projs[i].names, name)
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Pileup: columns= argument: unknown column %q; the output has %s", sel.name, strings.Join(files[len(files)-1], ","))
+		}
+	}
+	for _, p := range projs {
+		if len(p.src) == 0 {
+			return nil, fmt.Errorf("Pileup: columns= argument selects none of the columns of an output file")
+		}
+	}
+	return projs, nil
+}
+
+// startsWithChromPos returns true if the first two columns of p are CHROM and
+// POS, as indexing requires.
+func (p *columnProjection) startsWithChromPos(cols []string) bool {
+	return (len(p.src) >= 2) && (strings.TrimPrefix(cols[p.src[0]], "#") == "CHROM") && (cols[p.src[1]] == "POS")
+}
+
+// projectingWriter rewrites the tab-separated lines written to it to the
+// columns of a columnProjection, and passes them on to w.  The first line is
+// the header, and is replaced by the projection's column names.
+type projectingWriter struct {
+	w       io.Writer
+	proj    *columnProjection
+	nLine   int
+	line    []byte // the current partial line
+	fields  [][]byte
+	out     []byte
+	maxCols int
+}
+
+func newProjectingWriter(w io.Writer, proj *columnProjection) *projectingWriter {
+	pw := &projectingWriter{w: w, proj: proj}
+	for _, c := range proj.src {
+		if c+1 > pw.maxCols {
+			pw.maxCols = c + 1
+		}
+	}
+	return pw
+}
+
+// Write implements io.Writer.
+func (pw *projectingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	pw.out = pw.out[:0]
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			pw.line = append(pw.line, p...)
+			break
+		}
+		pw.line = append(pw.line, p[:i]...)
+		p = p[i+1:]
+		if err := pw.endLine(); err != nil {
+			return 0, err
+		}
+		pw.line = pw.line[:0]
+	}
+	if len(pw.out) > 0 {
+		if _, err := pw.w.Write(pw.out); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// endLine appends the projection of pw.line to pw.out.
+func (pw *projectingWriter) endLine() error {
+	pw.nLine++
+	if pw.nLine == 1 {
+		pw.out = append(pw.out, strings.Join(pw.proj.names, "\t")...)
+		pw.out = append(pw.out, '\n')
+		return nil
+	}
+	pw.fields = pw.fields[:0]
+	line := pw.line
+	for len(pw.fields) < pw.maxCols {
+		i := bytes.IndexByte(line, '\t')
+		if i < 0 {
+			pw.fields = append(pw.fields, line)
+			break
+		}
+		pw.fields = append(pw.fields, line[:i])
+		line = line[i+1:]
+	}
+	if len(pw.fields) < pw.maxCols {
+		return fmt.Errorf("projectingWriter: line %d has %d columns, expected at least %d: %q", pw.nLine, len(pw.fields), pw.maxCols, pw.line)
+	}
+	for i, c := range pw.proj.src {
+		if i > 0 {
+			pw.out = append(pw.out, '\t')
+		}
+		pw.out = append(pw.out, pw.fields[c]...)
+	}
+	pw.out = append(pw.out, '\n')
+	return nil
+}
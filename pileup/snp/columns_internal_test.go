@@ -0,0 +1,219 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/parquet"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseColumnSelections(t *testing.T) {
+	sels, err := parseColumnSelections("#CHROM=chrom,POS,DP=depth")
+	assert.NoError(t, err)
+	assert.EQ(t, sels, []columnSelection{{"CHROM", "chrom"}, {"POS", ""}, {"DP", "depth"}})
+	for _, bad := range []string{"", "POS,", "POS=", "=pos", "#", "POS,POS", "POS,DP=POS"} {
+		_, err := parseColumnSelections(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestNewColumnProjections(t *testing.T) {
+	files := outputColumns(formatTSV, colBitDpRef|colBitDpAlt|colBitHighQ, false)
+	assert.EQ(t, files, [][]string{
+		{"#CHROM", "POS", "REF", "DP", "ref_depth_tier1"},
+		{"#CHROM", "POS", "REF", "ALT", "DP", "alt_depth_tier1"},
+	})
+	sels, err := parseColumnSelections("CHROM,POS,ALT=allele,DP=depth")
+	assert.NoError(t, err)
+	projs, err := newColumnProjections(sels, files)
+	assert.NoError(t, err)
+	// ALT is only in the .alt.tsv file.
+	assert.EQ(t, *projs[0], columnProjection{src: []int{0, 1, 3}, names: []string{"#CHROM", "POS", "depth"}})
+	assert.EQ(t, *projs[1], columnProjection{src: []int{0, 1, 3, 4}, names: []string{"#CHROM", "POS", "allele", "depth"}})
+	assert.True(t, projs[1].startsWithChromPos(files[1]))
+
+	sels, err = parseColumnSelections("POS,CHROM")
+	assert.NoError(t, err)
+	projs, err = newColumnProjections(sels, files)
+	assert.NoError(t, err)
+	assert.False(t, projs[0].startsWithChromPos(files[0]))
+
+	for _, bad := range []string{"QUALS", "ALT"} {
+		sels, err := parseColumnSelections(bad)
+		assert.NoError(t, err)
+		_, err = newColumnProjections(sels, files)
+		assert.NotNil(t, err, bad)
+	}
+	assert.True(t, outputColumns(formatVCF, colBitDpRef, false) == nil)
+}
+
+func TestProjectingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newProjectingWriter(&buf, &columnProjection{src: []int{2, 0}, names: []string{"c", "a"}})
+	// Lines may be split across writes.
+	for _, s := range []string{"A\tB", "\tC\n1\t2\t3\t4\n", "5\t6", "\t7\n"} {
+		n, err := w.Write([]byte(s))
+		assert.NoError(t, err)
+		assert.EQ(t, n, len(s))
+	}
+	assert.EQ(t, buf.String(), "c\ta\n3\t1\n7\t5\n")
+	_, err := w.Write([]byte("8\t9\n"))
+	assert.NotNil(t, err)
+}
+
+// TestOutputColumnsMatchHeaders checks that the column registry agrees with
+// the headers written by the tsv and basestrand-tsv writers, and that the
+// rows have as many columns as the headers.
+func TestOutputColumnsMatchHeaders(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	rows := goldenRows()
+	// As in a real pileup, each counted A/C/G/T read has per-read features.
+	for i := range rows {
+		p := &rows[i].payload
+		for b := 0; b < pileup.NBase; b++ {
+			if n := p.counts[b][0] + p.counts[b][1]; n > 0 {
+				rows[i].fieldsPresent |= fieldPerReadA << uint(b)
+				p.perRead[b] = make([]perReadFeatures, n)
+				for j := range p.perRead[b] {
+					p.perRead[b][j] = perReadFeatures{dist5p: 10, fraglen: 150, qual: 40, strand: byte(pileup.StrandFwd)}
+				}
+			}
+		}
+	}
+	writeRows := func() []*os.File {
+		f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+		assert.NoError(t, err)
+		w := newPileupRowWriter(f, defaultShardCodec)
+		for i := range rows {
+			w.Append(&rows[i])
+		}
+		assert.NoError(t, w.Finish())
+		return []*os.File{f}
+	}
+	headerNames := func(header map[string]int) []string {
+		names := make([]string, len(header))
+		for name, i := range header {
+			names[i] = name
+		}
+		return names
+	}
+	trimmed := func(names []string) []string {
+		var out []string
+		for _, name := range names {
+			out = append(out, strings.TrimPrefix(name, "#"))
+		}
+		return out
+	}
+	for _, colBitset := range []int{
+		colBitDpRef | colBitDpAlt | colBitHighQ | colBitLowQ,
+		colBitDpRef | colBitDpAlt | colBitHighQ | colBitLowQ | colBitIndels | colBitQualWeights | colBitExtBases | colBitHapCounts,
+		colBitDpRef | colBitEndDists | colBitQuals | colBitFraglens | colBitStrands,
+	} {
+		mainPath := filepath.Join(tmpdir, "out")
+		assert.NoError(t, convertPileupRowsToTSV(ctx, writeRows(), mainPath, colBitset, compressNone, 1, goldenRefNames, goldenRefSeqs, nil, nil, nil))
+		assert.NoError(t, convertPileupRowsToBasestrandTSV(ctx, writeRows(), mainPath, colBitset, compressNone, 1, goldenRefNames, goldenRefSeqs, nil, nil))
+		tsvFiles := outputColumns(formatTSV, colBitset, false)
+		for i, suffix := range []string{".ref.tsv", ".alt.tsv"} {
+			header, _ := readGoldenTSV(t, mainPath+suffix)
+			assert.EQ(t, headerNames(header), trimmed(tsvFiles[i]), colBitset, suffix)
+		}
+		header, _ := readGoldenTSV(t, mainPath+".basestrand.tsv")
+		assert.EQ(t, headerNames(header), trimmed(outputColumns(formatBasestrandTSV, colBitset, false)[0]), colBitset)
+	}
+}
+
+func TestColumnProjectionOutput(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	rows := goldenRows()
+	writeRows := func() []*os.File {
+		f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+		assert.NoError(t, err)
+		w := newPileupRowWriter(f, defaultShardCodec)
+		for i := range rows {
+			w.Append(&rows[i])
+		}
+		assert.NoError(t, w.Finish())
+		return []*os.File{f}
+	}
+	const colBitset = colBitDpRef | colBitDpAlt | colBitHighQ | colBitIndels
+	project := func(format outputFormat, spec string) []*columnProjection {
+		sels, err := parseColumnSelections(spec)
+		assert.NoError(t, err)
+		projs, err := newColumnProjections(sels, outputColumns(format, colBitset, false))
+		assert.NoError(t, err)
+		return projs
+	}
+	mainPath := filepath.Join(tmpdir, "out")
+	want := expectedGoldenSites(rows)
+
+	// The projected columns have the values of the full output.
+	assert.NoError(t, convertPileupRowsToTSV(ctx, writeRows(), mainPath, colBitset, compressNone, 1, goldenRefNames, goldenRefSeqs, nil, nil, nil))
+	fullHeader, fullRows := readGoldenTSV(t, mainPath+".alt.tsv")
+	assert.NoError(t, convertPileupRowsToTSV(ctx, writeRows(), mainPath, colBitset, compressNone, 1, goldenRefNames, goldenRefSeqs, nil, project(formatTSV, "POS,ALT=allele,CHROM"), nil))
+	data, err := ioutil.ReadFile(mainPath + ".alt.tsv")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	assert.EQ(t, lines[0], "POS\tallele\t#CHROM")
+	assert.EQ(t, len(lines), len(fullRows)+1)
+	for i, row := range fullRows {
+		assert.EQ(t, lines[i+1], row[fullHeader["POS"]]+"\t"+row[fullHeader["ALT"]]+"\t"+row[fullHeader["CHROM"]])
+	}
+	header, refRows := readGoldenTSV(t, mainPath+".ref.tsv")
+	assert.EQ(t, header, map[string]int{"POS": 0, "CHROM": 1})
+	assert.EQ(t, len(refRows), len(want))
+
+	assert.NoError(t, convertPileupRowsToBasestrandTSV(ctx, writeRows(), mainPath, colBitset, compressNone, 1, goldenRefNames, goldenRefSeqs, project(formatBasestrandTSV, "CHROM,POS,A+=a_fwd"), nil))
+	header, bsRows := readGoldenTSV(t, mainPath+".basestrand.tsv")
+	assert.EQ(t, header, map[string]int{"CHROM": 0, "POS": 1, "a_fwd": 2})
+	assert.EQ(t, len(bsRows), len(want))
+	for i, row := range bsRows {
+		assert.EQ(t, row[2], strconv.Itoa(int(want[i].counts[pileup.BaseA][0])), row)
+	}
+
+	assert.NoError(t, convertPileupRowsToParquet(ctx, writeRows(), mainPath, colBitset, 0, goldenRefNames, goldenRefSeqs, nil, project(formatParquet, "depth=dp,chrom,pos"), nil))
+	data, err = ioutil.ReadFile(mainPath + ".parquet")
+	assert.NoError(t, err)
+	r, err := parquet.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	var names []string
+	for _, c := range r.Columns {
+		names = append(names, c.Name)
+	}
+	assert.EQ(t, names, []string{"dp", "chrom", "pos"})
+	depths, err := r.ReadColumn(0)
+	assert.NoError(t, err)
+	pos, err := r.ReadColumn(2)
+	assert.NoError(t, err)
+	for i, s := range want {
+		assert.EQ(t, depths.([]int32)[i], int32(s.depth))
+		assert.EQ(t, pos.([]int64)[i], int64(s.pos))
+	}
+}
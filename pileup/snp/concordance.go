@@ -0,0 +1,132 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+)
+
+// mateConcordanceCounts summarizes how often the two reads of an overlapping
+// pair agree at Opts.HetSites.  Since both reads sequence the same molecule,
+// a disagreement is an error in one of them (or a chimeric pair).
+type mateConcordanceCounts struct {
+	// pairs is the number of pairs with at least one het site compared, and
+	// discordantPairs the number of those with at least one disagreement.
+	pairs, discordantPairs int64
+	// agree and disagree count the (pair, het site) comparisons.
+	agree, disagree int64
+}
+
+func (c *mateConcordanceCounts) add(other *mateConcordanceCounts) {
+	c.pairs += other.pairs
+	c.discordantPairs += other.discordantPairs
+	c.agree += other.agree
+	c.disagree += other.disagree
+}
+
+// mateConcordance accumulates the mateConcordanceCounts of a run's jobs.
+type mateConcordance struct {
+	mu     sync.Mutex
+	counts mateConcordanceCounts
+}
+
+// merge adds counts to c.  It may be called concurrently.
+func (c *mateConcordance) merge(counts *mateConcordanceCounts) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts.add(counts)
+}
+
+// compareMates compares the two reads of a pair at the het sites in the
+// overlap of their relevant bases abb0 and abb1 (see alignRelevantBases).  A
+// site is only compared if both reads have a non-N base of quality >=
+// minBaseQual there.  It returns the number of sites compared, and the number
+// of those where the reads disagree.
+func compareMates(reads []readSNP, abb0, abb1 []alignedPos, hetSites *interval.BEDUnion, minBaseQual byte) (nSite, nDisagree int) {
+	refID := reads[0].samr.Ref.ID()
+	seq0, qual0 := reads[0].seq8, reads[0].samr.Qual
+	seq1, qual1 := reads[1].seq8, reads[1].samr.Qual
+	idx0, idx1 := 0, 0
+	for (idx0 != len(abb0)) && (idx1 != len(abb1)) {
+		posInRef0 := abb0[idx0].posInRef
+		posInRef1 := abb1[idx1].posInRef
+		if posInRef0 < posInRef1 {
+			idx0++
+			continue
+		}
+		if posInRef1 < posInRef0 {
+			idx1++
+			continue
+		}
+		posInRead0 := abb0[idx0].posInRead
+		posInRead1 := abb1[idx1].posInRead
+		idx0++
+		idx1++
+		if (qual0[posInRead0] < minBaseQual) || (qual1[posInRead1] < minBaseQual) {
+			continue
+		}
+		if (pileup.Seq8ToEnumTable[seq0[posInRead0]] == pileup.BaseX) || (pileup.Seq8ToEnumTable[seq1[posInRead1]] == pileup.BaseX) {
+			continue
+		}
+		if !hetSites.ContainsByID(refID, posInRef0) {
+			continue
+		}
+		nSite++
+		if seq0[posInRead0] != seq1[posInRead1] {
+			nDisagree++
+		}
+	}
+	return
+}
+
+// writeMateConcordance writes the run's counts to
+// <mainPath>.mate_concordance.tsv.
+func writeMateConcordance(ctx context.Context, mainPath string, c *mateConcordance) (err error) {
+	path := mainPath + ".mate_concordance.tsv"
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("PAIRS\tDISCORDANT_PAIRS\tAGREE\tDISAGREE\tDISAGREE_RATE")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	counts := &c.counts
+	rate := 0.0
+	if n := counts.agree + counts.disagree; n > 0 {
+		rate = float64(counts.disagree) / float64(n)
+	}
+	w.WriteInt64(counts.pairs)
+	w.WriteInt64(counts.discordantPairs)
+	w.WriteInt64(counts.agree)
+	w.WriteInt64(counts.disagree)
+	w.WriteFloat64(rate, 'g', 6)
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("pileupSNPMain: mate concordance: %d of %d pairs discordant, %d of %d het-site comparisons disagree; see %s", counts.discordantPairs, counts.pairs, counts.disagree, counts.agree+counts.disagree, path)
+	return
+}
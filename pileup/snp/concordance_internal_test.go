@@ -0,0 +1,103 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestCompareMates(t *testing.T) {
+	ref, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref})
+	bedOpts := interval.NewBEDOpts{SAMHeader: samHeader}
+	bedPart, err := interval.NewBEDUnionFromEntries([]interval.Entry{{RefName: "chr1", Start0: 0, End: 1000}}, bedOpts)
+	assert.NoError(t, err)
+	// Het sites at 104, 106 and 120.
+	hetSites, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 104, End: 105},
+		{RefName: "chr1", Start0: 106, End: 107},
+		{RefName: "chr1", Start0: 120, End: 121},
+	}, bedOpts)
+	assert.NoError(t, err)
+	qpt, _ := newQualPassTable(20)
+
+	// The reads are 10 bases long; read 0 starts at 100, and read 1 at 103.
+	read := func(pos int, seq string, qual byte) readSNP {
+		quals := make([]byte, len(seq))
+		for i := range quals {
+			quals[i] = qual
+		}
+		r := readSNP{
+			samr: &sam.Record{
+				Name:  "pair",
+				Ref:   ref,
+				Pos:   pos,
+				Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, len(seq))},
+				Seq:   sam.NewSeq([]byte(seq)),
+				Qual:  quals,
+			},
+			mapEnd: PosType(pos + len(seq)),
+		}
+		for _, b := range []byte(seq) {
+			r.seq8 = append(r.seq8, map[byte]byte{'A': 1, 'C': 2, 'G': 4, 'T': 8, 'N': 15}[b])
+		}
+		return r
+	}
+	// At 104 and 106, read 0 has C and C, and read 1 has C and C (or T).
+	concordant := []readSNP{read(100, "AAAACACAAA", 30), read(103, "ACACAAAAAA", 30)}
+	discordant := []readSNP{read(100, "AAAACACAAA", 30), read(103, "ACATAAAAAA", 30)}
+	lowQual := []readSNP{read(100, "AAAACACAAA", 30), read(103, "ACATAAAAAA", 10)}
+	withN := []readSNP{read(100, "AAAACANAAA", 30), read(103, "ACATAAAAAA", 30)}
+
+	for _, test := range []struct {
+		reads            []readSNP
+		nSite, nDisagree int
+	}{
+		{concordant, 2, 0},
+		{discordant, 2, 1},
+		{lowQual, 0, 0},
+		{withN, 1, 0},
+	} {
+		var abbs [2][]alignedPos
+		for i := range test.reads {
+			assert.NoError(t, alignRelevantBases(&abbs[i], test.reads[i], &bedPart))
+		}
+		nSite, nDisagree := compareMates(test.reads, abbs[0], abbs[1], &hetSites, 20)
+		assert.EQ(t, nSite, test.nSite)
+		assert.EQ(t, nDisagree, test.nDisagree)
+	}
+
+	for _, drop := range []bool{false, true} {
+		pm := newPileupMutable(1024, 10, true, nil)
+		pCtx := pileupContext{
+			bedPart:        bedPart,
+			qpt:            &qpt,
+			stitch:         true,
+			hetSites:       &hetSites,
+			dropDiscordant: drop,
+		}
+		assert.NoError(t, pm.addReadPair(concordant, 0, &pCtx))
+		assert.NoError(t, pm.addReadPair(discordant, 0, &pCtx))
+		assert.EQ(t, pm.concordance, mateConcordanceCounts{pairs: 2, discordantPairs: 1, agree: 3, disagree: 1})
+		wantDepth := uint32(2)
+		if drop {
+			wantDepth = 1
+		}
+		assert.EQ(t, pm.resultRingBuffer[105].depth, wantDepth)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"strings"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// dedupMode is the Opts.Dedup policy.
+type dedupMode int
+
+const (
+	dedupNone dedupMode = iota
+	// dedupCollapse keeps only the first fragment of each duplicate set.
+	dedupCollapse
+	// dedupDownweight keeps about 1 + ln(n) of the n fragments of a duplicate
+	// set: the k'th copy (1-based) is kept iff floor(H(k)) > floor(H(k-1)),
+	// where H is the harmonic series.  So the first, 4th, 11th, 31st, ...
+	// copies are kept.  This still lets heavily duplicated alleles count for
+	// more than singletons, without letting a PCR jackpot dominate.
+	dedupDownweight
+)
+
+var dedupModeNames = map[string]dedupMode{
+	"":           dedupNone,
+	"none":       dedupNone,
+	"collapse":   dedupCollapse,
+	"downweight": dedupDownweight,
+}
+
+func (m dedupMode) String() string {
+	switch m {
+	case dedupCollapse:
+		return "collapse"
+	case dedupDownweight:
+		return "downweight"
+	}
+	return "none"
+}
+
+// parseDedupOpts parses the Opts.Dedup and Opts.DedupUMITag arguments.
+func parseDedupOpts(mode, umiTag string) (dedupMode, sam.Tag, error) {
+	m, ok := dedupModeNames[mode]
+	if !ok {
+		return dedupNone, sam.Tag{}, fmt.Errorf("Pileup: invalid dedup= argument %q (expected collapse, downweight, or none)", mode)
+	}
+	if umiTag == "" {
+		return m, sam.Tag{}, nil
+	}
+	if m == dedupNone {
+		return dedupNone, sam.Tag{}, fmt.Errorf("Pileup: dedup-umi-tag= requires dedup=")
+	}
+	if len(umiTag) != 2 {
+		return dedupNone, sam.Tag{}, fmt.Errorf("Pileup: invalid dedup-umi-tag= argument %q", umiTag)
+	}
+	return m, sam.NewTag(umiTag), nil
+}
+
+// dupKey identifies a duplicate set.  For a fragment with both reads mapped
+// to the same reference, it is made of the unclipped 5' position and strand
+// of the leftmost read, and the alignment start and strand of its mate (the
+// mate's clipping isn't known until the mate is read); otherwise it is made
+// of the read's own unclipped 5' position and strand, with matePos -1.
+// The UMI is only set with Opts.DedupUMITag.
+type dupKey struct {
+	refID       int
+	fivePrime   int
+	reverse     bool
+	matePos     int
+	mateReverse bool
+	umi         string
+}
+
+// dupSet is the state of a duplicate set.
+type dupSet struct {
+	// n is the number of fragments seen so far, and h is H(n).
+	n int64
+	h float64
+	// lastPos is the alignment start of the read that was last added.
+	lastPos int
+}
+
+// dupFilter detects duplicate fragments on the fly (Opts.Dedup), for BAMs
+// which weren't run through a duplicate marker.  Reads which are already
+// flagged as duplicates are removed by Opts.FlagExclude, before they get
+// here.
+//
+// Like fraglenSampler, dupFilter makes the decision for a fragment on its
+// first read, and gives the second read the same decision, as long as both
+// are processed by the same job.  Duplicate sets are also tracked per job,
+// so a set whose reads straddle a job boundary (which requires their
+// alignment starts to differ, due to clipping) may be split.
+type dupFilter struct {
+	mateDecisions
+	mode   dedupMode
+	umiTag sam.Tag
+	// maxReadSpan bounds the distance between the alignment starts of reads
+	// in the same duplicate set, since they share an unclipped 5' end.
+	maxReadSpan int
+	sets        map[dupKey]dupSet
+	setsPruneAt int
+}
+
+func newDupFilter(mode dedupMode, umiTag sam.Tag, maxReadSpan int) *dupFilter {
+	return &dupFilter{
+		mateDecisions: newMateDecisions(),
+		mode:          mode,
+		umiTag:        umiTag,
+		maxReadSpan:   maxReadSpan,
+		sets:          make(map[dupKey]dupSet),
+		setsPruneAt:   1024,
+	}
+}
+
+func (f *dupFilter) key(r *sam.Record) dupKey {
+	k := dupKey{
+		refID:     r.Ref.ID(),
+		fivePrime: gbam.UnclippedFivePrimePosition(r),
+		reverse:   (r.Flags & sam.Reverse) != 0,
+		matePos:   -1,
+	}
+	if fragmentLength(r) != fraglenNone {
+		k.matePos = r.MatePos
+		k.mateReverse = (r.Flags & sam.MateReverse) != 0
+	}
+	if f.umiTag != (sam.Tag{}) {
+		if aux := r.AuxFields.Get(f.umiTag); aux != nil {
+			k.umi = fmt.Sprint(aux.Value())
+			// UMIs are often written as e.g. "ACG-TTA" for duplex reads; the
+			// separator isn't significant.
+			k.umi = strings.Replace(k.umi, "-", "", -1)
+		}
+	}
+	return k
+}
+
+// add adds a fragment to s, and returns true if it should be kept.
+func (s *dupSet) add(mode dedupMode) bool {
+	s.n++
+	if mode == dedupCollapse {
+		return s.n == 1
+	}
+	prev := s.h
+	s.h += 1 / float64(s.n)
+	return int(s.h) > int(prev)
+}
+
+// prune forgets the duplicate sets which can't get any more reads.
+func (f *dupFilter) prune(refID, pos int) {
+	for k, s := range f.sets {
+		if (k.refID < refID) || (s.lastPos+f.maxReadSpan < pos) {
+			delete(f.sets, k)
+		}
+	}
+	f.setsPruneAt = 2 * len(f.sets)
+	if f.setsPruneAt < 1024 {
+		f.setsPruneAt = 1024
+	}
+}
+
+// keep returns true if r should be kept.  Reads must be passed in coordinate
+// order.
+func (f *dupFilter) keep(r *sam.Record) bool {
+	if keep, ok := f.take(r); ok {
+		return keep
+	}
+	k := f.key(r)
+	s := f.sets[k]
+	keep := s.add(f.mode)
+	s.lastPos = r.Pos
+	f.sets[k] = s
+	if len(f.sets) >= f.setsPruneAt {
+		f.prune(r.Ref.ID(), r.Pos)
+	}
+	f.put(r, keep)
+	return keep
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseDedupOpts(t *testing.T) {
+	m, tag, err := parseDedupOpts("", "")
+	assert.NoError(t, err)
+	assert.EQ(t, m, dedupNone)
+	m, tag, err = parseDedupOpts("collapse", "RX")
+	assert.NoError(t, err)
+	assert.EQ(t, m, dedupCollapse)
+	assert.EQ(t, tag, sam.NewTag("RX"))
+
+	for _, bad := range [][2]string{{"markdup", ""}, {"", "RX"}, {"collapse", "UMI"}} {
+		_, _, err := parseDedupOpts(bad[0], bad[1])
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestDupSetDownweight(t *testing.T) {
+	var s dupSet
+	var kept []int
+	for k := 1; k <= 40; k++ {
+		if s.add(dedupDownweight) {
+			kept = append(kept, k)
+		}
+	}
+	assert.EQ(t, kept, []int{1, 4, 11, 31})
+}
+
+func TestDupFilter(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	_, _ = sam.NewHeader(nil, []*sam.Reference{ref1})
+	umiTag := sam.NewTag("RX")
+	f := newDupFilter(dedupCollapse, umiTag, 511)
+
+	// read returns a read of a pair, with 50 aligned bases after clip
+	// soft-clipped ones.
+	read := func(name string, pos, clip, matePos int, reverse bool, umi string) *sam.Record {
+		flags := sam.Paired
+		if reverse {
+			flags |= sam.Reverse
+		} else {
+			flags |= sam.MateReverse
+		}
+		tlen := matePos + 50 - pos
+		if reverse {
+			tlen = -(pos + 50 - matePos)
+		}
+		r := &sam.Record{Name: name, Ref: ref1, Pos: pos, MateRef: ref1, MatePos: matePos, TempLen: tlen, Flags: flags}
+		if clip > 0 {
+			r.Cigar = append(r.Cigar, sam.NewCigarOp(sam.CigarSoftClipped, clip))
+		}
+		r.Cigar = append(r.Cigar, sam.NewCigarOp(sam.CigarMatch, 50))
+		if umi != "" {
+			aux, err := sam.NewAux(umiTag, umi)
+			assert.NoError(t, err)
+			r.AuxFields = sam.AuxFields{aux}
+		}
+		return r
+	}
+	// "a" and "b" are duplicates: "b" is soft-clipped by 2 bases, but has the
+	// same unclipped 5' end.  "c" has a different mate position, and "d" has a
+	// different UMI.  "e" has the same UMI as "a", written with a separator.
+	assert.True(t, f.keep(read("a", 100, 0, 200, false, "ACGTTT")))
+	assert.True(t, f.keep(read("c", 100, 0, 201, false, "ACGTTT")))
+	assert.True(t, f.keep(read("d", 100, 0, 200, false, "ACGTTA")))
+	assert.False(t, f.keep(read("b", 102, 2, 200, false, "ACGTTT")))
+	assert.False(t, f.keep(read("e", 100, 0, 200, false, "ACG-TTT")))
+	// The mates get the same decisions.
+	for _, name := range []string{"a", "c", "d"} {
+		assert.True(t, f.keep(read(name, 200, 0, 100, true, "")), name)
+	}
+	for _, name := range []string{"b", "e"} {
+		assert.False(t, f.keep(read(name, 200, 0, 100, true, "")), name)
+	}
+	assert.EQ(t, len(f.pending), 0)
+
+	// The 5' end of a reverse-strand read is its rightmost position.
+	unpaired := func(name string, pos, length int) *sam.Record {
+		return &sam.Record{Name: name, Ref: ref1, Pos: pos, Flags: sam.Reverse, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, length)}}
+	}
+	assert.True(t, f.keep(unpaired("f", 300, 50)))
+	assert.False(t, f.keep(unpaired("g", 310, 40)))
+	assert.True(t, f.keep(unpaired("h", 310, 50)))
+
+	// Sets that can't get more reads are pruned.
+	for i := 0; i < 1100; i++ {
+		assert.True(t, f.keep(unpaired(fmt.Sprint("p", i), 1000+i, 50)))
+	}
+	assert.True(t, len(f.sets) < 1024)
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/interval"
+)
+
+// depthHist is a sparse depth histogram: counts[d] is the number of positions
+// with depth d.
+type depthHist map[uint32]int64
+
+// depthHistSummary is the JSON form of a depthHist.  Depths, NPositions and
+// FracAtLeast are parallel arrays, in order of increasing depth, listing the
+// depths which occur at least once; FracAtLeast is the cumulative coverage
+// curve, i.e. the fraction of positions with at least that depth.
+type depthHistSummary struct {
+	Target      string    `json:"target"`
+	NPositions  int64     `json:"n_positions"`
+	MeanDepth   float64   `json:"mean_depth"`
+	Depths      []uint32  `json:"depths"`
+	Counts      []int64   `json:"counts"`
+	FracAtLeast []float64 `json:"frac_at_least"`
+}
+
+func (h depthHist) summary(target string) depthHistSummary {
+	s := depthHistSummary{Target: target}
+	for d := range h {
+		s.Depths = append(s.Depths, d)
+	}
+	sort.Slice(s.Depths, func(i, j int) bool { return s.Depths[i] < s.Depths[j] })
+	var depthSum float64
+	s.Counts = make([]int64, len(s.Depths))
+	for i, d := range s.Depths {
+		s.Counts[i] = h[d]
+		s.NPositions += h[d]
+		depthSum += float64(d) * float64(h[d])
+	}
+	if s.NPositions == 0 {
+		return s
+	}
+	s.MeanDepth = depthSum / float64(s.NPositions)
+	s.FracAtLeast = make([]float64, len(s.Depths))
+	atLeast := s.NPositions
+	for i, n := range s.Counts {
+		s.FracAtLeast[i] = float64(atLeast) / float64(s.NPositions)
+		atLeast -= n
+	}
+	return s
+}
+
+// depthHistTargetAll is the target name of the histogram of all positions.
+const depthHistTargetAll = "all"
+
+// computeDepthHists reads the pileupRows in tmpFiles, and returns the
+// histogram of the depths of all positions, followed by one histogram per
+// interval of bedUnion (overlapping BED intervals are merged), named like
+// "chr1:101-200" (1-based, inclusive).  Only positions with a row are
+// counted, so e.g. quarantined regions are left out.
+func computeDepthHists(tmpFiles []*os.File, bedUnion *interval.BEDUnion, refNames []string) ([]depthHistSummary, error) {
+	all := make(depthHist)
+	var targets []depthHistSummary
+	var (
+		cur       depthHist
+		curRefID  = -1
+		curTarget = -1
+		endpoints []PosType
+	)
+	flush := func() {
+		if cur != nil {
+			start, end := endpoints[2*curTarget], endpoints[2*curTarget+1]
+			name := refNames[curRefID] + ":" + strconv.Itoa(int(start)+1) + "-" + strconv.Itoa(int(end))
+			targets = append(targets, cur.summary(name))
+		}
+		cur = nil
+	}
+	for _, f := range tmpFiles {
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		scanner := newPileupRowScanner(f)
+		for scanner.Scan() {
+			pr := scanner.Get().(*pileupRow)
+			depth := pr.payload.depth
+			all[depth]++
+			if int(pr.refID) != curRefID {
+				flush()
+				curRefID = int(pr.refID)
+				endpoints = bedUnion.EndpointsByID(curRefID)
+			}
+			pos := PosType(pr.pos)
+			idx := sort.Search(len(endpoints), func(i int) bool { return endpoints[i] > pos })
+			if idx%2 == 0 {
+				// Not in any interval; can only happen with a bedUnion that
+				// doesn't match the rows.
+				continue
+			}
+			if idx/2 != curTarget || cur == nil {
+				flush()
+				curTarget = idx / 2
+				cur = make(depthHist)
+			}
+			cur[depth]++
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	flush()
+	return append([]depthHistSummary{all.summary(depthHistTargetAll)}, targets...), nil
+}
+
+// writeDepthHists writes the output of computeDepthHists to
+// <mainPath>.depth_hist.tsv, with TARGET, DEPTH, N_POSITIONS and
+// FRAC_AT_LEAST columns, and to <mainPath>.depth_hist.json, as a list of
+// depthHistSummary objects.
+func writeDepthHists(ctx context.Context, mainPath string, tmpFiles []*os.File, bedUnion *interval.BEDUnion, refNames []string) (err error) {
+	var hists []depthHistSummary
+	if hists, err = computeDepthHists(tmpFiles, bedUnion, refNames); err != nil {
+		return
+	}
+	if err = writeDepthHistTSV(ctx, mainPath+".depth_hist.tsv", hists); err != nil {
+		return
+	}
+	var dst file.File
+	if dst, err = file.Create(ctx, mainPath+".depth_hist.json"); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	enc := json.NewEncoder(dst.Writer(ctx))
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(hists); err != nil {
+		return
+	}
+	all := hists[0]
+	log.Printf("pileupSNPMain: %d positions with mean depth %.2f; see %s.depth_hist.{tsv,json}", all.NPositions, all.MeanDepth, mainPath)
+	return
+}
+
+func writeDepthHistTSV(ctx context.Context, path string, hists []depthHistSummary) (err error) {
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#TARGET\tDEPTH\tN_POSITIONS\tFRAC_AT_LEAST")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	for _, h := range hists {
+		for i, d := range h.Depths {
+			w.WriteString(h.Target)
+			w.WriteUint32(d)
+			w.WriteInt64(h.Counts[i])
+			w.WriteFloat64(h.FracAtLeast[i], 'g', 6)
+			if err = w.EndLine(); err != nil {
+				return
+			}
+		}
+	}
+	return w.Flush()
+}
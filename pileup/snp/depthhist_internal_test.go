@@ -0,0 +1,89 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestDepthHists(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	ref2, _ := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref1, ref2})
+	bedUnion, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 10, End: 13},
+		{RefName: "chr1", Start0: 20, End: 22},
+		{RefName: "chr2", Start0: 0, End: 2},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+
+	// The rows of the two jobs.
+	depths := [][][3]uint32{
+		{{0, 10, 5}, {0, 11, 5}, {0, 12, 0}, {0, 20, 2}},
+		{{0, 21, 5}, {1, 0, 1}, {1, 1, 1}},
+	}
+	var tmpFiles []*os.File
+	for _, job := range depths {
+		f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+		assert.NoError(t, err)
+		w := newPileupRowWriter(f, defaultShardCodec)
+		for _, d := range job {
+			pr := &pileupRow{fieldsPresent: fieldCounts, refID: d[0], pos: d[1]}
+			pr.payload.depth = d[2]
+			w.Append(pr)
+		}
+		assert.NoError(t, w.Finish())
+		tmpFiles = append(tmpFiles, f)
+	}
+
+	hists, err := computeDepthHists(tmpFiles, &bedUnion, []string{"chr1", "chr2"})
+	assert.NoError(t, err)
+	assert.EQ(t, hists, []depthHistSummary{
+		{
+			Target:      "all",
+			NPositions:  7,
+			MeanDepth:   19.0 / 7,
+			Depths:      []uint32{0, 1, 2, 5},
+			Counts:      []int64{1, 2, 1, 3},
+			FracAtLeast: []float64{1, 6.0 / 7, 4.0 / 7, 3.0 / 7},
+		},
+		{Target: "chr1:11-13", NPositions: 3, MeanDepth: 10.0 / 3, Depths: []uint32{0, 5}, Counts: []int64{1, 2}, FracAtLeast: []float64{1, 2.0 / 3}},
+		{Target: "chr1:21-22", NPositions: 2, MeanDepth: 3.5, Depths: []uint32{2, 5}, Counts: []int64{1, 1}, FracAtLeast: []float64{1, 0.5}},
+		{Target: "chr2:1-2", NPositions: 2, MeanDepth: 1, Depths: []uint32{1}, Counts: []int64{2}, FracAtLeast: []float64{1}},
+	})
+
+	mainPath := filepath.Join(tmpdir, "out")
+	assert.NoError(t, writeDepthHists(context.Background(), mainPath, tmpFiles, &bedUnion, []string{"chr1", "chr2"}))
+	tsvData, err := ioutil.ReadFile(mainPath + ".depth_hist.tsv")
+	assert.NoError(t, err)
+	assert.HasSubstr(t, string(tsvData), "#TARGET\tDEPTH\tN_POSITIONS\tFRAC_AT_LEAST\nall\t0\t1\t1\nall\t1\t2\t0.857143\n")
+	assert.HasSubstr(t, string(tsvData), "chr2:1-2\t1\t2\t1\n")
+	jsonData, err := ioutil.ReadFile(mainPath + ".depth_hist.json")
+	assert.NoError(t, err)
+	var decoded []depthHistSummary
+	assert.NoError(t, json.Unmarshal(jsonData, &decoded))
+	assert.EQ(t, decoded, hists)
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+)
+
+// depthSketch summarizes all the reads with one base at one position, once
+// their number exceeds Opts.SketchDepth and the per-read features are
+// reservoir-sampled.  The quantiles are estimated from the reservoir, which
+// is a uniform sample of the reads, but the means are exact.
+type depthSketch struct {
+	// n is the number of reads, and the sums are over all of them.
+	n                              uint32
+	qualSum, dist5pSum, fraglenSum uint64
+}
+
+// add adds the features of one read to s.
+func (s *depthSketch) add(f *perReadFeatures) {
+	s.n++
+	s.qualSum += uint64(f.qual)
+	s.dist5pSum += uint64(f.dist5p)
+	s.fraglenSum += uint64(f.fraglen)
+}
+
+// depthSketchSize is the size of the encoding of a depthSketch.
+const depthSketchSize = 4 + 3*8
+
+// encodeDepthSketches returns the data of the extensionTagDepthSketch
+// extension: the depthSketches of pileup.BaseA..BaseT, in that order, with n
+// = 0 for the bases whose features weren't sampled.
+func encodeDepthSketches(sketches *[pileup.NBase]depthSketch) []byte {
+	data := make([]byte, pileup.NBase*depthSketchSize)
+	for b := range sketches {
+		s := &sketches[b]
+		buf := data[b*depthSketchSize:]
+		binary.LittleEndian.PutUint32(buf, s.n)
+		binary.LittleEndian.PutUint64(buf[4:], s.qualSum)
+		binary.LittleEndian.PutUint64(buf[12:], s.dist5pSum)
+		binary.LittleEndian.PutUint64(buf[20:], s.fraglenSum)
+	}
+	return data
+}
+
+// decodeDepthSketch returns the depthSketch of base in the data of an
+// extensionTagDepthSketch extension.  n is 0 if data is empty or invalid.
+func decodeDepthSketch(data []byte, base int) depthSketch {
+	if len(data) != pileup.NBase*depthSketchSize {
+		return depthSketch{}
+	}
+	buf := data[base*depthSketchSize:]
+	return depthSketch{
+		n:          binary.LittleEndian.Uint32(buf),
+		qualSum:    binary.LittleEndian.Uint64(buf[4:]),
+		dist5pSum:  binary.LittleEndian.Uint64(buf[12:]),
+		fraglenSum: binary.LittleEndian.Uint64(buf[20:]),
+	}
+}
+
+// parseSketchDepth validates Opts.SketchDepth.
+func parseSketchDepth(sketchDepth int) (int, error) {
+	if sketchDepth < 0 {
+		return 0, fmt.Errorf("Pileup: invalid sketch-depth= argument %d", sketchDepth)
+	}
+	return sketchDepth, nil
+}
+
+// appendSampledFeatures adds the features f of a read with the given base at
+// circPos to row.perRead, where row is the ring-buffer row at circPos.  Once
+// there are more than pm.sketchDepth of them, it replaces a random one
+// (Vitter's algorithm R), and accumulates the sketch of the row's base.
+func (pm *pileupMutable) appendSampledFeatures(row *pileupPayload, circPos PosType, base byte, f perReadFeatures) {
+	features := row.perRead[base]
+	if len(features) < pm.sketchDepth {
+		row.perRead[base] = append(features, f)
+		return
+	}
+	sketches := pm.sketches[circPos]
+	if sketches == nil {
+		sketches = new([pileup.NBase]depthSketch)
+		pm.sketches[circPos] = sketches
+	}
+	s := &sketches[base]
+	if s.n == 0 {
+		// The first read past the threshold: the sketch starts with the
+		// reads kept so far.
+		for i := range features {
+			s.add(&features[i])
+		}
+	}
+	s.add(&f)
+	if j := pm.sketchRand.Int63n(int64(s.n)); j < int64(len(features)) {
+		features[j] = f
+	}
+}
+
+// flushSketches moves the sketches of the ring-buffer row at circPos, if
+// any, to an extension of the row.
+func (pm *pileupMutable) flushSketches(row *pileupPayload, circPos PosType) {
+	if sketches := pm.sketches[circPos]; sketches != nil {
+		row.setExtension(extensionTagDepthSketch, encodeDepthSketches(sketches))
+		delete(pm.sketches, circPos)
+	}
+}
+
+// sketchTSVColumns are the columns of the sketch column set.
+var sketchTSVColumns = []string{"SKETCH_N", "QUAL_MEAN", "QUAL_QUARTILES", "5P_DIST_MEAN", "5P_DIST_QUARTILES", "FRAGLEN_MEAN", "FRAGLEN_QUARTILES"}
+
+// sketchEmpty is written in place of the sketch columns of an allele without
+// per-read features.
+var sketchEmpty = []byte(".\t.\t.\t.\t.\t.\t.\t")
+
+// writeSketchCols writes the sketch column set for the reads with the given
+// base at a position: their number, and the mean and quartiles of their
+// quality, 5' distance and fragment length.  features are the per-read
+// features of the base, and sketchData is the data of the row's
+// extensionTagDepthSketch extension (nil if the row has none).
+func writeSketchCols(w *tsv.Writer, features []perReadFeatures, sketchData []byte, base int) {
+	if len(features) == 0 {
+		w.WritePartialBytes(sketchEmpty)
+		return
+	}
+	s := decodeDepthSketch(sketchData, base)
+	if s.n == 0 {
+		// All the reads were kept.
+		for i := range features {
+			s.add(&features[i])
+		}
+	}
+	w.WriteUint32(s.n)
+	vals := make([]int, len(features))
+	for _, field := range []struct {
+		sum   uint64
+		value func(*perReadFeatures) int
+	}{
+		{s.qualSum, func(f *perReadFeatures) int { return int(f.qual) }},
+		{s.dist5pSum, func(f *perReadFeatures) int { return int(f.dist5p) }},
+		{s.fraglenSum, func(f *perReadFeatures) int { return int(f.fraglen) }},
+	} {
+		w.WriteFloat64(float64(field.sum)/float64(s.n), 'f', 1)
+		for j := range features {
+			vals[j] = field.value(&features[j])
+		}
+		sort.Ints(vals)
+		for _, q := range []int{1, 2, 3} {
+			// Nearest-rank quartiles.
+			w.WriteCsvUint32(uint32(vals[(q*len(vals)+3)/4-1]))
+		}
+		w.EndCsv()
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestDepthSketchSampling(t *testing.T) {
+	pm := pileupMutable{
+		sketchDepth: 10,
+		sketches:    make(map[PosType]*[pileup.NBase]depthSketch),
+		sketchRand:  rand.New(rand.NewSource(1)),
+	}
+	var row pileupPayload
+	var want depthSketch
+	for i := 0; i < 1000; i++ {
+		f := perReadFeatures{dist5p: uint32(i % 100), fraglen: uint32(150 + i%7), qual: byte(i % 41)}
+		want.add(&f)
+		pm.appendSampledFeatures(&row, 5, pileup.BaseC, f)
+	}
+	// A base below the threshold keeps all its features.
+	pm.appendSampledFeatures(&row, 5, pileup.BaseG, perReadFeatures{qual: 30})
+	assert.EQ(t, len(row.perRead[pileup.BaseC]), 10)
+	assert.EQ(t, len(row.perRead[pileup.BaseG]), 1)
+	assert.EQ(t, *pm.sketches[5], [pileup.NBase]depthSketch{pileup.BaseC: want})
+
+	pm.flushSketches(&row, 5)
+	assert.EQ(t, len(pm.sketches), 0)
+	data := row.extension(extensionTagDepthSketch)
+	assert.EQ(t, decodeDepthSketch(data, int(pileup.BaseC)), want)
+	assert.EQ(t, decodeDepthSketch(data, int(pileup.BaseG)), depthSketch{})
+	assert.EQ(t, decodeDepthSketch(nil, int(pileup.BaseC)), depthSketch{})
+}
+
+func TestWriteSketchCols(t *testing.T) {
+	features := []perReadFeatures{
+		{dist5p: 10, fraglen: 100, qual: 20},
+		{dist5p: 30, fraglen: 200, qual: 40},
+		{dist5p: 20, fraglen: 150, qual: 30},
+		{dist5p: 40, fraglen: 250, qual: 10},
+	}
+	sketches := [pileup.NBase]depthSketch{
+		pileup.BaseT: {n: 8, qualSum: 200, dist5pSum: 400, fraglenSum: 1600},
+	}
+	data := encodeDepthSketches(&sketches)
+
+	var buf bytes.Buffer
+	w := tsv.NewWriter(&buf)
+	// Without a sketch, the statistics are over the features.
+	writeSketchCols(w, features, data, int(pileup.BaseA))
+	assert.NoError(t, w.EndLine())
+	// With one, the number and means come from it.
+	writeSketchCols(w, features, data, int(pileup.BaseT))
+	assert.NoError(t, w.EndLine())
+	writeSketchCols(w, nil, data, int(pileup.BaseC))
+	assert.NoError(t, w.EndLine())
+	assert.NoError(t, w.Flush())
+	assert.EQ(t, buf.String(), ""+
+		"4\t25.0\t10,20,30\t25.0\t10,20,30\t175.0\t100,150,200\n"+
+		"8\t25.0\t10,20,30\t50.0\t10,20,30\t200.0\t100,150,200\n"+
+		".\t.\t.\t.\t.\t.\t.\n")
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// fraglenNone is the stratum of reads without a usable fragment length.
+const fraglenNone = -1
+
+// pendingFragment is the sampling decision for a fragment whose second read
+// hasn't been seen yet.
+type pendingFragment struct {
+	keep    bool
+	mateRef int
+	matePos int
+}
+
+// mateDecisions remembers the keep/drop decisions made on the first read of
+// fragments, so that the second read gets the same decision.  Reads must be
+// passed in coordinate order.
+type mateDecisions struct {
+	pending map[string]pendingFragment
+	pruneAt int
+}
+
+func newMateDecisions() mateDecisions {
+	return mateDecisions{pending: make(map[string]pendingFragment), pruneAt: 1024}
+}
+
+// take returns the decision made on the mate of r, if any, and forgets it.
+func (d *mateDecisions) take(r *sam.Record) (keep, ok bool) {
+	if fragmentLength(r) == fraglenNone {
+		return false, false
+	}
+	p, ok := d.pending[r.Name]
+	if ok {
+		delete(d.pending, r.Name)
+	}
+	return p.keep, ok
+}
+
+// put records the decision made on r, if its mate is still to come.
+func (d *mateDecisions) put(r *sam.Record, keep bool) {
+	if (fragmentLength(r) == fraglenNone) || (r.MatePos < r.Pos) {
+		return
+	}
+	d.pending[r.Name] = pendingFragment{keep: keep, mateRef: r.Ref.ID(), matePos: r.MatePos}
+	if len(d.pending) >= d.pruneAt {
+		d.prune(r.Ref.ID(), r.Pos)
+	}
+}
+
+// prune forgets the fragments whose second read should already have been
+// seen, e.g. because it was removed by another filter.
+func (d *mateDecisions) prune(refID, pos int) {
+	for name, p := range d.pending {
+		if (p.mateRef < refID) || ((p.mateRef == refID) && (p.matePos < pos)) {
+			delete(d.pending, name)
+		}
+	}
+	d.pruneAt = 2 * len(d.pending)
+	if d.pruneAt < 1024 {
+		d.pruneAt = 1024
+	}
+}
+
+// fraglenSampler downsamples fragments (Opts.DownsampleFrac), stratified by
+// fragment length.  Fragments are assigned to binWidth-wide fragment-length
+// bins, and within each bin, the fragments are sampled systematically (see
+// systematicStrata).  So every bin keeps frac of its fragments, up to
+// rounding, and the fragment-length distribution of the output matches that
+// of the input much more closely than with independent per-read coin flips,
+// which matters for cfDNA size profiles.
+//
+// Both reads of a pair get the same decision, as long as they are processed
+// by the same job: the decision is made on the first read and remembered
+// until the second shows up.
+type fraglenSampler struct {
+	mateDecisions
+	systematicStrata
+	frac     float64
+	binWidth int
+}
+
+func newFraglenSampler(frac float64, binWidth int) *fraglenSampler {
+	return &fraglenSampler{
+		mateDecisions: newMateDecisions(),
+		frac:          frac,
+		binWidth:      binWidth,
+	}
+}
+
+// fragmentLength returns the absolute template length of r, or fraglenNone
+// if r isn't part of a pair with both reads mapped to the same reference.
+func fragmentLength(r *sam.Record) int {
+	if (r.Flags&(sam.Paired|sam.Unmapped|sam.MateUnmapped) != sam.Paired) || (r.MateRef != r.Ref) || (r.TempLen == 0) {
+		return fraglenNone
+	}
+	if r.TempLen < 0 {
+		return -r.TempLen
+	}
+	return r.TempLen
+}
+
+// keep returns true if r should be kept.  Reads must be passed in coordinate
+// order.
+func (s *fraglenSampler) keep(r *sam.Record) bool {
+	if keep, ok := s.take(r); ok {
+		return keep
+	}
+	bin := fragmentLength(r)
+	if bin != fraglenNone {
+		bin /= s.binWidth
+	}
+	keep := s.next(float64(bin), s.frac)
+	s.put(r, keep)
+	return keep
+}
+
+// systematicStrata samples the items of each stratum systematically: with a
+// phase u drawn uniformly from [0, 1) for the stratum, its i'th (0-based)
+// item is kept iff floor((i+1)*frac+u) > floor(i*frac+u).  So each stratum
+// keeps frac of its items, up to rounding, and the random phase makes the
+// expected fraction exactly frac.  The strata restart at every shard, with
+// phases drawn from the shard's random source (see pileupSNPOpts.shardRand),
+// so that the decisions on a shard's reads don't depend on the shards
+// processed before it by the same job.
+type systematicStrata struct {
+	rng *rand.Rand
+	// seen is the number of items seen so far in each stratum of the shard,
+	// and phase the phase of the stratum.
+	seen  map[float64]int64
+	phase map[float64]float64
+}
+
+// startShard restarts the strata, with phases drawn from rng.
+func (s *systematicStrata) startShard(rng *rand.Rand) {
+	s.rng = rng
+	s.seen = make(map[float64]int64)
+	s.phase = make(map[float64]float64)
+}
+
+// next returns true if the next item of the given stratum is kept, when
+// sampling a fraction frac of the stratum.
+func (s *systematicStrata) next(stratum, frac float64) bool {
+	u, ok := s.phase[stratum]
+	if !ok {
+		u = s.rng.Float64()
+		s.phase[stratum] = u
+	}
+	i := s.seen[stratum]
+	s.seen[stratum] = i + 1
+	return systematicKeep(i, frac, u)
+}
+
+// systematicKeep returns true if the i'th (0-based) item of a stratum is kept
+// when sampling a fraction frac of the stratum systematically with phase u.
+func systematicKeep(i int64, frac, u float64) bool {
+	return math.Floor(float64(i+1)*frac+u) > math.Floor(float64(i)*frac+u)
+}
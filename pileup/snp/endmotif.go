@@ -0,0 +1,161 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/hts/sam"
+)
+
+// endMotifWeights are the keep probabilities of fragment ends, indexed by end
+// motif (see endMotif).
+type endMotifWeights struct {
+	weights [nEndMotif]float64
+	// desc describes the weights for provenance metadata.
+	desc string
+}
+
+// parseEndMotifWeights parses an end-motif weight table (Opts.EndMotifWeights):
+// one "<motif>\t<weight>" line per motif, where motif is a 4-mer and weight
+// is in [0, 1].  Blank lines and lines starting with '#' are ignored, and
+// motifs which aren't listed get weight 1.
+func parseEndMotifWeights(r io.Reader) (*endMotifWeights, error) {
+	w := &endMotifWeights{}
+	for i := range w.weights {
+		w.weights[i] = 1
+	}
+	h := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(r, h))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || (line[0] == '#') {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != endMotifLen {
+			return nil, fmt.Errorf("end-motif weights line %d: expected <%d-mer> <weight>, got %q", lineNum, endMotifLen, line)
+		}
+		motif := 0
+		for _, c := range []byte(strings.ToUpper(fields[0])) {
+			b := strings.IndexByte("ACGT", c)
+			if b < 0 {
+				return nil, fmt.Errorf("end-motif weights line %d: invalid motif %s", lineNum, fields[0])
+			}
+			motif = motif<<2 | b
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || !(weight >= 0 && weight <= 1) {
+			return nil, fmt.Errorf("end-motif weights line %d: weight must be in [0, 1], got %s", lineNum, fields[1])
+		}
+		w.weights[motif] = weight
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	w.desc = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return w, nil
+}
+
+// loadEndMotifWeights reads the end-motif weight table at path.
+func loadEndMotifWeights(ctx context.Context, path string) (w *endMotifWeights, err error) {
+	var f file.File
+	if f, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	if w, err = parseEndMotifWeights(f.Reader(ctx)); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	w.desc = path + " " + w.desc
+	return
+}
+
+// endMotifFilter keeps each fragment with probability equal to the product
+// of the weights of its two end motifs (Opts.EndMotifWeights), to correct for
+// end-motif biases of the library preparation.  A read without a usable
+// fragment length is treated as a fragment with one end, its own 5' end.
+// Motifs are taken from the reference, as in the fragmentomics features, and
+// ends whose motif runs off the reference or contains an N get weight 1.
+//
+// Like fraglenSampler, endMotifFilter samples systematically instead of
+// flipping coins: fragments are stratified by weight, and each stratum keeps
+// the expected fraction of its fragments, up to rounding.  Both reads of a
+// pair get the same decision, as long as they are processed by the same job.
+type endMotifFilter struct {
+	mateDecisions
+	systematicStrata
+	weights *endMotifWeights
+	refSeqs [][]byte
+}
+
+func newEndMotifFilter(weights *endMotifWeights, refSeqs [][]byte) *endMotifFilter {
+	return &endMotifFilter{
+		mateDecisions: newMateDecisions(),
+		weights:       weights,
+		refSeqs:       refSeqs,
+	}
+}
+
+func (f *endMotifFilter) endWeight(refSeq8 []byte, pos int, reverse bool) float64 {
+	if motif := endMotif(refSeq8, pos, reverse); motif >= 0 {
+		return f.weights.weights[motif]
+	}
+	return 1
+}
+
+// weight returns the weight of the fragment of r.
+func (f *endMotifFilter) weight(r *sam.Record) float64 {
+	refSeq8 := f.refSeqs[r.Ref.ID()]
+	fraglen := fragmentLength(r)
+	if fraglen == fraglenNone {
+		if (r.Flags & sam.Reverse) == 0 {
+			return f.endWeight(refSeq8, r.Pos, false)
+		}
+		end := r.End()
+		if end <= r.Pos {
+			return 1
+		}
+		return f.endWeight(refSeq8, end-1, true)
+	}
+	// The fragment covers [start, start+fraglen).
+	start := r.Pos
+	if r.TempLen < 0 {
+		start = r.End() - fraglen
+	}
+	return f.endWeight(refSeq8, start, false) * f.endWeight(refSeq8, start+fraglen-1, true)
+}
+
+// keep returns true if r should be kept.  Reads must be passed in coordinate
+// order.
+func (f *endMotifFilter) keep(r *sam.Record) bool {
+	if keep, ok := f.take(r); ok {
+		return keep
+	}
+	w := f.weight(r)
+	keep := true
+	if w < 1 {
+		keep = f.next(w, w)
+	}
+	f.put(r, keep)
+	return keep
+}
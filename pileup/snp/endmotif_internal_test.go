@@ -0,0 +1,83 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseEndMotifWeights(t *testing.T) {
+	w, err := parseEndMotifWeights(strings.NewReader("# motif\tweight\nGTAC\t0\n\nacgt 0.5\n"))
+	assert.NoError(t, err)
+	const gtac, acgt = 2<<6 | 3<<4 | 0<<2 | 1, 0<<6 | 1<<4 | 2<<2 | 3
+	assert.EQ(t, w.weights[gtac], 0.0)
+	assert.EQ(t, w.weights[acgt], 0.5)
+	assert.EQ(t, w.weights[0], 1.0)
+	assert.True(t, strings.HasPrefix(w.desc, "sha256:"))
+
+	for _, bad := range []string{"GTA\t0\n", "GTAN\t0\n", "GTAC\t1.5\n", "GTAC\t-1\n", "GTAC\n"} {
+		_, err := parseEndMotifWeights(strings.NewReader(bad))
+		assert.HasSubstr(t, fmt.Sprint(err), "line 1")
+	}
+}
+
+func TestEndMotifFilter(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	_, _ = sam.NewHeader(nil, []*sam.Reference{ref1})
+	refSeq8 := []byte(strings.Repeat("ACGT", 250))
+	for i, c := range refSeq8 {
+		refSeq8[i] = map[byte]byte{'A': 1, 'C': 2, 'G': 4, 'T': 8}[c]
+	}
+	w, err := parseEndMotifWeights(strings.NewReader("GTAC\t0\nACGT\t0.5\n"))
+	assert.NoError(t, err)
+	f := newEndMotifFilter(w, [][]byte{refSeq8})
+	f.startShard(rand.New(rand.NewSource(1)))
+
+	pair := func(name string, pos, matePos, tlen int, reverse bool) *sam.Record {
+		flags := sam.Paired
+		var cigar sam.Cigar
+		if reverse {
+			flags |= sam.Reverse
+			cigar = sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 41)}
+		}
+		return &sam.Record{Name: name, Ref: ref1, Pos: pos, MateRef: ref1, MatePos: matePos, TempLen: tlen, Flags: flags, Cigar: cigar}
+	}
+	// Fragment "a" covers [10, 130), and both of its end motifs are GTAC, with
+	// weight 0.
+	assert.EQ(t, f.keep(pair("a", 10, 89, 120, false)), false)
+	// Fragments "b0".."b3" cover [20, 141); the motif of their left end is ACGT,
+	// with weight 0.5, and the motif of their right end is TACG, with weight 1.
+	// Systematic sampling keeps every other one.
+	var keepB [4]bool
+	for i := range keepB {
+		keepB[i] = f.keep(pair(fmt.Sprintf("b%d", i), 20, 100, 121, false))
+	}
+	assert.EQ(t, keepB[0], keepB[2])
+	assert.EQ(t, keepB[1], keepB[3])
+	assert.True(t, keepB[0] != keepB[1])
+	// An unpaired read whose 5' end motif is GTAC.
+	assert.EQ(t, f.keep(&sam.Record{Name: "c", Ref: ref1, Pos: 30}), false)
+	// The mates get the same decisions.
+	assert.EQ(t, f.keep(pair("a", 89, 10, -120, true)), false)
+	for i := range keepB {
+		assert.EQ(t, f.keep(pair(fmt.Sprintf("b%d", i), 100, 20, -121, true)), keepB[i])
+	}
+	assert.EQ(t, len(f.pending), 0)
+}
@@ -0,0 +1,329 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/traverse"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/pileup"
+)
+
+// Executor runs the tasks of the main loop of a pileup run (Opts.Executor)
+// somewhere other than the calling process, e.g. on a bigslice or bigmachine
+// cluster, so that whole-genome high-depth pileups can scale beyond a single
+// machine.  The driver (the process that called Pileup or PileupSamples) then
+// merges the tasks' outputs into the final output files.
+type Executor interface {
+	// Run runs every task, by calling RunTask(ctx, task) on a worker with the
+	// same inputs as the driver available under the same paths, and returns
+	// when all of them have succeeded, or when one has failed for good.
+	// Retrying failed tasks, and running them in parallel, is up to the
+	// executor.
+	Run(ctx context.Context, tasks []Task) error
+}
+
+// Task is a main-loop task of a pileup run with an Executor: the pileup of one
+// job's shards, for one sample and strand.  Its rows are written to OutPath,
+// and a manifest entry with its read census to OutPath + ".json".
+//
+// A Task is serializable with encoding/json and encoding/gob, so that it can
+// be shipped to a worker.  Opts.Hooks, Opts.NewRandSource and Opts.Executor
+// are not serialized; they can't be combined with an Executor.
+type Task struct {
+	// Index is the index of the task within its pass over the genome.
+	Index int
+	// XAMPaths, FAPath, Format and Opts are the arguments of the run.  Opts
+	// has its Parallelism resolved, since it determines the shards.
+	XAMPaths []string
+	FAPath   string
+	Format   string
+	Opts     Opts
+	// Strand is the strand of the pass (pileup.StrandNone unless
+	// Opts.PerStrand is set).
+	Strand pileup.StrandType
+	// Sample is the index of the task's input in XAMPaths.
+	Sample int
+	// ShardStart and ShardEnd delimit the task's shards among those of the
+	// run.  Shards are their coordinate ranges on the driver, so that a worker
+	// which sees different inputs (or computes different shards) fails
+	// instead of silently producing different results.
+	ShardStart int
+	ShardEnd   int
+	Shards     []string
+	// OutPath is where the task writes its rows, typically under an S3
+	// prefix.
+	OutPath string
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, which encoding/gob uses
+// in place of its own encoding: gob can't encode Opts.Hooks.
+func (t *Task) MarshalBinary() ([]byte, error) {
+	return json.Marshal(t)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (t *Task) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, t)
+}
+
+// executorRun holds what the driver of a run with an Executor needs to create
+// the run's tasks.
+type executorRun struct {
+	executor Executor
+	dir      string
+	xampaths []string
+	fapath   string
+	format   string
+	rawOpts  Opts
+}
+
+// checkExecutorOpts rejects the options which can't be combined with
+// Opts.Executor: those that need callbacks into the driver, and those whose
+// side outputs are accumulated in the driver's memory during the main loop.
+func checkExecutorOpts(opts *pileupSNPOpts, rawOpts *Opts) error {
+	if opts.emit != nil {
+		return fmt.Errorf("StreamPileup: Executor is not supported")
+	}
+	if rawOpts.ExecutorDir == "" {
+		return fmt.Errorf("Pileup: Executor requires ExecutorDir")
+	}
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"Hooks", rawOpts.Hooks != nil},
+		{"NewRandSource", rawOpts.NewRandSource != nil},
+		{"resume=", rawOpts.Resume},
+		{"shard-retries=", rawOpts.ShardRetries > 0},
+		{"quarantine=", rawOpts.Quarantine},
+		{"time-budget=", rawOpts.TimeBudget > 0},
+		{"shard-plan-out=", rawOpts.ShardPlanOut != ""},
+		{"fragmentomics-window=", rawOpts.FragmentomicsWindow > 0},
+		{"haplotype-sites=", rawOpts.HaplotypeSites != ""},
+		{"het-sites=", rawOpts.HetSites != ""},
+		{"metrics=", rawOpts.Metrics != ""},
+	} {
+		if o.set {
+			return fmt.Errorf("Pileup: Executor cannot be combined with %s", o.name)
+		}
+	}
+	return nil
+}
+
+// newExecutorRun returns the executorRun of a run.  format is the run's
+// output format.
+func newExecutorRun(opts *pileupSNPOpts, xampaths []string, fapath string, format outputFormat, rawOpts *Opts) *executorRun {
+	r := &executorRun{
+		executor: rawOpts.Executor,
+		dir:      rawOpts.ExecutorDir,
+		xampaths: xampaths,
+		fapath:   fapath,
+		rawOpts:  *rawOpts,
+	}
+	for name, f := range formatNameMap {
+		if f == format {
+			r.format = name
+			break
+		}
+	}
+	r.rawOpts.Parallelism = opts.parallelism
+	return r
+}
+
+// taskPath returns the output path of the given task of a pass.
+func (r *executorRun) taskPath(strandReq pileup.StrandType, taskIdx int) string {
+	return file.Join(r.dir, "pileup_task_s"+strconv.Itoa(int(strandReq))+"_"+strconv.Itoa(taskIdx)+".rio")
+}
+
+// run runs the main-loop tasks of a pass with the executor, and copies their
+// outputs to tmpFiles.  On success, resumed[i] is the manifest entry of task
+// i, so that the main loop only merges the tasks' read censuses.
+// jobBounds(j) returns the bounds of job j's shards in opts.shards.
+func (r *executorRun) run(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.StrandType, parallelism int, jobBounds func(int) (int, int), tmpFiles []*os.File, resumed []*checkpointEntry) error {
+	tasks := make([]Task, len(tmpFiles))
+	for taskIdx := range tasks {
+		start, end := jobBounds(taskIdx % parallelism)
+		t := Task{
+			Index:      taskIdx,
+			XAMPaths:   r.xampaths,
+			FAPath:     r.fapath,
+			Format:     r.format,
+			Opts:       r.rawOpts,
+			Strand:     strandReq,
+			Sample:     taskIdx / parallelism,
+			ShardStart: start,
+			ShardEnd:   end,
+			OutPath:    r.taskPath(strandReq, taskIdx),
+		}
+		for _, shard := range opts.shards[start:end] {
+			t.Shards = append(t.Shards, shardString(shard))
+		}
+		tasks[taskIdx] = t
+	}
+	log.Printf("pileupSNPMain: running %d tasks with the executor", len(tasks))
+	if err := r.executor.Run(ctx, tasks); err != nil {
+		return fmt.Errorf("pileupSNPMain: executor: %v", err)
+	}
+	return traverse.Limit(opts.parallelism).Each(len(tasks), func(taskIdx int) error {
+		e, err := fetchTaskOutput(ctx, tasks[taskIdx].OutPath, tmpFiles[taskIdx])
+		if err != nil {
+			return err
+		}
+		if e.Task != taskIdx {
+			return fmt.Errorf("pileupSNPMain: %s is the output of task %d, not %d", tasks[taskIdx].OutPath, e.Task, taskIdx)
+		}
+		resumed[taskIdx] = e
+		return nil
+	})
+}
+
+func shardString(shard gbam.Shard) string {
+	return fmt.Sprint(gbam.ShardToCoordRange(shard))
+}
+
+// fetchTaskOutput copies the rows of the task at path to f, verifies them
+// against the task's manifest entry, and deletes the task's files.
+func fetchTaskOutput(ctx context.Context, path string, f *os.File) (*checkpointEntry, error) {
+	data, err := file.ReadFile(ctx, path+".json")
+	if err != nil {
+		return nil, err
+	}
+	entry := &checkpointEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("pileupSNPMain: %s.json: %v", path, err)
+	}
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), in.Reader(ctx))
+	if e := in.Close(ctx); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	if (n != entry.Size) || (hex.EncodeToString(h.Sum(nil)) != entry.SHA256) {
+		return nil, fmt.Errorf("pileupSNPMain: %s doesn't match its manifest entry", path)
+	}
+	for _, p := range []string{path, path + ".json"} {
+		if err = file.Remove(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+// RunTask runs a Task created by an Executor, typically on a worker machine.
+// The reference is loaded from Task.FAPath.
+func RunTask(ctx context.Context, task Task) error {
+	f, ok := formatNameMap[task.Format]
+	if !ok {
+		return fmt.Errorf("RunTask: unrecognized format %q", task.Format)
+	}
+	if (task.Sample < 0) || (task.Sample >= len(task.XAMPaths)) {
+		return fmt.Errorf("RunTask: invalid sample %d", task.Sample)
+	}
+	return pileupInternal(ctx, task.XAMPaths, task.FAPath, f, "", &task.Opts, nil, nil, &task)
+}
+
+// runTask runs the task on the run set up by pileupInternal.
+func runTask(ctx context.Context, opts *pileupSNPOpts, task *Task) (err error) {
+	if (task.ShardStart < 0) || (task.ShardEnd < task.ShardStart) || (task.ShardEnd > len(opts.shards)) {
+		return fmt.Errorf("RunTask: task %d has shards [%d, %d), but the run has %d", task.Index, task.ShardStart, task.ShardEnd, len(opts.shards))
+	}
+	shardSlice := opts.shards[task.ShardStart:task.ShardEnd]
+	if len(shardSlice) != len(task.Shards) {
+		return fmt.Errorf("RunTask: task %d has %d shards, but the worker computed %d", task.Index, len(task.Shards), len(shardSlice))
+	}
+	for i, shard := range shardSlice {
+		if s := shardString(shard); s != task.Shards[i] {
+			return fmt.Errorf("RunTask: task %d shard %d is %s on the driver, but %s on the worker; do they see the same inputs?", task.Index, i, task.Shards[i], s)
+		}
+	}
+	if len(opts.samples) > 0 {
+		opts.provider = opts.samples[task.Sample].provider
+	}
+	var qpt qualPassTable
+	if qpt, err = newQualPassTable(byte(opts.minBaseQual)); err != nil {
+		return
+	}
+	header, err := opts.provider.GetHeader()
+	if err != nil {
+		return
+	}
+
+	// The rows go to a local file first, so that the task's output only
+	// appears once it is complete.
+	if opts.tempDir != "" {
+		if err = os.MkdirAll(opts.tempDir, 0644); err != nil {
+			return
+		}
+	}
+	tmpFile, err := ioutil.TempFile(opts.tempDir, "pileup_task"+strconv.Itoa(task.Index)+"_*.rio")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := tmpFile.Close(); e != nil && err == nil {
+			err = e
+		}
+		if e := os.Remove(tmpFile.Name()); e != nil && err == nil {
+			err = e
+		}
+	}()
+	census := newReadCensus(len(header.Refs()))
+	if err = pileupJob(opts, task.Strand, shardSlice, newPileupRowWriter(tmpFile, opts.shardCodec), circBufferSize(opts), &qpt, census, nil, nil, nil, nil, nil, nil); err != nil {
+		return
+	}
+	if _, err = tmpFile.Seek(0, 0); err != nil {
+		return
+	}
+	e := checkpointEntry{Task: task.Index, Census: census.counts, Lengths: census.lengths}
+	if e.Size, e.SHA256, err = uploadTaskOutput(ctx, tmpFile, task.OutPath); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = json.Marshal(e); err != nil {
+		return
+	}
+	return file.WriteFile(ctx, task.OutPath+".json", data)
+}
+
+// uploadTaskOutput copies r to path, and returns its size and SHA-256.
+func uploadTaskOutput(ctx context.Context, r io.Reader, path string) (n int64, sum string, err error) {
+	var out file.File
+	if out, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, out, &err)
+	h := sha256.New()
+	if n, err = io.Copy(io.MultiWriter(out.Writer(ctx), h), r); err != nil {
+		return
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
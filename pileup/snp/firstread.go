@@ -46,6 +46,10 @@ type readSNP struct {
 	// read processing to decide whether/when to handle the read, and it is a
 	// little bit expensive to compute so we keep it around.
 	mapEnd PosType
+	// nm caches the read's edit distance (see readEditDistance) once nmCached
+	// is set.
+	nm       int
+	nmCached bool
 }
 
 // augSamr is a slightly-augmented *sam.Record.
@@ -54,6 +58,10 @@ type augSamr struct {
 	samr *sam.Record
 	// mapEnd caches the read end position.
 	mapEnd PosType
+	// nm and nmCached carry the read's cached edit distance (see readSNP)
+	// while it waits in the firstread-table.
+	nm       int
+	nmCached bool
 }
 
 // convertSamr extracts the pileup-relevant fields of a *sam.Record.
@@ -64,6 +72,15 @@ func convertSamr(read *readSNP, samr *sam.Record) {
 		biosimd.UnpackSeq(read.seq8, gbam.UnsafeDoubletsToBytes(samr.Seq.Seq))
 	}
 	read.samr = samr
+	read.nmCached = false
+}
+
+// convertAugSamr is convertSamr for a read taken from the firstread-table; it
+// keeps the read's cached edit distance.
+func convertAugSamr(read *readSNP, rec augSamr) {
+	convertSamr(read, rec.samr)
+	read.mapEnd = rec.mapEnd
+	read.nm, read.nmCached = rec.nm, rec.nmCached
 }
 
 // Size of readName hash tables.  Currently must be a power of 2, and less than
@@ -130,9 +147,9 @@ func (frt *firstreadSNPTable) remove(pos PosType, hashrem uint32, i int) {
 }
 
 // tryRemove tries to remove the read with the given readName, position, and
-// MatePos from the table.  Returns (*sam.Record, mapEnd) on success, nil on
-// failure.
-func (frt *firstreadSNPTable) tryRemove(samr *sam.Record) (*sam.Record, PosType) {
+// MatePos from the table.  Returns (the read's augSamr, true) on success,
+// false on failure.
+func (frt *firstreadSNPTable) tryRemove(samr *sam.Record) (augSamr, bool) {
 	expectedMatePos := samr.Pos
 	pos := PosType(samr.MatePos)
 	nCirc := frt.nCirc()
@@ -145,10 +162,10 @@ func (frt *firstreadSNPTable) tryRemove(samr *sam.Record) (*sam.Record, PosType)
 		if (rec.samr.MatePos == expectedMatePos) && (rec.samr.Name == readName) {
 			// Found the read; now remove it from the table.
 			frt.remove(pos, hashrem, i)
-			return rec.samr, rec.mapEnd
+			return rec, true
 		}
 	}
-	return nil, 0
+	return augSamr{}, false
 }
 
 // addOrRemove is the central function for iterating over a mix of reads and
@@ -172,33 +189,41 @@ func (frt *firstreadSNPTable) tryRemove(samr *sam.Record) (*sam.Record, PosType)
 //   firstreadSNPTable and return 0.
 // readPair[0].mapEnd is currently expected to be initialized to Pos + [first
 // return value of samr.Cigar.Lengths()].  This may be changed to an additional
-// function parameter later.
-func (frt *firstreadSNPTable) addOrRemove(readPair *[2]readSNP, samr *sam.Record, strand pileup.StrandType, maxReadSpan int) int {
+// function parameter later.  converted indicates that readPair[0] already
+// holds samr (e.g. after the -min-read-identity filter), in which case its
+// cached edit distance is kept, instead of being recomputed later.
+func (frt *firstreadSNPTable) addOrRemove(readPair *[2]readSNP, samr *sam.Record, strand pileup.StrandType, maxReadSpan int, converted bool) int {
 	matePos := PosType(samr.MatePos)
 	pos := PosType(samr.Pos)
 	mapEnd := readPair[0].mapEnd
 	if (strand == pileup.StrandNone) || (matePos >= mapEnd) || (matePos+PosType(maxReadSpan) <= pos) {
-		convertSamr(&(readPair[0]), samr)
+		if !converted {
+			convertSamr(&(readPair[0]), samr)
+		}
 		return 1
 	}
 	if pos >= matePos {
-		mateSamr, mateMapEnd := frt.tryRemove(samr)
-		if mateSamr != nil {
-			convertSamr(&(readPair[0]), samr)
-			readPair[1].mapEnd = mateMapEnd
-			convertSamr(&(readPair[1]), mateSamr)
+		if mate, ok := frt.tryRemove(samr); ok {
+			if !converted {
+				convertSamr(&(readPair[0]), samr)
+			}
+			convertAugSamr(&(readPair[1]), mate)
 			return 2
 		}
 		if pos != matePos {
 			// Missing mate.  Process this read on its own.
-			convertSamr(&(readPair[0]), samr)
+			if !converted {
+				convertSamr(&(readPair[0]), samr)
+			}
 			return 1
 		}
 		// If we get here, pos == matePos and we haven't seen the other end.
 	}
 	frt.add(augSamr{
-		samr:   samr,
-		mapEnd: mapEnd,
+		samr:     samr,
+		mapEnd:   mapEnd,
+		nm:       readPair[0].nm,
+		nmCached: converted && readPair[0].nmCached,
 	})
 	return 0
 }
@@ -21,6 +21,7 @@ import (
 
 	"github.com/grailbio/bio/pileup"
 	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
 )
 
 func TestFirstreadSNPTable(t *testing.T) {
@@ -130,7 +131,7 @@ func TestFirstreadSNPTable(t *testing.T) {
 			for _, samr := range samrs[pos] {
 				span, _ := samr.Cigar.Lengths()
 				readPair[0].mapEnd = PosType(samr.Pos + span)
-				nRead := firstReads.addOrRemove(&readPair, samr, pileup.StrandFwd, maxReadSpan)
+				nRead := firstReads.addOrRemove(&readPair, samr, pileup.StrandFwd, maxReadSpan, false)
 				nFoundRead += nRead
 				if nRead == 1 {
 					// Name must start with 'singleton' or 'farpair'.
@@ -158,3 +159,75 @@ func TestFirstreadSNPTable(t *testing.T) {
 		}
 	}
 }
+
+// TestFirstreadEditDistance checks that a read's edit distance, computed by
+// the -min-read-identity filter before the read enters the firstread-table,
+// is not recomputed after the read leaves it.
+func TestFirstreadEditDistance(t *testing.T) {
+	nComputed := 0
+	defer func(f func(*readSNP, []byte, bool) int) { editDistanceFunc = f }(editDistanceFunc)
+	editDistanceFunc = func(read *readSNP, refSeq8 []byte, ignoreTag bool) int {
+		nComputed++
+		return computeEditDistance(read, refSeq8, ignoreTag)
+	}
+
+	ref, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	refSeq8 := make([]byte, 1000)
+	for i := range refSeq8 {
+		refSeq8[i] = 1 // A
+	}
+	newRead := func(name string, pos, matePos int) *sam.Record {
+		return &sam.Record{
+			Name:    name,
+			Ref:     ref,
+			Pos:     pos,
+			MateRef: ref,
+			MatePos: matePos,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 10)},
+			Seq:     sam.NewSeq([]byte("AAAAACAAAA")),
+			Qual:    []byte{30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		}
+	}
+	frt := newFirstreadSNPTable(1024)
+	// convertSamr expects seq8 buffers with enough capacity.
+	var readPair [2]readSNP
+	for i := range readPair {
+		readPair[i].seq8 = make([]byte, 0, 16)
+	}
+	// add mimics processShard with -min-read-identity and stitching.
+	add := func(samr *sam.Record) int {
+		convertSamr(&readPair[0], samr)
+		assert.EQ(t, readIdentity(&readPair[0], refSeq8, true), 0.9)
+		readPair[0].mapEnd = PosType(samr.Pos + 10)
+		return frt.addOrRemove(&readPair, samr, pileup.StrandFwd, 100, true)
+	}
+
+	// The first read of a pair waits in the table; the second one takes it out.
+	assert.EQ(t, add(newRead("pair", 100, 105)), 0)
+	assert.EQ(t, add(newRead("pair", 105, 100)), 2)
+	assert.EQ(t, nComputed, 2)
+	for i := range readPair {
+		assert.EQ(t, readEditDistance(&readPair[i], refSeq8, true), 1)
+	}
+	assert.EQ(t, nComputed, 2)
+
+	// A read whose mate never shows up is added as an orphan.
+	assert.EQ(t, add(newRead("orphan", 200, 205)), 0)
+	assert.EQ(t, nComputed, 3)
+	bucket := &frt.buckets[200][firstreadSNPTableHashName("orphan")]
+	assert.EQ(t, len(*bucket), 1)
+	orphan := readSNP{seq8: make([]byte, 0, 16)}
+	convertAugSamr(&orphan, (*bucket)[0])
+	assert.EQ(t, orphan.mapEnd, PosType(210))
+	assert.EQ(t, readEditDistance(&orphan, refSeq8, true), 1)
+	assert.EQ(t, nComputed, 3)
+
+	// Without the filter, the distance is computed once, after conversion.
+	readPair[0].nmCached = false
+	readPair[0].mapEnd = 510
+	assert.EQ(t, frt.addOrRemove(&readPair, newRead("single", 500, 900), pileup.StrandFwd, 100, false), 1)
+	assert.False(t, readPair[0].nmCached)
+	assert.EQ(t, readEditDistance(&readPair[0], refSeq8, true), 1)
+	assert.EQ(t, readEditDistance(&readPair[0], refSeq8, true), 1)
+	assert.EQ(t, nComputed, 4)
+}
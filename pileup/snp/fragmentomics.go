@@ -0,0 +1,473 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/bio/encoding/parquet"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// Fragment-length ranges for the short/long size ratio, following the DELFI
+// method (Cristiano et al., Nature 2019).
+const (
+	fragShortMin = 100
+	fragShortMax = 150
+	fragLongMin  = 151
+	fragLongMax  = 220
+	// Fragments longer than fragMaxLen (e.g. with a discordantly mapped mate)
+	// are ignored.
+	fragMaxLen = 1000
+)
+
+// End motifs are the first endMotifLen reference bases at each read's 5' end,
+// read 5'->3'.  They are indexed with 2 bits per base, the first base in the
+// high bits.
+const (
+	endMotifLen = 4
+	nEndMotif   = 1 << (2 * endMotifLen)
+)
+
+// fragWindow holds the fragmentomics features of one window.
+type fragWindow struct {
+	nFrag  int64 // fragments with midpoint in the window
+	sumLen int64
+	nShort int64
+	nLong  int64
+	// nEnds are the numbers of read 5' ends in the window, for forward- and
+	// reverse-strand reads.
+	nEnds  [2]int64
+	motifs [nEndMotif]int64
+}
+
+func (w *fragWindow) add(other *fragWindow) {
+	w.nFrag += other.nFrag
+	w.sumLen += other.sumLen
+	w.nShort += other.nShort
+	w.nLong += other.nLong
+	w.nEnds[0] += other.nEnds[0]
+	w.nEnds[1] += other.nEnds[1]
+	for i, n := range other.motifs {
+		w.motifs[i] += n
+	}
+}
+
+type fragWindowKey struct {
+	refID, idx int
+}
+
+// fragmentomics accumulates the per-window features (Opts.FragmentomicsWindow)
+// of a run.
+type fragmentomics struct {
+	windowSize int
+	mu         sync.Mutex
+	windows    map[fragWindowKey]*fragWindow
+}
+
+func newFragmentomics(windowSize int) *fragmentomics {
+	return &fragmentomics{windowSize: windowSize, windows: make(map[fragWindowKey]*fragWindow)}
+}
+
+// merge adds the windows of a job to f.  It may be called concurrently.
+func (f *fragmentomics) merge(windows map[fragWindowKey]*fragWindow) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, w := range windows {
+		if fw, ok := f.windows[key]; ok {
+			fw.add(w)
+		} else {
+			f.windows[key] = w
+		}
+	}
+}
+
+// fragOutput is where a pileup job sends its fragmentomics features.
+type fragOutput struct {
+	agg *fragmentomics
+	// ends receives the job's per-position read 5' end counts, as
+	// fragEndRecordSize-byte records in coordinate order.
+	ends io.Writer
+	// wps, if non-nil, receives the job's fragments for the windowed
+	// protection score, as wpsRecordSize-byte records in coordinate order.
+	wps io.Writer
+}
+
+// fragEndRecordSize is the size of a per-position end count record: refID,
+// pos, and the forward and reverse counts, as little-endian uint32s.
+const fragEndRecordSize = 16
+
+// fragJob computes the fragmentomics features of one pileup job.  Each
+// fragment and read end is only counted by the job whose range contains its
+// position, so that the reads in the padding between jobs aren't counted
+// twice.
+type fragJob struct {
+	out        fragOutput
+	w          *bufio.Writer
+	wps        *bufio.Writer // nil unless out.wps is set
+	windowSize int
+	refSeqs    [][]byte
+	start      biopb.Coord
+	limit      biopb.Coord
+	windows    map[fragWindowKey]*fragWindow
+
+	// ends is a ring buffer of the 5' end counts at positions
+	// [endsBase, endsBase+len(ends)) of endsRef, which haven't been written
+	// yet.  Since reads arrive in coordinate order and span at most
+	// maxReadSpan positions, no end can be added before endsBase or past the
+	// ring.
+	ends     [][2]uint32
+	endsRef  int
+	endsBase int
+}
+
+func newFragJob(out fragOutput, jobRange biopb.CoordRange, maxReadSpan int, refSeqs [][]byte) *fragJob {
+	nRing := 1
+	for nRing < maxReadSpan {
+		nRing <<= 1
+	}
+	var wps *bufio.Writer
+	if out.wps != nil {
+		wps = bufio.NewWriter(out.wps)
+	}
+	return &fragJob{
+		out:        out,
+		wps:        wps,
+		w:          bufio.NewWriter(out.ends),
+		windowSize: out.agg.windowSize,
+		refSeqs:    refSeqs,
+		start:      jobRange.Start,
+		limit:      jobRange.Limit,
+		windows:    make(map[fragWindowKey]*fragWindow),
+		ends:       make([][2]uint32, nRing),
+		endsRef:    -1,
+	}
+}
+
+func (j *fragJob) inRange(refID, pos int) bool {
+	c := biopb.Coord{RefId: int32(refID), Pos: int32(pos)}
+	return j.start.LE(c) && c.LT(j.limit)
+}
+
+func (j *fragJob) window(refID, pos int) *fragWindow {
+	key := fragWindowKey{refID, pos / j.windowSize}
+	w := j.windows[key]
+	if w == nil {
+		w = &fragWindow{}
+		j.windows[key] = w
+	}
+	return w
+}
+
+// flushEnds writes the end counts at positions before pos, or all of them if
+// pos is negative.
+func (j *fragJob) flushEnds(pos int) error {
+	if j.endsRef < 0 {
+		return nil
+	}
+	n := len(j.ends)
+	end := j.endsBase + n
+	if (pos >= 0) && (pos < end) {
+		end = pos
+	}
+	var rec [fragEndRecordSize]byte
+	for p := j.endsBase; p < end; p++ {
+		counts := &j.ends[p&(n-1)]
+		if counts[0]+counts[1] == 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint32(rec[0:], uint32(j.endsRef))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(p))
+		binary.LittleEndian.PutUint32(rec[8:], counts[0])
+		binary.LittleEndian.PutUint32(rec[12:], counts[1])
+		if _, err := j.w.Write(rec[:]); err != nil {
+			return err
+		}
+		*counts = [2]uint32{}
+	}
+	if pos >= 0 {
+		j.endsBase = pos
+	}
+	return nil
+}
+
+// endMotif returns the index of the end motif of a read whose 5' end is at
+// pos, or -1 if the motif runs off the reference or contains an N.
+func endMotif(refSeq8 []byte, pos int, reverse bool) int {
+	start := pos
+	if reverse {
+		start = pos - endMotifLen + 1
+	}
+	if (start < 0) || (start+endMotifLen > len(refSeq8)) {
+		return -1
+	}
+	motif := 0
+	for i := 0; i < endMotifLen; i++ {
+		var b byte
+		if reverse {
+			b = pileup.Seq8ToEnumTable[refSeq8[pos-i]]
+			if b < pileup.NBase {
+				b = 3 - b // complement
+			}
+		} else {
+			b = pileup.Seq8ToEnumTable[refSeq8[pos+i]]
+		}
+		if b >= pileup.NBase {
+			return -1
+		}
+		motif = motif<<2 | int(b)
+	}
+	return motif
+}
+
+// add adds the read r, whose reference span is span, to the features.
+func (j *fragJob) add(r *sam.Record, span int) error {
+	refID := r.Ref.ID()
+	if refID != j.endsRef {
+		if err := j.flushEnds(-1); err != nil {
+			return err
+		}
+		j.endsRef = refID
+		j.endsBase = r.Pos
+	} else if r.Pos > j.endsBase {
+		if err := j.flushEnds(r.Pos); err != nil {
+			return err
+		}
+	}
+
+	// Read 5' end.
+	reverse := (r.Flags & sam.Reverse) != 0
+	endPos := r.Pos
+	if reverse && (span > 0) {
+		endPos = r.Pos + span - 1
+	}
+	if j.inRange(refID, endPos) {
+		strand := 0
+		if reverse {
+			strand = 1
+		}
+		j.ends[endPos&(len(j.ends)-1)][strand]++
+		w := j.window(refID, endPos)
+		w.nEnds[strand]++
+		if motif := endMotif(j.refSeqs[refID], endPos, reverse); motif >= 0 {
+			w.motifs[motif]++
+		}
+	}
+
+	// Fragment, counted once via its leftmost read (or read 1, if both reads
+	// start at the same position).
+	fraglen := fragmentLength(r)
+	if (fraglen == fraglenNone) || (fraglen > fragMaxLen) || !j.inRange(refID, r.Pos) {
+		return nil
+	}
+	if r.Pos == r.MatePos {
+		if r.Flags&sam.Read1 == 0 {
+			return nil
+		}
+	} else if r.TempLen < 0 {
+		return nil
+	}
+	w := j.window(refID, r.Pos+fraglen/2)
+	w.nFrag++
+	w.sumLen += int64(fraglen)
+	if (fraglen >= fragShortMin) && (fraglen <= fragShortMax) {
+		w.nShort++
+	} else if (fraglen >= fragLongMin) && (fraglen <= fragLongMax) {
+		w.nLong++
+	}
+	if (j.wps != nil) && (fraglen >= wpsMinLen) && (fraglen <= wpsMaxLen) {
+		var rec [wpsRecordSize]byte
+		binary.LittleEndian.PutUint32(rec[0:], uint32(refID))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(r.Pos))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(r.Pos+fraglen))
+		if _, err := j.wps.Write(rec[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish writes the remaining end counts, and adds the job's windows to the
+// run's.
+func (j *fragJob) finish() error {
+	if err := j.flushEnds(-1); err != nil {
+		return err
+	}
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	if j.wps != nil {
+		if err := j.wps.Flush(); err != nil {
+			return err
+		}
+	}
+	j.out.agg.merge(j.windows)
+	return nil
+}
+
+// fragParquetMetadata describes the feature definitions, and the run's
+// provenance metadata, in the Parquet key-value metadata.
+func fragParquetMetadata(windowSize int, provenance map[string]string) map[string]string {
+	m := map[string]string{
+		"window_size": strconv.Itoa(windowSize),
+		"short_range": strconv.Itoa(fragShortMin) + "-" + strconv.Itoa(fragShortMax),
+		"long_range":  strconv.Itoa(fragLongMin) + "-" + strconv.Itoa(fragLongMax),
+		"max_length":  strconv.Itoa(fragMaxLen),
+		"coordinates": "0-based",
+	}
+	for k, v := range provenance {
+		m[k] = v
+	}
+	return m
+}
+
+// createParquet creates a snappy-compressed parquet file.  rowGroupSize 0
+// selects parquet.DefaultRowGroupSize.
+func createParquet(ctx context.Context, path string, cols []parquet.Column, metadata map[string]string, rowGroupSize int) (file.File, *parquet.Writer, error) {
+	dst, err := file.Create(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	pw, err := parquet.NewWriter(dst.Writer(ctx), cols, parquet.WriterOpts{
+		RowGroupSize: rowGroupSize,
+		Codec:        parquet.Snappy,
+		Metadata:     metadata,
+		CreatedBy:    "bio-pileup",
+	})
+	if err != nil {
+		_ = dst.Close(ctx)
+		return nil, nil, err
+	}
+	return dst, pw, nil
+}
+
+// writeFragmentomics writes the window features to
+// <mainPath>.fragmentomics.parquet, with one row per window with any
+// fragments or read ends, and the per-position read 5' end counts in
+// endFiles (one per job, in job order) to <mainPath>.fragment_ends.parquet.
+func writeFragmentomics(ctx context.Context, mainPath string, f *fragmentomics, endFiles []*os.File, refNames []string, provenance map[string]string) (err error) {
+	cols := []parquet.Column{
+		{Name: "chrom", Type: parquet.String},
+		{Name: "start", Type: parquet.Int64},
+		{Name: "end", Type: parquet.Int64},
+		{Name: "n_fragments", Type: parquet.Int64},
+		{Name: "mean_length", Type: parquet.Double},
+		{Name: "n_short", Type: parquet.Int64},
+		{Name: "n_long", Type: parquet.Int64},
+		{Name: "short_long_ratio", Type: parquet.Double},
+		{Name: "n_ends_fwd", Type: parquet.Int64},
+		{Name: "n_ends_rev", Type: parquet.Int64},
+	}
+	nFixedCol := len(cols)
+	for motif := 0; motif < nEndMotif; motif++ {
+		name := []byte("motif_")
+		for i := endMotifLen - 1; i >= 0; i-- {
+			name = append(name, pileup.EnumToASCIITable[(motif>>(2*uint(i)))&3])
+		}
+		cols = append(cols, parquet.Column{Name: string(name), Type: parquet.Int64})
+	}
+	keys := make([]fragWindowKey, 0, len(f.windows))
+	for key := range f.windows {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return (keys[i].refID < keys[j].refID) || ((keys[i].refID == keys[j].refID) && (keys[i].idx < keys[j].idx))
+	})
+
+	dst, pw, err := createParquet(ctx, mainPath+".fragmentomics.parquet", cols, fragParquetMetadata(f.windowSize, provenance), 0)
+	if err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	for _, key := range keys {
+		w := f.windows[key]
+		start := int64(key.idx) * int64(f.windowSize)
+		pw.String(0, refNames[key.refID])
+		pw.Int64(1, start)
+		pw.Int64(2, start+int64(f.windowSize))
+		pw.Int64(3, w.nFrag)
+		meanLen, ratio := math.NaN(), math.NaN()
+		if w.nFrag > 0 {
+			meanLen = float64(w.sumLen) / float64(w.nFrag)
+		}
+		if w.nLong > 0 {
+			ratio = float64(w.nShort) / float64(w.nLong)
+		}
+		pw.Double(4, meanLen)
+		pw.Int64(5, w.nShort)
+		pw.Int64(6, w.nLong)
+		pw.Double(7, ratio)
+		pw.Int64(8, w.nEnds[0])
+		pw.Int64(9, w.nEnds[1])
+		for motif, n := range w.motifs {
+			pw.Int64(nFixedCol+motif, n)
+		}
+		if err = pw.EndRow(); err != nil {
+			return
+		}
+	}
+	if err = pw.Close(); err != nil {
+		return
+	}
+	return writeFragmentEnds(ctx, mainPath, fragParquetMetadata(f.windowSize, provenance), endFiles, refNames)
+}
+
+func writeFragmentEnds(ctx context.Context, mainPath string, metadata map[string]string, endFiles []*os.File, refNames []string) (err error) {
+	cols := []parquet.Column{
+		{Name: "chrom", Type: parquet.String},
+		{Name: "pos", Type: parquet.Int64},
+		{Name: "n_ends_fwd", Type: parquet.Int32},
+		{Name: "n_ends_rev", Type: parquet.Int32},
+	}
+	dst, pw, err := createParquet(ctx, mainPath+".fragment_ends.parquet", cols, metadata, 0)
+	if err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	var rec [fragEndRecordSize]byte
+	for _, f := range endFiles {
+		if _, err = f.Seek(0, 0); err != nil {
+			return
+		}
+		r := bufio.NewReader(f)
+		for {
+			if _, err = io.ReadFull(r, rec[:]); err != nil {
+				if err == io.EOF {
+					err = nil
+					break
+				}
+				return
+			}
+			pw.String(0, refNames[binary.LittleEndian.Uint32(rec[0:])])
+			pw.Int64(1, int64(binary.LittleEndian.Uint32(rec[4:])))
+			pw.Int32(2, int32(binary.LittleEndian.Uint32(rec[8:])))
+			pw.Int32(3, int32(binary.LittleEndian.Uint32(rec[12:])))
+			if err = pw.EndRow(); err != nil {
+				return
+			}
+		}
+	}
+	return pw.Close()
+}
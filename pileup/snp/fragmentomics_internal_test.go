@@ -0,0 +1,73 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestFragJob(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	_, _ = sam.NewHeader(nil, []*sam.Reference{ref1})
+	refSeq8 := []byte(strings.Repeat("ACGT", 250))
+	for i, c := range refSeq8 {
+		refSeq8[i] = map[byte]byte{'A': 1, 'C': 2, 'G': 4, 'T': 8}[c]
+	}
+	var ends bytes.Buffer
+	agg := newFragmentomics(100)
+	j := newFragJob(fragOutput{agg: agg, ends: &ends}, biopb.CoordRange{Start: biopb.Coord{RefId: 0, Pos: 0}, Limit: biopb.Coord{RefId: 0, Pos: 500}}, 64, [][]byte{refSeq8})
+
+	pair := func(name string, pos, matePos, tlen int, reverse bool) *sam.Record {
+		flags := sam.Paired
+		if reverse {
+			flags |= sam.Reverse
+		}
+		return &sam.Record{Name: name, Ref: ref1, Pos: pos, MateRef: ref1, MatePos: matePos, TempLen: tlen, Flags: flags}
+	}
+	for _, r := range []*sam.Record{
+		// A 120bp fragment, with midpoint 70.
+		pair("a", 10, 100, 120, false),
+		// A 180bp fragment, with midpoint 110.
+		pair("b", 20, 170, 180, false),
+		pair("a", 100, 10, -120, true),
+		pair("b", 170, 20, -180, true),
+		// The 5' end of this read is past the end of the job's range.
+		{Name: "c", Ref: ref1, Pos: 490, Flags: sam.Reverse},
+	} {
+		assert.NoError(t, j.add(r, 30))
+	}
+	assert.NoError(t, j.finish())
+
+	// The motifs at 10 and 129 (reverse) are GTAC; at 20 and 199 (reverse),
+	// ACGT.
+	const gtac, acgt = 2<<6 | 3<<4 | 0<<2 | 1, 0<<6 | 1<<4 | 2<<2 | 3
+	want0 := &fragWindow{nFrag: 1, sumLen: 120, nShort: 1, nEnds: [2]int64{2, 0}}
+	want0.motifs[gtac], want0.motifs[acgt] = 1, 1
+	want1 := &fragWindow{nFrag: 1, sumLen: 180, nLong: 1, nEnds: [2]int64{0, 2}}
+	want1.motifs[gtac], want1.motifs[acgt] = 1, 1
+	assert.EQ(t, agg.windows, map[fragWindowKey]*fragWindow{{0, 0}: want0, {0, 1}: want1})
+
+	var got [][4]uint32
+	for b := ends.Bytes(); len(b) > 0; b = b[fragEndRecordSize:] {
+		got = append(got, [4]uint32{binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:]), binary.LittleEndian.Uint32(b[8:]), binary.LittleEndian.Uint32(b[12:])})
+	}
+	assert.EQ(t, got, [][4]uint32{{0, 10, 1, 0}, {0, 20, 1, 0}, {0, 129, 0, 1}, {0, 199, 0, 1}})
+}
@@ -0,0 +1,445 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// gvcfMaxGQ caps the GQ values of the gvcf output, as in GATK.
+const gvcfMaxGQ = 99
+
+// gvcfDefaultGQBands are the reference-block bands used when Opts.GQBands is
+// empty.
+var gvcfDefaultGQBands = []int{10, 20, 30, 40, 50, 60}
+
+// gvcfMaxGenotypes is the number of diploid genotypes of the largest allele
+// set: REF, the three other bases, and <NON_REF>.
+const gvcfMaxGenotypes = (pileup.NBase + 1) * (pileup.NBase + 2) / 2
+
+// gvcfHeaderLines are the fixed meta-information lines of the gvcf output,
+// other than ##fileformat, ##reference, ##contig and ##GVCFBlock.
+const gvcfHeaderLines = `##source=bio-pileup
+##ALT=<ID=NON_REF,Description="Represents any possible alternative allele not already represented at this location">
+##INFO=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including bases below the base-quality threshold">
+##INFO=<ID=END,Number=1,Type=Integer,Description="Stop position of the reference block">
+##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+##FORMAT=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including bases below the base-quality threshold; the mean depth in reference blocks">
+##FORMAT=<ID=AD,Number=R,Type=Integer,Description="Number of reads supporting each allele, with base quality at or above the threshold">
+##FORMAT=<ID=GQ,Number=1,Type=Integer,Description="Genotype quality; the minimum genotype quality in reference blocks">
+##FORMAT=<ID=MIN_DP,Number=1,Type=Integer,Description="Minimum depth in the reference block">
+##FORMAT=<ID=PL,Number=G,Type=Integer,Description="Normalized, phred-scaled likelihoods of the genotypes, computed from the base qualities">
+`
+
+// parseGQBands parses Opts.GQBands, an increasing comma-separated list of
+// the GQ values (1..99) at which the reference-block bands of the gvcf
+// output start.  It returns gvcfDefaultGQBands if s is empty.
+func parseGQBands(s string) ([]int, error) {
+	if s == "" {
+		return gvcfDefaultGQBands, nil
+	}
+	var bands []int
+	for _, f := range strings.Split(s, ",") {
+		gq, err := strconv.Atoi(f)
+		if (err != nil) || (gq < 1) || (gq > gvcfMaxGQ) || ((len(bands) != 0) && (gq <= bands[len(bands)-1])) {
+			return nil, fmt.Errorf("Pileup: invalid gq-bands= argument %q (must be an increasing comma-separated list of GQ values in 1..%d)", s, gvcfMaxGQ)
+		}
+		bands = append(bands, gq)
+	}
+	return bands, nil
+}
+
+// gqBand returns the index of the band of bands (see parseGQBands) which
+// contains gq; band 0 is [0, bands[0]).
+func gqBand(bands []int, gq int) int {
+	return sort.SearchInts(bands, gq+1)
+}
+
+// genotypeIndex returns the index of diploid genotype j/k (j <= k) in VCF
+// Number=G fields.
+func genotypeIndex(j, k int) int {
+	return k*(k+1)/2 + j
+}
+
+// diploidPLs appends the phred-scaled likelihoods of the diploid genotypes
+// of alleles, in VCF order (0/0, 0/1, 1/1, 0/2, ...), to pls[:0], normalized
+// so that the most likely genotype has PL 0.  alleles are pileup.Base...
+// enum values; if nonRef is true, they are followed by <NON_REF>, which
+// stands for the bases not in alleles.
+//
+// The likelihoods are computed from the (high-quality) bases of perRead, as
+// in consensusBaseAndQual: each base is an independent observation with
+// error probability given by its base quality, and errors are evenly
+// distributed among the other three bases.  A base is drawn from either
+// allele of the genotype with equal probability.
+func diploidPLs(perRead *[pileup.NBase][]perReadFeatures, alleles []byte, nonRef bool, pls []int) []int {
+	nAllele := len(alleles)
+	if nonRef {
+		nAllele++
+	}
+	nGenotype := genotypeIndex(0, nAllele)
+	var ll [gvcfMaxGenotypes]float64
+	var probs [pileup.NBase + 1]float64
+	var qualCounts [nQual]uint32
+	for b, features := range perRead {
+		if len(features) == 0 {
+			continue
+		}
+		for q := range qualCounts {
+			qualCounts[q] = 0
+		}
+		for _, f := range features {
+			q := f.qual
+			if q >= nQual {
+				q = nQual - 1
+			}
+			qualCounts[q]++
+		}
+		for q, n := range qualCounts {
+			if n == 0 {
+				continue
+			}
+			pMatch := math.Exp(consensusLogProbs[q][0])
+			pMismatch := math.Exp(consensusLogProbs[q][1])
+			isAllele := false
+			for a, ab := range alleles {
+				probs[a] = pMismatch
+				if int(ab) == b {
+					probs[a] = pMatch
+					isAllele = true
+				}
+			}
+			if nonRef {
+				probs[nAllele-1] = pMatch
+				if isAllele {
+					probs[nAllele-1] = pMismatch
+				}
+			}
+			for k := 0; k < nAllele; k++ {
+				for j := 0; j <= k; j++ {
+					ll[genotypeIndex(j, k)] += float64(n) * math.Log(0.5*(probs[j]+probs[k]))
+				}
+			}
+		}
+	}
+	llMax := ll[0]
+	for _, x := range ll[1:nGenotype] {
+		if x > llMax {
+			llMax = x
+		}
+	}
+	pls = pls[:0]
+	for _, x := range ll[:nGenotype] {
+		pls = append(pls, int(math.Round((llMax-x)*10*math.Log10E)))
+	}
+	return pls
+}
+
+// bestGenotype returns the index of the most likely genotype of pls (the
+// first one, on ties), and its GQ: the PL of the next most likely genotype,
+// capped at gvcfMaxGQ.
+func bestGenotype(pls []int) (best, gq int) {
+	for g, pl := range pls {
+		if pl == 0 {
+			best = g
+			break
+		}
+	}
+	gq = gvcfMaxGQ
+	for g, pl := range pls {
+		if (g != best) && (pl < gq) {
+			gq = pl
+		}
+	}
+	return
+}
+
+// appendGenotype appends the GT value of genotype index g to buf.
+func appendGenotype(buf []byte, g int) []byte {
+	k := 0
+	for genotypeIndex(0, k+1) <= g {
+		k++
+	}
+	buf = strconv.AppendInt(buf, int64(g-genotypeIndex(0, k)), 10)
+	buf = append(buf, '/')
+	return strconv.AppendInt(buf, int64(k), 10)
+}
+
+// appendPLs appends a comma-separated list of pls to buf.
+func appendPLs(buf []byte, pls []int) []byte {
+	for i, pl := range pls {
+		if i != 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendInt(buf, int64(pl), 10)
+	}
+	return buf
+}
+
+// gvcfBlock is a reference block of the gvcf output: a run of adjacent
+// positions whose homozygous-reference GQs fall in the same band.
+type gvcfBlock struct {
+	refID uint32
+	// start and end are the 0-based positions of the first and last
+	// positions of the block.
+	start, end uint32
+	band       int
+	refBase    byte
+	minGQ      int
+	minDP      uint32
+	sumDP      uint64
+	// pls are the PLs of the first position with GQ minGQ.
+	pls []int
+}
+
+// gvcfWriter writes the records of the gvcf output.
+type gvcfWriter struct {
+	w        *tsv.Writer
+	refNames []string
+	bands    []int
+	// block is the current reference block, if inBlock is true.
+	block   gvcfBlock
+	inBlock bool
+	buf     []byte
+}
+
+// addRefPos adds a position called as homozygous-reference, with the given
+// GQ and PLs, to the current reference block, after writing the block out if
+// the position doesn't extend it.
+func (gw *gvcfWriter) addRefPos(refID, pos uint32, refBase byte, depth uint32, gq int, pls []int) error {
+	band := gqBand(gw.bands, gq)
+	b := &gw.block
+	if gw.inBlock && ((b.refID != refID) || (b.end+1 != pos) || (b.band != band)) {
+		if err := gw.flushBlock(); err != nil {
+			return err
+		}
+	}
+	if !gw.inBlock {
+		gw.inBlock = true
+		*b = gvcfBlock{
+			refID:   refID,
+			start:   pos,
+			band:    band,
+			refBase: refBase,
+			minGQ:   gq + 1,
+			minDP:   depth,
+			pls:     b.pls[:0],
+		}
+	}
+	b.end = pos
+	if gq < b.minGQ {
+		b.minGQ = gq
+		b.pls = append(b.pls[:0], pls...)
+	}
+	if depth < b.minDP {
+		b.minDP = depth
+	}
+	b.sumDP += uint64(depth)
+	return nil
+}
+
+// flushBlock writes the current reference block, if any.
+func (gw *gvcfWriter) flushBlock() error {
+	if !gw.inBlock {
+		return nil
+	}
+	gw.inBlock = false
+	b := &gw.block
+	w := gw.w
+	w.WriteString(gw.refNames[b.refID])
+	w.WriteUint32(b.start + 1)
+	w.WriteByte('.')
+	w.WriteByte(b.refBase)
+	w.WriteString("<NON_REF>\t.\t.") // ALT, QUAL, FILTER
+	gw.buf = strconv.AppendUint(append(gw.buf[:0], "END="...), uint64(b.end+1), 10)
+	w.WriteBytes(gw.buf)
+	w.WriteString("GT:DP:GQ:MIN_DP:PL")
+	gw.buf = append(gw.buf[:0], "0/0:"...)
+	gw.buf = strconv.AppendUint(gw.buf, b.sumDP/uint64(b.end-b.start+1), 10)
+	gw.buf = append(gw.buf, ':')
+	gw.buf = strconv.AppendInt(gw.buf, int64(b.minGQ), 10)
+	gw.buf = append(gw.buf, ':')
+	gw.buf = strconv.AppendUint(gw.buf, uint64(b.minDP), 10)
+	gw.buf = append(gw.buf, ':')
+	gw.buf = appendPLs(gw.buf, b.pls)
+	w.WriteBytes(gw.buf)
+	return w.EndLine()
+}
+
+// writeVariant writes the record of a position with a non-reference
+// genotype call.  alts are the ALT bases (not including <NON_REF>), and pls
+// and best are the PLs and most likely genotype of REF, alts and <NON_REF>.
+func (gw *gvcfWriter) writeVariant(refID, pos uint32, refBase byte, payload *pileupPayload, alts []byte, pls []int, best, gq int) error {
+	if err := gw.flushBlock(); err != nil {
+		return err
+	}
+	w := gw.w
+	w.WriteString(gw.refNames[refID])
+	w.WriteUint32(pos + 1)
+	w.WriteByte('.')
+	w.WriteByte(pileup.EnumToASCIITable[refBase])
+	gw.buf = gw.buf[:0]
+	for _, b := range alts {
+		gw.buf = append(gw.buf, pileup.EnumToASCIITable[b], ',')
+	}
+	gw.buf = append(gw.buf, "<NON_REF>"...)
+	w.WriteBytes(gw.buf)
+	// QUAL is the phred-scaled likelihood of 0/0, relative to the called
+	// genotype.
+	w.WriteInt64(int64(pls[0]))
+	w.WriteByte('.')
+	gw.buf = strconv.AppendUint(append(gw.buf[:0], "DP="...), uint64(payload.depth), 10)
+	w.WriteBytes(gw.buf)
+	w.WriteString("GT:DP:AD:GQ:PL")
+	gw.buf = appendGenotype(gw.buf[:0], best)
+	gw.buf = append(gw.buf, ':')
+	gw.buf = strconv.AppendUint(gw.buf, uint64(payload.depth), 10)
+	gw.buf = append(gw.buf, ':')
+	// The alts include every base with high-quality support, so there is
+	// none left for <NON_REF>.
+	gw.buf = append(appendVCFCounts(gw.buf, &payload.counts, refBase, alts, -1), ",0:"...)
+	gw.buf = strconv.AppendInt(gw.buf, int64(gq), 10)
+	gw.buf = append(gw.buf, ':')
+	gw.buf = appendPLs(gw.buf, pls)
+	w.WriteBytes(gw.buf)
+	return w.EndLine()
+}
+
+// convertPileupRowsToGVCF writes the pileup as a single-sample gVCF file,
+// with diploid genotype likelihoods computed from the base qualities (see
+// diploidPLs).
+//
+// Each position with high-quality support for a base other than the
+// reference is genotyped over REF, those bases and <NON_REF>; if the most
+// likely genotype isn't 0/0, the position gets its own record.  The other
+// positions are genotyped over REF and <NON_REF>, and adjacent positions
+// whose GQs fall in the same band of gqBands (see parseGQBands) are merged
+// into reference blocks, with the block's minimum GQ and depth, mean depth,
+// and the PLs of its lowest-GQ position.  Positions with an N in the
+// reference are added to the blocks with GQ 0.
+func convertPileupRowsToGVCF(ctx context.Context, tmpFiles []*os.File, mainPath, fapath, sampleName string, gqBands []int, compression outputCompression, parallelism int, refs []*sam.Reference, refSeqs [][]byte, provenance map[string]string) (err error) {
+	fullPath := mainPath + ".g.vcf" + compression.suffix()
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	cw, closeCompressed, err := newCompressedWriter(ctx, dst, compression, parallelism)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := closeCompressed(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	var header bytes.Buffer
+	writeVCFPreamble(&header, fapath, refs)
+	header.WriteString(gvcfHeaderLines)
+	for i := 0; i <= len(gqBands); i++ {
+		lo, hi := 0, gvcfMaxGQ+1
+		if i > 0 {
+			lo = gqBands[i-1]
+		}
+		if i < len(gqBands) {
+			hi = gqBands[i]
+		}
+		fmt.Fprintf(&header, "##GVCFBlock%d-%d=minGQ=%d(inclusive),maxGQ=%d(exclusive)\n", lo, hi, lo, hi)
+	}
+	for _, k := range sortedKeys(provenance) {
+		header.WriteString("##bio-pileup." + k + "=" + provenance[k] + "\n")
+	}
+	if _, err = cw.Write(header.Bytes()); err != nil {
+		return
+	}
+	w := tsv.NewWriter(cw)
+	w.WriteString("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT")
+	w.WriteString(sampleName)
+	if err = w.EndLine(); err != nil {
+		return
+	}
+
+	refNames := make([]string, len(refs))
+	for i, ref := range refs {
+		refNames[i] = ref.Name()
+	}
+	gw := gvcfWriter{
+		w:        w,
+		refNames: refNames,
+		bands:    gqBands,
+	}
+	var (
+		alts      = make([]byte, 0, pileup.NBase)
+		alleles   = make([]byte, 0, pileup.NBase)
+		pls       []int
+		nVariants int
+	)
+	noCallPLs := []int{0, 0, 0}
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		refBase8 := refSeqs[pr.refID][pr.pos]
+		refBase := pileup.Seq8ToEnumTable[refBase8]
+		if refBase == pileup.BaseX {
+			if err = gw.addRefPos(pr.refID, pr.pos, pileup.Seq8ToASCIITable[refBase8], pr.payload.depth, 0, noCallPLs); err != nil {
+				return err
+			}
+			return nil
+		}
+		counts := &pr.payload.counts
+		alts = vcfAltBases(counts, refBase, 0, alts)
+		alleles = append(append(alleles[:0], refBase), alts...)
+		if len(alts) != 0 {
+			pls = diploidPLs(&pr.payload.perRead, alleles, true, pls)
+			if best, gq := bestGenotype(pls); best != 0 {
+				if err = gw.writeVariant(pr.refID, pr.pos, refBase, &pr.payload, alts, pls, best, gq); err != nil {
+					return err
+				}
+				nVariants++
+				return nil
+			}
+		}
+		pls = diploidPLs(&pr.payload.perRead, alleles[:1], true, pls)
+		best, gq := bestGenotype(pls)
+		if best != 0 {
+			// 0/<NON_REF> or <NON_REF>/<NON_REF> is only possible with
+			// several weakly-supported alt bases, none of which is called.
+			gq = 0
+		}
+		return gw.addRefPos(pr.refID, pr.pos, pileup.Seq8ToASCIITable[refBase8], pr.payload.depth, gq, pls)
+	})
+	if err != nil {
+		return
+	}
+	if err = gw.flushBlock(); err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("convertPileupRowsToGVCF: done, %d variant records; final results written to %s", nVariants, fullPath)
+	return
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseGQBands(t *testing.T) {
+	bands, err := parseGQBands("")
+	assert.NoError(t, err)
+	assert.EQ(t, bands, gvcfDefaultGQBands)
+	bands, err = parseGQBands("5,20,99")
+	assert.NoError(t, err)
+	assert.EQ(t, bands, []int{5, 20, 99})
+	assert.EQ(t, gqBand(bands, 0), 0)
+	assert.EQ(t, gqBand(bands, 4), 0)
+	assert.EQ(t, gqBand(bands, 5), 1)
+	assert.EQ(t, gqBand(bands, 98), 2)
+	assert.EQ(t, gqBand(bands, 99), 3)
+	for _, s := range []string{"0,10", "10,10", "20,10", "100", "10,x"} {
+		_, err = parseGQBands(s)
+		assert.HasSubstr(t, err.Error(), "invalid gq-bands= argument", s)
+	}
+}
+
+// gvcfTestReads returns n perReadFeatures with base quality qual.
+func gvcfTestReads(n int, qual byte) []perReadFeatures {
+	features := make([]perReadFeatures, n)
+	for i := range features {
+		features[i].qual = qual
+	}
+	return features
+}
+
+func TestDiploidPLs(t *testing.T) {
+	var perRead [pileup.NBase][]perReadFeatures
+	// No reads: no information.
+	pls := diploidPLs(&perRead, []byte{pileup.BaseA}, true, nil)
+	assert.EQ(t, pls, []int{0, 0, 0})
+	best, gq := bestGenotype(pls)
+	assert.EQ(t, best, 0)
+	assert.EQ(t, gq, 0)
+
+	// Each Q30 read matching the reference adds ~3 to the PL of 0/<NON_REF>.
+	perRead[pileup.BaseA] = gvcfTestReads(10, 30)
+	pls = diploidPLs(&perRead, []byte{pileup.BaseA}, true, pls)
+	assert.EQ(t, pls, []int{0, 30, 348})
+	best, gq = bestGenotype(pls)
+	assert.EQ(t, best, 0)
+	assert.EQ(t, gq, 30)
+
+	perRead[pileup.BaseG] = gvcfTestReads(9, 30)
+	pls = diploidPLs(&perRead, []byte{pileup.BaseA, pileup.BaseG}, true, pls)
+	assert.EQ(t, pls, []int{256, 0, 291, 286, 318, 603})
+	best, gq = bestGenotype(pls)
+	assert.EQ(t, string(appendGenotype(nil, best)), "0/1")
+	assert.EQ(t, gq, gvcfMaxGQ)
+
+	perRead[pileup.BaseA] = nil
+	pls = diploidPLs(&perRead, []byte{pileup.BaseA, pileup.BaseG}, true, pls)
+	best, gq = bestGenotype(pls)
+	assert.EQ(t, string(appendGenotype(nil, best)), "1/1")
+	assert.EQ(t, gq, 27)
+
+	var gts []string
+	for g := 0; g < genotypeIndex(0, 4); g++ {
+		gts = append(gts, string(appendGenotype(nil, g)))
+	}
+	assert.EQ(t, strings.Join(gts, " "), "0/0 0/1 1/1 0/2 1/2 2/2 0/3 1/3 2/3 3/3")
+}
+
+func TestConvertPileupRowsToGVCF(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	refSeq := "ACGTACGTAC"
+	refSeq8 := make([]byte, len(refSeq))
+	biosimd.ASCIIToSeq8(refSeq8, []byte(refSeq))
+	ref, err := sam.NewReference("chr1", "", "", len(refSeq), nil, nil)
+	assert.NoError(t, err)
+
+	newRow := func(pos, depth uint32, perRead map[byte][]perReadFeatures) pileupRow {
+		pr := pileupRow{fieldsPresent: fieldCounts, pos: pos}
+		pr.payload.depth = depth
+		for b, features := range perRead {
+			pr.fieldsPresent |= fieldPerReadA << b
+			pr.payload.perRead[b] = features
+			pr.payload.counts[b][0] = uint32(len(features))
+		}
+		return pr
+	}
+	rows := []pileupRow{
+		// A reference block with GQ 30, and one with GQ 0.
+		newRow(0, 10, map[byte][]perReadFeatures{pileup.BaseA: gvcfTestReads(10, 30)}),
+		newRow(1, 12, map[byte][]perReadFeatures{pileup.BaseC: gvcfTestReads(10, 30)}),
+		newRow(2, 0, nil),
+		// A het SNV.
+		newRow(3, 19, map[byte][]perReadFeatures{pileup.BaseT: gvcfTestReads(10, 30), pileup.BaseG: gvcfTestReads(9, 30)}),
+		// A sequencing error, called 0/0 with a higher GQ band.
+		newRow(4, 31, map[byte][]perReadFeatures{pileup.BaseA: gvcfTestReads(30, 30), pileup.BaseC: gvcfTestReads(1, 20)}),
+		newRow(5, 10, map[byte][]perReadFeatures{pileup.BaseC: gvcfTestReads(10, 30)}),
+		// Not adjacent to the previous block.
+		newRow(8, 10, map[byte][]perReadFeatures{pileup.BaseA: gvcfTestReads(10, 30)}),
+	}
+	f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w := newPileupRowWriter(f, defaultShardCodec)
+	for i := range rows {
+		w.Append(&rows[i])
+	}
+	assert.NoError(t, w.Finish())
+
+	mainPath := filepath.Join(tmpdir, "out")
+	assert.NoError(t, convertPileupRowsToGVCF(ctx, []*os.File{f}, mainPath, "ref.fa", "sample", gvcfDefaultGQBands, compressNone, 1, []*sam.Reference{ref}, [][]byte{refSeq8}, nil))
+	data, err := ioutil.ReadFile(mainPath + ".g.vcf")
+	assert.NoError(t, err)
+	header, records := splitVCFTestOutput(string(data))
+	assert.HasSubstr(t, header, "##contig=<ID=chr1,length=10>\n")
+	assert.HasSubstr(t, header, "##GVCFBlock0-10=minGQ=0(inclusive),maxGQ=10(exclusive)\n")
+	assert.HasSubstr(t, header, "##GVCFBlock60-100=minGQ=60(inclusive),maxGQ=100(exclusive)\n")
+	assert.HasSubstr(t, header, "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tsample\n")
+	assert.EQ(t, records, `chr1	1	.	A	<NON_REF>	.	.	END=2	GT:DP:GQ:MIN_DP:PL	0/0:11:30:10:0,30,348
+chr1	3	.	G	<NON_REF>	.	.	END=3	GT:DP:GQ:MIN_DP:PL	0/0:0:0:0:0,0,0
+chr1	4	.	T	G,<NON_REF>	256	.	DP=19	GT:DP:AD:GQ:PL	0/1:19:10,9,0:99:256,0,291,286,318,603
+chr1	5	.	A	<NON_REF>	.	.	END=5	GT:DP:GQ:MIN_DP:PL	0/0:31:69:31:0,69,1018
+chr1	6	.	C	<NON_REF>	.	.	END=6	GT:DP:GQ:MIN_DP:PL	0/0:10:30:10:0,30,348
+chr1	9	.	A	<NON_REF>	.	.	END=9	GT:DP:GQ:MIN_DP:PL	0/0:10:30:10:0,30,348
+`)
+}
+
+// splitVCFTestOutput splits VCF text into its header lines and records.
+func splitVCFTestOutput(s string) (header, records string) {
+	i := strings.Index(s, "\n#CHROM")
+	j := strings.Index(s[i+1:], "\n")
+	return s[:i+j+2], s[i+j+2:]
+}
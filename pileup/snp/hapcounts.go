@@ -0,0 +1,157 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// Haplotypes, indexing pileupPayload.hapCounts.  hap1 and hap2 are the HP tag
+// values written by phasing tools such as WhatsHap.
+const (
+	hapUnassigned = iota
+	hap1
+	hap2
+	nHaplotype
+)
+
+var (
+	hpTag = sam.NewTag("HP")
+	psTag = sam.NewTag("PS")
+)
+
+// auxInt returns the value of an integer aux field.
+func auxInt(aux sam.Aux) (int64, bool) {
+	switch v := aux.Value().(type) {
+	case int8:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// readHapTags returns the haplotype and phase set of r, from its HP and PS
+// tags.  A read is only assigned to hap1 or hap2 if it has both tags, with an
+// HP value of 1 or 2 and a positive PS value; otherwise it is hapUnassigned,
+// with phase set 0.
+func readHapTags(r *sam.Record) (hap byte, phaseSet uint32) {
+	hpAux := r.AuxFields.Get(hpTag)
+	psAux := r.AuxFields.Get(psTag)
+	if (hpAux == nil) || (psAux == nil) {
+		return hapUnassigned, 0
+	}
+	hp, ok := auxInt(hpAux)
+	if !ok || ((hp != hap1) && (hp != hap2)) {
+		return hapUnassigned, 0
+	}
+	ps, ok := auxInt(psAux)
+	if !ok || (ps <= 0) {
+		return hapUnassigned, 0
+	}
+	return byte(hp), uint32(ps)
+}
+
+// pairHaplotype returns the haplotype and phase set of a read or read-pair.
+// The reads of a pair are normally tagged alike; if they aren't, the pair is
+// hapUnassigned.
+func pairHaplotype(reads []readSNP) (hap byte, phaseSet uint32) {
+	hap, phaseSet = readHapTags(reads[0].samr)
+	for _, r := range reads[1:] {
+		if h, ps := readHapTags(r.samr); (h != hap) || (ps != phaseSet) {
+			return hapUnassigned, 0
+		}
+	}
+	return
+}
+
+// addHapCount counts a base of the read being added (see
+// pileupMutable.readHap) in row.hapCounts.  The first phased read at a
+// position sets its phase set; since the haplotype numbers of different phase
+// sets are unrelated, the phased reads of other phase sets are counted as
+// hapUnassigned.
+func (pm *pileupMutable) addHapCount(row *pileupPayload, base byte) {
+	hap := pm.readHap
+	if (hap != hapUnassigned) && (row.phaseSet != pm.readPhaseSet) {
+		if row.phaseSet == 0 {
+			row.phaseSet = pm.readPhaseSet
+		} else {
+			hap = hapUnassigned
+		}
+	}
+	row.hapCounts[hap][base]++
+}
+
+// hapCountsTSVColumns returns the hapcounts columns of the .ref.tsv or
+// .alt.tsv file with the given prefix.
+func hapCountsTSVColumns(prefix string) []string {
+	return []string{"PS", prefix + "_hap1_depth", prefix + "_hap2_depth", prefix + "_unassigned_depth"}
+}
+
+// writeHapCountCols appends the hapcounts columns of base to tsvw.  The
+// per-haplotype depths are '.' for N, which isn't tracked.
+func writeHapCountCols(tsvw *tsv.Writer, p *pileupPayload, base PosType) {
+	writePhaseSet(tsvw, p)
+	if base == PosType(pileup.BaseX) {
+		tsvw.WriteString(".\t.\t.")
+		return
+	}
+	tsvw.WriteUint32(p.hapCounts[hap1][base])
+	tsvw.WriteUint32(p.hapCounts[hap2][base])
+	tsvw.WriteUint32(p.hapCounts[hapUnassigned][base])
+}
+
+// writePhaseSet appends the PS column, the phase set of the phased reads at
+// the position, or '.' if there are none.
+func writePhaseSet(tsvw *tsv.Writer, p *pileupPayload) {
+	if p.phaseSet == 0 {
+		tsvw.WriteByte('.')
+		return
+	}
+	tsvw.WriteUint32(p.phaseSet)
+}
+
+// hapCountsBasestrandColumns returns the hapcounts columns of the
+// basestrand-tsv formats: the phase set, followed by the per-base counts of
+// hap1, hap2 and the unassigned reads.
+func hapCountsBasestrandColumns() []string {
+	cols := []string{"PS"}
+	for _, prefix := range []string{"HAP1_", "HAP2_", "UNASSIGNED_"} {
+		for _, base := range "ACGT" {
+			cols = append(cols, prefix+string(base))
+		}
+	}
+	return cols
+}
+
+// writeHapCountBasestrandCols appends the hapcounts columns of the
+// basestrand-tsv formats to w.
+func writeHapCountBasestrandCols(w *tsv.Writer, p *pileupPayload) {
+	writePhaseSet(w, p)
+	for _, hap := range []int{hap1, hap2, hapUnassigned} {
+		for _, c := range p.hapCounts[hap] {
+			w.WriteUint32(c)
+		}
+	}
+}
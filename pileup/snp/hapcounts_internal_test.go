@@ -0,0 +1,102 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestReadHapTags(t *testing.T) {
+	newRead := func(tags ...interface{}) *sam.Record {
+		r := &sam.Record{Name: "r"}
+		for i := 0; i < len(tags); i += 2 {
+			aux, err := sam.NewAux(sam.NewTag(tags[i].(string)), tags[i+1])
+			assert.NoError(t, err)
+			r.AuxFields = append(r.AuxFields, aux)
+		}
+		return r
+	}
+	for _, tt := range []struct {
+		r        *sam.Record
+		hap      byte
+		phaseSet uint32
+	}{
+		{newRead("HP", 1, "PS", 12345), hap1, 12345},
+		{newRead("HP", 2, "PS", 70000), hap2, 70000},
+		// Both tags are needed.
+		{newRead("HP", 1), hapUnassigned, 0},
+		{newRead("PS", 12345), hapUnassigned, 0},
+		{newRead("HP", 3, "PS", 12345), hapUnassigned, 0},
+		{newRead("HP", 1, "PS", 0), hapUnassigned, 0},
+		{newRead("HP", "1", "PS", 12345), hapUnassigned, 0},
+		{newRead(), hapUnassigned, 0},
+	} {
+		hap, phaseSet := readHapTags(tt.r)
+		assert.EQ(t, hap, tt.hap, tt.r.AuxFields)
+		assert.EQ(t, phaseSet, tt.phaseSet, tt.r.AuxFields)
+	}
+
+	pair := []readSNP{{samr: newRead("HP", 1, "PS", 100)}, {samr: newRead("HP", 1, "PS", 100)}}
+	hap, phaseSet := pairHaplotype(pair)
+	assert.EQ(t, hap, byte(hap1))
+	assert.EQ(t, phaseSet, uint32(100))
+	pair[1].samr = newRead("HP", 2, "PS", 100)
+	hap, phaseSet = pairHaplotype(pair)
+	assert.EQ(t, hap, byte(hapUnassigned))
+	assert.EQ(t, phaseSet, uint32(0))
+}
+
+func TestHapCounts(t *testing.T) {
+	pm := newPileupMutable(8, 4, false, nil)
+	pm.hapCounted = true
+	// A, A, C and N (seq8 15).
+	seq := []byte{1, 1, 2, 15}
+	qual := []byte{30, 10, 30, 30}
+	pm.readHap, pm.readPhaseSet = hap1, 100
+	pm.addBase(0, 0, 0, seq, qual, 20)
+	// Below the minimum base quality.
+	pm.addBase(0, 1, 0, seq, qual, 20)
+	pm.readHap, pm.readPhaseSet = hap2, 100
+	pm.addBase(0, 2, 1, seq, qual, 20)
+	pm.addBase(0, 3, 1, seq, qual, 20)
+	// A different phase set.
+	pm.readHap, pm.readPhaseSet = hap1, 200
+	pm.addBase(0, 0, 0, seq, qual, 20)
+	pm.readHap, pm.readPhaseSet = hapUnassigned, 0
+	pm.addBase(0, 2, 0, seq, qual, 20)
+	row := &pm.resultRingBuffer[0]
+	assert.EQ(t, row.phaseSet, uint32(100))
+	assert.EQ(t, row.hapCounts, [nHaplotype][pileup.NBase]uint32{
+		hapUnassigned: {1, 1, 0, 0},
+		hap1:          {1, 0, 0, 0},
+		hap2:          {0, 1, 0, 0},
+	})
+
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldHapCounts,
+		refID:         1,
+		pos:           17,
+		payload:       *row,
+	}
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow).payload.hapCounts, row.hapCounts)
+	assert.EQ(t, got.(*pileupRow).payload.phaseSet, row.phaseSet)
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+const (
+	// haplotypeSiteMinLen and haplotypeSiteMaxLen bound the length of an
+	// Opts.HaplotypeSites locus.
+	haplotypeSiteMinLen = 2
+	haplotypeSiteMaxLen = 8
+)
+
+// haplotypeSite is a 0-based half-open locus of Opts.HaplotypeSites.
+type haplotypeSite struct {
+	refID      int
+	start, end int
+}
+
+func (s *haplotypeSite) less(other *haplotypeSite) bool {
+	if s.refID != other.refID {
+		return s.refID < other.refID
+	}
+	return s.start < other.start
+}
+
+// parseHaplotypeSites parses a BED file of haplotype sites.  Columns after
+// the third are ignored.  The sites are returned in coordinate order, without
+// duplicates.
+func parseHaplotypeSites(r io.Reader, refs []*sam.Reference) ([]haplotypeSite, error) {
+	refIDs := make(map[string]int, len(refs))
+	for _, ref := range refs {
+		refIDs[ref.Name()] = ref.ID()
+	}
+	var sites []haplotypeSite
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || (line[0] == '#') || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("haplotype sites line %d: expected <chrom> <start> <end>, got %q", lineNum, line)
+		}
+		refID, ok := refIDs[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("haplotype sites line %d: unknown reference %s", lineNum, fields[0])
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		end, err2 := strconv.Atoi(fields[2])
+		if (err1 != nil) || (err2 != nil) || (start < 0) || (end > refs[refID].Len()) {
+			return nil, fmt.Errorf("haplotype sites line %d: invalid interval %s:%s-%s", lineNum, fields[0], fields[1], fields[2])
+		}
+		if (end-start < haplotypeSiteMinLen) || (end-start > haplotypeSiteMaxLen) {
+			return nil, fmt.Errorf("haplotype sites line %d: site length must be between %d and %d, got %d", lineNum, haplotypeSiteMinLen, haplotypeSiteMaxLen, end-start)
+		}
+		sites = append(sites, haplotypeSite{refID: refID, start: start, end: end})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(sites, func(i, j int) bool { return sites[i].less(&sites[j]) })
+	var uniq []haplotypeSite
+	for _, s := range sites {
+		if (len(uniq) > 0) && (uniq[len(uniq)-1] == s) {
+			continue
+		}
+		uniq = append(uniq, s)
+	}
+	return uniq, nil
+}
+
+// haplotypeCount is the number of reads with a given haplotype at a site.
+// fwd and rev split total by the strand of the read's fragment, as in the
+// basestrand formats; reads of unknown strand are only in total.
+type haplotypeCount struct {
+	total, fwd, rev int64
+}
+
+// haplotypeCounts accumulates the haplotype counts of Opts.HaplotypeSites
+// over the jobs of a run.
+type haplotypeCounts struct {
+	mu    sync.Mutex
+	sites []haplotypeSite
+	// counts[i] maps the haplotypes observed at sites[i] to their counts.
+	counts []map[string]haplotypeCount
+}
+
+func loadHaplotypeCounts(ctx context.Context, path string, refs []*sam.Reference) (h *haplotypeCounts, err error) {
+	var f file.File
+	if f, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	var sites []haplotypeSite
+	if sites, err = parseHaplotypeSites(f.Reader(ctx), refs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return newHaplotypeCounts(sites), nil
+}
+
+func newHaplotypeCounts(sites []haplotypeSite) *haplotypeCounts {
+	return &haplotypeCounts{
+		sites:  sites,
+		counts: make([]map[string]haplotypeCount, len(sites)),
+	}
+}
+
+// haplotypeJob counts the haplotypes at the sites which start in the range
+// of one job.  Sites are assigned to jobs by their start, so that a site
+// is counted once even if the reads covering it are seen by two jobs.
+type haplotypeJob struct {
+	all         *haplotypeCounts
+	first       int // index of sites[0] in all.sites
+	sites       []haplotypeSite
+	counts      []map[string]haplotypeCount
+	minBaseQual byte
+	seq, hap    []byte
+}
+
+func newHaplotypeJob(all *haplotypeCounts, jobRange biopb.CoordRange, minBaseQual byte) *haplotypeJob {
+	inRange := func(i int) bool {
+		s := &all.sites[i]
+		return jobRange.Contains(biopb.Coord{RefId: int32(s.refID), Pos: int32(s.start)})
+	}
+	first := sort.Search(len(all.sites), func(i int) bool {
+		s := &all.sites[i]
+		return !biopb.Coord{RefId: int32(s.refID), Pos: int32(s.start)}.LT(jobRange.Start)
+	})
+	limit := first
+	for (limit < len(all.sites)) && inRange(limit) {
+		limit++
+	}
+	return &haplotypeJob{
+		all:         all,
+		first:       first,
+		sites:       all.sites[first:limit],
+		counts:      make([]map[string]haplotypeCount, limit-first),
+		minBaseQual: minBaseQual,
+	}
+}
+
+// add counts the haplotypes of r, whose alignment spans [r.Pos, mapEnd), at
+// the job's sites.
+func (j *haplotypeJob) add(r *sam.Record, strand pileup.StrandType, mapEnd int) {
+	refID := r.Ref.ID()
+	key := haplotypeSite{refID: refID, start: r.Pos}
+	i := sort.Search(len(j.sites), func(i int) bool { return !j.sites[i].less(&key) })
+	j.seq = j.seq[:0]
+	for ; (i < len(j.sites)) && (j.sites[i].refID == refID) && (j.sites[i].start < mapEnd); i++ {
+		s := &j.sites[i]
+		if s.end > mapEnd {
+			continue
+		}
+		if len(j.seq) == 0 {
+			j.seq = append(j.seq, r.Seq.Expand()...)
+		}
+		var ok bool
+		if j.hap, ok = readHaplotype(r, j.seq, s.start, s.end, j.minBaseQual, j.hap[:0]); !ok {
+			continue
+		}
+		if j.counts[i] == nil {
+			j.counts[i] = make(map[string]haplotypeCount)
+		}
+		c := j.counts[i][string(j.hap)]
+		c.total++
+		switch strand {
+		case pileup.StrandFwd:
+			c.fwd++
+		case pileup.StrandRev:
+			c.rev++
+		}
+		j.counts[i][string(j.hap)] = c
+	}
+}
+
+// finish adds the job's counts to the run's.
+func (j *haplotypeJob) finish() {
+	j.all.mu.Lock()
+	defer j.all.mu.Unlock()
+	for i, counts := range j.counts {
+		if counts == nil {
+			continue
+		}
+		dst := j.all.counts[j.first+i]
+		if dst == nil {
+			dst = make(map[string]haplotypeCount)
+			j.all.counts[j.first+i] = dst
+		}
+		for hap, c := range counts {
+			d := dst[hap]
+			d.total += c.total
+			d.fwd += c.fwd
+			d.rev += c.rev
+			dst[hap] = d
+		}
+	}
+}
+
+// readHaplotype appends the bases of r (whose expanded sequence is seq) that
+// are aligned to reference positions [start, end) to buf.  It returns false
+// if the read doesn't cover the whole site with aligned bases of quality >=
+// minBaseQual, or has an insertion inside the site.
+func readHaplotype(r *sam.Record, seq []byte, start, end int, minBaseQual byte, buf []byte) ([]byte, bool) {
+	refPos, readPos := r.Pos, 0
+	for _, op := range r.Cigar {
+		n := op.Len()
+		switch op.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			p := refPos
+			if p < start {
+				p = start
+			}
+			for ; p < min(refPos+n, end); p++ {
+				i := readPos + p - refPos
+				if (r.Qual[i] < minBaseQual) || (seq[i] == 'N') {
+					return buf, false
+				}
+				buf = append(buf, seq[i])
+			}
+			refPos += n
+			readPos += n
+		case sam.CigarInsertion:
+			if (refPos > start) && (refPos < end) {
+				return buf, false
+			}
+			readPos += n
+		case sam.CigarSoftClipped:
+			readPos += n
+		case sam.CigarDeletion, sam.CigarSkipped:
+			if (refPos < end) && (refPos+n > start) {
+				return buf, false
+			}
+			refPos += n
+		}
+		if refPos >= end {
+			break
+		}
+	}
+	return buf, len(buf) == end-start
+}
+
+// writeHaplotypeCounts writes <mainPath>.haplotypes.tsv, with one line per
+// (site, haplotype): the reference haplotype, even if no read has it, and
+// every haplotype observed at least once, in order of decreasing count.
+func writeHaplotypeCounts(ctx context.Context, mainPath string, h *haplotypeCounts, refNames []string, refSeqs [][]byte) (err error) {
+	var dst file.File
+	if dst, err = file.Create(ctx, mainPath+".haplotypes.tsv"); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#CHROM\tPOS\tREF\tHAPLOTYPE\tCOUNT\tFWD\tREV")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	var refHap []byte
+	for i, s := range h.sites {
+		refHap = refHap[:0]
+		for _, b := range refSeqs[s.refID][s.start:s.end] {
+			refHap = append(refHap, pileup.Seq8ToASCIITable[b])
+		}
+		counts := h.counts[i]
+		haps := []string{string(refHap)}
+		for hap := range counts {
+			if hap != haps[0] {
+				haps = append(haps, hap)
+			}
+		}
+		sort.Slice(haps[1:], func(a, b int) bool {
+			ca, cb := counts[haps[1+a]].total, counts[haps[1+b]].total
+			if ca != cb {
+				return ca > cb
+			}
+			return haps[1+a] < haps[1+b]
+		})
+		for _, hap := range haps {
+			c := counts[hap]
+			w.WriteString(refNames[s.refID])
+			w.WriteInt64(int64(s.start) + 1)
+			w.WriteBytes(refHap)
+			w.WriteString(hap)
+			w.WriteInt64(c.total)
+			w.WriteInt64(c.fwd)
+			w.WriteInt64(c.rev)
+			if err = w.EndLine(); err != nil {
+				return
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseHaplotypeSites(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	ref2, _ := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	refs := []*sam.Reference{ref1, ref2}
+	_, _ = sam.NewHeader(nil, refs)
+
+	sites, err := parseHaplotypeSites(strings.NewReader(`track name=cpg
+# comment
+chr2	10	12	cpg1
+chr1	500	503
+chr1	100	102
+chr2	10	12
+`), refs)
+	assert.NoError(t, err)
+	assert.EQ(t, sites, []haplotypeSite{
+		{refID: 0, start: 100, end: 102},
+		{refID: 0, start: 500, end: 503},
+		{refID: 1, start: 10, end: 12},
+	})
+
+	for _, bad := range []string{
+		"chr1\t100\n",
+		"chr3\t100\t102\n",
+		"chr1\tx\t102\n",
+		"chr1\t999\t1001\n",
+		"chr1\t100\t101\n",
+		"chr1\t100\t109\n",
+	} {
+		_, err := parseHaplotypeSites(strings.NewReader(bad), refs)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestReadHaplotype(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	_, _ = sam.NewHeader(nil, []*sam.Reference{ref1})
+	read := func(pos int, cigar sam.Cigar, seq string) *sam.Record {
+		qual := make([]byte, len(seq))
+		for i := range qual {
+			qual[i] = 30
+		}
+		qual[0] = 5
+		return &sam.Record{Ref: ref1, Pos: pos, Cigar: cigar, Seq: sam.NewSeq([]byte(seq)), Qual: qual}
+	}
+	m := func(n int) sam.CigarOp { return sam.NewCigarOp(sam.CigarMatch, n) }
+
+	// 2S4M2I4M: ref 100..103 are read 2..5, ref 104..107 are read 8..11.
+	r := read(100, sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 2), m(4), sam.NewCigarOp(sam.CigarInsertion, 2), m(4)}, "TTACGTGGCATG")
+	seq := r.Seq.Expand()
+	for _, test := range []struct {
+		start, end int
+		want       string
+		ok         bool
+	}{
+		{100, 102, "AC", true},
+		{102, 104, "GT", true},
+		{103, 105, "", false}, // insertion inside the site
+		{104, 107, "CAT", true},
+		{106, 109, "", false}, // runs off the read
+		{98, 100, "", false},
+	} {
+		hap, ok := readHaplotype(r, seq, test.start, test.end, 20, nil)
+		assert.EQ(t, ok, test.ok, test)
+		if ok {
+			assert.EQ(t, string(hap), test.want, test)
+		}
+	}
+
+	// 3M1D3M: a deletion inside the site, or next to it.
+	r = read(100, sam.Cigar{m(3), sam.NewCigarOp(sam.CigarDeletion, 1), m(3)}, "ACGTAC")
+	seq = r.Seq.Expand()
+	_, ok := readHaplotype(r, seq, 102, 104, 20, nil)
+	assert.False(t, ok)
+	hap, ok := readHaplotype(r, seq, 104, 106, 20, nil)
+	assert.True(t, ok)
+	assert.EQ(t, string(hap), "TA")
+	// The first base has quality 5.
+	_, ok = readHaplotype(r, seq, 100, 102, 20, nil)
+	assert.False(t, ok)
+	hap, ok = readHaplotype(r, seq, 100, 102, 0, nil)
+	assert.True(t, ok)
+	assert.EQ(t, string(hap), "AC")
+}
+
+func TestHaplotypeJob(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	_, _ = sam.NewHeader(nil, []*sam.Reference{ref1})
+	all := newHaplotypeCounts([]haplotypeSite{
+		{refID: 0, start: 102, end: 104},
+		{refID: 0, start: 108, end: 110},
+		{refID: 0, start: 600, end: 602},
+	})
+	// The job only owns the sites which start in [0, 500).
+	job := newHaplotypeJob(all, biopb.CoordRange{
+		Start: biopb.Coord{RefId: 0, Pos: 0},
+		Limit: biopb.Coord{RefId: 0, Pos: 500},
+	}, 20)
+	assert.EQ(t, len(job.sites), 2)
+
+	read := func(seq string, reverse bool) *sam.Record {
+		qual := make([]byte, len(seq))
+		for i := range qual {
+			qual[i] = 30
+		}
+		r := &sam.Record{Ref: ref1, Pos: 100, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, len(seq))}, Seq: sam.NewSeq([]byte(seq)), Qual: qual}
+		if reverse {
+			r.Flags = sam.Reverse
+		}
+		return r
+	}
+	for _, r := range []*sam.Record{
+		read("AACGAAAACG", false),
+		read("AATGAAAACG", true),
+		read("AACGAAAA", false), // doesn't cover the second site
+	} {
+		strand := pileup.StrandFwd
+		if r.Flags&sam.Reverse != 0 {
+			strand = pileup.StrandRev
+		}
+		job.add(r, strand, r.Pos+len(r.Qual))
+	}
+	job.finish()
+	assert.EQ(t, all.counts[0], map[string]haplotypeCount{
+		"CG": {total: 2, fwd: 2},
+		"TG": {total: 1, rev: 1},
+	})
+	assert.EQ(t, all.counts[1], map[string]haplotypeCount{
+		"CG": {total: 2, fwd: 1, rev: 1},
+	})
+	assert.True(t, all.counts[2] == nil)
+}
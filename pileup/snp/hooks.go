@@ -0,0 +1,130 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"time"
+
+	"github.com/grailbio/base/recordio"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// Hooks are callbacks into the lifecycle of a pileup run, for library users
+// that embed the pileup, e.g. to drive a live dashboard or to write custom
+// side outputs.  Nil hooks are skipped.
+//
+// The jobs of a run call the hooks concurrently, so they must be thread safe;
+// they also run on the main loop, so they should return quickly.  A job that
+// is retried (Opts.ShardRetries) repeats its events, and a per-strand run
+// (Opts.PerStrand) goes through the shards twice.
+type Hooks struct {
+	// OnShardStart is called when a job starts on a shard, and OnShardDone
+	// when it is done with it, with the time it took.  Shards which are
+	// skipped, because they don't intersect the BED regions or the index
+	// shows that they have no reads, get both events too.  OnShardDone isn't
+	// called for a shard that fails.
+	OnShardStart func(shard gbam.Shard)
+	OnShardDone  func(shard gbam.Shard, elapsed time.Duration)
+	// OnPositions is called with batches of final pileup rows, in position
+	// order within each job; the rows of a shard are all passed before its
+	// OnShardDone.  The rows are only valid until OnPositions returns.
+	// Per-read features are only filled in when Opts.Cols selects them.  It
+	// is not supported by PileupSamples.
+	OnPositions func(rows []Row)
+	// OnFinish is called once, when the run ends, with its error (nil on
+	// success).
+	OnFinish func(err error)
+	// ReadVisitor, if non-nil, is shown each read of the main loop which
+	// passes the built-in read filters up to Opts.ReadFilter, and may leave
+	// it out of the pileup; see ReadVisitor.
+	ReadVisitor ReadVisitor
+}
+
+// Decision is the verdict of a ReadVisitor on a read.
+type Decision int
+
+const (
+	// ReadKeep lets the read through to the remaining filters, and the
+	// pileup.
+	ReadKeep Decision = iota
+	// ReadDrop leaves the read out of the pileup.  It is counted as a
+	// read_visitor read in the Opts.Metrics report.
+	ReadDrop
+)
+
+// ReadVisitor implements custom read filtering or annotation, e.g. dropping
+// the reads of some read groups, or routing reads by tag, without changes to
+// the main loop.
+//
+// VisitRead is called with a read, and ref, the sequence of the read's
+// reference in the .bam seq nibble encoding (A=1, C=2, G=4, T=8, N=15; see
+// pileup.Seq8ToASCIITable), or nil if the read has no reference.  It may
+// modify the fields of r (e.g. its aux fields, or its quality scores, by
+// replacing r.Qual), with the same effect as if the input had the modified
+// read, but must not modify ref, or retain r after returning: the main loop
+// recycles the reads it is done with.  In a multi-sample run, the reads of
+// all samples are visited.  Like the other hooks, VisitRead is called
+// concurrently by the jobs of the run, and must be thread safe.
+type ReadVisitor interface {
+	VisitRead(r *sam.Record, ref []byte) Decision
+}
+
+// hookBatchSize is the maximum number of rows passed to Hooks.OnPositions
+// at a time.
+const hookBatchSize = 1024
+
+// hookWriter is a recordio.Writer wrapper which also passes the pileupRows
+// appended to it, as Rows, to Hooks.OnPositions.
+type hookWriter struct {
+	recordio.Writer
+	onPositions func([]Row)
+	refs        []*sam.Reference
+	batch       []Row
+}
+
+func newHookWriter(w recordio.Writer, onPositions func([]Row), refs []*sam.Reference) *hookWriter {
+	return &hookWriter{
+		Writer:      w,
+		onPositions: onPositions,
+		refs:        refs,
+		batch:       make([]Row, 0, hookBatchSize),
+	}
+}
+
+func (w *hookWriter) Append(v interface{}) {
+	// Convert the row first, in case the underlying writer recycles it.
+	w.batch = append(w.batch, newRow(v.(*pileupRow), w.refs))
+	w.Writer.Append(v)
+	if len(w.batch) == hookBatchSize {
+		w.flushBatch()
+	}
+}
+
+// flushBatch passes the pending rows to onPositions.
+func (w *hookWriter) flushBatch() {
+	if len(w.batch) == 0 {
+		return
+	}
+	w.onPositions(w.batch)
+	for i := range w.batch {
+		w.batch[i] = Row{}
+	}
+	w.batch = w.batch[:0]
+}
+
+func (w *hookWriter) Finish() error {
+	w.flushBatch()
+	return w.Writer.Finish()
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestHookWriter(t *testing.T) {
+	ref, _ := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	refs := []*sam.Reference{ref}
+	c := &auditCollector{refs: refs, rows: make(map[auditKey]Row)}
+	var batchSizes []int
+	var positions []PosType
+	w := newHookWriter(c, func(rows []Row) {
+		batchSizes = append(batchSizes, len(rows))
+		for _, row := range rows {
+			assert.EQ(t, row.RefName, "chr1")
+			positions = append(positions, row.Pos)
+		}
+	}, refs)
+
+	nRow := hookBatchSize + 10
+	for i := 0; i < nRow; i++ {
+		w.Append(&pileupRow{pos: uint32(i)})
+	}
+	assert.EQ(t, batchSizes, []int{hookBatchSize})
+	w.flushBatch()
+	w.flushBatch()
+	assert.EQ(t, batchSizes, []int{hookBatchSize, 10})
+	w.Append(&pileupRow{pos: uint32(nRow)})
+	assert.NoError(t, w.Finish())
+	assert.EQ(t, batchSizes, []int{hookBatchSize, 10, 1})
+	assert.EQ(t, len(positions), nRow+1)
+	for i, pos := range positions {
+		assert.EQ(t, pos, PosType(i))
+	}
+	assert.EQ(t, len(c.rows), nRow+1)
+}
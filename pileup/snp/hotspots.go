@@ -0,0 +1,295 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// hotspot is a single-base substitution of Opts.Hotspots.
+type hotspot struct {
+	refID int
+	pos   PosType // 0-based
+	// ref and alt are pileup.BaseA..BaseT.
+	ref, alt byte
+	name     string
+}
+
+// asciiToBaseEnum returns the pileup.BaseA..BaseT value of an ASCII base, or
+// pileup.BaseX if it isn't one of ACGT.
+func asciiToBaseEnum(c byte) byte {
+	switch c {
+	case 'A', 'a':
+		return pileup.BaseA
+	case 'C', 'c':
+		return pileup.BaseC
+	case 'G', 'g':
+		return pileup.BaseG
+	case 'T', 't':
+		return pileup.BaseT
+	}
+	return pileup.BaseX
+}
+
+// parseHotspots parses a hotspot list: a tab- or space-separated file with
+// <chrom> <1-based pos> <ref> <alt> [<name>] columns, or a VCF file (vcf
+// true), whose ID is the name and whose ALT may list several alleles.  Lines
+// starting with '#' are ignored.  The hotspots are returned in coordinate
+// order, then in ALT order, without duplicates.
+func parseHotspots(r io.Reader, vcf bool, refs []*sam.Reference) ([]hotspot, error) {
+	refIDs := make(map[string]int, len(refs))
+	for _, ref := range refs {
+		refIDs[ref.Name()] = ref.ID()
+	}
+	var hotspots []hotspot
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || (line[0] == '#') {
+			continue
+		}
+		fields := strings.Fields(line)
+		var refCol, altCol, nameCol int
+		if vcf {
+			refCol, altCol, nameCol = 3, 4, 2
+		} else {
+			refCol, altCol, nameCol = 2, 3, 4
+		}
+		if len(fields) <= altCol {
+			return nil, fmt.Errorf("hotspots line %d: expected at least %d columns, got %q", lineNum, altCol+1, line)
+		}
+		refID, ok := refIDs[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("hotspots line %d: unknown reference %s", lineNum, fields[0])
+		}
+		pos, err := strconv.Atoi(fields[1])
+		if (err != nil) || (pos < 1) || (pos > refs[refID].Len()) {
+			return nil, fmt.Errorf("hotspots line %d: invalid position %s:%s", lineNum, fields[0], fields[1])
+		}
+		name := "."
+		if len(fields) > nameCol {
+			name = fields[nameCol]
+		}
+		ref := fields[refCol]
+		for _, alt := range strings.Split(fields[altCol], ",") {
+			if (len(ref) != 1) || (len(alt) != 1) || (asciiToBaseEnum(ref[0]) == pileup.BaseX) || (asciiToBaseEnum(alt[0]) == pileup.BaseX) || (asciiToBaseEnum(ref[0]) == asciiToBaseEnum(alt[0])) {
+				return nil, fmt.Errorf("hotspots line %d: %s>%s is not a single-base substitution (the only supported kind of hotspot)", lineNum, ref, alt)
+			}
+			hotspots = append(hotspots, hotspot{
+				refID: refID,
+				pos:   PosType(pos - 1),
+				ref:   asciiToBaseEnum(ref[0]),
+				alt:   asciiToBaseEnum(alt[0]),
+				name:  name,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(hotspots, func(i, j int) bool {
+		hi, hj := &hotspots[i], &hotspots[j]
+		if hi.refID != hj.refID {
+			return hi.refID < hj.refID
+		}
+		if hi.pos != hj.pos {
+			return hi.pos < hj.pos
+		}
+		return hi.alt < hj.alt
+	})
+	n := 0
+	for i := range hotspots {
+		if (n > 0) && (hotspots[i].refID == hotspots[n-1].refID) && (hotspots[i].pos == hotspots[n-1].pos) && (hotspots[i].alt == hotspots[n-1].alt) {
+			continue
+		}
+		hotspots[n] = hotspots[i]
+		n++
+	}
+	return hotspots[:n], nil
+}
+
+// loadHotspots reads the hotspot list at path (see parseHotspots), which is
+// parsed as VCF if it has a .vcf suffix.
+func loadHotspots(ctx context.Context, path string, refs []*sam.Reference) (hotspots []hotspot, err error) {
+	var f file.File
+	if f, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	if hotspots, err = parseHotspots(f.Reader(ctx), strings.HasSuffix(path, ".vcf"), refs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(hotspots) == 0 {
+		return nil, fmt.Errorf("%s: no hotspots", path)
+	}
+	return
+}
+
+// hotspotEntries returns the positions of hotspots as BED entries.
+func hotspotEntries(hotspots []hotspot, refs []*sam.Reference) []interval.Entry {
+	entries := make([]interval.Entry, 0, len(hotspots))
+	for _, h := range hotspots {
+		refName := refs[h.refID].Name()
+		if n := len(entries); (n > 0) && (entries[n-1].RefName == refName) && (entries[n-1].Start0 == h.pos) {
+			continue
+		}
+		entries = append(entries, interval.Entry{RefName: refName, Start0: h.pos, End: h.pos + 1})
+	}
+	return entries
+}
+
+// checkHotspotRefs returns an error if the REF base of a hotspot doesn't
+// match the reference, which usually means that the list is for another
+// genome build.
+func checkHotspotRefs(hotspots []hotspot, refs []*sam.Reference, refSeqs [][]byte) error {
+	for _, h := range hotspots {
+		if refBase := pileup.Seq8ToEnumTable[refSeqs[h.refID][h.pos]]; refBase != h.ref {
+			return fmt.Errorf("hotspot %s:%d has REF %c, but the reference has %c", refs[h.refID].Name(), h.pos+1, pileup.EnumToASCIITable[h.ref], pileup.EnumToASCIITable[refBase])
+		}
+	}
+	return nil
+}
+
+// hotspotStatus returns the STATUS column of the hotspot report, for a
+// hotspot whose ALT base has nAlt of the total high-quality A/C/G/T bases.
+// The hotspot is detected under the same rule as the ALT alleles of the vcf
+// output (see vcfAltBases).
+func hotspotStatus(nAlt, total uint32, minAltFrac float64) string {
+	switch {
+	case total == 0:
+		return "no_coverage"
+	case (nAlt != 0) && (float64(nAlt) >= minAltFrac*float64(total)):
+		return "detected"
+	}
+	return "not_detected"
+}
+
+// writeHotspotReport writes <mainPath>.hotspots.tsv, with the depth, REF and
+// ALT counts, allele fraction and status of each hotspot, from the rows in
+// tmpFiles.  Every hotspot is reported, whether or not its ALT allele is
+// seen.  If ann is non-nil, the rows are annotated with the overlapping
+// genes.
+func writeHotspotReport(ctx context.Context, tmpFiles []*os.File, mainPath string, hotspots []hotspot, minAltFrac float64, refNames []string, ann *annotator) (err error) {
+	var dst file.File
+	if dst, err = file.Create(ctx, mainPath+".hotspots.tsv"); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#CHROM\tPOS\tREF\tALT\tNAME\tDP\tREF_COUNT\tALT_COUNT\tVAF\tSTATUS")
+	if ann != nil {
+		for _, col := range annotationColumns() {
+			w.WriteString(col)
+		}
+	}
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	// The rows are in coordinate order, like the hotspots, so the hotspots
+	// are matched up in a single pass; the ones without a row (possible with
+	// TimeBudget) are reported with no coverage.
+	var empty pileupPayload
+	writeRows := func(payload *pileupPayload, hs []hotspot) error {
+		var total uint32
+		for b := 0; b < pileup.NBase; b++ {
+			total += payload.counts[b][0] + payload.counts[b][1]
+		}
+		for _, h := range hs {
+			nRef := payload.counts[h.ref][0] + payload.counts[h.ref][1]
+			nAlt := payload.counts[h.alt][0] + payload.counts[h.alt][1]
+			w.WriteString(refNames[h.refID])
+			w.WriteUint32(uint32(h.pos + 1))
+			w.WriteByte(pileup.EnumToASCIITable[h.ref])
+			w.WriteByte(pileup.EnumToASCIITable[h.alt])
+			w.WriteString(h.name)
+			w.WriteUint32(payload.depth)
+			w.WriteUint32(nRef)
+			w.WriteUint32(nAlt)
+			if total == 0 {
+				w.WriteByte('.')
+			} else {
+				w.WriteFloat64(float64(nAlt)/float64(total), 'f', 4)
+			}
+			w.WriteString(hotspotStatus(nAlt, total, minAltFrac))
+			if ann != nil {
+				ann.lookup(refNames[h.refID], h.pos)
+				ann.writeCols(w)
+			}
+			if err := w.EndLine(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// nextGroup returns the hotspots at the position of hotspots[i].
+	nextGroup := func(i int) []hotspot {
+		j := i + 1
+		for (j < len(hotspots)) && (hotspots[j].refID == hotspots[i].refID) && (hotspots[j].pos == hotspots[i].pos) {
+			j++
+		}
+		return hotspots[i:j]
+	}
+	i := 0
+	for _, f := range tmpFiles {
+		if _, err = f.Seek(0, 0); err != nil {
+			return
+		}
+		scanner := newPileupRowScanner(f)
+		for (i < len(hotspots)) && scanner.Scan() {
+			pr := scanner.Get().(*pileupRow)
+			refID, pos := int(pr.refID), PosType(pr.pos)
+			for i < len(hotspots) {
+				h := &hotspots[i]
+				if (h.refID > refID) || ((h.refID == refID) && (h.pos > pos)) {
+					break
+				}
+				group := nextGroup(i)
+				payload := &empty
+				if (h.refID == refID) && (h.pos == pos) {
+					payload = &pr.payload
+				}
+				if err = writeRows(payload, group); err != nil {
+					return
+				}
+				i += len(group)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+	}
+	for i < len(hotspots) {
+		group := nextGroup(i)
+		if err = writeRows(&empty, group); err != nil {
+			return
+		}
+		i += len(group)
+	}
+	log.Printf("writeHotspotReport: %d hotspots written to %s.hotspots.tsv", len(hotspots), mainPath)
+	return w.Flush()
+}
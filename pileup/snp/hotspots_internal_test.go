@@ -0,0 +1,149 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func hotspotTestRefs(t *testing.T) []*sam.Reference {
+	var refs []*sam.Reference
+	for _, name := range []string{"chr1", "chr2"} {
+		ref, err := sam.NewReference(name, "", "", 100, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	return header.Refs()
+}
+
+func TestParseHotspots(t *testing.T) {
+	refs := hotspotTestRefs(t)
+	hotspots, err := parseHotspots(strings.NewReader(`#CHROM	POS	REF	ALT	NAME
+chr2	10	C	T	KRAS_G12D
+chr1	5	g	a
+chr1	5	G	A	dup
+chr1	5	G	C	other
+`), false, refs)
+	assert.NoError(t, err)
+	assert.EQ(t, hotspots, []hotspot{
+		{refID: 0, pos: 4, ref: pileup.BaseG, alt: pileup.BaseA, name: "."},
+		{refID: 0, pos: 4, ref: pileup.BaseG, alt: pileup.BaseC, name: "other"},
+		{refID: 1, pos: 9, ref: pileup.BaseC, alt: pileup.BaseT, name: "KRAS_G12D"},
+	})
+	assert.EQ(t, hotspotEntries(hotspots, refs), []interval.Entry{
+		{RefName: "chr1", Start0: 4, End: 5},
+		{RefName: "chr2", Start0: 9, End: 10},
+	})
+
+	hotspots, err = parseHotspots(strings.NewReader(`##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+chr1	7	rs1	A	C,T	.	.	.
+`), true, refs)
+	assert.NoError(t, err)
+	assert.EQ(t, hotspots, []hotspot{
+		{refID: 0, pos: 6, ref: pileup.BaseA, alt: pileup.BaseC, name: "rs1"},
+		{refID: 0, pos: 6, ref: pileup.BaseA, alt: pileup.BaseT, name: "rs1"},
+	})
+
+	for _, tc := range []struct {
+		data string
+		err  string
+	}{
+		{"chr3\t5\tG\tA\n", "unknown reference chr3"},
+		{"chr1\t0\tG\tA\n", "invalid position chr1:0"},
+		{"chr1\t101\tG\tA\n", "invalid position chr1:101"},
+		{"chr1\t5\tG\n", "expected at least 4 columns"},
+		{"chr1\t5\tGA\tA\n", "GA>A is not a single-base substitution"},
+		{"chr1\t5\tG\tG\n", "G>G is not a single-base substitution"},
+		{"chr1\t5\tG\tN\n", "G>N is not a single-base substitution"},
+	} {
+		_, err = parseHotspots(strings.NewReader(tc.data), false, refs)
+		assert.NotNil(t, err, tc.data)
+		assert.HasSubstr(t, err.Error(), tc.err)
+	}
+}
+
+func TestCheckHotspotRefs(t *testing.T) {
+	refs := hotspotTestRefs(t)
+	refSeqs := [][]byte{make([]byte, 100), make([]byte, 100)}
+	refSeqs[0][4] = 4 // G
+	hotspots := []hotspot{{refID: 0, pos: 4, ref: pileup.BaseG, alt: pileup.BaseA}}
+	assert.NoError(t, checkHotspotRefs(hotspots, refs, refSeqs))
+	hotspots[0].ref = pileup.BaseC
+	err := checkHotspotRefs(hotspots, refs, refSeqs)
+	assert.NotNil(t, err)
+	assert.HasSubstr(t, err.Error(), "chr1:5 has REF C, but the reference has G")
+}
+
+func TestHotspotStatus(t *testing.T) {
+	assert.EQ(t, hotspotStatus(0, 0, 0.1), "no_coverage")
+	assert.EQ(t, hotspotStatus(0, 10, 0), "not_detected")
+	assert.EQ(t, hotspotStatus(1, 10, 0.1), "detected")
+	assert.EQ(t, hotspotStatus(1, 11, 0.1), "not_detected")
+}
+
+func TestWriteHotspotReport(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	rows := []pileupRow{
+		{fieldsPresent: fieldCounts, refID: 0, pos: 4},
+		{fieldsPresent: fieldCounts, refID: 1, pos: 20},
+	}
+	rows[0].payload.depth = 12
+	rows[0].payload.counts[pileup.BaseG] = [2]uint32{4, 4}
+	rows[0].payload.counts[pileup.BaseA] = [2]uint32{1, 1}
+	rows[1].payload.depth = 3
+	rows[1].payload.counts[pileup.BaseT] = [2]uint32{3, 0}
+	f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w := newPileupRowWriter(f, defaultShardCodec)
+	for i := range rows {
+		w.Append(&rows[i])
+	}
+	assert.NoError(t, w.Finish())
+
+	hotspots := []hotspot{
+		{refID: 0, pos: 4, ref: pileup.BaseG, alt: pileup.BaseA, name: "h1"},
+		{refID: 0, pos: 4, ref: pileup.BaseG, alt: pileup.BaseT, name: "h2"},
+		{refID: 1, pos: 9, ref: pileup.BaseC, alt: pileup.BaseT, name: "h3"},
+		{refID: 1, pos: 20, ref: pileup.BaseA, alt: pileup.BaseT, name: "h4"},
+		{refID: 1, pos: 50, ref: pileup.BaseA, alt: pileup.BaseC, name: "h5"},
+	}
+	mainPath := filepath.Join(tmpdir, "out")
+	assert.NoError(t, writeHotspotReport(ctx, []*os.File{f}, mainPath, hotspots, 0.1, []string{"chr1", "chr2"}, nil))
+	data, err := ioutil.ReadFile(mainPath + ".hotspots.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), `#CHROM	POS	REF	ALT	NAME	DP	REF_COUNT	ALT_COUNT	VAF	STATUS
+chr1	5	G	A	h1	12	8	2	0.2000	detected
+chr1	5	G	T	h2	12	8	0	0.0000	not_detected
+chr2	10	C	T	h3	0	0	0	.	no_coverage
+chr2	21	A	T	h4	3	0	3	1.0000	detected
+chr2	51	A	C	h5	0	0	0	.	no_coverage
+`)
+}
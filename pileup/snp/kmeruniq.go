@@ -0,0 +1,262 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/bio/pileup"
+)
+
+// maxKmerUniquenessK is the largest k-mer length of Opts.KmerUniqueness; the
+// k-mers are packed into uint64s.
+const maxKmerUniquenessK = 32
+
+// kmerFilterBits is the log2 of the size of kmerUniqueness.filter, in bits.
+const kmerFilterBits = 26
+
+// kmerCode2bit maps seq8 bases to 2-bit codes, and everything else (N and the
+// IUPAC codes) to 4.
+var kmerCode2bit = func() (t [16]byte) {
+	for i := range t {
+		t[i] = 4
+	}
+	t[1], t[2], t[4], t[8] = 0, 1, 2, 3 // A, C, G, T
+	return
+}()
+
+// parseKmerUniqueness validates Opts.KmerUniqueness.
+func parseKmerUniqueness(k int) (int, error) {
+	if (k < 0) || (k > maxKmerUniquenessK) {
+		return 0, fmt.Errorf("Pileup: invalid kmer-uniqueness= argument %d (must be in 0..%d)", k, maxKmerUniquenessK)
+	}
+	return k, nil
+}
+
+// kmerUniqueness implements Opts.KmerUniqueness.  It holds the number of
+// occurrences in the reference of the k-mers which overlap the candidate
+// sites of the VCF output, with either the reference base or an ALT base
+// at the site.  The k-mers are canonical (the smaller of the k-mer and its
+// reverse complement), since a read from the other strand of the other
+// locus would be just as misleading.
+type kmerUniqueness struct {
+	k int
+	// kmers are the sorted distinct canonical k-mers, and counts[i] is the
+	// number of occurrences of kmers[i].
+	kmers  []uint64
+	counts []uint32
+	// filter is a bitset of the hashes of kmers, which rules out most of the
+	// reference k-mers before the binary search.
+	filter []uint64
+
+	kmerBuf []uint64
+}
+
+// kmerHash returns the filter bit of kmer.
+func kmerHash(kmer uint64) uint64 {
+	return (kmer * 0x9e3779b97f4a7c15) >> (64 - kmerFilterBits)
+}
+
+// appendSiteKmers appends to kmers the canonical k-mers of refSeq8 which
+// overlap pos, with the base of 2-bit code posCode in place of refSeq8[pos].
+// The 2-bit codes of A, C, G and T are their pileup.BaseA..BaseT values.
+// The k-mers which run off the reference, or contain a base other than A, C,
+// G and T, are skipped.
+func appendSiteKmers(kmers []uint64, refSeq8 []byte, pos int, posCode byte, k int) []uint64 {
+	mask := ^uint64(0) >> uint(64-2*k)
+	revShift := uint(2 * (k - 1))
+	var fwd, rev uint64
+	nValid := 0
+	start := pos - k + 1
+	if start < 0 {
+		start = 0
+	}
+	for i := start; (i < pos+k) && (i < len(refSeq8)); i++ {
+		c := uint64(kmerCode2bit[refSeq8[i]&15])
+		if i == pos {
+			c = uint64(posCode)
+		}
+		if c > 3 {
+			nValid = 0
+			continue
+		}
+		fwd = ((fwd << 2) | c) & mask
+		rev = (rev >> 2) | ((3 - c) << revShift)
+		if nValid++; (nValid >= k) && (i >= pos) {
+			if fwd < rev {
+				kmers = append(kmers, fwd)
+			} else {
+				kmers = append(kmers, rev)
+			}
+		}
+	}
+	return kmers
+}
+
+// newKmerUniqueness collects the k-mers of the candidate sites in tmpFiles,
+// the VCF records with at least one ALT allele (see vcfAltBases), and counts
+// their occurrences in refSeqs.  The reference is scanned once, with up to
+// parallelism goroutines.
+func newKmerUniqueness(tmpFiles []*os.File, k int, minAltFrac float64, refSeqs [][]byte, parallelism int) (*kmerUniqueness, error) {
+	ku := &kmerUniqueness{k: k}
+	alts := make([]byte, 0, pileup.NBase)
+	for _, f := range tmpFiles {
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		scanner := newPileupRowScanner(f)
+		for scanner.Scan() {
+			pr := scanner.Get().(*pileupRow)
+			refSeq8 := refSeqs[pr.refID]
+			pos := int(pr.pos)
+			refBase := pileup.Seq8ToEnumTable[refSeq8[pos]]
+			if alts = vcfAltBases(&pr.payload.counts, refBase, minAltFrac, alts); len(alts) == 0 {
+				continue
+			}
+			ku.kmers = appendSiteKmers(ku.kmers, refSeq8, pos, kmerCode2bit[refSeq8[pos]&15], k)
+			for _, b := range alts {
+				ku.kmers = appendSiteKmers(ku.kmers, refSeq8, pos, b, k)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ku, ku.countKmers(refSeqs, parallelism)
+}
+
+// countKmers sorts and deduplicates ku.kmers, and counts their occurrences in
+// refSeqs.
+func (ku *kmerUniqueness) countKmers(refSeqs [][]byte, parallelism int) error {
+	sort.Slice(ku.kmers, func(i, j int) bool { return ku.kmers[i] < ku.kmers[j] })
+	n := 0
+	for i, kmer := range ku.kmers {
+		if (i == 0) || (kmer != ku.kmers[n-1]) {
+			ku.kmers[n] = kmer
+			n++
+		}
+	}
+	ku.kmers = ku.kmers[:n:n]
+	ku.counts = make([]uint32, n)
+	ku.filter = make([]uint64, (1<<kmerFilterBits)/64)
+	for _, kmer := range ku.kmers {
+		h := kmerHash(kmer)
+		ku.filter[h/64] |= 1 << (h % 64)
+	}
+	log.Printf("kmerUniqueness: counting %d distinct %d-mers in the reference", n, ku.k)
+	if n == 0 {
+		return nil
+	}
+	return traverse.Limit(parallelism).Each(len(refSeqs), func(refID int) error {
+		ku.countRef(refSeqs[refID])
+		return nil
+	})
+}
+
+// countRef adds the occurrences of ku.kmers in refSeq8 to ku.counts.
+func (ku *kmerUniqueness) countRef(refSeq8 []byte) {
+	k := ku.k
+	mask := ^uint64(0) >> uint(64-2*k)
+	revShift := uint(2 * (k - 1))
+	var fwd, rev uint64
+	nValid := 0
+	for _, b := range refSeq8 {
+		c := uint64(kmerCode2bit[b&15])
+		if c > 3 {
+			nValid = 0
+			continue
+		}
+		fwd = ((fwd << 2) | c) & mask
+		rev = (rev >> 2) | ((3 - c) << revShift)
+		if nValid++; nValid < k {
+			continue
+		}
+		kmer := fwd
+		if rev < kmer {
+			kmer = rev
+		}
+		if h := kmerHash(kmer); ku.filter[h/64]&(1<<(h%64)) == 0 {
+			continue
+		}
+		if i := ku.index(kmer); i >= 0 {
+			atomic.AddUint32(&ku.counts[i], 1)
+		}
+	}
+}
+
+// index returns the index of kmer in ku.kmers, or -1 if it isn't there.
+func (ku *kmerUniqueness) index(kmer uint64) int {
+	i := sort.Search(len(ku.kmers), func(i int) bool { return ku.kmers[i] >= kmer })
+	if (i < len(ku.kmers)) && (ku.kmers[i] == kmer) {
+		return i
+	}
+	return -1
+}
+
+// count returns the number of occurrences of kmer in the reference.
+func (ku *kmerUniqueness) count(kmer uint64) uint32 {
+	if i := ku.index(kmer); i >= 0 {
+		return ku.counts[i]
+	}
+	return 0
+}
+
+// vcfKmerUniquenessHeaderLines returns the ##INFO lines of the fields written
+// by kmerUniqueness.appendInfo.
+func vcfKmerUniquenessHeaderLines(k int) string {
+	return fmt.Sprintf(`##INFO=<ID=REF_KMER_COPIES,Number=1,Type=Integer,Description="Smallest number of occurrences in the reference (either strand) of the %[1]d-mers overlapping the position; 1 means that the position is unique">
+##INFO=<ID=ALT_KMER_HITS,Number=A,Type=Integer,Description="Number of the %[1]d-mers overlapping the position, with the ALT base in place of REF, which occur elsewhere in the reference (either strand)">
+`, k)
+}
+
+// appendInfo appends the REF_KMER_COPIES and ALT_KMER_HITS INFO fields of
+// the position pos of refSeq8 with ALT bases alts (pileup.BaseA..BaseT) to
+// buf.  REF_KMER_COPIES is '.' when no k-mer overlapping the position
+// consists of A, C, G and T only.
+func (ku *kmerUniqueness) appendInfo(buf []byte, refSeq8 []byte, pos int, alts []byte) []byte {
+	ku.kmerBuf = appendSiteKmers(ku.kmerBuf[:0], refSeq8, pos, kmerCode2bit[refSeq8[pos]&15], ku.k)
+	buf = append(buf, ";REF_KMER_COPIES="...)
+	if len(ku.kmerBuf) == 0 {
+		buf = append(buf, '.')
+	} else {
+		minCount := ^uint32(0)
+		for _, kmer := range ku.kmerBuf {
+			if c := ku.count(kmer); c < minCount {
+				minCount = c
+			}
+		}
+		buf = strconv.AppendUint(buf, uint64(minCount), 10)
+	}
+	buf = append(buf, ";ALT_KMER_HITS="...)
+	for i, b := range alts {
+		if i != 0 {
+			buf = append(buf, ',')
+		}
+		ku.kmerBuf = appendSiteKmers(ku.kmerBuf[:0], refSeq8, pos, b, ku.k)
+		hits := 0
+		for _, kmer := range ku.kmerBuf {
+			if ku.count(kmer) != 0 {
+				hits++
+			}
+		}
+		buf = strconv.AppendInt(buf, int64(hits), 10)
+	}
+	return buf
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseKmerUniqueness(t *testing.T) {
+	k, err := parseKmerUniqueness(0)
+	assert.NoError(t, err)
+	assert.EQ(t, k, 0)
+	k, err = parseKmerUniqueness(32)
+	assert.NoError(t, err)
+	assert.EQ(t, k, 32)
+	_, err = parseKmerUniqueness(33)
+	assert.HasSubstr(t, err.Error(), "invalid kmer-uniqueness=")
+	_, err = parseKmerUniqueness(-1)
+	assert.HasSubstr(t, err.Error(), "invalid kmer-uniqueness=")
+}
+
+func TestKmerUniqueness(t *testing.T) {
+	var refSeqs [][]byte
+	for _, s := range []string{"GATTACA", "CCCGGGA", "ANA"} {
+		b := make([]byte, len(s))
+		biosimd.ASCIIToSeq8(b, []byte(s))
+		refSeqs = append(refSeqs, b)
+	}
+	type site struct {
+		refID int
+		pos   int
+		alts  []byte
+		info  string
+	}
+	sites := []site{
+		// The reference 3-mers ATT, TTA and TAC occur once.  Of the ALT ones,
+		// TAA (with A) and ATC (with C) occur elsewhere.
+		{0, 3, []byte{pileup.BaseA, pileup.BaseC, pileup.BaseG}, ";REF_KMER_COPIES=1;ALT_KMER_HITS=1,1,0"},
+		// CCC and CCG are the reverse complements of GGG and CGG.
+		{1, 1, []byte{pileup.BaseT}, ";REF_KMER_COPIES=2;ALT_KMER_HITS=0"},
+		// Every 3-mer has the N.
+		{2, 0, []byte{pileup.BaseC}, ";REF_KMER_COPIES=.;ALT_KMER_HITS=0"},
+	}
+	ku := &kmerUniqueness{k: 3}
+	for _, s := range sites {
+		refSeq8 := refSeqs[s.refID]
+		ku.kmers = appendSiteKmers(ku.kmers, refSeq8, s.pos, kmerCode2bit[refSeq8[s.pos]], ku.k)
+		for _, b := range s.alts {
+			ku.kmers = appendSiteKmers(ku.kmers, refSeq8, s.pos, b, ku.k)
+		}
+	}
+	assert.NoError(t, ku.countKmers(refSeqs, 2))
+	for _, s := range sites {
+		assert.EQ(t, string(ku.appendInfo(nil, refSeqs[s.refID], s.pos, s.alts)), s.info)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// longReadOpts holds the parsed Opts.LongRead, Opts.MinReadIdentity and
+// Opts.HomopolymerIndels.
+type longReadOpts struct {
+	minIdentity       float64
+	homopolymerIndels bool
+}
+
+// parseLongReadOpts returns nil if the long-read mode is disabled.
+func parseLongReadOpts(longRead bool, minIdentity float64, homopolymerIndels bool) (*longReadOpts, error) {
+	if !longRead {
+		if minIdentity != 0 {
+			return nil, fmt.Errorf("Pileup: min-read-identity= requires long-read=")
+		}
+		if homopolymerIndels {
+			return nil, fmt.Errorf("Pileup: homopolymer-indels= requires long-read=")
+		}
+		return nil, nil
+	}
+	if math.IsNaN(minIdentity) || (minIdentity < 0) || (minIdentity > 1) {
+		return nil, fmt.Errorf("Pileup: invalid min-read-identity= argument %v", minIdentity)
+	}
+	return &longReadOpts{
+		minIdentity:       minIdentity,
+		homopolymerIndels: homopolymerIndels,
+	}, nil
+}
+
+// readStrand returns the strand of r.  Long reads are unpaired, so their
+// strand is the one they are aligned to; otherwise it is determined by the
+// read pair (see pileup.GetStrand).
+func readStrand(r *sam.Record, longRead bool) pileup.StrandType {
+	if !longRead {
+		return pileup.GetStrand(r)
+	}
+	if r.Flags&sam.Reverse != 0 {
+		return pileup.StrandRev
+	}
+	return pileup.StrandFwd
+}
+
+// readIdentity returns the alignment identity of read, 1 - NM / n, where NM
+// is its edit distance from refSeq8 (see readEditDistance; ignoreTag is
+// Opts.RecomputeNM) and n is the number of its aligned, inserted and deleted
+// bases.  It is 1 for a read without any of them.
+func readIdentity(read *readSNP, refSeq8 []byte, ignoreTag bool) float64 {
+	n := 0
+	for _, op := range read.samr.Cigar {
+		switch op.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch, sam.CigarInsertion, sam.CigarDeletion:
+			n += op.Len()
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(readEditDistance(read, refSeq8, ignoreTag))/float64(n)
+}
+
+// homopolymerAnchor implements Opts.HomopolymerIndels.  seq8 holds the bases
+// of an indel anchored at anchor (the inserted bases, or the deleted
+// reference bases).  If they are all the same base, the indel lengthens or
+// shortens a reference homopolymer of that base, and the returned anchor is
+// the position before the homopolymer, so that the reads which place the
+// indel at different positions in it agree.  It isn't moved before
+// minAnchor.
+func homopolymerAnchor(refSeq8, seq8 []byte, anchor, minAnchor PosType) PosType {
+	if len(seq8) == 0 {
+		return anchor
+	}
+	base := seq8[0]
+	for _, b := range seq8[1:] {
+		if b != base {
+			return anchor
+		}
+	}
+	for (anchor > minAnchor) && (anchor < PosType(len(refSeq8))) && (refSeq8[anchor] == base) {
+		anchor--
+	}
+	return anchor
+}
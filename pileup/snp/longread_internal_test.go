@@ -0,0 +1,91 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseLongReadOpts(t *testing.T) {
+	opts, err := parseLongReadOpts(false, 0, false)
+	assert.NoError(t, err)
+	assert.True(t, opts == nil)
+	opts, err = parseLongReadOpts(true, 0.9, true)
+	assert.NoError(t, err)
+	assert.EQ(t, *opts, longReadOpts{minIdentity: 0.9, homopolymerIndels: true})
+	_, err = parseLongReadOpts(false, 0.9, false)
+	assert.HasSubstr(t, err.Error(), "min-read-identity= requires long-read=")
+	_, err = parseLongReadOpts(false, 0, true)
+	assert.HasSubstr(t, err.Error(), "homopolymer-indels= requires long-read=")
+	_, err = parseLongReadOpts(true, 1.5, false)
+	assert.HasSubstr(t, err.Error(), "invalid min-read-identity=")
+}
+
+func TestReadStrand(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	// An unpaired read has no pair strand, but a long read's strand is the
+	// one it is aligned to.
+	samr := &sam.Record{Name: "r", Ref: ref1, Pos: 100}
+	assert.EQ(t, readStrand(samr, false), pileup.StrandNone)
+	assert.EQ(t, readStrand(samr, true), pileup.StrandFwd)
+	samr.Flags = sam.Reverse
+	assert.EQ(t, readStrand(samr, true), pileup.StrandRev)
+}
+
+func TestReadIdentity(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	refSeq8 := make([]byte, 1000)
+	for i := range refSeq8 {
+		refSeq8[i] = 1 // A
+	}
+	samr := &sam.Record{
+		Name: "r",
+		Ref:  ref1,
+		Pos:  100,
+		// 2S5M1I1M1D = 6 aligned bases, 1 inserted and 1 deleted.
+		Cigar: []sam.CigarOp{
+			sam.NewCigarOp(sam.CigarSoftClipped, 2),
+			sam.NewCigarOp(sam.CigarMatch, 5),
+			sam.NewCigarOp(sam.CigarInsertion, 1),
+			sam.NewCigarOp(sam.CigarMatch, 1),
+			sam.NewCigarOp(sam.CigarDeletion, 1),
+		},
+	}
+	// One mismatch, plus the insertion and deletion.
+	read := readSNP{samr: samr, seq8: []byte{8, 8, 1, 1, 4, 1, 1, 2, 1}}
+	assert.EQ(t, readIdentity(&read, refSeq8, false), 0.625)
+	samr.Cigar = []sam.CigarOp{sam.NewCigarOp(sam.CigarSoftClipped, 9)}
+	assert.EQ(t, readIdentity(&read, refSeq8, false), 1.0)
+}
+
+func TestHomopolymerAnchor(t *testing.T) {
+	// C G A A A A T
+	refSeq8 := []byte{2, 4, 1, 1, 1, 1, 8}
+	a := []byte{1}
+	// An A inserted or deleted anywhere in the run of As goes after the G.
+	for anchor := PosType(1); anchor <= 5; anchor++ {
+		assert.EQ(t, homopolymerAnchor(refSeq8, a, anchor, 0), PosType(1))
+	}
+	assert.EQ(t, homopolymerAnchor(refSeq8, []byte{1, 1}, 3, 0), PosType(1))
+	// Not moved before minAnchor, the start of the read's M op.
+	assert.EQ(t, homopolymerAnchor(refSeq8, a, 4, 3), PosType(3))
+	// Not a homopolymer indel.
+	assert.EQ(t, homopolymerAnchor(refSeq8, []byte{1, 8}, 4, 0), PosType(4))
+	// A T inserted after the As stays there.
+	assert.EQ(t, homopolymerAnchor(refSeq8, []byte{8}, 5, 0), PosType(5))
+}
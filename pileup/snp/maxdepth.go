@@ -0,0 +1,313 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// maxDepthOpts holds the parsed Opts.MaxDepth, Opts.MaxDepthMode and
+// Opts.Seed arguments, and the run-wide number of dropped reads.
+type maxDepthOpts struct {
+	// maxDepth is 0 if the depth is only limited by overrides.
+	maxDepth int
+	// overrides, if non-nil, holds the per-interval max depths (and MAPQ
+	// thresholds) of Opts.BedOverrides.
+	overrides *regionOverrides
+	// byFragment is set when both reads of a pair get the same decision.
+	byFragment bool
+	seed       int64
+	// dropped is shared by all jobs, hence the atomic updates.
+	dropped *int64
+}
+
+// parseMaxDepthOpts returns nil if max-depth downsampling is disabled.  If
+// bedOverrides is set, the BED intervals may set max depths, so options with
+// a maxDepth of 0 are returned; the caller drops them if no interval does.
+func parseMaxDepthOpts(maxDepth int, mode string, seed int64, bedOverrides bool) (*maxDepthOpts, error) {
+	if maxDepth < 0 {
+		return nil, fmt.Errorf("Pileup: invalid max-depth= argument %d", maxDepth)
+	}
+	var byFragment bool
+	switch mode {
+	case "", "position":
+	case "fragment":
+		byFragment = true
+	default:
+		return nil, fmt.Errorf("Pileup: invalid max-depth-mode= argument %q", mode)
+	}
+	if (maxDepth == 0) && !bedOverrides {
+		if mode != "" {
+			return nil, fmt.Errorf("Pileup: max-depth-mode= requires max-depth=")
+		}
+		return nil, nil
+	}
+	return &maxDepthOpts{
+		maxDepth:   maxDepth,
+		byFragment: byFragment,
+		seed:       seed,
+		dropped:    new(int64),
+	}, nil
+}
+
+func (o *maxDepthOpts) String() string {
+	unit := "read"
+	if o.byFragment {
+		unit = "fragment"
+	}
+	limit := fmt.Sprintf("%d reads per position", o.maxDepth)
+	if o.maxDepth == 0 {
+		limit = "no limit"
+	}
+	if o.overrides != nil {
+		limit += " outside of the intervals with max_depth overrides"
+	}
+	return fmt.Sprintf("%s, reservoir sampling by %s, seed %d", limit, unit, o.seed)
+}
+
+// reservoirRead is a read in the reservoir of maxDepthIterator.
+type reservoirRead struct {
+	r *sam.Record
+	// idx is the index of r among the candidates of its group, which
+	// restores the input order of the kept reads.
+	idx int
+}
+
+// maxDepthIterator wraps the iterator of a shard, and drops reads so that no
+// position is covered by more than opts.maxDepth of them.
+//
+// The reads starting at a position form a group.  When a group starts, the
+// kept reads of the earlier groups which still cover its position use up
+// some of the maxDepth slots, and the remaining slots are filled by reservoir
+// sampling (Vitter's algorithm R) over the reads of the group, so every read
+// of the group has the same chance of being kept.  Since coverage only drops
+// between group starts, this bounds the depth everywhere.  Only the reservoir
+// is buffered, so a hotspot with millions of reads costs maxDepth records of
+// memory.
+//
+// In fragment mode, the second read of a pair gets the decision made on the
+// first one instead of taking part in the sampling, so the depth may exceed
+// maxDepth where the reads of kept fragments pile up.  Like fraglenSampler,
+// this only works for the pairs processed by one job.
+//
+// The random draws come from the shard's own source (see
+// pileupSNPOpts.shardRand), so the output only depends on the inputs, the
+// sharding and the seed, and not on how the shards are split between jobs or
+// workers.  Reads which match flagExclude, have a MAPQ below mapq (or below
+// the MAPQ threshold at their start, with overrides), or are unmapped take no
+// part in the sampling and are returned as is.  With overrides, the max depth
+// of a group is the one at its position.
+type maxDepthIterator struct {
+	src         bamprovider.Iterator
+	opts        *maxDepthOpts
+	flagExclude int
+	mapq        int
+	rng         *rand.Rand
+	mates       mateDecisions
+
+	// refID and pos are the position of the current group.
+	refID, pos int
+	// ends holds the alignment ends of the kept reads which may cover the
+	// current position.
+	ends endHeap
+	// slots is the size of the reservoir of the current group, and
+	// nCandidate is the number of its reads which have been sampled so far.
+	slots, nCandidate int
+	reservoir         []reservoirRead
+	ready             []*sam.Record
+
+	done bool
+	rec  *sam.Record
+	err  error
+}
+
+// newMaxDepthIterator returns an iterator over the reads of src, downsampled
+// to opts.maxDepth with the random draws of rng.
+func newMaxDepthIterator(src bamprovider.Iterator, opts *maxDepthOpts, rng *rand.Rand, flagExclude, mapq int) *maxDepthIterator {
+	it := &maxDepthIterator{
+		src:         src,
+		opts:        opts,
+		flagExclude: flagExclude,
+		mapq:        mapq,
+		rng:         rng,
+		refID:       -1,
+	}
+	if opts.byFragment {
+		it.mates = newMateDecisions()
+	}
+	return it
+}
+
+// usable returns true if r takes part in the sampling.
+func (it *maxDepthIterator) usable(r *sam.Record) bool {
+	if (r.Ref == nil) || (r.Flags&sam.Unmapped != 0) || (it.flagExclude&int(r.Flags) != 0) || (len(r.Cigar) == 0) {
+		return false
+	}
+	mapq := it.mapq
+	if it.opts.overrides != nil {
+		mapq = it.opts.overrides.at(r.Ref.ID(), PosType(r.Pos)).mapq
+	}
+	return int(r.MapQ) >= mapq
+}
+
+// keep marks r as kept, and makes it ready to be returned.
+func (it *maxDepthIterator) keep(r *sam.Record) {
+	heap.Push(&it.ends, r.End())
+	it.ready = append(it.ready, r)
+}
+
+func (it *maxDepthIterator) drop(r *sam.Record) {
+	if it.opts.byFragment {
+		it.mates.put(r, false)
+	}
+	atomic.AddInt64(it.opts.dropped, 1)
+	sam.PutInFreePool(r)
+}
+
+// finishGroup keeps the reads of the reservoir, in input order.
+func (it *maxDepthIterator) finishGroup() {
+	sort.Slice(it.reservoir, func(i, j int) bool { return it.reservoir[i].idx < it.reservoir[j].idx })
+	for i, rr := range it.reservoir {
+		if it.opts.byFragment {
+			it.mates.put(rr.r, true)
+		}
+		it.keep(rr.r)
+		it.reservoir[i] = reservoirRead{}
+	}
+	it.reservoir = it.reservoir[:0]
+}
+
+func (it *maxDepthIterator) add(r *sam.Record) {
+	refID := -1
+	if r.Ref != nil {
+		refID = r.Ref.ID()
+	}
+	if (refID != it.refID) || (r.Pos != it.pos) {
+		// The reservoir must be emptied before any read at a later position
+		// is returned.
+		it.finishGroup()
+		if refID != it.refID {
+			it.ends = it.ends[:0]
+		}
+		it.refID, it.pos = refID, r.Pos
+		for (len(it.ends) > 0) && (it.ends[0] <= r.Pos) {
+			heap.Pop(&it.ends)
+		}
+		maxDepth := it.opts.maxDepth
+		if it.opts.overrides != nil {
+			maxDepth = it.opts.overrides.at(refID, PosType(r.Pos)).maxDepth
+		}
+		if maxDepth == 0 {
+			// No limit.
+			it.slots = math.MaxInt32
+		} else if it.slots = maxDepth - len(it.ends); it.slots < 0 {
+			it.slots = 0
+		}
+		it.nCandidate = 0
+	}
+	if !it.usable(r) {
+		it.ready = append(it.ready, r)
+		return
+	}
+	if it.opts.byFragment {
+		if keep, ok := it.mates.take(r); ok {
+			if keep {
+				it.keep(r)
+			} else {
+				atomic.AddInt64(it.opts.dropped, 1)
+				sam.PutInFreePool(r)
+			}
+			return
+		}
+	}
+	i := it.nCandidate
+	it.nCandidate++
+	if i < it.slots {
+		it.reservoir = append(it.reservoir, reservoirRead{r: r, idx: i})
+		return
+	}
+	if j := it.rng.Intn(i + 1); j < it.slots {
+		it.drop(it.reservoir[j].r)
+		it.reservoir[j] = reservoirRead{r: r, idx: i}
+		return
+	}
+	it.drop(r)
+}
+
+// Scan implements bamprovider.Iterator.
+func (it *maxDepthIterator) Scan() bool {
+	for {
+		if len(it.ready) > 0 {
+			it.rec = it.ready[0]
+			it.ready[0] = nil
+			it.ready = it.ready[1:]
+			return true
+		}
+		if it.done {
+			return false
+		}
+		if !it.src.Scan() {
+			it.done = true
+			it.err = it.src.Err()
+			it.finishGroup()
+			continue
+		}
+		it.add(it.src.Record())
+	}
+}
+
+// Record implements bamprovider.Iterator.
+func (it *maxDepthIterator) Record() *sam.Record {
+	return it.rec
+}
+
+// Err implements bamprovider.Iterator.
+func (it *maxDepthIterator) Err() error {
+	return it.err
+}
+
+// Close implements bamprovider.Iterator.
+func (it *maxDepthIterator) Close() error {
+	for _, rr := range it.reservoir {
+		sam.PutInFreePool(rr.r)
+	}
+	for _, r := range it.ready {
+		sam.PutInFreePool(r)
+	}
+	it.reservoir, it.ready = nil, nil
+	return it.src.Close()
+}
+
+// endHeap is a min-heap of alignment ends.
+type endHeap []int
+
+func (h endHeap) Len() int            { return len(h) }
+func (h endHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h endHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *endHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+func (h *endHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
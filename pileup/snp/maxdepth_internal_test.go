@@ -0,0 +1,157 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseMaxDepthOpts(t *testing.T) {
+	o, err := parseMaxDepthOpts(0, "", 5, false)
+	assert.NoError(t, err)
+	assert.True(t, o == nil)
+	o, err = parseMaxDepthOpts(100, "", 5, false)
+	assert.NoError(t, err)
+	assert.EQ(t, o.maxDepth, 100)
+	assert.False(t, o.byFragment)
+	assert.EQ(t, o.seed, int64(5))
+	o, err = parseMaxDepthOpts(100, "fragment", 0, false)
+	assert.NoError(t, err)
+	assert.True(t, o.byFragment)
+
+	for _, bad := range []struct {
+		maxDepth int
+		mode     string
+	}{{-1, ""}, {0, "position"}, {10, "read"}} {
+		_, err := parseMaxDepthOpts(bad.maxDepth, bad.mode, 0, false)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+// runMaxDepth returns the names of the reads of recs kept by a
+// maxDepthIterator.
+func runMaxDepth(t *testing.T, recs []*sam.Record, opts *maxDepthOpts) []string {
+	it := newMaxDepthIterator(&sliceIterator{recs: recs}, opts, rand.New(rand.NewSource(opts.seed)), 0, 0)
+	var names []string
+	for it.Scan() {
+		names = append(names, it.Record().Name)
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	return names
+}
+
+func TestMaxDepthIterator(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	// 20 reads at 100, 10 at 120, 10 at 160 and 10 at 200, all 50 bases
+	// long, and an unmapped read at 120.
+	newRecs := func() []*sam.Record {
+		var recs []*sam.Record
+		for _, g := range []struct{ pos, n int }{{100, 20}, {120, 10}, {160, 10}, {200, 10}} {
+			for i := 0; i < g.n; i++ {
+				recs = append(recs, &sam.Record{
+					Name:  fmt.Sprintf("r%d_%d", g.pos, i),
+					Ref:   ref,
+					Pos:   g.pos,
+					MapQ:  60,
+					Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 50)},
+				})
+			}
+			if g.pos == 120 {
+				recs = append(recs, &sam.Record{Name: "unmapped", Ref: ref, Pos: 120, Flags: sam.Unmapped})
+			}
+		}
+		return recs
+	}
+	recs := newRecs()
+	byName := make(map[string]*sam.Record)
+	for _, r := range recs {
+		byName[r.Name] = r
+	}
+	opts, err := parseMaxDepthOpts(4, "", 1, false)
+	assert.NoError(t, err)
+	names := runMaxDepth(t, recs, opts)
+
+	var depth [1000]int
+	prevPos := 0
+	nPerPos := make(map[int]int)
+	unmapped := false
+	for _, name := range names {
+		r := byName[name]
+		assert.True(t, r.Pos >= prevPos, "reads out of order")
+		prevPos = r.Pos
+		if name == "unmapped" {
+			unmapped = true
+			continue
+		}
+		nPerPos[r.Pos]++
+		for pos := r.Pos; pos < r.End(); pos++ {
+			depth[pos]++
+		}
+	}
+	assert.True(t, unmapped)
+	for pos, d := range depth {
+		assert.True(t, d <= 4, "depth %d at %d", d, pos)
+	}
+	// The reads at 100 fill the slots until 150, and those at 160 until 210.
+	assert.EQ(t, nPerPos, map[int]int{100: 4, 160: 4})
+	assert.EQ(t, *opts.dropped, int64(50-8))
+
+	// The same seed gives the same reads.
+	opts2, err := parseMaxDepthOpts(4, "", 1, false)
+	assert.NoError(t, err)
+	assert.EQ(t, runMaxDepth(t, newRecs(), opts2), names)
+}
+
+func TestMaxDepthIteratorFragments(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	// 10 pairs with their first reads at 100 and their second reads at 200.
+	var recs []*sam.Record
+	for _, pos := range []int{100, 200} {
+		for i := 0; i < 10; i++ {
+			mateTempLen, matePos := 150, 200
+			if pos == 200 {
+				mateTempLen, matePos = -150, 100
+			}
+			recs = append(recs, &sam.Record{
+				Name:    fmt.Sprintf("f%d", i),
+				Ref:     ref,
+				Pos:     pos,
+				MapQ:    60,
+				Flags:   sam.Paired,
+				MateRef: ref,
+				MatePos: matePos,
+				TempLen: mateTempLen,
+				Cigar:   sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 50)},
+			})
+		}
+	}
+	opts, err := parseMaxDepthOpts(3, "fragment", 7, false)
+	assert.NoError(t, err)
+	names := runMaxDepth(t, recs, opts)
+	assert.EQ(t, len(names), 6)
+	// Both reads of each kept fragment are kept.
+	assert.EQ(t, names[3:], names[:3])
+}
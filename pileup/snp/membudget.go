@@ -0,0 +1,190 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/bio/util/diskspace"
+)
+
+// perReadFeaturesSize is the size of a perReadFeatures, in bytes.
+const perReadFeaturesSize = int64(unsafe.Sizeof(perReadFeatures{}))
+
+// pileupRowBaseSize is the size of a pileupRow without its slices.
+const pileupRowBaseSize = int64(unsafe.Sizeof(pileupRow{}))
+
+// minSpillBytes is the smallest block a budgetWriter spills early.  Without
+// it, a job writing low-depth rows while other jobs hold the budget would
+// write one-row blocks.
+const minSpillBytes = 1 << 20
+
+// memBudget is the memory accountant of Opts.MemoryBudgetMiB.  It tracks the
+// payload sizes of the rows which the main loop's jobs have completed, but
+// which are still held in memory: recordio holds on to the rows of a block
+// until the block is full (Opts.ShardBlockItems rows) and written, and at high
+// depth, a block's per-read features can take gigabytes.  When the total
+// exceeds the budget, the jobs spill their pending rows to their intermediate
+// files early (see budgetWriter), and stop keeping the per-read buffers of the
+// flushed ring-buffer rows for reuse.  The methods are thread safe, and no-ops
+// on a nil *memBudget.
+type memBudget struct {
+	limit int64
+	used  int64 // updated atomically
+	// highWater is the largest value of used, and nSpill the number of early
+	// spills.  They are updated atomically.
+	highWater int64
+	nSpill    int64
+}
+
+// parseMemBudget validates the MemoryBudgetMiB argument, and returns its
+// memBudget, or nil if it is 0.
+func parseMemBudget(mib int) (*memBudget, error) {
+	if mib < 0 {
+		return nil, fmt.Errorf("Pileup: invalid memory-budget-mib= argument")
+	}
+	if mib == 0 {
+		return nil, nil
+	}
+	return &memBudget{limit: int64(mib) << 20}, nil
+}
+
+// add records that n more bytes are held, and returns whether the budget is
+// now exceeded.
+func (b *memBudget) add(n int64) bool {
+	if b == nil {
+		return false
+	}
+	used := atomic.AddInt64(&b.used, n)
+	for {
+		high := atomic.LoadInt64(&b.highWater)
+		if (used <= high) || atomic.CompareAndSwapInt64(&b.highWater, high, used) {
+			break
+		}
+	}
+	return used > b.limit
+}
+
+// release records that n bytes were released.
+func (b *memBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.used, -n)
+}
+
+// over returns whether the budget is exceeded.
+func (b *memBudget) over() bool {
+	return (b != nil) && (atomic.LoadInt64(&b.used) > b.limit)
+}
+
+func (b *memBudget) String() string {
+	return fmt.Sprintf("%d early spills, high-water mark %s of %s", atomic.LoadInt64(&b.nSpill), diskspace.Format(atomic.LoadInt64(&b.highWater)), diskspace.Format(b.limit))
+}
+
+// pileupRowSize estimates the memory held by pr, in bytes.  The per-read
+// features dominate at high depth.
+func pileupRowSize(pr *pileupRow) int64 {
+	n := pileupRowBaseSize
+	if pr.fieldsPresent&fieldPerReadAny != 0 {
+		for i := 0; i < pileup.NBase; i++ {
+			n += int64(len(pr.payload.perRead[i])) * perReadFeaturesSize
+		}
+	}
+	return n + int64(len(pr.payload.indels))*int64(unsafe.Sizeof(indelAllele{})) + int64(len(pr.payload.extensions))*int64(unsafe.Sizeof(rowExtension{}))
+}
+
+// budgetWriter is a recordio.Writer which accounts for the rows of its recordio
+// blocks in a memBudget, from their Append until recordio has written them,
+// and flushes the current block early when the budget is exceeded (and the
+// blocks hold at least minSpillBytes).  It must wrap the intermediate file's
+// writer directly, so that it sees the same rows as recordio.
+type budgetWriter struct {
+	recordio.Writer
+	budget *memBudget
+	// maxItems is the number of rows per block, after which recordio flushes
+	// the block by itself.  nItem and pending are the number and size of the
+	// rows of the current block, and inFlight the size of the rows of the
+	// flushed blocks, which recordio may still be marshaling and writing in
+	// the background: they are released only after a Wait or Finish.
+	maxItems int
+	nItem    int
+	pending  int64
+	inFlight int64
+}
+
+// newBudgetWriter returns a budgetWriter for w, a newPileupRowWriter of codec.
+func newBudgetWriter(w recordio.Writer, budget *memBudget, codec shardCodec) *budgetWriter {
+	// parseShardCodec keeps maxItems within recordio's limit.
+	maxItems := codec.maxItems
+	if maxItems == 0 {
+		maxItems = recordio.DefaultPackedItems
+	}
+	return &budgetWriter{Writer: w, budget: budget, maxItems: int(maxItems)}
+}
+
+func (w *budgetWriter) Append(v interface{}) {
+	n := pileupRowSize(v.(*pileupRow))
+	w.Writer.Append(v)
+	w.nItem++
+	w.pending += n
+	over := w.budget.add(n)
+	if w.nItem >= w.maxItems {
+		// recordio started flushing the full block.
+		w.startFlush()
+	}
+	if !over || (w.pending+w.inFlight < minSpillBytes) {
+		return
+	}
+	if w.nItem > 0 {
+		w.Writer.Flush()
+		w.startFlush()
+		atomic.AddInt64(&w.budget.nSpill, 1)
+	}
+	// Wait blocks until recordio has written all the flushed blocks, and
+	// dropped their rows.
+	w.Writer.Wait()
+	w.releasePending()
+}
+
+func (w *budgetWriter) Flush() {
+	w.Writer.Flush()
+	w.startFlush()
+}
+
+func (w *budgetWriter) Finish() error {
+	err := w.Writer.Finish()
+	w.releasePending()
+	return err
+}
+
+// startFlush moves the rows of the current block to the in-flight blocks.
+func (w *budgetWriter) startFlush() {
+	w.inFlight += w.pending
+	w.nItem = 0
+	w.pending = 0
+}
+
+// releasePending releases the rows of the current and in-flight blocks from
+// the budget.  A failed job calls it to drop the rows that it won't write.
+func (w *budgetWriter) releasePending() {
+	w.budget.release(w.pending + w.inFlight)
+	w.nItem = 0
+	w.pending = 0
+	w.inFlight = 0
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/testutil/assert"
+)
+
+// flushCountingWriter counts the rows appended to it, its flushes and its
+// waits.
+type flushCountingWriter struct {
+	recordio.Writer
+	nRow, nFlush, nWait int
+}
+
+func (w *flushCountingWriter) Append(v interface{}) { w.nRow++ }
+func (w *flushCountingWriter) Flush()               { w.nFlush++ }
+func (w *flushCountingWriter) Wait()                { w.nWait++ }
+func (w *flushCountingWriter) Finish() error        { return nil }
+
+func TestParseMemBudget(t *testing.T) {
+	b, err := parseMemBudget(0)
+	assert.NoError(t, err)
+	assert.True(t, b == nil)
+	// The methods of a nil memBudget do nothing.
+	assert.False(t, b.add(1<<40))
+	assert.False(t, b.over())
+	b.release(1)
+	b, err = parseMemBudget(64)
+	assert.NoError(t, err)
+	assert.EQ(t, b.limit, int64(64<<20))
+	_, err = parseMemBudget(-1)
+	assert.HasSubstr(t, err.Error(), "invalid memory-budget-mib= argument")
+}
+
+func TestBudgetWriter(t *testing.T) {
+	// A row with 1 MiB of per-read features.
+	nFeature := int((1 << 20) / perReadFeaturesSize)
+	bigRow := func() *pileupRow {
+		pr := &pileupRow{fieldsPresent: fieldCounts | fieldPerReadA}
+		pr.payload.perRead[0] = make([]perReadFeatures, nFeature)
+		return pr
+	}
+	bigSize := pileupRowSize(bigRow())
+	assert.EQ(t, bigSize, pileupRowBaseSize+int64(nFeature)*perReadFeaturesSize)
+	budget := &memBudget{limit: 4 * bigSize}
+
+	inner1 := &flushCountingWriter{}
+	w1 := newBudgetWriter(inner1, budget, shardCodec{maxItems: 100})
+	inner2 := &flushCountingWriter{}
+	w2 := newBudgetWriter(inner2, budget, shardCodec{})
+	assert.EQ(t, w2.maxItems, int(recordio.DefaultPackedItems))
+
+	for i := 0; i < 4; i++ {
+		w1.Append(bigRow())
+	}
+	assert.EQ(t, inner1.nFlush, 0)
+	assert.False(t, budget.over())
+	// Small blocks don't spill, even over the budget.
+	w2.Append(&pileupRow{})
+	assert.EQ(t, budget.used, 4*bigSize+pileupRowBaseSize)
+	assert.True(t, budget.over())
+	assert.EQ(t, inner2.nFlush, 0)
+	// The next big row spills the first job's block, and waits for it to be
+	// written.
+	w1.Append(bigRow())
+	assert.EQ(t, inner1.nFlush, 1)
+	assert.EQ(t, inner1.nWait, 1)
+	assert.EQ(t, inner1.nRow, 5)
+	assert.EQ(t, budget.used, pileupRowBaseSize)
+	assert.False(t, budget.over())
+	assert.EQ(t, budget.highWater, 5*bigSize+pileupRowBaseSize)
+	assert.EQ(t, budget.nSpill, int64(1))
+
+	// Full blocks are flushed by recordio, but held until they are written.
+	for i := 0; i < 100; i++ {
+		w1.Append(&pileupRow{})
+	}
+	assert.EQ(t, inner1.nFlush, 1)
+	assert.EQ(t, w1.inFlight, 100*pileupRowBaseSize)
+	assert.EQ(t, budget.used, 101*pileupRowBaseSize)
+	for i := 0; i < 4; i++ {
+		w1.Append(bigRow())
+	}
+	assert.EQ(t, inner1.nFlush, 2)
+	assert.EQ(t, inner1.nWait, 2)
+	assert.EQ(t, budget.used, pileupRowBaseSize)
+
+	// Over the budget, the in-flight blocks alone are waited for.
+	inner3 := &flushCountingWriter{}
+	w3 := newBudgetWriter(inner3, budget, shardCodec{maxItems: 1})
+	for i := 0; i < 4; i++ {
+		w3.Append(bigRow())
+	}
+	assert.EQ(t, inner3.nFlush, 0)
+	assert.EQ(t, inner3.nWait, 1)
+	assert.EQ(t, budget.used, pileupRowBaseSize)
+	assert.EQ(t, budget.nSpill, int64(2))
+
+	// Finish, and the release of a failed job, drop the rest.
+	assert.NoError(t, w2.Finish())
+	w1.Append(&pileupRow{})
+	w1.Flush()
+	w1.Append(&pileupRow{})
+	w1.releasePending()
+	w1.releasePending()
+	assert.EQ(t, budget.used, int64(0))
+	assert.HasSubstr(t, budget.String(), "2 early spills, high-water mark 5.0 MiB of 4.0 MiB")
+}
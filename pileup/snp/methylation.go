@@ -0,0 +1,210 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+)
+
+// Cytosine contexts of the methylation report.  H is any base other than G.
+const (
+	methylationCG = iota
+	methylationCHG
+	methylationCHH
+	nMethylationContext
+)
+
+var methylationContextNames = [nMethylationContext]string{"CG", "CHG", "CHH"}
+
+// methylationOpts selects the cytosine contexts reported by
+// Opts.Methylation.
+type methylationOpts struct {
+	contexts [nMethylationContext]bool
+}
+
+// parseMethylationOpts parses Opts.Methylation, a comma-separated list of
+// "CG", "CHG" and "CHH", or "all".  It returns nil if s is empty.
+func parseMethylationOpts(s string) (*methylationOpts, error) {
+	if s == "" {
+		return nil, nil
+	}
+	opts := &methylationOpts{}
+	for _, f := range strings.Split(s, ",") {
+		switch f {
+		case "CG", "CpG":
+			opts.contexts[methylationCG] = true
+		case "CHG":
+			opts.contexts[methylationCHG] = true
+		case "CHH":
+			opts.contexts[methylationCHH] = true
+		case "all":
+			for c := range opts.contexts {
+				opts.contexts[c] = true
+			}
+		default:
+			return nil, fmt.Errorf("Pileup: invalid methylation= argument %q (must be a comma-separated list of CG, CHG and CHH, or all)", s)
+		}
+	}
+	return opts, nil
+}
+
+// cytosineSite describes a reference position as a potential methylation
+// site.
+type cytosineSite struct {
+	// isMinus is 0 for a C on the forward strand, and 1 for a G (i.e. a C on
+	// the reverse strand).
+	isMinus int
+	context int
+	// trinucleotide is the reference sequence starting at the cytosine, on
+	// its strand, e.g. "CAG".
+	trinucleotide [3]byte
+}
+
+// classifyCytosine returns the cytosineSite of position pos of refSeq8 (in
+// seq8 encoding), or false if it isn't a C or G, or if its context is
+// unknown because it is too close to the end of the reference or has a
+// non-ACGT base.
+func classifyCytosine(refSeq8 []byte, pos PosType) (site cytosineSite, ok bool) {
+	// The context is read away from the cytosine on its strand; comp maps a
+	// forward-strand base enum to the base on that strand.
+	var dir PosType
+	var comp func(b byte) byte
+	switch pileup.Seq8ToEnumTable[refSeq8[pos]] {
+	case pileup.BaseC:
+		dir = 1
+		comp = func(b byte) byte { return b }
+	case pileup.BaseG:
+		site.isMinus = 1
+		dir = -1
+		comp = func(b byte) byte { return pileup.BaseT - b }
+	default:
+		return
+	}
+	site.trinucleotide[0] = 'C'
+	for i := PosType(1); i < 3; i++ {
+		p := pos + i*dir
+		if (p < 0) || (p >= PosType(len(refSeq8))) {
+			return
+		}
+		b := pileup.Seq8ToEnumTable[refSeq8[p]]
+		if b == pileup.BaseX {
+			return
+		}
+		site.trinucleotide[i] = pileup.EnumToASCIITable[comp(b)]
+	}
+	switch {
+	case site.trinucleotide[1] == 'G':
+		site.context = methylationCG
+	case site.trinucleotide[2] == 'G':
+		site.context = methylationCHG
+	default:
+		site.context = methylationCHH
+	}
+	return site, true
+}
+
+// methylationCounts returns the numbers of reads which show a cytosine as
+// methylated (unconverted: still a C) and unmethylated (converted to a T),
+// on the cytosine's strand.  On the reverse strand, these are the Gs and As
+// of the forward-strand counts.
+func methylationCounts(payload *pileupPayload, site *cytosineSite) (nMeth, nUnmeth uint32) {
+	if site.isMinus == 0 {
+		return payload.counts[pileup.BaseC][0], payload.counts[pileup.BaseT][0]
+	}
+	return payload.counts[pileup.BaseG][1], payload.counts[pileup.BaseA][1]
+}
+
+// writeMethylationReport writes the methylation calls of the rows in
+// tmpFiles, at the cytosines of the contexts selected by opts, to
+// <mainPath>.CX_report.txt, in the Bismark coverage2cytosine format
+// (chromosome, 1-based position, strand, methylated and unmethylated counts,
+// context and trinucleotide, with every cytosine of the pileup positions),
+// and to <mainPath>.methylation.bedGraph, with the methylation percentage of
+// each covered cytosine.
+func writeMethylationReport(ctx context.Context, tmpFiles []*os.File, mainPath string, opts *methylationOpts, refNames []string, refSeqs [][]byte) (err error) {
+	var cxFile, bgFile file.File
+	if cxFile, err = file.Create(ctx, mainPath+".CX_report.txt"); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, cxFile, &err)
+	if bgFile, err = file.Create(ctx, mainPath+".methylation.bedGraph"); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, bgFile, &err)
+	cx := tsv.NewWriter(cxFile.Writer(ctx))
+	bg := tsv.NewWriter(bgFile.Writer(ctx))
+	bg.WriteString("track type=bedGraph")
+	if err = bg.EndLine(); err != nil {
+		return
+	}
+	// totals[c] are the methylated and unmethylated counts of context c.
+	var totals [nMethylationContext][2]uint64
+	for _, f := range tmpFiles {
+		if _, err = f.Seek(0, 0); err != nil {
+			return
+		}
+		scanner := newPileupRowScanner(f)
+		for scanner.Scan() {
+			pr := scanner.Get().(*pileupRow)
+			site, ok := classifyCytosine(refSeqs[pr.refID], PosType(pr.pos))
+			if !ok || !opts.contexts[site.context] {
+				continue
+			}
+			nMeth, nUnmeth := methylationCounts(&pr.payload, &site)
+			totals[site.context][0] += uint64(nMeth)
+			totals[site.context][1] += uint64(nUnmeth)
+			refName := refNames[pr.refID]
+			cx.WriteString(refName)
+			cx.WriteUint32(pr.pos + 1)
+			cx.WriteByte(pileup.StrandTypeToASCIITable[pileup.StrandFwd+pileup.StrandType(site.isMinus)])
+			cx.WriteUint32(nMeth)
+			cx.WriteUint32(nUnmeth)
+			cx.WriteString(methylationContextNames[site.context])
+			cx.WriteBytes(site.trinucleotide[:])
+			if err = cx.EndLine(); err != nil {
+				return
+			}
+			if nMeth+nUnmeth == 0 {
+				continue
+			}
+			bg.WriteString(refName)
+			bg.WriteUint32(pr.pos)
+			bg.WriteUint32(pr.pos + 1)
+			bg.WriteFloat64(100*float64(nMeth)/float64(nMeth+nUnmeth), 'g', 6)
+			if err = bg.EndLine(); err != nil {
+				return
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+	}
+	for c, t := range totals {
+		if opts.contexts[c] && (t[0]+t[1] != 0) {
+			log.Printf("writeMethylationReport: %s methylation %.2f%% (%d of %d calls)", methylationContextNames[c], 100*float64(t[0])/float64(t[0]+t[1]), t[0], t[0]+t[1])
+		}
+	}
+	if err = cx.Flush(); err != nil {
+		return
+	}
+	return bg.Flush()
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseMethylationOpts(t *testing.T) {
+	opts, err := parseMethylationOpts("")
+	assert.NoError(t, err)
+	assert.True(t, opts == nil)
+	opts, err = parseMethylationOpts("CG,CHH")
+	assert.NoError(t, err)
+	assert.EQ(t, opts.contexts, [nMethylationContext]bool{true, false, true})
+	opts, err = parseMethylationOpts("all")
+	assert.NoError(t, err)
+	assert.EQ(t, opts.contexts, [nMethylationContext]bool{true, true, true})
+	_, err = parseMethylationOpts("CG,CNN")
+	assert.HasSubstr(t, err.Error(), "invalid methylation= argument")
+}
+
+func methylationTestRef(s string) []byte {
+	b := make([]byte, len(s))
+	biosimd.ASCIIToSeq8(b, []byte(s))
+	return b
+}
+
+func TestClassifyCytosine(t *testing.T) {
+	refSeq8 := methylationTestRef("ACGTCAGACCATGNC")
+	for _, tc := range []struct {
+		pos     PosType
+		ok      bool
+		isMinus int
+		context int
+		tri     string
+	}{
+		{0, false, 0, 0, ""},
+		{1, true, 0, methylationCG, "CGT"},
+		{2, true, 1, methylationCG, "CGT"},
+		{3, false, 0, 0, ""},
+		{4, true, 0, methylationCHG, "CAG"},
+		{6, true, 1, methylationCHG, "CTG"},
+		{8, true, 0, methylationCHH, "CCA"},
+		{9, true, 0, methylationCHH, "CAT"},
+		{12, true, 1, methylationCHH, "CAT"},
+		// Unknown context: an N, or the end of the reference.
+		{13, false, 0, 0, ""},
+		{14, false, 0, 0, ""},
+	} {
+		site, ok := classifyCytosine(refSeq8, tc.pos)
+		assert.EQ(t, ok, tc.ok, tc.pos)
+		if !ok {
+			continue
+		}
+		assert.EQ(t, site.isMinus, tc.isMinus, tc.pos)
+		assert.EQ(t, site.context, tc.context, tc.pos)
+		assert.EQ(t, string(site.trinucleotide[:]), tc.tri, tc.pos)
+	}
+	_, ok := classifyCytosine(methylationTestRef("CNG"), 0)
+	assert.False(t, ok)
+	_, ok = classifyCytosine(methylationTestRef("CNG"), 2)
+	assert.False(t, ok)
+}
+
+func TestWriteMethylationReport(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	rows := []pileupRow{
+		{fieldsPresent: fieldCounts, refID: 0, pos: 1},
+		{fieldsPresent: fieldCounts, refID: 0, pos: 2},
+		{fieldsPresent: fieldCounts, refID: 0, pos: 3},
+		{fieldsPresent: fieldCounts, refID: 0, pos: 4},
+		{fieldsPresent: fieldCounts, refID: 0, pos: 8},
+	}
+	// CG on the forward strand: the reverse-strand Cs don't count.
+	rows[0].payload.counts[pileup.BaseC] = [2]uint32{3, 5}
+	rows[0].payload.counts[pileup.BaseT] = [2]uint32{1, 0}
+	// CG on the reverse strand.
+	rows[1].payload.counts[pileup.BaseG] = [2]uint32{7, 2}
+	rows[1].payload.counts[pileup.BaseA] = [2]uint32{0, 2}
+	rows[2].payload.counts[pileup.BaseT] = [2]uint32{4, 4}
+	// CHG, which isn't selected.
+	rows[3].payload.counts[pileup.BaseC] = [2]uint32{4, 0}
+	f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w := newPileupRowWriter(f, defaultShardCodec)
+	for i := range rows {
+		w.Append(&rows[i])
+	}
+	assert.NoError(t, w.Finish())
+
+	opts, err := parseMethylationOpts("CG,CHH")
+	assert.NoError(t, err)
+	mainPath := filepath.Join(tmpdir, "out")
+	refSeqs := [][]byte{methylationTestRef("ACGTCAGACCATGNC")}
+	assert.NoError(t, writeMethylationReport(ctx, []*os.File{f}, mainPath, opts, []string{"chr1"}, refSeqs))
+	data, err := ioutil.ReadFile(mainPath + ".CX_report.txt")
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), `chr1	2	+	3	1	CG	CGT
+chr1	3	-	2	2	CG	CGT
+chr1	9	+	0	0	CHH	CCA
+`)
+	data, err = ioutil.ReadFile(mainPath + ".methylation.bedGraph")
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), `track type=bedGraph
+chr1	1	2	75
+chr1	2	3	50
+`)
+}
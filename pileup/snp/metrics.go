@@ -0,0 +1,467 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// metricsOpts selects the files written by Opts.Metrics.
+type metricsOpts struct {
+	json, tsv bool
+}
+
+// parseMetricsOpts parses Opts.Metrics, a comma-separated list of "json"
+// and "tsv".  It returns nil if s is empty.
+func parseMetricsOpts(s string) (*metricsOpts, error) {
+	if s == "" {
+		return nil, nil
+	}
+	opts := &metricsOpts{}
+	for _, f := range strings.Split(s, ",") {
+		switch f {
+		case "json":
+			opts.json = true
+		case "tsv":
+			opts.tsv = true
+		default:
+			return nil, fmt.Errorf("Pileup: invalid metrics= argument %q (must be json, tsv, or json,tsv)", s)
+		}
+	}
+	return opts, nil
+}
+
+// The reasons a read is left out of the pileup by the main loop, in the
+// order of the filters.
+const (
+	filterFlagExclude = iota
+	filterReadPolicy
+	filterMapq
+	filterEmptyCigar
+	filterReadFilter
+	filterReadVisitor
+	filterPair
+	filterRemoveSq
+	filterMinBagDepth
+	filterStrand
+	filterDedup
+	filterDownsample
+	filterEndMotif
+	filterOffTarget
+	filterIdentity
+	nFilterReason
+)
+
+var filterReasonNames = [nFilterReason]string{
+	"flag_exclude",
+	"read_policy",
+	"mapq",
+	"empty_cigar",
+	"read_filter",
+	"read_visitor",
+	"pair",
+	"remove_sq",
+	"min_bag_depth",
+	"strand",
+	"dedup",
+	"downsample",
+	"end_motif",
+	"off_target",
+	"identity",
+}
+
+// metricsHighQual is the base quality threshold of the Q30 fraction.
+const metricsHighQual = 30
+
+// metricsTarget identifies an interval of the BED union: idx is its index
+// in the reference's endpoint list.
+type metricsTarget struct {
+	refID, idx int
+}
+
+// pileupMetrics holds the QC metrics of Opts.Metrics.  They are collected by
+// each job as it goes (so that no second pass over the pileupRows is
+// needed), and merged into a runMetrics at the end of the job.
+type pileupMetrics struct {
+	// depth is the depth histogram of all positions, and targets holds those
+	// of each BED interval.
+	depth   depthHist
+	targets map[metricsTarget]depthHist
+	// bases is the number of aligned bases of the pileup reads in the BED
+	// intervals, and highQualBases the number of those with quality at least
+	// metricsHighQual.
+	bases, highQualBases int64
+	// strandReads counts the pileup reads on the forward and reverse strands.
+	strandReads [2]int64
+	// filtered counts the reads left out of the pileup, by reason.
+	filtered [nFilterReason]int64
+}
+
+func newPileupMetrics() *pileupMetrics {
+	return &pileupMetrics{
+		depth:   make(depthHist),
+		targets: make(map[metricsTarget]depthHist),
+	}
+}
+
+func (m *pileupMetrics) merge(other *pileupMetrics) {
+	for d, n := range other.depth {
+		m.depth[d] += n
+	}
+	for t, h := range other.targets {
+		cur := m.targets[t]
+		if cur == nil {
+			cur = make(depthHist)
+			m.targets[t] = cur
+		}
+		for d, n := range h {
+			cur[d] += n
+		}
+	}
+	m.bases += other.bases
+	m.highQualBases += other.highQualBases
+	for i, n := range other.strandReads {
+		m.strandReads[i] += n
+	}
+	for i, n := range other.filtered {
+		m.filtered[i] += n
+	}
+}
+
+// inShard returns true if r starts in shardRange, so that the reads in the
+// padding between shards are only counted once.
+func inShard(r *sam.Record, shardRange *biopb.CoordRange) bool {
+	addr := gbam.CoordFromSAMRecord(r, 0)
+	return (r.Ref != nil) && shardRange.Start.LE(addr) && addr.LT(shardRange.Limit)
+}
+
+// addFiltered counts r as left out of the pileup for the given reason.
+func (m *pileupMetrics) addFiltered(r *sam.Record, reason int, shardRange *biopb.CoordRange) {
+	if inShard(r, shardRange) {
+		m.filtered[reason]++
+	}
+}
+
+// dropRead recycles r, a read left out of the pileup for the given reason,
+// after counting it in the metrics if they're collected.
+func (pm *pileupMutable) dropRead(r *sam.Record, reason int, shardRange *biopb.CoordRange) {
+	if pm.metrics != nil {
+		pm.metrics.addFiltered(r, reason, shardRange)
+	}
+	sam.PutInFreePool(r)
+}
+
+// addRead counts r as a pileup read on the given strand.
+func (m *pileupMetrics) addRead(r *sam.Record, strand pileup.StrandType, shardRange *biopb.CoordRange) {
+	if ((strand == pileup.StrandFwd) || (strand == pileup.StrandRev)) && inShard(r, shardRange) {
+		m.strandReads[strand-pileup.StrandFwd]++
+	}
+}
+
+// addBases counts the bases of read at alignedBases, its relevant bases (see
+// alignRelevantBases).  Since the jobs' BED intervals are disjoint, each base
+// is counted by one job.
+func (m *pileupMetrics) addBases(read *readSNP, alignedBases []alignedPos) {
+	qual := read.samr.Qual
+	m.bases += int64(len(alignedBases))
+	for _, ab := range alignedBases {
+		if qual[ab.posInRead] >= metricsHighQual {
+			m.highQualBases++
+		}
+	}
+}
+
+// runMetrics accumulates the pileupMetrics of a run's jobs.
+type runMetrics struct {
+	mu sync.Mutex
+	m  *pileupMetrics
+}
+
+// merge adds m to rm.  It may be called concurrently.
+func (rm *runMetrics) merge(m *pileupMetrics) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.m.merge(m)
+}
+
+// metricsWriter is a recordio.Writer wrapper which also adds the depths of
+// the pileupRows appended to it to a pileupMetrics.
+type metricsWriter struct {
+	recordio.Writer
+	m        *pileupMetrics
+	bedUnion *interval.BEDUnion
+
+	// The current reference, its BED endpoints, and the interval of the
+	// previous row (-1 if none) with its histogram.
+	refID     int
+	endpoints []PosType
+	target    int
+	cur       depthHist
+}
+
+func newMetricsWriter(w recordio.Writer, m *pileupMetrics, bedUnion *interval.BEDUnion) *metricsWriter {
+	return &metricsWriter{
+		Writer:   w,
+		m:        m,
+		bedUnion: bedUnion,
+		refID:    -1,
+		target:   -1,
+	}
+}
+
+func (w *metricsWriter) Append(v interface{}) {
+	// Count the row first, in case the underlying writer recycles it.
+	pr := v.(*pileupRow)
+	depth := pr.payload.depth
+	w.m.depth[depth]++
+	if int(pr.refID) != w.refID {
+		w.refID = int(pr.refID)
+		w.endpoints = w.bedUnion.EndpointsByID(w.refID)
+		w.target = -1
+	}
+	pos := PosType(pr.pos)
+	if (w.target < 0) || (pos < w.endpoints[2*w.target]) || (pos >= w.endpoints[2*w.target+1]) {
+		idx := sort.Search(len(w.endpoints), func(i int) bool { return w.endpoints[i] > pos })
+		if idx%2 == 0 {
+			// Not in any interval.
+			w.target = -1
+			w.Writer.Append(v)
+			return
+		}
+		w.target = idx / 2
+		key := metricsTarget{refID: w.refID, idx: w.target}
+		if w.cur = w.m.targets[key]; w.cur == nil {
+			w.cur = make(depthHist)
+			w.m.targets[key] = w.cur
+		}
+	}
+	w.cur[depth]++
+	w.Writer.Append(v)
+}
+
+// depthPercentiles returns the depths at the given fractions (in [0, 1]) of
+// the positions of s, i.e. for each p the lowest depth d such that at least
+// a fraction p of the positions have depth <= d.
+func depthPercentiles(s *depthHistSummary, ps []float64) []uint32 {
+	out := make([]uint32, len(ps))
+	if s.NPositions == 0 {
+		return out
+	}
+	for i, p := range ps {
+		var n int64
+		for j, d := range s.Depths {
+			n += s.Counts[j]
+			if float64(n) >= p*float64(s.NPositions) {
+				out[i] = d
+				break
+			}
+		}
+	}
+	return out
+}
+
+// metricsPercentiles are the depth percentiles reported per target.
+var metricsPercentiles = []float64{0.1, 0.5, 0.9}
+
+// targetMetrics summarizes the depths of an interval of the BED union, or
+// of all positions.
+type targetMetrics struct {
+	Target     string  `json:"target"`
+	NPositions int64   `json:"n_positions"`
+	MeanDepth  float64 `json:"mean_depth"`
+	MinDepth   uint32  `json:"min_depth"`
+	DepthP10   uint32  `json:"depth_p10"`
+	DepthP50   uint32  `json:"depth_p50"`
+	DepthP90   uint32  `json:"depth_p90"`
+	MaxDepth   uint32  `json:"max_depth"`
+}
+
+func newTargetMetrics(s *depthHistSummary) targetMetrics {
+	t := targetMetrics{
+		Target:     s.Target,
+		NPositions: s.NPositions,
+		MeanDepth:  s.MeanDepth,
+	}
+	if len(s.Depths) > 0 {
+		t.MinDepth = s.Depths[0]
+		t.MaxDepth = s.Depths[len(s.Depths)-1]
+	}
+	p := depthPercentiles(s, metricsPercentiles)
+	t.DepthP10, t.DepthP50, t.DepthP90 = p[0], p[1], p[2]
+	return t
+}
+
+// metricsReport is the JSON form of a run's pileupMetrics.  Coverage is the
+// depth histogram and cumulative coverage curve of all positions, and
+// Targets holds the depth summaries of all positions, followed by those of
+// each BED interval (overlapping intervals are merged), named like
+// "chr1:101-200" (1-based, inclusive).
+type metricsReport struct {
+	Coverage      depthHistSummary `json:"coverage"`
+	Bases         int64            `json:"bases"`
+	Q30Bases      int64            `json:"q30_bases"`
+	Q30Frac       float64          `json:"q30_frac"`
+	FwdReads      int64            `json:"fwd_reads"`
+	RevReads      int64            `json:"rev_reads"`
+	FwdFrac       float64          `json:"fwd_frac"`
+	FilteredReads map[string]int64 `json:"filtered_reads"`
+	Targets       []targetMetrics  `json:"targets"`
+}
+
+func newMetricsReport(m *pileupMetrics, bedUnion *interval.BEDUnion, refNames []string) *metricsReport {
+	r := &metricsReport{
+		Coverage:      m.depth.summary(depthHistTargetAll),
+		Bases:         m.bases,
+		Q30Bases:      m.highQualBases,
+		FwdReads:      m.strandReads[0],
+		RevReads:      m.strandReads[1],
+		FilteredReads: make(map[string]int64, nFilterReason),
+	}
+	if r.Bases > 0 {
+		r.Q30Frac = float64(r.Q30Bases) / float64(r.Bases)
+	}
+	if n := r.FwdReads + r.RevReads; n > 0 {
+		r.FwdFrac = float64(r.FwdReads) / float64(n)
+	}
+	for i, n := range m.filtered {
+		r.FilteredReads[filterReasonNames[i]] = n
+	}
+	r.Targets = append(r.Targets, newTargetMetrics(&r.Coverage))
+	var keys []metricsTarget
+	for t := range m.targets {
+		keys = append(keys, t)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].refID != keys[j].refID {
+			return keys[i].refID < keys[j].refID
+		}
+		return keys[i].idx < keys[j].idx
+	})
+	for _, t := range keys {
+		endpoints := bedUnion.EndpointsByID(t.refID)
+		start, end := endpoints[2*t.idx], endpoints[2*t.idx+1]
+		s := m.targets[t].summary(refNames[t.refID] + ":" + strconv.Itoa(int(start)+1) + "-" + strconv.Itoa(int(end)))
+		r.Targets = append(r.Targets, newTargetMetrics(&s))
+	}
+	return r
+}
+
+// writeMetrics writes the metrics of a run to <mainPath>.metrics.json and/or
+// <mainPath>.metrics.tsv.
+func writeMetrics(ctx context.Context, mainPath string, opts *metricsOpts, m *pileupMetrics, bedUnion *interval.BEDUnion, refNames []string) (err error) {
+	r := newMetricsReport(m, bedUnion, refNames)
+	if opts.json {
+		if err = writeMetricsJSON(ctx, mainPath+".metrics.json", r); err != nil {
+			return
+		}
+	}
+	if opts.tsv {
+		if err = writeMetricsTSV(ctx, mainPath+".metrics.tsv", r); err != nil {
+			return
+		}
+	}
+	log.Printf("pileupSNPMain: metrics: %d positions with mean depth %.2f, Q30 fraction %.4f, forward-strand fraction %.4f; see %s.metrics.*", r.Coverage.NPositions, r.Coverage.MeanDepth, r.Q30Frac, r.FwdFrac, mainPath)
+	return
+}
+
+func writeMetricsJSON(ctx context.Context, path string, r *metricsReport) (err error) {
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	enc := json.NewEncoder(dst.Writer(ctx))
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeMetricsTSV writes r in long form, with METRIC, KEY and VALUE columns.
+// The run-wide metrics have KEY "all", the filtered-read counts have the
+// filter as KEY, the coverage histogram has the depth as KEY, and the depth
+// summaries have the target as KEY.
+func writeMetricsTSV(ctx context.Context, path string, r *metricsReport) (err error) {
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#METRIC\tKEY\tVALUE")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	line := func(metric, key, value string) error {
+		w.WriteString(metric)
+		w.WriteString(key)
+		w.WriteString(value)
+		return w.EndLine()
+	}
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	ftoa := func(f float64) string { return strconv.FormatFloat(f, 'f', 4, 64) }
+	utoa := func(d uint32) string { return strconv.FormatUint(uint64(d), 10) }
+	for _, l := range [][2]string{
+		{"bases", itoa(r.Bases)},
+		{"q30_bases", itoa(r.Q30Bases)},
+		{"q30_frac", ftoa(r.Q30Frac)},
+		{"fwd_reads", itoa(r.FwdReads)},
+		{"rev_reads", itoa(r.RevReads)},
+		{"fwd_frac", ftoa(r.FwdFrac)},
+	} {
+		if err = line(l[0], depthHistTargetAll, l[1]); err != nil {
+			return
+		}
+	}
+	for _, name := range filterReasonNames {
+		if err = line("filtered_reads", name, itoa(r.FilteredReads[name])); err != nil {
+			return
+		}
+	}
+	for i, d := range r.Coverage.Depths {
+		if err = line("coverage_hist", utoa(d), itoa(r.Coverage.Counts[i])); err != nil {
+			return
+		}
+	}
+	for _, t := range r.Targets {
+		for _, l := range [][2]string{
+			{"n_positions", itoa(t.NPositions)},
+			{"mean_depth", ftoa(t.MeanDepth)},
+			{"min_depth", utoa(t.MinDepth)},
+			{"depth_p10", utoa(t.DepthP10)},
+			{"depth_p50", utoa(t.DepthP50)},
+			{"depth_p90", utoa(t.DepthP90)},
+			{"max_depth", utoa(t.MaxDepth)},
+		} {
+			if err = line(l[0], t.Target, l[1]); err != nil {
+				return
+			}
+		}
+	}
+	return w.Flush()
+}
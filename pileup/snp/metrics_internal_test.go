@@ -0,0 +1,132 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseMetricsOpts(t *testing.T) {
+	o, err := parseMetricsOpts("")
+	assert.NoError(t, err)
+	assert.True(t, o == nil)
+	o, err = parseMetricsOpts("tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, *o, metricsOpts{tsv: true})
+	o, err = parseMetricsOpts("json,tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, *o, metricsOpts{json: true, tsv: true})
+	for _, bad := range []string{"yaml", "json,", ","} {
+		_, err := parseMetricsOpts(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestDepthPercentiles(t *testing.T) {
+	h := depthHist{0: 1, 3: 4, 10: 4, 50: 1}
+	s := h.summary("x")
+	assert.EQ(t, depthPercentiles(&s, []float64{0, 0.1, 0.2, 0.5, 0.9, 1}), []uint32{0, 0, 3, 3, 10, 50})
+	empty := depthHist{}.summary("y")
+	assert.EQ(t, depthPercentiles(&empty, []float64{0.5}), []uint32{0})
+}
+
+func TestMetrics(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	ref2, _ := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref1, ref2})
+	bedUnion, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 10, End: 13},
+		{RefName: "chr1", Start0: 20, End: 22},
+		{RefName: "chr2", Start0: 0, End: 2},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+	refNames := []string{"chr1", "chr2"}
+
+	// The rows of the two jobs; the chr1:21-22 interval straddles them.
+	depths := [][][3]uint32{
+		{{0, 10, 5}, {0, 11, 5}, {0, 12, 0}, {0, 20, 2}},
+		{{0, 21, 5}, {1, 0, 1}, {1, 1, 1}},
+	}
+	run := &runMetrics{m: newPileupMetrics()}
+	for _, job := range depths {
+		f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+		assert.NoError(t, err)
+		m := newPileupMetrics()
+		w := newMetricsWriter(newPileupRowWriter(f, defaultShardCodec), m, &bedUnion)
+		for _, d := range job {
+			pr := &pileupRow{fieldsPresent: fieldCounts, refID: d[0], pos: d[1]}
+			pr.payload.depth = d[2]
+			w.Append(pr)
+		}
+		assert.NoError(t, w.Finish())
+		run.merge(m)
+	}
+
+	// Reads: one of each strand, and two filtered reads of which only the
+	// one starting in the shard is counted.
+	shardRange := biopb.CoordRange{Start: biopb.Coord{RefId: 0, Pos: 0}, Limit: biopb.Coord{RefId: 0, Pos: 100}}
+	newRead := func(pos int, flags sam.Flags) *sam.Record {
+		return &sam.Record{Ref: ref1, MateRef: ref1, Pos: pos, Flags: flags, MapQ: 60, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}, Qual: []byte{40, 20, 30, 10}}
+	}
+	pm := pileupMutable{metrics: newPileupMetrics()}
+	fwd := newRead(10, sam.Paired|sam.Read1|sam.MateReverse)
+	rev := newRead(10, sam.Paired|sam.Read1|sam.Reverse)
+	pm.metrics.addRead(fwd, pileup.GetStrand(fwd), &shardRange)
+	pm.metrics.addRead(rev, pileup.GetStrand(rev), &shardRange)
+	pm.metrics.addBases(&readSNP{samr: fwd}, []alignedPos{{10, 0}, {11, 1}, {12, 2}})
+	pm.dropRead(newRead(50, 0), filterMapq, &shardRange)
+	pm.dropRead(newRead(150, 0), filterMapq, &shardRange)
+	run.merge(pm.metrics)
+
+	r := newMetricsReport(run.m, &bedUnion, refNames)
+	assert.EQ(t, r.Coverage.NPositions, int64(7))
+	assert.EQ(t, r.Coverage.Depths, []uint32{0, 1, 2, 5})
+	assert.EQ(t, [3]int64{r.Bases, r.Q30Bases, r.FwdReads + r.RevReads}, [3]int64{3, 2, 2})
+	assert.EQ(t, r.FwdFrac, 0.5)
+	assert.EQ(t, r.FilteredReads["mapq"], int64(1))
+	assert.EQ(t, r.FilteredReads["dedup"], int64(0))
+	assert.EQ(t, r.Targets, []targetMetrics{
+		{Target: "all", NPositions: 7, MeanDepth: 19.0 / 7, MinDepth: 0, DepthP10: 0, DepthP50: 2, DepthP90: 5, MaxDepth: 5},
+		{Target: "chr1:11-13", NPositions: 3, MeanDepth: 10.0 / 3, MinDepth: 0, DepthP10: 0, DepthP50: 5, DepthP90: 5, MaxDepth: 5},
+		{Target: "chr1:21-22", NPositions: 2, MeanDepth: 3.5, MinDepth: 2, DepthP10: 2, DepthP50: 2, DepthP90: 5, MaxDepth: 5},
+		{Target: "chr2:1-2", NPositions: 2, MeanDepth: 1, MinDepth: 1, DepthP10: 1, DepthP50: 1, DepthP90: 1, MaxDepth: 1},
+	})
+
+	mainPath := filepath.Join(tmpdir, "out")
+	assert.NoError(t, writeMetrics(context.Background(), mainPath, &metricsOpts{json: true, tsv: true}, run.m, &bedUnion, refNames))
+	tsvData, err := ioutil.ReadFile(mainPath + ".metrics.tsv")
+	assert.NoError(t, err)
+	assert.HasSubstr(t, string(tsvData), "#METRIC\tKEY\tVALUE\nbases\tall\t3\nq30_bases\tall\t2\nq30_frac\tall\t0.6667\n")
+	assert.HasSubstr(t, string(tsvData), "filtered_reads\tmapq\t1\n")
+	assert.HasSubstr(t, string(tsvData), "coverage_hist\t5\t3\n")
+	assert.HasSubstr(t, string(tsvData), "depth_p50\tchr1:11-13\t5\n")
+	jsonData, err := ioutil.ReadFile(mainPath + ".metrics.json")
+	assert.NoError(t, err)
+	var decoded metricsReport
+	assert.NoError(t, json.Unmarshal(jsonData, &decoded))
+	assert.EQ(t, decoded, *r)
+}
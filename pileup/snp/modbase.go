@@ -0,0 +1,523 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// The base modifications reported by Opts.ModBase.
+const (
+	modBase5mC = iota
+	modBase5hmC
+	modBase6mA
+	nModBase
+)
+
+// modBaseInfo describes a base modification: its name in the reports, its
+// single-letter and ChEBI codes in the MM tag, and the (pileup.BaseA..BaseT)
+// base it modifies.
+type modBaseInfo struct {
+	name      string
+	code      byte
+	chebi     string
+	canonical byte
+}
+
+var modBaseInfos = [nModBase]modBaseInfo{
+	{name: "5mC", code: 'm', chebi: "27551", canonical: pileup.BaseC},
+	{name: "5hmC", code: 'h', chebi: "76792", canonical: pileup.BaseC},
+	{name: "6mA", code: 'a', chebi: "28871", canonical: pileup.BaseA},
+}
+
+// modBaseDefaultThreshold is the default minimum probability of a call, as
+// in modbam2bed.
+const modBaseDefaultThreshold = 0.66
+
+// The calls of a modification at a base, on the read's strand.  A base is
+// filtered when its most likely state is not probable enough, or is another
+// modification.
+const (
+	modStateCanonical = iota
+	modStateModified
+	modStateFiltered
+	nModState
+)
+
+var (
+	mmTag = sam.NewTag("MM")
+	mlTag = sam.NewTag("ML")
+	mnTag = sam.NewTag("MN")
+	// The tags were named Mm and Ml before they were standardized.
+	mmTagLegacy = sam.NewTag("Mm")
+	mlTagLegacy = sam.NewTag("Ml")
+)
+
+// modBaseOpts selects the modifications reported by Opts.ModBase.
+type modBaseOpts struct {
+	// mods are the reported modifications, in output order, and
+	// thresholds[m] is the minimum probability of a call of modification m.
+	mods       []int
+	thresholds [nModBase]float32
+}
+
+// parseModBaseOpts parses Opts.ModBase, a comma-separated list of
+// modifications ("5mC", "5hmC" and "6mA", or their MM codes "m", "h" and
+// "a"), each optionally followed by "=<threshold>".  It returns nil if s is
+// empty.
+func parseModBaseOpts(s string) (*modBaseOpts, error) {
+	if s == "" {
+		return nil, nil
+	}
+	opts := &modBaseOpts{}
+	var seen [nModBase]bool
+	for _, f := range strings.Split(s, ",") {
+		name := f
+		threshold := modBaseDefaultThreshold
+		if i := strings.IndexByte(f, '='); i >= 0 {
+			name = f[:i]
+			var err error
+			if threshold, err = strconv.ParseFloat(f[i+1:], 64); (err != nil) || (threshold <= 0) || (threshold > 1) {
+				return nil, fmt.Errorf("Pileup: invalid mod-base= argument %q (thresholds must be in (0, 1])", s)
+			}
+		}
+		m := 0
+		for ; m < nModBase; m++ {
+			if (name == modBaseInfos[m].name) || (name == string(modBaseInfos[m].code)) {
+				break
+			}
+		}
+		if (m == nModBase) || seen[m] {
+			return nil, fmt.Errorf("Pileup: invalid mod-base= argument %q (must be a comma-separated list of 5mC, 5hmC and 6mA, each with an optional =<threshold>)", s)
+		}
+		seen[m] = true
+		opts.mods = append(opts.mods, m)
+		opts.thresholds[m] = float32(threshold)
+	}
+	return opts, nil
+}
+
+// modBaseCall accumulates the MM/ML calls of one base of a read.
+type modBaseCall struct {
+	// called[m] is true iff the tags call modification m at the base (either
+	// explicitly, or implicitly as unmodified), and probs[m] is its
+	// probability.
+	called [nModBase]bool
+	probs  [nModBase]float32
+	// other is the highest probability of the other modification codes, and
+	// sum is the total probability of all modifications.
+	other float32
+	sum   float32
+}
+
+// state returns the call of modification m at c: the most likely of the
+// canonical base, m, and the other modifications, filtered if its
+// probability is below threshold or if it is another modification.
+func (c *modBaseCall) state(m int, threshold float32) int {
+	pMod := c.probs[m]
+	pCanon := 1 - c.sum
+	if pCanon < 0 {
+		pCanon = 0
+	}
+	pOther := c.other
+	for m2, p := range c.probs {
+		if (m2 != m) && (p > pOther) {
+			pOther = p
+		}
+	}
+	switch {
+	case (pMod >= pCanon) && (pMod >= pOther):
+		if pMod >= threshold {
+			return modStateModified
+		}
+	case pCanon >= pOther:
+		if pCanon >= threshold {
+			return modStateCanonical
+		}
+	}
+	return modStateFiltered
+}
+
+// modBaseIndex returns the modification of an MM code, or -1 if it isn't
+// one of the reported kinds.
+func modBaseIndex(code string) int {
+	for m := range modBaseInfos {
+		if (code == string(modBaseInfos[m].code)) || (code == modBaseInfos[m].chebi) {
+			return m
+		}
+	}
+	return -1
+}
+
+// parseModCalls adds the calls of an MM tag value mm, with ML probabilities
+// ml, to calls, which is indexed by position in seq8, the SEQ of the read (in
+// seq8 encoding); reverse is true iff the read is reverse-complemented.  The
+// MM skip counts are in the orientation of the original read, so they are
+// counted from the end of seq8 for a reversed read.  Entries of the
+// opposite strand ("C-m", as written for duplex reads) are skipped.
+func parseModCalls(mm string, ml []uint8, seq8 []byte, reverse bool, calls []modBaseCall) error {
+	n := len(seq8)
+	// origBase returns the base at position j of the original read.
+	origBase := func(j int) byte {
+		if reverse {
+			b := pileup.Seq8ToEnumTable[seq8[n-1-j]]
+			if b == pileup.BaseX {
+				return b
+			}
+			return pileup.BaseT - b
+		}
+		return pileup.Seq8ToEnumTable[seq8[j]]
+	}
+	seqPos := func(j int) int {
+		if reverse {
+			return n - 1 - j
+		}
+		return j
+	}
+	mlIdx := 0
+	for _, entry := range strings.Split(mm, ";") {
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ",")
+		header := fields[0]
+		skips := fields[1:]
+		if (len(header) < 3) || ((header[1] != '+') && (header[1] != '-')) {
+			return fmt.Errorf("invalid MM entry %q", entry)
+		}
+		// The fundamental base is pileup.BaseX for 'N', which matches every
+		// base.
+		baseIdx := strings.IndexByte("ACGTN", header[0])
+		if baseIdx < 0 {
+			return fmt.Errorf("invalid MM entry %q", entry)
+		}
+		fundamental := byte(baseIdx)
+		codeStr := header[2:]
+		implicit := true
+		if last := codeStr[len(codeStr)-1]; (last == '.') || (last == '?') {
+			implicit = last == '.'
+			codeStr = codeStr[:len(codeStr)-1]
+		}
+		// codes[i] is the modification of the ith code of the entry, or -1.
+		var codes []int
+		if _, err := strconv.Atoi(codeStr); err == nil {
+			codes = []int{modBaseIndex(codeStr)}
+		} else {
+			for i := 0; i < len(codeStr); i++ {
+				codes = append(codes, modBaseIndex(codeStr[i:i+1]))
+			}
+		}
+		if len(codes) == 0 {
+			return fmt.Errorf("invalid MM entry %q", entry)
+		}
+		nML := len(skips) * len(codes)
+		if mlIdx+nML > len(ml) {
+			return fmt.Errorf("MM tag has more calls than the %d ML probabilities", len(ml))
+		}
+		probs := ml[mlIdx : mlIdx+nML]
+		mlIdx += nML
+		if header[1] == '-' {
+			continue
+		}
+		isFundamental := func(j int) bool {
+			return (fundamental == pileup.BaseX) || (origBase(j) == fundamental)
+		}
+		if implicit {
+			// The bases which aren't listed are unmodified.
+			for j := 0; j < n; j++ {
+				if isFundamental(j) {
+					c := &calls[seqPos(j)]
+					for _, m := range codes {
+						if m >= 0 {
+							c.called[m] = true
+						}
+					}
+				}
+			}
+		}
+		j := 0
+		for k, skip := range skips {
+			nSkip, err := strconv.Atoi(skip)
+			if (err != nil) || (nSkip < 0) {
+				return fmt.Errorf("invalid MM entry %q", entry)
+			}
+			for ; j < n; j++ {
+				if isFundamental(j) {
+					if nSkip == 0 {
+						break
+					}
+					nSkip--
+				}
+			}
+			if j == n {
+				return fmt.Errorf("MM entry %q has more calls than the read has bases", header)
+			}
+			c := &calls[seqPos(j)]
+			for i, m := range codes {
+				// ML value v stands for a probability in [v/256, (v+1)/256).
+				p := (float32(probs[k*len(codes)+i]) + 0.5) / 256
+				c.sum += p
+				if m < 0 {
+					if p > c.other {
+						c.other = p
+					}
+					continue
+				}
+				c.called[m] = true
+				c.probs[m] += p
+			}
+			j++
+		}
+	}
+	return nil
+}
+
+// readModCalls returns the base-modification calls of read, indexed by
+// position in SEQ, in a buffer owned by pm.  It returns nil if the read has
+// no MM tag, or if its MM and ML tags are malformed or don't match its SEQ:
+// the tags are only valid for the whole sequence of the read, so a
+// hard-clipped read must have an MN tag with its clipped length.
+func (pm *pileupMutable) readModCalls(read *readSNP) []modBaseCall {
+	samr := read.samr
+	mmAux, mlAux := samr.AuxFields.Get(mmTag), samr.AuxFields.Get(mlTag)
+	if mmAux == nil {
+		mmAux, mlAux = samr.AuxFields.Get(mmTagLegacy), samr.AuxFields.Get(mlTagLegacy)
+		if mmAux == nil {
+			return nil
+		}
+	}
+	mm, ok := mmAux.Value().(string)
+	if !ok {
+		return nil
+	}
+	var ml []uint8
+	if mlAux != nil {
+		if ml, ok = mlAux.Value().([]uint8); !ok {
+			return nil
+		}
+	}
+	if mnAux := samr.AuxFields.Get(mnTag); mnAux != nil {
+		if mn, ok := auxInt(mnAux); !ok || (mn != int64(len(read.seq8))) {
+			return nil
+		}
+	} else {
+		for _, co := range samr.Cigar {
+			if co.Type() == sam.CigarHardClipped {
+				return nil
+			}
+		}
+	}
+	n := len(read.seq8)
+	if cap(pm.modCallBuf) < n {
+		pm.modCallBuf = make([]modBaseCall, n)
+	}
+	calls := pm.modCallBuf[:n]
+	for i := range calls {
+		calls[i] = modBaseCall{}
+	}
+	if err := parseModCalls(mm, ml, read.seq8, (samr.Flags&sam.Reverse) != 0, calls); err != nil {
+		return nil
+	}
+	return calls
+}
+
+// modBaseCounts[m][s][state] is the number of calls of modification m on
+// reference strand s.
+type modBaseCounts [nModBase][2][nModState]uint32
+
+// addModBaseCalls counts the calls of the reported modifications at
+// alignedBases, the bases of read in the pileup positions.  A call is only
+// counted where both the read and the reference have the modification's
+// canonical base, on the read's strand.  With extbases, a base called as
+// any reported modification is also counted as a pileup.BaseMod.
+func (pm *pileupMutable) addModBaseCalls(read *readSNP, alignedBases []alignedPos, isMinus PosType, refSeq8 []byte) {
+	if len(alignedBases) == 0 {
+		return
+	}
+	calls := pm.readModCalls(read)
+	if calls == nil {
+		return
+	}
+	mask := pm.nCirc() - 1
+	strand := 0
+	if (read.samr.Flags & sam.Reverse) != 0 {
+		strand = 1
+	}
+	for _, ab := range alignedBases {
+		c := &calls[ab.posInRead]
+		readBase := pileup.Seq8ToEnumTable[read.seq8[ab.posInRead]]
+		refBase := pileup.Seq8ToEnumTable[refSeq8[ab.posInRef]]
+		if (readBase == pileup.BaseX) || (readBase != refBase) {
+			continue
+		}
+		if strand == 1 {
+			readBase = pileup.BaseT - readBase
+		}
+		circPos := ab.posInRef & mask
+		modified := false
+		for _, m := range pm.modBase.mods {
+			if !c.called[m] || (modBaseInfos[m].canonical != readBase) {
+				continue
+			}
+			counts := pm.modCounts[circPos]
+			if counts == nil {
+				counts = new(modBaseCounts)
+				pm.modCounts[circPos] = counts
+			}
+			state := c.state(m, pm.modBase.thresholds[m])
+			counts[m][strand][state]++
+			modified = modified || (state == modStateModified)
+		}
+		if modified && pm.extBases {
+			pm.resultRingBuffer[circPos].counts[pileup.BaseMod][isMinus]++
+		}
+	}
+}
+
+// modBaseCountsSize is the size of the encoding of a modBaseCounts.
+const modBaseCountsSize = nModBase * 2 * nModState * 4
+
+// encodeModBaseCounts returns the data of the extensionTagModBase extension:
+// the counts, in index order.
+func encodeModBaseCounts(counts *modBaseCounts) []byte {
+	data := make([]byte, modBaseCountsSize)
+	buf := data
+	for m := range counts {
+		for s := range counts[m] {
+			for _, n := range counts[m][s] {
+				binary.LittleEndian.PutUint32(buf, n)
+				buf = buf[4:]
+			}
+		}
+	}
+	return data
+}
+
+// decodeModBaseCounts reverses encodeModBaseCounts.  It returns false if
+// data is empty or invalid.
+func decodeModBaseCounts(data []byte) (counts modBaseCounts, ok bool) {
+	if len(data) != modBaseCountsSize {
+		return
+	}
+	for m := range counts {
+		for s := range counts[m] {
+			for state := range counts[m][s] {
+				counts[m][s][state] = binary.LittleEndian.Uint32(data)
+				data = data[4:]
+			}
+		}
+	}
+	return counts, true
+}
+
+// flushModBaseCounts moves the modification counts of the ring-buffer row at
+// circPos, if any, to an extension of the row.
+func (pm *pileupMutable) flushModBaseCounts(row *pileupPayload, circPos PosType) {
+	if counts := pm.modCounts[circPos]; counts != nil {
+		row.setExtension(extensionTagModBase, encodeModBaseCounts(counts))
+		delete(pm.modCounts, circPos)
+	}
+}
+
+// writeModBaseReport writes the modification calls of the rows in tmpFiles
+// to one bedMethyl file per modification of opts, <mainPath>.<name>.bed
+// (e.g. out.5mC.bed), in the format of modbam2bed: chromosome, 0-based start
+// and end, modification name, score (1000 times the fraction of the calls
+// which aren't filtered), strand, thick start and end, color, number of
+// calls, percentage of modified calls among the unfiltered ones, and the
+// canonical, modified and filtered counts.  Each position and strand with
+// at least one call has a line.
+func writeModBaseReport(ctx context.Context, tmpFiles []*os.File, mainPath string, opts *modBaseOpts, refNames []string) (err error) {
+	var writers [nModBase]*tsv.Writer
+	for _, m := range opts.mods {
+		var f file.File
+		if f, err = file.Create(ctx, mainPath+"."+modBaseInfos[m].name+".bed"); err != nil {
+			return
+		}
+		defer file.CloseAndReport(ctx, f, &err)
+		writers[m] = tsv.NewWriter(f.Writer(ctx))
+	}
+	// totals[m] are the canonical and modified counts of modification m.
+	var totals [nModBase][2]uint64
+	for _, f := range tmpFiles {
+		if _, err = f.Seek(0, 0); err != nil {
+			return
+		}
+		scanner := newPileupRowScanner(f)
+		for scanner.Scan() {
+			pr := scanner.Get().(*pileupRow)
+			counts, ok := decodeModBaseCounts(pr.payload.extension(extensionTagModBase))
+			if !ok {
+				continue
+			}
+			for _, m := range opts.mods {
+				w := writers[m]
+				for s := range counts[m] {
+					c := &counts[m][s]
+					nCanon, nMod, nFilt := c[modStateCanonical], c[modStateModified], c[modStateFiltered]
+					n := nCanon + nMod + nFilt
+					if n == 0 {
+						continue
+					}
+					totals[m][0] += uint64(nCanon)
+					totals[m][1] += uint64(nMod)
+					w.WriteString(refNames[pr.refID])
+					w.WriteUint32(pr.pos)
+					w.WriteUint32(pr.pos + 1)
+					w.WriteString(modBaseInfos[m].name)
+					w.WriteUint32(uint32(1000 * uint64(nCanon+nMod) / uint64(n)))
+					w.WriteByte(pileup.StrandTypeToASCIITable[pileup.StrandFwd+pileup.StrandType(s)])
+					w.WriteUint32(pr.pos)
+					w.WriteUint32(pr.pos + 1)
+					w.WriteString("0,0,0")
+					w.WriteUint32(n)
+					if nCanon+nMod == 0 {
+						w.WriteString("nan")
+					} else {
+						w.WriteFloat64(100*float64(nMod)/float64(nCanon+nMod), 'f', 2)
+					}
+					w.WriteUint32(nCanon)
+					w.WriteUint32(nMod)
+					w.WriteUint32(nFilt)
+					if err = w.EndLine(); err != nil {
+						return
+					}
+				}
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+	}
+	for _, m := range opts.mods {
+		if t := totals[m]; t[0]+t[1] != 0 {
+			log.Printf("writeModBaseReport: %s %.2f%% (%d of %d calls)", modBaseInfos[m].name, 100*float64(t[1])/float64(t[0]+t[1]), t[1], t[0]+t[1])
+		}
+		if err = writers[m].Flush(); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biosimd"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseModBaseOpts(t *testing.T) {
+	opts, err := parseModBaseOpts("")
+	assert.NoError(t, err)
+	assert.True(t, opts == nil)
+	opts, err = parseModBaseOpts("5mC,a=0.8")
+	assert.NoError(t, err)
+	assert.EQ(t, opts.mods, []int{modBase5mC, modBase6mA})
+	assert.EQ(t, opts.thresholds, [nModBase]float32{0.66, 0, 0.8})
+	for _, s := range []string{"5fC", "5mC,m", "5mC=0", "5mC=1.5", "5mC=x"} {
+		_, err = parseModBaseOpts(s)
+		assert.HasSubstr(t, err.Error(), "invalid mod-base= argument", s)
+	}
+}
+
+// modBaseTestSeq8 returns seq in seq8 encoding.
+func modBaseTestSeq8(seq string) []byte {
+	seq8 := make([]byte, len(seq))
+	biosimd.ASCIIToSeq8(seq8, []byte(seq))
+	return seq8
+}
+
+func TestParseModCalls(t *testing.T) {
+	// The Cs are at 1, 3, 4, 7 and 9, and the As at 0 and 8.
+	seq8 := modBaseTestSeq8("ACGCCGTCAC")
+	calls := make([]modBaseCall, len(seq8))
+	assert.NoError(t, parseModCalls("C+mh?,1,2;A+a.,0;", []uint8{250, 2, 10, 200, 255}, seq8, false, calls))
+	// The Cs at 3 and 9 are listed.
+	for _, i := range []int{1, 4, 7} {
+		assert.EQ(t, calls[i], modBaseCall{}, i)
+	}
+	assert.EQ(t, calls[3].called, [nModBase]bool{true, true, false})
+	assert.EQ(t, calls[3].state(modBase5mC, 0.66), modStateModified)
+	// 5hmC is the most likely state at 9.
+	assert.EQ(t, calls[9].state(modBase5mC, 0.66), modStateFiltered)
+	assert.EQ(t, calls[9].state(modBase5hmC, 0.66), modStateModified)
+	assert.EQ(t, calls[9].state(modBase5hmC, 0.9), modStateFiltered)
+	// The A at 8 isn't listed, but the entry is implicit.
+	assert.EQ(t, calls[0].state(modBase6mA, 0.66), modStateModified)
+	assert.EQ(t, calls[8].called, [nModBase]bool{false, false, true})
+	assert.EQ(t, calls[8].state(modBase6mA, 0.66), modStateCanonical)
+
+	// The original read is GTGACGGCGT, with Cs at 4 and 7, which are at 5 and
+	// 2 in SEQ.
+	calls = make([]modBaseCall, len(seq8))
+	assert.NoError(t, parseModCalls("C+m,1", []uint8{255}, seq8, true, calls))
+	assert.EQ(t, calls[2].state(modBase5mC, 0.66), modStateModified)
+	assert.EQ(t, calls[5].state(modBase5mC, 0.66), modStateCanonical)
+	assert.False(t, calls[1].called[modBase5mC])
+
+	for _, tt := range []struct {
+		mm  string
+		ml  []uint8
+		err string
+	}{
+		{"C+m,5", []uint8{1}, "more calls than the read has bases"},
+		{"C+m,0,0", []uint8{1}, "more calls than the 1 ML probabilities"},
+		{"X+m,0", []uint8{1}, "invalid MM entry"},
+		{"C*m,0", []uint8{1}, "invalid MM entry"},
+		{"C+m,-1", []uint8{1}, "invalid MM entry"},
+	} {
+		err := parseModCalls(tt.mm, tt.ml, seq8, false, make([]modBaseCall, len(seq8)))
+		assert.HasSubstr(t, err.Error(), tt.err, tt.mm)
+	}
+}
+
+func TestWriteModBaseReport(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	const refSeq = "ACGCCGTCAC"
+	refSeq8 := modBaseTestSeq8(refSeq)
+	ref, err := sam.NewReference("chr1", "", "", len(refSeq), nil, nil)
+	assert.NoError(t, err)
+	opts, err := parseModBaseOpts("5mC,6mA=0.8")
+	assert.NoError(t, err)
+	pm := newPileupMutable(16, len(refSeq), false, nil)
+	pm.extBases = true
+	pm.modBase = opts
+	pm.modCounts = make(map[PosType]*modBaseCounts)
+
+	newRead := func(flags sam.Flags, cigar sam.Cigar, mm string, ml []uint8) readSNP {
+		samr := &sam.Record{Name: "r", Ref: ref, Flags: flags, Cigar: cigar}
+		mmAux, err := sam.NewAux(mmTag, mm)
+		assert.NoError(t, err)
+		mlAux, err := sam.NewAux(mlTag, ml)
+		assert.NoError(t, err)
+		samr.AuxFields = []sam.Aux{mmAux, mlAux}
+		return readSNP{samr: samr, seq8: modBaseTestSeq8(refSeq)}
+	}
+	var alignedBases []alignedPos
+	for i := range refSeq {
+		alignedBases = append(alignedBases, alignedPos{PosType(i), PosType(i)})
+	}
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, len(refSeq))}
+	// A modified C at 3 and an unmodified one at 9, an unmodified A at 0,
+	// and an A at 8 below the 6mA threshold.
+	read := newRead(0, cigar, "C+m?,1,2;A+a.,1;", []uint8{250, 10, 200})
+	pm.addModBaseCalls(&read, alignedBases, 0, refSeq8)
+	// The Cs of the original read are at 5 (undecided) and 2 (implicitly
+	// unmodified) in SEQ, i.e. on the reverse strand.
+	read = newRead(sam.Reverse, cigar, "C+m.,0", []uint8{128})
+	pm.addModBaseCalls(&read, alignedBases, 1, refSeq8)
+	// The tags of a hard-clipped read without an MN tag are ignored.
+	clipped := sam.Cigar{sam.NewCigarOp(sam.CigarHardClipped, 5), sam.NewCigarOp(sam.CigarMatch, len(refSeq))}
+	read = newRead(0, clipped, "C+m,0,0,0,0,0", []uint8{255, 255, 255, 255, 255})
+	pm.addModBaseCalls(&read, alignedBases, 0, refSeq8)
+	assert.EQ(t, pm.resultRingBuffer[3].counts[pileup.BaseMod], [2]uint32{1, 0})
+	assert.EQ(t, pm.resultRingBuffer[1].counts[pileup.BaseMod], [2]uint32{0, 0})
+
+	var rows []pileupRow
+	for pos := range refSeq {
+		row := &pm.resultRingBuffer[pos]
+		pm.flushModBaseCounts(row, PosType(pos))
+		pr := pileupRow{fieldsPresent: fieldCounts, pos: uint32(pos), payload: *row}
+		if len(row.extensions) != 0 {
+			pr.fieldsPresent |= fieldExtensions
+		}
+		rows = append(rows, pr)
+	}
+	assert.EQ(t, len(pm.modCounts), 0)
+	f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w := newPileupRowWriter(f, defaultShardCodec)
+	for i := range rows {
+		w.Append(&rows[i])
+	}
+	assert.NoError(t, w.Finish())
+
+	mainPath := filepath.Join(tmpdir, "out")
+	assert.NoError(t, writeModBaseReport(ctx, []*os.File{f}, mainPath, opts, []string{"chr1"}))
+	data, err := ioutil.ReadFile(mainPath + ".5mC.bed")
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), `chr1	2	3	5mC	1000	-	2	3	0,0,0	1	0.00	1	0	0
+chr1	3	4	5mC	1000	+	3	4	0,0,0	1	100.00	0	1	0
+chr1	5	6	5mC	0	-	5	6	0,0,0	1	nan	0	0	1
+chr1	9	10	5mC	1000	+	9	10	0,0,0	1	0.00	1	0	0
+`)
+	data, err = ioutil.ReadFile(mainPath + ".6mA.bed")
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), `chr1	0	1	6mA	1000	+	0	1	0,0,0	1	0.00	1	0	0
+chr1	8	9	6mA	0	+	8	9	0,0,0	1	nan	0	0	1
+`)
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+)
+
+// mpileupQualN is the quality reported for N bases, whose qualities aren't
+// retained in pileupRows.
+const mpileupQualN = '!'
+
+// appendMPileupBases appends the samtools mpileup read-base and base-quality
+// strings for payload to bases and quals, and returns the extended slices.
+//
+// As in samtools, reference matches are '.' on the forward strand and ',' on
+// the reverse strand, mismatches are upper- or lower-case bases, and indels
+// are written as "+<len><seq>" and "-<len><seq>" markers (lower-case on the
+// reverse strand).  The differences are:
+// - As elsewhere in this package, the strand is the strand of the read pair,
+//   not the read.
+// - Bases are grouped by base (A, C, G, T, then N) instead of sorted by read
+//   start, and indel markers follow the last base instead of the base of
+//   their read.
+// - There are no read start ('^') and end ('$') markers, and no '*'
+//   placeholders for reads spanning a deletion.
+//
+// refSeq8 is the contig's sequence in seq8 format, and pos is the 0-based
+// position of payload.  The returned depth is the number of bases appended.
+func appendMPileupBases(bases, quals []byte, payload *pileupPayload, refSeq8 []byte, pos PosType) ([]byte, []byte, int) {
+	refBase := pileup.Seq8ToEnumTable[refSeq8[pos]]
+	depth := 0
+	for b := 0; b < pileup.NBase; b++ {
+		for _, f := range payload.perRead[b] {
+			isMinus := f.strand == byte(pileup.StrandRev)
+			switch {
+			case byte(b) == refBase && isMinus:
+				bases = append(bases, ',')
+			case byte(b) == refBase:
+				bases = append(bases, '.')
+			case isMinus:
+				bases = append(bases, pileup.EnumToASCIITable[b]|0x20)
+			default:
+				bases = append(bases, pileup.EnumToASCIITable[b])
+			}
+			quals = append(quals, f.qual+33)
+			depth++
+		}
+	}
+	for strand, c := range payload.counts[pileup.BaseX] {
+		for i := uint32(0); i < c; i++ {
+			if strand == 1 {
+				bases = append(bases, 'n')
+			} else {
+				bases = append(bases, 'N')
+			}
+			quals = append(quals, mpileupQualN)
+			depth++
+		}
+	}
+	var marker []byte
+	for _, a := range payload.indels {
+		if a.delLen == 0 {
+			marker = append(marker[:0], '+')
+			marker = strconv.AppendInt(marker, int64(len(a.insSeq)), 10)
+			marker = append(marker, a.insSeq...)
+		} else {
+			marker = append(marker[:0], '-')
+			marker = strconv.AppendUint(marker, uint64(a.delLen), 10)
+			end := int(pos) + 1 + int(a.delLen)
+			if end > len(refSeq8) {
+				end = len(refSeq8)
+			}
+			for _, b := range refSeq8[pos+1 : end] {
+				marker = append(marker, pileup.Seq8ToASCIITable[b])
+			}
+		}
+		for i := uint32(0); i < a.counts[0]; i++ {
+			bases = append(bases, marker...)
+		}
+		for i := range marker {
+			if c := marker[i]; c >= 'A' && c <= 'Z' {
+				marker[i] = c | 0x20
+			}
+		}
+		for i := uint32(0); i < a.counts[1]; i++ {
+			bases = append(bases, marker...)
+		}
+	}
+	return bases, quals, depth
+}
+
+// convertPileupRowsToMPileup writes the pileup in the samtools mpileup text
+// format: CHROM, POS (1-based), REF, depth, read bases, and base qualities,
+// without a header.  Positions without any bases are skipped, like samtools
+// does by default, and so are the positions that rf doesn't keep.  See
+// appendMPileupBases for the details of the read-base column.
+func convertPileupRowsToMPileup(ctx context.Context, tmpFiles []*os.File, mainPath string, compression outputCompression, parallelism int, refNames []string, refSeqs [][]byte, rf *rowFilter) (err error) {
+	fullPath := mainPath + ".mpileup" + compression.suffix()
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	cw, closeCompressed, err := newCompressedWriter(ctx, dst, compression, parallelism)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := closeCompressed(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	w := tsv.NewWriter(cw)
+	lastRefID := uint32(0)
+	curRefName := refNames[0]
+	curRefSeq8 := refSeqs[0]
+	var bases, quals []byte
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		if !rf.keep(pr) {
+			return nil
+		}
+		refID := pr.refID
+		if refID != lastRefID {
+			curRefName = refNames[refID]
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
+		}
+		pos := PosType(pr.pos)
+		var depth int
+		bases, quals, depth = appendMPileupBases(bases[:0], quals[:0], &pr.payload, curRefSeq8, pos)
+		if depth == 0 {
+			return nil
+		}
+		writeChromPosRef(w, curRefName, pos, pileup.Seq8ToASCIITable[curRefSeq8[pos]])
+		w.WriteUint32(uint32(depth))
+		w.WriteBytes(bases)
+		w.WriteBytes(quals)
+		return w.EndLine()
+	})
+	if err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("convertPileupRowsToMPileup: done, final results written to %s", fullPath)
+	return
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestAppendMPileupBases(t *testing.T) {
+	// seq8: A=1, C=2, G=4, T=8.
+	refSeq8 := []byte{1, 2, 4, 8, 1}
+	fwd, rev := byte(pileup.StrandFwd), byte(pileup.StrandRev)
+	var payload pileupPayload
+	payload.perRead[pileup.BaseC] = []perReadFeatures{{qual: 30, strand: fwd}, {qual: 20, strand: rev}}
+	payload.perRead[pileup.BaseT] = []perReadFeatures{{qual: 10, strand: rev}}
+	payload.counts[pileup.BaseX] = [2]uint32{1, 0}
+	payload.indels = []indelAllele{
+		{insSeq: "GA", counts: [2]uint32{1, 1}},
+		{delLen: 2, counts: [2]uint32{0, 2}},
+	}
+	bases, quals, depth := appendMPileupBases(nil, nil, &payload, refSeq8, 1)
+	assert.EQ(t, depth, 4)
+	assert.EQ(t, string(bases), ".,tN+2GA+2ga-2gt-2gt")
+	assert.EQ(t, string(quals), "?5+!")
+
+	// Buffers are reused.
+	payload = pileupPayload{}
+	payload.perRead[pileup.BaseA] = []perReadFeatures{{qual: 40, strand: fwd}}
+	bases, quals, depth = appendMPileupBases(bases[:0], quals[:0], &payload, refSeq8, 1)
+	assert.EQ(t, depth, 1)
+	assert.EQ(t, string(bases), "A")
+	assert.EQ(t, string(quals), "I")
+}
@@ -0,0 +1,274 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/pileup"
+)
+
+// sampleInput is one input of a multi-sample pileup.
+type sampleInput struct {
+	name     string
+	provider bamprovider.Provider
+}
+
+// PileupSamples computes the pileups of several BAM/PAM files over the same
+// positions, and writes them to a single table with one set of per-sample
+// columns per input, e.g. for tumor/normal or trio comparisons.  The inputs
+// must be aligned to the same reference.  Samples are named after the SM tag
+// of their read groups, or their file names if that is ambiguous.
+//
+// Only the basestrand-tsv formats are supported; the output is written to
+// <outPrefix>.samples.tsv (plus the compression suffix), with columns
+// <sample>:A+, <sample>:A-, ..., <sample>:T- (and <sample>:INS+ etc. when
+// Cols includes "indels") for each sample.  With Opts.Somatic, the first
+// input is the tumor and the second the normal, and the somatic scores of
+// each position follow.
+func PileupSamples(ctx context.Context, xampaths []string, fapath, format, outPrefix string, rawOpts *Opts, refSeqs [][]byte) error {
+	if len(xampaths) < 2 {
+		return fmt.Errorf("PileupSamples: at least two inputs required")
+	}
+	f, ok := formatNameMap[format]
+	if !ok {
+		return fmt.Errorf("PileupSamples: unrecognized format= argument")
+	}
+	return pileupInternal(ctx, xampaths, fapath, f, outPrefix, rawOpts, refSeqs, nil, nil)
+}
+
+// checkMultiSampleOpts rejects the options which multi-sample mode doesn't
+// support.
+func checkMultiSampleOpts(opts *pileupSNPOpts, rawOpts *Opts) error {
+	switch {
+	case (opts.format != formatBasestrandTSV) && (opts.format != formatBasestrandTSVBgz) && (opts.format != formatBasestrandTSVZst):
+		return fmt.Errorf("PileupSamples: only the basestrand-tsv formats are supported")
+	case (opts.colBitset & colPerReadMask) != 0:
+		return fmt.Errorf("PileupSamples: per-read column sets are not supported")
+	case (opts.colBitset & colBitQualWeights) != 0:
+		return fmt.Errorf("PileupSamples: qualweights column set is not supported")
+	case (opts.colBitset & colBitExtBases) != 0:
+		return fmt.Errorf("PileupSamples: extbases column set is not supported")
+	case (opts.colBitset & colBitHapCounts) != 0:
+		return fmt.Errorf("PileupSamples: hapcounts column set is not supported")
+	case rawOpts.Hotspots != "":
+		return fmt.Errorf("PileupSamples: hotspots= is not supported")
+	case (rawOpts.MinDepth != 0) || (rawOpts.MinAltCount != 0) || (rawOpts.Positions != ""):
+		return fmt.Errorf("PileupSamples: min-depth=, min-alt-count= and positions= are not supported")
+	case (rawOpts.Hooks != nil) && (rawOpts.Hooks.OnPositions != nil):
+		// The rows don't say which sample they are from.
+		return fmt.Errorf("PileupSamples: Hooks.OnPositions is not supported")
+	case rawOpts.BamIndexPath != "":
+		return fmt.Errorf("PileupSamples: index= cannot be used with multiple inputs")
+	case rawOpts.PerStrand:
+		return fmt.Errorf("PileupSamples: per-strand= is not supported")
+	case opts.quarantine:
+		// The samples' intermediate files must have the same positions.
+		return fmt.Errorf("PileupSamples: quarantine= is not supported")
+	case opts.auditBoundaries:
+		return fmt.Errorf("PileupSamples: audit-boundaries= is not supported")
+	case opts.timeBudget > 0:
+		return fmt.Errorf("PileupSamples: time-budget= is not supported")
+	case opts.windowSize > 0:
+		return fmt.Errorf("PileupSamples: window= is not supported")
+	case opts.fragWindow > 0:
+		return fmt.Errorf("PileupSamples: fragmentomics-window= is not supported")
+	case opts.depthHist:
+		return fmt.Errorf("PileupSamples: depth-histogram= is not supported")
+	case opts.haplotypes != nil:
+		return fmt.Errorf("PileupSamples: haplotype-sites= is not supported")
+	case opts.hetSites != nil:
+		// Het sites are per-sample.
+		return fmt.Errorf("PileupSamples: het-sites= is not supported")
+	case opts.columns != nil:
+		return fmt.Errorf("PileupSamples: columns= is not supported")
+	case opts.metrics != nil:
+		return fmt.Errorf("PileupSamples: metrics= is not supported")
+	case opts.methylation != nil:
+		return fmt.Errorf("PileupSamples: methylation= is not supported")
+	}
+	return nil
+}
+
+// openSamples opens the providers of xampaths[1:] (xampaths[0] is already
+// open as first), checks that all inputs have the same references, and names
+// the samples.  The returned function closes the providers it opened.
+func openSamples(xampaths []string, first bamprovider.Provider, providerOpts bamprovider.ProviderOpts) (samples []sampleInput, closeAll func() error, err error) {
+	providers := []bamprovider.Provider{first}
+	closeAll = func() error {
+		var e error
+		for _, p := range providers[1:] {
+			if e2 := p.Close(); e2 != nil && e == nil {
+				e = e2
+			}
+		}
+		return e
+	}
+	for _, path := range xampaths[1:] {
+		providers = append(providers, bamprovider.NewProvider(path, providerOpts))
+	}
+	firstHeader, err := first.GetHeader()
+	if err != nil {
+		return
+	}
+	firstRefs := firstHeader.Refs()
+	seen := make(map[string]bool)
+	for i, p := range providers {
+		header, e := p.GetHeader()
+		if e != nil {
+			err = e
+			return
+		}
+		refs := header.Refs()
+		if len(refs) != len(firstRefs) {
+			err = fmt.Errorf("PileupSamples: %s and %s have different numbers of references", xampaths[0], xampaths[i])
+			return
+		}
+		for j, ref := range refs {
+			if (ref.Name() != firstRefs[j].Name()) || (ref.Len() != firstRefs[j].Len()) {
+				err = fmt.Errorf("PileupSamples: %s and %s have different references (%s vs. %s)", xampaths[0], xampaths[i], firstRefs[j].Name(), ref.Name())
+				return
+			}
+		}
+		base := filepath.Base(xampaths[i])
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+		name := vcfSampleName(header, base)
+		if seen[name] {
+			err = fmt.Errorf("PileupSamples: duplicate sample name %s (from %s)", name, xampaths[i])
+			return
+		}
+		seen[name] = true
+		samples = append(samples, sampleInput{name: name, provider: p})
+	}
+	return
+}
+
+// convertPileupRowsToMultiSampleTSV writes the multi-sample table.
+// tmpFiles[s*nJob+j] contains the rows of job j for sample s; the files of a
+// job have the same positions, in the same order.  If somatic is true, the
+// somatic columns of samples[0] (the tumor) vs. samples[1] (the normal) are
+// appended.
+func convertPileupRowsToMultiSampleTSV(ctx context.Context, tmpFiles []*os.File, nJob int, mainPath string, samples []sampleInput, colBitset int, somatic bool, compression outputCompression, parallelism int, refNames []string, refSeqs [][]byte) (err error) {
+	fullPath := mainPath + ".samples.tsv" + compression.suffix()
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	cw, closeCompressed, err := newCompressedWriter(ctx, dst, compression, parallelism)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := closeCompressed(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	w := tsv.NewWriter(cw)
+	w.WriteString("#CHROM\tPOS\tREF")
+	indels := (colBitset & colBitIndels) != 0
+	colNames := []string{"A+", "A-", "C+", "C-", "G+", "G-", "T+", "T-"}
+	if indels {
+		colNames = append(colNames, "INS+", "INS-", "DEL+", "DEL-")
+	}
+	for _, s := range samples {
+		for _, col := range colNames {
+			w.WriteString(s.name + ":" + col)
+		}
+	}
+	if somatic {
+		for _, col := range somaticColumns {
+			w.WriteString(col)
+		}
+	}
+	if err = w.EndLine(); err != nil {
+		return
+	}
+
+	// forEachShardRow reads the first sample's file of each job, and the
+	// other samples' files are read in step with it.
+	scanners := make([]recordio.Scanner, len(samples))
+	prs := make([]*pileupRow, len(samples))
+	for jobIdx := 0; jobIdx < nJob; jobIdx++ {
+		for s := 1; s < len(samples); s++ {
+			f := tmpFiles[s*nJob+jobIdx]
+			if _, err = f.Seek(0, 0); err != nil {
+				return
+			}
+			scanners[s] = newPileupRowScanner(f)
+		}
+		err = forEachShardRow(tmpFiles[jobIdx:jobIdx+1], func(pr0 *pileupRow) error {
+			refSeq8 := refSeqs[pr0.refID]
+			writeChromPosRef(w, refNames[pr0.refID], PosType(pr0.pos), pileup.Seq8ToASCIITable[refSeq8[pr0.pos]])
+			for s := range samples {
+				pr := pr0
+				if s > 0 {
+					if !scanners[s].Scan() {
+						return fmt.Errorf("convertPileupRowsToMultiSampleTSV: %s has fewer rows than %s", samples[s].name, samples[0].name)
+					}
+					pr = scanners[s].Get().(*pileupRow)
+					if (pr.refID != pr0.refID) || (pr.pos != pr0.pos) {
+						return fmt.Errorf("convertPileupRowsToMultiSampleTSV: %s and %s rows out of sync at %s:%d", samples[0].name, samples[s].name, refNames[pr0.refID], pr0.pos+1)
+					}
+				}
+				prs[s] = pr
+				for _, perStrandCounts := range pr.payload.counts[:pileup.NBase] {
+					for _, c := range perStrandCounts {
+						w.WriteUint32(c)
+					}
+				}
+				if indels {
+					for _, perStrandCounts := range pr.payload.indelCounts {
+						for _, c := range perStrandCounts {
+							w.WriteUint32(c)
+						}
+					}
+				}
+			}
+			if somatic {
+				writeSomaticCols(w, &prs[0].payload.counts, &prs[1].payload.counts, pileup.Seq8ToEnumTable[refSeq8[pr0.pos]])
+			}
+			return w.EndLine()
+		})
+		if err != nil {
+			return
+		}
+		for s := 1; s < len(samples); s++ {
+			if scanners[s].Scan() {
+				return fmt.Errorf("convertPileupRowsToMultiSampleTSV: %s has more rows than %s", samples[s].name, samples[0].name)
+			}
+			if err = scanners[s].Finish(); err != nil {
+				return
+			}
+			if err = removeShardFile(tmpFiles, s*nJob+jobIdx); err != nil {
+				return
+			}
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("convertPileupRowsToMultiSampleTSV: done, final results written to %s", fullPath)
+	return
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestMultiSampleTSV(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	// writeRows writes a job's intermediate file, with the given A+ counts at
+	// positions 0, 1, ...
+	writeRows := func(aFwd ...uint32) *os.File {
+		f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+		assert.NoError(t, err)
+		w := newPileupRowWriter(f, defaultShardCodec)
+		for pos, c := range aFwd {
+			pr := &pileupRow{pos: uint32(pos), fieldsPresent: fieldCounts}
+			pr.payload.depth = c
+			pr.payload.counts[pileup.BaseA][0] = c
+			w.Append(pr)
+		}
+		assert.NoError(t, w.Finish())
+		return f
+	}
+	samples := []sampleInput{{name: "tumor"}, {name: "normal"}}
+	refSeqs := [][]byte{{1, 2, 4}}
+
+	mainPath := filepath.Join(tmpdir, "ok")
+	tmpFiles := []*os.File{writeRows(3, 0, 1), writeRows(2, 5, 0)}
+	assert.NoError(t, convertPileupRowsToMultiSampleTSV(ctx, tmpFiles, 1, mainPath, samples, 0, false, compressNone, 1, []string{"chr1"}, refSeqs))
+	got, err := ioutil.ReadFile(mainPath + ".samples.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `#CHROM	POS	REF	tumor:A+	tumor:A-	tumor:C+	tumor:C-	tumor:G+	tumor:G-	tumor:T+	tumor:T-	normal:A+	normal:A-	normal:C+	normal:C-	normal:G+	normal:G-	normal:T+	normal:T-
+chr1	1	A	3	0	0	0	0	0	0	0	2	0	0	0	0	0	0	0
+chr1	2	C	0	0	0	0	0	0	0	0	5	0	0	0	0	0	0	0
+chr1	3	G	1	0	0	0	0	0	0	0	0	0	0	0	0	0	0	0
+`)
+
+	// The samples' rows must line up.
+	tmpFiles = []*os.File{writeRows(3, 0, 1), writeRows(2, 5)}
+	err = convertPileupRowsToMultiSampleTSV(ctx, tmpFiles, 1, filepath.Join(tmpdir, "bad"), samples, 0, false, compressNone, 1, []string{"chr1"}, refSeqs)
+	assert.HasSubstr(t, err.Error(), "normal has fewer rows than tumor")
+
+	// Only the last position has a tumor alt base.
+	mainPath = filepath.Join(tmpdir, "somatic")
+	tmpFiles = []*os.File{writeRows(3, 0, 1), writeRows(2, 5, 0)}
+	assert.NoError(t, convertPileupRowsToMultiSampleTSV(ctx, tmpFiles, 1, mainPath, samples, 0, true, compressNone, 1, []string{"chr1"}, refSeqs))
+	got, err = ioutil.ReadFile(mainPath + ".samples.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `#CHROM	POS	REF	tumor:A+	tumor:A-	tumor:C+	tumor:C-	tumor:G+	tumor:G-	tumor:T+	tumor:T-	normal:A+	normal:A-	normal:C+	normal:C-	normal:G+	normal:G-	normal:T+	normal:T-	ALT	TUMOR_AF	NORMAL_AF	TLOD	NLOD	STATUS
+chr1	1	A	3	0	0	0	0	0	0	0	2	0	0	0	0	0	0	0	.	.	.	.	.	.
+chr1	2	C	0	0	0	0	0	0	0	0	5	0	0	0	0	0	0	0	.	.	.	.	.	.
+chr1	3	G	1	0	0	0	0	0	0	0	0	0	0	0	0	0	0	0	A	1.0000	.	3.48	0.00	low_tlod
+`)
+}
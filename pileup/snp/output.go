@@ -14,8 +14,11 @@
 package snp
 
 import (
+	"bufio"
 	"context"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -24,10 +27,65 @@ import (
 	"github.com/grailbio/base/recordio"
 	"github.com/grailbio/base/recordio/recordiozstd"
 	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/encoding/fastq"
+	"github.com/grailbio/bio/encoding/zstdseek"
 	"github.com/grailbio/bio/pileup"
 	"github.com/grailbio/hts/bgzf"
 )
 
+// outputCompression selects how the text output formats are compressed.
+type outputCompression int
+
+const (
+	compressNone outputCompression = iota
+	// compressBGZF produces .gz files that can be indexed by tabix.
+	compressBGZF
+	// compressSeekableZstd produces .zst files in the zstd seekable format,
+	// which compress better than bgzf and still support random access.
+	compressSeekableZstd
+	// compressBGZFTabix and compressBGZFCSI produce bgzf files like
+	// compressBGZF, and also write a .tbi or .csi index of each file as it's
+	// written (Opts.OutputIndex).
+	compressBGZFTabix
+	compressBGZFCSI
+)
+
+// suffix returns the filename suffix for c.
+func (c outputCompression) suffix() string {
+	switch c {
+	case compressBGZF, compressBGZFTabix, compressBGZFCSI:
+		return ".gz"
+	case compressSeekableZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// newCompressedWriter wraps dst's writer with the compressor for c.  The
+// returned close function must be called after the last write, before dst is
+// closed.  For the indexed compressions, it also writes the index.
+func newCompressedWriter(ctx context.Context, dst file.File, c outputCompression, parallelism int) (io.Writer, func() error, error) {
+	w := dst.Writer(ctx)
+	switch c {
+	case compressBGZFTabix, compressBGZFCSI:
+		iw, err := newIndexingWriter(w, c == compressBGZFCSI)
+		if err != nil {
+			return nil, nil, err
+		}
+		return iw, func() error { return iw.close(ctx, dst.Name()) }, nil
+	case compressBGZF:
+		bw := bgzf.NewWriter(w, parallelism)
+		return bw, bw.Close, nil
+	case compressSeekableZstd:
+		zw, err := zstdseek.NewWriter(w, zstdseek.WriterOpts{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return zw, zw.Close, nil
+	}
+	return w, func() error { return nil }, nil
+}
+
 // writeChromPosRef is a convenience function which appends the CHROM/POS/REF
 // columns common to the TSV output formats.
 // It converts pos from 0-based to 1-based, since for better or worse, our
@@ -39,21 +97,160 @@ func writeChromPosRef(tsvw *tsv.Writer, refName string, pos PosType, refChar byt
 	tsvw.WriteByte(refChar)
 }
 
-func convertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath string, colBitset int, bgzip bool, parallelism int, refNames []string, refSeqs [][]byte) (err error) {
-	refPath := mainPath + ".ref.tsv"
-	if bgzip {
-		refPath = refPath + ".gz"
+// writeQualWeightedDepth appends the quality-weighted depth of base, summed
+// over both strands, or '.' for N.
+func writeQualWeightedDepth(tsvw *tsv.Writer, p *pileupPayload, base PosType) {
+	if base == PosType(pileup.BaseX) {
+		tsvw.WriteByte('.')
+		return
+	}
+	tsvw.WriteFloat64(float64(p.qualWeights[base][0]+p.qualWeights[base][1]), 'f', 2)
+}
+
+// writeIndelAllele appends the CHROM/POS/REF/ALT columns for an indel
+// anchored at pos, using VCF conventions: REF includes the deleted bases, and
+// ALT includes the inserted bases, both preceded by the anchor base.
+func writeIndelAllele(tsvw *tsv.Writer, refName string, pos PosType, refSeq8 []byte, a *indelAllele) {
+	tsvw.WriteString(refName)
+	tsvw.WriteUint32(uint32(pos + 1))
+	refChar := pileup.Seq8ToASCIITable[refSeq8[pos]]
+	buf := make([]byte, 0, 1+int(a.delLen)+len(a.insSeq))
+	buf = append(buf, refChar)
+	end := int(pos) + 1 + int(a.delLen)
+	if end > len(refSeq8) {
+		end = len(refSeq8)
+	}
+	for _, b := range refSeq8[pos+1 : end] {
+		buf = append(buf, pileup.Seq8ToASCIITable[b])
+	}
+	tsvw.WriteBytes(buf)
+	buf = append(buf[:1], a.insSeq...)
+	tsvw.WriteBytes(buf)
+}
+
+// sortIndelAlleles sorts alleles by type (insertions first), then by length,
+// then by inserted sequence, so that output order doesn't depend on read
+// order.
+func sortIndelAlleles(alleles []indelAllele) {
+	sort.Slice(alleles, func(i, j int) bool {
+		ai, aj := &alleles[i], &alleles[j]
+		if ai.delLen != aj.delLen {
+			return ai.delLen < aj.delLen
+		}
+		if len(ai.insSeq) != len(aj.insSeq) {
+			return len(ai.insSeq) < len(aj.insSeq)
+		}
+		return ai.insSeq < aj.insSeq
+	})
+}
+
+// tsvColumns returns the column names of the .ref.tsv file (alt false) or
+// the .alt.tsv file (alt true) of the tsv formats.  annotate adds the gene
+// annotation columns.
+func tsvColumns(colBitset int, alt, annotate bool) []string {
+	cols := []string{"#CHROM", "POS", "REF"}
+	if alt {
+		cols = append(cols, "ALT")
+	}
+	if (!alt && ((colBitset & colBitDpRef) != 0)) || (alt && ((colBitset & colBitDpAlt) != 0)) {
+		cols = append(cols, "DP")
+	}
+	if (colBitset & colBitEndDists) != 0 {
+		cols = append(cols, "5P_DISTS", "3P_DISTS")
+	}
+	if (colBitset & colBitQuals) != 0 {
+		cols = append(cols, "QUALS")
+	}
+	if (colBitset & colBitFraglens) != 0 {
+		cols = append(cols, "FRAGLENS")
+	}
+	if (colBitset & colBitStrands) != 0 {
+		cols = append(cols, "STRANDS")
+	}
+	if (colBitset & colBitReadFeatures) != 0 {
+		cols = append(cols, "MAPQS", "READ_GROUPS", "NMS", "CYCLES", "CLIP_DISTS")
+	}
+	if (colBitset & colBitSketch) != 0 {
+		cols = append(cols, sketchTSVColumns...)
+	}
+	if alt && ((colBitset & colBitBiasStats) != 0) {
+		cols = append(cols, "FS", "READ_POS_RANK_SUM", "BASE_Q_RANK_SUM")
+	}
+	prefix := "ref"
+	if alt {
+		prefix = "alt"
+	}
+	// These two columns will be renamed once we've removed
+	// targeted_to_tsv_snp2.py (used to create Conta-readable files) from the
+	// pipeline.  The basestrand format should be *more* convenient for Conta...
+	if (colBitset & colBitHighQ) != 0 {
+		cols = append(cols, prefix+"_depth_tier1")
+	}
+	if (colBitset & colBitLowQ) != 0 {
+		cols = append(cols, prefix+"_depth_tier2")
+	}
+	if (colBitset & colBitQualWeights) != 0 {
+		cols = append(cols, prefix+"_qual_weighted_depth")
+	}
+	if (colBitset & colBitHapCounts) != 0 {
+		cols = append(cols, hapCountsTSVColumns(prefix)...)
+	}
+	if annotate {
+		cols = append(cols, annotationColumns()...)
+	}
+	return cols
+}
+
+// forEachShardRow calls fn on the rows of the intermediate files tmpFiles, in
+// order, and stops at the first error.  Each file is closed and removed once
+// it has been read.
+func forEachShardRow(tmpFiles []*os.File, fn func(*pileupRow) error) error {
+	for i, f := range tmpFiles {
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+		scanner := newPileupRowScanner(f)
+		for scanner.Scan() {
+			if err := fn(scanner.Get().(*pileupRow)); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Finish(); err != nil {
+			return err
+		}
+		if err := removeShardFile(tmpFiles, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeShardFile closes and removes tmpFiles[i], and clears it.
+func removeShardFile(tmpFiles []*os.File, i int) error {
+	curPath := tmpFiles[i].Name()
+	if err := tmpFiles[i].Close(); err != nil {
+		return err
 	}
+	tmpFiles[i] = nil
+	// os.Remove returns an error if we try to remove a file that isn't there.
+	_ = os.Remove(curPath)
+	return nil
+}
+
+// convertPileupRowsToTSV writes the pileup as <mainPath>.ref.tsv and
+// <mainPath>.alt.tsv.  If ann is non-nil, the rows are annotated with the
+// overlapping genes.  If cols is non-nil, it holds the column projections of
+// the two files (Opts.Columns).  The positions that rf doesn't keep are left
+// out.
+func convertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath string, colBitset int, compression outputCompression, parallelism int, refNames []string, refSeqs [][]byte, ann *annotator, cols []*columnProjection, rf *rowFilter) (err error) {
+	refPath := mainPath + ".ref.tsv" + compression.suffix()
 	var dstRef file.File
 	if dstRef, err = file.Create(ctx, refPath); err != nil {
 		return
 	}
 	defer file.CloseAndReport(ctx, dstRef, &err)
 
-	altPath := mainPath + ".alt.tsv"
-	if bgzip {
-		altPath = altPath + ".gz"
-	}
+	altPath := mainPath + ".alt.tsv" + compression.suffix()
 	var dstAlt file.File
 	if dstAlt, err = file.Create(ctx, altPath); err != nil {
 		return
@@ -61,67 +258,52 @@ func convertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath s
 	defer file.CloseAndReport(ctx, dstAlt, &err)
 
 	// Write headers.
-	var refTSV *tsv.Writer
-	var altTSV *tsv.Writer
-	if !bgzip {
-		refTSV = tsv.NewWriter(dstRef.Writer(ctx))
-		altTSV = tsv.NewWriter(dstAlt.Writer(ctx))
-	} else {
-		bgzfRefWriter := bgzf.NewWriter(dstRef.Writer(ctx), parallelism)
-		bgzfAltWriter := bgzf.NewWriter(dstAlt.Writer(ctx), parallelism)
-		refTSV = tsv.NewWriter(bgzfRefWriter)
-		altTSV = tsv.NewWriter(bgzfAltWriter)
-		defer func() {
-			if e := bgzfRefWriter.Close(); e != nil && err == nil {
-				err = e
-			}
-			if e := bgzfAltWriter.Close(); e != nil && err == nil {
-				err = e
-			}
-		}()
+	refWriter, closeRef, err := newCompressedWriter(ctx, dstRef, compression, parallelism)
+	if err != nil {
+		return
 	}
-	refTSV.WriteString("#CHROM\tPOS\tREF")
-	altTSV.WriteString("#CHROM\tPOS\tREF\tALT")
-	if (colBitset & colBitDpRef) != 0 {
-		refTSV.WriteString("DP")
+	altWriter, closeAlt, err := newCompressedWriter(ctx, dstAlt, compression, parallelism)
+	if err != nil {
+		return
 	}
-	if (colBitset & colBitDpAlt) != 0 {
-		altTSV.WriteString("DP")
+	defer func() {
+		if e := closeRef(); e != nil && err == nil {
+			err = e
+		}
+		if e := closeAlt(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if cols != nil {
+		refWriter = newProjectingWriter(refWriter, cols[0])
+		altWriter = newProjectingWriter(altWriter, cols[1])
+	}
+	refTSV := tsv.NewWriter(refWriter)
+	altTSV := tsv.NewWriter(altWriter)
+	for _, col := range tsvColumns(colBitset, false, ann != nil) {
+		refTSV.WriteString(col)
+	}
+	for _, col := range tsvColumns(colBitset, true, ann != nil) {
+		altTSV.WriteString(col)
 	}
 	perReadStats := ((colBitset & colPerReadMask) != 0)
 	var emptyPerReadStats []byte
 	if perReadStats {
 		if (colBitset & colBitEndDists) != 0 {
-			refTSV.WriteString("5P_DISTS\t3P_DISTS")
-			altTSV.WriteString("5P_DISTS\t3P_DISTS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t"...)
 		}
 		if (colBitset & colBitQuals) != 0 {
-			refTSV.WriteString("QUALS")
-			altTSV.WriteString("QUALS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t"...)
 		}
 		if (colBitset & colBitFraglens) != 0 {
-			refTSV.WriteString("FRAGLENS")
-			altTSV.WriteString("FRAGLENS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t"...)
 		}
 		if (colBitset & colBitStrands) != 0 {
-			refTSV.WriteString("STRANDS")
-			altTSV.WriteString("STRANDS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t"...)
 		}
-	}
-	// These two columns will be renamed once we've removed
-	// targeted_to_tsv_snp2.py (used to create Conta-readable files) from the
-	// pipeline.  The basestrand format should be *more* convenient for Conta...
-	if (colBitset & colBitHighQ) != 0 {
-		refTSV.WriteString("ref_depth_tier1")
-		altTSV.WriteString("alt_depth_tier1")
-	}
-	if (colBitset & colBitLowQ) != 0 {
-		refTSV.WriteString("ref_depth_tier2")
-		altTSV.WriteString("alt_depth_tier2")
+		if (colBitset & colBitReadFeatures) != 0 {
+			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t"...)
+		}
 	}
 	if err = refTSV.EndLine(); err != nil {
 		return
@@ -133,157 +315,237 @@ func convertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath s
 	lastRefID := uint32(0)
 	curRefName := refNames[0]
 	curRefSeq8 := refSeqs[0]
-	for i, f := range tmpFiles {
-		if _, err = f.Seek(0, 0); err != nil {
-			return
+	// Possible todo: parallelize pileupRow -> final-output-format rendering.
+	// This intermediate-recordio design causes wall-clock time for the entire
+	// run to increase by up to ~35% over the old
+	// intermediate-TSVs-which-can-be-concatenated design.  (The design change
+	// was still made because, if performance is an issue, you should be
+	// requesting recordio final output instead of TSV anyway.)
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		if !rf.keep(pr) {
+			return nil
 		}
-		scanner := recordio.NewScanner(f, recordio.ScannerOpts{
-			Unmarshal: unmarshalPileupRow,
-		})
-		// Possible todo: parallelize pileupRow -> final-output-format rendering.
-		// This intermediate-recordio design causes wall-clock time for the entire
-		// run to increase by up to ~35% over the old
-		// intermediate-TSVs-which-can-be-concatenated design.  (The design change
-		// was still made because, if performance is an issue, you should be
-		// requesting recordio final output instead of TSV anyway.)
-		for scanner.Scan() {
-			pr := scanner.Get().(*pileupRow)
-			refID := pr.refID
-			if refID != lastRefID {
-				curRefName = refNames[refID]
-				curRefSeq8 = refSeqs[refID]
-				lastRefID = refID
-			}
-			pos := pr.pos
-			refBase8 := curRefSeq8[pos]
-			refChar := pileup.Seq8ToASCIITable[refBase8]
-			writeChromPosRef(refTSV, curRefName, PosType(pos), refChar)
-			refBase := PosType(pileup.Seq8ToEnumTable[refBase8])
-			if (colBitset & colBitDpRef) != 0 {
-				refTSV.WriteUint32(pr.payload.depth)
-			}
-			if perReadStats {
-				if refBase == PosType(pileup.BaseX) {
+		refID := pr.refID
+		if refID != lastRefID {
+			curRefName = refNames[refID]
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
+		}
+		pos := pr.pos
+		refBase8 := curRefSeq8[pos]
+		refChar := pileup.Seq8ToASCIITable[refBase8]
+		if ann != nil {
+			ann.lookup(curRefName, PosType(pos))
+		}
+		writeChromPosRef(refTSV, curRefName, PosType(pos), refChar)
+		refBase := PosType(pileup.Seq8ToEnumTable[refBase8])
+		if (colBitset & colBitDpRef) != 0 {
+			refTSV.WriteUint32(pr.payload.depth)
+		}
+		if perReadStats {
+			if refBase == PosType(pileup.BaseX) {
+				refTSV.WritePartialBytes(emptyPerReadStats)
+			} else {
+				refFeatures := pr.payload.perRead[refBase]
+				if len(refFeatures) == 0 {
 					refTSV.WritePartialBytes(emptyPerReadStats)
 				} else {
-					refFeatures := pr.payload.perRead[refBase]
-					if len(refFeatures) == 0 {
-						refTSV.WritePartialBytes(emptyPerReadStats)
+					if (colBitset & colBitEndDists) != 0 {
+						for _, f := range refFeatures {
+							refTSV.WriteCsvUint32(uint32(f.dist5p))
+						}
+						refTSV.EndCsv()
+						for _, f := range refFeatures {
+							refTSV.WriteCsvUint32(uint32(f.fraglen - 1 - f.dist5p))
+						}
+						refTSV.EndCsv()
+					}
+					if (colBitset & colBitQuals) != 0 {
+						for _, f := range refFeatures {
+							refTSV.WriteCsvUint32(uint32(f.qual))
+						}
+						refTSV.EndCsv()
+					}
+					if (colBitset & colBitFraglens) != 0 {
+						for _, f := range refFeatures {
+							refTSV.WriteCsvUint32(uint32(f.fraglen))
+						}
+						refTSV.EndCsv()
+					}
+					if (colBitset & colBitStrands) != 0 {
+						for _, f := range refFeatures {
+							refTSV.WriteCsvByte(pileup.StrandTypeToASCIITable[f.strand])
+						}
+						refTSV.EndCsv()
+					}
+					if (colBitset & colBitReadFeatures) != 0 {
+						writeReadFeatureCols(refTSV, refFeatures)
+					}
+				}
+			}
+		}
+		if (colBitset & colBitSketch) != 0 {
+			if refBase == PosType(pileup.BaseX) {
+				refTSV.WritePartialBytes(sketchEmpty)
+			} else {
+				writeSketchCols(refTSV, pr.payload.perRead[refBase], pr.payload.extension(extensionTagDepthSketch), int(refBase))
+			}
+		}
+		counts := &pr.payload.counts
+		if (colBitset & colBitHighQ) != 0 {
+			refTSV.WriteUint32(counts[refBase][0] + counts[refBase][1])
+		}
+		if (colBitset & colBitLowQ) != 0 {
+			refTSV.WriteByte('0')
+		}
+		if (colBitset & colBitQualWeights) != 0 {
+			writeQualWeightedDepth(refTSV, &pr.payload, refBase)
+		}
+		if (colBitset & colBitHapCounts) != 0 {
+			writeHapCountCols(refTSV, &pr.payload, refBase)
+		}
+		if ann != nil {
+			ann.writeCols(refTSV)
+		}
+		if err = refTSV.EndLine(); err != nil {
+			return err
+		}
+		// Do we want to report ALT=N?  Probably want to make this configurable,
+		// since this was handled inconsistently in the past...
+		// Current choice is to report counts, but nothing else, for Ns.
+		// Note that, when stitch=true, mismatch between the two read-sides is
+		// treated as N.
+		for altBase := PosType(0); altBase < pileup.NBaseEnum; altBase++ {
+			if altBase == refBase {
+				continue
+			}
+			altCount := counts[altBase][0] + counts[altBase][1]
+			if altCount != 0 {
+				writeChromPosRef(altTSV, curRefName, PosType(pos), refChar)
+				altTSV.WriteByte(pileup.EnumToASCIITable[altBase])
+				if (colBitset & colBitDpAlt) != 0 {
+					altTSV.WriteUint32(pr.payload.depth)
+				}
+				if perReadStats {
+					if altBase == PosType(pileup.BaseX) {
+						altTSV.WritePartialBytes(emptyPerReadStats)
 					} else {
+						altFeatures := pr.payload.perRead[altBase]
 						if (colBitset & colBitEndDists) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.dist5p))
+							for _, f := range altFeatures {
+								altTSV.WriteCsvUint32(uint32(f.dist5p))
 							}
-							refTSV.EndCsv()
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.fraglen - 1 - f.dist5p))
+							altTSV.EndCsv()
+							for _, f := range altFeatures {
+								altTSV.WriteCsvUint32(uint32(f.fraglen - 1 - f.dist5p))
 							}
-							refTSV.EndCsv()
+							altTSV.EndCsv()
 						}
 						if (colBitset & colBitQuals) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.qual))
+							for _, f := range altFeatures {
+								altTSV.WriteCsvUint32(uint32(f.qual))
 							}
-							refTSV.EndCsv()
+							altTSV.EndCsv()
 						}
 						if (colBitset & colBitFraglens) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.fraglen))
+							for _, f := range altFeatures {
+								altTSV.WriteCsvUint32(uint32(f.fraglen))
 							}
-							refTSV.EndCsv()
+							altTSV.EndCsv()
 						}
 						if (colBitset & colBitStrands) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvByte(pileup.StrandTypeToASCIITable[f.strand])
+							for _, f := range altFeatures {
+								altTSV.WriteCsvByte(pileup.StrandTypeToASCIITable[f.strand])
 							}
-							refTSV.EndCsv()
+							altTSV.EndCsv()
+						}
+						if (colBitset & colBitReadFeatures) != 0 {
+							writeReadFeatureCols(altTSV, altFeatures)
 						}
 					}
 				}
-			}
-			counts := &pr.payload.counts
-			if (colBitset & colBitHighQ) != 0 {
-				refTSV.WriteUint32(counts[refBase][0] + counts[refBase][1])
-			}
-			if (colBitset & colBitLowQ) != 0 {
-				refTSV.WriteByte('0')
-			}
-			if err = refTSV.EndLine(); err != nil {
-				return
-			}
-			// Do we want to report ALT=N?  Probably want to make this configurable,
-			// since this was handled inconsistently in the past...
-			// Current choice is to report counts, but nothing else, for Ns.
-			// Note that, when stitch=true, mismatch between the two read-sides is
-			// treated as N.
-			for altBase := PosType(0); altBase < pileup.NBaseEnum; altBase++ {
-				if altBase == refBase {
-					continue
-				}
-				altCount := counts[altBase][0] + counts[altBase][1]
-				if altCount != 0 {
-					writeChromPosRef(altTSV, curRefName, PosType(pos), refChar)
-					altTSV.WriteByte(pileup.EnumToASCIITable[altBase])
-					if (colBitset & colBitDpAlt) != 0 {
-						altTSV.WriteUint32(pr.payload.depth)
+				if (colBitset & colBitSketch) != 0 {
+					if altBase == PosType(pileup.BaseX) {
+						altTSV.WritePartialBytes(sketchEmpty)
+					} else {
+						writeSketchCols(altTSV, pr.payload.perRead[altBase], pr.payload.extension(extensionTagDepthSketch), int(altBase))
 					}
-					if perReadStats {
-						if altBase == PosType(pileup.BaseX) {
-							altTSV.WritePartialBytes(emptyPerReadStats)
-						} else {
-							altFeatures := pr.payload.perRead[altBase]
-							if (colBitset & colBitEndDists) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.dist5p))
-								}
-								altTSV.EndCsv()
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.fraglen - 1 - f.dist5p))
-								}
-								altTSV.EndCsv()
-							}
-							if (colBitset & colBitQuals) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.qual))
-								}
-								altTSV.EndCsv()
-							}
-							if (colBitset & colBitFraglens) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.fraglen))
-								}
-								altTSV.EndCsv()
-							}
-							if (colBitset & colBitStrands) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvByte(pileup.StrandTypeToASCIITable[f.strand])
-								}
-								altTSV.EndCsv()
-							}
+				}
+				if (colBitset & colBitBiasStats) != 0 {
+					if altBase == PosType(pileup.BaseX) {
+						altTSV.WritePartialBytes(biasStatsEmpty)
+					} else {
+						var refFeatures []perReadFeatures
+						if refBase != PosType(pileup.BaseX) {
+							refFeatures = pr.payload.perRead[refBase]
 						}
+						writeBiasStatsCols(altTSV, refFeatures, pr.payload.perRead[altBase])
 					}
-					if (colBitset & colBitHighQ) != 0 {
-						altTSV.WriteUint32(altCount)
-					}
-					if (colBitset & colBitLowQ) != 0 {
-						altTSV.WriteByte('0')
-					}
-					if err = altTSV.EndLine(); err != nil {
-						return
-					}
+				}
+				if (colBitset & colBitHighQ) != 0 {
+					altTSV.WriteUint32(altCount)
+				}
+				if (colBitset & colBitLowQ) != 0 {
+					altTSV.WriteByte('0')
+				}
+				if (colBitset & colBitQualWeights) != 0 {
+					writeQualWeightedDepth(altTSV, &pr.payload, altBase)
+				}
+				if (colBitset & colBitHapCounts) != 0 {
+					writeHapCountCols(altTSV, &pr.payload, altBase)
+				}
+				if ann != nil {
+					ann.writeCols(altTSV)
+				}
+				if err = altTSV.EndLine(); err != nil {
+					return err
 				}
 			}
 		}
-		if err = scanner.Err(); err != nil {
-			return
-		}
-		curPath := f.Name()
-		if err = f.Close(); err != nil {
-			return
+		if (colBitset & colBitIndels) != 0 {
+			// Per-read features are not tracked for indels.
+			sortIndelAlleles(pr.payload.indels)
+			for j := range pr.payload.indels {
+				a := &pr.payload.indels[j]
+				writeIndelAllele(altTSV, curRefName, PosType(pos), curRefSeq8, a)
+				if (colBitset & colBitDpAlt) != 0 {
+					altTSV.WriteUint32(pr.payload.depth)
+				}
+				if perReadStats {
+					altTSV.WritePartialBytes(emptyPerReadStats)
+				}
+				if (colBitset & colBitSketch) != 0 {
+					altTSV.WritePartialBytes(sketchEmpty)
+				}
+				if (colBitset & colBitBiasStats) != 0 {
+					altTSV.WritePartialBytes(biasStatsEmpty)
+				}
+				if (colBitset & colBitHighQ) != 0 {
+					altTSV.WriteUint32(a.counts[0] + a.counts[1])
+				}
+				if (colBitset & colBitLowQ) != 0 {
+					altTSV.WriteByte('0')
+				}
+				if (colBitset & colBitQualWeights) != 0 {
+					// Not tracked for indels.
+					altTSV.WriteByte('.')
+				}
+				if (colBitset & colBitHapCounts) != 0 {
+					// Likewise.
+					writeHapCountCols(altTSV, &pr.payload, PosType(pileup.BaseX))
+				}
+				if ann != nil {
+					ann.writeCols(altTSV)
+				}
+				if err = altTSV.EndLine(); err != nil {
+					return err
+				}
+			}
 		}
-		tmpFiles[i] = nil
-		// os.Remove returns an error if we try to remove a file that isn't there.
-		_ = os.Remove(curPath)
+		return nil
+	})
+	if err != nil {
+		return
 	}
 	if err = refTSV.Flush(); err != nil {
 		return
@@ -291,15 +553,13 @@ func convertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath s
 	if err = altTSV.Flush(); err != nil {
 		return
 	}
-	if bgzip {
-		log.Printf("convertPileupRowsToTSV: done, final results written to %s.{ref,alt}.tsv.gz", mainPath)
-	} else {
-		log.Printf("convertPileupRowsToTSV: done, final results written to %s.{ref,alt}.tsv", mainPath)
-	}
+	log.Printf("convertPileupRowsToTSV: done, final results written to %s.{ref,alt}.tsv%s", mainPath, compression.suffix())
 	return
 }
 
-func convertPileupRowsToBasestrandRio(ctx context.Context, tmpFiles []*os.File, mainPath string, refNames []string) (err error) {
+// convertPileupRowsToBasestrandRio writes the pileup as
+// <mainPath>.basestrand.rio.  The positions that rf doesn't keep are left out.
+func convertPileupRowsToBasestrandRio(ctx context.Context, tmpFiles []*os.File, mainPath string, refNames []string, rf *rowFilter) (err error) {
 	var dst file.File
 	if dst, err = file.Create(ctx, mainPath+".basestrand.rio"); err != nil {
 		return
@@ -315,38 +575,26 @@ func convertPileupRowsToBasestrandRio(ctx context.Context, tmpFiles []*os.File,
 	recordWriter.AddHeader(refNamesHeader, strings.Join(refNames, "\000"))
 	recordWriter.AddHeader(recordio.KeyTrailer, true)
 	var numPiles int
-	for i, f := range tmpFiles {
-		if _, err = f.Seek(0, 0); err != nil {
-			return
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		if !rf.keep(pr) {
+			return nil
 		}
-		scanner := recordio.NewScanner(f, recordio.ScannerOpts{
-			Unmarshal: unmarshalPileupRow,
+		counts := &pr.payload.counts
+		recordWriter.Append(&BaseStrandPile{
+			RefID: pr.refID,
+			Pos:   pr.pos,
+			Counts: [4][2]uint32{
+				counts[0],
+				counts[1],
+				counts[2],
+				counts[3],
+			},
 		})
-		for scanner.Scan() {
-			pr := scanner.Get().(*pileupRow)
-			counts := &pr.payload.counts
-			recordWriter.Append(&BaseStrandPile{
-				RefID: pr.refID,
-				Pos:   pr.pos,
-				Counts: [4][2]uint32{
-					counts[0],
-					counts[1],
-					counts[2],
-					counts[3],
-				},
-			})
-			numPiles++
-		}
-		if err = scanner.Err(); err != nil {
-			return
-		}
-		curPath := f.Name()
-		if err = f.Close(); err != nil {
-			return
-		}
-		tmpFiles[i] = nil
-		// os.Remove returns an error if we try to remove a file that isn't there.
-		_ = os.Remove(curPath)
+		numPiles++
+		return nil
+	})
+	if err != nil {
+		return
 	}
 	recordWriter.SetTrailer(baseStrandsRioTrailer(numPiles))
 	if err = recordWriter.Finish(); err != nil {
@@ -373,48 +621,92 @@ func flushPlusAndMinusBuf(w *tsv.Writer, plusBufPtr, minusBufPtr *[]byte) {
 	}
 }
 
-func convertPileupRowsToBasestrandTSV(ctx context.Context, tmpFiles []*os.File, mainPath string, colBitset int, bgzip bool, parallelism int, refNames []string, refSeqs [][]byte) (err error) {
-	fullPath := mainPath + ".basestrand.tsv"
-	if bgzip {
-		fullPath = fullPath + ".gz"
+// basestrandTSVColumns returns the column names of the basestrand-tsv
+// formats.  Note that the recordio format does not include REF.
+func basestrandTSVColumns(colBitset int) []string {
+	// perBaseStrand returns <prefix><base><strand> for each A/C/G/T base and
+	// strand.
+	perBaseStrand := func(prefix string) []string {
+		var cols []string
+		for _, base := range "ACGT" {
+			cols = append(cols, prefix+string(base)+"+", prefix+string(base)+"-")
+		}
+		return cols
 	}
+	cols := append([]string{"#CHROM", "POS", "REF"}, perBaseStrand("")...)
+	if (colBitset & colBitIndels) != 0 {
+		cols = append(cols, "INS+", "INS-", "DEL+", "DEL-")
+	}
+	if (colBitset & colBitQualWeights) != 0 {
+		cols = append(cols, perBaseStrand("QW_")...)
+	}
+	if (colBitset & colBitExtBases) != 0 {
+		cols = append(cols, "DEL_BASE+", "DEL_BASE-", "INS_NEXT+", "INS_NEXT-", "MOD+", "MOD-")
+	}
+	if (colBitset & colBitHapCounts) != 0 {
+		cols = append(cols, hapCountsBasestrandColumns()...)
+	}
+	if (colBitset & colBitEndDists) != 0 {
+		cols = append(cols, perBaseStrand("5P_DISTS_")...)
+		cols = append(cols, perBaseStrand("3P_DISTS_")...)
+	}
+	if (colBitset & colBitQuals) != 0 {
+		cols = append(cols, perBaseStrand("QUALS_")...)
+	}
+	if (colBitset & colBitFraglens) != 0 {
+		cols = append(cols, perBaseStrand("FRAGLENS_")...)
+	}
+	if (colBitset & colBitStrands) != 0 {
+		cols = append(cols, perBaseStrand("STRANDS_")...)
+	}
+	return cols
+}
+
+// convertPileupRowsToBasestrandTSV writes the pileup as
+// <mainPath>.basestrand.tsv.  If cols is non-nil, its only entry is the
+// column projection of the file (Opts.Columns).  The positions that rf
+// doesn't keep are left out.
+func convertPileupRowsToBasestrandTSV(ctx context.Context, tmpFiles []*os.File, mainPath string, colBitset int, compression outputCompression, parallelism int, refNames []string, refSeqs [][]byte, cols []*columnProjection, rf *rowFilter) (err error) {
+	fullPath := mainPath + ".basestrand.tsv" + compression.suffix()
 	var dst file.File
 	if dst, err = file.Create(ctx, fullPath); err != nil {
 		return
 	}
 	defer file.CloseAndReport(ctx, dst, &err)
 
-	var w *tsv.Writer
-	if !bgzip {
-		w = tsv.NewWriter(dst.Writer(ctx))
-	} else {
-		bgzfWriter := bgzf.NewWriter(dst.Writer(ctx), parallelism)
-		w = tsv.NewWriter(bgzfWriter)
-		defer func() {
-			if e := bgzfWriter.Close(); e != nil && err == nil {
-				err = e
-			}
-		}()
+	cw, closeCompressed, err := newCompressedWriter(ctx, dst, compression, parallelism)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := closeCompressed(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if cols != nil {
+		cw = newProjectingWriter(cw, cols[0])
+	}
+	w := tsv.NewWriter(cw)
+	for _, col := range basestrandTSVColumns(colBitset) {
+		w.WriteString(col)
 	}
-	// Note that the recordio format does not include REF.
-	w.WriteString("#CHROM\tPOS\tREF\tA+\tA-\tC+\tC-\tG+\tG-\tT+\tT-")
+	indels := (colBitset & colBitIndels) != 0
+	qualWeights := (colBitset & colBitQualWeights) != 0
+	extBases := (colBitset & colBitExtBases) != 0
+	hapCounts := (colBitset & colBitHapCounts) != 0
 	perReadStats := ((colBitset & colPerReadMask) != 0)
 	var emptyPerReadStats []byte
 	if perReadStats {
 		if (colBitset & colBitEndDists) != 0 {
-			w.WriteString("\t5P_DISTS_A+\t5P_DISTS_A-\t5P_DISTS_C+\t5P_DISTS_C-\t5P_DISTS_G+\t5P_DISTS_G-\t5P_DISTS_T+\t5P_DISTS_T-\t3P_DISTS_A+\t3P_DISTS_A-\t3P_DISTS_C+\t3P_DISTS_C-\t3P_DISTS_G+\t3P_DISTS_G-\t3P_DISTS_T+\t3P_DISTS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 		if (colBitset & colBitQuals) != 0 {
-			w.WriteString("\tQUALS_A+\tQUALS_A-\tQUALS_C+\tQUALS_C-\tQUALS_G+\tQUALS_G-\tQUALS_T+\tQUALS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 		if (colBitset & colBitFraglens) != 0 {
-			w.WriteString("\tFRAGLENS_A+\tFRAGLENS_A-\tFRAGLENS_C+\tFRAGLENS_C-\tFRAGLENS_G+\tFRAGLENS_G-\tFRAGLENS_T+\tFRAGLENS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 		if (colBitset & colBitStrands) != 0 {
-			w.WriteString("\tSTRANDS_A+\tSTRANDS_A-\tSTRANDS_C+\tSTRANDS_C-\tSTRANDS_G+\tSTRANDS_G-\tSTRANDS_T+\tSTRANDS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 	}
@@ -426,146 +718,154 @@ func convertPileupRowsToBasestrandTSV(ctx context.Context, tmpFiles []*os.File,
 	curRefSeq8 := refSeqs[0]
 	plusBuf := make([]byte, 0, 256)
 	minusBuf := make([]byte, 0, 256)
-	for i := range tmpFiles {
-		f := tmpFiles[i]
-		if _, err = f.Seek(0, 0); err != nil {
-			return
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		if !rf.keep(pr) {
+			return nil
 		}
-		scanner := recordio.NewScanner(f, recordio.ScannerOpts{
-			Unmarshal: unmarshalPileupRow,
-		})
-		for scanner.Scan() {
-			pr := scanner.Get().(*pileupRow)
-			refID := pr.refID
-			if refID != lastRefID {
-				curRefName = refNames[refID]
-				curRefSeq8 = refSeqs[refID]
-				lastRefID = refID
+		refID := pr.refID
+		if refID != lastRefID {
+			curRefName = refNames[refID]
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
+		}
+		pos := pr.pos
+		refBase8 := curRefSeq8[pos]
+		refChar := pileup.Seq8ToASCIITable[refBase8]
+		writeChromPosRef(w, curRefName, PosType(pos), refChar)
+		for _, perStrandCounts := range pr.payload.counts[:4] {
+			for _, c := range perStrandCounts {
+				w.WriteUint32(c)
 			}
-			pos := pr.pos
-			refBase8 := curRefSeq8[pos]
-			refChar := pileup.Seq8ToASCIITable[refBase8]
-			writeChromPosRef(w, curRefName, PosType(pos), refChar)
-			for _, perStrandCounts := range pr.payload.counts[:4] {
+		}
+		if indels {
+			for _, perStrandCounts := range pr.payload.indelCounts {
 				for _, c := range perStrandCounts {
 					w.WriteUint32(c)
 				}
 			}
-			if perReadStats {
-				if pr.payload.depth == 0 {
-					w.WritePartialBytes(emptyPerReadStats)
-				} else {
-					curPerRead := &pr.payload.perRead
-					// Note that this code would be simpler if we added a strand
-					// dimension to perRead.  But that has the drawback of significantly
-					// increasing the base size of pileupPayload everywhere, just for a
-					// currently-rare use case.
-					if (colBitset & colBitEndDists) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curDist5p := uint64(f.dist5p)
-									if f.strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curDist5p, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curDist5p, 10)
-										minusBuf = append(minusBuf, ',')
-									}
+		}
+		if qualWeights {
+			for _, perStrandWeights := range pr.payload.qualWeights {
+				for _, qw := range perStrandWeights {
+					w.WriteFloat64(float64(qw), 'f', 2)
+				}
+			}
+		}
+		if extBases {
+			for _, perStrandCounts := range pr.payload.counts[pileup.BaseDel:] {
+				for _, c := range perStrandCounts {
+					w.WriteUint32(c)
+				}
+			}
+		}
+		if hapCounts {
+			writeHapCountBasestrandCols(w, &pr.payload)
+		}
+		if perReadStats {
+			if pr.payload.depth == 0 {
+				w.WritePartialBytes(emptyPerReadStats)
+			} else {
+				curPerRead := &pr.payload.perRead
+				// Note that this code would be simpler if we added a strand
+				// dimension to perRead.  But that has the drawback of significantly
+				// increasing the base size of pileupPayload everywhere, just for a
+				// currently-rare use case.
+				if (colBitset & colBitEndDists) != 0 {
+					for _, baseFeatures := range curPerRead {
+						if len(baseFeatures) == 0 {
+							w.WriteString(".\t.")
+						} else {
+							for _, f := range baseFeatures {
+								curDist5p := uint64(f.dist5p)
+								if f.strand == byte(pileup.StrandFwd) {
+									plusBuf = strconv.AppendUint(plusBuf, curDist5p, 10)
+									plusBuf = append(plusBuf, ',')
+								} else {
+									minusBuf = strconv.AppendUint(minusBuf, curDist5p, 10)
+									minusBuf = append(minusBuf, ',')
 								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 							}
+							flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 						}
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curDist3p := uint64(f.fraglen - 1 - f.dist5p)
-									if f.strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curDist3p, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curDist3p, 10)
-										minusBuf = append(minusBuf, ',')
-									}
+					}
+					for _, baseFeatures := range curPerRead {
+						if len(baseFeatures) == 0 {
+							w.WriteString(".\t.")
+						} else {
+							for _, f := range baseFeatures {
+								curDist3p := uint64(f.fraglen - 1 - f.dist5p)
+								if f.strand == byte(pileup.StrandFwd) {
+									plusBuf = strconv.AppendUint(plusBuf, curDist3p, 10)
+									plusBuf = append(plusBuf, ',')
+								} else {
+									minusBuf = strconv.AppendUint(minusBuf, curDist3p, 10)
+									minusBuf = append(minusBuf, ',')
 								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 							}
+							flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 						}
 					}
-					if (colBitset & colBitQuals) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curQual := uint64(f.qual)
-									if f.strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curQual, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curQual, 10)
-										minusBuf = append(minusBuf, ',')
-									}
+				}
+				if (colBitset & colBitQuals) != 0 {
+					for _, baseFeatures := range curPerRead {
+						if len(baseFeatures) == 0 {
+							w.WriteString(".\t.")
+						} else {
+							for _, f := range baseFeatures {
+								curQual := uint64(f.qual)
+								if f.strand == byte(pileup.StrandFwd) {
+									plusBuf = strconv.AppendUint(plusBuf, curQual, 10)
+									plusBuf = append(plusBuf, ',')
+								} else {
+									minusBuf = strconv.AppendUint(minusBuf, curQual, 10)
+									minusBuf = append(minusBuf, ',')
 								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 							}
+							flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 						}
 					}
-					if (colBitset & colBitFraglens) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curFraglen := uint64(f.fraglen)
-									if f.strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curFraglen, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curFraglen, 10)
-										minusBuf = append(minusBuf, ',')
-									}
+				}
+				if (colBitset & colBitFraglens) != 0 {
+					for _, baseFeatures := range curPerRead {
+						if len(baseFeatures) == 0 {
+							w.WriteString(".\t.")
+						} else {
+							for _, f := range baseFeatures {
+								curFraglen := uint64(f.fraglen)
+								if f.strand == byte(pileup.StrandFwd) {
+									plusBuf = strconv.AppendUint(plusBuf, curFraglen, 10)
+									plusBuf = append(plusBuf, ',')
+								} else {
+									minusBuf = strconv.AppendUint(minusBuf, curFraglen, 10)
+									minusBuf = append(minusBuf, ',')
 								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 							}
+							flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 						}
 					}
-					if (colBitset & colBitStrands) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									if f.strand == byte(pileup.StrandFwd) {
-										plusBuf = append(plusBuf, "+,"...)
-									} else {
-										minusBuf = append(minusBuf, "-,"...)
-									}
+				}
+				if (colBitset & colBitStrands) != 0 {
+					for _, baseFeatures := range curPerRead {
+						if len(baseFeatures) == 0 {
+							w.WriteString(".\t.")
+						} else {
+							for _, f := range baseFeatures {
+								if f.strand == byte(pileup.StrandFwd) {
+									plusBuf = append(plusBuf, "+,"...)
+								} else {
+									minusBuf = append(minusBuf, "-,"...)
 								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 							}
+							flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
 						}
 					}
 				}
 			}
-			if err = w.EndLine(); err != nil {
-				return
-			}
-		}
-		if err = scanner.Err(); err != nil {
-			return
-		}
-		curPath := f.Name()
-		if err = f.Close(); err != nil {
-			return
 		}
-		tmpFiles[i] = nil
-		// os.Remove returns an error if we try to remove a file that isn't there.
-		_ = os.Remove(curPath)
+		return w.EndLine()
+	})
+	if err != nil {
+		return
 	}
 	if err = w.Flush(); err != nil {
 		return
@@ -573,3 +873,67 @@ func convertPileupRowsToBasestrandTSV(ctx context.Context, tmpFiles []*os.File,
 	log.Printf("convertPileupRowsToBasestrandTSV: done, final results written to %s", fullPath)
 	return
 }
+
+// convertPileupRowsToConsensusFASTQ writes one FASTQ record per contig,
+// containing the consensus base and its phred-scaled quality (see
+// consensusBaseAndQual) at each pileup position.  Only positions covered by
+// -region/-bed are included, so when several BED intervals fall on the same
+// contig, their consensus sequences are concatenated; positions without any
+// passing base are rendered as 'N' with qual 0.
+//
+// Each contig's record is accumulated in memory before it is written; this is
+// intended for small genomes and targeted panels.  The positions that rf
+// doesn't keep are left out of the records.
+func convertPileupRowsToConsensusFASTQ(ctx context.Context, tmpFiles []*os.File, mainPath string, refNames []string, rf *rowFilter) (err error) {
+	fullPath := mainPath + ".consensus.fq"
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	bufw := bufio.NewWriter(dst.Writer(ctx))
+	fqw := fastq.NewWriter(bufw)
+	var seq, qual []byte
+	curRefID := -1
+	flush := func() error {
+		if curRefID == -1 {
+			return nil
+		}
+		err := fqw.Write(&fastq.Read{
+			ID:   "@" + refNames[curRefID],
+			Seq:  string(seq),
+			Unk:  "+",
+			Qual: string(qual),
+		})
+		seq = seq[:0]
+		qual = qual[:0]
+		return err
+	}
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		if !rf.keep(pr) {
+			return nil
+		}
+		if int(pr.refID) != curRefID {
+			if err = flush(); err != nil {
+				return err
+			}
+			curRefID = int(pr.refID)
+		}
+		base, q := consensusBaseAndQual(&pr.payload.perRead)
+		seq = append(seq, pileup.EnumToASCIITable[base])
+		qual = append(qual, q+33)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if err = flush(); err != nil {
+		return
+	}
+	if err = bufw.Flush(); err != nil {
+		return
+	}
+	log.Printf("convertPileupRowsToConsensusFASTQ: done, final results written to %s", fullPath)
+	return
+}
@@ -0,0 +1,459 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/parquet"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+// The tests in this file feed the same pileup rows through the tsv,
+// basestrand-tsv, parquet and vcf writers, parse each output back into
+// goldenSites, and check that they agree with the rows on every field the
+// format reports.  A writer change which makes one format diverge from the
+// others should fail here.
+
+// goldenSite is the content of one output position.
+type goldenSite struct {
+	chrom string
+	pos   int // 0-based
+	ref   byte
+	depth uint32
+	// counts and indelCounts are as in pileupPayload.  Formats which only
+	// report totals store them in the forward-strand slot.
+	counts      [pileup.NBaseEnum][2]uint32
+	indelCounts [nIndelType][2]uint32
+	// indels maps "<REF>/<ALT>", with VCF-style alleles, to the total count
+	// of an indel allele.  It is nil if there are none.
+	indels map[string]uint32
+}
+
+// goldenRefNames and goldenRefSeqs are the references of goldenRows.  The N
+// at chr1:4 exercises the BaseX handling of the writers.
+var (
+	goldenRefNames = []string{"chr1", "chr2"}
+	goldenRefSeqs  = [][]byte{
+		{1, 2, 4, 8, 15, 1, 2, 4, 8, 1}, // ACGTNACGTA
+		{4, 4, 2, 1, 8, 8},              // GGCATT
+	}
+)
+
+// goldenRows returns the rows fed to every writer.
+func goldenRows() []pileupRow {
+	const fields = fieldCounts | fieldIndelCounts | fieldIndelAlleles
+	rows := []pileupRow{
+		{refID: 0, pos: 0},
+		{refID: 0, pos: 2},
+		// No reads, but a deletion anchored here spanning the N.
+		{refID: 0, pos: 3},
+		{refID: 0, pos: 4},
+		{refID: 1, pos: 1},
+		{refID: 1, pos: 5},
+	}
+	for i := range rows {
+		rows[i].fieldsPresent = fields
+	}
+	p := &rows[0].payload
+	p.depth = 10
+	p.counts[pileup.BaseA] = [2]uint32{4, 3}
+	p.counts[pileup.BaseC] = [2]uint32{1, 0}
+	p.counts[pileup.BaseT] = [2]uint32{0, 2}
+
+	p = &rows[1].payload
+	p.depth = 5
+	p.counts[pileup.BaseG] = [2]uint32{2, 2}
+	p.counts[pileup.BaseX] = [2]uint32{1, 0}
+	p.indelCounts[indelIns] = [2]uint32{1, 1}
+	p.indels = []indelAllele{{insSeq: "TT", counts: [2]uint32{1, 1}}}
+
+	p = &rows[2].payload
+	p.indelCounts[indelDel] = [2]uint32{0, 2}
+	p.indels = []indelAllele{{delLen: 2, counts: [2]uint32{0, 2}}}
+
+	p = &rows[3].payload
+	p.depth = 3
+	p.counts[pileup.BaseA] = [2]uint32{1, 0}
+	p.counts[pileup.BaseC] = [2]uint32{0, 1}
+	p.counts[pileup.BaseX] = [2]uint32{0, 1}
+
+	p = &rows[4].payload
+	p.depth = 20
+	p.counts[pileup.BaseG] = [2]uint32{5, 5}
+	p.counts[pileup.BaseA] = [2]uint32{4, 4}
+	p.counts[pileup.BaseT] = [2]uint32{1, 1}
+	p.indelCounts[indelIns] = [2]uint32{2, 0}
+	p.indelCounts[indelDel] = [2]uint32{1, 0}
+	p.indels = []indelAllele{
+		{insSeq: "C", counts: [2]uint32{1, 0}},
+		{insSeq: "AG", counts: [2]uint32{1, 0}},
+		{delLen: 1, counts: [2]uint32{1, 0}},
+	}
+
+	p = &rows[5].payload
+	p.depth = 2
+	p.counts[pileup.BaseT] = [2]uint32{1, 1}
+	return rows
+}
+
+// expectedGoldenSites returns the full content of rows.
+func expectedGoldenSites(rows []pileupRow) []goldenSite {
+	sites := make([]goldenSite, len(rows))
+	for i := range rows {
+		pr := &rows[i]
+		refSeq8 := goldenRefSeqs[pr.refID]
+		s := &sites[i]
+		s.chrom = goldenRefNames[pr.refID]
+		s.pos = int(pr.pos)
+		s.ref = pileup.Seq8ToASCIITable[refSeq8[pr.pos]]
+		s.depth = pr.payload.depth
+		copy(s.counts[:], pr.payload.counts[:pileup.NBaseEnum])
+		s.indelCounts = pr.payload.indelCounts
+		for _, a := range pr.payload.indels {
+			var ref, alt []byte
+			for _, b := range refSeq8[pr.pos : int(pr.pos)+1+int(a.delLen)] {
+				ref = append(ref, pileup.Seq8ToASCIITable[b])
+			}
+			alt = append(append(alt, ref[0]), a.insSeq...)
+			s.addIndel(string(ref), string(alt), a.counts[0]+a.counts[1])
+		}
+	}
+	return sites
+}
+
+func (s *goldenSite) addIndel(ref, alt string, count uint32) {
+	if s.indels == nil {
+		s.indels = make(map[string]uint32)
+	}
+	s.indels[ref+"/"+alt] += count
+}
+
+// The views below keep the fields of a site which a format reports.
+
+func (s goldenSite) tsvView() goldenSite {
+	v := goldenSite{chrom: s.chrom, pos: s.pos, ref: s.ref, depth: s.depth, indels: s.indels}
+	for b := range s.counts {
+		v.counts[b][0] = s.counts[b][0] + s.counts[b][1]
+	}
+	return v
+}
+
+func (s goldenSite) basestrandView() goldenSite {
+	v := goldenSite{chrom: s.chrom, pos: s.pos, ref: s.ref, indelCounts: s.indelCounts}
+	copy(v.counts[:], s.counts[:pileup.NBase])
+	return v
+}
+
+func (s goldenSite) parquetView() goldenSite {
+	v := s
+	v.indels = nil
+	return v
+}
+
+func (s goldenSite) vcfView() goldenSite {
+	v := goldenSite{chrom: s.chrom, pos: s.pos, ref: s.ref, depth: s.depth}
+	copy(v.counts[:], s.counts[:pileup.NBase])
+	return v
+}
+
+func views(sites []goldenSite, view func(goldenSite) goldenSite) []goldenSite {
+	result := make([]goldenSite, len(sites))
+	for i, s := range sites {
+		result[i] = view(s)
+	}
+	return result
+}
+
+// goldenBase returns the pileup base enum of an ASCII base.
+func goldenBase(t *testing.T, c string) int {
+	i := bytes.IndexByte(pileup.EnumToASCIITable[:pileup.NBaseEnum], c[0])
+	assert.True(t, len(c) == 1 && i >= 0, c)
+	return i
+}
+
+func goldenUint32(t *testing.T, s string) uint32 {
+	v, err := strconv.ParseUint(s, 10, 32)
+	assert.NoError(t, err, s)
+	return uint32(v)
+}
+
+// readGoldenTSV returns the column names and the rows of a tab-separated
+// file, skipping "##" lines.
+func readGoldenTSV(t *testing.T, path string) (map[string]int, [][]string) {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var header map[string]int
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if strings.HasPrefix(line, "##") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if header == nil {
+			header = make(map[string]int)
+			for i, name := range fields {
+				assert.True(t, name != "", path, line)
+				header[strings.TrimPrefix(name, "#")] = i
+			}
+			continue
+		}
+		assert.EQ(t, len(fields), len(header), line)
+		rows = append(rows, fields)
+	}
+	return header, rows
+}
+
+func parseGoldenTSV(t *testing.T, mainPath string) []goldenSite {
+	header, rows := readGoldenTSV(t, mainPath+".ref.tsv")
+	var sites []goldenSite
+	for _, row := range rows {
+		s := goldenSite{
+			chrom: row[header["CHROM"]],
+			pos:   int(goldenUint32(t, row[header["POS"]])) - 1,
+			ref:   row[header["REF"]][0],
+			depth: goldenUint32(t, row[header["DP"]]),
+		}
+		s.counts[goldenBase(t, row[header["REF"]])][0] = goldenUint32(t, row[header["ref_depth_tier1"]])
+		sites = append(sites, s)
+	}
+	// Alt rows follow the order of the ref rows.
+	header, rows = readGoldenTSV(t, mainPath+".alt.tsv")
+	i := 0
+	for _, row := range rows {
+		chrom, pos := row[header["CHROM"]], int(goldenUint32(t, row[header["POS"]]))-1
+		for (i < len(sites)) && ((sites[i].chrom != chrom) || (sites[i].pos != pos)) {
+			i++
+		}
+		assert.True(t, i < len(sites), "alt row %v has no ref row", row)
+		s := &sites[i]
+		assert.EQ(t, goldenUint32(t, row[header["DP"]]), s.depth, row)
+		ref, alt := row[header["REF"]], row[header["ALT"]]
+		count := goldenUint32(t, row[header["alt_depth_tier1"]])
+		if len(ref) == 1 && len(alt) == 1 {
+			b := goldenBase(t, alt)
+			assert.EQ(t, s.counts[b][0], uint32(0), row)
+			s.counts[b][0] = count
+		} else {
+			s.addIndel(ref, alt, count)
+		}
+	}
+	return sites
+}
+
+func parseGoldenBasestrandTSV(t *testing.T, mainPath string) []goldenSite {
+	header, rows := readGoldenTSV(t, mainPath+".basestrand.tsv")
+	sites := make([]goldenSite, len(rows))
+	for i, row := range rows {
+		s := &sites[i]
+		s.chrom = row[header["CHROM"]]
+		s.pos = int(goldenUint32(t, row[header["POS"]])) - 1
+		s.ref = row[header["REF"]][0]
+		for strand, sign := range []string{"+", "-"} {
+			for b := 0; b < pileup.NBase; b++ {
+				s.counts[b][strand] = goldenUint32(t, row[header[string(pileup.EnumToASCIITable[b])+sign]])
+			}
+			s.indelCounts[indelIns][strand] = goldenUint32(t, row[header["INS"+sign]])
+			s.indelCounts[indelDel][strand] = goldenUint32(t, row[header["DEL"+sign]])
+		}
+	}
+	return sites
+}
+
+func parseGoldenParquet(t *testing.T, mainPath string) []goldenSite {
+	data, err := ioutil.ReadFile(mainPath + ".parquet")
+	assert.NoError(t, err)
+	r, err := parquet.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	colIndex := make(map[string]int)
+	for i, c := range r.Columns {
+		colIndex[c.Name] = i
+	}
+	read := func(name string) interface{} {
+		i, ok := colIndex[name]
+		assert.True(t, ok, name)
+		v, err := r.ReadColumn(i)
+		assert.NoError(t, err, name)
+		return v
+	}
+	chroms := read("chrom").([]string)
+	sites := make([]goldenSite, len(chroms))
+	for i, pos := range read("pos").([]int64) {
+		sites[i].chrom = chroms[i]
+		sites[i].pos = int(pos)
+	}
+	for i, ref := range read("ref").([]string) {
+		sites[i].ref = ref[0]
+	}
+	for i, depth := range read("depth").([]int32) {
+		sites[i].depth = uint32(depth)
+	}
+	for strand, suffix := range []string{"_fwd", "_rev"} {
+		for b := 0; b < pileup.NBaseEnum; b++ {
+			for i, c := range read(string(pileup.EnumToASCIITable[b]) + suffix).([]int32) {
+				sites[i].counts[b][strand] = uint32(c)
+			}
+		}
+		for indelType, prefix := range []string{"ins", "del"} {
+			for i, c := range read(prefix + suffix).([]int32) {
+				sites[i].indelCounts[indelType][strand] = uint32(c)
+			}
+		}
+	}
+	return sites
+}
+
+// parseGoldenVCF returns the sites of a VCF file, and the ALT alleles of
+// each.
+func parseGoldenVCF(t *testing.T, mainPath string) ([]goldenSite, []string) {
+	header, rows := readGoldenTSV(t, mainPath+".vcf")
+	sites := make([]goldenSite, len(rows))
+	alts := make([]string, len(rows))
+	for i, row := range rows {
+		s := &sites[i]
+		s.chrom = row[header["CHROM"]]
+		s.pos = int(goldenUint32(t, row[header["POS"]])) - 1
+		s.ref = row[header["REF"]][0]
+		assert.EQ(t, row[header["FILTER"]], ".")
+		assert.True(t, strings.HasPrefix(row[header["INFO"]], "DP="), row)
+		s.depth = goldenUint32(t, strings.TrimPrefix(row[header["INFO"]], "DP="))
+		assert.EQ(t, row[header["FORMAT"]], "DP:AD:ADF:ADR")
+		sample := strings.Split(row[len(row)-1], ":")
+		assert.EQ(t, goldenUint32(t, sample[0]), s.depth, row)
+
+		alleles := []string{row[header["REF"]]}
+		if alt := row[header["ALT"]]; alt != "." {
+			alts[i] = alt
+			alleles = append(alleles, strings.Split(alt, ",")...)
+		}
+		ad, adf, adr := strings.Split(sample[1], ","), strings.Split(sample[2], ","), strings.Split(sample[3], ",")
+		assert.EQ(t, len(ad), len(alleles), row)
+		for j, allele := range alleles {
+			fwd, rev := goldenUint32(t, adf[j]), goldenUint32(t, adr[j])
+			assert.EQ(t, goldenUint32(t, ad[j]), fwd+rev, row)
+			b := goldenBase(t, allele)
+			if b == int(pileup.BaseX) {
+				// An N reference allele is always reported with zero counts.
+				assert.True(t, j == 0 && fwd+rev == 0, row)
+				continue
+			}
+			s.counts[b] = [2]uint32{fwd, rev}
+		}
+	}
+	return sites, alts
+}
+
+func TestGoldenOutputEquivalence(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	rows := goldenRows()
+	// writeRows writes rows to the intermediate files of two jobs, split in
+	// the middle of chr1.  The writers remove their input, so each needs its
+	// own copy.
+	writeRows := func() []*os.File {
+		var tmpFiles []*os.File
+		for _, jobRows := range [][]pileupRow{rows[:2], rows[2:]} {
+			f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+			assert.NoError(t, err)
+			w := newPileupRowWriter(f, defaultShardCodec)
+			for i := range jobRows {
+				w.Append(&jobRows[i])
+			}
+			assert.NoError(t, w.Finish())
+			tmpFiles = append(tmpFiles, f)
+		}
+		return tmpFiles
+	}
+	const colBitset = colBitDpRef | colBitDpAlt | colBitHighQ | colBitIndels
+	refs := make([]*sam.Reference, len(goldenRefNames))
+	for i, name := range goldenRefNames {
+		var err error
+		refs[i], err = sam.NewReference(name, "", "", len(goldenRefSeqs[i]), nil, nil)
+		assert.NoError(t, err)
+	}
+	mainPath := filepath.Join(tmpdir, "out")
+	assert.NoError(t, convertPileupRowsToTSV(ctx, writeRows(), mainPath, colBitset, compressNone, 1, goldenRefNames, goldenRefSeqs, nil, nil, nil))
+	assert.NoError(t, convertPileupRowsToBasestrandTSV(ctx, writeRows(), mainPath, colBitset, compressNone, 1, goldenRefNames, goldenRefSeqs, nil, nil))
+	assert.NoError(t, convertPileupRowsToParquet(ctx, writeRows(), mainPath, colBitset, 0, goldenRefNames, goldenRefSeqs, nil, nil, nil))
+	assert.NoError(t, convertPileupRowsToVCF(ctx, writeRows(), mainPath, "ref.fa", "sample", 0, compressNone, 1, refs, goldenRefSeqs, nil, nil, nil, nil))
+
+	want := expectedGoldenSites(rows)
+	assert.EQ(t, parseGoldenTSV(t, mainPath), views(want, goldenSite.tsvView))
+	assert.EQ(t, parseGoldenBasestrandTSV(t, mainPath), views(want, goldenSite.basestrandView))
+	assert.EQ(t, parseGoldenParquet(t, mainPath), views(want, goldenSite.parquetView))
+	vcfSites, _ := parseGoldenVCF(t, mainPath)
+	assert.EQ(t, vcfSites, views(want, goldenSite.vcfView))
+}
+
+// TestGoldenVCFAltFilter checks that the ALT alleles of the vcf output,
+// filtered by minAltFrac, are the tsv output's alt bases with enough support.
+func TestGoldenVCFAltFilter(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	ctx := vcontext.Background()
+
+	rows := goldenRows()
+	writeRows := func() []*os.File {
+		f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+		assert.NoError(t, err)
+		w := newPileupRowWriter(f, defaultShardCodec)
+		for i := range rows {
+			w.Append(&rows[i])
+		}
+		assert.NoError(t, w.Finish())
+		return []*os.File{f}
+	}
+	refs := make([]*sam.Reference, len(goldenRefNames))
+	for i, name := range goldenRefNames {
+		var err error
+		refs[i], err = sam.NewReference(name, "", "", len(goldenRefSeqs[i]), nil, nil)
+		assert.NoError(t, err)
+	}
+	tsvPath := filepath.Join(tmpdir, "tsv")
+	assert.NoError(t, convertPileupRowsToTSV(ctx, writeRows(), tsvPath, colBitDpRef|colBitDpAlt|colBitHighQ, compressNone, 1, goldenRefNames, goldenRefSeqs, nil, nil, nil))
+	tsvSites := parseGoldenTSV(t, tsvPath)
+
+	for _, minAltFrac := range []float64{0, 0.15, 0.3, 1} {
+		vcfPath := filepath.Join(tmpdir, "vcf"+strconv.FormatFloat(minAltFrac, 'f', -1, 64))
+		assert.NoError(t, convertPileupRowsToVCF(ctx, writeRows(), vcfPath, "ref.fa", "sample", minAltFrac, compressNone, 1, refs, goldenRefSeqs, nil, nil, nil, nil))
+		_, alts := parseGoldenVCF(t, vcfPath)
+		assert.EQ(t, len(alts), len(tsvSites))
+		for i, s := range tsvSites {
+			var total uint32
+			for b := 0; b < pileup.NBase; b++ {
+				total += s.counts[b][0]
+			}
+			var want []string
+			for b := 0; b < pileup.NBase; b++ {
+				base := pileup.EnumToASCIITable[b]
+				if n := s.counts[b][0]; (base != s.ref) && (n != 0) && (float64(n) >= minAltFrac*float64(total)) {
+					want = append(want, string(base))
+				}
+			}
+			assert.EQ(t, alts[i], strings.Join(want, ","), minAltFrac, s)
+		}
+	}
+}
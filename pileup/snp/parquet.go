@@ -0,0 +1,238 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/parquet"
+	"github.com/grailbio/bio/pileup"
+)
+
+// parquetSchemaVersion is stored in the "pileup_schema_version" key of the
+// parquet output's metadata.  It must be incremented when the meaning of an
+// existing column changes; adding columns doesn't require it.
+const parquetSchemaVersion = 1
+
+// pileupParquetColumns returns the columns of the parquet output format.
+// The first columns are always present, in this order:
+//
+//   chrom           string
+//   pos             int64, 0-based
+//   ref             string, the reference base
+//   depth           int32, as in the DEPTH column of the tsv format
+//   A_fwd ... N_rev int32, Row.Counts
+//
+// followed, depending on colBitset, by the indel counts (ins_fwd, ins_rev,
+// del_fwd, del_rev), and by one list column per base and per-read feature,
+// e.g. A_qual, holding the features of the reads with that base:
+// <base>_dist5p and <base>_dist3p (enddists), <base>_qual (quals),
+// <base>_fraglen (fraglens) and <base>_strand (strands, "+" or "-").
+func pileupParquetColumns(colBitset int) []parquet.Column {
+	cols := []parquet.Column{
+		{Name: "chrom", Type: parquet.String},
+		{Name: "pos", Type: parquet.Int64},
+		{Name: "ref", Type: parquet.String},
+		{Name: "depth", Type: parquet.Int32},
+	}
+	for b := 0; b < pileup.NBaseEnum; b++ {
+		base := string(pileup.EnumToASCIITable[b])
+		cols = append(cols,
+			parquet.Column{Name: base + "_fwd", Type: parquet.Int32},
+			parquet.Column{Name: base + "_rev", Type: parquet.Int32})
+	}
+	if (colBitset & colBitIndels) != 0 {
+		for _, name := range []string{"ins_fwd", "ins_rev", "del_fwd", "del_rev"} {
+			cols = append(cols, parquet.Column{Name: name, Type: parquet.Int32})
+		}
+	}
+	for b := 0; b < pileup.NBase; b++ {
+		base := string(pileup.EnumToASCIITable[b])
+		if (colBitset & colBitEndDists) != 0 {
+			cols = append(cols,
+				parquet.Column{Name: base + "_dist5p", Type: parquet.Int32, List: true},
+				parquet.Column{Name: base + "_dist3p", Type: parquet.Int32, List: true})
+		}
+		if (colBitset & colBitQuals) != 0 {
+			cols = append(cols, parquet.Column{Name: base + "_qual", Type: parquet.Int32, List: true})
+		}
+		if (colBitset & colBitFraglens) != 0 {
+			cols = append(cols, parquet.Column{Name: base + "_fraglen", Type: parquet.Int32, List: true})
+		}
+		if (colBitset & colBitStrands) != 0 {
+			cols = append(cols, parquet.Column{Name: base + "_strand", Type: parquet.String, List: true})
+		}
+	}
+	return cols
+}
+
+// parquetRowWriter is the part of *parquet.Writer used by
+// writePileupParquetRow.
+type parquetRowWriter interface {
+	Int32(col int, v int32)
+	Int64(col int, v int64)
+	String(col int, v string)
+	EndRow() error
+}
+
+// projectedParquetWriter writes the columns of a columnProjection of
+// pileupParquetColumns rows, which are passed to it in the full layout.
+type projectedParquetWriter struct {
+	pw *parquet.Writer
+	// dst[c] is the output column of column c of the full layout, or -1 if
+	// it isn't selected.
+	dst []int
+}
+
+func newProjectedParquetWriter(pw *parquet.Writer, proj *columnProjection, nCol int) *projectedParquetWriter {
+	dst := make([]int, nCol)
+	for c := range dst {
+		dst[c] = -1
+	}
+	for i, c := range proj.src {
+		dst[c] = i
+	}
+	return &projectedParquetWriter{pw: pw, dst: dst}
+}
+
+func (w *projectedParquetWriter) Int32(col int, v int32) {
+	if c := w.dst[col]; c >= 0 {
+		w.pw.Int32(c, v)
+	}
+}
+
+func (w *projectedParquetWriter) Int64(col int, v int64) {
+	if c := w.dst[col]; c >= 0 {
+		w.pw.Int64(c, v)
+	}
+}
+
+func (w *projectedParquetWriter) String(col int, v string) {
+	if c := w.dst[col]; c >= 0 {
+		w.pw.String(c, v)
+	}
+}
+
+func (w *projectedParquetWriter) EndRow() error {
+	return w.pw.EndRow()
+}
+
+// writePileupParquetRow appends pr to pw, in the layout of
+// pileupParquetColumns(colBitset).
+func writePileupParquetRow(pw parquetRowWriter, pr *pileupRow, colBitset int, refNames []string, refSeqs [][]byte) error {
+	payload := &pr.payload
+	pw.String(0, refNames[pr.refID])
+	pw.Int64(1, int64(pr.pos))
+	pw.String(2, string(pileup.Seq8ToASCIITable[refSeqs[pr.refID][pr.pos]]))
+	pw.Int32(3, int32(payload.depth))
+	col := 4
+	for b := 0; b < pileup.NBaseEnum; b++ {
+		pw.Int32(col, int32(payload.counts[b][0]))
+		pw.Int32(col+1, int32(payload.counts[b][1]))
+		col += 2
+	}
+	if (colBitset & colBitIndels) != 0 {
+		for _, counts := range [][2]uint32{payload.indelCounts[indelIns], payload.indelCounts[indelDel]} {
+			pw.Int32(col, int32(counts[0]))
+			pw.Int32(col+1, int32(counts[1]))
+			col += 2
+		}
+	}
+	for b := 0; b < pileup.NBase; b++ {
+		features := payload.perRead[b]
+		if (colBitset & colBitEndDists) != 0 {
+			for _, f := range features {
+				pw.Int32(col, int32(f.dist5p))
+				pw.Int32(col+1, int32(f.fraglen)-1-int32(f.dist5p))
+			}
+			col += 2
+		}
+		if (colBitset & colBitQuals) != 0 {
+			for _, f := range features {
+				pw.Int32(col, int32(f.qual))
+			}
+			col++
+		}
+		if (colBitset & colBitFraglens) != 0 {
+			for _, f := range features {
+				pw.Int32(col, int32(f.fraglen))
+			}
+			col++
+		}
+		if (colBitset & colBitStrands) != 0 {
+			for _, f := range features {
+				pw.String(col, string(pileup.StrandTypeToASCIITable[f.strand]))
+			}
+			col++
+		}
+	}
+	return pw.EndRow()
+}
+
+// convertPileupRowsToParquet writes the pileupRows in tmpFiles to
+// <mainPath>.parquet, with rowGroupSize rows per row group (0 selects
+// parquet.DefaultRowGroupSize), and removes tmpFiles.  If cols is non-nil,
+// its only entry is the column projection of the file (Opts.Columns).  The
+// positions that rf doesn't keep are left out.
+func convertPileupRowsToParquet(ctx context.Context, tmpFiles []*os.File, mainPath string, colBitset, rowGroupSize int, refNames []string, refSeqs [][]byte, provenance map[string]string, cols []*columnProjection, rf *rowFilter) (err error) {
+	metadata := map[string]string{
+		"pileup_schema_version": strconv.Itoa(parquetSchemaVersion),
+		"coordinates":           "0-based",
+	}
+	for k, v := range provenance {
+		metadata[k] = v
+	}
+	path := mainPath + ".parquet"
+	fullCols := pileupParquetColumns(colBitset)
+	outCols := fullCols
+	if cols != nil {
+		outCols = make([]parquet.Column, len(cols[0].src))
+		for i, c := range cols[0].src {
+			outCols[i] = fullCols[c]
+			outCols[i].Name = cols[0].names[i]
+		}
+	}
+	dst, pw, err := createParquet(ctx, path, outCols, metadata, rowGroupSize)
+	if err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	var rw parquetRowWriter = pw
+	if cols != nil {
+		rw = newProjectedParquetWriter(pw, cols[0], len(fullCols))
+	}
+	var nRow int64
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		if !rf.keep(pr) {
+			return nil
+		}
+		if err = writePileupParquetRow(rw, pr, colBitset, refNames, refSeqs); err != nil {
+			return err
+		}
+		nRow++
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if err = pw.Close(); err != nil {
+		return
+	}
+	log.Printf("convertPileupRowsToParquet: done, %d rows written to %s", nRow, path)
+	return
+}
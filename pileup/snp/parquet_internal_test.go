@@ -0,0 +1,95 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/parquet"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestPileupParquetColumns(t *testing.T) {
+	base := len(pileupParquetColumns(0))
+	assert.EQ(t, base, 4+2*pileup.NBaseEnum)
+	assert.EQ(t, len(pileupParquetColumns(colBitIndels)), base+4)
+	assert.EQ(t, len(pileupParquetColumns(colBitEndDists|colBitStrands)), base+3*pileup.NBase)
+	cols := pileupParquetColumns(colBitQuals)
+	assert.EQ(t, cols[base].Name, "A_qual")
+	assert.True(t, cols[base].List)
+}
+
+func TestWritePileupParquetRow(t *testing.T) {
+	colBitset := colBitQuals | colBitIndels
+	cols := pileupParquetColumns(colBitset)
+	var buf bytes.Buffer
+	pw, err := parquet.NewWriter(&buf, cols, parquet.WriterOpts{})
+	assert.NoError(t, err)
+
+	// chr1 is ACGT.
+	refNames := []string{"chr1"}
+	refSeqs := [][]byte{{1, 2, 4, 8}}
+	rows := []pileupRow{{refID: 0, pos: 1}, {refID: 0, pos: 3}}
+	rows[0].payload.depth = 3
+	rows[0].payload.counts[pileup.BaseC] = [2]uint32{1, 1}
+	rows[0].payload.counts[pileup.BaseT] = [2]uint32{0, 1}
+	rows[0].payload.indelCounts[indelDel] = [2]uint32{2, 0}
+	rows[0].payload.perRead[pileup.BaseC] = []perReadFeatures{{qual: 30}, {qual: 35}}
+	rows[0].payload.perRead[pileup.BaseT] = []perReadFeatures{{qual: 12}}
+	rows[1].payload.depth = 1
+	rows[1].payload.counts[pileup.BaseT] = [2]uint32{1, 0}
+	rows[1].payload.perRead[pileup.BaseT] = []perReadFeatures{{qual: 40}}
+	for i := range rows {
+		assert.NoError(t, writePileupParquetRow(pw, &rows[i], colBitset, refNames, refSeqs))
+	}
+	assert.NoError(t, pw.Close())
+
+	r, err := parquet.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	assert.EQ(t, r.NumRows, int64(2))
+	assert.EQ(t, len(r.Columns), len(cols))
+	colIndex := make(map[string]int)
+	for i, c := range r.Columns {
+		colIndex[c.Name] = i
+	}
+	read := func(name string) interface{} {
+		i, ok := colIndex[name]
+		assert.True(t, ok, name)
+		v, err := r.ReadColumn(i)
+		assert.NoError(t, err, name)
+		return v
+	}
+	assert.EQ(t, read("chrom"), []string{"chr1", "chr1"})
+	assert.EQ(t, read("pos"), []int64{1, 3})
+	assert.EQ(t, read("ref"), []string{"C", "T"})
+	assert.EQ(t, read("depth"), []int32{3, 1})
+	assert.EQ(t, read("C_rev"), []int32{1, 0})
+	assert.EQ(t, read("T_fwd"), []int32{0, 1})
+	assert.EQ(t, read("del_fwd"), []int32{2, 0})
+	// Empty lists may come back as nil or as empty slices.
+	quals := func(name string) [][]int32 {
+		v := read(name).([][]int32)
+		for i := range v {
+			if len(v[i]) == 0 {
+				v[i] = nil
+			}
+		}
+		return v
+	}
+	assert.EQ(t, quals("A_qual"), [][]int32{nil, nil})
+	assert.EQ(t, quals("C_qual"), [][]int32{{30, 35}, nil})
+	assert.EQ(t, quals("T_qual"), [][]int32{{12}, {40}})
+}
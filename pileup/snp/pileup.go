@@ -17,18 +17,26 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/recordio"
 	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/bio/biopb"
 	"github.com/grailbio/bio/circular"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/interval"
 	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/bio/util/iothrottle"
+	"github.com/grailbio/bio/util/progress"
 	"github.com/grailbio/hts/sam"
 )
 
@@ -50,6 +58,481 @@ type Opts struct {
 	RemoveSq     bool
 	Stitch       bool
 	TempDir      string
+
+	// SkipDiskCheck disables the free-space preflight check.
+	SkipDiskCheck bool
+	// ShardRetries is the number of times a failed parallel job is rerun
+	// before giving up on it.
+	ShardRetries int
+	// Quarantine causes the regions of jobs that fail every retry to be
+	// listed in <out>.quarantine.tsv and left out of the output, instead of
+	// failing the run.
+	Quarantine bool
+	// TimeBudget, if positive, is the wall-clock time after which no further
+	// shards are started.  Output is still written for the completed shards,
+	// and <out>.partial.tsv and <out>.unprocessed.bed describe what is
+	// missing, so that a follow-up run can fill it in.
+	TimeBudget time.Duration
+	// MinAltFrac is the minimum fraction of high-quality bases at a position
+	// that an allele must have to be reported as ALT in vcf output.
+	MinAltFrac float64
+	// MinDepth, MinAltCount and Positions, when set, cause the per-position
+	// output formats to only have the positions with a depth of at least
+	// MinDepth, an allele other than the reference base with at least
+	// MinAltCount high-quality bases, and which are in Positions, the path of a BED file or, with a .vcf suffix,
+	// of a VCF file whose record positions are kept.  The positions are
+	// filtered while the output is written, so that the other reports (e.g.
+	// DepthHistogram and Hotspots) are unaffected.  They can't be combined
+	// with WindowSize.
+	MinDepth    int
+	MinAltCount int
+	Positions   string
+	// WindowSize, if positive, causes the tsv and basestrand-tsv formats to
+	// write one line of summary statistics per WindowSize-position window
+	// instead of one line per position.  Windows start every WindowStep
+	// positions (default WindowSize, i.e. non-overlapping).
+	WindowSize int
+	WindowStep int
+	// WindowStats is a comma-separated list of the statistics to report for
+	// each window (see WindowStatNames); "" reports all of them.
+	WindowStats string
+	// AuditBoundaries is a debugging mode which recomputes the positions near
+	// each shard boundary without the boundary, and writes the positions
+	// where the results differ to <out>.boundary_audit.tsv.  The run fails if
+	// there are any.
+	AuditBoundaries bool
+	// UnmappedReads, MateUnmappedReads, and ZeroMapqReads are the policies
+	// ("keep", "drop", or "error") for reads in those buckets; "" selects the
+	// defaults of drop, keep, and keep respectively.  Unmapped reads have no
+	// alignment to pile up, so UnmappedReads can't be "keep".  Kept reads are
+	// still subject to the other filters, e.g. Mapq.  The number of reads in each
+	// bucket is written to <out>.read_census.tsv, and the aligned-length and
+	// soft-clip-length distributions of the mapped reads of each reference
+	// to <out>.read_lengths.tsv.
+	UnmappedReads     string
+	MateUnmappedReads string
+	ZeroMapqReads     string
+
+	// DownsampleFrac, if in (0, 1), keeps only that fraction of the
+	// fragments, sampled separately within each DownsampleBinWidth-wide
+	// fragment-length bin (0 selects 10) so that the fragment-length
+	// distribution is preserved.  Fragment lengths come from TLEN; unpaired
+	// reads form their own stratum.
+	DownsampleFrac     float64
+	DownsampleBinWidth int
+
+	// ShardCodec is the compression codec for the intermediate per-shard
+	// files: "zstd" or "zstd:<level>" (level 1-22), "lz4", "snappy", or
+	// "none"; "" selects zstd level 1.  ShardBlockItems is the maximum number
+	// of positions per compressed block, at most recordio.MaxPackedItems (0
+	// selects the recordio default).
+	// Skipping compression saves CPU time with fast local disks, while
+	// heavier compression helps on network filesystems.
+	ShardCodec      string
+	ShardBlockItems int
+
+	// ShardSchedule determines how the genome is split between the parallel
+	// jobs.  "balanced" (or "") gives each job an equal part of the genome,
+	// regardless of contig boundaries.  "contig" moves the boundaries between
+	// jobs to contig boundaries where that changes the jobs' sizes by at most
+	// a quarter, so that most contigs are processed by a single job, which
+	// improves reference and index locality; the job sizes are based on
+	// reference lengths rather than file offsets.  "targets" only covers the
+	// BedPath intervals (after Pad), clustering nearby ones into one shard,
+	// and gives each job an equal number of targeted positions; references
+	// without targets are skipped entirely.  "" selects "targets" when
+	// BedPath is set, and "balanced" otherwise.  The locality of the schedule
+	// is logged.
+	ShardSchedule string
+
+	// Pad extends each BedPath interval by this many positions on both sides
+	// (clipped to the reference), e.g. to cover the flanks of the targets of
+	// a capture panel.  Overlapping padded intervals are merged, and rows are
+	// emitted for every position of the padded intervals.
+	Pad int
+
+	// BedOverrides reads per-interval filter thresholds from the columns of
+	// BedPath after the third: min_bq=<n>, min_mapq=<n> and max_depth=<n>
+	// tokens override MinBaseQual, Mapq and MaxDepth (0: unlimited) within
+	// the interval, so that e.g. the hotspot sites and the backbone of a
+	// panel can be counted with different stringency in one run.  Columns
+	// without '=' (e.g. names) are ignored.  Where intervals overlap, the
+	// shortest one applies.  The overrides cover the intervals as written,
+	// not their Pad flanks, and only apply to the pileup counts and to
+	// MaxDepth sampling; the other outputs use the run-wide thresholds.
+	BedOverrides bool
+
+	// ShardPlanOut, if nonempty, is the path where the run's shards are
+	// written as JSON after the run, with the time spent on each.
+	// ShardPlan, if nonempty, is the path of such a file from an earlier run
+	// on the same references (typically the same sample or panel): its shards
+	// are reused as is, skipping ShardSchedule planning, and they are split
+	// between the jobs so that the jobs' historical times are balanced.  Both
+	// may be the same path, to refine the timings from run to run.
+	ShardPlanOut string
+	ShardPlan    string
+
+	// FragmentomicsWindow, if positive, also computes cfDNA fragmentomics
+	// features during the pileup pass: per window of this many positions, the
+	// fragment count and mean length, the short (100-150) / long (151-220)
+	// fragment ratio, the read 5' end counts, and the counts of each 4-mer
+	// end motif, written to <out>.fragmentomics.parquet; and the read 5' end
+	// counts of each position, written to <out>.fragment_ends.parquet.
+	FragmentomicsWindow int
+	// WPSWindow, if positive, also computes the windowed protection score
+	// (WPS, Snyder et al. 2016) of each position from the 120-180 bp
+	// fragments, with a protection window of this many positions (120 in the
+	// paper), and writes it to <out>.wps.bw.  It requires
+	// FragmentomicsWindow.
+	WPSWindow int
+
+	// EndMotifWeights, if nonempty, is the path of a table of end-motif
+	// weights: "<4-mer>\t<weight>" lines, with weights in [0, 1] (unlisted
+	// motifs get weight 1).  Each fragment is kept with probability equal to
+	// the product of the weights of the reference motifs at its two ends,
+	// before anything is counted, to correct for the end-motif biases of the
+	// library preparation.  A motif with weight 0 filters out its fragments.
+	// The weights are recorded in the provenance metadata of the output.
+	EndMotifWeights string
+
+	// ReadFilter, if nonempty, is a boolean expression which each read must
+	// satisfy to be counted, e.g. "qual>=20 && mapq>=30 && !dup &&
+	// fraglen<600".  It combines comparisons of the fields mapq, qual (mean
+	// base quality), fraglen (|TLEN|), len and span with integers, and the
+	// flags paired, proper, unmapped, mateunmapped, reverse, matereverse,
+	// read1, read2, secondary, qcfail, dup and supplementary, with "&&", "||",
+	// "!" and parentheses.  It is applied after FlagExclude and Mapq.
+	ReadFilter string
+
+	// Dedup, if nonempty, detects duplicate fragments on the fly, for BAMs
+	// whose duplicates weren't flagged by a separate duplicate-marking run.
+	// Fragments are grouped by the unclipped 5' position and strand of their
+	// leftmost read and the position and strand of its mate (or, for unpaired
+	// reads, by their own 5' position and strand), plus the DedupUMITag UMI if
+	// set.  "collapse" keeps only the first fragment of each duplicate set,
+	// and "downweight" keeps about 1 + ln(n) of a set of n fragments.  Reads
+	// already flagged as duplicates are still removed by FlagExclude.
+	Dedup string
+	// DedupUMITag, if nonempty, is the aux tag (e.g. "RX") of the UMI, which
+	// becomes part of the Dedup grouping key.
+	DedupUMITag string
+
+	// UMIConsensusTag, if nonempty, is the aux tag (e.g. "RX" or "BX") of the
+	// UMI of each read, and enables UMI consensus counting: the reads of each
+	// UMI family (same UMI, read number and strand, and aligned fragment
+	// coordinates) are collapsed into one consensus read before anything is
+	// counted, which suppresses most PCR and sequencing errors.  At each
+	// position, the consensus base is the one with the highest quality sum,
+	// with the quality sum of the other bases subtracted from its quality.
+	// Reads without the tag are dropped.  FlagExclude and Mapq apply to the
+	// raw reads; the other read filters apply to the consensus reads.
+	UMIConsensusTag string
+	// UMIMinFamilySize is the minimum number of reads of a UMI family for its
+	// consensus to be counted (default 1).
+	UMIMinFamilySize int
+
+	// ActiveRegions enables local reassembly of active regions: runs of
+	// positions where at least ActiveRegionMinFrac (default 0.1, and at least
+	// two) of the reads have a high-quality mismatch, an indel, or a long soft
+	// clip.  The reads around each region are assembled into candidate
+	// haplotypes, and the reads which span the region are realigned to their
+	// best-matching haplotype before they are counted, so that e.g. the reads
+	// supporting an indel in a repeat agree on where it is.  It is applied
+	// after UMI consensus calling, if enabled.
+	ActiveRegions       bool
+	ActiveRegionMinFrac float64
+
+	// MaxDepth, if positive, caps the number of reads covering a position:
+	// the reads starting at each position are reservoir-sampled into the
+	// slots left by the kept reads starting earlier.  With MaxDepthMode
+	// "fragment", the second read of a pair gets the first one's decision,
+	// so the cap may be exceeded by mates; "position" or "" samples the reads
+	// independently.  Reads which fail FlagExclude or Mapq don't count.  It
+	// is applied after UMI consensus calling and active-region reassembly,
+	// if enabled.
+	MaxDepth     int
+	MaxDepthMode string
+	// SketchDepth, if positive, bounds the memory used by the per-read
+	// features at extreme-depth sites (e.g. amplicon hotspots): once more
+	// than SketchDepth reads with the same base cover a position, their
+	// features are reservoir-sampled down to SketchDepth, and the number of
+	// reads and the sums of their base qualities, 5' distances and fragment
+	// lengths are kept, for the sketch column set.  Unlike MaxDepth, it
+	// doesn't change the counts.  It requires a per-read column set.
+	SketchDepth int
+	// MemoryBudgetMiB, if positive, bounds the memory (in MiB) held by the
+	// completed rows that the main loop's jobs haven't written to their
+	// intermediate files yet, most of which is their per-read features at
+	// high depth.  Rows are normally written in blocks of ShardBlockItems
+	// positions; over the budget, the jobs write their pending rows early,
+	// and release the per-read buffers of the written positions instead of
+	// keeping them for reuse.  The output is unchanged.  With an Executor,
+	// it applies to each task separately.
+	MemoryBudgetMiB int
+	// Circular is a comma-separated list of circular contigs, e.g. "chrM" or
+	// the contigs of a viral genome.  The reads aligned past the end of one
+	// of them are cut at its end, and their bases past the end are counted
+	// from position 0 of the contig, so all positions stay within the contig
+	// and the reads spanning the origin contribute to both ends.  The part
+	// past the origin isn't stitched with the read's mate.
+	Circular string
+	// Seed seeds the random sampling of MaxDepth, SketchDepth, DownsampleFrac
+	// and EndMotifWeights.  Each shard gets its own random source for each of
+	// them, seeded with a seed derived from Seed and the shard's start, so
+	// the reads kept in a shard only depend on the inputs, the options, the
+	// seed and the shard, and not on the job, worker or parallelism that
+	// processes it; distributed and local runs with the same shards keep the
+	// same reads.  The exceptions are the reads within MaxReadSpan of a
+	// boundary between shards processed by different jobs, which both jobs
+	// see, and the pairs straddling such a boundary.
+	Seed int64
+	// NewRandSource, if non-nil, returns the random source of a seed, in
+	// place of math/rand's rand.NewSource, e.g. to use a generator with
+	// stronger statistical guarantees.  It must be deterministic for the
+	// output to be reproducible.  It is not part of the run's identity for
+	// Resume.
+	NewRandSource func(seed int64) rand.Source `json:"-"`
+
+	// Resume keeps the intermediate per-task files of the main loop, and a
+	// manifest of the completed tasks with their checksums, in a checkpoint
+	// directory under TempDir.  If a run with the same inputs and options is
+	// interrupted, rerunning it with Resume only recomputes the tasks that
+	// didn't complete.  TempDir must survive the interruption.  The
+	// checkpoint is deleted when the run succeeds.
+	Resume bool
+
+	// MaxReadMiBPerSec and MaxReadOpsPerSec, if positive, limit the combined
+	// bandwidth (in MiB/s) and rate of read operations of the run's input
+	// readers, so that a large run on shared storage (NFS, S3) doesn't starve
+	// other users.  With an Executor, they apply to each task separately.
+	// The main loop logs its progress, with the current input throughput,
+	// every minute.  SIGQUIT makes it write a debug dump of the running jobs
+	// (their shards, last read positions and read counts) and the goroutine
+	// stacks to a file in TempDir, without stopping the run.
+	MaxReadMiBPerSec float64
+	MaxReadOpsPerSec int
+
+	// Progress, if non-empty, receives progress events of the main loop
+	// (pipeline "pileup"): one per finished shard with its read and position
+	// throughput, a run-wide one with the ETA and memory high-water mark
+	// every minute, and a final one.  See progress.NewSinks.  They are not
+	// part of the run's identity for Resume.
+	Progress []progress.Sink `json:"-"`
+
+	// ParquetRowGroupSize is the number of positions per row group of the
+	// parquet output format.  Larger row groups compress better and are read
+	// more efficiently, at the cost of memory.  0 selects
+	// parquet.DefaultRowGroupSize.
+	ParquetRowGroupSize int
+
+	// OutputIndex, if nonempty, is "tbi" or "csi", and causes an index of
+	// that type to be written next to each bgzf-compressed text output file
+	// (<file>.tbi or <file>.csi) as the file is written, so that the results
+	// can be queried by region with tabix or Query.  It requires a -bgz
+	// format.  .tbi indexes only support contigs of up to 512 Mbp.
+	OutputIndex string
+
+	// DepthHistogram also writes the depth histogram and cumulative coverage
+	// curve of the positions in the BED union, overall and per BED interval
+	// (overlapping intervals are merged), to <out>.depth_hist.tsv and
+	// <out>.depth_hist.json.  Depth counts all reads covering a position, as
+	// in the DEPTH column of the tsv format.
+	DepthHistogram bool
+
+	// Metrics, if nonempty, is "json", "tsv" or "json,tsv", and causes a QC
+	// report to be written to <out>.metrics.json and/or <out>.metrics.tsv:
+	// the coverage histogram of the positions in the BED union, the depth
+	// percentiles of each BED interval, the fraction of the aligned bases in
+	// the BED union with quality at least 30, the forward-strand fraction of
+	// the reads, and the number of reads left out of the pileup by each
+	// filter.  The metrics are collected by the main loop, without a second
+	// pass over the pileup.  Reads dropped inside UMIConsensus,
+	// ActiveRegions and MaxDepth are not in the filter counts.
+	Metrics string
+
+	// HaplotypeSites, if nonempty, is the path of a BED file of short loci
+	// (2 to 8 positions, e.g. CpG dinucleotides for deamination QC) where the
+	// "allele" of each read is the haplotype of bases it has across the whole
+	// locus.  The haplotype counts of each locus, overall and per strand, are
+	// written to <out>.haplotypes.tsv.  A read only counts at a locus if it
+	// aligns all of its positions, without an indel inside it, with base
+	// qualities of at least MinBaseQual.  The reads of an overlapping pair are
+	// counted separately, even with Stitch.  Loci outside the BED region may
+	// be missed.
+	HaplotypeSites string
+
+	// HetSites, if nonempty, is the path of a BED file of the sample's
+	// heterozygous sites.  With Stitch (or ClipOverlap), the two reads of an
+	// overlapping pair are compared at each het site in their overlap where
+	// both have a non-N base of quality at least MinBaseQual; since they
+	// sequence the same molecule, a disagreement is a sequencing error (or a
+	// chimeric pair).
+	// The number of pairs compared, of discordant pairs, and of agreeing and
+	// disagreeing comparisons are written to <out>.mate_concordance.tsv.  A
+	// pair whose overlap straddles a job boundary is judged separately by
+	// each job.
+	HetSites string
+	// ExcludeDiscordantPairs leaves the pairs which disagree at any het site
+	// out of the pileup.  It requires HetSites.
+	ExcludeDiscordantPairs bool
+
+	// RequireProperPair leaves the reads without the proper-pair flag out of
+	// the pileup.
+	RequireProperPair bool
+	// MaxInsertSize, if positive, leaves the paired reads whose |TLEN|
+	// exceeds it, or whose mate is mapped to another reference, out of the
+	// pileup.  Reads without a mapped mate are kept.
+	MaxInsertSize int
+	// ClipOverlap detects the overlap of the two reads of a pair, and counts
+	// only the higher-quality base (that of the leftmost read on a tie) at
+	// each position covered by both, so that a fragment is counted once.
+	// Unlike Stitch, the counted base keeps its own quality, and the mates may
+	// disagree without the position becoming an N.  It cannot be combined
+	// with Stitch.
+	ClipOverlap bool
+
+	// LongRead enables the long-read (PacBio/ONT) mode.  The reads are
+	// unpaired: the strand of a read is the one it is aligned to, and the
+	// pair-based options (Stitch, ClipOverlap, RequireProperPair and
+	// MaxInsertSize) can't be used.  MaxReadLen and MaxReadSpan usually need
+	// to be raised to fit the longest reads.
+	LongRead bool
+	// MinReadIdentity, if positive, leaves the reads whose alignment identity
+	// (1 - NM / number of aligned, inserted and deleted bases) is lower out
+	// of the pileup.  HomopolymerIndels moves each insertion or deletion
+	// which lengthens or shortens a reference homopolymer to the position
+	// before the homopolymer, so that the homopolymer-length errors typical
+	// of long reads are grouped into one indel allele wherever the aligner
+	// placed them in the run.  Both require LongRead.
+	MinReadIdentity   float64
+	HomopolymerIndels bool
+
+	// BAQ caps the quality of each aligned base by its base alignment
+	// quality, as samtools does: the read is realigned to the reference
+	// around its alignment with a profile HMM, and a base which may be
+	// aligned elsewhere (typically next to an indel the aligner missed) gets
+	// a low quality, so that its mismatches aren't counted as SNVs.  A read
+	// with a BQ tag (e.g. from "samtools calmd -r") is capped by the tag's
+	// values instead of being realigned.  The capped qualities are used for
+	// counting the bases and for all the per-base outputs, but not by the
+	// read filters.  It cannot be combined with LongRead.
+	BAQ bool
+
+	// RecomputeNM causes the read edit distances (the NM of the readfeats
+	// column set, and the identity of LongRead) to always be computed from
+	// the alignment and the reference, instead of being taken from the NM
+	// tags of the reads that have them.  It is for aligners whose NM tags
+	// are missing, or computed against a different reference.  The distance
+	// is computed at most once per read.  (The REF/ALT classification never
+	// uses the NM or MD tags.)  It requires the readfeats column set or
+	// LongRead.
+	RecomputeNM bool
+
+	// Annotate, if nonempty, is gtf=<path> or gff3=<path>, the (possibly
+	// gzipped) gene annotation file used to annotate the output: each row of
+	// the tsv output gets GENES, EXONS and CDS columns, with the names of the
+	// genes whose gene, exon and CDS features overlap the position ('.' for
+	// none), and each vcf record gets the corresponding GENE, EXON and CDS
+	// INFO fields.  Other formats are not supported.
+	Annotate string
+
+	// KmerUniqueness, if positive, is a k-mer length (at most 32) for the
+	// k-mer uniqueness annotation of the vcf output: each record with an ALT
+	// allele gets REF_KMER_COPIES, the smallest number of occurrences in the
+	// reference of the k-mers overlapping the position, and ALT_KMER_HITS,
+	// the number of those k-mers which occur elsewhere in the reference once
+	// the ALT base replaces the reference base.  An ALT allele which creates
+	// reference k-mers is a typical artifact of reads mismapped from the
+	// other locus.  The k-mers of all the candidate sites are counted in a
+	// single pass over the reference after the main loop; their memory
+	// usage is proportional to the number of candidate ALT alleles, so
+	// MinAltFrac should usually be set with large BED regions.
+	KmerUniqueness int
+	// GQBands is an increasing comma-separated list of GQ values (1..99) at
+	// which the reference-block bands of gvcf output start: adjacent
+	// positions are merged into one block when their GQs fall in the same
+	// band.  The default is "10,20,30,40,50,60".
+	GQBands string
+
+	// Hotspots, if nonempty, is the path (local or S3) of a hotspot list, e.g.
+	// the cancer hotspots of a panel: a tsv file with CHROM, POS (1-based),
+	// REF, ALT and optional NAME columns, or a .vcf file.  Only single-base
+	// substitutions are supported.  The hotspot positions are used as the
+	// BED region (so BedPath and Region must be empty), and
+	// <out>.hotspots.tsv reports the depth, REF and ALT counts, allele
+	// fraction and status of every hotspot, whether or not its ALT allele is
+	// seen; it is detected if its fraction is at least MinAltFrac, as in the
+	// vcf output.  With Annotate, the report also has the gene annotation
+	// columns.  No hotspot list is bundled: the curated lists (e.g. COSMIC or
+	// cancerhotspots.org) are versioned, reference-specific, and not all
+	// redistributable, so the list must be supplied.
+	Hotspots string
+
+	// Methylation, if nonempty, is a comma-separated list of the cytosine
+	// contexts ("CG", "CHG" and "CHH", or "all") of a bisulfite or EM-seq
+	// methylation report.  The contexts are derived from the reference, and
+	// each cytosine is called from the reads of its strand, as in a
+	// directional library: on the forward strand, a C is unconverted
+	// (methylated) and a T is converted (unmethylated); on the reverse
+	// strand, these are a G and an A.  The calls of every cytosine in the
+	// pileup positions are written to <out>.CX_report.txt, in the Bismark
+	// coverage2cytosine format, and the methylation percentage of each
+	// covered cytosine to <out>.methylation.bedGraph.  Since the strand of
+	// each read must be known, the reads with an undefined strand are left
+	// out of the pileup in all output formats.
+	Methylation string
+
+	// ModBase, if nonempty, is a comma-separated list of the base
+	// modifications ("5mC", "5hmC" and "6mA") to report from the MM and ML
+	// tags of the reads (e.g. from ONT or PacBio basecallers), each
+	// optionally followed by "=<threshold>", the minimum probability of a
+	// call (default 0.66).  Each base is called as the most likely of its
+	// canonical form and its modifications, and counted as filtered when that
+	// call's probability is below the threshold, or is another modification.
+	// The calls at the reference bases of each modification, on each strand,
+	// are written to <out>.<modification>.bed (e.g. <out>.5mC.bed), in the
+	// bedMethyl format of modbam2bed.  Each read of a pair is counted
+	// separately.  With the extbases column set, the bases called as any of
+	// the modifications are also counted as MOD+/-.
+	ModBase string
+
+	// Somatic, with two inputs (see PileupSamples), treats the first as the
+	// tumor and the second as the normal, and appends MuTect-style somatic
+	// scores to each row of the multi-sample table: the tumor's most
+	// frequent non-reference base (ALT), its fraction of the REF and ALT
+	// bases in the tumor and normal (TUMOR_AF and NORMAL_AF), the log10
+	// likelihood ratios TLOD (tumor bases under the observed ALT fraction vs.
+	// no ALT allele) and NLOD (normal bases under no ALT allele vs. a
+	// heterozygous germline variant), and STATUS: PASS if TLOD >= 6.3 and
+	// NLOD >= 2.2, low_tlod or low_nlod otherwise.  The scores assume a
+	// fixed 0.1% error rate for the counted bases.
+	Somatic bool
+
+	// Columns, if nonempty, selects, orders and renames the columns of the
+	// tsv, basestrand-tsv and parquet outputs: it is a comma-separated list
+	// of <column>[=<new name>] entries, where <column> is a column of the
+	// output for the selected column sets (the '#' of #CHROM is optional).
+	// Columns are written in the order given, under their original names
+	// unless renamed.  With the tsv formats, a column in only one of the
+	// main and .alt.tsv files (e.g. ALT) is only written to that file.  With
+	// OutputIndex, the first two columns must be CHROM and POS.  It cannot
+	// be combined with WindowSize.
+	Columns string
+
+	// Hooks, if non-nil, are called at the main events of the run; see
+	// Hooks.  They are not part of the run's identity for Resume.
+	Hooks *Hooks `json:"-"`
+
+	// Executor, if non-nil, runs the tasks of the main loop, e.g. on a
+	// cluster; see Executor.  Each task writes its intermediate pileup rows
+	// under ExecutorDir (typically an S3 prefix), and the calling process
+	// copies them back and writes the final output as usual.  Options whose
+	// side outputs are collected in memory during the main loop
+	// (FragmentomicsWindow, HaplotypeSites, HetSites and Metrics), or which
+	// control its local scheduling (Resume, ShardRetries, Quarantine,
+	// TimeBudget and ShardPlanOut), can't be combined with it.
+	Executor    Executor `json:"-"`
+	ExecutorDir string
 }
 
 var DefaultOpts = Opts{
@@ -130,6 +613,36 @@ var DefaultOpts = Opts{
 //              Slated for renaming.
 //   LowQ     = Currently an all-zero column existing for backward
 //              compatibility.  Will be removed.
+//   Indels   = Insertion and deletion counts, anchored at the preceding
+//              reference position as in VCF.  These are additional .alt.tsv
+//              lines (with multi-base REF or ALT) in the tsv formats, and
+//              INS+/INS-/DEL+/DEL- columns in the basestrand-tsv formats.
+//   ReadFeats = Comma-separated mapping qualities, read-group indexes (1-based,
+//               0 = none), edit distances, sequencing cycles, and distances
+//               from the nearest soft clip ('.' = unclipped read), for
+//               training base-quality recalibration models.  tsv formats only.
+//   BiasStats = FS (Fisher strand bias), READ_POS_RANK_SUM, and BASE_Q_RANK_SUM
+//               columns in .alt.tsv, computed from the per-read features as
+//               in the GATK annotations of the same names.  tsv formats only.
+//   QualWeights = Base-quality-weighted counts, i.e. sums of 1 - 10^(-q/10)
+//                 over the bases (including those below min-bq), for error
+//                 models that prefer them to hard-thresholded counts.  tsv and
+//                 basestrand-tsv formats only.
+//   ExtBases = Per-strand counts of reads spanning the position with a
+//              deletion ('*'), of reads whose base at the position is followed
+//              by an insertion ('+'), and of modified bases ('m'; only
+//              detected with ModBase, and zero otherwise).  DEL_BASE+/-,
+//              INS_NEXT+/- and MOD+/- columns in the basestrand-tsv formats,
+//              and the pileup.BaseDel..BaseMod entries of Row.Counts.
+//   Sketch   = Number of reads, and mean and quartiles ("q1,median,q3") of the
+//              base qualities, 5' distances and fragment lengths of the reads
+//              supporting the allele.  With SketchDepth, the means and number
+//              are over all the reads, and the quartiles are estimated from
+//              the sampled ones.  tsv formats only.
+//   HapCounts = Counts split by the haplotype (HP tag) of the reads, for
+//               allele-specific expression: hap1, hap2 and unassigned depths,
+//               preceded by the phase set (PS tag) of the phased reads.  See
+//               readHapTags.  tsv and basestrand-tsv formats only.
 const (
 	colBitDpRef = 1 << iota
 	colBitDpAlt
@@ -140,9 +653,16 @@ const (
 
 	colBitHighQ
 	colBitLowQ
+	colBitIndels
+	colBitReadFeatures
+	colBitBiasStats
+	colBitQualWeights
+	colBitExtBases
+	colBitSketch
+	colBitHapCounts
 )
 
-const colPerReadMask = (colBitEndDists | colBitQuals | colBitFraglens | colBitStrands)
+const colPerReadMask = (colBitEndDists | colBitQuals | colBitFraglens | colBitStrands | colBitReadFeatures | colBitBiasStats | colBitSketch)
 
 var colNameMap = map[string]int{
 	"dpref":    colBitDpRef,
@@ -153,6 +673,25 @@ var colNameMap = map[string]int{
 	"strands":  colBitStrands,
 	"highq":    colBitHighQ,
 	"lowq":     colBitLowQ,
+	"indels":   colBitIndels,
+
+	"readfeats":   colBitReadFeatures,
+	"biasstats":   colBitBiasStats,
+	"qualweights": colBitQualWeights,
+	"extbases":    colBitExtBases,
+	"sketch":      colBitSketch,
+	"hapcounts":   colBitHapCounts,
+}
+
+// ColNames returns the column-set names accepted by Opts.Cols, in sorted
+// order.
+func ColNames() []string {
+	names := make([]string, 0, len(colNameMap))
+	for name := range colNameMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // Immutable (within each ref) background info needed for both the inner
@@ -181,14 +720,51 @@ type pileupMutable struct {
 	alignedBaseBufs  [2][]alignedPos // preallocated buffers for alignRelevantBases
 	firstReads       firstreadSNPTable
 	endMax           PosType // 1 + <last position that has a pileup entry>
+	indelSeqBuf      []byte  // preallocated buffer for addIndels
 	w                recordio.Writer
 	writePosScanner  interval.UnionScanner
+
+	// perReadExtended is true iff the per-read features include the extended
+	// feature set.
+	perReadExtended bool
+	// qualWeighted is true iff pileupPayload.qualWeights is accumulated.
+	qualWeighted bool
+	// extBases is true iff the counts of the extended observation classes
+	// (pileup.BaseDel..BaseMod) are accumulated.
+	extBases bool
+	// hapCounted is true iff pileupPayload.hapCounts is accumulated.  readHap
+	// and readPhaseSet are then the haplotype and phase set of the read or
+	// read-pair being added.
+	hapCounted   bool
+	readHap      byte
+	readPhaseSet uint32
+	// concordance counts the mate comparisons at het sites, when
+	// pileupContext.hetSites is set.
+	concordance mateConcordanceCounts
+	// metrics collects the QC metrics of Opts.Metrics, or is nil.
+	metrics *pileupMetrics
+	// sketchDepth is Opts.SketchDepth.  When it is positive, sketches holds
+	// the depthSketches of the ring-buffer rows whose per-read features are
+	// being sampled, keyed by circular position, and sketchRand is the
+	// current shard's random source.
+	sketchDepth int
+	sketches    map[PosType]*[pileup.NBase]depthSketch
+	sketchRand  *rand.Rand
+	// modBase is Opts.ModBase, or nil.  modCounts then holds the
+	// modification counts of the ring-buffer rows, keyed by circular
+	// position, and modCallBuf the calls of the read being added.
+	modBase    *modBaseOpts
+	modCounts  map[PosType]*modBaseCounts
+	modCallBuf []modBaseCall
+	// memBudget is the memory accountant of Opts.MemoryBudgetMiB, or nil.
+	memBudget *memBudget
 }
 
-func newPileupMutable(nCirc PosType, maxReadLen int, stitch bool, w *os.File) (pm pileupMutable) {
+func newPileupMutable(nCirc PosType, maxReadLen int, stitch bool, w recordio.Writer) (pm pileupMutable) {
 	pm = pileupMutable{
 		resultRingBuffer: make([]pileupPayload, nCirc),
 		seq8Buf:          make([]byte, 0, maxReadLen),
+		indelSeqBuf:      make([]byte, 0, maxReadLen),
 		alignedBaseBufs: [2][]alignedPos{
 			make([]alignedPos, 0, maxReadLen),
 			nil,
@@ -198,12 +774,7 @@ func newPileupMutable(nCirc PosType, maxReadLen int, stitch bool, w *os.File) (p
 		pm.firstReads = newFirstreadSNPTable(nCirc)
 		pm.alignedBaseBufs[1] = make([]alignedPos, 0, maxReadLen)
 	}
-	if w != nil {
-		pm.w = recordio.NewWriter(w, recordio.WriterOpts{
-			Marshal:      marshalPileupRow,
-			Transformers: []string{"zstd 1"},
-		})
-	}
+	pm.w = w
 	return
 }
 
@@ -212,10 +783,39 @@ type pileupContext struct {
 	bedPart       interval.BEDUnion // per-thread BED subset
 	clip          int               // number of bases on ends of each read to treat as min-qual
 	ignoreStrand  bool              // are we reporting strand in the output?
+	indels        bool              // are we counting insertions and deletions?
+	extBases      bool              // are we counting pileup.BaseDel and pileup.BaseIns observations?
+	indelAlleles  bool              // if counting indels, are we tracking them by allele?
 	minBaseQual   byte
 	perReadNeeded bool           // are we reporting comma-separated per-read stats in the output, or are counts enough?
 	qpt           *qualPassTable // (R1 base-qual, R2 base-qual) good enough? lookup table
 	stitch        bool
+	clipOverlap   bool // only set with stitch, which pairs the reads
+
+	// hetSites is the per-thread subset of Opts.HetSites, or nil.
+	// dropDiscordant is Opts.ExcludeDiscordantPairs.
+	hetSites       *interval.BEDUnion
+	dropDiscordant bool
+
+	// overrides holds the per-interval thresholds of Opts.BedOverrides, or is
+	// nil.  minBaseQual and qpt are the run-wide ones.
+	overrides *regionOverrides
+
+	// readFeatures is true when the extended per-read features are reported.
+	// readGroupIdx is only set in that case, and refSeq8 (the current
+	// reference, in seq8 encoding) in that case or with longRead.
+	readFeatures bool
+	readGroupIdx map[string]uint16
+	refSeq8      []byte
+	// recomputeNM is Opts.RecomputeNM.
+	recomputeNM bool
+
+	// longRead is opts.longRead.
+	longRead *longReadOpts
+
+	// baq computes the BAQ of the reads, or is nil; refSeq8 is also set
+	// when it is non-nil.
+	baq *baqRealigner
 }
 
 // addBase performs a pileup update that only requires count-increments.
@@ -226,43 +826,167 @@ func (pm *pileupMutable) addBase(circPos, posInRead, isMinus PosType, seq, qual
 	// Always count Ns, to preserve tsv-snp2 compatibility.
 	if (qual[posInRead] >= minBaseQual) || (base == pileup.BaseX) {
 		row.counts[base][isMinus]++
+		if pm.hapCounted && (base != pileup.BaseX) {
+			pm.addHapCount(row, base)
+		}
+	}
+	if pm.qualWeighted && (base != pileup.BaseX) {
+		row.qualWeights[base][isMinus] += qualWeightTable[qual[posInRead]]
 	}
 }
 
 // appendBase performs a more-expensive pileup update that appends a bunch of
 // per-read stats.
-func (pm *pileupMutable) appendBase(circPos, posInRead, isMinus PosType, seq, qual []byte, minBaseQual, strandByte byte) {
+func (pm *pileupMutable) appendBase(circPos, posInRead, isMinus PosType, seq, qual []byte, minBaseQual byte, rf *readFeatures) {
 	row := &pm.resultRingBuffer[circPos]
 	row.depth++
 	base := pileup.Seq8ToEnumTable[seq[posInRead]]
 	if base == pileup.BaseX {
 		row.counts[base][isMinus]++
-	} else if qual[posInRead] >= minBaseQual {
+		return
+	}
+	if qual[posInRead] >= minBaseQual {
 		row.counts[base][isMinus]++
-		row.perRead[base] = append(row.perRead[base], perReadFeatures{
-			dist5p:  uint16(posInRead),
-			fraglen: uint16(len(qual)),
-			qual:    qual[posInRead],
-			strand:  strandByte,
-		})
+		if pm.hapCounted {
+			pm.addHapCount(row, base)
+		}
+		if pm.sketchDepth > 0 {
+			pm.appendSampledFeatures(row, circPos, base, rf.features(posInRead, qual))
+		} else {
+			row.perRead[base] = append(row.perRead[base], rf.features(posInRead, qual))
+		}
+	}
+	if pm.qualWeighted {
+		row.qualWeights[base][isMinus] += qualWeightTable[qual[posInRead]]
 	}
 }
 
 // addUnstitchedSegment adds an unpaired portion of a single read to the
 // pileup.
-func (pm *pileupMutable) addUnstitchedSegment(read *readSNP, isMinus PosType, alignedBases []alignedPos, minBaseQual byte, perReadNeeded bool) {
+func (pm *pileupMutable) addUnstitchedSegment(read *readSNP, isMinus PosType, alignedBases []alignedPos, pCtx *pileupContext) {
 	mask := pm.nCirc() - 1
 	qual := read.samr.Qual
-	if !perReadNeeded {
+	refID := read.samr.Ref.ID()
+	if !pCtx.perReadNeeded {
 		for _, ab := range alignedBases {
-			pm.addBase(ab.posInRef&mask, ab.posInRead, isMinus, read.seq8, qual, minBaseQual)
+			pm.addBase(ab.posInRef&mask, ab.posInRead, isMinus, read.seq8, qual, pCtx.minBaseQualAt(refID, ab.posInRef))
 		}
 	} else {
-		strandByte := byte(pileup.GetStrand(read.samr))
+		var rf readFeatures
+		newReadFeatures(&rf, read, pCtx)
 		for _, ab := range alignedBases {
-			pm.appendBase(ab.posInRef&mask, ab.posInRead, isMinus, read.seq8, qual, minBaseQual, strandByte)
+			pm.appendBase(ab.posInRef&mask, ab.posInRead, isMinus, read.seq8, qual, pCtx.minBaseQualAt(refID, ab.posInRef), &rf)
+		}
+	}
+}
+
+// addIndels adds the insertions and deletions in read to the pileup.  An indel
+// is only counted when it directly follows an aligned base (its VCF anchor)
+// where the read counts (see pileupContext.countsAt).  With
+// Opts.HomopolymerIndels, the anchor of a homopolymer indel is moved first
+// (see homopolymerAnchor).
+func (pm *pileupMutable) addIndels(read *readSNP, isMinus PosType, pCtx *pileupContext) {
+	mask := pm.nCirc() - 1
+	refID := read.samr.Ref.ID()
+	posInRef := PosType(read.samr.Pos)
+	posInRead := PosType(0)
+	anchored := false
+	homopolymers := (pCtx.longRead != nil) && pCtx.longRead.homopolymerIndels
+	// matchStart is the start of the last M op; with homopolymers, an indel's
+	// anchor is moved within it at most.
+	matchStart := posInRef
+	for _, co := range read.samr.Cigar {
+		cLen := PosType(co.Len())
+		switch co.Type() {
+		case sam.CigarMatch:
+			matchStart = posInRef
+			posInRef += cLen
+			posInRead += cLen
+			anchored = true
+			continue
+		case sam.CigarInsertion:
+			anchor := posInRef - 1
+			if anchored && homopolymers {
+				anchor = homopolymerAnchor(pCtx.refSeq8, read.seq8[posInRead:posInRead+cLen], anchor, matchStart)
+			}
+			if anchored && pCtx.countsAt(read, refID, anchor) {
+				seq := pm.indelSeqBuf[:0]
+				for _, b := range read.seq8[posInRead : posInRead+cLen] {
+					seq = append(seq, pileup.Seq8ToASCIITable[b])
+				}
+				pm.resultRingBuffer[anchor&mask].addIndel(indelIns, seq, 0, isMinus, pCtx.indelAlleles)
+				pm.indelSeqBuf = seq
+			}
+			posInRead += cLen
+		case sam.CigarDeletion:
+			anchor := posInRef - 1
+			if anchored && homopolymers && (posInRef+cLen <= PosType(len(pCtx.refSeq8))) {
+				anchor = homopolymerAnchor(pCtx.refSeq8, pCtx.refSeq8[posInRef:posInRef+cLen], anchor, matchStart)
+			}
+			if anchored && pCtx.countsAt(read, refID, anchor) {
+				pm.resultRingBuffer[anchor&mask].addIndel(indelDel, nil, uint32(cLen), isMinus, pCtx.indelAlleles)
+			}
+			posInRef += cLen
+		case sam.CigarSkipped:
+			posInRef += cLen
+		case sam.CigarSoftClipped:
+			posInRead += cLen
+		}
+		anchored = false
+	}
+}
+
+// addExtBases adds the pileup.BaseDel and pileup.BaseIns observations of
+// read to the pileup: each reference position within the BED intervals which
+// the read spans with a deletion, and each aligned base (within the BED
+// intervals) which is directly followed by an insertion.
+func (pm *pileupMutable) addExtBases(read *readSNP, isMinus PosType, pCtx *pileupContext) {
+	mask := pm.nCirc() - 1
+	refID := read.samr.Ref.ID()
+	posInRef := PosType(read.samr.Pos)
+	anchored := false
+	for _, co := range read.samr.Cigar {
+		cLen := PosType(co.Len())
+		switch co.Type() {
+		case sam.CigarMatch:
+			posInRef += cLen
+			anchored = true
+			continue
+		case sam.CigarInsertion:
+			if anchored && pCtx.countsAt(read, refID, posInRef-1) {
+				pm.resultRingBuffer[(posInRef-1)&mask].counts[pileup.BaseIns][isMinus]++
+			}
+		case sam.CigarDeletion:
+			for pos := posInRef; pos != posInRef+cLen; pos++ {
+				if pCtx.countsAt(read, refID, pos) {
+					pm.resultRingBuffer[pos&mask].counts[pileup.BaseDel][isMinus]++
+				}
+			}
+			posInRef += cLen
+		case sam.CigarSkipped:
+			posInRef += cLen
+		}
+		anchored = false
+	}
+}
+
+// addIndel increments the count for the given indel, and for its allele if
+// byAllele is set.
+func (row *pileupPayload) addIndel(indelType int, insSeq []byte, delLen uint32, isMinus PosType, byAllele bool) {
+	row.indelCounts[indelType][isMinus]++
+	if !byAllele {
+		return
+	}
+	for i := range row.indels {
+		a := &row.indels[i]
+		if a.delLen == delLen && a.insSeq == string(insSeq) {
+			a.counts[isMinus]++
+			return
 		}
 	}
+	a := indelAllele{insSeq: string(insSeq), delLen: delLen}
+	a.counts[isMinus]++
+	row.indels = append(row.indels, a)
 }
 
 // alignRelevantBases checks where the read intersects loaded BED intervals,
@@ -367,17 +1091,55 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 		if err = alignRelevantBases(&(pm.alignedBaseBufs[i]), r, &pCtx.bedPart); err != nil {
 			return
 		}
+		if pCtx.overrides != nil {
+			pm.alignedBaseBufs[i] = pCtx.overrides.filterMapq(pm.alignedBaseBufs[i], r.samr.Ref.ID(), r.samr.MapQ)
+		}
+		if pm.metrics != nil {
+			pm.metrics.addBases(&reads[i], pm.alignedBaseBufs[i])
+		}
 		clipQuals(r.samr, pCtx.clip)
 	}
 	abb0 := pm.alignedBaseBufs[0]
 	abb1 := pm.alignedBaseBufs[1]
-	minBaseQual := pCtx.minBaseQual
+	if pm.hapCounted {
+		pm.readHap, pm.readPhaseSet = pairHaplotype(reads)
+	}
+	if (pCtx.hetSites != nil) && (len(reads) == 2) {
+		nSite, nDisagree := compareMates(reads, abb0, abb1, pCtx.hetSites, pCtx.minBaseQual)
+		if nSite > 0 {
+			pm.concordance.pairs++
+			pm.concordance.agree += int64(nSite - nDisagree)
+			pm.concordance.disagree += int64(nDisagree)
+		}
+		if nDisagree > 0 {
+			pm.concordance.discordantPairs++
+			if pCtx.dropDiscordant {
+				return
+			}
+		}
+	}
+	if pCtx.indels {
+		for i := range reads {
+			pm.addIndels(&reads[i], isMinus, pCtx)
+		}
+	}
+	if pCtx.extBases {
+		for i := range reads {
+			pm.addExtBases(&reads[i], isMinus, pCtx)
+		}
+	}
+	if pm.modBase != nil {
+		pm.addModBaseCalls(&reads[0], abb0, isMinus, pCtx.refSeq8)
+		if len(reads) == 2 {
+			pm.addModBaseCalls(&reads[1], abb1, isMinus, pCtx.refSeq8)
+		}
+	}
 	perReadNeeded := pCtx.perReadNeeded
 	if (len(reads) == 1) || (len(abb1) == 0) {
 		// Empty alignedBases is possible when the read has deletions overlapping
 		// all SNP positions.
 		if len(abb0) != 0 {
-			pm.addUnstitchedSegment(&(reads[0]), isMinus, abb0, minBaseQual, perReadNeeded)
+			pm.addUnstitchedSegment(&(reads[0]), isMinus, abb0, pCtx)
 			curEndMax := abb0[len(abb0)-1].posInRef + 1
 			if pm.endMax < curEndMax {
 				pm.endMax = curEndMax
@@ -386,18 +1148,23 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 		return
 	}
 	if len(abb0) == 0 {
-		pm.addUnstitchedSegment(&(reads[1]), isMinus, abb1, minBaseQual, perReadNeeded)
+		pm.addUnstitchedSegment(&(reads[1]), isMinus, abb1, pCtx)
 		curEndMax := abb1[len(abb1)-1].posInRef + 1
 		if pm.endMax < curEndMax {
 			pm.endMax = curEndMax
 		}
 		return
 	}
+	if pCtx.clipOverlap {
+		pm.addOverlapClippedPair(reads, isMinus, abb0, abb1, pCtx)
+		return
+	}
 	mask := pm.nCirc() - 1
 	seq0 := reads[0].seq8
 	seq1 := reads[1].seq8
 	qual0 := reads[0].samr.Qual
 	qual1 := reads[1].samr.Qual
+	refID := reads[0].samr.Ref.ID()
 	idx0 := 0
 	idx1 := 0
 	// Loop over all relevant positions, stitching shared bases when possible,
@@ -415,8 +1182,14 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 			if curSeq0 == curSeq1 {
 				base := pileup.Seq8ToEnumTable[curSeq0]
 				if !perReadNeeded {
-					if pCtx.qpt.lookup2(qual0[posInRead0], qual1[posInRead1]) || (base == pileup.BaseX) {
+					if pCtx.qptAt(refID, posInRef0).lookup2(qual0[posInRead0], qual1[posInRead1]) || (base == pileup.BaseX) {
 						row.counts[base][isMinus]++
+						if pm.hapCounted && (base != pileup.BaseX) {
+							pm.addHapCount(row, base)
+						}
+					}
+					if pm.qualWeighted && (base != pileup.BaseX) {
+						row.qualWeights[base][isMinus] += qualWeightTable[qualSumTable[qual0[posInRead0]][qual1[posInRead1]]]
 					}
 				} else {
 					// dist5p/fraglen are a bit complicated in this case.  Punt for now.
@@ -429,14 +1202,14 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 			idx1++
 		} else if posInRef0 < posInRef1 {
 			if !perReadNeeded {
-				pm.addBase(posInRef0&mask, abb0[idx0].posInRead, isMinus, seq0, qual0, minBaseQual)
+				pm.addBase(posInRef0&mask, abb0[idx0].posInRead, isMinus, seq0, qual0, pCtx.minBaseQualAt(refID, posInRef0))
 			} else {
 				panic("stitched per-read features not yet supported")
 			}
 			idx0++
 		} else {
 			if !perReadNeeded {
-				pm.addBase(posInRef1&mask, abb1[idx1].posInRead, isMinus, seq1, qual1, minBaseQual)
+				pm.addBase(posInRef1&mask, abb1[idx1].posInRead, isMinus, seq1, qual1, pCtx.minBaseQualAt(refID, posInRef1))
 			} else {
 				panic("stitched per-read features not yet supported")
 			}
@@ -445,10 +1218,10 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 	}
 	var curEndMax PosType
 	if len(abb0) != idx0 {
-		pm.addUnstitchedSegment(&(reads[0]), isMinus, abb0[idx0:], minBaseQual, perReadNeeded)
+		pm.addUnstitchedSegment(&(reads[0]), isMinus, abb0[idx0:], pCtx)
 		curEndMax = abb0[len(abb0)-1].posInRef + 1
 	} else if len(abb1) != idx1 {
-		pm.addUnstitchedSegment(&(reads[1]), isMinus, abb1[idx1:], minBaseQual, perReadNeeded)
+		pm.addUnstitchedSegment(&(reads[1]), isMinus, abb1[idx1:], pCtx)
 		curEndMax = abb1[len(abb1)-1].posInRef + 1
 	} else {
 		// Note that this is guaranteed to be equal to
@@ -463,6 +1236,55 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 	return
 }
 
+// addOverlapClippedPair adds a read-pair to the pileup, counting only the
+// higher-quality base (that of reads[0] on a tie) at each position covered by
+// both reads.  abb0 and abb1 must be nonempty.
+func (pm *pileupMutable) addOverlapClippedPair(reads []readSNP, isMinus PosType, abb0, abb1 []alignedPos, pCtx *pileupContext) {
+	mask := pm.nCirc() - 1
+	refID := reads[0].samr.Ref.ID()
+	var rfs [2]readFeatures
+	if pCtx.perReadNeeded {
+		newReadFeatures(&rfs[0], &reads[0], pCtx)
+		newReadFeatures(&rfs[1], &reads[1], pCtx)
+	}
+	add := func(i int, ab alignedPos) {
+		minBaseQual := pCtx.minBaseQualAt(refID, ab.posInRef)
+		if pCtx.perReadNeeded {
+			pm.appendBase(ab.posInRef&mask, ab.posInRead, isMinus, reads[i].seq8, reads[i].samr.Qual, minBaseQual, &rfs[i])
+		} else {
+			pm.addBase(ab.posInRef&mask, ab.posInRead, isMinus, reads[i].seq8, reads[i].samr.Qual, minBaseQual)
+		}
+	}
+	qual0 := reads[0].samr.Qual
+	qual1 := reads[1].samr.Qual
+	idx0 := 0
+	idx1 := 0
+	for (idx0 != len(abb0)) || (idx1 != len(abb1)) {
+		if (idx1 == len(abb1)) || ((idx0 != len(abb0)) && (abb0[idx0].posInRef < abb1[idx1].posInRef)) {
+			add(0, abb0[idx0])
+			idx0++
+		} else if (idx0 == len(abb0)) || (abb1[idx1].posInRef < abb0[idx0].posInRef) {
+			add(1, abb1[idx1])
+			idx1++
+		} else {
+			if qual1[abb1[idx1].posInRead] > qual0[abb0[idx0].posInRead] {
+				add(1, abb1[idx1])
+			} else {
+				add(0, abb0[idx0])
+			}
+			idx0++
+			idx1++
+		}
+	}
+	curEndMax := abb0[len(abb0)-1].posInRef + 1
+	if end1 := abb1[len(abb1)-1].posInRef + 1; curEndMax < end1 {
+		curEndMax = end1
+	}
+	if pm.endMax < curEndMax {
+		pm.endMax = curEndMax
+	}
+}
+
 // addOrphanReads adds every read in the firstread-table mapped to position <
 // stopPos to the pileup, since their mates were filtered out or not found.
 func (pm *pileupMutable) addOrphanReads(pCtx *pileupContext, stopPos PosType) (err error) {
@@ -482,8 +1304,7 @@ func (pm *pileupMutable) addOrphanReads(pCtx *pileupContext, stopPos PosType) (e
 		for rs, bucketIdx := nonempty.NewRowScanner(); bucketIdx != -1; bucketIdx = rs.Next() {
 			bucket := &(bucketRow[bucketIdx])
 			for _, rec := range *bucket {
-				convertSamr(&firstread[0], rec.samr)
-				firstread[0].mapEnd = rec.mapEnd
+				convertAugSamr(&firstread[0], rec)
 				if !ignoreStrand {
 					isMinus = PosType(pileup.GetStrand(rec.samr) - 1)
 				}
@@ -517,7 +1338,9 @@ func (pm *pileupMutable) flushToInternal(rCtx *refContext, perReadNeeded bool, w
 	for pm.writePosScanner.Scan(&start, &end, writeEnd) {
 		for pos := start; pos != end; pos++ {
 			row := &pm.resultRingBuffer[pos&mask]
-			if row.depth == 0 {
+			// A position may be spanned only by deletions, in which case it has
+			// no depth but still has pileup.BaseDel counts to flush.
+			if (row.depth == 0) && (row.counts[pileup.BaseDel] == [2]uint32{}) {
 				// It isn't strictly necessary to separate out this case, but it's a
 				// significant performance win when zero-depth is common.
 				pm.w.Append(&pileupRow{
@@ -526,32 +1349,81 @@ func (pm *pileupMutable) flushToInternal(rCtx *refContext, perReadNeeded bool, w
 				})
 			} else {
 				fieldsPresent := uint32(fieldCounts)
+				// Like perRead below, indels and extensions must be deep-copied
+				// before the ring-buffer copy is cleared.
+				var indelsCopy []indelAllele
+				if row.indelCounts != ([nIndelType][2]uint32{}) {
+					fieldsPresent |= fieldIndelCounts
+					if len(row.indels) != 0 {
+						fieldsPresent |= fieldIndelAlleles
+						indelsCopy = append([]indelAllele(nil), row.indels...)
+					}
+				}
+				if pm.sketchDepth > 0 {
+					pm.flushSketches(row, pos&mask)
+				}
+				if pm.modBase != nil {
+					pm.flushModBaseCounts(row, pos&mask)
+				}
+				var extensionsCopy []rowExtension
+				if len(row.extensions) != 0 {
+					fieldsPresent |= fieldExtensions
+					extensionsCopy = append([]rowExtension(nil), row.extensions...)
+				}
+				if pm.qualWeighted {
+					fieldsPresent |= fieldQualWeights
+				}
+				if pm.extBases {
+					fieldsPresent |= fieldExtCounts
+				}
+				if pm.hapCounted {
+					fieldsPresent |= fieldHapCounts
+				}
 				if !perReadNeeded {
+					payload := *row
+					payload.indels = indelsCopy
+					payload.extensions = extensionsCopy
 					pm.w.Append(&pileupRow{
 						fieldsPresent: fieldsPresent,
 						refID:         uint32(refID),
 						pos:           uint32(pos),
-						payload:       *row,
+						payload:       payload,
 					})
 				} else {
-					fieldsPresent := fieldCounts
 					// perRead contains regular slices instead of just arrays, so we need
-					// to deep-copy it before clearing the ring-buffer copy.
+					// to deep-copy it before clearing the ring-buffer copy.  Over the
+					// memory budget, the slices are handed over instead, so that the
+					// ring buffer doesn't keep their memory for reuse.
+					handOver := pm.memBudget.over()
 					var perReadCopy [pileup.NBase][]perReadFeatures
 					for i := 0; i < pileup.NBase; i++ {
 						if len(row.perRead[i]) != 0 {
 							fieldsPresent |= fieldPerReadA << uint(i)
-							perReadCopy[i] = append([]perReadFeatures(nil), row.perRead[i]...)
+							if handOver {
+								perReadCopy[i] = row.perRead[i]
+								row.perRead[i] = nil
+							} else {
+								perReadCopy[i] = append([]perReadFeatures(nil), row.perRead[i]...)
+							}
 						}
 					}
+					if pm.perReadExtended && (fieldsPresent&fieldPerReadAny != 0) {
+						fieldsPresent |= fieldPerReadExtended
+					}
 					pm.w.Append(&pileupRow{
-						fieldsPresent: uint32(fieldsPresent),
+						fieldsPresent: fieldsPresent,
 						refID:         uint32(refID),
 						pos:           uint32(pos),
 						payload: pileupPayload{
-							depth:   row.depth,
-							counts:  row.counts,
-							perRead: perReadCopy,
+							depth:       row.depth,
+							counts:      row.counts,
+							perRead:     perReadCopy,
+							indelCounts: row.indelCounts,
+							indels:      indelsCopy,
+							extensions:  extensionsCopy,
+							qualWeights: row.qualWeights,
+							hapCounts:   row.hapCounts,
+							phaseSet:    row.phaseSet,
 						},
 					})
 					for i := range row.perRead {
@@ -563,6 +1435,12 @@ func (pm *pileupMutable) flushToInternal(rCtx *refContext, perReadNeeded bool, w
 						row.counts[i][j] = 0
 					}
 				}
+				row.indelCounts = [nIndelType][2]uint32{}
+				row.qualWeights = [pileup.NBase][2]float32{}
+				row.hapCounts = [nHaplotype][pileup.NBase]uint32{}
+				row.phaseSet = 0
+				row.indels = row.indels[:0]
+				row.extensions = row.extensions[:0]
 				row.depth = 0
 			}
 		}
@@ -591,33 +1469,166 @@ const (
 	formatBasestrandTSVBgz
 	formatTSV
 	formatTSVBgz
+	formatConsensusFASTQ
+	formatBasestrandTSVZst
+	formatTSVZst
+	formatVCF
+	formatVCFBgz
+	formatMPileup
+	formatMPileupBgz
+	formatParquet
+	formatGVCF
+	formatGVCFBgz
+	// formatStream is used by StreamPileup.  It has no name, since it doesn't
+	// produce a file.
+	formatStream
 )
 
+var formatNameMap = map[string]outputFormat{
+	"basestrand-rio":     formatBasestrandRio,
+	"basestrand-tsv":     formatBasestrandTSV,
+	"basestrand-tsv-bgz": formatBasestrandTSVBgz,
+	"basestrand-tsv-zst": formatBasestrandTSVZst,
+	"tsv":                formatTSV,
+	"tsv-bgz":            formatTSVBgz,
+	"tsv-zst":            formatTSVZst,
+	"consensus-fastq":    formatConsensusFASTQ,
+	"vcf":                formatVCF,
+	"vcf-bgz":            formatVCFBgz,
+	"mpileup":            formatMPileup,
+	"mpileup-bgz":        formatMPileupBgz,
+	"parquet":            formatParquet,
+	"gvcf":               formatGVCF,
+	"gvcf-bgz":           formatGVCFBgz,
+}
+
+// isTSV returns true for the (ref, alt)-split TSV formats.
+func (f outputFormat) isTSV() bool {
+	return (f == formatTSV) || (f == formatTSVBgz) || (f == formatTSVZst)
+}
+
+// isVCF returns true for the VCF formats.
+func (f outputFormat) isVCF() bool {
+	return (f == formatVCF) || (f == formatVCFBgz)
+}
+
+// isGVCF returns true for the gVCF formats.
+func (f outputFormat) isGVCF() bool {
+	return (f == formatGVCF) || (f == formatGVCFBgz)
+}
+
+// isMPileup returns true for the samtools-mpileup-compatible formats.
+func (f outputFormat) isMPileup() bool {
+	return (f == formatMPileup) || (f == formatMPileupBgz)
+}
+
+// compression returns the compression used by the text formats.
+func (f outputFormat) compression() outputCompression {
+	switch f {
+	case formatTSVBgz, formatBasestrandTSVBgz, formatVCFBgz, formatMPileupBgz, formatGVCFBgz:
+		return compressBGZF
+	case formatTSVZst, formatBasestrandTSVZst:
+		return compressSeekableZstd
+	}
+	return compressNone
+}
+
+// FormatNames returns the output format names accepted by Pileup, in sorted
+// order.
+func FormatNames() []string {
+	names := make([]string, 0, len(formatNameMap))
+	for name := range formatNameMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type pileupSNPOpts struct {
+	annotator        *annotator // nil unless Opts.Annotate is set
+	baq              bool       // Opts.BAQ
+	recomputeNM      bool       // Opts.RecomputeNM
+	kmerUniqueness   int        // 0 unless Opts.KmerUniqueness is set
+	hotspots         []hotspot  // nil unless Opts.Hotspots is set
+	rowFilter        *rowFilter // nil unless the output positions are filtered
+	auditBoundaries  bool
 	bedUnion         interval.BEDUnion
+	checkpointKey    string // if nonempty, the main loop is checkpointed
 	clip             int
+	clipOverlap      bool // implies stitch, for the read pairing
 	colBitset        int
+	columns          []*columnProjection // nil unless Opts.Columns is set
+	compression      outputCompression
+	depthHist        bool
+	downsampleBin    int
+	downsampleFrac   float64
+	dedup            dedupMode
+	dedupUMITag      sam.Tag
+	deadline         time.Time
+	umiConsensus     *umiConsensusOpts // nil unless UMI consensus counting is enabled
+	activeRegions    *activeRegionOpts // nil unless active-region reassembly is enabled
+	longRead         *longReadOpts     // nil unless Opts.LongRead is set
+	maxDepth         *maxDepthOpts     // nil unless max-depth downsampling is enabled
+	sketchDepth      int               // 0 unless per-read features are sampled at high depth
+	memBudget        *memBudget        // nil unless Opts.MemoryBudgetMiB is set
+	circular         []bool            // indexed by reference ID; nil unless Opts.Circular is set
+	emit             func(*Row) error  // if non-nil, rows are passed to emit instead of written to files
+	executor         *executorRun      // nil unless Opts.Executor is set
+	endMotifWeights  *endMotifWeights
 	fapath           string
+	hooks            *Hooks // nil unless Opts.Hooks is set
+	progress         []progress.Sink
 	flagExclude      int
 	format           outputFormat
+	fragWindow       int
+	gqBands          []int            // gvcf output only
+	haplotypes       *haplotypeCounts // nil unless Opts.HaplotypeSites is set
+	hetSites         *interval.BEDUnion
+	dropDiscordant   bool
 	linearConsensus  int
 	linearNosplit    bool
 	mapq             int
+	maxInsertSize    int
 	maxLinearBagSpan int
 	maxReadLen       int
 	maxReadSpan      int
+	metrics          *metricsOpts     // nil unless Opts.Metrics is set
+	methylation      *methylationOpts // nil unless Opts.Methylation is set
+	modBase          *modBaseOpts     // nil unless Opts.ModBase is set
+	minAltFrac       float64
 	minBagDepth      int
 	minBaseQual      int
 	minBaseQualSum   int
+	overrides        *regionOverrides // nil unless Opts.BedOverrides is set
 	outPrefix        string
+	rowGroupSize     int // parquet output only
 	padding          int
 	parallelism      int
 	provider         bamprovider.Provider
+	quarantine       bool
+	readFilter       *readFilter // nil unless Opts.ReadFilter is set
+	readPolicies     [nCensusBucket]readPolicy
 	refSeqs          [][]byte
 	removeSq         bool
+	requireProper    bool
+	newRandSource    func(int64) rand.Source // nil unless Opts.NewRandSource is set
+	seed             int64
+	samples          []sampleInput // only set for multi-sample runs
+	somatic          bool          // Opts.Somatic
+	shardCodec       shardCodec
+	shardSchedule    shardSchedule
+	shardRetries     int
+	shardTimer       *shardTimer // nil unless Opts.ShardPlanOut is set
 	shards           []gbam.Shard
+	jobStarts        []int // if non-nil, job j processes shards[jobStarts[j]:jobStarts[j+1]]
 	stitch           bool
 	tempDir          string
+	throttle         *iothrottle.Throttle // limits and measures the reads of the inputs
+	timeBudget       time.Duration
+	wpsWindow        int
+	windowSize       int
+	windowStats      []string
+	windowStep       int
 }
 
 func (pm *pileupMutable) finishRef(refIdxEnd int, opts *pileupSNPOpts, rCtx *refContext, pCtx *pileupContext) (err error) {
@@ -646,6 +1657,9 @@ func (pm *pileupMutable) nextRef(rCtx *refContext, newRefID int, opts *pileupSNP
 	pm.writePosScanner = interval.NewUnionScanner(endpoints)
 	rCtx.refID = newRefID
 	rCtx.refName = pCtx.bedPart.RefNames[newRefID] // only needed for error messages
+	if pCtx.readFeatures || (pCtx.longRead != nil) || (pCtx.baq != nil) || (pm.modBase != nil) {
+		pCtx.refSeq8 = opts.refSeqs[newRefID]
+	}
 	return
 }
 
@@ -655,10 +1669,49 @@ type pileupShardContext struct {
 	prevLimitPos int
 	shardOverlap bool
 	readPair     [2]readSNP
+	census       *readCensus // this job's census
+	sampler      *fraglenSampler
+	motifFilter  *endMotifFilter
+	dupFilter    *dupFilter
+	frag         *fragJob
+	haps         *haplotypeJob
+	activity     *taskActivity // for the debug dumps; may be nil
 }
 
 func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCtx *refContext, pCtx *pileupContext, psCtx *pileupShardContext) (err error) {
-	iter := opts.provider.NewIterator(shard)
+	shardRange := gbam.ShardToCoordRange(shard)
+	// With per-interval MAPQ thresholds, the reads which pass the lowest one
+	// are filtered at each position they cover.
+	readMapq := opts.mapq
+	if opts.overrides != nil {
+		readMapq = opts.overrides.minMapq
+	}
+	var visitor ReadVisitor
+	if opts.hooks != nil {
+		visitor = opts.hooks.ReadVisitor
+	}
+	var iter bamprovider.Iterator = opts.provider.NewIterator(shard)
+	if opts.circular != nil {
+		iter = newCircularIterator(iter, opts.provider, &shard, opts.circular, opts.maxReadSpan)
+	}
+	if opts.umiConsensus != nil {
+		iter = newUMIConsensusIterator(iter, opts.umiConsensus, opts.flagExclude, readMapq, opts.maxReadSpan)
+	}
+	if opts.activeRegions != nil {
+		iter = newActiveRegionIterator(iter, opts.activeRegions, opts.refSeqs, opts.flagExclude, readMapq, opts.maxReadSpan, opts.minBaseQual)
+	}
+	if opts.maxDepth != nil {
+		iter = newMaxDepthIterator(iter, opts.maxDepth, opts.shardRand(&shard, randStreamMaxDepth), opts.flagExclude, readMapq)
+	}
+	if psCtx.sampler != nil {
+		psCtx.sampler.startShard(opts.shardRand(&shard, randStreamDownsample))
+	}
+	if psCtx.motifFilter != nil {
+		psCtx.motifFilter.startShard(opts.shardRand(&shard, randStreamEndMotif))
+	}
+	if pm.sketchDepth > 0 {
+		pm.sketchRand = opts.shardRand(&shard, randStreamDepthSketch)
+	}
 	defer func() {
 		if e := iter.Close(); e != nil && err == nil {
 			err = e
@@ -669,6 +1722,7 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 	var isMinus PosType
 	for iter.Scan() {
 		curRead := iter.Record()
+		psCtx.activity.addRead(curRead)
 		if psCtx.shardOverlap {
 			// The first few reads may have already been processed while iterating
 			// over the previous shard, since padding > 0.  Don't reprocess them.
@@ -686,9 +1740,48 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 			}
 			psCtx.shardOverlap = false
 		}
-		// -flag-exclude, -mapq, and blank-read filters
-		if (opts.flagExclude&int(curRead.Flags) != 0) || (opts.mapq > int(curRead.MapQ)) || (len(curRead.Cigar) == 0) {
-			sam.PutInFreePool(curRead)
+		// -flag-exclude filter
+		if opts.flagExclude&int(curRead.Flags) != 0 {
+			pm.dropRead(curRead, filterFlagExclude, &shardRange)
+			continue
+		}
+		// Unmapped/mate-unmapped/zero-MAPQ policies
+		var drop bool
+		if drop, err = applyReadPolicies(curRead, &opts.readPolicies, psCtx.census, &shardRange); err != nil {
+			return
+		}
+		if drop {
+			pm.dropRead(curRead, filterReadPolicy, &shardRange)
+			continue
+		}
+		// -mapq and blank-read filters
+		if readMapq > int(curRead.MapQ) {
+			pm.dropRead(curRead, filterMapq, &shardRange)
+			continue
+		}
+		if len(curRead.Cigar) == 0 {
+			pm.dropRead(curRead, filterEmptyCigar, &shardRange)
+			continue
+		}
+		// -read-filter filter
+		if (opts.readFilter != nil) && !opts.readFilter.keep(curRead) {
+			pm.dropRead(curRead, filterReadFilter, &shardRange)
+			continue
+		}
+		// Hooks.ReadVisitor filter
+		if visitor != nil {
+			var refSeq8 []byte
+			if refID := curRead.Ref.ID(); (refID >= 0) && (refID < len(opts.refSeqs)) {
+				refSeq8 = opts.refSeqs[refID]
+			}
+			if visitor.VisitRead(curRead, refSeq8) == ReadDrop {
+				pm.dropRead(curRead, filterReadVisitor, &shardRange)
+				continue
+			}
+		}
+		// -require-proper-pair and -max-insert-size filters
+		if !keepPairedRead(curRead, opts.requireProper, opts.maxInsertSize) {
+			pm.dropRead(curRead, filterPair, &shardRange)
 			continue
 		}
 		// -remove-sq filter
@@ -698,7 +1791,7 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 				return
 			}
 			if libraryBagSize < 2 {
-				sam.PutInFreePool(curRead)
+				pm.dropRead(curRead, filterRemoveSq, &shardRange)
 				continue
 			}
 		}
@@ -709,21 +1802,36 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 				return
 			}
 			if bagDepthFilterFail {
-				sam.PutInFreePool(curRead)
+				pm.dropRead(curRead, filterMinBagDepth, &shardRange)
 				continue
 			}
 		}
-		strand := pileup.GetStrand(curRead)
+		strand := readStrand(curRead, opts.longRead != nil)
 		if psCtx.strandReq != pileup.StrandNone {
 			// -per-strand filter
 			if strand != psCtx.strandReq {
-				sam.PutInFreePool(curRead)
+				pm.dropRead(curRead, filterStrand, &shardRange)
 				continue
 			}
 		} else if (strand == pileup.StrandNone) && (!ignoreStrand) {
 			// We also don't need to include nonstandard-strand reads in the pileup
 			// when we're only reporting (base x strand) counts.
-			sam.PutInFreePool(curRead)
+			pm.dropRead(curRead, filterStrand, &shardRange)
+			continue
+		}
+		// -dedup filter
+		if (psCtx.dupFilter != nil) && !psCtx.dupFilter.keep(curRead) {
+			pm.dropRead(curRead, filterDedup, &shardRange)
+			continue
+		}
+		// -downsample filter
+		if (psCtx.sampler != nil) && !psCtx.sampler.keep(curRead) {
+			pm.dropRead(curRead, filterDownsample, &shardRange)
+			continue
+		}
+		// -end-motif-weights filter
+		if (psCtx.motifFilter != nil) && !psCtx.motifFilter.keep(curRead) {
+			pm.dropRead(curRead, filterEndMotif, &shardRange)
 			continue
 		}
 		// Okay, this read might actually matter.
@@ -769,11 +1877,40 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 		if span > opts.maxReadSpan {
 			return fmt.Errorf("pileupMutable.processShard: maxReadSpan is %d, but read %s at %s:%d has span %d", opts.maxReadSpan, curRead.Name, rCtx.refName, curRead.Pos, span)
 		}
+		// The other outputs keep the run-wide MAPQ threshold.
+		passesMapq := opts.mapq <= int(curRead.MapQ)
+		if (psCtx.frag != nil) && passesMapq {
+			if err = psCtx.frag.add(curRead, span); err != nil {
+				return
+			}
+		}
+		if (psCtx.haps != nil) && passesMapq {
+			psCtx.haps.add(curRead, strand, curRead.Pos+span)
+		}
 		mapEnd := PosType(curRead.Pos + span)
 		if !pCtx.bedPart.IntersectsByID(rCtx.refID, PosType(curRead.Pos), mapEnd) {
-			sam.PutInFreePool(curRead)
+			pm.dropRead(curRead, filterOffTarget, &shardRange)
 			continue
 		}
+		// -min-read-identity filter.  The read is converted here, and keeps
+		// the edit distance computed for the filter.
+		converted := false
+		if (opts.longRead != nil) && (opts.longRead.minIdentity > 0) {
+			convertSamr(&(psCtx.readPair[0]), curRead)
+			converted = true
+			if readIdentity(&(psCtx.readPair[0]), pCtx.refSeq8, pCtx.recomputeNM) < opts.longRead.minIdentity {
+				pm.dropRead(curRead, filterIdentity, &shardRange)
+				continue
+			}
+		}
+		if pm.metrics != nil {
+			pm.metrics.addRead(curRead, strand, &shardRange)
+		}
+		// -baq adjustment; with stitching, it has to happen before the read
+		// enters the firstread-table.
+		if pCtx.baq != nil {
+			pCtx.baq.apply(curRead, pCtx.refSeq8)
+		}
 		psCtx.readPair[0].mapEnd = mapEnd
 
 		// 3. If stitching, look for a mate in the firstread-table.
@@ -785,11 +1922,11 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 		//      the BAM/PAM.
 		nRead := 1
 		if opts.stitch {
-			nRead = pm.firstReads.addOrRemove(&psCtx.readPair, curRead, strand, opts.maxReadSpan)
+			nRead = pm.firstReads.addOrRemove(&psCtx.readPair, curRead, strand, opts.maxReadSpan, converted)
 			if nRead == 0 {
 				continue
 			}
-		} else {
+		} else if !converted {
 			convertSamr(&(psCtx.readPair[0]), curRead)
 		}
 
@@ -808,29 +1945,271 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 	return
 }
 
-func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.StrandType) (err error) {
-	if (opts.format != formatTSV) && (opts.format != formatTSVBgz) && (strandReq != pileup.StrandNone) {
-		err = fmt.Errorf("pileupSNPMain: single-strand mode not supported with basestrand output (strands are already tracked separately)")
-		return
+// pileupJob runs the main pileup loop over shardSlice, writing pileupRows to
+// w.  If census is non-nil, the job's read census is added to it on success.
+// Similarly, if frag is non-nil, the job's fragmentomics features are sent to
+// it, and if haps (resp. conc, metrics) is non-nil, the job's haplotype counts
+// (resp. mate concordance counts, QC metrics) are added to it on success.  If
+// activity is non-nil, the job's current shard and reads are recorded in it,
+// and its finished shards are reported to it.
+func pileupJob(opts *pileupSNPOpts, strandReq pileup.StrandType, shardSlice []gbam.Shard, w recordio.Writer, nCirc PosType, qpt *qualPassTable, census *readCensus, frag *fragOutput, haps *haplotypeCounts, conc *mateConcordance, metrics *runMetrics, unprocessed *[]gbam.Shard, activity *taskActivity) error {
+	rCtx := refContext{
+		refID: -1,
 	}
-	nShard := len(opts.shards)
-	parallelism := min(opts.parallelism, nShard)
-
-	// When we aren't stitching, it is always safe to flush final pileup results
-	// for all positions before the current read-start; we only need to keep
-	// track of the maxReadSpan positions past that point.
-	// However, when stitching, we also need to track the maxReadSpan positions
-	// before the current read-start, since there may be a read-pair where the
-	// first read starts almost that far behind us, we haven't encountered the
-	// second read yet, and there's some overlap between the two read-sides.
-	nCirc := PosType(circular.NextExp2(opts.maxReadSpan))
-	if opts.stitch {
-		nCirc = nCirc * 2
+	// We already got the header before, so it shouldn't be possible for this
+	// call to generate a new error.
+	header, _ := opts.provider.GetHeader()
+	headerRefs := header.Refs()
+	if opts.memBudget != nil {
+		bw := newBudgetWriter(w, opts.memBudget, opts.shardCodec)
+		defer bw.releasePending()
+		w = bw
+	}
+	var jobMetrics *pileupMetrics
+	if metrics != nil {
+		jobMetrics = newPileupMetrics()
+		w = newMetricsWriter(w, jobMetrics, &opts.bedUnion)
+	}
+	var hooks Hooks
+	if opts.hooks != nil {
+		hooks = *opts.hooks
+	}
+	var hw *hookWriter
+	if hooks.OnPositions != nil {
+		hw = newHookWriter(w, hooks.OnPositions, headerRefs)
+		w = hw
+	}
+	var pc *positionCounter
+	if activity.wantsPositions() {
+		pc = &positionCounter{Writer: w}
+		w = pc
 	}
+	// If the time budget runs out partway through the job, the shards that
+	// weren't started are returned in *unprocessed, and rows past the last
+	// processed shard are dropped.  The hooks don't see the dropped rows.
+	var cw *cutoffWriter
+	if (unprocessed != nil) && !opts.deadline.IsZero() {
+		cw = &cutoffWriter{Writer: w}
+		w = cw
+	}
+	maxReadLen := opts.maxReadLen
+	results := newPileupMutable(nCirc, maxReadLen, opts.stitch, w)
+	results.metrics = jobMetrics
+	padding := PosType(opts.padding)
 
-	var qpt qualPassTable
-	if qpt, err = newQualPassTable(byte(opts.minBaseQual)); err != nil {
-		return
+	// This contains information needed by some functions called by
+	// pileupMutable.processShard.
+	// Probable todo: set ignoreStrand to false when per-strand TSV output is
+	// requested, and move the per-strand-reporting logic to the final
+	// internal-format -> final format conversion; this lets up stop executing
+	// the main loop twice.
+	pCtx := pileupContext{
+		clip:          opts.clip,
+		ignoreStrand:  (opts.format.isTSV() || (opts.format == formatConsensusFASTQ)) && (opts.methylation == nil),
+		indels:        (opts.colBitset & colBitIndels) != 0,
+		extBases:      (opts.colBitset & colBitExtBases) != 0,
+		indelAlleles:  opts.format.isTSV() || opts.format.isMPileup(),
+		perReadNeeded: ((opts.colBitset & colPerReadMask) != 0),
+		minBaseQual:   byte(opts.minBaseQual),
+		overrides:     opts.overrides,
+		stitch:        opts.stitch,
+		clipOverlap:   opts.clipOverlap,
+		qpt:           qpt,
+		longRead:      opts.longRead,
+		recomputeNM:   opts.recomputeNM,
+	}
+	if opts.baq {
+		pCtx.baq = &baqRealigner{}
+	}
+	results.qualWeighted = (opts.colBitset & colBitQualWeights) != 0
+	if opts.sketchDepth > 0 {
+		results.sketchDepth = opts.sketchDepth
+		results.sketches = make(map[PosType]*[pileup.NBase]depthSketch)
+	}
+	if opts.modBase != nil {
+		results.modBase = opts.modBase
+		results.modCounts = make(map[PosType]*modBaseCounts)
+	}
+	results.memBudget = opts.memBudget
+	results.extBases = pCtx.extBases
+	results.hapCounted = (opts.colBitset & colBitHapCounts) != 0
+	if (opts.colBitset & colBitReadFeatures) != 0 {
+		pCtx.readFeatures = true
+		pCtx.readGroupIdx = newReadGroupIdx(header)
+		results.perReadExtended = true
+	}
+	// The final concatenation step does not currently deduplicate records in
+	// the overlapping region, so it's necessary to precisely split the
+	// BEDUnion here.
+	{
+		firstCoordRange := gbam.ShardToCoordRange(shardSlice[0])
+		startRefID := int(firstCoordRange.Start.RefId)
+		startPos := PosType(firstCoordRange.Start.Pos)
+
+		lastCoordRange := gbam.ShardToCoordRange(shardSlice[len(shardSlice)-1])
+		limitRefID := int(lastCoordRange.Limit.RefId)
+		limitPos := PosType(lastCoordRange.Limit.Pos)
+		if limitRefID < 0 {
+			limitRefID = len(headerRefs) - 1
+			limitPos = PosType(headerRefs[limitRefID].Len())
+		}
+		pCtx.bedPart = opts.bedUnion.Subset(startRefID, startPos, limitRefID, limitPos)
+		if opts.hetSites != nil {
+			hetPart := opts.hetSites.Subset(startRefID, startPos, limitRefID, limitPos)
+			pCtx.hetSites = &hetPart
+			pCtx.dropDiscordant = opts.dropDiscordant
+		}
+	}
+
+	// This contains context only needed by the top-level processShard
+	// function.
+	psCtx := pileupShardContext{
+		strandReq:   strandReq,
+		prevLimitID: -1,
+		census:      newReadCensus(len(headerRefs)),
+		activity:    activity,
+	}
+	if opts.dedup != dedupNone {
+		psCtx.dupFilter = newDupFilter(opts.dedup, opts.dedupUMITag, opts.maxReadSpan)
+	}
+	if opts.downsampleFrac > 0 {
+		psCtx.sampler = newFraglenSampler(opts.downsampleFrac, opts.downsampleBin)
+	}
+	if opts.endMotifWeights != nil {
+		psCtx.motifFilter = newEndMotifFilter(opts.endMotifWeights, opts.refSeqs)
+	}
+	jobRange := biopb.CoordRange{
+		Start: gbam.ShardToCoordRange(shardSlice[0]).Start,
+		Limit: gbam.ShardToCoordRange(shardSlice[len(shardSlice)-1]).Limit,
+	}
+	if frag != nil {
+		psCtx.frag = newFragJob(*frag, jobRange, opts.maxReadSpan, opts.refSeqs)
+	}
+	if haps != nil {
+		psCtx.haps = newHaplotypeJob(haps, jobRange, byte(opts.minBaseQual))
+	}
+	psCtx.readPair[0].seq8 = make([]byte, 0, maxReadLen)
+	psCtx.readPair[1].seq8 = make([]byte, 0, maxReadLen)
+
+	for i, shard := range shardSlice {
+		if (cw != nil) && time.Now().After(opts.deadline) {
+			*unprocessed = shardSlice[i:]
+			cut := gbam.ShardToCoordRange(shard).Start
+			cw.setCutoff(cut)
+			// Don't write empty rows for the later contigs either.
+			pCtx.bedPart = opts.bedUnion.Subset(int(jobRange.Start.RefId), PosType(jobRange.Start.Pos), int(cut.RefId), PosType(cut.Pos))
+			break
+		}
+		shardStart := time.Now()
+		activity.startShard(shard)
+		var positions0 int64
+		if pc != nil {
+			positions0 = pc.n
+		}
+		if hooks.OnShardStart != nil {
+			hooks.OnShardStart(shard)
+		}
+		shardDone := func() {
+			if hw != nil {
+				hw.flushBatch()
+			}
+			if hooks.OnShardDone != nil {
+				hooks.OnShardDone(shard, time.Since(shardStart))
+			}
+			if pc != nil {
+				activity.shardDone(pc.n - positions0)
+			}
+		}
+		// May as well skip completely-nonoverlapping shards.
+		if intersectionIsEmpty(&shard, headerRefs, &pCtx.bedPart) {
+			shardDone()
+			continue
+		}
+		// Skipping shards that the index proves to be empty is a big win on
+		// sparse targeted data.  Zero-depth rows are still written later by
+		// the writePosScanner.
+		if stats, e := bamprovider.QueryIndex(opts.provider, shard); e != nil {
+			return e
+		} else if !stats.MayHaveRecords {
+			shardDone()
+			continue
+		}
+		if e := results.processShard(shard, opts, &rCtx, &pCtx, &psCtx); e != nil {
+			return e
+		}
+		if opts.shardTimer != nil {
+			opts.shardTimer.add(&shard, time.Since(shardStart))
+		}
+		shardDone()
+		psCtx.shardOverlap = true
+		coordRange := gbam.ShardToCoordRange(shard)
+		psCtx.prevLimitID = int(coordRange.Limit.RefId)
+		psCtx.prevLimitPos = int(coordRange.Limit.Pos) + int(padding)
+	}
+	// Flush last entries, unless there were no entries at all.
+	if e := results.finishRef(len(headerRefs), opts, &rCtx, &pCtx); e != nil {
+		return e
+	}
+	if e := results.w.Finish(); e != nil {
+		return e
+	}
+	if census != nil {
+		census.merge(psCtx.census)
+	}
+	if psCtx.haps != nil {
+		psCtx.haps.finish()
+	}
+	if conc != nil {
+		conc.merge(&results.concordance)
+	}
+	if metrics != nil {
+		metrics.merge(jobMetrics)
+	}
+	if psCtx.frag != nil {
+		return psCtx.frag.finish()
+	}
+	return nil
+}
+
+func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.StrandType) (err error) {
+	if !opts.format.isTSV() && (opts.format != formatConsensusFASTQ) && (strandReq != pileup.StrandNone) {
+		err = fmt.Errorf("pileupSNPMain: single-strand mode not supported with basestrand output (strands are already tracked separately)")
+		return
+	}
+	nShard := len(opts.shards)
+	parallelism := min(opts.parallelism, nShard)
+	if opts.jobStarts != nil {
+		parallelism = len(opts.jobStarts) - 1
+	}
+	nCirc := circBufferSize(opts)
+
+	var qpt qualPassTable
+	if qpt, err = newQualPassTable(byte(opts.minBaseQual)); err != nil {
+		return
+	}
+
+	jobBounds := func(jobIdx int) (int, int) {
+		if opts.jobStarts != nil {
+			return opts.jobStarts[jobIdx], opts.jobStarts[jobIdx+1]
+		}
+		startIdx := (jobIdx * nShard) / parallelism
+		endIdx := ((jobIdx + 1) * nShard) / parallelism
+		return startIdx, endIdx
+	}
+	jobShards := func(jobIdx int) []gbam.Shard {
+		startIdx, endIdx := jobBounds(jobIdx)
+		return opts.shards[startIdx:endIdx]
+	}
+	{
+		header, _ := opts.provider.GetHeader()
+		log.Printf("pileupSNPMain: %s shard schedule: %v", opts.shardSchedule, computeScheduleStats(parallelism, len(header.Refs()), jobShards))
+	}
+	if opts.emit != nil {
+		header, _ := opts.provider.GetHeader()
+		w := &rowEmitter{emit: opts.emit, refs: header.Refs()}
+		return traverse.Each(parallelism, func(jobIdx int) error {
+			return pileupJob(opts, strandReq, jobShards(jobIdx), w, nCirc, &qpt, nil, nil, nil, nil, nil, nil, nil)
+		})
 	}
 
 	if opts.tempDir != "" {
@@ -841,7 +2220,13 @@ func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.St
 		}
 	}
 
-	tmpFiles := make([]*os.File, parallelism)
+	// In multi-sample mode, each job is run once per sample, with the rows of
+	// sample s and job j in tmpFiles[s*parallelism+j].
+	nSample := 1
+	if len(opts.samples) > 0 {
+		nSample = len(opts.samples)
+	}
+	tmpFiles := make([]*os.File, parallelism*nSample)
 	defer func() {
 		for _, f := range tmpFiles {
 			if f != nil {
@@ -851,126 +2236,352 @@ func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.St
 			}
 		}
 	}()
+	// With a checkpoint, resumed[i] is the entry of task i if an earlier run
+	// completed it.
+	var ckpt *checkpoint
+	resumed := make([]*checkpointEntry, len(tmpFiles))
+	if opts.checkpointKey != "" {
+		if ckpt, err = openCheckpoint(opts.tempDir, opts.checkpointKey+"_s"+strconv.Itoa(int(strandReq))+"_p"+strconv.Itoa(parallelism)); err != nil {
+			return
+		}
+		defer func() {
+			var e error
+			if err == nil {
+				e = ckpt.remove()
+			} else {
+				e = ckpt.close()
+			}
+			if e != nil && err == nil {
+				err = e
+			}
+		}()
+	}
 	for jobIdx := range tmpFiles {
+		if ckpt != nil {
+			if tmpFiles[jobIdx], resumed[jobIdx], err = ckpt.openTaskFile(jobIdx); err != nil {
+				return
+			}
+			continue
+		}
 		if tmpFiles[jobIdx], err = ioutil.TempFile(opts.tempDir, "pileup_tmp"+strconv.Itoa(jobIdx)+"_*.rio"); err != nil {
 			return
 		}
 	}
-
-	log.Printf("pileupSNPMain: starting main loop (%d jobs)\n", parallelism)
-	err = traverse.Each(parallelism, func(jobIdx int) error {
-		startIdx := (jobIdx * nShard) / parallelism
-		endIdx := ((jobIdx + 1) * nShard) / parallelism
-		shardSlice := opts.shards[startIdx:endIdx]
-
-		rCtx := refContext{
-			refID: -1,
+	if opts.executor != nil {
+		// The executor's tasks are treated like those completed by an earlier
+		// run.
+		if err = opts.executor.run(ctx, opts, strandReq, parallelism, jobBounds, tmpFiles, resumed); err != nil {
+			return
 		}
-		maxReadLen := opts.maxReadLen
-		results := newPileupMutable(nCirc, maxReadLen, opts.stitch, tmpFiles[jobIdx])
-
-		// We already got the header before, so it shouldn't be possible for this
-		// call to generate a new error.
-		header, _ := opts.provider.GetHeader()
-		headerRefs := header.Refs()
-		padding := PosType(opts.padding)
-
-		// This contains information needed by some functions called by
-		// pileupMutable.processShard.
-		// Probable todo: set ignoreStrand to false when per-strand TSV output is
-		// requested, and move the per-strand-reporting logic to the final
-		// internal-format -> final format conversion; this lets up stop executing
-		// the main loop twice.
-		pCtx := pileupContext{
-			clip:          opts.clip,
-			ignoreStrand:  (opts.format == formatTSV) || (opts.format == formatTSVBgz),
-			perReadNeeded: ((opts.colBitset & (colBitEndDists | colBitQuals | colBitFraglens | colBitStrands)) != 0),
-			minBaseQual:   byte(opts.minBaseQual),
-			stitch:        opts.stitch,
-			qpt:           &qpt,
-		}
-		// The final concatenation step does not currently deduplicate records in
-		// the overlapping region, so it's necessary to precisely split the
-		// BEDUnion here.
-		{
-			firstCoordRange := gbam.ShardToCoordRange(shardSlice[0])
-			startRefID := int(firstCoordRange.Start.RefId)
-			startPos := PosType(firstCoordRange.Start.Pos)
-
-			lastCoordRange := gbam.ShardToCoordRange(shardSlice[len(shardSlice)-1])
-			limitRefID := int(lastCoordRange.Limit.RefId)
-			limitPos := PosType(lastCoordRange.Limit.Pos)
-			if limitRefID < 0 {
-				limitRefID = len(headerRefs) - 1
-				limitPos = PosType(headerRefs[limitRefID].Len())
+	}
+	// The per-position read end counts of job j are in fragEndFiles[j], and
+	// its WPS fragments in wpsFiles[j].
+	var frags *fragmentomics
+	var fragEndFiles, wpsFiles []*os.File
+	if opts.fragWindow > 0 {
+		frags = newFragmentomics(opts.fragWindow)
+		fragEndFiles = make([]*os.File, parallelism)
+		if opts.wpsWindow > 0 {
+			wpsFiles = make([]*os.File, parallelism)
+		}
+		defer func() {
+			for _, f := range append(fragEndFiles, wpsFiles...) {
+				if f != nil {
+					if e := f.Close(); e != nil && err == nil {
+						err = e
+					}
+				}
+			}
+		}()
+		for jobIdx := range fragEndFiles {
+			if fragEndFiles[jobIdx], err = ioutil.TempFile(opts.tempDir, "pileup_frag_ends"+strconv.Itoa(jobIdx)+"_*.bin"); err != nil {
+				return
 			}
-			pCtx.bedPart = opts.bedUnion.Subset(startRefID, startPos, limitRefID, limitPos)
 		}
-
-		// This contains context only needed by the top-level processShard
-		// function.
-		psCtx := pileupShardContext{
-			strandReq:   strandReq,
-			prevLimitID: -1,
+		for jobIdx := range wpsFiles {
+			if wpsFiles[jobIdx], err = ioutil.TempFile(opts.tempDir, "pileup_wps"+strconv.Itoa(jobIdx)+"_*.bin"); err != nil {
+				return
+			}
+		}
+	}
+	// resetFragFiles discards the fragmentomics output of a failed job.
+	resetFragFiles := func(jobIdx int) error {
+		if err := resetTmpFile(fragEndFiles[jobIdx]); err != nil {
+			return err
+		}
+		if wpsFiles != nil {
+			return resetTmpFile(wpsFiles[jobIdx])
 		}
-		psCtx.readPair[0].seq8 = make([]byte, 0, maxReadLen)
-		psCtx.readPair[1].seq8 = make([]byte, 0, maxReadLen)
+		return nil
+	}
 
-		for _, shard := range shardSlice {
-			// May as well skip completely-nonoverlapping shards.
-			if intersectionIsEmpty(&shard, headerRefs, &pCtx.bedPart) {
-				continue
+	log.Printf("pileupSNPMain: starting main loop (%d jobs)\n", len(tmpFiles))
+	header, _ := opts.provider.GetHeader()
+	census := newReadCensus(len(header.Refs()))
+	var concordance *mateConcordance
+	if opts.hetSites != nil {
+		concordance = &mateConcordance{}
+	}
+	var metrics *runMetrics
+	if opts.metrics != nil {
+		metrics = &runMetrics{m: newPileupMetrics()}
+	}
+	quarantined := make([]*quarantineEntry, parallelism)
+	unprocessed := make([][]gbam.Shard, len(tmpFiles))
+	reporter := startProgress(len(tmpFiles), opts.throttle, opts.tempDir, header.Refs(), opts.progress)
+	err = traverse.Limit(parallelism).Each(len(tmpFiles), func(taskIdx int) error {
+		activity := reporter.taskStarted(taskIdx)
+		defer reporter.taskDone(taskIdx)
+		jobIdx := taskIdx % parallelism
+		if e := resumed[taskIdx]; e != nil {
+			census.merge(&readCensus{counts: e.Census, lengths: e.Lengths})
+			return nil
+		}
+		if !opts.deadline.IsZero() && time.Now().After(opts.deadline) {
+			// Out of time before the job started; it gets an empty
+			// intermediate file.
+			unprocessed[taskIdx] = jobShards(jobIdx)
+			return newPileupRowWriter(tmpFiles[taskIdx], opts.shardCodec).Finish()
+		}
+		jobOpts := opts
+		if len(opts.samples) > 0 {
+			sampleOpts := *opts
+			sampleOpts.provider = opts.samples[taskIdx/parallelism].provider
+			jobOpts = &sampleOpts
+		}
+		shardSlice := jobShards(jobIdx)
+		var frag *fragOutput
+		if frags != nil {
+			frag = &fragOutput{agg: frags, ends: fragEndFiles[jobIdx]}
+			if wpsFiles != nil {
+				frag.wps = wpsFiles[jobIdx]
 			}
-			if e := results.processShard(shard, opts, &rCtx, &pCtx, &psCtx); e != nil {
-				return e
+		}
+		var e error
+		for attempt := 0; attempt <= opts.shardRetries; attempt++ {
+			if attempt > 0 {
+				log.Error.Printf("pileupSNPMain: job %d failed (attempt %d of %d): %v", taskIdx, attempt, opts.shardRetries+1, e)
+				if e = resetTmpFile(tmpFiles[taskIdx]); e != nil {
+					return e
+				}
+				if frag != nil {
+					if e = resetFragFiles(jobIdx); e != nil {
+						return e
+					}
+				}
+			}
+			taskCensus := newReadCensus(len(header.Refs()))
+			unprocessed[taskIdx] = nil
+			if e = pileupJob(jobOpts, strandReq, shardSlice, newPileupRowWriter(tmpFiles[taskIdx], opts.shardCodec), nCirc, &qpt, taskCensus, frag, opts.haplotypes, concordance, metrics, &unprocessed[taskIdx], activity); e == nil {
+				census.merge(taskCensus)
+				if ckpt != nil {
+					return ckpt.record(taskIdx, tmpFiles[taskIdx], taskCensus)
+				}
+				return nil
 			}
-			psCtx.shardOverlap = true
-			coordRange := gbam.ShardToCoordRange(shard)
-			psCtx.prevLimitID = int(coordRange.Limit.RefId)
-			psCtx.prevLimitPos = int(coordRange.Limit.Pos) + int(padding)
 		}
-		// Flush last entries, unless there were no entries at all.
-		if e := results.finishRef(len(headerRefs), opts, &rCtx, &pCtx); e != nil {
+		if !opts.quarantine {
 			return e
 		}
-
-		return results.w.Finish()
+		log.Error.Printf("pileupSNPMain: job %d failed %d times, quarantining its region: %v", jobIdx, opts.shardRetries+1, e)
+		quarantined[jobIdx] = newQuarantineEntry(shardSlice, opts.shardRetries+1, e)
+		// Leave a valid, empty intermediate file behind, so that the rest of the
+		// run can complete.
+		if e = resetTmpFile(tmpFiles[jobIdx]); e != nil {
+			return e
+		}
+		if frag != nil {
+			if e = resetFragFiles(jobIdx); e != nil {
+				return e
+			}
+		}
+		return newPileupRowWriter(tmpFiles[jobIdx], opts.shardCodec).Finish()
 	})
+	reporter.stop(err)
 	if err != nil {
 		return
 	}
-	log.Printf("pileupSNPMain: main loop complete")
+	log.Printf("pileupSNPMain: main loop complete; input %s", formatThroughput(opts.throttle.Stats()))
+	if opts.umiConsensus != nil {
+		log.Printf("pileupSNPMain: UMI consensus: %v", opts.umiConsensus.stats)
+	}
+	if opts.activeRegions != nil {
+		log.Printf("pileupSNPMain: active regions: %v", opts.activeRegions.stats)
+	}
+	if opts.maxDepth != nil {
+		log.Printf("pileupSNPMain: max depth: %d reads dropped", atomic.LoadInt64(opts.maxDepth.dropped))
+	}
+	if opts.memBudget != nil {
+		log.Printf("pileupSNPMain: memory budget: %v", opts.memBudget)
+	}
 	mainPath := opts.outPrefix
 	if strandReq == pileup.StrandFwd {
 		mainPath = mainPath + ".strand.fwd"
 	} else if strandReq == pileup.StrandRev {
 		mainPath = mainPath + ".strand.rev"
 	}
-	header, _ := opts.provider.GetHeader()
+	if err = writeQuarantineReport(ctx, mainPath, quarantined); err != nil {
+		return
+	}
+	if err = writePartialReport(ctx, mainPath, opts, nShard, unprocessed, header.Refs()); err != nil {
+		return
+	}
+	if err = writeReadCensus(ctx, mainPath, census, header.Refs()); err != nil {
+		return
+	}
+	if err = writeReadLengths(ctx, mainPath, census, header.Refs()); err != nil {
+		return
+	}
+	provenance := opts.provenance()
+	if err = writeProvenance(ctx, mainPath, provenance); err != nil {
+		return
+	}
 	var refNames []string
 	for _, ref := range header.Refs() {
 		refNames = append(refNames, ref.Name())
 	}
+	if opts.depthHist {
+		if err = writeDepthHists(ctx, mainPath, tmpFiles, &opts.bedUnion, refNames); err != nil {
+			return
+		}
+	}
+	if opts.haplotypes != nil {
+		if err = writeHaplotypeCounts(ctx, mainPath, opts.haplotypes, refNames, opts.refSeqs); err != nil {
+			return
+		}
+	}
+	if opts.hotspots != nil {
+		if err = writeHotspotReport(ctx, tmpFiles, mainPath, opts.hotspots, opts.minAltFrac, refNames, opts.annotator); err != nil {
+			return
+		}
+	}
+	if opts.methylation != nil {
+		if err = writeMethylationReport(ctx, tmpFiles, mainPath, opts.methylation, refNames, opts.refSeqs); err != nil {
+			return
+		}
+	}
+	if opts.modBase != nil {
+		if err = writeModBaseReport(ctx, tmpFiles, mainPath, opts.modBase, refNames); err != nil {
+			return
+		}
+	}
+	if concordance != nil {
+		if err = writeMateConcordance(ctx, mainPath, concordance); err != nil {
+			return
+		}
+	}
+	if metrics != nil {
+		if err = writeMetrics(ctx, mainPath, opts.metrics, metrics.m, &opts.bedUnion, refNames); err != nil {
+			return
+		}
+	}
+	if opts.auditBoundaries {
+		var nBad int
+		var reportPath string
+		if nBad, reportPath, err = auditShardBoundaries(ctx, opts, strandReq, tmpFiles, mainPath, nCirc, &qpt); err != nil {
+			return
+		}
+		if nBad > 0 {
+			// Still write the main output, since it may help with debugging.
+			defer func() {
+				if err == nil {
+					err = fmt.Errorf("pileupSNPMain: boundary audit found %d discrepancies; see %s", nBad, reportPath)
+				}
+			}()
+		}
+	}
+	if frags != nil {
+		if err = writeFragmentomics(ctx, mainPath, frags, fragEndFiles, refNames, provenance); err != nil {
+			return
+		}
+		if wpsFiles != nil {
+			if err = writeWPS(ctx, mainPath, opts.wpsWindow, wpsFiles, header.Refs(), opts.tempDir); err != nil {
+				return
+			}
+		}
+	}
+	if len(opts.samples) > 0 {
+		return convertPileupRowsToMultiSampleTSV(ctx, tmpFiles, parallelism, mainPath, opts.samples, opts.colBitset, opts.somatic, opts.compression, opts.parallelism, refNames, opts.refSeqs)
+	}
+	if opts.windowSize > 0 {
+		var refLens []PosType
+		for _, ref := range header.Refs() {
+			refLens = append(refLens, PosType(ref.Len()))
+		}
+		return convertPileupRowsToWindows(ctx, tmpFiles, mainPath, opts.windowSize, opts.windowStep, opts.windowStats, opts.compression, opts.parallelism, refNames, refLens, opts.refSeqs)
+	}
 	switch opts.format {
-	case formatTSV:
-		err = convertPileupRowsToTSV(ctx, tmpFiles, mainPath, opts.colBitset, false, opts.parallelism, refNames, opts.refSeqs)
-	case formatTSVBgz:
-		err = convertPileupRowsToTSV(ctx, tmpFiles, mainPath, opts.colBitset, true, opts.parallelism, refNames, opts.refSeqs)
+	case formatTSV, formatTSVBgz, formatTSVZst:
+		err = convertPileupRowsToTSV(ctx, tmpFiles, mainPath, opts.colBitset, opts.compression, opts.parallelism, refNames, opts.refSeqs, opts.annotator, opts.columns, opts.rowFilter)
 	case formatBasestrandRio:
-		err = convertPileupRowsToBasestrandRio(ctx, tmpFiles, mainPath, refNames)
-	case formatBasestrandTSV:
-		err = convertPileupRowsToBasestrandTSV(ctx, tmpFiles, mainPath, opts.colBitset, false, opts.parallelism, refNames, opts.refSeqs)
-	case formatBasestrandTSVBgz:
-		err = convertPileupRowsToBasestrandTSV(ctx, tmpFiles, mainPath, opts.colBitset, true, opts.parallelism, refNames, opts.refSeqs)
+		err = convertPileupRowsToBasestrandRio(ctx, tmpFiles, mainPath, refNames, opts.rowFilter)
+	case formatBasestrandTSV, formatBasestrandTSVBgz, formatBasestrandTSVZst:
+		err = convertPileupRowsToBasestrandTSV(ctx, tmpFiles, mainPath, opts.colBitset, opts.compression, opts.parallelism, refNames, opts.refSeqs, opts.columns, opts.rowFilter)
+	case formatConsensusFASTQ:
+		err = convertPileupRowsToConsensusFASTQ(ctx, tmpFiles, mainPath, refNames, opts.rowFilter)
+	case formatVCF, formatVCFBgz:
+		sampleName := vcfSampleName(header, filepath.Base(opts.outPrefix))
+		var ku *kmerUniqueness
+		if opts.kmerUniqueness > 0 {
+			if ku, err = newKmerUniqueness(tmpFiles, opts.kmerUniqueness, opts.minAltFrac, opts.refSeqs, opts.parallelism); err != nil {
+				return
+			}
+		}
+		err = convertPileupRowsToVCF(ctx, tmpFiles, mainPath, opts.fapath, sampleName, opts.minAltFrac, opts.compression, opts.parallelism, header.Refs(), opts.refSeqs, provenance, opts.annotator, ku, opts.rowFilter)
+	case formatMPileup, formatMPileupBgz:
+		err = convertPileupRowsToMPileup(ctx, tmpFiles, mainPath, opts.compression, opts.parallelism, refNames, opts.refSeqs, opts.rowFilter)
+	case formatGVCF, formatGVCFBgz:
+		sampleName := vcfSampleName(header, filepath.Base(opts.outPrefix))
+		err = convertPileupRowsToGVCF(ctx, tmpFiles, mainPath, opts.fapath, sampleName, opts.gqBands, opts.compression, opts.parallelism, header.Refs(), opts.refSeqs, provenance)
+	case formatParquet:
+		err = convertPileupRowsToParquet(ctx, tmpFiles, mainPath, opts.colBitset, opts.rowGroupSize, refNames, opts.refSeqs, provenance, opts.columns, opts.rowFilter)
+	}
+	if (err == nil) && (opts.rowFilter != nil) {
+		log.Printf("pileupSNPMain: row filter: %v", opts.rowFilter)
 	}
 	return
 }
 
-func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawOpts *Opts, refSeqs [][]byte) (err error) {
+// circBufferSize returns the size of the circular buffers of the main loop.
+func circBufferSize(opts *pileupSNPOpts) PosType {
+	// When we aren't stitching, it is always safe to flush final pileup results
+	// for all positions before the current read-start; we only need to keep
+	// track of the maxReadSpan positions past that point.
+	// However, when stitching, we also need to track the maxReadSpan positions
+	// before the current read-start, since there may be a read-pair where the
+	// first read starts almost that far behind us, we haven't encountered the
+	// second read yet, and there's some overlap between the two read-sides.
+	nCirc := PosType(circular.NextExp2(opts.maxReadSpan))
+	if opts.stitch {
+		nCirc = nCirc * 2
+	}
+	return nCirc
+}
+
+func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawOpts *Opts, refSeqs [][]byte) error {
+	f, ok := formatNameMap[format]
+	if !ok {
+		return fmt.Errorf("Pileup: unrecognized format= argument")
+	}
+	return pileupInternal(ctx, []string{xampath}, fapath, f, outPrefix, rawOpts, refSeqs, nil, nil)
+}
+
+// pileupInternal implements Pileup, PileupSamples, StreamPileup and RunTask.
+// emit must be non-nil iff format is formatStream.  xampaths has more than one
+// element iff this is a multi-sample run.  If task is non-nil, only that task
+// of the main loop is run.
+func pileupInternal(ctx context.Context, xampaths []string, fapath string, format outputFormat, outPrefix string, rawOpts *Opts, refSeqs [][]byte, emit func(*Row) error, task *Task) (err error) {
+	if (rawOpts.Hooks != nil) && (rawOpts.Hooks.OnFinish != nil) {
+		defer func() {
+			rawOpts.Hooks.OnFinish(err)
+		}()
+	}
 	// 1. Parse and validate command-line parameters
 	// 2. Read .bam header, BED, .fa
 	// 3. Construct disjoint shards with necessary padding
 	var opts pileupSNPOpts
+	opts.hooks = rawOpts.Hooks
+	opts.progress = rawOpts.Progress
 	opts.clip = rawOpts.Clip
 	opts.maxReadLen = rawOpts.MaxReadLen
 	if (opts.clip < 0) || (opts.clip*2 >= opts.maxReadLen) {
@@ -980,6 +2591,8 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 	opts.fapath = fapath
 	opts.flagExclude = rawOpts.FlagExclude
 	opts.mapq = rawOpts.Mapq
+	opts.seed = rawOpts.Seed
+	opts.newRandSource = rawOpts.NewRandSource
 
 	opts.maxReadSpan = rawOpts.MaxReadSpan
 	if opts.maxReadLen > opts.maxReadSpan {
@@ -997,41 +2610,166 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 
 	opts.removeSq = rawOpts.RemoveSq
 	opts.tempDir = rawOpts.TempDir
-	// can look up a map instead
-	if format == "basestrand-rio" {
-		opts.format = formatBasestrandRio
-	} else if format == "basestrand-tsv" {
-		opts.format = formatBasestrandTSV
-	} else if format == "basestrand-tsv-bgz" {
-		opts.format = formatBasestrandTSVBgz
-	} else if format == "tsv" {
-		opts.format = formatTSV
-	} else if format == "tsv-bgz" {
-		opts.format = formatTSVBgz
-	} else {
-		return fmt.Errorf("Pileup: unrecognized format= argument")
-	}
+	opts.format = format
+	opts.emit = emit
 	colBitsetDefault := colBitDpRef | colBitHighQ | colBitLowQ
+	if opts.format == formatConsensusFASTQ {
+		// The consensus quality is computed from per-read base-quals.
+		colBitsetDefault = colBitQuals
+	} else if opts.format.isMPileup() {
+		// The base-quality column needs per-read base-quals.
+		colBitsetDefault = colBitQuals | colBitIndels
+	} else if opts.format.isGVCF() {
+		// The genotype likelihoods are computed from per-read base-quals.
+		colBitsetDefault = colBitQuals
+	} else if (opts.format == formatStream) || (opts.format == formatParquet) {
+		colBitsetDefault = 0
+	}
 	if rawOpts.Cols != "" {
 		if opts.format == formatBasestrandRio {
 			return fmt.Errorf("Pileup: -cols cannot be used with basestrand-rio output")
 		}
+		if opts.format == formatConsensusFASTQ {
+			return fmt.Errorf("Pileup: -cols cannot be used with consensus-fastq output")
+		}
+		if opts.format.isVCF() {
+			return fmt.Errorf("Pileup: -cols cannot be used with vcf output")
+		}
+		if opts.format.isMPileup() {
+			return fmt.Errorf("Pileup: -cols cannot be used with mpileup output")
+		}
+		if opts.format.isGVCF() {
+			return fmt.Errorf("Pileup: -cols cannot be used with gvcf output")
+		}
 		if opts.colBitset, err = pileup.ParseCols(rawOpts.Cols, colNameMap, colBitsetDefault); err != nil {
 			return err
 		}
+		if (opts.format == formatStream) && ((opts.colBitset & colPerReadMask) != 0) {
+			return fmt.Errorf("StreamPileup: per-read column sets are not supported")
+		}
+		if ((opts.colBitset & colBitReadFeatures) != 0) && !opts.format.isTSV() {
+			return fmt.Errorf("Pileup: readfeats column set is only supported with tsv output")
+		}
+		if ((opts.colBitset & colBitSketch) != 0) && !opts.format.isTSV() {
+			return fmt.Errorf("Pileup: sketch column set is only supported with tsv output")
+		}
+		if ((opts.colBitset & colBitBiasStats) != 0) && !opts.format.isTSV() {
+			return fmt.Errorf("Pileup: biasstats column set is only supported with tsv output")
+		}
+		if ((opts.colBitset & colBitQualWeights) != 0) && !opts.format.isTSV() && (opts.format != formatBasestrandTSV) && (opts.format != formatBasestrandTSVBgz) && (opts.format != formatBasestrandTSVZst) {
+			return fmt.Errorf("Pileup: qualweights column set is only supported with tsv and basestrand-tsv output")
+		}
+		if ((opts.colBitset & colBitExtBases) != 0) && (opts.format != formatBasestrandTSV) && (opts.format != formatBasestrandTSVBgz) && (opts.format != formatBasestrandTSVZst) && (opts.format != formatStream) {
+			return fmt.Errorf("Pileup: extbases column set is only supported with basestrand-tsv and stream output")
+		}
+		if ((opts.colBitset & colBitHapCounts) != 0) && !opts.format.isTSV() && (opts.format != formatBasestrandTSV) && (opts.format != formatBasestrandTSVBgz) && (opts.format != formatBasestrandTSVZst) {
+			return fmt.Errorf("Pileup: hapcounts column set is only supported with tsv and basestrand-tsv output")
+		}
 	} else {
 		opts.colBitset = colBitsetDefault
 	}
 
-	dropFields := []gbam.FieldType{
-		gbam.FieldTempLen,
+	if (rawOpts.DownsampleFrac < 0) || (rawOpts.DownsampleFrac > 1) || (rawOpts.DownsampleBinWidth < 0) {
+		return fmt.Errorf("Pileup: invalid downsample= or downsample-bin-width= argument")
+	}
+	if (rawOpts.DownsampleFrac > 0) && (rawOpts.DownsampleFrac < 1) {
+		opts.downsampleFrac = rawOpts.DownsampleFrac
+		opts.downsampleBin = rawOpts.DownsampleBinWidth
+		if opts.downsampleBin == 0 {
+			opts.downsampleBin = 10
+		}
+	}
+
+	if opts.shardCodec, err = parseShardCodec(rawOpts.ShardCodec, rawOpts.ShardBlockItems); err != nil {
+		return err
+	}
+	if opts.shardSchedule, err = parseShardSchedule(rawOpts.ShardSchedule); err != nil {
+		return err
+	}
+	if rawOpts.Pad < 0 {
+		return fmt.Errorf("Pileup: invalid pad= argument")
+	}
+	if (rawOpts.Pad > 0) && (rawOpts.BedPath == "") {
+		return fmt.Errorf("Pileup: pad= requires bed=")
+	}
+	if rawOpts.BedOverrides && (rawOpts.BedPath == "") {
+		return fmt.Errorf("Pileup: bed-overrides= requires bed=")
+	}
+	if (opts.shardSchedule == scheduleTargets) && (rawOpts.BedPath == "") && (rawOpts.Hotspots == "") {
+		return fmt.Errorf("Pileup: shard-schedule=targets requires bed= or hotspots=")
+	}
+	if rawOpts.EndMotifWeights != "" {
+		if opts.endMotifWeights, err = loadEndMotifWeights(ctx, rawOpts.EndMotifWeights); err != nil {
+			return fmt.Errorf("Pileup: invalid end-motif-weights= argument: %v", err)
+		}
+	}
+
+	if opts.readFilter, err = compileReadFilter(rawOpts.ReadFilter); err != nil {
+		return err
+	}
+	if opts.dedup, opts.dedupUMITag, err = parseDedupOpts(rawOpts.Dedup, rawOpts.DedupUMITag); err != nil {
+		return err
+	}
+	if opts.umiConsensus, err = parseUMIConsensusOpts(rawOpts.UMIConsensusTag, rawOpts.UMIMinFamilySize); err != nil {
+		return err
+	}
+	if (opts.umiConsensus != nil) && (opts.dedup != dedupNone) {
+		// The consensus reads of the duplicates of a fragment are already
+		// merged, up to UMI errors.
+		return fmt.Errorf("Pileup: umi-consensus-tag= cannot be combined with dedup=")
+	}
+	if opts.activeRegions, err = parseActiveRegionOpts(rawOpts.ActiveRegions, rawOpts.ActiveRegionMinFrac); err != nil {
+		return err
+	}
+	if opts.maxDepth, err = parseMaxDepthOpts(rawOpts.MaxDepth, rawOpts.MaxDepthMode, rawOpts.Seed, rawOpts.BedOverrides); err != nil {
+		return err
+	}
+	if opts.sketchDepth, err = parseSketchDepth(rawOpts.SketchDepth); err != nil {
+		return err
+	}
+	if (opts.sketchDepth > 0) && ((opts.colBitset & colPerReadMask) == 0) {
+		return fmt.Errorf("Pileup: sketch-depth= requires a per-read column set")
 	}
-	if opts.minBagDepth == 0 {
+	if opts.memBudget, err = parseMemBudget(rawOpts.MemoryBudgetMiB); err != nil {
+		return err
+	}
+	if (opts.memBudget != nil) && (opts.emit != nil) {
+		// The streamed rows aren't held.
+		return fmt.Errorf("StreamPileup: MemoryBudgetMiB is not supported")
+	}
+	if opts.modBase, err = parseModBaseOpts(rawOpts.ModBase); err != nil {
+		return err
+	}
+	if (opts.modBase != nil) && (opts.emit != nil) {
+		return fmt.Errorf("StreamPileup: ModBase is not supported")
+	}
+
+	var dropFields []gbam.FieldType
+	if (opts.downsampleFrac == 0) && (opts.endMotifWeights == nil) && (opts.dedup == dedupNone) && (opts.umiConsensus == nil) && ((opts.maxDepth == nil) || !opts.maxDepth.byFragment) && ((opts.readFilter == nil) || !opts.readFilter.needsTempLen) && (rawOpts.MaxInsertSize == 0) {
+		// Downsampling stratifies by TLEN, end-motif weighting uses it to
+		// locate the far end of the fragment, and all five use it to
+		// recognize the reads of a pair.  The read filter may use it as
+		// fraglen, and max-insert-size caps it.
+		dropFields = append(dropFields, gbam.FieldTempLen)
+	}
+	if (opts.minBagDepth == 0) && ((opts.colBitset & colBitReadFeatures) == 0) && (opts.dedupUMITag == sam.Tag{}) && (opts.umiConsensus == nil) && (opts.modBase == nil) {
+		// readfeats needs the NM and RG tags, dedup-umi-tag and
+		// umi-consensus-tag need the UMI, and mod-base needs the MM and ML
+		// tags.
 		dropFields = append(dropFields, gbam.FieldAux)
 	}
-	opts.provider = bamprovider.NewProvider(xampath, bamprovider.ProviderOpts{
+	if (rawOpts.MaxReadMiBPerSec < 0) || (rawOpts.MaxReadOpsPerSec < 0) {
+		return fmt.Errorf("Pileup: invalid max-read-mib-per-sec= or max-read-ops-per-sec= argument")
+	}
+	// Without limits, the throttle only measures the throughput for the
+	// progress reports.
+	opts.throttle = iothrottle.New(int64(rawOpts.MaxReadMiBPerSec*(1<<20)), rawOpts.MaxReadOpsPerSec)
+	providerOpts := bamprovider.ProviderOpts{
 		Index:      rawOpts.BamIndexPath,
-		DropFields: dropFields})
+		DropFields: dropFields,
+		Reference:  fapath,
+		Throttle:   opts.throttle}
+	opts.provider = bamprovider.NewProvider(xampaths[0], providerOpts)
 	defer func() {
 		if e := opts.provider.Close(); e != nil && err == nil {
 			err = e
@@ -1040,6 +2778,9 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 
 	var header *sam.Header
 	var regionEntry interval.Entry
+	if (rawOpts.Hotspots != "") && ((rawOpts.Region != "") || (rawOpts.BedPath != "")) {
+		return fmt.Errorf("Pileup: hotspots= cannot be combined with bed= or region=")
+	}
 	if (rawOpts.Region != "") || (rawOpts.BedPath != "") {
 		if header, err = opts.provider.GetHeader(); err != nil {
 			return
@@ -1055,31 +2796,101 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 				// perform the necessary intersection operation.
 				return fmt.Errorf("Pileup: -region and -bed flags can't be used together yet")
 			}
-			if opts.bedUnion, err = interval.NewBEDUnionFromPath(rawOpts.BedPath, interval.NewBEDOpts{SAMHeader: header}); err != nil {
+			if opts.bedUnion, err = interval.NewBEDUnionFromPath(rawOpts.BedPath, interval.NewBEDOpts{SAMHeader: header, Padding: PosType(rawOpts.Pad)}); err != nil {
 				return
 			}
+			if rawOpts.BedOverrides {
+				defaults := regionThresholds{minBaseQual: byte(opts.minBaseQual), mapq: opts.mapq, maxDepth: rawOpts.MaxDepth}
+				var qpt qualPassTable
+				if qpt, err = newQualPassTable(defaults.minBaseQual); err != nil {
+					return
+				}
+				defaults.qpt = &qpt
+				if opts.overrides, err = loadRegionOverrides(ctx, rawOpts.BedPath, header.Refs(), defaults); err != nil {
+					return fmt.Errorf("Pileup: invalid bed= overrides: %v", err)
+				}
+				if opts.maxDepth != nil {
+					if opts.overrides.maxDepth {
+						opts.maxDepth.overrides = opts.overrides
+					} else if opts.maxDepth.maxDepth == 0 {
+						if rawOpts.MaxDepthMode != "" {
+							return fmt.Errorf("Pileup: max-depth-mode= requires max-depth= or max_depth overrides")
+						}
+						opts.maxDepth = nil
+					}
+				}
+			}
+			if rawOpts.ShardSchedule == "" {
+				opts.shardSchedule = scheduleTargets
+			}
 		} else if rawOpts.Region != "" {
 			if opts.bedUnion, err = interval.NewBEDUnionFromEntries([]interval.Entry{regionEntry}, interval.NewBEDOpts{SAMHeader: header}); err != nil {
 				return
 			}
 		}
+	} else if rawOpts.Hotspots != "" {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: Hotspots is not supported")
+		}
+		if header, err = opts.provider.GetHeader(); err != nil {
+			return
+		}
+		if opts.hotspots, err = loadHotspots(ctx, rawOpts.Hotspots, header.Refs()); err != nil {
+			return fmt.Errorf("Pileup: invalid hotspots= argument: %v", err)
+		}
+		if opts.bedUnion, err = interval.NewBEDUnionFromEntries(hotspotEntries(opts.hotspots, header.Refs()), interval.NewBEDOpts{SAMHeader: header}); err != nil {
+			return
+		}
+		if rawOpts.ShardSchedule == "" {
+			opts.shardSchedule = scheduleTargets
+		}
 	} else {
-		return fmt.Errorf("Pileup: either -bed or -region is currently required")
+		return fmt.Errorf("Pileup: either -bed, -region or -hotspots is currently required")
 	}
 	headerRefs := header.Refs()
+	if opts.circular, err = parseCircularContigs(rawOpts.Circular, headerRefs); err != nil {
+		return
+	}
 
 	// padding requirement increases if we need to keep track of fragment lengths
 	opts.padding = rawOpts.MaxReadSpan
 
-	if regionEntry.RefName == "" {
+	if rawOpts.ShardPlan != "" {
+		if regionEntry.RefName != "" {
+			return fmt.Errorf("Pileup: shard-plan= cannot be combined with region=")
+		}
+		var plan *shardPlan
+		if plan, err = readShardPlan(ctx, rawOpts.ShardPlan); err != nil {
+			return fmt.Errorf("Pileup: invalid shard-plan= argument: %v", err)
+		}
+		var costs []float64
+		if opts.shards, costs, err = plan.shards(headerRefs, opts.padding); err != nil {
+			return fmt.Errorf("Pileup: invalid shard-plan= argument: %s: %v", rawOpts.ShardPlan, err)
+		}
+		opts.jobStarts = balanceJobs(costs, opts.parallelism)
+		log.Printf("Pileup: reusing the %d shards of %s", len(opts.shards), rawOpts.ShardPlan)
+	} else if regionEntry.RefName == "" {
 		// Easiest to join the results at the end if we have each job process huge
 		// disjoint (up to padding) chunks of the genome, so let's start with that
 		// strategy.  Can experiment with finer-grained parallelism later.
-		if opts.shards, err = opts.provider.GenerateShards(bamprovider.GenerateShardsOpts{
-			Padding:   opts.padding,
-			NumShards: opts.parallelism,
-		}); err != nil {
-			return
+		switch opts.shardSchedule {
+		case scheduleTargets:
+			if opts.shards, opts.jobStarts = targetShards(headerRefs, &opts.bedUnion, opts.parallelism, opts.padding); len(opts.shards) == 0 {
+				// The BED doesn't cover anything; fall back to the balanced
+				// schedule, so that the run still writes its (empty) output.
+				opts.shardSchedule = scheduleBalanced
+				opts.jobStarts = nil
+			}
+		case scheduleContig:
+			opts.shards, opts.jobStarts = contigAffinityShards(headerRefs, opts.parallelism, opts.padding)
+		}
+		if opts.shardSchedule == scheduleBalanced {
+			if opts.shards, err = opts.provider.GenerateShards(bamprovider.GenerateShardsOpts{
+				Padding:   opts.padding,
+				NumShards: opts.parallelism,
+			}); err != nil {
+				return
+			}
 		}
 	} else {
 		// todo: add automatic sub-sharder to bamprovider
@@ -1104,15 +2915,407 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 	}
 
 	if refSeqs == nil {
-		if opts.refSeqs, err = pileup.LoadFa(ctx, fapath, 250000000, headerRefs); err != nil {
+		if opts.refSeqs, err = pileup.LoadReference(ctx, fapath, 250000000, headerRefs); err != nil {
 			return
 		}
 	} else {
 		opts.refSeqs = refSeqs
 	}
+	if opts.hotspots != nil {
+		if err = checkHotspotRefs(opts.hotspots, headerRefs, opts.refSeqs); err != nil {
+			return fmt.Errorf("Pileup: invalid hotspots= argument: %v", err)
+		}
+	}
 
 	opts.stitch = rawOpts.Stitch
+	if opts.stitch && ((opts.colBitset & colBitIndels) != 0) {
+		// The two ends of a read-pair may disagree about an indel in their
+		// overlap; this needs the same kind of handling as mismatched bases.
+		return fmt.Errorf("Pileup: indels column set not yet supported with -stitch")
+	}
+	if opts.stitch && ((opts.colBitset & colBitExtBases) != 0) {
+		return fmt.Errorf("Pileup: extbases column set not yet supported with -stitch")
+	}
+	if opts.stitch && opts.format.isGVCF() {
+		// The per-read base-quals of stitched bases aren't retained.
+		return fmt.Errorf("Pileup: gvcf output not yet supported with -stitch")
+	}
+	if rawOpts.ClipOverlap {
+		if opts.stitch {
+			return fmt.Errorf("Pileup: clip-overlap= cannot be combined with stitch=")
+		}
+		if (opts.colBitset & colBitIndels) != 0 {
+			// The indels in the overlap would be counted twice.
+			return fmt.Errorf("Pileup: indels column set not yet supported with -clip-overlap")
+		}
+		if (opts.colBitset & colBitExtBases) != 0 {
+			return fmt.Errorf("Pileup: extbases column set not yet supported with -clip-overlap")
+		}
+		// The firstread-table brings the two reads of a pair together.
+		opts.stitch = true
+		opts.clipOverlap = true
+	}
+	if rawOpts.MaxInsertSize < 0 {
+		return fmt.Errorf("Pileup: invalid max-insert-size= argument")
+	}
+	opts.maxInsertSize = rawOpts.MaxInsertSize
+	opts.requireProper = rawOpts.RequireProperPair
+	if opts.longRead, err = parseLongReadOpts(rawOpts.LongRead, rawOpts.MinReadIdentity, rawOpts.HomopolymerIndels); err != nil {
+		return
+	}
+	if opts.longRead != nil {
+		if opts.stitch {
+			return fmt.Errorf("Pileup: long-read= cannot be combined with stitch= or clip-overlap=")
+		}
+		if opts.requireProper || (opts.maxInsertSize > 0) {
+			return fmt.Errorf("Pileup: long-read= cannot be combined with require-proper-pair= or max-insert-size=")
+		}
+		if rawOpts.BAQ {
+			// The HMM parameters are those of short reads.
+			return fmt.Errorf("Pileup: long-read= cannot be combined with baq=")
+		}
+	}
+	opts.baq = rawOpts.BAQ
+	if rawOpts.RecomputeNM && ((opts.colBitset & colBitReadFeatures) == 0) && (opts.longRead == nil) {
+		return fmt.Errorf("Pileup: recompute-nm= requires the readfeats column set or long-read=")
+	}
+	opts.recomputeNM = rawOpts.RecomputeNM
+	if rawOpts.ShardRetries < 0 {
+		return fmt.Errorf("Pileup: invalid shard-retries= argument")
+	}
+	opts.shardRetries = rawOpts.ShardRetries
+	opts.quarantine = rawOpts.Quarantine
+	if rawOpts.TimeBudget < 0 {
+		return fmt.Errorf("Pileup: invalid time-budget= argument")
+	}
+	opts.timeBudget = rawOpts.TimeBudget
+	if opts.timeBudget > 0 {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: TimeBudget is not supported")
+		}
+		if rawOpts.Resume {
+			// A checkpoint would record partially-processed jobs as complete.
+			return fmt.Errorf("Pileup: time-budget= cannot be combined with resume=")
+		}
+	}
+	if rawOpts.Resume {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: Resume is not supported")
+		}
+		if rawOpts.FragmentomicsWindow > 0 {
+			// The fragmentomics features of resumed tasks would be missing.
+			return fmt.Errorf("Pileup: resume= cannot be combined with fragmentomics-window=")
+		}
+		opts.checkpointKey = runFingerprint(xampaths, fapath, rawOpts, opts.shards)
+	}
+	if opts.readPolicies, err = parseReadPolicies(rawOpts); err != nil {
+		return
+	}
+	if (rawOpts.MinAltFrac < 0) || (rawOpts.MinAltFrac > 1) {
+		return fmt.Errorf("Pileup: invalid min-alt-frac= argument")
+	}
+	opts.minAltFrac = rawOpts.MinAltFrac
+	if rawOpts.ParquetRowGroupSize < 0 {
+		return fmt.Errorf("Pileup: invalid parquet-row-group-size= argument")
+	}
+	if (rawOpts.ParquetRowGroupSize > 0) && (opts.format != formatParquet) {
+		return fmt.Errorf("Pileup: parquet-row-group-size= requires parquet output")
+	}
+	opts.rowGroupSize = rawOpts.ParquetRowGroupSize
+	opts.compression = opts.format.compression()
+	switch rawOpts.OutputIndex {
+	case "":
+	case "tbi", "csi":
+		if opts.compression != compressBGZF {
+			return fmt.Errorf("Pileup: output-index= requires a -bgz format")
+		}
+		if rawOpts.WindowSize > 0 {
+			// Window lines span START to END, rather than a single POS.
+			return fmt.Errorf("Pileup: output-index= cannot be combined with window=")
+		}
+		opts.compression = compressBGZFTabix
+		if rawOpts.OutputIndex == "csi" {
+			opts.compression = compressBGZFCSI
+		}
+	default:
+		return fmt.Errorf("Pileup: invalid output-index= argument")
+	}
+	if rawOpts.WindowSize < 0 || rawOpts.WindowStep < 0 {
+		return fmt.Errorf("Pileup: invalid window= or window-step= argument")
+	}
+	if rawOpts.WindowSize > 0 {
+		switch opts.format {
+		case formatTSV, formatTSVBgz, formatTSVZst, formatBasestrandTSV, formatBasestrandTSVBgz, formatBasestrandTSVZst:
+		default:
+			return fmt.Errorf("Pileup: window= is only supported with tsv and basestrand-tsv formats")
+		}
+		if (opts.colBitset & colBitQualWeights) != 0 {
+			return fmt.Errorf("Pileup: qualweights column set cannot be combined with window=")
+		}
+		if (opts.colBitset & colBitHapCounts) != 0 {
+			return fmt.Errorf("Pileup: hapcounts column set cannot be combined with window=")
+		}
+		opts.windowSize = rawOpts.WindowSize
+		opts.windowStep = rawOpts.WindowStep
+		if opts.windowStep == 0 {
+			opts.windowStep = opts.windowSize
+		}
+		if opts.windowStats, err = parseWindowStats(rawOpts.WindowStats); err != nil {
+			return
+		}
+	} else if rawOpts.WindowStep != 0 || rawOpts.WindowStats != "" {
+		return fmt.Errorf("Pileup: window-step= and window-stats= require window=")
+	}
+	if opts.kmerUniqueness, err = parseKmerUniqueness(rawOpts.KmerUniqueness); err != nil {
+		return
+	}
+	if opts.kmerUniqueness > 0 {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: KmerUniqueness is not supported")
+		}
+		if !opts.format.isVCF() {
+			return fmt.Errorf("Pileup: kmer-uniqueness= is only supported with vcf output")
+		}
+	}
+	if (rawOpts.MinDepth != 0) || (rawOpts.MinAltCount != 0) || (rawOpts.Positions != "") {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: MinDepth, MinAltCount and Positions are not supported")
+		}
+		if opts.windowSize > 0 {
+			return fmt.Errorf("Pileup: min-depth=, min-alt-count= and positions= cannot be combined with window=")
+		}
+	}
+	if opts.rowFilter, err = parseRowFilter(ctx, rawOpts, header, opts.refSeqs); err != nil {
+		return
+	}
+	if (opts.rowFilter != nil) && opts.format.isGVCF() {
+		// The reference blocks need every position.
+		return fmt.Errorf("Pileup: min-depth=, min-alt-count= and positions= cannot be combined with gvcf output")
+	}
+	if opts.format.isGVCF() {
+		if opts.gqBands, err = parseGQBands(rawOpts.GQBands); err != nil {
+			return
+		}
+	} else if rawOpts.GQBands != "" {
+		return fmt.Errorf("Pileup: gq-bands= is only supported with gvcf output")
+	}
+	if rawOpts.Annotate != "" {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: Annotate is not supported")
+		}
+		switch opts.format {
+		case formatTSV, formatTSVBgz, formatTSVZst, formatVCF, formatVCFBgz:
+		default:
+			return fmt.Errorf("Pileup: annotate= is only supported with tsv and vcf formats")
+		}
+		if opts.windowSize > 0 {
+			return fmt.Errorf("Pileup: annotate= cannot be combined with window=")
+		}
+		if opts.annotator, err = newAnnotator(ctx, rawOpts.Annotate); err != nil {
+			return fmt.Errorf("Pileup: invalid annotate= argument: %v", err)
+		}
+	}
+	if rawOpts.Columns != "" {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: Columns is not supported")
+		}
+		files := outputColumns(opts.format, opts.colBitset, opts.annotator != nil)
+		if files == nil {
+			return fmt.Errorf("Pileup: columns= is only supported with tsv, basestrand-tsv and parquet formats")
+		}
+		if opts.windowSize > 0 {
+			return fmt.Errorf("Pileup: columns= cannot be combined with window=")
+		}
+		var sels []columnSelection
+		if sels, err = parseColumnSelections(rawOpts.Columns); err != nil {
+			return
+		}
+		if opts.columns, err = newColumnProjections(sels, files); err != nil {
+			return
+		}
+		if rawOpts.OutputIndex != "" {
+			for i, proj := range opts.columns {
+				if !proj.startsWithChromPos(files[i]) {
+					return fmt.Errorf("Pileup: output-index= requires columns= to start with CHROM,POS")
+				}
+			}
+		}
+	}
+	if rawOpts.FragmentomicsWindow < 0 {
+		return fmt.Errorf("Pileup: invalid fragmentomics-window= argument")
+	} else if rawOpts.FragmentomicsWindow > 0 {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: FragmentomicsWindow is not supported")
+		}
+		if rawOpts.PerStrand {
+			// The main loop runs once per strand.
+			return fmt.Errorf("Pileup: fragmentomics-window= cannot be combined with per-strand=")
+		}
+		opts.fragWindow = rawOpts.FragmentomicsWindow
+	}
+	if rawOpts.DepthHistogram {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: DepthHistogram is not supported")
+		}
+		opts.depthHist = true
+	}
+	if opts.metrics, err = parseMetricsOpts(rawOpts.Metrics); err != nil {
+		return
+	}
+	if opts.metrics != nil {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: Metrics is not supported")
+		}
+		if rawOpts.Resume {
+			// The metrics of resumed tasks would be missing.
+			return fmt.Errorf("Pileup: resume= cannot be combined with metrics=")
+		}
+	}
+	if opts.methylation, err = parseMethylationOpts(rawOpts.Methylation); err != nil {
+		return
+	}
+	if (opts.methylation != nil) && (opts.emit != nil) {
+		return fmt.Errorf("StreamPileup: Methylation is not supported")
+	}
+	if rawOpts.HaplotypeSites != "" {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: HaplotypeSites is not supported")
+		}
+		if rawOpts.Resume {
+			// The haplotype counts of resumed tasks would be missing.
+			return fmt.Errorf("Pileup: resume= cannot be combined with haplotype-sites=")
+		}
+		if rawOpts.PerStrand {
+			// The main loop runs once per strand, and the counts would
+			// accumulate across both runs.
+			return fmt.Errorf("Pileup: haplotype-sites= cannot be combined with per-strand=")
+		}
+		if opts.haplotypes, err = loadHaplotypeCounts(ctx, rawOpts.HaplotypeSites, headerRefs); err != nil {
+			return fmt.Errorf("Pileup: invalid haplotype-sites= argument: %v", err)
+		}
+	}
+	if rawOpts.HetSites != "" {
+		if !opts.stitch {
+			// Only stitched pairs are seen together.
+			return fmt.Errorf("Pileup: het-sites= requires stitch= or clip-overlap=")
+		}
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: HetSites is not supported")
+		}
+		if rawOpts.Resume {
+			// The counts of resumed tasks would be missing.
+			return fmt.Errorf("Pileup: resume= cannot be combined with het-sites=")
+		}
+		var hetSites interval.BEDUnion
+		if hetSites, err = interval.NewBEDUnionFromPath(rawOpts.HetSites, interval.NewBEDOpts{SAMHeader: header}); err != nil {
+			return fmt.Errorf("Pileup: invalid het-sites= argument: %v", err)
+		}
+		opts.hetSites = &hetSites
+		opts.dropDiscordant = rawOpts.ExcludeDiscordantPairs
+	} else if rawOpts.ExcludeDiscordantPairs {
+		return fmt.Errorf("Pileup: exclude-discordant-pairs= requires het-sites=")
+	}
+	if rawOpts.WPSWindow < 0 {
+		return fmt.Errorf("Pileup: invalid wps-window= argument")
+	} else if rawOpts.WPSWindow > 0 {
+		if opts.fragWindow == 0 {
+			// The fragments are collected by the fragmentomics pass.
+			return fmt.Errorf("Pileup: wps-window= requires fragmentomics-window=")
+		}
+		opts.wpsWindow = rawOpts.WPSWindow
+	}
+	if rawOpts.AuditBoundaries {
+		if opts.emit != nil {
+			return fmt.Errorf("StreamPileup: AuditBoundaries is not supported")
+		}
+		if opts.quarantine {
+			// Quarantined regions are missing from the output by design.
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with quarantine=")
+		}
+		if opts.timeBudget > 0 {
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with time-budget=")
+		}
+		if opts.downsampleFrac > 0 {
+			// The audit's jobs would sample different fragments.
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with downsample=")
+		}
+		if opts.dedup != dedupNone {
+			// Duplicate sets are tracked per job, so the audit's jobs would
+			// collapse different fragments.
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with dedup=")
+		}
+		if opts.umiConsensus != nil {
+			// Likewise for UMI families.
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with umi-consensus-tag=")
+		}
+		if opts.activeRegions != nil {
+			// Likewise for active regions.
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with active-regions=")
+		}
+		if opts.maxDepth != nil {
+			// The audit's jobs would sample different reads.
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with max-depth=")
+		}
+		if opts.sketchDepth > 0 {
+			// Likewise for the per-read features.
+			return fmt.Errorf("Pileup: audit-boundaries= cannot be combined with sketch-depth=")
+		}
+		opts.auditBoundaries = true
+	}
+	if rawOpts.Executor != nil {
+		if err = checkExecutorOpts(&opts, rawOpts); err != nil {
+			return
+		}
+		opts.executor = newExecutorRun(&opts, xampaths, fapath, format, rawOpts)
+	}
+	if len(xampaths) > 1 {
+		if err = checkMultiSampleOpts(&opts, rawOpts); err != nil {
+			return
+		}
+		var closeSamples func() error
+		opts.samples, closeSamples, err = openSamples(xampaths, opts.provider, providerOpts)
+		defer func() {
+			if e := closeSamples(); e != nil && err == nil {
+				err = e
+			}
+		}()
+		if err != nil {
+			return
+		}
+	}
+	if rawOpts.Somatic {
+		if len(xampaths) != 2 {
+			return fmt.Errorf("Pileup: somatic= requires exactly two inputs, the tumor and the normal")
+		}
+		opts.somatic = true
+	}
+
+	if task != nil {
+		return runTask(ctx, &opts, task)
+	}
+
+	if !rawOpts.SkipDiskCheck && (opts.emit == nil) {
+		// The samples of a multi-sample run are assumed to be of similar size.
+		nRun := len(xampaths)
+		if rawOpts.PerStrand {
+			nRun = 2
+		}
+		if err = preflight(ctx, &opts, xampaths[0], outPrefix, nRun, headerRefs); err != nil {
+			return
+		}
+	}
 
+	if rawOpts.ShardPlanOut != "" {
+		// The timings are indexed by ShardIdx.
+		for i := range opts.shards {
+			opts.shards[i].ShardIdx = i
+		}
+		opts.shardTimer = newShardTimer(len(opts.shards))
+	}
+	if opts.timeBudget > 0 {
+		// Both passes of a per-strand run share the budget.
+		opts.deadline = time.Now().Add(opts.timeBudget)
+	}
 	if rawOpts.PerStrand {
 		// special case: run twice, filtering on different strand each time
 		if err = pileupSNPMain(ctx, &opts, pileup.StrandFwd); err != nil {
@@ -1121,8 +3324,11 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 		if err = pileupSNPMain(ctx, &opts, pileup.StrandRev); err != nil {
 			return
 		}
-	} else {
-		err = pileupSNPMain(ctx, &opts, pileup.StrandNone)
+	} else if err = pileupSNPMain(ctx, &opts, pileup.StrandNone); err != nil {
+		return
+	}
+	if opts.shardTimer != nil {
+		err = writeShardPlan(ctx, rawOpts.ShardPlanOut, newShardPlan(headerRefs, opts.shards, opts.shardTimer))
 	}
 	return
 }
@@ -1,14 +1,24 @@
 package snp
 
 import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/base/vcontext"
+	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/interval"
 	"github.com/grailbio/bio/pileup"
 	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
 	"github.com/grailbio/testutil/assert"
 )
 
@@ -259,7 +269,7 @@ func TestAddOrphanReads(t *testing.T) {
 			for _, samr := range samrs[pos] {
 				span, _ := samr.Cigar.Lengths()
 				readPair[0].mapEnd = PosType(samr.Pos + span)
-				nRead := results.firstReads.addOrRemove(&readPair, samr, pileup.StrandFwd, maxReadSpan)
+				nRead := results.firstReads.addOrRemove(&readPair, samr, pileup.StrandFwd, maxReadSpan, false)
 				nFoundRead += nRead
 				if nRead == 1 {
 					// Lookup should fail iff current position >= halfNPos and mate
@@ -295,3 +305,540 @@ func TestAddOrphanReads(t *testing.T) {
 		}
 	}
 }
+
+func TestEstimateSizes(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	ref2, _ := sam.NewReference("chr2", "", "", 1000000, nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref1, ref2})
+	bedUnion, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 100, End: 200},
+		{RefName: "chr1", Start0: 150, End: 300},
+		{RefName: "chr2", Start0: 0, End: 50},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+	assert.EQ(t, bedSpan(&bedUnion, samHeader.Refs()), int64(250))
+
+	opts := pileupSNPOpts{format: formatTSV, colBitset: colBitDpRef | colBitHighQ}
+	est := estimateSizes(&opts, 1000, 1<<20)
+	assert.EQ(t, est.scratch, int64(1000*scratchBytesPerPos))
+	assert.EQ(t, est.output, int64(40000))
+
+	// Per-read columns scale with the input size, and compression shrinks the
+	// output.
+	opts = pileupSNPOpts{format: formatTSVZst, colBitset: colBitQuals | colBitStrands}
+	est = estimateSizes(&opts, 1000, 1<<20)
+	assert.EQ(t, est.scratch, int64(1000*scratchBytesPerPos+(1<<20)*scratchBytesPerInputByte))
+	assert.EQ(t, est.output, int64((40000+2*(1<<20)*outputBytesPerInputBytePerCol)/textCompressionRatio))
+}
+
+func TestQuarantineReport(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+	mainPath := filepath.Join(tmpdir, "out")
+
+	// No report without quarantined jobs.
+	assert.NoError(t, writeQuarantineReport(ctx, mainPath, []*quarantineEntry{nil, nil}))
+	_, err := ioutil.ReadFile(mainPath + ".quarantine.tsv")
+	assert.NotNil(t, err)
+
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	ref2, _ := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	shards := []gbam.Shard{
+		{StartRef: ref1, Start: 100, EndRef: ref1, End: 1000},
+		{StartRef: ref2, Start: 0, EndRef: ref2, End: 500},
+	}
+	entries := []*quarantineEntry{nil, newQuarantineEntry(shards, 3, errors.New("bad\nblock"))}
+	assert.NoError(t, writeQuarantineReport(ctx, mainPath, entries))
+	data, err := ioutil.ReadFile(mainPath + ".quarantine.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), "#START_CHROM\tSTART\tLIMIT_CHROM\tLIMIT\tATTEMPTS\tERROR\nchr1\t100\tchr2\t500\t3\tbad block\n")
+}
+
+func TestAddIndels(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref1})
+	bedPart, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 100, End: 120},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+	pCtx := pileupContext{bedPart: bedPart, indels: true, indelAlleles: true}
+	pm := newPileupMutable(32, 50, false, nil)
+
+	addRead := func(pos int, cigar sam.Cigar, seq string, isMinus PosType) {
+		samr := &sam.Record{Ref: ref1, Pos: pos, Cigar: cigar}
+		read := readSNP{samr: samr}
+		for i := range seq {
+			read.seq8 = append(read.seq8, byte(strings.IndexByte("=AC?G???T", seq[i])))
+		}
+		pm.addIndels(&read, isMinus, &pCtx)
+	}
+	// 2-base insertion after 105, on both strands.
+	ins := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 6), sam.NewCigarOp(sam.CigarInsertion, 2), sam.NewCigarOp(sam.CigarMatch, 4)}
+	addRead(100, ins, "AAAAAAGTAAAA", 0)
+	addRead(100, ins, "AAAAAAGTAAAA", 1)
+	// Same position, different inserted sequence.
+	addRead(100, ins, "AAAAAACCAAAA", 0)
+	// 3-base deletion after 110.
+	addRead(105, sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 6), sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 4)}, "AAAAAAAAAA", 1)
+	// Deletion with its anchor outside the BED, and an unanchored insertion
+	// after a soft-clip; neither is counted.
+	addRead(90, sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 5), sam.NewCigarOp(sam.CigarDeletion, 10), sam.NewCigarOp(sam.CigarMatch, 5)}, "AAAAAAAAAA", 0)
+	addRead(110, sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 2), sam.NewCigarOp(sam.CigarInsertion, 1), sam.NewCigarOp(sam.CigarMatch, 4)}, "AAGAAAA", 0)
+
+	row := &pm.resultRingBuffer[105&31]
+	assert.EQ(t, row.indelCounts, [nIndelType][2]uint32{{2, 1}, {0, 0}})
+	assert.EQ(t, row.indels, []indelAllele{
+		{insSeq: "GT", counts: [2]uint32{1, 1}},
+		{insSeq: "CC", counts: [2]uint32{1, 0}},
+	})
+	row = &pm.resultRingBuffer[110&31]
+	assert.EQ(t, row.indelCounts, [nIndelType][2]uint32{{0, 0}, {0, 1}})
+	assert.EQ(t, row.indels, []indelAllele{{delLen: 3, counts: [2]uint32{0, 1}}})
+	for pos := 0; pos < 32; pos++ {
+		if pos != 105&31 && pos != 110&31 {
+			assert.EQ(t, pm.resultRingBuffer[pos].indelCounts, [nIndelType][2]uint32{})
+		}
+	}
+}
+
+func TestAddExtBases(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref1})
+	bedPart, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 100, End: 120},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+	pCtx := pileupContext{bedPart: bedPart, extBases: true}
+	pm := newPileupMutable(32, 50, false, nil)
+
+	addRead := func(pos int, cigar sam.Cigar, isMinus PosType) {
+		read := readSNP{samr: &sam.Record{Ref: ref1, Pos: pos, Cigar: cigar}}
+		pm.addExtBases(&read, isMinus, &pCtx)
+	}
+	// Insertion after 105.
+	addRead(100, sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 6), sam.NewCigarOp(sam.CigarInsertion, 2), sam.NewCigarOp(sam.CigarMatch, 4)}, 1)
+	// Deletion of 111..113, on both strands.
+	del := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 6), sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 4)}
+	addRead(105, del, 0)
+	addRead(105, del, 1)
+	// Deletion straddling the start of the BED; only 100 and 101 are counted.
+	addRead(90, sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 8), sam.NewCigarOp(sam.CigarDeletion, 4), sam.NewCigarOp(sam.CigarMatch, 5)}, 0)
+
+	for pos := PosType(96); pos < 128; pos++ {
+		var wantDel, wantIns [2]uint32
+		switch {
+		case pos == 100 || pos == 101:
+			wantDel = [2]uint32{1, 0}
+		case pos == 105:
+			wantIns = [2]uint32{0, 1}
+		case pos >= 111 && pos <= 113:
+			wantDel = [2]uint32{1, 1}
+		}
+		row := &pm.resultRingBuffer[pos&31]
+		assert.EQ(t, row.counts[pileup.BaseDel], wantDel, "pos %d", pos)
+		assert.EQ(t, row.counts[pileup.BaseIns], wantIns, "pos %d", pos)
+		assert.EQ(t, row.counts[pileup.BaseMod], [2]uint32{})
+	}
+
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldExtCounts,
+		refID:         0,
+		pos:           112,
+		payload:       pileupPayload{counts: pm.resultRingBuffer[112&31].counts},
+	}
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow), pr)
+}
+
+func TestPileupRowIndelsRoundTrip(t *testing.T) {
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldIndelCounts | fieldIndelAlleles,
+		refID:         2,
+		pos:           1234,
+		payload: pileupPayload{
+			depth:       7,
+			indelCounts: [nIndelType][2]uint32{{3, 1}, {0, 2}},
+			indels: []indelAllele{
+				{insSeq: "ACGT", counts: [2]uint32{3, 1}},
+				{delLen: 5, counts: [2]uint32{0, 2}},
+			},
+		},
+	}
+	pr.payload.counts[pileup.BaseA][0] = 4
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow), pr)
+}
+
+func TestPerReadFeaturesRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldPerReadA | fieldPerReadG,
+		refID:         1,
+		pos:           100,
+	}
+	for _, b := range []byte{pileup.BaseA, pileup.BaseG} {
+		features := []perReadFeatures{
+			// Extreme values.
+			{dist5p: math.MaxUint32, fraglen: 0, qual: 93, strand: byte(pileup.StrandRev)},
+			{dist5p: 0, fraglen: math.MaxUint32, qual: 63, strand: byte(pileup.StrandNone)},
+			{dist5p: 65535, fraglen: 100000, qual: 20, strand: byte(pileup.StrandFwd)},
+			{dist5p: 0, fraglen: 0, qual: 0, strand: byte(pileup.StrandFwd)},
+		}
+		for i := 0; i < 1000; i++ {
+			features = append(features, perReadFeatures{
+				dist5p:  uint32(r.Intn(500)),
+				fraglen: uint32(r.Intn(1000)),
+				qual:    byte(r.Intn(100)),
+				strand:  byte(r.Intn(3)),
+			})
+		}
+		pr.payload.perRead[b] = features
+		pr.payload.counts[b][0] = uint32(len(features))
+	}
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow), pr)
+
+	_, err = unmarshalPileupRow(data[:len(data)-1])
+	assert.NotNil(t, err)
+}
+
+func TestPerReadExtendedFeatures(t *testing.T) {
+	features := []perReadFeatures{
+		{dist5p: 3, fraglen: 150, qual: 30, strand: byte(pileup.StrandFwd), mapq: 60, readGroup: 2, nm: 1, cycle: 3, clipDist: clipDistNone},
+		{dist5p: 10, fraglen: 151, qual: 93, strand: byte(pileup.StrandRev), mapq: 255, readGroup: 0, nm: 65535, cycle: 140, clipDist: 1},
+	}
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldPerReadC | fieldPerReadExtended,
+		refID:         0,
+		pos:           7,
+	}
+	pr.payload.perRead[pileup.BaseC] = features
+	pr.payload.counts[pileup.BaseC][0] = 2
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow), pr)
+
+	// Without fieldPerReadExtended, as in rows written before it existed, only
+	// the basic features are stored.
+	pr.fieldsPresent &^= fieldPerReadExtended
+	data, err = marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err = unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	gotFeatures := got.(*pileupRow).payload.perRead[pileup.BaseC]
+	assert.EQ(t, gotFeatures[1], perReadFeatures{dist5p: 10, fraglen: 151, qual: 93, strand: byte(pileup.StrandRev)})
+
+	// Rows written before clipDist was widened have fieldPerReadExtended16,
+	// and a 16-bit clipDistNone.
+	pr.fieldsPresent |= fieldPerReadExtended
+	features[0].clipDist = math.MaxUint16
+	data, err = marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	mask := binary.LittleEndian.Uint32(data)
+	binary.LittleEndian.PutUint32(data, mask^(fieldPerReadExtended|fieldPerReadExtended16))
+	got, err = unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow).fieldsPresent, pr.fieldsPresent)
+	gotFeatures = got.(*pileupRow).payload.perRead[pileup.BaseC]
+	assert.EQ(t, gotFeatures[0].clipDist, uint32(clipDistNone))
+	assert.EQ(t, gotFeatures[1], features[1])
+}
+
+func TestReadFeatures(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	refSeq8 := make([]byte, 1000)
+	for i := range refSeq8 {
+		refSeq8[i] = 1 // A
+	}
+	samr := &sam.Record{
+		Name:  "r",
+		Ref:   ref1,
+		Pos:   100,
+		MapQ:  50,
+		Flags: sam.Reverse,
+		// 2S3M1I2M1D2M = 10 read bases.
+		Cigar: []sam.CigarOp{
+			sam.NewCigarOp(sam.CigarHardClipped, 5),
+			sam.NewCigarOp(sam.CigarSoftClipped, 2),
+			sam.NewCigarOp(sam.CigarMatch, 3),
+			sam.NewCigarOp(sam.CigarInsertion, 1),
+			sam.NewCigarOp(sam.CigarMatch, 2),
+			sam.NewCigarOp(sam.CigarDeletion, 1),
+			sam.NewCigarOp(sam.CigarMatch, 2),
+		},
+		Qual: []byte{30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	}
+	read := readSNP{samr: samr, seq8: []byte{2, 2, 1, 2, 1, 8, 1, 1, 1, 4}}
+	// One mismatch in each of the first and last M ops, plus the insertion
+	// and deletion.
+	assert.EQ(t, readEditDistance(&read, refSeq8, false), 4)
+
+	// An NM tag is used unless it's ignored; the result is cached until
+	// convertSamr reuses the readSNP.
+	nmAux, err := sam.NewAux(nmTag, 7)
+	assert.NoError(t, err)
+	samr.AuxFields = sam.AuxFields{nmAux}
+	tagged := readSNP{samr: samr, seq8: read.seq8}
+	assert.EQ(t, readEditDistance(&tagged, refSeq8, false), 7)
+	tagged.samr = nil
+	assert.EQ(t, readEditDistance(&tagged, refSeq8, false), 7)
+	tagged = readSNP{samr: samr, seq8: read.seq8}
+	assert.EQ(t, readEditDistance(&tagged, refSeq8, true), 4)
+	samr.AuxFields = nil
+
+	pCtx := pileupContext{readFeatures: true, refSeq8: refSeq8}
+	var rf readFeatures
+	newReadFeatures(&rf, &read, &pCtx)
+	f := rf.features(2, samr.Qual)
+	assert.EQ(t, f, perReadFeatures{
+		// The read has no mate, so its strand is StrandNone.
+		dist5p: 2, fraglen: 10, qual: 30,
+		mapq: 50, nm: 4, cycle: 7, clipDist: 1,
+	})
+	assert.EQ(t, rf.features(9, samr.Qual).clipDist, uint32(8))
+}
+
+func TestPileupRowExtensions(t *testing.T) {
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldExtensions,
+		refID:         0,
+		pos:           5,
+	}
+	pr.payload.setExtension(extensionTagTest, []byte("old"))
+	pr.payload.setExtension(extensionTagTest+100, []byte{})
+	pr.payload.setExtension(extensionTagTest, []byte("embedding"))
+	assert.EQ(t, len(pr.payload.extensions), 2)
+	assert.EQ(t, string(pr.payload.extension(extensionTagTest)), "embedding")
+	assert.True(t, pr.payload.extension(extensionTagTest+1) == nil)
+
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	gotPayload := &got.(*pileupRow).payload
+	assert.EQ(t, string(gotPayload.extension(extensionTagTest)), "embedding")
+	// Tags unknown to the reader are carried along.
+	assert.EQ(t, gotPayload.extensions[1].tag, extensionTagTest+100)
+	assert.EQ(t, len(gotPayload.extensions[1].data), 0)
+
+	_, err = unmarshalPileupRow(data[:len(data)-1])
+	assert.NotNil(t, err)
+}
+
+func TestQualWeights(t *testing.T) {
+	pm := newPileupMutable(8, 4, false, nil)
+	pm.qualWeighted = true
+	// A (seq8 1) at quals 30 and 10, and N (seq8 15).
+	seq := []byte{1, 1, 15}
+	qual := []byte{30, 10, 30}
+	pm.addBase(0, 0, 0, seq, qual, 20)
+	pm.addBase(0, 1, 1, seq, qual, 20)
+	pm.addBase(0, 2, 0, seq, qual, 20)
+	row := &pm.resultRingBuffer[0]
+	assert.EQ(t, row.counts[pileup.BaseA], [2]uint32{1, 0})
+	// The low-quality base still contributes its weight.
+	assert.EQ(t, row.qualWeights[pileup.BaseA], [2]float32{qualWeightTable[30], qualWeightTable[10]})
+	assert.True(t, math.Abs(float64(qualWeightTable[10])-0.9) < 1e-6)
+
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldQualWeights,
+		refID:         1,
+		pos:           17,
+		payload:       *row,
+	}
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(data)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow).payload.qualWeights, row.qualWeights)
+}
+
+func TestShardBoundaries(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	ref2, _ := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	shards := []gbam.Shard{
+		{StartRef: ref1, Start: 0, EndRef: ref1, End: 400},
+		{StartRef: ref1, Start: 400, EndRef: ref1, End: 1000},
+		// Shards that meet at the end of a reference don't split it.
+		{StartRef: ref2, Start: 0, EndRef: ref2, End: 500},
+		// Neither do disjoint ones.
+		{StartRef: ref2, Start: 600, EndRef: ref2, End: 1000},
+	}
+	assert.EQ(t, shardBoundaries(shards), []shardBoundary{{ref: ref1, pos: 400}})
+
+	row := &Row{Depth: 7}
+	row.Counts[pileup.BaseA] = [2]uint32{3, 2}
+	row.Counts[pileup.BaseX] = [2]uint32{0, 1}
+	row.DelCounts = [2]uint32{1, 0}
+	assert.EQ(t, formatAuditRow(row), "7;3,2,0,0,0,0,0,0,0,1;0,0;1,0")
+	assert.EQ(t, formatAuditRow(nil), ".")
+}
+
+func TestShardCodec(t *testing.T) {
+	for _, tt := range []struct {
+		arg  string
+		want []string
+	}{
+		{"", []string{"zstd 1"}},
+		{"zstd", []string{"zstd 1"}},
+		{"zstd:9", []string{"zstd 9"}},
+		{"zstd 9", []string{"zstd 9"}},
+		{"lz4", []string{lz4TransformerName}},
+		{"snappy", []string{snappyTransformerName}},
+		{"none", nil},
+	} {
+		c, err := parseShardCodec(tt.arg, 0)
+		assert.NoError(t, err)
+		assert.EQ(t, c.transformers, tt.want, tt.arg)
+	}
+	for _, arg := range []string{"zstd:0", "zstd:x", "lz4:1", "gzip"} {
+		_, err := parseShardCodec(arg, 0)
+		assert.HasSubstr(t, err.Error(), "invalid shard-codec=")
+	}
+	for _, blockItems := range []int{-1, int(recordio.MaxPackedItems) + 1} {
+		_, err := parseShardCodec("", blockItems)
+		assert.HasSubstr(t, err.Error(), "invalid shard-block-items=")
+	}
+	c, err := parseShardCodec("", int(recordio.MaxPackedItems))
+	assert.NoError(t, err)
+	assert.EQ(t, c.maxItems, recordio.MaxPackedItems)
+
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	repetitive := []byte(strings.Repeat("ACGT", 1000))
+	zeros := make([]byte, 1<<20)
+	for _, fns := range [][2]func([]byte, [][]byte) ([]byte, error){
+		{snappyCompress, snappyUncompress},
+		{lz4Compress, lz4Uncompress},
+	} {
+		for _, in := range [][][]byte{{random}, {repetitive, random[:10]}, {zeros}, {{}}} {
+			compressed, err := fns[0](nil, in)
+			assert.NoError(t, err)
+			got, err := fns[1](nil, [][]byte{compressed})
+			assert.NoError(t, err)
+			assert.EQ(t, string(got), string(concatTransformInput(in)))
+		}
+	}
+	// A corrupt lz4 header can't make lz4Uncompress allocate a huge buffer.
+	corrupt := make([]byte, binary.MaxVarintLen64)
+	corrupt = append(corrupt[:binary.PutUvarint(corrupt, 1<<50)], 1, 0x10, 'A')
+	_, err = lz4Uncompress(nil, [][]byte{corrupt})
+	assert.HasSubstr(t, err.Error(), "corrupt block header")
+}
+
+func TestFraglenSampler(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 100000, nil, nil)
+	_, _ = sam.NewHeader(nil, []*sam.Reference{ref1})
+	s := newFraglenSampler(0.25, 10)
+	s.startShard(rand.New(rand.NewSource(1)))
+	// 20 short and 20 long fragments, alternating, followed by 8 unpaired
+	// reads.
+	kept := make(map[int]int)
+	for i := 0; i < 40; i++ {
+		fraglen := 150
+		if i%2 == 1 {
+			fraglen = 300
+		}
+		name := "frag" + strconv.Itoa(i)
+		pos := i * 10
+		r1 := &sam.Record{Name: name, Ref: ref1, Pos: pos, MateRef: ref1, MatePos: pos + 5, TempLen: fraglen, Flags: sam.Paired}
+		r2 := &sam.Record{Name: name, Ref: ref1, Pos: pos + 5, MateRef: ref1, MatePos: pos, TempLen: -fraglen, Flags: sam.Paired}
+		keep1 := s.keep(r1)
+		// Both reads of a pair get the same decision.
+		assert.EQ(t, s.keep(r2), keep1)
+		if keep1 {
+			kept[fraglen]++
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if s.keep(&sam.Record{Name: "single", Ref: ref1, Pos: 1000 + i}) {
+			kept[fraglenNone]++
+		}
+	}
+	assert.EQ(t, kept, map[int]int{150: 5, 300: 5, fraglenNone: 2})
+	assert.EQ(t, len(s.pending), 0)
+}
+
+func TestReadLengthStats(t *testing.T) {
+	assert.EQ(t, lengthBin(0), 0)
+	assert.EQ(t, lengthBin(1), 1)
+	assert.EQ(t, lengthBin(100), 7)
+	assert.EQ(t, lengthBin(1<<30), nLengthBin-1)
+
+	var s readLengthStats
+	s.add(&sam.Record{Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 100)}})
+	s.add(&sam.Record{Cigar: sam.Cigar{
+		sam.NewCigarOp(sam.CigarSoftClipped, 40),
+		sam.NewCigarOp(sam.CigarMatch, 30),
+		sam.NewCigarOp(sam.CigarInsertion, 5),
+		sam.NewCigarOp(sam.CigarEqual, 25),
+	}})
+	assert.EQ(t, s.Reads, int64(2))
+	assert.EQ(t, s.Clipped, int64(1))
+	assert.EQ(t, s.AlignedBases, int64(155))
+	assert.EQ(t, s.ClippedBases, int64(40))
+	assert.EQ(t, formatLengthHist(&s.Aligned), "0,0,0,0,0,0,1,1")
+	assert.EQ(t, formatLengthHist(&s.SoftClip), "1,0,0,0,0,0,1")
+
+	var total readLengthStats
+	total.merge(&s)
+	total.merge(&s)
+	assert.EQ(t, total.Reads, int64(4))
+	assert.EQ(t, total.Aligned[7], int64(2))
+	var empty [nLengthBin]int64
+	assert.EQ(t, formatLengthHist(&empty), "0")
+}
+
+func TestApplyReadPolicies(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	// Sets ref1's ID.
+	_, _ = sam.NewHeader(nil, []*sam.Reference{ref1})
+	shardRange := gbam.ShardToCoordRange(gbam.Shard{StartRef: ref1, Start: 100, EndRef: ref1, End: 200})
+	policies := [nCensusBucket]readPolicy{policyDrop, policyKeep, policyKeep}
+	census := newReadCensus(1)
+	reads := []*sam.Record{
+		{Name: "unmapped", Ref: ref1, Pos: 150, Flags: sam.Paired | sam.Unmapped},
+		{Name: "mate_unmapped_mapq0", Ref: ref1, Pos: 150, Flags: sam.Paired | sam.MateUnmapped},
+		{Name: "mapped", Ref: ref1, Pos: 150, MapQ: 60, Flags: sam.Paired},
+		// In the padding, so not counted.
+		{Name: "padding", Ref: ref1, Pos: 99, Flags: sam.Unmapped},
+	}
+	var drops []bool
+	for _, r := range reads {
+		drop, err := applyReadPolicies(r, &policies, census, &shardRange)
+		assert.NoError(t, err)
+		drops = append(drops, drop)
+	}
+	assert.EQ(t, drops, []bool{true, false, false, true})
+	assert.EQ(t, census.counts, [][nCensusBucket]int64{{1, 1, 1}})
+	// Only the mapped reads in the shard range have lengths counted.
+	assert.EQ(t, census.lengths[0].Reads, int64(2))
+
+	policies[censusZeroMapq] = policyError
+	_, err := applyReadPolicies(reads[1], &policies, census, &shardRange)
+	assert.HasSubstr(t, err.Error(), "ZERO_MAPQ")
+
+	p, err := parseReadPolicy("", policyKeep)
+	assert.NoError(t, err)
+	assert.EQ(t, p, policyKeep)
+	_, err = parseReadPolicy("ignore", policyKeep)
+	assert.NotNil(t, err)
+
+	policies, err = parseReadPolicies(&Opts{ZeroMapqReads: "drop"})
+	assert.NoError(t, err)
+	assert.EQ(t, policies, [nCensusBucket]readPolicy{policyDrop, policyKeep, policyDrop})
+	_, err = parseReadPolicies(&Opts{UnmappedReads: "keep"})
+	assert.HasSubstr(t, err.Error(), "unmapped reads can't be kept")
+}
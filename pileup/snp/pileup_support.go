@@ -38,6 +38,13 @@ func minPosType(a, b PosType) PosType {
 	return b
 }
 
+func maxPosType(a, b PosType) PosType {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // Returns true if the read does not pass the filter.
 func bagDepthFilter(samr *sam.Record, minBagDepth int) (bool, error) {
 	ds, e := samr.BagSize()
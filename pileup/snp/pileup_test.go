@@ -1,6 +1,10 @@
 package snp_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
 	"path/filepath"
 	"testing"
 
@@ -15,6 +19,43 @@ import (
 	"github.com/grailbio/testutil/assert"
 )
 
+// testExecutor is an snp.Executor which runs the tasks in the test process,
+// after a gob round trip.
+type testExecutor struct {
+	nTask int
+}
+
+func (e *testExecutor) Run(ctx context.Context, tasks []snp.Task) error {
+	for _, task := range tasks {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&task); err != nil {
+			return err
+		}
+		var decoded snp.Task
+		if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+			return err
+		}
+		if err := snp.RunTask(ctx, decoded); err != nil {
+			return err
+		}
+		e.nTask++
+	}
+	return nil
+}
+
+// nameDropVisitor is an snp.ReadVisitor which drops the reads with the given
+// name.
+type nameDropVisitor struct {
+	name string
+}
+
+func (v nameDropVisitor) VisitRead(r *sam.Record, ref []byte) snp.Decision {
+	if r.Name == v.name {
+		return snp.ReadDrop
+	}
+	return snp.ReadKeep
+}
+
 func TestPileup(t *testing.T) {
 	// Write a temporary BED file.
 	tmpdir, cleanup := testutil.TempDir(t, "", "")
@@ -57,6 +98,8 @@ func TestPileup(t *testing.T) {
 		name  string
 		reads []sam.Record
 		want  []snp.BaseStrandPile
+		// modify, if non-nil, adjusts opts for the test.
+		modify func(opts *snp.Opts)
 	}{
 		// Basic read-pair with no overlap, and high enough base-quals to pass the
 		// filter.
@@ -196,6 +239,95 @@ func TestPileup(t *testing.T) {
 				},
 			},
 		},
+		// The stitch_overlap pair with overlap clipping, plus an unpaired read
+		// and a read with a large insert size, which are filtered out.
+		{
+			name: "clip_overlap",
+			reads: []sam.Record{
+				{
+					Name:    "read2",
+					Ref:     ref,
+					Pos:     100000,
+					MapQ:    60,
+					Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 6)},
+					Flags:   sam.Paired | sam.ProperPair | sam.Reverse | sam.Read1,
+					MateRef: ref,
+					MatePos: 100002,
+					TempLen: 8,
+					Seq:     sam.NewSeq([]byte("ACNGGT")),
+					Qual:    []byte{37, 37, 2, 25, 37, 37},
+				},
+				{
+					Name:  "unpaired",
+					Ref:   ref,
+					Pos:   100000,
+					MapQ:  60,
+					Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 6)},
+					Seq:   sam.NewSeq([]byte("AAAAAA")),
+					Qual:  []byte{37, 37, 37, 37, 37, 37},
+				},
+				{
+					Name:    "far",
+					Ref:     ref,
+					Pos:     100001,
+					MapQ:    60,
+					Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 6)},
+					Flags:   sam.Paired | sam.ProperPair | sam.Read1,
+					MateRef: ref,
+					MatePos: 101000,
+					TempLen: 1005,
+					Seq:     sam.NewSeq([]byte("CCCCCC")),
+					Qual:    []byte{37, 37, 37, 37, 37, 37},
+				},
+				{
+					Name:    "read2",
+					Ref:     ref,
+					Pos:     100002,
+					MapQ:    60,
+					Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 6)},
+					Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read2,
+					MateRef: ref,
+					MatePos: 100000,
+					TempLen: -8,
+					Seq:     sam.NewSeq([]byte("NGCTTA")),
+					Qual:    []byte{2, 25, 25, 37, 37, 37},
+				},
+			},
+			want: []snp.BaseStrandPile{
+				{
+					Pos:    100000,
+					Counts: [4][2]uint32{{0, 1}, {0, 0}, {0, 0}, {0, 0}},
+				},
+				{
+					Pos:    100001,
+					Counts: [4][2]uint32{{0, 0}, {0, 1}, {0, 0}, {0, 0}},
+				},
+				{
+					Pos: 100002,
+				},
+				{
+					// Equal qualities; the leftmost read's base is counted.
+					Pos:    100003,
+					Counts: [4][2]uint32{{0, 0}, {0, 0}, {0, 1}, {0, 0}},
+				},
+				{
+					// The G of the first read has the higher quality.
+					Pos:    100004,
+					Counts: [4][2]uint32{{0, 0}, {0, 0}, {0, 1}, {0, 0}},
+				},
+				{
+					Pos:    100006,
+					Counts: [4][2]uint32{{0, 0}, {0, 0}, {0, 0}, {0, 1}},
+				},
+			},
+			modify: func(opts *snp.Opts) {
+				opts.Stitch = false
+				opts.ClipOverlap = true
+				opts.RequireProperPair = true
+				opts.MaxInsertSize = 500
+				opts.MinBaseQual = 20
+			},
+		},
 		// Four reads with mates which were filtered out of the BAM.  One of them
 		// doesn't pass the mapq threshold.  One of them contains an insertion and
 		// a deletion; these don't currently appear in the pileup, but we'll
@@ -313,6 +445,52 @@ func TestPileup(t *testing.T) {
 			},
 		},
 	}
+	// The first test again, with the main loop run by an Executor.
+	executor := &testExecutor{}
+	executorDir := filepath.Join(tmpdir, "tasks")
+	withExecutor := tests[0]
+	withExecutor.name = "no_overlap_executor"
+	withExecutor.modify = func(opts *snp.Opts) {
+		opts.Parallelism = 2
+		opts.Executor = executor
+		opts.ExecutorDir = executorDir
+	}
+	tests = append(tests, withExecutor)
+	// The first test again, with another read-pair which a ReadVisitor drops.
+	withVisitor := tests[0]
+	withVisitor.name = "no_overlap_read_visitor"
+	withVisitor.reads = []sam.Record{
+		tests[0].reads[0],
+		{
+			Name:    "dropped",
+			Ref:     ref,
+			Pos:     100001,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 2)},
+			Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 100004,
+			Seq:     sam.NewSeq([]byte("TT")),
+			Qual:    []byte{43, 43},
+		},
+		tests[0].reads[1],
+		{
+			Name:    "dropped",
+			Ref:     ref,
+			Pos:     100004,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 2)},
+			Flags:   sam.Paired | sam.ProperPair | sam.Reverse | sam.Read2,
+			MateRef: ref,
+			MatePos: 100001,
+			Seq:     sam.NewSeq([]byte("TT")),
+			Qual:    []byte{43, 43},
+		},
+	}
+	withVisitor.modify = func(opts *snp.Opts) {
+		opts.Hooks = &snp.Hooks{ReadVisitor: nameDropVisitor{name: "dropped"}}
+	}
+	tests = append(tests, withVisitor)
 	bampath := filepath.Join(tmpdir, "tmp.bam")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -353,7 +531,11 @@ func TestPileup(t *testing.T) {
 			assert.NoError(t, err)
 
 			// Write pileup to temporary file in basestrand-rio format.
-			err = snp.Pileup(ctx, bampath, filepath.Join("testdata", "chr2_subset.fa"), "basestrand-rio", outPrefix, &opts, nil)
+			testOpts := opts
+			if tt.modify != nil {
+				tt.modify(&testOpts)
+			}
+			err = snp.Pileup(ctx, bampath, filepath.Join("testdata", "chr2_subset.fa"), "basestrand-rio", outPrefix, &testOpts, nil)
 			assert.NoError(t, err)
 
 			// Verify output is as expected.
@@ -373,7 +555,30 @@ func TestPileup(t *testing.T) {
 			}
 			assert.False(t, scanner.Scan())
 			assert.NoError(t, scanner.Err())
+
+			// StreamPileup should produce the same counts, without any files.  Its
+			// rows are only in position order with a single job.
+			testOpts.Executor = nil
+			testOpts.Parallelism = 1
+			var streamed []snp.BaseStrandPile
+			err = snp.StreamPileup(ctx, bampath, filepath.Join("testdata", "chr2_subset.fa"), &testOpts, nil, func(row *snp.Row) error {
+				var counts [4][2]uint32
+				copy(counts[:], row.Counts[:4])
+				streamed = append(streamed, snp.BaseStrandPile{
+					RefID:  uint32(row.RefID),
+					Pos:    uint32(row.Pos),
+					Counts: counts,
+				})
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.EQ(t, streamed, tt.want)
 		})
 		assert.NoError(t, err)
 	}
+	assert.True(t, executor.nTask > 0)
+	// The tasks' outputs were cleaned up.
+	tasks, err := ioutil.ReadDir(executorDir)
+	assert.NoError(t, err)
+	assert.EQ(t, len(tasks), 0)
 }
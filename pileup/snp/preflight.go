@@ -0,0 +1,205 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/util/diskspace"
+	"github.com/grailbio/hts/sam"
+)
+
+// The constants below are rough per-unit sizes measured on typical WGS and
+// panel runs; they're meant to catch order-of-magnitude problems (e.g. a
+// whole-genome basestrand-tsv run pointed at a small scratch volume), not to
+// predict sizes precisely.
+const (
+	// Intermediate pileupRow recordio bytes per position, without per-read
+	// features.
+	scratchBytesPerPos = 12
+	// Intermediate per-read feature bytes, per input BAM/PAM byte overlapping
+	// the region.
+	scratchBytesPerInputByte = 2
+	// Final-output text bytes, per input byte overlapping the region, for each
+	// selected per-read column set.
+	outputBytesPerInputBytePerCol = 2
+	// Approximate compression ratio of the -bgz and -zst text formats.
+	textCompressionRatio = 4
+	// Required free space is estimate * preflightMargin.
+	preflightMargin = 1.25
+)
+
+// sizeEstimate is the estimated disk usage of a Pileup run.
+type sizeEstimate struct {
+	scratch int64
+	output  int64
+}
+
+// bedSpan returns the number of positions covered by u.
+func bedSpan(u *interval.BEDUnion, refs []*sam.Reference) int64 {
+	var n int64
+	for _, ref := range refs {
+		endpoints := u.EndpointsByID(ref.ID())
+		for i := 0; i+1 < len(endpoints); i += 2 {
+			n += int64(endpoints[i+1] - endpoints[i])
+		}
+	}
+	return n
+}
+
+// estimateSizes estimates the scratch and final-output sizes of a run over
+// nPos positions, given that regionInputBytes bytes of the input overlap the
+// region.
+func estimateSizes(opts *pileupSNPOpts, nPos, regionInputBytes int64) sizeEstimate {
+	var est sizeEstimate
+	nPerReadCols := int64(0)
+	for _, bit := range []int{colBitEndDists, colBitQuals, colBitFraglens, colBitStrands} {
+		if opts.colBitset&bit != 0 {
+			nPerReadCols++
+		}
+	}
+	est.scratch = nPos * scratchBytesPerPos
+	if nPerReadCols > 0 {
+		est.scratch += regionInputBytes * scratchBytesPerInputByte
+	}
+
+	// Fixed per-position text: CHROM/POS/REF plus counts.
+	var bytesPerPos int64
+	switch opts.format {
+	case formatTSV, formatTSVBgz, formatTSVZst:
+		// .ref.tsv and .alt.tsv; the latter has one line per observed alt
+		// allele, but most positions have none.
+		bytesPerPos = 40
+	case formatBasestrandTSV, formatBasestrandTSVBgz, formatBasestrandTSVZst:
+		bytesPerPos = 48
+	case formatBasestrandRio:
+		bytesPerPos = 8
+	case formatVCF, formatVCFBgz:
+		bytesPerPos = 56
+		nPerReadCols = 0
+	case formatConsensusFASTQ:
+		bytesPerPos = 2
+		nPerReadCols = 0
+	case formatGVCF, formatGVCFBgz:
+		// Most positions are merged into reference blocks.
+		bytesPerPos = 8
+		nPerReadCols = 0
+	case formatMPileup, formatMPileupBgz:
+		// The read-base and quality columns are covered by the per-read
+		// estimate for colBitQuals.
+		bytesPerPos = 24
+	}
+	est.output = nPos*bytesPerPos + regionInputBytes*nPerReadCols*outputBytesPerInputBytePerCol
+	if opts.format.compression() != compressNone {
+		est.output /= textCompressionRatio
+	}
+	return est
+}
+
+// inputSize returns the total size of the BAM or PAM at path.
+func inputSize(ctx context.Context, path string, provider bamprovider.Provider) (int64, error) {
+	if _, ok := provider.(*bamprovider.PAMProvider); !ok {
+		info, err := provider.FileInfo()
+		return info.Size, err
+	}
+	var n int64
+	lister := file.List(ctx, path, true)
+	for lister.Scan() {
+		n += lister.Info().Size()
+	}
+	return n, lister.Err()
+}
+
+// localDir returns the directory that will contain path, or "" if path isn't
+// on a local filesystem.
+func localDir(path string) string {
+	if scheme, _, err := file.ParsePath(path); err != nil || scheme != "" {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// preflight estimates the scratch and output space needed by a Pileup run,
+// and returns an error if a local target volume has insufficient free space.
+// Non-local targets (e.g. S3) are not checked.
+func preflight(ctx context.Context, opts *pileupSNPOpts, xampath, outPrefix string, nRun int, headerRefs []*sam.Reference) error {
+	inputBytes, err := inputSize(ctx, xampath, opts.provider)
+	if err != nil {
+		return err
+	}
+	var genomeLen int64
+	for _, ref := range headerRefs {
+		genomeLen += int64(ref.Len())
+	}
+	nPos := bedSpan(&opts.bedUnion, headerRefs)
+	regionInputBytes := inputBytes
+	if genomeLen > 0 && nPos < genomeLen {
+		// Reads outside the region don't contribute, although this
+		// underestimates targeted data, where the reads concentrate in the
+		// targets.  Extend each position by the read span to partly account
+		// for that.
+		frac := float64(nPos*int64(opts.maxReadSpan)) / float64(genomeLen)
+		if frac < 1 {
+			regionInputBytes = int64(float64(inputBytes) * frac)
+		}
+	}
+	est := estimateSizes(opts, nPos, regionInputBytes)
+	// Scratch files are removed after each run, but outputs accumulate.
+	est.output *= int64(nRun)
+	log.Printf("Pileup: estimated %s scratch space and %s output for %d positions", diskspace.Format(est.scratch), diskspace.Format(est.output), nPos)
+
+	type target struct {
+		what, dir string
+		need      int64
+	}
+	tempDir := opts.tempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	targets := []target{{"scratch", tempDir, est.scratch}}
+	if dir := localDir(outPrefix); dir != "" {
+		targets = append(targets, target{"output", dir, est.output})
+	} else {
+		log.Printf("Pileup: skipping free-space check for non-local output %s", outPrefix)
+	}
+	needByDevice := map[uint64]int64{}
+	for _, t := range targets {
+		v, err := diskspace.Stat(t.dir)
+		if err == diskspace.ErrUnsupported {
+			log.Printf("Pileup: %v; skipping free-space check", err)
+			return nil
+		}
+		if os.IsNotExist(err) {
+			// The temp dir is created later; don't fail the check for it.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		needByDevice[v.Device] += t.need
+		need := int64(float64(needByDevice[v.Device]) * preflightMargin)
+		if need > v.Available {
+			return fmt.Errorf("Pileup: insufficient disk space for %s in %s: need about %s (including scratch and output on the same volume), but only %s is available; point -temp-dir/-out elsewhere or pass -skip-disk-check to override",
+				t.what, t.dir, diskspace.Format(need), diskspace.Format(v.Available))
+		}
+	}
+	return nil
+}
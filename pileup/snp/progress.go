@@ -0,0 +1,291 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/recordio"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/util/diskspace"
+	"github.com/grailbio/bio/util/iothrottle"
+	"github.com/grailbio/bio/util/progress"
+	"github.com/grailbio/hts/sam"
+)
+
+// progressInterval is the interval between the progress reports of the main
+// loop.
+const progressInterval = time.Minute
+
+// progressReporter logs the number of finished main-loop tasks, and the input
+// throughput, every progressInterval.  While it runs, SIGQUIT writes a debug
+// dump of the running tasks and the goroutine stacks (see dump) to a file in
+// dumpDir, instead of killing the process.  If there are Opts.Progress sinks,
+// it also reports the tasks and shards to them as progress events.
+type progressReporter struct {
+	nTask    int
+	nDone    int64 // updated atomically
+	throttle *iothrottle.Throttle
+	dumpDir  string
+	refs     []*sam.Reference
+	events   *progress.Reporter // nil unless there are sinks
+	stopc    chan struct{}
+	donec    chan struct{}
+
+	mu     sync.Mutex
+	active map[int]*taskActivity
+}
+
+// taskActivity describes what a running main-loop task is doing, for the
+// debug dumps and the progress events.  The methods are no-ops on a nil
+// *taskActivity.
+type taskActivity struct {
+	taskIdx int
+	start   time.Time
+	events  *progress.Reporter
+
+	// lastPos is the position of the last read of the task, as refID << 32 |
+	// pos, and nRead is the number of reads so far.  They are updated
+	// atomically.
+	lastPos int64
+	nRead   int64
+
+	mu         sync.Mutex
+	shard      gbam.Shard
+	shardStart time.Time
+	shardRead0 int64 // nRead at the start of the shard
+}
+
+// startProgress starts reporting the progress of a main loop of nTask tasks,
+// whose inputs are read through throttle.  refs are the references of the
+// input, and dumpDir is the directory of the debug dumps ("" selects the
+// default temporary directory).  The progress events go to sinks.
+func startProgress(nTask int, throttle *iothrottle.Throttle, dumpDir string, refs []*sam.Reference, sinks []progress.Sink) *progressReporter {
+	p := &progressReporter{
+		nTask:    nTask,
+		throttle: throttle,
+		dumpDir:  dumpDir,
+		refs:     refs,
+		events:   progress.Start("pileup", nTask, progressInterval, sinks...),
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+		active:   make(map[int]*taskActivity),
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGQUIT)
+	go func() {
+		defer close(p.donec)
+		defer signal.Stop(sigc)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("pileupSNPMain: progress: %v", p)
+			case <-sigc:
+				if path, err := p.dumpToFile(); err != nil {
+					log.Error.Printf("pileupSNPMain: debug dump failed: %v", err)
+				} else {
+					log.Printf("pileupSNPMain: debug dump written to %s", path)
+				}
+			case <-p.stopc:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// taskStarted records that the task taskIdx has started, and returns its
+// taskActivity.
+func (p *progressReporter) taskStarted(taskIdx int) *taskActivity {
+	a := &taskActivity{taskIdx: taskIdx, start: time.Now(), events: p.events}
+	a.lastPos = -1 << 32
+	p.mu.Lock()
+	p.active[taskIdx] = a
+	p.mu.Unlock()
+	return a
+}
+
+// taskDone records that the task taskIdx has finished.
+func (p *progressReporter) taskDone(taskIdx int) {
+	p.mu.Lock()
+	delete(p.active, taskIdx)
+	p.mu.Unlock()
+	atomic.AddInt64(&p.nDone, 1)
+	p.events.TaskDone()
+}
+
+// stop stops the reports.  err is the error of the main loop, for the last
+// progress event.
+func (p *progressReporter) stop(err error) {
+	close(p.stopc)
+	<-p.donec
+	p.events.Stop(err)
+}
+
+// startShard records that the task has started processing shard.
+func (a *taskActivity) startShard(shard gbam.Shard) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.shard = shard
+	a.shardStart = time.Now()
+	a.shardRead0 = atomic.LoadInt64(&a.nRead)
+	a.mu.Unlock()
+}
+
+// shardDone reports that the task has finished its current shard, after
+// writing positions pileup positions for it.
+func (a *taskActivity) shardDone(positions int64) {
+	if (a == nil) || (a.events == nil) {
+		return
+	}
+	a.mu.Lock()
+	shard, shardStart, read0 := a.shard, a.shardStart, a.shardRead0
+	a.mu.Unlock()
+	a.events.ShardDone(formatShard(&shard), atomic.LoadInt64(&a.nRead)-read0, positions, time.Since(shardStart))
+}
+
+// formatShard describes the unpadded range of a shard, e.g. "chr1:0-1000000",
+// or "chr1:248900000-chr2:100000" if it spans references.
+func formatShard(s *gbam.Shard) string {
+	if s.StartRef == s.EndRef {
+		return fmt.Sprintf("%s:%d-%d", s.StartRef.Name(), s.Start, s.End)
+	}
+	return fmt.Sprintf("%s:%d-%s:%d", s.StartRef.Name(), s.Start, s.EndRef.Name(), s.End)
+}
+
+// wantsPositions returns whether shardDone uses its positions argument.
+func (a *taskActivity) wantsPositions() bool {
+	return (a != nil) && (a.events != nil)
+}
+
+// positionCounter is a recordio.Writer which counts the rows written through
+// it, for the progress events.
+type positionCounter struct {
+	recordio.Writer
+	n int64
+}
+
+func (w *positionCounter) Append(v interface{}) {
+	w.n++
+	w.Writer.Append(v)
+}
+
+// addRead records that the task has read r.
+func (a *taskActivity) addRead(r *sam.Record) {
+	if a == nil {
+		return
+	}
+	refID := -1
+	if r.Ref != nil {
+		refID = r.Ref.ID()
+	}
+	atomic.StoreInt64(&a.lastPos, int64(refID)<<32|int64(uint32(r.Pos)))
+	atomic.AddInt64(&a.nRead, 1)
+}
+
+// dumpToFile writes a debug dump to a new file in p.dumpDir, and returns its
+// path.
+func (p *progressReporter) dumpToFile() (path string, err error) {
+	f, err := ioutil.TempFile(p.dumpDir, "pileup_debug_*.txt")
+	if err != nil {
+		return "", err
+	}
+	if err = p.dump(f); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// dump writes the progress, the shard, last read position and number of reads
+// of each running task, and the stacks of all goroutines to w.
+func (p *progressReporter) dump(w io.Writer) error {
+	now := time.Now()
+	p.mu.Lock()
+	active := make([]*taskActivity, 0, len(p.active))
+	for _, a := range p.active {
+		active = append(active, a)
+	}
+	p.mu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].taskIdx < active[j].taskIdx })
+	if _, err := fmt.Fprintf(w, "time: %s\nprogress: %v\nrunning tasks: %d\n", now.Format(time.RFC3339), p, len(active)); err != nil {
+		return err
+	}
+	for _, a := range active {
+		a.mu.Lock()
+		shard, shardStart := a.shard, a.shardStart
+		a.mu.Unlock()
+		shardStr := "none"
+		if shard.StartRef != nil {
+			shardStr = fmt.Sprintf("%s (for %v)", shard.String(), now.Sub(shardStart).Round(time.Second))
+		}
+		if _, err := fmt.Fprintf(w, "task %d: running for %v, shard %s, last read at %s, %d reads\n",
+			a.taskIdx, now.Sub(a.start).Round(time.Second), shardStr, p.formatPos(atomic.LoadInt64(&a.lastPos)), atomic.LoadInt64(&a.nRead)); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "\ngoroutines:\n"); err != nil {
+		return err
+	}
+	return pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// formatPos formats a taskActivity.lastPos value as "<ref>:<1-based pos>".
+func (p *progressReporter) formatPos(lastPos int64) string {
+	refID := int(lastPos >> 32)
+	pos := uint32(lastPos)
+	switch {
+	case refID == -1 && pos == 0:
+		return "none"
+	case refID < 0:
+		return "unmapped"
+	case refID < len(p.refs):
+		return fmt.Sprintf("%s:%d", p.refs[refID].Name(), pos+1)
+	}
+	return fmt.Sprintf("ref%d:%d", refID, pos+1)
+}
+
+func (p *progressReporter) String() string {
+	return fmt.Sprintf("%d of %d tasks finished; input %s", atomic.LoadInt64(&p.nDone), p.nTask, formatThroughput(p.throttle.Stats()))
+}
+
+// formatThroughput describes the amount and rate of the reads of s, e.g.
+// "1.2 GiB read, 35.0 MiB/s (limit 40.0 MiB/s, 100 reads/s)".
+func formatThroughput(s iothrottle.Stats) string {
+	str := fmt.Sprintf("%s read, %s/s", diskspace.Format(s.Bytes), diskspace.Format(int64(s.BytesPerSec)))
+	switch {
+	case (s.MaxBytesPerSec > 0) && (s.MaxOpsPerSec > 0):
+		str += fmt.Sprintf(" (limit %s/s, %d reads/s)", diskspace.Format(s.MaxBytesPerSec), s.MaxOpsPerSec)
+	case s.MaxBytesPerSec > 0:
+		str += fmt.Sprintf(" (limit %s/s)", diskspace.Format(s.MaxBytesPerSec))
+	case s.MaxOpsPerSec > 0:
+		str += fmt.Sprintf(" (limit %d reads/s)", s.MaxOpsPerSec)
+	}
+	return str
+}
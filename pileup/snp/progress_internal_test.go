@@ -0,0 +1,118 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/util/iothrottle"
+	"github.com/grailbio/bio/util/progress"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestFormatThroughput(t *testing.T) {
+	assert.EQ(t, formatThroughput(iothrottle.Stats{Bytes: 3 << 30, BytesPerSec: 1.5 * (1 << 20)}), "3.0 GiB read, 1.5 MiB/s")
+	assert.EQ(t, formatThroughput(iothrottle.Stats{Bytes: 100, MaxBytesPerSec: 40 << 20, MaxOpsPerSec: 100}), "100 B read, 0 B/s (limit 40.0 MiB/s, 100 reads/s)")
+	assert.EQ(t, formatThroughput(iothrottle.Stats{MaxOpsPerSec: 50}), "0 B read, 0 B/s (limit 50 reads/s)")
+}
+
+func TestProgressReporter(t *testing.T) {
+	p := startProgress(3, nil, "", nil, nil)
+	p.taskStarted(0)
+	p.taskDone(0)
+	p.stop(nil)
+	assert.EQ(t, p.String(), "1 of 3 tasks finished; input 0 B read, 0 B/s")
+}
+
+// progressEvents records the progress events it is shown.
+type progressEvents struct {
+	events []progress.Event
+}
+
+func (s *progressEvents) Emit(e *progress.Event) {
+	s.events = append(s.events, *e)
+}
+
+func TestProgressEvents(t *testing.T) {
+	ref, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	_, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	var sink progressEvents
+	p := startProgress(2, nil, "", []*sam.Reference{ref}, []progress.Sink{&sink})
+	a := p.taskStarted(0)
+	assert.True(t, a.wantsPositions())
+	a.addRead(&sam.Record{Name: "r1", Ref: ref, Pos: 9})
+	a.startShard(gbam.Shard{StartRef: ref, Start: 0, EndRef: ref, End: 500})
+	a.addRead(&sam.Record{Name: "r2", Ref: ref, Pos: 99})
+	a.addRead(&sam.Record{Name: "r3", Ref: ref, Pos: 199})
+	a.shardDone(500)
+	p.taskDone(0)
+	p.stop(nil)
+
+	assert.EQ(t, len(sink.events), 2)
+	e := sink.events[0]
+	assert.EQ(t, e.Kind, progress.KindShard)
+	assert.EQ(t, e.Pipeline, "pileup")
+	assert.EQ(t, e.Shard, "chr1:0-500")
+	assert.EQ(t, e.Reads, int64(2))
+	assert.EQ(t, e.Positions, int64(500))
+	e = sink.events[1]
+	assert.EQ(t, e.Kind, progress.KindDone)
+	assert.EQ(t, e.TasksDone, 1)
+	assert.EQ(t, e.Tasks, 2)
+
+	ref2, _ := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	assert.EQ(t, formatShard(&gbam.Shard{StartRef: ref, Start: 900, EndRef: ref2, End: 100}), "chr1:900-chr2:100")
+
+	// Without sinks, there are no events to report.
+	p = startProgress(2, nil, "", nil, nil)
+	defer p.stop(nil)
+	assert.False(t, p.taskStarted(0).wantsPositions())
+}
+
+func TestProgressDump(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	ref2, _ := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	// The header assigns the reference IDs.
+	_, err := sam.NewHeader(nil, []*sam.Reference{ref1, ref2})
+	assert.NoError(t, err)
+	p := startProgress(3, nil, "", []*sam.Reference{ref1, ref2}, nil)
+	defer p.stop(nil)
+	a := p.taskStarted(2)
+	a.startShard(gbam.Shard{StartRef: ref2, Start: 0, EndRef: ref2, End: 500})
+	a.addRead(&sam.Record{Name: "r1", Ref: ref2, Pos: 99})
+	a.addRead(&sam.Record{Name: "r2", Ref: ref2, Pos: 199})
+	p.taskStarted(1)
+	// Methods of a nil taskActivity do nothing.
+	var nilActivity *taskActivity
+	nilActivity.startShard(gbam.Shard{StartRef: ref1})
+	nilActivity.addRead(&sam.Record{Name: "r3", Ref: ref1})
+
+	var buf bytes.Buffer
+	assert.NoError(t, p.dump(&buf))
+	dump := buf.String()
+	assert.HasSubstr(t, dump, "running tasks: 2\n")
+	assert.HasSubstr(t, dump, "task 1: running for 0s, shard none, last read at none, 0 reads\n")
+	assert.HasSubstr(t, dump, "last read at chr2:200, 2 reads\n")
+	assert.HasSubstr(t, dump, "goroutine")
+	assert.True(t, strings.Index(dump, "task 1:") < strings.Index(dump, "task 2:"))
+
+	a.addRead(&sam.Record{Name: "r4", Pos: -1})
+	assert.EQ(t, p.formatPos(atomic.LoadInt64(&a.lastPos)), "unmapped")
+}
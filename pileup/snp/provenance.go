@@ -0,0 +1,107 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/util/buildinfo"
+	"github.com/grailbio/hts/sam"
+)
+
+// provenance returns key-value metadata describing the build of bio-pileup
+// which produced the output, and the read deduplication, weighting and
+// sampling applied by the run, which downstream consumers need in order to
+// interpret the counts.
+func (opts *pileupSNPOpts) provenance() map[string]string {
+	info := buildinfo.Get()
+	p := map[string]string{"version": info.Version}
+	if info.GitSHA != "" {
+		p["git_sha"] = info.GitSHA
+	}
+	if info.BuildFlags != "" {
+		p["build_flags"] = info.BuildFlags
+	}
+	if opts.dedup != dedupNone {
+		p["dedup"] = opts.dedup.String()
+		if opts.dedupUMITag != (sam.Tag{}) {
+			p["dedup"] += ", UMI tag " + opts.dedupUMITag.String()
+		}
+	}
+	if opts.readFilter != nil {
+		p["read_filter"] = opts.readFilter.expr
+	}
+	if opts.umiConsensus != nil {
+		p["umi_consensus"] = "UMI tag " + opts.umiConsensus.tag.String() + ", min family size " + strconv.Itoa(opts.umiConsensus.minFamilySize)
+	}
+	if opts.activeRegions != nil {
+		p["active_regions"] = "reads realigned to locally assembled haplotypes at positions with at least " + strconv.FormatFloat(opts.activeRegions.minFrac, 'g', -1, 64) + " of reads disagreeing with the reference"
+	}
+	if opts.maxDepth != nil {
+		p["max_depth"] = opts.maxDepth.String()
+	}
+	if opts.overrides != nil {
+		p["bed_overrides"] = opts.overrides.String()
+	}
+	if opts.dropDiscordant {
+		p["exclude_discordant_pairs"] = "overlapping pairs which disagree at any het site excluded"
+	}
+	if opts.downsampleFrac > 0 {
+		p["downsample"] = "fraction " + strconv.FormatFloat(opts.downsampleFrac, 'g', -1, 64) + ", systematic sampling stratified by " + strconv.Itoa(opts.downsampleBin) + "bp fragment-length bins, seed " + strconv.FormatInt(opts.seed, 10)
+	}
+	if opts.endMotifWeights != nil {
+		p["end_motif_weights"] = opts.endMotifWeights.desc + "; fragments kept with probability equal to the product of the weights of their reference " + strconv.Itoa(endMotifLen) + "-mer end motifs, systematic sampling stratified by weight, seed " + strconv.FormatInt(opts.seed, 10)
+	}
+	return p
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeProvenance writes p to <mainPath>.provenance.tsv, as KEY/VALUE lines.
+// Nothing is written if p is empty.
+func writeProvenance(ctx context.Context, mainPath string, p map[string]string) (err error) {
+	if len(p) == 0 {
+		return nil
+	}
+	var dst file.File
+	if dst, err = file.Create(ctx, mainPath+".provenance.tsv"); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#KEY\tVALUE")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	for _, k := range sortedKeys(p) {
+		w.WriteString(k)
+		w.WriteString(p[k])
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	return w.Flush()
+}
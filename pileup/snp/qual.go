@@ -16,6 +16,8 @@ package snp
 import (
 	"fmt"
 	"math"
+
+	"github.com/grailbio/bio/pileup"
 )
 
 // This file contains qual phred-math routines.  Some of them may migrate to
@@ -34,6 +36,11 @@ const nQual = 96
 // values.
 var qualSumTable [nQual][nQual]byte
 
+// qualWeightTable[q] is 1 - 10^(-q/10), the probability that a base with
+// quality q is correct.  Quals of nQual and above (including 0xff, "missing")
+// are treated as nQual - 1.
+var qualWeightTable [256]float32
+
 func init() {
 	// Fortunately, nQual is small enough that we don't have to worry about
 	// floating-point underflow anywhere.
@@ -55,6 +62,13 @@ func init() {
 			qualSumTable[j][i] = curQual
 		}
 	}
+	for i := range qualWeightTable {
+		q := i
+		if q >= nQual {
+			q = nQual - 1
+		}
+		qualWeightTable[i] = float32(1 - errProbs[q])
+	}
 }
 
 type qualPassTable [nQual][nQual]bool
@@ -79,3 +93,77 @@ func newQualPassTable(minBaseQual byte) (t qualPassTable, err error) {
 func (t *qualPassTable) lookup2(q1, q2 byte) bool {
 	return t[q1][q2]
 }
+
+// maxFASTQQual is the largest phred score representable in Sanger-encoded
+// FASTQ ('~').
+const maxFASTQQual = 93
+
+// consensusLogProbs[q] stores ln(1 - e) and ln(e / 3), where e is the error
+// probability corresponding to base-qual q.  e is capped at 0.75 (a uniformly
+// random base), so that qual-0 and qual-1 bases carry no information instead
+// of pointing away from the observed base.
+var consensusLogProbs [nQual][2]float64
+
+func init() {
+	for q := range consensusLogProbs {
+		e := math.Min(math.Exp(float64(q)*(-0.1*math.Ln10)), 0.75)
+		consensusLogProbs[q] = [2]float64{math.Log1p(-e), math.Log(e / 3)}
+	}
+}
+
+// consensusBaseAndQual returns the most likely base (as a pileup.Base... enum
+// value) at a position, given the per-read observations there, along with the
+// phred-scaled posterior probability that this base is wrong.
+//
+// Each read is treated as an independent observation with error probability
+// given by its base-qual, errors are assumed to be evenly distributed among
+// the other three bases, and the prior is flat.  So the likelihood of true
+// base b is
+//   prod_{reads with base b} (1 - e_i) * prod_{other reads} (e_i / 3),
+// and the returned qual is -10 * log10(1 - P(best base | reads)), capped at
+// maxFASTQQual.  Positions with no observations produce (BaseX, 0).
+func consensusBaseAndQual(perRead *[pileup.NBase][]perReadFeatures) (base, qual byte) {
+	var logLikelihoods [pileup.NBase]float64
+	nObs := 0
+	for obsBase, features := range perRead {
+		nObs += len(features)
+		for _, f := range features {
+			q := f.qual
+			if q >= nQual {
+				q = nQual - 1
+			}
+			lp := &consensusLogProbs[q]
+			for b := range logLikelihoods {
+				if b == obsBase {
+					logLikelihoods[b] += lp[0]
+				} else {
+					logLikelihoods[b] += lp[1]
+				}
+			}
+		}
+	}
+	if nObs == 0 {
+		return pileup.BaseX, 0
+	}
+	best := 0
+	for b := 1; b < pileup.NBase; b++ {
+		if logLikelihoods[b] > logLikelihoods[best] {
+			best = b
+		}
+	}
+	// P(wrong) = sum_{b != best} L_b / sum_b L_b.  Normalizing by L_best avoids
+	// underflow at high depth.
+	var otherSum float64
+	for b, ll := range logLikelihoods {
+		if b != best {
+			otherSum += math.Exp(ll - logLikelihoods[best])
+		}
+	}
+	errProb := otherSum / (1 + otherSum)
+	phred := math.Round(math.Log10(errProb) * -10)
+	if !(phred < maxFASTQQual) {
+		// Also catches errProb == 0.
+		phred = maxFASTQQual
+	}
+	return byte(best), byte(phred)
+}
@@ -15,6 +15,8 @@ package snp
 
 import (
 	"testing"
+
+	"github.com/grailbio/bio/pileup"
 )
 
 func TestQualPassTable(t *testing.T) {
@@ -53,3 +55,37 @@ func TestQualPassTable(t *testing.T) {
 		t.Fatalf("Unexpected value %v for qpt.lookup2(25, 25) (expected true)", qpt.lookup2(25, 25))
 	}
 }
+
+func TestConsensusBaseAndQual(t *testing.T) {
+	var perRead [pileup.NBase][]perReadFeatures
+	base, qual := consensusBaseAndQual(&perRead)
+	if base != pileup.BaseX || qual != 0 {
+		t.Fatalf("Unexpected consensus (%d, %d) for empty position (expected (%d, 0))", base, qual, pileup.BaseX)
+	}
+
+	// A single Q30 observation: P(wrong) = 0.001.
+	perRead[pileup.BaseG] = []perReadFeatures{{qual: 30}}
+	base, qual = consensusBaseAndQual(&perRead)
+	if base != pileup.BaseG || qual != 30 {
+		t.Fatalf("Unexpected consensus (%d, %d) for single Q30 G (expected (%d, 30))", base, qual, pileup.BaseG)
+	}
+
+	// Two agreeing Q20 observations beat one dissenting Q30 observation, but the
+	// consensus is weak.
+	perRead[pileup.BaseG] = []perReadFeatures{{qual: 20}, {qual: 20}}
+	perRead[pileup.BaseT] = []perReadFeatures{{qual: 30}}
+	base, qual = consensusBaseAndQual(&perRead)
+	if base != pileup.BaseG || qual < 10 || qual > 20 {
+		t.Fatalf("Unexpected consensus (%d, %d) for GGT (expected G with qual in [10, 20])", base, qual)
+	}
+
+	// High depth saturates at the FASTQ maximum, and qual-0 bases are ignored.
+	perRead[pileup.BaseT] = []perReadFeatures{{qual: 0}}
+	for i := 0; i < 20; i++ {
+		perRead[pileup.BaseG] = append(perRead[pileup.BaseG], perReadFeatures{qual: 40})
+	}
+	base, qual = consensusBaseAndQual(&perRead)
+	if base != pileup.BaseG || qual != maxFASTQQual {
+		t.Fatalf("Unexpected consensus (%d, %d) for deep G (expected (%d, %d))", base, qual, pileup.BaseG, maxFASTQQual)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	gbam "github.com/grailbio/bio/encoding/bam"
+)
+
+// quarantineEntry describes the region of a job that failed every retry.
+// Its positions are absent from the main output.
+type quarantineEntry struct {
+	startRef, limitRef string
+	start, limit       int
+	attempts           int
+	err                error
+}
+
+func newQuarantineEntry(shardSlice []gbam.Shard, attempts int, err error) *quarantineEntry {
+	first := shardSlice[0]
+	last := shardSlice[len(shardSlice)-1]
+	return &quarantineEntry{
+		startRef: first.StartRef.Name(),
+		start:    first.Start,
+		limitRef: last.EndRef.Name(),
+		limit:    last.End,
+		attempts: attempts,
+		err:      err,
+	}
+}
+
+// resetTmpFile discards the contents of a job's intermediate file, so that
+// the job can be rerun.
+func resetTmpFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, 0)
+	return err
+}
+
+// writeQuarantineReport writes <mainPath>.quarantine.tsv, listing the regions
+// that failed every retry.  Nothing is written if entries has no non-nil
+// element.
+func writeQuarantineReport(ctx context.Context, mainPath string, entries []*quarantineEntry) (err error) {
+	n := 0
+	for _, e := range entries {
+		if e != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	path := mainPath + ".quarantine.tsv"
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	w := tsv.NewWriter(dst.Writer(ctx))
+	w.WriteString("#START_CHROM\tSTART\tLIMIT_CHROM\tLIMIT\tATTEMPTS\tERROR")
+	if err = w.EndLine(); err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		// Coordinates are 0-based and half-open, as in BED files.
+		w.WriteString(e.startRef)
+		w.WriteInt64(int64(e.start))
+		w.WriteString(e.limitRef)
+		w.WriteInt64(int64(e.limit))
+		w.WriteInt64(int64(e.attempts))
+		w.WriteString(strings.Replace(e.err.Error(), "\n", " ", -1))
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Error.Printf("pileupSNPMain: %d region(s) quarantined after repeated failures; see %s", n, path)
+	return
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math/rand"
+
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+)
+
+// The random streams of the sampling features.  Each feature gets its own
+// stream, so that enabling one doesn't change the draws of another.
+const (
+	randStreamMaxDepth = iota + 1
+	randStreamDownsample
+	randStreamEndMotif
+	randStreamDepthSketch
+)
+
+// splitmix64 is the output function of the SplitMix64 generator, a bijective
+// mix of the bits of x.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// deriveSeed returns the seed of the given stream of the shard starting at
+// start.  It only depends on its arguments, so a shard gets the same draws
+// whichever job or worker processes it.
+func deriveSeed(seed int64, stream int, start biopb.Coord) int64 {
+	x := splitmix64(uint64(seed))
+	x = splitmix64(x ^ uint64(stream))
+	x = splitmix64(x ^ uint64(start.RefId))
+	x = splitmix64(x ^ uint64(start.Pos))
+	return int64(x)
+}
+
+// shardRand returns the random source of the given stream of shard.
+func (opts *pileupSNPOpts) shardRand(shard *gbam.Shard, stream int) *rand.Rand {
+	seed := deriveSeed(opts.seed, stream, gbam.ShardToCoordRange(*shard).Start)
+	if opts.newRandSource != nil {
+		return rand.New(opts.newRandSource(seed))
+	}
+	return rand.New(rand.NewSource(seed))
+}
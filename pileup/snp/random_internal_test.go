@@ -0,0 +1,94 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math/rand"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+// countingSource is a rand.Source which counts its draws.
+type countingSource struct {
+	rand.Source
+	n *int
+}
+
+func (s countingSource) Int63() int64 {
+	*s.n++
+	return s.Source.Int63()
+}
+
+func TestShardRand(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	shards := []gbam.Shard{
+		{StartRef: ref, EndRef: ref, Start: 0, End: 500, ShardIdx: 0},
+		{StartRef: ref, EndRef: ref, Start: 500, End: 1000, ShardIdx: 1},
+	}
+	draws := func(opts *pileupSNPOpts, shard gbam.Shard, stream int) [4]int64 {
+		rng := opts.shardRand(&shard, stream)
+		var d [4]int64
+		for i := range d {
+			d[i] = rng.Int63()
+		}
+		return d
+	}
+	opts := &pileupSNPOpts{seed: 7}
+	d := draws(opts, shards[1], randStreamMaxDepth)
+	// The draws only depend on the seed, the stream and the shard's start.
+	renumbered := shards[1]
+	renumbered.ShardIdx = 5
+	assert.EQ(t, draws(opts, renumbered, randStreamMaxDepth), d)
+	assert.True(t, draws(opts, shards[0], randStreamMaxDepth) != d)
+	assert.True(t, draws(opts, shards[1], randStreamDownsample) != d)
+	assert.True(t, draws(&pileupSNPOpts{seed: 8}, shards[1], randStreamMaxDepth) != d)
+
+	var n int
+	opts.newRandSource = func(seed int64) rand.Source {
+		return countingSource{Source: rand.NewSource(seed), n: &n}
+	}
+	assert.EQ(t, draws(opts, shards[1], randStreamMaxDepth), d)
+	assert.EQ(t, n, 4)
+}
+
+func TestSystematicStrata(t *testing.T) {
+	// Restarting the strata at every shard still keeps the expected fraction,
+	// even with one item per stratum and shard.
+	var s systematicStrata
+	rng := rand.New(rand.NewSource(1))
+	nKept := 0
+	for shard := 0; shard < 10000; shard++ {
+		s.startShard(rng)
+		if s.next(0, 0.25) {
+			nKept++
+		}
+	}
+	assert.True(t, (nKept > 2300) && (nKept < 2700), "kept %d", nKept)
+
+	// Within a shard, the sampling is systematic.
+	s.startShard(rng)
+	nKept = 0
+	for i := 0; i < 100; i++ {
+		if s.next(1, 0.3) {
+			nKept++
+		}
+	}
+	assert.EQ(t, nKept, 30)
+}
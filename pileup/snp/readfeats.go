@@ -0,0 +1,209 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/hts/sam"
+)
+
+// clipDistNone is the perReadFeatures.clipDist value of a read without soft
+// clips.
+const clipDistNone = math.MaxUint32
+
+var (
+	nmTag = sam.NewTag("NM")
+	rgTag = sam.NewTag("RG")
+)
+
+// readFeatures holds what appendBase needs to fill in the perReadFeatures of
+// one read's bases.
+type readFeatures struct {
+	// template has the fields that are the same for all bases of the read.
+	template perReadFeatures
+	// extended is true iff the extended feature set is requested.
+	extended bool
+	reverse  bool
+	readLen  PosType
+	// The unclipped part of the read is [clipStart, clipEnd).
+	clipStart, clipEnd PosType
+}
+
+// newReadFeatures initializes rf for read.
+func newReadFeatures(rf *readFeatures, read *readSNP, pCtx *pileupContext) {
+	samr := read.samr
+	*rf = readFeatures{
+		template: perReadFeatures{strand: byte(readStrand(samr, pCtx.longRead != nil))},
+		extended: pCtx.readFeatures,
+	}
+	if !rf.extended {
+		return
+	}
+	rf.template.mapq = samr.MapQ
+	if aux := samr.AuxFields.Get(rgTag); aux != nil {
+		if name, ok := aux.Value().(string); ok {
+			rf.template.readGroup = pCtx.readGroupIdx[name]
+		}
+	}
+	rf.template.nm = saturateUint16(readEditDistance(read, pCtx.refSeq8, pCtx.recomputeNM))
+	rf.reverse = samr.Flags&sam.Reverse != 0
+	rf.readLen = PosType(len(samr.Qual))
+	rf.clipStart, rf.clipEnd = 0, rf.readLen
+	cigar := samr.Cigar
+	for _, op := range cigar {
+		if op.Type() == sam.CigarHardClipped {
+			continue
+		}
+		if op.Type() == sam.CigarSoftClipped {
+			rf.clipStart = PosType(op.Len())
+		}
+		break
+	}
+	for i := len(cigar) - 1; i >= 0; i-- {
+		op := cigar[i]
+		if op.Type() == sam.CigarHardClipped {
+			continue
+		}
+		if op.Type() == sam.CigarSoftClipped {
+			rf.clipEnd = rf.readLen - PosType(op.Len())
+		}
+		break
+	}
+}
+
+// features returns the perReadFeatures of the base at posInRead.
+func (rf *readFeatures) features(posInRead PosType, qual []byte) perReadFeatures {
+	f := rf.template
+	f.dist5p = uint32(posInRead)
+	f.fraglen = uint32(len(qual))
+	f.qual = qual[posInRead]
+	if rf.extended {
+		if rf.reverse {
+			f.cycle = uint32(rf.readLen - 1 - posInRead)
+		} else {
+			f.cycle = uint32(posInRead)
+		}
+		f.clipDist = clipDistNone
+		if rf.clipStart > 0 {
+			f.clipDist = uint32(posInRead - rf.clipStart + 1)
+		}
+		if (rf.clipEnd < rf.readLen) && (uint32(rf.clipEnd-posInRead) < f.clipDist) {
+			f.clipDist = uint32(rf.clipEnd - posInRead)
+		}
+	}
+	return f
+}
+
+// readEditDistance returns the read's NM tag if it has one and ignoreTag is
+// false.  Otherwise, it computes the edit distance from the alignment and
+// refSeq8, so that reads without NM or MD tags need no preprocessing.  The
+// result is cached in read, since e.g. each segment of a stitched pair needs
+// it.
+func readEditDistance(read *readSNP, refSeq8 []byte, ignoreTag bool) int {
+	if !read.nmCached {
+		read.nm = editDistanceFunc(read, refSeq8, ignoreTag)
+		read.nmCached = true
+	}
+	return read.nm
+}
+
+// editDistanceFunc is computeEditDistance; tests replace it to count the
+// computations.
+var editDistanceFunc = computeEditDistance
+
+func computeEditDistance(read *readSNP, refSeq8 []byte, ignoreTag bool) int {
+	samr := read.samr
+	if !ignoreTag {
+		if aux := samr.AuxFields.Get(nmTag); aux != nil {
+			if v, ok := auxInt(aux); ok {
+				return int(v)
+			}
+		}
+	}
+	nm := 0
+	posInRef := samr.Pos
+	posInRead := 0
+	for _, op := range samr.Cigar {
+		n := op.Len()
+		switch op.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			for i := 0; i < n; i++ {
+				if posInRef+i >= len(refSeq8) || posInRead+i >= len(read.seq8) || read.seq8[posInRead+i] != refSeq8[posInRef+i] {
+					nm++
+				}
+			}
+			posInRef += n
+			posInRead += n
+		case sam.CigarInsertion:
+			nm += n
+			posInRead += n
+		case sam.CigarDeletion:
+			nm += n
+			posInRef += n
+		case sam.CigarSkipped:
+			posInRef += n
+		case sam.CigarSoftClipped:
+			posInRead += n
+		}
+	}
+	return nm
+}
+
+func saturateUint16(x int) uint16 {
+	if x > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(x)
+}
+
+// newReadGroupIdx maps each read group name in header to 1 + its index.
+func newReadGroupIdx(header *sam.Header) map[string]uint16 {
+	rgs := header.RGs()
+	idx := make(map[string]uint16, len(rgs))
+	for i, rg := range rgs {
+		idx[rg.Name()] = saturateUint16(i + 1)
+	}
+	return idx
+}
+
+// writeReadFeatureCols writes the readfeats column set for features, as
+// comma-separated lists.
+func writeReadFeatureCols(w *tsv.Writer, features []perReadFeatures) {
+	for _, f := range features {
+		w.WriteCsvUint32(uint32(f.mapq))
+	}
+	w.EndCsv()
+	for _, f := range features {
+		w.WriteCsvUint32(uint32(f.readGroup))
+	}
+	w.EndCsv()
+	for _, f := range features {
+		w.WriteCsvUint32(uint32(f.nm))
+	}
+	w.EndCsv()
+	for _, f := range features {
+		w.WriteCsvUint32(uint32(f.cycle))
+	}
+	w.EndCsv()
+	for _, f := range features {
+		if f.clipDist == clipDistNone {
+			w.WriteCsvByte('.')
+		} else {
+			w.WriteCsvUint32(uint32(f.clipDist))
+		}
+	}
+	w.EndCsv()
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// A read filter expression (Opts.ReadFilter) is a boolean expression over
+// the fields and flags of a read, e.g.
+//
+//   qual>=20 && mapq>=30 && !dup && fraglen<600
+//
+// The grammar is
+//
+//   expr       = and { "||" and }
+//   and        = unary { "&&" unary }
+//   unary      = "!" unary | "(" expr ")" | comparison | flag
+//   comparison = field ("<" | "<=" | ">" | ">=" | "==" | "!=") integer
+//
+// where the fields are listed in readFilterFields and the flags in
+// readFilterFlags.  The expression is compiled once into a tree of closures.
+
+// readFilterFields are the integer-valued fields of a read.
+var readFilterFields = map[string]func(r *sam.Record) int{
+	// mapq is the mapping quality.
+	"mapq": func(r *sam.Record) int { return int(r.MapQ) },
+	// qual is the mean base quality, rounded down; 0 for a read without
+	// bases.
+	"qual": func(r *sam.Record) int {
+		if len(r.Qual) == 0 {
+			return 0
+		}
+		sum := 0
+		for _, q := range r.Qual {
+			sum += int(q)
+		}
+		return sum / len(r.Qual)
+	},
+	// fraglen is |TLEN|.
+	"fraglen": func(r *sam.Record) int {
+		if r.TempLen < 0 {
+			return -r.TempLen
+		}
+		return r.TempLen
+	},
+	// len is the number of bases.
+	"len": func(r *sam.Record) int { return r.Seq.Length },
+	// span is the number of reference positions covered by the alignment.
+	"span": func(r *sam.Record) int {
+		span, _ := r.Cigar.Lengths()
+		return span
+	},
+}
+
+// readFilterFlags are the boolean fields of a read.
+var readFilterFlags = map[string]sam.Flags{
+	"paired":        sam.Paired,
+	"proper":        sam.ProperPair,
+	"unmapped":      sam.Unmapped,
+	"mateunmapped":  sam.MateUnmapped,
+	"reverse":       sam.Reverse,
+	"matereverse":   sam.MateReverse,
+	"read1":         sam.Read1,
+	"read2":         sam.Read2,
+	"secondary":     sam.Secondary,
+	"qcfail":        sam.QCFail,
+	"dup":           sam.Duplicate,
+	"supplementary": sam.Supplementary,
+}
+
+var readFilterComparisons = map[string]func(a, b int) bool{
+	"<":  func(a, b int) bool { return a < b },
+	"<=": func(a, b int) bool { return a <= b },
+	">":  func(a, b int) bool { return a > b },
+	">=": func(a, b int) bool { return a >= b },
+	"==": func(a, b int) bool { return a == b },
+	"!=": func(a, b int) bool { return a != b },
+}
+
+// readFilter is a compiled read filter expression.
+type readFilter struct {
+	expr string
+	keep func(r *sam.Record) bool
+	// needsTempLen is true if the expression uses fraglen.
+	needsTempLen bool
+}
+
+type readFilterToken struct {
+	text string
+	pos  int // byte offset in the expression
+}
+
+func tokenizeReadFilter(expr string) ([]readFilterToken, error) {
+	var toks []readFilterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case (c == ' ') || (c == '\t'):
+			i++
+			continue
+		case ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) || (c == '_'):
+			j := i + 1
+			for (j < len(expr)) && (((expr[j] >= 'a') && (expr[j] <= 'z')) || ((expr[j] >= 'A') && (expr[j] <= 'Z')) || ((expr[j] >= '0') && (expr[j] <= '9')) || (expr[j] == '_')) {
+				j++
+			}
+			toks = append(toks, readFilterToken{text: expr[i:j], pos: i})
+			i = j
+			continue
+		}
+		n := 0
+		for _, op := range []string{"&&", "||", "<=", ">=", "==", "!=", "<", ">", "!", "(", ")"} {
+			if strings.HasPrefix(expr[i:], op) {
+				n = len(op)
+				break
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+		toks = append(toks, readFilterToken{text: expr[i : i+n], pos: i})
+		i += n
+	}
+	return toks, nil
+}
+
+type readFilterParser struct {
+	expr string
+	toks []readFilterToken
+	next int
+	f    *readFilter
+}
+
+func (p *readFilterParser) peek() string {
+	if p.next < len(p.toks) {
+		return p.toks[p.next].text
+	}
+	return ""
+}
+
+func (p *readFilterParser) errorf(format string, args ...interface{}) error {
+	pos := len(p.expr)
+	if p.next < len(p.toks) {
+		pos = p.toks[p.next].pos
+	}
+	return fmt.Errorf("%s at offset %d of %q", fmt.Sprintf(format, args...), pos, p.expr)
+}
+
+func (p *readFilterParser) parseOr() (func(*sam.Record) bool, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next++
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := lhs
+		lhs = func(r *sam.Record) bool { return l(r) || rhs(r) }
+	}
+	return lhs, nil
+}
+
+func (p *readFilterParser) parseAnd() (func(*sam.Record) bool, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next++
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := lhs
+		lhs = func(r *sam.Record) bool { return l(r) && rhs(r) }
+	}
+	return lhs, nil
+}
+
+func (p *readFilterParser) parseUnary() (func(*sam.Record) bool, error) {
+	tok := p.peek()
+	switch tok {
+	case "":
+		return nil, p.errorf("unexpected end of expression")
+	case "!":
+		p.next++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *sam.Record) bool { return !operand(r) }, nil
+	case "(":
+		p.next++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, p.errorf("expected )")
+		}
+		p.next++
+		return inner, nil
+	}
+	if flag, ok := readFilterFlags[tok]; ok {
+		p.next++
+		return func(r *sam.Record) bool { return r.Flags&flag != 0 }, nil
+	}
+	field, ok := readFilterFields[tok]
+	if !ok {
+		return nil, p.errorf("unknown field %q (expected one of %s)", tok, strings.Join(readFilterNames(), ", "))
+	}
+	if tok == "fraglen" {
+		p.f.needsTempLen = true
+	}
+	p.next++
+	cmp, ok := readFilterComparisons[p.peek()]
+	if !ok {
+		return nil, p.errorf("expected a comparison operator after %s", tok)
+	}
+	p.next++
+	value, err := strconv.Atoi(p.peek())
+	if err != nil {
+		return nil, p.errorf("expected an integer")
+	}
+	p.next++
+	return func(r *sam.Record) bool { return cmp(field(r), value) }, nil
+}
+
+// readFilterNames returns the names of the fields and flags, in sorted order.
+func readFilterNames() []string {
+	var names []string
+	for name := range readFilterFields {
+		names = append(names, name)
+	}
+	for name := range readFilterFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compileReadFilter compiles a read filter expression.  It returns nil for an
+// empty expression.
+func compileReadFilter(expr string) (*readFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	toks, err := tokenizeReadFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Pileup: invalid read-filter= argument: %v", err)
+	}
+	p := readFilterParser{expr: expr, toks: toks, f: &readFilter{expr: expr}}
+	if p.f.keep, err = p.parseOr(); err != nil {
+		return nil, fmt.Errorf("Pileup: invalid read-filter= argument: %v", err)
+	}
+	if p.next < len(p.toks) {
+		return nil, fmt.Errorf("Pileup: invalid read-filter= argument: %v", p.errorf("unexpected %q", p.peek()))
+	}
+	return p.f, nil
+}
+
+// keepPairedRead returns false if r fails the Opts.RequireProperPair (if
+// requireProper) or Opts.MaxInsertSize (if maxInsertSize > 0) filters.
+func keepPairedRead(r *sam.Record, requireProper bool, maxInsertSize int) bool {
+	if requireProper && (r.Flags&sam.ProperPair == 0) {
+		return false
+	}
+	if (maxInsertSize > 0) && (r.Flags&(sam.Paired|sam.Unmapped|sam.MateUnmapped) == sam.Paired) {
+		if r.MateRef != r.Ref {
+			return false
+		}
+		tlen := r.TempLen
+		if tlen < 0 {
+			tlen = -tlen
+		}
+		if tlen > maxInsertSize {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestCompileReadFilter(t *testing.T) {
+	f, err := compileReadFilter("  ")
+	assert.NoError(t, err)
+	assert.True(t, f == nil)
+
+	r := &sam.Record{
+		MapQ:    40,
+		Flags:   sam.Paired | sam.Read1 | sam.Duplicate,
+		TempLen: -250,
+		Cigar:   sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 3), sam.NewCigarOp(sam.CigarDeletion, 2)},
+		Seq:     sam.NewSeq([]byte("ACG")),
+		Qual:    []byte{20, 30, 31},
+	}
+	for _, test := range []struct {
+		expr string
+		want bool
+	}{
+		{"mapq>=30", true},
+		{"mapq>40", false},
+		{"qual==27", true},
+		{"fraglen<600 && fraglen>=250", true},
+		{"!dup", false},
+		{"dup && read1", true},
+		{"read2 || mapq!=40", false},
+		{"read2 || mapq<=40", true},
+		{"len==3 && span==5", true},
+		{"!(dup || reverse)", false},
+		{"qual>=20 && mapq>=30 && !dup && fraglen<600", false},
+		{"mapq < 50 && (proper || paired)", true},
+	} {
+		f, err := compileReadFilter(test.expr)
+		assert.NoError(t, err, test.expr)
+		assert.EQ(t, f.keep(r), test.want, test.expr)
+	}
+
+	f, err = compileReadFilter("fraglen<600")
+	assert.NoError(t, err)
+	assert.True(t, f.needsTempLen)
+	f, err = compileReadFilter("mapq<60")
+	assert.NoError(t, err)
+	assert.False(t, f.needsTempLen)
+
+	for _, bad := range []string{
+		"mapq",
+		"mapq>=",
+		"mapq>=x",
+		"mapq=30",
+		"baseq>20",
+		"dup &&",
+		"(dup",
+		"dup)",
+		"dup read1",
+		"mapq>=30 & dup",
+	} {
+		_, err := compileReadFilter(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/hts/sam"
+)
+
+// regionThresholds are the filter thresholds in effect at a position.
+type regionThresholds struct {
+	minBaseQual byte
+	mapq        int
+	// maxDepth is 0 if the depth is unlimited.
+	maxDepth int
+	// qpt is the qualPassTable of minBaseQual, for stitched bases.
+	qpt *qualPassTable
+}
+
+// thresholdSegment is a run of positions with the same thresholds.
+type thresholdSegment struct {
+	start, end PosType
+	t          *regionThresholds
+}
+
+// regionOverrides holds the per-interval thresholds of Opts.BedOverrides.
+type regionOverrides struct {
+	defaults regionThresholds
+	// segs[refID] holds the disjoint segments of the reference where the
+	// thresholds differ from defaults, in coordinate order.
+	segs [][]thresholdSegment
+	// minMapq and maxMapq are the lowest and highest MAPQ thresholds of the
+	// run, and maxDepth is set if any interval overrides the max depth.
+	minMapq, maxMapq int
+	maxDepth         bool
+	nInterval        int
+}
+
+// overrideInterval is a line of an Opts.BedOverrides BED file.
+type overrideInterval struct {
+	start, end PosType
+	// idx is the line order, which breaks ties between intervals of the same
+	// length.
+	idx int
+	t   regionThresholds
+}
+
+// overrideHeap is a heap of the intervals covering a position, the shortest
+// (then the earliest in the file) first.
+type overrideHeap []*overrideInterval
+
+func (h overrideHeap) Len() int { return len(h) }
+func (h overrideHeap) Less(i, j int) bool {
+	li, lj := h[i].end-h[i].start, h[j].end-h[j].start
+	if li != lj {
+		return li < lj
+	}
+	return h[i].idx < h[j].idx
+}
+func (h overrideHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *overrideHeap) Push(x interface{}) { *h = append(*h, x.(*overrideInterval)) }
+func (h *overrideHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// parseOverrideToken applies a key=value token of a BED line to t.  It
+// returns false if the token isn't of that form.
+func parseOverrideToken(tok string, t *regionThresholds) (bool, error) {
+	i := strings.IndexByte(tok, '=')
+	if i < 0 {
+		return false, nil
+	}
+	key := tok[:i]
+	v, err := strconv.Atoi(tok[i+1:])
+	if err != nil {
+		return true, fmt.Errorf("invalid %s value %q", key, tok[i+1:])
+	}
+	switch key {
+	case "min_bq":
+		if (v < 0) || (v >= nQual) {
+			return true, fmt.Errorf("min_bq must be between 0 and %d, got %d", nQual-1, v)
+		}
+		t.minBaseQual = byte(v)
+	case "min_mapq":
+		if (v < 0) || (v > 255) {
+			return true, fmt.Errorf("min_mapq must be between 0 and 255, got %d", v)
+		}
+		t.mapq = v
+	case "max_depth":
+		if v < 0 {
+			return true, fmt.Errorf("max_depth must be nonnegative, got %d", v)
+		}
+		t.maxDepth = v
+	default:
+		return true, fmt.Errorf("unknown override %q (expected min_bq=, min_mapq= or max_depth=)", key)
+	}
+	return true, nil
+}
+
+// parseRegionOverrides parses a BED file whose columns after the third may
+// hold min_bq=, min_mapq= and max_depth= tokens; other columns without '='
+// (e.g. names) are ignored, as are the intervals on references not in refs.
+// defaults are the run-wide thresholds.  Where intervals overlap, the
+// shortest one applies.
+func parseRegionOverrides(r io.Reader, refs []*sam.Reference, defaults regionThresholds) (*regionOverrides, error) {
+	refIDs := make(map[string]int, len(refs))
+	for _, ref := range refs {
+		refIDs[ref.Name()] = ref.ID()
+	}
+	o := &regionOverrides{
+		defaults: defaults,
+		segs:     make([][]thresholdSegment, len(refs)),
+		minMapq:  defaults.mapq,
+		maxMapq:  defaults.mapq,
+	}
+	byRef := make([][]*overrideInterval, len(refs))
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || (line[0] == '#') || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("BED line %d: expected <chrom> <start> <end>, got %q", lineNum, line)
+		}
+		iv := &overrideInterval{idx: lineNum, t: defaults}
+		for _, tok := range fields[3:] {
+			if _, err := parseOverrideToken(tok, &iv.t); err != nil {
+				return nil, fmt.Errorf("BED line %d: %v", lineNum, err)
+			}
+		}
+		refID, ok := refIDs[fields[0]]
+		if !ok {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		end, err2 := strconv.Atoi(fields[2])
+		if (err1 != nil) || (err2 != nil) || (start < 0) || (end < start) {
+			return nil, fmt.Errorf("BED line %d: invalid interval %s:%s-%s", lineNum, fields[0], fields[1], fields[2])
+		}
+		if start == end {
+			continue
+		}
+		iv.start, iv.end = PosType(start), PosType(end)
+		byRef[refID] = append(byRef[refID], iv)
+		o.nInterval++
+		if iv.t.mapq < o.minMapq {
+			o.minMapq = iv.t.mapq
+		}
+		if iv.t.mapq > o.maxMapq {
+			o.maxMapq = iv.t.mapq
+		}
+		if iv.t.maxDepth != defaults.maxDepth {
+			o.maxDepth = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// One qualPassTable per distinct min_bq.
+	qpts := map[byte]*qualPassTable{defaults.minBaseQual: defaults.qpt}
+	for refID, ivs := range byRef {
+		for _, iv := range ivs {
+			if qpts[iv.t.minBaseQual] == nil {
+				qpt, err := newQualPassTable(iv.t.minBaseQual)
+				if err != nil {
+					return nil, err
+				}
+				qpts[iv.t.minBaseQual] = &qpt
+			}
+			iv.t.qpt = qpts[iv.t.minBaseQual]
+		}
+		o.segs[refID] = resolveOverrides(ivs, &o.defaults)
+	}
+	return o, nil
+}
+
+// resolveOverrides returns the segments of the thresholds of ivs, which are
+// on the same reference, leaving out those with the default thresholds.
+func resolveOverrides(ivs []*overrideInterval, defaults *regionThresholds) []thresholdSegment {
+	sort.SliceStable(ivs, func(i, j int) bool { return ivs[i].start < ivs[j].start })
+	bounds := make([]PosType, 0, 2*len(ivs))
+	for _, iv := range ivs {
+		bounds = append(bounds, iv.start, iv.end)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	var segs []thresholdSegment
+	var active overrideHeap
+	next := 0
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if start == end {
+			continue
+		}
+		for (next < len(ivs)) && (ivs[next].start <= start) {
+			heap.Push(&active, ivs[next])
+			next++
+		}
+		for (len(active) > 0) && (active[0].end <= start) {
+			heap.Pop(&active)
+		}
+		// Intervals which ended earlier may still be in the heap below the
+		// top; only the top matters.
+		if len(active) == 0 {
+			continue
+		}
+		t := &active[0].t
+		if (t.minBaseQual == defaults.minBaseQual) && (t.mapq == defaults.mapq) && (t.maxDepth == defaults.maxDepth) {
+			continue
+		}
+		if n := len(segs); (n > 0) && (segs[n-1].end == start) && (*segs[n-1].t == *t) {
+			segs[n-1].end = end
+			continue
+		}
+		segs = append(segs, thresholdSegment{start: start, end: end, t: t})
+	}
+	return segs
+}
+
+// loadRegionOverrides reads the overrides of the BED file at path.
+func loadRegionOverrides(ctx context.Context, path string, refs []*sam.Reference, defaults regionThresholds) (o *regionOverrides, err error) {
+	var f file.File
+	if f, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	if o, err = parseRegionOverrides(f.Reader(ctx), refs, defaults); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+func (o *regionOverrides) String() string {
+	return fmt.Sprintf("per-interval thresholds from %d BED intervals, with defaults min_bq=%d min_mapq=%d max_depth=%d (0: unlimited)", o.nInterval, o.defaults.minBaseQual, o.defaults.mapq, o.defaults.maxDepth)
+}
+
+// at returns the thresholds in effect at pos.
+func (o *regionOverrides) at(refID int, pos PosType) *regionThresholds {
+	if (refID < 0) || (refID >= len(o.segs)) {
+		return &o.defaults
+	}
+	segs := o.segs[refID]
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].end > pos })
+	if (i < len(segs)) && (segs[i].start <= pos) {
+		return segs[i].t
+	}
+	return &o.defaults
+}
+
+// filterMapq removes the positions of alignedBases where a read with the
+// given MAPQ doesn't count, in place.
+func (o *regionOverrides) filterMapq(alignedBases []alignedPos, refID int, mapq byte) []alignedPos {
+	if int(mapq) >= o.maxMapq {
+		return alignedBases
+	}
+	out := alignedBases[:0]
+	for _, ab := range alignedBases {
+		if int(mapq) >= o.at(refID, ab.posInRef).mapq {
+			out = append(out, ab)
+		}
+	}
+	return out
+}
+
+// minBaseQualAt returns the minimum base quality at pos.
+func (pCtx *pileupContext) minBaseQualAt(refID int, pos PosType) byte {
+	if pCtx.overrides == nil {
+		return pCtx.minBaseQual
+	}
+	return pCtx.overrides.at(refID, pos).minBaseQual
+}
+
+// qptAt returns the qualPassTable of the minimum base quality at pos.
+func (pCtx *pileupContext) qptAt(refID int, pos PosType) *qualPassTable {
+	if pCtx.overrides == nil {
+		return pCtx.qpt
+	}
+	return pCtx.overrides.at(refID, pos).qpt
+}
+
+// countsAt returns true if read is counted at pos: pos is in the BED
+// intervals, and the read passes the MAPQ threshold there.
+func (pCtx *pileupContext) countsAt(read *readSNP, refID int, pos PosType) bool {
+	if !pCtx.bedPart.ContainsByID(refID, pos) {
+		return false
+	}
+	return (pCtx.overrides == nil) || (int(read.samr.MapQ) >= pCtx.overrides.at(refID, pos).mapq)
+}
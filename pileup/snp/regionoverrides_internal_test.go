@@ -0,0 +1,139 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func testOverrideRefs(t *testing.T) []*sam.Reference {
+	var refs []*sam.Reference
+	for _, name := range []string{"chr1", "chr2"} {
+		ref, err := sam.NewReference(name, "", "", 1000, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	_, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	return refs
+}
+
+func testOverrideDefaults(t *testing.T, maxDepth int) regionThresholds {
+	qpt, err := newQualPassTable(20)
+	assert.NoError(t, err)
+	return regionThresholds{minBaseQual: 20, mapq: 60, maxDepth: maxDepth, qpt: &qpt}
+}
+
+func TestParseRegionOverrides(t *testing.T) {
+	refs := testOverrideRefs(t)
+	bed := `# backbone, hotspots and an amplicon
+chr1	0	100
+chr1	40	42	hotspot1	min_mapq=20	min_bq=10
+chr1	80	120	amp1	max_depth=5
+chr1	90	95	min_bq=30
+chr3	0	10	min_mapq=0
+chr2	10	20	min_mapq=70
+`
+	o, err := parseRegionOverrides(strings.NewReader(bed), refs, testOverrideDefaults(t, 0))
+	assert.NoError(t, err)
+	assert.EQ(t, o.nInterval, 5)
+	assert.EQ(t, o.minMapq, 20)
+	assert.EQ(t, o.maxMapq, 70)
+	assert.True(t, o.maxDepth)
+
+	for _, tt := range []struct {
+		refID            int
+		pos              PosType
+		minBQ, mapq, max int
+	}{
+		{0, 0, 20, 60, 0},
+		{0, 39, 20, 60, 0},
+		{0, 40, 10, 20, 0},
+		{0, 41, 10, 20, 0},
+		{0, 42, 20, 60, 0},
+		{0, 85, 20, 60, 5},
+		// The shortest interval applies, with the defaults for what it
+		// doesn't override.
+		{0, 90, 30, 60, 0},
+		{0, 95, 20, 60, 5},
+		{0, 119, 20, 60, 5},
+		{0, 120, 20, 60, 0},
+		{1, 15, 20, 70, 0},
+		{-1, 15, 20, 60, 0},
+	} {
+		th := o.at(tt.refID, tt.pos)
+		assert.EQ(t, [3]int{int(th.minBaseQual), th.mapq, th.maxDepth}, [3]int{tt.minBQ, tt.mapq, tt.max}, tt)
+		assert.True(t, th.qpt != nil)
+		assert.EQ(t, th.qpt[th.minBaseQual][th.minBaseQual], qualSumTable[th.minBaseQual][th.minBaseQual] >= th.minBaseQual)
+	}
+	// The segments of equal thresholds are merged.
+	assert.EQ(t, len(o.segs[0]), 4)
+
+	abs := []alignedPos{{38, 0}, {40, 2}, {41, 3}, {42, 4}}
+	assert.EQ(t, o.filterMapq(append([]alignedPos(nil), abs...), 0, 30), []alignedPos{{40, 2}, {41, 3}})
+	assert.EQ(t, o.filterMapq(append([]alignedPos(nil), abs...), 0, 70), abs)
+
+	for _, bad := range []string{
+		"chr1\t0",
+		"chr1\t0\t10\tmin_qual=20",
+		"chr1\t0\t10\tmin_bq=high",
+		"chr1\t0\t10\tmin_bq=200",
+		"chr1\t0\t10\tmax_depth=-1",
+		"chr1\t10\t0",
+	} {
+		_, err := parseRegionOverrides(strings.NewReader(bad), refs, testOverrideDefaults(t, 0))
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestMaxDepthIteratorOverrides(t *testing.T) {
+	refs := testOverrideRefs(t)
+	ref := refs[0]
+	o, err := parseRegionOverrides(strings.NewReader("chr1\t150\t250\tmax_depth=2\nchr1\t300\t400\tmin_mapq=50\n"), refs, testOverrideDefaults(t, 4))
+	assert.NoError(t, err)
+	opts, err := parseMaxDepthOpts(4, "", 1, true)
+	assert.NoError(t, err)
+	opts.overrides = o
+
+	// 20 reads at 100 and 10 at 160, and 10 MAPQ 55 reads at 320 and 500, all
+	// 50 bases long.  The reads at 500 are below the MAPQ threshold there, so
+	// they take no part in the sampling.
+	var recs []*sam.Record
+	for _, g := range []struct{ pos, n, mapq int }{{100, 20, 60}, {160, 10, 60}, {320, 10, 55}, {500, 10, 55}} {
+		for i := 0; i < g.n; i++ {
+			recs = append(recs, &sam.Record{
+				Name:  fmt.Sprintf("r%d_%d", g.pos, i),
+				Ref:   ref,
+				Pos:   g.pos,
+				MapQ:  byte(g.mapq),
+				Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 50)},
+			})
+		}
+	}
+	posByName := make(map[string]int)
+	for _, r := range recs {
+		posByName[r.Name] = r.Pos
+	}
+	nPerPos := make(map[int]int)
+	for _, name := range runMaxDepth(t, recs, opts) {
+		nPerPos[posByName[name]]++
+	}
+	assert.EQ(t, nPerPos, map[int]int{100: 4, 160: 2, 320: 4, 500: 10})
+	assert.EQ(t, *opts.dropped, int64(16+8+6))
+}
@@ -15,6 +15,8 @@ package snp
 
 import (
 	"encoding/binary"
+	"fmt"
+	"math"
 
 	"github.com/grailbio/bio/pileup"
 )
@@ -22,12 +24,32 @@ import (
 type perReadFeatures struct {
 	// dist5p is the 0-based distance of the current base from its 5' end.  (Note
 	// that Dist3p := fraglen - 1 - dist5p, so we don't need to store it
-	// separately.)
-	dist5p uint16
+	// separately.)  dist5p, fraglen, cycle and clipDist are 32-bit so that
+	// long reads (Opts.LongRead) fit.
+	dist5p uint32
 
-	fraglen uint16
+	fraglen uint32
 	qual    byte
 	strand  byte
+
+	// The remaining fields form the extended feature set, used to train base
+	// quality recalibration models.  They are only filled in (and marked by
+	// fieldPerReadExtended) when the readfeats column set is requested.
+	//
+	// mapq is the read's mapping quality, and readGroup is 1 + the index of
+	// its read group in the header (0 if it has none).
+	mapq      byte
+	readGroup uint16
+	// nm is the read's edit distance from the reference; see
+	// readEditDistance.
+	nm uint16
+	// cycle is the 0-based position of the base in the read as sequenced,
+	// i.e. before any reverse-complementing by the aligner.
+	cycle uint32
+	// clipDist is the distance from the base to the nearest soft-clipped base
+	// of the read (1 if they are adjacent), or clipDistNone if the read isn't
+	// soft-clipped.
+	clipDist uint32
 }
 
 const (
@@ -36,9 +58,71 @@ const (
 	fieldPerReadC
 	fieldPerReadG
 	fieldPerReadT
+	fieldIndelCounts
+	fieldIndelAlleles
+	fieldExtensions
+	// fieldPerReadExtended16 is set when the per-read features include the
+	// extended feature set, as written before clipDist was widened to 32 bits:
+	// reads without soft clips have a clipDist of math.MaxUint16.  It is no
+	// longer written; the decoder turns it into fieldPerReadExtended.  Rows
+	// written before it existed never set it, so they decode with zero
+	// extended features.
+	fieldPerReadExtended16
+	fieldQualWeights
+	fieldExtCounts
+	fieldHapCounts
+	// fieldPerReadExtended is set when the per-read features include the
+	// extended feature set, with a clipDist of clipDistNone for reads without
+	// soft clips.
+	fieldPerReadExtended
 	fieldPerReadAny = fieldPerReadA | fieldPerReadC | fieldPerReadG | fieldPerReadT
 )
 
+// Indel types, indexing pileupPayload.indelCounts.
+const (
+	indelIns = iota
+	indelDel
+	nIndelType
+)
+
+// indelAllele is a single insertion or deletion allele, with per-strand
+// counts.  Like in VCF, indels are anchored at the last reference position
+// before the event.
+type indelAllele struct {
+	// insSeq is the inserted sequence (in ASCII) for an insertion, and empty
+	// for a deletion.
+	insSeq string
+	// delLen is the number of deleted reference bases for a deletion, and 0
+	// for an insertion.
+	delLen uint32
+	counts [2]uint32
+}
+
+// extensionTag identifies the kind of data in a rowExtension.  Tags are
+// allocated in the list below; an experimental feature should claim a tag
+// there, so that two experiments never interpret each other's data.  Tags
+// are never reused, even after the corresponding feature is removed.
+type extensionTag uint32
+
+const (
+	// extensionTagTest is reserved for tests.
+	extensionTagTest extensionTag = iota + 1
+	// extensionTagDepthSketch holds the depthSketches of the bases whose
+	// per-read features were sampled (Opts.SketchDepth).
+	extensionTagDepthSketch
+	// extensionTagModBase holds the base-modification counts of Opts.ModBase.
+	extensionTagModBase
+)
+
+// rowExtension is an opaque tag-length-value blob attached to a position.
+// It lets experimental per-position data (e.g. modification fractions) ride
+// along in the intermediate files without changing the core format; once
+// such data is used for real, it should become a regular pileupPayload field.
+type rowExtension struct {
+	tag  extensionTag
+	data []byte
+}
+
 // pileupPayload is a container for all types of pileup data which may be
 // associated with a single position.  It does not store the position itself,
 // or a tag indicating which parts of the container are used.
@@ -46,16 +130,68 @@ const (
 // Depth and count values are of type uint32 instead of int to reduce cache
 // footprint.
 type pileupPayload struct {
-	depth   uint32
-	counts  [pileup.NBaseEnum][2]uint32
+	depth uint32
+	// counts[b][s] is the number of bases b on strand s.  The counts of the
+	// extended observation classes (pileup.BaseDel..BaseMod) are only filled
+	// in when the extbases column set is requested.
+	counts  [pileup.NBaseEnumExt][2]uint32
 	perRead [pileup.NBase][]perReadFeatures
+
+	// indelCounts[indelIns] and indelCounts[indelDel] are the per-strand
+	// numbers of insertions and deletions anchored at this position.
+	indelCounts [nIndelType][2]uint32
+	// indels is the breakdown of indelCounts by allele.  It is only filled in
+	// when the output format reports alleles.
+	indels []indelAllele
+
+	// extensions contains at most one entry per tag.
+	extensions []rowExtension
+
+	// qualWeights[b][s] is the sum of 1 - 10^(-q/10) over the bases b on
+	// strand s, where q is the base quality (for a stitched pair of matching
+	// bases, the combined quality).  Unlike counts, it includes the bases
+	// below the minimum base quality.  It is only filled in when the
+	// qualweights column set is requested.
+	qualWeights [pileup.NBase][2]float32
+
+	// hapCounts[h][b] is the number of bases b of the reads of haplotype h
+	// (see readHapTags), counted like counts (i.e. without the bases below
+	// the minimum base quality).  phaseSet is the phase set of the reads
+	// counted as hap1 or hap2, or 0 if there are none.  They are only filled
+	// in when the hapcounts column set is requested.
+	hapCounts [nHaplotype][pileup.NBase]uint32
+	phaseSet  uint32
+}
+
+// extension returns the data of the extension with the given tag, or nil if
+// there is none.
+func (p *pileupPayload) extension(tag extensionTag) []byte {
+	for _, e := range p.extensions {
+		if e.tag == tag {
+			return e.data
+		}
+	}
+	return nil
+}
+
+// setExtension sets the data of the extension with the given tag, replacing
+// any previous value.  p retains data, so the caller must not modify it
+// afterwards.
+func (p *pileupPayload) setExtension(tag extensionTag, data []byte) {
+	for i := range p.extensions {
+		if p.extensions[i].tag == tag {
+			p.extensions[i].data = data
+			return
+		}
+	}
+	p.extensions = append(p.extensions, rowExtension{tag: tag, data: data})
 }
 
 // pileupRow contains all pileup data associated with a single position, along
 // with the position itself and the set of pileupPayload fields used.
 //
 // The main loop splits the genome into shards, and generates lightly
-// compressed (zstd level 1) per-shard pileupRow recordio files.  Then, the
+// compressed (zstd level 1 by default) per-shard pileupRow recordio files.  Then, the
 // per-shard files are read in sequence and converted to the final requested
 // output format.  This is a bit inefficient, but we can easily afford it.
 type pileupRow struct {
@@ -89,27 +225,163 @@ func cutAndAdvance(offset *int, s []byte, pieceLen int) []byte {
 	return tmpSlice[:pieceLen]
 }
 
-// Serialized format:
+// Per-read feature arrays dominate the size of the intermediate files at high
+// depth, so they are stored compactly:
+// - dist5p and fraglen are delta-coded against the previous read's values at
+//   the same position, as zigzag varints.  Reads at a position are mostly
+//   processed in order of increasing start, so dist5p tends to decrease by
+//   small amounts, and fraglen is often unchanged.
+// - qual and strand are packed into a single byte, with qual in the low 6
+//   bits and strand (pileup.StrandType, so 0..2) in the high 2 bits.  The
+//   rare qual >= qualEscape is stored as qualEscape, followed by a byte with
+//   the full value.
+const (
+	qualEscape = 63
+	// maxPerReadFeatureBytes is the largest encoded size of a
+	// perReadFeatures: the zigzag deltas of uint32 values need up to 33 bits,
+	// i.e. 5 varint bytes.
+	maxPerReadFeatureBytes = 5 + 5 + 2
+	// maxPerReadExtendedBytes is the largest encoded size of the extended
+	// feature set: mapq as a byte, followed by the other four fields as
+	// uvarints (3 bytes for the uint16 ones, 5 for the uint32 ones).
+	maxPerReadExtendedBytes = 1 + 2*3 + 2*5
+)
+
+// putPerReadFeatures encodes features into t[offset:], and returns the offset
+// after the last byte written.  If extended is true, each read's extended
+// features follow its other features.  t must have room for
+// maxPerReadFeatureBytes * len(features) bytes, plus maxPerReadExtendedBytes
+// * len(features) if extended.
+func putPerReadFeatures(t []byte, offset int, features []perReadFeatures, extended bool) int {
+	var prevDist5p, prevFraglen int64
+	for _, f := range features {
+		offset += binary.PutVarint(t[offset:], int64(f.dist5p)-prevDist5p)
+		offset += binary.PutVarint(t[offset:], int64(f.fraglen)-prevFraglen)
+		prevDist5p = int64(f.dist5p)
+		prevFraglen = int64(f.fraglen)
+		if f.qual < qualEscape {
+			t[offset] = f.qual | (f.strand << 6)
+			offset++
+		} else {
+			t[offset] = qualEscape | (f.strand << 6)
+			t[offset+1] = f.qual
+			offset += 2
+		}
+		if extended {
+			t[offset] = f.mapq
+			offset++
+			offset += binary.PutUvarint(t[offset:], uint64(f.readGroup))
+			offset += binary.PutUvarint(t[offset:], uint64(f.nm))
+			offset += binary.PutUvarint(t[offset:], uint64(f.cycle))
+			offset += binary.PutUvarint(t[offset:], uint64(f.clipDist))
+		}
+	}
+	return offset
+}
+
+// getPerReadFeatures decodes len(features) values written by
+// putPerReadFeatures from in[offset:], and returns the offset after the last
+// byte read.
+func getPerReadFeatures(in []byte, offset int, features []perReadFeatures, extended bool) (int, error) {
+	var dist5p, fraglen int64
+	for i := range features {
+		delta, n := binary.Varint(in[offset:])
+		if n <= 0 {
+			return offset, fmt.Errorf("unmarshalPileupRow: corrupt dist5p")
+		}
+		offset += n
+		dist5p += delta
+		if delta, n = binary.Varint(in[offset:]); n <= 0 {
+			return offset, fmt.Errorf("unmarshalPileupRow: corrupt fraglen")
+		}
+		offset += n
+		fraglen += delta
+		if offset >= len(in) {
+			return offset, fmt.Errorf("unmarshalPileupRow: truncated per-read features")
+		}
+		packed := in[offset]
+		offset++
+		f := &features[i]
+		f.dist5p = uint32(dist5p)
+		f.fraglen = uint32(fraglen)
+		f.qual = packed & qualEscape
+		f.strand = packed >> 6
+		if f.qual == qualEscape {
+			if offset >= len(in) {
+				return offset, fmt.Errorf("unmarshalPileupRow: truncated per-read features")
+			}
+			f.qual = in[offset]
+			offset++
+		}
+		if extended {
+			if offset >= len(in) {
+				return offset, fmt.Errorf("unmarshalPileupRow: truncated per-read features")
+			}
+			f.mapq = in[offset]
+			offset++
+			var v [4]uint64
+			for j := range v {
+				var err error
+				if v[j], offset, err = getUvarint(in, offset); err != nil {
+					return offset, err
+				}
+			}
+			f.readGroup = uint16(v[0])
+			f.nm = uint16(v[1])
+			f.cycle = uint32(v[2])
+			f.clipDist = uint32(v[3])
+		}
+	}
+	return offset, nil
+}
+
+// getUvarint decodes a uvarint from in[offset:], and returns it along with
+// the offset after it.
+func getUvarint(in []byte, offset int) (uint64, int, error) {
+	v, n := binary.Uvarint(in[offset:])
+	if n <= 0 {
+		return 0, offset, fmt.Errorf("unmarshalPileupRow: corrupt varint")
+	}
+	return v, offset + n, nil
+}
+
+// Serialized format (pileupRowVersion 2):
 //   [0..4): fieldsPresent
 //   [4..8): refID
 //   [8..12): pos
 //   [12..16): depth
-//   if counts present, stored in next 40 bytes
-//   if perRead[pileup.baseA] present, length stored in next 4 bytes, then
-//     values stored in next 6*n bytes
-//   if perRead[pileup.baseC] present... etc.
-// This is essentially the simplest format that can support the variable-length
-// per-read feature arrays that are needed.  It is not difficult to decrease
-// the nominal size of these records by (i) using varints instead of uint32s,
-// and (ii) making fieldsPresent indicate which counts[][] values are nonzero
-// and only storing those; but I wouldn't expect that to be worth the
-// additional complexity since all uses of this marshal function are bundled
-// with the "zstd 1" transformer anyway.  (Instead, all the 'extra' complexity
-// in this function concerns (i) avoiding extra allocations and (ii) avoiding a
-// ridiculous number of spurious bounds-checks, in ways that make sense for a
-// wide variety of other serialization functions.)
+//   followed by the fields present, in pileupRowSchema order.  Fixed-width
+//   fields are stored as-is; variable-width fields are prefixed by their size
+//   in bytes, as a uvarint, so that a reader can skip fields it doesn't know.
+//   Field contents:
+//   counts: 40 bytes
+//   perRead[pileup.baseA], etc.: length as a uvarint, then values stored as
+//     described at putPerReadFeatures(), including the extended features iff
+//     fieldPerReadExtended (or, in older files, fieldPerReadExtended16) is set
+//   indelCounts: 16 bytes
+//   indels: length in 4 bytes, then for each allele, delLen, counts[0],
+//     counts[1], and len(insSeq) in the next 16 bytes, followed by insSeq
+//   extensions: count as a uvarint, then for each extension, the tag and data
+//     length as uvarints, followed by the data
+//   qualWeights: 32 bytes, float32s in the same order as counts (minus N)
+//   extCounts: 24 bytes, the counts of pileup.BaseDel..BaseMod, in the same
+//     order as counts
+//   hapCounts: 52 bytes, phaseSet, followed by hapCounts in index order
+// Version 1, written before the schema header existed, is the same except
+// that variable-width fields have no size prefix.
 //
-// In the future, we may need to add indel support.
+// Apart from the per-read features, this is essentially the simplest format
+// that works.  It is not difficult to decrease the nominal size of the
+// fixed-size part by (i) using varints instead of uint32s, and (ii) making
+// fieldsPresent indicate which counts[][] values are nonzero and only storing
+// those; but I wouldn't expect that to be worth the additional complexity
+// since this marshal function is normally bundled with the "zstd 1"
+// transformer anyway.  (Instead, all the 'extra' complexity in this function
+// concerns (i) avoiding extra allocations and (ii) avoiding a ridiculous
+// number of spurious bounds-checks, in ways that make sense for a wide variety
+// of other serialization functions.)  The per-read features are the
+// exception, since zstd can't recover much from thousands of small structs
+// per position; they are packed as described at putPerReadFeatures().
 func marshalPileupRow(scratch []byte, p interface{}) ([]byte, error) {
 	pr := p.(*pileupRow)
 	fieldsPresent := pr.fieldsPresent
@@ -124,10 +396,38 @@ func marshalPileupRow(scratch []byte, p interface{}) ([]byte, error) {
 			// For b in {0,1,2,3}, (fieldPerReadA << b) is the bit indicating that
 			// perRead[b] must be stored.
 			if fieldsPresent&(fieldPerReadA<<uint(b)) != 0 {
-				bytesReq += 4 + 6*len(pr.payload.perRead[b])
+				// Upper bound; the varints are usually much shorter.
+				bytesReq += 2*binary.MaxVarintLen32 + maxPerReadFeatureBytes*len(pr.payload.perRead[b])
+				if fieldsPresent&fieldPerReadExtended != 0 {
+					bytesReq += maxPerReadExtendedBytes * len(pr.payload.perRead[b])
+				}
 			}
 		}
 	}
+	if fieldsPresent&fieldIndelCounts != 0 {
+		bytesReq += 16
+	}
+	if fieldsPresent&fieldIndelAlleles != 0 {
+		bytesReq += binary.MaxVarintLen32 + 4
+		for _, a := range pr.payload.indels {
+			bytesReq += 16 + len(a.insSeq)
+		}
+	}
+	if fieldsPresent&fieldExtensions != 0 {
+		bytesReq += 2 * binary.MaxVarintLen32
+		for _, e := range pr.payload.extensions {
+			bytesReq += 2*binary.MaxVarintLen32 + len(e.data)
+		}
+	}
+	if fieldsPresent&fieldQualWeights != 0 {
+		bytesReq += 32
+	}
+	if fieldsPresent&fieldExtCounts != 0 {
+		bytesReq += 24
+	}
+	if fieldsPresent&fieldHapCounts != 0 {
+		bytesReq += 52
+	}
 	t := scratch
 	if len(t) < bytesReq {
 		t = make([]byte, bytesReq)
@@ -159,24 +459,262 @@ func marshalPileupRow(scratch []byte, p interface{}) ([]byte, error) {
 	if fieldsPresent&fieldPerReadAny != 0 {
 		for b := range pr.payload.perRead {
 			if fieldsPresent&(fieldPerReadA<<uint(b)) != 0 {
-				lenSlice := cutAndAdvance(&offset, t, 4)
-				binary.LittleEndian.PutUint32(lenSlice, uint32(len(pr.payload.perRead[b])))
-				for _, src := range pr.payload.perRead[b] {
-					dst := cutAndAdvance(&offset, t, 6)
-					binary.LittleEndian.PutUint16(dst[:2], src.dist5p)
-					binary.LittleEndian.PutUint16(dst[2:4], src.fraglen)
-					dst[4] = src.qual
-					dst[5] = src.strand
-				}
+				bodyStart := offset + binary.MaxVarintLen32
+				bodyEnd := bodyStart + binary.PutUvarint(t[bodyStart:], uint64(len(pr.payload.perRead[b])))
+				bodyEnd = putPerReadFeatures(t, bodyEnd, pr.payload.perRead[b], fieldsPresent&fieldPerReadExtended != 0)
+				offset = putFieldSize(t, offset, bodyStart, bodyEnd)
+			}
+		}
+	}
+	if fieldsPresent&fieldIndelCounts != 0 {
+		tIndels := cutAndAdvance(&offset, t, 16)
+		binary.LittleEndian.PutUint32(tIndels[:4], pr.payload.indelCounts[indelIns][0])
+		binary.LittleEndian.PutUint32(tIndels[4:8], pr.payload.indelCounts[indelIns][1])
+		binary.LittleEndian.PutUint32(tIndels[8:12], pr.payload.indelCounts[indelDel][0])
+		binary.LittleEndian.PutUint32(tIndels[12:16], pr.payload.indelCounts[indelDel][1])
+	}
+	if fieldsPresent&fieldIndelAlleles != 0 {
+		bodyStart := offset + binary.MaxVarintLen32
+		bodyEnd := bodyStart
+		lenSlice := cutAndAdvance(&bodyEnd, t, 4)
+		binary.LittleEndian.PutUint32(lenSlice, uint32(len(pr.payload.indels)))
+		for _, a := range pr.payload.indels {
+			dst := cutAndAdvance(&bodyEnd, t, 16)
+			binary.LittleEndian.PutUint32(dst[:4], a.delLen)
+			binary.LittleEndian.PutUint32(dst[4:8], a.counts[0])
+			binary.LittleEndian.PutUint32(dst[8:12], a.counts[1])
+			binary.LittleEndian.PutUint32(dst[12:16], uint32(len(a.insSeq)))
+			copy(cutAndAdvance(&bodyEnd, t, len(a.insSeq)), a.insSeq)
+		}
+		offset = putFieldSize(t, offset, bodyStart, bodyEnd)
+	}
+	if fieldsPresent&fieldExtensions != 0 {
+		bodyStart := offset + binary.MaxVarintLen32
+		bodyEnd := bodyStart + binary.PutUvarint(t[bodyStart:], uint64(len(pr.payload.extensions)))
+		for _, e := range pr.payload.extensions {
+			bodyEnd += binary.PutUvarint(t[bodyEnd:], uint64(e.tag))
+			bodyEnd += binary.PutUvarint(t[bodyEnd:], uint64(len(e.data)))
+			copy(cutAndAdvance(&bodyEnd, t, len(e.data)), e.data)
+		}
+		offset = putFieldSize(t, offset, bodyStart, bodyEnd)
+	}
+	if fieldsPresent&fieldQualWeights != 0 {
+		tWeights := cutAndAdvance(&offset, t, 32)
+		for b := range pr.payload.qualWeights {
+			for s, w := range pr.payload.qualWeights[b] {
+				binary.LittleEndian.PutUint32(tWeights[8*b+4*s:], math.Float32bits(w))
 			}
 		}
 	}
-	return t, nil
+	if fieldsPresent&fieldExtCounts != 0 {
+		tExt := cutAndAdvance(&offset, t, 24)
+		binary.LittleEndian.PutUint32(tExt[:4], pr.payload.counts[pileup.BaseDel][0])
+		binary.LittleEndian.PutUint32(tExt[4:8], pr.payload.counts[pileup.BaseDel][1])
+		binary.LittleEndian.PutUint32(tExt[8:12], pr.payload.counts[pileup.BaseIns][0])
+		binary.LittleEndian.PutUint32(tExt[12:16], pr.payload.counts[pileup.BaseIns][1])
+		binary.LittleEndian.PutUint32(tExt[16:20], pr.payload.counts[pileup.BaseMod][0])
+		binary.LittleEndian.PutUint32(tExt[20:24], pr.payload.counts[pileup.BaseMod][1])
+	}
+	if fieldsPresent&fieldHapCounts != 0 {
+		tHap := cutAndAdvance(&offset, t, 52)
+		binary.LittleEndian.PutUint32(tHap[:4], pr.payload.phaseSet)
+		for h := range pr.payload.hapCounts {
+			for b, c := range pr.payload.hapCounts[h] {
+				binary.LittleEndian.PutUint32(tHap[4+16*h+4*b:], c)
+			}
+		}
+	}
+	return t[:offset], nil
+}
+
+// putFieldSize finishes a variable-width field whose contents were written
+// to t[bodyStart:bodyEnd], leaving room for the size prefix at t[offset:]:
+// it writes the prefix, moves the contents right after it, and returns the
+// offset after the field.
+func putFieldSize(t []byte, offset, bodyStart, bodyEnd int) int {
+	offset += binary.PutUvarint(t[offset:], uint64(bodyEnd-bodyStart))
+	return offset + copy(t[offset:], t[bodyStart:bodyEnd])
+}
+
+// unmarshalPileupRow decodes a row written by marshalPileupRow.  Files may
+// also contain rows of other versions; use newPileupRowScanner to read them.
+func unmarshalPileupRow(in []byte) (out interface{}, err error) {
+	return currentRowDecoder.unmarshal(in)
+}
+
+// The get... functions below decode one pileupRow field from in[offset:]
+// into pr, and return the offset after the field.
+
+func getCounts(in []byte, offset int, pr *pileupRow) (int, error) {
+	if len(in)-offset < 40 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated counts")
+	}
+	inCounts := cutAndAdvance(&offset, in, 40)
+	pr.payload.counts[pileup.BaseA][0] = binary.LittleEndian.Uint32(inCounts[0:4])
+	pr.payload.counts[pileup.BaseA][1] = binary.LittleEndian.Uint32(inCounts[4:8])
+	pr.payload.counts[pileup.BaseC][0] = binary.LittleEndian.Uint32(inCounts[8:12])
+	pr.payload.counts[pileup.BaseC][1] = binary.LittleEndian.Uint32(inCounts[12:16])
+	pr.payload.counts[pileup.BaseG][0] = binary.LittleEndian.Uint32(inCounts[16:20])
+	pr.payload.counts[pileup.BaseG][1] = binary.LittleEndian.Uint32(inCounts[20:24])
+	pr.payload.counts[pileup.BaseT][0] = binary.LittleEndian.Uint32(inCounts[24:28])
+	pr.payload.counts[pileup.BaseT][1] = binary.LittleEndian.Uint32(inCounts[28:32])
+	pr.payload.counts[pileup.BaseX][0] = binary.LittleEndian.Uint32(inCounts[32:36])
+	pr.payload.counts[pileup.BaseX][1] = binary.LittleEndian.Uint32(inCounts[36:40])
+	return offset, nil
+}
+
+func getPerRead(in []byte, offset int, pr *pileupRow, b int) (int, error) {
+	curLen, offset, err := getUvarint(in, offset)
+	if err != nil {
+		return offset, err
+	}
+	// Each read takes at least 3 bytes; don't let a corrupt length trigger a
+	// huge allocation.
+	if curLen > uint64(len(in)-offset)/3 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated per-read features")
+	}
+
+	// If we wanted to further reduce the number of small allocations, we
+	// could allocate a single []perReadFeatures slice outside this loop,
+	// and then make the per-base slices point to subslices of the single
+	// allocation.  (I don't bother since, most of the time, only one
+	// newFeatures slice corresponding to the REF base is allocated
+	// anyway.)
+	newFeatures := make([]perReadFeatures, curLen)
+
+	pr.payload.perRead[b] = newFeatures
+	extended16 := pr.fieldsPresent&fieldPerReadExtended16 != 0
+	if offset, err = getPerReadFeatures(in, offset, newFeatures, extended16 || (pr.fieldsPresent&fieldPerReadExtended != 0)); err != nil {
+		return offset, err
+	}
+	if extended16 {
+		for i := range newFeatures {
+			if newFeatures[i].clipDist == math.MaxUint16 {
+				newFeatures[i].clipDist = clipDistNone
+			}
+		}
+	}
+	return offset, nil
+}
+
+func getIndelCounts(in []byte, offset int, pr *pileupRow) (int, error) {
+	if len(in)-offset < 16 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated indel counts")
+	}
+	inIndels := cutAndAdvance(&offset, in, 16)
+	pr.payload.indelCounts[indelIns][0] = binary.LittleEndian.Uint32(inIndels[:4])
+	pr.payload.indelCounts[indelIns][1] = binary.LittleEndian.Uint32(inIndels[4:8])
+	pr.payload.indelCounts[indelDel][0] = binary.LittleEndian.Uint32(inIndels[8:12])
+	pr.payload.indelCounts[indelDel][1] = binary.LittleEndian.Uint32(inIndels[12:16])
+	return offset, nil
+}
+
+func getIndelAlleles(in []byte, offset int, pr *pileupRow) (int, error) {
+	if len(in)-offset < 4 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated indel alleles")
+	}
+	n := binary.LittleEndian.Uint32(cutAndAdvance(&offset, in, 4))
+	if uint64(n) > uint64(len(in)-offset)/16 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated indel alleles")
+	}
+	pr.payload.indels = make([]indelAllele, n)
+	for i := range pr.payload.indels {
+		if len(in)-offset < 16 {
+			return offset, fmt.Errorf("unmarshalPileupRow: truncated indel alleles")
+		}
+		src := cutAndAdvance(&offset, in, 16)
+		a := &pr.payload.indels[i]
+		a.delLen = binary.LittleEndian.Uint32(src[:4])
+		a.counts[0] = binary.LittleEndian.Uint32(src[4:8])
+		a.counts[1] = binary.LittleEndian.Uint32(src[8:12])
+		seqLen := binary.LittleEndian.Uint32(src[12:16])
+		if uint64(seqLen) > uint64(len(in)-offset) {
+			return offset, fmt.Errorf("unmarshalPileupRow: truncated indel alleles")
+		}
+		a.insSeq = string(cutAndAdvance(&offset, in, int(seqLen)))
+	}
+	return offset, nil
+}
+
+func getExtensions(in []byte, offset int, pr *pileupRow) (int, error) {
+	n, offset, err := getUvarint(in, offset)
+	if err != nil {
+		return offset, err
+	}
+	// Each extension takes at least 2 bytes.
+	if n > uint64(len(in)-offset)/2 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated extension")
+	}
+	pr.payload.extensions = make([]rowExtension, n)
+	for i := range pr.payload.extensions {
+		e := &pr.payload.extensions[i]
+		var tag, dataLen uint64
+		if tag, offset, err = getUvarint(in, offset); err != nil {
+			return offset, err
+		}
+		if dataLen, offset, err = getUvarint(in, offset); err != nil {
+			return offset, err
+		}
+		if dataLen > uint64(len(in)-offset) {
+			return offset, fmt.Errorf("unmarshalPileupRow: truncated extension")
+		}
+		e.tag = extensionTag(tag)
+		// Copy, since the scanner may reuse in.
+		e.data = append([]byte(nil), cutAndAdvance(&offset, in, int(dataLen))...)
+	}
+	return offset, nil
+}
+
+func getQualWeights(in []byte, offset int, pr *pileupRow) (int, error) {
+	if len(in)-offset < 32 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated qual weights")
+	}
+	inWeights := cutAndAdvance(&offset, in, 32)
+	for b := range pr.payload.qualWeights {
+		for s := range pr.payload.qualWeights[b] {
+			pr.payload.qualWeights[b][s] = math.Float32frombits(binary.LittleEndian.Uint32(inWeights[8*b+4*s:]))
+		}
+	}
+	return offset, nil
+}
+
+func getExtCounts(in []byte, offset int, pr *pileupRow) (int, error) {
+	if len(in)-offset < 24 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated extended counts")
+	}
+	inExt := cutAndAdvance(&offset, in, 24)
+	pr.payload.counts[pileup.BaseDel][0] = binary.LittleEndian.Uint32(inExt[:4])
+	pr.payload.counts[pileup.BaseDel][1] = binary.LittleEndian.Uint32(inExt[4:8])
+	pr.payload.counts[pileup.BaseIns][0] = binary.LittleEndian.Uint32(inExt[8:12])
+	pr.payload.counts[pileup.BaseIns][1] = binary.LittleEndian.Uint32(inExt[12:16])
+	pr.payload.counts[pileup.BaseMod][0] = binary.LittleEndian.Uint32(inExt[16:20])
+	pr.payload.counts[pileup.BaseMod][1] = binary.LittleEndian.Uint32(inExt[20:24])
+	return offset, nil
+}
+
+func getHapCounts(in []byte, offset int, pr *pileupRow) (int, error) {
+	if len(in)-offset < 52 {
+		return offset, fmt.Errorf("unmarshalPileupRow: truncated haplotype counts")
+	}
+	inHap := cutAndAdvance(&offset, in, 52)
+	pr.payload.phaseSet = binary.LittleEndian.Uint32(inHap[:4])
+	for h := range pr.payload.hapCounts {
+		for b := range pr.payload.hapCounts[h] {
+			pr.payload.hapCounts[h][b] = binary.LittleEndian.Uint32(inHap[4+16*h+4*b:])
+		}
+	}
+	return offset, nil
 }
 
+// unmarshalPileupRowV1 decodes a row of version 1, i.e. a file without a
+// schema header.
+//
 // tried the block-unmarshal strategy in grail.com/bio/variants, it actually
 // seemed to have worse performance for this use case
-func unmarshalPileupRow(in []byte) (out interface{}, err error) {
+func unmarshalPileupRowV1(in []byte) (out interface{}, err error) {
+	if len(in) < 16 {
+		return nil, fmt.Errorf("unmarshalPileupRow: truncated row")
+	}
 	offset := 0
 	inStart := cutAndAdvance(&offset, in, 16)
 	pr := &pileupRow{
@@ -186,42 +724,33 @@ func unmarshalPileupRow(in []byte) (out interface{}, err error) {
 	}
 	pr.payload.depth = binary.LittleEndian.Uint32(inStart[12:16])
 	if pr.fieldsPresent&fieldCounts != 0 {
-		inCounts := cutAndAdvance(&offset, in, 40)
-		pr.payload.counts[pileup.BaseA][0] = binary.LittleEndian.Uint32(inCounts[0:4])
-		pr.payload.counts[pileup.BaseA][1] = binary.LittleEndian.Uint32(inCounts[4:8])
-		pr.payload.counts[pileup.BaseC][0] = binary.LittleEndian.Uint32(inCounts[8:12])
-		pr.payload.counts[pileup.BaseC][1] = binary.LittleEndian.Uint32(inCounts[12:16])
-		pr.payload.counts[pileup.BaseG][0] = binary.LittleEndian.Uint32(inCounts[16:20])
-		pr.payload.counts[pileup.BaseG][1] = binary.LittleEndian.Uint32(inCounts[20:24])
-		pr.payload.counts[pileup.BaseT][0] = binary.LittleEndian.Uint32(inCounts[24:28])
-		pr.payload.counts[pileup.BaseT][1] = binary.LittleEndian.Uint32(inCounts[28:32])
-		pr.payload.counts[pileup.BaseX][0] = binary.LittleEndian.Uint32(inCounts[32:36])
-		pr.payload.counts[pileup.BaseX][1] = binary.LittleEndian.Uint32(inCounts[36:40])
+		if offset, err = getCounts(in, offset, pr); err != nil {
+			return nil, err
+		}
 	}
 	if pr.fieldsPresent&fieldPerReadAny != 0 {
 		for b := range pr.payload.perRead {
 			if pr.fieldsPresent&(fieldPerReadA<<uint(b)) != 0 {
-				lenSlice := cutAndAdvance(&offset, in, 4)
-				curLen := binary.LittleEndian.Uint32(lenSlice)
-
-				// If we wanted to further reduce the number of small allocations, we
-				// could allocate a single []perReadFeatures slice outside this loop,
-				// and then make the per-base slices point to subslices of the single
-				// allocation.  (I don't bother since, most of the time, only one
-				// newFeatures slice corresponding to the REF base is allocated
-				// anyway.)
-				newFeatures := make([]perReadFeatures, curLen)
-
-				pr.payload.perRead[b] = newFeatures
-				for i := range newFeatures {
-					src := cutAndAdvance(&offset, in, 6)
-					newFeatures[i].dist5p = binary.LittleEndian.Uint16(src[:2])
-					newFeatures[i].fraglen = binary.LittleEndian.Uint16(src[2:4])
-					newFeatures[i].qual = src[4]
-					newFeatures[i].strand = src[5]
+				if offset, err = getPerRead(in, offset, pr, b); err != nil {
+					return nil, err
 				}
 			}
 		}
 	}
+	if pr.fieldsPresent&fieldIndelCounts != 0 {
+		if offset, err = getIndelCounts(in, offset, pr); err != nil {
+			return nil, err
+		}
+	}
+	if pr.fieldsPresent&fieldIndelAlleles != 0 {
+		if offset, err = getIndelAlleles(in, offset, pr); err != nil {
+			return nil, err
+		}
+	}
+	if pr.fieldsPresent&fieldExtensions != 0 {
+		if _, err = getExtensions(in, offset, pr); err != nil {
+			return nil, err
+		}
+	}
 	return pr, nil
 }
@@ -0,0 +1,175 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// rowFilter implements Opts.MinDepth, Opts.MinAltCount and Opts.Positions: it
+// decides which positions of the main loop's output are written by the
+// per-position formats.  The output writers call keep on each row; a nil
+// *rowFilter keeps every row.
+type rowFilter struct {
+	minDepth    uint32
+	minAltCount uint32
+	// positions is nil unless Opts.Positions is set.
+	positions *interval.BEDUnion
+	refSeqs   [][]byte
+	// nKept and nDropped count the rows passed to keep.
+	nKept, nDropped int
+}
+
+// parseRowFilter returns the rowFilter of rawOpts, or nil if it wouldn't drop
+// anything.  refSeqs are the reference sequences of header.
+func parseRowFilter(ctx context.Context, rawOpts *Opts, header *sam.Header, refSeqs [][]byte) (*rowFilter, error) {
+	if rawOpts.MinDepth < 0 {
+		return nil, fmt.Errorf("Pileup: invalid min-depth= argument")
+	}
+	if rawOpts.MinAltCount < 0 {
+		return nil, fmt.Errorf("Pileup: invalid min-alt-count= argument")
+	}
+	if (rawOpts.MinDepth == 0) && (rawOpts.MinAltCount == 0) && (rawOpts.Positions == "") {
+		return nil, nil
+	}
+	rf := &rowFilter{
+		minDepth:    uint32(rawOpts.MinDepth),
+		minAltCount: uint32(rawOpts.MinAltCount),
+		refSeqs:     refSeqs,
+	}
+	if rawOpts.Positions != "" {
+		positions, err := loadPositions(ctx, rawOpts.Positions, header)
+		if err != nil {
+			return nil, fmt.Errorf("Pileup: invalid positions= argument: %v", err)
+		}
+		rf.positions = &positions
+	}
+	return rf, nil
+}
+
+// loadPositions reads the positions of Opts.Positions: a BED file, or, if
+// path has a .vcf suffix, the POS of each VCF record.
+func loadPositions(ctx context.Context, path string, header *sam.Header) (bedUnion interval.BEDUnion, err error) {
+	if !strings.HasSuffix(path, ".vcf") {
+		return interval.NewBEDUnionFromPath(path, interval.NewBEDOpts{SAMHeader: header})
+	}
+	var f file.File
+	if f, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	var entries []interval.Entry
+	if entries, err = parseVCFPositions(f.Reader(ctx), header.Refs()); err != nil {
+		return bedUnion, fmt.Errorf("%s: %v", path, err)
+	}
+	return interval.NewBEDUnionFromEntries(entries, interval.NewBEDOpts{SAMHeader: header})
+}
+
+// parseVCFPositions returns the CHROM and POS of the records of a VCF file,
+// as sorted one-base entries.
+func parseVCFPositions(r io.Reader, refs []*sam.Reference) ([]interval.Entry, error) {
+	refIDs := make(map[string]int, len(refs))
+	for _, ref := range refs {
+		refIDs[ref.Name()] = ref.ID()
+	}
+	type refPos struct {
+		refID int
+		pos   PosType
+	}
+	var positions []refPos
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if (line == "") || (line[0] == '#') {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected at least 2 columns, got %q", lineNum, line)
+		}
+		refID, ok := refIDs[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown reference %s", lineNum, fields[0])
+		}
+		pos, err := strconv.Atoi(fields[1])
+		if (err != nil) || (pos < 1) || (pos > refs[refID].Len()) {
+			return nil, fmt.Errorf("line %d: invalid position %s:%s", lineNum, fields[0], fields[1])
+		}
+		positions = append(positions, refPos{refID, PosType(pos - 1)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].refID != positions[j].refID {
+			return positions[i].refID < positions[j].refID
+		}
+		return positions[i].pos < positions[j].pos
+	})
+	entries := make([]interval.Entry, len(positions))
+	for i, p := range positions {
+		entries[i] = interval.Entry{RefName: refs[p.refID].Name(), Start0: p.pos, End: p.pos + 1}
+	}
+	return entries, nil
+}
+
+// keep returns true if the position of pr passes the filter.  The ALT alleles
+// are the bases other than the reference base, and the position needs one
+// with at least minAltCount high-quality bases.
+func (rf *rowFilter) keep(pr *pileupRow) bool {
+	if rf == nil {
+		return true
+	}
+	if rf.pass(pr) {
+		rf.nKept++
+		return true
+	}
+	rf.nDropped++
+	return false
+}
+
+func (rf *rowFilter) pass(pr *pileupRow) bool {
+	if pr.payload.depth < rf.minDepth {
+		return false
+	}
+	if (rf.positions != nil) && !rf.positions.ContainsByID(int(pr.refID), PosType(pr.pos)) {
+		return false
+	}
+	if rf.minAltCount == 0 {
+		return true
+	}
+	counts := &pr.payload.counts
+	refBase := pileup.Seq8ToEnumTable[rf.refSeqs[pr.refID][pr.pos]]
+	for b := byte(0); b < pileup.NBase; b++ {
+		if (b != refBase) && (counts[b][0]+counts[b][1] >= rf.minAltCount) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rf *rowFilter) String() string {
+	return fmt.Sprintf("%d positions kept, %d dropped", rf.nKept, rf.nDropped)
+}
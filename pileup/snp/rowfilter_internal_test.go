@@ -0,0 +1,140 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestParseRowFilter(t *testing.T) {
+	ctx := vcontext.Background()
+	rf, err := parseRowFilter(ctx, &Opts{}, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, rf == nil)
+	// MinAltFrac only applies to vcf ALT alleles.
+	rf, err = parseRowFilter(ctx, &Opts{MinAltFrac: 0.1}, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, rf == nil)
+	rf, err = parseRowFilter(ctx, &Opts{MinDepth: 10, MinAltCount: 2, MinAltFrac: 0.1}, nil, nil)
+	assert.NoError(t, err)
+	assert.EQ(t, *rf, rowFilter{minDepth: 10, minAltCount: 2})
+	_, err = parseRowFilter(ctx, &Opts{MinDepth: -1}, nil, nil)
+	assert.HasSubstr(t, err.Error(), "invalid min-depth=")
+	_, err = parseRowFilter(ctx, &Opts{MinAltCount: -1}, nil, nil)
+	assert.HasSubstr(t, err.Error(), "invalid min-alt-count=")
+}
+
+func TestParseVCFPositions(t *testing.T) {
+	var refs []*sam.Reference
+	for _, name := range []string{"chr1", "chr2"} {
+		ref, err := sam.NewReference(name, "", "", 100, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	entries, err := parseVCFPositions(strings.NewReader(`##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+chr2	3	.	A	C	.	.	.
+chr1	50	.	AT	A	.	.	.
+chr1	7	.	G	T	.	.	.
+`), header.Refs())
+	assert.NoError(t, err)
+	assert.EQ(t, entries, []interval.Entry{
+		{RefName: "chr1", Start0: 6, End: 7},
+		{RefName: "chr1", Start0: 49, End: 50},
+		{RefName: "chr2", Start0: 2, End: 3},
+	})
+	_, err = parseVCFPositions(strings.NewReader("chr3\t1\n"), header.Refs())
+	assert.HasSubstr(t, err.Error(), "unknown reference chr3")
+	_, err = parseVCFPositions(strings.NewReader("chr1\t101\n"), header.Refs())
+	assert.HasSubstr(t, err.Error(), "invalid position chr1:101")
+}
+
+func TestRowFilter(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	// The reference base is A at every position.
+	refSeqs := [][]byte{[]byte(strings.Repeat("\x01", 20))}
+	newRow := func(pos uint32, nRef, nAlt uint32) pileupRow {
+		pr := pileupRow{fieldsPresent: fieldCounts, pos: pos}
+		pr.payload.depth = nRef + nAlt
+		pr.payload.counts[pileup.BaseA] = [2]uint32{nRef, 0}
+		pr.payload.counts[pileup.BaseG] = [2]uint32{0, nAlt}
+		return pr
+	}
+	rows := []pileupRow{
+		newRow(1, 10, 0),
+		newRow(2, 10, 1),
+		newRow(3, 10, 5),
+		newRow(4, 1, 2),
+		newRow(5, 20, 3),
+	}
+	ref, err := sam.NewReference("chr1", "", "", 20, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	positions, err := interval.NewBEDUnionFromEntries([]interval.Entry{{RefName: "chr1", Start0: 0, End: 5}}, interval.NewBEDOpts{SAMHeader: header})
+	assert.NoError(t, err)
+	for _, tc := range []struct {
+		rf   *rowFilter
+		want []uint32
+	}{
+		{nil, []uint32{1, 2, 3, 4, 5}},
+		{&rowFilter{minDepth: 5}, []uint32{1, 2, 3, 5}},
+		{&rowFilter{minAltCount: 2, refSeqs: refSeqs}, []uint32{3, 4, 5}},
+		{&rowFilter{minDepth: 5, minAltCount: 4, refSeqs: refSeqs}, []uint32{3}},
+		{&rowFilter{positions: &positions}, []uint32{1, 2, 3, 4}},
+	} {
+		var got []uint32
+		for i := range rows {
+			if tc.rf.keep(&rows[i]) {
+				got = append(got, rows[i].pos)
+			}
+		}
+		assert.EQ(t, got, tc.want, tc.rf)
+		if tc.rf != nil {
+			assert.EQ(t, tc.rf.nKept, len(tc.want))
+			assert.EQ(t, tc.rf.nDropped, len(rows)-len(tc.want))
+		}
+	}
+
+	// The output writers skip the rows that the filter doesn't keep.
+	f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w := newPileupRowWriter(f, defaultShardCodec)
+	for i := range rows {
+		w.Append(&rows[i])
+	}
+	assert.NoError(t, w.Finish())
+	mainPath := filepath.Join(tmpdir, "out")
+	rf := &rowFilter{minAltCount: 2, refSeqs: refSeqs}
+	assert.NoError(t, convertPileupRowsToTSV(vcontext.Background(), []*os.File{f}, mainPath, colBitDpRef|colBitHighQ, compressNone, 1, []string{"chr1"}, refSeqs, nil, nil, rf))
+	data, err := ioutil.ReadFile(mainPath + ".ref.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(data), "#CHROM\tPOS\tREF\tDP\tref_depth_tier1\n"+"chr1\t4\tA\t15\t10\n"+"chr1\t5\tA\t3\t1\n"+"chr1\t6\tA\t23\t20\n")
+	assert.EQ(t, rf.String(), "3 positions kept, 2 dropped")
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/hts/sam"
+)
+
+// The intermediate per-task files of Pileup, in TempDir (or in the
+// checkpoint directory when Opts.Resume is set), can be read with RowReader,
+// and files in the same format can be written with RowWriter.  The format
+// is:
+//
+// - A recordio file with one item per position, in position order.  The
+//   blocks are compressed with the transformers listed in the recordio
+//   header: "zstd 1" by default, or as selected by Opts.ShardCodec.  The
+//   "grail-snp-snappy" and "grail-snp-lz4" transformers are registered by
+//   this package.
+// - The "pileup_row_schema" header entry describes the row layout, as
+//   "<version>;<field>;<field>;...".  Each field is "<name>/<id>/<width>",
+//   where id is the field's bit in the row's field mask, and width is its
+//   size in bytes, or "var" for a variable-width field.
+// - Each item starts with four little-endian uint32s: the field mask, the
+//   reference ID (an index into the BAM/PAM header's references), the 0-based
+//   position, and the depth.  The fields in the mask follow, in schema order.
+//   Variable-width fields are prefixed by their size in bytes, as a uvarint,
+//   so that readers can skip the fields they don't know.  Fields of width 0
+//   are flags which modify the encoding of other fields.
+//
+// The encoding of each field is documented at marshalPileupRow.  Files
+// without a schema header were written by older versions of Pileup; they
+// are still readable.
+
+// RowReader reads Rows from an intermediate pileup file.  Typical usage:
+//
+//   r := snp.NewRowReader(f, header.Refs())
+//   for r.Scan() {
+//     row := r.Row()
+//     ...
+//   }
+//   if err := r.Err(); err != nil {
+//     ...
+//   }
+type RowReader struct {
+	scanner recordio.Scanner
+	refs    []*sam.Reference
+	row     Row
+	err     error
+}
+
+// NewRowReader returns a reader for the intermediate pileup file r.  refs
+// should be the references of the BAM/PAM file the pileup was computed from;
+// they are used to fill in Row.RefName.  If refs is nil, RefName is left
+// empty.
+func NewRowReader(r io.ReadSeeker, refs []*sam.Reference) *RowReader {
+	return &RowReader{
+		scanner: newPileupRowScanner(r),
+		refs:    refs,
+	}
+}
+
+// Scan reads the next row.  It returns false at the end of the file, or on
+// error; call Err to distinguish the two.
+func (r *RowReader) Scan() bool {
+	if (r.err != nil) || !r.scanner.Scan() {
+		return false
+	}
+	pr := r.scanner.Get().(*pileupRow)
+	if (r.refs != nil) && (int(pr.refID) >= len(r.refs)) {
+		r.err = fmt.Errorf("RowReader: reference ID %d out of range (%d references)", pr.refID, len(r.refs))
+		return false
+	}
+	r.row = newRow(pr, r.refs)
+	return true
+}
+
+// Row returns the row read by the last call to Scan.  It is only valid until
+// the next call to Scan.
+func (r *RowReader) Row() *Row {
+	return &r.row
+}
+
+// Err returns the first error encountered by Scan, if any.
+func (r *RowReader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.scanner.Err()
+}
+
+// Close releases the resources of the reader.  It does not close the
+// underlying file.
+func (r *RowReader) Close() error {
+	return r.scanner.Finish()
+}
+
+// RowWriter writes Rows to an intermediate pileup file, which can be read by
+// RowReader.  Rows should be written in position order.
+type RowWriter struct {
+	w recordio.Writer
+}
+
+// NewRowWriter returns a writer which writes to w, with the default
+// compression of the intermediate files.  Finish must be called to flush the
+// rows.
+func NewRowWriter(w io.Writer) *RowWriter {
+	return &RowWriter{w: newPileupRowWriter(w, defaultShardCodec)}
+}
+
+// Write appends row to the file.  Row.RefName is not stored.
+func (w *RowWriter) Write(row *Row) error {
+	if (row.RefID < 0) || (row.Pos < 0) {
+		return fmt.Errorf("RowWriter: invalid position %d:%d", row.RefID, row.Pos)
+	}
+	w.w.Append(newPileupRow(row))
+	return nil
+}
+
+// Finish flushes the rows and finalizes the file.  It does not close the
+// underlying writer.
+func (w *RowWriter) Finish() error {
+	return w.w.Finish()
+}
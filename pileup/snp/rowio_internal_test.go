@@ -0,0 +1,104 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestRowReaderWriter(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	refs := []*sam.Reference{chr1, chr2}
+
+	rows := []Row{
+		{RefID: 0, Pos: 5, Depth: 1},
+		{RefID: 1, Pos: 10, Depth: 4, InsCounts: [2]uint32{1, 0}},
+		{RefID: 1, Pos: 11, Depth: 2},
+	}
+	rows[0].Counts[pileup.BaseA][0] = 1
+	rows[1].Counts[pileup.BaseT][1] = 3
+	rows[1].Indels = []IndelAllele{{InsSeq: "AC", Counts: [2]uint32{1, 0}}}
+	rows[2].PerRead[pileup.BaseG] = []ReadFeatures{
+		{Dist5p: 3, FragLen: 150, Qual: 37, Strand: byte(pileup.StrandFwd)},
+		{Dist5p: 70, FragLen: 140, Qual: 63, Strand: byte(pileup.StrandRev), MapQ: 60, NM: 2, Cycle: 70, ClipDist: clipDistNone},
+	}
+	rows[2].Counts[pileup.BaseG] = [2]uint32{1, 1}
+
+	f, err := ioutil.TempFile(tmpdir, "rows*.rio")
+	assert.NoError(t, err)
+	w := NewRowWriter(f)
+	for i := range rows {
+		assert.NoError(t, w.Write(&rows[i]))
+	}
+	assert.NotNil(t, w.Write(&Row{RefID: -1}))
+	assert.NoError(t, w.Finish())
+
+	_, err = f.Seek(0, 0)
+	assert.NoError(t, err)
+	r := NewRowReader(f, refs)
+	var got []Row
+	for r.Scan() {
+		got = append(got, *r.Row())
+	}
+	assert.NoError(t, r.Err())
+	assert.NoError(t, r.Close())
+	rows[0].RefName = "chr1"
+	rows[1].RefName = "chr2"
+	rows[2].RefName = "chr2"
+	assert.EQ(t, got, rows)
+
+	// Rows which refer to missing references are an error.
+	_, err = f.Seek(0, 0)
+	assert.NoError(t, err)
+	r = NewRowReader(f, refs[:1])
+	assert.True(t, r.Scan())
+	assert.False(t, r.Scan())
+	assert.HasSubstr(t, r.Err().Error(), "reference ID 1 out of range")
+}
+
+func TestRowReaderPileupFile(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	pr, _ := testIndelRow()
+
+	// Files written by the main loop can be read without the references.
+	f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w := newPileupRowWriter(f, shardCodec{transformers: []string{lz4TransformerName}})
+	w.Append(pr)
+	assert.NoError(t, w.Finish())
+	_, err = f.Seek(0, 0)
+	assert.NoError(t, err)
+	r := NewRowReader(f, nil)
+	assert.True(t, r.Scan())
+	row := r.Row()
+	assert.EQ(t, row.RefName, "")
+	assert.EQ(t, row.RefID, 1)
+	assert.EQ(t, row.Pos, PosType(10))
+	assert.EQ(t, row.Counts[pileup.BaseT][1], uint32(3))
+	assert.EQ(t, row.Indels, []IndelAllele{{InsSeq: "AC", Counts: [2]uint32{1, 2}}})
+	assert.False(t, r.Scan())
+	assert.NoError(t, r.Err())
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/recordio"
+)
+
+// pileupRowSchemaHeader is the recordio header key of the row schema of an
+// intermediate pileupRow file.  Files written before the schema existed
+// don't have it; their rows are decoded as version 1.
+const pileupRowSchemaHeader = "pileup_row_schema"
+
+// pileupRowVersion is the version of the row layout written by
+// marshalPileupRow.
+const pileupRowVersion = 2
+
+// rowFieldVarWidth is the width of variable-width fields.
+const rowFieldVarWidth = -1
+
+// rowField describes a pileupRow field.  id is its fieldsPresent bit, and
+// width is its size in bytes, or rowFieldVarWidth.  Flag fields, which only
+// modify how other fields are encoded, have width 0.
+type rowField struct {
+	name  string
+	id    uint32
+	width int
+}
+
+// pileupRowSchema is the list of fields written by marshalPileupRow, in
+// layout order.  To add a field, allocate a fieldsPresent bit for it and
+// append it here; readers skip the fields they don't know, so older
+// binaries can still read newer files.  Changing the encoding of an existing
+// field requires a new field ID.
+var pileupRowSchema = []rowField{
+	{"counts", fieldCounts, 40},
+	// Only read, from files written before clipDist was widened.
+	{"per_read_extended", fieldPerReadExtended16, 0},
+	{"per_read_a", fieldPerReadA, rowFieldVarWidth},
+	{"per_read_c", fieldPerReadC, rowFieldVarWidth},
+	{"per_read_g", fieldPerReadG, rowFieldVarWidth},
+	{"per_read_t", fieldPerReadT, rowFieldVarWidth},
+	{"indel_counts", fieldIndelCounts, 16},
+	{"indel_alleles", fieldIndelAlleles, rowFieldVarWidth},
+	{"extensions", fieldExtensions, rowFieldVarWidth},
+	{"qual_weights", fieldQualWeights, 32},
+	{"ext_counts", fieldExtCounts, 24},
+	{"hap_counts", fieldHapCounts, 52},
+	{"per_read_extended_32", fieldPerReadExtended, 0},
+}
+
+// pileupRowSchemaString is the pileupRowSchemaHeader value of the files
+// written by this binary.
+var pileupRowSchemaString = formatRowSchema(pileupRowVersion, pileupRowSchema)
+
+// formatRowSchema returns the header value describing the given layout, e.g.
+// "2;counts/1/40;per_read_a/2/var;...".
+func formatRowSchema(version int, fields []rowField) string {
+	parts := []string{strconv.Itoa(version)}
+	for _, f := range fields {
+		width := "var"
+		if f.width != rowFieldVarWidth {
+			width = strconv.Itoa(f.width)
+		}
+		parts = append(parts, f.name+"/"+strconv.FormatUint(uint64(f.id), 10)+"/"+width)
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseRowSchema parses a header value written by formatRowSchema.
+func parseRowSchema(s string) (version int, fields []rowField, err error) {
+	parts := strings.Split(s, ";")
+	if version, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, nil, fmt.Errorf("invalid row schema %q", s)
+	}
+	for _, part := range parts[1:] {
+		f := strings.Split(part, "/")
+		if len(f) != 3 {
+			return 0, nil, fmt.Errorf("invalid row schema field %q", part)
+		}
+		id, err := strconv.ParseUint(f[1], 10, 32)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid row schema field %q", part)
+		}
+		width := rowFieldVarWidth
+		if f[2] != "var" {
+			if width, err = strconv.Atoi(f[2]); err != nil || width < 0 {
+				return 0, nil, fmt.Errorf("invalid row schema field %q", part)
+			}
+		}
+		fields = append(fields, rowField{name: f[0], id: uint32(id), width: width})
+	}
+	return version, fields, nil
+}
+
+// pileupRowDecoder decodes the rows of a file, given its schema.
+type pileupRowDecoder struct {
+	// v1 is true for files without a schema header.
+	v1     bool
+	fields []rowField
+	// known is the union of the IDs of the fields this binary can decode.
+	known uint32
+	// err is the error in the file's schema, if any; it is returned for
+	// every row.
+	err error
+}
+
+var currentRowDecoder = newRowDecoder(pileupRowSchema)
+
+func newRowDecoder(fields []rowField) pileupRowDecoder {
+	d := pileupRowDecoder{fields: fields}
+	for _, f := range fields {
+		for _, g := range pileupRowSchema {
+			if f.id != g.id {
+				continue
+			}
+			if f.width != g.width {
+				d.err = fmt.Errorf("unmarshalPileupRow: field %s has width %d, expected %d", f.name, f.width, g.width)
+				return d
+			}
+			d.known |= f.id
+		}
+	}
+	return d
+}
+
+// newPileupRowDecoder returns the decoder for a file with the given recordio
+// header.
+func newPileupRowDecoder(header recordio.ParsedHeader) pileupRowDecoder {
+	for _, kv := range header {
+		if kv.Key != pileupRowSchemaHeader {
+			continue
+		}
+		s, ok := kv.Value.(string)
+		if !ok {
+			return pileupRowDecoder{err: fmt.Errorf("unmarshalPileupRow: invalid %s header", pileupRowSchemaHeader)}
+		}
+		version, fields, err := parseRowSchema(s)
+		if err != nil {
+			return pileupRowDecoder{err: fmt.Errorf("unmarshalPileupRow: %v", err)}
+		}
+		if version < 2 {
+			return pileupRowDecoder{err: fmt.Errorf("unmarshalPileupRow: unsupported row version %d", version)}
+		}
+		return newRowDecoder(fields)
+	}
+	return pileupRowDecoder{v1: true}
+}
+
+func (d *pileupRowDecoder) unmarshal(in []byte) (interface{}, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.v1 {
+		return unmarshalPileupRowV1(in)
+	}
+	if len(in) < 16 {
+		return nil, fmt.Errorf("unmarshalPileupRow: truncated row")
+	}
+	offset := 0
+	inStart := cutAndAdvance(&offset, in, 16)
+	pr := &pileupRow{
+		fieldsPresent: binary.LittleEndian.Uint32(inStart[:4]),
+		refID:         binary.LittleEndian.Uint32(inStart[4:8]),
+		pos:           binary.LittleEndian.Uint32(inStart[8:12]),
+	}
+	pr.payload.depth = binary.LittleEndian.Uint32(inStart[12:16])
+	for _, f := range d.fields {
+		if pr.fieldsPresent&f.id == 0 {
+			continue
+		}
+		size := uint64(f.width)
+		if f.width == rowFieldVarWidth {
+			var err error
+			if size, offset, err = getUvarint(in, offset); err != nil {
+				return nil, err
+			}
+		}
+		if size > uint64(len(in)-offset) {
+			return nil, fmt.Errorf("unmarshalPileupRow: truncated %s", f.name)
+		}
+		body := cutAndAdvance(&offset, in, int(size))
+		if d.known&f.id == 0 {
+			// Skip the field, and hide it from the rest of the code.
+			pr.fieldsPresent &^= f.id
+			continue
+		}
+		if err := decodeRowField(body, f, pr); err != nil {
+			return nil, err
+		}
+	}
+	// Fields which are absent from the file's schema can't have been written.
+	pr.fieldsPresent &= d.known
+	if pr.fieldsPresent&fieldPerReadExtended16 != 0 {
+		// getPerRead converted the features.
+		pr.fieldsPresent ^= fieldPerReadExtended16 | fieldPerReadExtended
+	}
+	return pr, nil
+}
+
+// decodeRowField decodes body, the contents of field f, into pr.
+func decodeRowField(body []byte, f rowField, pr *pileupRow) (err error) {
+	var n int
+	switch f.id {
+	case fieldCounts:
+		n, err = getCounts(body, 0, pr)
+	case fieldPerReadA, fieldPerReadC, fieldPerReadG, fieldPerReadT:
+		b := 0
+		for (fieldPerReadA << uint(b)) != f.id {
+			b++
+		}
+		n, err = getPerRead(body, 0, pr, b)
+	case fieldIndelCounts:
+		n, err = getIndelCounts(body, 0, pr)
+	case fieldIndelAlleles:
+		n, err = getIndelAlleles(body, 0, pr)
+	case fieldExtensions:
+		n, err = getExtensions(body, 0, pr)
+	case fieldQualWeights:
+		n, err = getQualWeights(body, 0, pr)
+	case fieldExtCounts:
+		n, err = getExtCounts(body, 0, pr)
+	case fieldHapCounts:
+		n, err = getHapCounts(body, 0, pr)
+	}
+	if (err == nil) && (n != len(body)) {
+		err = fmt.Errorf("unmarshalPileupRow: corrupt %s", f.name)
+	}
+	return err
+}
+
+// newPileupRowScanner returns a scanner for the intermediate pileupRow file
+// r, which decodes rows according to the file's schema header.
+func newPileupRowScanner(r io.ReadSeeker) recordio.Scanner {
+	var (
+		once    sync.Once
+		dec     pileupRowDecoder
+		scanner recordio.Scanner
+	)
+	scanner = recordio.NewScanner(r, recordio.ScannerOpts{
+		Unmarshal: func(in []byte) (interface{}, error) {
+			once.Do(func() { dec = newPileupRowDecoder(scanner.Header()) })
+			return dec.unmarshal(in)
+		},
+	})
+	return scanner
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/grailbio/base/recordio"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestRowSchemaFormat(t *testing.T) {
+	version, fields, err := parseRowSchema(pileupRowSchemaString)
+	assert.NoError(t, err)
+	assert.EQ(t, version, pileupRowVersion)
+	assert.EQ(t, fields, pileupRowSchema)
+
+	for _, bad := range []string{"", "x;counts/1/40", "2;counts/1", "2;counts/x/40", "2;counts/1/-2"} {
+		_, _, err := parseRowSchema(bad)
+		assert.NotNil(t, err, bad)
+	}
+	// A known field with a different width can't be decoded.
+	d := newRowDecoder([]rowField{{"counts", fieldCounts, 20}})
+	_, err = d.unmarshal(make([]byte, 36))
+	assert.HasSubstr(t, err.Error(), "field counts has width 20")
+}
+
+// testIndelRow returns a row with counts and indel alleles, along with its
+// version 1 encoding.
+func testIndelRow() (*pileupRow, []byte) {
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts | fieldIndelAlleles,
+		refID:         1,
+		pos:           10,
+		payload: pileupPayload{
+			depth:  4,
+			indels: []indelAllele{{insSeq: "AC", counts: [2]uint32{1, 2}}},
+		},
+	}
+	pr.payload.counts[pileup.BaseT][1] = 3
+	v1 := make([]byte, 16+40+4+16+2)
+	binary.LittleEndian.PutUint32(v1[0:], pr.fieldsPresent)
+	binary.LittleEndian.PutUint32(v1[4:], 1)
+	binary.LittleEndian.PutUint32(v1[8:], 10)
+	binary.LittleEndian.PutUint32(v1[12:], 4)
+	binary.LittleEndian.PutUint32(v1[16+28:], 3)
+	binary.LittleEndian.PutUint32(v1[56:], 1)
+	binary.LittleEndian.PutUint32(v1[64:], 1)
+	binary.LittleEndian.PutUint32(v1[68:], 2)
+	binary.LittleEndian.PutUint32(v1[72:], 2)
+	copy(v1[76:], "AC")
+	return pr, v1
+}
+
+func TestRowDecoderUnknownFields(t *testing.T) {
+	pr, _ := testIndelRow()
+	data, err := marshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+
+	// A newer writer added a variable-width field between counts and the
+	// indel alleles, and a fixed-width field at the end.
+	const fieldNewVar, fieldNewFixed = 1 << 20, 1 << 21
+	schema := append([]rowField{pileupRowSchema[0], {"new_var", fieldNewVar, rowFieldVarWidth}}, pileupRowSchema[1:]...)
+	schema = append(schema, rowField{"new_fixed", fieldNewFixed, 2})
+	var newData []byte
+	newData = append(newData, data[:16+40]...)
+	newData = append(newData, 3, 'x', 'y', 'z')
+	newData = append(newData, data[16+40:]...)
+	newData = append(newData, 7, 8)
+	binary.LittleEndian.PutUint32(newData, pr.fieldsPresent|fieldNewVar|fieldNewFixed)
+
+	d := newRowDecoder(schema)
+	got, err := d.unmarshal(newData)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*pileupRow), pr)
+
+	_, err = d.unmarshal(newData[:len(newData)-1])
+	assert.HasSubstr(t, err.Error(), "truncated new_fixed")
+}
+
+func TestPileupRowScannerVersions(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+	pr, v1 := testIndelRow()
+
+	// Current files.
+	f, err := ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w := newPileupRowWriter(f, defaultShardCodec)
+	w.Append(pr)
+	assert.NoError(t, w.Finish())
+	_, err = f.Seek(0, 0)
+	assert.NoError(t, err)
+	scanner := newPileupRowScanner(f)
+	assert.True(t, scanner.Scan())
+	assert.EQ(t, scanner.Get().(*pileupRow), pr)
+	assert.False(t, scanner.Scan())
+	assert.NoError(t, scanner.Err())
+
+	// Version 1 files have no schema header.
+	f, err = ioutil.TempFile(tmpdir, "pileup_tmp*.rio")
+	assert.NoError(t, err)
+	w = recordio.NewWriter(f, recordio.WriterOpts{})
+	w.Append(v1)
+	assert.NoError(t, w.Finish())
+	_, err = f.Seek(0, 0)
+	assert.NoError(t, err)
+	scanner = newPileupRowScanner(f)
+	assert.True(t, scanner.Scan())
+	assert.EQ(t, scanner.Get().(*pileupRow), pr)
+	assert.NoError(t, scanner.Err())
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"sort"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+)
+
+// shardSchedule is the Opts.ShardSchedule policy.
+type shardSchedule int
+
+const (
+	// scheduleBalanced gives each job an equal part of the genome, as
+	// computed by bamprovider.GenerateShards, regardless of contig
+	// boundaries.
+	scheduleBalanced shardSchedule = iota
+	// scheduleContig moves the job boundaries to contig boundaries where that
+	// doesn't unbalance the jobs much, so that most contigs are processed by
+	// a single job, and cuts each job's part of the genome into one shard per
+	// contig.
+	scheduleContig
+	// scheduleTargets only covers the BED intervals: each shard is a BED
+	// interval, or a cluster of nearby ones, and the jobs get equal numbers
+	// of targeted positions.  References without any interval are skipped.
+	scheduleTargets
+)
+
+func parseShardSchedule(s string) (shardSchedule, error) {
+	switch s {
+	case "", "balanced":
+		return scheduleBalanced, nil
+	case "contig":
+		return scheduleContig, nil
+	case "targets":
+		return scheduleTargets, nil
+	}
+	return scheduleBalanced, fmt.Errorf("Pileup: invalid shard-schedule= argument %q (expected balanced, contig, or targets)", s)
+}
+
+func (s shardSchedule) String() string {
+	switch s {
+	case scheduleContig:
+		return "contig"
+	case scheduleTargets:
+		return "targets"
+	}
+	return "balanced"
+}
+
+// contigAffinitySlack is how far (as a fraction of the average job size) a
+// job boundary may be moved to reach a contig boundary.
+const contigAffinitySlack = 0.25
+
+// contigAffinityShards splits refs into shards for at most nJob jobs, with
+// the scheduleContig policy.  It returns the shards, in coordinate order, and
+// jobStarts, where job j processes shards[jobStarts[j]:jobStarts[j+1]].
+//
+// Job sizes are measured in reference positions.  The ideal boundary between
+// jobs j-1 and j is at j/nJob of the genome; if a contig boundary is within
+// contigAffinitySlack of the average job size of it, it is used instead.
+func contigAffinityShards(refs []*sam.Reference, nJob, padding int) (shards []gbam.Shard, jobStarts []int) {
+	// refStarts[i] is the genome-wide offset of refs[i], and
+	// refStarts[len(refs)] is the genome length.
+	refStarts := make([]int64, len(refs)+1)
+	for i, ref := range refs {
+		refStarts[i+1] = refStarts[i] + int64(ref.Len())
+	}
+	total := refStarts[len(refs)]
+	if (nJob < 1) || (total == 0) {
+		return nil, []int{0}
+	}
+	jobLen := float64(total) / float64(nJob)
+	bounds := []int64{0}
+	for j := 1; j < nJob; j++ {
+		ideal := int64(float64(j) * jobLen)
+		// The contig boundaries (excluding 0 and the genome end) nearest to
+		// ideal are refStarts[k-1] and refStarts[k].
+		k := sort.Search(len(refs), func(i int) bool { return refStarts[i] >= ideal })
+		best, bestDist := ideal, int64(-1)
+		for _, c := range []int{k - 1, k} {
+			if (c <= 0) || (c >= len(refs)) {
+				continue
+			}
+			d := abs64(refStarts[c] - ideal)
+			if (float64(d) <= contigAffinitySlack*jobLen) && ((bestDist < 0) || (d < bestDist)) {
+				best, bestDist = refStarts[c], d
+			}
+		}
+		if best > bounds[len(bounds)-1] {
+			bounds = append(bounds, best)
+		}
+	}
+	bounds = append(bounds, total)
+
+	// Cut each job's [bounds[j], bounds[j+1]) range at the contig boundaries.
+	refIdx := 0
+	for j := 0; j+1 < len(bounds); j++ {
+		jobStarts = append(jobStarts, len(shards))
+		for start := bounds[j]; start < bounds[j+1]; {
+			for refStarts[refIdx+1] <= start {
+				refIdx++
+			}
+			end := refStarts[refIdx+1]
+			if end > bounds[j+1] {
+				end = bounds[j+1]
+			}
+			shards = append(shards, gbam.Shard{
+				StartRef: refs[refIdx],
+				EndRef:   refs[refIdx],
+				Start:    int(start - refStarts[refIdx]),
+				End:      int(end - refStarts[refIdx]),
+				Padding:  padding,
+				ShardIdx: len(shards),
+			})
+			start = end
+		}
+	}
+	jobStarts = append(jobStarts, len(shards))
+	return shards, jobStarts
+}
+
+// targetShards splits the intervals of bedUnion into shards for at most nJob
+// jobs, with the scheduleTargets policy.  Intervals less than 2*padding apart
+// share a shard, since the reads between them are read anyway.  The return
+// values are as for contigAffinityShards; there are no shards if bedUnion
+// doesn't cover any position of refs.
+func targetShards(refs []*sam.Reference, bedUnion *interval.BEDUnion, nJob, padding int) (shards []gbam.Shard, jobStarts []int) {
+	type target struct {
+		ref        *sam.Reference
+		start, end int
+	}
+	var targets []target
+	var total int64
+	for _, ref := range refs {
+		endpoints := bedUnion.EndpointsByID(ref.ID())
+		for i := 0; i+1 < len(endpoints); i += 2 {
+			start, end := int(endpoints[i]), min(int(endpoints[i+1]), ref.Len())
+			if start >= end {
+				continue
+			}
+			if n := len(targets); (n > 0) && (targets[n-1].ref == ref) && (start-targets[n-1].end < 2*padding) {
+				total += int64(end - targets[n-1].end)
+				targets[n-1].end = end
+				continue
+			}
+			targets = append(targets, target{ref: ref, start: start, end: end})
+			total += int64(end - start)
+		}
+	}
+	if (nJob < 1) || (total == 0) {
+		return nil, []int{0}
+	}
+	// Job j covers the targeted positions [j*jobLen, (j+1)*jobLen) in
+	// coordinate order; the shards are cut at the job boundaries.
+	jobLen := (total + int64(nJob) - 1) / int64(nJob)
+	var done int64
+	for _, t := range targets {
+		for start := t.start; start < t.end; {
+			if done == int64(len(jobStarts))*jobLen {
+				jobStarts = append(jobStarts, len(shards))
+			}
+			end := t.end
+			if jobEnd := int64(len(jobStarts)) * jobLen; int64(end-start) > jobEnd-done {
+				end = start + int(jobEnd-done)
+			}
+			shards = append(shards, gbam.Shard{
+				StartRef: t.ref,
+				EndRef:   t.ref,
+				Start:    start,
+				End:      end,
+				Padding:  padding,
+				ShardIdx: len(shards),
+			})
+			done += int64(end - start)
+			start = end
+		}
+	}
+	jobStarts = append(jobStarts, len(shards))
+	return shards, jobStarts
+}
+
+func abs64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// scheduleStats describes the locality of a shard schedule.  Each job loads
+// the reference sequence and the index bins of every contig its shards touch.
+// The first load of a contig is unavoidable, but every further load (by
+// another job) is a miss that a per-contig cache shared by the jobs would
+// have served, and that a schedule with more contig affinity avoids.
+type scheduleStats struct {
+	jobs    int
+	contigs int
+	// contigLoads is the number of (job, contig) pairs, and splitContigs is
+	// the number of contigs which are touched by more than one job.
+	contigLoads  int
+	splitContigs int
+}
+
+// hitRate returns the fraction of contig loads which aren't misses, i.e.
+// contigs / contigLoads.
+func (s scheduleStats) hitRate() float64 {
+	if s.contigLoads == 0 {
+		return 1
+	}
+	return float64(s.contigs) / float64(s.contigLoads)
+}
+
+func (s scheduleStats) String() string {
+	return fmt.Sprintf("%d jobs, %d contigs, %d contig loads, %d contigs split across jobs, reference cache hit rate %.1f%%",
+		s.jobs, s.contigs, s.contigLoads, s.splitContigs, 100*s.hitRate())
+}
+
+// shardRefIDs returns the IDs of the references touched by shard.
+func shardRefIDs(shard *gbam.Shard, nRef int) []int {
+	if shard.StartRef == nil {
+		return nil
+	}
+	end := nRef - 1
+	if shard.EndRef != nil {
+		end = shard.EndRef.ID()
+		if (end > shard.StartRef.ID()) && (shard.End == 0) {
+			// The shard stops at the start of EndRef.
+			end--
+		}
+	}
+	var ids []int
+	for id := shard.StartRef.ID(); id <= end; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// computeScheduleStats returns the locality of the schedule where job j
+// processes jobShards(j).
+func computeScheduleStats(nJob, nRef int, jobShards func(int) []gbam.Shard) scheduleStats {
+	s := scheduleStats{jobs: nJob}
+	jobsPerRef := make([]int, nRef)
+	for j := 0; j < nJob; j++ {
+		touched := make(map[int]bool)
+		shards := jobShards(j)
+		for i := range shards {
+			for _, id := range shardRefIDs(&shards[i], nRef) {
+				touched[id] = true
+			}
+		}
+		for id := range touched {
+			jobsPerRef[id]++
+		}
+		s.contigLoads += len(touched)
+	}
+	for _, n := range jobsPerRef {
+		if n > 0 {
+			s.contigs++
+		}
+		if n > 1 {
+			s.splitContigs++
+		}
+	}
+	return s
+}
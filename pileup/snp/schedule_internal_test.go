@@ -0,0 +1,132 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestContigAffinityShards(t *testing.T) {
+	var refs []*sam.Reference
+	for i, length := range []int{100, 60, 40, 100} {
+		ref, err := sam.NewReference(fmt.Sprintf("chr%d", i+1), "", "", length, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	_, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+
+	// describe returns the job boundaries and the shards of each job, as
+	// strings.
+	describe := func(nJob int) ([]int, [][]string, scheduleStats) {
+		shards, jobStarts := contigAffinityShards(refs, nJob, 10)
+		jobShards := func(j int) []gbam.Shard { return shards[jobStarts[j]:jobStarts[j+1]] }
+		var desc [][]string
+		for j := 0; j+1 < len(jobStarts); j++ {
+			var jobDesc []string
+			for _, s := range jobShards(j) {
+				assert.EQ(t, s.Padding, 10)
+				jobDesc = append(jobDesc, fmt.Sprintf("%s:%d-%d", s.StartRef.Name(), s.Start, s.End))
+			}
+			desc = append(desc, jobDesc)
+		}
+		return jobStarts, desc, computeScheduleStats(len(jobStarts)-1, len(refs), jobShards)
+	}
+
+	// The ideal job boundaries are contig boundaries.
+	jobStarts, desc, stats := describe(3)
+	assert.EQ(t, jobStarts, []int{0, 1, 3, 4})
+	assert.EQ(t, desc, [][]string{{"chr1:0-100"}, {"chr2:0-60", "chr3:0-40"}, {"chr4:0-100"}})
+	assert.EQ(t, stats, scheduleStats{jobs: 3, contigs: 4, contigLoads: 4})
+
+	// The boundary at 150 moves to the start of chr3.
+	_, desc, stats = describe(2)
+	assert.EQ(t, desc, [][]string{{"chr1:0-100", "chr2:0-60"}, {"chr3:0-40", "chr4:0-100"}})
+	assert.EQ(t, stats.hitRate(), 1.0)
+
+	// The boundaries at 75 and 225 are too far from contig boundaries.
+	_, desc, stats = describe(4)
+	assert.EQ(t, desc, [][]string{{"chr1:0-75"}, {"chr1:75-100", "chr2:0-60"}, {"chr3:0-40", "chr4:0-25"}, {"chr4:25-100"}})
+	assert.EQ(t, stats, scheduleStats{jobs: 4, contigs: 4, contigLoads: 6, splitContigs: 2})
+}
+
+func TestTargetShards(t *testing.T) {
+	var refs []*sam.Reference
+	for i, length := range []int{1000, 500, 800} {
+		ref, err := sam.NewReference(fmt.Sprintf("chr%d", i+1), "", "", length, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	bedUnion, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 100, End: 150},
+		{RefName: "chr1", Start0: 160, End: 200},
+		{RefName: "chr1", Start0: 600, End: 700},
+		{RefName: "chr3", Start0: 0, End: 100},
+	}, interval.NewBEDOpts{SAMHeader: header})
+	assert.NoError(t, err)
+
+	describe := func(nJob int) [][]string {
+		shards, jobStarts := targetShards(refs, &bedUnion, nJob, 10)
+		var desc [][]string
+		for j := 0; j+1 < len(jobStarts); j++ {
+			var jobDesc []string
+			for _, s := range shards[jobStarts[j]:jobStarts[j+1]] {
+				assert.EQ(t, s.Padding, 10)
+				jobDesc = append(jobDesc, fmt.Sprintf("%s:%d-%d", s.StartRef.Name(), s.Start, s.End))
+			}
+			desc = append(desc, jobDesc)
+		}
+		return desc
+	}
+	// The first two intervals are less than 2*padding apart, so they share a
+	// shard, and chr2 is skipped.
+	assert.EQ(t, describe(3), [][]string{{"chr1:100-200"}, {"chr1:600-700"}, {"chr3:0-100"}})
+	// The jobs are cut at 150 targeted positions.
+	assert.EQ(t, describe(2), [][]string{{"chr1:100-200", "chr1:600-650"}, {"chr1:650-700", "chr3:0-100"}})
+
+	empty, err := interval.NewBEDUnionFromEntries(nil, interval.NewBEDOpts{SAMHeader: header})
+	assert.NoError(t, err)
+	shards, jobStarts := targetShards(refs, &empty, 4, 10)
+	assert.EQ(t, len(shards), 0)
+	assert.EQ(t, jobStarts, []int{0})
+}
+
+func TestScheduleStats(t *testing.T) {
+	var refs []*sam.Reference
+	for i := 0; i < 3; i++ {
+		ref, err := sam.NewReference(fmt.Sprintf("chr%d", i+1), "", "", 100, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	_, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+
+	// Shards which end at the start of a reference don't touch it.
+	shards := []gbam.Shard{
+		{StartRef: refs[0], EndRef: refs[1], Start: 0, End: 0},
+		{StartRef: refs[1], EndRef: refs[2], Start: 0, End: 50},
+		{StartRef: refs[2], EndRef: nil, Start: 50, End: 0},
+	}
+	stats := computeScheduleStats(3, len(refs), func(j int) []gbam.Shard { return shards[j : j+1] })
+	assert.EQ(t, stats, scheduleStats{jobs: 3, contigs: 3, contigLoads: 4, splitContigs: 1})
+	assert.EQ(t, stats.hitRate(), 0.75)
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// shardPlanVersion is the version of the shard plan format.
+const shardPlanVersion = 1
+
+// shardPlan is the JSON form of a run's shards (Opts.ShardPlanOut), with the
+// time spent on each, so that later runs on the same sample or panel can
+// reuse it (Opts.ShardPlan).
+type shardPlan struct {
+	Version int `json:"version"`
+	// Refs are the references of the run, which must match those of a run
+	// that reuses the plan.
+	Refs   []shardPlanRef   `json:"refs"`
+	Shards []shardPlanShard `json:"shards"`
+}
+
+type shardPlanRef struct {
+	Name string `json:"name"`
+	Len  int    `json:"len"`
+}
+
+// shardPlanShard is a gbam.Shard, with its references identified by name.
+// EndRef is "" for a shard which extends to the end of the genome.
+type shardPlanShard struct {
+	StartRef string `json:"start_ref"`
+	Start    int    `json:"start"`
+	StartSeq int    `json:"start_seq,omitempty"`
+	EndRef   string `json:"end_ref"`
+	End      int    `json:"end"`
+	EndSeq   int    `json:"end_seq,omitempty"`
+	// Seconds is the total time spent by the run's jobs on the shard (over
+	// all attempts, samples, and strands).
+	Seconds float64 `json:"seconds"`
+}
+
+// shardTimer accumulates the time spent on each shard of a run, by ShardIdx.
+// It may be used concurrently.
+type shardTimer struct {
+	nanos []int64
+}
+
+func newShardTimer(nShard int) *shardTimer {
+	return &shardTimer{nanos: make([]int64, nShard)}
+}
+
+func (t *shardTimer) add(shard *gbam.Shard, d time.Duration) {
+	if (shard.ShardIdx >= 0) && (shard.ShardIdx < len(t.nanos)) {
+		atomic.AddInt64(&t.nanos[shard.ShardIdx], int64(d))
+	}
+}
+
+func newShardPlan(refs []*sam.Reference, shards []gbam.Shard, timer *shardTimer) *shardPlan {
+	p := &shardPlan{Version: shardPlanVersion}
+	for _, ref := range refs {
+		p.Refs = append(p.Refs, shardPlanRef{Name: ref.Name(), Len: ref.Len()})
+	}
+	for i := range shards {
+		s := &shards[i]
+		ps := shardPlanShard{
+			Start:    s.Start,
+			StartSeq: s.StartSeq,
+			End:      s.End,
+			EndSeq:   s.EndSeq,
+		}
+		if s.StartRef != nil {
+			ps.StartRef = s.StartRef.Name()
+		}
+		if s.EndRef != nil {
+			ps.EndRef = s.EndRef.Name()
+		}
+		if timer != nil {
+			ps.Seconds = time.Duration(atomic.LoadInt64(&timer.nanos[i])).Seconds()
+		}
+		p.Shards = append(p.Shards, ps)
+	}
+	return p
+}
+
+// shards converts the plan back to gbam.Shards, with the given padding, and
+// returns the shards' costs for balanceJobs.  It fails if the plan was made
+// for different references.
+func (p *shardPlan) shards(refs []*sam.Reference, padding int) (shards []gbam.Shard, costs []float64, err error) {
+	if p.Version != shardPlanVersion {
+		return nil, nil, fmt.Errorf("unsupported shard plan version %d", p.Version)
+	}
+	byName := make(map[string]*sam.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+	if len(p.Refs) != len(refs) {
+		return nil, nil, fmt.Errorf("shard plan has %d references, but the input has %d", len(p.Refs), len(refs))
+	}
+	for i, pr := range p.Refs {
+		if (pr.Name != refs[i].Name()) || (pr.Len != refs[i].Len()) {
+			return nil, nil, fmt.Errorf("shard plan reference %s (length %d) doesn't match input reference %s (length %d)", pr.Name, pr.Len, refs[i].Name(), refs[i].Len())
+		}
+	}
+	if len(p.Shards) == 0 {
+		return nil, nil, fmt.Errorf("shard plan has no shards")
+	}
+	var total float64
+	for i, ps := range p.Shards {
+		s := gbam.Shard{
+			StartRef: byName[ps.StartRef],
+			Start:    ps.Start,
+			StartSeq: ps.StartSeq,
+			End:      ps.End,
+			EndSeq:   ps.EndSeq,
+			Padding:  padding,
+			ShardIdx: i,
+		}
+		if s.StartRef == nil {
+			return nil, nil, fmt.Errorf("shard plan shard %d has unknown reference %q", i, ps.StartRef)
+		}
+		if ps.EndRef != "" {
+			if s.EndRef = byName[ps.EndRef]; s.EndRef == nil {
+				return nil, nil, fmt.Errorf("shard plan shard %d has unknown reference %q", i, ps.EndRef)
+			}
+		}
+		if i > 0 {
+			prev := &shards[i-1]
+			if (prev.EndRef == nil) || gbam.ShardToCoordRange(s).Start.LT(gbam.ShardToCoordRange(*prev).Limit) {
+				return nil, nil, fmt.Errorf("shard plan shards %d and %d overlap or are out of order", i-1, i)
+			}
+		}
+		shards = append(shards, s)
+		costs = append(costs, ps.Seconds)
+		total += ps.Seconds
+	}
+	if total == 0 {
+		// No timings; fall back to equal numbers of shards per job.
+		for i := range costs {
+			costs[i] = 1
+		}
+	}
+	return shards, costs, nil
+}
+
+// balanceJobs splits shards with the given costs between at most nJob jobs,
+// so that the jobs' total costs are as equal as possible without reordering
+// the shards.  It returns jobStarts, where job j processes shards
+// [jobStarts[j], jobStarts[j+1]).
+func balanceJobs(costs []float64, nJob int) []int {
+	var total float64
+	for _, c := range costs {
+		total += c
+	}
+	jobStarts := []int{0}
+	var done float64
+	for i, c := range costs {
+		// Start the next job with shard i if most of it is past the job's ideal
+		// start.
+		if j := len(jobStarts); (i > 0) && (j < nJob) && (done+c/2 > float64(j)*total/float64(nJob)) {
+			jobStarts = append(jobStarts, i)
+		}
+		done += c
+	}
+	return append(jobStarts, len(costs))
+}
+
+func readShardPlan(ctx context.Context, path string) (p *shardPlan, err error) {
+	var f file.File
+	if f, err = file.Open(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	var data []byte
+	if data, err = ioutil.ReadAll(f.Reader(ctx)); err != nil {
+		return
+	}
+	p = &shardPlan{}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func writeShardPlan(ctx context.Context, path string, p *shardPlan) (err error) {
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	enc := json.NewEncoder(dst.Writer(ctx))
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(p); err != nil {
+		return
+	}
+	log.Printf("pileupSNPMain: wrote the shard plan (%d shards) to %s", len(p.Shards), path)
+	return
+}
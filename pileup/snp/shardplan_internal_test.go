@@ -0,0 +1,82 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestBalanceJobs(t *testing.T) {
+	assert.EQ(t, balanceJobs([]float64{1, 1, 1, 1}, 2), []int{0, 2, 4})
+	// The slow first shard gets a job of its own.
+	assert.EQ(t, balanceJobs([]float64{6, 1, 1, 1, 1, 1, 1}, 2), []int{0, 1, 7})
+	assert.EQ(t, balanceJobs([]float64{1, 1, 1, 1, 4, 4}, 3), []int{0, 4, 5, 6})
+	// There are never more jobs than shards.
+	assert.EQ(t, balanceJobs([]float64{1, 1}, 4), []int{0, 1, 2})
+}
+
+func TestShardPlan(t *testing.T) {
+	var refs []*sam.Reference
+	for i, length := range []int{1000, 500} {
+		ref, err := sam.NewReference(fmt.Sprintf("chr%d", i+1), "", "", length, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	_, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	shards := []gbam.Shard{
+		{StartRef: refs[0], EndRef: refs[0], Start: 0, End: 600, ShardIdx: 0},
+		{StartRef: refs[0], EndRef: refs[1], Start: 600, End: 100, ShardIdx: 1},
+		{StartRef: refs[1], EndRef: nil, Start: 100, End: 0, ShardIdx: 2},
+	}
+	timer := newShardTimer(len(shards))
+	timer.add(&shards[0], 2*time.Second)
+	timer.add(&shards[2], time.Second)
+	timer.add(&shards[2], time.Second)
+	timer.add(&gbam.Shard{ShardIdx: -1}, time.Hour)
+
+	data, err := json.Marshal(newShardPlan(refs, shards, timer))
+	assert.NoError(t, err)
+	var plan shardPlan
+	assert.NoError(t, json.Unmarshal(data, &plan))
+	got, costs, err := plan.shards(refs, 50)
+	assert.NoError(t, err)
+	assert.EQ(t, costs, []float64{2, 0, 2})
+	assert.EQ(t, len(got), len(shards))
+	for i := range got {
+		want := shards[i]
+		want.Padding = 50
+		assert.EQ(t, got[i], want)
+	}
+
+	// The references must match.
+	other, err := sam.NewReference("chr2", "", "", 501, nil, nil)
+	assert.NoError(t, err)
+	_, _, err = plan.shards([]*sam.Reference{refs[0], other}, 50)
+	assert.NotNil(t, err)
+	_, _, err = plan.shards(refs[:1], 50)
+	assert.NotNil(t, err)
+	// The shards must be in order.
+	plan.Shards[0], plan.Shards[1] = plan.Shards[1], plan.Shards[0]
+	_, _, err = plan.shards(refs, 50)
+	assert.NotNil(t, err)
+}
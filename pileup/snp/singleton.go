@@ -26,4 +26,5 @@ const PosTypeMax = pileup.PosTypeMax
 
 func init() {
 	recordiozstd.Init()
+	registerShardTransformers()
 }
@@ -0,0 +1,121 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+)
+
+const (
+	// somaticErrorRate is the probability that a high-quality base is a
+	// sequencing error, which the somatic scores assume for every base since
+	// the rows don't keep the base qualities.  Errors are assumed to be
+	// equally likely to produce each of the three other bases.
+	somaticErrorRate = 0.001
+	// somaticMinTLOD and somaticMinNLOD are the thresholds of the STATUS
+	// column, those of MuTect for sites which aren't known germline variants.
+	somaticMinTLOD = 6.3
+	somaticMinNLOD = 2.2
+	// somaticGermlineFrac is the alt allele fraction of a heterozygous
+	// germline variant, the alternative hypothesis of NLOD.
+	somaticGermlineFrac = 0.5
+)
+
+// somaticColumns are the columns written by writeSomaticCols.
+var somaticColumns = []string{"ALT", "TUMOR_AF", "NORMAL_AF", "TLOD", "NLOD", "STATUS"}
+
+// somaticLog10Likelihood returns the log10-likelihood of observing nRef
+// reference and nAlt alt bases at a position with alt allele fraction f.
+func somaticLog10Likelihood(nRef, nAlt uint32, f float64) float64 {
+	pAlt := f*(1-somaticErrorRate) + (1-f)*somaticErrorRate/3
+	pRef := f*somaticErrorRate/3 + (1-f)*(1-somaticErrorRate)
+	return float64(nAlt)*math.Log10(pAlt) + float64(nRef)*math.Log10(pRef)
+}
+
+// somaticScore returns the somatic alt base of a position, the non-reference
+// base (pileup.BaseA..BaseT) with the most tumor support, and its MuTect-style
+// scores: tlod is the log10 likelihood ratio of the tumor bases under an alt
+// allele fraction equal to the observed one vs. no alt allele, and nlod is
+// the log10 likelihood ratio of the normal bases under no alt allele vs. a
+// heterozygous germline variant.  Only the reference and alt bases are
+// considered.  ok is false if the reference base is N or the tumor has no
+// alt bases.
+func somaticScore(tumor, normal *[pileup.NBaseEnumExt][2]uint32, refBase byte) (alt byte, tlod, nlod float64, ok bool) {
+	if refBase >= pileup.NBase {
+		return
+	}
+	var nAlt uint32
+	for b := byte(0); b < pileup.NBase; b++ {
+		if n := tumor[b][0] + tumor[b][1]; (b != refBase) && (n > nAlt) {
+			alt, nAlt = b, n
+		}
+	}
+	if nAlt == 0 {
+		return
+	}
+	nRef := tumor[refBase][0] + tumor[refBase][1]
+	f := float64(nAlt) / float64(nRef+nAlt)
+	tlod = somaticLog10Likelihood(nRef, nAlt, f) - somaticLog10Likelihood(nRef, nAlt, 0)
+	nRef = normal[refBase][0] + normal[refBase][1]
+	nAlt = normal[alt][0] + normal[alt][1]
+	nlod = somaticLog10Likelihood(nRef, nAlt, 0) - somaticLog10Likelihood(nRef, nAlt, somaticGermlineFrac)
+	return alt, tlod, nlod, true
+}
+
+// somaticStatus returns the STATUS column of a scored position.
+func somaticStatus(tlod, nlod float64) string {
+	switch {
+	case tlod < somaticMinTLOD:
+		return "low_tlod"
+	case nlod < somaticMinNLOD:
+		return "low_nlod"
+	}
+	return "PASS"
+}
+
+// alleleFrac returns the fraction of the reference and alt bases of counts
+// which are alt bases, or -1 if there are none.
+func alleleFrac(counts *[pileup.NBaseEnumExt][2]uint32, refBase, alt byte) float64 {
+	nAlt := counts[alt][0] + counts[alt][1]
+	total := nAlt + counts[refBase][0] + counts[refBase][1]
+	if total == 0 {
+		return -1
+	}
+	return float64(nAlt) / float64(total)
+}
+
+// writeSomaticCols appends the somatic columns of a position with the given
+// tumor and normal counts to w.  All of them are '.' if the position has no
+// alt base in the tumor.
+func writeSomaticCols(w *tsv.Writer, tumor, normal *[pileup.NBaseEnumExt][2]uint32, refBase byte) {
+	alt, tlod, nlod, ok := somaticScore(tumor, normal, refBase)
+	if !ok {
+		w.WriteString(".\t.\t.\t.\t.\t.")
+		return
+	}
+	w.WriteByte(pileup.EnumToASCIITable[alt])
+	for _, af := range []float64{alleleFrac(tumor, refBase, alt), alleleFrac(normal, refBase, alt)} {
+		if af < 0 {
+			w.WriteByte('.')
+		} else {
+			w.WriteFloat64(af, 'f', 4)
+		}
+	}
+	w.WriteFloat64(tlod, 'f', 2)
+	w.WriteFloat64(nlod, 'f', 2)
+	w.WriteString(somaticStatus(tlod, nlod))
+}
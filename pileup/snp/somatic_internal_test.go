@@ -0,0 +1,54 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestSomaticScore(t *testing.T) {
+	counts := func(nRef, nAlt uint32) *[pileup.NBaseEnumExt][2]uint32 {
+		var c [pileup.NBaseEnumExt][2]uint32
+		c[pileup.BaseC] = [2]uint32{nRef / 2, nRef - nRef/2}
+		c[pileup.BaseT] = [2]uint32{nAlt, 0}
+		return &c
+	}
+	for _, tc := range []struct {
+		tumorRef, tumorAlt, normalRef, normalAlt uint32
+		tlod, nlod, status                       string
+	}{
+		{50, 10, 30, 0, "23.03", "9.03", "PASS"},
+		// The normal looks like a heterozygous germline variant.
+		{50, 10, 30, 12, "23.03", "-29.08", "low_nlod"},
+		// Two alt bases out of 100 could be sequencing errors.
+		{98, 2, 30, 0, "2.71", "9.03", "low_tlod"},
+	} {
+		alt, tlod, nlod, ok := somaticScore(counts(tc.tumorRef, tc.tumorAlt), counts(tc.normalRef, tc.normalAlt), pileup.BaseC)
+		assert.True(t, ok)
+		assert.EQ(t, alt, byte(pileup.BaseT))
+		assert.EQ(t, fmt.Sprintf("%.2f", tlod), tc.tlod, tc)
+		assert.EQ(t, fmt.Sprintf("%.2f", nlod), tc.nlod, tc)
+		assert.EQ(t, somaticStatus(tlod, nlod), tc.status, tc)
+	}
+
+	// No alt bases in the tumor, or an N reference base.
+	_, _, _, ok := somaticScore(counts(50, 0), counts(30, 3), pileup.BaseC)
+	assert.False(t, ok)
+	_, _, _, ok = somaticScore(counts(50, 10), counts(30, 0), pileup.BaseX)
+	assert.False(t, ok)
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// Row is the pileup result for a single position, as passed to the emit
+// function of StreamPileup, and as read and written by RowReader and
+// RowWriter.
+type Row struct {
+	RefID   int
+	RefName string
+	// Pos is 0-based.
+	Pos PosType
+	// Depth is the number of reads covering the position, including those
+	// with a base below Opts.MinBaseQual.
+	Depth uint32
+	// Counts[b][s] is the number of reads with base b (pileup.BaseA..BaseX) on
+	// strand s (0 = forward, 1 = reverse) and base quality >= MinBaseQual.  Ns
+	// are counted regardless of quality.  The counts of the extended
+	// observation classes (pileup.BaseDel..BaseMod) are only filled in when
+	// Opts.Cols includes "extbases".
+	Counts [pileup.NBaseEnumExt][2]uint32
+	// InsCounts and DelCounts are the per-strand numbers of insertions and
+	// deletions anchored at this position, as in VCF.  They are only filled
+	// in when Opts.Cols includes "indels".
+	InsCounts [2]uint32
+	DelCounts [2]uint32
+	// PerRead[b] has the features of the reads with base b
+	// (pileup.BaseA..BaseT) at the position.  It is only filled in when
+	// Opts.Cols includes a per-read column set (e.g. "quals"), so it is
+	// always empty for StreamPileup.
+	PerRead [pileup.NBase][]ReadFeatures
+	// Indels is the breakdown of InsCounts and DelCounts by allele.  It is
+	// only filled in for the output formats that report indel alleles.
+	Indels []IndelAllele
+}
+
+// ReadFeatures are the features of a single read at a position.
+type ReadFeatures struct {
+	// Dist5p is the 0-based distance of the base from the 5' end of the
+	// fragment, and FragLen is the fragment length.
+	Dist5p  uint32
+	FragLen uint32
+	Qual    byte
+	// Strand is a pileup.StrandType.
+	Strand byte
+
+	// The remaining fields are only filled in when Opts.Cols includes
+	// "readfeats"; see perReadFeatures for their definitions.
+	MapQ      byte
+	ReadGroup uint16
+	NM        uint16
+	Cycle     uint32
+	ClipDist  uint32
+}
+
+// IndelAllele is a single insertion or deletion allele, with per-strand
+// counts.  Like in VCF, indels are anchored at the last reference position
+// before the event.
+type IndelAllele struct {
+	// InsSeq is the inserted sequence for an insertion, and empty for a
+	// deletion.  DelLen is the number of deleted reference bases for a
+	// deletion, and 0 for an insertion.
+	InsSeq string
+	DelLen uint32
+	Counts [2]uint32
+}
+
+// rowEmitter is a recordio.Writer which passes pileupRows to an emit function
+// as Rows, instead of serializing them.  It is shared by all jobs.
+type rowEmitter struct {
+	emit func(*Row) error
+	refs []*sam.Reference
+
+	mu  sync.Mutex
+	row Row
+	err error
+}
+
+func (e *rowEmitter) Append(v interface{}) {
+	pr := v.(*pileupRow)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return
+	}
+	e.row = newRow(pr, e.refs)
+	e.err = e.emit(&e.row)
+}
+
+// newRow converts a pileupRow to a Row.  RefName is left empty if refs is
+// nil.
+func newRow(pr *pileupRow, refs []*sam.Reference) Row {
+	row := Row{
+		RefID:     int(pr.refID),
+		Pos:       PosType(pr.pos),
+		Depth:     pr.payload.depth,
+		Counts:    pr.payload.counts,
+		InsCounts: pr.payload.indelCounts[indelIns],
+		DelCounts: pr.payload.indelCounts[indelDel],
+	}
+	if refs != nil {
+		row.RefName = refs[pr.refID].Name()
+	}
+	for b, features := range pr.payload.perRead {
+		if len(features) == 0 {
+			continue
+		}
+		row.PerRead[b] = make([]ReadFeatures, len(features))
+		for i, f := range features {
+			row.PerRead[b][i] = ReadFeatures{
+				Dist5p:    f.dist5p,
+				FragLen:   f.fraglen,
+				Qual:      f.qual,
+				Strand:    f.strand,
+				MapQ:      f.mapq,
+				ReadGroup: f.readGroup,
+				NM:        f.nm,
+				Cycle:     f.cycle,
+				ClipDist:  f.clipDist,
+			}
+		}
+	}
+	if len(pr.payload.indels) != 0 {
+		row.Indels = make([]IndelAllele, len(pr.payload.indels))
+		for i, a := range pr.payload.indels {
+			row.Indels[i] = IndelAllele{InsSeq: a.insSeq, DelLen: a.delLen, Counts: a.counts}
+		}
+	}
+	return row
+}
+
+// newPileupRow converts a Row to a pileupRow, setting the fieldsPresent bits
+// of the nonempty fields.
+func newPileupRow(row *Row) *pileupRow {
+	pr := &pileupRow{
+		fieldsPresent: fieldCounts,
+		refID:         uint32(row.RefID),
+		pos:           uint32(row.Pos),
+	}
+	pr.payload.depth = row.Depth
+	pr.payload.counts = row.Counts
+	for _, c := range row.Counts[pileup.BaseDel:] {
+		if c != [2]uint32{} {
+			pr.fieldsPresent |= fieldExtCounts
+		}
+	}
+	if (row.InsCounts != [2]uint32{}) || (row.DelCounts != [2]uint32{}) {
+		pr.fieldsPresent |= fieldIndelCounts
+		pr.payload.indelCounts[indelIns] = row.InsCounts
+		pr.payload.indelCounts[indelDel] = row.DelCounts
+	}
+	for b, features := range row.PerRead {
+		if len(features) == 0 {
+			continue
+		}
+		pr.fieldsPresent |= fieldPerReadA << uint(b)
+		pr.payload.perRead[b] = make([]perReadFeatures, len(features))
+		for i, f := range features {
+			pr.payload.perRead[b][i] = perReadFeatures{
+				dist5p:    f.Dist5p,
+				fraglen:   f.FragLen,
+				qual:      f.Qual,
+				strand:    f.Strand,
+				mapq:      f.MapQ,
+				readGroup: f.ReadGroup,
+				nm:        f.NM,
+				cycle:     f.Cycle,
+				clipDist:  f.ClipDist,
+			}
+			if (f.MapQ != 0) || (f.ReadGroup != 0) || (f.NM != 0) || (f.Cycle != 0) || (f.ClipDist != 0) {
+				pr.fieldsPresent |= fieldPerReadExtended
+			}
+		}
+	}
+	if len(row.Indels) != 0 {
+		pr.fieldsPresent |= fieldIndelAlleles
+		pr.payload.indels = make([]indelAllele, len(row.Indels))
+		for i, a := range row.Indels {
+			pr.payload.indels[i] = indelAllele{insSeq: a.InsSeq, delLen: a.DelLen, counts: a.Counts}
+		}
+	}
+	return pr
+}
+
+func (e *rowEmitter) AddHeader(key string, value interface{}) {}
+func (e *rowEmitter) Flush()                                  {}
+func (e *rowEmitter) Wait()                                   {}
+func (e *rowEmitter) SetTrailer(trailer []byte)               {}
+
+func (e *rowEmitter) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+func (e *rowEmitter) Finish() error {
+	return e.Err()
+}
+
+// StreamPileup computes the same per-position counts as the basestrand
+// formats of Pileup, but passes each position's Row to emit as soon as it is
+// final, instead of writing files.  This lets services consume pileups
+// in-process.
+//
+// emit calls are serialized, and *row is only valid until emit returns.  Rows
+// are emitted in position order within each of the Opts.Parallelism jobs, each
+// of which covers a contiguous part of the genome, but the jobs run
+// concurrently; set Parallelism to 1 if the rows are needed in position order.
+// If emit returns an error, no further rows are emitted, and StreamPileup
+// returns the error.
+//
+// PerStrand, ShardRetries and Quarantine are not supported, since rows that
+// were already emitted can't be taken back.  Opts.Cols may only select
+// "indels".
+func StreamPileup(ctx context.Context, xampath, fapath string, rawOpts *Opts, refSeqs [][]byte, emit func(row *Row) error) error {
+	if rawOpts.PerStrand {
+		return fmt.Errorf("StreamPileup: per-strand mode is not supported; Row.Counts is already split by strand")
+	}
+	if (rawOpts.ShardRetries != 0) || rawOpts.Quarantine {
+		return fmt.Errorf("StreamPileup: shard retries and quarantine are not supported")
+	}
+	return pileupInternal(ctx, []string{xampath}, fapath, formatStream, "", rawOpts, refSeqs, emit, nil)
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bio/encoding/bcf"
+	biobgzf "github.com/grailbio/bio/encoding/bgzf"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/bgzf/index"
+)
+
+// csiDepth is the depth of the .csi indexes written by Pileup.  With the
+// standard min_shift of 14, it supports contigs of up to 4 Gbp.
+const csiDepth = 6
+
+// vcfMagic starts the first line of a VCF file.
+const vcfMagic = "##fileformat=VCF"
+
+// indexingWriter compresses a text output file with bgzf, and builds a .tbi
+// or .csi index of its lines, by CHROM (column 1) and 1-based POS (column 2),
+// as they're written.  '#' lines are comments, and other lines before the
+// first one with a numeric POS are skipped headers.  VCF lines are indexed
+// by the span of their REF allele, as tabix does.
+//
+// Unlike compressBGZF output, the compression is single-threaded, since the
+// index needs the virtual offset of each line.
+type indexingWriter struct {
+	bw      *biobgzf.Writer
+	builder *bcf.IndexBuilder
+	csi     bool
+	// line is the current line, up to and including its newline.
+	line      []byte
+	lineStart uint64
+	nLine     int
+	sawData   bool
+	vcf       bool
+}
+
+func newIndexingWriter(w io.Writer, csi bool) (*indexingWriter, error) {
+	bw, err := biobgzf.NewWriter(w, 6)
+	if err != nil {
+		return nil, err
+	}
+	conf := bcf.TabixConf{Format: bcf.TabixGeneric, ColSeq: 1, ColBeg: 2, Meta: '#'}
+	iw := &indexingWriter{bw: bw, csi: csi}
+	if csi {
+		iw.builder = bcf.NewCSIIndexBuilder(conf, 14, csiDepth)
+	} else {
+		iw.builder = bcf.NewTabixIndexBuilder(conf)
+	}
+	return iw, nil
+}
+
+// Write implements io.Writer.
+func (w *indexingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.line) == 0 {
+			w.lineStart = w.bw.VOffset()
+		}
+		end := len(p)
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			end = i + 1
+		}
+		if _, err := w.bw.Write(p[:end]); err != nil {
+			return 0, err
+		}
+		w.line = append(w.line, p[:end]...)
+		p = p[end:]
+		if w.line[len(w.line)-1] == '\n' {
+			if err := w.endLine(); err != nil {
+				return 0, err
+			}
+			w.line = w.line[:0]
+		}
+	}
+	return n, nil
+}
+
+// endLine indexes w.line, which has just been written.
+func (w *indexingWriter) endLine() error {
+	line := w.line[:len(w.line)-1]
+	w.nLine++
+	if (w.nLine == 1) && bytes.HasPrefix(line, []byte(vcfMagic)) {
+		w.vcf = true
+		w.builder.Conf.Format = bcf.TabixVCF
+	}
+	if (len(line) > 0) && (line[0] == '#') {
+		return nil
+	}
+	fields := bytes.SplitN(line, []byte{'\t'}, 9)
+	var pos int
+	var err error
+	if len(fields) >= 2 {
+		pos, err = strconv.Atoi(string(fields[1]))
+	}
+	if (len(fields) < 2) || (err != nil) || (pos < 1) {
+		if w.sawData {
+			return fmt.Errorf("indexingWriter: line %d has no valid CHROM and POS: %q", w.nLine, line)
+		}
+		// A header line; tabix must skip all of the lines before it.
+		w.builder.Conf.Skip = int32(w.nLine)
+		return nil
+	}
+	w.sawData = true
+	end := pos
+	if w.vcf && (len(fields) >= 4) {
+		end = pos + len(fields[3]) - 1
+		// As in htslib, an INFO END (e.g. of a gVCF reference block) extends
+		// the record.
+		if len(fields) >= 8 {
+			if infoEnd := vcfInfoEnd(fields[7]); infoEnd > end {
+				end = infoEnd
+			}
+		}
+	}
+	return w.builder.Add(string(fields[0]), pos-1, end, w.lineStart, w.bw.VOffset())
+}
+
+// vcfInfoEnd returns the value of the END field of VCF INFO column info, or
+// 0 if there is none.
+func vcfInfoEnd(info []byte) int {
+	for _, field := range bytes.Split(info, []byte{';'}) {
+		if bytes.HasPrefix(field, []byte("END=")) {
+			end, err := strconv.Atoi(string(field[4:]))
+			if err != nil {
+				return 0
+			}
+			return end
+		}
+	}
+	return 0
+}
+
+// close finishes the bgzf file, and writes the index to path + ".tbi" or
+// ".csi".
+func (w *indexingWriter) close(ctx context.Context, path string) (err error) {
+	if len(w.line) > 0 {
+		// Index an unterminated last line.
+		w.line = append(w.line, '\n')
+		if err = w.endLine(); err != nil {
+			return
+		}
+	}
+	if err = w.bw.Close(); err != nil {
+		return
+	}
+	indexPath := path + ".tbi"
+	if w.csi {
+		indexPath = path + ".csi"
+	}
+	var dst file.File
+	if dst, err = file.Create(ctx, indexPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	return w.builder.Write(dst.Writer(ctx))
+}
+
+// Query returns the lines of path, a bgzf-compressed text output of Pileup
+// written with Opts.OutputIndex, whose CHROM is chrom and whose POS is in
+// [start, end) (0-based).  The lines don't include their newlines.  The
+// index is read from path + ".tbi", or path + ".csi" if that doesn't exist.
+func Query(ctx context.Context, path, chrom string, start, end PosType) (lines []string, err error) {
+	idx, err := readOutputIndex(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	refID := -1
+	for i, name := range idx.Names {
+		if name == chrom {
+			refID = i
+			break
+		}
+	}
+	if refID < 0 {
+		// The file has no lines on chrom.
+		return nil, nil
+	}
+	chunks := idx.Chunks(refID, int(start), int(end))
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	var in file.File
+	if in, err = file.Open(ctx, path); err != nil {
+		return nil, err
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	bg, err := bgzf.NewReader(in.Reader(ctx), 1)
+	if err != nil {
+		return nil, fmt.Errorf("Query: %s: %v", path, err)
+	}
+	defer func() {
+		if e := bg.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	cr, err := index.NewChunkReader(bg, chunks)
+	if err != nil {
+		return nil, fmt.Errorf("Query: %s: %v", path, err)
+	}
+	defer func() {
+		if e := cr.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	scanner := bufio.NewScanner(cr)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if (len(line) == 0) || (line[0] == '#') {
+			continue
+		}
+		fields := bytes.SplitN([]byte(line), []byte{'\t'}, 3)
+		if len(fields) < 2 {
+			continue
+		}
+		pos, e := strconv.Atoi(string(fields[1]))
+		if e != nil {
+			continue
+		}
+		if string(fields[0]) != chrom {
+			continue
+		}
+		if PosType(pos-1) >= end {
+			// Lines are sorted, so no later line is in range.
+			break
+		}
+		if PosType(pos-1) >= start {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readOutputIndex reads the .tbi or .csi index of path.
+func readOutputIndex(ctx context.Context, path string) (idx *bcf.Index, err error) {
+	var in file.File
+	if in, err = file.Open(ctx, path+".tbi"); err != nil {
+		var e error
+		if in, e = file.Open(ctx, path+".csi"); e != nil {
+			return nil, fmt.Errorf("Query: no .tbi or .csi index for %s: %v", path, err)
+		}
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	return bcf.ReadIndex(in.Reader(ctx))
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestIndexedOutput(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	for _, c := range []outputCompression{compressBGZFTabix, compressBGZFCSI} {
+		path := filepath.Join(tmpdir, fmt.Sprintf("out%d.tsv.gz", c))
+		dst, err := file.Create(ctx, path)
+		assert.NoError(t, err)
+		w, closeCompressed, err := newCompressedWriter(ctx, dst, c, 1)
+		assert.NoError(t, err)
+		// A header without the '#' meta character, as in basestrand-tsv.
+		_, err = w.Write([]byte("CHROM\tPOS\tDEPTH\n"))
+		assert.NoError(t, err)
+		for pos := 1; pos <= 100000; pos += 10 {
+			// Write each line in two pieces, to exercise partial lines.
+			_, err = fmt.Fprintf(w, "chr1\t%d", pos)
+			assert.NoError(t, err)
+			_, err = w.Write([]byte("\t7\n"))
+			assert.NoError(t, err)
+		}
+		_, err = w.Write([]byte("chr2\t5\t3\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, closeCompressed())
+		assert.NoError(t, dst.Close(ctx))
+
+		lines, err := Query(ctx, path, "chr1", 50000, 50021)
+		assert.NoError(t, err)
+		assert.EQ(t, lines, []string{"chr1\t50001\t7", "chr1\t50011\t7", "chr1\t50021\t7"})
+		lines, err = Query(ctx, path, "chr2", 0, 10)
+		assert.NoError(t, err)
+		assert.EQ(t, lines, []string{"chr2\t5\t3"})
+		lines, err = Query(ctx, path, "chr3", 0, 10)
+		assert.NoError(t, err)
+		assert.EQ(t, len(lines), 0)
+	}
+
+	// Unsorted output can't be indexed.
+	path := filepath.Join(tmpdir, "unsorted.tsv.gz")
+	dst, err := file.Create(ctx, path)
+	assert.NoError(t, err)
+	w, _, err := newCompressedWriter(ctx, dst, compressBGZFTabix, 1)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("chr1\t10\t1\nchr1\t5\t1\n"))
+	assert.NotNil(t, err)
+	assert.NoError(t, dst.Close(ctx))
+}
+
+func TestVCFInfoEnd(t *testing.T) {
+	assert.EQ(t, vcfInfoEnd([]byte("END=120")), 120)
+	assert.EQ(t, vcfInfoEnd([]byte("DP=5;END=9")), 9)
+	assert.EQ(t, vcfInfoEnd([]byte("DP=5;BLOCKEND=9")), 0)
+	assert.EQ(t, vcfInfoEnd([]byte(".")), 0)
+	assert.EQ(t, vcfInfoEnd([]byte("END=x")), 0)
+}
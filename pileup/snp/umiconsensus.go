@@ -0,0 +1,315 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/umi"
+	"github.com/grailbio/hts/sam"
+)
+
+// umiConsensusOpts holds the parsed Opts.UMIConsensusTag and
+// Opts.UMIMinFamilySize arguments, and the run-wide family counts.
+type umiConsensusOpts struct {
+	tag           sam.Tag
+	minFamilySize int
+	stats         *umiConsensusStats
+}
+
+// parseUMIConsensusOpts returns nil if UMI consensus counting is disabled.
+func parseUMIConsensusOpts(tag string, minFamilySize int) (*umiConsensusOpts, error) {
+	if minFamilySize < 0 {
+		return nil, fmt.Errorf("Pileup: invalid umi-min-family-size= argument %d", minFamilySize)
+	}
+	if tag == "" {
+		if minFamilySize > 0 {
+			return nil, fmt.Errorf("Pileup: umi-min-family-size= requires umi-consensus-tag=")
+		}
+		return nil, nil
+	}
+	if len(tag) != 2 {
+		return nil, fmt.Errorf("Pileup: invalid umi-consensus-tag= argument %q", tag)
+	}
+	if minFamilySize == 0 {
+		minFamilySize = 1
+	}
+	return &umiConsensusOpts{
+		tag:           sam.NewTag(tag),
+		minFamilySize: minFamilySize,
+		stats:         &umiConsensusStats{},
+	}, nil
+}
+
+// umiConsensusStats counts the UMI families of a run.  It is shared by all
+// jobs, hence the atomic updates.
+type umiConsensusStats struct {
+	// noUMI is the number of reads without the UMI tag, which are dropped.
+	noUMI int64
+	// families is the number of families, and small is the number of them
+	// which were dropped for having fewer than minFamilySize reads.
+	families, small int64
+	// used and discarded are the reads which did and didn't (due to a CIGAR
+	// which differs from the family's most common one) take part in a
+	// consensus.
+	used, discarded int64
+}
+
+func (s *umiConsensusStats) String() string {
+	families := atomic.LoadInt64(&s.families)
+	used := atomic.LoadInt64(&s.used)
+	meanSize := 0.0
+	if kept := families - atomic.LoadInt64(&s.small); kept > 0 {
+		meanSize = float64(used) / float64(kept)
+	}
+	return fmt.Sprintf("%d families (%d dropped as too small), mean size %.2f; %d reads discarded for a minority CIGAR, %d reads without a UMI",
+		families, atomic.LoadInt64(&s.small), meanSize, atomic.LoadInt64(&s.discarded), atomic.LoadInt64(&s.noUMI))
+}
+
+// umiFamilyKey identifies the reads sequenced from one end of one strand of
+// a molecule.  For a read whose mate is mapped to the same reference, the
+// molecule is located by the aligned fragment coordinates (the leftmost
+// alignment start of the pair and |TLEN|); otherwise by the read's own
+// alignment start (or end, for reverse reads), with fragLen -1.  Both reads
+// of a pair thus get families with the same umi, fragStart and fragLen,
+// which only differ in read1.
+type umiFamilyKey struct {
+	refID     int
+	fragStart int
+	fragLen   int
+	umi       string
+	read1     bool
+	reverse   bool
+}
+
+// name returns the name of the consensus read of the family.  It is the
+// same for the two reads of a pair, so that they can be stitched.
+func (k *umiFamilyKey) name() string {
+	strand := "+"
+	if k.read1 == k.reverse {
+		// Read 1 is reverse.
+		strand = "-"
+	}
+	return k.umi + ":" + strconv.Itoa(k.refID) + ":" + strconv.Itoa(k.fragStart) + ":" + strconv.Itoa(k.fragLen) + ":" + strand
+}
+
+type umiFamily struct {
+	key   umiFamilyKey
+	reads []*sam.Record
+}
+
+// umiConsensusIterator wraps the iterator of a shard, and returns the
+// consensus reads of its UMI families, in coordinate order, instead of the
+// raw reads.
+//
+// All reads of a family have alignment starts within maxReadSpan of each
+// other, so a family is complete once the raw reads are past that window
+// from its first read.  Families are created in order of their first read,
+// so the open families are a FIFO.  Since a consensus read starts at one of
+// its family's reads, it can be returned once no open family starts before
+// it.
+//
+// Like dupFilter, families are tracked per shard; a family whose reads
+// straddle a shard boundary (which requires their alignment starts to
+// differ) is split.
+type umiConsensusIterator struct {
+	src         bamprovider.Iterator
+	opts        *umiConsensusOpts
+	flagExclude int
+	mapq        int
+	maxReadSpan int
+
+	open  []*umiFamily
+	byKey map[umiFamilyKey]*umiFamily
+	ready recordHeap
+	done  bool
+	rec   *sam.Record
+	err   error
+}
+
+// newUMIConsensusIterator returns an iterator over the consensus reads of
+// src.  Raw reads which match flagExclude, or have a MAPQ below mapq, are
+// dropped before they're grouped; the other read filters apply to the
+// consensus reads.
+func newUMIConsensusIterator(src bamprovider.Iterator, opts *umiConsensusOpts, flagExclude, mapq, maxReadSpan int) *umiConsensusIterator {
+	return &umiConsensusIterator{
+		src:         src,
+		opts:        opts,
+		flagExclude: flagExclude,
+		mapq:        mapq,
+		maxReadSpan: maxReadSpan,
+		byKey:       make(map[umiFamilyKey]*umiFamily),
+	}
+}
+
+func (it *umiConsensusIterator) key(r *sam.Record) (umiFamilyKey, bool) {
+	aux := r.AuxFields.Get(it.opts.tag)
+	if aux == nil {
+		return umiFamilyKey{}, false
+	}
+	k := umiFamilyKey{
+		refID:   r.Ref.ID(),
+		umi:     fmt.Sprint(aux.Value()),
+		read1:   (r.Flags & sam.Read2) == 0,
+		reverse: (r.Flags & sam.Reverse) != 0,
+		fragLen: -1,
+	}
+	if fragLen := fragmentLength(r); fragLen != fraglenNone {
+		k.fragLen = fragLen
+		k.fragStart = r.Pos
+		if r.MatePos < k.fragStart {
+			k.fragStart = r.MatePos
+		}
+	} else if k.reverse {
+		k.fragStart = r.End()
+	} else {
+		k.fragStart = r.Pos
+	}
+	return k, true
+}
+
+// startsAtOrAfter returns true if the first read of f doesn't precede
+// (refID, pos).
+func (f *umiFamily) startsAtOrAfter(refID, pos int) bool {
+	first := f.reads[0]
+	if refID != first.Ref.ID() {
+		return refID < first.Ref.ID()
+	}
+	return pos <= first.Pos
+}
+
+// closeFamily computes the consensus read of the first open family, if it
+// is large enough, and adds it to it.ready.
+func (it *umiConsensusIterator) closeFamily() {
+	f := it.open[0]
+	it.open[0] = nil
+	it.open = it.open[1:]
+	delete(it.byKey, f.key)
+	stats := it.opts.stats
+	atomic.AddInt64(&stats.families, 1)
+	if len(f.reads) < it.opts.minFamilySize {
+		atomic.AddInt64(&stats.small, 1)
+	} else {
+		c, cStats := umi.CallConsensus(f.reads, f.key.name())
+		atomic.AddInt64(&stats.used, int64(cStats.Used))
+		atomic.AddInt64(&stats.discarded, int64(cStats.Discarded))
+		heap.Push(&it.ready, c)
+	}
+	for _, r := range f.reads {
+		sam.PutInFreePool(r)
+	}
+}
+
+// add adds a raw read to its family, after closing the families which can't
+// get any more reads.
+func (it *umiConsensusIterator) add(r *sam.Record) {
+	refID := r.Ref.ID()
+	for len(it.open) > 0 {
+		first := it.open[0].reads[0]
+		if (first.Ref.ID() == refID) && (first.Pos+it.maxReadSpan >= r.Pos) {
+			break
+		}
+		it.closeFamily()
+	}
+	k, ok := it.key(r)
+	if !ok {
+		atomic.AddInt64(&it.opts.stats.noUMI, 1)
+		sam.PutInFreePool(r)
+		return
+	}
+	f := it.byKey[k]
+	if f == nil {
+		f = &umiFamily{key: k}
+		it.byKey[k] = f
+		it.open = append(it.open, f)
+	}
+	f.reads = append(f.reads, r)
+}
+
+// Scan implements bamprovider.Iterator.
+func (it *umiConsensusIterator) Scan() bool {
+	for {
+		if len(it.ready) > 0 {
+			c := it.ready[0]
+			if it.done || (len(it.open) == 0) || it.open[0].startsAtOrAfter(c.Ref.ID(), c.Pos) {
+				it.rec = heap.Pop(&it.ready).(*sam.Record)
+				return true
+			}
+		}
+		if it.done {
+			return false
+		}
+		if !it.src.Scan() {
+			it.done = true
+			it.err = it.src.Err()
+			for len(it.open) > 0 {
+				it.closeFamily()
+			}
+			continue
+		}
+		r := it.src.Record()
+		if (it.flagExclude&int(r.Flags) != 0) || (it.mapq > int(r.MapQ)) || (len(r.Cigar) == 0) || (r.Ref == nil) {
+			sam.PutInFreePool(r)
+			continue
+		}
+		it.add(r)
+	}
+}
+
+// Record implements bamprovider.Iterator.
+func (it *umiConsensusIterator) Record() *sam.Record {
+	return it.rec
+}
+
+// Err implements bamprovider.Iterator.
+func (it *umiConsensusIterator) Err() error {
+	return it.err
+}
+
+// Close implements bamprovider.Iterator.
+func (it *umiConsensusIterator) Close() error {
+	for _, f := range it.open {
+		for _, r := range f.reads {
+			sam.PutInFreePool(r)
+		}
+	}
+	for _, r := range it.ready {
+		sam.PutInFreePool(r)
+	}
+	it.open, it.ready = nil, nil
+	return it.src.Close()
+}
+
+// recordHeap is a min-heap of records, by position.
+type recordHeap []*sam.Record
+
+func (h recordHeap) Len() int { return len(h) }
+func (h recordHeap) Less(i, j int) bool {
+	if h[i].Ref.ID() != h[j].Ref.ID() {
+		return h[i].Ref.ID() < h[j].Ref.ID()
+	}
+	return h[i].Pos < h[j].Pos
+}
+func (h recordHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x interface{}) { *h = append(*h, x.(*sam.Record)) }
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
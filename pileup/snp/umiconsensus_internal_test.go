@@ -0,0 +1,145 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/umi"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+// sliceIterator is a bamprovider.Iterator over a slice of records.
+type sliceIterator struct {
+	recs []*sam.Record
+	rec  *sam.Record
+}
+
+func (it *sliceIterator) Scan() bool {
+	if len(it.recs) == 0 {
+		return false
+	}
+	it.rec, it.recs = it.recs[0], it.recs[1:]
+	return true
+}
+
+func (it *sliceIterator) Record() *sam.Record { return it.rec }
+func (it *sliceIterator) Err() error          { return nil }
+func (it *sliceIterator) Close() error        { return nil }
+
+func TestParseUMIConsensusOpts(t *testing.T) {
+	o, err := parseUMIConsensusOpts("", 0)
+	assert.NoError(t, err)
+	assert.True(t, o == nil)
+	o, err = parseUMIConsensusOpts("RX", 0)
+	assert.NoError(t, err)
+	assert.EQ(t, o.tag, sam.NewTag("RX"))
+	assert.EQ(t, o.minFamilySize, 1)
+
+	for _, bad := range []struct {
+		tag           string
+		minFamilySize int
+	}{{"", 2}, {"RX", -1}, {"UMI", 0}} {
+		_, err := parseUMIConsensusOpts(bad.tag, bad.minFamilySize)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func simulateUMIFamilies(t *testing.T, errorRate float64) ([]*sam.Record, []byte) {
+	refSeq := []byte(strings.Repeat("ACGTTGCAATCCGAGT", 250))
+	ref, err := sam.NewReference("chr1", "", "", len(refSeq), nil, nil)
+	assert.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	recs, _, err := umi.SimulateFamilies(umi.SimulateOpts{
+		Ref:          ref,
+		RefSeq:       refSeq,
+		NumMolecules: 100,
+		UMILen:       8,
+		ReadLen:      50,
+		FragLenMin:   120,
+		FragLenMax:   200,
+		FamilySize:   umi.FixedFamilySize(3),
+		ErrorRate:    errorRate,
+		Seed:         1,
+	})
+	assert.NoError(t, err)
+	return recs, refSeq
+}
+
+// countMismatches returns the number of read bases which differ from refSeq.
+// The simulated reads have no indels.
+func countMismatches(recs []*sam.Record, refSeq []byte) int {
+	n := 0
+	for _, r := range recs {
+		for i, b := range r.Seq.Expand() {
+			if b != refSeq[r.Pos+i] {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestUMIConsensusIterator(t *testing.T) {
+	recs, refSeq := simulateUMIFamilies(t, 0.02)
+	rawMismatches := countMismatches(recs, refSeq)
+
+	opts, err := parseUMIConsensusOpts("RX", 2)
+	assert.NoError(t, err)
+	it := newUMIConsensusIterator(&sliceIterator{recs: recs}, opts, 0xf00, 60, 511)
+	var out []*sam.Record
+	names := make(map[string]int)
+	for it.Scan() {
+		r := it.Record()
+		if len(out) > 0 {
+			assert.True(t, out[len(out)-1].Pos <= r.Pos)
+		}
+		out = append(out, r)
+		names[r.Name]++
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+
+	// One consensus read per read of each molecule, and the two reads of a
+	// molecule share a name.
+	assert.EQ(t, len(out), 200)
+	assert.EQ(t, len(names), 100)
+	for name, n := range names {
+		assert.EQ(t, n, 2, name)
+	}
+	assert.EQ(t, opts.stats.families, int64(200))
+	assert.EQ(t, opts.stats.used, int64(600))
+	// Errors in one read of a 3-read family are voted out.
+	consensusMismatches := countMismatches(out, refSeq)
+	assert.True(t, rawMismatches > 100)
+	assert.True(t, 20*consensusMismatches < rawMismatches)
+}
+
+func TestUMIConsensusIteratorMinFamilySize(t *testing.T) {
+	recs, _ := simulateUMIFamilies(t, 0)
+	// The reads without a UMI are dropped.
+	recs[0].AuxFields = nil
+
+	opts, err := parseUMIConsensusOpts("RX", 4)
+	assert.NoError(t, err)
+	it := newUMIConsensusIterator(&sliceIterator{recs: recs}, opts, 0xf00, 60, 511)
+	assert.False(t, it.Scan())
+	assert.NoError(t, it.Close())
+	assert.EQ(t, opts.stats.families, int64(200))
+	assert.EQ(t, opts.stats.small, int64(200))
+	assert.EQ(t, opts.stats.noUMI, int64(1))
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+)
+
+// vcfHeaderLines are the fixed meta-information lines of the VCF output,
+// other than ##fileformat, ##reference and ##contig.
+const vcfHeaderLines = `##source=bio-pileup
+##INFO=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including bases below the base-quality threshold">
+##FORMAT=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including bases below the base-quality threshold">
+##FORMAT=<ID=AD,Number=R,Type=Integer,Description="Number of reads supporting each allele, with base quality at or above the threshold">
+##FORMAT=<ID=ADF,Number=R,Type=Integer,Description="Number of forward-strand reads supporting each allele, with base quality at or above the threshold">
+##FORMAT=<ID=ADR,Number=R,Type=Integer,Description="Number of reverse-strand reads supporting each allele, with base quality at or above the threshold">
+`
+
+// vcfSampleName returns the SM value shared by the read groups in header, or
+// fallback if there isn't exactly one such value.
+func vcfSampleName(header *sam.Header, fallback string) string {
+	smTag := sam.NewTag("SM")
+	name := ""
+	for _, rg := range header.RGs() {
+		sm := rg.Get(smTag)
+		if sm == "" || (name != "" && sm != name) {
+			return fallback
+		}
+		name = sm
+	}
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// vcfAltBases returns the bases other than refBase whose (high-quality)
+// support is nonzero and at least minAltFrac of the total high-quality
+// support at the position, in A/C/G/T order.  N is never reported as an ALT
+// allele.
+func vcfAltBases(counts *[pileup.NBaseEnumExt][2]uint32, refBase byte, minAltFrac float64, result []byte) []byte {
+	result = result[:0]
+	var total uint32
+	for b := 0; b < pileup.NBase; b++ {
+		total += counts[b][0] + counts[b][1]
+	}
+	for b := byte(0); b < pileup.NBase; b++ {
+		if b == refBase {
+			continue
+		}
+		n := counts[b][0] + counts[b][1]
+		if n != 0 && float64(n) >= minAltFrac*float64(total) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// appendVCFCounts appends a comma-separated list of counts for the REF allele
+// followed by the alts, for strand index strand (0 = forward, 1 = reverse), or
+// for both strands if strand is -1.
+func appendVCFCounts(buf []byte, counts *[pileup.NBaseEnumExt][2]uint32, refBase byte, alts []byte, strand int) []byte {
+	count := func(b byte) uint64 {
+		if strand < 0 {
+			return uint64(counts[b][0] + counts[b][1])
+		}
+		return uint64(counts[b][strand])
+	}
+	if refBase == pileup.BaseX {
+		// Bases matching an N in the reference are only counted as BaseX.
+		buf = append(buf, '0')
+	} else {
+		buf = strconv.AppendUint(buf, count(refBase), 10)
+	}
+	for _, b := range alts {
+		buf = append(buf, ',')
+		buf = strconv.AppendUint(buf, count(b), 10)
+	}
+	return buf
+}
+
+// writeVCFPreamble writes the ##fileformat, ##reference and ##contig lines of
+// the VCF header to header.
+func writeVCFPreamble(header *bytes.Buffer, fapath string, refs []*sam.Reference) {
+	header.WriteString("##fileformat=VCFv4.3\n")
+	header.WriteString("##reference=" + fapath + "\n")
+	for _, ref := range refs {
+		fmt.Fprintf(header, "##contig=<ID=%s,length=%d>\n", ref.Name(), ref.Len())
+	}
+}
+
+// convertPileupRowsToVCF writes the pileup as a single-sample VCF 4.3 file.
+// There is one record per position covered by -region/-bed, including
+// positions without ALT alleles (ALT=".").  The provenance metadata is
+// written as ##bio-pileup.<key>=<value> header lines.  If ann is non-nil, the
+// overlapping genes are added as INFO fields, and likewise for the k-mer
+// uniqueness of the records with ALT alleles if ku is non-nil.  The positions
+// that rf doesn't keep are left out.
+func convertPileupRowsToVCF(ctx context.Context, tmpFiles []*os.File, mainPath, fapath, sampleName string, minAltFrac float64, compression outputCompression, parallelism int, refs []*sam.Reference, refSeqs [][]byte, provenance map[string]string, ann *annotator, ku *kmerUniqueness, rf *rowFilter) (err error) {
+	fullPath := mainPath + ".vcf" + compression.suffix()
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	cw, closeCompressed, err := newCompressedWriter(ctx, dst, compression, parallelism)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := closeCompressed(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	var header bytes.Buffer
+	writeVCFPreamble(&header, fapath, refs)
+	header.WriteString(vcfHeaderLines)
+	if ann != nil {
+		header.WriteString(vcfAnnotationHeaderLines)
+	}
+	if ku != nil {
+		header.WriteString(vcfKmerUniquenessHeaderLines(ku.k))
+	}
+	for _, k := range sortedKeys(provenance) {
+		header.WriteString("##bio-pileup." + k + "=" + provenance[k] + "\n")
+	}
+	if _, err = cw.Write(header.Bytes()); err != nil {
+		return
+	}
+	w := tsv.NewWriter(cw)
+	w.WriteString("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT")
+	w.WriteString(sampleName)
+	if err = w.EndLine(); err != nil {
+		return
+	}
+
+	lastRefID := uint32(0)
+	curRefName := refs[0].Name()
+	curRefSeq8 := refSeqs[0]
+	alts := make([]byte, 0, pileup.NBase)
+	var buf []byte
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		if !rf.keep(pr) {
+			return nil
+		}
+		refID := pr.refID
+		if refID != lastRefID {
+			curRefName = refs[refID].Name()
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
+		}
+		pos := pr.pos
+		refBase8 := curRefSeq8[pos]
+		refBase := pileup.Seq8ToEnumTable[refBase8]
+		counts := &pr.payload.counts
+		alts = vcfAltBases(counts, refBase, minAltFrac, alts)
+
+		w.WriteString(curRefName)
+		w.WriteUint32(pos + 1)
+		w.WriteByte('.')
+		w.WriteByte(pileup.Seq8ToASCIITable[refBase8])
+		if len(alts) == 0 {
+			w.WriteByte('.')
+		} else {
+			buf = buf[:0]
+			for j, b := range alts {
+				if j != 0 {
+					buf = append(buf, ',')
+				}
+				buf = append(buf, pileup.EnumToASCIITable[b])
+			}
+			w.WriteBytes(buf)
+		}
+		w.WriteString(".\t.") // QUAL, FILTER
+		buf = append(buf[:0], "DP="...)
+		buf = strconv.AppendUint(buf, uint64(pr.payload.depth), 10)
+		if ann != nil {
+			ann.lookup(curRefName, PosType(pos))
+			buf = ann.appendInfo(buf)
+		}
+		if (ku != nil) && (len(alts) != 0) {
+			buf = ku.appendInfo(buf, curRefSeq8, int(pos), alts)
+		}
+		w.WriteBytes(buf)
+		w.WriteString("DP:AD:ADF:ADR")
+		buf = strconv.AppendUint(buf[:0], uint64(pr.payload.depth), 10)
+		for _, strand := range []int{-1, 0, 1} {
+			buf = append(buf, ':')
+			buf = appendVCFCounts(buf, counts, refBase, alts, strand)
+		}
+		w.WriteBytes(buf)
+		return w.EndLine()
+	})
+	if err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("convertPileupRowsToVCF: done, final results written to %s", fullPath)
+	return
+}
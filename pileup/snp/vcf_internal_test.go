@@ -0,0 +1,62 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestVCFAltBasesAndCounts(t *testing.T) {
+	var counts [pileup.NBaseEnumExt][2]uint32
+	counts[pileup.BaseA] = [2]uint32{50, 40}
+	counts[pileup.BaseC] = [2]uint32{1, 0}
+	counts[pileup.BaseT] = [2]uint32{3, 6}
+	counts[pileup.BaseX] = [2]uint32{20, 20}
+
+	alts := vcfAltBases(&counts, pileup.BaseA, 0, nil)
+	assert.EQ(t, alts, []byte{pileup.BaseC, pileup.BaseT})
+	// C is 1% of the 100 high-quality A/C/G/T bases, T is 9%; N is ignored.
+	alts = vcfAltBases(&counts, pileup.BaseA, 0.05, alts)
+	assert.EQ(t, alts, []byte{pileup.BaseT})
+	alts = vcfAltBases(&counts, pileup.BaseA, 0.5, alts)
+	assert.EQ(t, len(alts), 0)
+
+	alts = []byte{pileup.BaseC, pileup.BaseT}
+	assert.EQ(t, string(appendVCFCounts(nil, &counts, pileup.BaseA, alts, -1)), "90,1,9")
+	assert.EQ(t, string(appendVCFCounts(nil, &counts, pileup.BaseA, alts, 0)), "50,1,3")
+	assert.EQ(t, string(appendVCFCounts(nil, &counts, pileup.BaseA, alts, 1)), "40,0,6")
+	assert.EQ(t, string(appendVCFCounts(nil, &counts, pileup.BaseX, alts, -1)), "0,1,9")
+}
+
+func TestVCFSampleName(t *testing.T) {
+	newHeader := func(samples ...string) *sam.Header {
+		header, err := sam.NewHeader(nil, nil)
+		assert.NoError(t, err)
+		for i, sm := range samples {
+			rg, err := sam.NewReadGroup(string('a'+rune(i)), "", "", "", "", "", "", sm, "", "", time.Time{}, 0)
+			assert.NoError(t, err)
+			assert.NoError(t, header.AddReadGroup(rg))
+		}
+		return header
+	}
+	assert.EQ(t, vcfSampleName(newHeader(), "out"), "out")
+	assert.EQ(t, vcfSampleName(newHeader("s1", "s1"), "out"), "s1")
+	assert.EQ(t, vcfSampleName(newHeader("s1", "s2"), "out"), "out")
+	assert.EQ(t, vcfSampleName(newHeader("s1", ""), "out"), "out")
+}
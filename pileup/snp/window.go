@@ -0,0 +1,336 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+)
+
+// windowStat summarizes the pileup rows of a window as a single value.  New
+// statistics only need to implement this interface and be added to
+// windowStatMap.
+type windowStat interface {
+	// add adds a row, whose reference base (a pileup.BaseA..BaseX enum) is
+	// refBase, to the window.
+	add(row *pileupRow, refBase byte)
+	// value returns the summary of the rows added since the last reset.
+	value() float64
+	reset()
+}
+
+// windowStatMap maps the -window-stats names to windowStat constructors.  The
+// names are also the output column headers.
+var windowStatMap = map[string]func() windowStat{
+	"mean_depth":  func() windowStat { return &meanDepthStat{} },
+	"nonref_frac": func() windowStat { return &nonrefFracStat{} },
+	"entropy":     func() windowStat { return &entropyStat{} },
+}
+
+// windowStatOrder is the default column order.
+var windowStatOrder = []string{"mean_depth", "nonref_frac", "entropy"}
+
+// WindowStatNames returns the names accepted by Opts.WindowStats, in sorted
+// order.
+func WindowStatNames() []string {
+	names := make([]string, 0, len(windowStatMap))
+	for name := range windowStatMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseWindowStats parses a comma-separated list of windowStatMap names.  ""
+// selects all of them.
+func parseWindowStats(s string) ([]string, error) {
+	if s == "" {
+		return windowStatOrder, nil
+	}
+	names := strings.Split(s, ",")
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := windowStatMap[name]; !ok {
+			return nil, fmt.Errorf("Pileup: unknown window stat %q (supported: %s)", name, strings.Join(WindowStatNames(), ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Pileup: duplicate window stat %q", name)
+		}
+		seen[name] = true
+	}
+	return names, nil
+}
+
+// meanDepthStat is the mean total depth (including low-quality bases) over
+// the covered positions of the window.
+type meanDepthStat struct {
+	sum uint64
+	n   int
+}
+
+func (s *meanDepthStat) add(row *pileupRow, refBase byte) {
+	s.sum += uint64(row.payload.depth)
+	s.n++
+}
+
+func (s *meanDepthStat) value() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return float64(s.sum) / float64(s.n)
+}
+
+func (s *meanDepthStat) reset() { *s = meanDepthStat{} }
+
+// nonrefFracStat is the fraction of high-quality A/C/G/T bases in the window
+// that don't match the reference.  Positions where the reference is N are
+// skipped.
+type nonrefFracStat struct {
+	nonref, total uint64
+}
+
+func (s *nonrefFracStat) add(row *pileupRow, refBase byte) {
+	if refBase >= pileup.NBase {
+		return
+	}
+	for b := byte(0); b < pileup.NBase; b++ {
+		n := uint64(row.payload.counts[b][0] + row.payload.counts[b][1])
+		s.total += n
+		if b != refBase {
+			s.nonref += n
+		}
+	}
+}
+
+func (s *nonrefFracStat) value() float64 {
+	if s.total == 0 {
+		return 0
+	}
+	return float64(s.nonref) / float64(s.total)
+}
+
+func (s *nonrefFracStat) reset() { *s = nonrefFracStat{} }
+
+// entropyStat is the mean, over the window positions with any high-quality
+// A/C/G/T bases, of the Shannon entropy (in bits) of the per-position base
+// distribution.  It is 0 for a window of clean homozygous sites, and
+// approaches 2 for noise.
+type entropyStat struct {
+	sum float64
+	n   int
+}
+
+func (s *entropyStat) add(row *pileupRow, refBase byte) {
+	var counts [pileup.NBase]uint32
+	var total uint32
+	for b := range counts {
+		counts[b] = row.payload.counts[b][0] + row.payload.counts[b][1]
+		total += counts[b]
+	}
+	if total == 0 {
+		return
+	}
+	h := 0.0
+	for _, c := range counts {
+		if c != 0 {
+			p := float64(c) / float64(total)
+			h -= p * math.Log2(p)
+		}
+	}
+	s.sum += h
+	s.n++
+}
+
+func (s *entropyStat) value() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return s.sum / float64(s.n)
+}
+
+func (s *entropyStat) reset() { *s = entropyStat{} }
+
+// window is an open window of a windowWriter.
+type window struct {
+	start PosType
+	nPos  int
+	stats []windowStat
+}
+
+// windowWriter aggregates the pileup rows of each contig into windows of
+// size positions, starting at every multiple of step, and writes one line per
+// window that contains at least one row.  Rows must be added in position
+// order within each contig.
+type windowWriter struct {
+	w          *tsv.Writer
+	size, step PosType
+	statNames  []string
+
+	refName string
+	refLen  PosType
+	// open holds the windows containing the last row, in start order.
+	open []*window
+	free []*window
+}
+
+func newWindowWriter(w *tsv.Writer, size, step int, statNames []string) *windowWriter {
+	return &windowWriter{
+		w:         w,
+		size:      PosType(size),
+		step:      PosType(step),
+		statNames: statNames,
+	}
+}
+
+func (ww *windowWriter) writeHeader() error {
+	ww.w.WriteString("#CHROM\tSTART\tEND\tN_POS")
+	for _, name := range ww.statNames {
+		ww.w.WriteString(strings.ToUpper(name))
+	}
+	return ww.w.EndLine()
+}
+
+// add adds the row at pos of contig refName, whose length is refLen.
+func (ww *windowWriter) add(refName string, refLen PosType, row *pileupRow, refBase byte) error {
+	pos := PosType(row.pos)
+	if refName != ww.refName {
+		if err := ww.flush(); err != nil {
+			return err
+		}
+		ww.refName, ww.refLen = refName, refLen
+	}
+	// Close the windows that end at or before pos.
+	nClosed := 0
+	for ; nClosed < len(ww.open) && ww.open[nClosed].start+ww.size <= pos; nClosed++ {
+		if err := ww.writeWindow(ww.open[nClosed]); err != nil {
+			return err
+		}
+	}
+	ww.free = append(ww.free, ww.open[:nClosed]...)
+	ww.open = append(ww.open[:0], ww.open[nClosed:]...)
+
+	// Open the windows that start at or before pos and contain it.
+	start := PosType(0)
+	if pos >= ww.size {
+		start = ((pos-ww.size)/ww.step + 1) * ww.step
+	}
+	if n := len(ww.open); n > 0 {
+		start = ww.open[n-1].start + ww.step
+	}
+	for ; start <= pos; start += ww.step {
+		ww.open = append(ww.open, ww.newWindow(start))
+	}
+	for _, win := range ww.open {
+		win.nPos++
+		for _, s := range win.stats {
+			s.add(row, refBase)
+		}
+	}
+	return nil
+}
+
+func (ww *windowWriter) newWindow(start PosType) *window {
+	var win *window
+	if n := len(ww.free); n > 0 {
+		win = ww.free[n-1]
+		ww.free = ww.free[:n-1]
+		for _, s := range win.stats {
+			s.reset()
+		}
+	} else {
+		win = &window{stats: make([]windowStat, len(ww.statNames))}
+		for i, name := range ww.statNames {
+			win.stats[i] = windowStatMap[name]()
+		}
+	}
+	win.start, win.nPos = start, 0
+	return win
+}
+
+func (ww *windowWriter) writeWindow(win *window) error {
+	end := win.start + ww.size
+	if end > ww.refLen {
+		end = ww.refLen
+	}
+	ww.w.WriteString(ww.refName)
+	ww.w.WriteUint32(uint32(win.start))
+	ww.w.WriteUint32(uint32(end))
+	ww.w.WriteInt64(int64(win.nPos))
+	for _, s := range win.stats {
+		ww.w.WriteFloat64(s.value(), 'g', 6)
+	}
+	return ww.w.EndLine()
+}
+
+// flush writes all open windows.
+func (ww *windowWriter) flush() error {
+	for _, win := range ww.open {
+		if err := ww.writeWindow(win); err != nil {
+			return err
+		}
+	}
+	ww.free = append(ww.free, ww.open...)
+	ww.open = ww.open[:0]
+	return nil
+}
+
+// convertPileupRowsToWindows writes <mainPath>.windows.tsv, which has one
+// line per window instead of one per position; see windowWriter.
+func convertPileupRowsToWindows(ctx context.Context, tmpFiles []*os.File, mainPath string, size, step int, statNames []string, compression outputCompression, parallelism int, refNames []string, refLens []PosType, refSeqs [][]byte) (err error) {
+	fullPath := mainPath + ".windows.tsv" + compression.suffix()
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	cw, closeCompressed, err := newCompressedWriter(ctx, dst, compression, parallelism)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := closeCompressed(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	w := tsv.NewWriter(cw)
+	ww := newWindowWriter(w, size, step, statNames)
+	if err = ww.writeHeader(); err != nil {
+		return
+	}
+	err = forEachShardRow(tmpFiles, func(pr *pileupRow) error {
+		refBase := pileup.Seq8ToEnumTable[refSeqs[pr.refID][pr.pos]]
+		return ww.add(refNames[pr.refID], refLens[pr.refID], pr, refBase)
+	})
+	if err != nil {
+		return
+	}
+	if err = ww.flush(); err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("convertPileupRowsToWindows: done, final results written to %s", fullPath)
+	return
+}
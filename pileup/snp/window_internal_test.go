@@ -0,0 +1,80 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grailbio/base/tsv"
+	"github.com/grailbio/bio/pileup"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestWindowWriter(t *testing.T) {
+	newRow := func(pos, depth uint32, a, c [2]uint32) *pileupRow {
+		pr := &pileupRow{pos: pos}
+		pr.payload.depth = depth
+		pr.payload.counts[pileup.BaseA] = a
+		pr.payload.counts[pileup.BaseC] = c
+		return pr
+	}
+	var buf bytes.Buffer
+	w := tsv.NewWriter(&buf)
+	ww := newWindowWriter(w, 4, 2, []string{"mean_depth", "nonref_frac"})
+	assert.NoError(t, ww.writeHeader())
+	// chr1 has length 7, so the window starting at 4 is clipped.
+	assert.NoError(t, ww.add("chr1", 7, newRow(0, 10, [2]uint32{4, 4}, [2]uint32{1, 1}), pileup.BaseA))
+	assert.NoError(t, ww.add("chr1", 7, newRow(1, 20, [2]uint32{10, 0}, [2]uint32{}), pileup.BaseA))
+	assert.NoError(t, ww.add("chr1", 7, newRow(3, 30, [2]uint32{}, [2]uint32{}), pileup.BaseA))
+	assert.NoError(t, ww.add("chr1", 7, newRow(5, 0, [2]uint32{}, [2]uint32{}), pileup.BaseA))
+	// Reference N positions don't count towards nonref_frac.
+	assert.NoError(t, ww.add("chr2", 10, newRow(2, 4, [2]uint32{}, [2]uint32{2, 2}), pileup.BaseX))
+	// Windows without any rows aren't written.
+	assert.NoError(t, ww.add("chr2", 10, newRow(9, 4, [2]uint32{}, [2]uint32{2, 2}), pileup.BaseA))
+	assert.NoError(t, ww.flush())
+	assert.NoError(t, w.Flush())
+	assert.EQ(t, buf.String(), `#CHROM	START	END	N_POS	MEAN_DEPTH	NONREF_FRAC
+chr1	0	4	3	20	0.1
+chr1	2	6	2	15	0
+chr1	4	7	1	0	0
+chr2	0	4	1	4	0
+chr2	2	6	1	4	0
+chr2	6	10	1	4	1
+chr2	8	10	1	4	1
+`)
+}
+
+func TestWindowStats(t *testing.T) {
+	var s entropyStat
+	pr := &pileupRow{}
+	pr.payload.counts[pileup.BaseA] = [2]uint32{3, 2}
+	pr.payload.counts[pileup.BaseC] = [2]uint32{0, 5}
+	s.add(pr, pileup.BaseA)
+	pr.payload.counts[pileup.BaseC] = [2]uint32{}
+	s.add(pr, pileup.BaseA)
+	// Positions without A/C/G/T bases are ignored.
+	s.add(&pileupRow{}, pileup.BaseA)
+	assert.EQ(t, s.value(), 0.5)
+	s.reset()
+	assert.EQ(t, s.value(), 0.0)
+
+	names, err := parseWindowStats("")
+	assert.NoError(t, err)
+	assert.EQ(t, names, []string{"mean_depth", "nonref_frac", "entropy"})
+	_, err = parseWindowStats("entropy,foo")
+	assert.HasSubstr(t, err.Error(), "unknown window stat")
+	_, err = parseWindowStats("entropy,entropy")
+	assert.HasSubstr(t, err.Error(), "duplicate")
+}
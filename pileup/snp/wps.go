@@ -0,0 +1,202 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/bigwig"
+	"github.com/grailbio/hts/sam"
+)
+
+// Fragment-length range of the windowed protection score; like the "long
+// fragment" WPS of Snyder et al. (Cell 2016), it selects the fragments
+// protected by a nucleosome.
+const (
+	wpsMinLen = 120
+	wpsMaxLen = 180
+)
+
+// wpsRecordSize is the size of a fragment record in the per-job WPS files:
+// refID, start, and end (exclusive), as little-endian uint32s.
+const wpsRecordSize = 12
+
+// wpsDelta holds the changes of the score and of the number of contributing
+// fragments at a position.
+type wpsDelta struct {
+	score, active int32
+}
+
+// wpsSweep computes the windowed protection score of each position from the
+// fragments, which must be added in (refID, start) order.  The WPS of
+// position p is the number of fragments spanning [p-k, p+k], minus the
+// number of fragments with an endpoint in [p-k, p+k], where k = window/2.
+// Only the positions within k of a fragment are reported.
+type wpsSweep struct {
+	k    int
+	refs []*sam.Reference
+	emit func(refID, pos int, score int32) error
+
+	// deltas is a ring buffer of the deltas at positions [pos, pos+len(deltas)),
+	// which haven't been applied yet.
+	deltas        []wpsDelta
+	refID         int
+	pos           int
+	end           int // positions >= end have no pending deltas
+	score, active int32
+}
+
+func newWPSSweep(window int, refs []*sam.Reference, emit func(refID, pos int, score int32) error) *wpsSweep {
+	k := window / 2
+	nRing := 1
+	for nRing <= wpsMaxLen+2*k+1 {
+		nRing <<= 1
+	}
+	return &wpsSweep{k: k, refs: refs, emit: emit, deltas: make([]wpsDelta, nRing), refID: -1}
+}
+
+// flush applies the deltas, and reports the scores, of the positions before
+// limit, or of all positions if limit is negative.
+func (s *wpsSweep) flush(limit int) error {
+	if s.refID < 0 {
+		return nil
+	}
+	end := s.end
+	if (limit >= 0) && (limit < end) {
+		end = limit
+	}
+	refLen := s.refs[s.refID].Len()
+	mask := len(s.deltas) - 1
+	for ; s.pos < end; s.pos++ {
+		d := &s.deltas[s.pos&mask]
+		s.score += d.score
+		s.active += d.active
+		*d = wpsDelta{}
+		if (s.active > 0) && (s.pos < refLen) {
+			if err := s.emit(s.refID, s.pos, s.score); err != nil {
+				return err
+			}
+		}
+	}
+	// There are no deltas in [s.end, limit).
+	if limit > s.pos {
+		s.pos = limit
+	}
+	return nil
+}
+
+// addDelta adds d to the positions [start, end).
+func (s *wpsSweep) addDelta(start, end int, d wpsDelta) {
+	if start < s.pos {
+		// Only happens near the start of the reference.
+		start = s.pos
+	}
+	if start >= end {
+		return
+	}
+	mask := len(s.deltas) - 1
+	s.deltas[start&mask].score += d.score
+	s.deltas[start&mask].active += d.active
+	s.deltas[end&mask].score -= d.score
+	s.deltas[end&mask].active -= d.active
+	if end+1 > s.end {
+		s.end = end + 1
+	}
+}
+
+// add adds the fragment [start, end) of reference refID.
+func (s *wpsSweep) add(refID, start, end int) error {
+	k := s.k
+	if refID != s.refID {
+		if err := s.flush(-1); err != nil {
+			return err
+		}
+		s.refID = refID
+		s.pos = 0
+		s.end = 0
+		s.score, s.active = 0, 0
+	}
+	if start > k {
+		if err := s.flush(start - k); err != nil {
+			return err
+		}
+	}
+	last := end - 1
+	s.addDelta(start-k, last+k+1, wpsDelta{active: 1})
+	s.addDelta(start+k, last-k+1, wpsDelta{score: 1})
+	s.addDelta(start-k, start+k+1, wpsDelta{score: -1})
+	s.addDelta(last-k, last+k+1, wpsDelta{score: -1})
+	return nil
+}
+
+// writeWPS writes the windowed protection scores of the fragments in
+// wpsFiles (one per job, in job order) to <mainPath>.wps.bw.
+func writeWPS(ctx context.Context, mainPath string, window int, wpsFiles []*os.File, refs []*sam.Reference, tempDir string) (err error) {
+	chroms := make([]bigwig.Chrom, len(refs))
+	for i, ref := range refs {
+		chroms[i] = bigwig.Chrom{Name: ref.Name(), Len: ref.Len()}
+	}
+	bw, err := bigwig.NewWriter(chroms, bigwig.WriterOpts{TempDir: tempDir})
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := bw.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	sweep := newWPSSweep(window, refs, func(refID, pos int, score int32) error {
+		return bw.Add(refID, pos, pos+1, float32(score))
+	})
+	var rec [wpsRecordSize]byte
+	for _, f := range wpsFiles {
+		if _, err = f.Seek(0, 0); err != nil {
+			return
+		}
+		r := bufio.NewReader(f)
+		for {
+			if _, err = io.ReadFull(r, rec[:]); err != nil {
+				if err == io.EOF {
+					err = nil
+					break
+				}
+				return
+			}
+			if err = sweep.add(int(binary.LittleEndian.Uint32(rec[0:])), int(binary.LittleEndian.Uint32(rec[4:])), int(binary.LittleEndian.Uint32(rec[8:]))); err != nil {
+				return
+			}
+		}
+	}
+	if err = sweep.flush(-1); err != nil {
+		return
+	}
+
+	path := mainPath + ".wps.bw"
+	var dst file.File
+	if dst, err = file.Create(ctx, path); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+	if err = bw.Finish(dst.Writer(ctx)); err != nil {
+		return
+	}
+	log.Printf("writeWPS: done, windowed protection scores written to %s", path)
+	return
+}
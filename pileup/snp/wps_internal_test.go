@@ -0,0 +1,93 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestWPSSweep(t *testing.T) {
+	const refLen = 2000
+	ref0, _ := sam.NewReference("chr1", "", "", refLen, nil, nil)
+	ref1, _ := sam.NewReference("chr2", "", "", refLen, nil, nil)
+	refs := []*sam.Reference{ref0, ref1}
+	_, _ = sam.NewHeader(nil, refs)
+
+	type frag struct{ refID, start, end int }
+	rng := rand.New(rand.NewSource(1))
+	var frags []frag
+	for i := 0; i < 200; i++ {
+		start := rng.Intn(refLen - wpsMaxLen)
+		if i%10 == 0 {
+			// Near the start of the reference.
+			start = rng.Intn(40)
+		}
+		frags = append(frags, frag{rng.Intn(2), start, start + wpsMinLen + rng.Intn(wpsMaxLen-wpsMinLen+1)})
+	}
+	sort.Slice(frags, func(i, j int) bool {
+		return (frags[i].refID < frags[j].refID) || ((frags[i].refID == frags[j].refID) && (frags[i].start < frags[j].start))
+	})
+
+	const window = 120
+	const k = window / 2
+	type key struct{ refID, pos int }
+	got := make(map[key]int32)
+	var prev key
+	sweep := newWPSSweep(window, refs, func(refID, pos int, score int32) error {
+		cur := key{refID, pos}
+		assert.True(t, len(got) == 0 || (prev.refID < refID) || (prev.refID == refID && prev.pos < pos))
+		prev = cur
+		got[cur] = score
+		return nil
+	})
+	for _, f := range frags {
+		assert.NoError(t, sweep.add(f.refID, f.start, f.end))
+	}
+	assert.NoError(t, sweep.flush(-1))
+
+	want := make(map[key]int32)
+	for refID := range refs {
+		for pos := 0; pos < refLen; pos++ {
+			var score int32
+			near := false
+			for _, f := range frags {
+				if f.refID != refID {
+					continue
+				}
+				last := f.end - 1
+				if (f.start-k <= pos) && (pos <= last+k) {
+					near = true
+				}
+				if (f.start <= pos-k) && (last >= pos+k) {
+					score++
+				}
+				if (f.start >= pos-k) && (f.start <= pos+k) {
+					score--
+				}
+				if (last >= pos-k) && (last <= pos+k) {
+					score--
+				}
+			}
+			if near {
+				want[key{refID, pos}] = score
+			}
+		}
+	}
+	assert.EQ(t, got, want)
+}
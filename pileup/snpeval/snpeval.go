@@ -0,0 +1,328 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snpeval compares SNV candidates derived from bio-pileup output
+// against a truth VCF restricted to a confident-region BED (GIAB-style), and
+// reports precision and recall stratified by VAF and depth.
+//
+// Candidates are read from basestrand-tsv output, since it carries the counts
+// of every allele at every position on a single line.  A position/alt pair is
+// a candidate when it passes the CallOpts thresholds.
+package snpeval
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/bio/interval"
+)
+
+// CallOpts controls which pileup observations are treated as candidate SNVs.
+type CallOpts struct {
+	MinDepth    int
+	MinAltCount int
+	MinVAF      float64
+}
+
+// DefaultCallOpts is a permissive caller suitable for germline evaluation.
+var DefaultCallOpts = CallOpts{
+	MinDepth:    10,
+	MinAltCount: 3,
+	MinVAF:      0.1,
+}
+
+// Strata holds the upper bin boundaries used for stratification; a site
+// falls into the first bin whose boundary is > its value, or into a final
+// open-ended bin.
+type Strata struct {
+	VAF   []float64
+	Depth []int
+}
+
+// DefaultStrata is a reasonable binning for mixed germline/somatic data.
+var DefaultStrata = Strata{
+	VAF:   []float64{0.01, 0.05, 0.1, 0.25, 0.75},
+	Depth: []int{10, 30, 100, 300, 1000},
+}
+
+// Stats contains site-level comparison counts.
+type Stats struct {
+	TP, FP, FN int
+}
+
+// Precision returns TP / (TP + FP), or 0 if there are no candidates.
+func (s Stats) Precision() float64 {
+	if s.TP+s.FP == 0 {
+		return 0
+	}
+	return float64(s.TP) / float64(s.TP+s.FP)
+}
+
+// Recall returns TP / (TP + FN), or 0 if there are no truth sites.
+func (s Stats) Recall() float64 {
+	if s.TP+s.FN == 0 {
+		return 0
+	}
+	return float64(s.TP) / float64(s.TP+s.FN)
+}
+
+func (s *Stats) add(tp, fp, fn int) {
+	s.TP += tp
+	s.FP += fp
+	s.FN += fn
+}
+
+// Stratum is one row of a stratified report.  Label is e.g. "[0.05,0.1)".
+type Stratum struct {
+	Label string
+	Stats
+}
+
+// Report is the result of Evaluate.
+//
+// Sites are stratified by the depth and VAF observed in the pileup.  For
+// false negatives, the VAF is that of the truth allele, which is 0 if it was
+// never seen, and the depth is 0 if the position isn't in the pileup at all.
+type Report struct {
+	Overall Stats
+	ByVAF   []Stratum
+	ByDepth []Stratum
+}
+
+// Variant is a biallelic SNV.  Pos is 0-based.
+type Variant struct {
+	Chrom    string
+	Pos      int
+	Ref, Alt byte
+}
+
+type siteKey struct {
+	chrom string
+	pos   int
+}
+
+// ReadTruthVCF reads the SNVs from a VCF.  Multi-allelic records are split,
+// non-SNV alleles and records with a FILTER other than PASS or '.' are
+// skipped.
+func ReadTruthVCF(r io.Reader) ([]Variant, error) {
+	var variants []Variant
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte{'\t'}, 8)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("snpeval.ReadTruthVCF: line %d: expected at least 5 columns, got %d", lineNum, len(fields))
+		}
+		if len(fields) >= 7 {
+			if filter := string(fields[6]); filter != "PASS" && filter != "." {
+				continue
+			}
+		}
+		pos, err := strconv.Atoi(string(fields[1]))
+		if err != nil || pos < 1 {
+			return nil, fmt.Errorf("snpeval.ReadTruthVCF: line %d: invalid POS %q", lineNum, fields[1])
+		}
+		ref := bytes.ToUpper(fields[3])
+		if len(ref) != 1 {
+			continue
+		}
+		for _, alt := range bytes.Split(bytes.ToUpper(fields[4]), []byte{','}) {
+			if len(alt) != 1 || baseIndex(alt[0]) < 0 || alt[0] == ref[0] {
+				continue
+			}
+			variants = append(variants, Variant{string(fields[0]), pos - 1, ref[0], alt[0]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
+
+var basestrandBases = []byte("ACGT")
+
+func baseIndex(b byte) int {
+	return bytes.IndexByte(basestrandBases, b)
+}
+
+// Evaluate compares the candidates in a basestrand-tsv pileup against truth.
+// Only positions inside confident are considered; a nil confident includes
+// everything.  The pileup must cover every truth site of interest; truth
+// sites absent from it count as false negatives at depth 0.
+func Evaluate(pileupTSV io.Reader, truth []Variant, confident *interval.BEDUnion, opts CallOpts, strata Strata) (*Report, error) {
+	inConfident := func(chrom string, pos int) bool {
+		return confident == nil || confident.ContainsByName(chrom, interval.PosType(pos))
+	}
+	truthAlts := map[siteKey][]byte{}
+	for _, v := range truth {
+		if !inConfident(v.Chrom, v.Pos) {
+			continue
+		}
+		k := siteKey{v.Chrom, v.Pos}
+		truthAlts[k] = append(truthAlts[k], v.Alt)
+	}
+	rep := &Report{
+		ByVAF:   make([]Stratum, len(strata.VAF)+1),
+		ByDepth: make([]Stratum, len(strata.Depth)+1),
+	}
+	for i := range rep.ByVAF {
+		rep.ByVAF[i].Label = binLabel(i, len(strata.VAF), func(j int) string { return strconv.FormatFloat(strata.VAF[j], 'g', -1, 64) })
+	}
+	for i := range rep.ByDepth {
+		rep.ByDepth[i].Label = binLabel(i, len(strata.Depth), func(j int) string { return strconv.Itoa(strata.Depth[j]) })
+	}
+	record := func(depth int, vaf float64, tp, fp, fn int) {
+		rep.Overall.add(tp, fp, fn)
+		rep.ByVAF[vafBin(strata.VAF, vaf)].add(tp, fp, fn)
+		rep.ByDepth[depthBin(strata.Depth, depth)].add(tp, fp, fn)
+	}
+
+	seen := map[siteKey]bool{}
+	scanner := bufio.NewScanner(pileupTSV)
+	scanner.Buffer(nil, 1<<24)
+	lineNum := 0
+	var counts [4]int
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 12)
+		if len(fields) < 11 {
+			return nil, fmt.Errorf("snpeval.Evaluate: pileup line %d: expected at least 11 basestrand-tsv columns, got %d", lineNum, len(fields))
+		}
+		pos1, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("snpeval.Evaluate: pileup line %d: invalid POS %q", lineNum, fields[1])
+		}
+		chrom, pos := fields[0], pos1-1
+		if !inConfident(chrom, pos) {
+			continue
+		}
+		depth := 0
+		for b := range counts {
+			plus, err1 := strconv.Atoi(fields[3+2*b])
+			minus, err2 := strconv.Atoi(fields[4+2*b])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("snpeval.Evaluate: pileup line %d: invalid count", lineNum)
+			}
+			counts[b] = plus + minus
+			depth += counts[b]
+		}
+		refIdx := -1
+		if len(fields[2]) == 1 {
+			refIdx = baseIndex(fields[2][0] &^ 0x20)
+		}
+		k := siteKey{chrom, pos}
+		alts := truthAlts[k]
+		if alts != nil {
+			seen[k] = true
+		}
+		for b, c := range counts {
+			if b == refIdx {
+				continue
+			}
+			vaf := 0.0
+			if depth > 0 {
+				vaf = float64(c) / float64(depth)
+			}
+			isTruth := bytes.IndexByte(alts, basestrandBases[b]) >= 0
+			called := depth >= opts.MinDepth && c >= opts.MinAltCount && vaf >= opts.MinVAF && c > 0
+			switch {
+			case called && isTruth:
+				record(depth, vaf, 1, 0, 0)
+			case called:
+				record(depth, vaf, 0, 1, 0)
+			case isTruth:
+				record(depth, vaf, 0, 0, 1)
+			}
+		}
+		// Truth alleles that aren't A/C/G/T-distinct from REF as reported (e.g.
+		// REF mismatch between VCF and FASTA) are counted as missed.
+		for _, alt := range alts {
+			if b := baseIndex(alt); b < 0 || b == refIdx {
+				record(depth, 0, 0, 0, 1)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for k, alts := range truthAlts {
+		if !seen[k] {
+			for range alts {
+				record(0, 0, 0, 0, 1)
+			}
+		}
+	}
+	return rep, nil
+}
+
+func binLabel(i, n int, boundary func(int) string) string {
+	lo, hi := "0", "inf"
+	if i > 0 {
+		lo = boundary(i - 1)
+	}
+	if i < n {
+		hi = boundary(i)
+	}
+	return "[" + lo + "," + hi + ")"
+}
+
+func vafBin(bounds []float64, v float64) int {
+	for i, b := range bounds {
+		if v < b {
+			return i
+		}
+	}
+	return len(bounds)
+}
+
+func depthBin(bounds []int, v int) int {
+	for i, b := range bounds {
+		if v < b {
+			return i
+		}
+	}
+	return len(bounds)
+}
+
+// WriteTSV writes the report as a TSV table with columns
+// STRATIFICATION, BIN, TP, FP, FN, PRECISION, RECALL.
+func (r *Report) WriteTSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "STRATIFICATION\tBIN\tTP\tFP\tFN\tPRECISION\tRECALL")
+	writeRow := func(strat, label string, s Stats) {
+		fmt.Fprintf(bw, "%s\t%s\t%d\t%d\t%d\t%.4f\t%.4f\n", strat, label, s.TP, s.FP, s.FN, s.Precision(), s.Recall())
+	}
+	writeRow("all", "all", r.Overall)
+	for _, s := range r.ByVAF {
+		writeRow("vaf", s.Label, s.Stats)
+	}
+	for _, s := range r.ByDepth {
+		writeRow("depth", s.Label, s.Stats)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snpeval_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/bio/pileup/snpeval"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+const truthVCF = `##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+chr1	101	.	A	G	50	PASS	.
+chr1	103	.	C	T,A	50	PASS	.
+chr1	105	.	G	GA	50	PASS	.
+chr1	106	.	T	C	50	LowQual	.
+chr1	110	.	A	C	50	.	.
+chr1	500	.	A	T	50	PASS	.
+`
+
+// Positions 101-104, 1-based.
+const pileupTSV = `#CHROM	POS	REF	A+	A-	C+	C-	G+	G-	T+	T-
+chr1	101	A	10	10	0	0	5	5	0	0
+chr1	102	C	0	1	20	19	0	0	0	0
+chr1	103	C	0	1	10	10	0	0	5	4
+chr1	104	G	0	0	0	0	20	10	3	3
+chr1	110	A	200	200	1	0	0	0	0	0
+`
+
+func TestEvaluate(t *testing.T) {
+	truth, err := snpeval.ReadTruthVCF(strings.NewReader(truthVCF))
+	assert.NoError(t, err)
+	expect.EQ(t, truth, []snpeval.Variant{
+		{"chr1", 100, 'A', 'G'},
+		{"chr1", 102, 'C', 'T'},
+		{"chr1", 102, 'C', 'A'},
+		{"chr1", 109, 'A', 'C'},
+		{"chr1", 499, 'A', 'T'},
+	})
+
+	// chr1:500 is outside the confident region.
+	confident, err := interval.NewBEDUnion(strings.NewReader("chr1\t0\t200\n"), interval.NewBEDOpts{})
+	assert.NoError(t, err)
+	rep, err := snpeval.Evaluate(strings.NewReader(pileupTSV), truth, &confident, snpeval.DefaultCallOpts, snpeval.DefaultStrata)
+	assert.NoError(t, err)
+	// TP: 101 A>G, 103 C>T.  FP: 104 G>T.  FN: 103 C>A (1 read), 110 A>C (VAF
+	// 0.0025).
+	expect.EQ(t, rep.Overall, snpeval.Stats{TP: 2, FP: 1, FN: 2})
+	expect.EQ(t, rep.ByVAF[0], snpeval.Stratum{Label: "[0,0.01)", Stats: snpeval.Stats{FN: 1}})
+	expect.EQ(t, rep.ByVAF[1], snpeval.Stratum{Label: "[0.01,0.05)", Stats: snpeval.Stats{FN: 1}})
+	expect.EQ(t, rep.ByVAF[3].Stats, snpeval.Stats{FP: 1})
+	expect.EQ(t, rep.ByVAF[4].Stats, snpeval.Stats{TP: 2})
+	expect.EQ(t, rep.ByDepth[2], snpeval.Stratum{Label: "[30,100)", Stats: snpeval.Stats{TP: 2, FP: 1, FN: 1}})
+	expect.EQ(t, rep.ByDepth[4].Stats, snpeval.Stats{FN: 1})
+	expect.EQ(t, rep.ByDepth[5].Label, "[1000,inf)")
+
+	// Without a confident region, the uncovered chr1:500 is a depth-0 miss.
+	rep, err = snpeval.Evaluate(strings.NewReader(pileupTSV), truth, nil, snpeval.DefaultCallOpts, snpeval.DefaultStrata)
+	assert.NoError(t, err)
+	expect.EQ(t, rep.Overall, snpeval.Stats{TP: 2, FP: 1, FN: 3})
+	expect.EQ(t, rep.ByDepth[0].Stats, snpeval.Stats{FN: 1})
+
+	var buf bytes.Buffer
+	assert.NoError(t, rep.WriteTSV(&buf))
+	lines := strings.Split(buf.String(), "\n")
+	expect.EQ(t, lines[0], "STRATIFICATION\tBIN\tTP\tFP\tFN\tPRECISION\tRECALL")
+	expect.EQ(t, lines[1], "all\tall\t2\t1\t3\t0.6667\t0.4000")
+}
@@ -0,0 +1,195 @@
+// Package reference provides random access to reference genome sequences,
+// independent of where and how they are stored.  Open supports
+//
+//   - indexed FASTA (with a .fai next to it), read with range requests, so the
+//     reference needn't be on local disk;
+//   - unindexed FASTA, which is read into memory;
+//   - UCSC .2bit files.
+//
+// Paths are opened with grailbio/base/file, so e.g. s3:// paths work, and
+// http:// and https:// URLs are read with HTTP range requests.
+package reference
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bio/encoding/fasta"
+)
+
+// Contig describes one sequence of a Genome.
+type Contig struct {
+	Name string
+	Len  int
+}
+
+// Genome is a reference genome.  Implementations are thread-safe.
+type Genome interface {
+	// Contigs returns the contigs, in file order.
+	Contigs() []Contig
+	// GetSeq returns the bases of chrom in the 0-based half-open range
+	// [start, end), as stored in the file (e.g. soft-masked bases are
+	// lowercase).  The range must be within the contig.
+	GetSeq(chrom string, start, end int) ([]byte, error)
+	// Close releases the resources of the genome.
+	Close() error
+}
+
+// Open opens the reference genome at path; see the package doc.  The format is
+// determined by the suffix: ".2bit" files are read as 2bit, everything else as
+// FASTA.
+func Open(ctx context.Context, path string) (Genome, error) {
+	if strings.HasSuffix(path, ".2bit") {
+		r, err := openReaderAt(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		g, err := NewTwoBit(r)
+		if err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("reference.Open %s: %v", path, err)
+		}
+		return g, nil
+	}
+	return OpenFASTA(ctx, path)
+}
+
+// OpenFASTA opens a FASTA file.  If path+".fai" exists, sequences are read on
+// demand; otherwise the whole file is read into memory, which requires it to
+// be on a filesystem rather than behind an HTTP URL.
+func OpenFASTA(ctx context.Context, path string) (Genome, error) {
+	index, err := readAll(ctx, path+".fai")
+	if err != nil {
+		if isURL(path) {
+			return nil, fmt.Errorf("reference.OpenFASTA %s: an index is required for remote FASTA: %v", path, err)
+		}
+		in, err := file.Open(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close(ctx) // nolint: errcheck
+		fa, err := fasta.New(in.Reader(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("reference.OpenFASTA %s: %v", path, err)
+		}
+		return NewFASTA(fa, nil)
+	}
+	r, err := openReaderAt(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	fa, err := fasta.NewIndexed(newSeekerAt(r), bytes.NewReader(index))
+	if err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("reference.OpenFASTA %s: %v", path, err)
+	}
+	return NewFASTA(fa, r.Close)
+}
+
+// fastaGenome implements Genome for a fasta.Fasta.
+type fastaGenome struct {
+	fa      fasta.Fasta
+	contigs []Contig
+	close   func() error
+}
+
+// NewFASTA returns a Genome which reads from fa.  close, if non-nil, is called
+// by Close.
+func NewFASTA(fa fasta.Fasta, close func() error) (Genome, error) {
+	g := &fastaGenome{fa: fa, close: close}
+	for _, name := range fa.SeqNames() {
+		n, err := fa.Len(name)
+		if err != nil {
+			return nil, err
+		}
+		g.contigs = append(g.contigs, Contig{Name: name, Len: int(n)})
+	}
+	return g, nil
+}
+
+// Contigs implements Genome.
+func (g *fastaGenome) Contigs() []Contig {
+	return g.contigs
+}
+
+// GetSeq implements Genome.
+func (g *fastaGenome) GetSeq(chrom string, start, end int) ([]byte, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("reference.GetSeq: invalid range %s:[%d, %d)", chrom, start, end)
+	}
+	if start == end {
+		// fasta.Fasta rejects empty ranges.
+		if _, err := g.fa.Len(chrom); err != nil {
+			return nil, err
+		}
+		return []byte{}, nil
+	}
+	s, err := g.fa.Get(chrom, uint64(start), uint64(end))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// Close implements Genome.
+func (g *fastaGenome) Close() error {
+	if g.close == nil {
+		return nil
+	}
+	return g.close()
+}
+
+// readAll returns the contents of the file or URL at path.
+func readAll(ctx context.Context, path string) ([]byte, error) {
+	if isURL(path) {
+		return httpGet(ctx, path)
+	}
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	return ioutil.ReadAll(in.Reader(ctx))
+}
+
+// fastaAdapter implements fasta.Fasta for a Genome.
+type fastaAdapter struct {
+	g     Genome
+	names []string
+	lens  map[string]uint64
+}
+
+// AsFasta returns a fasta.Fasta which reads from g, for code written against
+// encoding/fasta.
+func AsFasta(g Genome) fasta.Fasta {
+	a := &fastaAdapter{g: g, lens: map[string]uint64{}}
+	for _, c := range g.Contigs() {
+		a.names = append(a.names, c.Name)
+		a.lens[c.Name] = uint64(c.Len)
+	}
+	return a
+}
+
+// Get implements fasta.Fasta.
+func (a *fastaAdapter) Get(seqName string, start, end uint64) (string, error) {
+	seq, err := a.g.GetSeq(seqName, int(start), int(end))
+	return string(seq), err
+}
+
+// Len implements fasta.Fasta.
+func (a *fastaAdapter) Len(seqName string) (uint64, error) {
+	n, ok := a.lens[seqName]
+	if !ok {
+		return 0, fmt.Errorf("sequence not found: %s", seqName)
+	}
+	return n, nil
+}
+
+// SeqNames implements fasta.Fasta.
+func (a *fastaAdapter) SeqNames() []string {
+	return a.names
+}
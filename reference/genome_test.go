@@ -0,0 +1,202 @@
+package reference_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/reference"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+var testSeqs = []struct {
+	name, seq string
+}{
+	{"chr1", "ACGTNNNNacgtACGGTTAN"},
+	{"chr2", "GATTACA"},
+	{"chrM", "nnACGT"},
+}
+
+// testFASTA returns testSeqs as FASTA, with 6 bases per line.
+func testFASTA() string {
+	var b strings.Builder
+	for _, s := range testSeqs {
+		b.WriteString(">" + s.name + "\n")
+		for i := 0; i < len(s.seq); i += 6 {
+			end := i + 6
+			if end > len(s.seq) {
+				end = len(s.seq)
+			}
+			b.WriteString(s.seq[i:end] + "\n")
+		}
+	}
+	return b.String()
+}
+
+// blocks returns the runs of bases satisfying fn, as parallel start and size
+// slices.
+func blocks(seq string, fn func(byte) bool) (starts, sizes []uint32) {
+	for i := 0; i < len(seq); {
+		if !fn(seq[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(seq) && fn(seq[j]) {
+			j++
+		}
+		starts = append(starts, uint32(i))
+		sizes = append(sizes, uint32(j-i))
+		i = j
+	}
+	return
+}
+
+// testTwoBit returns testSeqs in the given 2bit version.
+func testTwoBit(version uint32) []byte {
+	le := binary.LittleEndian
+	var index, records bytes.Buffer
+	u32 := func(b *bytes.Buffer, v uint32) {
+		var buf [4]byte
+		le.PutUint32(buf[:], v)
+		b.Write(buf[:])
+	}
+	offsetSize := 4
+	if version == 1 {
+		offsetSize = 8
+	}
+	indexLen := 0
+	for _, s := range testSeqs {
+		indexLen += 1 + len(s.name) + offsetSize
+	}
+	for _, s := range testSeqs {
+		offset := 16 + indexLen + records.Len()
+		index.WriteByte(byte(len(s.name)))
+		index.WriteString(s.name)
+		if version == 1 {
+			var buf [8]byte
+			le.PutUint64(buf[:], uint64(offset))
+			index.Write(buf[:])
+		} else {
+			u32(&index, uint32(offset))
+		}
+		u32(&records, uint32(len(s.seq)))
+		for _, fn := range []func(byte) bool{
+			func(b byte) bool { return b == 'N' || b == 'n' },
+			func(b byte) bool { return b >= 'a' },
+		} {
+			starts, sizes := blocks(s.seq, fn)
+			u32(&records, uint32(len(starts)))
+			for _, v := range append(starts, sizes...) {
+				u32(&records, v)
+			}
+		}
+		u32(&records, 0)
+		packed := make([]byte, (len(s.seq)+3)/4)
+		for i := 0; i < len(s.seq); i++ {
+			code := strings.IndexByte("TCAG", s.seq[i]&^0x20)
+			if code < 0 {
+				code = 0
+			}
+			packed[i/4] |= byte(code) << uint(6-2*(i%4))
+		}
+		records.Write(packed)
+	}
+	var out bytes.Buffer
+	u32(&out, 0x1A412743)
+	u32(&out, version)
+	u32(&out, uint32(len(testSeqs)))
+	u32(&out, 0)
+	out.Write(index.Bytes())
+	out.Write(records.Bytes())
+	return out.Bytes()
+}
+
+func checkGenome(t *testing.T, g reference.Genome, label string) {
+	var want []reference.Contig
+	for _, s := range testSeqs {
+		want = append(want, reference.Contig{Name: s.name, Len: len(s.seq)})
+	}
+	expect.EQ(t, g.Contigs(), want, label)
+	for _, s := range testSeqs {
+		for start := 0; start <= len(s.seq); start++ {
+			for end := start; end <= len(s.seq); end++ {
+				seq, err := g.GetSeq(s.name, start, end)
+				assert.NoError(t, err, label)
+				assert.EQ(t, string(seq), s.seq[start:end], label, s.name, start, end)
+			}
+		}
+	}
+	_, err := g.GetSeq("chr1", 10, 21)
+	expect.NotNil(t, err, label)
+	_, err = g.GetSeq("chr3", 0, 1)
+	expect.NotNil(t, err, label)
+	assert.NoError(t, g.Close(), label)
+}
+
+func TestTwoBit(t *testing.T) {
+	for _, version := range []uint32{0, 1} {
+		g, err := reference.NewTwoBit(bytes.NewReader(testTwoBit(version)))
+		assert.NoError(t, err)
+		checkGenome(t, g, "2bit")
+	}
+	_, err := reference.NewTwoBit(strings.NewReader(testFASTA()))
+	expect.NotNil(t, err)
+}
+
+func TestOpen(t *testing.T) {
+	ctx := vcontext.Background()
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	fa := testFASTA()
+	var fai bytes.Buffer
+	assert.NoError(t, fasta.GenerateIndex(&fai, strings.NewReader(fa)))
+	for name, data := range map[string][]byte{
+		"indexed.fa":     []byte(fa),
+		"indexed.fa.fai": fai.Bytes(),
+		"unindexed.fa":   []byte(fa),
+		"genome.2bit":    testTwoBit(0),
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(tmpdir, name), data, 0644))
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(tmpdir)))
+	defer srv.Close()
+
+	for _, path := range []string{
+		filepath.Join(tmpdir, "indexed.fa"),
+		filepath.Join(tmpdir, "unindexed.fa"),
+		filepath.Join(tmpdir, "genome.2bit"),
+		srv.URL + "/indexed.fa",
+		srv.URL + "/genome.2bit",
+	} {
+		g, err := reference.Open(ctx, path)
+		assert.NoError(t, err, path)
+		checkGenome(t, g, path)
+	}
+	// Remote FASTA must be indexed.
+	_, err := reference.Open(ctx, srv.URL+"/unindexed.fa")
+	expect.NotNil(t, err)
+	_, err = reference.Open(ctx, filepath.Join(tmpdir, "missing.2bit"))
+	expect.NotNil(t, err)
+
+	g, err := reference.Open(ctx, filepath.Join(tmpdir, "genome.2bit"))
+	assert.NoError(t, err)
+	defer g.Close() // nolint: errcheck
+	adapter := reference.AsFasta(g)
+	expect.EQ(t, adapter.SeqNames(), []string{"chr1", "chr2", "chrM"})
+	n, err := adapter.Len("chr2")
+	assert.NoError(t, err)
+	expect.EQ(t, n, uint64(7))
+	s, err := adapter.Get("chr1", 2, 10)
+	assert.NoError(t, err)
+	expect.EQ(t, s, "GTNNNNac")
+}
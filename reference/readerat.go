@@ -0,0 +1,134 @@
+package reference
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/file"
+)
+
+// readerAtCloser is a random-access view of a file.
+type readerAtCloser interface {
+	io.ReaderAt
+	Close() error
+}
+
+// isURL returns whether path is an HTTP(S) URL.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// openReaderAt opens the file or URL at path for random access.  ctx is used
+// for all the reads.
+func openReaderAt(ctx context.Context, path string) (readerAtCloser, error) {
+	if isURL(path) {
+		return &httpReaderAt{ctx: ctx, url: path, client: http.DefaultClient}, nil
+	}
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReaderAt{ctx: ctx, in: in, r: in.Reader(ctx)}, nil
+}
+
+// newSeekerAt returns an io.ReadSeeker over r.
+func newSeekerAt(r io.ReaderAt) io.ReadSeeker {
+	return io.NewSectionReader(r, 0, math.MaxInt64)
+}
+
+// fileReaderAt implements readerAtCloser for a file.File, whose readers only
+// support Seek and Read.  For remote filesystems like S3, those are range
+// reads.
+type fileReaderAt struct {
+	ctx context.Context
+	in  file.File
+	mu  sync.Mutex
+	r   io.ReadSeeker
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *fileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close implements readerAtCloser.
+func (f *fileReaderAt) Close() error {
+	return f.in.Close(f.ctx)
+}
+
+// httpReaderAt implements readerAtCloser with HTTP range requests.
+type httpReaderAt struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+}
+
+// ReadAt implements io.ReaderAt.
+func (h *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest("GET", h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(h.ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	case http.StatusOK:
+		// Reading the whole file for each request would be hopeless.
+		return 0, fmt.Errorf("reference: %s: server doesn't support range requests", h.url)
+	default:
+		return 0, fmt.Errorf("reference: %s: %s", h.url, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close implements readerAtCloser.
+func (h *httpReaderAt) Close() error {
+	return nil
+}
+
+// httpGet returns the body of url.
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reference: %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,264 @@
+package reference
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// The .2bit format is described at
+// https://genome.ucsc.edu/FAQ/FAQformat.html#format7.  In brief, the file
+// starts with a header and an index of sequence names and offsets; each
+// sequence record then holds its length, its blocks of Ns and of soft-masked
+// (lowercase) bases, and its bases packed four to a byte, with T=0, C=1, A=2
+// and G=3, most significant bits first.  Version 1 files have 64-bit offsets
+// in the index.
+
+const twoBitSignature = 0x1A412743
+
+// twoBitBases maps a 2-bit code to its base.
+const twoBitBases = "TCAG"
+
+// twoBitBlock is a 0-based half-open range of N or soft-masked bases.
+type twoBitBlock struct {
+	start, end int
+}
+
+// twoBitSeq is the record of one sequence.  The blocks and dnaOffset are only
+// read on the first GetSeq call for the sequence.
+type twoBitSeq struct {
+	offset     int64
+	loaded     bool
+	nBlocks    []twoBitBlock
+	maskBlocks []twoBitBlock
+	dnaOffset  int64
+}
+
+// twoBit implements Genome for a .2bit file.
+type twoBit struct {
+	r       io.ReaderAt
+	order   binary.ByteOrder
+	contigs []Contig
+	byName  map[string]int
+	mu      sync.Mutex // guards seqs[*].loaded and the fields it covers
+	seqs    []twoBitSeq
+}
+
+// NewTwoBit returns a Genome which reads the .2bit file r.  The genome's Close
+// closes r if it is an io.Closer.
+func NewTwoBit(r io.ReaderAt) (Genome, error) {
+	var header [16]byte
+	if err := readFullAt(r, header[:], 0); err != nil {
+		return nil, fmt.Errorf("reading 2bit header: %v", err)
+	}
+	g := &twoBit{r: r, byName: map[string]int{}}
+	switch {
+	case binary.LittleEndian.Uint32(header[0:]) == twoBitSignature:
+		g.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[0:]) == twoBitSignature:
+		g.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a 2bit file")
+	}
+	version := g.order.Uint32(header[4:])
+	if version > 1 {
+		return nil, fmt.Errorf("unsupported 2bit version %d", version)
+	}
+	nSeq := int(g.order.Uint32(header[8:]))
+	offsetSize := 4
+	if version == 1 {
+		offsetSize = 8
+	}
+
+	// The index entries have variable length, so read the index in chunks.
+	off := int64(len(header))
+	buf := make([]byte, 1<<16)
+	bufOff, bufLen := off, 0
+	read := func(n int) ([]byte, error) {
+		if off+int64(n) > bufOff+int64(bufLen) {
+			var err error
+			bufOff = off
+			if bufLen, err = r.ReadAt(buf, off); bufLen < n {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, fmt.Errorf("reading 2bit index: %v", err)
+			}
+		}
+		b := buf[off-bufOff : off-bufOff+int64(n)]
+		off += int64(n)
+		return b, nil
+	}
+	g.seqs = make([]twoBitSeq, nSeq)
+	g.contigs = make([]Contig, nSeq)
+	for i := 0; i < nSeq; i++ {
+		b, err := read(1)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = read(int(b[0]) + offsetSize); err != nil {
+			return nil, err
+		}
+		name := string(b[:len(b)-offsetSize])
+		if offsetSize == 4 {
+			g.seqs[i].offset = int64(g.order.Uint32(b[len(name):]))
+		} else {
+			g.seqs[i].offset = int64(g.order.Uint64(b[len(name):]))
+		}
+		g.contigs[i].Name = name
+		g.byName[name] = i
+	}
+	// The lengths are at the start of each record.
+	var lenBuf [4]byte
+	for i := range g.seqs {
+		if err := readFullAt(r, lenBuf[:], g.seqs[i].offset); err != nil {
+			return nil, fmt.Errorf("reading 2bit record of %s: %v", g.contigs[i].Name, err)
+		}
+		g.contigs[i].Len = int(g.order.Uint32(lenBuf[:]))
+	}
+	return g, nil
+}
+
+// readFullAt fills p from r at off.  Unlike r.ReadAt, it doesn't return io.EOF
+// when p ends at the end of the file.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Contigs implements Genome.
+func (g *twoBit) Contigs() []Contig {
+	return g.contigs
+}
+
+// readUint32s reads n uint32s at off.
+func (g *twoBit) readUint32s(off int64, n int) ([]uint32, error) {
+	b := make([]byte, 4*n)
+	if err := readFullAt(g.r, b, off); err != nil {
+		return nil, err
+	}
+	v := make([]uint32, n)
+	for i := range v {
+		v[i] = g.order.Uint32(b[4*i:])
+	}
+	return v, nil
+}
+
+// readBlocks reads a block list (count, starts, sizes) at off, and returns
+// the blocks and the offset past them.
+func (g *twoBit) readBlocks(off int64) ([]twoBitBlock, int64, error) {
+	count, err := g.readUint32s(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += 4
+	n := int(count[0])
+	if n == 0 {
+		return nil, off, nil
+	}
+	v, err := g.readUint32s(off, 2*n)
+	if err != nil {
+		return nil, 0, err
+	}
+	blocks := make([]twoBitBlock, n)
+	for i := range blocks {
+		blocks[i].start = int(v[i])
+		blocks[i].end = int(v[i]) + int(v[n+i])
+	}
+	return blocks, off + 8*int64(n), nil
+}
+
+// load returns the record of sequence i, reading its blocks if necessary.
+func (g *twoBit) load(i int) (*twoBitSeq, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := &g.seqs[i]
+	if s.loaded {
+		return s, nil
+	}
+	var err error
+	off := s.offset + 4 // skip dnaSize
+	if s.nBlocks, off, err = g.readBlocks(off); err != nil {
+		return nil, err
+	}
+	if s.maskBlocks, off, err = g.readBlocks(off); err != nil {
+		return nil, err
+	}
+	s.dnaOffset = off + 4 // skip reserved
+	s.loaded = true
+	return s, nil
+}
+
+// applyBlocks calls fn for the part of each block that overlaps [start, end),
+// relative to start.  blocks must be sorted.
+func applyBlocks(blocks []twoBitBlock, start, end int, fn func(i, j int)) {
+	first := sort.Search(len(blocks), func(i int) bool { return blocks[i].end > start })
+	for _, b := range blocks[first:] {
+		if b.start >= end {
+			break
+		}
+		i, j := b.start, b.end
+		if i < start {
+			i = start
+		}
+		if j > end {
+			j = end
+		}
+		fn(i-start, j-start)
+	}
+}
+
+// GetSeq implements Genome.
+func (g *twoBit) GetSeq(chrom string, start, end int) ([]byte, error) {
+	idx, ok := g.byName[chrom]
+	if !ok {
+		return nil, fmt.Errorf("reference.GetSeq: sequence not found: %s", chrom)
+	}
+	if start < 0 || end < start || end > g.contigs[idx].Len {
+		return nil, fmt.Errorf("reference.GetSeq: invalid range %s:[%d, %d)", chrom, start, end)
+	}
+	seq := make([]byte, end-start)
+	if start == end {
+		return seq, nil
+	}
+	s, err := g.load(idx)
+	if err != nil {
+		return nil, fmt.Errorf("reference.GetSeq: reading 2bit record of %s: %v", chrom, err)
+	}
+	packed := make([]byte, (end-1)/4-start/4+1)
+	if err := readFullAt(g.r, packed, s.dnaOffset+int64(start/4)); err != nil {
+		return nil, fmt.Errorf("reference.GetSeq: reading %s:[%d, %d): %v", chrom, start, end, err)
+	}
+	for i := range seq {
+		pos := start + i
+		code := packed[pos/4-start/4] >> uint(6-2*(pos%4)) & 3
+		seq[i] = twoBitBases[code]
+	}
+	applyBlocks(s.nBlocks, start, end, func(i, j int) {
+		for k := i; k < j; k++ {
+			seq[k] = 'N'
+		}
+	})
+	applyBlocks(s.maskBlocks, start, end, func(i, j int) {
+		for k := i; k < j; k++ {
+			seq[k] |= 0x20 // lowercase
+		}
+	})
+	return seq, nil
+}
+
+// Close implements Genome.
+func (g *twoBit) Close() error {
+	if c, ok := g.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
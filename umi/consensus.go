@@ -0,0 +1,133 @@
+package umi
+
+import (
+	"github.com/grailbio/hts/sam"
+)
+
+const (
+	// ConsensusMaxQual is the highest base quality assigned by CallConsensus.
+	ConsensusMaxQual = 60
+	// ConsensusMinQual is the base quality of consensus bases which are
+	// contradicted about as much as they are supported.
+	ConsensusMinQual = 2
+)
+
+// ConsensusStats describes the outcome of a CallConsensus call.
+type ConsensusStats struct {
+	// Used is the number of reads the consensus was built from, and
+	// Discarded is the number of reads left out because their CIGAR differed
+	// from the family's most common one.
+	Used, Discarded int
+}
+
+// CallConsensus builds the consensus read of a UMI family, i.e. of reads
+// sequenced from the same strand of the same molecule.  Only the reads with
+// the family's most common CIGAR (and alignment start) take part; ties are
+// broken in favor of the CIGAR seen first.
+//
+// At each read position, the consensus base is the one with the highest sum
+// of base qualities, and its quality is that sum minus the sum of the
+// qualities of the other bases, clamped to [ConsensusMinQual,
+// ConsensusMaxQual].  A position where no read has a called base gets N.
+//
+// The returned record is a copy of the first selected read, named name, with
+// the consensus sequence and qualities, and the Duplicate flag cleared.  It
+// is taken from the sam free pool.  The input reads are not modified.
+// CallConsensus returns nil if reads is empty.
+func CallConsensus(reads []*sam.Record, name string) (*sam.Record, ConsensusStats) {
+	if len(reads) == 0 {
+		return nil, ConsensusStats{}
+	}
+	// Find the most common (Pos, CIGAR); families are small, so a quadratic
+	// scan is fine.
+	best, bestN := 0, 0
+	for i, r := range reads {
+		n := 0
+		for _, r2 := range reads {
+			if sameAlignment(r, r2) {
+				n++
+			}
+		}
+		if n > bestN {
+			best, bestN = i, n
+		}
+	}
+	rep := reads[best]
+	readLen := rep.Seq.Length
+	var (
+		scores = make([][4]int, readLen)
+		seq    = make([]byte, readLen)
+		qual   = make([]byte, readLen)
+	)
+	for _, r := range reads {
+		if !sameAlignment(rep, r) {
+			continue
+		}
+		for i, base := range r.Seq.Expand() {
+			if b := baseIndex(base); b >= 0 {
+				scores[i][b] += int(r.Qual[i])
+			}
+		}
+	}
+	for i := range scores {
+		s := &scores[i]
+		b, total := 0, 0
+		for j := range s {
+			total += s[j]
+			if s[j] > s[b] {
+				b = j
+			}
+		}
+		if s[b] == 0 {
+			seq[i], qual[i] = 'N', ConsensusMinQual
+			continue
+		}
+		q := 2*s[b] - total
+		if q < ConsensusMinQual {
+			q = ConsensusMinQual
+		} else if q > ConsensusMaxQual {
+			q = ConsensusMaxQual
+		}
+		seq[i], qual[i] = "ACGT"[b], byte(q)
+	}
+
+	c := sam.GetFromFreePool()
+	*c = *rep
+	c.Name = name
+	c.Flags &^= sam.Duplicate
+	// The slices of rep may be reused once it goes back to the free pool.
+	c.Cigar = append(sam.Cigar(nil), rep.Cigar...)
+	c.AuxFields = append(sam.AuxFields(nil), rep.AuxFields...)
+	c.Seq = sam.NewSeq(seq)
+	c.Qual = qual
+	return c, ConsensusStats{Used: bestN, Discarded: len(reads) - bestN}
+}
+
+// sameAlignment returns true if a and b have the same alignment start and
+// CIGAR.
+func sameAlignment(a, b *sam.Record) bool {
+	if (a.Pos != b.Pos) || (len(a.Cigar) != len(b.Cigar)) || (a.Seq.Length != b.Seq.Length) {
+		return false
+	}
+	for i, op := range a.Cigar {
+		if op != b.Cigar[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// baseIndex returns the index of b in "ACGT", or -1 for other bases.
+func baseIndex(b byte) int {
+	switch b {
+	case 'A', 'a':
+		return 0
+	case 'C', 'c':
+		return 1
+	case 'G', 'g':
+		return 2
+	case 'T', 't':
+		return 3
+	}
+	return -1
+}
@@ -0,0 +1,59 @@
+package umi
+
+import (
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallConsensus(t *testing.T) {
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	require.NoError(t, err)
+	newRead := func(name string, pos int, cigar sam.Cigar, seq string, qual byte) *sam.Record {
+		quals := make([]byte, len(seq))
+		for i := range quals {
+			quals[i] = qual
+		}
+		return &sam.Record{
+			Name:  name,
+			Ref:   ref,
+			Pos:   pos,
+			MapQ:  60,
+			Cigar: cigar,
+			Flags: sam.Paired | sam.Read1 | sam.Duplicate,
+			Seq:   sam.NewSeq([]byte(seq)),
+			Qual:  quals,
+		}
+	}
+	match5 := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 5)}
+	clipped := sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 1), sam.NewCigarOp(sam.CigarMatch, 4)}
+
+	c, stats := CallConsensus(nil, "x")
+	assert.Nil(t, c)
+	assert.Equal(t, ConsensusStats{}, stats)
+
+	reads := []*sam.Record{
+		newRead("a", 100, match5, "ACGTA", 30),
+		newRead("b", 100, match5, "ACTTN", 30),
+		newRead("c", 101, clipped, "GGGGG", 30),
+		newRead("d", 100, match5, "ACGTN", 20),
+	}
+	c, stats = CallConsensus(reads, "fam")
+	require.NotNil(t, c)
+	assert.Equal(t, ConsensusStats{Used: 3, Discarded: 1}, stats)
+	assert.Equal(t, "fam", c.Name)
+	assert.Equal(t, 100, c.Pos)
+	assert.Equal(t, "ACGTA", string(c.Seq.Expand()))
+	// Position 2 is G (50) against T (30); position 4 only has one call.
+	assert.Equal(t, []byte{60, 60, 20, 60, 30}, c.Qual)
+	assert.Equal(t, sam.Paired|sam.Read1, c.Flags)
+	assert.Equal(t, "a", reads[0].Name)
+
+	// A tie between the two alignments goes to the first one seen.
+	c, stats = CallConsensus(reads[1:3], "fam")
+	assert.Equal(t, ConsensusStats{Used: 1, Discarded: 1}, stats)
+	assert.Equal(t, "ACTTN", string(c.Seq.Expand()))
+	assert.Equal(t, byte(ConsensusMinQual), c.Qual[4])
+}
@@ -0,0 +1,278 @@
+package umi
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// FamilySizeFunc returns the number of read-pairs sequenced from one strand
+// of a molecule.  A value <= 0 means that strand was not sequenced.
+type FamilySizeFunc func(r *rand.Rand) int
+
+// FixedFamilySize returns a FamilySizeFunc that always returns n.
+func FixedFamilySize(n int) FamilySizeFunc {
+	return func(*rand.Rand) int { return n }
+}
+
+// PoissonFamilySize returns a FamilySizeFunc drawing from a zero-truncated
+// Poisson distribution with the given (pre-truncation) mean.  This is the
+// usual model for PCR duplicate counts at moderate sequencing depth.
+func PoissonFamilySize(mean float64) FamilySizeFunc {
+	limit := math.Exp(-mean)
+	return func(r *rand.Rand) int {
+		for {
+			// Knuth's algorithm; fine for the small means seen in practice.
+			n, p := 0, r.Float64()
+			for p > limit {
+				n++
+				p *= r.Float64()
+			}
+			if n > 0 {
+				return n
+			}
+		}
+	}
+}
+
+// GeometricFamilySize returns a FamilySizeFunc drawing from a geometric
+// distribution on {1, 2, ...} with the given mean (>= 1).  It has a longer
+// tail than PoissonFamilySize, which resembles over-amplified libraries.
+func GeometricFamilySize(mean float64) FamilySizeFunc {
+	p := 1 / mean
+	return func(r *rand.Rand) int {
+		n := 1
+		for r.Float64() >= p {
+			n++
+		}
+		return n
+	}
+}
+
+// SimulateOpts configures SimulateFamilies.
+type SimulateOpts struct {
+	// Ref and RefSeq describe the contig that reads are drawn from.  RefSeq
+	// must be uppercase ACGT(N).
+	Ref    *sam.Reference
+	RefSeq []byte
+	// NumMolecules is the number of original double-stranded molecules.
+	NumMolecules int
+	// UMILen is the length of each of the two UMIs attached to a molecule.
+	UMILen int
+	// ReadLen is the length of each read; FragLenMin and FragLenMax bound the
+	// (uniformly distributed) molecule length.  FragLenMin must be >= ReadLen.
+	ReadLen    int
+	FragLenMin int
+	FragLenMax int
+	// FamilySize draws the family size for each strand of each molecule.
+	// Defaults to FixedFamilySize(1).
+	FamilySize FamilySizeFunc
+	// DuplexFraction is the fraction of molecules for which both strands are
+	// sequenced.  The remaining molecules only produce a top-strand (A)
+	// family.
+	DuplexFraction float64
+	// DamageRate is the per-base probability of deamination-like damage on
+	// one strand of the original molecule: C>T on the top strand, which reads
+	// as G>A in reference coordinates on the bottom strand.  Damage is copied
+	// into every read of the strand's family, but never appears in the other
+	// strand's family, so duplex consensus should remove it.
+	DamageRate float64
+	// ErrorRate is the per-base sequencing error rate, applied independently to
+	// every read.
+	ErrorRate float64
+	// Qual is the base quality assigned to every base.  Defaults to 30.
+	Qual byte
+	// Seed seeds the random number generator.
+	Seed int64
+}
+
+// SimulatedStrand describes one strand family of a SimulatedMolecule.
+type SimulatedStrand struct {
+	// FamilySize is the number of read-pairs generated.  It is 0 if the strand
+	// wasn't sequenced.
+	FamilySize int
+	// Damage lists the 0-based reference positions damaged on this strand.
+	Damage []int
+}
+
+// SimulatedMolecule is the ground truth for one original molecule.
+type SimulatedMolecule struct {
+	// ID is the molecule index; it is also the prefix of the MI aux tag.
+	ID int
+	// Start and End are the 0-based half-open reference interval.
+	Start, End int
+	// UMIs are the UMIs ligated to the molecule's two ends.  Top-strand reads
+	// carry RX:Z:UMIs[0]-UMIs[1], bottom-strand reads RX:Z:UMIs[1]-UMIs[0].
+	UMIs [2]string
+	// Strands are the top (A) and bottom (B) strand families.
+	Strands [2]SimulatedStrand
+}
+
+var (
+	rxTag = sam.NewTag("RX")
+	miTag = sam.NewTag("MI")
+)
+
+// SimulateFamilies generates paired-end reads from UMI-tagged molecules, for
+// testing UMI collapsing and duplex consensus code.
+//
+// Reads follow the fgbio conventions: the RX aux tag holds the two UMIs
+// separated by '-', in read-1-first order, and the MI aux tag holds the
+// molecule ID with a "/A" or "/B" strand suffix.  Top-strand (A) pairs have
+// read 1 on the forward strand at the molecule start; bottom-strand (B) pairs
+// have read 2 there instead.  Read names are "<molecule>:<strand>:<index>".
+//
+// The returned records are coordinate-sorted.  The molecules are returned in
+// ID order.
+func SimulateFamilies(opts SimulateOpts) ([]*sam.Record, []SimulatedMolecule, error) {
+	if opts.ReadLen <= 0 || opts.FragLenMin < opts.ReadLen || opts.FragLenMax < opts.FragLenMin {
+		return nil, nil, fmt.Errorf("umi.SimulateFamilies: need 0 < ReadLen <= FragLenMin <= FragLenMax, got %d, %d, %d", opts.ReadLen, opts.FragLenMin, opts.FragLenMax)
+	}
+	if opts.FragLenMax > len(opts.RefSeq) {
+		return nil, nil, fmt.Errorf("umi.SimulateFamilies: FragLenMax %d exceeds reference length %d", opts.FragLenMax, len(opts.RefSeq))
+	}
+	familySize := opts.FamilySize
+	if familySize == nil {
+		familySize = FixedFamilySize(1)
+	}
+	qual := opts.Qual
+	if qual == 0 {
+		qual = 30
+	}
+	r := rand.New(rand.NewSource(opts.Seed))
+	var (
+		records   []*sam.Record
+		molecules = make([]SimulatedMolecule, opts.NumMolecules)
+		fragBuf   []byte
+	)
+	for id := range molecules {
+		m := &molecules[id]
+		m.ID = id
+		fragLen := opts.FragLenMin + r.Intn(opts.FragLenMax-opts.FragLenMin+1)
+		m.Start = r.Intn(len(opts.RefSeq) - fragLen + 1)
+		m.End = m.Start + fragLen
+		m.UMIs = [2]string{randomBases(r, opts.UMILen), randomBases(r, opts.UMILen)}
+		nStrand := 1
+		if r.Float64() < opts.DuplexFraction {
+			nStrand = 2
+		}
+		for strand := 0; strand < nStrand; strand++ {
+			s := &m.Strands[strand]
+			if s.FamilySize = familySize(r); s.FamilySize <= 0 {
+				s.FamilySize = 0
+				continue
+			}
+			// Apply strand-specific damage to the molecule template.
+			fragBuf = append(fragBuf[:0], opts.RefSeq[m.Start:m.End]...)
+			from, to := byte('C'), byte('T')
+			if strand == 1 {
+				from, to = 'G', 'A'
+			}
+			for i, b := range fragBuf {
+				if b == from && opts.DamageRate > 0 && r.Float64() < opts.DamageRate {
+					fragBuf[i] = to
+					s.Damage = append(s.Damage, m.Start+i)
+				}
+			}
+			strandName := "A"
+			umiTag := m.UMIs[0] + "-" + m.UMIs[1]
+			if strand == 1 {
+				strandName = "B"
+				umiTag = m.UMIs[1] + "-" + m.UMIs[0]
+			}
+			mi := strconv.Itoa(id) + "/" + strandName
+			for dup := 0; dup < s.FamilySize; dup++ {
+				name := strconv.Itoa(id) + ":" + strandName + ":" + strconv.Itoa(dup)
+				fwd, rev, err := simulatePair(r, &opts, name, fragBuf, m.Start, umiTag, mi, qual)
+				if err != nil {
+					return nil, nil, err
+				}
+				// Read 1 is forward on the top strand and reverse on the bottom
+				// strand.
+				if strand == 0 {
+					fwd.Flags |= sam.Read1
+					rev.Flags |= sam.Read2
+				} else {
+					fwd.Flags |= sam.Read2
+					rev.Flags |= sam.Read1
+				}
+				records = append(records, fwd, rev)
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pos < records[j].Pos })
+	return records, molecules, nil
+}
+
+// simulatePair generates the forward read at the start of frag and the
+// reverse read at its end.  Read1/Read2 flags are left to the caller.
+func simulatePair(r *rand.Rand, opts *SimulateOpts, name string, frag []byte, start int, umiTag, mi string, qual byte) (fwd, rev *sam.Record, err error) {
+	readLen := opts.ReadLen
+	end := start + len(frag)
+	newRead := func(pos, matePos int, seq []byte, flags sam.Flags, tlen int) (*sam.Record, error) {
+		seq = append([]byte(nil), seq...)
+		for i := range seq {
+			if opts.ErrorRate > 0 && r.Float64() < opts.ErrorRate {
+				seq[i] = substituteBase(r, seq[i])
+			}
+		}
+		quals := make([]byte, readLen)
+		for i := range quals {
+			quals[i] = qual
+		}
+		rx, err := sam.NewAux(rxTag, umiTag)
+		if err != nil {
+			return nil, err
+		}
+		miAux, err := sam.NewAux(miTag, mi)
+		if err != nil {
+			return nil, err
+		}
+		return &sam.Record{
+			Name:    name,
+			Ref:     opts.Ref,
+			Pos:     pos,
+			MapQ:    60,
+			Cigar:   sam.Cigar{sam.NewCigarOp(sam.CigarMatch, readLen)},
+			Flags:   sam.Paired | sam.ProperPair | flags,
+			MateRef: opts.Ref,
+			MatePos: matePos,
+			TempLen: tlen,
+			Seq:     sam.NewSeq(seq),
+			Qual:    quals,
+			AuxFields: sam.AuxFields{
+				rx,
+				miAux,
+			},
+		}, nil
+	}
+	revPos := end - readLen
+	if fwd, err = newRead(start, revPos, frag[:readLen], sam.MateReverse, len(frag)); err != nil {
+		return
+	}
+	rev, err = newRead(revPos, start, frag[len(frag)-readLen:], sam.Reverse, -len(frag))
+	return
+}
+
+var bases = []byte("ACGT")
+
+func randomBases(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = bases[r.Intn(4)]
+	}
+	return string(b)
+}
+
+// substituteBase returns a random base different from b.
+func substituteBase(r *rand.Rand, b byte) byte {
+	for {
+		if nb := bases[r.Intn(4)]; nb != b {
+			return nb
+		}
+	}
+}
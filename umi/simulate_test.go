@@ -0,0 +1,130 @@
+package umi
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulateFamilies(t *testing.T) {
+	refSeq := []byte(strings.Repeat("ACGTTGCA", 125))
+	ref, err := sam.NewReference("chr1", "", "", len(refSeq), nil, nil)
+	require.NoError(t, err)
+	opts := SimulateOpts{
+		Ref:            ref,
+		RefSeq:         refSeq,
+		NumMolecules:   50,
+		UMILen:         6,
+		ReadLen:        50,
+		FragLenMin:     120,
+		FragLenMax:     200,
+		FamilySize:     PoissonFamilySize(3),
+		DuplexFraction: 0.5,
+		DamageRate:     0.05,
+		Seed:           1,
+	}
+	records, molecules, err := SimulateFamilies(opts)
+	require.NoError(t, err)
+	require.Len(t, molecules, 50)
+
+	nPairs := 0
+	nDuplex := 0
+	for _, m := range molecules {
+		assert.True(t, m.Strands[0].FamilySize > 0)
+		nPairs += m.Strands[0].FamilySize + m.Strands[1].FamilySize
+		if m.Strands[1].FamilySize > 0 {
+			nDuplex++
+		}
+		for _, pos := range m.Strands[0].Damage {
+			assert.Equal(t, byte('C'), refSeq[pos])
+		}
+		for _, pos := range m.Strands[1].Damage {
+			assert.Equal(t, byte('G'), refSeq[pos])
+		}
+	}
+	assert.Equal(t, 2*nPairs, len(records))
+	assert.True(t, nDuplex > 10 && nDuplex < 40, "nDuplex=%d", nDuplex)
+
+	for i, rec := range records {
+		if i > 0 {
+			assert.True(t, records[i-1].Pos <= rec.Pos)
+		}
+		fields := strings.Split(rec.Name, ":")
+		require.Len(t, fields, 3)
+		id, err := strconv.Atoi(fields[0])
+		require.NoError(t, err)
+		m := molecules[id]
+		strand := 0
+		if fields[1] == "B" {
+			strand = 1
+		}
+		rx := rec.AuxFields.Get(sam.NewTag("RX")).Value().(string)
+		mi := rec.AuxFields.Get(sam.NewTag("MI")).Value().(string)
+		assert.Equal(t, fields[0]+"/"+fields[1], mi)
+		if strand == 0 {
+			assert.Equal(t, m.UMIs[0]+"-"+m.UMIs[1], rx)
+		} else {
+			assert.Equal(t, m.UMIs[1]+"-"+m.UMIs[0], rx)
+		}
+		// Read 1 is forward iff the read comes from the top strand.
+		isRead1 := rec.Flags&sam.Read1 != 0
+		isFwd := rec.Flags&sam.Reverse == 0
+		assert.Equal(t, strand == 0, isRead1 == isFwd, rec.Name)
+		if isFwd {
+			assert.Equal(t, m.Start, rec.Pos)
+			assert.Equal(t, m.End-m.Start, rec.TempLen)
+		} else {
+			assert.Equal(t, m.End-opts.ReadLen, rec.Pos)
+		}
+
+		// Without sequencing errors, reads only differ from the reference at
+		// the damaged positions of their own strand.
+		damaged := map[int]bool{}
+		for _, pos := range m.Strands[strand].Damage {
+			damaged[pos] = true
+		}
+		seq := rec.Seq.Expand()
+		for j, b := range seq {
+			pos := rec.Pos + j
+			if damaged[pos] {
+				if strand == 0 {
+					assert.Equal(t, byte('T'), b)
+				} else {
+					assert.Equal(t, byte('A'), b)
+				}
+			} else {
+				assert.Equal(t, refSeq[pos], b, "%s pos %d", rec.Name, pos)
+			}
+		}
+	}
+
+	_, _, err = SimulateFamilies(SimulateOpts{RefSeq: refSeq, ReadLen: 100, FragLenMin: 50, FragLenMax: 60})
+	assert.Error(t, err)
+}
+
+func TestFamilySizeFuncs(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, tt := range []struct {
+		fn   FamilySizeFunc
+		mean float64
+	}{
+		{FixedFamilySize(4), 4},
+		// Zero-truncated Poisson(2) has mean 2 / (1 - e^-2) ~= 2.31.
+		{PoissonFamilySize(2), 2.31},
+		{GeometricFamilySize(5), 5},
+	} {
+		sum := 0
+		const n = 20000
+		for i := 0; i < n; i++ {
+			v := tt.fn(r)
+			assert.True(t, v >= 1)
+			sum += v
+		}
+		assert.InDelta(t, tt.mean, float64(sum)/n, 0.1)
+	}
+}
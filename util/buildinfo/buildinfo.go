@@ -0,0 +1,76 @@
+// Package buildinfo holds the version information embedded in the bio-*
+// binaries at link time, e.g. by "make static":
+//
+//	go build -ldflags "-X github.com/grailbio/bio/util/buildinfo.Version=v1.2.3 \
+//	    -X github.com/grailbio/bio/util/buildinfo.GitSHA=$(git rev-parse HEAD)"
+//
+// Binaries built without these flags report the module version recorded by
+// the go tool, usually "(devel)".
+package buildinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at link time with -X.
+var (
+	// Version is the semantic version of the build, e.g. "v1.2.3".
+	Version string
+	// GitSHA is the commit the binary was built from, with a "-dirty" suffix
+	// if the tree had local changes.
+	GitSHA string
+	// BuildFlags describes how the binary was built, e.g. "static".
+	BuildFlags string
+)
+
+// Info describes a binary's build.
+type Info struct {
+	Version    string `json:"version"`
+	GitSHA     string `json:"git_sha,omitempty"`
+	BuildFlags string `json:"build_flags,omitempty"`
+	GoVersion  string `json:"go_version"`
+	Platform   string `json:"platform"`
+}
+
+// Get returns the build information of the running binary.
+func Get() Info {
+	info := Info{
+		Version:    Version,
+		GitSHA:     GitSHA,
+		BuildFlags: BuildFlags,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+		if bi, ok := debug.ReadBuildInfo(); ok && (bi.Main.Version != "") {
+			info.Version = bi.Main.Version
+		}
+	}
+	return info
+}
+
+// String returns a one-line description of the build, e.g.
+// "v1.2.3 (git 0123abc, static, go1.13.8 linux/amd64)".
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.GitSHA != "" {
+		s += "git " + i.GitSHA + ", "
+	}
+	if i.BuildFlags != "" {
+		s += i.BuildFlags + ", "
+	}
+	return s + i.GoVersion + " " + i.Platform + ")"
+}
+
+// JSON returns the build information as a JSON object.
+func (i Info) JSON() []byte {
+	b, err := json.Marshal(i)
+	if err != nil {
+		panic(fmt.Sprintf("buildinfo: %v", err))
+	}
+	return b
+}
@@ -0,0 +1,28 @@
+package buildinfo_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/util/buildinfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfo(t *testing.T) {
+	info := buildinfo.Get()
+	assert.NotEmpty(t, info.Version)
+	assert.True(t, strings.HasPrefix(info.GoVersion, "go"), info.GoVersion)
+
+	info = buildinfo.Info{Version: "v1.2.3", GitSHA: "0123abc", BuildFlags: "static", GoVersion: "go1.13", Platform: "linux/amd64"}
+	assert.Equal(t, "v1.2.3 (git 0123abc, static, go1.13 linux/amd64)", info.String())
+	var got buildinfo.Info
+	require.NoError(t, json.Unmarshal(info.JSON(), &got))
+	assert.Equal(t, info, got)
+	assert.Contains(t, string(info.JSON()), `"git_sha":"0123abc"`)
+
+	info.GitSHA, info.BuildFlags = "", ""
+	assert.Equal(t, "v1.2.3 (go1.13 linux/amd64)", info.String())
+	assert.NotContains(t, string(info.JSON()), "git_sha")
+}
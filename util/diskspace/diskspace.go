@@ -0,0 +1,35 @@
+// Package diskspace reports the free space on local filesystems, for
+// fail-fast checks before writing large outputs.
+package diskspace
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupported is returned by Stat on platforms where free space can't be
+// queried.
+var ErrUnsupported = errors.New("diskspace: not supported on this platform")
+
+// Volume describes the filesystem containing a directory.
+type Volume struct {
+	// Device identifies the filesystem; two directories on the same filesystem
+	// have the same Device.
+	Device uint64
+	// Available is the number of bytes available to unprivileged users.
+	Available int64
+}
+
+// Format renders a byte count in human-readable binary units, e.g. "1.5 GiB".
+func Format(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,8 @@
+// +build !linux,!darwin
+
+package diskspace
+
+// Stat returns ErrUnsupported.
+func Stat(dir string) (Volume, error) {
+	return Volume{}, ErrUnsupported
+}
@@ -0,0 +1,35 @@
+package diskspace_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/grailbio/bio/util/diskspace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskspace")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	v, err := diskspace.Stat(dir)
+	if err == diskspace.ErrUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	assert.True(t, v.Available > 0)
+	parent, err := diskspace.Stat(dir + "/..")
+	require.NoError(t, err)
+	assert.Equal(t, parent.Device, v.Device)
+
+	_, err = diskspace.Stat(dir + "/nonexistent")
+	assert.Error(t, err)
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "12 B", diskspace.Format(12))
+	assert.Equal(t, "1.5 KiB", diskspace.Format(1536))
+	assert.Equal(t, "3.0 GiB", diskspace.Format(3<<30))
+}
@@ -0,0 +1,21 @@
+// +build linux darwin
+
+package diskspace
+
+import "syscall"
+
+// Stat returns the Volume containing dir, which must exist.
+func Stat(dir string) (Volume, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return Volume{}, err
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return Volume{}, err
+	}
+	return Volume{
+		Device:    uint64(st.Dev),
+		Available: int64(fs.Bavail) * int64(fs.Bsize),
+	}, nil
+}
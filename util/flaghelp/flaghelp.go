@@ -0,0 +1,397 @@
+// Package flaghelp generates long-form help text and shell completion scripts
+// from the flag.FlagSets that the bio-* commands already define, so that the
+// two can't drift out of sync with the actual options.  It also provides the
+// commands' -version flag.
+//
+// Flags with a fixed set of valid values (e.g. bio-pileup -format) can be
+// annotated with SetValues/SetListValues; the values are then listed in the
+// help text and offered as completions.
+//
+// A typical flag-package command does
+//
+//	cmd := &flaghelp.Command{Name: "bio-foo", Short: "...", Flags: flag.CommandLine}
+//	flaghelp.SetValues(flag.CommandLine, "format", "tsv", "rio")
+//	flaghelp.Register(cmd)
+//	shutdown := grail.Init() // calls flag.Parse()
+//	flaghelp.Handle(cmd)
+package flaghelp
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/bio/util/buildinfo"
+)
+
+// Command describes a command, or a subcommand of a cmdline-style tool, for
+// help and completion generation.
+type Command struct {
+	// Name is the command name, as typed on the command line.
+	Name string
+	// Short is a one-line description.
+	Short string
+	// ArgsName describes the positional arguments, e.g. "srcpath destpath".
+	ArgsName string
+	// Flags contains the command's flags.  It may be nil.
+	Flags *flag.FlagSet
+	// Children are subcommands.  Completion supports only one level of
+	// subcommands, which covers all commands in this repository.
+	Children []*Command
+}
+
+type valueSpec struct {
+	values []string
+	// list is true if the flag takes a comma-separated list of values.
+	list bool
+}
+
+var (
+	mu     sync.Mutex
+	values = map[*flag.Flag]valueSpec{}
+)
+
+func setValues(fs *flag.FlagSet, name string, vals []string, list bool) {
+	f := fs.Lookup(name)
+	if f == nil {
+		panic(fmt.Sprintf("flaghelp.SetValues: flag -%s not defined", name))
+	}
+	mu.Lock()
+	values[f] = valueSpec{values: append([]string(nil), vals...), list: list}
+	mu.Unlock()
+}
+
+// SetValues records the valid values of flag -name in fs.  It panics if the
+// flag is not defined.
+func SetValues(fs *flag.FlagSet, name string, vals ...string) {
+	setValues(fs, name, vals, false)
+}
+
+// SetListValues is like SetValues, for flags which take a comma-separated list
+// of values (e.g. bio-pileup -cols).
+func SetListValues(fs *flag.FlagSet, name string, vals ...string) {
+	setValues(fs, name, vals, true)
+}
+
+func lookupValues(f *flag.Flag) (valueSpec, bool) {
+	mu.Lock()
+	spec, ok := values[f]
+	mu.Unlock()
+	return spec, ok
+}
+
+// isBoolFlag mirrors the check in the flag package.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// sortedFlags returns the flags in fs in lexicographical order, like
+// flag.FlagSet.VisitAll.
+func sortedFlags(fs *flag.FlagSet) []*flag.Flag {
+	var flags []*flag.Flag
+	if fs != nil {
+		fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	}
+	return flags
+}
+
+// WriteHelp writes long-form help for cmd and its subcommands: every flag with
+// its type, default value, full usage text and, where known, valid values.
+func WriteHelp(w io.Writer, cmd *Command) error {
+	var b strings.Builder
+	writeHelp(&b, cmd, cmd.Name)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHelp(b *strings.Builder, cmd *Command, path string) {
+	b.WriteString(path)
+	if cmd.Short != "" {
+		b.WriteString(" - ")
+		b.WriteString(cmd.Short)
+	}
+	b.WriteString("\n\nUsage:\n  ")
+	b.WriteString(path)
+	if len(sortedFlags(cmd.Flags)) > 0 {
+		b.WriteString(" [flags]")
+	}
+	if len(cmd.Children) > 0 {
+		b.WriteString(" <command>")
+	}
+	if cmd.ArgsName != "" {
+		b.WriteString(" ")
+		b.WriteString(cmd.ArgsName)
+	}
+	b.WriteString("\n")
+	if len(cmd.Children) > 0 {
+		b.WriteString("\nCommands:\n")
+		for _, c := range cmd.Children {
+			fmt.Fprintf(b, "  %-16s %s\n", c.Name, firstLine(c.Short))
+		}
+	}
+	if flags := sortedFlags(cmd.Flags); len(flags) > 0 {
+		b.WriteString("\nFlags:\n")
+		for _, f := range flags {
+			typeName, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(b, "  -%s", f.Name)
+			if typeName != "" {
+				fmt.Fprintf(b, " <%s>", typeName)
+			}
+			if !isBoolFlag(f) || f.DefValue != "false" {
+				fmt.Fprintf(b, " (default %q)", f.DefValue)
+			}
+			b.WriteString("\n")
+			for _, line := range strings.Split(strings.TrimSpace(usage), "\n") {
+				b.WriteString("      ")
+				b.WriteString(strings.TrimSpace(line))
+				b.WriteString("\n")
+			}
+			if spec, ok := lookupValues(f); ok {
+				if spec.list {
+					b.WriteString("      Comma-separated list of: ")
+				} else {
+					b.WriteString("      Valid values: ")
+				}
+				b.WriteString(strings.Join(spec.values, ", "))
+				b.WriteString("\n")
+			}
+		}
+	}
+	for _, c := range cmd.Children {
+		b.WriteString("\n")
+		writeHelp(b, c, path+" "+c.Name)
+	}
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// Shells lists the shells supported by WriteCompletion.
+var Shells = []string{"bash", "fish", "zsh"}
+
+// WriteCompletion writes a completion script for cmd.  shell must be one of
+// Shells.  The bash script is sourced as usual; the zsh script is the bash
+// script run through bashcompinit.
+func WriteCompletion(w io.Writer, shell string, cmd *Command) error {
+	var b strings.Builder
+	switch shell {
+	case "bash":
+		writeBashCompletion(&b, cmd)
+	case "zsh":
+		b.WriteString("autoload -U +X compinit && compinit\n")
+		b.WriteString("autoload -U +X bashcompinit && bashcompinit\n")
+		writeBashCompletion(&b, cmd)
+	case "fish":
+		writeFishCompletion(&b, cmd)
+	default:
+		return fmt.Errorf("flaghelp.WriteCompletion: unsupported shell %q (supported: %s)", shell, strings.Join(Shells, ", "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func bashFuncName(name string) string {
+	return "_" + strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// writeBashFlagCases writes the code completing cmd's flags and flag values,
+// falling back to its subcommand names (if any).  It is indented for
+// placement inside a case arm.
+func writeBashFlagCases(b *strings.Builder, cmd *Command, indent string) {
+	flags := sortedFlags(cmd.Flags)
+	var names []string
+	var valueCases []string
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+		spec, ok := lookupValues(f)
+		if !ok {
+			continue
+		}
+		vals := strings.Join(spec.values, " ")
+		if spec.list {
+			valueCases = append(valueCases, fmt.Sprintf(`-%[1]s|--%[1]s) __flaghelp_list "%[2]s"; return ;;`, f.Name, vals))
+		} else {
+			valueCases = append(valueCases, fmt.Sprintf(`-%[1]s|--%[1]s) COMPREPLY=($(compgen -W "%[2]s" -- "$cur")); return ;;`, f.Name, vals))
+		}
+	}
+	if len(valueCases) > 0 {
+		fmt.Fprintf(b, "%scase \"$prev\" in\n", indent)
+		for _, c := range valueCases {
+			fmt.Fprintf(b, "%s  %s\n", indent, c)
+		}
+		fmt.Fprintf(b, "%sesac\n", indent)
+	}
+	fmt.Fprintf(b, "%sif [[ \"$cur\" == -* ]]; then\n", indent)
+	fmt.Fprintf(b, "%s  COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", indent, strings.Join(names, " "))
+	fmt.Fprintf(b, "%s  return\n", indent)
+	fmt.Fprintf(b, "%sfi\n", indent)
+	if len(cmd.Children) > 0 {
+		var sub []string
+		for _, c := range cmd.Children {
+			sub = append(sub, c.Name)
+		}
+		fmt.Fprintf(b, "%sCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", indent, strings.Join(sub, " "))
+	}
+}
+
+func writeBashCompletion(b *strings.Builder, cmd *Command) {
+	fn := bashFuncName(cmd.Name)
+	fmt.Fprintf(b, "# bash completion for %s; generated by flaghelp.\n", cmd.Name)
+	b.WriteString(`__flaghelp_list() {
+  local prefix=""
+  if [[ "$cur" == *,* ]]; then
+    prefix="${cur%,*},"
+  fi
+  COMPREPLY=($(compgen -P "$prefix" -W "$1" -- "${cur##*,}"))
+  compopt -o nospace 2>/dev/null
+}
+`)
+	fmt.Fprintf(b, "%s() {\n", fn)
+	b.WriteString("  local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" sub=\"\" i\n")
+	if len(cmd.Children) > 0 {
+		var names []string
+		for _, c := range cmd.Children {
+			names = append(names, c.Name)
+		}
+		b.WriteString("  for ((i = 1; i < COMP_CWORD; i++)); do\n")
+		b.WriteString("    case \"${COMP_WORDS[i]}\" in\n")
+		fmt.Fprintf(b, "      %s) sub=\"${COMP_WORDS[i]}\"; break ;;\n", strings.Join(names, "|"))
+		b.WriteString("    esac\n")
+		b.WriteString("  done\n")
+	}
+	b.WriteString("  case \"$sub\" in\n")
+	for _, c := range cmd.Children {
+		fmt.Fprintf(b, "    %s)\n", c.Name)
+		writeBashFlagCases(b, c, "      ")
+		b.WriteString("      ;;\n")
+	}
+	b.WriteString("    *)\n")
+	writeBashFlagCases(b, cmd, "      ")
+	b.WriteString("      ;;\n")
+	b.WriteString("  esac\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(b, "complete -o default -F %s %s\n", fn, cmd.Name)
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func writeFishFlags(b *strings.Builder, cmd *Command, root, cond string) {
+	for _, f := range sortedFlags(cmd.Flags) {
+		_, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(b, "complete -c %s%s -o %s -d %s", root, cond, f.Name, fishQuote(firstLine(usage)))
+		if !isBoolFlag(f) {
+			if spec, ok := lookupValues(f); ok && !spec.list {
+				fmt.Fprintf(b, " -x -a %s", fishQuote(strings.Join(spec.values, " ")))
+			} else if ok {
+				// fish can't complete individual list elements; offer each value
+				// as a starting point.
+				fmt.Fprintf(b, " -r -a %s", fishQuote(strings.Join(spec.values, " ")))
+			} else {
+				b.WriteString(" -r")
+			}
+		}
+		b.WriteString("\n")
+	}
+}
+
+func writeFishCompletion(b *strings.Builder, cmd *Command) {
+	fmt.Fprintf(b, "# fish completion for %s; generated by flaghelp.\n", cmd.Name)
+	if len(cmd.Children) == 0 {
+		writeFishFlags(b, cmd, cmd.Name, "")
+		return
+	}
+	var names []string
+	for _, c := range cmd.Children {
+		names = append(names, c.Name)
+	}
+	writeFishFlags(b, cmd, cmd.Name, " -n '__fish_use_subcommand'")
+	for _, c := range cmd.Children {
+		fmt.Fprintf(b, "complete -c %s -n '__fish_use_subcommand' -f -a %s -d %s\n", cmd.Name, c.Name, fishQuote(firstLine(c.Short)))
+	}
+	for _, c := range cmd.Children {
+		writeFishFlags(b, c, cmd.Name, fmt.Sprintf(" -n '__fish_seen_subcommand_from %s'", c.Name))
+	}
+}
+
+type handlerFlags struct {
+	completion string
+	helpLong   bool
+	version    bool
+	json       bool
+}
+
+var (
+	handlerMu sync.Mutex
+	handlers  = map[*Command]*handlerFlags{}
+)
+
+// Register defines -completion=<shell>, -help-long, and -version [-json]
+// flags on cmd.Flags.  After the flags are parsed, call Handle to act on
+// them.
+func Register(cmd *Command) {
+	h := &handlerFlags{}
+	cmd.Flags.StringVar(&h.completion, "completion", "", "Print a shell completion script and exit")
+	cmd.Flags.BoolVar(&h.helpLong, "help-long", false, "Print long-form help, including valid flag values, and exit")
+	cmd.Flags.BoolVar(&h.version, "version", false, "Print the version, git commit, and build flags of the binary, and exit")
+	cmd.Flags.BoolVar(&h.json, "json", false, "With -version, print the build information as a JSON object")
+	SetValues(cmd.Flags, "completion", Shells...)
+	handlerMu.Lock()
+	handlers[cmd] = h
+	handlerMu.Unlock()
+}
+
+// Handle writes the completion script, long-form help, or build information
+// to stdout and exits the process if -completion, -help-long, or -version was
+// passed to a command set up with Register.  Otherwise it does nothing.
+func Handle(cmd *Command) {
+	handlerMu.Lock()
+	h := handlers[cmd]
+	handlerMu.Unlock()
+	if h == nil {
+		return
+	}
+	var err error
+	switch {
+	case h.completion != "":
+		err = WriteCompletion(os.Stdout, h.completion, cmd)
+	case h.helpLong:
+		err = WriteHelp(os.Stdout, cmd)
+	case h.version:
+		err = writeVersion(os.Stdout, cmd, h.json)
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// writeVersion writes the build information of the binary, as JSON if
+// asJSON is set.
+func writeVersion(w io.Writer, cmd *Command, asJSON bool) error {
+	info := buildinfo.Get()
+	if asJSON {
+		_, err := fmt.Fprintf(w, "%s\n", info.JSON())
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", cmd.Name, info)
+	return err
+}
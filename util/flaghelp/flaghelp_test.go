@@ -0,0 +1,86 @@
+package flaghelp_test
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/util/flaghelp"
+)
+
+func newCommand() *flaghelp.Command {
+	fs := flag.NewFlagSet("bio-foo", flag.ContinueOnError)
+	fs.String("format", "tsv", "Output `format`")
+	fs.String("cols", "", "Output column sets")
+	fs.Bool("stitch", false, "Stitch read-pairs")
+	flaghelp.SetValues(fs, "format", "tsv", "rio")
+	flaghelp.SetListValues(fs, "cols", "dpref", "quals")
+
+	sub := flag.NewFlagSet("convert", flag.ContinueOnError)
+	sub.Int("parallelism", 4, "Number of threads\nUse 0 for all CPUs")
+	return &flaghelp.Command{
+		Name:     "bio-foo",
+		Short:    "Do foo",
+		ArgsName: "path",
+		Flags:    fs,
+		Children: []*flaghelp.Command{{Name: "convert", Short: "Convert\nthings", Flags: sub}},
+	}
+}
+
+func TestWriteHelp(t *testing.T) {
+	var b strings.Builder
+	if err := flaghelp.WriteHelp(&b, newCommand()); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, want := range []string{
+		"bio-foo - Do foo\n\nUsage:\n  bio-foo [flags] <command> path\n",
+		"  convert          Convert\n",
+		"  -format <format> (default \"tsv\")\n      Output format\n      Valid values: tsv, rio\n",
+		"      Comma-separated list of: dpref, quals\n",
+		"  -stitch\n      Stitch read-pairs\n",
+		"bio-foo convert - Convert\nthings\n",
+		"  -parallelism <int> (default \"4\")\n      Number of threads\n      Use 0 for all CPUs\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("help does not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+	cmd := newCommand()
+	for _, tt := range []struct {
+		shell string
+		want  []string
+	}{
+		{"bash", []string{
+			"_bio_foo() {",
+			`-format|--format) COMPREPLY=($(compgen -W "tsv rio" -- "$cur")); return ;;`,
+			`-cols|--cols) __flaghelp_list "dpref quals"; return ;;`,
+			`convert) sub="${COMP_WORDS[i]}"; break ;;`,
+			`COMPREPLY=($(compgen -W "-parallelism" -- "$cur"))`,
+			"complete -o default -F _bio_foo bio-foo\n",
+		}},
+		{"zsh", []string{"bashcompinit", "complete -o default -F _bio_foo bio-foo\n"}},
+		{"fish", []string{
+			"complete -c bio-foo -n '__fish_use_subcommand' -o format -d 'Output format' -x -a 'tsv rio'\n",
+			"complete -c bio-foo -n '__fish_use_subcommand' -o stitch -d 'Stitch read-pairs'\n",
+			"complete -c bio-foo -n '__fish_use_subcommand' -f -a convert -d 'Convert'\n",
+			"complete -c bio-foo -n '__fish_seen_subcommand_from convert' -o parallelism -d 'Number of threads' -r\n",
+		}},
+	} {
+		var b strings.Builder
+		if err := flaghelp.WriteCompletion(&b, tt.shell, cmd); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(b.String(), want) {
+				t.Errorf("%s completion does not contain %q:\n%s", tt.shell, want, b.String())
+			}
+		}
+	}
+	if err := flaghelp.WriteCompletion(&strings.Builder{}, "tcsh", cmd); err == nil {
+		t.Error("expected error for unsupported shell")
+	}
+}
@@ -0,0 +1,167 @@
+// Package iothrottle limits the bandwidth and the rate of read operations of a
+// group of readers, e.g. all the input readers of a pileup run, so that large
+// jobs on shared storage (NFS, S3) leave room for interactive users.  It also
+// measures the group's current throughput, for progress reports.
+package iothrottle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// maxBurst is how far an idle Throttle lets its readers get ahead of the
+// limits.
+const maxBurst = 100 * time.Millisecond
+
+// meterWindow is the number of seconds over which Stats.BytesPerSec is
+// averaged.
+const meterWindow = 10
+
+// Throttle is shared by the readers it limits.  A nil *Throttle doesn't limit
+// or measure anything.  It is thread safe.
+type Throttle struct {
+	bytesPerSec float64 // 0: unlimited
+	opsPerSec   float64 // 0: unlimited
+	now         func() time.Time
+	sleep       func(time.Duration)
+
+	mu sync.Mutex
+	// nextByte and nextOp are the times at which the limits allow the next
+	// byte and operation; they run ahead of the clock while the readers are
+	// throttled.
+	nextByte, nextOp time.Time
+	bytes, ops       int64
+	// meterSecs[i] is the Unix second whose byte count is in meterBytes[i].
+	meterSecs  [meterWindow]int64
+	meterBytes [meterWindow]int64
+}
+
+// New returns a Throttle which limits its readers to bytesPerSec bytes and
+// opsPerSec read operations (Read and Seek calls) per second, in total.  A
+// non-positive limit is unlimited.
+func New(bytesPerSec int64, opsPerSec int) *Throttle {
+	t := &Throttle{now: time.Now, sleep: time.Sleep}
+	if bytesPerSec > 0 {
+		t.bytesPerSec = float64(bytesPerSec)
+	}
+	if opsPerSec > 0 {
+		t.opsPerSec = float64(opsPerSec)
+	}
+	return t
+}
+
+// Stats is a snapshot of the activity of a Throttle's readers.
+type Stats struct {
+	// Bytes and Ops are the total number of bytes read, and of read
+	// operations, since the Throttle was created.
+	Bytes int64
+	Ops   int64
+	// BytesPerSec is the throughput over the last few seconds.
+	BytesPerSec float64
+	// MaxBytesPerSec and MaxOpsPerSec are the limits; 0 is unlimited.
+	MaxBytesPerSec int64
+	MaxOpsPerSec   int
+}
+
+// Stats returns the current Stats.
+func (t *Throttle) Stats() Stats {
+	if t == nil {
+		return Stats{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Stats{
+		Bytes:          t.bytes,
+		Ops:            t.ops,
+		MaxBytesPerSec: int64(t.bytesPerSec),
+		MaxOpsPerSec:   int(t.opsPerSec),
+	}
+	// Average over the last meterWindow complete seconds.
+	now := t.now().Unix()
+	var sum int64
+	for i, sec := range t.meterSecs {
+		if (sec < now) && (sec >= now-meterWindow) {
+			sum += t.meterBytes[i]
+		}
+	}
+	s.BytesPerSec = float64(sum) / meterWindow
+	return s
+}
+
+// reserve charges cost to the limit whose next available time is *next, and
+// returns how long the caller must wait for it.
+func reserve(next *time.Time, now time.Time, cost time.Duration) time.Duration {
+	if earliest := now.Add(-maxBurst); next.Before(earliest) {
+		*next = earliest
+	}
+	*next = next.Add(cost)
+	return next.Sub(now)
+}
+
+// wait blocks until the limits allow an operation, and the n bytes it read.
+// It must be called after the operation, since the size of a read isn't known
+// in advance; a reader gets ahead of the bandwidth limit by at most one read.
+func (t *Throttle) wait(n int) {
+	t.mu.Lock()
+	now := t.now()
+	t.bytes += int64(n)
+	t.ops++
+	sec := now.Unix()
+	i := sec % meterWindow
+	if t.meterSecs[i] != sec {
+		t.meterSecs[i] = sec
+		t.meterBytes[i] = 0
+	}
+	t.meterBytes[i] += int64(n)
+	var delay time.Duration
+	if t.opsPerSec > 0 {
+		delay = reserve(&t.nextOp, now, time.Duration(float64(time.Second)/t.opsPerSec))
+	}
+	if t.bytesPerSec > 0 {
+		if d := reserve(&t.nextByte, now, time.Duration(float64(n)*float64(time.Second)/t.bytesPerSec)); d > delay {
+			delay = d
+		}
+	}
+	t.mu.Unlock()
+	if delay > 0 {
+		t.sleep(delay)
+	}
+}
+
+// Reader returns a reader which reads from r, within the limits of t.  If r
+// is an io.ReadSeeker, so is the result.  If t is nil, it returns r.
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	if s, ok := r.(io.ReadSeeker); ok {
+		return &readSeeker{reader{r: r, t: t}, s}
+	}
+	return &reader{r: r, t: t}
+}
+
+type reader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.wait(n)
+	return n, err
+}
+
+type readSeeker struct {
+	reader
+	s io.Seeker
+}
+
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.s.Seek(offset, whence)
+	if (offset != 0) || (whence != io.SeekCurrent) {
+		// Seek(0, io.SeekCurrent) only asks for the position.
+		r.t.wait(0)
+	}
+	return pos, err
+}
@@ -0,0 +1,93 @@
+package iothrottle
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock which only advances when slept on.
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+	c.slept += d
+}
+
+func newFakeThrottle(bytesPerSec int64, opsPerSec int) (*Throttle, *fakeClock) {
+	c := &fakeClock{t: time.Unix(1000, 0)}
+	t := New(bytesPerSec, opsPerSec)
+	t.now = c.now
+	t.sleep = c.sleep
+	return t, c
+}
+
+func TestNil(t *testing.T) {
+	var th *Throttle
+	r := strings.NewReader("abc")
+	assert.True(t, th.Reader(r) == io.Reader(r))
+	assert.Equal(t, Stats{}, th.Stats())
+}
+
+func TestBandwidth(t *testing.T) {
+	th, c := newFakeThrottle(1000, 0)
+	r := th.Reader(bytes.NewReader(make([]byte, 10000)))
+	buf := make([]byte, 100)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		}
+	}
+	// 10 seconds, minus the initial burst.
+	assert.Equal(t, 10*time.Second-maxBurst, c.slept)
+	s := th.Stats()
+	assert.Equal(t, int64(10000), s.Bytes)
+	assert.Equal(t, int64(1000), s.MaxBytesPerSec)
+	assert.InDelta(t, 1000, s.BytesPerSec, 150)
+}
+
+func TestOps(t *testing.T) {
+	th, c := newFakeThrottle(0, 10)
+	r := th.Reader(strings.NewReader(strings.Repeat("x", 100)))
+	rs, ok := r.(io.ReadSeeker)
+	require.True(t, ok)
+	for i := 0; i < 10; i++ {
+		_, err := rs.Read(make([]byte, 1))
+		require.NoError(t, err)
+		_, err = rs.Seek(0, io.SeekCurrent)
+		require.NoError(t, err)
+	}
+	_, err := rs.Seek(50, io.SeekStart)
+	require.NoError(t, err)
+	// 11 operations at 10/s; asking for the position doesn't count.
+	assert.Equal(t, 1100*time.Millisecond-maxBurst, c.slept)
+	assert.Equal(t, int64(11), th.Stats().Ops)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, 50, len(data))
+}
+
+func TestIdle(t *testing.T) {
+	// An idle throttle doesn't save up more than maxBurst.
+	th, c := newFakeThrottle(1000, 0)
+	c.sleep(time.Hour)
+	c.slept = 0
+	r := th.Reader(bytes.NewReader(make([]byte, 2000)))
+	_, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, c.slept >= 2*time.Second-maxBurst, "slept %v", c.slept)
+	// The throughput is averaged over the last meterWindow seconds.
+	c.sleep(time.Hour)
+	assert.Equal(t, 0.0, th.Stats().BytesPerSec)
+}
@@ -0,0 +1,237 @@
+// Package progress reports the progress of long pipeline runs, e.g. the
+// pileup main loop or a BAM/PAM conversion, so that long cluster runs are
+// observable: the throughput of each shard and of the whole run, an estimate
+// of the remaining time, and the memory high-water mark.  The reports are
+// Events, passed to pluggable Sinks which log them, write them as JSON lines,
+// or serve them to expvar and Prometheus scrapers.
+package progress
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Kind is the kind of an Event.
+type Kind int
+
+const (
+	// KindShard reports a finished shard.  The counts and rates of the event
+	// are those of the shard.
+	KindShard Kind = iota
+	// KindProgress is a periodic report of the whole run.
+	KindProgress
+	// KindDone is the last event of a run.
+	KindDone
+)
+
+var kindNames = [...]string{"shard", "progress", "done"}
+
+func (k Kind) String() string {
+	if (k < 0) || (int(k) >= len(kindNames)) {
+		return "unknown"
+	}
+	return kindNames[k]
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the JSON events have
+// readable kinds.
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Event is a progress report.
+type Event struct {
+	Kind Kind `json:"kind"`
+	// Pipeline names the run, e.g. "pileup" or "bam2pam".
+	Pipeline string    `json:"pipeline"`
+	Time     time.Time `json:"time"`
+	// Elapsed is the time since the start of the run, or for a KindShard
+	// event, the time the shard took.
+	Elapsed time.Duration `json:"elapsed_ns"`
+	// Shard describes the shard of a KindShard event.
+	Shard string `json:"shard,omitempty"`
+	// TasksDone is the number of finished tasks, of Tasks (0 if the number
+	// isn't known in advance).
+	TasksDone int `json:"tasks_done"`
+	Tasks     int `json:"tasks"`
+	// Reads and Positions are the numbers of reads and pileup positions
+	// processed, and ReadsPerSec and PositionsPerSec their average rates
+	// over Elapsed.
+	Reads           int64   `json:"reads"`
+	Positions       int64   `json:"positions"`
+	ReadsPerSec     float64 `json:"reads_per_sec"`
+	PositionsPerSec float64 `json:"positions_per_sec"`
+	// ETA is the estimated remaining time of the run, extrapolated from the
+	// finished tasks, or 0 if it is unknown.
+	ETA time.Duration `json:"eta_ns"`
+	// MemHighWater is the largest heap size (runtime.MemStats.HeapAlloc)
+	// sampled so far, in bytes.  The heap is sampled at each event.
+	MemHighWater uint64 `json:"mem_high_water_bytes"`
+	// Err is the error of the run, for a KindDone event.
+	Err string `json:"error,omitempty"`
+}
+
+// Sink receives the events of a Reporter.  The Reporter serializes its calls
+// to Emit, which should return quickly.  Emit must not retain e.
+type Sink interface {
+	Emit(e *Event)
+}
+
+// Reporter collects the progress of a run, and passes it to its Sinks as
+// Events.  A nil *Reporter does nothing.  It is thread safe.
+type Reporter struct {
+	pipeline string
+	sinks    []Sink
+	now      func() time.Time
+	heapSize func() uint64
+	stopc    chan struct{}
+	donec    chan struct{}
+
+	mu           sync.Mutex
+	start        time.Time
+	tasks        int
+	tasksDone    int
+	reads        int64
+	positions    int64
+	memHighWater uint64
+	stopped      bool
+}
+
+// Start starts reporting the progress of a run of nTask tasks (0 if
+// unknown) to sinks, with a KindProgress event every interval (none if
+// interval is not positive).  It returns nil if there are no sinks.
+func Start(pipeline string, nTask int, interval time.Duration, sinks ...Sink) *Reporter {
+	if len(sinks) == 0 {
+		return nil
+	}
+	r := newReporter(pipeline, nTask, sinks, time.Now, heapSize)
+	if interval > 0 {
+		go func() {
+			defer close(r.donec)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					r.mu.Lock()
+					r.emitLocked(&Event{Kind: KindProgress})
+					r.mu.Unlock()
+				case <-r.stopc:
+					return
+				}
+			}
+		}()
+	} else {
+		close(r.donec)
+	}
+	return r
+}
+
+func newReporter(pipeline string, nTask int, sinks []Sink, now func() time.Time, heapSize func() uint64) *Reporter {
+	return &Reporter{
+		pipeline: pipeline,
+		sinks:    sinks,
+		now:      now,
+		heapSize: heapSize,
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+		start:    now(),
+		tasks:    nTask,
+	}
+}
+
+// heapSize returns the current size of the heap.
+func heapSize() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// ShardDone reports that a shard, described by shard, is done, after
+// processing reads reads and positions pileup positions in elapsed.
+func (r *Reporter) ShardDone(shard string, reads, positions int64, elapsed time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reads += reads
+	r.positions += positions
+	e := Event{
+		Kind:      KindShard,
+		Elapsed:   elapsed,
+		Shard:     shard,
+		Reads:     reads,
+		Positions: positions,
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		e.ReadsPerSec = float64(reads) / secs
+		e.PositionsPerSec = float64(positions) / secs
+	}
+	r.emitLocked(&e)
+}
+
+// TaskDone reports that one of the tasks of the run is done.
+func (r *Reporter) TaskDone() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.tasksDone++
+	r.mu.Unlock()
+}
+
+// Stop stops the periodic events, and emits a KindDone event with err, the
+// error of the run (nil on success).  Later calls do nothing.
+func (r *Reporter) Stop(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.stopped = true
+	r.mu.Unlock()
+	close(r.stopc)
+	<-r.donec
+	e := Event{Kind: KindDone}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	r.mu.Lock()
+	r.emitLocked(&e)
+	r.mu.Unlock()
+}
+
+// emitLocked fills in the run-wide fields of e, and passes it to the sinks.
+// For a KindShard event, the counts and rates are already those of the
+// shard.  r.mu must be held.
+func (r *Reporter) emitLocked(e *Event) {
+	e.Pipeline = r.pipeline
+	e.Time = r.now()
+	elapsed := e.Time.Sub(r.start)
+	if e.Kind != KindShard {
+		e.Elapsed = elapsed
+		e.Reads = r.reads
+		e.Positions = r.positions
+		if secs := elapsed.Seconds(); secs > 0 {
+			e.ReadsPerSec = float64(r.reads) / secs
+			e.PositionsPerSec = float64(r.positions) / secs
+		}
+	}
+	e.TasksDone = r.tasksDone
+	e.Tasks = r.tasks
+	if (r.tasksDone > 0) && (r.tasksDone < r.tasks) && (e.Kind != KindDone) {
+		e.ETA = time.Duration(float64(elapsed) * float64(r.tasks-r.tasksDone) / float64(r.tasksDone))
+	}
+	if heap := r.heapSize(); heap > r.memHighWater {
+		r.memHighWater = heap
+	}
+	e.MemHighWater = r.memHighWater
+	for _, s := range r.sinks {
+		s.Emit(e)
+	}
+}
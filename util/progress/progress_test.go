@@ -0,0 +1,163 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink records the events it is shown.
+type recordingSink struct {
+	events []Event
+}
+
+func (s *recordingSink) Emit(e *Event) {
+	s.events = append(s.events, *e)
+}
+
+// newTestReporter returns a Reporter with a fake clock, which advance moves
+// forward, and a heap whose size is *heap.
+func newTestReporter(nTask int, sinks ...Sink) (r *Reporter, advance func(time.Duration), heap *uint64) {
+	now := time.Unix(1000, 0)
+	heap = new(uint64)
+	r = newReporter("test", nTask, sinks, func() time.Time { return now }, func() uint64 { return *heap })
+	close(r.donec)
+	return r, func(d time.Duration) { now = now.Add(d) }, heap
+}
+
+func TestNil(t *testing.T) {
+	r := Start("test", 3, time.Second)
+	assert.True(t, r == nil)
+	r.ShardDone("shard", 10, 10, time.Second)
+	r.TaskDone()
+	r.Stop(nil)
+}
+
+func TestReporter(t *testing.T) {
+	var sink recordingSink
+	r, advance, heap := newTestReporter(4, &sink)
+	*heap = 100
+	advance(10 * time.Second)
+	r.ShardDone("chr1:0-1000", 200, 1000, 4*time.Second)
+	r.TaskDone()
+	*heap = 50
+	advance(10 * time.Second)
+	r.mu.Lock()
+	r.emitLocked(&Event{Kind: KindProgress})
+	r.mu.Unlock()
+	r.Stop(errors.New("failed"))
+	r.Stop(nil)
+
+	require.Equal(t, 3, len(sink.events))
+	e := sink.events[0]
+	assert.Equal(t, KindShard, e.Kind)
+	assert.Equal(t, "test", e.Pipeline)
+	assert.Equal(t, "chr1:0-1000", e.Shard)
+	assert.Equal(t, 4*time.Second, e.Elapsed)
+	assert.Equal(t, 50.0, e.ReadsPerSec)
+	assert.Equal(t, 250.0, e.PositionsPerSec)
+	assert.Equal(t, uint64(100), e.MemHighWater)
+
+	e = sink.events[1]
+	assert.Equal(t, KindProgress, e.Kind)
+	assert.Equal(t, 20*time.Second, e.Elapsed)
+	assert.Equal(t, int64(200), e.Reads)
+	assert.Equal(t, 10.0, e.ReadsPerSec)
+	assert.Equal(t, 1, e.TasksDone)
+	assert.Equal(t, 4, e.Tasks)
+	// 1 of 4 tasks took 20s.
+	assert.Equal(t, 60*time.Second, e.ETA)
+	assert.Equal(t, uint64(100), e.MemHighWater)
+
+	e = sink.events[2]
+	assert.Equal(t, KindDone, e.Kind)
+	assert.Equal(t, "failed", e.Err)
+	assert.Equal(t, time.Duration(0), e.ETA)
+}
+
+func TestFormatEvent(t *testing.T) {
+	assert.Equal(t, "shard chr1:0-1000 done in 4s: 200 reads (50.0/s), 1000 positions (250.0/s)",
+		FormatEvent(&Event{Kind: KindShard, Shard: "chr1:0-1000", Elapsed: 4 * time.Second, Reads: 200, ReadsPerSec: 50, Positions: 1000, PositionsPerSec: 250}))
+	assert.Equal(t, "running for 20s: 200 reads (10.0/s), 0 positions (0.0/s), 1 of 4 tasks finished, ETA 1m0s, memory high-water mark 1.5 GiB",
+		FormatEvent(&Event{Kind: KindProgress, Elapsed: 20 * time.Second, Reads: 200, ReadsPerSec: 10, TasksDone: 1, Tasks: 4, ETA: time.Minute, MemHighWater: 3 << 29}))
+	assert.Equal(t, "done in 1s (error: failed): 0 reads (0.0/s), 0 positions (0.0/s), memory high-water mark 0 B",
+		FormatEvent(&Event{Kind: KindDone, Elapsed: time.Second, Err: "failed"}))
+}
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewJSONSink(&buf)
+	r, advance, _ := newTestReporter(2, s)
+	advance(time.Second)
+	r.ShardDone("chr1:0-1000", 10, 20, time.Second)
+	r.Stop(nil)
+	assert.NoError(t, s.Err())
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Equal(t, 2, len(lines))
+	var e map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, "shard", e["kind"])
+	assert.Equal(t, "chr1:0-1000", e["shard"])
+	assert.Equal(t, 20.0, e["positions_per_sec"])
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equal(t, "done", e["kind"])
+	assert.Equal(t, 10.0, e["reads"])
+}
+
+func TestMetricsSink(t *testing.T) {
+	s := NewMetricsSink()
+	r, advance, _ := newTestReporter(2, s)
+	advance(time.Second)
+	r.ShardDone("chr1:0-1000", 10, 20, time.Second)
+	r.ShardDone("chr1:1000-2000", 5, 20, time.Second)
+	r.TaskDone()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE bio_progress_reads_total counter\n")
+	assert.Contains(t, body, "bio_progress_reads_total{pipeline=\"test\"} 15\n")
+	assert.Contains(t, body, "bio_progress_shards_total{pipeline=\"test\"} 2\n")
+	assert.Contains(t, body, "bio_progress_done{pipeline=\"test\"} 0\n")
+
+	r.Stop(nil)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body = w.Body.String()
+	assert.Contains(t, body, "bio_progress_tasks_done{pipeline=\"test\"} 1\n")
+	assert.Contains(t, body, "bio_progress_positions_per_second{pipeline=\"test\"} 40\n")
+	assert.Contains(t, body, "bio_progress_done{pipeline=\"test\"} 1\n")
+	assert.Contains(t, s.Var().String(), "\"pipeline\":\"test\"")
+}
+
+func TestNewSinks(t *testing.T) {
+	ctx := vcontext.Background()
+	tmpdir, err := ioutil.TempDir("", "progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir) // nolint: errcheck
+	path := tmpdir + "/events.json"
+	sinks, closer, err := NewSinks(ctx, "log,json:"+path)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sinks))
+	r := Start("test", 1, 0, sinks...)
+	r.ShardDone("chr1:0-1000", 10, 20, time.Second)
+	r.Stop(nil)
+	require.NoError(t, closer.Close())
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	_, _, err = NewSinks(ctx, "log,stdout")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid sink \"stdout\"")
+}
@@ -0,0 +1,259 @@
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/util/diskspace"
+)
+
+// LogSink logs the events as text lines.
+type LogSink struct{}
+
+// Emit implements Sink.
+func (LogSink) Emit(e *Event) {
+	log.Printf("%s: %s", e.Pipeline, FormatEvent(e))
+}
+
+// FormatEvent describes e in one line, e.g. "shard chr1:0-1000000 done in
+// 12s: 1200000 reads (100000.0/s), 1000000 positions (83333.3/s)".
+func FormatEvent(e *Event) string {
+	var b strings.Builder
+	switch e.Kind {
+	case KindShard:
+		fmt.Fprintf(&b, "shard %s done in %v", e.Shard, e.Elapsed.Round(time.Millisecond))
+	case KindDone:
+		fmt.Fprintf(&b, "done in %v", e.Elapsed.Round(time.Second))
+		if e.Err != "" {
+			fmt.Fprintf(&b, " (error: %s)", e.Err)
+		}
+	default:
+		fmt.Fprintf(&b, "running for %v", e.Elapsed.Round(time.Second))
+	}
+	fmt.Fprintf(&b, ": %d reads (%.1f/s), %d positions (%.1f/s)", e.Reads, e.ReadsPerSec, e.Positions, e.PositionsPerSec)
+	if e.Kind == KindShard {
+		return b.String()
+	}
+	if e.Tasks > 0 {
+		fmt.Fprintf(&b, ", %d of %d tasks finished", e.TasksDone, e.Tasks)
+	}
+	if e.ETA > 0 {
+		fmt.Fprintf(&b, ", ETA %v", e.ETA.Round(time.Second))
+	}
+	fmt.Fprintf(&b, ", memory high-water mark %s", diskspace.Format(int64(e.MemHighWater)))
+	return b.String()
+}
+
+// JSONSink writes each event to a writer as a line of JSON.
+type JSONSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewJSONSink returns a JSONSink which writes to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// Emit implements Sink.
+func (s *JSONSink) Emit(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		_, err = s.w.Write(append(data, '\n'))
+	}
+	s.err = err
+}
+
+// Err returns the first error of the writes, after which the sink drops the
+// events.
+func (s *JSONSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// MetricsSink keeps the latest run-wide event (KindProgress or KindDone) of
+// each pipeline, and the totals of the shard events, for monitoring
+// endpoints: it serves them in the Prometheus text format as an
+// http.Handler, and as an expvar.Var (see Var).
+type MetricsSink struct {
+	mu     sync.Mutex
+	latest map[string]Event
+	shards map[string]int64
+	// order is the pipelines in order of their first event.
+	order []string
+}
+
+// NewMetricsSink returns an empty MetricsSink.
+func NewMetricsSink() *MetricsSink {
+	return &MetricsSink{latest: make(map[string]Event), shards: make(map[string]int64)}
+}
+
+// Emit implements Sink.
+func (s *MetricsSink) Emit(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.latest[e.Pipeline]; !ok {
+		s.order = append(s.order, e.Pipeline)
+	}
+	if e.Kind == KindShard {
+		s.shards[e.Pipeline]++
+		// Keep the run-wide fields current between the periodic events.
+		latest := s.latest[e.Pipeline]
+		latest.Kind = KindProgress
+		latest.Pipeline = e.Pipeline
+		latest.Time = e.Time
+		latest.Reads += e.Reads
+		latest.Positions += e.Positions
+		latest.TasksDone = e.TasksDone
+		latest.Tasks = e.Tasks
+		latest.MemHighWater = e.MemHighWater
+		s.latest[e.Pipeline] = latest
+		return
+	}
+	s.latest[e.Pipeline] = *e
+}
+
+// Var returns an expvar.Var with the latest events, by pipeline, to be
+// published with expvar.Publish.
+func (s *MetricsSink) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		latest := make(map[string]Event, len(s.latest))
+		for p, e := range s.latest {
+			latest[p] = e
+		}
+		return latest
+	})
+}
+
+// ServeHTTP implements http.Handler, with the metrics in the Prometheus text
+// exposition format.
+func (s *MetricsSink) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metric := func(name, typ, help string, value func(e *Event) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, p := range s.order {
+			e := s.latest[p]
+			fmt.Fprintf(w, "%s{pipeline=%q} %g\n", name, p, value(&e))
+		}
+	}
+	metric("bio_progress_reads_total", "counter", "Reads processed.", func(e *Event) float64 { return float64(e.Reads) })
+	metric("bio_progress_positions_total", "counter", "Pileup positions processed.", func(e *Event) float64 { return float64(e.Positions) })
+	metric("bio_progress_shards_total", "counter", "Shards finished.", func(e *Event) float64 { return float64(s.shards[e.Pipeline]) })
+	metric("bio_progress_tasks_done", "gauge", "Tasks finished.", func(e *Event) float64 { return float64(e.TasksDone) })
+	metric("bio_progress_tasks", "gauge", "Tasks of the run (0 if unknown).", func(e *Event) float64 { return float64(e.Tasks) })
+	metric("bio_progress_reads_per_second", "gauge", "Average read throughput of the run.", func(e *Event) float64 { return e.ReadsPerSec })
+	metric("bio_progress_positions_per_second", "gauge", "Average position throughput of the run.", func(e *Event) float64 { return e.PositionsPerSec })
+	metric("bio_progress_eta_seconds", "gauge", "Estimated remaining time of the run (0 if unknown).", func(e *Event) float64 { return e.ETA.Seconds() })
+	metric("bio_progress_memory_high_water_bytes", "gauge", "Largest sampled heap size.", func(e *Event) float64 { return float64(e.MemHighWater) })
+	metric("bio_progress_done", "gauge", "1 once the run is done.", func(e *Event) float64 {
+		if e.Kind == KindDone {
+			return 1
+		}
+		return 0
+	})
+}
+
+// NewSinks returns the sinks of spec, a comma-separated list of:
+//
+//   log          log the events (LogSink)
+//   json:<path>  write the events to a file as JSON lines (JSONSink)
+//   http:<addr>  serve a MetricsSink on <addr> (e.g. ":9090"), in the
+//                Prometheus format at /metrics, and with expvar at
+//                /debug/vars
+//
+// The returned closer closes the files and stops the servers.
+func NewSinks(ctx context.Context, spec string) (sinks []Sink, closer io.Closer, err error) {
+	c := &sinkCloser{ctx: ctx}
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if spec == "" {
+		return nil, c, nil
+	}
+	for _, f := range strings.Split(spec, ",") {
+		switch {
+		case f == "log":
+			sinks = append(sinks, LogSink{})
+		case strings.HasPrefix(f, "json:"):
+			var out file.File
+			if out, err = file.Create(ctx, f[len("json:"):]); err != nil {
+				return nil, nil, err
+			}
+			c.files = append(c.files, out)
+			sinks = append(sinks, NewJSONSink(out.Writer(ctx)))
+		case strings.HasPrefix(f, "http:"):
+			var l net.Listener
+			if l, err = net.Listen("tcp", f[len("http:"):]); err != nil {
+				return nil, nil, err
+			}
+			s := NewMetricsSink()
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", s)
+			mux.Handle("/debug/vars", expvarHandler(s))
+			server := &http.Server{Handler: mux}
+			c.servers = append(c.servers, server)
+			go server.Serve(l) // nolint: errcheck
+			sinks = append(sinks, s)
+		default:
+			return nil, nil, fmt.Errorf("progress: invalid sink %q in %q (must be log, json:<path> or http:<addr>)", f, spec)
+		}
+	}
+	return sinks, c, nil
+}
+
+// expvarHandler serves the published expvars, and the events of s as
+// "progress".  Unlike expvar.Handler, it doesn't publish s globally, so that
+// several runs in one process don't collide.
+func expvarHandler(s *MetricsSink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n%q: %s", "progress", s.Var().String())
+		expvar.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, ",\n%q: %s", kv.Key, kv.Value)
+		})
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
+
+// sinkCloser closes the files and servers of the sinks of NewSinks.
+type sinkCloser struct {
+	ctx     context.Context
+	files   []file.File
+	servers []*http.Server
+}
+
+// Close implements io.Closer.
+func (c *sinkCloser) Close() error {
+	err := errors.Once{}
+	for _, f := range c.files {
+		err.Set(f.Close(c.ctx))
+	}
+	for _, s := range c.servers {
+		err.Set(s.Close())
+	}
+	return err.Err()
+}